@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// Action executes one kind of rule consequence: an HTTP webhook, a NATS
+// publish, a row insert, and so on. Implementations register themselves
+// under a type name; rule_actions rows pick a type and supply its config,
+// so a new action is a row, not a new worker binary.
+type Action interface {
+	// Execute performs the action for one message and returns a short
+	// description of the outcome for the log. Errors are retried via Nak,
+	// except worker.Permanent ones, which terminate the message.
+	Execute(ctx context.Context, m *ActionMessage) (string, error)
+}
+
+// ActionMessage is a message being handled by an action
+type ActionMessage struct {
+	Msg     *nats.Msg
+	Payload *WebhookPayload
+
+	// Event is set when the message arrived as a CloudEvent
+	Event *CloudEvent
+
+	// Config is the rule_actions row named by the message's action field;
+	// nil for plain webhook messages
+	Config *ActionConfig
+
+	// data is the payload's JSON: the message data, or a CloudEvent's
+	data []byte
+
+	num      uint64
+	traceID  string // see messageTraceID
+	start    time.Time
+	dedupKey string
+	window   time.Duration
+	deferred bool
+
+	// deliveryKey is set while an exactly-once claim is held
+	deliveryKey string
+}
+
+// deferAck leaves the message unsettled when Execute returns successfully;
+// the action must call complete later, e.g. once a batch is written.
+func (m *ActionMessage) deferAck() {
+	m.deferred = true
+}
+
+// complete settles the message by the worker's ack policy, updating stats,
+// metrics, and dedup state.
+func (m *ActionMessage) complete(detail string, err error) {
+	// The ledger is settled before the message, whatever the outcome
+	if m.deliveryKey != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), opsWriteTimeout)
+		if err != nil {
+			releaseDelivery(ctx, m)
+		} else {
+			confirmDelivery(ctx, m)
+		}
+		cancel()
+	}
+
+	var down *destinationDownError
+	if errors.As(err, &down) {
+		m.deferDelivery(down)
+		return
+	}
+
+	duration := time.Since(m.start)
+	durationMs := duration.Milliseconds()
+	recordActionResult(m.metricsName(), duration, err, m.traceID)
+	recordRuleAction(m.Payload.Rule, err)
+
+	if err != nil {
+		logMessage(m.traceID, true, "   ❌ [%d %s] %s failed: %v (%dms)", m.num, m.traceID, m.metricsName(), err, durationMs)
+		recordDelivery(m, outcomeFailed, duration)
+		recordFailure(m, err)
+		settleMessage(m.Msg, err, worker.Counts{"failed": 1})
+		return
+	}
+
+	logMessage(m.traceID, false, "   ✅ [%d %s] Success: %s (%dms)", m.num, m.traceID, detail, durationMs)
+	recordDelivery(m, outcomeDelivered, duration)
+	// The delivery happened, so record it even if the message's context
+	// has ended
+	ctx, cancel := context.WithTimeout(context.Background(), opsWriteTimeout)
+	defer cancel()
+	markDelivered(ctx, m.dedupKey, m.Payload.EventKey, m.window)
+	settleMessage(m.Msg, nil, worker.Counts{"succeeded": 1, processingTimeCount: uint64(durationMs)})
+}
+
+// ActionConfig is a configured action (rule_actions row)
+type ActionConfig struct {
+	ID        int
+	Name      string
+	Type      string
+	Config    json.RawMessage
+	TimeoutMs int
+
+	// DedupWindowSeconds overrides the worker-wide dedup window when set
+	DedupWindowSeconds *int
+}
+
+// decode unmarshals the action's JSON config into v
+func (c *ActionConfig) decode(v interface{}) error {
+	if len(c.Config) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(c.Config, v); err != nil {
+		return fmt.Errorf("action %s has invalid config: %w", c.Name, err)
+	}
+	return nil
+}
+
+var actionTypes = map[string]Action{}
+
+// registerAction makes an action type available to rule_actions rows. It is
+// called from init functions and panics on duplicate names.
+func registerAction(name string, action Action) {
+	if _, exists := actionTypes[name]; exists {
+		panic("action type registered twice: " + name)
+	}
+	actionTypes[name] = action
+}
+
+// registeredActionTypes lists the known action types in name order
+func registeredActionTypes() []string {
+	names := make([]string, 0, len(actionTypes))
+	for name := range actionTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveAction returns the action for a message: the configured action
+// named by payload.Action, or the webhook action when none is named.
+func resolveAction(ctx context.Context, payload *WebhookPayload) (Action, *ActionConfig, error) {
+	if payload.Action == "" {
+		return actionTypes["webhook"], nil, nil
+	}
+	cfg, err := getActionConfig(ctx, payload.Action)
+	if err != nil {
+		return nil, nil, err
+	}
+	action, ok := actionTypes[cfg.Type]
+	if !ok {
+		return nil, nil, worker.Permanent(fmt.Errorf("action %s has unknown type %q (this worker supports %s)",
+			cfg.Name, cfg.Type, strings.Join(registeredActionTypes(), ", ")))
+	}
+	return action, cfg, nil
+}
+
+// dedupTarget identifies where a message goes for dedup purposes, along
+// with the window that applies. Plain webhook messages keep the webhook's
+// own identity and window.
+func (m *ActionMessage) dedupTarget(ctx context.Context) (string, time.Duration, error) {
+	if m.Config == nil {
+		dest, webhookURL, err := resolveWebhook(ctx, m.Payload)
+		if err != nil {
+			return "", 0, err
+		}
+		return dedupDestination(dest, webhookURL), dedupWindow(dest), nil
+	}
+
+	seconds := config.Dedup.WindowSeconds
+	if m.Config.DedupWindowSeconds != nil {
+		seconds = *m.Config.DedupWindowSeconds
+	}
+	return "action:" + m.Config.Name, time.Duration(seconds) * time.Second, nil
+}
+
+// metricsName is the name per-action metrics are recorded under
+func (m *ActionMessage) metricsName() string {
+	if m.Config == nil {
+		return "webhook"
+	}
+	return m.Config.Name
+}
+
+// actionCacheTTL bounds how stale a cached action config may be
+const actionCacheTTL = 30 * time.Second
+
+type cachedAction struct {
+	cfg      *ActionConfig
+	loadedAt time.Time
+}
+
+var (
+	actionConfigsMu sync.Mutex
+	actionConfigs   = map[string]cachedAction{}
+)
+
+// getActionConfig returns the enabled action with the given name, reading
+// it from Postgres at most once per actionCacheTTL.
+func getActionConfig(ctx context.Context, name string) (*ActionConfig, error) {
+	actionConfigsMu.Lock()
+	cached, ok := actionConfigs[name]
+	actionConfigsMu.Unlock()
+	if ok && time.Since(cached.loadedAt) < actionCacheTTL {
+		return cached.cfg, nil
+	}
+
+	cfg, err := loadActionConfig(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	actionConfigsMu.Lock()
+	actionConfigs[name] = cachedAction{cfg: cfg, loadedAt: time.Now()}
+	actionConfigsMu.Unlock()
+	return cfg, nil
+}
+
+func loadActionConfig(ctx context.Context, name string) (*ActionConfig, error) {
+	var (
+		cfg         ActionConfig
+		timeoutMs   sql.NullInt64
+		dedupWindow sql.NullInt64
+	)
+
+	err := lookupQueryRow(ctx,
+		`SELECT action_id, action_name, action_type, config, timeout_ms, dedup_window_seconds
+		 FROM rule_actions
+		 WHERE action_name = $1 AND enabled = true`,
+		name,
+	).Scan(&cfg.ID, &cfg.Name, &cfg.Type, &cfg.Config, &timeoutMs, &dedupWindow)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("action %s not found or disabled", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load action %s: %w", name, err)
+	}
+
+	cfg.TimeoutMs = int(timeoutMs.Int64)
+	if dedupWindow.Valid {
+		seconds := int(dedupWindow.Int64)
+		cfg.DedupWindowSeconds = &seconds
+	}
+	return &cfg, nil
+}
+
+// actionCounters are the per-action metrics
+type actionCounters struct {
+	Executed       uint64    `json:"executed"`
+	Succeeded      uint64    `json:"succeeded"`
+	Failed         uint64    `json:"failed"`
+	TotalTimeMs    uint64    `json:"total_time_ms"`
+	LastError      string    `json:"last_error,omitempty"`
+	LastErrorTrace string    `json:"last_error_trace_id,omitempty"`
+	LastExecutedAt time.Time `json:"last_executed_at"`
+
+	// latency counts successful executions per latencyBucketsMs bucket,
+	// for the Prometheus histogram
+	latency [len(latencyBucketsMs) + 1]uint64
+}
+
+var (
+	actionMetricsMu sync.Mutex
+	actionMetrics   = map[string]*actionCounters{}
+)
+
+// recordActionResult updates the metrics of the named action
+func recordActionResult(name string, duration time.Duration, err error, traceID string) {
+	actionMetricsMu.Lock()
+	defer actionMetricsMu.Unlock()
+
+	c, ok := actionMetrics[name]
+	if !ok {
+		c = &actionCounters{}
+		actionMetrics[name] = c
+	}
+	c.Executed++
+	c.LastExecutedAt = time.Now()
+	if err != nil {
+		c.Failed++
+		c.LastError = err.Error()
+		c.LastErrorTrace = traceID
+		return
+	}
+	c.Succeeded++
+	c.TotalTimeMs += uint64(duration.Milliseconds())
+	c.latency[latencyBucket(duration.Milliseconds())]++
+}
+
+// snapshotActionMetrics copies the per-action metrics
+func snapshotActionMetrics() map[string]actionCounters {
+	actionMetricsMu.Lock()
+	defer actionMetricsMu.Unlock()
+
+	snapshot := make(map[string]actionCounters, len(actionMetrics))
+	for name, c := range actionMetrics {
+		snapshot[name] = *c
+	}
+	return snapshot
+}
+
+// reportActionStatistics saves per-action metrics to rule_action_stats. It
+// returns errOpsBuffered if any were buffered for later.
+func reportActionStatistics() error {
+	var result error
+	for name, c := range snapshotActionMetrics() {
+		var avgTime float64
+		if c.Succeeded > 0 {
+			avgTime = float64(c.TotalTimeMs) / float64(c.Succeeded)
+		}
+		var lastError, lastErrorTrace *string
+		if c.LastError != "" {
+			lastError, lastErrorTrace = &c.LastError, &c.LastErrorTrace
+		}
+
+		err := opsWrite("action_stats:"+name,
+			`INSERT INTO rule_action_stats
+			 (action_name, stream_name, consumer_name, executed, succeeded, failed, avg_time_ms, last_error, last_error_trace_id,
+			  last_executed_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, CURRENT_TIMESTAMP)
+			 ON CONFLICT (action_name, stream_name, consumer_name) DO UPDATE SET
+			     executed = EXCLUDED.executed,
+			     succeeded = EXCLUDED.succeeded,
+			     failed = EXCLUDED.failed,
+			     avg_time_ms = EXCLUDED.avg_time_ms,
+			     last_error = COALESCE(EXCLUDED.last_error, rule_action_stats.last_error),
+			     last_error_trace_id = CASE WHEN EXCLUDED.last_error IS NULL THEN rule_action_stats.last_error_trace_id
+			                                ELSE EXCLUDED.last_error_trace_id END,
+			     last_executed_at = EXCLUDED.last_executed_at,
+			     updated_at = EXCLUDED.updated_at`,
+			name,
+			config.Worker.StreamName,
+			config.Worker.ConsumerName,
+			c.Executed,
+			c.Succeeded,
+			c.Failed,
+			avgTime,
+			lastError,
+			lastErrorTrace,
+			c.LastExecutedAt,
+		)
+		if errors.Is(err, errOpsBuffered) {
+			result = err
+		} else if err != nil {
+			return fmt.Errorf("action %s: %w", name, err)
+		}
+	}
+	return result
+}
+
+func init() {
+	expvar.Publish("actions", expvar.Func(func() interface{} {
+		return snapshotActionMetrics()
+	}))
+
+	expvar.Publish("action_types", expvar.Func(func() interface{} {
+		return registeredActionTypes()
+	}))
+}
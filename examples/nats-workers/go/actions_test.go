@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// mockDB points the worker's primary pool at a sqlmock for one test and
+// checks that every expectation was met
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	mockPool, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.MatchExpectationsInOrder(false)
+
+	prev := db
+	db = mockPool
+	t.Cleanup(func() {
+		db = prev
+		mockPool.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return mock
+}
+
+// resetActionConfigs empties the action config cache for one test
+func resetActionConfigs(t *testing.T) {
+	t.Helper()
+	actionConfigsMu.Lock()
+	actionConfigs = map[string]cachedAction{}
+	actionConfigsMu.Unlock()
+	t.Cleanup(func() {
+		actionConfigsMu.Lock()
+		actionConfigs = map[string]cachedAction{}
+		actionConfigsMu.Unlock()
+	})
+}
+
+var actionColumns = []string{"action_id", "action_name", "action_type", "config", "timeout_ms", "dedup_window_seconds"}
+
+func TestRegisteredActionTypes(t *testing.T) {
+	types := registeredActionTypes()
+	if !sort.StringsAreSorted(types) {
+		t.Fatalf("types not sorted: %v", types)
+	}
+	for _, want := range []string{"webhook", "nats_publish", "insert_row", "function"} {
+		found := false
+		for _, name := range types {
+			found = found || name == want
+		}
+		if !found {
+			t.Errorf("%s not registered (have %v)", want, types)
+		}
+	}
+}
+
+func TestRegisterActionTwicePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering webhook twice did not panic")
+		}
+	}()
+	registerAction("webhook", natsPublishAction{})
+}
+
+func TestActionConfigDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    natsPublishConfig
+		wantErr string
+	}{
+		{name: "empty", want: natsPublishConfig{}},
+		{name: "fields", config: `{"subject":"a.b","jetstream":true,"headers":{"X":"1"}}`,
+			want: natsPublishConfig{Subject: "a.b", JetStream: true, Headers: map[string]string{"X": "1"}}},
+		{name: "invalid json", config: `{"subject":`, wantErr: "action alerts has invalid config"},
+		{name: "wrong type", config: `{"subject":5}`, wantErr: "action alerts has invalid config"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ActionConfig{Name: "alerts", Config: json.RawMessage(tt.config)}
+			var got natsPublishConfig
+			err := cfg.decode(&got)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("config = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveAction(t *testing.T) {
+	tests := []struct {
+		name          string
+		action        string
+		row           []interface{} // nil: no enabled row
+		queryErr      error
+		wantType      string
+		wantErr       string
+		wantPermanent bool
+	}{
+		{name: "no action is a webhook", wantType: "webhook"},
+		{name: "configured action", action: "alerts",
+			row: []interface{}{1, "alerts", "nats_publish", []byte(`{"subject":"a"}`), nil, nil}, wantType: "nats_publish"},
+		{name: "unknown type", action: "mystery",
+			row:     []interface{}{2, "mystery", "carrier_pigeon", []byte(`{}`), nil, nil},
+			wantErr: `unknown type "carrier_pigeon"`, wantPermanent: true},
+		{name: "missing or disabled", action: "gone", wantErr: "action gone not found or disabled"},
+		{name: "query error", action: "broken", queryErr: errors.New("boom"), wantErr: "failed to load action broken: boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetActionConfigs(t)
+			mock := mockDB(t)
+			if tt.action != "" {
+				q := mock.ExpectQuery("FROM rule_actions").WithArgs(tt.action)
+				switch {
+				case tt.queryErr != nil:
+					q.WillReturnError(tt.queryErr)
+				case tt.row != nil:
+					values := make([]driver.Value, len(tt.row))
+					for i, v := range tt.row {
+						values[i] = v
+					}
+					q.WillReturnRows(sqlmock.NewRows(actionColumns).AddRow(values...))
+				default:
+					q.WillReturnError(sql.ErrNoRows)
+				}
+			}
+
+			action, cfg, err := resolveAction(context.Background(), &WebhookPayload{Action: tt.action})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if worker.IsPermanent(err) != tt.wantPermanent {
+					t.Fatalf("permanent = %v, want %v", worker.IsPermanent(err), tt.wantPermanent)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if action != actionTypes[tt.wantType] {
+				t.Fatalf("action = %T, want %s", action, tt.wantType)
+			}
+			if (cfg == nil) != (tt.action == "") {
+				t.Fatalf("config = %+v for action %q", cfg, tt.action)
+			}
+		})
+	}
+}
+
+func TestGetActionConfigCaches(t *testing.T) {
+	resetActionConfigs(t)
+	mock := mockDB(t)
+	mock.ExpectQuery("FROM rule_actions").WithArgs("alerts").
+		WillReturnRows(sqlmock.NewRows(actionColumns).AddRow(3, "alerts", "nats_publish", []byte(`{}`), 2500, 60))
+
+	for i := 0; i < 3; i++ {
+		cfg, err := getActionConfig(context.Background(), "alerts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.ID != 3 || cfg.TimeoutMs != 2500 || cfg.DedupWindowSeconds == nil || *cfg.DedupWindowSeconds != 60 {
+			t.Fatalf("config = %+v", cfg)
+		}
+	}
+
+	// An expired entry is read again
+	actionConfigsMu.Lock()
+	entry := actionConfigs["alerts"]
+	entry.loadedAt = time.Now().Add(-actionCacheTTL)
+	actionConfigs["alerts"] = entry
+	actionConfigsMu.Unlock()
+
+	mock.ExpectQuery("FROM rule_actions").WithArgs("alerts").
+		WillReturnRows(sqlmock.NewRows(actionColumns).AddRow(3, "alerts", "nats_publish", []byte(`{}`), nil, nil))
+	cfg, err := getActionConfig(context.Background(), "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TimeoutMs != 0 || cfg.DedupWindowSeconds != nil {
+		t.Fatalf("reloaded config = %+v", cfg)
+	}
+}
+
+func TestActionDedupTarget(t *testing.T) {
+	defer func(seconds int) { config.Dedup.WindowSeconds = seconds }(config.Dedup.WindowSeconds)
+	config.Dedup.WindowSeconds = 300
+	ten := 10
+
+	tests := []struct {
+		name       string
+		cfg        *ActionConfig
+		wantDest   string
+		wantWindow time.Duration
+	}{
+		{name: "worker window", cfg: &ActionConfig{Name: "alerts"},
+			wantDest: "action:alerts", wantWindow: 5 * time.Minute},
+		{name: "action override", cfg: &ActionConfig{Name: "alerts", DedupWindowSeconds: &ten},
+			wantDest: "action:alerts", wantWindow: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ActionMessage{Payload: &WebhookPayload{}, Config: tt.cfg}
+			dest, window, err := m.dedupTarget(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dest != tt.wantDest || window != tt.wantWindow {
+				t.Fatalf("target = %s %v, want %s %v", dest, window, tt.wantDest, tt.wantWindow)
+			}
+			if got := m.metricsName(); got != tt.cfg.Name {
+				t.Fatalf("metrics name = %s, want %s", got, tt.cfg.Name)
+			}
+		})
+	}
+
+	if got := (&ActionMessage{}).metricsName(); got != "webhook" {
+		t.Fatalf("plain webhook metrics name = %s", got)
+	}
+}
+
+func TestRecordActionResult(t *testing.T) {
+	const name = "test-record-action"
+	defer func() {
+		actionMetricsMu.Lock()
+		delete(actionMetrics, name)
+		actionMetricsMu.Unlock()
+	}()
+
+	recordActionResult(name, 20*time.Millisecond, nil, "t1")
+	recordActionResult(name, 3*time.Second, nil, "t2")
+	recordActionResult(name, time.Second, errors.New("refused"), "t3")
+
+	c := snapshotActionMetrics()[name]
+	if c.Executed != 3 || c.Succeeded != 2 || c.Failed != 1 {
+		t.Fatalf("counts = %d/%d/%d, want 3/2/1", c.Executed, c.Succeeded, c.Failed)
+	}
+	// Failures count towards neither the time nor the latency histogram
+	if c.TotalTimeMs != 3020 {
+		t.Fatalf("total time = %d, want 3020", c.TotalTimeMs)
+	}
+	if c.latency[latencyBucket(20)] != 1 || c.latency[latencyBucket(3000)] != 1 {
+		t.Fatalf("latency = %v", c.latency)
+	}
+	if c.LastError != "refused" || c.LastErrorTrace != "t3" {
+		t.Fatalf("last error = %q (%s)", c.LastError, c.LastErrorTrace)
+	}
+}
+
+func TestNATSPublishConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "no subject", config: `{}`, wantErr: "action alerts has no subject"},
+		{name: "subject renders empty", config: `{"subject":"{{if .missing}}x{{end}}"}`, wantErr: "has no subject"},
+		{name: "bad subject template", config: `{"subject":"alerts.{{"}`, wantErr: "subject:"},
+		{name: "bad body template", config: `{"subject":"alerts","body_template":"{{"}`, wantErr: "invalid body_template"},
+		{name: "invalid config", config: `[]`, wantErr: "invalid config"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ActionMessage{
+				Payload: &WebhookPayload{Data: map[string]interface{}{"region": "eu"}},
+				Config:  &ActionConfig{Name: "alerts", Type: "nats_publish", Config: json.RawMessage(tt.config)},
+			}
+			_, err := natsPublishAction{}.Execute(context.Background(), m)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
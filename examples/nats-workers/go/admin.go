@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/buildinfo"
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// startAdminServer serves operational endpoints on ADMIN_ADDR. It is off
+// unless ADMIN_ADDR is set; pprof additionally requires ENABLE_PPROF and
+// the operations UI ENABLE_UI. The /healthz and /readyz probes, /version,
+// and the UI page do not require ADMIN_TOKEN. See admintls.go for TLS.
+func startAdminServer() error {
+	if config.Admin.Addr == "" {
+		return nil
+	}
+	tlsConfig, err := adminTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", serveMetrics)
+
+	if config.Admin.EnablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	root.HandleFunc("/readyz", serveReadiness)
+	root.Handle("/version", buildinfo.Handler(buildinfo.Read(version, commit, date)))
+	if config.Admin.EnableUI {
+		registerUI(root, mux)
+	}
+	root.Handle("/", requireAdminToken(mux))
+
+	server := &http.Server{
+		Addr:              config.Admin.Addr,
+		Handler:           requireClientCert(root),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		log.Printf("🩺 Admin server listening on %s (tls: %v, client certs: %v, pprof: %v, ui: %v)", config.Admin.Addr,
+			tlsConfig != nil, config.Admin.TLSClientCAFile != "", config.Admin.EnablePprof, config.Admin.EnableUI)
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("⚠️  Admin server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// serveReadiness reports 503 while the worker cannot process messages:
+// the primary database is failing or NATS is disconnected. An unavailable
+// operational database does not affect readiness, since its writes are
+// buffered.
+func serveReadiness(w http.ResponseWriter, r *http.Request) {
+	ready, natsConnected := readiness()
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body := map[string]interface{}{
+		"ready":          ready,
+		"postgres":       primaryHealth.snapshot(),
+		"ops_postgres":   opsHealth.snapshot(),
+		"ops_buffered":   opsBuffered(),
+		"nats_connected": natsConnected,
+	}
+	if config.NATS.JournalPath != "" {
+		body["journal_pending"] = journalPending()
+	}
+	if standbyDB != nil {
+		body["standby_postgres"] = standbyHealth.snapshot()
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// readiness reports whether the worker can process messages, and whether
+// NATS is connected. A healthy standby stands in for the primary.
+func readiness() (ready, natsConnected bool) {
+	natsConnected = natsConn != nil && natsConn.IsConnected()
+	postgres := primaryHealth.ok() || (standbyDB != nil && standbyHealth.ok())
+	return postgres && natsConnected, natsConnected
+}
+
+// subscriptionStats reports each lane's subscription, or nil before the
+// worker starts
+func subscriptionStats() []worker.SubscriptionStats {
+	if consumer == nil {
+		return nil
+	}
+	return consumer.SubscriptionStats()
+}
+
+// requireAdminToken enforces "Authorization: Bearer <ADMIN_TOKEN>" when a
+// token is configured
+func requireAdminToken(next http.Handler) http.Handler {
+	if config.Admin.Token == "" {
+		return next
+	}
+	expected := []byte(config.Admin.Token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Runtime diagnostics published under /debug/vars alongside expvar's
+// built-in cmdline and memstats
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+
+	expvar.Publish("gc", expvar.Func(func() interface{} {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return map[string]interface{}{
+			"num_gc":          m.NumGC,
+			"pause_total_ns":  m.PauseTotalNs,
+			"last_pause_ns":   m.PauseNs[(m.NumGC+255)%256],
+			"heap_alloc":      m.HeapAlloc,
+			"heap_objects":    m.HeapObjects,
+			"next_gc":         m.NextGC,
+			"gc_cpu_fraction": m.GCCPUFraction,
+		}
+	}))
+
+	expvar.Publish("postgres_pool", expvar.Func(func() interface{} {
+		if db == nil {
+			return nil
+		}
+		s := db.Stats()
+		return map[string]interface{}{
+			"max_open":         s.MaxOpenConnections,
+			"open":             s.OpenConnections,
+			"in_use":           s.InUse,
+			"idle":             s.Idle,
+			"wait_count":       s.WaitCount,
+			"wait_duration_ms": s.WaitDuration.Milliseconds(),
+		}
+	}))
+
+	expvar.Publish("postgres_health", expvar.Func(func() interface{} {
+		health := map[string]interface{}{
+			"primary":      primaryHealth.snapshot(),
+			"ops":          opsHealth.snapshot(),
+			"ops_buffered": opsBuffered(),
+		}
+		if standbyDB != nil {
+			health["standby"] = standbyHealth.snapshot()
+			health["standby_serving"] = standbyServing.Load()
+		}
+		return health
+	}))
+
+	expvar.Publish("nats", expvar.Func(func() interface{} {
+		if consumer == nil {
+			return nil
+		}
+		lanes := map[string]interface{}{}
+		for _, sub := range consumer.Subscriptions() {
+			msgs, bytes, _ := sub.Pending()
+			dropped, _ := sub.Dropped()
+			lanes[sub.Subject] = map[string]interface{}{
+				"pending_messages": msgs,
+				"pending_bytes":    bytes,
+				"dropped":          dropped,
+			}
+		}
+		if len(lanes) == 0 {
+			return nil
+		}
+		return lanes
+	}))
+
+	expvar.Publish("subscriptions", expvar.Func(func() interface{} {
+		return subscriptionStats()
+	}))
+
+	expvar.Publish("worker", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"processed":      atomic.LoadUint64(&stats.MessagesProcessed),
+			"succeeded":      atomic.LoadUint64(&stats.MessagesSucceeded),
+			"failed":         atomic.LoadUint64(&stats.MessagesFailed),
+			"expired":        atomic.LoadUint64(&stats.MessagesExpired),
+			"duplicates":     atomic.LoadUint64(&stats.MessagesDuplicate),
+			"deferred":       atomic.LoadUint64(&stats.MessagesDeferred),
+			"uptime_seconds": time.Since(stats.StartTime).Seconds(),
+		}
+	}))
+
+	expvar.Publish("tenants", expvar.Func(func() interface{} {
+		tenants := map[string]interface{}{}
+		for tenant, c := range snapshotTenantMetrics() {
+			tenants[tenant] = c.outcomes
+		}
+		return tenants
+	}))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdminToken(t *testing.T) {
+	defer func(token string) { config.Admin.Token = token }(config.Admin.Token)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{name: "no token configured", want: http.StatusNoContent},
+		{name: "no token configured ignores header", header: "Bearer x", want: http.StatusNoContent},
+		{name: "missing header", token: "s3cret", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "s3cret", header: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "token without bearer prefix", token: "s3cret", header: "s3cret", want: http.StatusNoContent},
+		{name: "right token", token: "s3cret", header: "Bearer s3cret", want: http.StatusNoContent},
+		{name: "token prefix", token: "s3cret", header: "Bearer s3c", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Admin.Token = tt.token
+			req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			requireAdminToken(ok).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Fatal("401 without WWW-Authenticate: Bearer")
+			}
+		})
+	}
+}
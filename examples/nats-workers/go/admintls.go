@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The admin server speaks TLS when ADMIN_TLS_CERT_FILE and
+// ADMIN_TLS_KEY_FILE are set. With ADMIN_TLS_CLIENT_CA_FILE, every request
+// except the /healthz and /readyz probes must present a client certificate
+// signed by that CA, and with ADMIN_TLS_ALLOWED_SANS its subject
+// alternative names must include one of the listed DNS names (which may
+// start with "*."), IP addresses, URIs, or email addresses. Probes are
+// exempt because kubelet and load balancer checks cannot present one.
+
+// certReloadInterval bounds how often the certificate files are checked
+// for rotation
+const certReloadInterval = time.Minute
+
+// adminTLSConfig returns the admin server's TLS configuration, or nil when
+// TLS is off
+func adminTLSConfig() (*tls.Config, error) {
+	if config.Admin.TLSCertFile == "" {
+		return nil, nil
+	}
+	certs := &certReloader{certFile: config.Admin.TLSCertFile, keyFile: config.Admin.TLSKeyFile}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.get,
+	}
+	if config.Admin.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(config.Admin.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read admin client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("admin client CA %s holds no PEM certificates", config.Admin.TLSClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		// Verified when given; requireClientCert rejects requests without one
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// certReloader serves the admin certificate, reading the files again when
+// they change so a rotated certificate is picked up without a restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modified  time.Time
+	checkedAt time.Time
+}
+
+func (c *certReloader) load() error {
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read admin certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load admin certificate: %w", err)
+	}
+	c.cert, c.modified = &cert, info.ModTime()
+	return nil
+}
+
+func (c *certReloader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checkedAt) >= certReloadInterval {
+		c.checkedAt = time.Now()
+		if info, err := os.Stat(c.certFile); err == nil && !info.ModTime().Equal(c.modified) {
+			if err := c.load(); err != nil {
+				// Keep serving the old certificate
+				log.Printf("⚠️  %v", err)
+			} else {
+				log.Printf("🔐 Reloaded admin certificate %s", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// requireClientCert enforces ADMIN_TLS_CLIENT_CA_FILE and
+// ADMIN_TLS_ALLOWED_SANS on every request except the probes
+func requireClientCert(next http.Handler) http.Handler {
+	if config.Admin.TLSClientCAFile == "" {
+		return next
+	}
+	allowed := splitList(config.Admin.TLSAllowedSANs)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		if leaf := r.TLS.VerifiedChains[0][0]; len(allowed) > 0 && !sanAllowed(leaf, allowed) {
+			log.Printf("⚠️  Admin request from %s refused: certificate %q has no allowed SAN", r.RemoteAddr, leaf.Subject.CommonName)
+			http.Error(w, "client certificate not allowed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sanAllowed reports whether cert has one of the allowed subject
+// alternative names
+func sanAllowed(cert *x509.Certificate, allowed []string) bool {
+	for _, pattern := range allowed {
+		for _, name := range cert.DNSNames {
+			if matchDNSName(pattern, name) {
+				return true
+			}
+		}
+		for _, ip := range cert.IPAddresses {
+			if ip.String() == pattern {
+				return true
+			}
+		}
+		for _, uri := range cert.URIs {
+			if uri.String() == pattern {
+				return true
+			}
+		}
+		for _, email := range cert.EmailAddresses {
+			if strings.EqualFold(email, pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchDNSName matches name against pattern, where a leading "*." stands
+// for exactly one label
+func matchDNSName(pattern, name string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		label, rest, found := strings.Cut(name, ".")
+		return found && label != "" && strings.EqualFold(rest, suffix)
+	}
+	return strings.EqualFold(pattern, name)
+}
+
+// validateAdminTLS checks that the admin TLS settings are used together
+func validateAdminTLS() error {
+	a := config.Admin
+	switch {
+	case (a.TLSCertFile == "") != (a.TLSKeyFile == ""):
+		return errors.New("ADMIN_TLS_CERT_FILE and ADMIN_TLS_KEY_FILE must be set together")
+	case a.TLSClientCAFile != "" && a.TLSCertFile == "":
+		return errors.New("ADMIN_TLS_CLIENT_CA_FILE requires ADMIN_TLS_CERT_FILE")
+	case a.TLSAllowedSANs != "" && a.TLSClientCAFile == "":
+		return errors.New("ADMIN_TLS_ALLOWED_SANS requires ADMIN_TLS_CLIENT_CA_FILE")
+	}
+	return nil
+}
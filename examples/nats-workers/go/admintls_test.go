@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key, in memory and as PEM files
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// issueCert creates a certificate from template, signed by parent or self
+// signed when parent is nil, and writes it to dir
+func issueCert(t *testing.T, dir, name string, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	if template.Subject.CommonName == "" {
+		template.Subject.CommonName = name
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	c := &testCert{cert: cert, key: key,
+		certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key")}
+	os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return c
+}
+
+func newCA(t *testing.T, dir, name string) *testCert {
+	return issueCert(t, dir, name, &x509.Certificate{IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature}, nil)
+}
+
+func clientCert(t *testing.T, dir, name string, ca *testCert, template *x509.Certificate) tls.Certificate {
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	c := issueCert(t, dir, name, template, ca)
+	pair, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// setAdminTLS replaces the admin TLS settings for the test
+func setAdminTLS(t *testing.T, certFile, keyFile, clientCA, sans string) {
+	t.Helper()
+	prev := config.Admin
+	t.Cleanup(func() { config.Admin = prev })
+	config.Admin.TLSCertFile, config.Admin.TLSKeyFile = certFile, keyFile
+	config.Admin.TLSClientCAFile, config.Admin.TLSAllowedSANs = clientCA, sans
+}
+
+func TestMatchDNSName(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"ops.example.com", "ops.example.com", true},
+		{"ops.example.com", "OPS.Example.com", true},
+		{"ops.example.com", "dev.example.com", false},
+		{"*.example.com", "ops.example.com", true},
+		{"*.example.com", "a.ops.example.com", false},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", ".example.com", false},
+	}
+	for _, tt := range tests {
+		if got := matchDNSName(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchDNSName(%q, %q) = %v", tt.pattern, tt.name, got)
+		}
+	}
+}
+
+func TestSANAllowed(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/ops/sa/deployer")
+	cert := &x509.Certificate{
+		DNSNames:       []string{"deployer.ops.example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.7")},
+		URIs:           []*url.URL{spiffe},
+		EmailAddresses: []string{"Oncall@Example.com"},
+	}
+	tests := []struct {
+		allowed []string
+		want    bool
+	}{
+		{[]string{"deployer.ops.example.com"}, true},
+		{[]string{"*.ops.example.com"}, true},
+		{[]string{"*.example.com"}, false},
+		{[]string{"10.0.0.7"}, true},
+		{[]string{"10.0.0.8"}, false},
+		{[]string{"spiffe://cluster.local/ns/ops/sa/deployer"}, true},
+		{[]string{"spiffe://cluster.local/ns/ops/sa/other"}, false},
+		{[]string{"oncall@example.com"}, true},
+		{[]string{"nobody@example.com", "10.0.0.7"}, true},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := sanAllowed(cert, tt.allowed); got != tt.want {
+			t.Errorf("sanAllowed(%v) = %v, want %v", tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestValidateAdminTLS(t *testing.T) {
+	tests := []struct {
+		name                      string
+		cert, key, clientCA, sans string
+		wantErr                   string
+	}{
+		{name: "off"},
+		{name: "server tls", cert: "a.crt", key: "a.key"},
+		{name: "mutual tls", cert: "a.crt", key: "a.key", clientCA: "ca.crt", sans: "*.ops.example.com"},
+		{name: "cert without key", cert: "a.crt", wantErr: "must be set together"},
+		{name: "key without cert", key: "a.key", wantErr: "must be set together"},
+		{name: "client CA without TLS", clientCA: "ca.crt", wantErr: "ADMIN_TLS_CLIENT_CA_FILE requires ADMIN_TLS_CERT_FILE"},
+		{name: "SANs without client CA", cert: "a.crt", key: "a.key", sans: "ops", wantErr: "ADMIN_TLS_ALLOWED_SANS requires ADMIN_TLS_CLIENT_CA_FILE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAdminTLS(t, tt.cert, tt.key, tt.clientCA, tt.sans)
+			err := validateAdminTLS()
+			if (tt.wantErr == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAdminTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, dir, "ca")
+	server := issueCert(t, dir, "server", &x509.Certificate{DNSNames: []string{"localhost"}}, ca)
+	notPEM := filepath.Join(dir, "not.pem")
+	os.WriteFile(notPEM, []byte("hello"), 0o600)
+
+	tests := []struct {
+		name                string
+		cert, key, clientCA string
+		wantErr             string
+	}{
+		{name: "missing certificate", cert: filepath.Join(dir, "none.crt"), key: server.keyFile, wantErr: "failed to read admin certificate"},
+		{name: "mismatched key", cert: server.certFile, key: ca.keyFile, wantErr: "failed to load admin certificate"},
+		{name: "missing client CA", cert: server.certFile, key: server.keyFile, clientCA: filepath.Join(dir, "none.crt"),
+			wantErr: "failed to read admin client CA"},
+		{name: "client CA not PEM", cert: server.certFile, key: server.keyFile, clientCA: notPEM, wantErr: "holds no PEM certificates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAdminTLS(t, tt.cert, tt.key, tt.clientCA, "")
+			if _, err := adminTLSConfig(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	setAdminTLS(t, "", "", "", "")
+	if cfg, err := adminTLSConfig(); cfg != nil || err != nil {
+		t.Fatalf("TLS off = %v, %v", cfg, err)
+	}
+}
+
+func TestAdminMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, dir, "ca")
+	other := newCA(t, dir, "other-ca")
+	server := issueCert(t, dir, "server", &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, ca)
+	setAdminTLS(t, server.certFile, server.keyFile, ca.certFile, "*.ops.example.com, 10.0.0.7")
+
+	tlsConfig, err := adminTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+	// httptest would swap in its own certificate, so serve directly
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: requireClientCert(mux)}
+	go srv.Serve(ln)
+	defer srv.Close()
+	baseURL := "https://" + ln.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	allowed := clientCert(t, dir, "deployer", ca, &x509.Certificate{DNSNames: []string{"deployer.ops.example.com"}})
+	byIP := clientCert(t, dir, "runner", ca, &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.7")}})
+	refused := clientCert(t, dir, "intern", ca, &x509.Certificate{DNSNames: []string{"intern.dev.example.com"}})
+	foreign := clientCert(t, dir, "foreign", other, &x509.Certificate{DNSNames: []string{"deployer.ops.example.com"}})
+
+	tests := []struct {
+		name       string
+		cert       *tls.Certificate
+		path       string
+		wantStatus int
+		wantErr    bool
+	}{
+		{name: "probe without certificate", path: "/healthz", wantStatus: 200},
+		{name: "readiness without certificate", path: "/readyz", wantStatus: 200},
+		{name: "no certificate", path: "/debug/vars", wantStatus: 401},
+		{name: "allowed DNS name", cert: &allowed, path: "/debug/vars", wantStatus: 200},
+		{name: "allowed IP", cert: &byIP, path: "/api/destinations", wantStatus: 200},
+		{name: "SAN not allowed", cert: &refused, path: "/debug/vars", wantStatus: 403},
+		{name: "other CA", cert: &foreign, path: "/healthz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientTLS := &tls.Config{RootCAs: roots}
+			if tt.cert != nil {
+				// Always presented, even when the server asks for another CA
+				cert := tt.cert
+				clientTLS.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return cert, nil }
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+			resp, err := client.Get(baseURL + tt.path)
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("handshake with a certificate from another CA succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+
+	// Without a client CA, requests pass through untouched
+	setAdminTLS(t, server.certFile, server.keyFile, "", "")
+	rec := httptest.NewRecorder()
+	requireClientCert(mux).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+	if rec.Code != 200 {
+		t.Fatalf("status without client CA = %d", rec.Code)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, dir, "ca")
+	first := issueCert(t, dir, "server", &x509.Certificate{DNSNames: []string{"first"}}, ca)
+	r := &certReloader{certFile: first.certFile, keyFile: first.keyFile}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	r.checkedAt = time.Now()
+
+	served := func() string {
+		cert, err := r.get(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.DNSNames[0]
+	}
+
+	// Rotated on disk, but not checked again until certReloadInterval
+	issueCert(t, dir, "server", &x509.Certificate{DNSNames: []string{"second"}}, ca)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(first.certFile, later, later)
+	if got := served(); got != "first" {
+		t.Fatalf("served %s before the reload interval", got)
+	}
+	r.checkedAt = time.Time{}
+	if got := served(); got != "second" {
+		t.Fatalf("served %s after rotation", got)
+	}
+
+	// A broken rotation keeps the old certificate
+	os.WriteFile(first.certFile, []byte("garbage"), 0o600)
+	evenLater := later.Add(time.Second)
+	os.Chtimes(first.certFile, evenLater, evenLater)
+	r.checkedAt = time.Time{}
+	if got := served(); got != "second" {
+		t.Fatalf("served %s after a broken rotation", got)
+	}
+}
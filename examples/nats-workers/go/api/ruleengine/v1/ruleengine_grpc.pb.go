@@ -0,0 +1,211 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.27.1
+// source: api/ruleengine/v1/ruleengine.proto
+
+// Rule engine gRPC API, served by cmd/rule-api alongside the REST API.
+//
+// Regenerate the Go code from the module root with:
+//   protoc --go_out=. --go_opt=module=github.com/rule-engine/nats-webhook-worker \
+//     --go-grpc_out=. --go-grpc_opt=module=github.com/rule-engine/nats-webhook-worker \
+//     api/ruleengine/v1/ruleengine.proto
+
+package ruleenginev1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	RuleEngine_EvaluateRules_FullMethodName     = "/ruleengine.v1.RuleEngine/EvaluateRules"
+	RuleEngine_StreamEvaluations_FullMethodName = "/ruleengine.v1.RuleEngine/StreamEvaluations"
+	RuleEngine_ManageRules_FullMethodName       = "/ruleengine.v1.RuleEngine/ManageRules"
+)
+
+// RuleEngineClient is the client API for RuleEngine service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RuleEngineClient interface {
+	// EvaluateRules runs a rule set against one fact document.
+	EvaluateRules(ctx context.Context, in *EvaluateRequest, opts ...grpc.CallOption) (*EvaluateResponse, error)
+	// StreamEvaluations evaluates a stream of fact documents for bulk
+	// scoring. Responses are sent in request order and carry the request's
+	// correlation_id; a failed document sets error instead of ending the
+	// stream.
+	StreamEvaluations(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[EvaluateRequest, EvaluateResponse], error)
+	// ManageRules performs one rule repository operation.
+	ManageRules(ctx context.Context, in *ManageRulesRequest, opts ...grpc.CallOption) (*ManageRulesResponse, error)
+}
+
+type ruleEngineClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRuleEngineClient(cc grpc.ClientConnInterface) RuleEngineClient {
+	return &ruleEngineClient{cc}
+}
+
+func (c *ruleEngineClient) EvaluateRules(ctx context.Context, in *EvaluateRequest, opts ...grpc.CallOption) (*EvaluateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(EvaluateResponse)
+	err := c.cc.Invoke(ctx, RuleEngine_EvaluateRules_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ruleEngineClient) StreamEvaluations(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[EvaluateRequest, EvaluateResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &RuleEngine_ServiceDesc.Streams[0], RuleEngine_StreamEvaluations_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[EvaluateRequest, EvaluateResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RuleEngine_StreamEvaluationsClient = grpc.BidiStreamingClient[EvaluateRequest, EvaluateResponse]
+
+func (c *ruleEngineClient) ManageRules(ctx context.Context, in *ManageRulesRequest, opts ...grpc.CallOption) (*ManageRulesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ManageRulesResponse)
+	err := c.cc.Invoke(ctx, RuleEngine_ManageRules_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RuleEngineServer is the server API for RuleEngine service.
+// All implementations must embed UnimplementedRuleEngineServer
+// for forward compatibility.
+type RuleEngineServer interface {
+	// EvaluateRules runs a rule set against one fact document.
+	EvaluateRules(context.Context, *EvaluateRequest) (*EvaluateResponse, error)
+	// StreamEvaluations evaluates a stream of fact documents for bulk
+	// scoring. Responses are sent in request order and carry the request's
+	// correlation_id; a failed document sets error instead of ending the
+	// stream.
+	StreamEvaluations(grpc.BidiStreamingServer[EvaluateRequest, EvaluateResponse]) error
+	// ManageRules performs one rule repository operation.
+	ManageRules(context.Context, *ManageRulesRequest) (*ManageRulesResponse, error)
+	mustEmbedUnimplementedRuleEngineServer()
+}
+
+// UnimplementedRuleEngineServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedRuleEngineServer struct{}
+
+func (UnimplementedRuleEngineServer) EvaluateRules(context.Context, *EvaluateRequest) (*EvaluateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method EvaluateRules not implemented")
+}
+func (UnimplementedRuleEngineServer) StreamEvaluations(grpc.BidiStreamingServer[EvaluateRequest, EvaluateResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamEvaluations not implemented")
+}
+func (UnimplementedRuleEngineServer) ManageRules(context.Context, *ManageRulesRequest) (*ManageRulesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ManageRules not implemented")
+}
+func (UnimplementedRuleEngineServer) mustEmbedUnimplementedRuleEngineServer() {}
+func (UnimplementedRuleEngineServer) testEmbeddedByValue()                    {}
+
+// UnsafeRuleEngineServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RuleEngineServer will
+// result in compilation errors.
+type UnsafeRuleEngineServer interface {
+	mustEmbedUnimplementedRuleEngineServer()
+}
+
+func RegisterRuleEngineServer(s grpc.ServiceRegistrar, srv RuleEngineServer) {
+	// If the following call pancis, it indicates UnimplementedRuleEngineServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&RuleEngine_ServiceDesc, srv)
+}
+
+func _RuleEngine_EvaluateRules_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EvaluateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RuleEngineServer).EvaluateRules(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RuleEngine_EvaluateRules_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RuleEngineServer).EvaluateRules(ctx, req.(*EvaluateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RuleEngine_StreamEvaluations_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RuleEngineServer).StreamEvaluations(&grpc.GenericServerStream[EvaluateRequest, EvaluateResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RuleEngine_StreamEvaluationsServer = grpc.BidiStreamingServer[EvaluateRequest, EvaluateResponse]
+
+func _RuleEngine_ManageRules_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ManageRulesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RuleEngineServer).ManageRules(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RuleEngine_ManageRules_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RuleEngineServer).ManageRules(ctx, req.(*ManageRulesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// RuleEngine_ServiceDesc is the grpc.ServiceDesc for RuleEngine service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var RuleEngine_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ruleengine.v1.RuleEngine",
+	HandlerType: (*RuleEngineServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "EvaluateRules",
+			Handler:    _RuleEngine_EvaluateRules_Handler,
+		},
+		{
+			MethodName: "ManageRules",
+			Handler:    _RuleEngine_ManageRules_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEvaluations",
+			Handler:       _RuleEngine_StreamEvaluations_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "api/ruleengine/v1/ruleengine.proto",
+}
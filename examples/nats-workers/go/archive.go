@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// archiveAction writes messages to S3-compatible object storage (S3, GCS,
+// MinIO) for downstream analytics:
+//
+//	{"bucket": "rule-events", "credentials_secret": "archive_s3", "prefix": "events/",
+//	 "partition": "dt={{.Date}}/tenant={{.Data.tenant_id}}", "format": "parquet",
+//	 "batch_size": 500, "max_age_seconds": 15}
+//
+// With batch_size above 1, messages are buffered per partition and written
+// as one object when the batch is full or max_age_seconds old; they are
+// acknowledged only after the upload succeeds, and redelivered if it fails.
+type archiveAction struct{}
+
+type archiveConfig struct {
+	Endpoint          string `json:"endpoint"`
+	Region            string `json:"region"`
+	Bucket            string `json:"bucket"`
+	PathStyle         bool   `json:"path_style"`
+	CredentialsSecret string `json:"credentials_secret"`
+	Prefix            string `json:"prefix"`
+	Partition         string `json:"partition"`
+	Format            string `json:"format"` // ndjson (default) or parquet
+	Gzip              bool   `json:"gzip"`   // ndjson only; parquet pages are always compressed
+	BatchSize         int    `json:"batch_size"`
+	MaxAgeSeconds     int    `json:"max_age_seconds"`
+}
+
+// archiveMaxAge stays below the consumer's 30s AckWait so buffered messages
+// are settled before JetStream redelivers them
+const archiveMaxAge = 25 * time.Second
+
+// archiveRecord is one archived message
+type archiveRecord struct {
+	PublishedAt    time.Time       `json:"published_at"`
+	Subject        string          `json:"subject"`
+	StreamSequence uint64          `json:"stream_sequence"`
+	EventKey       string          `json:"event_key,omitempty"`
+	Action         string          `json:"action"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+// partitionFields are available to partition templates
+type partitionFields struct {
+	Date, Year, Month, Day, Hour string
+	Action, Subject              string
+	Data                         map[string]interface{}
+}
+
+// archiveBatch is a buffer of messages bound for one object
+type archiveBatch struct {
+	cfg       archiveConfig
+	action    string
+	partition string
+	records   []archiveRecord
+	messages  []*ActionMessage
+	timer     *time.Timer
+}
+
+var (
+	archiveMu      sync.Mutex
+	archiveBatches = map[string]*archiveBatch{}
+)
+
+func init() {
+	registerAction("archive", archiveAction{})
+}
+
+func (archiveAction) Execute(ctx context.Context, m *ActionMessage) (string, error) {
+	cfg := archiveConfig{Format: "ndjson", Partition: "dt={{.Date}}", BatchSize: 1, MaxAgeSeconds: 10}
+	if err := m.Config.decode(&cfg); err != nil {
+		return "", err
+	}
+	if cfg.Format != "ndjson" && cfg.Format != "parquet" {
+		return "", fmt.Errorf("action %s: format must be ndjson or parquet", m.Config.Name)
+	}
+
+	record := archiveRecord{
+		PublishedAt: time.Now().UTC(),
+		Subject:     m.Msg.Subject,
+		EventKey:    m.Payload.EventKey,
+		Action:      m.Config.Name,
+		Payload:     json.RawMessage(m.Msg.Data),
+	}
+	if meta, err := m.Msg.Metadata(); err == nil {
+		record.PublishedAt = meta.Timestamp.UTC()
+		record.StreamSequence = meta.Sequence.Stream
+	}
+
+	partition, err := renderPartition(cfg.Partition, record, m.Payload.Data)
+	if err != nil {
+		return "", err
+	}
+
+	if cfg.BatchSize <= 1 {
+		key, err := writeArchive(ctx, cfg, partition, []archiveRecord{record})
+		if err != nil {
+			return "", err
+		}
+		return "archived to " + key, nil
+	}
+
+	maxAge := time.Duration(cfg.MaxAgeSeconds) * time.Second
+	if maxAge <= 0 || maxAge > archiveMaxAge {
+		maxAge = archiveMaxAge
+	}
+
+	batchKey := m.Config.Name + "\x00" + partition
+	archiveMu.Lock()
+	batch, ok := archiveBatches[batchKey]
+	if !ok {
+		batch = &archiveBatch{cfg: cfg, action: m.Config.Name, partition: partition}
+		archiveBatches[batchKey] = batch
+		batch.timer = time.AfterFunc(maxAge, func() {
+			if takeArchiveBatch(batchKey, batch) {
+				flushArchiveBatch(batch)
+			}
+		})
+	}
+	batch.records = append(batch.records, record)
+	batch.messages = append(batch.messages, m)
+	size := len(batch.records)
+	full := size >= cfg.BatchSize
+	if full {
+		delete(archiveBatches, batchKey)
+		batch.timer.Stop()
+	}
+	archiveMu.Unlock()
+
+	m.deferAck()
+	if full {
+		go flushArchiveBatch(batch)
+	}
+	return fmt.Sprintf("buffered for %s (%d/%d)", partition, size, cfg.BatchSize), nil
+}
+
+// takeArchiveBatch removes batch from the buffer if it is still current
+func takeArchiveBatch(key string, batch *archiveBatch) bool {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+	if archiveBatches[key] != batch {
+		return false
+	}
+	delete(archiveBatches, key)
+	return true
+}
+
+// flushArchiveBatch writes a batch and settles its messages
+func flushArchiveBatch(batch *archiveBatch) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	key, err := writeArchive(ctx, batch.cfg, batch.partition, batch.records)
+	detail := fmt.Sprintf("archived %d message(s) to %s", len(batch.records), key)
+	if err != nil {
+		log.Printf("❌ Archive %s failed for %d message(s): %v", batch.action, len(batch.records), err)
+	}
+	for _, m := range batch.messages {
+		m.complete(detail, err)
+	}
+}
+
+// flushArchives writes every buffered batch, for shutdown
+func flushArchives() {
+	archiveMu.Lock()
+	batches := make([]*archiveBatch, 0, len(archiveBatches))
+	for key, batch := range archiveBatches {
+		batch.timer.Stop()
+		batches = append(batches, batch)
+		delete(archiveBatches, key)
+	}
+	archiveMu.Unlock()
+
+	for _, batch := range batches {
+		flushArchiveBatch(batch)
+	}
+}
+
+// renderPartition renders the partition template. Missing values become
+// "_unknown" so objects never land in an empty path segment.
+func renderPartition(text string, record archiveRecord, data map[string]interface{}) (string, error) {
+	tmpl, err := template.New("partition").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid partition: %w", err)
+	}
+	t := record.PublishedAt
+	fields := partitionFields{
+		Date:    t.Format("2006-01-02"),
+		Year:    t.Format("2006"),
+		Month:   t.Format("01"),
+		Day:     t.Format("02"),
+		Hour:    t.Format("15"),
+		Action:  record.Action,
+		Subject: record.Subject,
+		Data:    data,
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, fields); err != nil {
+		return "", fmt.Errorf("failed to render partition: %w", err)
+	}
+
+	segments := strings.Split(strings.Trim(buf.String(), "/"), "/")
+	for i, segment := range segments {
+		segment = strings.ReplaceAll(segment, "<no value>", "_unknown")
+		if segment == "" || strings.HasSuffix(segment, "=") {
+			segment += "_unknown"
+		}
+		segments[i] = segment
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// writeArchive encodes records and uploads them as one object, returning
+// its key
+func writeArchive(ctx context.Context, cfg archiveConfig, partition string, records []archiveRecord) (string, error) {
+	store, err := newObjectStore(ctx, cfg.Endpoint, cfg.Region, cfg.Bucket, cfg.PathStyle, cfg.CredentialsSecret)
+	if err != nil {
+		return "", err
+	}
+
+	var body bytes.Buffer
+	var contentType, contentEncoding, ext string
+	if cfg.Format == "parquet" {
+		contentType, ext = "application/vnd.apache.parquet", ".parquet"
+		if err := writeParquet(&body, archiveParquetColumns(records), len(records)); err != nil {
+			return "", err
+		}
+	} else {
+		contentType, ext = "application/x-ndjson", ".ndjson"
+		var w io.Writer = &body
+		var gz *gzip.Writer
+		if cfg.Gzip {
+			gz = gzip.NewWriter(&body)
+			w = gz
+			contentEncoding, ext = "gzip", ".ndjson.gz"
+		}
+		encoder := json.NewEncoder(w)
+		for _, r := range records {
+			if err := encoder.Encode(r); err != nil {
+				return "", err
+			}
+		}
+		if gz != nil {
+			if err := gz.Close(); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	random := make([]byte, 4)
+	rand.Read(random)
+	key := fmt.Sprintf("%s%s/%s-%s%s",
+		cfg.Prefix, partition, time.Now().UTC().Format("20060102T150405.000Z"), hex.EncodeToString(random), ext)
+	key = strings.TrimLeft(key, "/")
+
+	if err := store.Put(ctx, key, contentType, contentEncoding, body.Bytes()); err != nil {
+		return "", err
+	}
+	return key, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxQueryParams is PostgreSQL's limit on bind parameters per statement
+const maxQueryParams = 65535
+
+// auditStats counts audit rows written, failed, and flushed early because
+// AUDIT_BUFFER_SIZE was reached
+var auditStats = expvar.NewMap("audit")
+
+// auditTable identifies rows that can share one INSERT
+type auditTable struct {
+	table   string
+	columns string // comma-separated
+}
+
+var (
+	auditMu      sync.Mutex
+	auditRows    = map[auditTable][][]interface{}{}
+	auditPending int
+	// auditKick asks the flusher to write a full batch before the interval
+	auditKick = make(chan struct{}, 1)
+	// auditFlushMu keeps flushes in order, so rows are written as recorded
+	auditFlushMu sync.Mutex
+)
+
+// auditInsert records one row of a delivery audit table, such as
+// rule_nats_expired_messages. With AUDIT_FLUSH_INTERVAL_MS set the row is
+// buffered and written with others in a multi-row INSERT, so recording it
+// costs a delivery no database round trip; the error is then always nil
+// and failures are logged by the flush. Otherwise it is written at once,
+// with opsWrite's errors.
+func auditInsert(table string, columns []string, values ...interface{}) error {
+	if config.Audit.FlushIntervalMs == 0 {
+		return opsWrite("", auditInsertQuery(table, columns, 1), values...)
+	}
+
+	key := auditTable{table: table, columns: strings.Join(columns, ", ")}
+	auditMu.Lock()
+	auditRows[key] = append(auditRows[key], values)
+	auditPending++
+	pending := auditPending
+	auditMu.Unlock()
+
+	switch {
+	case pending >= config.Audit.BufferSize:
+		// Write in the caller rather than hold more rows in memory
+		auditStats.Add("backpressure", 1)
+		flushAudit()
+	case pending >= config.Audit.BatchSize:
+		select {
+		case auditKick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// auditInsertQuery is an INSERT of rows rows into table
+func auditInsertQuery(table string, columns []string, rows int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "INSERT INTO %s (%s) VALUES ", table, strings.Join(columns, ", "))
+	n := 0
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for c := range columns {
+			if c > 0 {
+				b.WriteString(", ")
+			}
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// startAuditBuffer flushes buffered audit rows every
+// AUDIT_FLUSH_INTERVAL_MS, and as soon as AUDIT_BATCH_SIZE are waiting
+func startAuditBuffer() {
+	if config.Audit.FlushIntervalMs == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.Audit.FlushIntervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-auditKick:
+			}
+			flushAudit()
+		}
+	}()
+}
+
+// flushAudit writes the buffered audit rows, AUDIT_BATCH_SIZE per INSERT.
+// Batches the operational database cannot take are kept by opsWrite's
+// buffer like any other write. It is called on shutdown, after the last
+// message is settled.
+func flushAudit() {
+	auditFlushMu.Lock()
+	defer auditFlushMu.Unlock()
+
+	auditMu.Lock()
+	batches := auditRows
+	auditRows = map[auditTable][][]interface{}{}
+	auditPending = 0
+	auditMu.Unlock()
+
+	for key, rows := range batches {
+		columns := strings.Split(key.columns, ", ")
+		perInsert := config.Audit.BatchSize
+		if max := maxQueryParams / len(columns); perInsert > max {
+			perInsert = max
+		}
+		for len(rows) > 0 {
+			n := perInsert
+			if n > len(rows) {
+				n = len(rows)
+			}
+			args := make([]interface{}, 0, n*len(columns))
+			for _, row := range rows[:n] {
+				args = append(args, row...)
+			}
+			err := opsWrite("", auditInsertQuery(key.table, columns, n), args...)
+			if err != nil && !errors.Is(err, errOpsBuffered) {
+				auditStats.Add("failed", int64(n))
+				log.Printf("⚠️  Failed to write %d %s row(s): %v", n, key.table, err)
+			} else {
+				auditStats.Add("written", int64(n))
+			}
+			rows = rows[n:]
+		}
+	}
+}
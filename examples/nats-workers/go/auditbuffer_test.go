@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+// useAuditBuffer sets the AUDIT_* buffering settings for one test and
+// empties the buffer before and after it
+func useAuditBuffer(t *testing.T, intervalMs, batchSize, bufferSize int) {
+	t.Helper()
+	prev := config.Audit
+	config.Audit.FlushIntervalMs, config.Audit.BatchSize, config.Audit.BufferSize = intervalMs, batchSize, bufferSize
+	reset := func() {
+		auditMu.Lock()
+		auditRows, auditPending = map[auditTable][][]interface{}{}, 0
+		auditMu.Unlock()
+		select {
+		case <-auditKick:
+		default:
+		}
+	}
+	reset()
+	t.Cleanup(func() {
+		reset()
+		config.Audit = prev
+	})
+}
+
+// auditCount returns the audit counter for name
+func auditCount(name string) int64 {
+	if v, ok := auditStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestAuditInsertQuery(t *testing.T) {
+	tests := []struct {
+		columns []string
+		rows    int
+		want    string
+	}{
+		{[]string{"a"}, 1, "INSERT INTO audit (a) VALUES ($1)"},
+		{[]string{"a", "b", "c"}, 1, "INSERT INTO audit (a, b, c) VALUES ($1, $2, $3)"},
+		{[]string{"a", "b"}, 3, "INSERT INTO audit (a, b) VALUES ($1, $2), ($3, $4), ($5, $6)"},
+	}
+	for _, tt := range tests {
+		if got := auditInsertQuery("audit", tt.columns, tt.rows); got != tt.want {
+			t.Errorf("auditInsertQuery(%v, %d) = %q, want %q", tt.columns, tt.rows, got, tt.want)
+		}
+	}
+}
+
+func TestAuditInsertUnbuffered(t *testing.T) {
+	useAuditBuffer(t, 0, 500, 10000)
+	ops := mockOpsDB(t)
+	ops.ExpectExec(`INSERT INTO rule_nats_expired_messages \(subject, payload\) VALUES \(\$1, \$2\)$`).
+		WithArgs("webhooks.orders", "{}").WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := auditInsert("rule_nats_expired_messages", []string{"subject", "payload"}, "webhooks.orders", "{}"); err != nil {
+		t.Fatal(err)
+	}
+	ops.ExpectExec(`INSERT INTO rule_nats_expired_messages`).WillReturnError(&pq.Error{Code: "42P01", Message: "relation does not exist"})
+	if err := auditInsert("rule_nats_expired_messages", []string{"subject", "payload"}, "webhooks.orders", "{}"); err == nil {
+		t.Fatal("write error not returned")
+	}
+	if auditPending != 0 {
+		t.Fatalf("%d rows buffered", auditPending)
+	}
+}
+
+func TestAuditInsertBuffered(t *testing.T) {
+	tests := []struct {
+		name         string
+		rows         int
+		wantPending  int
+		wantKick     bool
+		wantWritten  int64
+		backpressure int64
+	}{
+		{name: "buffered", rows: 2, wantPending: 2},
+		{name: "batch ready", rows: 3, wantPending: 3, wantKick: true},
+		// The buffer is full: the caller writes it
+		{name: "backpressure", rows: 5, wantKick: true, wantWritten: 5, backpressure: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useAuditBuffer(t, 1000, 3, 5)
+			ops := mockOpsDB(t)
+			if tt.wantWritten > 0 {
+				ops.ExpectExec(`INSERT INTO rule_notification_receipts \(status\) VALUES \(\$1\), \(\$2\), \(\$3\)$`).
+					WithArgs(0, 1, 2).WillReturnResult(sqlmock.NewResult(0, 3))
+				ops.ExpectExec(`INSERT INTO rule_notification_receipts \(status\) VALUES \(\$1\), \(\$2\)$`).
+					WithArgs(3, 4).WillReturnResult(sqlmock.NewResult(0, 2))
+			}
+			written, backpressure := auditCount("written"), auditCount("backpressure")
+			for i := 0; i < tt.rows; i++ {
+				if err := auditInsert("rule_notification_receipts", []string{"status"}, i); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if auditPending != tt.wantPending {
+				t.Fatalf("pending = %d, want %d", auditPending, tt.wantPending)
+			}
+			if kicked := len(auditKick) == 1; kicked != tt.wantKick {
+				t.Fatalf("flusher kicked = %v, want %v", kicked, tt.wantKick)
+			}
+			if got := auditCount("written") - written; got != tt.wantWritten {
+				t.Fatalf("written = %d, want %d", got, tt.wantWritten)
+			}
+			if got := auditCount("backpressure") - backpressure; got != tt.backpressure {
+				t.Fatalf("backpressure = %d, want %d", got, tt.backpressure)
+			}
+		})
+	}
+}
+
+func TestFlushAudit(t *testing.T) {
+	useAuditBuffer(t, 1000, 2, 100)
+	ops := mockOpsDB(t)
+	for i := 0; i < 3; i++ {
+		auditInsert("rule_webhook_captures", []string{"destination", "status"}, "crm", 200+i)
+	}
+	auditInsert("rule_nats_expired_messages", []string{"subject"}, "webhooks.orders")
+	auditInsert("rule_notification_receipts", []string{"status"}, "sent")
+	auditInsert("rule_notification_receipts", []string{"status"}, "failed")
+
+	// AUDIT_BATCH_SIZE rows per INSERT, each table on its own
+	ops.ExpectExec(`INSERT INTO rule_webhook_captures \(destination, status\) VALUES \(\$1, \$2\), \(\$3, \$4\)$`).
+		WithArgs("crm", 200, "crm", 201).WillReturnResult(sqlmock.NewResult(0, 2))
+	ops.ExpectExec(`INSERT INTO rule_webhook_captures \(destination, status\) VALUES \(\$1, \$2\)$`).
+		WithArgs("crm", 202).WillReturnResult(sqlmock.NewResult(0, 1))
+	ops.ExpectExec(`INSERT INTO rule_nats_expired_messages \(subject\) VALUES \(\$1\)$`).
+		WithArgs("webhooks.orders").WillReturnResult(sqlmock.NewResult(0, 1))
+	ops.ExpectExec(`INSERT INTO rule_notification_receipts \(status\) VALUES \(\$1\), \(\$2\)$`).
+		WithArgs("sent", "failed").WillReturnError(&pq.Error{Code: "42P01", Message: "relation does not exist"})
+
+	written, failed := auditCount("written"), auditCount("failed")
+	flushAudit()
+	if auditPending != 0 || len(auditRows) != 0 {
+		t.Fatalf("%d rows left in the buffer", auditPending)
+	}
+	if got := auditCount("written") - written; got != 4 {
+		t.Fatalf("written = %d, want 4", got)
+	}
+	if got := auditCount("failed") - failed; got != 2 {
+		t.Fatalf("failed = %d, want 2", got)
+	}
+}
+
+func TestFlushAuditWhileOpsDBDown(t *testing.T) {
+	useAuditBuffer(t, 1000, 2, 100)
+	resetOpsBuffer(t, 10)
+	mockOpsDB(t) // no expectations: nothing reaches the database
+	opsHealth.markUnhealthy(errors.New("connection refused"))
+	for i := 0; i < 3; i++ {
+		auditInsert("rule_webhook_captures", []string{"status"}, 200+i)
+	}
+
+	// Kept by opsWrite's buffer, so not failed
+	written, failed := auditCount("written"), auditCount("failed")
+	flushAudit()
+	if opsBuffered() != 2 {
+		t.Fatalf("%d writes in the ops buffer, want 2", opsBuffered())
+	}
+	if auditCount("written")-written != 3 || auditCount("failed") != failed {
+		t.Fatalf("written %d, failed %d", auditCount("written")-written, auditCount("failed")-failed)
+	}
+}
+
+func TestFlushAuditParameterLimit(t *testing.T) {
+	// 16384 columns: at most 3 rows fit PostgreSQL's 65535 parameters
+	useAuditBuffer(t, 1000, 500, 1000)
+	ops := mockOpsDB(t)
+	columns := make([]string, 16384)
+	row := make([]interface{}, len(columns))
+	for i := range columns {
+		columns[i], row[i] = fmt.Sprintf("c%d", i), i
+	}
+	for i := 0; i < 4; i++ {
+		auditInsert("wide", columns, row...)
+	}
+	ops.ExpectExec(`INSERT INTO wide .*\(\$32769, .*\$49152\)$`).WillReturnResult(sqlmock.NewResult(0, 3))
+	ops.ExpectExec(`INSERT INTO wide .*\(\$1, .*\$16384\)$`).WillReturnResult(sqlmock.NewResult(0, 1))
+	flushAudit()
+}
+
+func TestFlushAuditEmpty(t *testing.T) {
+	useAuditBuffer(t, 1000, 500, 1000)
+	mockOpsDB(t) // no expectations: nothing is written
+	flushAudit()
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// avroDecoder reads Avro binary records. With SCHEMA_REGISTRY_URL set the
+// data must use the registry wire format and its schema id picks the
+// schema; otherwise the option names a local .avsc file.
+type avroDecoder struct {
+	mu    sync.Mutex
+	files map[string]*avroSchema
+}
+
+func init() {
+	registerDecoder("avro", &avroDecoder{files: map[string]*avroSchema{}})
+}
+
+func (d *avroDecoder) Decode(ctx context.Context, data []byte, option string) (map[string]interface{}, error) {
+	var schema *avroSchema
+	if r := getSchemaRegistry(); r != nil {
+		id, body, err := splitSchemaID(data)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := r.schema(ctx, id, func(s *registrySchema) (interface{}, error) {
+			if s.SchemaType != "" && s.SchemaType != "AVRO" {
+				return nil, fmt.Errorf("is a %s schema, not Avro", s.SchemaType)
+			}
+			return parseAvroSchema([]byte(s.Schema))
+		})
+		if err != nil {
+			return nil, err
+		}
+		schema, data = parsed.(*avroSchema), body
+	} else {
+		var err error
+		if schema, err = d.schemaFile(option); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &avroReader{data: data}
+	value, err := schema.read(r)
+	if err == nil && r.pos != len(data) {
+		err = fmt.Errorf("%d bytes after the record", len(data)-r.pos)
+	}
+	if err != nil {
+		return nil, worker.Permanent(fmt.Errorf("invalid avro data: %w", err))
+	}
+	record, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, worker.Permanent(fmt.Errorf("avro schema must be a record, got %s", schema.kind))
+	}
+	return record, nil
+}
+
+// schemaFile loads and caches the schema in path
+func (d *avroDecoder) schemaFile(path string) (*avroSchema, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if schema, ok := d.files[path]; ok {
+		return schema, nil
+	}
+	if path == "" {
+		return nil, worker.Permanent(fmt.Errorf("no schema: set SCHEMA_REGISTRY_URL or name an .avsc file (avro:path)"))
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := parseAvroSchema(text)
+	if err != nil {
+		return nil, worker.Permanent(fmt.Errorf("%s: %w", path, err))
+	}
+	d.files[path] = schema
+	return schema, nil
+}
+
+// avroSchema is a parsed Avro schema. Named types are shared, so records
+// may refer to themselves.
+type avroSchema struct {
+	kind        string // a primitive type name, record, enum, array, map, fixed, or union
+	name        string // full name of records, enums, and fixed
+	logicalType string
+	scale       int // decimal
+
+	fields   []avroField   // record
+	symbols  []string      // enum
+	items    *avroSchema   // array items, map values
+	size     int           // fixed
+	branches []*avroSchema // union
+}
+
+type avroField struct {
+	name   string
+	schema *avroSchema
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+func parseAvroSchema(text []byte) (*avroSchema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(text, &doc); err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %w", err)
+	}
+	p := &avroParser{named: map[string]*avroSchema{}}
+	return p.parse(doc, "")
+}
+
+type avroParser struct {
+	named map[string]*avroSchema
+}
+
+func (p *avroParser) parse(doc interface{}, namespace string) (*avroSchema, error) {
+	switch v := doc.(type) {
+	case string:
+		if avroPrimitives[v] {
+			return &avroSchema{kind: v}, nil
+		}
+		if s, ok := p.named[avroFullName(v, namespace)]; ok {
+			return s, nil
+		}
+		if s, ok := p.named[v]; ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unknown avro type %q", v)
+
+	case []interface{}:
+		union := &avroSchema{kind: "union"}
+		for _, branch := range v {
+			s, err := p.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			union.branches = append(union.branches, s)
+		}
+		return union, nil
+
+	case map[string]interface{}:
+		return p.parseObject(v, namespace)
+	}
+	return nil, fmt.Errorf("invalid avro schema %v", doc)
+}
+
+func (p *avroParser) parseObject(v map[string]interface{}, namespace string) (*avroSchema, error) {
+	typ, _ := v["type"].(string)
+	switch typ {
+	case "record", "error", "enum", "fixed":
+		name, _ := v["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("avro %s without a name", typ)
+		}
+		if ns, ok := v["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		s := &avroSchema{kind: typ, name: avroFullName(name, namespace)}
+		if i := strings.LastIndex(s.name, "."); i >= 0 {
+			namespace = s.name[:i]
+		}
+		p.named[s.name] = s
+
+		switch typ {
+		case "record", "error":
+			s.kind = "record"
+			fields, _ := v["fields"].([]interface{})
+			for _, f := range fields {
+				field, _ := f.(map[string]interface{})
+				fieldName, _ := field["name"].(string)
+				if fieldName == "" {
+					return nil, fmt.Errorf("record %s has a field without a name", s.name)
+				}
+				fs, err := p.parse(field["type"], namespace)
+				if err != nil {
+					return nil, fmt.Errorf("%s.%s: %w", s.name, fieldName, err)
+				}
+				s.fields = append(s.fields, avroField{name: fieldName, schema: fs})
+			}
+		case "enum":
+			symbols, _ := v["symbols"].([]interface{})
+			for _, symbol := range symbols {
+				name, _ := symbol.(string)
+				s.symbols = append(s.symbols, name)
+			}
+		case "fixed":
+			size, _ := v["size"].(float64)
+			s.size = int(size)
+			s.logicalType, _ = v["logicalType"].(string)
+			if scale, ok := v["scale"].(float64); ok {
+				s.scale = int(scale)
+			}
+		}
+		return s, nil
+
+	case "array", "map":
+		key := "items"
+		if typ == "map" {
+			key = "values"
+		}
+		items, err := p.parse(v[key], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{kind: typ, items: items}, nil
+	}
+
+	// A primitive, or a named type, annotated with a logical type
+	base, err := p.parse(v["type"], namespace)
+	if err != nil {
+		return nil, err
+	}
+	if !avroPrimitives[base.kind] {
+		return base, nil
+	}
+	s := *base
+	s.logicalType, _ = v["logicalType"].(string)
+	if scale, ok := v["scale"].(float64); ok {
+		s.scale = int(scale)
+	}
+	return &s, nil
+}
+
+func avroFullName(name, namespace string) string {
+	if namespace == "" || strings.Contains(name, ".") {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// avroReader reads Avro binary encoding
+type avroReader struct {
+	data []byte
+	pos  int
+}
+
+var errAvroShort = errors.New("data ends early")
+
+func (r *avroReader) long() (int64, error) {
+	u, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, errAvroShort
+	}
+	r.pos += n
+	return int64(u>>1) ^ -int64(u&1), nil
+}
+
+func (r *avroReader) next(n int64) ([]byte, error) {
+	if n < 0 || n > int64(len(r.data)-r.pos) {
+		return nil, errAvroShort
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// blockCount reads the item count of an array or map block. A negative
+// count is followed by the block's size in bytes.
+func (r *avroReader) blockCount() (int64, error) {
+	count, err := r.long()
+	if err != nil {
+		return 0, err
+	}
+	if count < 0 {
+		count = -count
+		if _, err := r.long(); err != nil {
+			return 0, err
+		}
+	}
+	// Items take at least a byte, except nulls; this bounds what a corrupt
+	// count can allocate
+	if count > int64(len(r.data)-r.pos)+1 {
+		return 0, errAvroShort
+	}
+	return count, nil
+}
+
+// read decodes a value of schema s into the types encoding/json produces.
+// Unions read as the chosen branch's value, bytes and fixed as base64,
+// and dates and timestamps as RFC 3339 strings.
+func (s *avroSchema) read(r *avroReader) (interface{}, error) {
+	switch s.kind {
+	case "null":
+		return nil, nil
+
+	case "boolean":
+		b, err := r.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+
+	case "int", "long":
+		n, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		switch s.logicalType {
+		case "date":
+			return time.Unix(n*86400, 0).UTC().Format("2006-01-02"), nil
+		case "timestamp-millis":
+			return time.UnixMilli(n).UTC().Format(time.RFC3339Nano), nil
+		case "timestamp-micros":
+			return time.UnixMicro(n).UTC().Format(time.RFC3339Nano), nil
+		}
+		return n, nil
+
+	case "float":
+		b, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+
+	case "double":
+		b, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+
+	case "bytes", "string":
+		n, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.next(n)
+		if err != nil {
+			return nil, err
+		}
+		if s.kind == "string" {
+			return string(b), nil
+		}
+		return s.bytesValue(b), nil
+
+	case "fixed":
+		b, err := r.next(int64(s.size))
+		if err != nil {
+			return nil, err
+		}
+		return s.bytesValue(b), nil
+
+	case "enum":
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(s.symbols)) {
+			return nil, fmt.Errorf("enum %s has no symbol %d", s.name, i)
+		}
+		return s.symbols[i], nil
+
+	case "union":
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(s.branches)) {
+			return nil, fmt.Errorf("union has no branch %d", i)
+		}
+		return s.branches[i].read(r)
+
+	case "record":
+		record := make(map[string]interface{}, len(s.fields))
+		for _, f := range s.fields {
+			value, err := f.schema.read(r)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f.name, err)
+			}
+			record[f.name] = value
+		}
+		return record, nil
+
+	case "array":
+		items := []interface{}{}
+		for {
+			count, err := r.blockCount()
+			if err != nil || count == 0 {
+				return items, err
+			}
+			for ; count > 0; count-- {
+				value, err := s.items.read(r)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, value)
+			}
+		}
+
+	case "map":
+		values := map[string]interface{}{}
+		for {
+			count, err := r.blockCount()
+			if err != nil || count == 0 {
+				return values, err
+			}
+			for ; count > 0; count-- {
+				n, err := r.long()
+				if err != nil {
+					return nil, err
+				}
+				key, err := r.next(n)
+				if err != nil {
+					return nil, err
+				}
+				if values[string(key)], err = s.items.read(r); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("unsupported avro type %s", s.kind)
+}
+
+// bytesValue renders bytes or fixed data: decimals as JSON numbers,
+// anything else as base64
+func (s *avroSchema) bytesValue(b []byte) interface{} {
+	if s.logicalType != "decimal" {
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	unscaled := new(big.Int).SetBytes(b)
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		// two's complement
+		unscaled.Sub(unscaled, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	digits := new(big.Int).Abs(unscaled).String()
+	if s.scale > 0 {
+		if len(digits) <= s.scale {
+			digits = strings.Repeat("0", s.scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-s.scale] + "." + digits[len(digits)-s.scale:]
+	}
+	if unscaled.Sign() < 0 {
+		digits = "-" + digits
+	}
+	return json.Number(digits)
+}
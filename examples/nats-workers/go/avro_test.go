@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// avroUnion is a union value for avroWriter: the branch and its value
+type avroUnion struct {
+	branch int
+	value  interface{}
+}
+
+// avroWriter encodes values the way the Avro specification does, for
+// round trips through the decoder. Arrays and maps are written in two
+// blocks, the first with its size in bytes, as writers may.
+type avroWriter struct {
+	buf []byte
+}
+
+func (w *avroWriter) long(n int64) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(n<<1)^uint64(n>>63))
+}
+
+func (w *avroWriter) bytes(b []byte) {
+	w.long(int64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *avroWriter) write(s *avroSchema, v interface{}) {
+	switch s.kind {
+	case "null":
+	case "boolean":
+		if v.(bool) {
+			w.buf = append(w.buf, 1)
+		} else {
+			w.buf = append(w.buf, 0)
+		}
+	case "int", "long":
+		w.long(v.(int64))
+	case "float":
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, math.Float32bits(v.(float32)))
+	case "double":
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(v.(float64)))
+	case "string":
+		w.bytes([]byte(v.(string)))
+	case "bytes":
+		w.bytes(v.([]byte))
+	case "fixed":
+		w.buf = append(w.buf, v.([]byte)...)
+	case "enum":
+		for i, symbol := range s.symbols {
+			if symbol == v {
+				w.long(int64(i))
+			}
+		}
+	case "union":
+		u := v.(avroUnion)
+		w.long(int64(u.branch))
+		w.write(s.branches[u.branch], u.value)
+	case "record":
+		for _, f := range s.fields {
+			w.write(f.schema, v.(map[string]interface{})[f.name])
+		}
+	case "array":
+		items := v.([]interface{})
+		w.blocks(len(items), func(w *avroWriter, i int) { w.write(s.items, items[i]) })
+	case "map":
+		m := v.(map[string]interface{})
+		var keys []string
+		for key := range m {
+			keys = append(keys, key)
+		}
+		w.blocks(len(keys), func(w *avroWriter, i int) {
+			w.bytes([]byte(keys[i]))
+			w.write(s.items, m[keys[i]])
+		})
+	}
+}
+
+func (w *avroWriter) blocks(n int, item func(w *avroWriter, i int)) {
+	if first := (n + 1) / 2; first > 0 {
+		block := &avroWriter{}
+		for i := 0; i < first; i++ {
+			item(block, i)
+		}
+		w.long(int64(-first))
+		w.long(int64(len(block.buf)))
+		w.buf = append(w.buf, block.buf...)
+		if n > first {
+			w.long(int64(n - first))
+			for i := first; i < n; i++ {
+				item(w, i)
+			}
+		}
+	}
+	w.long(0)
+}
+
+func mustParseAvro(t *testing.T, schema string) *avroSchema {
+	t.Helper()
+	s, err := parseAvroSchema([]byte(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// decodeAvroJSON decodes data with schema and renders the value as JSON
+func decodeAvroJSON(s *avroSchema, data []byte) (string, error) {
+	r := &avroReader{data: data}
+	v, err := s.read(r)
+	if err != nil {
+		return "", err
+	}
+	b, _ := json.Marshal(v)
+	return string(b), nil
+}
+
+// The examples from the Avro specification's binary encoding section
+func TestAvroSpecEncoding(t *testing.T) {
+	tests := []struct {
+		schema string
+		data   []byte
+		want   string
+	}{
+		{`"long"`, []byte{0x00}, `0`},
+		{`"long"`, []byte{0x01}, `-1`},
+		{`"long"`, []byte{0x02}, `1`},
+		{`"long"`, []byte{0x03}, `-2`},
+		{`"long"`, []byte{0x04}, `2`},
+		{`"long"`, []byte{0x7f}, `-64`},
+		{`"long"`, []byte{0x80, 0x01}, `64`},
+		{`"string"`, []byte{0x06, 0x66, 0x6f, 0x6f}, `"foo"`},
+		{`{"type": "record", "name": "test", "fields": [{"name": "a", "type": "long"}, {"name": "b", "type": "string"}]}`,
+			[]byte{0x36, 0x06, 0x66, 0x6f, 0x6f}, `{"a":27,"b":"foo"}`},
+		{`{"type": "array", "items": "long"}`, []byte{0x04, 0x06, 0x36, 0x00}, `[3,27]`},
+		{`["null", "string"]`, []byte{0x00}, `null`},
+		{`["null", "string"]`, []byte{0x02, 0x02, 0x61}, `"a"`},
+	}
+	for _, tt := range tests {
+		got, err := decodeAvroJSON(mustParseAvro(t, tt.schema), tt.data)
+		if err != nil || got != tt.want {
+			t.Errorf("%s % x = %s, %v, want %s", tt.schema, tt.data, got, err, tt.want)
+		}
+	}
+}
+
+func TestAvroRoundTrip(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 12, 30, 0, 123456000, time.UTC)
+	tests := []struct {
+		name   string
+		schema string
+		value  interface{}
+		want   string
+	}{
+		{name: "primitives",
+			schema: `{"type": "record", "name": "P", "fields": [
+				{"name": "n", "type": "null"}, {"name": "b", "type": "boolean"}, {"name": "i", "type": "int"},
+				{"name": "l", "type": "long"}, {"name": "f", "type": "float"}, {"name": "d", "type": "double"},
+				{"name": "s", "type": "string"}, {"name": "y", "type": "bytes"}]}`,
+			value: map[string]interface{}{"n": nil, "b": true, "i": int64(-2147483648), "l": int64(math.MaxInt64),
+				"f": float32(1.5), "d": -0.25, "s": "héllo", "y": []byte{0, 1, 255}},
+			want: `{"b":true,"d":-0.25,"f":1.5,"i":-2147483648,"l":9223372036854775807,"n":null,"s":"héllo","y":"AAH/"}`},
+		{name: "logical types",
+			schema: `{"type": "record", "name": "L", "fields": [
+				{"name": "day", "type": {"type": "int", "logicalType": "date"}},
+				{"name": "ms", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+				{"name": "us", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+				{"name": "price", "type": {"type": "bytes", "logicalType": "decimal", "precision": 9, "scale": 2}},
+				{"name": "debt", "type": {"type": "fixed", "name": "Money", "size": 4, "logicalType": "decimal", "scale": 3}},
+				{"name": "id", "type": {"type": "string", "logicalType": "uuid"}}]}`,
+			value: map[string]interface{}{"day": int64(19783), "ms": ts.UnixMilli(), "us": ts.UnixMicro(),
+				"price": []byte{0x30, 0x39}, "debt": []byte{0xff, 0xff, 0xff, 0xfb}, "id": "0b8e0f7e-3c2a-4c1a-9d65-2f8d3f9b9a10"},
+			want: `{"day":"2024-03-01","debt":-0.005,"id":"0b8e0f7e-3c2a-4c1a-9d65-2f8d3f9b9a10",` +
+				`"ms":"2024-03-01T12:30:00.123Z","price":123.45,"us":"2024-03-01T12:30:00.123456Z"}`},
+		{name: "enums, fixed and unions",
+			schema: `{"type": "record", "name": "U", "namespace": "acme", "fields": [
+				{"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["NEW", "PAID", "SHIPPED"]}},
+				{"name": "hash", "type": {"type": "fixed", "name": "Hash", "size": 2}},
+				{"name": "note", "type": ["null", "string"]},
+				{"name": "amount", "type": ["null", "long", "double"]},
+				{"name": "previous", "type": ["null", "Status"]}]}`,
+			value: map[string]interface{}{"status": "PAID", "hash": []byte{0xab, 0xcd}, "note": avroUnion{0, nil},
+				"amount": avroUnion{2, 9.5}, "previous": avroUnion{1, "NEW"}},
+			want: `{"amount":9.5,"hash":"q80=","note":null,"previous":"NEW","status":"PAID"}`},
+		{name: "arrays and maps in blocks",
+			schema: `{"type": "record", "name": "C", "fields": [
+				{"name": "tags", "type": {"type": "array", "items": "string"}},
+				{"name": "empty", "type": {"type": "array", "items": "long"}},
+				{"name": "nulls", "type": {"type": "array", "items": "null"}},
+				{"name": "counts", "type": {"type": "map", "values": "long"}},
+				{"name": "nested", "type": {"type": "map", "values": {"type": "array", "items": "int"}}}]}`,
+			value: map[string]interface{}{"tags": []interface{}{"a", "b", "c"}, "empty": []interface{}{},
+				"nulls":  []interface{}{nil, nil, nil},
+				"counts": map[string]interface{}{"x": int64(1), "y": int64(-1)},
+				"nested": map[string]interface{}{"k": []interface{}{int64(1), int64(2)}}},
+			want: `{"counts":{"x":1,"y":-1},"empty":[],"nested":{"k":[1,2]},"nulls":[null,null,null],"tags":["a","b","c"]}`},
+		{name: "recursive record",
+			schema: `{"type": "record", "name": "Node", "namespace": "list", "fields": [
+				{"name": "value", "type": "int"},
+				{"name": "next", "type": ["null", "list.Node"]}]}`,
+			value: map[string]interface{}{"value": int64(1), "next": avroUnion{1,
+				map[string]interface{}{"value": int64(2), "next": avroUnion{1,
+					map[string]interface{}{"value": int64(3), "next": avroUnion{0, nil}}}}}},
+			want: `{"next":{"next":{"next":null,"value":3},"value":2},"value":1}`},
+		{name: "namespaces",
+			schema: `{"type": "record", "name": "Order", "namespace": "shop", "fields": [
+				{"name": "customer", "type": {"type": "record", "name": "Customer", "fields": [
+					{"name": "tier", "type": {"type": "enum", "name": "crm.Tier", "symbols": ["GOLD"]}}]}},
+				{"name": "billing", "type": "Customer"},
+				{"name": "tier", "type": "crm.Tier"},
+				{"name": "error", "type": {"type": "error", "name": "Failure", "fields": [{"name": "code", "type": "int"}]}}]}`,
+			value: map[string]interface{}{"customer": map[string]interface{}{"tier": "GOLD"},
+				"billing": map[string]interface{}{"tier": "GOLD"}, "tier": "GOLD",
+				"error": map[string]interface{}{"code": int64(7)}},
+			want: `{"billing":{"tier":"GOLD"},"customer":{"tier":"GOLD"},"error":{"code":7},"tier":"GOLD"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := mustParseAvro(t, tt.schema)
+			w := &avroWriter{}
+			w.write(s, tt.value)
+			got, err := decodeAvroJSON(s, w.buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("decoded %s\nwant    %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAvroDecimal(t *testing.T) {
+	tests := []struct {
+		bytes []byte
+		scale int
+		want  string
+	}{
+		{[]byte{0x30, 0x39}, 2, "123.45"},
+		{[]byte{0x30, 0x39}, 0, "12345"},
+		{[]byte{0x05}, 3, "0.005"},
+		{[]byte{0xfb}, 1, "-0.5"},
+		{[]byte{0x00, 0x80}, 0, "128"},
+		{[]byte{0x80}, 0, "-128"},
+		{[]byte{}, 2, "0.00"},
+	}
+	for _, tt := range tests {
+		s := &avroSchema{kind: "bytes", logicalType: "decimal", scale: tt.scale}
+		if got := s.bytesValue(tt.bytes); got != json.Number(tt.want) {
+			t.Errorf("decimal(% x, %d) = %v, want %s", tt.bytes, tt.scale, got, tt.want)
+		}
+	}
+}
+
+func TestParseAvroSchemaErrors(t *testing.T) {
+	tests := []struct {
+		schema, want string
+	}{
+		{`{"type":`, "invalid avro schema: unexpected end of JSON input"},
+		{`"decimal"`, `unknown avro type "decimal"`},
+		{`{"type": "record", "fields": []}`, "avro record without a name"},
+		{`{"type": "enum", "symbols": ["A"]}`, "avro enum without a name"},
+		{`{"type": "record", "name": "R", "fields": [{"type": "int"}]}`, "record R has a field without a name"},
+		{`{"type": "record", "name": "R", "namespace": "a", "fields": [{"name": "x", "type": "Other"}]}`, `a.R.x: unknown avro type "Other"`},
+		{`{"type": "array", "items": "nothing"}`, `unknown avro type "nothing"`},
+		{`["null", 3]`, "invalid avro schema 3"},
+	}
+	for _, tt := range tests {
+		if _, err := parseAvroSchema([]byte(tt.schema)); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: err = %v, want %q", tt.schema, err, tt.want)
+		}
+	}
+}
+
+func TestAvroReadErrors(t *testing.T) {
+	record := `{"type": "record", "name": "R", "fields": [{"name": "s", "type": "string"}]}`
+	tests := []struct {
+		name   string
+		schema string
+		data   []byte
+		want   string
+	}{
+		{"short long", `"long"`, []byte{0x80}, "data ends early"},
+		{"short string", record, []byte{0x06, 'a'}, "s: data ends early"},
+		{"negative length", `"bytes"`, []byte{0x01}, "data ends early"},
+		{"short double", `"double"`, []byte{1, 2, 3}, "data ends early"},
+		{"enum index", `{"type": "enum", "name": "E", "symbols": ["A"]}`, []byte{0x02}, "enum E has no symbol 1"},
+		{"union branch", `["null", "int"]`, []byte{0x04}, "union has no branch 2"},
+		{"negative union branch", `["null", "int"]`, []byte{0x01}, "union has no branch -1"},
+		{"array count beyond the data", `{"type": "array", "items": "null"}`, []byte{0xfe, 0xff, 0xff, 0xff, 0x0f}, "data ends early"},
+		{"unterminated map", `{"type": "map", "values": "int"}`, []byte{0x02, 0x02, 'k', 0x02}, "data ends early"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeAvroJSON(mustParseAvro(t, tt.schema), tt.data)
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAvroDecoderSchemaFile(t *testing.T) {
+	useSchemaRegistry(t, "")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "order.avsc")
+	if err := os.WriteFile(path, []byte(`{"type": "record", "name": "Order", "fields": [
+		{"name": "id", "type": "string"}, {"name": "total", "type": "double"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "long.avsc"), []byte(`"long"`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bad.avsc"), []byte(`{"type": "record"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	order := &avroWriter{}
+	order.write(mustParseAvro(t, `{"type": "record", "name": "Order", "fields": [
+		{"name": "id", "type": "string"}, {"name": "total", "type": "double"}]}`),
+		map[string]interface{}{"id": "o1", "total": 12.5})
+
+	tests := []struct {
+		name          string
+		option        string
+		data          []byte
+		want          string
+		wantErr       string
+		wantPermanent bool
+	}{
+		{name: "record", option: path, data: order.buf, want: `{"id":"o1","total":12.5}`},
+		{name: "trailing bytes", option: path, data: append(append([]byte{}, order.buf...), 0, 0),
+			wantErr: "invalid avro data: 2 bytes after the record", wantPermanent: true},
+		{name: "truncated", option: path, data: order.buf[:3], wantErr: "invalid avro data: total: data ends early", wantPermanent: true},
+		{name: "not a record", option: filepath.Join(dir, "long.avsc"), data: []byte{0x02},
+			wantErr: "avro schema must be a record, got long", wantPermanent: true},
+		{name: "invalid schema", option: filepath.Join(dir, "bad.avsc"), data: []byte{0},
+			wantErr: filepath.Join(dir, "bad.avsc") + ": avro record without a name", wantPermanent: true},
+		{name: "no schema", wantErr: "no schema: set SCHEMA_REGISTRY_URL or name an .avsc file (avro:path)", wantPermanent: true},
+		{name: "missing file retries", option: filepath.Join(dir, "missing.avsc"), wantErr: "no such file or directory"},
+	}
+	d := &avroDecoder{files: map[string]*avroSchema{}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record, err := d.Decode(context.Background(), tt.data, tt.option)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasSuffix(err.Error(), tt.wantErr) || worker.IsPermanent(err) != tt.wantPermanent {
+					t.Fatalf("err = %v (permanent %v), want %q", err, worker.IsPermanent(err), tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := json.Marshal(record); string(got) != tt.want {
+				t.Fatalf("record = %s", got)
+			}
+		})
+	}
+
+	// The schema is read once
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Decode(context.Background(), order.buf, path); err != nil {
+		t.Fatalf("cached schema: %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+// The benchmarks below time the steps every message goes through, from
+// decoding it to delivering it to a local test server. TestPerfBudget
+// holds them to perf_budget.json.
+
+var (
+	perfBudget = flag.Bool("perf.budget", false, "check the hot-path benchmarks against perf_budget.json")
+	perfSlack  = flag.Float64("perf.slack", 1, "multiply ns/op budgets by this on slower machines, e.g. shared CI runners")
+	perfUpdate = flag.Bool("perf.update", false, "write the benchmark results to perf_budget.json instead of checking them")
+)
+
+// benchBudget is the most a benchmark may cost per message, as stored in
+// perf_budget.json
+type benchBudget struct {
+	NsPerOp     int64 `json:"ns_per_op"`
+	AllocsPerOp int64 `json:"allocs_per_op"`
+}
+
+// perfBenchmarks are the benchmarks perf_budget.json covers, by its names
+var perfBenchmarks = map[string]func(*testing.B){
+	"trace_id":        BenchmarkTraceID,
+	"subject_rules":   BenchmarkSubjectRules,
+	"decode":          BenchmarkDecode,
+	"encode_json":     BenchmarkEncodeJSON,
+	"encode_template": BenchmarkEncodeTemplate,
+	"encode_xml":      BenchmarkEncodeXML,
+	"deliver":         BenchmarkDeliver,
+}
+
+// benchPayload is a typical message: a plain webhook with a few fields,
+// a nested object, and an array
+var benchPayload = []byte(`{"webhook_url":"http://destination/hooks/orders","event_key":"order-1042",` +
+	`"headers":{"X-Source":"rules"},"data":{"order_id":1042,"customer":{"id":"c-77","tier":"gold","email":"a@example.com"},` +
+	`"total":129.95,"currency":"EUR","items":[{"sku":"A-1","qty":2},{"sku":"B-7","qty":1},{"sku":"C-3","qty":4}],"rule":"high_value"}}`)
+
+// useBenchConfig gives one benchmark the default settings, with logging
+// off so it measures the work rather than the log
+func useBenchConfig(b *testing.B) {
+	b.Helper()
+	prev, prevLog := config, log.Writer()
+	config = defaultConfig()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() {
+		config = prev
+		log.SetOutput(prevLog)
+	})
+	b.ReportAllocs()
+}
+
+func benchMsg() *nats.Msg {
+	msg := nats.NewMsg("webhooks.orders")
+	msg.Data = benchPayload
+	msg.Header.Set(traceIDHeader, "4bf92f3577b34da6a3ce929d0e0e4736")
+	return msg
+}
+
+func benchDecoded(b *testing.B) *WebhookPayload {
+	var p WebhookPayload
+	if err := json.Unmarshal(benchPayload, &p); err != nil {
+		b.Fatal(err)
+	}
+	return &p
+}
+
+func BenchmarkTraceID(b *testing.B) {
+	useBenchConfig(b)
+	m := benchMsg()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		messageTraceID(m)
+	}
+}
+
+// BenchmarkSubjectRules matches a subject against DECODE_SUBJECTS and
+// EXACTLY_ONCE_SUBJECTS rules that do not apply to it, as most do not
+func BenchmarkSubjectRules(b *testing.B) {
+	useBenchConfig(b)
+	useDecodeRules(b, "kafka.orders.>=avro:orders.avsc,webhooks.raw.*=json")
+	useExactlyOnce(b, "payments.>", "webhooks.refunds")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decoderFor("webhooks.orders")
+		exactlyOnce("webhooks.orders")
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	useBenchConfig(b)
+	m := benchMsg()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := decodeMessage(context.Background(), m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeJSON(b *testing.B) {
+	useBenchConfig(b)
+	p := benchDecoded(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := encodeBody("application/json", "", p, benchPayload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeTemplate(b *testing.B) {
+	useBenchConfig(b)
+	p := benchDecoded(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := encodeBody("text/plain", "Order {{.order_id}} for {{.customer.id}}: {{.total}} {{.currency}}", p, benchPayload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeXML(b *testing.B) {
+	useBenchConfig(b)
+	p := benchDecoded(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := encodeBody("application/xml", "", p, benchPayload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDeliver(b *testing.B) {
+	useBenchConfig(b)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	p := benchDecoded(b)
+	p.WebhookURL = server.URL
+	m := &ActionMessage{Msg: benchMsg(), Payload: p, data: benchPayload, traceID: "4bf92f3577b34da6a3ce929d0e0e4736"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := (webhookAction{}).Execute(context.Background(), m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestPerfBudget runs the benchmarks in perfBenchmarks and fails when one
+// costs more than perf_budget.json allows. Allocations are deterministic
+// and checked exactly; ns/op is multiplied by -perf.slack. It needs no
+// NATS or PostgreSQL, but takes a few seconds, so it only runs when asked:
+//
+//	go test -run TestPerfBudget -perf.budget .
+//	go test -run TestPerfBudget -perf.budget -perf.slack 3 .  # shared CI runners
+//	go test -run TestPerfBudget -perf.update .                # record a new budget
+func TestPerfBudget(t *testing.T) {
+	if !*perfBudget && !*perfUpdate {
+		t.Skip("run with -perf.budget to check perf_budget.json")
+	}
+	budgets := map[string]benchBudget{}
+	if !*perfUpdate {
+		raw, err := os.ReadFile("perf_budget.json")
+		if err == nil {
+			err = json.Unmarshal(raw, &budgets)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := make([]string, 0, len(perfBenchmarks))
+	for name := range perfBenchmarks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	results := map[string]benchBudget{}
+	for _, name := range names {
+		r := testing.Benchmark(perfBenchmarks[name])
+		if r.N == 0 {
+			t.Errorf("%s: benchmark failed", name)
+			continue
+		}
+		got := benchBudget{NsPerOp: r.NsPerOp(), AllocsPerOp: r.AllocsPerOp()}
+		results[name] = got
+		t.Logf("%-16s %8d ns/op %7d B/op %4d allocs/op", name, got.NsPerOp, r.AllocedBytesPerOp(), got.AllocsPerOp)
+		if *perfUpdate {
+			continue
+		}
+		budget, ok := budgets[name]
+		limit := int64(float64(budget.NsPerOp) * *perfSlack)
+		switch {
+		case !ok:
+			t.Errorf("%s: no budget in perf_budget.json", name)
+		case got.AllocsPerOp > budget.AllocsPerOp:
+			t.Errorf("%s: %d allocs/op, budget %d", name, got.AllocsPerOp, budget.AllocsPerOp)
+		case got.NsPerOp > limit:
+			t.Errorf("%s: %d ns/op, budget %d", name, got.NsPerOp, limit)
+		}
+	}
+
+	if *perfUpdate && !t.Failed() {
+		// Sub-microsecond steps get 1µs, so timer and scheduler noise do
+		// not fail them; their allocations are what regress
+		for name, got := range results {
+			if got.NsPerOp *= 2; got.NsPerOp < 1000 {
+				got.NsPerOp = 1000
+			}
+			results[name] = got
+		}
+		if err := writeBudget("perf_budget.json", results); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeBudget stores budgets with their names in order, one per line, so
+// changes to the file read well in review
+func writeBudget(path string, budgets map[string]benchBudget) error {
+	names := make([]string, 0, len(budgets))
+	for name := range budgets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := []byte("{\n")
+	for i, name := range names {
+		line, err := json.Marshal(budgets[name])
+		if err != nil {
+			return err
+		}
+		out = append(out, fmt.Sprintf("  %q: %s", name, line)...)
+		if i < len(names)-1 {
+			out = append(out, ',')
+		}
+		out = append(out, '\n')
+	}
+	out = append(out, "}\n"...)
+	return os.WriteFile(path, out, 0o644)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Content types understood in the content_type field. Full MIME types
+// (e.g. "application/xml") are accepted as well and passed through.
+var contentTypeAliases = map[string]string{
+	"json":   "application/json",
+	"form":   "application/x-www-form-urlencoded",
+	"text":   "text/plain; charset=utf-8",
+	"xml":    "application/xml",
+	"binary": "application/octet-stream",
+}
+
+// resolveContentType maps an alias or MIME type to the header value to send.
+// An empty value means JSON, preserving the original worker behaviour.
+func resolveContentType(contentType string) string {
+	if contentType == "" {
+		return contentTypeAliases["json"]
+	}
+	if mime, ok := contentTypeAliases[strings.ToLower(contentType)]; ok {
+		return mime
+	}
+	return contentType
+}
+
+// encodeBody produces the request body for the given content type. A body
+// template, when present, always wins and is rendered with payload.Data;
+// otherwise Data is encoded in the format the content type calls for.
+func encodeBody(contentType, bodyTemplate string, payload *WebhookPayload, raw []byte) ([]byte, error) {
+	if bodyTemplate != "" {
+		return renderBodyTemplate(bodyTemplate, payload.Data)
+	}
+
+	mime := strings.ToLower(contentType)
+	if i := strings.Index(mime, ";"); i >= 0 {
+		mime = strings.TrimSpace(mime[:i])
+	}
+
+	switch {
+	case mime == "application/json" || strings.HasSuffix(mime, "+json"):
+		if payload.Data == nil {
+			return raw, nil
+		}
+		return payload.dataJSON()
+
+	case mime == "application/x-www-form-urlencoded":
+		form := url.Values{}
+		for key, value := range payload.Data {
+			form.Set(key, scalarString(value))
+		}
+		return []byte(form.Encode()), nil
+
+	case mime == "application/octet-stream":
+		if payload.BodyBase64 == "" {
+			return nil, fmt.Errorf("binary content requires body_base64")
+		}
+		return base64.StdEncoding.DecodeString(payload.BodyBase64)
+
+	case mime == "application/xml" || mime == "text/xml" || strings.HasSuffix(mime, "+xml"):
+		if payload.Body != "" {
+			return []byte(payload.Body), nil
+		}
+		return encodeXML(payload.Data)
+
+	case strings.HasPrefix(mime, "text/"):
+		if payload.Body != "" {
+			return []byte(payload.Body), nil
+		}
+		return nil, fmt.Errorf("%s content requires body or body_template", mime)
+	}
+
+	// Unknown types: send the literal body, or the raw base64 bytes
+	if payload.Body != "" {
+		return []byte(payload.Body), nil
+	}
+	if payload.BodyBase64 != "" {
+		return base64.StdEncoding.DecodeString(payload.BodyBase64)
+	}
+	return nil, fmt.Errorf("no body for content type %s", contentType)
+}
+
+// maxCachedTemplates bounds bodyTemplates; templates carried by messages
+// themselves can be any text
+const maxCachedTemplates = 256
+
+var (
+	bodyTemplatesMu sync.RWMutex
+	bodyTemplates   = map[string]*template.Template{}
+)
+
+func renderBodyTemplate(text string, data map[string]interface{}) ([]byte, error) {
+	tmpl, err := parseBodyTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	return pooledBytes(func(buf *bytes.Buffer) error {
+		if err := tmpl.Execute(buf, data); err != nil {
+			return fmt.Errorf("failed to render body_template: %w", err)
+		}
+		return nil
+	})
+}
+
+// parseBodyTemplate returns text parsed, reusing earlier parses: parsing
+// costs far more than rendering
+func parseBodyTemplate(text string) (*template.Template, error) {
+	bodyTemplatesMu.RLock()
+	tmpl, ok := bodyTemplates[text]
+	bodyTemplatesMu.RUnlock()
+	if ok {
+		return tmpl, nil
+	}
+
+	tmpl, err := template.New("body").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body_template: %w", err)
+	}
+	bodyTemplatesMu.Lock()
+	if len(bodyTemplates) >= maxCachedTemplates {
+		bodyTemplates = map[string]*template.Template{}
+	}
+	bodyTemplates[text] = tmpl
+	bodyTemplatesMu.Unlock()
+	return tmpl, nil
+}
+
+// encodeXML writes data as <data><key>value</key>...</data> with keys in
+// sorted order. Nested objects and arrays are written as JSON text.
+func encodeXML(data map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return pooledBytes(func(buf *bytes.Buffer) error {
+		buf.WriteString(xml.Header)
+		buf.WriteString("<data>")
+		enc := xml.NewEncoder(buf)
+		for _, key := range keys {
+			name := xml.Name{Local: key}
+			if err := enc.EncodeElement(scalarString(data[key]), xml.StartElement{Name: name}); err != nil {
+				return fmt.Errorf("failed to encode %q as XML: %w", key, err)
+			}
+		}
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+		buf.WriteString("</data>")
+		return nil
+	})
+}
+
+// scalarString formats a decoded JSON value for form and XML bodies
+func scalarString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		// fmt.Sprint would print ids such as 12345678 as 1.2345678e+07
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveContentType(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "application/json"},
+		{"json", "application/json"},
+		{"FORM", "application/x-www-form-urlencoded"},
+		{"text", "text/plain; charset=utf-8"},
+		{"xml", "application/xml"},
+		{"binary", "application/octet-stream"},
+		{"application/vnd.api+json", "application/vnd.api+json"},
+	}
+	for _, tt := range tests {
+		if got := resolveContentType(tt.in); got != tt.want {
+			t.Errorf("resolveContentType(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeBody(t *testing.T) {
+	data := map[string]interface{}{
+		"name":  "Ada & Co",
+		"total": 12.5,
+		"tags":  []interface{}{"a", "b"},
+		"none":  nil,
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		template    string
+		payload     WebhookPayload
+		raw         string
+		want        string
+		wantErr     string
+	}{
+		{name: "json from data", contentType: "application/json",
+			payload: WebhookPayload{Data: map[string]interface{}{"a": 1.0}}, want: `{"a":1}`},
+		{name: "json raw when no data", contentType: "application/json", raw: `{"x":true}`, want: `{"x":true}`},
+		{name: "json suffix", contentType: "application/cloudevents+json",
+			payload: WebhookPayload{Data: map[string]interface{}{"a": "b"}}, want: `{"a":"b"}`},
+		{name: "form", contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			payload: WebhookPayload{Data: data}, want: "name=Ada+%26+Co&none=&tags=%5B%22a%22%2C%22b%22%5D&total=12.5"},
+		{name: "form numbers", contentType: "application/x-www-form-urlencoded",
+			payload: WebhookPayload{Data: map[string]interface{}{"id": 12345678.0, "amount": 1e21, "count": 3.0, "rate": 0.000001}},
+			want:    "amount=1000000000000000000000&count=3&id=12345678&rate=0.000001"},
+		{name: "binary", contentType: "application/octet-stream",
+			payload: WebhookPayload{BodyBase64: "aGVsbG8="}, want: "hello"},
+		{name: "binary without body", contentType: "application/octet-stream", wantErr: "requires body_base64"},
+		{name: "binary bad base64", contentType: "application/octet-stream",
+			payload: WebhookPayload{BodyBase64: "!!"}, wantErr: "illegal base64"},
+		{name: "xml literal", contentType: "text/xml", payload: WebhookPayload{Body: "<a/>"}, want: "<a/>"},
+		{name: "xml from data", contentType: "application/xml",
+			payload: WebhookPayload{Data: map[string]interface{}{"b": "x<y", "a": 1.0}},
+			want:    `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + "<data><a>1</a><b>x&lt;y</b></data>"},
+		{name: "xml numbers", contentType: "application/xml",
+			payload: WebhookPayload{Data: map[string]interface{}{"id": 12345678.0, "amount": 1e21, "count": 3.0, "rate": 0.000001}},
+			want: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				"<data><amount>1000000000000000000000</amount><count>3</count><id>12345678</id><rate>0.000001</rate></data>"},
+		{name: "text", contentType: "text/plain; charset=utf-8", payload: WebhookPayload{Body: "hi"}, want: "hi"},
+		{name: "text without body", contentType: "text/csv", wantErr: "text/csv content requires body"},
+		{name: "template wins", contentType: "text/plain", template: "Hello {{.name}}",
+			payload: WebhookPayload{Data: data, Body: "ignored"}, want: "Hello Ada & Co"},
+		{name: "template missing key", contentType: "text/plain", template: "[{{.missing}}]",
+			payload: WebhookPayload{Data: data}, want: "[<no value>]"},
+		{name: "bad template", contentType: "text/plain", template: "{{", wantErr: "invalid body_template"},
+		{name: "unknown type literal", contentType: "application/pdf", payload: WebhookPayload{Body: "%PDF"}, want: "%PDF"},
+		{name: "unknown type base64", contentType: "application/pdf", payload: WebhookPayload{BodyBase64: "JVBERg=="}, want: "%PDF"},
+		{name: "unknown type no body", contentType: "application/pdf", wantErr: "no body for content type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeBody(tt.contentType, tt.template, &tt.payload, []byte(tt.raw))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
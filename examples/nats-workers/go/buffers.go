@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// maxPooledBuffer is the largest buffer returned to bufferPool; bigger
+// ones are left to the garbage collector rather than pin memory after a
+// rare large message
+const maxPooledBuffer = 1 << 20
+
+// maxDrainedBody is how much of a response body is read and discarded so
+// its connection can be reused; past it, closing the connection is cheaper
+const maxDrainedBody = 64 << 10
+
+// payloadStats counts messages refused by MAX_PAYLOAD_BYTES
+var payloadStats = expvar.NewMap("payloads")
+
+var (
+	bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	copyPool   = sync.Pool{New: func() interface{} { b := make([]byte, 32<<10); return &b }}
+)
+
+// getBuffer returns an empty buffer from the pool; hand it back with
+// putBuffer once nothing refers to its bytes
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// pooledBytes renders into a pooled buffer and returns a copy of exactly
+// the rendered size, so a growing render does not reallocate every time
+func pooledBytes(render func(buf *bytes.Buffer) error) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := render(buf); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// drainBody reads what is left of a response body, up to maxDrainedBody,
+// so the HTTP client can reuse the connection
+func drainBody(body io.Reader) {
+	b := copyPool.Get().(*[]byte)
+	defer copyPool.Put(b)
+	io.CopyBuffer(io.Discard, io.LimitReader(body, maxDrainedBody), *b)
+}
+
+// checkPayloadSize refuses a message larger than MAX_PAYLOAD_BYTES before
+// it is decoded, which takes several times its size in memory. Redelivery
+// cannot shrink it, so the error is permanent.
+func checkPayloadSize(msg *nats.Msg) error {
+	limit := config.Worker.MaxPayloadBytes
+	if limit <= 0 || len(msg.Data) <= limit {
+		return nil
+	}
+	payloadStats.Add("too_large", 1)
+	return worker.Permanent(fmt.Errorf("payload of %d bytes exceeds MAX_PAYLOAD_BYTES (%d)", len(msg.Data), limit))
+}
+
+// UnmarshalJSON decodes a payload and keeps the data field's JSON as it
+// arrived, so actions that send it on as JSON need not encode it again
+func (p *WebhookPayload) UnmarshalJSON(b []byte) error {
+	type plain WebhookPayload
+	aux := struct {
+		*plain
+		Data json.RawMessage `json:"data"`
+	}{plain: (*plain)(p)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	p.Data, p.rawData = nil, nil
+	if len(aux.Data) == 0 || string(aux.Data) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(aux.Data, &p.Data); err != nil {
+		return err
+	}
+	p.rawData = aux.Data
+	return nil
+}
+
+// dataJSON returns the payload's data as JSON: the bytes received when
+// there are any, otherwise Data encoded
+func (p *WebhookPayload) dataJSON() ([]byte, error) {
+	if p.rawData != nil && p.Data != nil {
+		return p.rawData, nil
+	}
+	return json.Marshal(p.Data)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+func TestCheckPayloadSize(t *testing.T) {
+	prev := config.Worker.MaxPayloadBytes
+	t.Cleanup(func() { config.Worker.MaxPayloadBytes = prev })
+	tests := []struct {
+		name    string
+		limit   int
+		size    int
+		wantErr string
+	}{
+		{name: "no limit", limit: 0, size: 10 << 20},
+		{name: "under", limit: 1024, size: 1000},
+		{name: "at the limit", limit: 1024, size: 1024},
+		{name: "over", limit: 1024, size: 1025, wantErr: "payload of 1025 bytes exceeds MAX_PAYLOAD_BYTES (1024)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Worker.MaxPayloadBytes = tt.limit
+			err := checkPayloadSize(&nats.Msg{Data: make([]byte, tt.size)})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr || !worker.IsPermanent(err) {
+				t.Fatalf("err = %v, want the permanent %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPooledBytes(t *testing.T) {
+	first, err := pooledBytes(func(buf *bytes.Buffer) error {
+		buf.WriteString("first")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The next render may reuse the buffer; the first result must not change
+	second, _ := pooledBytes(func(buf *bytes.Buffer) error {
+		if buf.Len() != 0 {
+			t.Errorf("pooled buffer not reset: %q", buf.String())
+		}
+		buf.WriteString("SECOND")
+		return nil
+	})
+	if string(first) != "first" || string(second) != "SECOND" {
+		t.Fatalf("rendered %q and %q", first, second)
+	}
+
+	boom := errors.New("template: no such field")
+	if out, err := pooledBytes(func(buf *bytes.Buffer) error { buf.WriteString("partial"); return boom }); err != boom || out != nil {
+		t.Fatalf("pooledBytes = %q, %v", out, err)
+	}
+}
+
+func TestDrainBody(t *testing.T) {
+	tests := []struct {
+		size int
+		left int
+	}{
+		{size: 0},
+		{size: 100},
+		{size: maxDrainedBody},
+		// Past the cap the connection is closed instead
+		{size: maxDrainedBody + 10, left: 10},
+	}
+	for _, tt := range tests {
+		body := strings.NewReader(strings.Repeat("x", tt.size))
+		drainBody(body)
+		if body.Len() != tt.left {
+			t.Errorf("%d byte body: %d bytes left, want %d", tt.size, body.Len(), tt.left)
+		}
+	}
+}
+
+func TestWebhookPayloadUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		data    map[string]interface{}
+		raw     string
+		wantErr bool
+	}{
+		{name: "data kept as received", in: `{"webhook_url":"https://crm.example.com","data":{ "b": 2, "a": [1, 2] }}`,
+			data: map[string]interface{}{"a": []interface{}{1.0, 2.0}, "b": 2.0}, raw: `{ "b": 2, "a": [1, 2] }`},
+		{name: "no data", in: `{"webhook_url":"https://crm.example.com"}`},
+		{name: "null data", in: `{"data":null}`},
+		{name: "data not an object", in: `{"data":[1]}`, wantErr: true},
+		{name: "invalid", in: `{"data":`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Decoding into a reused payload leaves nothing of the last one
+			p := WebhookPayload{Data: map[string]interface{}{"stale": true}, rawData: json.RawMessage(`{"stale":true}`)}
+			err := json.Unmarshal([]byte(tt.in), &p)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(p.Data, tt.data) || string(p.rawData) != tt.raw {
+				t.Fatalf("data = %v, raw = %s", p.Data, p.rawData)
+			}
+		})
+	}
+}
+
+func TestDataJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload WebhookPayload
+		want    string
+	}{
+		{name: "as received", payload: WebhookPayload{Data: map[string]interface{}{"a": 1.0}, rawData: json.RawMessage(`{ "a": 1 }`)},
+			want: `{ "a": 1 }`},
+		{name: "built in code", payload: WebhookPayload{Data: map[string]interface{}{"a": 1.0}}, want: `{"a":1}`},
+		{name: "data dropped", payload: WebhookPayload{rawData: json.RawMessage(`{"a":1}`)}, want: `null`},
+	}
+	for _, tt := range tests {
+		got, err := tt.payload.dataJSON()
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: dataJSON = %s, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Package buildinfo describes a running binary: the release, commit, and
+// build date that cmd/release stamps into it with
+//
+//	-ldflags "-X main.version=v1.2.3 -X main.commit=<sha> -X main.date=<RFC 3339>"
+//
+// falling back to what the Go toolchain records for a plain go build.
+package buildinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Info is a binary's version information, as served at /version
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// Read completes the values a main package was built with. An empty
+// commit or date is taken from the VCS stamp go build adds in a checkout.
+func Read(version, commit, date string) Info {
+	info := Info{
+		Version:   version,
+		Commit:    commit,
+		Date:      date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.Date == "":
+				info.Date = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// String is the one-line form printed by --version, e.g.
+// "v1.2.3 (commit 1a2b3c4d5e6f, built 2026-10-16T09:00:00Z, go1.21.0 linux/amd64)"
+func (i Info) String() string {
+	s := i.Version + " ("
+	if i.Commit != "" {
+		commit := i.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		s += "commit " + commit + ", "
+	}
+	if i.Date != "" {
+		s += "built " + i.Date + ", "
+	}
+	return s + fmt.Sprintf("%s %s)", i.GoVersion, i.Platform)
+}
+
+// Handler serves i as JSON
+func Handler(i Info) http.Handler {
+	body, _ := json.Marshal(i)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(body, '\n'))
+	})
+}
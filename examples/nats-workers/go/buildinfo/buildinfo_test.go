@@ -0,0 +1,65 @@
+package buildinfo
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name                  string
+		version, commit, date string
+		want                  Info
+	}{
+		{name: "stamped", version: "v1.2.3", commit: "1a2b3c4d5e6f7a8b", date: "2026-10-16T09:00:00Z",
+			want: Info{Version: "v1.2.3", Commit: "1a2b3c4d5e6f7a8b", Date: "2026-10-16T09:00:00Z"}},
+		// A test binary has no VCS stamp to fall back to
+		{name: "plain go build", want: Info{Version: "dev"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.want.GoVersion, tt.want.Platform = runtime.Version(), runtime.GOOS+"/"+runtime.GOARCH
+			if got := Read(tt.version, tt.commit, tt.date); got != tt.want {
+				t.Fatalf("Read = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		info Info
+		want string
+	}{
+		{Info{Version: "v1.2.3", Commit: "1a2b3c4d5e6f7a8b9c0d", Date: "2026-10-16T09:00:00Z", GoVersion: "go1.21.0", Platform: "linux/amd64"},
+			"v1.2.3 (commit 1a2b3c4d5e6f, built 2026-10-16T09:00:00Z, go1.21.0 linux/amd64)"},
+		{Info{Version: "v1.2.3", Commit: "1a2b3c", GoVersion: "go1.21.0", Platform: "darwin/arm64"},
+			"v1.2.3 (commit 1a2b3c, go1.21.0 darwin/arm64)"},
+		{Info{Version: "dev", GoVersion: "go1.21.0", Platform: "linux/arm64"},
+			"dev (go1.21.0 linux/arm64)"},
+	}
+	for _, tt := range tests {
+		if got := tt.info.String(); got != tt.want {
+			t.Errorf("String = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	info := Info{Version: "v1.2.3", GoVersion: "go1.21.0", Platform: "linux/amd64"}
+	rec := httptest.NewRecorder()
+	Handler(info).ServeHTTP(rec, httptest.NewRequest("GET", "/version", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	// Unknown commit and date are left out
+	if got, want := rec.Body.String(), `{"version":"v1.2.3","go_version":"go1.21.0","platform":"linux/amd64"}`+"\n"; got != want {
+		t.Fatalf("body = %s, want %s", got, want)
+	}
+	var got Info
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got != info {
+		t.Fatalf("decoded %+v, %v", got, err)
+	}
+}
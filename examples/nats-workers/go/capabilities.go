@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+var (
+	capabilityMu sync.RWMutex
+	// capabilityClient holds the functions found by the last discovery;
+	// nil until one succeeds, when every capability is assumed
+	capabilityClient *ruleengine.Client
+	capabilityReport []ruleengine.Capability
+)
+
+func init() {
+	expvar.Publish("capabilities", expvar.Func(func() interface{} {
+		capabilityMu.RLock()
+		defer capabilityMu.RUnlock()
+		return capabilityReport
+	}))
+}
+
+// discoverCapabilities looks up the SQL functions the worker's features
+// call, in the primary and operational databases, and logs the features
+// left off for want of them. It runs on startup and again once the
+// operational schema is applied, if that had to wait; a failed lookup
+// leaves the previous result.
+func discoverCapabilities() {
+	client := ruleengine.New(db)
+	if opsDB != db {
+		client.SetOpsDB(opsDB)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	report, err := client.Capabilities(ctx)
+	if err != nil {
+		log.Printf("⚠️  Failed to discover database capabilities: %v", err)
+		return
+	}
+	for _, c := range report {
+		if !c.Available {
+			log.Printf("⚠️  %s disabled: missing %s", c.Description, strings.Join(c.Missing, ", "))
+		}
+	}
+	capabilityMu.Lock()
+	capabilityClient, capabilityReport = client, report
+	capabilityMu.Unlock()
+}
+
+// hasCapability reports whether the databases have the functions of the
+// named ruleengine capability
+func hasCapability(name string) bool {
+	capabilityMu.RLock()
+	defer capabilityMu.RUnlock()
+	return capabilityClient == nil || capabilityClient.Supports(name)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// useCapabilities makes functions the only SQL functions discovery found,
+// for one test
+func useCapabilities(t *testing.T, functions ...string) {
+	t.Helper()
+	pool, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(`FROM pg_proc`).WillReturnRows(functionRows(functions...))
+	client := ruleengine.New(pool)
+	report, err := client.Capabilities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	capabilityMu.Lock()
+	prevClient, prevReport := capabilityClient, capabilityReport
+	capabilityClient, capabilityReport = client, report
+	capabilityMu.Unlock()
+	t.Cleanup(func() {
+		capabilityMu.Lock()
+		capabilityClient, capabilityReport = prevClient, prevReport
+		capabilityMu.Unlock()
+		pool.Close()
+	})
+}
+
+// assumeCapabilities forgets what discovery found, so every capability
+// is assumed for one test
+func assumeCapabilities(t *testing.T) {
+	t.Helper()
+	capabilityMu.Lock()
+	prevClient, prevReport := capabilityClient, capabilityReport
+	capabilityClient, capabilityReport = nil, nil
+	capabilityMu.Unlock()
+	t.Cleanup(func() {
+		capabilityMu.Lock()
+		capabilityClient, capabilityReport = prevClient, prevReport
+		capabilityMu.Unlock()
+	})
+}
+
+func functionRows(names ...string) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"proname"})
+	for _, name := range names {
+		rows.AddRow(name)
+	}
+	return rows
+}
+
+func TestDiscoverCapabilities(t *testing.T) {
+	primary := mockDB(t)
+	ops := mockOpsDB(t)
+	assumeCapabilities(t)
+
+	// Before discovery every capability is assumed
+	if !hasCapability("consumer_stats") {
+		t.Fatal("consumer_stats not assumed")
+	}
+
+	primary.ExpectQuery(`FROM pg_proc`).WillReturnRows(functionRows("rule_window_record", "rule_window_facts", "rule_window_value", "rule_window_prune"))
+	ops.ExpectQuery(`FROM pg_proc`).WillReturnRows(functionRows("rule_nats_consumer_update_stats"))
+	discoverCapabilities()
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"windows", true},
+		{"consumer_stats", true},
+		{"latency_percentiles", false},
+		{"rule_stats", false},
+	}
+	for _, tt := range tests {
+		if got := hasCapability(tt.name); got != tt.want {
+			t.Errorf("hasCapability(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// A failed lookup keeps what the last one found
+	primary.ExpectQuery(`FROM pg_proc`).WillReturnError(errors.New("connection refused"))
+	discoverCapabilities()
+	if !hasCapability("windows") || hasCapability("rule_stats") {
+		t.Fatal("failed discovery changed the capabilities")
+	}
+	capabilityMu.RLock()
+	defer capabilityMu.RUnlock()
+	if len(capabilityReport) == 0 {
+		t.Fatal("no capabilities reported")
+	}
+}
+
+func TestRollupDeliveryStatsWithoutFunction(t *testing.T) {
+	mockOpsDB(t) // no expectations: the rollup is skipped
+	useCapabilities(t)
+	if err := rollupDeliveryStats(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlushDeliveryStatsWithoutPercentiles(t *testing.T) {
+	resetDeliveryStats(t)
+	resetOpsBuffer(t, 10)
+	ops := mockOpsDB(t)
+	useCapabilities(t)
+	prevStats := config.Stats
+	t.Cleanup(func() { config.Stats = prevStats })
+	config.Stats.Transactional, config.Stats.TenantField, config.Stats.TenantToken = false, "", 0
+
+	recordDelivery(&ActionMessage{dedupKey: "webhook:crm", Payload: &WebhookPayload{}}, outcomeDelivered, 20*time.Millisecond)
+	ops.ExpectExec(`INSERT INTO rule_delivery_stats .* latency_histogram = rule_delivery_stats.latency_histogram$`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "webhook:crm", sqlmock.AnyArg(), int64(1), int64(0), int64(0), int64(0),
+			int64(20), int64(20), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	flushDeliveryStats()
+}
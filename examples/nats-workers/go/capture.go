@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// maxCaptureBody bounds how much of each request and response body a
+// capture keeps
+const maxCaptureBody = 256 << 10
+
+// captureStats counts captured exchanges by outcome
+var captureStats = expvar.NewMap("captures")
+
+var (
+	captureRequestsMu       sync.Mutex
+	captureRequests         map[string]bool
+	captureRequestsLoadedAt time.Time
+)
+
+// webhookCapture records one exchange with a destination for debugging;
+// see rule_webhook_captures
+type webhookCapture struct {
+	m           *ActionMessage
+	dest        *Destination
+	messageID   string
+	destination string
+	start       time.Time
+	exchange    ruleengine.CapturedExchange
+}
+
+// startCapture begins recording req when capture is on for the
+// destination (rule_webhooks.capture_until) or for the message's
+// Nats-Msg-Id or trace ID (rule_capture_requests). It returns nil
+// otherwise; finish is a no-op on nil.
+func startCapture(ctx context.Context, m *ActionMessage, dest *Destination, req *http.Request, body []byte) *webhookCapture {
+	messageID := ""
+	if m.Msg != nil && m.Msg.Header != nil {
+		messageID = m.Msg.Header.Get(nats.MsgIdHdr)
+	}
+	on := dest != nil && dest.CaptureUntil != nil && time.Now().Before(*dest.CaptureUntil)
+	if !on {
+		requested := capturedMessages(ctx)
+		on = requested[m.traceID] || (messageID != "" && requested[messageID])
+	}
+	if !on {
+		return nil
+	}
+
+	c := &webhookCapture{m: m, dest: dest, messageID: messageID, destination: req.URL.Host, start: time.Now()}
+	if dest != nil {
+		c.destination = dest.Name
+	}
+	c.exchange.Request = capturedHTTP(ctx, req.Header, body, len(body) > maxCaptureBody)
+	c.exchange.Request.Method = req.Method
+	c.exchange.Request.URL = req.URL.String()
+	return c
+}
+
+// finish records the response, or the error that stopped the request.
+// Up to maxCaptureBody of the response body is read; resp.Body still
+// yields the whole body afterwards.
+func (c *webhookCapture) finish(ctx context.Context, resp *http.Response, reqErr error) {
+	if c == nil {
+		return
+	}
+	duration := time.Since(c.start)
+
+	var status *int
+	var errText *string
+	if reqErr != nil {
+		text := reqErr.Error()
+		errText = &text
+	}
+	if resp != nil {
+		head, err := io.ReadAll(io.LimitReader(resp.Body, maxCaptureBody+1))
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+		if err != nil {
+			text := "reading the response: " + err.Error()
+			errText = &text
+		}
+		truncated := len(head) > maxCaptureBody
+		if truncated {
+			head = head[:maxCaptureBody]
+		}
+		response := capturedHTTP(ctx, resp.Header, head, truncated)
+		response.Status = resp.StatusCode
+		c.exchange.Response = &response
+		status = &resp.StatusCode
+	}
+
+	stored, err := json.Marshal(c.exchange)
+	if err == nil {
+		stored, err = payloadSealer.Seal(ctx, stored)
+	}
+	if err != nil {
+		captureStats.Add("failed", 1)
+		log.Printf("   ⚠️  [%d %s] Failed to encrypt the captured exchange, not recording it: %v", c.m.num, c.m.traceID, err)
+		return
+	}
+
+	var webhookID *int
+	if c.dest != nil {
+		webhookID = &c.dest.ID
+	}
+	subject := ""
+	if c.m.Msg != nil {
+		subject = c.m.Msg.Subject
+	}
+	traceID := sql.NullString{String: c.m.traceID, Valid: c.m.traceID != ""}
+	messageID := sql.NullString{String: c.messageID, Valid: c.messageID != ""}
+	err = auditInsert("rule_webhook_captures",
+		[]string{"webhook_id", "destination", "trace_id", "message_id", "subject", "status", "duration_ms", "error", "exchange"},
+		webhookID, c.destination, traceID, messageID, subject, status, duration.Milliseconds(), errText, string(stored),
+	)
+	if err != nil && !errors.Is(err, errOpsBuffered) {
+		captureStats.Add("failed", 1)
+		log.Printf("   ⚠️  [%d %s] Failed to record the captured exchange: %v", c.m.num, c.m.traceID, err)
+		return
+	}
+	captureStats.Add("recorded", 1)
+}
+
+// capturedHTTP is headers and body as a capture stores them: credentials
+// redacted, the scrub rules applied, and binary bodies base64 encoded.
+// A truncated body is not valid JSON and cannot be scrubbed, so it is
+// dropped while scrub rules are in force.
+func capturedHTTP(ctx context.Context, header http.Header, body []byte, truncated bool) ruleengine.CapturedHTTP {
+	h := ruleengine.CapturedHTTP{Headers: http.Header{}, Truncated: truncated}
+	for name, values := range header {
+		if redactedHeader(name) {
+			values = []string{scrubMask}
+		}
+		h.Headers[name] = values
+	}
+	if truncated && len(body) > maxCaptureBody {
+		body = body[:maxCaptureBody]
+	}
+
+	if truncated {
+		if rules, err := getScrubRules(ctx); err != nil || len(rules) > 0 {
+			return h
+		}
+	} else if scrubbed, err := scrubPayload(ctx, body); err != nil {
+		return h
+	} else {
+		body = scrubbed
+	}
+	if utf8.Valid(body) {
+		h.Body = string(body)
+	} else {
+		h.Body, h.Encoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return h
+}
+
+// redactedHeader reports whether a header may carry credentials. The
+// Idempotency-Key the worker sets is kept; it identifies the delivery.
+func redactedHeader(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "authorization", "proxy-authorization", "cookie", "set-cookie":
+		return true
+	case "idempotency-key":
+		return false
+	}
+	for _, word := range []string{"key", "token", "secret", "signature", "password"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// capturedMessages returns the message and trace IDs whose deliveries are
+// captured, reading them from the operational database at most once per
+// destinationCacheTTL. If it is unavailable the last IDs read are kept;
+// before it is opened there are none.
+func capturedMessages(ctx context.Context) map[string]bool {
+	captureRequestsMu.Lock()
+	defer captureRequestsMu.Unlock()
+	if opsDB == nil || (!captureRequestsLoadedAt.IsZero() && time.Since(captureRequestsLoadedAt) < destinationCacheTTL) {
+		return captureRequests
+	}
+	// Try again no sooner than the TTL either way
+	captureRequestsLoadedAt = time.Now()
+
+	if err := ensureOpsReady(); err != nil {
+		return captureRequests
+	}
+	ctx, cancel := context.WithTimeout(ctx, opsWriteTimeout)
+	defer cancel()
+	rows, err := opsDB.QueryContext(ctx, `SELECT message_id FROM rule_capture_requests WHERE expires_at > CURRENT_TIMESTAMP`)
+	if err != nil {
+		return captureRequests
+	}
+	defer rows.Close()
+
+	ids := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return captureRequests
+		}
+		ids[id] = true
+	}
+	if rows.Err() == nil {
+		captureRequests = ids
+	}
+	return captureRequests
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// useCaptureRequests installs ids in the capture request cache for one test
+func useCaptureRequests(t *testing.T, ids ...string) {
+	t.Helper()
+	requested := map[string]bool{}
+	for _, id := range ids {
+		requested[id] = true
+	}
+	captureRequestsMu.Lock()
+	prev, prevAt := captureRequests, captureRequestsLoadedAt
+	captureRequests, captureRequestsLoadedAt = requested, time.Now()
+	captureRequestsMu.Unlock()
+	t.Cleanup(func() {
+		captureRequestsMu.Lock()
+		captureRequests, captureRequestsLoadedAt = prev, prevAt
+		captureRequestsMu.Unlock()
+	})
+}
+
+// captureCount returns the captures counter for outcome
+func captureCount(outcome string) int64 {
+	if v, ok := captureStats.Get(outcome).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestRedactedHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Authorization", true},
+		{"proxy-authorization", true},
+		{"Cookie", true},
+		{"Set-Cookie", true},
+		{"X-Api-Key", true},
+		{"X-Auth-Token", true},
+		{"X-Webhook-Signature", true},
+		{"X-Client-Secret", true},
+		{"Idempotency-Key", false},
+		{"Content-Type", false},
+		{"X-Trace-Id", false},
+	}
+	for _, tt := range tests {
+		if got := redactedHeader(tt.name); got != tt.want {
+			t.Errorf("redactedHeader(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCapturedHTTP(t *testing.T) {
+	long := []byte(`{"data":{"ssn":"` + strings.Repeat("1", maxCaptureBody) + `"}}`)
+	tests := []struct {
+		name      string
+		rules     bool // $.data.ssn is masked
+		header    http.Header
+		body      []byte
+		truncated bool
+		want      ruleengine.CapturedHTTP
+	}{
+		{name: "headers redacted",
+			header: http.Header{"Authorization": {"Bearer abc"}, "Idempotency-Key": {"k-1"}, "Content-Type": {"application/json"}},
+			body:   []byte(`{"ok":true}`),
+			want: ruleengine.CapturedHTTP{Body: `{"ok":true}`,
+				Headers: http.Header{"Authorization": {scrubMask}, "Idempotency-Key": {"k-1"}, "Content-Type": {"application/json"}}}},
+		{name: "scrubbed", rules: true, body: []byte(`{"data":{"ssn":"123-45-6789"}}`),
+			want: ruleengine.CapturedHTTP{Headers: http.Header{}, Body: `{"data":{"ssn":"` + scrubMask + `"}}`}},
+		{name: "binary", body: []byte{0xff, 0xfe, 0x00},
+			want: ruleengine.CapturedHTTP{Headers: http.Header{}, Body: "//4A", Encoding: "base64"}},
+		{name: "truncated", body: long, truncated: true,
+			want: ruleengine.CapturedHTTP{Headers: http.Header{}, Body: string(long[:maxCaptureBody]), Truncated: true}},
+		// A truncated body can't be scrubbed, so none is kept
+		{name: "truncated with scrub rules", rules: true, body: long, truncated: true,
+			want: ruleengine.CapturedHTTP{Headers: http.Header{}, Truncated: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.rules {
+				setScrubRules(t, map[string]string{"$.data.ssn": "mask"}, "$.data.ssn")
+			} else {
+				setScrubRules(t, map[string]string{})
+			}
+			got := capturedHTTP(context.Background(), tt.header, tt.body, tt.truncated)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("captured %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartCapture(t *testing.T) {
+	setScrubRules(t, map[string]string{})
+	useCaptureRequests(t, "trace-7", "msg-8")
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+	tests := []struct {
+		name      string
+		dest      *Destination
+		traceID   string
+		messageID string
+		want      bool
+	}{
+		{name: "destination captured", dest: &Destination{ID: 3, Name: "crm", CaptureUntil: &future}, want: true},
+		{name: "destination capture ended", dest: &Destination{ID: 3, Name: "crm", CaptureUntil: &past}},
+		{name: "not captured", dest: &Destination{ID: 3, Name: "crm"}, traceID: "trace-1", messageID: "msg-1"},
+		{name: "trace requested", traceID: "trace-7", want: true},
+		{name: "message requested", dest: &Destination{ID: 3, Name: "crm"}, traceID: "trace-1", messageID: "msg-8", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &nats.Msg{Subject: "webhooks.orders", Header: nats.Header{}}
+			if tt.messageID != "" {
+				msg.Header.Set(nats.MsgIdHdr, tt.messageID)
+			}
+			m := &ActionMessage{Msg: msg, traceID: tt.traceID}
+			req := httptest.NewRequest(http.MethodPost, "https://hooks.example.com/orders?v=2", nil)
+			req.Header.Set("X-Api-Key", "secret")
+			c := startCapture(context.Background(), m, tt.dest, req, []byte(`{"order":1}`))
+			if (c != nil) != tt.want {
+				t.Fatalf("captured = %v, want %v", c != nil, tt.want)
+			}
+			if c == nil {
+				return
+			}
+			wantDest := "hooks.example.com"
+			if tt.dest != nil {
+				wantDest = tt.dest.Name
+			}
+			r := c.exchange.Request
+			if c.destination != wantDest || c.messageID != tt.messageID || r.Method != "POST" ||
+				r.URL != "https://hooks.example.com/orders?v=2" || r.Body != `{"order":1}` || r.Headers.Get("X-Api-Key") != scrubMask {
+				t.Fatalf("capture = %+v", c)
+			}
+		})
+	}
+}
+
+func TestCaptureFinish(t *testing.T) {
+	setScrubRules(t, map[string]string{})
+	const insert = `INSERT INTO rule_webhook_captures \(webhook_id, destination, trace_id, message_id, subject, status, duration_ms, error, exchange\)`
+	status := 502
+	tests := []struct {
+		name     string
+		dest     *Destination
+		resp     *http.Response
+		reqErr   error
+		insert   error
+		webhook  interface{}
+		status   interface{}
+		errText  interface{}
+		response *ruleengine.CapturedHTTP
+		outcome  string
+	}{
+		{name: "response", dest: &Destination{ID: 3, Name: "crm"},
+			resp: &http.Response{StatusCode: 502, Header: http.Header{"Set-Cookie": {"s=1"}},
+				Body: io.NopCloser(strings.NewReader(`{"error":"upstream"}`))},
+			webhook: 3, status: &status, errText: (*string)(nil),
+			response: &ruleengine.CapturedHTTP{Status: 502, Headers: http.Header{"Set-Cookie": {scrubMask}}, Body: `{"error":"upstream"}`},
+			outcome:  "recorded"},
+		{name: "no response", reqErr: errors.New("dial tcp: connection refused"),
+			webhook: (*int)(nil), status: (*int)(nil), errText: "dial tcp: connection refused",
+			outcome: "recorded"},
+		{name: "insert fails", reqErr: errors.New("timeout"), insert: errors.New("permission denied"),
+			webhook: (*int)(nil), status: (*int)(nil), errText: "timeout",
+			outcome: "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := mockOpsDB(t)
+			m := &ActionMessage{Msg: &nats.Msg{Subject: "webhooks.orders"}, traceID: "trace-7"}
+			c := &webhookCapture{m: m, dest: tt.dest, destination: "crm", start: time.Now(),
+				exchange: ruleengine.CapturedExchange{Request: ruleengine.CapturedHTTP{Method: "POST", URL: "https://crm.example.com", Headers: http.Header{}}}}
+			want, _ := json.Marshal(ruleengine.CapturedExchange{Request: c.exchange.Request, Response: tt.response})
+
+			exec := ops.ExpectExec(insert).WithArgs(tt.webhook, "crm", sql.NullString{String: "trace-7", Valid: true},
+				sql.NullString{}, "webhooks.orders", tt.status, sqlmock.AnyArg(), tt.errText, string(want))
+			if tt.insert != nil {
+				exec.WillReturnError(tt.insert)
+			} else {
+				exec.WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			before := captureCount(tt.outcome)
+			c.finish(context.Background(), tt.resp, tt.reqErr)
+			if got := captureCount(tt.outcome) - before; got != 1 {
+				t.Fatalf("%s count went up by %d, want 1", tt.outcome, got)
+			}
+			if tt.resp != nil {
+				// The delivery still reads the whole body
+				if body, _ := io.ReadAll(tt.resp.Body); string(body) != `{"error":"upstream"}` {
+					t.Fatalf("body after capture = %q", body)
+				}
+			}
+		})
+	}
+
+	// Not capturing
+	var c *webhookCapture
+	c.finish(context.Background(), nil, nil)
+}
+
+func TestCapturedMessages(t *testing.T) {
+	ops := mockOpsDB(t)
+	captureRequestsMu.Lock()
+	prev, prevAt := captureRequests, captureRequestsLoadedAt
+	captureRequests, captureRequestsLoadedAt = nil, time.Time{}
+	captureRequestsMu.Unlock()
+	t.Cleanup(func() {
+		captureRequestsMu.Lock()
+		captureRequests, captureRequestsLoadedAt = prev, prevAt
+		captureRequestsMu.Unlock()
+	})
+
+	ops.ExpectQuery(`SELECT message_id FROM rule_capture_requests WHERE expires_at > CURRENT_TIMESTAMP`).
+		WillReturnRows(sqlmock.NewRows([]string{"message_id"}).AddRow("msg-8").AddRow("trace-7"))
+	want := map[string]bool{"msg-8": true, "trace-7": true}
+	if got := capturedMessages(context.Background()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("captured = %v, want %v", got, want)
+	}
+	// Cached: no second query
+	if got := capturedMessages(context.Background()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("captured = %v, want %v", got, want)
+	}
+
+	// When the reload fails the last IDs are kept
+	captureRequestsMu.Lock()
+	captureRequestsLoadedAt = time.Now().Add(-2 * destinationCacheTTL)
+	captureRequestsMu.Unlock()
+	ops.ExpectQuery(`FROM rule_capture_requests`).WillReturnError(errors.New("connection refused"))
+	if got := capturedMessages(context.Background()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("captured = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+)
+
+// cdcStats counts row changes read from the replication slot
+var cdcStats = expvar.NewMap("cdc_changes")
+
+// cdcTableHeader carries the schema-qualified table a change came from
+const cdcTableHeader = "Rule-Cdc-Table"
+
+// cdcSlotName matches the names Postgres allows for replication slots
+var cdcSlotName = regexp.MustCompile(`^[a-z0-9_]{1,63}$`)
+
+// pgEpoch is the zero of the timestamps in pgoutput messages
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	// cdcDB is the database whose changes are captured: CDC_DATABASE_URL,
+	// or the worker's own database
+	cdcDB *sql.DB
+
+	// cdcTables are the captured tables by schema.table
+	cdcTables map[string]cdcTable
+
+	// cdcSlotReady is set once the slot (and publication) are known to exist
+	cdcSlotReady bool
+)
+
+// cdcTable is a table whose row changes are published
+type cdcTable struct {
+	schema string
+	name   string
+	action string // sent as Rule-Action, so the worker delivers the change
+}
+
+func (t cdcTable) qualified() string {
+	return t.schema + "." + t.name
+}
+
+// parseCDCTables parses CDC_TABLES, a comma-separated list of
+// [schema.]table[@action] entries such as "public.orders@order_changed".
+// The schema defaults to public.
+func parseCDCTables(value string) ([]cdcTable, error) {
+	var tables []cdcTable
+	seen := make(map[string]bool)
+	for _, item := range splitList(value) {
+		name, action, _ := strings.Cut(item, "@")
+		schema, table, ok := strings.Cut(strings.TrimSpace(name), ".")
+		if !ok {
+			schema, table = "public", schema
+		}
+		if schema == "" || table == "" || strings.Contains(table, ".") {
+			return nil, fmt.Errorf("must look like public.orders@order_changed, got %q", item)
+		}
+		t := cdcTable{schema: schema, name: table, action: strings.TrimSpace(action)}
+		if seen[t.qualified()] {
+			return nil, fmt.Errorf("%s is listed twice", t.qualified())
+		}
+		seen[t.qualified()] = true
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+// initCDC registers the task that captures changes to CDC_TABLES on the
+// leader. Only one worker may read a replication slot.
+func initCDC() error {
+	if config.CDC.Tables == "" {
+		return nil
+	}
+	tables, _ := parseCDCTables(config.CDC.Tables) // checked by validateConfig
+	cdcTables = make(map[string]cdcTable, len(tables))
+	for _, t := range tables {
+		cdcTables[t.qualified()] = t
+	}
+	cdcDB = db
+	if config.CDC.DatabaseURL != "" {
+		pool, err := openPostgres(config.CDC.DatabaseURL)
+		if err != nil {
+			return fmt.Errorf("invalid CDC_DATABASE_URL: %w", err)
+		}
+		pool.SetMaxOpenConns(2)
+		cdcDB = pool
+	}
+	registerSingleton("cdc", time.Duration(config.CDC.PollIntervalMs)*time.Millisecond, pollCDC)
+	log.Printf("🧬 Capturing changes to %d table(s) through slot %s (%s)", len(tables), config.CDC.Slot, config.CDC.Plugin)
+	return nil
+}
+
+// cdcChange is the message published for one row change
+type cdcChange struct {
+	Op     string                 `json:"op"` // insert, update, delete, or truncate
+	Schema string                 `json:"schema"`
+	Table  string                 `json:"table"`
+	New    map[string]interface{} `json:"new,omitempty"`
+
+	// Old is the replica identity (the primary key by default) for
+	// deletes, and for updates that change it or with REPLICA IDENTITY FULL
+	Old map[string]interface{} `json:"old,omitempty"`
+
+	XID        uint32    `json:"xid"`
+	LSN        string    `json:"lsn"` // the end of the commit record
+	CommitTime time.Time `json:"commit_time"`
+}
+
+// pollCDC publishes the changes committed since the slot's position, then
+// moves the slot past them. A worker that stops between the two publishes
+// the changes again under the same Nats-Msg-Id, so JetStream's duplicate
+// window drops them.
+func pollCDC(ctx context.Context) error {
+	if !cdcSlotReady {
+		if err := ensureCDCSlot(ctx); err != nil {
+			return err
+		}
+		cdcSlotReady = true
+	}
+	for {
+		rows, err := captureCDCBatch(ctx)
+		if err != nil || rows < config.CDC.BatchSize {
+			return err
+		}
+	}
+}
+
+// ensureCDCSlot creates the replication slot and, for pgoutput, the
+// publication when they do not exist
+func ensureCDCSlot(ctx context.Context) error {
+	if config.CDC.Plugin == "pgoutput" {
+		var exists bool
+		if err := cdcDB.QueryRowContext(ctx,
+			`SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)`, config.CDC.Publication,
+		).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			names := make([]string, 0, len(cdcTables))
+			for _, t := range cdcTables {
+				names = append(names, pq.QuoteIdentifier(t.schema)+"."+pq.QuoteIdentifier(t.name))
+			}
+			stmt := "CREATE PUBLICATION " + pq.QuoteIdentifier(config.CDC.Publication) + " FOR TABLE " + strings.Join(names, ", ")
+			if _, err := cdcDB.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("publication %s does not exist and could not be created, have the table owner run %q: %w",
+					config.CDC.Publication, stmt, err)
+			}
+			log.Printf("🧬 Created publication %s", config.CDC.Publication)
+		}
+	}
+
+	var plugin string
+	err := cdcDB.QueryRowContext(ctx,
+		`SELECT plugin FROM pg_replication_slots WHERE slot_name = $1`, config.CDC.Slot,
+	).Scan(&plugin)
+	switch {
+	case err == sql.ErrNoRows:
+		if _, err := cdcDB.ExecContext(ctx,
+			`SELECT pg_create_logical_replication_slot($1, $2)`, config.CDC.Slot, config.CDC.Plugin,
+		); err != nil {
+			return fmt.Errorf("failed to create replication slot %s (requires wal_level = logical and the REPLICATION attribute): %w",
+				config.CDC.Slot, err)
+		}
+		log.Printf("🧬 Created replication slot %s; changes committed from now on are captured", config.CDC.Slot)
+	case err != nil:
+		return err
+	case plugin != config.CDC.Plugin:
+		return fmt.Errorf("replication slot %s uses %s, not CDC_PLUGIN=%s", config.CDC.Slot, plugin, config.CDC.Plugin)
+	}
+	return nil
+}
+
+// captureCDCBatch reads up to CDC_BATCH_SIZE rows (rounded up to whole
+// transactions) from the slot without consuming them, publishes their
+// changes, and advances the slot past the transactions published. It
+// returns the number of rows read.
+func captureCDCBatch(ctx context.Context) (int, error) {
+	var query string
+	var args []interface{}
+	if config.CDC.Plugin == "wal2json" {
+		filter := make([]string, 0, len(cdcTables))
+		for _, t := range cdcTables {
+			filter = append(filter, wal2jsonEscape(t.schema)+"."+wal2jsonEscape(t.name))
+		}
+		query = `SELECT lsn::text, data FROM pg_logical_slot_peek_changes($1, NULL, $2,
+			'format-version', '2', 'include-xids', '1', 'include-timestamp', '1', 'add-tables', $3)`
+		args = []interface{}{config.CDC.Slot, config.CDC.BatchSize, strings.Join(filter, ",")}
+	} else {
+		query = `SELECT lsn::text, data FROM pg_logical_slot_peek_binary_changes($1, NULL, $2,
+			'proto_version', '1', 'publication_names', $3)`
+		args = []interface{}{config.CDC.Slot, config.CDC.BatchSize, config.CDC.Publication}
+	}
+
+	rows, err := cdcDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	type txn struct {
+		changes []cdcChange
+		end     string
+	}
+	var txns []txn
+	r := &cdcReader{relations: make(map[uint32]*pgRelation)}
+	n := 0
+	for rows.Next() {
+		var lsn string
+		var data []byte
+		if err := rows.Scan(&lsn, &data); err != nil {
+			return n, err
+		}
+		n++
+		var commit bool
+		if config.CDC.Plugin == "wal2json" {
+			commit, err = r.wal2json(data)
+		} else {
+			commit, err = r.pgoutput(data)
+		}
+		if err != nil {
+			// The slot stays put, so the change is not lost
+			return n, fmt.Errorf("failed to decode change at %s: %w", lsn, err)
+		}
+		if commit {
+			txns = append(txns, txn{changes: r.commit(lsn), end: lsn})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	rows.Close()
+
+	published := ""
+	for _, t := range txns {
+		for i := range t.changes {
+			if err := publishCDCChange(ctx, &t.changes[i], i); err != nil {
+				cdcStats.Add("failed", 1)
+				return n, advanceCDCSlot(ctx, published, err)
+			}
+			cdcStats.Add("published", 1)
+		}
+		published = t.end
+	}
+	return n, advanceCDCSlot(ctx, published, nil)
+}
+
+// advanceCDCSlot confirms the changes up to lsn, letting Postgres recycle
+// the WAL before it. failed, the publish error if any, is returned.
+func advanceCDCSlot(ctx context.Context, lsn string, failed error) error {
+	if lsn == "" {
+		return failed
+	}
+	if _, err := cdcDB.ExecContext(ctx,
+		`SELECT pg_replication_slot_advance($1, $2::pg_lsn)`, config.CDC.Slot, lsn,
+	); err != nil && failed == nil {
+		return err
+	}
+	return failed
+}
+
+// publishCDCChange publishes the seq'th change of a transaction to
+// CDC_SUBJECT_PREFIX.<schema>.<table>.<op>
+func publishCDCChange(ctx context.Context, change *cdcChange, seq int) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	table := cdcTables[change.Schema+"."+change.Table]
+	out := nats.NewMsg(strings.Join([]string{
+		config.CDC.SubjectPrefix, subjectToken(change.Schema), subjectToken(change.Table), change.Op,
+	}, "."))
+	out.Data = body
+	out.Header.Set(nats.MsgIdHdr, fmt.Sprintf("cdc:%s:%s:%d", config.CDC.Slot, change.LSN, seq))
+	out.Header.Set(cdcTableHeader, table.qualified())
+	if table.action != "" {
+		out.Header.Set(actionHeader, table.action)
+	}
+
+	if _, err := jetStream.PublishMsg(out, nats.Context(ctx)); errors.Is(err, nats.ErrNoStreamResponse) {
+		return natsConn.PublishMsg(out)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// cdcReader turns the rows a slot returns into changes, collecting each
+// transaction's changes until its commit
+type cdcReader struct {
+	relations  map[uint32]*pgRelation // pgoutput sends each once per read
+	pending    []cdcChange
+	xid        uint32
+	commitTime time.Time
+}
+
+// add queues a change to a captured table; other tables are skipped
+func (r *cdcReader) add(op, schema, table string, newRow, oldRow map[string]interface{}) {
+	if _, ok := cdcTables[schema+"."+table]; !ok {
+		cdcStats.Add("skipped", 1)
+		return
+	}
+	r.pending = append(r.pending, cdcChange{Op: op, Schema: schema, Table: table, New: newRow, Old: oldRow})
+}
+
+// commit returns the transaction's changes, stamped with its commit
+func (r *cdcReader) commit(lsn string) []cdcChange {
+	changes := r.pending
+	for i := range changes {
+		changes[i].XID, changes[i].LSN, changes[i].CommitTime = r.xid, lsn, r.commitTime
+	}
+	r.pending = nil
+	return changes
+}
+
+// wal2json decodes one format-version 2 row, reporting whether it was a
+// commit
+func (r *cdcReader) wal2json(data []byte) (bool, error) {
+	type column struct {
+		Name  string      `json:"name"`
+		Value interface{} `json:"value"`
+	}
+	var row struct {
+		Action    string   `json:"action"`
+		XID       uint32   `json:"xid"`
+		Timestamp string   `json:"timestamp"`
+		Schema    string   `json:"schema"`
+		Table     string   `json:"table"`
+		Columns   []column `json:"columns"`
+		Identity  []column `json:"identity"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&row); err != nil {
+		return false, err
+	}
+	values := func(columns []column) map[string]interface{} {
+		if columns == nil {
+			return nil
+		}
+		m := make(map[string]interface{}, len(columns))
+		for _, c := range columns {
+			m[c.Name] = c.Value
+		}
+		return m
+	}
+
+	switch row.Action {
+	case "B":
+		r.xid, r.commitTime = row.XID, parsePGTimestamp(row.Timestamp)
+	case "C":
+		if t := parsePGTimestamp(row.Timestamp); !t.IsZero() {
+			r.commitTime = t
+		}
+		return true, nil
+	case "I":
+		r.add("insert", row.Schema, row.Table, values(row.Columns), nil)
+	case "U":
+		r.add("update", row.Schema, row.Table, values(row.Columns), values(row.Identity))
+	case "D":
+		r.add("delete", row.Schema, row.Table, nil, values(row.Identity))
+	case "T":
+		r.add("truncate", row.Schema, row.Table, nil, nil)
+	}
+	// M (logical decoding messages) carry no row changes
+	return false, nil
+}
+
+// wal2jsonEscape escapes the characters add-tables treats specially
+func wal2jsonEscape(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		if strings.ContainsRune(`,.*\ `, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// parsePGTimestamp parses a timestamptz in Postgres' text format, returning
+// the zero time when it cannot
+func parsePGTimestamp(s string) time.Time {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999-07", "2006-01-02 15:04:05.999999-07:00"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// pgRelation describes a table, as sent in a pgoutput Relation message
+type pgRelation struct {
+	schema  string
+	name    string
+	columns []pgColumn
+}
+
+type pgColumn struct {
+	name    string
+	typeOID uint32
+}
+
+// pgoutput decodes one protocol version 1 message, reporting whether it
+// was a commit
+func (r *cdcReader) pgoutput(data []byte) (bool, error) {
+	m := &pgMessage{b: data}
+	kind := m.byte1()
+	if m.err != nil {
+		return false, m.err
+	}
+	switch kind {
+	case 'B':
+		m.int64() // final LSN
+		r.commitTime = pgEpoch.Add(time.Duration(m.int64()) * time.Microsecond)
+		r.xid = m.uint32()
+	case 'C':
+		return true, m.err
+	case 'R':
+		id := m.uint32()
+		rel := &pgRelation{schema: m.cstring(), name: m.cstring()}
+		m.byte1() // replica identity setting
+		n := int(m.int16())
+		for i := 0; i < n && m.err == nil; i++ {
+			m.byte1() // flags
+			col := pgColumn{name: m.cstring(), typeOID: m.uint32()}
+			m.uint32() // type modifier
+			rel.columns = append(rel.columns, col)
+		}
+		r.relations[id] = rel
+	case 'I', 'U', 'D':
+		rel, ok := r.relations[m.uint32()]
+		if !ok {
+			return false, errors.New("change to a relation that was not described")
+		}
+		var newRow, oldRow map[string]interface{}
+		for m.err == nil && len(m.b) > 0 {
+			switch tag := m.byte1(); tag {
+			case 'N':
+				newRow = m.tuple(rel)
+			case 'K', 'O':
+				oldRow = m.tuple(rel)
+			default:
+				return false, fmt.Errorf("unexpected tuple tag %q", tag)
+			}
+		}
+		op := map[byte]string{'I': "insert", 'U': "update", 'D': "delete"}[kind]
+		r.add(op, rel.schema, rel.name, newRow, oldRow)
+	case 'T':
+		n := int(m.uint32())
+		m.byte1() // CASCADE / RESTART IDENTITY
+		for i := 0; i < n && m.err == nil; i++ {
+			if rel, ok := r.relations[m.uint32()]; ok {
+				r.add("truncate", rel.schema, rel.name, nil, nil)
+			}
+		}
+	case 'O', 'Y', 'M':
+		// Origin, type, and logical decoding messages carry no row changes
+	default:
+		return false, fmt.Errorf("unknown pgoutput message %q", kind)
+	}
+	return false, m.err
+}
+
+// pgMessage reads the fields of a pgoutput message. The first read past
+// the end sets err; later reads return zero values.
+type pgMessage struct {
+	b   []byte
+	err error
+}
+
+func (m *pgMessage) next(n int) []byte {
+	if m.err != nil {
+		return make([]byte, n)
+	}
+	if len(m.b) < n {
+		m.err = errors.New("truncated pgoutput message")
+		return make([]byte, n)
+	}
+	b := m.b[:n]
+	m.b = m.b[n:]
+	return b
+}
+
+func (m *pgMessage) byte1() byte    { return m.next(1)[0] }
+func (m *pgMessage) int16() int16   { return int16(binary.BigEndian.Uint16(m.next(2))) }
+func (m *pgMessage) uint32() uint32 { return binary.BigEndian.Uint32(m.next(4)) }
+func (m *pgMessage) int64() int64   { return int64(binary.BigEndian.Uint64(m.next(8))) }
+
+func (m *pgMessage) cstring() string {
+	if m.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(m.b, 0)
+	if i < 0 {
+		m.err = errors.New("truncated pgoutput message")
+		return ""
+	}
+	s := string(m.b[:i])
+	m.b = m.b[i+1:]
+	return s
+}
+
+// tuple reads TupleData as a row keyed by column name. Unchanged TOASTed
+// values are not sent, so their columns are left out.
+func (m *pgMessage) tuple(rel *pgRelation) map[string]interface{} {
+	n := int(m.int16())
+	row := make(map[string]interface{}, n)
+	for i := 0; i < n && m.err == nil; i++ {
+		col := pgColumn{name: fmt.Sprintf("column%d", i+1)}
+		if i < len(rel.columns) {
+			col = rel.columns[i]
+		}
+		switch kind := m.byte1(); kind {
+		case 'n':
+			row[col.name] = nil
+		case 'u':
+		case 't':
+			row[col.name] = pgTextValue(col.typeOID, string(m.next(int(m.uint32()))))
+		default:
+			m.err = fmt.Errorf("unknown tuple value kind %q", kind)
+		}
+	}
+	return row
+}
+
+// pgTextValue converts a column's text representation to JSON: booleans,
+// numbers, and json/jsonb keep their type, everything else is a string
+func pgTextValue(typeOID uint32, s string) interface{} {
+	switch typeOID {
+	case 16: // bool
+		return s == "t"
+	case 20, 21, 23, 26, 700, 701, 1700: // int8, int2, int4, oid, float4, float8, numeric
+		if json.Valid([]byte(s)) {
+			return json.Number(s) // NaN and Infinity stay strings
+		}
+	case 114, 3802: // json, jsonb
+		if json.Valid([]byte(s)) {
+			return json.RawMessage(s)
+		}
+	}
+	return s
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+)
+
+// useCDC captures tables (a CDC_TABLES value) through plugin for one test
+func useCDC(t *testing.T, plugin, tables string) {
+	t.Helper()
+	parsed, err := parseCDCTables(tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev, prevTables, prevDB := config.CDC, cdcTables, cdcDB
+	config.CDC.Plugin, config.CDC.Slot, config.CDC.Publication = plugin, "rule_engine_cdc", "rule_engine_cdc"
+	config.CDC.SubjectPrefix, config.CDC.BatchSize = "cdc", 100
+	cdcTables = make(map[string]cdcTable)
+	for _, tbl := range parsed {
+		cdcTables[tbl.qualified()] = tbl
+	}
+	t.Cleanup(func() { config.CDC, cdcTables, cdcDB = prev, prevTables, prevDB })
+}
+
+func cdcCount(key string) int64 {
+	if v, ok := cdcStats.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// pgoutputMsg builds a pgoutput protocol version 1 message
+type pgoutputMsg struct{ bytes.Buffer }
+
+func newPGOutput(kind byte) *pgoutputMsg {
+	m := &pgoutputMsg{}
+	m.WriteByte(kind)
+	return m
+}
+
+func (m *pgoutputMsg) u8(b byte) *pgoutputMsg { m.WriteByte(b); return m }
+func (m *pgoutputMsg) i16(n int) *pgoutputMsg {
+	binary.Write(m, binary.BigEndian, int16(n))
+	return m
+}
+func (m *pgoutputMsg) u32(n uint32) *pgoutputMsg {
+	binary.Write(m, binary.BigEndian, n)
+	return m
+}
+func (m *pgoutputMsg) i64(n int64) *pgoutputMsg {
+	binary.Write(m, binary.BigEndian, n)
+	return m
+}
+func (m *pgoutputMsg) str(s string) *pgoutputMsg { m.WriteString(s); m.WriteByte(0); return m }
+
+// tuple writes TupleData: nil is 'n', "\x00u" is 'u' (unchanged TOAST),
+// anything else 't' with its text
+func (m *pgoutputMsg) tuple(values ...interface{}) *pgoutputMsg {
+	m.i16(len(values))
+	for _, v := range values {
+		switch v {
+		case nil:
+			m.u8('n')
+		case "\x00u":
+			m.u8('u')
+		default:
+			s := v.(string)
+			m.u8('t').u32(uint32(len(s)))
+			m.WriteString(s)
+		}
+	}
+	return m
+}
+
+// relationMsg describes public.<name> with id, status, paid, meta, and
+// total columns
+func relationMsg(id uint32, name string) []byte {
+	m := newPGOutput('R').u32(id).str("public").str(name).u8('d').i16(5)
+	for _, c := range []struct {
+		name string
+		oid  uint32
+	}{{"id", 23}, {"status", 25}, {"paid", 16}, {"meta", 3802}, {"total", 1700}} {
+		m.u8(0).str(c.name).u32(c.oid).u32(0xffffffff)
+	}
+	return m.Bytes()
+}
+
+func TestParseCDCTables(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []cdcTable
+		wantErr string
+	}{
+		{value: ""},
+		{value: "public.orders@order_changed, sales.items ,users",
+			want: []cdcTable{
+				{schema: "public", name: "orders", action: "order_changed"},
+				{schema: "sales", name: "items"},
+				{schema: "public", name: "users"},
+			}},
+		{value: "orders, public.orders", wantErr: "public.orders is listed twice"},
+		{value: "a.b.c", wantErr: `must look like public.orders@order_changed, got "a.b.c"`},
+		{value: ".orders", wantErr: `must look like public.orders@order_changed, got ".orders"`},
+		{value: "@notify", wantErr: `must look like public.orders@order_changed, got "@notify"`},
+	}
+	for _, tt := range tests {
+		got, err := parseCDCTables(tt.value)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%q: err = %v, want %q", tt.value, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q = %+v, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestCDCReaderPGOutput(t *testing.T) {
+	useCDC(t, "pgoutput", "public.orders@order_changed")
+	commitTime := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	skipped := cdcCount("skipped")
+
+	messages := [][]byte{
+		newPGOutput('B').i64(0x16B3748).i64(commitTime.Sub(pgEpoch).Microseconds()).u32(7).Bytes(),
+		relationMsg(16384, "orders"),
+		relationMsg(16385, "audit"),
+		newPGOutput('I').u32(16384).u8('N').tuple("1", "new", "f", `{"a": 1}`, "NaN").Bytes(),
+		newPGOutput('I').u32(16385).u8('N').tuple("9", "x", "t", nil, "1").Bytes(),
+		newPGOutput('U').u32(16384).u8('O').tuple("1", "new", "f", `{"a": 1}`, "NaN").
+			u8('N').tuple("1", "paid", "t", "\x00u", "12.50").Bytes(),
+		newPGOutput('D').u32(16384).u8('K').tuple("1", nil, nil, nil, nil).Bytes(),
+		newPGOutput('T').u32(2).u8(0).u32(16384).u32(99999).Bytes(),
+		newPGOutput('M').u8(1).i64(0).str("prefix").u32(0).Bytes(),
+		newPGOutput('C').u8(0).i64(0x16B3700).i64(0x16B3748).i64(0).Bytes(),
+	}
+	r := &cdcReader{relations: make(map[uint32]*pgRelation)}
+	for i, data := range messages {
+		commit, err := r.pgoutput(data)
+		if err != nil {
+			t.Fatalf("message %d (%c): %v", i, data[0], err)
+		}
+		if commit != (i == len(messages)-1) {
+			t.Fatalf("message %d (%c): commit = %v", i, data[0], commit)
+		}
+	}
+
+	got, _ := json.Marshal(r.commit("0/16B3748"))
+	const stamp = `"xid":7,"lsn":"0/16B3748","commit_time":"2024-01-02T03:04:05.123456Z"`
+	want := `[` +
+		`{"op":"insert","schema":"public","table":"orders","new":{"id":1,"meta":{"a":1},"paid":false,"status":"new","total":"NaN"},` + stamp + `},` +
+		`{"op":"update","schema":"public","table":"orders","new":{"id":1,"paid":true,"status":"paid","total":12.50},` +
+		`"old":{"id":1,"meta":{"a":1},"paid":false,"status":"new","total":"NaN"},` + stamp + `},` +
+		`{"op":"delete","schema":"public","table":"orders","old":{"id":1,"meta":null,"paid":null,"status":null,"total":null},` + stamp + `},` +
+		`{"op":"truncate","schema":"public","table":"orders",` + stamp + `}]`
+	if string(got) != want {
+		t.Fatalf("changes =\n%s\nwant\n%s", got, want)
+	}
+	if len(r.pending) != 0 {
+		t.Fatal("commit kept pending changes")
+	}
+	if n := cdcCount("skipped") - skipped; n != 1 {
+		t.Fatalf("skipped %d changes, want 1", n)
+	}
+}
+
+func TestCDCReaderPGOutputErrors(t *testing.T) {
+	useCDC(t, "pgoutput", "public.orders")
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "unknown message", data: []byte{'Z'}, wantErr: `unknown pgoutput message 'Z'`},
+		{name: "empty", data: nil, wantErr: "truncated pgoutput message"},
+		{name: "truncated begin", data: newPGOutput('B').i64(1).Bytes(), wantErr: "truncated pgoutput message"},
+		{name: "unterminated relation name", data: []byte("R\x00\x00\x40\x00public"), wantErr: "truncated pgoutput message"},
+		{name: "change before its relation", data: newPGOutput('I').u32(5).u8('N').tuple("1").Bytes(),
+			wantErr: "change to a relation that was not described"},
+		{name: "unexpected tuple tag", data: newPGOutput('U').u32(16384).u8('X').Bytes(), wantErr: `unexpected tuple tag 'X'`},
+		{name: "unknown value kind", data: newPGOutput('I').u32(16384).u8('N').i16(1).u8('b').Bytes(),
+			wantErr: `unknown tuple value kind 'b'`},
+		{name: "value longer than the message", data: newPGOutput('I').u32(16384).u8('N').i16(1).u8('t').u32(10).Bytes(),
+			wantErr: "truncated pgoutput message"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &cdcReader{relations: make(map[uint32]*pgRelation)}
+			if _, err := r.pgoutput(relationMsg(16384, "orders")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.pgoutput(tt.data); err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCDCReaderWAL2JSON(t *testing.T) {
+	useCDC(t, "wal2json", "public.orders")
+	rows := []string{
+		`{"action":"B","xid":7,"timestamp":"2024-01-02 03:04:05.123456+00"}`,
+		`{"action":"I","schema":"public","table":"orders","columns":[{"name":"id","type":"integer","value":1},{"name":"total","type":"numeric","value":12.50}]}`,
+		`{"action":"I","schema":"public","table":"audit","columns":[{"name":"id","type":"integer","value":9}]}`,
+		`{"action":"U","schema":"public","table":"orders","columns":[{"name":"id","value":1},{"name":"status","value":"paid"}],"identity":[{"name":"id","value":1}]}`,
+		`{"action":"D","schema":"public","table":"orders","identity":[{"name":"id","value":1}]}`,
+		`{"action":"T","schema":"public","table":"orders"}`,
+		`{"action":"M","transactional":true,"prefix":"p","content":"x"}`,
+		`{"action":"C","xid":7,"timestamp":"2024-01-02 03:04:06+01:00"}`,
+	}
+	r := &cdcReader{}
+	for i, row := range rows {
+		commit, err := r.wal2json([]byte(row))
+		if err != nil || commit != (i == len(rows)-1) {
+			t.Fatalf("row %d: commit = %v, %v", i, commit, err)
+		}
+	}
+	got, _ := json.Marshal(r.commit("0/A0"))
+	const stamp = `"xid":7,"lsn":"0/A0","commit_time":"2024-01-02T02:04:06Z"`
+	want := `[` +
+		`{"op":"insert","schema":"public","table":"orders","new":{"id":1,"total":12.50},` + stamp + `},` +
+		`{"op":"update","schema":"public","table":"orders","new":{"id":1,"status":"paid"},"old":{"id":1},` + stamp + `},` +
+		`{"op":"delete","schema":"public","table":"orders","old":{"id":1},` + stamp + `},` +
+		`{"op":"truncate","schema":"public","table":"orders",` + stamp + `}]`
+	if string(got) != want {
+		t.Fatalf("changes =\n%s\nwant\n%s", got, want)
+	}
+
+	if _, err := (&cdcReader{}).wal2json([]byte(`{"action":`)); err == nil {
+		t.Fatal("invalid row decoded")
+	}
+}
+
+func TestWal2jsonEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"orders":      "orders",
+		"order items": `order\ items`,
+		"a,b.c*d":     `a\,b\.c\*d`,
+		`back\slash`:  `back\\slash`,
+	} {
+		if got := wal2jsonEscape(in); got != want {
+			t.Errorf("wal2jsonEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParsePGTimestamp(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"2024-01-02 03:04:05.123456+00", time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)},
+		{"2024-01-02 03:04:05-05", time.Date(2024, 1, 2, 8, 4, 5, 0, time.UTC)},
+		{"2024-01-02 03:04:05.5+05:30", time.Date(2024, 1, 1, 21, 34, 5, 500000000, time.UTC)},
+		{"", time.Time{}},
+		{"2024-01-02T03:04:05Z", time.Time{}},
+	}
+	for _, tt := range tests {
+		if got := parsePGTimestamp(tt.in); !got.Equal(tt.want) {
+			t.Errorf("parsePGTimestamp(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPGTextValue(t *testing.T) {
+	tests := []struct {
+		oid  uint32
+		in   string
+		want interface{}
+	}{
+		{16, "t", true},
+		{16, "f", false},
+		{20, "9007199254740993", json.Number("9007199254740993")},
+		{1700, "12.50", json.Number("12.50")},
+		{701, "Infinity", "Infinity"},
+		{700, "NaN", "NaN"},
+		{3802, `{"a": [1]}`, json.RawMessage(`{"a": [1]}`)},
+		{114, `{bad`, `{bad`},
+		{25, "42", "42"},
+		{1184, "2024-01-02 03:04:05+00", "2024-01-02 03:04:05+00"},
+	}
+	for _, tt := range tests {
+		if got := pgTextValue(tt.oid, tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pgTextValue(%d, %q) = %#v, want %#v", tt.oid, tt.in, got, tt.want)
+		}
+	}
+}
+
+// flakyJetStream accepts ok publishes, then fails with err
+type flakyJetStream struct {
+	nats.JetStreamContext
+	mu        sync.Mutex
+	ok        int
+	err       error
+	published []*nats.Msg
+}
+
+func (js *flakyJetStream) PublishMsg(m *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.err != nil && len(js.published) >= js.ok {
+		return nil, js.err
+	}
+	js.published = append(js.published, m)
+	return &nats.PubAck{Stream: "CDC", Sequence: uint64(len(js.published))}, nil
+}
+
+func TestCaptureCDCBatch(t *testing.T) {
+	txn := func(xid int, id int) []string {
+		return []string{
+			`{"action":"B","xid":` + strconv.Itoa(xid) + `,"timestamp":"2024-01-02 03:04:05+00"}`,
+			`{"action":"I","schema":"public","table":"orders","columns":[{"name":"id","value":` + strconv.Itoa(id) + `}]}`,
+			`{"action":"I","schema":"public","table":"orders","columns":[{"name":"id","value":` + strconv.Itoa(id+1) + `}]}`,
+			`{"action":"C","xid":` + strconv.Itoa(xid) + `}`,
+		}
+	}
+	slotRows := func() *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"lsn", "data"})
+		for i, data := range txn(7, 1) {
+			rows.AddRow("0/A"+strconv.Itoa(i), []byte(data))
+		}
+		for i, data := range txn(8, 3) {
+			rows.AddRow("0/B"+strconv.Itoa(i), []byte(data))
+		}
+		return rows
+	}
+
+	tests := []struct {
+		name        string
+		publishOK   int // publishes that succeed before publishErr
+		publishErr  error
+		wantAdvance string // "" for none
+		wantErr     error
+		wantSubject []string
+	}{
+		{name: "published", wantAdvance: "0/B3",
+			wantSubject: []string{"cdc.public.orders.insert", "cdc.public.orders.insert", "cdc.public.orders.insert", "cdc.public.orders.insert"}},
+		{name: "second transaction fails", publishOK: 3, publishErr: errors.New("no responders"), wantAdvance: "0/A3",
+			wantErr:     errors.New("no responders"),
+			wantSubject: []string{"cdc.public.orders.insert", "cdc.public.orders.insert", "cdc.public.orders.insert"}},
+		{name: "first transaction fails", publishErr: errors.New("no responders"), wantErr: errors.New("no responders")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCDC(t, "wal2json", "public.orders@order_changed")
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockDB.Close()
+			cdcDB = mockDB
+			js := &flakyJetStream{ok: tt.publishOK, err: tt.publishErr}
+			useJetStream(t, js)
+
+			mock.ExpectQuery("pg_logical_slot_peek_changes").
+				WithArgs("rule_engine_cdc", 100, "public.orders").
+				WillReturnRows(slotRows())
+			if tt.wantAdvance != "" {
+				mock.ExpectExec(`pg_replication_slot_advance`).WithArgs("rule_engine_cdc", tt.wantAdvance).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			n, err := captureCDCBatch(context.Background())
+			if n != 8 || (err == nil) != (tt.wantErr == nil) || (err != nil && err.Error() != tt.wantErr.Error()) {
+				t.Fatalf("= %d, %v, want 8, %v", n, err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+			var subjects []string
+			for _, m := range js.published {
+				subjects = append(subjects, m.Subject)
+			}
+			if !reflect.DeepEqual(subjects, tt.wantSubject) {
+				t.Fatalf("published %v, want %v", subjects, tt.wantSubject)
+			}
+			if len(js.published) == 0 {
+				return
+			}
+
+			first := js.published[0]
+			if first.Header.Get(nats.MsgIdHdr) != "cdc:rule_engine_cdc:0/A3:0" ||
+				js.published[1].Header.Get(nats.MsgIdHdr) != "cdc:rule_engine_cdc:0/A3:1" ||
+				first.Header.Get(cdcTableHeader) != "public.orders" || first.Header.Get(actionHeader) != "order_changed" {
+				t.Fatalf("headers = %v", first.Header)
+			}
+			var change cdcChange
+			if err := json.Unmarshal(first.Data, &change); err != nil || change.XID != 7 || change.LSN != "0/A3" ||
+				change.New["id"] != 1.0 || !change.CommitTime.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+				t.Fatalf("change = %+v, %v", change, err)
+			}
+		})
+	}
+}
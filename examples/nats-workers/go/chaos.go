@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+)
+
+// Chaos mode injects faults so retries, redelivery, and buffering can be
+// seen to work before production depends on them. It is off unless
+// CHAOS_ENABLED is set, and each fault is a percentage chance:
+//
+//   - CHAOS_DB_DELAY_PERCENT of PostgreSQL calls wait up to
+//     CHAOS_DB_DELAY_MAX_MS first
+//   - CHAOS_HTTP_FAILURE_PERCENT of outgoing HTTP requests fail without
+//     being sent
+//   - CHAOS_ACK_DROP_PERCENT of acks are skipped, so JetStream redelivers
+//     the message after AckWait
+//   - every chaosKillInterval, each NATS and PostgreSQL connection is
+//     closed with CHAOS_CONN_KILL_PERCENT probability
+//
+// Injected faults are counted under chaos_faults on /debug/vars.
+
+const chaosKillInterval = 10 * time.Second
+
+var chaosFaults = expvar.NewMap("chaos_faults")
+
+// chaosRoll reports whether a fault with the given percentage chance fires
+func chaosRoll(percent int) bool {
+	return config.Chaos.Enabled && percent > 0 && rand.Intn(100) < percent
+}
+
+// initChaos installs the HTTP fault injector and starts killing
+// connections. It must run before any connection is opened.
+func initChaos() {
+	if !config.Chaos.Enabled {
+		return
+	}
+	log.Printf("🐒 Chaos mode enabled: db delay %d%% (up to %dms), http failure %d%%, ack drop %d%%, connection kill %d%% every %s",
+		config.Chaos.DBDelayPercent, config.Chaos.DBDelayMaxMs, config.Chaos.HTTPFailurePercent,
+		config.Chaos.AckDropPercent, config.Chaos.ConnKillPercent, chaosKillInterval)
+
+	http.DefaultTransport = chaosTransport{next: http.DefaultTransport}
+	if config.Chaos.ConnKillPercent > 0 {
+		go killConnections()
+	}
+}
+
+// chaosDBDelay stalls a PostgreSQL call, or returns early when ctx ends
+func chaosDBDelay(ctx context.Context) {
+	if !chaosRoll(config.Chaos.DBDelayPercent) || config.Chaos.DBDelayMaxMs <= 0 {
+		return
+	}
+	chaosFaults.Add("db_delay", 1)
+	select {
+	case <-time.After(time.Duration(rand.Intn(config.Chaos.DBDelayMaxMs)+1) * time.Millisecond):
+	case <-ctx.Done():
+	}
+}
+
+// chaosDropAck is the worker's DropAck hook
+func chaosDropAck(msg *nats.Msg) bool {
+	if !chaosRoll(config.Chaos.AckDropPercent) {
+		return false
+	}
+	chaosFaults.Add("ack_drop", 1)
+	log.Printf("🐒 Dropped ack for %s", msg.Subject)
+	return true
+}
+
+// errChaosHTTP is the error injected into outgoing requests
+var errChaosHTTP = errors.New("chaos: injected HTTP failure")
+
+// chaosTransport fails a share of requests before they are sent
+type chaosTransport struct {
+	next http.RoundTripper
+}
+
+func (t chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if chaosRoll(config.Chaos.HTTPFailurePercent) {
+		chaosFaults.Add("http_failure", 1)
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, errChaosHTTP
+	}
+	return t.next.RoundTrip(req)
+}
+
+// chaosConns are the open connections made through chaosDialer
+var chaosConns = struct {
+	sync.Mutex
+	open map[*chaosConn]string // connection → what it is for
+}{open: map[*chaosConn]string{}}
+
+// chaosDialer dials NATS and PostgreSQL connections that killConnections
+// can close
+type chaosDialer struct {
+	kind string
+}
+
+func (d chaosDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialTimeout(network, address, 0)
+}
+
+func (d chaosDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &chaosConn{Conn: conn}
+	chaosConns.Lock()
+	chaosConns.open[c] = d.kind
+	chaosConns.Unlock()
+	return c, nil
+}
+
+// chaosConn forgets itself when closed
+type chaosConn struct {
+	net.Conn
+}
+
+func (c *chaosConn) Close() error {
+	chaosConns.Lock()
+	delete(chaosConns.open, c)
+	chaosConns.Unlock()
+	return c.Conn.Close()
+}
+
+// killConnections closes connections at random, as a network fault or a
+// server restart would
+func killConnections() {
+	ticker := time.NewTicker(chaosKillInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		killSomeConnections()
+	}
+}
+
+// killSomeConnections closes each open connection with
+// CHAOS_CONN_KILL_PERCENT probability
+func killSomeConnections() {
+	chaosConns.Lock()
+	var victims []*chaosConn
+	for c, kind := range chaosConns.open {
+		if chaosRoll(config.Chaos.ConnKillPercent) {
+			victims = append(victims, c)
+			chaosFaults.Add(kind+"_conn_kill", 1)
+			log.Printf("🐒 Killing %s connection to %s", kind, c.RemoteAddr())
+		}
+	}
+	chaosConns.Unlock()
+	for _, c := range victims {
+		c.Close()
+	}
+}
+
+// chaosNATSOptions routes NATS connections through chaosDialer in chaos
+// mode
+func chaosNATSOptions() []nats.Option {
+	if !config.Chaos.Enabled {
+		return nil
+	}
+	return []nats.Option{nats.SetCustomDialer(chaosDialer{kind: "nats"})}
+}
+
+// openPostgres opens a connection pool for dsn. In chaos mode its
+// connections are dialed through chaosDialer.
+func openPostgres(dsn string) (*sql.DB, error) {
+	if !config.Chaos.Enabled {
+		return sql.Open("postgres", dsn)
+	}
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	connector.Dialer(chaosDialer{kind: "postgres"})
+	return sql.OpenDB(connector), nil
+}
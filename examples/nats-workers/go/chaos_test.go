@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// setChaos replaces the chaos settings for the test
+func setChaos(t *testing.T, enabled bool, percent int) {
+	t.Helper()
+	prev := config.Chaos
+	t.Cleanup(func() { config.Chaos = prev })
+	config.Chaos.Enabled = enabled
+	config.Chaos.DBDelayPercent, config.Chaos.HTTPFailurePercent = percent, percent
+	config.Chaos.AckDropPercent, config.Chaos.ConnKillPercent = percent, percent
+	config.Chaos.DBDelayMaxMs = 5
+}
+
+// chaosCount reads one chaos_faults counter
+func chaosCount(key string) int64 {
+	if v, ok := chaosFaults.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestChaosRoll(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		percent int
+		want    bool
+	}{
+		{name: "disabled", enabled: false, percent: 100, want: false},
+		{name: "zero", enabled: true, percent: 0, want: false},
+		{name: "always", enabled: true, percent: 100, want: true},
+	}
+	for _, tt := range tests {
+		setChaos(t, tt.enabled, tt.percent)
+		for i := 0; i < 50; i++ {
+			if got := chaosRoll(tt.percent); got != tt.want {
+				t.Fatalf("%s: chaosRoll(%d) = %v", tt.name, tt.percent, got)
+			}
+		}
+	}
+
+	setChaos(t, true, 50)
+	fired := 0
+	for i := 0; i < 1000; i++ {
+		if chaosRoll(50) {
+			fired++
+		}
+	}
+	if fired < 350 || fired > 650 {
+		t.Fatalf("50%% fired %d of 1000 times", fired)
+	}
+}
+
+func TestChaosTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: chaosTransport{next: http.DefaultTransport}}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		percent int
+		wantErr bool
+	}{
+		{name: "disabled passes through", enabled: false, percent: 100},
+		{name: "zero passes through", enabled: true, percent: 0},
+		{name: "always fails", enabled: true, percent: 100, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setChaos(t, tt.enabled, tt.percent)
+			before := chaosCount("http_failure")
+			resp, err := client.Post(srv.URL, "text/plain", strings.NewReader("body"))
+			if tt.wantErr {
+				if !errors.Is(err, errChaosHTTP) {
+					t.Fatalf("err = %v, want the injected failure", err)
+				}
+				if chaosCount("http_failure") != before+1 {
+					t.Fatal("failure not counted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != 200 || chaosCount("http_failure") != before {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestChaosDropAck(t *testing.T) {
+	msg := &nats.Msg{Subject: "rules.orders"}
+
+	setChaos(t, false, 100)
+	if chaosDropAck(msg) {
+		t.Fatal("dropped an ack with chaos disabled")
+	}
+	setChaos(t, true, 100)
+	before := chaosCount("ack_drop")
+	if !chaosDropAck(msg) || chaosCount("ack_drop") != before+1 {
+		t.Fatal("ack not dropped and counted")
+	}
+}
+
+func TestChaosDBDelay(t *testing.T) {
+	setChaos(t, true, 100)
+	config.Chaos.DBDelayMaxMs = 60_000
+	before := chaosCount("db_delay")
+
+	// A long delay still ends with the caller's context
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	chaosDBDelay(ctx)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("delay ignored the context: %s", elapsed)
+	}
+	if chaosCount("db_delay") != before+1 {
+		t.Fatal("delay not counted")
+	}
+
+	config.Chaos.DBDelayMaxMs = 0
+	chaosDBDelay(context.Background())
+	if chaosCount("db_delay") != before+1 {
+		t.Fatal("delayed with no maximum")
+	}
+}
+
+func TestChaosDialerKillsConnections(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	setChaos(t, true, 0)
+	conn, err := chaosDialer{kind: "nats"}.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := func() bool {
+		chaosConns.Lock()
+		defer chaosConns.Unlock()
+		_, ok := chaosConns.open[conn.(*chaosConn)]
+		return ok
+	}
+	if !tracked() {
+		t.Fatal("dialed connection not tracked")
+	}
+
+	killSomeConnections() // 0%: nothing closed
+	if !tracked() {
+		t.Fatal("connection killed at 0%")
+	}
+
+	config.Chaos.ConnKillPercent = 100
+	before := chaosCount("nats_conn_kill")
+	killSomeConnections()
+	if tracked() || chaosCount("nats_conn_kill") != before+1 {
+		t.Fatal("connection not killed at 100%")
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Fatal("killed connection still writable")
+	}
+
+	if _, err := (chaosDialer{kind: "nats"}).Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Fatal("dial to a closed port succeeded")
+	}
+}
+
+func TestChaosNATSOptions(t *testing.T) {
+	setChaos(t, false, 0)
+	if opts := chaosNATSOptions(); opts != nil {
+		t.Fatalf("options without chaos: %d", len(opts))
+	}
+	setChaos(t, true, 0)
+	var o nats.Options
+	for _, opt := range chaosNATSOptions() {
+		opt(&o)
+	}
+	if _, ok := o.CustomDialer.(chaosDialer); !ok {
+		t.Fatalf("dialer = %T", o.CustomDialer)
+	}
+}
+
+func TestOpenPostgres(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		setChaos(t, enabled, 0)
+		pool, err := openPostgres("postgres://user@127.0.0.1:1/rules?sslmode=disable&connect_timeout=1")
+		if err != nil {
+			t.Fatalf("chaos %v: %v", enabled, err)
+		}
+		if err := pool.Ping(); err == nil {
+			t.Fatalf("chaos %v: ping to a closed port succeeded", enabled)
+		}
+		pool.Close()
+	}
+	setChaos(t, true, 0)
+	if _, err := openPostgres("postgres://user@host:port/rules"); err == nil {
+		t.Fatal("bad DSN accepted")
+	}
+}
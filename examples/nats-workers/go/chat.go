@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// Shared plumbing for chat actions (slack, teams): JSON templating, rate
+// limiting, and thread bookkeeping.
+
+// renderJSONTemplate renders a template that produces JSON (Slack blocks,
+// Teams cards) and checks the result parses. The json function encodes a
+// value as a JSON literal: {"text": {{json .summary}}}.
+func renderJSONTemplate(text string, data map[string]interface{}) (json.RawMessage, error) {
+	tmpl, err := template.New("json").Option("missingkey=zero").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			encoded, err := json.Marshal(v)
+			return string(encoded), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render template: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template did not produce valid JSON: %s", buf.String())
+	}
+	return json.RawMessage(buf.Bytes()), nil
+}
+
+// renderText renders an optional text template; empty templates give ""
+func renderText(text string, data map[string]interface{}) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	rendered, err := renderBodyTemplate(text, data)
+	return string(rendered), err
+}
+
+// rateLimiter spaces out calls sharing a key. It is per worker process, so
+// the effective rate across replicas is the configured rate times the
+// replica count.
+type rateLimiter struct {
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+var chatLimiter = &rateLimiter{next: map[string]time.Time{}}
+
+// wait blocks until a call for key may proceed, allowing perSecond calls
+// per second. A non-positive rate disables limiting.
+func (l *rateLimiter) wait(ctx context.Context, key string, perSecond float64) error {
+	if perSecond <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / perSecond)
+
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next[key]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[key] = at.Add(interval)
+	l.mu.Unlock()
+
+	delay := time.Until(at)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// postJSON sends body to url and returns the response body. 429 responses
+// are retried no sooner than their Retry-After.
+func postJSON(ctx context.Context, url string, body interface{}, headers map[string]string) ([]byte, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respBody bytes.Buffer
+	respBody.ReadFrom(resp.Body)
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, worker.RetryAfter(fmt.Errorf("rate limited (HTTP 429)"), retryAfter(resp.Header, time.Minute))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("HTTP error: %d: %s", resp.StatusCode, bytes.TrimSpace(respBody.Bytes()))
+	}
+	return respBody.Bytes(), nil
+}
+
+// lookupThread returns the thread an earlier message with the same key
+// started, if any
+func lookupThread(ctx context.Context, action, key string) (channel, threadID string, ok bool, err error) {
+	err = withDBRetry(ctx, primaryHealth, func() error {
+		return db.QueryRowContext(ctx,
+			`SELECT channel, thread_id FROM rule_chat_threads WHERE action_name = $1 AND thread_key = $2`,
+			action, key,
+		).Scan(&channel, &threadID)
+	})
+	if err == sql.ErrNoRows {
+		return "", "", false, nil
+	}
+	return channel, threadID, err == nil, err
+}
+
+// saveThread records the message that starts a thread. The first writer
+// wins if two messages race to start the same thread.
+func saveThread(ctx context.Context, action, key, channel, threadID string) error {
+	return withDBRetry(ctx, primaryHealth, func() error {
+		_, err := db.ExecContext(ctx,
+			`INSERT INTO rule_chat_threads (action_name, thread_key, channel, thread_id)
+			 VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (action_name, thread_key) DO NOTHING`,
+			action, key, channel, threadID,
+		)
+		return err
+	})
+}
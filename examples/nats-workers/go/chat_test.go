@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRenderJSONTemplate(t *testing.T) {
+	data := map[string]interface{}{"summary": `say "hi"`, "score": 0.9}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  string
+	}{
+		{name: "json function escapes", template: `{"text": {{json .summary}}, "score": {{.score}}}`,
+			want: `{"text": "say \"hi\"", "score": 0.9}`},
+		{name: "array", template: `[{"type":"section","text":{{json .summary}}}]`,
+			want: `[{"type":"section","text":"say \"hi\""}]`},
+		{name: "unescaped string is invalid", template: `{"text": "{{.summary}}"}`, wantErr: "did not produce valid JSON"},
+		{name: "bad template", template: `{{`, wantErr: "invalid template"},
+		{name: "missing key renders empty", template: `{"x": {{json .missing}}}`, want: `{"x": null}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderJSONTemplate(tt.template, data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("json = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{next: map[string]time.Time{}}
+	ctx := context.Background()
+
+	// Unlimited calls never wait
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if err := l.wait(ctx, "free", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("calls without a rate waited")
+	}
+
+	// At 20/s the third call is due 100ms after the first
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.wait(ctx, "limited", 20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("3 calls at 20/s took %v", elapsed)
+	}
+
+	// Other keys are not held up
+	start = time.Now()
+	if err := l.wait(ctx, "other", 20); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("a new key waited for another key's slot")
+	}
+
+	// A cancelled wait returns the context error
+	l.wait(ctx, "slow", 0.5)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.wait(cancelled, "slow", 0.5); err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestPostJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		body       string
+		want       string
+		wantErr    string
+	}{
+		{name: "ok", status: 200, body: `{"ok":true}`, want: `{"ok":true}`},
+		{name: "rate limited", status: 429, retryAfter: "7", wantErr: "rate limited (HTTP 429) (retry after 7s)"},
+		{name: "rate limited without header", status: 429, wantErr: "(retry after 1m0s)"},
+		{name: "server error", status: 500, body: " invalid_payload \n", wantErr: "HTTP error: 500: invalid_payload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if ct := r.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+					t.Errorf("Content-Type = %q", ct)
+				}
+				if auth := r.Header.Get("Authorization"); auth != "Bearer xoxb" {
+					t.Errorf("Authorization = %q", auth)
+				}
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			got, err := postJSON(context.Background(), srv.URL, map[string]string{"text": "hi"},
+				map[string]string{"Authorization": "Bearer xoxb"})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretOr(t *testing.T) {
+	mock := mockDB(t)
+	resetSecrets := func() {
+		secretsMu.Lock()
+		secrets = map[string]cachedSecret{}
+		secretsMu.Unlock()
+	}
+	resetSecrets()
+	t.Cleanup(resetSecrets)
+
+	mock.ExpectQuery("FROM rule_action_secrets").WithArgs("slack_bot").
+		WillReturnRows(sqlmock.NewRows([]string{"decrypt_credential"}).AddRow("xoxb-1"))
+	mock.ExpectQuery("FROM rule_action_secrets").WithArgs("gone").WillReturnError(sql.ErrNoRows)
+
+	tests := []struct {
+		name, value, secret string
+		want, wantErr       string
+	}{
+		{name: "inline value wins", value: "inline", secret: "slack_bot", want: "inline"},
+		{name: "neither", want: ""},
+		{name: "secret", secret: "slack_bot", want: "xoxb-1"},
+		{name: "cached secret", secret: "slack_bot", want: "xoxb-1"},
+		{name: "missing secret", secret: "gone", wantErr: "secret gone not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := secretOr(context.Background(), tt.value, tt.secret)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("value = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// chatServer records the JSON bodies posted to it and answers with reply
+type chatServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []map[string]interface{}
+}
+
+func newChatServer(t *testing.T, reply string) *chatServer {
+	t.Helper()
+	s := &chatServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("invalid JSON body: %v", err)
+		}
+		s.mu.Lock()
+		s.bodies = append(s.bodies, body)
+		s.mu.Unlock()
+		io.WriteString(w, reply)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *chatServer) last(t *testing.T) map[string]interface{} {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.bodies) == 0 {
+		t.Fatal("nothing was posted")
+	}
+	return s.bodies[len(s.bodies)-1]
+}
+
+func chatMessage(name, typ, config string, data map[string]interface{}) *ActionMessage {
+	return &ActionMessage{
+		Payload: &WebhookPayload{Data: data},
+		Config:  &ActionConfig{Name: name, Type: typ, Config: json.RawMessage(config)},
+	}
+}
+
+func TestSlackActionWebhook(t *testing.T) {
+	srv := newChatServer(t, "ok")
+	data := map[string]interface{}{"order_id": "7"}
+
+	tests := []struct {
+		name    string
+		config  string
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{name: "text", config: `{"webhook_url": "` + srv.URL + `", "text": "Order {{.order_id}} flagged", "rate_per_second": 0}`,
+			want: map[string]interface{}{"text": "Order 7 flagged"}},
+		{name: "blocks", config: `{"webhook_url": "` + srv.URL + `", "blocks": "[{\"type\":\"section\",\"text\":{{json .order_id}}}]", "rate_per_second": 0}`,
+			want: map[string]interface{}{"blocks": []interface{}{map[string]interface{}{"type": "section", "text": "7"}}}},
+		{name: "nothing to say", config: `{"webhook_url": "` + srv.URL + `"}`, wantErr: "has no text or blocks"},
+		{name: "bad blocks", config: `{"webhook_url": "x", "blocks": "[{{.order_id}"}`, wantErr: "blocks:"},
+		{name: "no destination", config: `{"text": "hi", "rate_per_second": 0}`, wantErr: "needs webhook_url or token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detail, err := slackAction{}.Execute(context.Background(), chatMessage("fraud", "slack", tt.config, data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detail != "posted to Slack" {
+				t.Fatalf("detail = %q", detail)
+			}
+			got := srv.last(t)
+			for key, want := range tt.want {
+				if g, _ := json.Marshal(got[key]); string(g) != mustJSON(t, want) {
+					t.Errorf("%s = %s, want %s", key, g, mustJSON(t, want))
+				}
+			}
+		})
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+func TestSlackActionThreads(t *testing.T) {
+	srv := newChatServer(t, `{"ok": true, "channel": "C123", "ts": "1700000000.000100"}`)
+	defer func(url string) { slackPostMessageURL = url }(slackPostMessageURL)
+	slackPostMessageURL = srv.URL
+
+	const threadConfig = `{"token": "xoxb", "channel": "#fraud", "text": "Order {{.order_id}}",
+		"thread_key": "order-{{.order_id}}", "reply_broadcast": true, "rate_per_second": 0}`
+	data := map[string]interface{}{"order_id": "7"}
+	threadCols := []string{"channel", "thread_id"}
+
+	// The first message starts the thread and saves it
+	mock := mockDB(t)
+	mock.ExpectQuery("FROM rule_chat_threads").WithArgs("fraud", "order-7").WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO rule_chat_threads").WithArgs("fraud", "order-7", "C123", "1700000000.000100").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	detail, err := slackAction{}.Execute(context.Background(), chatMessage("fraud", "slack", threadConfig, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail != "posted to C123" {
+		t.Fatalf("detail = %q", detail)
+	}
+	if first := srv.last(t); first["thread_ts"] != nil || first["channel"] != "#fraud" {
+		t.Fatalf("first message = %v", first)
+	}
+
+	// Later messages reply in it
+	mock.ExpectQuery("FROM rule_chat_threads").WithArgs("fraud", "order-7").
+		WillReturnRows(sqlmock.NewRows(threadCols).AddRow("C123", "1700000000.000100"))
+	detail, err = slackAction{}.Execute(context.Background(), chatMessage("fraud", "slack", threadConfig, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail != "replied in C123 thread 1700000000.000100" {
+		t.Fatalf("detail = %q", detail)
+	}
+	reply := srv.last(t)
+	if reply["thread_ts"] != "1700000000.000100" || reply["channel"] != "C123" || reply["reply_broadcast"] != true {
+		t.Fatalf("reply = %v", reply)
+	}
+}
+
+func TestSlackActionAPIErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		config  string
+		wantErr string
+	}{
+		{name: "slack error", reply: `{"ok": false, "error": "channel_not_found"}`,
+			config: `{"token": "xoxb", "channel": "#nope", "text": "hi", "rate_per_second": 0}`, wantErr: "Slack error: channel_not_found"},
+		{name: "invalid response", reply: `<html>`,
+			config: `{"token": "xoxb", "channel": "#ops", "text": "hi", "rate_per_second": 0}`, wantErr: "invalid Slack response"},
+		{name: "token without channel", reply: `{"ok": true}`,
+			config: `{"token": "xoxb", "text": "hi", "rate_per_second": 0}`, wantErr: "needs a channel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newChatServer(t, tt.reply)
+			defer func(url string) { slackPostMessageURL = url }(slackPostMessageURL)
+			slackPostMessageURL = srv.URL
+
+			_, err := slackAction{}.Execute(context.Background(), chatMessage("ops", "slack", tt.config, nil))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTeamsAction(t *testing.T) {
+	srv := newChatServer(t, "1")
+	data := map[string]interface{}{"order_id": "7", "score": 0.92}
+
+	tests := []struct {
+		name       string
+		config     string
+		wantBlocks []string
+		wantCard   string
+		wantErr    string
+	}{
+		{name: "title and text", config: `{"webhook_url": "` + srv.URL + `", "title": "Order {{.order_id}} flagged", "text": "Score {{.score}}", "rate_per_second": 0}`,
+			wantBlocks: []string{"Order 7 flagged", "Score 0.92"}},
+		{name: "title only", config: `{"webhook_url": "` + srv.URL + `", "title": "Order {{.order_id}}", "rate_per_second": 0}`,
+			wantBlocks: []string{"Order 7"}},
+		{name: "custom card", config: `{"webhook_url": "` + srv.URL + `", "card": "{\"type\":\"AdaptiveCard\",\"id\":{{json .order_id}}}", "rate_per_second": 0}`,
+			wantCard: `{"id":"7","type":"AdaptiveCard"}`},
+		{name: "empty card", config: `{"webhook_url": "` + srv.URL + `"}`, wantErr: "needs title, text, or card"},
+		{name: "no webhook", config: `{"title": "x"}`, wantErr: "needs webhook_url or webhook_secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := teamsAction{}.Execute(context.Background(), chatMessage("ops", "teams", tt.config, data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg := srv.last(t)
+			attachments := msg["attachments"].([]interface{})
+			attachment := attachments[0].(map[string]interface{})
+			if msg["type"] != "message" || attachment["contentType"] != "application/vnd.microsoft.card.adaptive" {
+				t.Fatalf("message = %v", msg)
+			}
+			card := attachment["content"].(map[string]interface{})
+			if tt.wantCard != "" {
+				if got := mustJSON(t, card); got != tt.wantCard {
+					t.Fatalf("card = %s, want %s", got, tt.wantCard)
+				}
+				return
+			}
+			body := card["body"].([]interface{})
+			if len(body) != len(tt.wantBlocks) {
+				t.Fatalf("card body = %v", body)
+			}
+			for i, want := range tt.wantBlocks {
+				if text := body[i].(map[string]interface{})["text"]; text != want {
+					t.Errorf("block %d = %v, want %q", i, text, want)
+				}
+			}
+		})
+	}
+}
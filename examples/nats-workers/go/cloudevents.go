@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// CloudEvents content modes for outbound webhooks
+const (
+	cloudEventsBinary     = "binary"     // attributes in ce-* headers, body unchanged
+	cloudEventsStructured = "structured" // whole event as application/cloudevents+json
+)
+
+const cloudEventsContentType = "application/cloudevents+json"
+
+// CloudEvent is the context of a CloudEvents message (spec 1.0)
+type CloudEvent struct {
+	SpecVersion     string
+	ID              string
+	Source          string
+	Type            string
+	Subject         string
+	Time            string
+	DataContentType string
+	DataSchema      string
+
+	// Extensions holds the other attributes, by lower-case name
+	Extensions map[string]string
+}
+
+// Extension attributes that route a foreign event: its data becomes the
+// message data and these pick the destination
+const (
+	ceWebhookIDExtension = "webhookid"
+	ceActionExtension    = "action"
+	ceRuleExtension      = "rule"
+)
+
+// Headers that route a message whose data is not a worker payload, for
+// events and decoded records from producers that know nothing of the
+// worker's format
+const (
+	webhookIDHeader = "Rule-Webhook-Id"
+	actionHeader    = "Rule-Action"
+	ruleHeader      = "Rule-Name"
+)
+
+// decodeMessage parses a message into the worker payload. CloudEvents
+// messages (CLOUDEVENTS_INBOUND) are unwrapped, then subjects listed in
+// DECODE_SUBJECTS are decoded to JSON. The result is either a worker
+// payload or, when the event has a webhookid or action extension or the
+// message a Rule-Webhook-Id or Rule-Action header, the data to deliver.
+// It returns the event, if any, and the payload's raw bytes.
+func decodeMessage(ctx context.Context, msg *nats.Msg) (*WebhookPayload, *CloudEvent, []byte, error) {
+	data := msg.Data
+	var event *CloudEvent
+	if config.CloudEvents.Inbound {
+		var err error
+		if event, data, err = parseCloudEvent(msg); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	data, err := decodeData(ctx, msg.Subject, data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	webhookID, action, rule := headerValue(msg.Header, webhookIDHeader), headerValue(msg.Header, actionHeader), headerValue(msg.Header, ruleHeader)
+	if event != nil && (event.Extensions[ceWebhookIDExtension] != "" || event.Extensions[ceActionExtension] != "") {
+		webhookID, action, rule = event.Extensions[ceWebhookIDExtension], event.Extensions[ceActionExtension], event.Extensions[ceRuleExtension]
+	}
+
+	var payload WebhookPayload
+	if webhookID != "" || action != "" {
+		if err := json.Unmarshal(data, &payload.Data); err != nil || payload.Data == nil {
+			return nil, nil, nil, worker.Permanent(fmt.Errorf("data must be a JSON object"))
+		}
+		payload.rawData = data
+		if webhookID != "" {
+			n, err := strconv.Atoi(webhookID)
+			if err != nil {
+				return nil, nil, nil, worker.Permanent(fmt.Errorf("invalid webhook id %q", webhookID))
+			}
+			payload.WebhookID = n
+		}
+		payload.Action = action
+		payload.Rule = rule
+	} else if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, nil, nil, worker.Permanent(err)
+	}
+
+	// source and id identify the event, so a redelivered event is a
+	// duplicate
+	if event != nil && payload.EventKey == "" {
+		payload.EventKey = event.Source + "#" + event.ID
+	}
+	return &payload, event, data, nil
+}
+
+// parseCloudEvent reads the event of a binary-mode (ce-* headers) or
+// structured-mode (application/cloudevents+json) message, returning its
+// data. Other messages give a nil event and their data unchanged.
+func parseCloudEvent(msg *nats.Msg) (*CloudEvent, []byte, error) {
+	event := &CloudEvent{Extensions: map[string]string{}}
+	binary := false
+	for key, values := range msg.Header {
+		name := strings.ToLower(key)
+		if !strings.HasPrefix(name, "ce-") || len(values) == 0 {
+			continue
+		}
+		binary = true
+		event.set(strings.TrimPrefix(name, "ce-"), values[0])
+	}
+
+	contentType := headerValue(msg.Header, "Content-Type")
+	data := msg.Data
+	switch {
+	case binary:
+		event.DataContentType = contentType
+	case mediaType(contentType) == cloudEventsContentType:
+		var err error
+		if data, err = event.unmarshalStructured(msg.Data); err != nil {
+			return nil, nil, worker.Permanent(fmt.Errorf("invalid cloudevent: %w", err))
+		}
+	default:
+		return nil, msg.Data, nil
+	}
+
+	if !strings.HasPrefix(event.SpecVersion, "1.") {
+		return nil, nil, worker.Permanent(fmt.Errorf("unsupported cloudevents specversion %q", event.SpecVersion))
+	}
+	if event.ID == "" || event.Source == "" || event.Type == "" {
+		return nil, nil, worker.Permanent(fmt.Errorf("cloudevent is missing id, source, or type"))
+	}
+	return event, data, nil
+}
+
+func (e *CloudEvent) set(name, value string) {
+	switch name {
+	case "specversion":
+		e.SpecVersion = value
+	case "id":
+		e.ID = value
+	case "source":
+		e.Source = value
+	case "type":
+		e.Type = value
+	case "subject":
+		e.Subject = value
+	case "time":
+		e.Time = value
+	case "datacontenttype":
+		e.DataContentType = value
+	case "dataschema":
+		e.DataSchema = value
+	default:
+		e.Extensions[name] = value
+	}
+}
+
+// unmarshalStructured reads a structured-mode event and returns its data:
+// the JSON of data for JSON content types, the text of a string data
+// otherwise, or the decoded data_base64
+func (e *CloudEvent) unmarshalStructured(body []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	for name, raw := range fields {
+		if name == "data" || name == "data_base64" {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		switch v := value.(type) {
+		case string:
+			e.set(name, v)
+		case nil:
+		default:
+			// Extensions may be booleans or integers
+			e.set(name, strings.TrimSpace(string(raw)))
+		}
+	}
+
+	if encoded, ok := fields["data_base64"]; ok {
+		var s string
+		if err := json.Unmarshal(encoded, &s); err != nil {
+			return nil, fmt.Errorf("data_base64: %w", err)
+		}
+		return base64.StdEncoding.DecodeString(s)
+	}
+	data := fields["data"]
+	if len(data) > 0 && data[0] == '"' && !isJSONMediaType(e.DataContentType) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, err
+		}
+		return []byte(s), nil
+	}
+	return data, nil
+}
+
+// cloudEventMode returns how a webhook request is sent: binary,
+// structured, or "" for a plain request. The destination's setting wins
+// over CLOUDEVENTS_OUTBOUND.
+func cloudEventMode(dest *Destination) (string, error) {
+	mode := config.CloudEvents.Outbound
+	if dest != nil && dest.CloudEvents != "" {
+		mode = dest.CloudEvents
+	}
+	switch mode {
+	case "", "none":
+		return "", nil
+	case cloudEventsBinary, cloudEventsStructured:
+		return mode, nil
+	}
+	return "", worker.Permanent(fmt.Errorf("unknown cloudevents mode %q (want none, binary, or structured)", mode))
+}
+
+// outboundCloudEvent is the event a webhook request for m carries. An
+// inbound CloudEvent is forwarded with its attributes; anything else gets
+// an id stable across redeliveries and the configured source and type.
+func outboundCloudEvent(m *ActionMessage) CloudEvent {
+	if m.Event != nil {
+		event := *m.Event
+		event.Extensions = map[string]string{}
+		for name, value := range m.Event.Extensions {
+			if name != ceWebhookIDExtension && name != ceActionExtension {
+				event.Extensions[name] = value
+			}
+		}
+		return event
+	}
+
+	event := CloudEvent{
+		SpecVersion: "1.0",
+		ID:          cloudEventID(m.Msg),
+		Source:      config.CloudEvents.Source,
+		Type:        config.CloudEvents.Type,
+		Subject:     m.Payload.EventKey,
+		Time:        time.Now().UTC().Format(time.RFC3339Nano),
+		Extensions:  map[string]string{},
+	}
+	if meta, err := m.Msg.Metadata(); err == nil {
+		event.Time = meta.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+	if m.Payload.Rule != "" {
+		event.Extensions[ceRuleExtension] = m.Payload.Rule
+	}
+	return event
+}
+
+// cloudEventID is the message's Nats-Msg-Id, its stream position, or for
+// core NATS messages a random id
+func cloudEventID(msg *nats.Msg) string {
+	if id := msg.Header.Get(nats.MsgIdHdr); id != "" {
+		return id
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		return fmt.Sprintf("%s-%d", meta.Stream, meta.Sequence.Stream)
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// encodeCloudEvent wraps a webhook request as event. Binary mode adds
+// ce-* headers and keeps the body; structured mode returns the event as the
+// new body and content type. Requests without a body always use headers.
+func encodeCloudEvent(mode string, event CloudEvent, contentType string, body []byte) ([]byte, string, http.Header, error) {
+	if body != nil {
+		event.DataContentType = contentType
+	}
+	if mode == cloudEventsBinary || body == nil {
+		headers := http.Header{}
+		for name, value := range event.attributes() {
+			if name != "datacontenttype" {
+				headers.Set("ce-"+name, value)
+			}
+		}
+		return body, contentType, headers, nil
+	}
+
+	structured := map[string]interface{}{}
+	for name, value := range event.attributes() {
+		structured[name] = value
+	}
+	switch {
+	case isJSONMediaType(contentType) && json.Valid(body):
+		structured["data"] = json.RawMessage(body)
+	case strings.HasPrefix(mediaType(contentType), "text/") || strings.HasSuffix(mediaType(contentType), "xml"):
+		structured["data"] = string(body)
+	default:
+		structured["data_base64"] = base64.StdEncoding.EncodeToString(body)
+	}
+	encoded, err := json.Marshal(structured)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return encoded, cloudEventsContentType + "; charset=utf-8", nil, nil
+}
+
+// attributes returns the event's non-empty attributes by name
+func (e CloudEvent) attributes() map[string]string {
+	attrs := map[string]string{}
+	for name, value := range e.Extensions {
+		attrs[name] = value
+	}
+	for name, value := range map[string]string{
+		"specversion": e.SpecVersion, "id": e.ID, "source": e.Source, "type": e.Type, "subject": e.Subject,
+		"time": e.Time, "datacontenttype": e.DataContentType, "dataschema": e.DataSchema,
+	} {
+		if value != "" {
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
+
+// headerValue looks a NATS header up case-insensitively; NATS keeps
+// header names as published
+func headerValue(h nats.Header, name string) string {
+	if v := h.Get(name); v != "" {
+		return v
+	}
+	for key, values := range h {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return t
+}
+
+func isJSONMediaType(contentType string) bool {
+	t := mediaType(contentType)
+	return t == "" || t == "application/json" || strings.HasSuffix(t, "+json")
+}
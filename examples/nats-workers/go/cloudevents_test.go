@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// useCloudEvents sets the CloudEvents settings for one test
+func useCloudEvents(t *testing.T, inbound bool, outbound string) {
+	t.Helper()
+	prev := config.CloudEvents
+	config.CloudEvents.Inbound = inbound
+	config.CloudEvents.Outbound = outbound
+	config.CloudEvents.Source = "/worker"
+	config.CloudEvents.Type = "com.example.webhook"
+	t.Cleanup(func() { config.CloudEvents = prev })
+}
+
+func binaryHeaders(extra ...string) nats.Header {
+	h := nats.Header{"ce-specversion": {"1.0"}, "Ce-Id": {"e1"}, "ce-source": {"/orders"}, "CE-TYPE": {"order.created"}}
+	for i := 0; i+1 < len(extra); i += 2 {
+		h[extra[i]] = []string{extra[i+1]}
+	}
+	return h
+}
+
+func TestParseCloudEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    nats.Header
+		data      string
+		wantEvent *CloudEvent
+		wantData  string
+		wantErr   string
+	}{
+		{name: "not an event", header: nats.Header{"Content-Type": {"application/json"}}, data: `{"a":1}`, wantData: `{"a":1}`},
+		{name: "binary",
+			header: binaryHeaders("ce-subject", "o1", "ce-time", "2024-01-01T00:00:00Z", "ce-dataschema", "/schemas/order",
+				"ce-webhookid", "7", "Content-Type", "application/json"),
+			data: `{"a":1}`,
+			wantEvent: &CloudEvent{SpecVersion: "1.0", ID: "e1", Source: "/orders", Type: "order.created", Subject: "o1",
+				Time: "2024-01-01T00:00:00Z", DataSchema: "/schemas/order", DataContentType: "application/json",
+				Extensions: map[string]string{"webhookid": "7"}},
+			wantData: `{"a":1}`},
+		{name: "structured JSON data",
+			header: nats.Header{"Content-Type": {"application/cloudevents+json; charset=utf-8"}},
+			data:   `{"specversion":"1.0","id":"e1","source":"/orders","type":"order.created","priority":3,"urgent":true,"none":null,"data":{"a":1}}`,
+			wantEvent: &CloudEvent{SpecVersion: "1.0", ID: "e1", Source: "/orders", Type: "order.created",
+				Extensions: map[string]string{"priority": "3", "urgent": "true"}},
+			wantData: `{"a":1}`},
+		{name: "structured text data",
+			header: nats.Header{"content-type": {"application/cloudevents+json"}},
+			data:   `{"specversion":"1.0","id":"e1","source":"/s","type":"t","datacontenttype":"text/plain","data":"hello"}`,
+			wantEvent: &CloudEvent{SpecVersion: "1.0", ID: "e1", Source: "/s", Type: "t", DataContentType: "text/plain",
+				Extensions: map[string]string{}},
+			wantData: `hello`},
+		{name: "structured JSON string data is kept as JSON",
+			header:    nats.Header{"Content-Type": {"application/cloudevents+json"}},
+			data:      `{"specversion":"1.0","id":"e1","source":"/s","type":"t","data":"hello"}`,
+			wantEvent: &CloudEvent{SpecVersion: "1.0", ID: "e1", Source: "/s", Type: "t", Extensions: map[string]string{}},
+			wantData:  `"hello"`},
+		{name: "structured base64 data",
+			header: nats.Header{"Content-Type": {"application/cloudevents+json"}},
+			data:   `{"specversion":"1.0","id":"e1","source":"/s","type":"t","datacontenttype":"application/octet-stream","data_base64":"AAEC"}`,
+			wantEvent: &CloudEvent{SpecVersion: "1.0", ID: "e1", Source: "/s", Type: "t", DataContentType: "application/octet-stream",
+				Extensions: map[string]string{}},
+			wantData: "\x00\x01\x02"},
+
+		{name: "unsupported version", header: binaryHeaders("ce-specversion", "0.3"), data: `{}`,
+			wantErr: `unsupported cloudevents specversion "0.3"`},
+		{name: "missing type", header: nats.Header{"ce-specversion": {"1.0"}, "ce-id": {"e1"}, "ce-source": {"/s"}}, data: `{}`,
+			wantErr: "cloudevent is missing id, source, or type"},
+		{name: "invalid structured event", header: nats.Header{"Content-Type": {"application/cloudevents+json"}}, data: `{"id":`,
+			wantErr: "invalid cloudevent: unexpected end of JSON input"},
+		{name: "invalid base64", header: nats.Header{"Content-Type": {"application/cloudevents+json"}},
+			data:    `{"specversion":"1.0","id":"e1","source":"/s","type":"t","data_base64":"!!"}`,
+			wantErr: "invalid cloudevent: illegal base64 data at input byte 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, data, err := parseCloudEvent(&nats.Msg{Header: tt.header, Data: []byte(tt.data)})
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr || !worker.IsPermanent(err) {
+					t.Fatalf("err = %v, want permanent %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(event, tt.wantEvent) {
+				t.Fatalf("event = %+v, want %+v", event, tt.wantEvent)
+			}
+			if string(data) != tt.wantData {
+				t.Fatalf("data = %q, want %q", data, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		inbound bool
+		header  nats.Header
+		data    string
+		want    WebhookPayload
+		wantErr string
+	}{
+		{name: "worker payload", inbound: true, data: `{"webhook_url":"http://x","data":{"a":1}}`,
+			want: WebhookPayload{WebhookURL: "http://x", Data: map[string]interface{}{"a": 1.0}, rawData: json.RawMessage(`{"a":1}`)}},
+		{name: "event with a worker payload gets an event key", inbound: true, header: binaryHeaders(),
+			data: `{"webhook_id":3,"data":{"a":1}}`,
+			want: WebhookPayload{WebhookID: 3, Data: map[string]interface{}{"a": 1.0}, EventKey: "/orders#e1", rawData: json.RawMessage(`{"a":1}`)}},
+		{name: "the payload's event key wins", inbound: true, header: binaryHeaders(),
+			data: `{"webhook_id":3,"data":{},"event_key":"k"}`,
+			want: WebhookPayload{WebhookID: 3, Data: map[string]interface{}{}, EventKey: "k", rawData: json.RawMessage(`{}`)}},
+		{name: "foreign event routed by extensions", inbound: true,
+			header: binaryHeaders("ce-webhookid", "7", "ce-rule", "Big", webhookIDHeader, "9"), data: `{"a":1}`,
+			want: WebhookPayload{WebhookID: 7, Rule: "Big", Data: map[string]interface{}{"a": 1.0}, EventKey: "/orders#e1",
+				rawData: json.RawMessage(`{"a":1}`)}},
+		{name: "foreign event routed to an action", inbound: true, header: binaryHeaders("ce-action", "notify"), data: `{"a":1}`,
+			want: WebhookPayload{Action: "notify", Data: map[string]interface{}{"a": 1.0}, EventKey: "/orders#e1",
+				rawData: json.RawMessage(`{"a":1}`)}},
+		{name: "plain message routed by headers", inbound: true,
+			header: nats.Header{"rule-webhook-id": {"9"}, ruleHeader: {"Big"}}, data: `{"a":1}`,
+			want: WebhookPayload{WebhookID: 9, Rule: "Big", Data: map[string]interface{}{"a": 1.0}, rawData: json.RawMessage(`{"a":1}`)}},
+		{name: "inbound off ignores ce headers", header: binaryHeaders("ce-webhookid", "7"),
+			data: `{"webhook_url":"http://x","data":{}}`,
+			want: WebhookPayload{WebhookURL: "http://x", Data: map[string]interface{}{}, rawData: json.RawMessage(`{}`)}},
+
+		{name: "invalid webhook id", inbound: true, header: binaryHeaders("ce-webhookid", "seven"), data: `{"a":1}`,
+			wantErr: `invalid webhook id "seven"`},
+		{name: "routed data must be an object", inbound: true, header: nats.Header{webhookIDHeader: {"9"}}, data: `[1]`,
+			wantErr: "data must be a JSON object"},
+		{name: "invalid payload", inbound: true, data: `{"data":`, wantErr: "unexpected end of JSON input"},
+		{name: "invalid event", inbound: true, header: nats.Header{"ce-specversion": {"1.0"}, "ce-id": {"e1"}}, data: `{}`,
+			wantErr: "cloudevent is missing id, source, or type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCloudEvents(t, tt.inbound, "none")
+			payload, event, data, err := decodeMessage(context.Background(), &nats.Msg{Subject: "orders", Header: tt.header, Data: []byte(tt.data)})
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr || !worker.IsPermanent(err) {
+					t.Fatalf("err = %v, want permanent %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*payload, tt.want) {
+				t.Fatalf("payload = %+v, want %+v", *payload, tt.want)
+			}
+			if (event != nil) != (tt.inbound && tt.header.Get("ce-specversion") != "") {
+				t.Fatalf("event = %+v", event)
+			}
+			if string(data) != tt.data {
+				t.Fatalf("data = %s", data)
+			}
+		})
+	}
+}
+
+func TestCloudEventMode(t *testing.T) {
+	tests := []struct {
+		outbound string
+		dest     *Destination
+		want     string
+		wantErr  bool
+	}{
+		{outbound: "none", want: ""},
+		{outbound: "", want: ""},
+		{outbound: "binary", want: "binary"},
+		{outbound: "none", dest: &Destination{CloudEvents: "structured"}, want: "structured"},
+		{outbound: "binary", dest: &Destination{CloudEvents: "none"}, want: ""},
+		{outbound: "binary", dest: &Destination{}, want: "binary"},
+		{outbound: "none", dest: &Destination{CloudEvents: "batched"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		useCloudEvents(t, true, tt.outbound)
+		got, err := cloudEventMode(tt.dest)
+		if got != tt.want || (err != nil) != tt.wantErr || (err != nil && !worker.IsPermanent(err)) {
+			t.Errorf("cloudEventMode(%s, %+v) = %q, %v", tt.outbound, tt.dest, got, err)
+		}
+	}
+}
+
+func TestEncodeCloudEvent(t *testing.T) {
+	event := CloudEvent{SpecVersion: "1.0", ID: "e1", Source: "/s", Type: "t", Extensions: map[string]string{"rule": "Big"}}
+	tests := []struct {
+		name        string
+		mode        string
+		contentType string
+		body        string
+		nilBody     bool
+		wantBody    string
+		wantType    string
+		wantHeaders http.Header
+	}{
+		{name: "binary", mode: cloudEventsBinary, contentType: "application/json", body: `{"a":1}`,
+			wantBody: `{"a":1}`, wantType: "application/json",
+			wantHeaders: http.Header{"Ce-Specversion": {"1.0"}, "Ce-Id": {"e1"}, "Ce-Source": {"/s"}, "Ce-Type": {"t"}, "Ce-Rule": {"Big"}}},
+		{name: "no body uses headers", mode: cloudEventsStructured, nilBody: true,
+			wantHeaders: http.Header{"Ce-Specversion": {"1.0"}, "Ce-Id": {"e1"}, "Ce-Source": {"/s"}, "Ce-Type": {"t"}, "Ce-Rule": {"Big"}}},
+		{name: "structured JSON", mode: cloudEventsStructured, contentType: "application/json", body: `{"a":1}`,
+			wantBody: `{"data":{"a":1},"datacontenttype":"application/json","id":"e1","rule":"Big","source":"/s","specversion":"1.0","type":"t"}`,
+			wantType: "application/cloudevents+json; charset=utf-8"},
+		{name: "structured invalid JSON is base64", mode: cloudEventsStructured, contentType: "application/json", body: `{"a"`,
+			wantBody: `{"data_base64":"eyJhIg==","datacontenttype":"application/json","id":"e1","rule":"Big","source":"/s","specversion":"1.0","type":"t"}`,
+			wantType: "application/cloudevents+json; charset=utf-8"},
+		{name: "structured text", mode: cloudEventsStructured, contentType: "text/plain; charset=utf-8", body: "hi",
+			wantBody: `{"data":"hi","datacontenttype":"text/plain; charset=utf-8","id":"e1","rule":"Big","source":"/s","specversion":"1.0","type":"t"}`,
+			wantType: "application/cloudevents+json; charset=utf-8"},
+		{name: "structured XML", mode: cloudEventsStructured, contentType: "application/xml", body: "<a/>",
+			wantBody: `{"data":"\u003ca/\u003e","datacontenttype":"application/xml","id":"e1","rule":"Big","source":"/s","specversion":"1.0","type":"t"}`,
+			wantType: "application/cloudevents+json; charset=utf-8"},
+		{name: "structured binary", mode: cloudEventsStructured, contentType: "application/octet-stream", body: "\x00\x01",
+			wantBody: `{"data_base64":"AAE=","datacontenttype":"application/octet-stream","id":"e1","rule":"Big","source":"/s","specversion":"1.0","type":"t"}`,
+			wantType: "application/cloudevents+json; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			if !tt.nilBody {
+				body = []byte(tt.body)
+			}
+			gotBody, gotType, gotHeaders, err := encodeCloudEvent(tt.mode, event, tt.contentType, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(gotBody) != tt.wantBody || gotType != tt.wantType {
+				t.Fatalf("body = %s (%s), want %s (%s)", gotBody, gotType, tt.wantBody, tt.wantType)
+			}
+			if !reflect.DeepEqual(gotHeaders, tt.wantHeaders) {
+				t.Fatalf("headers = %v, want %v", gotHeaders, tt.wantHeaders)
+			}
+		})
+	}
+}
+
+func TestCloudEventRoundTrip(t *testing.T) {
+	event := CloudEvent{SpecVersion: "1.0", ID: "e1", Source: "/s", Type: "t", Subject: "o1", Time: "2024-01-01T00:00:00Z",
+		DataSchema: "/schema", Extensions: map[string]string{"rule": "Big"}}
+	for _, mode := range []string{cloudEventsBinary, cloudEventsStructured} {
+		for _, tc := range []struct{ contentType, body string }{
+			{"application/json", `{"a":[1,2]}`},
+			{"text/plain", "hello"},
+			{"application/octet-stream", "\x00\xff"},
+		} {
+			body, contentType, headers, err := encodeCloudEvent(mode, event, tc.contentType, []byte(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := &nats.Msg{Header: nats.Header{"Content-Type": {contentType}}, Data: body}
+			for key, values := range headers {
+				msg.Header[key] = values
+			}
+			got, data, err := parseCloudEvent(msg)
+			if err != nil {
+				t.Fatalf("%s %s: %v", mode, tc.contentType, err)
+			}
+			want := event
+			want.DataContentType = tc.contentType
+			if !reflect.DeepEqual(*got, want) || string(data) != tc.body {
+				t.Fatalf("%s %s: event = %+v, data = %q", mode, tc.contentType, *got, data)
+			}
+		}
+	}
+}
+
+func TestOutboundCloudEvent(t *testing.T) {
+	useCloudEvents(t, true, "binary")
+
+	// Inbound events are forwarded without their routing extensions
+	in := &CloudEvent{SpecVersion: "1.0", ID: "e1", Source: "/orders", Type: "order.created",
+		Extensions: map[string]string{"webhookid": "7", "action": "notify", "rule": "Big", "tenant": "acme"}}
+	got := outboundCloudEvent(&ActionMessage{Msg: &nats.Msg{}, Payload: &WebhookPayload{}, Event: in})
+	if want := map[string]string{"rule": "Big", "tenant": "acme"}; got.ID != "e1" || got.Source != "/orders" ||
+		!reflect.DeepEqual(got.Extensions, want) {
+		t.Fatalf("forwarded = %+v", got)
+	}
+	if len(in.Extensions) != 4 {
+		t.Fatal("the inbound event was changed")
+	}
+
+	// Others get the configured source and type and a stable id
+	msg := &nats.Msg{Header: nats.Header{nats.MsgIdHdr: {"order-1"}}}
+	got = outboundCloudEvent(&ActionMessage{Msg: msg, Payload: &WebhookPayload{EventKey: "o1", Rule: "Big"}})
+	if got.SpecVersion != "1.0" || got.ID != "order-1" || got.Source != "/worker" || got.Type != "com.example.webhook" ||
+		got.Subject != "o1" || got.Time == "" || got.Extensions["rule"] != "Big" {
+		t.Fatalf("event = %+v", got)
+	}
+	a := cloudEventID(&nats.Msg{})
+	if b := cloudEventID(&nats.Msg{}); len(a) != 32 || a == b {
+		t.Fatalf("random ids %q, %q", a, b)
+	}
+}
+
+func TestWebhookActionCloudEvents(t *testing.T) {
+	tests := []struct {
+		mode       string
+		wantType   string
+		wantHeader string // ce-id header
+		wantBody   string
+	}{
+		{mode: "none", wantType: "application/json", wantBody: `{"id":1}`},
+		{mode: "binary", wantType: "application/json", wantHeader: "order-1", wantBody: `{"id":1}`},
+		{mode: "structured", wantType: "application/cloudevents+json; charset=utf-8", wantBody: `"data":{"id":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			useCloudEvents(t, true, tt.mode)
+			var got *http.Request
+			var body []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				body, _ = io.ReadAll(r.Body)
+			}))
+			defer srv.Close()
+
+			m := &ActionMessage{
+				Msg:     &nats.Msg{Header: nats.Header{nats.MsgIdHdr: {"order-1"}}},
+				Payload: &WebhookPayload{WebhookURL: srv.URL, Data: map[string]interface{}{"id": 1}},
+			}
+			if _, err := (webhookAction{}).Execute(context.Background(), m); err != nil {
+				t.Fatal(err)
+			}
+			if ct := got.Header.Get("Content-Type"); ct != tt.wantType {
+				t.Fatalf("content type = %q", ct)
+			}
+			if id := got.Header.Get("ce-id"); id != tt.wantHeader {
+				t.Fatalf("ce-id = %q", id)
+			}
+			if !strings.Contains(string(body), tt.wantBody) {
+				t.Fatalf("body = %s", body)
+			}
+		})
+	}
+}
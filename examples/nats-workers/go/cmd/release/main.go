@@ -0,0 +1,222 @@
+// Command release builds the worker, rule-api, rulectl, and rule-operator
+// for every supported platform as static binaries stamped with their
+// version, packages them with checksums, and optionally builds multi-arch
+// distroless container images from the same binaries. Run it from the
+// module directory:
+//
+//	go run ./cmd/release -version v1.2.3
+//	go run ./cmd/release -version v1.2.3 -image docker.io/acme/rule-engine- -push
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// binary is one command the release ships
+type binary struct {
+	name string
+	pkg  string
+	// module is the directory of the command's own Go module, empty for
+	// this one
+	module string
+}
+
+var binaries = []binary{
+	{"webhook-worker", ".", ""},
+	{"rule-api", "./cmd/rule-api", ""},
+	{"rulectl", "./cmd/rulectl", ""},
+	{"rule-operator", ".", "cmd/rule-operator"},
+}
+
+const defaultPlatforms = "linux/amd64,linux/arm64,darwin/amd64,darwin/arm64"
+
+func main() {
+	log.SetFlags(0)
+	version := flag.String("version", gitOutput("describe", "--tags", "--always", "--dirty"), "release version stamped into the binaries")
+	out := flag.String("out", "dist", "output directory, emptied first")
+	platforms := flag.String("platforms", defaultPlatforms, "comma-separated GOOS/GOARCH pairs")
+	image := flag.String("image", "", "build container images named this prefix followed by each binary's name, e.g. docker.io/acme/rule-engine-")
+	push := flag.Bool("push", false, "push the images instead of writing them to -out as OCI archives")
+	latest := flag.Bool("latest", false, "also tag the images latest")
+	flag.Parse()
+
+	if _, err := os.Stat("go.mod"); err != nil {
+		log.Fatal("release: run from the module directory (examples/nats-workers/go)")
+	}
+	if *version == "" {
+		*version = "dev"
+	}
+	commit := gitOutput("rev-parse", "HEAD")
+	// The commit's time rather than now, so rebuilding a tag gives the
+	// same binaries
+	date := gitOutput("log", "-1", "--format=%cI")
+	if date == "" {
+		date = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	if err := os.RemoveAll(*out); err != nil {
+		log.Fatalf("release: %v", err)
+	}
+	ldflags := fmt.Sprintf("-s -w -X main.version=%s -X main.commit=%s -X main.date=%s", *version, commit, date)
+
+	// Named like goreleaser's, apart from the extension's own release files
+	prefix := "rule-engine-nats_" + strings.TrimPrefix(*version, "v")
+	var archives, linux []string
+	for _, platform := range strings.Split(*platforms, ",") {
+		goos, goarch, ok := strings.Cut(strings.TrimSpace(platform), "/")
+		if !ok {
+			log.Fatalf("release: -platforms: want GOOS/GOARCH, got %q", platform)
+		}
+		dir := filepath.Join(*out, goos+"_"+goarch)
+		for _, b := range binaries {
+			log.Printf("building %s for %s/%s", b.name, goos, goarch)
+			output, err := filepath.Abs(filepath.Join(dir, b.name))
+			if err != nil {
+				log.Fatalf("release: %v", err)
+			}
+			cmd := exec.Command("go", "build", "-trimpath", "-ldflags", ldflags, "-o", output, b.pkg)
+			cmd.Dir = b.module
+			cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS="+goos, "GOARCH="+goarch)
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				log.Fatalf("release: building %s for %s/%s: %v", b.name, goos, goarch, err)
+			}
+		}
+		archive := filepath.Join(*out, fmt.Sprintf("%s_%s_%s.tar.gz", prefix, goos, goarch))
+		if err := writeArchive(archive, dir); err != nil {
+			log.Fatalf("release: %v", err)
+		}
+		archives = append(archives, archive)
+		if goos == "linux" {
+			linux = append(linux, goos+"/"+goarch)
+		}
+	}
+	if err := writeChecksums(filepath.Join(*out, prefix+"_checksums.txt"), archives); err != nil {
+		log.Fatalf("release: %v", err)
+	}
+
+	if *image != "" {
+		if len(linux) == 0 {
+			log.Fatal("release: -image needs at least one linux platform")
+		}
+		for _, b := range binaries {
+			if err := buildImage(*image+b.name, b.name, *version, commit, linux, *out, *push, *latest); err != nil {
+				log.Fatalf("release: %v", err)
+			}
+		}
+	}
+	log.Printf("released %s (%s) to %s", *version, commit, *out)
+}
+
+// buildImage builds name from Dockerfile.release with the binaries in out
+// for the linux platforms, pushing it or saving it as an OCI archive
+func buildImage(name, binary, version, commit string, platforms []string, out string, push, latest bool) error {
+	tag := name + ":" + strings.TrimPrefix(version, "v")
+	args := []string{"buildx", "build",
+		"--file", "Dockerfile.release",
+		"--platform", strings.Join(platforms, ","),
+		"--build-arg", "BINARY=" + binary,
+		"--label", "org.opencontainers.image.title=" + binary,
+		"--label", "org.opencontainers.image.version=" + version,
+		"--label", "org.opencontainers.image.revision=" + commit,
+		"--tag", tag,
+	}
+	if latest {
+		args = append(args, "--tag", name+":latest")
+	}
+	if push {
+		args = append(args, "--push")
+	} else {
+		args = append(args, "--output", "type=oci,dest="+filepath.Join(out, binary+"-image.tar"))
+	}
+	log.Printf("building image %s for %s", tag, strings.Join(platforms, ", "))
+	cmd := exec.Command("docker", append(args, out)...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("building image %s: %w", tag, err)
+	}
+	return nil
+}
+
+// writeArchive packs the files in dir into a .tar.gz at path
+func writeArchive(path, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.ModTime = time.Time{}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		src, err := os.Open(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeChecksums writes sha256sum-style lines for files
+func writeChecksums(path string, files []string) error {
+	sort.Strings(files)
+	var lines strings.Builder
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(&lines, "%s  %s\n", hex.EncodeToString(sum[:]), filepath.Base(file))
+	}
+	return os.WriteFile(path, []byte(lines.String()), 0o644)
+}
+
+// gitOutput runs git and returns its trimmed output, or "" outside a
+// checkout
+func gitOutput(args ...string) string {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
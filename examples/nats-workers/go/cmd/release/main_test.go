@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteArchive(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "linux_amd64")
+	if err := os.Mkdir(bin, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"rulectl": "#!rulectl", "webhook-worker": "#!worker"}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := filepath.Join(dir, "first.tar.gz")
+	if err := writeArchive(first, bin); err != nil {
+		t.Fatal(err)
+	}
+	// Rebuilding gives the same archive, whatever the files' times
+	later := time.Now().Add(time.Hour)
+	for name := range files {
+		os.Chtimes(filepath.Join(bin, name), later, later)
+	}
+	second := filepath.Join(dir, "second.tar.gz")
+	if err := writeArchive(second, bin); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := os.ReadFile(first)
+	b, _ := os.ReadFile(second)
+	if !bytes.Equal(a, b) {
+		t.Fatal("archives of the same files differ")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	got := map[string]string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Mode&0o111 == 0 || h.ModTime.Unix() != 0 {
+			t.Errorf("%s: mode %o, modified %s", h.Name, h.Mode, h.ModTime)
+		}
+		content, _ := io.ReadAll(tr)
+		got[h.Name] = string(content)
+	}
+	if len(got) != len(files) || got["rulectl"] != files["rulectl"] || got["webhook-worker"] != files["webhook-worker"] {
+		t.Fatalf("archive holds %v", got)
+	}
+
+	if err := writeArchive(filepath.Join(dir, "missing.tar.gz"), filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("archived a missing directory")
+	}
+}
+
+func TestWriteChecksums(t *testing.T) {
+	dir := t.TempDir()
+	contents := map[string]string{
+		"rule-engine-nats_1.2.3_linux_arm64.tar.gz":  "arm64",
+		"rule-engine-nats_1.2.3_darwin_amd64.tar.gz": "darwin",
+	}
+	var files []string
+	for name, content := range contents {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+
+	path := filepath.Join(dir, "checksums.txt")
+	if err := writeChecksums(path, files); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(path)
+	// sha256sum -c format, by file name
+	want := sum("darwin") + "  rule-engine-nats_1.2.3_darwin_amd64.tar.gz\n" +
+		sum("arm64") + "  rule-engine-nats_1.2.3_linux_arm64.tar.gz\n"
+	if string(got) != want {
+		t.Fatalf("checksums:\n%s\nwant:\n%s", got, want)
+	}
+
+	if err := writeChecksums(path, []string{filepath.Join(dir, "missing.tar.gz")}); err == nil {
+		t.Fatal("checksummed a missing file")
+	}
+}
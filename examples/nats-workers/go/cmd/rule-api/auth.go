@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// apiKey is one accepted key. Name identifies the caller in the rule audit
+// log; Roles limit what it may do (see authz.go).
+type apiKey struct {
+	Name  string
+	Key   string
+	Roles []string
+}
+
+// parseAPIKeys reads RULE_API_KEYS: comma-separated "name=key" entries, or
+// bare keys, which are named key-1, key-2, ... by position
+func parseAPIKeys(value string) []apiKey {
+	var keys []apiKey
+	for i, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		k := apiKey{Name: fmt.Sprintf("key-%d", i+1), Key: entry}
+		if name, key, ok := strings.Cut(entry, "="); ok && name != "" && key != "" {
+			k = apiKey{Name: strings.TrimSpace(name), Key: strings.TrimSpace(key)}
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// storedKeyTTL bounds how long a key stored in Postgres is trusted without
+// looking it up again, and so how long a revoked key keeps working
+const storedKeyTTL = 30 * time.Second
+
+// authenticator checks presented keys against RULE_API_KEYS and, with
+// RULE_API_STORED_KEYS, the keys issued with "rulectl apikey create". With
+// RULE_API_OIDC_ISSUER it also accepts the issuer's JWTs.
+type authenticator struct {
+	keys  []apiKey
+	store *ruleengine.Client // nil unless stored keys are enabled
+	oidc  *oidcVerifier      // nil unless RULE_API_OIDC_ISSUER is set
+
+	mu     sync.Mutex
+	cached map[[sha256.Size]byte]cachedKey
+}
+
+type cachedKey struct {
+	principal *principal // nil for an invalid key
+	expires   time.Time
+}
+
+// enabled reports whether any key is accepted; without keys the API is
+// unauthenticated
+func (a *authenticator) enabled() bool {
+	return len(a.keys) > 0 || a.store != nil || a.oidc != nil
+}
+
+// authenticate returns the caller presenting a key or token, or nil for an
+// unknown key or invalid token. Errors are failures to look the key up or
+// to fetch the token issuer's signing keys.
+func (a *authenticator) authenticate(ctx context.Context, presented string) (*principal, error) {
+	if presented == "" {
+		return nil, nil
+	}
+	if key, ok := validAPIKey(a.keys, presented); ok {
+		return &principal{Name: key.Name, Roles: key.Roles}, nil
+	}
+	if a.oidc != nil && looksLikeJWT(presented) {
+		p, err := a.oidc.verify(ctx, presented)
+		if errors.Is(err, errInvalidToken) {
+			return nil, nil
+		}
+		return p, err
+	}
+	if a.store == nil {
+		return nil, nil
+	}
+
+	hash := sha256.Sum256([]byte(presented))
+	a.mu.Lock()
+	cached, ok := a.cached[hash]
+	a.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.principal, nil
+	}
+
+	var p *principal
+	key, err := a.store.AuthenticateAPIKey(ctx, presented)
+	switch {
+	case err == nil:
+		p = &principal{Name: key.Name, Roles: key.Roles, RuleSets: key.RuleSetIDs, Tenant: key.Tenant}
+	case !errors.Is(err, ruleengine.ErrAPIKeyInvalid):
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cached == nil || len(a.cached) >= 10000 {
+		// Unknown keys are cached too, so bound what a scan of random keys
+		// can fill
+		a.cached = map[[sha256.Size]byte]cachedKey{}
+	}
+	a.cached[hash] = cachedKey{principal: p, expires: time.Now().Add(storedKeyTTL)}
+	return p, nil
+}
+
+// requireAPIKey accepts "Authorization: Bearer <key>" or "X-API-Key: <key>"
+// matching one of RULE_API_KEYS or a stored key, attributes changes made by
+// the request to the key's name, and authorizes the request with the key's
+// roles. Without keys it is a no-op.
+// Browsers' EventSource cannot set headers, so /v1/events also accepts an
+// access_token query parameter.
+func requireAPIKey(auth *authenticator, next http.Handler) http.Handler {
+	if !auth.enabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := auth.authenticate(r.Context(), presentedKey(r))
+		if err != nil {
+			log.Printf("⚠️  Failed to check API key: %v", err)
+			writeJSON(w, http.StatusServiceUnavailable, errorBody{Error: "failed to check API key"})
+			return
+		}
+		if p == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, errorBody{Error: "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(principalContext(r.Context(), p)))
+	})
+}
+
+func presentedKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if r.URL.Path == "/v1/events" {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// validAPIKey compares against every key so timing does not reveal which
+// (if any) prefix matched, and returns the matching key
+func validAPIKey(keys []apiKey, presented string) (*apiKey, bool) {
+	if presented == "" {
+		return nil, false
+	}
+	var match *apiKey
+	for i, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(key.Key)) == 1 {
+			match = &keys[i]
+		}
+	}
+	return match, match != nil
+}
+
+// principalContext returns ctx carrying p's name as the audit actor and p
+// as the caller to authorize
+func principalContext(ctx context.Context, p *principal) context.Context {
+	return withPrincipal(ruleengine.WithActor(ctx, p.Name), p)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []apiKey
+	}{
+		{"", nil},
+		{"abc", []apiKey{{Name: "key-1", Key: "abc"}}},
+		{"ci=abc, ops = def ,", []apiKey{{Name: "ci", Key: "abc"}, {Name: "ops", Key: "def"}}},
+		{"abc,,def", []apiKey{{Name: "key-1", Key: "abc"}, {Name: "key-3", Key: "def"}}},
+		{"=abc", []apiKey{{Name: "key-1", Key: "=abc"}}},
+	}
+	for _, tt := range tests {
+		if got := parseAPIKeys(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAPIKeys(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPresentedKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		header map[string]string
+		want   string
+	}{
+		{name: "none", path: "/v1/rules"},
+		{name: "x-api-key", path: "/v1/rules", header: map[string]string{"X-API-Key": "k1"}, want: "k1"},
+		{name: "bearer", path: "/v1/rules", header: map[string]string{"Authorization": "Bearer k2"}, want: "k2"},
+		{name: "x-api-key wins", path: "/v1/rules", header: map[string]string{"X-API-Key": "k1", "Authorization": "Bearer k2"}, want: "k1"},
+		{name: "basic ignored", path: "/v1/rules", header: map[string]string{"Authorization": "Basic eDp5"}},
+		{name: "query only for events", path: "/v1/rules?access_token=k3"},
+		{name: "events query", path: "/v1/events?access_token=k3", want: "k3"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		if got := presentedKey(req); got != tt.want {
+			t.Errorf("%s: presentedKey = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidAPIKey(t *testing.T) {
+	keys := []apiKey{{Name: "a", Key: "alpha"}, {Name: "b", Key: "beta"}}
+	tests := []struct {
+		presented string
+		want      string
+	}{
+		{"alpha", "a"},
+		{"beta", "b"},
+		{"alph", ""},
+		{"alphaa", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		key, ok := validAPIKey(keys, tt.presented)
+		if ok != (tt.want != "") || (ok && key.Name != tt.want) {
+			t.Errorf("validAPIKey(%q) = %v, %v; want %q", tt.presented, key, ok, tt.want)
+		}
+	}
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	var actor string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor = ruleengine.ActorFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	open := requireAPIKey(&authenticator{}, next)
+	if rec := do(open, "GET", "/v1/rules", "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("without keys: status %d", rec.Code)
+	}
+
+	auth := &authenticator{keys: []apiKey{{Name: "ci", Key: "secret", Roles: []string{ruleengine.RoleViewer}}}}
+	h := requireAPIKey(auth, next)
+	if rec := do(h, "GET", "/v1/rules", "", nil); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Fatalf("missing key: status %d", rec.Code)
+	}
+	if rec := do(h, "GET", "/v1/rules", "wrong", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong key: status %d", rec.Code)
+	}
+	if rec := do(h, "GET", "/v1/rules", "secret", nil); rec.Code != http.StatusNoContent || actor != "ci" {
+		t.Fatalf("valid key: status %d, actor %q", rec.Code, actor)
+	}
+}
+
+func TestAuthenticateEmpty(t *testing.T) {
+	auth := &authenticator{keys: []apiKey{{Name: "ci", Key: "secret"}}}
+	p, err := auth.authenticate(context.Background(), "")
+	if p != nil || err != nil {
+		t.Fatalf("empty key: %v, %v", p, err)
+	}
+}
+
+func TestAuthenticateStoredKeys(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	auth := &authenticator{keys: []apiKey{{Name: "ci", Key: "static"}}, store: ruleengine.New(db)}
+
+	const secret = "rek_0123456789ab_c2VjcmV0"
+	hash := sha256.Sum256([]byte(secret))
+	lookup := `SELECT key_id, key_hash FROM rule_api_keys`
+	mock.ExpectQuery(lookup).WithArgs("rek_0123456789ab").
+		WillReturnRows(sqlmock.NewRows([]string{"key_id", "key_hash"}).AddRow(7, hash[:]))
+	mock.ExpectQuery(`UPDATE rule_api_keys SET last_used_at`).WillReturnRows(sqlmock.NewRows([]string{"key_id", "name", "roles",
+		"ruleset_ids", "tenant", "prefix", "created_by", "created_at", "expires_at", "last_used_at", "revoked_at", "replaced_by"}).
+		AddRow(7, "team-a", []byte("{operator}"), []byte("{3}"), "acme", "rek_0123456789ab", "", time.Now(), nil, nil, nil, 0))
+	mock.ExpectQuery(lookup).WithArgs("rek_ffffffffffff").WillReturnRows(sqlmock.NewRows([]string{"key_id", "key_hash"}))
+	mock.ExpectQuery(lookup).WithArgs("rek_eeeeeeeeeeee").WillReturnError(errors.New("connection reset"))
+
+	tests := []struct {
+		name      string
+		presented string
+		want      *principal
+		wantErr   bool
+	}{
+		{name: "static key", presented: "static", want: &principal{Name: "ci"}},
+		{name: "stored key", presented: secret,
+			want: &principal{Name: "team-a", Roles: []string{"operator"}, RuleSets: []int{3}, Tenant: "acme"}},
+		// Answered from the cache: no more queries are expected
+		{name: "stored key again", presented: secret,
+			want: &principal{Name: "team-a", Roles: []string{"operator"}, RuleSets: []int{3}, Tenant: "acme"}},
+		{name: "unknown key", presented: "rek_ffffffffffff_eA"},
+		{name: "unknown key again", presented: "rek_ffffffffffff_eA"},
+		{name: "not a stored key", presented: "guess"},
+		{name: "lookup fails", presented: "rek_eeeeeeeeeeee_eA", wantErr: true},
+	}
+	for _, tt := range tests {
+		p, err := auth.authenticate(context.Background(), tt.presented)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("%s: authenticate = %+v, %v; want %+v", tt.name, p, err, tt.want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the cache entry expires the key is looked up again
+	auth.mu.Lock()
+	for k, v := range auth.cached {
+		v.expires = time.Now().Add(-time.Second)
+		auth.cached[k] = v
+	}
+	auth.mu.Unlock()
+	mock.ExpectQuery(lookup).WithArgs("rek_0123456789ab").WillReturnRows(sqlmock.NewRows([]string{"key_id", "key_hash"}))
+	if p, err := auth.authenticate(context.Background(), secret); p != nil || err != nil {
+		t.Fatalf("revoked key = %+v, %v", p, err)
+	}
+}
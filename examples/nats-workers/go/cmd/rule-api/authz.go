@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// access is what a route needs from the caller's roles
+type access int
+
+const (
+	accessRead    access = iota // read rules, statistics, and events; evaluate
+	accessOperate               // enable and disable rules and rule sets
+	accessAuthor                // create, change, and delete rules and rule sets
+	accessAdmin                 // everything
+)
+
+func (a access) String() string {
+	return [...]string{"read", "operate", "author", "admin"}[a]
+}
+
+// roleAccess is what each role grants. rule-author includes operate, so
+// authors can switch off a rule they are changing.
+var roleAccess = map[string][]access{
+	ruleengine.RoleViewer:     {accessRead},
+	ruleengine.RoleOperator:   {accessRead, accessOperate},
+	ruleengine.RoleRuleAuthor: {accessRead, accessOperate, accessAuthor},
+	ruleengine.RoleAdmin:      {accessRead, accessOperate, accessAuthor, accessAdmin},
+}
+
+// parseRoles checks a "|"-separated list of role names
+func parseRoles(value string) ([]string, error) {
+	var roles []string
+	for _, role := range strings.Split(value, "|") {
+		role = strings.TrimSpace(role)
+		if _, ok := roleAccess[role]; !ok {
+			return nil, fmt.Errorf("unknown role %q (expected %s)", role, strings.Join(ruleengine.Roles, ", "))
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// assignKeyRoles gives each key the roles RULE_API_KEY_ROLES lists for its
+// name ("name=role|role,..."), or defaultRoles
+func assignKeyRoles(keys []apiKey, value, defaultRoles string) error {
+	fallback, err := parseRoles(defaultRoles)
+	if err != nil {
+		return fmt.Errorf("RULE_API_DEFAULT_ROLE: %w", err)
+	}
+	byName, err := parseRoleMap(value)
+	if err != nil {
+		return fmt.Errorf("RULE_API_KEY_ROLES: %w", err)
+	}
+	for i := range keys {
+		keys[i].Roles = fallback
+		if roles, ok := byName[keys[i].Name]; ok {
+			keys[i].Roles = roles
+			delete(byName, keys[i].Name)
+		}
+	}
+	for name := range byName {
+		return fmt.Errorf("RULE_API_KEY_ROLES: no API key is named %q", name)
+	}
+	return nil
+}
+
+// parseRoleMap reads comma-separated "name=role|role" entries
+func parseRoleMap(value string) (map[string][]string, error) {
+	m := map[string][]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, roles, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not name=role", entry)
+		}
+		parsed, err := parseRoles(roles)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", strings.TrimSpace(name), err)
+		}
+		m[strings.TrimSpace(name)] = parsed
+	}
+	return m, nil
+}
+
+// principal is the authenticated caller
+type principal struct {
+	Name  string
+	Roles []string
+
+	// RuleSets limits a stored key to these rule sets; empty means all
+	RuleSets []int
+	Tenant   string
+}
+
+// can reports whether p's roles grant a
+func (p *principal) can(a access) bool {
+	for _, role := range p.Roles {
+		for _, granted := range roleAccess[role] {
+			if granted == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// forbiddenError is returned when the caller's roles do not grant the
+// access an operation needs
+type forbiddenError struct {
+	name    string
+	need    access
+	ruleSet int    // set when the rule set is outside the caller's scope
+	rule    string // set when the rule is outside the caller's scope
+}
+
+func (e *forbiddenError) Error() string {
+	if e.ruleSet != 0 {
+		return fmt.Sprintf("%s may not use rule set %d", e.name, e.ruleSet)
+	}
+	if e.rule != "" {
+		return fmt.Sprintf("%s may not use rule %s", e.name, e.rule)
+	}
+	return fmt.Sprintf("%s may not do this: it needs %s access", e.name, e.need)
+}
+
+// authorize checks that the caller in ctx has access a. Without
+// authentication (no API keys configured) there is no caller and
+// everything is allowed.
+func authorize(ctx context.Context, a access) error {
+	p, ok := ctx.Value(principalKey{}).(*principal)
+	if !ok || p.can(a) {
+		return nil
+	}
+	return &forbiddenError{name: p.Name, need: a}
+}
+
+// scoped returns the caller in ctx when it is limited to some rule sets
+func scoped(ctx context.Context) (*principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*principal)
+	return p, ok && len(p.RuleSets) > 0
+}
+
+// inScope reports whether rule set id is one of p's
+func (p *principal) inScope(id int) bool {
+	for _, allowed := range p.RuleSets {
+		if allowed == id {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeRuleSet checks that rule set id is within the caller's scope
+func authorizeRuleSet(ctx context.Context, id int) error {
+	if p, ok := scoped(ctx); ok && !p.inScope(id) {
+		return &forbiddenError{name: p.Name, ruleSet: id}
+	}
+	return nil
+}
+
+// authorizeRule checks that rule name is within the caller's scope. Reading
+// it needs one of its rule sets in scope; anything else needs all of them,
+// since a change to a shared rule changes every rule set it is in. A rule
+// in no rule set is in no scope, except to add it to one (member).
+func authorizeRule(ctx context.Context, c *ruleengine.Client, name string, a access, member bool) error {
+	p, ok := scoped(ctx)
+	if !ok {
+		return nil
+	}
+	ids, err := c.RuleSetsOf(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 && member {
+		return nil
+	}
+	in := 0
+	for _, id := range ids {
+		if p.inScope(id) {
+			in++
+		}
+	}
+	if in == 0 || (a != accessRead && in < len(ids)) {
+		return &forbiddenError{name: p.Name, rule: name}
+	}
+	return nil
+}
+
+// scopeRules leaves out the rules outside the caller's rule sets
+func scopeRules(ctx context.Context, c *ruleengine.Client, rules []ruleengine.Rule) ([]ruleengine.Rule, error) {
+	p, ok := scoped(ctx)
+	if !ok {
+		return rules, nil
+	}
+	members, err := c.RuleSetMembers(ctx, p.RuleSets)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, set := range members {
+		for _, m := range set {
+			names[m.Rule] = true
+		}
+	}
+	kept := []ruleengine.Rule{}
+	for _, r := range rules {
+		if names[r.Name] {
+			kept = append(kept, r)
+		}
+	}
+	return kept, nil
+}
+
+// scopeRuleSets leaves out the rule sets outside the caller's scope
+func scopeRuleSets(ctx context.Context, sets []ruleengine.RuleSet) []ruleengine.RuleSet {
+	p, ok := scoped(ctx)
+	if !ok {
+		return sets
+	}
+	kept := []ruleengine.RuleSet{}
+	for _, rs := range sets {
+		if p.inScope(rs.ID) {
+			kept = append(kept, rs)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	ruleenginev1 "github.com/rule-engine/nats-webhook-worker/api/ruleengine/v1"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func TestParseRoles(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr string
+	}{
+		{in: "viewer", want: []string{"viewer"}},
+		{in: " operator | rule-author ", want: []string{"operator", "rule-author"}},
+		{in: "admin", want: []string{"admin"}},
+		{in: "root", wantErr: `unknown role "root" (expected viewer, operator, rule-author, admin)`},
+		{in: "viewer|", wantErr: `unknown role ""`},
+		{in: "", wantErr: `unknown role ""`},
+	}
+	for _, tt := range tests {
+		got, err := parseRoles(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseRoles(%q) err = %v, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRoles(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestAssignKeyRoles(t *testing.T) {
+	tests := []struct {
+		name        string
+		roles, dflt string
+		want        map[string][]string
+		wantErr     string
+	}{
+		{name: "default for all", dflt: "viewer",
+			want: map[string][]string{"ci": {"viewer"}, "ops": {"viewer"}}},
+		{name: "per key", roles: "ci=rule-author, ops=operator|viewer", dflt: "admin",
+			want: map[string][]string{"ci": {"rule-author"}, "ops": {"operator", "viewer"}}},
+		{name: "some keys listed", roles: "ops=operator,", dflt: "viewer",
+			want: map[string][]string{"ci": {"viewer"}, "ops": {"operator"}}},
+		{name: "bad default", dflt: "everyone", wantErr: "RULE_API_DEFAULT_ROLE: unknown role"},
+		{name: "not name=role", roles: "ci", dflt: "viewer", wantErr: `RULE_API_KEY_ROLES: "ci" is not name=role`},
+		{name: "bad role", roles: "ci=root", dflt: "viewer", wantErr: "RULE_API_KEY_ROLES: ci: unknown role"},
+		{name: "unknown key", roles: "deploy=admin", dflt: "viewer", wantErr: `no API key is named "deploy"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := []apiKey{{Name: "ci", Key: "a"}, {Name: "ops", Key: "b"}}
+			err := assignKeyRoles(keys, tt.roles, tt.dflt)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range keys {
+				if !reflect.DeepEqual(k.Roles, tt.want[k.Name]) {
+					t.Errorf("%s roles = %v, want %v", k.Name, k.Roles, tt.want[k.Name])
+				}
+			}
+		})
+	}
+}
+
+func TestRoleAccess(t *testing.T) {
+	// Each role includes the ones before it
+	tests := []struct {
+		role string
+		want []access
+	}{
+		{ruleengine.RoleViewer, []access{accessRead}},
+		{ruleengine.RoleOperator, []access{accessRead, accessOperate}},
+		{ruleengine.RoleRuleAuthor, []access{accessRead, accessOperate, accessAuthor}},
+		{ruleengine.RoleAdmin, []access{accessRead, accessOperate, accessAuthor, accessAdmin}},
+	}
+	for _, tt := range tests {
+		p := &principal{Name: "k", Roles: []string{tt.role}}
+		for a := accessRead; a <= accessAdmin; a++ {
+			want := false
+			for _, granted := range tt.want {
+				want = want || granted == a
+			}
+			if got := p.can(a); got != want {
+				t.Errorf("%s can %s = %v", tt.role, a, got)
+			}
+		}
+	}
+	if (&principal{Name: "none"}).can(accessRead) {
+		t.Error("a caller without roles can read")
+	}
+	if p := (&principal{Roles: []string{"viewer", "operator"}}); !p.can(accessOperate) || p.can(accessAuthor) {
+		t.Error("roles are not combined")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	viewer := withPrincipal(context.Background(), &principal{Name: "ci", Roles: []string{ruleengine.RoleViewer}})
+	scoped := withPrincipal(context.Background(), &principal{Name: "team-a", Roles: []string{ruleengine.RoleAdmin}, RuleSets: []int{3, 5}})
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr string
+	}{
+		{name: "unauthenticated", err: authorize(context.Background(), accessAdmin)},
+		{name: "granted", err: authorize(viewer, accessRead)},
+		{name: "not granted", err: authorize(viewer, accessOperate), wantErr: "ci may not do this: it needs operate access"},
+		{name: "unscoped key", err: authorizeRuleSet(viewer, 9)},
+		{name: "unauthenticated rule set", err: authorizeRuleSet(context.Background(), 9)},
+		{name: "rule set in scope", err: authorizeRuleSet(scoped, 5)},
+		{name: "rule set out of scope", err: authorizeRuleSet(scoped, 4), wantErr: "team-a may not use rule set 4"},
+	}
+	for _, tt := range tests {
+		if tt.wantErr == "" {
+			if tt.err != nil {
+				t.Errorf("%s: %v", tt.name, tt.err)
+			}
+			continue
+		}
+		var forbidden *forbiddenError
+		if !errors.As(tt.err, &forbidden) || tt.err.Error() != tt.wantErr {
+			t.Errorf("%s: err = %v, want %q", tt.name, tt.err, tt.wantErr)
+		}
+	}
+}
+
+func TestRouteAccess(t *testing.T) {
+	keys := []apiKey{
+		{Name: "viewer", Key: "v", Roles: []string{ruleengine.RoleViewer}},
+		{Name: "operator", Key: "o", Roles: []string{ruleengine.RoleOperator}},
+		{Name: "author", Key: "r", Roles: []string{ruleengine.RoleRuleAuthor}},
+		{Name: "admin", Key: "a", Roles: []string{ruleengine.RoleAdmin}},
+	}
+	h, _ := newTestServer(t, keys...)
+
+	// Requests that pass authorization may still fail against the empty
+	// database; only 403 matters here
+	routes := []struct {
+		method, path string
+		need         access
+	}{
+		{"GET", "/v1/rules", accessRead},
+		{"POST", "/v1/rulesets/1/evaluate", accessRead},
+		{"POST", "/v1/rules/A/enable", accessOperate},
+		{"POST", "/v1/rulesets/1/disable", accessOperate},
+		{"POST", "/v1/match-views/hot/refresh", accessOperate},
+		{"POST", "/v1/rules", accessAuthor},
+		{"PUT", "/v1/rules/A", accessAuthor},
+		{"DELETE", "/v1/rules/A", accessAuthor},
+		{"DELETE", "/v1/rulesets/1/rules/A", accessAuthor},
+	}
+	for _, rt := range routes {
+		for _, key := range keys {
+			p := &principal{Roles: key.Roles}
+			rec := do(h, rt.method, rt.path, key.Key, map[string]interface{}{})
+			if forbidden := rec.Code == http.StatusForbidden; forbidden == p.can(rt.need) {
+				t.Errorf("%s %s as %s: status %d (%s)", rt.method, rt.path, key.Name, rec.Code, rec.Body)
+			}
+		}
+	}
+}
+
+func TestRouteRuleSetScope(t *testing.T) {
+	var rt router
+	rt.handle("GET", "/v1/rulesets/{id}", accessRead, func(w http.ResponseWriter, r *http.Request, p params) error {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+	p := &principal{Name: "team-a", Roles: []string{ruleengine.RoleViewer}, RuleSets: []int{3}}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/v1/rulesets/3", http.StatusNoContent},
+		{"/v1/rulesets/4", http.StatusForbidden},
+		{"/v1/rulesets/abc", http.StatusBadRequest},
+		{"/v1/rulesets/-3", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := do(h, "GET", tt.path, "", nil); rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.path, rec.Code, tt.want)
+		}
+	}
+}
+
+// scopedRuleSets are the rule sets of rules A, B, S, and N, with the
+// scoped caller of newScopedServer limited to rule set 3
+var scopedRuleSets = map[string][]int{"A": {3}, "B": {4}, "S": {3, 4}, "N": nil}
+
+// newScopedServer returns the gateway's handler, GraphQL included, serving
+// every request as an admin key limited to rule set 3
+func newScopedServer(t *testing.T) (http.Handler, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.MatchExpectationsInOrder(false)
+	t.Cleanup(func() { db.Close() })
+	client := ruleengine.New(db)
+	s := &server{client: client, tenants: &tenantClients{base: client}}
+	s.gql = s.graphQLSchema()
+	h := s.routes(&authenticator{})
+	p := &principal{Name: "team-a", Roles: []string{ruleengine.RoleAdmin}, RuleSets: []int{3}}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	}), mock
+}
+
+// expectRuleSetsOf expects the rule sets of rule to be looked up
+func expectRuleSetsOf(mock sqlmock.Sqlmock, rule string) {
+	rows := sqlmock.NewRows([]string{"ruleset_id"})
+	for _, id := range scopedRuleSets[rule] {
+		rows.AddRow(id)
+	}
+	mock.ExpectQuery(`FROM rule_set_members WHERE rule_name`).WithArgs(rule).WillReturnRows(rows)
+}
+
+func TestScopedRoutes(t *testing.T) {
+	// Requests in scope may still fail against the empty database; only
+	// 403 matters here
+	tests := []struct {
+		method, path string
+		body         interface{}
+		// rule is the rule whose rule sets are looked up
+		rule      string
+		forbidden bool
+	}{
+		{method: "GET", path: "/v1/rulesets/3"},
+		{method: "GET", path: "/v1/rulesets/4", forbidden: true},
+		{method: "DELETE", path: "/v1/rulesets/4", forbidden: true},
+		{method: "POST", path: "/v1/rulesets/4/evaluate", body: map[string]interface{}{"facts": map[string]interface{}{}}, forbidden: true},
+		{method: "POST", path: "/v1/rulesets/4/disable", forbidden: true},
+		{method: "DELETE", path: "/v1/rulesets/4/rules/B", forbidden: true},
+		{method: "GET", path: "/v1/rules/A", rule: "A"},
+		{method: "GET", path: "/v1/rules/S", rule: "S"},
+		{method: "GET", path: "/v1/rules/B", rule: "B", forbidden: true},
+		{method: "GET", path: "/v1/rules/N", rule: "N", forbidden: true},
+		{method: "PUT", path: "/v1/rules/A", body: map[string]interface{}{}, rule: "A"},
+		{method: "PUT", path: "/v1/rules/B", body: map[string]interface{}{}, rule: "B", forbidden: true},
+		// Changing a shared rule changes rule set 4 too
+		{method: "PUT", path: "/v1/rules/S", body: map[string]interface{}{}, rule: "S", forbidden: true},
+		{method: "DELETE", path: "/v1/rules/B", rule: "B", forbidden: true},
+		{method: "POST", path: "/v1/rules/B/activate", body: map[string]interface{}{"version": "1.0.0"}, rule: "B", forbidden: true},
+		{method: "POST", path: "/v1/rules/S/enable", rule: "S", forbidden: true},
+		{method: "POST", path: "/v1/rules/B/disable", rule: "B", forbidden: true},
+		{method: "POST", path: "/v1/rulesets/3/rules", body: map[string]interface{}{"rule": "A"}, rule: "A"},
+		{method: "POST", path: "/v1/rulesets/3/rules", body: map[string]interface{}{"rule": "N"}, rule: "N"},
+		{method: "POST", path: "/v1/rulesets/3/rules", body: map[string]interface{}{"rule": "B"}, rule: "B", forbidden: true},
+		{method: "POST", path: "/v1/rulesets/3/rules", body: map[string]interface{}{"rule": "S"}, rule: "S", forbidden: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			h, mock := newScopedServer(t)
+			if tt.rule != "" {
+				expectRuleSetsOf(mock, tt.rule)
+			}
+			rec := do(h, tt.method, tt.path, "", tt.body)
+			if forbidden := rec.Code == http.StatusForbidden; forbidden != tt.forbidden {
+				t.Fatalf("status %d (%s)", rec.Code, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestScopedLists(t *testing.T) {
+	expectLists := func(mock sqlmock.Sqlmock) {
+		now := time.Now()
+		rules := sqlmock.NewRows([]string{"id", "name", "description", "is_active", "version", "grl", "created_at", "updated_at", "updated_by"})
+		for i, name := range []string{"A", "B", "N", "S"} {
+			rules.AddRow(i+1, name, "", true, "1.0.0", "rule "+name, now, now, "")
+		}
+		mock.ExpectQuery(`FROM rule_definitions rd`).WillReturnRows(rules)
+		mock.ExpectQuery(`WHERE ruleset_id = ANY`).WithArgs("{3}").WillReturnRows(
+			sqlmock.NewRows([]string{"ruleset_id", "rule_name", "version", "execution_order"}).AddRow(3, "A", "", 1).AddRow(3, "S", "", 2))
+		mock.ExpectQuery(`FROM ruleset_list\(\)`).WillReturnRows(
+			sqlmock.NewRows([]string{"ruleset_id", "name", "description", "is_active", "created_at"}).
+				AddRow(3, "orders", "", true, now).AddRow(4, "refunds", "", true, now))
+	}
+	names := func(t *testing.T, rec *httptest.ResponseRecorder, key string) []interface{} {
+		t.Helper()
+		var items []map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &items); err != nil {
+			t.Fatalf("%d %s", rec.Code, rec.Body)
+		}
+		var got []interface{}
+		for _, item := range items {
+			got = append(got, item[key])
+		}
+		return got
+	}
+
+	t.Run("rest", func(t *testing.T) {
+		h, mock := newScopedServer(t)
+		expectLists(mock)
+		if got := names(t, do(h, "GET", "/v1/rules", "", nil), "name"); !reflect.DeepEqual(got, []interface{}{"A", "S"}) {
+			t.Errorf("rules = %v, want [A S]", got)
+		}
+		if got := names(t, do(h, "GET", "/v1/rulesets", "", nil), "id"); !reflect.DeepEqual(got, []interface{}{3.0}) {
+			t.Errorf("rule sets = %v, want [3]", got)
+		}
+	})
+
+	t.Run("graphql", func(t *testing.T) {
+		h, mock := newScopedServer(t)
+		expectLists(mock)
+		expectRuleSetsOf(mock, "B")
+		rec := do(h, "POST", "/v1/graphql", "", gqlRequest{Query: `{ rules { name } ruleSets { id } rule(name: "B") { name } }`})
+		want := `{"data":{"rules":[{"name":"A"},{"name":"S"}],"ruleSets":[{"id":3}],"rule":null},` +
+			`"errors":[{"message":"team-a may not use rule B","path":["rule"]}]}`
+		if got := strings.TrimSpace(rec.Body.String()); got != want {
+			t.Fatalf("%d %s", rec.Code, got)
+		}
+	})
+}
+
+func TestManageRulesAccess(t *testing.T) {
+	tests := []struct {
+		req  *ruleenginev1.ManageRulesRequest
+		want access
+	}{
+		{&ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_Get{Get: "A"}}, accessRead},
+		{&ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_List{List: &ruleenginev1.ListRules{}}}, accessRead},
+		{&ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_Enable{Enable: "A"}}, accessOperate},
+		{&ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_Disable{Disable: "A"}}, accessOperate},
+		{&ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_Create{Create: &ruleenginev1.SaveRule{}}}, accessAuthor},
+		{&ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_Delete{Delete: &ruleenginev1.DeleteRule{}}}, accessAuthor},
+		{&ruleenginev1.ManageRulesRequest{}, accessAuthor},
+	}
+	for _, tt := range tests {
+		if got := manageRulesAccess(tt.req); got != tt.want {
+			t.Errorf("%T: access %s, want %s", tt.req.Operation, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// eventsChannel is the NOTIFY channel written by the triggers in events.sql
+const eventsChannel = "rule_engine_events"
+
+//go:embed events.sql
+var eventsSQL string
+
+// ensureEventTriggers installs the NOTIFY triggers behind /v1/events
+func ensureEventTriggers(db *sql.DB) error {
+	if _, err := db.Exec(eventsSQL); err != nil {
+		return fmt.Errorf("failed to install event triggers: %w", err)
+	}
+	return nil
+}
+
+// event is one notification, passed through to clients as-is
+type event struct {
+	Type string
+	Data []byte
+}
+
+type subscriber struct {
+	ch    chan event
+	types map[string]bool // nil: all types
+}
+
+// eventHub fans LISTEN notifications out to connected stream clients.
+// Slow clients miss events rather than blocking the hub.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+// newEventHub starts listening on eventsChannel using its own connection
+func newEventHub(databaseURL string) (*eventHub, error) {
+	listener := pq.NewListener(databaseURL, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			log.Printf("⚠️  Event listener disconnected: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Println("✅ Event listener reconnected")
+		}
+	})
+	if err := listener.Listen(eventsChannel); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to LISTEN on %s: %w", eventsChannel, err)
+	}
+
+	hub := &eventHub{subs: make(map[*subscriber]struct{})}
+	go hub.run(listener)
+	return hub, nil
+}
+
+func (h *eventHub) run(listener *pq.Listener) {
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n == nil {
+				// Reconnected; notifications sent while down are lost
+				continue
+			}
+			var head struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal([]byte(n.Extra), &head); err != nil {
+				log.Printf("⚠️  Ignoring malformed event: %v", err)
+				continue
+			}
+			h.broadcast(event{Type: head.Type, Data: []byte(n.Extra)})
+		case <-ping.C:
+			go listener.Ping()
+		}
+	}
+}
+
+func (h *eventHub) broadcast(ev event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		if sub.types != nil && !sub.types[ev.Type] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
+
+func (h *eventHub) subscribe(types map[string]bool) *subscriber {
+	sub := &subscriber{ch: make(chan event, 64), types: types}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *eventHub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+// streamEvents serves live events as Server-Sent Events. ?types= takes a
+// comma-separated list (rule.fired, webhook.delivery, webhook.published).
+func (s *server) streamEvents(w http.ResponseWriter, r *http.Request, p params) error {
+	if s.events == nil {
+		return &badRequest{msg: "event stream is disabled"}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming unsupported by response writer")
+	}
+
+	var types map[string]bool
+	if raw := r.URL.Query().Get("types"); raw != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(raw, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	sub := s.events.subscribe(types)
+	defer s.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case ev := <-sub.ch:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, ev.Data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+-- Live event notifications for the rule-api /v1/events stream.
+--
+-- Applied idempotently on gateway startup (see ensureEventTriggers in
+-- events.go). Each trigger sends a small JSON summary on the
+-- rule_engine_events channel; NOTIFY is delivered on commit and payloads
+-- stay well under the 8000 byte limit because row data is never included.
+
+CREATE OR REPLACE FUNCTION rule_api_notify_rule_fired() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.rules_fired > 0 THEN
+        PERFORM pg_notify('rule_engine_events', json_build_object(
+            'type', 'rule.fired',
+            'rule', NEW.rule_name,
+            'version', NEW.rule_version,
+            'rules_fired', NEW.rules_fired,
+            'success', NEW.success,
+            'execution_time_ms', NEW.execution_time_ms,
+            'at', NEW.executed_at
+        )::TEXT);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS rule_api_events ON rule_execution_stats;
+CREATE TRIGGER rule_api_events
+    AFTER INSERT ON rule_execution_stats
+    FOR EACH ROW EXECUTE FUNCTION rule_api_notify_rule_fired();
+
+CREATE OR REPLACE FUNCTION rule_api_notify_webhook_call() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND NEW.status IS NOT DISTINCT FROM OLD.status THEN
+        RETURN NULL;
+    END IF;
+    PERFORM pg_notify('rule_engine_events', json_build_object(
+        'type', 'webhook.delivery',
+        'call_id', NEW.call_id,
+        'webhook_id', NEW.webhook_id,
+        'rule', NEW.rule_name,
+        'status', NEW.status,
+        'retry_count', NEW.retry_count,
+        'response_status', NEW.response_status,
+        'error', NEW.error_message,
+        'at', CURRENT_TIMESTAMP
+    )::TEXT);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS rule_api_events ON rule_webhook_calls;
+CREATE TRIGGER rule_api_events
+    AFTER INSERT OR UPDATE OF status ON rule_webhook_calls
+    FOR EACH ROW EXECUTE FUNCTION rule_api_notify_webhook_call();
+
+CREATE OR REPLACE FUNCTION rule_api_notify_nats_publish() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('rule_engine_events', json_build_object(
+        'type', 'webhook.published',
+        'publish_id', NEW.publish_id,
+        'webhook_id', NEW.webhook_id,
+        'subject', NEW.subject,
+        'success', NEW.success,
+        'error', NEW.error_message,
+        'at', NEW.published_at
+    )::TEXT);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS rule_api_events ON rule_nats_publish_history;
+CREATE TRIGGER rule_api_events
+    AFTER INSERT ON rule_nats_publish_history
+    FOR EACH ROW EXECUTE FUNCTION rule_api_notify_nats_publish();
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func TestEventHubBroadcast(t *testing.T) {
+	hub := &eventHub{subs: make(map[*subscriber]struct{})}
+	all := hub.subscribe(nil)
+	fired := hub.subscribe(map[string]bool{"rule.fired": true})
+
+	hub.broadcast(event{Type: "rule.fired", Data: []byte(`{}`)})
+	hub.broadcast(event{Type: "webhook.delivery", Data: []byte(`{}`)})
+
+	if len(all.ch) != 2 {
+		t.Fatalf("unfiltered subscriber got %d events, want 2", len(all.ch))
+	}
+	if len(fired.ch) != 1 || (<-fired.ch).Type != "rule.fired" {
+		t.Fatal("filtered subscriber did not get only rule.fired")
+	}
+
+	// A full subscriber misses events instead of blocking the hub
+	for i := 0; i < cap(all.ch)+10; i++ {
+		hub.broadcast(event{Type: "rule.fired"})
+	}
+	if len(all.ch) != cap(all.ch) {
+		t.Fatalf("buffer = %d, want %d", len(all.ch), cap(all.ch))
+	}
+
+	hub.unsubscribe(all)
+	hub.unsubscribe(fired)
+	if len(hub.subs) != 0 {
+		t.Fatalf("%d subscribers left", len(hub.subs))
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	hub := &eventHub{subs: make(map[*subscriber]struct{})}
+	s := &server{tenants: &tenantClients{base: ruleengine.New(nil)}, events: hub}
+	ts := httptest.NewServer(s.routes(&authenticator{keys: []apiKey{
+		{Name: "ci", Key: "secret", Roles: []string{ruleengine.RoleViewer}},
+	}}))
+	defer ts.Close()
+
+	// EventSource cannot send headers, so the key comes as access_token
+	resp, err := http.Get(ts.URL + "/v1/events?types=webhook.delivery&access_token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hub.mu.Lock()
+		n := len(hub.subs)
+		hub.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream did not subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hub.broadcast(event{Type: "rule.fired", Data: []byte(`{"type":"rule.fired"}`)})
+	hub.broadcast(event{Type: "webhook.delivery", Data: []byte(`{"type":"webhook.delivery"}`)})
+
+	r := bufio.NewReader(resp.Body)
+	var got []string
+	for len(got) < 2 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, strings.TrimSpace(line))
+	}
+	want := []string{"event: webhook.delivery", `data: {"type":"webhook.delivery"}`}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("stream = %q, want %q", got, want)
+	}
+}
+
+func TestStreamEventsDisabled(t *testing.T) {
+	h, _ := newTestServer(t)
+	if rec := do(h, "GET", "/v1/events", "", nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,1251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This file is a small GraphQL implementation: enough of the language for
+// client queries (operations, variables, aliases, fragments, @skip and
+// @include) and an executor that resolves each field once per level for
+// all parent objects, so nested lists cost one query per field instead of
+// one per item. Introspection is not supported; the schema is published as
+// SDL at /v1/graphql/schema.
+
+// Lexing
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunct
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+	pos   int
+}
+
+type gqlLexer struct {
+	src string
+	pos int
+}
+
+func (l *gqlLexer) skipIgnored() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "\uFEFF"):
+			l.pos += len("\uFEFF")
+		default:
+			return
+		}
+	}
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	l.skipIgnored()
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return gqlToken{kind: gqlEOF, pos: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return gqlToken{kind: gqlPunct, value: "...", pos: start}, nil
+	case strings.IndexByte("!$&()[]{}:=@|", c) >= 0:
+		l.pos++
+		return gqlToken{kind: gqlPunct, value: string(c), pos: start}, nil
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for l.pos < len(l.src) && isNameByte(l.src[l.pos]) {
+			l.pos++
+		}
+		return gqlToken{kind: gqlName, value: l.src[start:l.pos], pos: start}, nil
+	case c == '-' || c >= '0' && c <= '9':
+		return l.number()
+	case c == '"':
+		return l.string()
+	}
+	return gqlToken{}, fmt.Errorf("unexpected character %q at offset %d", c, start)
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (l *gqlLexer) number() (gqlToken, error) {
+	start := l.pos
+	kind := gqlInt
+	digits := func() int {
+		n := 0
+		for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+			l.pos++
+			n++
+		}
+		return n
+	}
+
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	if digits() == 0 {
+		return gqlToken{}, fmt.Errorf("invalid number at offset %d", start)
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		l.pos++
+		kind = gqlFloat
+		if digits() == 0 {
+			return gqlToken{}, fmt.Errorf("invalid number at offset %d", start)
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		l.pos++
+		kind = gqlFloat
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		if digits() == 0 {
+			return gqlToken{}, fmt.Errorf("invalid number at offset %d", start)
+		}
+	}
+	return gqlToken{kind: kind, value: l.src[start:l.pos], pos: start}, nil
+}
+
+// string reads a quoted or block string. GraphQL's escapes are a subset of
+// JSON's, so quoted strings are decoded as JSON.
+func (l *gqlLexer) string() (gqlToken, error) {
+	start := l.pos
+	if strings.HasPrefix(l.src[l.pos:], `"""`) {
+		for i := l.pos + 3; i < len(l.src); i++ {
+			if strings.HasPrefix(l.src[i:], `\"""`) {
+				i += 3
+				continue
+			}
+			if strings.HasPrefix(l.src[i:], `"""`) {
+				raw := l.src[l.pos+3 : i]
+				l.pos = i + 3
+				return gqlToken{kind: gqlString, value: strings.ReplaceAll(raw, `\"""`, `"""`), pos: start}, nil
+			}
+		}
+		return gqlToken{}, fmt.Errorf("unterminated string at offset %d", start)
+	}
+
+	l.pos++
+	for l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case '\\':
+			l.pos += 2
+			continue
+		case '\n', '\r':
+			return gqlToken{}, fmt.Errorf("unterminated string at offset %d", start)
+		case '"':
+			l.pos++
+			var s string
+			if err := json.Unmarshal([]byte(l.src[start:l.pos]), &s); err != nil {
+				return gqlToken{}, fmt.Errorf("invalid string at offset %d", start)
+			}
+			return gqlToken{kind: gqlString, value: s, pos: start}, nil
+		}
+		l.pos++
+	}
+	return gqlToken{}, fmt.Errorf("unterminated string at offset %d", start)
+}
+
+// Parsing
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind       string // query or mutation
+	name       string
+	variables  []gqlVariableDef
+	selections []gqlSelection
+}
+
+type gqlVariableDef struct {
+	name     string
+	nonNull  bool
+	def      interface{}
+	hasValue bool // def was given
+}
+
+type gqlFragment struct {
+	on         string
+	selections []gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread (spread set), or an inline
+// fragment (inline set)
+type gqlSelection struct {
+	alias, name string
+	args        map[string]interface{}
+	directives  []gqlDirective
+	selections  []gqlSelection
+
+	spread string
+	inline bool
+	on     string // type condition of an inline fragment; may be empty
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]interface{}
+}
+
+// gqlVariable is a $variable reference in a value
+type gqlVariable string
+
+// gqlMaxNesting bounds the nesting of selection sets and values the parser
+// accepts, well above any depth limit, so a hostile document cannot run
+// it out of stack
+const gqlMaxNesting = 100
+
+type gqlParser struct {
+	lex   gqlLexer
+	tok   gqlToken
+	depth int
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{lex: gqlLexer{src: src}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	doc := &gqlDocument{fragments: map[string]*gqlFragment{}}
+	for p.tok.kind != gqlEOF {
+		switch {
+		case p.peek("{"):
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: selections})
+		case p.peek("query"), p.peek("mutation"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.peek("fragment"):
+			name, frag, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := doc.fragments[name]; dup {
+				return nil, fmt.Errorf("fragment %s is defined twice", name)
+			}
+			doc.fragments[name] = frag
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("document has no operation")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+// peek reports whether the current token is the punctuator or name s
+func (p *gqlParser) peek(s string) bool {
+	return (p.tok.kind == gqlPunct || p.tok.kind == gqlName) && p.tok.value == s
+}
+
+func (p *gqlParser) expect(s string) error {
+	if !p.peek(s) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) unexpected() error {
+	if p.tok.kind == gqlEOF {
+		return fmt.Errorf("unexpected end of document")
+	}
+	return fmt.Errorf("unexpected %q at offset %d", p.tok.value, p.tok.pos)
+}
+
+// nest enters a selection set, list, or object; the caller undoes it
+func (p *gqlParser) nest() error {
+	if p.depth++; p.depth > gqlMaxNesting {
+		return fmt.Errorf("document is nested deeper than %d levels at offset %d", gqlMaxNesting, p.tok.pos)
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != gqlName {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.tok.value}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == gqlName {
+		op.name = p.tok.value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek("(") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		for !p.peek(")") {
+			v, err := p.variableDef()
+			if err != nil {
+				return nil, err
+			}
+			op.variables = append(op.variables, v)
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+func (p *gqlParser) variableDef() (gqlVariableDef, error) {
+	var v gqlVariableDef
+	if err := p.expect("$"); err != nil {
+		return v, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return v, err
+	}
+	v.name = name
+	if err := p.expect(":"); err != nil {
+		return v, err
+	}
+	if v.nonNull, err = p.typeRef(); err != nil {
+		return v, err
+	}
+	if p.peek("=") {
+		if err := p.advance(); err != nil {
+			return v, err
+		}
+		if v.def, err = p.value(true); err != nil {
+			return v, err
+		}
+		v.hasValue = true
+	}
+	_, err = p.directives()
+	return v, err
+}
+
+// typeRef skips a type reference, reporting whether it is non-null.
+// Variable types are not checked beyond that; arguments are coerced to
+// the types the schema declares.
+func (p *gqlParser) typeRef() (bool, error) {
+	if p.peek("[") {
+		if err := p.advance(); err != nil {
+			return false, err
+		}
+		if _, err := p.typeRef(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	if p.peek("!") {
+		return true, p.advance()
+	}
+	return false, nil
+}
+
+func (p *gqlParser) fragment() (string, *gqlFragment, error) {
+	if err := p.advance(); err != nil {
+		return "", nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := p.expect("on"); err != nil {
+		return "", nil, err
+	}
+	frag := &gqlFragment{}
+	if frag.on, err = p.name(); err != nil {
+		return "", nil, err
+	}
+	if _, err := p.directives(); err != nil {
+		return "", nil, err
+	}
+	frag.selections, err = p.selectionSet()
+	return name, frag, err
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []gqlSelection
+	for !p.peek("}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, sel)
+	}
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("empty selection set at offset %d", p.tok.pos)
+	}
+	return selections, p.advance()
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	var sel gqlSelection
+	var err error
+
+	if p.peek("...") {
+		if err := p.advance(); err != nil {
+			return sel, err
+		}
+		if p.tok.kind == gqlName && p.tok.value != "on" {
+			sel.spread = p.tok.value
+			if err := p.advance(); err != nil {
+				return sel, err
+			}
+			sel.directives, err = p.directives()
+			return sel, err
+		}
+		sel.inline = true
+		if p.peek("on") {
+			if err := p.advance(); err != nil {
+				return sel, err
+			}
+			if sel.on, err = p.name(); err != nil {
+				return sel, err
+			}
+		}
+		if sel.directives, err = p.directives(); err != nil {
+			return sel, err
+		}
+		sel.selections, err = p.selectionSet()
+		return sel, err
+	}
+
+	if sel.name, err = p.name(); err != nil {
+		return sel, err
+	}
+	if p.peek(":") {
+		if err := p.advance(); err != nil {
+			return sel, err
+		}
+		sel.alias = sel.name
+		if sel.name, err = p.name(); err != nil {
+			return sel, err
+		}
+	}
+	if p.peek("(") {
+		if sel.args, err = p.arguments(); err != nil {
+			return sel, err
+		}
+	}
+	if sel.directives, err = p.directives(); err != nil {
+		return sel, err
+	}
+	if p.peek("{") {
+		sel.selections, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	args := map[string]interface{}{}
+	for !p.peek(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, p.advance()
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var directives []gqlDirective
+	for p.peek("@") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		var d gqlDirective
+		var err error
+		if d.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if p.peek("(") {
+			if d.args, err = p.arguments(); err != nil {
+				return nil, err
+			}
+		}
+		directives = append(directives, d)
+	}
+	return directives, nil
+}
+
+// value parses a value into the types encoding/json decodes to (numbers
+// are float64), with gqlVariable for variable references. Enum values
+// are kept as strings.
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == gqlPunct && tok.value == "$" && !constant:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return gqlVariable(name), err
+	case tok.kind == gqlInt, tok.kind == gqlFloat:
+		n, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok.value)
+		}
+		return n, p.advance()
+	case tok.kind == gqlString:
+		return tok.value, p.advance()
+	case tok.kind == gqlName:
+		var v interface{} = tok.value
+		switch tok.value {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		}
+		return v, p.advance()
+	case p.peek("["):
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for !p.peek("]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.advance()
+	case p.peek("{"):
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		obj := map[string]interface{}{}
+		for !p.peek("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		return obj, p.advance()
+	}
+	return nil, p.unexpected()
+}
+
+// Schema
+
+// gqlResolver returns a field's value for each of sources, in order. An
+// element that is an error nulls the field for that source alone; a
+// returned error nulls it for all of them.
+type gqlResolver func(ctx context.Context, sources []interface{}, args map[string]interface{}) ([]interface{}, error)
+
+type gqlObject struct {
+	name   string
+	fields []*gqlField
+	byName map[string]*gqlField
+}
+
+type gqlField struct {
+	name string
+	typ  string // SDL type, e.g. "[Rule]" or "Int"
+	args []gqlArg
+	doc  string
+
+	// resolve defaults to reading the source struct's field whose JSON
+	// name is the snake_case form of name
+	resolve gqlResolver
+
+	object *gqlObject // type of object values; nil for scalars
+	list   bool
+}
+
+type gqlArg struct {
+	name string
+	typ  string // Int, Float, String, Boolean, or JSON; "!" marks required
+}
+
+type gqlSchema struct {
+	query, mutation *gqlObject
+	objects         []*gqlObject
+	scalars         []string
+	limits          gqlLimits
+}
+
+// gqlLimits bound the work one operation may ask for, since every field
+// can cost a query. Fragments count each time they are spread.
+type gqlLimits struct {
+	depth      int // levels of nested fields
+	aliases    int // aliased fields
+	selections int // fields in all
+}
+
+var defaultGQLLimits = gqlLimits{depth: 10, aliases: 30, selections: 500}
+
+// newGraphQLSchema links field types to their objects. It panics on a type
+// it does not know, since the schema is fixed at compile time.
+func newGraphQLSchema(objects []*gqlObject, scalars ...string) *gqlSchema {
+	s := &gqlSchema{objects: objects, scalars: scalars, limits: defaultGQLLimits}
+	byName := map[string]*gqlObject{}
+	for _, obj := range objects {
+		byName[obj.name] = obj
+	}
+	builtin := map[string]bool{"Int": true, "Float": true, "String": true, "Boolean": true, "ID": true}
+	for _, name := range scalars {
+		builtin[name] = true
+	}
+	for _, obj := range objects {
+		obj.byName = map[string]*gqlField{}
+		for _, f := range obj.fields {
+			obj.byName[f.name] = f
+			f.list = strings.HasPrefix(f.typ, "[")
+			elem := strings.Trim(f.typ, "[]!")
+			if !builtin[elem] {
+				if f.object = byName[elem]; f.object == nil {
+					panic("graphql: unknown type " + elem)
+				}
+			}
+		}
+	}
+	s.query, s.mutation = byName["Query"], byName["Mutation"]
+	return s
+}
+
+// SDL renders the schema in the GraphQL schema definition language
+func (s *gqlSchema) SDL() string {
+	var b strings.Builder
+	for _, name := range s.scalars {
+		fmt.Fprintf(&b, "scalar %s\n\n", name)
+	}
+	for _, obj := range s.objects {
+		fmt.Fprintf(&b, "type %s {\n", obj.name)
+		for _, f := range obj.fields {
+			if f.doc != "" {
+				fmt.Fprintf(&b, "  %q\n", f.doc)
+			}
+			b.WriteString("  " + f.name)
+			if len(f.args) > 0 {
+				args := make([]string, len(f.args))
+				for i, a := range f.args {
+					args[i] = a.name + ": " + a.typ
+				}
+				b.WriteString("(" + strings.Join(args, ", ") + ")")
+			}
+			b.WriteString(": " + f.typ + "\n")
+		}
+		b.WriteString("}\n\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// each adapts a per-source resolver
+func each(fn func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error)) gqlResolver {
+	return func(ctx context.Context, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+		values := make([]interface{}, len(sources))
+		for i, src := range sources {
+			v, err := fn(ctx, src, args)
+			if err != nil {
+				values[i] = err
+			} else {
+				values[i] = v
+			}
+		}
+		return values, nil
+	}
+}
+
+// root adapts a resolver of a Query or Mutation field, which has a single
+// (nil) source
+func root(fn func(ctx context.Context, args map[string]interface{}) (interface{}, error)) gqlResolver {
+	return each(func(ctx context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+		return fn(ctx, args)
+	})
+}
+
+// jsonProperty resolves name from a struct's JSON fields
+func jsonProperty(name string) gqlResolver {
+	key := snakeCase(name)
+	return each(func(_ context.Context, src interface{}, _ map[string]interface{}) (interface{}, error) {
+		v := reflect.Indirect(reflect.ValueOf(src))
+		if v.Kind() != reflect.Struct {
+			return nil, nil
+		}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); tag == key {
+				return v.Field(i).Interface(), nil
+			}
+		}
+		return nil, nil
+	})
+}
+
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Execution
+
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+type gqlResponse struct {
+	Data   *gqlMap    `json:"data,omitempty"`
+	Errors []gqlError `json:"errors,omitempty"`
+}
+
+// gqlMap is a response object; its keys keep the query's order
+type gqlMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newGQLMap() *gqlMap {
+	return &gqlMap{values: map[string]interface{}{}}
+}
+
+func (m *gqlMap) set(key string, v interface{}) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = v
+}
+
+func (m *gqlMap) MarshalJSON() ([]byte, error) {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return []byte(b.String()), nil
+}
+
+type gqlExecution struct {
+	doc       *gqlDocument
+	variables map[string]interface{}
+	errors    []gqlError
+
+	// fieldError turns a resolver error into a client-safe message
+	fieldError func(error) string
+}
+
+// execute runs the request's operation. Query errors fail the request;
+// field errors null the field and are reported next to the data.
+func (s *gqlSchema) execute(ctx context.Context, req gqlRequest, fieldError func(error) string) gqlResponse {
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return gqlResponse{Errors: []gqlError{{Message: "syntax error: " + err.Error()}}}
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return gqlResponse{Errors: []gqlError{{Message: err.Error()}}}
+	}
+	if err := doc.checkLimits(op, s.limits); err != nil {
+		return gqlResponse{Errors: []gqlError{{Message: err.Error()}}}
+	}
+
+	e := &gqlExecution{doc: doc, fieldError: fieldError}
+	if e.variables, err = op.coerceVariables(req.Variables); err != nil {
+		return gqlResponse{Errors: []gqlError{{Message: err.Error()}}}
+	}
+	obj := s.query
+	if op.kind == "mutation" {
+		obj = s.mutation
+	}
+	if obj == nil {
+		return gqlResponse{Errors: []gqlError{{Message: "the schema has no " + op.kind + " type"}}}
+	}
+	data, err := e.selectFields(ctx, obj, []gqlNode{{}}, op.selections)
+	if err != nil {
+		return gqlResponse{Errors: []gqlError{{Message: err.Error()}}}
+	}
+	return gqlResponse{Data: data[0], Errors: e.errors}
+}
+
+func (doc *gqlDocument) operation(name string) (*gqlOperation, error) {
+	if name == "" {
+		if len(doc.operations) > 1 {
+			return nil, fmt.Errorf("operationName is required when the document has several operations")
+		}
+		return doc.operations[0], nil
+	}
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %q", name)
+}
+
+// checkLimits measures op before any of it runs, expanding fragments the
+// way collectFields does. It stops at the first limit exceeded, so a
+// document of fragments that multiply is not walked in full.
+func (doc *gqlDocument) checkLimits(op *gqlOperation, limits gqlLimits) error {
+	var aliases, selections int
+	spreading := map[string]bool{}
+	var walk func(sels []gqlSelection, depth int) error
+	walk = func(sels []gqlSelection, depth int) error {
+		for _, sel := range sels {
+			switch {
+			case sel.spread != "":
+				frag, ok := doc.fragments[sel.spread]
+				if !ok || spreading[sel.spread] {
+					// Unknown fragments are reported when the field is
+					// collected; a spread within itself adds nothing
+					continue
+				}
+				spreading[sel.spread] = true
+				err := walk(frag.selections, depth)
+				delete(spreading, sel.spread)
+				if err != nil {
+					return err
+				}
+			case sel.inline:
+				if err := walk(sel.selections, depth); err != nil {
+					return err
+				}
+			default:
+				if depth > limits.depth {
+					return fmt.Errorf("query is nested deeper than %d levels", limits.depth)
+				}
+				if sel.alias != "" {
+					if aliases++; aliases > limits.aliases {
+						return fmt.Errorf("query has more than %d aliases", limits.aliases)
+					}
+				}
+				if selections++; selections > limits.selections {
+					return fmt.Errorf("query selects more than %d fields", limits.selections)
+				}
+				if err := walk(sel.selections, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(op.selections, 1)
+}
+
+func (op *gqlOperation) coerceVariables(given map[string]interface{}) (map[string]interface{}, error) {
+	vars := map[string]interface{}{}
+	for _, def := range op.variables {
+		v, ok := given[def.name]
+		if !ok && def.hasValue {
+			v, ok = def.def, true
+		}
+		if (!ok || v == nil) && def.nonNull {
+			return nil, fmt.Errorf("variable $%s is required", def.name)
+		}
+		if ok {
+			vars[def.name] = v
+		}
+	}
+	return vars, nil
+}
+
+// gqlNode is a source object and its path in the response
+type gqlNode struct {
+	value interface{}
+	path  []interface{}
+}
+
+// collectedField is one response key with its merged sub-selections
+type collectedField struct {
+	key, name  string
+	args       map[string]interface{}
+	selections []gqlSelection
+}
+
+// selectFields resolves sels on each node, field by field, so every
+// resolver runs once for all nodes. It returns a response object per node.
+func (e *gqlExecution) selectFields(ctx context.Context, obj *gqlObject, nodes []gqlNode, sels []gqlSelection) ([]*gqlMap, error) {
+	fields, err := e.collectFields(obj, sels, nil, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*gqlMap, len(nodes))
+	for i := range out {
+		out[i] = newGQLMap()
+	}
+
+	for _, f := range fields {
+		if f.name == "__typename" {
+			for _, m := range out {
+				m.set(f.key, obj.name)
+			}
+			continue
+		}
+		def := obj.byName[f.name]
+		if def == nil {
+			return nil, fmt.Errorf("cannot query field %q on type %s", f.name, obj.name)
+		}
+		if def.object != nil && len(f.selections) == 0 {
+			return nil, fmt.Errorf("field %q of type %s must have a selection of subfields", f.name, def.typ)
+		}
+		if def.object == nil && len(f.selections) > 0 {
+			return nil, fmt.Errorf("field %q of type %s cannot have a selection of subfields", f.name, def.typ)
+		}
+		args, err := e.coerceArgs(def, f.args)
+		if err != nil {
+			return nil, err
+		}
+
+		resolve := def.resolve
+		if resolve == nil {
+			resolve = jsonProperty(def.name)
+		}
+		sources := make([]interface{}, len(nodes))
+		for i, n := range nodes {
+			sources[i] = n.value
+		}
+		values, err := resolve(ctx, sources, args)
+		if err == nil && len(values) != len(nodes) {
+			err = fmt.Errorf("resolver of %s.%s returned %d values for %d sources", obj.name, def.name, len(values), len(nodes))
+		}
+		if err != nil {
+			values = make([]interface{}, len(nodes))
+			for i := range values {
+				values[i] = err
+			}
+		}
+
+		// Scalars go into the response as they are; objects are resolved
+		// for every node at once
+		var children []gqlNode
+		for i, v := range values {
+			path := appendPath(nodes[i].path, f.key)
+			if fieldErr, ok := v.(error); ok {
+				e.errors = append(e.errors, gqlError{Message: e.fieldError(fieldErr), Path: path})
+				out[i].set(f.key, nil)
+				continue
+			}
+			if isNil(v) {
+				if def.list {
+					v = []interface{}{}
+				} else {
+					v = nil
+				}
+			}
+			out[i].set(f.key, v)
+			if def.object == nil || v == nil {
+				continue
+			}
+			if def.list {
+				list := reflect.ValueOf(v)
+				for j := 0; j < list.Len(); j++ {
+					children = append(children, gqlNode{value: list.Index(j).Interface(), path: appendPath(path, j)})
+				}
+			} else {
+				children = append(children, gqlNode{value: v, path: path})
+			}
+		}
+		if def.object == nil {
+			continue
+		}
+
+		maps, err := e.selectFields(ctx, def.object, children, f.selections)
+		if err != nil {
+			return nil, err
+		}
+		for i := range nodes {
+			v := out[i].values[f.key]
+			if v == nil {
+				continue
+			}
+			if def.list {
+				n := reflect.ValueOf(v).Len()
+				out[i].set(f.key, maps[:n])
+				maps = maps[n:]
+			} else {
+				out[i].set(f.key, maps[0])
+				maps = maps[1:]
+			}
+		}
+	}
+	return out, nil
+}
+
+func appendPath(path []interface{}, elem interface{}) []interface{} {
+	return append(append(make([]interface{}, 0, len(path)+1), path...), elem)
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// collectFields flattens fragments into response keys in query order,
+// merging the sub-selections of fields requested more than once
+func (e *gqlExecution) collectFields(obj *gqlObject, sels []gqlSelection, fields []*collectedField, visited map[string]bool) ([]*collectedField, error) {
+	for _, sel := range sels {
+		include, err := e.included(sel.directives)
+		if err != nil {
+			return nil, err
+		}
+		if !include {
+			continue
+		}
+
+		switch {
+		case sel.spread != "":
+			if visited[sel.spread] {
+				continue
+			}
+			visited[sel.spread] = true
+			frag, ok := e.doc.fragments[sel.spread]
+			if !ok {
+				return nil, fmt.Errorf("unknown fragment %q", sel.spread)
+			}
+			if frag.on != obj.name {
+				continue
+			}
+			if fields, err = e.collectFields(obj, frag.selections, fields, visited); err != nil {
+				return nil, err
+			}
+		case sel.inline:
+			if sel.on != "" && sel.on != obj.name {
+				continue
+			}
+			if fields, err = e.collectFields(obj, sel.selections, fields, visited); err != nil {
+				return nil, err
+			}
+		default:
+			key := sel.alias
+			if key == "" {
+				key = sel.name
+			}
+			var existing *collectedField
+			for _, f := range fields {
+				if f.key == key {
+					existing = f
+				}
+			}
+			if existing == nil {
+				fields = append(fields, &collectedField{key: key, name: sel.name, args: sel.args, selections: sel.selections})
+				continue
+			}
+			if existing.name != sel.name {
+				return nil, fmt.Errorf("%q selects both %s and %s", key, existing.name, sel.name)
+			}
+			existing.selections = append(existing.selections, sel.selections...)
+		}
+	}
+	return fields, nil
+}
+
+// included applies @skip and @include
+func (e *gqlExecution) included(directives []gqlDirective) (bool, error) {
+	for _, d := range directives {
+		if d.name != "skip" && d.name != "include" {
+			continue
+		}
+		cond, err := coerceScalar("Boolean", e.resolveValue(d.args["if"]))
+		if err != nil || cond == nil {
+			return false, fmt.Errorf("@%s needs a Boolean if argument", d.name)
+		}
+		if cond.(bool) == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (e *gqlExecution) coerceArgs(def *gqlField, given map[string]interface{}) (map[string]interface{}, error) {
+	names := make([]string, 0, len(given))
+	for name := range given {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		found := false
+		for _, a := range def.args {
+			found = found || a.name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown argument %q on field %s", name, def.name)
+		}
+	}
+
+	args := map[string]interface{}{}
+	for _, a := range def.args {
+		v, err := coerceScalar(strings.TrimSuffix(a.typ, "!"), e.resolveValue(given[a.name]))
+		if err != nil {
+			return nil, fmt.Errorf("argument %q of %s: %v", a.name, def.name, err)
+		}
+		if v == nil {
+			if strings.HasSuffix(a.typ, "!") {
+				return nil, fmt.Errorf("argument %q of %s is required", a.name, def.name)
+			}
+			continue
+		}
+		args[a.name] = v
+	}
+	return args, nil
+}
+
+// resolveValue substitutes variables
+func (e *gqlExecution) resolveValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case gqlVariable:
+		return e.variables[string(v)]
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = e.resolveValue(elem)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			out[k] = e.resolveValue(elem)
+		}
+		return out
+	}
+	return v
+}
+
+// coerceScalar converts an argument value to its Go type: int, float64,
+// string, bool, or, for JSON, the value itself
+func coerceScalar(typ string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch typ {
+	case "Int":
+		if n, ok := v.(float64); ok && n == math.Trunc(n) && math.Abs(n) <= math.MaxInt32 {
+			return int(n), nil
+		}
+	case "Float":
+		if n, ok := v.(float64); ok {
+			return n, nil
+		}
+	case "String":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case "Boolean":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case "JSON":
+		return v, nil
+	}
+	return nil, fmt.Errorf("%v is not a valid %s", v, typ)
+}
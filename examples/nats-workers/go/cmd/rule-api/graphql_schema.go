@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// graphQLSchema is the gateway's GraphQL schema. It exposes what the REST
+// API reads, plus evaluation; changes to rules stay REST-only.
+func (s *server) graphQLSchema() *gqlSchema {
+	rule := &gqlObject{name: "Rule", fields: []*gqlField{
+		{name: "id", typ: "Int"},
+		{name: "name", typ: "String"},
+		{name: "description", typ: "String"},
+		{name: "isActive", typ: "Boolean"},
+		{name: "activeVersion", typ: "String"},
+		{name: "grl", typ: "String"},
+		{name: "createdAt", typ: "Time"},
+		{name: "updatedAt", typ: "Time"},
+		{name: "updatedBy", typ: "String"},
+	}}
+
+	member := &gqlObject{name: "RuleSetMember", fields: []*gqlField{
+		{name: "ruleName", typ: "String", resolve: each(func(_ context.Context, src interface{}, _ map[string]interface{}) (interface{}, error) {
+			return src.(ruleengine.RuleSetMember).Rule, nil
+		})},
+		{name: "version", typ: "String", doc: "Pinned version; empty follows the rule's active version"},
+		{name: "order", typ: "Int"},
+		{name: "rule", typ: "Rule", resolve: func(ctx context.Context, sources []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+			names := make([]string, len(sources))
+			for i, src := range sources {
+				names[i] = src.(ruleengine.RuleSetMember).Rule
+			}
+			return loadersFrom(ctx).rules(ctx, names)
+		}},
+	}}
+
+	ruleSet := &gqlObject{name: "RuleSet", fields: []*gqlField{
+		{name: "id", typ: "Int"},
+		{name: "name", typ: "String"},
+		{name: "description", typ: "String"},
+		{name: "isActive", typ: "Boolean"},
+		{name: "createdAt", typ: "Time"},
+		{name: "members", typ: "[RuleSetMember]", resolve: func(ctx context.Context, sources []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+			ids := make([]int, len(sources))
+			for i, src := range sources {
+				ids[i] = src.(ruleengine.RuleSet).ID
+			}
+			members, err := s.clientFor(ctx).RuleSetMembers(ctx, ids)
+			if err != nil {
+				return nil, err
+			}
+			values := make([]interface{}, len(ids))
+			for i, id := range ids {
+				values[i] = members[id]
+			}
+			return values, nil
+		}},
+	}}
+
+	delivery := &gqlObject{name: "Delivery", fields: []*gqlField{
+		{name: "id", typ: "Int"},
+		{name: "webhookId", typ: "Int"},
+		{name: "status", typ: "String"},
+		{name: "ruleName", typ: "String", resolve: each(func(_ context.Context, src interface{}, _ map[string]interface{}) (interface{}, error) {
+			return src.(ruleengine.Delivery).Rule, nil
+		})},
+		{name: "rule", typ: "Rule", resolve: func(ctx context.Context, sources []interface{}, _ map[string]interface{}) ([]interface{}, error) {
+			names := make([]string, len(sources))
+			for i, src := range sources {
+				names[i] = src.(ruleengine.Delivery).Rule
+			}
+			return loadersFrom(ctx).rules(ctx, names)
+		}},
+		{name: "payload", typ: "JSON"},
+		{name: "retryCount", typ: "Int"},
+		{name: "responseStatus", typ: "Int"},
+		{name: "error", typ: "String"},
+		{name: "durationMs", typ: "Float"},
+		{name: "createdAt", typ: "Time"},
+		{name: "completedAt", typ: "Time"},
+	}}
+
+	consumerStats := &gqlObject{name: "ConsumerStats", fields: []*gqlField{
+		{name: "stream", typ: "String"},
+		{name: "consumer", typ: "String"},
+		{name: "queueGroup", typ: "String"},
+		{name: "messagesDelivered", typ: "Int"},
+		{name: "messagesAcknowledged", typ: "Int"},
+		{name: "messagesPending", typ: "Int"},
+		{name: "messagesRedelivered", typ: "Int"},
+		{name: "messagesFailed", typ: "Int"},
+		{name: "avgProcessingTimeMs", typ: "Float"},
+		{name: "lastActiveAt", typ: "Time"},
+		{name: "lagSampledAt", typ: "Time"},
+		{name: "active", typ: "Boolean"},
+	}}
+
+	cacheStats := &gqlObject{name: "CacheStats", fields: []*gqlField{
+		{name: "hits", typ: "Int"},
+		{name: "misses", typ: "Int"},
+		{name: "hitRate", typ: "Float"},
+		{name: "entries", typ: "Int"},
+	}}
+
+	action := &gqlObject{name: "Action", fields: []*gqlField{
+		{name: "rule", typ: "String"},
+		{name: "action", typ: "String"},
+	}}
+
+	result := &gqlObject{name: "EvaluationResult", fields: []*gqlField{
+		{name: "facts", typ: "JSON"},
+		{name: "matchedRules", typ: "[String]"},
+		{name: "actions", typ: "[Action]"},
+		{name: "explanation", typ: "JSON", doc: "Per-rule condition results, with explain: true"},
+		{name: "ruleFirings", typ: "JSON"},
+		{name: "durationMs", typ: "Float", resolve: each(func(_ context.Context, src interface{}, _ map[string]interface{}) (interface{}, error) {
+			return float64(src.(*ruleengine.Result).Duration.Microseconds()) / 1000, nil
+		})},
+	}}
+
+	query := &gqlObject{name: "Query", fields: []*gqlField{
+		{name: "rules", typ: "[Rule]", resolve: root(func(ctx context.Context, _ map[string]interface{}) (interface{}, error) {
+			client := s.clientFor(ctx)
+			rules, err := client.ListRules(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return scopeRules(ctx, client, rules)
+		})},
+		{name: "rule", typ: "Rule", args: []gqlArg{{"name", "String!"}}, resolve: root(func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			name := args["name"].(string)
+			if err := authorizeRule(ctx, s.clientFor(ctx), name, accessRead, false); err != nil {
+				return nil, err
+			}
+			rules, err := loadersFrom(ctx).rules(ctx, []string{name})
+			if err != nil {
+				return nil, err
+			}
+			return rules[0], nil
+		})},
+		{name: "ruleSets", typ: "[RuleSet]", resolve: root(func(ctx context.Context, _ map[string]interface{}) (interface{}, error) {
+			sets, err := s.clientFor(ctx).ListRuleSets(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return scopeRuleSets(ctx, sets), nil
+		})},
+		{name: "ruleSet", typ: "RuleSet", args: []gqlArg{{"id", "Int!"}}, resolve: root(func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			id := args["id"].(int)
+			if err := authorizeRuleSet(ctx, id); err != nil {
+				return nil, err
+			}
+			rs, err := s.clientFor(ctx).GetRuleSet(ctx, id)
+			if errors.Is(err, ruleengine.ErrRuleSetNotFound) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return *rs, nil
+		})},
+		{name: "deliveries", typ: "[Delivery]", args: []gqlArg{{"webhookId", "Int"}, {"status", "String"}, {"limit", "Int"}},
+			doc: "Recent webhook deliveries, newest first",
+			resolve: root(func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+				filter := ruleengine.DeliveryFilter{}
+				filter.WebhookID, _ = args["webhookId"].(int)
+				filter.Status, _ = args["status"].(string)
+				filter.Limit, _ = args["limit"].(int)
+				return s.clientFor(ctx).ListDeliveries(ctx, filter)
+			})},
+		{name: "consumerStats", typ: "[ConsumerStats]", resolve: root(func(ctx context.Context, _ map[string]interface{}) (interface{}, error) {
+			return s.clientFor(ctx).ListConsumerStats(ctx)
+		})},
+		{name: "cacheStats", typ: "CacheStats", resolve: root(func(ctx context.Context, _ map[string]interface{}) (interface{}, error) {
+			return s.client.ResultCacheStats(), nil
+		})},
+	}}
+
+	mutation := &gqlObject{name: "Mutation", fields: []*gqlField{
+		{name: "evaluate", typ: "EvaluationResult", args: []gqlArg{{"ruleSetId", "Int!"}, {"facts", "JSON!"}, {"explain", "Boolean"}},
+			doc: "Evaluates a rule set against a fact document",
+			resolve: root(func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+				id := args["ruleSetId"].(int)
+				if err := authorizeRuleSet(ctx, id); err != nil {
+					return nil, err
+				}
+				facts, ok := args["facts"].(map[string]interface{})
+				if !ok {
+					return nil, &badRequest{msg: "facts must be an object"}
+				}
+				explain, _ := args["explain"].(bool)
+				return s.clientFor(ctx).EvaluateWithOptions(ctx, id, facts, ruleengine.EvaluateOptions{Explain: explain})
+			})},
+	}}
+
+	return newGraphQLSchema([]*gqlObject{
+		query, mutation, rule, ruleSet, member, delivery, consumerStats, cacheStats, result, action,
+	}, "Time", "JSON")
+}
+
+// gqlLoaders batch and cache the lookups of one GraphQL request, so a rule
+// referenced from many places is read once
+type gqlLoaders struct {
+	client *ruleengine.Client
+
+	mu    sync.Mutex
+	cache map[string]*ruleengine.Rule // nil for rules known not to exist
+}
+
+type gqlLoadersKey struct{}
+
+func loadersFrom(ctx context.Context) *gqlLoaders {
+	return ctx.Value(gqlLoadersKey{}).(*gqlLoaders)
+}
+
+// rules returns the named rules in order, reading those not yet cached in
+// one query. Missing and empty names give nil.
+func (l *gqlLoaders) rules(ctx context.Context, names []string) ([]interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var missing []string
+	pending := map[string]bool{}
+	for _, name := range names {
+		if _, cached := l.cache[name]; !cached && name != "" && !pending[name] {
+			missing = append(missing, name)
+			pending[name] = true
+		}
+	}
+	if len(missing) > 0 {
+		rules, err := l.client.GetRules(ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range missing {
+			l.cache[name] = nil
+		}
+		for i := range rules {
+			l.cache[rules[i].Name] = &rules[i]
+		}
+	}
+
+	values := make([]interface{}, len(names))
+	for i, name := range names {
+		if rule := l.cache[name]; rule != nil {
+			values[i] = rule
+		}
+	}
+	return values, nil
+}
+
+// graphql serves POST /v1/graphql. Every field needs only read access, as
+// the matching REST routes do; rule set arguments are checked against the
+// caller's scope.
+func (s *server) graphql(w http.ResponseWriter, r *http.Request, p params) error {
+	var req gqlRequest
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	if req.Query == "" {
+		return &badRequest{msg: "query is required"}
+	}
+
+	ctx := context.WithValue(r.Context(), gqlLoadersKey{}, &gqlLoaders{
+		client: s.clientFor(r.Context()),
+		cache:  map[string]*ruleengine.Rule{},
+	})
+	writeJSON(w, http.StatusOK, s.gql.execute(ctx, req, func(err error) string {
+		return graphQLErrorMessage(r, err)
+	}))
+	return nil
+}
+
+// graphQLErrorMessage reports field errors the way writeError reports them
+// over REST: client errors as they are, anything else without detail
+func graphQLErrorMessage(r *http.Request, err error) string {
+	var (
+		bad        *badRequest
+		validation *ruleengine.ValidationError
+		evaluation *ruleengine.EvaluationError
+		forbidden  *forbiddenError
+	)
+	switch {
+	case errors.As(err, &bad), errors.As(err, &validation), errors.As(err, &evaluation), errors.As(err, &forbidden),
+		errors.Is(err, ruleengine.ErrRuleNotFound), errors.Is(err, ruleengine.ErrRuleSetNotFound):
+		return err.Error()
+	}
+	logInternal(r.Method+" "+r.URL.Path, err)
+	return "internal error"
+}
+
+func (s *server) graphqlSchemaSDL(w http.ResponseWriter, r *http.Request, p params) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(s.gql.SDL()))
+	return nil
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func TestGQLLexer(t *testing.T) {
+	tests := []struct {
+		src     string
+		want    []string // kind:value
+		wantErr string
+	}{
+		{src: `{ rule(name: "A") }`, want: []string{"p:{", "n:rule", "p:(", "n:name", "p::", "s:A", "p:)", "p:}"}},
+		{src: "a, b # comment\n\uFEFFc", want: []string{"n:a", "n:b", "n:c"}},
+		{src: `... $x! @skip [ ] = |`, want: []string{"p:...", "p:$", "n:x", "p:!", "p:@", "n:skip", "p:[", "p:]", "p:=", "p:|"}},
+		{src: `0 -12 1.5 2e3 -4.5E-1`, want: []string{"i:0", "i:-12", "f:1.5", "f:2e3", "f:-4.5E-1"}},
+		{src: `"tab\t \"q\" \u00e9"`, want: []string{"s:tab\t \"q\" é"}},
+		{src: `"""block "quoted" \""" here"""`, want: []string{`s:block "quoted" """ here`}},
+		{src: `1.`, wantErr: "invalid number at offset 0"},
+		{src: `1e`, wantErr: "invalid number at offset 0"},
+		{src: `-`, wantErr: "invalid number at offset 0"},
+		{src: `"open`, wantErr: "unterminated string at offset 0"},
+		{src: "\"line\nbreak\"", wantErr: "unterminated string at offset 0"},
+		{src: `"""open`, wantErr: "unterminated string at offset 0"},
+		{src: `"bad \x"`, wantErr: "invalid string at offset 0"},
+		{src: `a ; b`, wantErr: `unexpected character ';' at offset 2`},
+	}
+	kinds := map[gqlTokenKind]string{gqlPunct: "p", gqlName: "n", gqlInt: "i", gqlFloat: "f", gqlString: "s"}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			l := gqlLexer{src: tt.src}
+			var got []string
+			for {
+				tok, err := l.next()
+				if err != nil {
+					if tt.wantErr == "" || err.Error() != tt.wantErr {
+						t.Fatalf("err = %v, want %q", err, tt.wantErr)
+					}
+					return
+				}
+				if tok.kind == gqlEOF {
+					break
+				}
+				got = append(got, kinds[tok.kind]+":"+tok.value)
+			}
+			if tt.wantErr != "" {
+				t.Fatalf("tokens = %q, want error %q", got, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("tokens = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGraphQL(t *testing.T) {
+	doc, err := parseGraphQL(`
+		query Items($first: Int = 2, $tags: [String!]!) @cached {
+			list: items(first: $first, filter: {tags: $tags, deep: [1, 2.5, "x", true, null, RED]}) {
+				...ItemFields @include(if: true)
+				... on Item { name }
+				... { id }
+			}
+		}
+		mutation { add(n: 1) }
+		fragment ItemFields on Item { id }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.operations) != 2 || len(doc.fragments) != 1 {
+		t.Fatalf("document = %+v", doc)
+	}
+
+	q := doc.operations[0]
+	if q.kind != "query" || q.name != "Items" {
+		t.Fatalf("operation = %s %s", q.kind, q.name)
+	}
+	wantVars := []gqlVariableDef{{name: "first", def: 2.0, hasValue: true}, {name: "tags", nonNull: true}}
+	if !reflect.DeepEqual(q.variables, wantVars) {
+		t.Fatalf("variables = %+v", q.variables)
+	}
+	want := []gqlSelection{{
+		alias: "list", name: "items",
+		args: map[string]interface{}{
+			"first": gqlVariable("first"),
+			"filter": map[string]interface{}{
+				"tags": gqlVariable("tags"),
+				"deep": []interface{}{1.0, 2.5, "x", true, nil, "RED"},
+			},
+		},
+		selections: []gqlSelection{
+			{spread: "ItemFields", directives: []gqlDirective{{name: "include", args: map[string]interface{}{"if": true}}}},
+			{inline: true, on: "Item", selections: []gqlSelection{{name: "name"}}},
+			{inline: true, selections: []gqlSelection{{name: "id"}}},
+		},
+	}}
+	if !reflect.DeepEqual(q.selections, want) {
+		t.Fatalf("selections = %+v", q.selections)
+	}
+	if m := doc.operations[1]; m.kind != "mutation" || m.name != "" || m.selections[0].args["n"] != 1.0 {
+		t.Fatalf("mutation = %+v", m)
+	}
+	if f := doc.fragments["ItemFields"]; f.on != "Item" || !reflect.DeepEqual(f.selections, []gqlSelection{{name: "id"}}) {
+		t.Fatalf("fragment = %+v", f)
+	}
+}
+
+func TestParseGraphQLErrors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{``, "document has no operation"},
+		{`fragment F on Item { id }`, "document has no operation"},
+		{`{ }`, "empty selection set at offset 2"},
+		{`{ a`, "unexpected end of document"},
+		{`subscription { a }`, `unexpected "subscription" at offset 0`},
+		{`{ a(x: $v) } fragment F on Item { id } fragment F on Item { name }`, "fragment F is defined twice"},
+		{`query($v: Int = $w) { a }`, `unexpected "$" at offset 16`},
+		{`query(v: Int) { a }`, `unexpected "v" at offset 6`},
+		{`{ a(x 1) }`, `unexpected "1" at offset 6`},
+		{`{ a: }`, `unexpected "}" at offset 5`},
+		{`{ ...on }`, `unexpected "}" at offset 8`},
+		{`{ a @ }`, `unexpected "}" at offset 6`},
+		{`{ a(x: [1, 2) }`, `unexpected ")" at offset 12`},
+		{`{ a(x: 1e) }`, "invalid number at offset 7"},
+		{`{` + strings.Repeat(" a {", gqlMaxNesting) + ` b` + strings.Repeat(" }", gqlMaxNesting+1), "document is nested deeper than 100 levels"},
+		{`{ a(x: ` + strings.Repeat("[", gqlMaxNesting+1) + `) }`, "document is nested deeper than 100 levels"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			_, err := parseGraphQL(tt.src)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+type testItem struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// testSchema serves items 1-3, each with the next as its only child. It
+// counts resolver calls and the sources each was given.
+type testSchema struct {
+	*gqlSchema
+	calls map[string][]int // field: sources per call
+}
+
+func newTestSchema() *testSchema {
+	ts := &testSchema{calls: map[string][]int{}}
+	items := []testItem{{1, "one"}, {2, "two"}, {3, "three"}}
+	count := func(field string, fn gqlResolver) gqlResolver {
+		return func(ctx context.Context, sources []interface{}, args map[string]interface{}) ([]interface{}, error) {
+			ts.calls[field] = append(ts.calls[field], len(sources))
+			return fn(ctx, sources, args)
+		}
+	}
+
+	item := &gqlObject{name: "Item"}
+	item.fields = []*gqlField{
+		{name: "id", typ: "Int"},
+		{name: "name", typ: "String"},
+		{name: "children", typ: "[Item]", resolve: count("children", each(func(_ context.Context, src interface{}, _ map[string]interface{}) (interface{}, error) {
+			if id := src.(testItem).ID; id < len(items) {
+				return []testItem{items[id]}, nil
+			}
+			return nil, nil
+		}))},
+		{name: "broken", typ: "String", resolve: each(func(_ context.Context, src interface{}, _ map[string]interface{}) (interface{}, error) {
+			if src.(testItem).ID == 2 {
+				return nil, errors.New("item 2 is broken")
+			}
+			return "fine", nil
+		})},
+		{name: "down", typ: "String", resolve: func(context.Context, []interface{}, map[string]interface{}) ([]interface{}, error) {
+			return nil, errors.New("backend down")
+		}},
+		{name: "short", typ: "String", resolve: func(context.Context, []interface{}, map[string]interface{}) ([]interface{}, error) {
+			return nil, nil
+		}},
+	}
+	query := &gqlObject{name: "Query", fields: []*gqlField{
+		{name: "items", typ: "[Item]", args: []gqlArg{{"first", "Int"}}, resolve: count("items", root(func(_ context.Context, args map[string]interface{}) (interface{}, error) {
+			if n, ok := args["first"].(int); ok && n < len(items) {
+				return items[:n], nil
+			}
+			return items, nil
+		}))},
+		{name: "item", typ: "Item", args: []gqlArg{{"id", "Int!"}}, resolve: root(func(_ context.Context, args map[string]interface{}) (interface{}, error) {
+			for _, it := range items {
+				if it.ID == args["id"] {
+					return it, nil
+				}
+			}
+			return nil, nil
+		})},
+		{name: "echo", typ: "JSON", args: []gqlArg{{"s", "String"}, {"n", "Int"}, {"f", "Float"}, {"b", "Boolean"}, {"j", "JSON"}},
+			resolve: root(func(_ context.Context, args map[string]interface{}) (interface{}, error) {
+				return args, nil
+			})},
+	}}
+	mutation := &gqlObject{name: "Mutation", fields: []*gqlField{
+		{name: "add", typ: "Int", args: []gqlArg{{"a", "Int!"}, {"b", "Int"}}, resolve: root(func(_ context.Context, args map[string]interface{}) (interface{}, error) {
+			b, _ := args["b"].(int)
+			return args["a"].(int) + b, nil
+		})},
+	}}
+	ts.gqlSchema = newGraphQLSchema([]*gqlObject{query, mutation, item}, "JSON")
+	return ts
+}
+
+// run executes query and returns the response as JSON
+func (ts *testSchema) run(query, operation string, variables map[string]interface{}) string {
+	resp := ts.execute(context.Background(), gqlRequest{Query: query, OperationName: operation, Variables: variables},
+		func(err error) string { return err.Error() })
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return "marshal: " + err.Error()
+	}
+	return string(b)
+}
+
+func TestGraphQLExecute(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+		variables map[string]interface{}
+		want      string
+	}{
+		{name: "fields in query order", query: `{ items(first: 2) { name id } }`,
+			want: `{"data":{"items":[{"name":"one","id":1},{"name":"two","id":2}]}}`},
+		{name: "aliases", query: `{ a: item(id: 1) { name } b: item(id: 3) { label: name } }`,
+			want: `{"data":{"a":{"name":"one"},"b":{"label":"three"}}}`},
+		{name: "nested lists", query: `{ items(first: 2) { id children { id children { id } } } }`,
+			want: `{"data":{"items":[{"id":1,"children":[{"id":2,"children":[{"id":3}]}]},{"id":2,"children":[{"id":3,"children":[]}]}]}}`},
+		{name: "null object", query: `{ item(id: 9) { id } }`, want: `{"data":{"item":null}}`},
+		{name: "typename", query: `{ __typename item(id: 1) { __typename } }`,
+			want: `{"data":{"__typename":"Query","item":{"__typename":"Item"}}}`},
+		{name: "fragments", query: `{ item(id: 1) { ...A ... on Item { name } ... { id } ... on Query { echo } } } fragment A on Item { id }`,
+			want: `{"data":{"item":{"id":1,"name":"one"}}}`},
+		{name: "fragment on another type is skipped", query: `{ item(id: 1) { id ...Q } } fragment Q on Query { echo }`,
+			want: `{"data":{"item":{"id":1}}}`},
+		{name: "repeated fields merge", query: `{ item(id: 1) { children { id } children { name } } }`,
+			want: `{"data":{"item":{"children":[{"id":2,"name":"two"}]}}}`},
+		{name: "self-spreading fragment", query: `{ item(id: 1) { ...A } } fragment A on Item { id ...A }`,
+			want: `{"data":{"item":{"id":1}}}`},
+		{name: "skip and include", query: `query($no: Boolean!) { item(id: 1) { id @skip(if: true) name @include(if: $no) children @skip(if: $no) { id } } }`,
+			variables: map[string]interface{}{"no": false}, want: `{"data":{"item":{"children":[{"id":2}]}}}`},
+		{name: "argument coercion", query: `{ echo(s: "x", n: 3, f: 2, b: true, j: {a: [1, "b"]}) }`,
+			want: `{"data":{"echo":{"b":true,"f":2,"j":{"a":[1,"b"]},"n":3,"s":"x"}}}`},
+		{name: "variables and defaults", query: `query($n: Int = 2, $j: JSON) { echo(n: $n, j: $j) }`,
+			variables: map[string]interface{}{"j": map[string]interface{}{"k": []interface{}{"v"}}},
+			want:      `{"data":{"echo":{"j":{"k":["v"]},"n":2}}}`},
+		{name: "given variable beats default", query: `query($n: Int = 2) { echo(n: $n) }`,
+			variables: map[string]interface{}{"n": 5.0}, want: `{"data":{"echo":{"n":5}}}`},
+		{name: "named operation", query: `query A { item(id: 1) { id } } mutation B { add(a: 2, b: 3) }`, operation: "B",
+			want: `{"data":{"add":5}}`},
+		{name: "field error nulls one item", query: `{ items { id broken } }`,
+			want: `{"data":{"items":[{"id":1,"broken":"fine"},{"id":2,"broken":null},{"id":3,"broken":"fine"}]},` +
+				`"errors":[{"message":"item 2 is broken","path":["items",1,"broken"]}]}`},
+		{name: "resolver error nulls every item", query: `{ items(first: 2) { down } }`,
+			want: `{"data":{"items":[{"down":null},{"down":null}]},"errors":[` +
+				`{"message":"backend down","path":["items",0,"down"]},{"message":"backend down","path":["items",1,"down"]}]}`},
+		{name: "resolver returning too few values", query: `{ item(id: 1) { short } }`,
+			want: `{"data":{"item":{"short":null}},"errors":[{"message":"resolver of Item.short returned 0 values for 1 sources","path":["item","short"]}]}`},
+
+		{name: "syntax error", query: `{ item(`, want: `{"errors":[{"message":"syntax error: unexpected end of document"}]}`},
+		{name: "operation name required", query: `query A { echo } query B { echo }`,
+			want: `{"errors":[{"message":"operationName is required when the document has several operations"}]}`},
+		{name: "unknown operation", query: `query A { echo }`, operation: "C", want: `{"errors":[{"message":"unknown operation \"C\""}]}`},
+		{name: "required variable", query: `query($id: Int!) { item(id: $id) { id } }`,
+			want: `{"errors":[{"message":"variable $id is required"}]}`},
+		{name: "null required variable", query: `query($id: Int!) { item(id: $id) { id } }`, variables: map[string]interface{}{"id": nil},
+			want: `{"errors":[{"message":"variable $id is required"}]}`},
+		{name: "unknown field", query: `{ item(id: 1) { price } }`, want: `{"errors":[{"message":"cannot query field \"price\" on type Item"}]}`},
+		{name: "object without subfields", query: `{ items }`,
+			want: `{"errors":[{"message":"field \"items\" of type [Item] must have a selection of subfields"}]}`},
+		{name: "scalar with subfields", query: `{ item(id: 1) { id { x } } }`,
+			want: `{"errors":[{"message":"field \"id\" of type Int cannot have a selection of subfields"}]}`},
+		{name: "unknown argument", query: `{ items(last: 1) { id } }`, want: `{"errors":[{"message":"unknown argument \"last\" on field items"}]}`},
+		{name: "missing argument", query: `{ item { id } }`, want: `{"errors":[{"message":"argument \"id\" of item is required"}]}`},
+		{name: "invalid argument", query: `{ item(id: 1.5) { id } }`, want: `{"errors":[{"message":"argument \"id\" of item: 1.5 is not a valid Int"}]}`},
+		{name: "alias conflict", query: `{ item(id: 1) { x: id x: name } }`, want: `{"errors":[{"message":"\"x\" selects both id and name"}]}`},
+		{name: "unknown fragment", query: `{ item(id: 1) { ...Nope } }`, want: `{"errors":[{"message":"unknown fragment \"Nope\""}]}`},
+		{name: "directive without condition", query: `{ item(id: 1) { id @skip } }`, want: `{"errors":[{"message":"@skip needs a Boolean if argument"}]}`},
+		{name: "mutation", query: `mutation { add(a: 1) }`, want: `{"data":{"add":1}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newTestSchema().run(tt.query, tt.operation, tt.variables); got != tt.want {
+				t.Fatalf("response =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	queryOnly := newTestSchema()
+	queryOnly.mutation = nil
+	if got, want := queryOnly.run(`mutation { add(a: 1) }`, "", nil), `{"errors":[{"message":"the schema has no mutation type"}]}`; got != want {
+		t.Fatalf("response = %s", got)
+	}
+}
+
+func TestGraphQLBatching(t *testing.T) {
+	ts := newTestSchema()
+	got := ts.run(`{ items { children { children { id } } } again: items(first: 1) { id } }`, "", nil)
+	if strings.Contains(got, "errors") {
+		t.Fatal(got)
+	}
+	// Each level of children is resolved once, for all of its parents
+	want := map[string][]int{"items": {1, 1}, "children": {3, 2}}
+	if !reflect.DeepEqual(ts.calls, want) {
+		t.Fatalf("calls = %v, want %v", ts.calls, want)
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		limits    gqlLimits
+		query     string
+		operation string
+		want      string // error message; empty for none
+	}{
+		{name: "within limits", limits: gqlLimits{depth: 2, aliases: 1, selections: 3},
+			query: `{ a: item(id: 1) { id name } }`},
+		{name: "too deep", limits: gqlLimits{depth: 2, aliases: 10, selections: 10},
+			query: `{ item(id: 1) { children { id } } }`, want: "query is nested deeper than 2 levels"},
+		{name: "depth through fragments", limits: gqlLimits{depth: 2, aliases: 10, selections: 10},
+			query: `{ item(id: 1) { ... { ...C } } } fragment C on Item { children { id } }`, want: "query is nested deeper than 2 levels"},
+		{name: "too many aliases", limits: gqlLimits{depth: 10, aliases: 2, selections: 10},
+			query: `{ a: item(id: 1) { b: id c: name } }`, want: "query has more than 2 aliases"},
+		{name: "too many fields", limits: gqlLimits{depth: 10, aliases: 10, selections: 3},
+			query: `{ item(id: 1) { id name __typename } }`, want: "query selects more than 3 fields"},
+		{name: "fragments count where spread", limits: gqlLimits{depth: 10, aliases: 10, selections: 5},
+			query: `{ item(id: 1) { ...F children { ...F } } } fragment F on Item { id name }`, want: "query selects more than 5 fields"},
+		{name: "skipped fields still count", limits: gqlLimits{depth: 10, aliases: 10, selections: 2},
+			query: `{ item(id: 1) { id name @skip(if: true) } }`, want: "query selects more than 2 fields"},
+		{name: "only the chosen operation", limits: gqlLimits{depth: 10, aliases: 10, selections: 2},
+			query: `query A { item(id: 1) { id } } query B { items { id name children { id } } }`, operation: "A"},
+		{name: "fragment cycles", limits: gqlLimits{depth: 10, aliases: 10, selections: 5},
+			query: `{ item(id: 1) { ...A } } fragment A on Item { id ...B } fragment B on Item { name ...A }`},
+		{name: "fragments that multiply", limits: defaultGQLLimits,
+			query: `{ items { ...F3 } } fragment F3 on Item { a: children { ...F2 } b: children { ...F2 } }` +
+				` fragment F2 on Item { a: children { ...F1 } b: children { ...F1 } }` +
+				` fragment F1 on Item { ` + strings.Repeat("id ", 200) + `}`,
+			want: "query selects more than 500 fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestSchema()
+			ts.limits = tt.limits
+			got := ts.run(tt.query, tt.operation, nil)
+			if tt.want != "" {
+				if want := `{"errors":[{"message":"` + tt.want + `"}]}`; got != want {
+					t.Fatalf("response = %s, want %s", got, want)
+				}
+				if len(ts.calls) != 0 {
+					t.Fatalf("resolvers ran: %v", ts.calls)
+				}
+				return
+			}
+			if !strings.HasPrefix(got, `{"data":`) || strings.Contains(got, "errors") {
+				t.Fatalf("response = %s", got)
+			}
+		})
+	}
+}
+
+func TestCoerceScalar(t *testing.T) {
+	tests := []struct {
+		typ     string
+		in      interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{"Int", 3.0, 3, false},
+		{"Int", -2147483647.0, -2147483647, false},
+		{"Int", 2147483648.0, nil, true},
+		{"Int", 1.5, nil, true},
+		{"Int", "3", nil, true},
+		{"Float", 1.5, 1.5, false},
+		{"Float", true, nil, true},
+		{"String", "x", "x", false},
+		{"String", 1.0, nil, true},
+		{"Boolean", false, false, false},
+		{"Boolean", "true", nil, true},
+		{"JSON", map[string]interface{}{"a": 1.0}, map[string]interface{}{"a": 1.0}, false},
+		{"Time", "2024-01-01", nil, true},
+		{"Int", nil, nil, false},
+	}
+	for _, tt := range tests {
+		got, err := coerceScalar(tt.typ, tt.in)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("coerceScalar(%s, %v) = %v, %v", tt.typ, tt.in, got, err)
+		}
+	}
+}
+
+func TestGraphQLSDL(t *testing.T) {
+	sdl := newTestSchema().SDL()
+	for _, want := range []string{
+		"scalar JSON\n",
+		"type Query {\n  items(first: Int): [Item]\n  item(id: Int!): Item\n",
+		"type Mutation {\n  add(a: Int!, b: Int): Int\n}",
+	} {
+		if !strings.Contains(sdl, want) {
+			t.Errorf("SDL has no %q:\n%s", want, sdl)
+		}
+	}
+}
+
+func TestGraphQLEndpoint(t *testing.T) {
+	newServer := func(t *testing.T) (http.Handler, sqlmock.Sqlmock) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		client := ruleengine.New(db)
+		s := &server{client: client, tenants: &tenantClients{base: client}}
+		s.gql = s.graphQLSchema()
+		return s.routes(&authenticator{}), mock
+	}
+	ruleRows := func(names ...string) *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"id", "name", "description", "is_active", "version", "grl", "created_at", "updated_at", "updated_by"})
+		for i, name := range names {
+			rows.AddRow(i+1, name, "", true, "1.0.0", "rule "+name, time.Now(), time.Now(), "")
+		}
+		return rows
+	}
+
+	t.Run("rules are read once per request", func(t *testing.T) {
+		h, mock := newServer(t)
+		mock.ExpectQuery(`WHERE rd.name = ANY\(\$1\)`).WithArgs(`{"A"}`).WillReturnRows(ruleRows("A"))
+		mock.ExpectQuery(`WHERE rd.name = ANY\(\$1\)`).WithArgs(`{"Z"}`).WillReturnRows(ruleRows())
+		rec := do(h, "POST", "/v1/graphql", "", gqlRequest{
+			Query: `{ a: rule(name: "A") { name } again: rule(name: "A") { activeVersion } z: rule(name: "Z") { name } }`,
+		})
+		if want := `{"data":{"a":{"name":"A"},"again":{"activeVersion":"1.0.0"},"z":null}}`; rec.Code != http.StatusOK ||
+			strings.TrimSpace(rec.Body.String()) != want {
+			t.Fatalf("%d %s", rec.Code, rec.Body)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("internal errors are not leaked", func(t *testing.T) {
+		h, mock := newServer(t)
+		mock.ExpectQuery(`FROM rule_definitions`).WillReturnError(errors.New("pq: relation rule_definitions does not exist"))
+		rec := do(h, "POST", "/v1/graphql", "", gqlRequest{Query: `{ rules { name } }`})
+		if want := `{"data":{"rules":null},"errors":[{"message":"internal error","path":["rules"]}]}`; strings.TrimSpace(rec.Body.String()) != want {
+			t.Fatalf("%d %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("query errors", func(t *testing.T) {
+		h, _ := newServer(t)
+		deep := `{` + strings.Repeat(` a {`, defaultGQLLimits.depth) + ` b` + strings.Repeat(` }`, defaultGQLLimits.depth+1)
+		tests := []struct {
+			query string
+			code  int
+			want  string
+		}{
+			{``, http.StatusBadRequest, "query is required"},
+			{`{ rules { price } }`, http.StatusOK, `cannot query field \"price\" on type Rule`},
+			{`{` + strings.Repeat(` a: __typename`, defaultGQLLimits.aliases+1) + ` }`, http.StatusOK, "query has more than 30 aliases"},
+			{deep, http.StatusOK, "query is nested deeper than 10 levels"},
+		}
+		for _, tt := range tests {
+			rec := do(h, "POST", "/v1/graphql", "", gqlRequest{Query: tt.query})
+			if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("%.40s: %d %s", tt.query, rec.Code, rec.Body)
+			}
+		}
+	})
+
+	t.Run("schema", func(t *testing.T) {
+		h, _ := newServer(t)
+		rec := do(h, "GET", "/v1/graphql/schema", "", nil)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "evaluate(ruleSetId: Int!, facts: JSON!, explain: Boolean): EvaluationResult") {
+			t.Fatalf("%d %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		h, _ := newTestServer(t)
+		if rec := do(h, "POST", "/v1/graphql", "", gqlRequest{Query: `{ rules { name } }`}); rec.Code != http.StatusNotFound {
+			t.Fatalf("status %d", rec.Code)
+		}
+	})
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	ruleenginev1 "github.com/rule-engine/nats-webhook-worker/api/ruleengine/v1"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// grpcServer implements ruleengine.v1.RuleEngine on top of the SDK
+type grpcServer struct {
+	ruleenginev1.UnimplementedRuleEngineServer
+	tenants *tenantClients
+}
+
+// clientFor returns the SDK client for the caller's tenant
+func (s *grpcServer) clientFor(ctx context.Context) *ruleengine.Client {
+	return s.tenants.forContext(ctx)
+}
+
+// newGRPCServer returns a gRPC server with the rule engine service and the
+// same API key check as the REST API
+func newGRPCServer(tenants *tenantClients, auth *authenticator) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := checkGRPCKey(ctx, auth)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := checkGRPCKey(ss.Context(), auth)
+			if err != nil {
+				return err
+			}
+			return handler(srv, &actorStream{ServerStream: ss, ctx: ctx})
+		}),
+	)
+	ruleenginev1.RegisterRuleEngineServer(srv, &grpcServer{tenants: tenants})
+	return srv
+}
+
+// checkGRPCKey accepts "authorization: Bearer <key>" or "x-api-key: <key>"
+// metadata and returns ctx carrying the key's name as the audit actor and
+// its roles
+func checkGRPCKey(ctx context.Context, auth *authenticator) (context.Context, error) {
+	if !auth.enabled() {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var presented string
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		presented = v[0]
+	} else if v := md.Get("authorization"); len(v) > 0 && strings.HasPrefix(v[0], "Bearer ") {
+		presented = strings.TrimPrefix(v[0], "Bearer ")
+	}
+	p, err := auth.authenticate(ctx, presented)
+	if err != nil {
+		log.Printf("⚠️  Failed to check API key: %v", err)
+		return nil, status.Error(codes.Unavailable, "failed to check API key")
+	}
+	if p == nil {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return principalContext(ctx, p), nil
+}
+
+// actorStream overrides a stream's context with the authenticated one
+type actorStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *actorStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *grpcServer) EvaluateRules(ctx context.Context, req *ruleenginev1.EvaluateRequest) (*ruleenginev1.EvaluateResponse, error) {
+	if err := authorize(ctx, accessRead); err != nil {
+		return nil, grpcError(err)
+	}
+	resp, err := s.evaluate(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) StreamEvaluations(stream ruleenginev1.RuleEngine_StreamEvaluationsServer) error {
+	if err := authorize(stream.Context(), accessRead); err != nil {
+		return grpcError(err)
+	}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp, err := s.evaluate(stream.Context(), req)
+		if err != nil {
+			st := status.Convert(grpcError(err))
+			resp = &ruleenginev1.EvaluateResponse{
+				CorrelationId: req.CorrelationId,
+				Error:         &ruleenginev1.Error{Code: codeName(st.Code()), Message: st.Message()},
+			}
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *grpcServer) evaluate(ctx context.Context, req *ruleenginev1.EvaluateRequest) (*ruleenginev1.EvaluateResponse, error) {
+	if req.RulesetId <= 0 {
+		return nil, &badRequest{msg: "ruleset_id is required"}
+	}
+	if req.Facts == nil {
+		return nil, &badRequest{msg: "facts is required"}
+	}
+	if err := authorizeRuleSet(ctx, int(req.RulesetId)); err != nil {
+		return nil, err
+	}
+
+	result, err := s.clientFor(ctx).Evaluate(ctx, int(req.RulesetId), req.Facts.AsMap())
+	if err != nil {
+		return nil, err
+	}
+	facts, err := structpb.NewStruct(result.Facts)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ruleenginev1.EvaluateResponse{
+		CorrelationId: req.CorrelationId,
+		Facts:         facts,
+		MatchedRules:  result.MatchedRules,
+		Duration:      durationpb.New(result.Duration),
+	}
+	for _, a := range result.Actions {
+		resp.Actions = append(resp.Actions, &ruleenginev1.Action{Rule: a.Rule, Action: a.Action})
+	}
+	if req.Trace {
+		for _, e := range result.Trace {
+			resp.Trace = append(resp.Trace, &ruleenginev1.TraceEvent{
+				RulesetMember: e.RuleSetMember,
+				Step:          e.Step,
+				Type:          e.Type,
+				Description:   e.Description,
+				DataJson:      string(e.Data),
+			})
+		}
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) ManageRules(ctx context.Context, req *ruleenginev1.ManageRulesRequest) (*ruleenginev1.ManageRulesResponse, error) {
+	rules, err := s.manageRules(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := &ruleenginev1.ManageRulesResponse{}
+	for _, r := range rules {
+		resp.Rules = append(resp.Rules, ruleToProto(r))
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) manageRules(ctx context.Context, req *ruleenginev1.ManageRulesRequest) ([]ruleengine.Rule, error) {
+	if err := authorize(ctx, manageRulesAccess(req)); err != nil {
+		return nil, err
+	}
+	client := s.clientFor(ctx)
+	if name := manageRulesTarget(req); name != "" {
+		if err := authorizeRule(ctx, client, name, manageRulesAccess(req), false); err != nil {
+			return nil, err
+		}
+	}
+	switch op := req.Operation.(type) {
+	case *ruleenginev1.ManageRulesRequest_Create:
+		return single(client.CreateRule(ctx, saveRuleInput(op.Create)))
+	case *ruleenginev1.ManageRulesRequest_Update:
+		return single(client.UpdateRule(ctx, saveRuleInput(op.Update)))
+	case *ruleenginev1.ManageRulesRequest_Get:
+		return single(client.GetRule(ctx, op.Get))
+	case *ruleenginev1.ManageRulesRequest_List:
+		rules, err := client.ListRules(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return scopeRules(ctx, client, rules)
+	case *ruleenginev1.ManageRulesRequest_Activate:
+		if err := client.ActivateVersion(ctx, op.Activate.Name, op.Activate.Version, op.Activate.ExpectedVersion); err != nil {
+			return nil, err
+		}
+		return single(client.GetRule(ctx, op.Activate.Name))
+	case *ruleenginev1.ManageRulesRequest_Enable:
+		return nil, client.EnableRule(ctx, op.Enable)
+	case *ruleenginev1.ManageRulesRequest_Disable:
+		return nil, client.DisableRule(ctx, op.Disable)
+	case *ruleenginev1.ManageRulesRequest_Delete:
+		return nil, client.DeleteRule(ctx, op.Delete.Name, op.Delete.Version)
+	default:
+		return nil, &badRequest{msg: "operation is required"}
+	}
+}
+
+// manageRulesAccess is the access a ManageRules operation needs, matching
+// the REST routes
+func manageRulesAccess(req *ruleenginev1.ManageRulesRequest) access {
+	switch req.Operation.(type) {
+	case *ruleenginev1.ManageRulesRequest_Get, *ruleenginev1.ManageRulesRequest_List:
+		return accessRead
+	case *ruleenginev1.ManageRulesRequest_Enable, *ruleenginev1.ManageRulesRequest_Disable:
+		return accessOperate
+	default:
+		return accessAuthor
+	}
+}
+
+// manageRulesTarget is the existing rule a ManageRules operation names, to
+// check against the caller's rule sets; empty for create and list
+func manageRulesTarget(req *ruleenginev1.ManageRulesRequest) string {
+	switch op := req.Operation.(type) {
+	case *ruleenginev1.ManageRulesRequest_Update:
+		return op.Update.GetName()
+	case *ruleenginev1.ManageRulesRequest_Get:
+		return op.Get
+	case *ruleenginev1.ManageRulesRequest_Activate:
+		return op.Activate.GetName()
+	case *ruleenginev1.ManageRulesRequest_Enable:
+		return op.Enable
+	case *ruleenginev1.ManageRulesRequest_Disable:
+		return op.Disable
+	case *ruleenginev1.ManageRulesRequest_Delete:
+		return op.Delete.GetName()
+	}
+	return ""
+}
+
+func single(rule *ruleengine.Rule, err error) ([]ruleengine.Rule, error) {
+	if err != nil {
+		return nil, err
+	}
+	return []ruleengine.Rule{*rule}, nil
+}
+
+func saveRuleInput(in *ruleenginev1.SaveRule) ruleengine.SaveRuleInput {
+	return ruleengine.SaveRuleInput{
+		Name:            in.Name,
+		GRL:             in.Grl,
+		Version:         in.Version,
+		Description:     in.Description,
+		ChangeNotes:     in.ChangeNotes,
+		ExpectedVersion: in.ExpectedVersion,
+		Activate:        in.Activate,
+	}
+}
+
+func ruleToProto(r ruleengine.Rule) *ruleenginev1.Rule {
+	return &ruleenginev1.Rule{
+		Id:            int32(r.ID),
+		Name:          r.Name,
+		Description:   r.Description,
+		IsActive:      r.IsActive,
+		ActiveVersion: r.ActiveVersion,
+		Grl:           r.GRL,
+		CreatedAt:     timestamppb.New(r.CreatedAt),
+		UpdatedAt:     timestamppb.New(r.UpdatedAt),
+		UpdatedBy:     r.UpdatedBy,
+	}
+}
+
+// grpcError maps SDK errors to status codes, mirroring writeError
+func grpcError(err error) error {
+	var (
+		bad        *badRequest
+		validation *ruleengine.ValidationError
+		conflict   *ruleengine.ConflictError
+		evaluation *ruleengine.EvaluationError
+		forbidden  *forbiddenError
+	)
+
+	switch {
+	case errors.As(err, &forbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.As(err, &bad), errors.As(err, &validation):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ruleengine.ErrRuleNotFound), errors.Is(err, ruleengine.ErrRuleSetNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ruleengine.ErrRuleExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.As(err, &conflict):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.As(err, &evaluation):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	default:
+		logInternal("grpc", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+}
+
+// codeName renders a status code as its canonical upper-case name
+func codeName(c codes.Code) string {
+	var b strings.Builder
+	var prev rune
+	for _, r := range c.String() {
+		if r >= 'A' && r <= 'Z' && prev >= 'a' && prev <= 'z' {
+			b.WriteByte('_')
+		}
+		b.WriteRune(r)
+		prev = r
+	}
+	return strings.ToUpper(b.String())
+}
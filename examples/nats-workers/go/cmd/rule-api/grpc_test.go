@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	ruleenginev1 "github.com/rule-engine/nats-webhook-worker/api/ruleengine/v1"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// newTestGRPC serves the rule engine service over an in-memory listener
+// with a viewer key "view" and an author key "author"
+func newTestGRPC(t *testing.T) (ruleenginev1.RuleEngineClient, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	auth := &authenticator{keys: []apiKey{
+		{Name: "viewer", Key: "view", Roles: []string{ruleengine.RoleViewer}},
+		{Name: "author", Key: "author", Roles: []string{ruleengine.RoleRuleAuthor}},
+	}}
+	srv := newGRPCServer(&tenantClients{base: ruleengine.New(db)}, auth)
+
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return ruleenginev1.NewRuleEngineClient(conn), mock
+}
+
+func withKey(key string) context.Context {
+	ctx := context.Background()
+	if key == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+key)
+}
+
+func TestGRPCAuth(t *testing.T) {
+	client, mock := newTestGRPC(t)
+	now := time.Now()
+	mock.ExpectQuery(`FROM rule_definitions rd`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "is_active", "version", "grl", "created_at", "updated_at", "updated_by"}).
+			AddRow(1, "A", "", true, "1.0.0", "rule A", now, now, ""))
+
+	list := &ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_List{List: &ruleenginev1.ListRules{}}}
+	create := &ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_Create{
+		Create: &ruleenginev1.SaveRule{Name: "B", Grl: "rule B"}}}
+
+	tests := []struct {
+		name string
+		key  string
+		req  *ruleenginev1.ManageRulesRequest
+		want codes.Code
+	}{
+		{"no key", "", list, codes.Unauthenticated},
+		{"wrong key", "nope", list, codes.Unauthenticated},
+		{"viewer cannot create", "view", create, codes.PermissionDenied},
+		{"no operation", "author", &ruleenginev1.ManageRulesRequest{}, codes.InvalidArgument},
+		{"viewer lists", "view", list, codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.ManageRules(withKey(tt.key), tt.req)
+			if got := status.Code(err); got != tt.want {
+				t.Fatalf("code = %v, want %v (%v)", got, tt.want, err)
+			}
+			if tt.want == codes.OK && (len(resp.Rules) != 1 || resp.Rules[0].Name != "A") {
+				t.Fatalf("rules = %v", resp.Rules)
+			}
+		})
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGRPCEvaluateValidation(t *testing.T) {
+	client, _ := newTestGRPC(t)
+	facts, _ := structpb.NewStruct(map[string]interface{}{"a": 1})
+	tests := []struct {
+		name string
+		req  *ruleenginev1.EvaluateRequest
+	}{
+		{"no rule set", &ruleenginev1.EvaluateRequest{Facts: facts}},
+		{"no facts", &ruleenginev1.EvaluateRequest{RulesetId: 1}},
+	}
+	for _, tt := range tests {
+		_, err := client.EvaluateRules(withKey("view"), tt.req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: err = %v, want InvalidArgument", tt.name, err)
+		}
+	}
+}
+
+func TestGRPCStreamReportsErrorsInline(t *testing.T) {
+	client, _ := newTestGRPC(t)
+	stream, err := client.StreamEvaluations(withKey("view"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		id := fmt.Sprintf("c%d", i)
+		if err := stream.Send(&ruleenginev1.EvaluateRequest{CorrelationId: id}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.CorrelationId != id || resp.Error.GetCode() != "INVALID_ARGUMENT" {
+			t.Fatalf("response %d = %v", i, resp)
+		}
+	}
+	stream.CloseSend()
+}
+
+func TestGRPCError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want codes.Code
+	}{
+		{&forbiddenError{name: "k", need: accessAuthor}, codes.PermissionDenied},
+		{&badRequest{msg: "x"}, codes.InvalidArgument},
+		{&ruleengine.ValidationError{Field: "name", Message: "x"}, codes.InvalidArgument},
+		{fmt.Errorf("A: %w", ruleengine.ErrRuleNotFound), codes.NotFound},
+		{fmt.Errorf("A: %w", ruleengine.ErrRuleExists), codes.AlreadyExists},
+		{&ruleengine.ConflictError{Rule: "A"}, codes.Aborted},
+		{&ruleengine.EvaluationError{Rule: "A", Err: errors.New("x")}, codes.FailedPrecondition},
+		{context.DeadlineExceeded, codes.DeadlineExceeded},
+		{errors.New("pq: boom"), codes.Internal},
+	}
+	for _, tt := range tests {
+		if got := status.Code(grpcError(tt.err)); got != tt.want {
+			t.Errorf("grpcError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestCodeName(t *testing.T) {
+	tests := map[codes.Code]string{
+		codes.OK:                 "OK",
+		codes.InvalidArgument:    "INVALID_ARGUMENT",
+		codes.FailedPrecondition: "FAILED_PRECONDITION",
+		codes.Unauthenticated:    "UNAUTHENTICATED",
+	}
+	for c, want := range tests {
+		if got := codeName(c); got != want {
+			t.Errorf("codeName(%v) = %q, want %q", c, got, want)
+		}
+	}
+}
+
+func TestGRPCManageRulesScope(t *testing.T) {
+	scoped := withPrincipal(context.Background(), &principal{Name: "team-a", Roles: []string{ruleengine.RoleAdmin}, RuleSets: []int{3}})
+	tests := []struct {
+		name string
+		req  *ruleenginev1.ManageRulesRequest
+		// rule is the rule whose rule sets are looked up
+		rule      string
+		forbidden bool
+	}{
+		{"get in scope", &ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_Get{Get: "A"}}, "A", false},
+		{"get", &ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_Get{Get: "B"}}, "B", true},
+		{"update shared", &ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_Update{
+			Update: &ruleenginev1.SaveRule{Name: "S", Grl: "rule S"}}}, "S", true},
+		{"disable", &ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_Disable{Disable: "B"}}, "B", true},
+		{"delete", &ruleenginev1.ManageRulesRequest{Operation: &ruleenginev1.ManageRulesRequest_Delete{
+			Delete: &ruleenginev1.DeleteRule{Name: "N"}}}, "N", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			expectRuleSetsOf(mock, tt.rule)
+			s := &grpcServer{tenants: &tenantClients{base: ruleengine.New(db)}}
+			_, err = s.manageRules(scoped, tt.req)
+			var forbidden *forbiddenError
+			if errors.As(err, &forbidden) != tt.forbidden {
+				t.Fatalf("err = %v, want forbidden %v", err, tt.forbidden)
+			}
+		})
+	}
+}
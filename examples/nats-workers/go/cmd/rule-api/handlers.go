@@ -0,0 +1,442 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+type evaluateRequest struct {
+	Facts   map[string]interface{} `json:"facts"`
+	Trace   bool                   `json:"trace"`
+	Explain bool                   `json:"explain"`
+}
+
+func (s *server) evaluate(w http.ResponseWriter, r *http.Request, p params) error {
+	id, err := intParam(p, "id")
+	if err != nil {
+		return err
+	}
+	var req evaluateRequest
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	if req.Facts == nil {
+		return &badRequest{msg: "facts is required"}
+	}
+
+	result, err := s.clientFor(r.Context()).EvaluateWithOptions(r.Context(), id, req.Facts,
+		ruleengine.EvaluateOptions{Explain: req.Explain})
+	if err != nil {
+		return err
+	}
+	if !req.Trace {
+		result.Trace = nil
+	}
+	writeJSON(w, http.StatusOK, result)
+	return nil
+}
+
+// Rules
+
+type saveRuleRequest struct {
+	Name            string `json:"name"`
+	GRL             string `json:"grl"`
+	Version         string `json:"version"`
+	Description     string `json:"description"`
+	ChangeNotes     string `json:"change_notes"`
+	ExpectedVersion string `json:"expected_version"`
+	Activate        bool   `json:"activate"`
+}
+
+func (s *server) listRules(w http.ResponseWriter, r *http.Request, p params) error {
+	client := s.clientFor(r.Context())
+	rules, err := client.ListRules(r.Context())
+	if err != nil {
+		return err
+	}
+	if rules, err = scopeRules(r.Context(), client, rules); err != nil {
+		return err
+	}
+	if rules == nil {
+		rules = []ruleengine.Rule{}
+	}
+	writeJSON(w, http.StatusOK, rules)
+	return nil
+}
+
+func (s *server) createRule(w http.ResponseWriter, r *http.Request, p params) error {
+	var req saveRuleRequest
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+
+	rule, err := s.clientFor(r.Context()).CreateRule(r.Context(), ruleengine.SaveRuleInput{
+		Name:        req.Name,
+		GRL:         req.GRL,
+		Version:     req.Version,
+		Description: req.Description,
+		ChangeNotes: req.ChangeNotes,
+	})
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, rule)
+	return nil
+}
+
+// authorizeRule checks the rule named in the path against the caller's
+// rule sets
+func (s *server) authorizeRule(r *http.Request, p params, a access) error {
+	return authorizeRule(r.Context(), s.clientFor(r.Context()), p["name"], a, false)
+}
+
+func (s *server) getRule(w http.ResponseWriter, r *http.Request, p params) error {
+	if err := s.authorizeRule(r, p, accessRead); err != nil {
+		return err
+	}
+	rule, err := s.clientFor(r.Context()).GetRule(r.Context(), p["name"])
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, rule)
+	return nil
+}
+
+func (s *server) updateRule(w http.ResponseWriter, r *http.Request, p params) error {
+	var req saveRuleRequest
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	if req.Name != "" && req.Name != p["name"] {
+		return &badRequest{msg: "name in body does not match the URL"}
+	}
+	if err := s.authorizeRule(r, p, accessAuthor); err != nil {
+		return err
+	}
+
+	rule, err := s.clientFor(r.Context()).UpdateRule(r.Context(), ruleengine.SaveRuleInput{
+		Name:            p["name"],
+		GRL:             req.GRL,
+		Version:         req.Version,
+		ChangeNotes:     req.ChangeNotes,
+		ExpectedVersion: req.ExpectedVersion,
+		Activate:        req.Activate,
+	})
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, rule)
+	return nil
+}
+
+func (s *server) deleteRule(w http.ResponseWriter, r *http.Request, p params) error {
+	if err := s.authorizeRule(r, p, accessAuthor); err != nil {
+		return err
+	}
+	if err := s.clientFor(r.Context()).DeleteRule(r.Context(), p["name"], r.URL.Query().Get("version")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type activateRequest struct {
+	Version         string `json:"version"`
+	ExpectedVersion string `json:"expected_version"`
+}
+
+func (s *server) activateRule(w http.ResponseWriter, r *http.Request, p params) error {
+	var req activateRequest
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	if req.Version == "" {
+		return &badRequest{msg: "version is required"}
+	}
+	if err := s.authorizeRule(r, p, accessAuthor); err != nil {
+		return err
+	}
+
+	if err := s.clientFor(r.Context()).ActivateVersion(r.Context(), p["name"], req.Version, req.ExpectedVersion); err != nil {
+		return err
+	}
+	return s.getRule(w, r, p)
+}
+
+func (s *server) enableRule(w http.ResponseWriter, r *http.Request, p params) error {
+	if err := s.authorizeRule(r, p, accessOperate); err != nil {
+		return err
+	}
+	if err := s.clientFor(r.Context()).EnableRule(r.Context(), p["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *server) disableRule(w http.ResponseWriter, r *http.Request, p params) error {
+	if err := s.authorizeRule(r, p, accessOperate); err != nil {
+		return err
+	}
+	if err := s.clientFor(r.Context()).DisableRule(r.Context(), p["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type validateRequest struct {
+	GRL string `json:"grl"`
+}
+
+func (s *server) validateRule(w http.ResponseWriter, r *http.Request, p params) error {
+	var req validateRequest
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+
+	report, err := s.clientFor(r.Context()).ValidateRule(r.Context(), req.GRL)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, report)
+	return nil
+}
+
+type dryRunRequest struct {
+	GRL   string                 `json:"grl"`
+	Facts map[string]interface{} `json:"facts"`
+	Trace bool                   `json:"trace"`
+}
+
+func (s *server) dryRun(w http.ResponseWriter, r *http.Request, p params) error {
+	var req dryRunRequest
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	if req.Facts == nil {
+		return &badRequest{msg: "facts is required"}
+	}
+
+	result, err := s.clientFor(r.Context()).DryRun(r.Context(), req.GRL, req.Facts)
+	if err != nil {
+		return err
+	}
+	if !req.Trace {
+		result.Trace = nil
+	}
+	writeJSON(w, http.StatusOK, result)
+	return nil
+}
+
+// Rule sets
+
+type createRuleSetRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func (s *server) listRuleSets(w http.ResponseWriter, r *http.Request, p params) error {
+	sets, err := s.clientFor(r.Context()).ListRuleSets(r.Context())
+	if err != nil {
+		return err
+	}
+	sets = scopeRuleSets(r.Context(), sets)
+	if sets == nil {
+		sets = []ruleengine.RuleSet{}
+	}
+	writeJSON(w, http.StatusOK, sets)
+	return nil
+}
+
+func (s *server) createRuleSet(w http.ResponseWriter, r *http.Request, p params) error {
+	var req createRuleSetRequest
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+
+	id, err := s.clientFor(r.Context()).CreateRuleSet(r.Context(), req.Name, req.Description)
+	if err != nil {
+		return err
+	}
+	rs, err := s.clientFor(r.Context()).GetRuleSet(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, rs)
+	return nil
+}
+
+func (s *server) getRuleSet(w http.ResponseWriter, r *http.Request, p params) error {
+	id, err := intParam(p, "id")
+	if err != nil {
+		return err
+	}
+	rs, err := s.clientFor(r.Context()).GetRuleSet(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, rs)
+	return nil
+}
+
+func (s *server) deleteRuleSet(w http.ResponseWriter, r *http.Request, p params) error {
+	id, err := intParam(p, "id")
+	if err != nil {
+		return err
+	}
+	if err := s.clientFor(r.Context()).DeleteRuleSet(r.Context(), id); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *server) addRuleToSet(w http.ResponseWriter, r *http.Request, p params) error {
+	id, err := intParam(p, "id")
+	if err != nil {
+		return err
+	}
+	var member ruleengine.RuleSetMember
+	if err := decode(w, r, &member); err != nil {
+		return err
+	}
+	// Otherwise a scoped key could take over another rule set's rule
+	if err := authorizeRule(r.Context(), s.clientFor(r.Context()), member.Rule, accessAuthor, true); err != nil {
+		return err
+	}
+
+	if err := s.clientFor(r.Context()).AddRuleToSet(r.Context(), id, member); err != nil {
+		return err
+	}
+	return s.getRuleSet(w, r, p)
+}
+
+func (s *server) removeRuleFromSet(w http.ResponseWriter, r *http.Request, p params) error {
+	id, err := intParam(p, "id")
+	if err != nil {
+		return err
+	}
+	if err := s.clientFor(r.Context()).RemoveRuleFromSet(r.Context(), id, p["rule"], r.URL.Query().Get("version")); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *server) enableRuleSet(w http.ResponseWriter, r *http.Request, p params) error {
+	id, err := intParam(p, "id")
+	if err != nil {
+		return err
+	}
+	if err := s.clientFor(r.Context()).EnableRuleSet(r.Context(), id); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *server) disableRuleSet(w http.ResponseWriter, r *http.Request, p params) error {
+	id, err := intParam(p, "id")
+	if err != nil {
+		return err
+	}
+	if err := s.clientFor(r.Context()).DisableRuleSet(r.Context(), id); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Monitoring
+
+func (s *server) listAudit(w http.ResponseWriter, r *http.Request, p params) error {
+	limit, err := intQuery(r, "limit")
+	if err != nil {
+		return err
+	}
+	since, err := timeQuery(r, "since")
+	if err != nil {
+		return err
+	}
+	until, err := timeQuery(r, "until")
+	if err != nil {
+		return err
+	}
+
+	q := r.URL.Query()
+	entries, err := s.clientFor(r.Context()).ListAuditLog(r.Context(), ruleengine.AuditFilter{
+		Rule:   q.Get("rule"),
+		Actor:  q.Get("actor"),
+		Action: q.Get("action"),
+		Since:  since,
+		Until:  until,
+		Limit:  limit,
+	})
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, entries)
+	return nil
+}
+
+func (s *server) listDeliveries(w http.ResponseWriter, r *http.Request, p params) error {
+	webhookID, err := intQuery(r, "webhook_id")
+	if err != nil {
+		return err
+	}
+	limit, err := intQuery(r, "limit")
+	if err != nil {
+		return err
+	}
+
+	deliveries, err := s.clientFor(r.Context()).ListDeliveries(r.Context(), ruleengine.DeliveryFilter{
+		WebhookID: webhookID,
+		Status:    r.URL.Query().Get("status"),
+		Limit:     limit,
+	})
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+	return nil
+}
+
+func (s *server) cacheStats(w http.ResponseWriter, r *http.Request, p params) error {
+	writeJSON(w, http.StatusOK, s.client.ResultCacheStats())
+	return nil
+}
+
+// listMatchViews reports each match view's staleness and, when this
+// gateway runs the scheduler, its refresh counters
+func (s *server) listMatchViews(w http.ResponseWriter, r *http.Request, p params) error {
+	views, err := s.client.ListMatchViews(r.Context())
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{"views": views}
+	if s.matviews != nil {
+		body["scheduler"] = s.matviews.Stats()
+	}
+	writeJSON(w, http.StatusOK, body)
+	return nil
+}
+
+func (s *server) refreshMatchView(w http.ResponseWriter, r *http.Request, p params) error {
+	refresh, err := s.client.RefreshMatchView(r.Context(), p["name"], r.URL.Query().Get("full") == "true")
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, refresh)
+	return nil
+}
+
+func (s *server) consumerStats(w http.ResponseWriter, r *http.Request, p params) error {
+	stats, err := s.clientFor(r.Context()).ListConsumerStats(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, stats)
+	return nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// inboundTolerance is how far a signed timestamp may be from now, so a
+// captured request cannot be replayed later. Stripe, Slack, and Standard
+// Webhooks sign a timestamp; GitHub, Shopify, and plain HMAC do not, so
+// for them a replay is only caught when its event id was already stored.
+const inboundTolerance = 5 * time.Minute
+
+// errInboundSignature rejects a request whose signature does not verify.
+// The reason is logged, not returned to the sender.
+var errInboundSignature = errors.New("invalid signature")
+
+// inboundEvent is a verified webhook, normalized for rules
+type inboundEvent struct {
+	id   string      // the provider's event or delivery id; a body hash if it has none
+	typ  string      // e.g. invoice.paid, pull_request.opened
+	data interface{} // the Event.data fact
+
+	// reply answers a handshake instead of storing an event
+	reply interface{}
+}
+
+// inboundProvider verifies a request signed with secret and parses it
+type inboundProvider func(secret string, h http.Header, body []byte, now time.Time) (*inboundEvent, error)
+
+var inboundProviders = map[string]inboundProvider{
+	"stripe":   verifyStripe,
+	"github":   verifyGitHub,
+	"slack":    verifySlack,
+	"shopify":  verifyShopify,
+	"standard": verifyStandardWebhook,
+	"hmac":     verifyHMAC,
+}
+
+// receiveInbound serves POST /inbound/{source}. It is outside /v1: senders
+// authenticate with the source's signature instead of an API key.
+func (s *server) receiveInbound(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/inbound/")
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorBody{Error: "method not allowed"})
+		return
+	}
+	source, err := s.client.GetInboundSource(r.Context(), name)
+	if errors.Is(err, ruleengine.ErrInboundSourceNotFound) || (err == nil && !source.Enabled) {
+		writeJSON(w, http.StatusNotFound, errorBody{Error: "not found"})
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, errorBody{Error: "body too large"})
+		return
+	}
+
+	ev, err := inboundProviders[source.Provider](source.Secret, r.Header, body, time.Now())
+	if err != nil {
+		logInternal("inbound "+name, err)
+		if errors.Is(err, errInboundSignature) {
+			writeJSON(w, http.StatusUnauthorized, errorBody{Error: errInboundSignature.Error()})
+		} else {
+			writeJSON(w, http.StatusBadRequest, errorBody{Error: err.Error()})
+		}
+		return
+	}
+	if ev.reply != nil {
+		writeJSON(w, http.StatusOK, ev.reply)
+		return
+	}
+	if ev.id == "" {
+		sum := sha256.Sum256(body)
+		ev.id = hex.EncodeToString(sum[:16])
+	}
+
+	// Errors are 500s so the provider retries; the event id makes the
+	// retry a no-op if the first attempt was stored
+	stored, duplicate, err := s.client.IngestInboundEvent(r.Context(), source, ev.id, ev.typ, ev.data)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":            stored.ID,
+		"duplicate":     duplicate,
+		"matched_rules": stored.MatchedRules,
+	})
+}
+
+// verifyStripe checks Stripe-Signature: t=<unix>,v1=<hex HMAC of "t.body">
+func verifyStripe(secret string, h http.Header, body []byte, now time.Time) (*inboundEvent, error) {
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(h.Get("Stripe-Signature"), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	if err := checkTimestamp(ts, now); err != nil {
+		return nil, err
+	}
+	if !anyHexMAC(secret, []byte(ts+"."+string(body)), sigs) {
+		return nil, errInboundSignature
+	}
+	var event struct {
+		ID   string          `json:"id"`
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid Stripe event: %v", err)
+	}
+	data, err := jsonValue(event.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &inboundEvent{id: event.ID, typ: event.Type, data: data}, nil
+}
+
+// verifyGitHub checks X-Hub-Signature-256: sha256=<hex HMAC of body>. The
+// type is the X-GitHub-Event header plus the payload's action, as in
+// pull_request.opened; pings are answered without storing. GitHub signs
+// no timestamp: a replayed delivery is a duplicate by X-GitHub-Delivery.
+func verifyGitHub(secret string, h http.Header, body []byte, _ time.Time) (*inboundEvent, error) {
+	if !anyHexMAC(secret, body, []string{strings.TrimPrefix(h.Get("X-Hub-Signature-256"), "sha256=")}) {
+		return nil, errInboundSignature
+	}
+	event := h.Get("X-GitHub-Event")
+	if event == "ping" {
+		return &inboundEvent{reply: map[string]bool{"ok": true}}, nil
+	}
+	data, err := jsonValue(body)
+	if err != nil {
+		return nil, err
+	}
+	typ := event
+	if payload, ok := data.(map[string]interface{}); ok {
+		if action, ok := payload["action"].(string); ok && action != "" {
+			typ += "." + action
+		}
+	}
+	return &inboundEvent{id: h.Get("X-GitHub-Delivery"), typ: typ, data: data}, nil
+}
+
+// verifySlack checks X-Slack-Signature: v0=<hex HMAC of "v0:ts:body">
+// against X-Slack-Request-Timestamp, and answers url_verification
+func verifySlack(secret string, h http.Header, body []byte, now time.Time) (*inboundEvent, error) {
+	ts := h.Get("X-Slack-Request-Timestamp")
+	if err := checkTimestamp(ts, now); err != nil {
+		return nil, err
+	}
+	sig := strings.TrimPrefix(h.Get("X-Slack-Signature"), "v0=")
+	if !anyHexMAC(secret, []byte("v0:"+ts+":"+string(body)), []string{sig}) {
+		return nil, errInboundSignature
+	}
+	var envelope struct {
+		Type      string                 `json:"type"`
+		Challenge string                 `json:"challenge"`
+		EventID   string                 `json:"event_id"`
+		Event     map[string]interface{} `json:"event"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid Slack event: %v", err)
+	}
+	if envelope.Type == "url_verification" {
+		return &inboundEvent{reply: map[string]string{"challenge": envelope.Challenge}}, nil
+	}
+	typ, _ := envelope.Event["type"].(string)
+	return &inboundEvent{id: envelope.EventID, typ: typ, data: envelope.Event}, nil
+}
+
+// verifyShopify checks X-Shopify-Hmac-Sha256: <base64 HMAC of body>.
+// X-Shopify-Triggered-At is not signed, so it is no replay window; a
+// replay is a duplicate by X-Shopify-Event-Id.
+func verifyShopify(secret string, h http.Header, body []byte, _ time.Time) (*inboundEvent, error) {
+	sig, err := base64.StdEncoding.DecodeString(h.Get("X-Shopify-Hmac-Sha256"))
+	if err != nil || !hmac.Equal(sig, computeMAC([]byte(secret), body)) {
+		return nil, errInboundSignature
+	}
+	data, err := jsonValue(body)
+	if err != nil {
+		return nil, err
+	}
+	id := h.Get("X-Shopify-Event-Id")
+	if id == "" {
+		id = h.Get("X-Shopify-Webhook-Id")
+	}
+	return &inboundEvent{id: id, typ: h.Get("X-Shopify-Topic"), data: data}, nil
+}
+
+// verifyStandardWebhook checks the Standard Webhooks scheme (Svix, and
+// others): webhook-signature holds "v1,<base64 HMAC of id.timestamp.body>"
+// entries, keyed by the base64 part of a whsec_ secret
+func verifyStandardWebhook(secret string, h http.Header, body []byte, now time.Time) (*inboundEvent, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, "whsec_"))
+	if err != nil {
+		return nil, fmt.Errorf("source secret is not a whsec_ key: %w", errInboundSignature)
+	}
+	id, ts := h.Get("webhook-id"), h.Get("webhook-timestamp")
+	if err := checkTimestamp(ts, now); err != nil {
+		return nil, err
+	}
+	expected := computeMAC(key, []byte(id+"."+ts+"."+string(body)))
+	verified := false
+	for _, entry := range strings.Fields(h.Get("webhook-signature")) {
+		version, encoded, _ := strings.Cut(entry, ",")
+		sig, err := base64.StdEncoding.DecodeString(encoded)
+		verified = verified || (version == "v1" && err == nil && hmac.Equal(sig, expected))
+	}
+	if !verified {
+		return nil, errInboundSignature
+	}
+
+	var event struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	json.Unmarshal(body, &event)
+	raw := json.RawMessage(body)
+	if event.Data != nil {
+		raw = event.Data
+	}
+	data, err := jsonValue(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &inboundEvent{id: id, typ: event.Type, data: data}, nil
+}
+
+// verifyHMAC checks X-Signature-256 (or X-Signature): the hex HMAC-SHA256
+// of the body, optionally prefixed sha256=. X-Event-Id and X-Event-Type,
+// or the body's id and type, identify the event. Nothing time-bound is
+// signed: a replay is a duplicate by that id, or by the body's hash.
+func verifyHMAC(secret string, h http.Header, body []byte, _ time.Time) (*inboundEvent, error) {
+	sig := h.Get("X-Signature-256")
+	if sig == "" {
+		sig = h.Get("X-Signature")
+	}
+	if !anyHexMAC(secret, body, []string{strings.TrimPrefix(sig, "sha256=")}) {
+		return nil, errInboundSignature
+	}
+	data, err := jsonValue(body)
+	if err != nil {
+		return nil, err
+	}
+	ev := &inboundEvent{id: h.Get("X-Event-Id"), typ: h.Get("X-Event-Type"), data: data}
+	if payload, ok := data.(map[string]interface{}); ok {
+		if id, ok := payload["id"].(string); ok && ev.id == "" {
+			ev.id = id
+		}
+		if typ, ok := payload["type"].(string); ok && ev.typ == "" {
+			ev.typ = typ
+		}
+	}
+	return ev, nil
+}
+
+func computeMAC(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// anyHexMAC reports whether one of sigs is the hex HMAC-SHA256 of message
+func anyHexMAC(secret string, message []byte, sigs []string) bool {
+	expected := computeMAC([]byte(secret), message)
+	for _, s := range sigs {
+		if sig, err := hex.DecodeString(s); err == nil && hmac.Equal(sig, expected) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTimestamp rejects a Unix timestamp outside inboundTolerance of now
+func checkTimestamp(ts string, now time.Time) error {
+	n, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing signature timestamp: %w", errInboundSignature)
+	}
+	if d := now.Sub(time.Unix(n, 0)); d > inboundTolerance || d < -inboundTolerance {
+		return fmt.Errorf("signature timestamp is %s off: %w", d.Round(time.Second), errInboundSignature)
+	}
+	return nil
+}
+
+func jsonValue(raw []byte) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("body is not JSON: %v", err)
+	}
+	return v, nil
+}
+
+func (s *server) listInboundSources(w http.ResponseWriter, r *http.Request, p params) error {
+	sources, err := s.client.ListInboundSources(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, sources)
+	return nil
+}
+
+func (s *server) createInboundSource(w http.ResponseWriter, r *http.Request, p params) error {
+	var req ruleengine.InboundSource
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	if err := authorizeRuleSet(r.Context(), req.RuleSetID); req.RuleSetID != 0 && err != nil {
+		return err
+	}
+	if err := s.client.CreateInboundSource(r.Context(), req); err != nil {
+		return err
+	}
+	created, err := s.client.GetInboundSource(r.Context(), req.Name)
+	if err != nil {
+		return err
+	}
+	created.Secret = ""
+	writeJSON(w, http.StatusCreated, created)
+	return nil
+}
+
+func (s *server) deleteInboundSource(w http.ResponseWriter, r *http.Request, p params) error {
+	if err := s.client.DeleteInboundSource(r.Context(), p["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *server) listInboundEvents(w http.ResponseWriter, r *http.Request, p params) error {
+	limit, err := intQuery(r, "limit")
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.GetInboundSource(r.Context(), p["name"]); err != nil {
+		return err
+	}
+	events, err := s.client.ListInboundEvents(r.Context(), p["name"], limit)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, events)
+	return nil
+}
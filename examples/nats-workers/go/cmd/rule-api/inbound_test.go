@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// sign returns the HMAC-SHA256 of message under key
+func sign(key, message string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func signHex(key, message string) string { return hex.EncodeToString(sign(key, message)) }
+
+func TestInboundProviders(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	const ts, stale, ahead = "1700000000", "1699999400", "1700000360"
+
+	standardKey := "standard-key"
+	standardSecret := "whsec_" + base64.StdEncoding.EncodeToString([]byte(standardKey))
+	standardSig := func(id, ts, body string) string {
+		return "v1," + base64.StdEncoding.EncodeToString(sign(standardKey, id+"."+ts+"."+body))
+	}
+
+	const (
+		stripeBody   = `{"id":"evt_1","type":"invoice.paid","data":{"object":{"amount":5}}}`
+		githubBody   = `{"action":"opened","number":7}`
+		slackBody    = `{"type":"event_callback","event_id":"Ev1","event":{"type":"app_mention","text":"hi"}}`
+		slackVerify  = `{"type":"url_verification","challenge":"c1"}`
+		shopifyBody  = `{"id":42,"total_price":"9.50"}`
+		standardBody = `{"type":"user.created","data":{"id":"u1"}}`
+		hmacBody     = `{"id":"o1","type":"order.created","total":3}`
+	)
+
+	tests := []struct {
+		name     string
+		provider string
+		secret   string
+		header   http.Header
+		body     string
+		want     *inboundEvent
+		wantErr  string // prefix
+		wantSig  bool   // wantErr is errInboundSignature
+	}{
+		{name: "stripe", provider: "stripe", secret: "whsec_s", body: stripeBody,
+			header: http.Header{"Stripe-Signature": {"t=" + ts + ",v1=" + signHex("whsec_s", ts+"."+stripeBody)}},
+			want: &inboundEvent{id: "evt_1", typ: "invoice.paid",
+				data: map[string]interface{}{"object": map[string]interface{}{"amount": 5.0}}}},
+		{name: "stripe during secret rotation", provider: "stripe", secret: "whsec_s", body: stripeBody,
+			header: http.Header{"Stripe-Signature": {"t=" + ts + ", v1=" + signHex("old", ts+"."+stripeBody) +
+				", v1=" + signHex("whsec_s", ts+"."+stripeBody) + ", v0=zz"}},
+			want: &inboundEvent{id: "evt_1", typ: "invoice.paid",
+				data: map[string]interface{}{"object": map[string]interface{}{"amount": 5.0}}}},
+		{name: "stripe wrong secret", provider: "stripe", secret: "whsec_s", body: stripeBody,
+			header:  http.Header{"Stripe-Signature": {"t=" + ts + ",v1=" + signHex("other", ts+"."+stripeBody)}},
+			wantErr: "invalid signature", wantSig: true},
+		{name: "stripe signature over another timestamp", provider: "stripe", secret: "whsec_s", body: stripeBody,
+			header:  http.Header{"Stripe-Signature": {"t=" + ts + ",v1=" + signHex("whsec_s", stale+"."+stripeBody)}},
+			wantErr: "invalid signature", wantSig: true},
+		{name: "stripe replayed after the window", provider: "stripe", secret: "whsec_s", body: stripeBody,
+			header:  http.Header{"Stripe-Signature": {"t=" + stale + ",v1=" + signHex("whsec_s", stale+"."+stripeBody)}},
+			wantErr: "signature timestamp is 10m0s off: invalid signature", wantSig: true},
+		{name: "stripe without a timestamp", provider: "stripe", secret: "whsec_s", body: stripeBody,
+			header:  http.Header{"Stripe-Signature": {"v1=" + signHex("whsec_s", "."+stripeBody)}},
+			wantErr: "missing signature timestamp: invalid signature", wantSig: true},
+		{name: "stripe invalid event", provider: "stripe", secret: "whsec_s", body: `[]`,
+			header:  http.Header{"Stripe-Signature": {"t=" + ts + ",v1=" + signHex("whsec_s", ts+".[]")}},
+			wantErr: "invalid Stripe event: "},
+
+		{name: "github", provider: "github", secret: "gh", body: githubBody,
+			header: http.Header{"X-Hub-Signature-256": {"sha256=" + signHex("gh", githubBody)},
+				"X-Github-Event": {"pull_request"}, "X-Github-Delivery": {"d1"}},
+			want: &inboundEvent{id: "d1", typ: "pull_request.opened",
+				data: map[string]interface{}{"action": "opened", "number": 7.0}}},
+		{name: "github event without an action", provider: "github", secret: "gh", body: `{"ref":"main"}`,
+			header: http.Header{"X-Hub-Signature-256": {"sha256=" + signHex("gh", `{"ref":"main"}`)},
+				"X-Github-Event": {"push"}, "X-Github-Delivery": {"d2"}},
+			want: &inboundEvent{id: "d2", typ: "push", data: map[string]interface{}{"ref": "main"}}},
+		{name: "github ping", provider: "github", secret: "gh", body: `{"zen":"x"}`,
+			header: http.Header{"X-Hub-Signature-256": {"sha256=" + signHex("gh", `{"zen":"x"}`)}, "X-Github-Event": {"ping"}},
+			want:   &inboundEvent{reply: map[string]bool{"ok": true}}},
+		{name: "github unsigned", provider: "github", secret: "gh", body: githubBody,
+			header:  http.Header{"X-Github-Event": {"pull_request"}},
+			wantErr: "invalid signature", wantSig: true},
+		{name: "github not JSON", provider: "github", secret: "gh", body: "a=b",
+			header:  http.Header{"X-Hub-Signature-256": {"sha256=" + signHex("gh", "a=b")}, "X-Github-Event": {"push"}},
+			wantErr: "body is not JSON: "},
+
+		{name: "slack", provider: "slack", secret: "sl", body: slackBody,
+			header: http.Header{"X-Slack-Request-Timestamp": {ts}, "X-Slack-Signature": {"v0=" + signHex("sl", "v0:"+ts+":"+slackBody)}},
+			want: &inboundEvent{id: "Ev1", typ: "app_mention",
+				data: map[string]interface{}{"type": "app_mention", "text": "hi"}}},
+		{name: "slack url verification", provider: "slack", secret: "sl", body: slackVerify,
+			header: http.Header{"X-Slack-Request-Timestamp": {ts}, "X-Slack-Signature": {"v0=" + signHex("sl", "v0:"+ts+":"+slackVerify)}},
+			want:   &inboundEvent{reply: map[string]string{"challenge": "c1"}}},
+		{name: "slack timestamp ahead of the window", provider: "slack", secret: "sl", body: slackBody,
+			header:  http.Header{"X-Slack-Request-Timestamp": {ahead}, "X-Slack-Signature": {"v0=" + signHex("sl", "v0:"+ahead+":"+slackBody)}},
+			wantErr: "signature timestamp is -6m0s off: invalid signature", wantSig: true},
+		{name: "slack timestamp swapped after signing", provider: "slack", secret: "sl", body: slackBody,
+			header:  http.Header{"X-Slack-Request-Timestamp": {ts}, "X-Slack-Signature": {"v0=" + signHex("sl", "v0:"+stale+":"+slackBody)}},
+			wantErr: "invalid signature", wantSig: true},
+
+		{name: "shopify", provider: "shopify", secret: "sh", body: shopifyBody,
+			header: http.Header{"X-Shopify-Hmac-Sha256": {base64.StdEncoding.EncodeToString(sign("sh", shopifyBody))},
+				"X-Shopify-Topic": {"orders/create"}, "X-Shopify-Event-Id": {"e1"}, "X-Shopify-Webhook-Id": {"w1"}},
+			want: &inboundEvent{id: "e1", typ: "orders/create", data: map[string]interface{}{"id": 42.0, "total_price": "9.50"}}},
+		{name: "shopify webhook id", provider: "shopify", secret: "sh", body: shopifyBody,
+			header: http.Header{"X-Shopify-Hmac-Sha256": {base64.StdEncoding.EncodeToString(sign("sh", shopifyBody))},
+				"X-Shopify-Topic": {"orders/create"}, "X-Shopify-Webhook-Id": {"w1"}},
+			want: &inboundEvent{id: "w1", typ: "orders/create", data: map[string]interface{}{"id": 42.0, "total_price": "9.50"}}},
+		{name: "shopify hex signature", provider: "shopify", secret: "sh", body: shopifyBody,
+			header:  http.Header{"X-Shopify-Hmac-Sha256": {signHex("sh", shopifyBody)}},
+			wantErr: "invalid signature", wantSig: true},
+
+		{name: "standard", provider: "standard", secret: standardSecret, body: standardBody,
+			header: http.Header{"Webhook-Id": {"msg_1"}, "Webhook-Timestamp": {ts},
+				"Webhook-Signature": {"v1,AAAA " + standardSig("msg_1", ts, standardBody)}},
+			want: &inboundEvent{id: "msg_1", typ: "user.created", data: map[string]interface{}{"id": "u1"}}},
+		{name: "standard without data is the whole body", provider: "standard", secret: standardSecret, body: `{"n":1}`,
+			header: http.Header{"Webhook-Id": {"msg_2"}, "Webhook-Timestamp": {ts},
+				"Webhook-Signature": {standardSig("msg_2", ts, `{"n":1}`)}},
+			want: &inboundEvent{id: "msg_2", data: map[string]interface{}{"n": 1.0}}},
+		{name: "standard id swapped after signing", provider: "standard", secret: standardSecret, body: standardBody,
+			header: http.Header{"Webhook-Id": {"msg_9"}, "Webhook-Timestamp": {ts},
+				"Webhook-Signature": {standardSig("msg_1", ts, standardBody)}},
+			wantErr: "invalid signature", wantSig: true},
+		{name: "standard unknown version", provider: "standard", secret: standardSecret, body: standardBody,
+			header: http.Header{"Webhook-Id": {"msg_1"}, "Webhook-Timestamp": {ts},
+				"Webhook-Signature": {"v1a" + strings.TrimPrefix(standardSig("msg_1", ts, standardBody), "v1")}},
+			wantErr: "invalid signature", wantSig: true},
+		{name: "standard replayed after the window", provider: "standard", secret: standardSecret, body: standardBody,
+			header: http.Header{"Webhook-Id": {"msg_1"}, "Webhook-Timestamp": {stale},
+				"Webhook-Signature": {standardSig("msg_1", stale, standardBody)}},
+			wantErr: "signature timestamp is 10m0s off: invalid signature", wantSig: true},
+		{name: "standard secret that is not a key", provider: "standard", secret: "whsec_!!", body: standardBody,
+			wantErr: "source secret is not a whsec_ key: invalid signature", wantSig: true},
+
+		{name: "hmac", provider: "hmac", secret: "k", body: hmacBody,
+			header: http.Header{"X-Signature-256": {"sha256=" + signHex("k", hmacBody)}},
+			want: &inboundEvent{id: "o1", typ: "order.created",
+				data: map[string]interface{}{"id": "o1", "type": "order.created", "total": 3.0}}},
+		{name: "hmac headers win over the body", provider: "hmac", secret: "k", body: hmacBody,
+			header: http.Header{"X-Signature": {signHex("k", hmacBody)}, "X-Event-Id": {"h1"}, "X-Event-Type": {"h.type"}},
+			want: &inboundEvent{id: "h1", typ: "h.type",
+				data: map[string]interface{}{"id": "o1", "type": "order.created", "total": 3.0}}},
+		{name: "hmac body changed after signing", provider: "hmac", secret: "k", body: hmacBody,
+			header:  http.Header{"X-Signature-256": {"sha256=" + signHex("k", `{"total":300}`)}},
+			wantErr: "invalid signature", wantSig: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, err := inboundProviders[tt.provider](tt.secret, tt.header, []byte(tt.body), now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) || errors.Is(err, errInboundSignature) != tt.wantSig {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ev, tt.want) {
+				t.Fatalf("event = %+v, want %+v", ev, tt.want)
+			}
+		})
+	}
+
+	for _, p := range ruleengine.InboundProviders {
+		if inboundProviders[p] == nil {
+			t.Errorf("provider %s has no verifier", p)
+		}
+	}
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		ts      string
+		wantErr string
+	}{
+		{ts: "1700000000"},
+		{ts: "1699999700"},
+		{ts: "1700000300"},
+		{ts: "1699999699", wantErr: "signature timestamp is 5m1s off: invalid signature"},
+		{ts: "1700000301", wantErr: "signature timestamp is -5m1s off: invalid signature"},
+		{ts: "", wantErr: "missing signature timestamp: invalid signature"},
+		{ts: "2023-11-14T22:13:20Z", wantErr: "missing signature timestamp: invalid signature"},
+	}
+	for _, tt := range tests {
+		err := checkTimestamp(tt.ts, now)
+		if (tt.wantErr == "" && err != nil) || (tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr)) {
+			t.Errorf("%q: err = %v, want %q", tt.ts, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, errInboundSignature) {
+			t.Errorf("%q: %v is not a signature error", tt.ts, err)
+		}
+	}
+}
+
+func TestReceiveInbound(t *testing.T) {
+	const body = `{"ref":"main"}`
+	signed := http.Header{"X-Hub-Signature-256": {"sha256=" + signHex("gh", body)},
+		"X-Github-Event": {"push"}, "X-Github-Delivery": {"d1"}}
+	sourceRow := func(enabled bool) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"name", "provider", "ruleset_id", "enabled", "created_at", "decrypt_credential"}).
+			AddRow("gh", "github", 0, enabled, time.Now(), "gh")
+	}
+	expectSource := func(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+		mock.ExpectQuery(`decrypt_credential\(secret_encrypted\) FROM rule_inbound_sources WHERE name = \$1`).
+			WithArgs("gh").WillReturnRows(rows)
+	}
+	eventColumns := []string{"id", "source", "event_id", "event_type", "facts", "matched_rules", "error", "received_at", "evaluated_at"}
+
+	tests := []struct {
+		name       string
+		method     string
+		header     http.Header
+		expect     func(sqlmock.Sqlmock)
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "stored", method: "POST", header: signed,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectSource(mock, sourceRow(true))
+				mock.ExpectQuery("INSERT INTO rule_inbound_events").
+					WithArgs("gh", "d1", "push", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "received_at"}).AddRow(5, time.Now()))
+			},
+			wantStatus: http.StatusOK, wantBody: `{"duplicate":false,"id":5,"matched_rules":null}`},
+		{name: "replayed delivery is a duplicate", method: "POST", header: signed,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectSource(mock, sourceRow(true))
+				mock.ExpectQuery("INSERT INTO rule_inbound_events").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "received_at"}))
+				mock.ExpectQuery("FROM rule_inbound_events WHERE source = \\$1 AND event_id = \\$2").WithArgs("gh", "d1").
+					WillReturnRows(sqlmock.NewRows(eventColumns).AddRow(5, "gh", "d1", "push", []byte(`{}`), []byte("{Big}"), "",
+						time.Now(), time.Now()))
+			},
+			wantStatus: http.StatusOK, wantBody: `{"duplicate":true,"id":5,"matched_rules":["Big"]}`},
+		{name: "bad signature", method: "POST", header: http.Header{"X-Hub-Signature-256": {"sha256=00"}},
+			expect:     func(mock sqlmock.Sqlmock) { expectSource(mock, sourceRow(true)) },
+			wantStatus: http.StatusUnauthorized, wantBody: `{"error":"invalid signature"}`},
+		{name: "disabled source", method: "POST", header: signed,
+			expect:     func(mock sqlmock.Sqlmock) { expectSource(mock, sourceRow(false)) },
+			wantStatus: http.StatusNotFound, wantBody: `{"error":"not found"}`},
+		{name: "unknown source", method: "POST", header: signed,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectSource(mock, sqlmock.NewRows([]string{"name", "provider", "ruleset_id", "enabled", "created_at", "decrypt_credential"}))
+			},
+			wantStatus: http.StatusNotFound, wantBody: `{"error":"not found"}`},
+		{name: "not a POST", method: "GET", expect: func(sqlmock.Sqlmock) {},
+			wantStatus: http.StatusMethodNotAllowed, wantBody: `{"error":"method not allowed"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			client := ruleengine.New(db)
+			s := &server{client: client, tenants: &tenantClients{base: client}, inbound: true}
+			tt.expect(mock)
+
+			req := httptest.NewRequest(tt.method, "/inbound/gh", strings.NewReader(body))
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			s.routes(&authenticator{}).ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus || strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+				t.Fatalf("= %d %s, want %d %s", rec.Code, rec.Body, tt.wantStatus, tt.wantBody)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+// Command rule-api is a REST gateway for the rule engine. It exposes rule
+// evaluation, rule and rule set management, webhook deliveries, and NATS
+// consumer statistics over HTTP using the ruleengine SDK, so clients need
+// neither Go nor direct database access.
+//
+// The REST API is described by openapi.yaml, which is also served at
+// /openapi.yaml. With RULE_API_GRAPHQL=true the same data is available
+// over GraphQL at /v1/graphql. The same binary serves the gRPC service defined in
+// api/ruleengine/v1/ruleengine.proto on a separate port.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+	"google.golang.org/grpc"
+
+	"github.com/rule-engine/nats-webhook-worker/buildinfo"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// version, commit, and date describe the build; cmd/release sets them
+// with -ldflags "-X main.version=v1.2.3 -X main.commit=… -X main.date=…"
+var (
+	version = "dev"
+	commit  string
+	date    string
+)
+
+// Config holds the gateway configuration
+type Config struct {
+	Addr        string
+	GRPCAddr    string
+	DatabaseURL string
+	OpsURL      string
+	APIKeys     []apiKey
+	Events      bool
+	Audit       bool
+	Rollouts    bool
+	StoredKeys  bool
+	Tenancy     bool
+	MatchViews  bool
+	Windows     bool
+	Responses   bool
+	RuleStats   bool
+	GraphQL     bool
+	Inbound     bool
+	OIDC        oidcConfig
+
+	// ResultCache is the number of evaluation results to cache; 0 disables
+	ResultCache    int
+	ResultCacheTTL time.Duration
+}
+
+func loadConfig() Config {
+	return Config{
+		Addr:        getEnv("RULE_API_ADDR", ":8080"),
+		GRPCAddr:    os.Getenv("RULE_API_GRPC_ADDR"),
+		DatabaseURL: getEnv("DATABASE_URL", "postgresql://localhost/postgres?sslmode=disable"),
+		OpsURL:      os.Getenv("OPS_DATABASE_URL"),
+		APIKeys:     parseAPIKeys(os.Getenv("RULE_API_KEYS")),
+		Events:      getEnv("RULE_API_EVENTS", "true") == "true",
+		Audit:       getEnv("RULE_API_AUDIT", "true") == "true",
+		Rollouts:    getEnv("RULE_API_ROLLOUTS", "false") == "true",
+		StoredKeys:  getEnv("RULE_API_STORED_KEYS", "false") == "true",
+		Tenancy:     getEnv("RULE_API_TENANCY", "false") == "true",
+		MatchViews:  getEnv("RULE_API_MATCH_VIEWS", "false") == "true",
+		Windows:     getEnv("RULE_API_WINDOWS", "false") == "true",
+		Responses:   getEnv("RULE_API_RESPONSE_FACTS", "false") == "true",
+		RuleStats:   getEnv("RULE_API_RULE_STATS", "false") == "true",
+		GraphQL:     getEnv("RULE_API_GRAPHQL", "false") == "true",
+		Inbound:     getEnv("RULE_API_INBOUND", "false") == "true",
+		OIDC:        loadOIDCConfig(),
+
+		ResultCache:    getEnvInt("RULE_API_RESULT_CACHE", 0),
+		ResultCacheTTL: getEnvDuration("RULE_API_RESULT_CACHE_TTL", 0),
+	}
+}
+
+func main() {
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println("rule-api", buildinfo.Read(version, commit, date))
+		return
+	}
+
+	log.Printf("🚀 Starting rule-api gateway %s...", buildinfo.Read(version, commit, date))
+	cfg := loadConfig()
+
+	db, err := sql.Open("postgres", cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("❌ Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		log.Fatalf("❌ Failed to ping database: %v", err)
+	}
+	log.Println("✅ Connected to PostgreSQL")
+
+	if err := assignKeyRoles(cfg.APIKeys, os.Getenv("RULE_API_KEY_ROLES"), getEnv("RULE_API_DEFAULT_ROLE", "admin")); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	client := ruleengine.New(db)
+	// The gateway serves what it can of an unsupported extension, so a
+	// mismatch is only logged
+	if ext, err := client.CheckExtension(context.Background()); err != nil {
+		log.Printf("⚠️  %v", err)
+	} else {
+		log.Printf("✅ Rule engine extension %s", ext)
+	}
+	auth := &authenticator{keys: cfg.APIKeys}
+	if cfg.StoredKeys {
+		if err := client.EnableAPIKeys(context.Background()); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		auth.store = client
+		log.Println("✅ Accepting API keys stored in rule_api_keys")
+	}
+	if cfg.OIDC.Issuer != "" {
+		if auth.oidc, err = newOIDCVerifier(cfg.OIDC); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		log.Printf("✅ Accepting tokens from %s", cfg.OIDC.Issuer)
+	}
+	if !auth.enabled() {
+		log.Println("⚠️  RULE_API_KEYS is not set; the API is unauthenticated")
+	}
+	if cfg.OpsURL != "" {
+		// Consumer statistics live where the workers write them
+		opsDB, err := sql.Open("postgres", cfg.OpsURL)
+		if err != nil {
+			log.Fatalf("❌ Failed to open operational database: %v", err)
+		}
+		defer opsDB.Close()
+		client.SetOpsDB(opsDB)
+	}
+	if cfg.Rollouts {
+		if err := client.EnableRollouts(context.Background()); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		log.Println("✅ Applying rule version rollouts to evaluations")
+	}
+	if cfg.Windows {
+		if err := client.EnableWindows(context.Background()); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		log.Println("✅ Adding window aggregates to evaluation facts")
+	}
+	if cfg.Responses {
+		if err := client.EnableResponseFacts(context.Background()); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		log.Println("✅ Adding webhook response facts to evaluation facts")
+	}
+	if cfg.RuleStats {
+		if err := client.EnableRuleStats(context.Background(), ruleengine.RuleStatsOptions{}); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		defer client.Close()
+		log.Println("✅ Recording rule hit statistics")
+	}
+	if cfg.ResultCache > 0 {
+		if err := client.InstallChangeNotifications(context.Background()); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		if err := client.EnableCache(context.Background(), ruleengine.CacheOptions{
+			DatabaseURL:     cfg.DatabaseURL,
+			ResultCacheSize: cfg.ResultCache,
+			ResultTTL:       cfg.ResultCacheTTL,
+		}); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		defer client.Close()
+		log.Printf("✅ Caching up to %d evaluation results", cfg.ResultCache)
+	}
+	api := &server{client: client, tenants: &tenantClients{base: client}}
+	if cfg.GraphQL {
+		api.gql = api.graphQLSchema()
+		log.Println("✅ Serving GraphQL at /v1/graphql")
+	}
+	if cfg.Inbound {
+		if err := client.EnableInbound(context.Background()); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		api.inbound = true
+		log.Println("✅ Accepting signed webhooks at /inbound/{source}")
+	}
+	if cfg.Audit {
+		if err := client.InstallAuditLog(context.Background()); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+	}
+	if cfg.Tenancy {
+		if _, err := pq.NewConnector(cfg.DatabaseURL); err != nil {
+			log.Fatalf("❌ Invalid DATABASE_URL: %v", err)
+		}
+		if err := client.EnableTenancy(context.Background()); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		api.tenants.dsn = cfg.DatabaseURL
+		defer api.tenants.close()
+		log.Println("✅ Scoping callers with a tenant to their rules")
+	}
+	if cfg.Events {
+		if err := ensureEventTriggers(db); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+		if api.events, err = newEventHub(cfg.DatabaseURL); err != nil {
+			log.Printf("⚠️  Event stream disabled: %v", err)
+		} else {
+			log.Println("✅ Streaming events from LISTEN " + eventsChannel)
+		}
+	}
+	// Cancelled on shutdown so long-lived /v1/events streams end promptly
+	baseCtx, cancelStreams := context.WithCancel(context.Background())
+	if cfg.MatchViews {
+		if err := client.EnableMatchViews(context.Background()); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		api.matviews = client.NewMatchViewScheduler()
+		api.matviews.OnRefresh = func(view string, refresh *ruleengine.MatchViewRefresh, err error) {
+			if err != nil && view != "" {
+				log.Printf("⚠️  Match view %s: %v", view, err)
+			} else if err != nil {
+				log.Printf("⚠️  Match views: %v", err)
+			}
+		}
+		go api.matviews.Run(baseCtx)
+		log.Println("✅ Refreshing match views on their schedules")
+	}
+	httpServer := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           api.routes(auth),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+
+	go func() {
+		log.Printf("✅ Listening on %s", cfg.Addr)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("❌ Server failed: %v", err)
+		}
+	}()
+
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddr != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			log.Fatalf("❌ Failed to listen on %s: %v", cfg.GRPCAddr, err)
+		}
+		grpcServer = newGRPCServer(api.tenants, auth)
+		go func() {
+			log.Printf("✅ gRPC listening on %s", cfg.GRPCAddr)
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatalf("❌ gRPC server failed: %v", err)
+			}
+		}()
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
+
+	log.Println("\n🛑 Shutting down gracefully...")
+	cancelStreams()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("⚠️  Shutdown error: %v", err)
+	}
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+	log.Println("✅ Gateway stopped")
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("❌ %s: %v", key, err)
+	}
+	return n
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("❌ %s: %v", key, err)
+	}
+	return d
+}
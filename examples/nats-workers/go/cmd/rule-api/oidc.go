@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// With RULE_API_OIDC_ISSUER the gateway also accepts JWTs signed by that
+// OpenID Connect issuer, e.g. access tokens from the company SSO. Signing
+// keys come from the issuer's JWKS, found through its discovery document.
+// The token's subject is the audit actor; its roles come from a claim,
+// mapped with RULE_API_OIDC_ROLE_MAP.
+
+const (
+	// jwksRefreshInterval is how long signing keys are trusted before they
+	// are fetched again
+	jwksRefreshInterval = time.Hour
+
+	// jwksMinRefresh limits refetches for tokens with an unknown key id
+	jwksMinRefresh = time.Minute
+
+	// jwksFetchTimeout bounds one discovery and JWKS fetch
+	jwksFetchTimeout = 10 * time.Second
+
+	// tokenLeeway tolerates clock skew between the issuer and the gateway
+	tokenLeeway = time.Minute
+)
+
+// errInvalidToken is returned for tokens that fail verification
+var errInvalidToken = errors.New("invalid token")
+
+// oidcConfig holds the RULE_API_OIDC_* settings
+type oidcConfig struct {
+	Issuer       string
+	Audience     string
+	SubjectClaim string
+	RolesClaim   string
+	RoleMap      string
+	DefaultRole  string
+	TenantClaim  string
+}
+
+func loadOIDCConfig() oidcConfig {
+	return oidcConfig{
+		Issuer:       strings.TrimSuffix(os.Getenv("RULE_API_OIDC_ISSUER"), "/"),
+		Audience:     os.Getenv("RULE_API_OIDC_AUDIENCE"),
+		SubjectClaim: getEnv("RULE_API_OIDC_SUBJECT_CLAIM", "sub"),
+		RolesClaim:   getEnv("RULE_API_OIDC_ROLES_CLAIM", "roles"),
+		RoleMap:      os.Getenv("RULE_API_OIDC_ROLE_MAP"),
+		DefaultRole:  os.Getenv("RULE_API_OIDC_DEFAULT_ROLE"),
+		TenantClaim:  os.Getenv("RULE_API_OIDC_TENANT_CLAIM"),
+	}
+}
+
+// oidcVerifier checks JWTs from one issuer
+type oidcVerifier struct {
+	cfg          oidcConfig
+	roleMap      map[string][]string
+	defaultRoles []string
+	client       *http.Client
+	fetches      singleflight.Group
+
+	mu          sync.Mutex
+	jwksURI     string
+	keys        map[string]crypto.PublicKey // by key id
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	fetchErr    error
+}
+
+func newOIDCVerifier(cfg oidcConfig) (*oidcVerifier, error) {
+	if cfg.Audience == "" {
+		return nil, errors.New("RULE_API_OIDC_AUDIENCE is required with RULE_API_OIDC_ISSUER")
+	}
+	roleMap, err := parseRoleMap(cfg.RoleMap)
+	if err != nil {
+		return nil, fmt.Errorf("RULE_API_OIDC_ROLE_MAP: %w", err)
+	}
+	v := &oidcVerifier{cfg: cfg, roleMap: roleMap, client: &http.Client{Timeout: jwksFetchTimeout}}
+	if cfg.DefaultRole != "" {
+		if v.defaultRoles, err = parseRoles(cfg.DefaultRole); err != nil {
+			return nil, fmt.Errorf("RULE_API_OIDC_DEFAULT_ROLE: %w", err)
+		}
+	}
+	return v, nil
+}
+
+// looksLikeJWT tells tokens apart from API keys, which have no dots
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// verify returns the caller a token identifies. Tokens that fail
+// verification return errInvalidToken; other errors are failures to fetch
+// the issuer's keys.
+func (v *oidcVerifier) verify(ctx context.Context, token string) (*principal, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, errInvalidToken
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	name, _ := claimValue(claims, v.cfg.SubjectClaim).(string)
+	if name == "" {
+		return nil, errInvalidToken
+	}
+	p := &principal{Name: name, Roles: v.roles(claims)}
+	p.Tenant, _ = claimValue(claims, v.cfg.TenantClaim).(string)
+	return p, nil
+}
+
+func (v *oidcVerifier) checkClaims(claims map[string]interface{}) error {
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.cfg.Issuer {
+		return errInvalidToken
+	}
+	if !hasAudience(claims["aud"], v.cfg.Audience) {
+		return errInvalidToken
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(tokenLeeway)) {
+		return errInvalidToken
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(tokenLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errInvalidToken
+	}
+	return nil
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// roles maps the roles claim (a list, or a space-separated string like
+// "scope") through RULE_API_OIDC_ROLE_MAP. Values that are role names
+// count as that role.
+func (v *oidcVerifier) roles(claims map[string]interface{}) []string {
+	var values []string
+	switch claim := claimValue(claims, v.cfg.RolesClaim).(type) {
+	case string:
+		values = strings.Fields(claim)
+	case []interface{}:
+		for _, c := range claim {
+			if s, ok := c.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var roles []string
+	for _, value := range values {
+		if mapped, ok := v.roleMap[value]; ok {
+			roles = append(roles, mapped...)
+		} else if _, ok := roleAccess[value]; ok {
+			roles = append(roles, value)
+		}
+	}
+	if len(roles) == 0 {
+		return v.defaultRoles
+	}
+	return roles
+}
+
+// claimValue looks up a claim by a dotted path, e.g. realm_access.roles
+func claimValue(claims map[string]interface{}, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[name]
+	}
+	return value
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg %s", alg)
+	}
+	var h hash.Hash
+	var hashID crypto.Hash
+	switch alg[2:] {
+	case "256":
+		h, hashID = sha256.New(), crypto.SHA256
+	case "384":
+		h, hashID = sha512.New384(), crypto.SHA384
+	case "512":
+		h, hashID = sha512.New(), crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %s", alg)
+	}
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hashID, digest, sig)
+		case "PS":
+			return rsa.VerifyPSS(key, hashID, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		// ES256 is P-256 only, ES384 P-384, and ES512 P-521
+		curve := map[string]string{"256": "P-256", "384": "P-384", "512": "P-521"}[alg[2:]]
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] == "ES" && key.Curve.Params().Name == curve && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+			return errors.New("bad signature")
+		}
+	}
+	return fmt.Errorf("alg %s does not match the key", alg)
+}
+
+// key returns the signing key with id kid, fetching the issuer's JWKS when
+// it is stale or does not have the key yet
+func (v *oidcVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	fresh := ok && time.Since(v.fetchedAt) < jwksRefreshInterval
+	v.mu.Unlock()
+	if fresh {
+		return key, nil
+	}
+
+	// Concurrent callers share one fetch, which runs on its own deadline so
+	// a caller giving up does not cancel it for the rest. Callers arriving
+	// during a fetch wait for it; refresh skips fetches within
+	// jwksMinRefresh of the last.
+	fetched := v.fetches.DoChan("jwks", func() (interface{}, error) { return nil, v.refresh() })
+	select {
+	case <-fetched:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok = v.keys[kid]
+	switch {
+	case ok:
+		// Possibly stale; still used while the issuer is unreachable
+		return key, nil
+	case v.keys == nil && v.fetchErr != nil:
+		return nil, v.fetchErr
+	default:
+		return nil, errInvalidToken
+	}
+}
+
+// refresh fetches the issuer's keys, unless another caller just did
+func (v *oidcVerifier) refresh() error {
+	v.mu.Lock()
+	if time.Since(v.attemptedAt) < jwksMinRefresh {
+		v.mu.Unlock()
+		return nil
+	}
+	v.attemptedAt = time.Now()
+	jwksURI := v.jwksURI
+	v.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+	keys, jwksURI, err := v.fetchKeys(ctx, jwksURI)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.jwksURI, v.fetchErr = jwksURI, err
+	if err == nil {
+		v.keys, v.fetchedAt = keys, time.Now()
+	}
+	return err
+}
+
+// fetchKeys reads the signing keys from jwksURI, first finding it through
+// discovery when it is empty, and returns them with the JWKS URI
+func (v *oidcVerifier) fetchKeys(ctx context.Context, jwksURI string) (map[string]crypto.PublicKey, string, error) {
+	if jwksURI == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, v.cfg.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, "", fmt.Errorf("OIDC discovery failed: %w", err)
+		}
+		// A document for another issuer would trust its keys for ours
+		if strings.TrimSuffix(discovery.Issuer, "/") != v.cfg.Issuer {
+			return nil, "", fmt.Errorf("OIDC discovery document is for issuer %q, not %q", discovery.Issuer, v.cfg.Issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, "", errors.New("OIDC discovery document has no jwks_uri")
+		}
+		jwksURI = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := v.getJSON(ctx, jwksURI, &set); err != nil {
+		return nil, jwksURI, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if curve == nil || errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, jwksURI, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, jwksURI, nil
+}
+
+func (v *oidcVerifier) getJSON(ctx context.Context, url string, dest interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dest)
+}
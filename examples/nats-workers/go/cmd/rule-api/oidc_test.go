@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIssuer is an OIDC issuer serving discovery and a JWKS
+type testIssuer struct {
+	*httptest.Server
+	jwks      atomic.Value // []map[string]string
+	issuer    atomic.Value // string, the discovery document's issuer
+	fetches   atomic.Int32 // JWKS requests
+	discovery atomic.Int32
+	hold      chan struct{} // when set, JWKS requests wait on it
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	iss := &testIssuer{}
+	iss.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			iss.discovery.Add(1)
+			issuer, _ := iss.issuer.Load().(string)
+			if issuer == "" {
+				issuer = iss.URL
+			}
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": iss.URL + "/jwks"})
+		case "/jwks":
+			iss.fetches.Add(1)
+			if iss.hold != nil {
+				<-iss.hold
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": iss.jwks.Load()})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(iss.Close)
+	iss.jwks.Store([]map[string]string{})
+	return iss
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "use": "sig",
+		"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJWK(kid, crv string, key *ecdsa.PrivateKey) map[string]string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{"kty": "EC", "kid": kid, "crv": crv,
+		"x": b64(key.X.FillBytes(make([]byte, size))), "y": b64(key.Y.FillBytes(make([]byte, size)))}
+}
+
+// signToken returns a JWT with the given header alg and kid, signed by key
+func signToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+
+	var h hash.Hash
+	var hashID crypto.Hash
+	switch alg[2:] {
+	case "384":
+		h, hashID = sha512.New384(), crypto.SHA384
+	case "512":
+		h, hashID = sha512.New(), crypto.SHA512
+	default:
+		h, hashID = sha256.New(), crypto.SHA256
+	}
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			sig, err = rsa.SignPSS(rand.Reader, k, hashID, digest, nil)
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hashID, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func newTestVerifier(t *testing.T, iss *testIssuer, cfg oidcConfig) *oidcVerifier {
+	t.Helper()
+	cfg.Issuer = iss.URL
+	if cfg.Audience == "" {
+		cfg.Audience = "rule-api"
+	}
+	if cfg.SubjectClaim == "" {
+		cfg.SubjectClaim = "sub"
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+	v, err := newOIDCVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestNewOIDCVerifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     oidcConfig
+		wantErr string
+	}{
+		{name: "valid", cfg: oidcConfig{Issuer: "https://sso", Audience: "api", RoleMap: "sre=operator", DefaultRole: "viewer"}},
+		{name: "no audience", cfg: oidcConfig{Issuer: "https://sso"}, wantErr: "RULE_API_OIDC_AUDIENCE is required"},
+		{name: "bad role map", cfg: oidcConfig{Issuer: "https://sso", Audience: "api", RoleMap: "sre"}, wantErr: "RULE_API_OIDC_ROLE_MAP"},
+		{name: "bad default role", cfg: oidcConfig{Issuer: "https://sso", Audience: "api", DefaultRole: "root"}, wantErr: "RULE_API_OIDC_DEFAULT_ROLE"},
+	}
+	for _, tt := range tests {
+		_, err := newOIDCVerifier(tt.cfg)
+		if (tt.wantErr == "") != (err == nil) || err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	iss := newTestIssuer(t)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p521, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	otherRSA, _ := rsa.GenerateKey(rand.Reader, 2048)
+	iss.jwks.Store([]map[string]string{
+		rsaJWK("rsa", rsaKey), ecJWK("p256", "P-256", p256), ecJWK("p384", "P-384", p384), ecJWK("p521", "P-521", p521),
+		// Encryption keys are not used for signatures
+		func() map[string]string { k := rsaJWK("enc", otherRSA); k["use"] = "enc"; return k }(),
+	})
+	v := newTestVerifier(t, iss, oidcConfig{RoleMap: "rules-team=rule-author", TenantClaim: "org.tenant"})
+
+	now := time.Now()
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"iss": iss.URL, "aud": "rule-api", "sub": "alice", "exp": now.Add(time.Hour).Unix(),
+			"roles": []string{"rules-team"}, "org": map[string]string{"tenant": "acme"}}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	valid := &principal{Name: "alice", Roles: []string{"rule-author"}, Tenant: "acme"}
+
+	tests := []struct {
+		name  string
+		token string
+		want  *principal
+	}{
+		{name: "RS256", token: signToken(t, "RS256", "rsa", rsaKey, claims(nil)), want: valid},
+		{name: "RS512", token: signToken(t, "RS512", "rsa", rsaKey, claims(nil)), want: valid},
+		{name: "PS256", token: signToken(t, "PS256", "rsa", rsaKey, claims(nil)), want: valid},
+		{name: "ES256", token: signToken(t, "ES256", "p256", p256, claims(nil)), want: valid},
+		{name: "ES384", token: signToken(t, "ES384", "p384", p384, claims(nil)), want: valid},
+		{name: "ES512", token: signToken(t, "ES512", "p521", p521, claims(nil)), want: valid},
+		{name: "issuer with trailing slash", token: signToken(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) {
+			c["iss"] = iss.URL + "/"
+		})), want: valid},
+		{name: "audience in a list", token: signToken(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) {
+			c["aud"] = []string{"other", "rule-api"}
+		})), want: valid},
+		{name: "expired within leeway", token: signToken(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) {
+			c["exp"] = now.Add(-30 * time.Second).Unix()
+		})), want: valid},
+
+		// The curve must be the one the algorithm names
+		{name: "ES256 on P-384", token: signToken(t, "ES256", "p384", p384, claims(nil))},
+		{name: "ES384 on P-256", token: signToken(t, "ES384", "p256", p256, claims(nil))},
+		{name: "ES512 on P-384", token: signToken(t, "ES512", "p384", p384, claims(nil))},
+		{name: "RS256 with an EC key", token: signToken(t, "RS256", "p256", rsaKey, claims(nil))},
+		{name: "tampered signature", token: strings.TrimSuffix(signToken(t, "RS256", "rsa", rsaKey, claims(nil)), "x") + "x"},
+		{name: "signed by another key", token: signToken(t, "RS256", "rsa", otherRSA, claims(nil))},
+		{name: "encryption key", token: signToken(t, "RS256", "enc", otherRSA, claims(nil))},
+		{name: "unknown key id", token: signToken(t, "RS256", "gone", rsaKey, claims(nil))},
+		{name: "unsupported alg", token: signToken(t, "HS256", "rsa", rsaKey, claims(nil))},
+		{name: "other issuer", token: signToken(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example.com"
+		}))},
+		{name: "other audience", token: signToken(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) {
+			c["aud"] = "billing"
+		}))},
+		{name: "expired", token: signToken(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) {
+			c["exp"] = now.Add(-2 * time.Minute).Unix()
+		}))},
+		{name: "no exp", token: signToken(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { delete(c, "exp") }))},
+		{name: "not yet valid", token: signToken(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) {
+			c["nbf"] = now.Add(2 * time.Minute).Unix()
+		}))},
+		{name: "no subject", token: signToken(t, "RS256", "rsa", rsaKey, claims(func(c map[string]interface{}) { delete(c, "sub") }))},
+		{name: "bad header", token: "e30x.e30.c2ln"},
+		{name: "bad signature encoding", token: "eyJhbGciOiJSUzI1NiJ9.e30.!!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := v.verify(context.Background(), tt.token)
+			if tt.want == nil {
+				if !errors.Is(err, errInvalidToken) {
+					t.Fatalf("verify = %+v, %v; want an invalid token", p, err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(p, tt.want) {
+				t.Fatalf("verify = %+v, %v; want %+v", p, err, tt.want)
+			}
+		})
+	}
+	// Keys are fetched once; the unknown key id is not refetched within
+	// jwksMinRefresh
+	if iss.discovery.Load() != 1 || iss.fetches.Load() != 1 {
+		t.Fatalf("discovery %d, JWKS %d fetches", iss.discovery.Load(), iss.fetches.Load())
+	}
+}
+
+func TestOIDCRoles(t *testing.T) {
+	v := &oidcVerifier{
+		cfg:          oidcConfig{RolesClaim: "realm_access.roles"},
+		roleMap:      map[string][]string{"rules-team": {"rule-author"}, "sre": {"operator", "viewer"}},
+		defaultRoles: []string{"viewer"},
+	}
+	tests := []struct {
+		name   string
+		claims string
+		want   []string
+	}{
+		{name: "mapped", claims: `{"realm_access": {"roles": ["rules-team"]}}`, want: []string{"rule-author"}},
+		{name: "several", claims: `{"realm_access": {"roles": ["sre", "rules-team", "other"]}}`, want: []string{"operator", "viewer", "rule-author"}},
+		{name: "role names count", claims: `{"realm_access": {"roles": ["admin"]}}`, want: []string{"admin"}},
+		{name: "space separated", claims: `{"realm_access": {"roles": "sre  admin"}}`, want: []string{"operator", "viewer", "admin"}},
+		{name: "unmapped gets the default", claims: `{"realm_access": {"roles": ["marketing"]}}`, want: []string{"viewer"}},
+		{name: "missing claim", claims: `{}`, want: []string{"viewer"}},
+		{name: "not a list", claims: `{"realm_access": {"roles": 7}}`, want: []string{"viewer"}},
+	}
+	for _, tt := range tests {
+		var claims map[string]interface{}
+		json.Unmarshal([]byte(tt.claims), &claims)
+		if got := v.roles(claims); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: roles = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	v.defaultRoles = nil
+	if got := v.roles(map[string]interface{}{}); got != nil {
+		t.Errorf("without a default role: %v", got)
+	}
+}
+
+func TestClaimValue(t *testing.T) {
+	var claims map[string]interface{}
+	json.Unmarshal([]byte(`{"sub": "alice", "org": {"tenant": "acme", "team": {"name": "rules"}}, "email": 7}`), &claims)
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		{"sub", "alice"},
+		{"org.tenant", "acme"},
+		{"org.team.name", "rules"},
+		{"org.missing", nil},
+		{"sub.deeper", nil},
+		{"", nil},
+		{"email", float64(7)},
+	}
+	for _, tt := range tests {
+		if got := claimValue(claims, tt.path); got != tt.want {
+			t.Errorf("claimValue(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestHasAudience(t *testing.T) {
+	tests := []struct {
+		aud  interface{}
+		want bool
+	}{
+		{"rule-api", true},
+		{"rule-api-2", false},
+		{[]interface{}{"a", "rule-api"}, true},
+		{[]interface{}{"a", 7}, false},
+		{nil, false},
+		{7.0, false},
+	}
+	for _, tt := range tests {
+		if got := hasAudience(tt.aud, "rule-api"); got != tt.want {
+			t.Errorf("hasAudience(%v) = %v", tt.aud, got)
+		}
+	}
+}
+
+func TestLooksLikeJWT(t *testing.T) {
+	tests := map[string]bool{"a.b.c": true, "rek_abc_def": false, "a.b": false, "a.b.c.d": false, "": false}
+	for token, want := range tests {
+		if got := looksLikeJWT(token); got != want {
+			t.Errorf("looksLikeJWT(%q) = %v", token, got)
+		}
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	iss := newTestIssuer(t)
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	iss.jwks.Store([]map[string]string{rsaJWK("rsa", key)})
+	iss.issuer.Store("https://evil.example.com")
+	v := newTestVerifier(t, iss, oidcConfig{DefaultRole: "viewer"})
+
+	token := signToken(t, "RS256", "rsa", key, map[string]interface{}{"iss": iss.URL, "aud": "rule-api", "sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix()})
+	_, err := v.verify(context.Background(), token)
+	if err == nil || errors.Is(err, errInvalidToken) || !strings.Contains(err.Error(), `is for issuer "https://evil.example.com"`) {
+		t.Fatalf("err = %v", err)
+	}
+	if iss.fetches.Load() != 0 {
+		t.Fatal("fetched the JWKS of a mismatched discovery document")
+	}
+}
+
+func TestOIDCKeyRotationAndOutage(t *testing.T) {
+	iss := newTestIssuer(t)
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	iss.jwks.Store([]map[string]string{rsaJWK("old", oldKey)})
+	v := newTestVerifier(t, iss, oidcConfig{DefaultRole: "viewer"})
+	claims := map[string]interface{}{"iss": iss.URL, "aud": "rule-api", "sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+	expireAttempt := func() {
+		v.mu.Lock()
+		v.attemptedAt = time.Time{}
+		v.mu.Unlock()
+	}
+
+	if _, err := v.verify(context.Background(), signToken(t, "RS256", "old", oldKey, claims)); err != nil {
+		t.Fatal(err)
+	}
+	// The issuer rotates; a token with the new key id triggers a refetch
+	iss.jwks.Store([]map[string]string{rsaJWK("old", oldKey), rsaJWK("new", newKey)})
+	expireAttempt()
+	if _, err := v.verify(context.Background(), signToken(t, "RS256", "new", newKey, claims)); err != nil {
+		t.Fatal(err)
+	}
+	if iss.fetches.Load() != 2 {
+		t.Fatalf("JWKS fetched %d times", iss.fetches.Load())
+	}
+
+	// Stale keys keep working while the issuer is down
+	v.mu.Lock()
+	v.fetchedAt = time.Now().Add(-2 * jwksRefreshInterval)
+	v.mu.Unlock()
+	expireAttempt()
+	iss.Close()
+	if _, err := v.verify(context.Background(), signToken(t, "RS256", "new", newKey, claims)); err != nil {
+		t.Fatalf("stale key during an outage: %v", err)
+	}
+
+	// Without any keys an outage is an error, not an invalid token
+	down := newTestVerifier(t, iss, oidcConfig{DefaultRole: "viewer"})
+	_, err := down.verify(context.Background(), signToken(t, "RS256", "new", newKey, claims))
+	if err == nil || errors.Is(err, errInvalidToken) || !strings.Contains(err.Error(), "OIDC discovery failed") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestOIDCConcurrentFetch(t *testing.T) {
+	iss := newTestIssuer(t)
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	iss.jwks.Store([]map[string]string{rsaJWK("rsa", key)})
+	iss.hold = make(chan struct{})
+	v := newTestVerifier(t, iss, oidcConfig{DefaultRole: "viewer"})
+	token := signToken(t, "RS256", "rsa", key, map[string]interface{}{"iss": iss.URL, "aud": "rule-api", "sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix()})
+
+	// A caller that gives up does not cancel the fetch for the others
+	ctx, cancel := context.WithCancel(context.Background())
+	impatient := make(chan error, 1)
+	go func() {
+		_, err := v.verify(ctx, token)
+		impatient <- err
+	}()
+	for iss.fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := v.verify(context.Background(), token)
+			errs <- err
+		}()
+	}
+	// Other callers do not wait on the verifier's lock
+	done := make(chan struct{})
+	go func() {
+		v.mu.Lock()
+		v.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the fetch holds the verifier's lock")
+	}
+
+	cancel()
+	if err := <-impatient; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled caller: %v", err)
+	}
+	close(iss.hold)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := iss.fetches.Load(); n != 1 {
+		t.Fatalf("JWKS fetched %d times", n)
+	}
+}
+
+func TestAuthenticateOIDC(t *testing.T) {
+	iss := newTestIssuer(t)
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	iss.jwks.Store([]map[string]string{rsaJWK("rsa", key)})
+	auth := &authenticator{keys: []apiKey{{Name: "ci", Key: "static"}}, oidc: newTestVerifier(t, iss, oidcConfig{DefaultRole: "viewer"})}
+	claims := map[string]interface{}{"iss": iss.URL, "aud": "rule-api", "sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+
+	if p, err := auth.authenticate(context.Background(), signToken(t, "RS256", "rsa", key, claims)); err != nil || p.Name != "alice" {
+		t.Fatalf("token: %+v, %v", p, err)
+	}
+	claims["aud"] = "billing"
+	if p, err := auth.authenticate(context.Background(), signToken(t, "RS256", "rsa", key, claims)); p != nil || err != nil {
+		t.Fatalf("invalid token: %+v, %v", p, err)
+	}
+	if p, err := auth.authenticate(context.Background(), "static"); err != nil || p.Name != "ci" {
+		t.Fatalf("API key: %+v, %v", p, err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// params holds the {placeholders} matched from a route pattern
+type params map[string]string
+
+type handlerFunc func(w http.ResponseWriter, r *http.Request, p params) error
+
+type route struct {
+	method   string
+	segments []string
+	access   access
+	handler  handlerFunc
+}
+
+// router matches "METHOD /path/{param}" patterns in registration order.
+// Register literal paths before parameterized ones that could shadow them.
+type router struct {
+	routes []route
+}
+
+// handle registers h for callers whose roles grant a
+func (rt *router) handle(method, pattern string, a access, h handlerFunc) {
+	rt.routes = append(rt.routes, route{
+		method:   method,
+		segments: strings.Split(strings.Trim(pattern, "/"), "/"),
+		access:   a,
+		handler:  h,
+	})
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	pathMatched := false
+
+	for _, rte := range rt.routes {
+		p, ok := match(rte.segments, segments)
+		if !ok {
+			continue
+		}
+		pathMatched = true
+		if rte.method != r.Method {
+			continue
+		}
+		err := authorize(r.Context(), rte.access)
+		if _, ok := p["id"]; ok && err == nil {
+			// {id} is always a rule set. Rules are checked by their
+			// handlers, which look up the rule's rule sets.
+			var id int
+			if id, err = intParam(p, "id"); err == nil {
+				err = authorizeRuleSet(r.Context(), id)
+			}
+		}
+		if err == nil {
+			err = rte.handler(w, r, p)
+		}
+		if err != nil {
+			writeError(w, r, err)
+		}
+		return
+	}
+
+	if pathMatched {
+		writeJSON(w, http.StatusMethodNotAllowed, errorBody{Error: "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusNotFound, errorBody{Error: "not found"})
+}
+
+func match(pattern, path []string) (params, bool) {
+	if len(pattern) != len(path) {
+		return nil, false
+	}
+	p := params{}
+	for i, seg := range pattern {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if path[i] == "" {
+				return nil, false
+			}
+			p[seg[1:len(seg)-1]] = path[i]
+			continue
+		}
+		if seg != path[i] {
+			return nil, false
+		}
+	}
+	return p, true
+}
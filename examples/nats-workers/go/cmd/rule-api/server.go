@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/buildinfo"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// maxBodyBytes bounds request bodies; GRL documents are far smaller
+const maxBodyBytes = 4 << 20
+
+// server implements the REST API on top of the SDK
+type server struct {
+	client  *ruleengine.Client
+	tenants *tenantClients
+	events  *eventHub // nil when RULE_API_EVENTS=false
+
+	// matviews refreshes match views; nil when RULE_API_MATCH_VIEWS=false
+	matviews *ruleengine.MatchViewScheduler
+
+	// gql is the GraphQL schema; nil when RULE_API_GRAPHQL=false
+	gql *gqlSchema
+
+	// inbound accepts third-party webhooks at /inbound/{source}
+	inbound bool
+}
+
+// clientFor returns the SDK client for the caller's tenant
+func (s *server) clientFor(ctx context.Context) *ruleengine.Client {
+	return s.tenants.forContext(ctx)
+}
+
+// routes builds the handler tree. /healthz, /version, and /openapi.yaml are public,
+// and /inbound/ authenticates senders by their webhook signatures.
+// Everything under /v1 requires an API key when keys are configured, and
+// each route the access its roles must grant.
+func (s *server) routes(auth *authenticator) http.Handler {
+	api := &router{}
+
+	api.handle("POST", "/v1/rulesets/{id}/evaluate", accessRead, s.evaluate)
+
+	api.handle("GET", "/v1/rules", accessRead, s.listRules)
+	api.handle("POST", "/v1/rules", accessAuthor, s.createRule)
+	api.handle("POST", "/v1/rules/validate", accessRead, s.validateRule)
+	api.handle("POST", "/v1/rules/dry-run", accessRead, s.dryRun)
+	api.handle("GET", "/v1/rules/{name}", accessRead, s.getRule)
+	api.handle("PUT", "/v1/rules/{name}", accessAuthor, s.updateRule)
+	api.handle("DELETE", "/v1/rules/{name}", accessAuthor, s.deleteRule)
+	api.handle("POST", "/v1/rules/{name}/activate", accessAuthor, s.activateRule)
+	api.handle("POST", "/v1/rules/{name}/enable", accessOperate, s.enableRule)
+	api.handle("POST", "/v1/rules/{name}/disable", accessOperate, s.disableRule)
+
+	api.handle("GET", "/v1/rulesets", accessRead, s.listRuleSets)
+	api.handle("POST", "/v1/rulesets", accessAuthor, s.createRuleSet)
+	api.handle("GET", "/v1/rulesets/{id}", accessRead, s.getRuleSet)
+	api.handle("DELETE", "/v1/rulesets/{id}", accessAuthor, s.deleteRuleSet)
+	api.handle("POST", "/v1/rulesets/{id}/rules", accessAuthor, s.addRuleToSet)
+	api.handle("DELETE", "/v1/rulesets/{id}/rules/{rule}", accessAuthor, s.removeRuleFromSet)
+	api.handle("POST", "/v1/rulesets/{id}/enable", accessOperate, s.enableRuleSet)
+	api.handle("POST", "/v1/rulesets/{id}/disable", accessOperate, s.disableRuleSet)
+
+	api.handle("GET", "/v1/audit", accessRead, s.listAudit)
+	api.handle("GET", "/v1/deliveries", accessRead, s.listDeliveries)
+	api.handle("GET", "/v1/consumers/stats", accessRead, s.consumerStats)
+	api.handle("GET", "/v1/cache/stats", accessRead, s.cacheStats)
+	api.handle("GET", "/v1/match-views", accessRead, s.listMatchViews)
+	api.handle("POST", "/v1/match-views/{name}/refresh", accessOperate, s.refreshMatchView)
+	api.handle("GET", "/v1/events", accessRead, s.streamEvents)
+	if s.gql != nil {
+		api.handle("POST", "/v1/graphql", accessRead, s.graphql)
+		api.handle("GET", "/v1/graphql/schema", accessRead, s.graphqlSchemaSDL)
+	}
+	if s.inbound {
+		api.handle("GET", "/v1/inbound-sources", accessRead, s.listInboundSources)
+		api.handle("POST", "/v1/inbound-sources", accessAdmin, s.createInboundSource)
+		api.handle("DELETE", "/v1/inbound-sources/{name}", accessAdmin, s.deleteInboundSource)
+		api.handle("GET", "/v1/inbound-sources/{name}/events", accessRead, s.listInboundEvents)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/", requireAPIKey(auth, api))
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.Handle("/version", buildinfo.Handler(buildinfo.Read(version, commit, date)))
+	if s.inbound {
+		mux.HandleFunc("/inbound/", s.receiveInbound)
+	}
+	mux.HandleFunc("/openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPISpec)
+	})
+	return mux
+}
+
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	if err := s.client.DB().PingContext(r.Context()); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+	Field string `json:"field,omitempty"`
+}
+
+// badRequest is a client error detected by the gateway itself
+type badRequest struct {
+	msg string
+}
+
+func (e *badRequest) Error() string { return e.msg }
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError maps SDK errors to HTTP statuses. Unexpected errors are logged
+// and reported without detail, since they may contain SQL.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var (
+		bad        *badRequest
+		validation *ruleengine.ValidationError
+		conflict   *ruleengine.ConflictError
+		evaluation *ruleengine.EvaluationError
+		forbidden  *forbiddenError
+	)
+
+	switch {
+	case errors.As(err, &forbidden):
+		writeJSON(w, http.StatusForbidden, errorBody{Error: err.Error()})
+	case errors.As(err, &bad):
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: bad.msg})
+	case errors.As(err, &validation):
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: validation.Error(), Field: validation.Field})
+	case errors.Is(err, ruleengine.ErrRuleNotFound), errors.Is(err, ruleengine.ErrRuleSetNotFound),
+		errors.Is(err, ruleengine.ErrMatchViewNotFound), errors.Is(err, ruleengine.ErrInboundSourceNotFound):
+		writeJSON(w, http.StatusNotFound, errorBody{Error: err.Error()})
+	case errors.Is(err, ruleengine.ErrRuleExists), errors.As(err, &conflict):
+		writeJSON(w, http.StatusConflict, errorBody{Error: err.Error()})
+	case errors.As(err, &evaluation):
+		writeJSON(w, http.StatusUnprocessableEntity, errorBody{Error: err.Error()})
+	default:
+		logInternal(r.Method+" "+r.URL.Path, err)
+		writeJSON(w, http.StatusInternalServerError, errorBody{Error: "internal error"})
+	}
+}
+
+// decode reads a JSON request body into v, rejecting unknown fields
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return &badRequest{msg: fmt.Sprintf("invalid JSON body: %v", err)}
+	}
+	return nil
+}
+
+// intParam parses a numeric path parameter
+func intParam(p params, name string) (int, error) {
+	n, err := strconv.Atoi(p[name])
+	if err != nil || n <= 0 {
+		return 0, &badRequest{msg: fmt.Sprintf("invalid %s: %q", name, p[name])}
+	}
+	return n, nil
+}
+
+// intQuery parses an optional numeric query parameter
+func intQuery(r *http.Request, name string) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, &badRequest{msg: fmt.Sprintf("invalid %s: %q", name, raw)}
+	}
+	return n, nil
+}
+
+func timeQuery(r *http.Request, name string) (time.Time, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, &badRequest{msg: fmt.Sprintf("invalid %s: %q (want RFC 3339)", name, raw)}
+	}
+	return t, nil
+}
+
+func logInternal(where string, err error) {
+	log.Printf("❌ %s: %v", where, err)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// newTestServer returns the gateway's handler over a sqlmock database,
+// with the given static API keys
+func newTestServer(t *testing.T, keys ...apiKey) (http.Handler, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.MatchExpectationsInOrder(false)
+	t.Cleanup(func() { db.Close() })
+	client := ruleengine.New(db)
+	s := &server{client: client, tenants: &tenantClients{base: client}}
+	return s.routes(&authenticator{keys: keys}), mock
+}
+
+// do sends a request to h and returns the response
+func do(h http.Handler, method, path, key string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{&forbiddenError{name: "k", need: accessAdmin}, http.StatusForbidden},
+		{&badRequest{msg: "bad"}, http.StatusBadRequest},
+		{&ruleengine.ValidationError{Field: "name", Message: "x"}, http.StatusBadRequest},
+		{fmt.Errorf("A: %w", ruleengine.ErrRuleNotFound), http.StatusNotFound},
+		{fmt.Errorf("rule set 1: %w", ruleengine.ErrRuleSetNotFound), http.StatusNotFound},
+		{fmt.Errorf("hot: %w", ruleengine.ErrMatchViewNotFound), http.StatusNotFound},
+		{fmt.Errorf("A: %w", ruleengine.ErrRuleExists), http.StatusConflict},
+		{&ruleengine.ConflictError{Rule: "A"}, http.StatusConflict},
+		{&ruleengine.EvaluationError{Rule: "A", Err: errors.New("x")}, http.StatusUnprocessableEntity},
+		{errors.New(`pq: syntax error at or near "SELECT"`), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		writeError(rec, httptest.NewRequest("GET", "/v1/rules", nil), tt.err)
+		if rec.Code != tt.want {
+			t.Errorf("%T %v: status %d, want %d", tt.err, tt.err, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusInternalServerError && bytes.Contains(rec.Body.Bytes(), []byte("SELECT")) {
+			t.Errorf("internal error leaked: %s", rec.Body)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	h, mock := newTestServer(t)
+	now := time.Now()
+	mock.ExpectQuery(`FROM rule_definitions rd`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "is_active", "version", "grl", "created_at", "updated_at", "updated_by"}).
+			AddRow(1, "A", "", true, "1.0.0", "rule A", now, now, ""))
+
+	tests := []struct {
+		method, path string
+		body         interface{}
+		want         int
+	}{
+		{"GET", "/v1/rules", nil, http.StatusOK},
+		{"PATCH", "/v1/rules", nil, http.StatusMethodNotAllowed},
+		{"GET", "/v1/nothing-here", nil, http.StatusNotFound},
+		{"GET", "/v1/rulesets/abc", nil, http.StatusBadRequest},
+		{"POST", "/v1/rulesets/1/evaluate", map[string]interface{}{"trace": true}, http.StatusBadRequest},
+		{"POST", "/v1/rulesets/1/evaluate", map[string]interface{}{"facts": map[string]interface{}{}, "unknown": 1}, http.StatusBadRequest},
+		{"POST", "/v1/rules", map[string]interface{}{"name": "bad name", "grl": "rule"}, http.StatusBadRequest},
+		{"GET", "/v1/audit?since=yesterday", nil, http.StatusBadRequest},
+		{"GET", "/v1/audit?limit=many", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := do(h, tt.method, tt.path, "", tt.body)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d (%s)", tt.method, tt.path, rec.Code, tt.want, rec.Body)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchViewRoutes(t *testing.T) {
+	h, mock := newTestServer(t)
+	columns := []string{"name", "ruleset_id", "source", "key_column", "facts_column", "updated_column",
+		"full", "incremental", "watermark", "last_full_at", "last_refresh_at", "last_refresh_ms", "last_rows",
+		"staleness", "created_at"}
+	mock.ExpectQuery(`FROM rule_match_views ORDER BY name`).WillReturnRows(sqlmock.NewRows(columns))
+	rec := do(h, "GET", "/v1/match-views", "", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"views":[]`) ||
+		strings.Contains(rec.Body.String(), "scheduler") {
+		t.Fatalf("list: %d %s", rec.Code, rec.Body)
+	}
+
+	mock.ExpectQuery(`FROM rule_match_views WHERE name`).WithArgs("gone").WillReturnRows(sqlmock.NewRows(columns))
+	if rec := do(h, "POST", "/v1/match-views/gone/refresh", "", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("refresh unknown view: %d %s", rec.Code, rec.Body)
+	}
+
+	mock.ExpectQuery(`FROM rule_match_views WHERE name`).WithArgs("hot").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("hot", 3, "orders", "id", "", "", 0.0, 0.0,
+			nil, nil, nil, int64(0), int64(0), 1.0, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(`pg_advisory_xact_lock`).WithArgs("hot").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`rule_match_view_refresh`).WithArgs("hot", true).
+		WillReturnRows(sqlmock.NewRows([]string{"rows"}).AddRow(7))
+	mock.ExpectQuery(`last_full_at = last_refresh_at`).WillReturnRows(sqlmock.NewRows([]string{"full"}).AddRow(true))
+	mock.ExpectCommit()
+	rec = do(h, "POST", "/v1/match-views/hot/refresh?full=true", "", nil)
+	var refresh ruleengine.MatchViewRefresh
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &refresh) != nil || refresh.Rows != 7 || !refresh.Full {
+		t.Fatalf("refresh: %d %s", rec.Code, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublicEndpoints(t *testing.T) {
+	h, _ := newTestServer(t, apiKey{Name: "ci", Key: "secret"})
+	for _, path := range []string{"/openapi.yaml", "/version"} {
+		if rec := do(h, "GET", path, "", nil); rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d without a key", path, rec.Code)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          params
+	}{
+		{"v1/rules", "v1/rules", params{}},
+		{"v1/rules/{name}", "v1/rules/HighValue", params{"name": "HighValue"}},
+		{"v1/rulesets/{id}/rules/{rule}", "v1/rulesets/3/rules/A", params{"id": "3", "rule": "A"}},
+		{"v1/rules/{name}", "v1/rules/", nil},
+		{"v1/rules/{name}", "v1/rules/A/enable", nil},
+		{"v1/rules", "v1/rulesets", nil},
+	}
+	for _, tt := range tests {
+		got, ok := match(strings.Split(tt.pattern, "/"), strings.Split(tt.path, "/"))
+		if ok != (tt.want != nil) {
+			t.Errorf("match(%s, %s) ok = %v", tt.pattern, tt.path, ok)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) && tt.want != nil {
+			t.Errorf("match(%s, %s) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
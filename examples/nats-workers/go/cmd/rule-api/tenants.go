@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/lib/pq"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// tenantMaxConns bounds each tenant's connection pool
+const tenantMaxConns = 4
+
+// tenantClients hands out SDK clients whose connections are bound to the
+// caller's tenant (RULE_API_TENANCY), so Postgres row-level security keeps
+// tenants apart. Callers without a tenant use the shared client.
+type tenantClients struct {
+	base *ruleengine.Client
+	dsn  string // empty when tenancy is off
+
+	mu      sync.Mutex
+	clients map[string]*ruleengine.Client
+}
+
+// forContext returns the client for the tenant of the caller in ctx
+func (t *tenantClients) forContext(ctx context.Context) *ruleengine.Client {
+	p, ok := ctx.Value(principalKey{}).(*principal)
+	if t.dsn == "" || !ok || p.Tenant == "" {
+		return t.base
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if client, ok := t.clients[p.Tenant]; ok {
+		return client
+	}
+	// The DSN was checked on startup
+	connector, _ := pq.NewConnector(t.dsn)
+	db := sql.OpenDB(ruleengine.TenantConnector(connector, p.Tenant))
+	db.SetMaxOpenConns(tenantMaxConns)
+	db.SetMaxIdleConns(1)
+	if t.clients == nil {
+		t.clients = map[string]*ruleengine.Client{}
+	}
+	client := t.base.WithDB(db)
+	t.clients[p.Tenant] = client
+	return client
+}
+
+// close closes the tenants' connection pools
+func (t *tenantClients) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, client := range t.clients {
+		client.DB().Close()
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func TestTenantClients(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	base := ruleengine.New(db)
+	tenant := func(name string) context.Context {
+		return withPrincipal(context.Background(), &principal{Name: "k", Tenant: name})
+	}
+
+	off := &tenantClients{base: base}
+	if off.forContext(tenant("acme")) != base {
+		t.Fatal("tenancy off: not the shared client")
+	}
+
+	// Pools are opened lazily, so no database is needed
+	on := &tenantClients{base: base, dsn: "postgres://rules@127.0.0.1:1/rules?sslmode=disable"}
+	defer on.close()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		base bool
+	}{
+		{name: "unauthenticated", ctx: context.Background(), base: true},
+		{name: "no tenant", ctx: tenant(""), base: true},
+		{name: "tenant", ctx: tenant("acme")},
+	}
+	for _, tt := range tests {
+		if got := on.forContext(tt.ctx); (got == base) != tt.base {
+			t.Errorf("%s: shared client %v, want %v", tt.name, got == base, tt.base)
+		}
+	}
+
+	acme, globex := on.forContext(tenant("acme")), on.forContext(tenant("globex"))
+	if acme == globex || acme.DB() == globex.DB() || on.forContext(tenant("acme")) != acme {
+		t.Fatal("tenants do not get one client each")
+	}
+	if n := acme.DB().Stats().MaxOpenConnections; n != tenantMaxConns {
+		t.Fatalf("tenant pool allows %d connections", n)
+	}
+
+	on.close()
+	if err := acme.DB().Ping(); err == nil || err.Error() != "sql: database is closed" {
+		t.Fatalf("tenant pool not closed: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// destinationSecretsIndex indexes WebhookDestinations by the Secrets they
+// read, so a changed Secret is applied to its webhooks at once
+const destinationSecretsIndex = "spec.secretRefs"
+
+// webhookDestination is a registered webhook (rule_webhooks row) the
+// operator keeps in step with its spec
+type webhookDestination struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   webhookDestinationSpec   `json:"spec"`
+	Status webhookDestinationStatus `json:"status"`
+}
+
+type webhookDestinationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []webhookDestination `json:"items"`
+}
+
+func (d *webhookDestination) DeepCopyObject() runtime.Object     { return deepCopy(d) }
+func (l *webhookDestinationList) DeepCopyObject() runtime.Object { return deepCopy(l) }
+
+type webhookDestinationSpec struct {
+	// Name is the webhook_name messages use; metadata.name when empty. It
+	// must be unique across the namespaces the operator watches.
+	Name string `json:"name,omitempty"`
+	// URL, or URLFrom for one carrying a token
+	URL         string            `json:"url,omitempty"`
+	URLFrom     *secretKeyRef     `json:"urlFrom,omitempty"`
+	Method      string            `json:"method,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	HeadersFrom []headerFrom      `json:"headersFrom,omitempty"`
+	Description string            `json:"description,omitempty"`
+	TimeoutMs   int               `json:"timeoutMs,omitempty"`
+	MaxRetries  *int              `json:"maxRetries,omitempty"`
+	Enabled     *bool             `json:"enabled,omitempty"` // true when unset
+	Tags        []string          `json:"tags,omitempty"`
+	// DeletionPolicy Delete (the default) deletes the webhook when the
+	// resource is deleted; Retain keeps it
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+}
+
+// headerFrom is a header whose value is read from a Secret
+type headerFrom struct {
+	Header       string       `json:"header"`
+	SecretKeyRef secretKeyRef `json:"secretKeyRef"`
+}
+
+type webhookDestinationStatus struct {
+	status    `json:",inline"`
+	WebhookID int `json:"webhookID"`
+}
+
+// webhookName is the rule_webhooks row the resource manages
+func (d *webhookDestination) webhookName() string {
+	if d.Spec.Name != "" {
+		return d.Spec.Name
+	}
+	return d.Name
+}
+
+// indexDestinationSecrets is destinationSecretsIndex's value: the Secrets
+// the spec reads
+func indexDestinationSecrets(obj client.Object) []string {
+	d := obj.(*webhookDestination)
+	var names []string
+	if ref := d.Spec.URLFrom; ref != nil {
+		names = append(names, ref.Name)
+	}
+	for _, h := range d.Spec.HeadersFrom {
+		names = append(names, h.SecretKeyRef.Name)
+	}
+	return names
+}
+
+// secretDestinations maps a Secret to the WebhookDestinations reading it
+func (o *operator) secretDestinations(ctx context.Context, secret client.Object) []reconcile.Request {
+	var list webhookDestinationList
+	err := o.List(ctx, &list, client.InNamespace(secret.GetNamespace()),
+		client.MatchingFields{destinationSecretsIndex: secret.GetName()})
+	if err != nil {
+		log.Printf("⚠️  Failed to list WebhookDestinations reading Secret %s/%s: %v", secret.GetNamespace(), secret.GetName(), err)
+		return nil
+	}
+	requests := make([]reconcile.Request, len(list.Items))
+	for i, d := range list.Items {
+		requests[i].NamespacedName = types.NamespacedName{Namespace: d.Namespace, Name: d.Name}
+	}
+	return requests
+}
+
+// reconcileWebhookDestination syncs a WebhookDestination into
+// rule_webhooks. It runs again each RECONCILE_INTERVAL, since the row can
+// change outside Kubernetes.
+func (o *operator) reconcileWebhookDestination(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var d webhookDestination
+	if err := o.Get(ctx, req.NamespacedName, &d); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	policy := d.Spec.DeletionPolicy
+	if policy == "" {
+		policy = deletionDelete
+	}
+	deleting, err := o.finalize(ctx, &d, policy, func() error {
+		err := o.rules.DeleteDestination(ctx, d.webhookName())
+		if err == nil {
+			log.Printf("🗑️  Deleted webhook %s", d.webhookName())
+		}
+		if errors.Is(err, ruleengine.ErrWebhookNotFound) {
+			return nil
+		}
+		return err
+	})
+	if deleting || err != nil {
+		return ctrl.Result{}, err
+	}
+	base := d.DeepCopyObject().(*webhookDestination)
+	err = o.reconcileDestination(ctx, &d)
+	report(webhookDestinationKind, &d, &d.Status.status, phaseReady, err)
+	if d.Status != base.Status {
+		if err := o.setStatus(ctx, &d, base); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: o.interval}, nil
+}
+
+// reconcileDestination resolves the spec's Secrets and applies the
+// webhook. Secret values end up in rule_webhooks, where the workers read
+// them.
+func (o *operator) reconcileDestination(ctx context.Context, d *webhookDestination) error {
+	dest := ruleengine.Destination{
+		Name:        d.webhookName(),
+		URL:         d.Spec.URL,
+		Method:      d.Spec.Method,
+		Headers:     map[string]string{},
+		Description: d.Spec.Description,
+		TimeoutMs:   d.Spec.TimeoutMs,
+		MaxRetries:  d.Spec.MaxRetries,
+		Enabled:     d.Spec.Enabled == nil || *d.Spec.Enabled,
+		Tags:        d.Spec.Tags,
+	}
+	if ref := d.Spec.URLFrom; ref != nil {
+		url, err := o.secretValue(ctx, d.Namespace, *ref)
+		if err != nil {
+			return err
+		}
+		dest.URL = url
+	}
+	for name, value := range d.Spec.Headers {
+		dest.Headers[name] = value
+	}
+	for _, h := range d.Spec.HeadersFrom {
+		value, err := o.secretValue(ctx, d.Namespace, h.SecretKeyRef)
+		if err != nil {
+			return err
+		}
+		dest.Headers[h.Header] = value
+	}
+
+	id, outcome, err := o.rules.ApplyDestination(ctx, dest)
+	if err != nil {
+		return err
+	}
+	if outcome != "unchanged" {
+		log.Printf("🔗 Webhook %s %s (id %d)", dest.Name, outcome, id)
+	}
+	d.Status.WebhookID = id
+	return nil
+}
+
+// secretValue returns one key of a Secret in namespace. It is read from
+// the API server: the operator only caches Secrets' metadata.
+func (o *operator) secretValue(ctx context.Context, namespace string, ref secretKeyRef) (string, error) {
+	var secret corev1.Secret
+	if err := o.secrets.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, &secret); err != nil {
+		return "", fmt.Errorf("secret %s: %w", ref.Name, err)
+	}
+	value, ok := secret.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %s", ref.Name, ref.Key)
+	}
+	return string(value), nil
+}
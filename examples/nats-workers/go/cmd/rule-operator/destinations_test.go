@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+const applyWebhook = `INSERT INTO rule_webhooks \(webhook_name, url, method, headers, description, timeout_ms, max_retries, enabled, tags\)`
+
+// useRules gives o a ruleengine client on sqlmock
+func useRules(t *testing.T, o *operator) sqlmock.Sqlmock {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	o.rules = ruleengine.New(db)
+	return mock
+}
+
+func TestReconcileWebhookDestination(t *testing.T) {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "crm"},
+		Data: map[string][]byte{"url": []byte("https://crm.example.com/hook?token=s3cret"), "auth": []byte("Bearer t0ken")}}
+	tests := []struct {
+		name      string
+		spec      webhookDestinationSpec
+		wantURL   string
+		wantHdrs  string
+		wantPhase string
+		wantErr   string
+		wantID    int
+	}{
+		{name: "inline", spec: webhookDestinationSpec{URL: "https://crm.example.com/hook", Headers: map[string]string{"X-Team": "sales"}},
+			wantURL: "https://crm.example.com/hook", wantHdrs: `{"X-Team":"sales"}`, wantPhase: phaseReady, wantID: 7},
+		{name: "from secrets", spec: webhookDestinationSpec{Name: "crm-hook", URLFrom: &secretKeyRef{Name: "crm", Key: "url"},
+			HeadersFrom: []headerFrom{{Header: "Authorization", SecretKeyRef: secretKeyRef{Name: "crm", Key: "auth"}}}},
+			wantURL: "https://crm.example.com/hook?token=s3cret", wantHdrs: `{"Authorization":"Bearer t0ken"}`, wantPhase: phaseReady, wantID: 7},
+		{name: "missing key", spec: webhookDestinationSpec{URLFrom: &secretKeyRef{Name: "crm", Key: "missing"}},
+			wantPhase: phaseError, wantErr: "secret crm has no key missing"},
+		{name: "missing secret", spec: webhookDestinationSpec{URLFrom: &secretKeyRef{Name: "gone", Key: "url"}},
+			wantPhase: phaseError, wantErr: "secret gone"},
+		{name: "invalid", spec: webhookDestinationSpec{URL: "ftp://crm.example.com"}, wantPhase: phaseError, wantErr: "url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, _ := newTestOperator(t, secret.DeepCopy(), &webhookDestination{ObjectMeta: objectMeta("crm"), Spec: tt.spec})
+			mock := useRules(t, o)
+			if tt.wantURL != "" {
+				name := tt.spec.Name
+				if name == "" {
+					name = "crm"
+				}
+				mock.ExpectQuery(applyWebhook).
+					WithArgs(name, tt.wantURL, "POST", tt.wantHdrs, "", 5000, 3, true, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"webhook_id", "created"}).AddRow(tt.wantID, true))
+			}
+			reconcileOnce(t, o.reconcileWebhookDestination, "crm")
+
+			var d webhookDestination
+			if err := o.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "crm"}, &d); err != nil {
+				t.Fatal(err)
+			}
+			if d.Status.Phase != tt.wantPhase || !strings.Contains(d.Status.Message, tt.wantErr) || d.Status.WebhookID != tt.wantID {
+				t.Fatalf("status = %+v, want %s %q", d.Status, tt.wantPhase, tt.wantErr)
+			}
+			// Deleted with the resource by default
+			if !reflect.DeepEqual(d.Finalizers, []string{finalizer}) {
+				t.Fatalf("finalizers = %v", d.Finalizers)
+			}
+		})
+	}
+}
+
+func TestDeleteWebhookDestination(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		deleted int64 // rows
+	}{
+		{name: "deleted", deleted: 1},
+		{name: "already gone"},
+		{name: "retained", policy: deletionRetain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &webhookDestination{ObjectMeta: objectMeta("crm"), Spec: webhookDestinationSpec{URL: "https://crm.example.com", DeletionPolicy: tt.policy}}
+			o, _ := newTestOperator(t, d)
+			mock := useRules(t, o)
+			mock.ExpectQuery(applyWebhook).WillReturnRows(sqlmock.NewRows([]string{"webhook_id", "created"}).AddRow(7, true))
+			reconcileOnce(t, o.reconcileWebhookDestination, "crm")
+
+			if tt.policy != deletionRetain {
+				mock.ExpectExec(`DELETE FROM rule_webhooks WHERE webhook_name = \$1`).WithArgs("crm").
+					WillReturnResult(sqlmock.NewResult(0, tt.deleted))
+			}
+			if err := o.Delete(context.Background(), d); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := o.reconcileWebhookDestination(context.Background(), reqFor(d)); err != nil {
+				t.Fatal(err)
+			}
+			if err := o.Get(context.Background(), client.ObjectKeyFromObject(d), &webhookDestination{}); err == nil {
+				t.Fatal("WebhookDestination still there")
+			}
+		})
+	}
+}
+
+func TestSecretDestinations(t *testing.T) {
+	o, _ := newTestOperator(t,
+		&webhookDestination{ObjectMeta: objectMeta("url"), Spec: webhookDestinationSpec{URLFrom: &secretKeyRef{Name: "crm", Key: "url"}}},
+		&webhookDestination{ObjectMeta: objectMeta("header"), Spec: webhookDestinationSpec{HeadersFrom: []headerFrom{{Header: "Authorization", SecretKeyRef: secretKeyRef{Name: "crm", Key: "auth"}}}}},
+		&webhookDestination{ObjectMeta: objectMeta("inline"), Spec: webhookDestinationSpec{URL: "https://crm.example.com"}},
+		&webhookDestination{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "url"},
+			Spec: webhookDestinationSpec{URLFrom: &secretKeyRef{Name: "crm", Key: "url"}}},
+	)
+	tests := []struct {
+		name   string
+		secret client.Object
+		want   []string
+	}{
+		{name: "read", secret: &metav1.PartialObjectMetadata{ObjectMeta: objectMeta("crm")}, want: []string{"rules/header", "rules/url"}},
+		{name: "other namespace", secret: &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "crm"}},
+			want: []string{"other/url"}},
+		{name: "unread", secret: &metav1.PartialObjectMetadata{ObjectMeta: objectMeta("billing")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestNames(o.secretDestinations(context.Background(), tt.secret)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("requests = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
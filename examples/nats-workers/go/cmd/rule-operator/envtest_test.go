@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+// startEnvtest runs the manager against a real API server with the CRDs
+// from deploy/kubernetes. It needs the etcd and kube-apiserver binaries in
+// KUBEBUILDER_ASSETS, e.g. from setup-envtest use -p path.
+func startEnvtest(t *testing.T) *operator {
+	t.Helper()
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("KUBEBUILDER_ASSETS not set")
+	}
+	env := &envtest.Environment{
+		CRDDirectoryPaths:     []string{filepath.Join("..", "..", "deploy", "kubernetes", "crds.yaml")},
+		ErrorIfCRDPathMissing: true,
+	}
+	cfg, err := env.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { env.Stop() })
+
+	mgr, err := newManager(cfg, "", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The NATS and client parts of a test operator, on the real API server
+	o, _ := newTestOperator(t)
+	o.Client, o.secrets, o.interval = mgr.GetClient(), mgr.GetAPIReader(), time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := o.setupWithManager(ctx, mgr); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- mgr.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}}
+	if err := o.Create(ctx, ns); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// eventually fails the test if cond does not hold within 10s
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestEnvtestFinalizers(t *testing.T) {
+	o := startEnvtest(t)
+	ctx := context.Background()
+	tests := []struct {
+		name          string
+		policy        string
+		wantFinalizer bool
+	}{
+		{name: "delete", policy: deletionDelete, wantFinalizer: true},
+		{name: "retain", policy: deletionRetain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := "stream-" + tt.name
+			s := &ruleStream{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+				Spec: ruleStreamSpec{Subjects: []string{name + ".>"}, DeletionPolicy: tt.policy}}
+			if err := o.Create(ctx, s); err != nil {
+				t.Fatal(err)
+			}
+			eventually(t, "the stream to be ready", func() bool {
+				var got ruleStream
+				return o.Get(ctx, client.ObjectKeyFromObject(s), &got) == nil && got.Status.Phase == phaseReady &&
+					controllerutil.ContainsFinalizer(&got, finalizer) == tt.wantFinalizer
+			})
+
+			if err := o.Delete(ctx, s); err != nil {
+				t.Fatal(err)
+			}
+			eventually(t, "the RuleStream to be deleted", func() bool {
+				return apierrors.IsNotFound(o.Get(ctx, client.ObjectKeyFromObject(s), &ruleStream{}))
+			})
+			// The finalizer held it back until the stream was gone
+			if _, err := o.js.StreamInfo(name); (err == nil) == tt.wantFinalizer {
+				t.Fatalf("stream info: %v", err)
+			}
+		})
+	}
+}
+
+func TestEnvtestOwnerReferences(t *testing.T) {
+	o := startEnvtest(t)
+	ctx := context.Background()
+	stream := &ruleStream{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "webhooks"},
+		Spec: ruleStreamSpec{Name: "WEBHOOKS", Subjects: []string{"webhooks.>"}}}
+	w := &ruleWorker{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "workers"},
+		Spec: ruleWorkerSpec{Stream: "webhooks", DatabaseURL: secretKeyRef{Name: "rules-db", Key: "url"}}}
+	for _, obj := range []client.Object{stream, w} {
+		if err := o.Create(ctx, obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var d appsv1.Deployment
+	eventually(t, "the Deployment", func() bool {
+		return o.Get(ctx, client.ObjectKeyFromObject(w), &d) == nil
+	})
+	if err := o.Get(ctx, client.ObjectKeyFromObject(w), w); err != nil {
+		t.Fatal(err)
+	}
+	ref := metav1.GetControllerOf(&d)
+	if ref == nil || ref.UID != w.UID || ref.Kind != ruleWorkerKind || ref.BlockOwnerDeletion == nil || !*ref.BlockOwnerDeletion {
+		t.Fatalf("controller = %+v, want RuleWorker %s", ref, w.UID)
+	}
+
+	// Owned: scaling the Deployment away from the spec is undone
+	d.Spec.Replicas = ptr(int32(5))
+	if err := o.Update(ctx, &d); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the replicas to be restored", func() bool {
+		return o.Get(ctx, client.ObjectKeyFromObject(w), &d) == nil && d.Spec.Replicas != nil && *d.Spec.Replicas == 1
+	})
+
+	// Watched: a new subject on the stream reaches the workers' consumer
+	if err := o.Get(ctx, client.ObjectKeyFromObject(stream), stream); err != nil {
+		t.Fatal(err)
+	}
+	base := stream.DeepCopyObject().(client.Object)
+	stream.Spec.Subjects = []string{"events.>", "webhooks.>"}
+	if err := o.Patch(ctx, stream, client.MergeFrom(base)); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the consumer's filter subject", func() bool {
+		info, err := o.js.ConsumerInfo("WEBHOOKS", "workers")
+		return err == nil && info.Config.FilterSubject == "events.>"
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// fieldManager names the operator in server-side apply
+const fieldManager = "rule-operator"
+
+// apply creates or updates obj with server-side apply, controlled by owner
+// so it is deleted with it. The operator owns the fields it sets, taking
+// them over from anyone else. It returns the object the server holds.
+func (o *operator) apply(ctx context.Context, owner client.Object, obj map[string]interface{}) (*unstructured.Unstructured, error) {
+	// Through JSON, since unstructured objects only hold JSON's types
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	if err := controllerutil.SetControllerReference(owner, u, o.Scheme()); err != nil {
+		return nil, err
+	}
+	err = o.Apply(ctx, client.ApplyConfigurationFromUnstructured(u), client.FieldOwner(fieldManager), client.ForceOwnership)
+	return u, err
+}
+
+// remove deletes the object, letting the garbage collector remove what it
+// owns. An object already gone, or of a kind the cluster does not have,
+// is not an error.
+func (o *operator) remove(ctx context.Context, apiVersion, kind, namespace, name string) error {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(apiVersion)
+	u.SetKind(kind)
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	err := o.Delete(ctx, u, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if apierrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,241 @@
+// Command rule-operator manages webhook workers on Kubernetes from three
+// custom resources (see deploy/kubernetes):
+//
+//   - RuleStream: a JetStream stream, created and kept in step with its spec
+//   - RuleWorker: a worker Deployment and the durable consumer it binds to,
+//     optionally autoscaled on the consumer's backlog by KEDA
+//   - WebhookDestination: a registered webhook in rule_webhooks, with
+//     headers and URLs read from Secrets
+//
+// It is a controller-runtime manager: a resource is reconciled when it,
+// its Deployment, its RuleStream, or a Secret it reads changes, and again
+// each RECONCILE_INTERVAL for what changes outside Kubernetes. The outcome
+// is reported in its status. With SCALER_ADDR set it also serves a KEDA
+// external scaler on SCALER_ADDR reporting consumers' backlog.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr/funcr"
+	_ "github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/rule-engine/nats-webhook-worker/api/externalscaler"
+	"github.com/rule-engine/nats-webhook-worker/buildinfo"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// version, commit, and date describe the build; cmd/release sets them
+// with -ldflags "-X main.version=v1.2.3 -X main.commit=… -X main.date=…"
+var (
+	version = "dev"
+	commit  string
+	date    string
+)
+
+// operator reconciles the custom resources against NATS, PostgreSQL, and
+// the Kubernetes API
+type operator struct {
+	client.Client
+	// secrets reads Secrets from the API server: only their metadata is
+	// cached, for the watch
+	secrets client.Reader
+	js      nats.JetStreamContext
+	rules   *ruleengine.Client
+
+	natsURL     string
+	workerImage string
+	// scalerAddress is where KEDA reaches the external scaler, set in the
+	// ScaledObjects of autoscaled RuleWorkers
+	scalerAddress string
+	// interval is how often a resource is reconciled again for changes
+	// outside Kubernetes
+	interval time.Duration
+}
+
+func main() {
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println("rule-operator", buildinfo.Read(version, commit, date))
+		return
+	}
+
+	log.Printf("🚀 Starting rule-operator %s...", buildinfo.Read(version, commit, date))
+	// controller-runtime logs its errors through the standard logger
+	ctrl.SetLogger(funcr.New(func(prefix, args string) { log.Println(prefix, args) }, funcr.Options{}))
+	interval, err := time.ParseDuration(getEnv("RECONCILE_INTERVAL", "30s"))
+	if err != nil || interval <= 0 {
+		log.Fatalf("❌ RECONCILE_INTERVAL must be a positive duration, got %q", os.Getenv("RECONCILE_INTERVAL"))
+	}
+	natsURL := getEnv("NATS_URL", nats.DefaultURL)
+
+	// KUBECONFIG outside a cluster, the pod's service account inside
+	cfg, err := ctrl.GetConfig()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	namespace := os.Getenv("WATCH_NAMESPACE")
+	mgr, err := newManager(cfg, namespace, getEnv("METRICS_ADDR", "0"))
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	opts := []nats.Option{nats.Name("Rule Engine Operator"), nats.MaxReconnects(-1)}
+	if user := os.Getenv("NATS_USER"); user != "" {
+		opts = append(opts, nats.UserInfo(user, os.Getenv("NATS_PASS")))
+	}
+	nc, err := nats.Connect(natsURL, opts...)
+	if err != nil {
+		log.Fatalf("❌ Failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Fatalf("❌ Failed to get JetStream context: %v", err)
+	}
+	log.Println("✅ Connected to NATS")
+
+	db, err := sql.Open("postgres", getEnv("DATABASE_URL", "postgresql://localhost/postgres?sslmode=disable"))
+	if err != nil {
+		log.Fatalf("❌ Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		log.Fatalf("❌ Failed to ping database: %v", err)
+	}
+	log.Println("✅ Connected to PostgreSQL")
+
+	o := &operator{
+		Client:      mgr.GetClient(),
+		secrets:     mgr.GetAPIReader(),
+		js:          js,
+		rules:       ruleengine.New(db),
+		natsURL:     natsURL,
+		workerImage: getEnv("WORKER_IMAGE", "rule-engine-webhook-worker:latest"),
+		interval:    interval,
+
+		scalerAddress: os.Getenv("SCALER_ADDRESS"),
+	}
+	ctx := ctrl.SetupSignalHandler()
+	if err := o.setupWithManager(ctx, mgr); err != nil {
+		log.Fatalf("❌ Failed to set up controllers: %v", err)
+	}
+	if namespace == "" {
+		log.Printf("👀 Watching all namespaces, resyncing every %s", interval)
+	} else {
+		log.Printf("👀 Watching namespace %s, resyncing every %s", namespace, interval)
+	}
+
+	if addr := os.Getenv("SCALER_ADDR"); addr != "" {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("❌ Failed to listen on %s: %v", addr, err)
+		}
+		err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			srv := grpc.NewServer()
+			externalscaler.RegisterExternalScalerServer(srv, &scalerServer{js: js, interval: scalerPushInterval})
+			go func() {
+				<-ctx.Done()
+				// Stop rather than GracefulStop: StreamIsActive calls never end
+				srv.Stop()
+			}()
+			log.Printf("📈 KEDA external scaler listening on %s", addr)
+			return srv.Serve(lis)
+		}))
+		if err != nil {
+			log.Fatalf("❌ Failed to add the scaler: %v", err)
+		}
+	}
+
+	if err := mgr.Start(ctx); err != nil {
+		log.Fatalf("❌ Operator failed: %v", err)
+	}
+	log.Println("👋 Operator stopped")
+}
+
+// newManager creates the manager caching the custom resources, in
+// namespace or in every namespace when empty. Only the Deployments the
+// operator manages are cached, and only the metadata of Secrets.
+func newManager(cfg *rest.Config, namespace, metricsAddr string) (manager.Manager, error) {
+	scheme, err := newScheme()
+	if err != nil {
+		return nil, err
+	}
+	cacheOpts := cache.Options{
+		ByObject: map[client.Object]cache.ByObject{
+			&appsv1.Deployment{}: {Label: labels.SelectorFromSet(labels.Set{"app.kubernetes.io/managed-by": fieldManager})},
+		},
+	}
+	if namespace != "" {
+		cacheOpts.DefaultNamespaces = map[string]cache.Config{namespace: {}}
+	}
+	return ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:  scheme,
+		Cache:   cacheOpts,
+		Metrics: metricsserver.Options{BindAddress: metricsAddr},
+	})
+}
+
+// setupWithManager registers a controller per kind, with the watches that
+// bring a resource up to date when what it depends on changes
+func (o *operator) setupWithManager(ctx context.Context, mgr manager.Manager) error {
+	indexer := mgr.GetFieldIndexer()
+	if err := indexer.IndexField(ctx, &ruleWorker{}, workerStreamIndex, indexWorkerStream); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(ctx, &webhookDestination{}, destinationSecretsIndex, indexDestinationSecrets); err != nil {
+		return err
+	}
+
+	err := ctrl.NewControllerManagedBy(mgr).
+		Named("rulestream").
+		For(&ruleStream{}).
+		Complete(reconcile.Func(o.reconcileRuleStream))
+	if err != nil {
+		return err
+	}
+	err = ctrl.NewControllerManagedBy(mgr).
+		Named("ruleworker").
+		For(&ruleWorker{}).
+		Owns(&appsv1.Deployment{}).
+		// A stream's subjects and name are the workers' defaults
+		Watches(&ruleStream{}, handler.EnqueueRequestsFromMapFunc(o.streamWorkers)).
+		Complete(reconcile.Func(o.reconcileRuleWorker))
+	if err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("webhookdestination").
+		For(&webhookDestination{}).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(o.secretDestinations), builder.OnlyMetadata).
+		Complete(reconcile.Func(o.reconcileWebhookDestination))
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	group = "rules.rule-engine.io"
+
+	// finalizer holds back deleting a resource with deletionPolicy Delete
+	// until its stream, consumer, or webhook is gone
+	finalizer = group + "/cleanup"
+)
+
+// groupVersion is the API version of the custom resources
+var groupVersion = schema.GroupVersion{Group: group, Version: "v1alpha1"}
+
+// Deletion policies: whether deleting a resource deletes what it manages
+const (
+	deletionRetain = "Retain"
+	deletionDelete = "Delete"
+)
+
+// Status phases
+const (
+	phaseReady   = "Ready"
+	phasePending = "Pending"
+	phaseError   = "Error"
+)
+
+// Kinds, as logged and registered in the scheme
+const (
+	ruleStreamKind         = "RuleStream"
+	ruleWorkerKind         = "RuleWorker"
+	webhookDestinationKind = "WebhookDestination"
+)
+
+// secretKeyRef names one key of a Secret in the resource's namespace
+type secretKeyRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// status is reported on every resource. It is only written when it
+// changes, so an idle cluster sees no updates.
+type status struct {
+	ObservedGeneration int64  `json:"observedGeneration"`
+	Phase              string `json:"phase"`
+	Message            string `json:"message"`
+}
+
+// newScheme knows the custom resources and the built-in kinds the operator
+// manages
+func newScheme() (*runtime.Scheme, error) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	for kind, obj := range map[string]runtime.Object{
+		ruleStreamKind:                  &ruleStream{},
+		ruleStreamKind + "List":         &ruleStreamList{},
+		ruleWorkerKind:                  &ruleWorker{},
+		ruleWorkerKind + "List":         &ruleWorkerList{},
+		webhookDestinationKind:          &webhookDestination{},
+		webhookDestinationKind + "List": &webhookDestinationList{},
+	} {
+		scheme.AddKnownTypeWithName(groupVersion.WithKind(kind), obj)
+	}
+	metav1.AddToGroupVersion(scheme, groupVersion)
+	return scheme, nil
+}
+
+// deepCopy copies a resource through JSON. The kinds are small and read
+// rarely enough that this beats keeping generated deep copies in step.
+func deepCopy[T any](in *T) *T {
+	out := new(T)
+	data, err := json.Marshal(in)
+	if err == nil {
+		err = json.Unmarshal(data, out)
+	}
+	if err != nil {
+		// Every field is plain JSON, so this is a bug in the types
+		panic(err)
+	}
+	return out
+}
+
+// finalize keeps the finalizer in step with the deletion policy. For a
+// resource being deleted it runs cleanup, if the finalizer asks for it,
+// and then releases the resource; it reports whether the resource is
+// being deleted, so there is nothing more to reconcile.
+func (o *operator) finalize(ctx context.Context, obj client.Object, policy string, cleanup func() error) (bool, error) {
+	base := obj.DeepCopyObject().(client.Object)
+	if !obj.GetDeletionTimestamp().IsZero() {
+		if !controllerutil.ContainsFinalizer(obj, finalizer) {
+			return true, nil
+		}
+		if err := cleanup(); err != nil {
+			return true, err
+		}
+		controllerutil.RemoveFinalizer(obj, finalizer)
+		return true, o.setFinalizers(ctx, obj, base)
+	}
+
+	var changed bool
+	if policy == deletionDelete {
+		changed = controllerutil.AddFinalizer(obj, finalizer)
+	} else {
+		changed = controllerutil.RemoveFinalizer(obj, finalizer)
+	}
+	if !changed {
+		return false, nil
+	}
+	return false, o.setFinalizers(ctx, obj, base)
+}
+
+// setFinalizers patches obj's finalizers, as changed from base, failing if
+// it changed since it was read. Only they are sent: an update would send
+// the spec's unset fields, which the CRDs' validation rejects.
+func (o *operator) setFinalizers(ctx context.Context, obj, base client.Object) error {
+	return o.Patch(ctx, obj, client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{}))
+}
+
+// setStatus writes the status subresource of obj, as changed from base
+func (o *operator) setStatus(ctx context.Context, obj, base client.Object) error {
+	return o.Status().Patch(ctx, obj, client.MergeFrom(base))
+}
+
+// report sets a status's common fields after a reconcile returning err,
+// and logs the resource's phase when it changes
+func report(kind string, obj client.Object, st *status, phase string, err error) {
+	previous := st.Phase + st.Message
+	st.ObservedGeneration = obj.GetGeneration()
+	st.Phase, st.Message = phase, ""
+	if err != nil {
+		st.Phase, st.Message = phaseError, err.Error()
+	}
+	if st.Phase+st.Message == previous {
+		return
+	}
+	switch st.Phase {
+	case phaseReady:
+		log.Printf("✅ %s %s/%s ready", kind, obj.GetNamespace(), obj.GetName())
+	case phasePending:
+		log.Printf("⏳ %s %s/%s pending", kind, obj.GetNamespace(), obj.GetName())
+	default:
+		log.Printf("⚠️  %s %s/%s: %s", kind, obj.GetNamespace(), obj.GetName(), st.Message)
+	}
+}
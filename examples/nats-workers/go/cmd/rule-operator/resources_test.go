@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/rule-engine/nats-webhook-worker/internal/natstest"
+)
+
+const testNamespace = "rules"
+
+// newTestOperator is an operator on a fake API server holding objs and on
+// a natstest server
+func newTestOperator(t *testing.T, objs ...client.Object) (*operator, *natstest.Server) {
+	t.Helper()
+	scheme, err := newScheme()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithStatusSubresource(&ruleStream{}, &ruleWorker{}, &webhookDestination{}).
+		WithIndex(&ruleWorker{}, workerStreamIndex, indexWorkerStream).
+		WithIndex(&webhookDestination{}, destinationSecretsIndex, indexDestinationSecrets).
+		WithObjects(objs...).
+		Build()
+	srv := natstest.NewServer(t)
+	nc, err := nats.Connect(srv.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &operator{Client: c, secrets: c, js: js, natsURL: srv.URL(), workerImage: "worker:test", interval: time.Minute}, srv
+}
+
+// reconcileOnce reconciles the named resource, which must requeue after
+// the interval
+func reconcileOnce(t *testing.T, fn func(context.Context, ctrl.Request) (ctrl.Result, error), name string) {
+	t.Helper()
+	res, err := fn(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: testNamespace, Name: name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RequeueAfter != time.Minute {
+		t.Fatalf("result = %+v, want a requeue after the interval", res)
+	}
+}
+
+// reqFor is the request reconciling obj
+func reqFor(obj client.Object) ctrl.Request {
+	return ctrl.Request{NamespacedName: client.ObjectKeyFromObject(obj)}
+}
+
+// objectMeta is the metadata of a resource in testNamespace
+func objectMeta(name string, finalizers ...string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Namespace: testNamespace, Name: name, Generation: 2, Finalizers: finalizers}
+}
+
+// deleted marks the metadata as deleted: the fake API server keeps it
+// while it has finalizers
+func deleted(meta metav1.ObjectMeta) metav1.ObjectMeta {
+	now := metav1.Now()
+	meta.DeletionTimestamp = &now
+	return meta
+}
+
+func TestSchemeRoundTrip(t *testing.T) {
+	scheme, err := newScheme()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		kind string
+		obj  client.Object
+	}{
+		{ruleStreamKind, &ruleStream{ObjectMeta: objectMeta("webhooks"),
+			Spec:   ruleStreamSpec{Name: "WEBHOOKS", Subjects: []string{"webhooks.>"}},
+			Status: ruleStreamStatus{status: status{Phase: phaseReady}, StreamName: "WEBHOOKS"}}},
+		{ruleWorkerKind, &ruleWorker{ObjectMeta: objectMeta("workers"),
+			Spec:   ruleWorkerSpec{Stream: "webhooks", Env: []map[string]interface{}{{"name": "LOG_LEVEL", "value": "debug"}}},
+			Status: ruleWorkerStatus{status: status{Phase: phasePending}, ReadyReplicas: 1}}},
+		{webhookDestinationKind, &webhookDestination{ObjectMeta: objectMeta("crm"),
+			Spec:   webhookDestinationSpec{URLFrom: &secretKeyRef{Name: "crm", Key: "url"}},
+			Status: webhookDestinationStatus{status: status{Phase: phaseError, Message: "down"}, WebhookID: 7}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			gvks, _, err := scheme.ObjectKinds(tt.obj)
+			if err != nil || len(gvks) != 1 || gvks[0] != groupVersion.WithKind(tt.kind) {
+				t.Fatalf("kinds = %v, %v", gvks, err)
+			}
+			// Written and read back through the API server's JSON
+			c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(tt.obj).WithObjects(tt.obj).Build()
+			got := tt.obj.DeepCopyObject().(client.Object)
+			if err := c.Get(context.Background(), client.ObjectKeyFromObject(tt.obj), got); err != nil {
+				t.Fatal(err)
+			}
+			got.SetResourceVersion("")
+			tt.obj.SetResourceVersion("")
+			got.GetObjectKind().SetGroupVersionKind(tt.obj.GetObjectKind().GroupVersionKind())
+			if !reflect.DeepEqual(got, tt.obj) {
+				t.Fatalf("read %+v, want %+v", got, tt.obj)
+			}
+		})
+	}
+}
+
+func TestFinalize(t *testing.T) {
+	tests := []struct {
+		name           string
+		meta           metav1.ObjectMeta
+		policy         string
+		cleanupErr     error
+		wantDeleting   bool
+		wantCleanup    bool
+		wantErr        bool
+		wantFinalizers []string // nil: the resource is gone
+	}{
+		{name: "delete policy adds the finalizer", meta: objectMeta("s"), policy: deletionDelete,
+			wantFinalizers: []string{finalizer}},
+		{name: "retain policy removes it", meta: objectMeta("s", "other", finalizer), policy: deletionRetain,
+			wantFinalizers: []string{"other"}},
+		{name: "default policy retains", meta: objectMeta("s", finalizer),
+			wantFinalizers: []string{}},
+		{name: "in step", meta: objectMeta("s", finalizer), policy: deletionDelete,
+			wantFinalizers: []string{finalizer}},
+		{name: "deleted runs cleanup", meta: deleted(objectMeta("s", finalizer)), policy: deletionDelete,
+			wantDeleting: true, wantCleanup: true},
+		{name: "deleted keeps other finalizers", meta: deleted(objectMeta("s", finalizer, "other")), policy: deletionDelete,
+			wantDeleting: true, wantCleanup: true, wantFinalizers: []string{"other"}},
+		{name: "failed cleanup keeps the finalizer", meta: deleted(objectMeta("s", finalizer)), policy: deletionDelete,
+			cleanupErr: errors.New("nats: timeout"), wantDeleting: true, wantCleanup: true, wantErr: true,
+			wantFinalizers: []string{finalizer}},
+		// Its policy was Retain when it was deleted
+		{name: "deleted without the finalizer", meta: deleted(objectMeta("s", "other")), policy: deletionDelete,
+			wantDeleting: true, wantFinalizers: []string{"other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &ruleStream{ObjectMeta: tt.meta}
+			o, _ := newTestOperator(t, s)
+			if err := o.Get(context.Background(), client.ObjectKeyFromObject(s), s); err != nil {
+				t.Fatal(err)
+			}
+			cleaned := false
+			deleting, err := o.finalize(context.Background(), s, tt.policy, func() error {
+				cleaned = true
+				return tt.cleanupErr
+			})
+			if deleting != tt.wantDeleting || cleaned != tt.wantCleanup || (err != nil) != tt.wantErr {
+				t.Fatalf("deleting = %v, cleaned up = %v, err = %v", deleting, cleaned, err)
+			}
+
+			var got ruleStream
+			err = o.Get(context.Background(), client.ObjectKeyFromObject(s), &got)
+			if tt.wantFinalizers == nil {
+				if err == nil {
+					t.Fatalf("still there with finalizers %v", got.Finalizers)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Finalizers) != len(tt.wantFinalizers) || (len(got.Finalizers) > 0 && !reflect.DeepEqual(got.Finalizers, tt.wantFinalizers)) {
+				t.Fatalf("finalizers = %v, want %v", got.Finalizers, tt.wantFinalizers)
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	tests := []struct {
+		name   string
+		before status
+		phase  string
+		err    error
+		want   status
+	}{
+		{name: "ready", phase: phaseReady, want: status{ObservedGeneration: 2, Phase: phaseReady}},
+		{name: "pending", before: status{Phase: phaseReady}, phase: phasePending,
+			want: status{ObservedGeneration: 2, Phase: phasePending}},
+		{name: "error", before: status{Phase: phaseReady}, phase: phaseReady, err: errors.New("stream RULES not found"),
+			want: status{ObservedGeneration: 2, Phase: phaseError, Message: "stream RULES not found"}},
+		{name: "recovered", before: status{ObservedGeneration: 1, Phase: phaseError, Message: "down"}, phase: phaseReady,
+			want: status{ObservedGeneration: 2, Phase: phaseReady}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := tt.before
+			report(ruleStreamKind, &ruleStream{ObjectMeta: objectMeta("s")}, &st, tt.phase, tt.err)
+			if st != tt.want {
+				t.Fatalf("status = %+v, want %+v", st, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	"github.com/rule-engine/nats-webhook-worker/api/externalscaler"
+)
+
+// Defaults of the trigger metadata
+const (
+	defaultTargetBacklog     = 100
+	defaultActivationBacklog = 0
+)
+
+// scalerPushInterval is how often StreamIsActive checks the backlog by
+// default
+const scalerPushInterval = 5 * time.Second
+
+// backlogMetric names the metric KEDA scales on
+const backlogMetric = "rule-worker-backlog"
+
+// scalerServer is a KEDA external scaler on durable consumers' backlog:
+// messages waiting in the stream plus those delivered but not yet acked.
+// The trigger's metadata names the consumer:
+//
+//	stream: WEBHOOKS
+//	consumer: webhook-workers
+//	targetBacklog: "100"      # per replica
+//	activationBacklog: "0"    # scale from zero above this
+type scalerServer struct {
+	externalscaler.UnimplementedExternalScalerServer
+	js nats.JetStreamContext
+	// interval is how often StreamIsActive checks the backlog
+	interval time.Duration
+}
+
+// scalerTrigger is a ScaledObject trigger's metadata
+type scalerTrigger struct {
+	stream, consumer  string
+	target            int64
+	activationBacklog int64
+}
+
+// parseTrigger reads and checks a trigger's metadata
+func parseTrigger(ref *externalscaler.ScaledObjectRef) (*scalerTrigger, error) {
+	md := ref.GetScalerMetadata()
+	t := &scalerTrigger{
+		stream:            md["stream"],
+		consumer:          md["consumer"],
+		target:            defaultTargetBacklog,
+		activationBacklog: defaultActivationBacklog,
+	}
+	if t.stream == "" || t.consumer == "" {
+		return nil, grpcstatus.Error(codes.InvalidArgument, "trigger metadata needs stream and consumer")
+	}
+	for key, dest := range map[string]*int64{"targetBacklog": &t.target, "activationBacklog": &t.activationBacklog} {
+		value, ok := md[key]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return nil, grpcstatus.Errorf(codes.InvalidArgument, "%s must be a whole number of messages, got %q", key, value)
+		}
+		*dest = n
+	}
+	if t.target == 0 {
+		return nil, grpcstatus.Error(codes.InvalidArgument, "targetBacklog must be above 0")
+	}
+	return t, nil
+}
+
+// backlog returns the consumer's pending and unacknowledged messages
+func (s *scalerServer) backlog(ctx context.Context, t *scalerTrigger) (int64, error) {
+	info, err := s.js.ConsumerInfo(t.stream, t.consumer, nats.Context(ctx))
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound), errors.Is(err, nats.ErrConsumerNotFound):
+		return 0, grpcstatus.Errorf(codes.NotFound, "consumer %s on stream %s not found", t.consumer, t.stream)
+	case err != nil:
+		return 0, grpcstatus.Errorf(codes.Unavailable, "failed to read consumer %s: %v", t.consumer, err)
+	}
+	return int64(info.NumPending) + int64(info.NumAckPending), nil
+}
+
+func (s *scalerServer) IsActive(ctx context.Context, ref *externalscaler.ScaledObjectRef) (*externalscaler.IsActiveResponse, error) {
+	t, err := parseTrigger(ref)
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.backlog(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	return &externalscaler.IsActiveResponse{Result: n > t.activationBacklog}, nil
+}
+
+// StreamIsActive sends IsActive's result whenever it changes
+func (s *scalerServer) StreamIsActive(ref *externalscaler.ScaledObjectRef, stream externalscaler.ExternalScaler_StreamIsActiveServer) error {
+	t, err := parseTrigger(ref)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	var sent, active bool
+	for {
+		// A failed read keeps the last result rather than ending the stream
+		if n, err := s.backlog(stream.Context(), t); err == nil {
+			if now := n > t.activationBacklog; !sent || now != active {
+				if err := stream.Send(&externalscaler.IsActiveResponse{Result: now}); err != nil {
+					return err
+				}
+				sent, active = true, now
+			}
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *scalerServer) GetMetricSpec(ctx context.Context, ref *externalscaler.ScaledObjectRef) (*externalscaler.GetMetricSpecResponse, error) {
+	t, err := parseTrigger(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &externalscaler.GetMetricSpecResponse{
+		MetricSpecs: []*externalscaler.MetricSpec{
+			{MetricName: backlogMetric, TargetSize: t.target, TargetSizeFloat: float64(t.target)},
+		},
+	}, nil
+}
+
+func (s *scalerServer) GetMetrics(ctx context.Context, req *externalscaler.GetMetricsRequest) (*externalscaler.GetMetricsResponse, error) {
+	t, err := parseTrigger(req.GetScaledObjectRef())
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.backlog(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	return &externalscaler.GetMetricsResponse{
+		MetricValues: []*externalscaler.MetricValue{
+			{MetricName: req.GetMetricName(), MetricValue: n, MetricValueFloat: float64(n)},
+		},
+	}, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	"github.com/rule-engine/nats-webhook-worker/api/externalscaler"
+)
+
+// newTestScaler is a scaler on a consumer "workers" of stream WEBHOOKS
+// with pending messages waiting and ackPending delivered but not acked
+func newTestScaler(t *testing.T, pending, ackPending int) *scalerServer {
+	t.Helper()
+	o, srv := newTestOperator(t)
+	srv.AddStream("WEBHOOKS", "webhooks.>")
+	if _, err := o.js.AddConsumer("WEBHOOKS", &nats.ConsumerConfig{Durable: "workers", AckPolicy: nats.AckExplicitPolicy,
+		AckWait: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < pending+ackPending; i++ {
+		srv.Publish("webhooks.orders", nil, []byte(`{}`))
+	}
+	if ackPending > 0 {
+		sub, err := o.js.PullSubscribe("", "workers", nats.Bind("WEBHOOKS", "workers"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgs, err := sub.Fetch(ackPending, nats.MaxWait(time.Second)); err != nil || len(msgs) != ackPending {
+			t.Fatalf("fetched %d: %v", len(msgs), err)
+		}
+	}
+	return &scalerServer{js: o.js, interval: 10 * time.Millisecond}
+}
+
+// scaledObject is a ScaledObject ref with the trigger metadata md
+func scaledObject(md map[string]string) *externalscaler.ScaledObjectRef {
+	return &externalscaler.ScaledObjectRef{Name: "workers", Namespace: testNamespace, ScalerMetadata: md}
+}
+
+// workersTrigger is the metadata of a trigger on the test consumer
+func workersTrigger(kv ...string) map[string]string {
+	md := map[string]string{"stream": "WEBHOOKS", "consumer": "workers"}
+	for i := 0; i+1 < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return md
+}
+
+func TestParseTrigger(t *testing.T) {
+	tests := []struct {
+		name    string
+		md      map[string]string
+		want    *scalerTrigger
+		wantErr bool
+	}{
+		{name: "defaults", md: workersTrigger(),
+			want: &scalerTrigger{stream: "WEBHOOKS", consumer: "workers", target: defaultTargetBacklog, activationBacklog: defaultActivationBacklog}},
+		{name: "every setting", md: workersTrigger("targetBacklog", "25", "activationBacklog", "5"),
+			want: &scalerTrigger{stream: "WEBHOOKS", consumer: "workers", target: 25, activationBacklog: 5}},
+		{name: "no stream", md: map[string]string{"consumer": "workers"}, wantErr: true},
+		{name: "no consumer", md: map[string]string{"stream": "WEBHOOKS"}, wantErr: true},
+		{name: "no metadata", wantErr: true},
+		{name: "target not a number", md: workersTrigger("targetBacklog", "lots"), wantErr: true},
+		{name: "negative activation", md: workersTrigger("activationBacklog", "-1"), wantErr: true},
+		{name: "zero target", md: workersTrigger("targetBacklog", "0"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTrigger(scaledObject(tt.md))
+			if tt.wantErr {
+				if grpcstatus.Code(err) != codes.InvalidArgument {
+					t.Fatalf("err = %v, want InvalidArgument", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("trigger = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsActive(t *testing.T) {
+	tests := []struct {
+		name       string
+		pending    int
+		ackPending int
+		md         map[string]string
+		want       bool
+		wantCode   codes.Code
+	}{
+		{name: "idle", md: workersTrigger()},
+		{name: "waiting", pending: 1, md: workersTrigger(), want: true},
+		{name: "in flight", ackPending: 1, md: workersTrigger(), want: true},
+		{name: "at activation", pending: 2, ackPending: 1, md: workersTrigger("activationBacklog", "3")},
+		{name: "above activation", pending: 3, ackPending: 1, md: workersTrigger("activationBacklog", "3"), want: true},
+		{name: "consumer not found", md: workersTrigger("consumer", "missing"), wantCode: codes.NotFound},
+		{name: "stream not found", md: workersTrigger("stream", "MISSING"), wantCode: codes.NotFound},
+		{name: "invalid trigger", md: map[string]string{}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestScaler(t, tt.pending, tt.ackPending)
+			res, err := s.IsActive(context.Background(), scaledObject(tt.md))
+			if grpcstatus.Code(err) != tt.wantCode {
+				t.Fatalf("err = %v, want %s", err, tt.wantCode)
+			}
+			if err == nil && res.Result != tt.want {
+				t.Fatalf("active = %v, want %v", res.Result, tt.want)
+			}
+		})
+	}
+}
+
+// activeStream is the server side of a StreamIsActive call, passing what is
+// sent on to sent
+type activeStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent chan bool
+}
+
+func (s *activeStream) Context() context.Context { return s.ctx }
+
+func (s *activeStream) Send(res *externalscaler.IsActiveResponse) error {
+	s.sent <- res.Result
+	return nil
+}
+
+func TestStreamIsActive(t *testing.T) {
+	tests := []struct {
+		name     string
+		pending  int
+		md       map[string]string
+		publish  int // more messages after the first result
+		want     []bool
+		wantCode codes.Code
+	}{
+		{name: "idle", md: workersTrigger(), want: []bool{false}},
+		{name: "becomes active", md: workersTrigger(), publish: 1, want: []bool{false, true}},
+		{name: "stays active", pending: 1, md: workersTrigger(), publish: 1, want: []bool{true}},
+		{name: "crosses activation", pending: 2, md: workersTrigger("activationBacklog", "2"), publish: 1, want: []bool{false, true}},
+		// A failed read sends nothing rather than ending the stream
+		{name: "consumer not found", md: workersTrigger("consumer", "missing")},
+		{name: "invalid trigger", md: map[string]string{"stream": "WEBHOOKS"}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestScaler(t, tt.pending, 0)
+			ctx, cancel := context.WithCancel(context.Background())
+			stream := &activeStream{ctx: ctx, sent: make(chan bool, 10)}
+			done := make(chan error, 1)
+			go func() { done <- s.StreamIsActive(scaledObject(tt.md), stream) }()
+
+			var got []bool
+			receive := func() {
+				select {
+				case active := <-stream.sent:
+					got = append(got, active)
+				case <-time.After(200 * time.Millisecond):
+				}
+			}
+			if tt.wantCode == codes.OK {
+				receive()
+				for i := 0; i < tt.publish; i++ {
+					s.js.Publish("webhooks.orders", []byte(`{}`))
+				}
+				// Several pushes, of which only a change is sent
+				for i := 0; i < 3; i++ {
+					receive()
+				}
+			}
+			cancel()
+			if err := <-done; grpcstatus.Code(err) != tt.wantCode {
+				t.Fatalf("err = %v, want %s", err, tt.wantCode)
+			}
+			if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+				t.Fatalf("sent %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetMetricSpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		md       map[string]string
+		want     int64
+		wantCode codes.Code
+	}{
+		{name: "default target", md: workersTrigger(), want: defaultTargetBacklog},
+		{name: "target", md: workersTrigger("targetBacklog", "25"), want: 25},
+		// The consumer is not read
+		{name: "consumer not found", md: workersTrigger("consumer", "missing"), want: defaultTargetBacklog},
+		{name: "invalid trigger", md: workersTrigger("targetBacklog", "0"), wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestScaler(t, 0, 0)
+			res, err := s.GetMetricSpec(context.Background(), scaledObject(tt.md))
+			if grpcstatus.Code(err) != tt.wantCode {
+				t.Fatalf("err = %v, want %s", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			want := []*externalscaler.MetricSpec{{MetricName: backlogMetric, TargetSize: tt.want, TargetSizeFloat: float64(tt.want)}}
+			if len(res.MetricSpecs) != 1 || res.MetricSpecs[0].MetricName != want[0].MetricName ||
+				res.MetricSpecs[0].TargetSize != want[0].TargetSize || res.MetricSpecs[0].TargetSizeFloat != want[0].TargetSizeFloat {
+				t.Fatalf("metric specs = %v, want %v", res.MetricSpecs, want)
+			}
+		})
+	}
+}
+
+func TestGetMetrics(t *testing.T) {
+	tests := []struct {
+		name       string
+		pending    int
+		ackPending int
+		md         map[string]string
+		want       int64
+		wantCode   codes.Code
+	}{
+		{name: "idle", md: workersTrigger()},
+		{name: "waiting and in flight", pending: 3, ackPending: 2, md: workersTrigger(), want: 5},
+		{name: "consumer not found", md: workersTrigger("consumer", "missing"), wantCode: codes.NotFound},
+		{name: "invalid trigger", md: map[string]string{"consumer": "workers"}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestScaler(t, tt.pending, tt.ackPending)
+			res, err := s.GetMetrics(context.Background(), &externalscaler.GetMetricsRequest{
+				ScaledObjectRef: scaledObject(tt.md), MetricName: "s0-" + backlogMetric})
+			if grpcstatus.Code(err) != tt.wantCode {
+				t.Fatalf("err = %v, want %s", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			// Named as KEDA asked for it
+			if len(res.MetricValues) != 1 || res.MetricValues[0].MetricName != "s0-"+backlogMetric ||
+				res.MetricValues[0].MetricValue != tt.want || res.MetricValues[0].MetricValueFloat != float64(tt.want) {
+				t.Fatalf("metric values = %v, want %d", res.MetricValues, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ruleStream is a JetStream stream the operator creates and keeps in step
+// with its spec
+type ruleStream struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ruleStreamSpec   `json:"spec"`
+	Status ruleStreamStatus `json:"status"`
+}
+
+type ruleStreamList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ruleStream `json:"items"`
+}
+
+func (s *ruleStream) DeepCopyObject() runtime.Object     { return deepCopy(s) }
+func (l *ruleStreamList) DeepCopyObject() runtime.Object { return deepCopy(l) }
+
+type ruleStreamSpec struct {
+	// Name is the stream's name; metadata.name when empty
+	Name     string   `json:"name,omitempty"`
+	Subjects []string `json:"subjects"`
+	// Storage is file (default) or memory; Retention is limits (default),
+	// interest, or workqueue. Neither can change once the stream exists.
+	Storage   string `json:"storage,omitempty"`
+	Retention string `json:"retention,omitempty"`
+	Replicas  int    `json:"replicas,omitempty"`
+	// MaxAge and DuplicateWindow are Go durations, e.g. 72h
+	MaxAge          string `json:"maxAge,omitempty"`
+	DuplicateWindow string `json:"duplicateWindow,omitempty"`
+	MaxBytes        int64  `json:"maxBytes,omitempty"`
+	MaxMsgs         int64  `json:"maxMsgs,omitempty"`
+	// DeletionPolicy Delete deletes the stream, with its messages, when the
+	// resource is deleted; the default Retain keeps it
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+}
+
+type ruleStreamStatus struct {
+	status     `json:",inline"`
+	StreamName string `json:"streamName"`
+	// Signed, as Kubernetes API fields are
+	Messages  int64 `json:"messages"`
+	Bytes     int64 `json:"bytes"`
+	Consumers int   `json:"consumers"`
+}
+
+// streamName is the JetStream stream the resource manages
+func (s *ruleStream) streamName() string {
+	if s.Spec.Name != "" {
+		return s.Spec.Name
+	}
+	return s.Name
+}
+
+// config is the stream configuration the spec asks for
+func (s *ruleStream) config() (*nats.StreamConfig, error) {
+	cfg := &nats.StreamConfig{
+		Name:     s.streamName(),
+		Subjects: s.Spec.Subjects,
+		Replicas: s.Spec.Replicas,
+		MaxBytes: s.Spec.MaxBytes,
+		MaxMsgs:  s.Spec.MaxMsgs,
+	}
+	if strings.ContainsAny(cfg.Name, ". *>") {
+		return nil, fmt.Errorf("stream name %q may not contain '.', ' ', '*', or '>'; set spec.name", cfg.Name)
+	}
+	if len(cfg.Subjects) == 0 {
+		return nil, errors.New("spec.subjects is required")
+	}
+	if cfg.Replicas == 0 {
+		cfg.Replicas = 1
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = -1
+	}
+	if cfg.MaxMsgs == 0 {
+		cfg.MaxMsgs = -1
+	}
+	switch s.Spec.Storage {
+	case "", "file":
+		cfg.Storage = nats.FileStorage
+	case "memory":
+		cfg.Storage = nats.MemoryStorage
+	default:
+		return nil, fmt.Errorf("spec.storage must be file or memory, got %q", s.Spec.Storage)
+	}
+	switch s.Spec.Retention {
+	case "", "limits":
+		cfg.Retention = nats.LimitsPolicy
+	case "interest":
+		cfg.Retention = nats.InterestPolicy
+	case "workqueue":
+		cfg.Retention = nats.WorkQueuePolicy
+	default:
+		return nil, fmt.Errorf("spec.retention must be limits, interest, or workqueue, got %q", s.Spec.Retention)
+	}
+	var err error
+	if s.Spec.MaxAge != "" {
+		if cfg.MaxAge, err = time.ParseDuration(s.Spec.MaxAge); err != nil {
+			return nil, fmt.Errorf("spec.maxAge: %w", err)
+		}
+	}
+	if s.Spec.DuplicateWindow != "" {
+		if cfg.Duplicates, err = time.ParseDuration(s.Spec.DuplicateWindow); err != nil {
+			return nil, fmt.Errorf("spec.duplicateWindow: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+// reconcileRuleStream creates or updates the stream of a RuleStream. It
+// runs again each RECONCILE_INTERVAL, since the stream can change outside
+// Kubernetes.
+func (o *operator) reconcileRuleStream(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var s ruleStream
+	if err := o.Get(ctx, req.NamespacedName, &s); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	deleting, err := o.finalize(ctx, &s, s.Spec.DeletionPolicy, func() error {
+		return o.deleteStream(s.streamName())
+	})
+	if deleting || err != nil {
+		return ctrl.Result{}, err
+	}
+	base := s.DeepCopyObject().(*ruleStream)
+	err = o.reconcileStream(ctx, &s)
+	report(ruleStreamKind, &s, &s.Status.status, phaseReady, err)
+	if s.Status != base.Status {
+		if err := o.setStatus(ctx, &s, base); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: o.interval}, nil
+}
+
+// reconcileStream creates the stream, or updates the settings the spec
+// covers and leaves the rest
+func (o *operator) reconcileStream(ctx context.Context, s *ruleStream) error {
+	want, err := s.config()
+	if err != nil {
+		return err
+	}
+	s.Status.StreamName = want.Name
+
+	info, err := o.js.StreamInfo(want.Name, nats.Context(ctx))
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		if info, err = o.js.AddStream(want, nats.Context(ctx)); err != nil {
+			return fmt.Errorf("failed to create stream %s: %w", want.Name, err)
+		}
+		log.Printf("🌊 Created stream %s for RuleStream %s/%s", want.Name, s.Namespace, s.Name)
+	case err != nil:
+		return fmt.Errorf("failed to look up stream %s: %w", want.Name, err)
+	default:
+		cfg := info.Config
+		if cfg.Storage != want.Storage || cfg.Retention != want.Retention {
+			return fmt.Errorf("stream %s has %s storage and %s retention, which cannot be changed", want.Name, cfg.Storage, cfg.Retention)
+		}
+		if !sameStrings(cfg.Subjects, want.Subjects) || cfg.Replicas != want.Replicas || cfg.MaxAge != want.MaxAge ||
+			(want.Duplicates != 0 && cfg.Duplicates != want.Duplicates) || cfg.MaxBytes != want.MaxBytes || cfg.MaxMsgs != want.MaxMsgs {
+			cfg.Subjects, cfg.Replicas, cfg.MaxAge = want.Subjects, want.Replicas, want.MaxAge
+			cfg.MaxBytes, cfg.MaxMsgs = want.MaxBytes, want.MaxMsgs
+			if want.Duplicates != 0 {
+				cfg.Duplicates = want.Duplicates
+			}
+			if info, err = o.js.UpdateStream(&cfg, nats.Context(ctx)); err != nil {
+				return fmt.Errorf("failed to update stream %s: %w", want.Name, err)
+			}
+			log.Printf("🌊 Updated stream %s for RuleStream %s/%s", want.Name, s.Namespace, s.Name)
+		}
+	}
+	s.Status.Messages, s.Status.Bytes, s.Status.Consumers = int64(info.State.Msgs), int64(info.State.Bytes), info.State.Consumers
+	return nil
+}
+
+// deleteStream deletes a stream, which may be gone already
+func (o *operator) deleteStream(name string) error {
+	err := o.js.DeleteStream(name)
+	if err == nil {
+		log.Printf("🗑️  Deleted stream %s", name)
+	}
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return nil
+	}
+	return err
+}
+
+// sameStrings reports whether a and b hold the same strings in order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
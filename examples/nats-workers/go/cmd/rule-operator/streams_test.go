@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestRuleStreamConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  ruleStream
+		want    *nats.StreamConfig
+		wantErr string
+	}{
+		{name: "defaults", stream: ruleStream{ObjectMeta: objectMeta("webhooks"), Spec: ruleStreamSpec{Subjects: []string{"webhooks.>"}}},
+			want: &nats.StreamConfig{Name: "webhooks", Subjects: []string{"webhooks.>"}, Replicas: 1, MaxBytes: -1, MaxMsgs: -1,
+				Storage: nats.FileStorage, Retention: nats.LimitsPolicy}},
+		{name: "every setting", stream: ruleStream{ObjectMeta: objectMeta("webhooks"), Spec: ruleStreamSpec{
+			Name: "WEBHOOKS", Subjects: []string{"webhooks.>"}, Storage: "memory", Retention: "workqueue", Replicas: 3,
+			MaxAge: "72h", DuplicateWindow: "2m", MaxBytes: 1 << 30, MaxMsgs: 1000}},
+			want: &nats.StreamConfig{Name: "WEBHOOKS", Subjects: []string{"webhooks.>"}, Replicas: 3, MaxBytes: 1 << 30, MaxMsgs: 1000,
+				Storage: nats.MemoryStorage, Retention: nats.WorkQueuePolicy, MaxAge: 72 * time.Hour, Duplicates: 2 * time.Minute}},
+		{name: "name from metadata with a dot", stream: ruleStream{ObjectMeta: objectMeta("web.hooks"), Spec: ruleStreamSpec{Subjects: []string{"a"}}},
+			wantErr: "set spec.name"},
+		{name: "no subjects", stream: ruleStream{ObjectMeta: objectMeta("webhooks")}, wantErr: "spec.subjects is required"},
+		{name: "bad storage", stream: ruleStream{ObjectMeta: objectMeta("webhooks"), Spec: ruleStreamSpec{Subjects: []string{"a"}, Storage: "disk"}},
+			wantErr: "spec.storage"},
+		{name: "bad retention", stream: ruleStream{ObjectMeta: objectMeta("webhooks"), Spec: ruleStreamSpec{Subjects: []string{"a"}, Retention: "forever"}},
+			wantErr: "spec.retention"},
+		{name: "bad max age", stream: ruleStream{ObjectMeta: objectMeta("webhooks"), Spec: ruleStreamSpec{Subjects: []string{"a"}, MaxAge: "3 days"}},
+			wantErr: "spec.maxAge"},
+		{name: "bad duplicate window", stream: ruleStream{ObjectMeta: objectMeta("webhooks"), Spec: ruleStreamSpec{Subjects: []string{"a"}, DuplicateWindow: "soon"}},
+			wantErr: "spec.duplicateWindow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.stream.config()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("config = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileRuleStream(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   *nats.StreamConfig // in NATS before the reconcile
+		spec       ruleStreamSpec
+		wantPhase  string
+		wantErr    string
+		wantStream *nats.StreamConfig // nil: left alone
+	}{
+		{name: "created", spec: ruleStreamSpec{Name: "WEBHOOKS", Subjects: []string{"webhooks.>"}, MaxAge: "24h"},
+			wantPhase: phaseReady,
+			wantStream: &nats.StreamConfig{Name: "WEBHOOKS", Subjects: []string{"webhooks.>"}, Replicas: 1, MaxBytes: -1, MaxMsgs: -1,
+				MaxAge: 24 * time.Hour}},
+		{name: "updated", existing: &nats.StreamConfig{Name: "WEBHOOKS", Subjects: []string{"webhooks.>"}, Replicas: 1, MaxBytes: -1, MaxMsgs: -1},
+			spec:       ruleStreamSpec{Name: "WEBHOOKS", Subjects: []string{"webhooks.>", "alerts.>"}, MaxMsgs: 500},
+			wantPhase:  phaseReady,
+			wantStream: &nats.StreamConfig{Name: "WEBHOOKS", Subjects: []string{"webhooks.>", "alerts.>"}, Replicas: 1, MaxBytes: -1, MaxMsgs: 500}},
+		{name: "storage cannot change", existing: &nats.StreamConfig{Name: "WEBHOOKS", Subjects: []string{"webhooks.>"}, Storage: nats.MemoryStorage},
+			spec:      ruleStreamSpec{Name: "WEBHOOKS", Subjects: []string{"webhooks.>"}},
+			wantPhase: phaseError, wantErr: "cannot be changed"},
+		{name: "invalid spec", spec: ruleStreamSpec{Name: "WEBHOOKS"}, wantPhase: phaseError, wantErr: "spec.subjects is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, srv := newTestOperator(t, &ruleStream{ObjectMeta: objectMeta("webhooks"), Spec: tt.spec})
+			if tt.existing != nil {
+				if _, err := o.js.AddStream(tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			reconcileOnce(t, o.reconcileRuleStream, "webhooks")
+
+			var got ruleStream
+			if err := o.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "webhooks"}, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status.Phase != tt.wantPhase || !strings.Contains(got.Status.Message, tt.wantErr) || got.Status.ObservedGeneration != 2 {
+				t.Fatalf("status = %+v, want %s %q", got.Status, tt.wantPhase, tt.wantErr)
+			}
+			if tt.wantStream == nil {
+				return
+			}
+			cfg, ok := srv.Stream("WEBHOOKS")
+			if !ok || !sameStrings(cfg.Subjects, tt.wantStream.Subjects) || cfg.MaxAge != tt.wantStream.MaxAge || cfg.MaxMsgs != tt.wantStream.MaxMsgs {
+				t.Fatalf("stream = %+v, want %+v", cfg, tt.wantStream)
+			}
+			if got.Status.StreamName != "WEBHOOKS" {
+				t.Fatalf("status = %+v", got.Status)
+			}
+		})
+	}
+}
+
+func TestDeleteRuleStream(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		wantDeleted bool
+	}{
+		{name: "delete", policy: deletionDelete, wantDeleted: true},
+		{name: "retain", policy: deletionRetain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &ruleStream{ObjectMeta: objectMeta("webhooks"), Spec: ruleStreamSpec{Name: "WEBHOOKS", Subjects: []string{"webhooks.>"}, DeletionPolicy: tt.policy}}
+			o, srv := newTestOperator(t, s)
+			reconcileOnce(t, o.reconcileRuleStream, "webhooks")
+			if err := o.Delete(context.Background(), s); err != nil {
+				t.Fatal(err)
+			}
+			// The finalizer holds back a stream with deletionPolicy Delete
+			// until the second pass
+			if _, err := o.reconcileRuleStream(context.Background(), reqFor(s)); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := srv.Stream("WEBHOOKS"); ok == tt.wantDeleted {
+				t.Fatalf("stream exists: %v", ok)
+			}
+			if err := o.Get(context.Background(), client.ObjectKeyFromObject(s), &ruleStream{}); err == nil {
+				t.Fatal("RuleStream still there")
+			}
+		})
+	}
+}
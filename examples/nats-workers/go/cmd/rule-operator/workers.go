@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// The worker binds to its durable consumer with these settings and fails
+// if they differ, so they match consumerMaxDeliver and AckWait in the
+// worker's startWorker
+const (
+	workerMaxDeliver = 3
+	workerAckWait    = 30 * time.Second
+)
+
+// workerAdminPort serves the worker's probes and metrics (ADMIN_ADDR)
+const workerAdminPort = 6060
+
+// workerStreamIndex indexes RuleWorkers by their RuleStream, so a changed
+// stream is applied to its workers at once
+const workerStreamIndex = "spec.stream"
+
+// ruleWorker is a Deployment of webhook workers consuming a RuleStream
+type ruleWorker struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ruleWorkerSpec   `json:"spec"`
+	Status ruleWorkerStatus `json:"status"`
+}
+
+type ruleWorkerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ruleWorker `json:"items"`
+}
+
+func (w *ruleWorker) DeepCopyObject() runtime.Object     { return deepCopy(w) }
+func (l *ruleWorkerList) DeepCopyObject() runtime.Object { return deepCopy(l) }
+
+type ruleWorkerSpec struct {
+	// Stream is a RuleStream in the same namespace
+	Stream string `json:"stream"`
+	// Subject defaults to the stream's first subject, Consumer to
+	// metadata.name, and QueueGroup to Consumer
+	Subject    string `json:"subject,omitempty"`
+	Consumer   string `json:"consumer,omitempty"`
+	QueueGroup string `json:"queueGroup,omitempty"`
+
+	// Image defaults to the operator's WORKER_IMAGE. Replicas is ignored
+	// when Autoscaling is set.
+	Image       string             `json:"image,omitempty"`
+	Replicas    *int               `json:"replicas,omitempty"`
+	Autoscaling *workerAutoscaling `json:"autoscaling,omitempty"`
+
+	// DatabaseURL and OpsDatabaseURL are read by the pods from Secrets
+	DatabaseURL    secretKeyRef  `json:"databaseURL"`
+	OpsDatabaseURL *secretKeyRef `json:"opsDatabaseURL,omitempty"`
+
+	// BatchSize, MaxAckPending, and Fetchers set the worker's variables of
+	// the same names when not 0; Fetchers above 0 makes a pull consumer
+	BatchSize     int `json:"batchSize,omitempty"`
+	MaxAckPending int `json:"maxAckPending,omitempty"`
+	Fetchers      int `json:"fetchers,omitempty"`
+
+	// Env is added to the container's environment and overrides the
+	// variables the operator sets; Resources is the container's
+	Env       []map[string]interface{} `json:"env,omitempty"`
+	Resources map[string]interface{}   `json:"resources,omitempty"`
+
+	// DeletionPolicy Delete deletes the durable consumer when the resource
+	// is deleted; the default Retain keeps it, with its position
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+}
+
+// workerAutoscaling scales the Deployment on the consumer's backlog with a
+// KEDA ScaledObject whose trigger is the operator's external scaler
+type workerAutoscaling struct {
+	// MinReplicas 0 scales the workers to zero while the backlog is at or
+	// below ActivationBacklog
+	MinReplicas *int `json:"minReplicas,omitempty"`
+	MaxReplicas int  `json:"maxReplicas"`
+	// TargetBacklog is the backlog per replica, 100 when 0
+	TargetBacklog     int `json:"targetBacklog,omitempty"`
+	ActivationBacklog int `json:"activationBacklog,omitempty"`
+	// PollingInterval and CooldownPeriod are in seconds; KEDA's defaults
+	// apply when 0
+	PollingInterval int `json:"pollingInterval,omitempty"`
+	CooldownPeriod  int `json:"cooldownPeriod,omitempty"`
+}
+
+type ruleWorkerStatus struct {
+	status        `json:",inline"`
+	StreamName    string `json:"streamName"`
+	Consumer      string `json:"consumer"`
+	Replicas      int    `json:"replicas"`
+	ReadyReplicas int    `json:"readyReplicas"`
+	Pending       int64  `json:"pending"`
+}
+
+// consumerName is the durable consumer the workers share
+func (w *ruleWorker) consumerName() string {
+	if w.Spec.Consumer != "" {
+		return w.Spec.Consumer
+	}
+	return w.Name
+}
+
+// indexWorkerStream is workerStreamIndex's value
+func indexWorkerStream(obj client.Object) []string {
+	return []string{obj.(*ruleWorker).Spec.Stream}
+}
+
+// streamWorkers maps a RuleStream to the RuleWorkers consuming it
+func (o *operator) streamWorkers(ctx context.Context, stream client.Object) []reconcile.Request {
+	var list ruleWorkerList
+	err := o.List(ctx, &list, client.InNamespace(stream.GetNamespace()),
+		client.MatchingFields{workerStreamIndex: stream.GetName()})
+	if err != nil {
+		log.Printf("⚠️  Failed to list RuleWorkers of RuleStream %s/%s: %v", stream.GetNamespace(), stream.GetName(), err)
+		return nil
+	}
+	requests := make([]reconcile.Request, len(list.Items))
+	for i, w := range list.Items {
+		requests[i].NamespacedName = types.NamespacedName{Namespace: w.Namespace, Name: w.Name}
+	}
+	return requests
+}
+
+// reconcileRuleWorker provisions the consumer and Deployment of a
+// RuleWorker. It runs again each RECONCILE_INTERVAL, for the consumer's
+// backlog and changes made outside Kubernetes.
+func (o *operator) reconcileRuleWorker(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var w ruleWorker
+	if err := o.Get(ctx, req.NamespacedName, &w); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	deleting, err := o.finalize(ctx, &w, w.Spec.DeletionPolicy, func() error {
+		return o.deleteWorker(ctx, &w)
+	})
+	if deleting || err != nil {
+		return ctrl.Result{}, err
+	}
+	base := w.DeepCopyObject().(*ruleWorker)
+	phase, err := o.reconcileWorker(ctx, &w)
+	report(ruleWorkerKind, &w, &w.Status.status, phase, err)
+	if w.Status != base.Status {
+		if err := o.setStatus(ctx, &w, base); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: o.interval}, nil
+}
+
+// reconcileWorker provisions the durable consumer and applies the
+// Deployment. It returns Pending until every replica is ready.
+func (o *operator) reconcileWorker(ctx context.Context, w *ruleWorker) (string, error) {
+	if w.Spec.Stream == "" {
+		return "", errors.New("spec.stream is required")
+	}
+	if w.Spec.DatabaseURL.Name == "" || w.Spec.DatabaseURL.Key == "" {
+		return "", errors.New("spec.databaseURL needs a Secret name and key")
+	}
+	var stream ruleStream
+	err := o.Get(ctx, types.NamespacedName{Namespace: w.Namespace, Name: w.Spec.Stream}, &stream)
+	if apierrors.IsNotFound(err) {
+		return "", fmt.Errorf("RuleStream %s not found", w.Spec.Stream)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(stream.Spec.Subjects) == 0 && w.Spec.Subject == "" {
+		return "", fmt.Errorf("RuleStream %s has no subjects", w.Spec.Stream)
+	}
+	streamName := stream.streamName()
+	subject := w.Spec.Subject
+	if subject == "" {
+		subject = stream.Spec.Subjects[0]
+	}
+	queueGroup := w.Spec.QueueGroup
+	if queueGroup == "" {
+		queueGroup = w.consumerName()
+	}
+	w.Status.StreamName, w.Status.Consumer = streamName, w.consumerName()
+
+	info, err := o.ensureConsumer(ctx, streamName, &nats.ConsumerConfig{
+		Durable:       w.consumerName(),
+		AckPolicy:     nats.AckExplicitPolicy,
+		FilterSubject: subject,
+		MaxDeliver:    workerMaxDeliver,
+		AckWait:       workerAckWait,
+		MaxAckPending: w.Spec.MaxAckPending,
+		DeliverGroup:  queueGroup,
+	}, w.Spec.Fetchers > 0)
+	if err != nil {
+		return "", err
+	}
+	w.Status.Pending = int64(info.NumPending)
+
+	if a := w.Spec.Autoscaling; a != nil {
+		if o.scalerAddress == "" {
+			return "", errors.New("spec.autoscaling needs the operator's SCALER_ADDRESS")
+		}
+		if a.MaxReplicas < 1 {
+			return "", errors.New("spec.autoscaling.maxReplicas must be at least 1")
+		}
+	}
+	applied, err := o.apply(ctx, w, o.workerDeployment(w, streamName, subject, queueGroup))
+	if err != nil {
+		return "", fmt.Errorf("failed to apply Deployment: %w", err)
+	}
+	replicas, _, _ := unstructured.NestedInt64(applied.Object, "status", "replicas")
+	ready, _, _ := unstructured.NestedInt64(applied.Object, "status", "readyReplicas")
+	w.Status.Replicas, w.Status.ReadyReplicas = int(replicas), int(ready)
+
+	if w.Spec.Autoscaling == nil {
+		// Autoscaling may have been turned off since the last pass
+		if err := o.remove(ctx, "keda.sh/v1alpha1", "ScaledObject", w.Namespace, w.Name); err != nil {
+			return "", fmt.Errorf("failed to delete ScaledObject: %w", err)
+		}
+	} else if _, err := o.apply(ctx, w, o.workerScaledObject(w, streamName)); err != nil {
+		return "", fmt.Errorf("failed to apply ScaledObject (is KEDA installed?): %w", err)
+	}
+
+	// The Deployment's replicas rather than the spec's, which autoscaling
+	// leaves to KEDA
+	if want, _, _ := unstructured.NestedInt64(applied.Object, "spec", "replicas"); ready < want {
+		return phasePending, nil
+	}
+	return phaseReady, nil
+}
+
+// ensureConsumer creates the durable consumer as the worker would, or
+// updates the filter subject and ack limit of an existing one. A push
+// consumer gets its deliver subject here; pull consumers have none.
+func (o *operator) ensureConsumer(ctx context.Context, stream string, want *nats.ConsumerConfig, pull bool) (*nats.ConsumerInfo, error) {
+	if pull {
+		want.DeliverGroup = ""
+	}
+	info, err := o.js.ConsumerInfo(stream, want.Durable, nats.Context(ctx))
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		return nil, fmt.Errorf("stream %s not found", stream)
+	case errors.Is(err, nats.ErrConsumerNotFound):
+		if !pull {
+			want.DeliverSubject = nats.NewInbox()
+		}
+		if info, err = o.js.AddConsumer(stream, want, nats.Context(ctx)); err != nil {
+			return nil, fmt.Errorf("failed to create consumer %s: %w", want.Durable, err)
+		}
+		log.Printf("📥 Created consumer %s on stream %s", want.Durable, stream)
+		return info, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to look up consumer %s: %w", want.Durable, err)
+	}
+
+	cfg := info.Config
+	if pull != (cfg.DeliverSubject == "") {
+		return nil, fmt.Errorf("consumer %s cannot switch between push and pull; delete it to change fetchers", want.Durable)
+	}
+	if cfg.DeliverGroup != want.DeliverGroup {
+		return nil, fmt.Errorf("consumer %s has queue group %q, which cannot be changed", want.Durable, cfg.DeliverGroup)
+	}
+	if cfg.FilterSubject == want.FilterSubject && (want.MaxAckPending == 0 || cfg.MaxAckPending == want.MaxAckPending) {
+		return info, nil
+	}
+	cfg.FilterSubject = want.FilterSubject
+	if want.MaxAckPending != 0 {
+		cfg.MaxAckPending = want.MaxAckPending
+	}
+	if info, err = o.js.UpdateConsumer(stream, &cfg, nats.Context(ctx)); err != nil {
+		return nil, fmt.Errorf("failed to update consumer %s: %w", want.Durable, err)
+	}
+	log.Printf("📥 Updated consumer %s on stream %s", want.Durable, stream)
+	return info, nil
+}
+
+// workerDeployment is the Deployment running the workers
+func (o *operator) workerDeployment(w *ruleWorker, stream, subject, queueGroup string) map[string]interface{} {
+	labels := map[string]interface{}{
+		"app.kubernetes.io/name":       "rule-engine-webhook-worker",
+		"app.kubernetes.io/instance":   w.Name,
+		"app.kubernetes.io/managed-by": fieldManager,
+	}
+	selector := map[string]interface{}{
+		"app.kubernetes.io/name":     "rule-engine-webhook-worker",
+		"app.kubernetes.io/instance": w.Name,
+	}
+
+	env := []map[string]interface{}{
+		{"name": "NATS_URL", "value": o.natsURL},
+		{"name": "STREAM_NAME", "value": stream},
+		{"name": "CONSUMER_NAME", "value": w.consumerName()},
+		{"name": "QUEUE_GROUP", "value": queueGroup},
+		{"name": "SUBJECT", "value": subject},
+		{"name": "ADMIN_ADDR", "value": ":" + strconv.Itoa(workerAdminPort)},
+		secretEnv("DATABASE_URL", w.Spec.DatabaseURL),
+	}
+	if ref := w.Spec.OpsDatabaseURL; ref != nil {
+		env = append(env, secretEnv("OPS_DATABASE_URL", *ref))
+	}
+	// In a fixed order: a reordered template would roll the pods
+	for _, v := range []struct {
+		name  string
+		value int
+	}{
+		{"BATCH_SIZE", w.Spec.BatchSize},
+		{"MAX_ACK_PENDING", w.Spec.MaxAckPending},
+		{"FETCHERS", w.Spec.Fetchers},
+	} {
+		if v.value != 0 {
+			env = append(env, map[string]interface{}{"name": v.name, "value": strconv.Itoa(v.value)})
+		}
+	}
+	env = overrideEnv(env, w.Spec.Env)
+
+	image := w.Spec.Image
+	if image == "" {
+		image = o.workerImage
+	}
+	container := map[string]interface{}{
+		"name":  "worker",
+		"image": image,
+		"env":   env,
+		"ports": []map[string]interface{}{
+			{"name": "admin", "containerPort": workerAdminPort, "protocol": "TCP"},
+		},
+		"readinessProbe": map[string]interface{}{
+			"httpGet":       map[string]interface{}{"path": "/readyz", "port": "admin"},
+			"periodSeconds": 10,
+		},
+		"livenessProbe": map[string]interface{}{
+			"httpGet":          map[string]interface{}{"path": "/healthz", "port": "admin"},
+			"periodSeconds":    20,
+			"failureThreshold": 3,
+		},
+	}
+	if w.Spec.Resources != nil {
+		container["resources"] = w.Spec.Resources
+	}
+
+	spec := map[string]interface{}{
+		"selector": map[string]interface{}{"matchLabels": selector},
+		"template": map[string]interface{}{
+			"metadata": map[string]interface{}{"labels": labels},
+			"spec": map[string]interface{}{
+				"containers": []interface{}{container},
+			},
+		},
+	}
+	// With autoscaling the operator gives up replicas, so applying does
+	// not undo KEDA's scaling
+	if w.Spec.Autoscaling == nil {
+		replicas := 1
+		if w.Spec.Replicas != nil {
+			replicas = *w.Spec.Replicas
+		}
+		spec["replicas"] = replicas
+	}
+	return map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":      w.Name,
+			"namespace": w.Namespace,
+			"labels":    labels,
+		},
+		"spec": spec,
+	}
+}
+
+// workerScaledObject is the KEDA ScaledObject scaling the Deployment on
+// the consumer's backlog through the operator's external scaler
+func (o *operator) workerScaledObject(w *ruleWorker, stream string) map[string]interface{} {
+	a := w.Spec.Autoscaling
+	target := a.TargetBacklog
+	if target == 0 {
+		target = defaultTargetBacklog
+	}
+	minReplicas := 1
+	if a.MinReplicas != nil {
+		minReplicas = *a.MinReplicas
+	}
+	spec := map[string]interface{}{
+		"scaleTargetRef":  map[string]interface{}{"name": w.Name},
+		"minReplicaCount": minReplicas,
+		"maxReplicaCount": a.MaxReplicas,
+		"triggers": []interface{}{
+			map[string]interface{}{
+				"type": "external",
+				"metadata": map[string]interface{}{
+					"scalerAddress":     o.scalerAddress,
+					"stream":            stream,
+					"consumer":          w.consumerName(),
+					"targetBacklog":     strconv.Itoa(target),
+					"activationBacklog": strconv.Itoa(a.ActivationBacklog),
+				},
+			},
+		},
+	}
+	if a.PollingInterval != 0 {
+		spec["pollingInterval"] = a.PollingInterval
+	}
+	if a.CooldownPeriod != 0 {
+		spec["cooldownPeriod"] = a.CooldownPeriod
+	}
+	return map[string]interface{}{
+		"apiVersion": "keda.sh/v1alpha1",
+		"kind":       "ScaledObject",
+		"metadata": map[string]interface{}{
+			"name":      w.Name,
+			"namespace": w.Namespace,
+			"labels": map[string]interface{}{
+				"app.kubernetes.io/name":       "rule-engine-webhook-worker",
+				"app.kubernetes.io/instance":   w.Name,
+				"app.kubernetes.io/managed-by": fieldManager,
+			},
+		},
+		"spec": spec,
+	}
+}
+
+// secretEnv is an environment variable read from a Secret
+func secretEnv(name string, ref secretKeyRef) map[string]interface{} {
+	return map[string]interface{}{
+		"name": name,
+		"valueFrom": map[string]interface{}{
+			"secretKeyRef": map[string]interface{}{"name": ref.Name, "key": ref.Key},
+		},
+	}
+}
+
+// overrideEnv appends extra to env, dropping variables of env that extra
+// sets again: server-side apply rejects duplicate names
+func overrideEnv(env, extra []map[string]interface{}) []map[string]interface{} {
+	set := make(map[interface{}]bool, len(extra))
+	for _, e := range extra {
+		set[e["name"]] = true
+	}
+	var merged []map[string]interface{}
+	for _, e := range env {
+		if !set[e["name"]] {
+			merged = append(merged, e)
+		}
+	}
+	return append(merged, extra...)
+}
+
+// deleteWorker removes the Deployment and then the durable consumer, so no
+// worker is left bound to it
+func (o *operator) deleteWorker(ctx context.Context, w *ruleWorker) error {
+	if err := o.remove(ctx, "apps/v1", "Deployment", w.Namespace, w.Name); err != nil {
+		return err
+	}
+	stream := w.Status.StreamName
+	if stream == "" {
+		// Never reconciled, so the operator created no consumer
+		return nil
+	}
+	err := o.js.DeleteConsumer(stream, w.consumerName(), nats.Context(ctx))
+	if errors.Is(err, nats.ErrConsumerNotFound) || errors.Is(err, nats.ErrStreamNotFound) {
+		return nil
+	}
+	if err == nil {
+		log.Printf("🗑️  Deleted consumer %s on stream %s", w.consumerName(), stream)
+	}
+	return err
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// testStream is the RuleStream the test workers consume
+var testStream = &ruleStream{ObjectMeta: objectMeta("webhooks"), Spec: ruleStreamSpec{Name: "WEBHOOKS", Subjects: []string{"webhooks.>"}}}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestReconcileRuleWorker(t *testing.T) {
+	dbURL := secretKeyRef{Name: "rules-db", Key: "url"}
+	tests := []struct {
+		name          string
+		spec          ruleWorkerSpec
+		scalerAddress string
+		deployment    *appsv1.Deployment // already there
+		wantPhase     string
+		wantErr       string
+		wantConsumer  nats.ConsumerConfig
+		wantPush      bool
+		wantReplicas  *int32 // nil: left to KEDA
+		wantEnv       map[string]string
+		wantScaled    map[string]interface{} // the trigger's metadata, nil for no ScaledObject
+	}{
+		{name: "push consumer", spec: ruleWorkerSpec{Stream: "webhooks", DatabaseURL: dbURL, Replicas: ptr(2), MaxAckPending: 50},
+			wantPhase:    phasePending,
+			wantConsumer: nats.ConsumerConfig{Durable: "workers", FilterSubject: "webhooks.>", DeliverGroup: "workers", MaxAckPending: 50},
+			wantPush:     true, wantReplicas: ptr(int32(2)),
+			wantEnv: map[string]string{"STREAM_NAME": "WEBHOOKS", "CONSUMER_NAME": "workers", "QUEUE_GROUP": "workers",
+				"SUBJECT": "webhooks.>", "ADMIN_ADDR": ":6060", "MAX_ACK_PENDING": "50", "DATABASE_URL": "secret rules-db/url"}},
+		{name: "pull consumer", spec: ruleWorkerSpec{Stream: "webhooks", DatabaseURL: dbURL, Subject: "webhooks.orders", Consumer: "orders", Fetchers: 2},
+			wantPhase:    phasePending,
+			wantConsumer: nats.ConsumerConfig{Durable: "orders", FilterSubject: "webhooks.orders"},
+			wantReplicas: ptr(int32(1)),
+			wantEnv:      map[string]string{"CONSUMER_NAME": "orders", "SUBJECT": "webhooks.orders", "FETCHERS": "2"}},
+		{name: "ready", spec: ruleWorkerSpec{Stream: "webhooks", DatabaseURL: dbURL},
+			deployment: &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "workers"},
+				Status: appsv1.DeploymentStatus{Replicas: 1, ReadyReplicas: 1}},
+			wantPhase:    phaseReady,
+			wantConsumer: nats.ConsumerConfig{Durable: "workers", FilterSubject: "webhooks.>", DeliverGroup: "workers"},
+			wantPush:     true, wantReplicas: ptr(int32(1))},
+		{name: "env overrides", spec: ruleWorkerSpec{Stream: "webhooks", DatabaseURL: dbURL,
+			Env: []map[string]interface{}{{"name": "SUBJECT", "value": "webhooks.priority"}, {"name": "LOG_LEVEL", "value": "debug"}}},
+			wantPhase:    phasePending,
+			wantConsumer: nats.ConsumerConfig{Durable: "workers", FilterSubject: "webhooks.>", DeliverGroup: "workers"},
+			wantPush:     true, wantReplicas: ptr(int32(1)),
+			wantEnv: map[string]string{"SUBJECT": "webhooks.priority", "LOG_LEVEL": "debug"}},
+		{name: "autoscaled", scalerAddress: "rule-operator.rule-engine:6000",
+			spec: ruleWorkerSpec{Stream: "webhooks", DatabaseURL: dbURL, Replicas: ptr(3),
+				Autoscaling: &workerAutoscaling{MinReplicas: ptr(0), MaxReplicas: 5, ActivationBacklog: 10}},
+			wantPhase:    phaseReady,
+			wantConsumer: nats.ConsumerConfig{Durable: "workers", FilterSubject: "webhooks.>", DeliverGroup: "workers"},
+			wantPush:     true,
+			wantScaled: map[string]interface{}{"scalerAddress": "rule-operator.rule-engine:6000", "stream": "WEBHOOKS",
+				"consumer": "workers", "targetBacklog": "100", "activationBacklog": "10"}},
+		{name: "autoscaled without a scaler", spec: ruleWorkerSpec{Stream: "webhooks", DatabaseURL: dbURL,
+			Autoscaling: &workerAutoscaling{MaxReplicas: 5}},
+			wantPhase: phaseError, wantErr: "SCALER_ADDRESS"},
+		{name: "no stream", spec: ruleWorkerSpec{DatabaseURL: dbURL}, wantPhase: phaseError, wantErr: "spec.stream is required"},
+		{name: "stream not found", spec: ruleWorkerSpec{Stream: "missing", DatabaseURL: dbURL},
+			wantPhase: phaseError, wantErr: "RuleStream missing not found"},
+		{name: "no database", spec: ruleWorkerSpec{Stream: "webhooks"}, wantPhase: phaseError, wantErr: "spec.databaseURL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs := []client.Object{testStream.DeepCopyObject().(client.Object),
+				&ruleWorker{ObjectMeta: objectMeta("workers"), Spec: tt.spec}}
+			if tt.deployment != nil {
+				objs = append(objs, tt.deployment)
+			}
+			o, srv := newTestOperator(t, objs...)
+			o.scalerAddress = tt.scalerAddress
+			srv.AddStream("WEBHOOKS", "webhooks.>")
+			reconcileOnce(t, o.reconcileRuleWorker, "workers")
+
+			var w ruleWorker
+			if err := o.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "workers"}, &w); err != nil {
+				t.Fatal(err)
+			}
+			if w.Status.Phase != tt.wantPhase || !strings.Contains(w.Status.Message, tt.wantErr) {
+				t.Fatalf("status = %+v, want %s %q", w.Status, tt.wantPhase, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+
+			cfg, ok := srv.Consumer("WEBHOOKS", tt.wantConsumer.Durable)
+			if !ok || cfg.FilterSubject != tt.wantConsumer.FilterSubject || cfg.DeliverGroup != tt.wantConsumer.DeliverGroup ||
+				cfg.MaxAckPending != tt.wantConsumer.MaxAckPending || (cfg.DeliverSubject != "") != tt.wantPush ||
+				cfg.MaxDeliver != workerMaxDeliver || cfg.AckWait != workerAckWait {
+				t.Fatalf("consumer = %+v, want %+v", cfg, tt.wantConsumer)
+			}
+			if w.Status.StreamName != "WEBHOOKS" || w.Status.Consumer != tt.wantConsumer.Durable {
+				t.Fatalf("status = %+v", w.Status)
+			}
+
+			var d appsv1.Deployment
+			if err := o.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "workers"}, &d); err != nil {
+				t.Fatal(err)
+			}
+			if ref := metav1.GetControllerOf(&d); ref == nil || ref.Kind != ruleWorkerKind || ref.Name != "workers" || ref.APIVersion != groupVersion.String() {
+				t.Fatalf("controller = %+v", ref)
+			}
+			if !reflect.DeepEqual(d.Spec.Replicas, tt.wantReplicas) {
+				t.Fatalf("replicas = %v, want %v", d.Spec.Replicas, tt.wantReplicas)
+			}
+			env := map[string]string{}
+			for _, e := range d.Spec.Template.Spec.Containers[0].Env {
+				env[e.Name] = e.Value
+				if ref := e.ValueFrom; ref != nil && ref.SecretKeyRef != nil {
+					env[e.Name] = "secret " + ref.SecretKeyRef.Name + "/" + ref.SecretKeyRef.Key
+				}
+			}
+			for name, value := range tt.wantEnv {
+				if env[name] != value {
+					t.Errorf("%s = %q, want %q", name, env[name], value)
+				}
+			}
+			if image := d.Spec.Template.Spec.Containers[0].Image; image != "worker:test" {
+				t.Fatalf("image = %s", image)
+			}
+
+			scaled := &unstructured.Unstructured{}
+			scaled.SetAPIVersion("keda.sh/v1alpha1")
+			scaled.SetKind("ScaledObject")
+			err := o.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "workers"}, scaled)
+			if tt.wantScaled == nil {
+				if err == nil {
+					t.Fatal("ScaledObject applied")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			triggers, _, _ := unstructured.NestedSlice(scaled.Object, "spec", "triggers")
+			if len(triggers) != 1 || !reflect.DeepEqual(triggers[0].(map[string]interface{})["metadata"], tt.wantScaled) {
+				t.Fatalf("triggers = %v", triggers)
+			}
+			if ref := metav1.GetControllerOf(scaled); ref == nil || ref.Name != "workers" {
+				t.Fatalf("controller = %+v", ref)
+			}
+		})
+	}
+}
+
+func TestReconcileRuleWorkerAutoscalingOff(t *testing.T) {
+	w := &ruleWorker{ObjectMeta: objectMeta("workers"), Spec: ruleWorkerSpec{Stream: "webhooks", DatabaseURL: secretKeyRef{Name: "db", Key: "url"},
+		Autoscaling: &workerAutoscaling{MaxReplicas: 5}}}
+	o, srv := newTestOperator(t, testStream.DeepCopyObject().(client.Object), w)
+	o.scalerAddress = "scaler:6000"
+	srv.AddStream("WEBHOOKS", "webhooks.>")
+	reconcileOnce(t, o.reconcileRuleWorker, "workers")
+
+	if err := o.Get(context.Background(), client.ObjectKeyFromObject(w), w); err != nil {
+		t.Fatal(err)
+	}
+	w.Spec.Autoscaling, w.Spec.Replicas = nil, ptr(4)
+	if err := o.Update(context.Background(), w); err != nil {
+		t.Fatal(err)
+	}
+	reconcileOnce(t, o.reconcileRuleWorker, "workers")
+
+	scaled := &unstructured.Unstructured{}
+	scaled.SetAPIVersion("keda.sh/v1alpha1")
+	scaled.SetKind("ScaledObject")
+	if err := o.Get(context.Background(), client.ObjectKeyFromObject(w), scaled); err == nil {
+		t.Fatal("ScaledObject not deleted")
+	}
+	var d appsv1.Deployment
+	if err := o.Get(context.Background(), client.ObjectKeyFromObject(w), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Spec.Replicas == nil || *d.Spec.Replicas != 4 {
+		t.Fatalf("replicas = %v", d.Spec.Replicas)
+	}
+}
+
+func TestDeleteRuleWorker(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		wantConsumer bool
+	}{
+		{name: "delete", policy: deletionDelete},
+		{name: "retain", policy: deletionRetain, wantConsumer: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &ruleWorker{ObjectMeta: objectMeta("workers"), Spec: ruleWorkerSpec{Stream: "webhooks",
+				DatabaseURL: secretKeyRef{Name: "db", Key: "url"}, DeletionPolicy: tt.policy}}
+			o, srv := newTestOperator(t, testStream.DeepCopyObject().(client.Object), w)
+			srv.AddStream("WEBHOOKS", "webhooks.>")
+			reconcileOnce(t, o.reconcileRuleWorker, "workers")
+			if err := o.Delete(context.Background(), w); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := o.reconcileRuleWorker(context.Background(), reqFor(w)); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok := srv.Consumer("WEBHOOKS", "workers"); ok != tt.wantConsumer {
+				t.Fatalf("consumer exists: %v", ok)
+			}
+			// With Retain, only the garbage collector, which the fake API
+			// server does not run, removes the Deployment
+			err := o.Get(context.Background(), client.ObjectKeyFromObject(w), &appsv1.Deployment{})
+			if (err == nil) != tt.wantConsumer {
+				t.Fatalf("Deployment: %v", err)
+			}
+		})
+	}
+}
+
+func TestStreamWorkers(t *testing.T) {
+	o, _ := newTestOperator(t,
+		&ruleWorker{ObjectMeta: objectMeta("a"), Spec: ruleWorkerSpec{Stream: "webhooks"}},
+		&ruleWorker{ObjectMeta: objectMeta("b"), Spec: ruleWorkerSpec{Stream: "alerts"}},
+		&ruleWorker{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "c"}, Spec: ruleWorkerSpec{Stream: "webhooks"}},
+		&ruleWorker{ObjectMeta: objectMeta("d"), Spec: ruleWorkerSpec{Stream: "webhooks"}},
+	)
+	tests := []struct {
+		name   string
+		stream client.Object
+		want   []string
+	}{
+		{name: "consumed", stream: &ruleStream{ObjectMeta: objectMeta("webhooks")}, want: []string{"rules/a", "rules/d"}},
+		{name: "other namespace", stream: &ruleStream{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "webhooks"}}, want: []string{"other/c"}},
+		{name: "unused", stream: &ruleStream{ObjectMeta: objectMeta("audit")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestNames(o.streamWorkers(context.Background(), tt.stream)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("requests = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// requestNames are the namespace/name of requests
+func requestNames(requests []reconcile.Request) []string {
+	var names []string
+	for _, r := range requests {
+		names = append(names, r.String())
+	}
+	return names
+}
+
+func TestOverrideEnv(t *testing.T) {
+	env := []map[string]interface{}{{"name": "A", "value": "1"}, {"name": "B", "value": "2"}}
+	tests := []struct {
+		name  string
+		extra []map[string]interface{}
+		want  []string
+	}{
+		{name: "none", want: []string{"A=1", "B=2"}},
+		{name: "added", extra: []map[string]interface{}{{"name": "C", "value": "3"}}, want: []string{"A=1", "B=2", "C=3"}},
+		{name: "overridden", extra: []map[string]interface{}{{"name": "A", "value": "9"}}, want: []string{"B=2", "A=9"}},
+		{name: "from a secret", extra: []map[string]interface{}{secretEnv("B", secretKeyRef{Name: "s", Key: "k"})},
+			want: []string{"A=1", "B=<nil>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range overrideEnv(env, tt.extra) {
+				got = append(got, e["name"].(string)+"="+toString(e["value"]))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("env = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func toString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return "<nil>"
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("apikey create", "Issue a gateway API key", apiKeyCreate)
+	register("apikey list", "List gateway API keys", apiKeyList)
+	register("apikey rotate", "Replace an API key, keeping the old one for a grace period", apiKeyRotate)
+	register("apikey revoke", "Stop an API key from working", apiKeyRevoke)
+}
+
+func apiKeyCreate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("apikey create")
+	name := fs.String("name", "", "key name, recorded as the actor of changes made with it")
+	roles := fs.String("roles", ruleengine.RoleViewer, "comma-separated roles: "+strings.Join(ruleengine.Roles, ", "))
+	rulesets := fs.String("rulesets", "", "comma-separated rule set ids the key is limited to (default all)")
+	tenant := fs.String("tenant", "", "tenant the key belongs to")
+	expires := fs.Duration("expires", 0, "lifetime, e.g. 2160h; 0 never expires")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	key := ruleengine.APIKey{Name: *name, Roles: splitFlag(*roles), Tenant: *tenant}
+	for _, id := range splitFlag(*rulesets) {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("invalid rule set id %q", id)
+		}
+		key.RuleSetIDs = append(key.RuleSetIDs, n)
+	}
+	if *expires > 0 {
+		t := time.Now().Add(*expires)
+		key.ExpiresAt = &t
+	}
+
+	// Creates the key table on first use
+	if err := client.EnableAPIKeys(ctx); err != nil {
+		return err
+	}
+	created, secret, err := client.CreateAPIKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	printSecret(created, secret)
+	return nil
+}
+
+func apiKeyList(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("apikey list")
+	all := fs.Bool("all", false, "include revoked and expired keys")
+	fs.Parse(args)
+
+	keys, err := client.ListAPIKeys(ctx, *all)
+	if err != nil {
+		return err
+	}
+	return printJSON(keys)
+}
+
+func apiKeyRotate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("apikey rotate")
+	id := fs.Int("id", 0, "API key id")
+	grace := fs.Duration("grace", 24*time.Hour, "how long the old key keeps working")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id)}); err != nil {
+		return err
+	}
+	created, secret, err := client.RotateAPIKey(ctx, *id, *grace)
+	if err != nil {
+		return err
+	}
+	printSecret(created, secret)
+	return nil
+}
+
+func apiKeyRevoke(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("apikey revoke")
+	id := fs.Int("id", 0, "API key id")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id)}); err != nil {
+		return err
+	}
+	return client.RevokeAPIKey(ctx, *id)
+}
+
+// printSecret prints the secret alone on stdout so it can be captured, and
+// the key's details on stderr
+func printSecret(key *ruleengine.APIKey, secret string) {
+	fmt.Fprintf(os.Stderr, "Created API key %d (%s) with roles %s. Store the key now; it cannot be shown again.\n",
+		key.ID, key.Name, strings.Join(key.Roles, ", "))
+	fmt.Println(secret)
+}
+
+// splitFlag splits a comma-separated flag value, dropping empty entries
+func splitFlag(value string) []string {
+	var out []string
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("audit install", "Install the rule change audit log triggers", auditInstall)
+	register("audit list", "Show who changed which rules", auditList)
+}
+
+func auditInstall(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("audit install")
+	fs.Parse(args)
+
+	return client.InstallAuditLog(ctx)
+}
+
+func auditList(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("audit list")
+	rule := fs.String("rule", "", "rule name")
+	actor := fs.String("actor", "", "actor that made the change")
+	action := fs.String("action", "", "create, update, enable, disable, save_version, activate, delete_version, or delete")
+	since := fs.String("since", "", "RFC 3339 time or duration ago (e.g. 24h)")
+	until := fs.String("until", "", "RFC 3339 time or duration ago")
+	limit := fs.Int("limit", 100, "maximum entries")
+	fs.Parse(args)
+
+	filter := ruleengine.AuditFilter{Rule: *rule, Actor: *actor, Action: *action, Limit: *limit}
+	var err error
+	if filter.Since, err = parseTime(*since); err != nil {
+		return err
+	}
+	if filter.Until, err = parseTime(*until); err != nil {
+		return err
+	}
+
+	entries, err := client.ListAuditLog(ctx, filter)
+	if err != nil {
+		return err
+	}
+	return printJSON(entries)
+}
+
+// parseTime accepts an RFC 3339 timestamp or a duration before now
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q (want RFC 3339 or a duration like 24h)", value)
+	}
+	return t, nil
+}
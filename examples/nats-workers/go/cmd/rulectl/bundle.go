@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("ruleset export", "Export a rule set as a JSON or YAML bundle", rulesetExport)
+	register("ruleset import", "Import a rule set bundle", rulesetImport)
+}
+
+func rulesetExport(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("ruleset export")
+	id := fs.Int("id", 0, "rule set id")
+	format := fs.String("format", "yaml", "yaml or json")
+	destinations := fs.String("destinations", "", "comma-separated webhook names to include")
+	out := fs.String("out", "-", "output file ('-' for stdout)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id)}); err != nil {
+		return err
+	}
+
+	var opts ruleengine.ExportOptions
+	for _, name := range strings.Split(*destinations, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			opts.Destinations = append(opts.Destinations, name)
+		}
+	}
+
+	bundle, err := client.ExportRuleSet(ctx, *id, opts)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch *format {
+	case "yaml":
+		data, err = yaml.Marshal(bundle)
+	case "json":
+		data, err = json.MarshalIndent(bundle, "", "  ")
+		data = append(data, '\n')
+	default:
+		return fmt.Errorf("unknown format %q (want yaml or json)", *format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *out == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*out, data, 0o644)
+}
+
+func rulesetImport(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("ruleset import")
+	file := fs.String("file", "", "bundle file, JSON or YAML ('-' for stdin)")
+	strategy := fs.String("on-conflict", "skip", "skip, overwrite, or rename")
+	suffix := fs.String("rename-suffix", "_imported", "suffix for renamed objects")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"file": *file}); err != nil {
+		return err
+	}
+	data, err := readInput(*file)
+	if err != nil {
+		return err
+	}
+
+	// JSON is valid YAML, so one decoder handles both formats
+	var bundle ruleengine.Bundle
+	if err := yaml.Unmarshal(data, &bundle); err != nil {
+		return fmt.Errorf("invalid bundle: %w", err)
+	}
+
+	report, err := client.ImportBundle(ctx, &bundle, ruleengine.ImportOptions{
+		Strategy:     ruleengine.ConflictStrategy(*strategy),
+		RenameSuffix: *suffix,
+	})
+	if err != nil {
+		return err
+	}
+	return printJSON(report)
+}
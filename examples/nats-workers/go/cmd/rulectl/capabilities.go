@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("capabilities", "Report which features the database's rule engine functions support", capabilities)
+}
+
+func capabilities(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("capabilities")
+	asJSON := fs.Bool("json", false, "print JSON")
+	strict := fs.Bool("strict", false, "exit 1 if any capability is unavailable")
+	fs.Parse(args)
+
+	extension, err := client.ExtensionVersion(ctx)
+	if err != nil && !errors.Is(err, ruleengine.ErrExtensionNotInstalled) {
+		return err
+	}
+	report, err := client.Capabilities(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if err := printJSON(map[string]interface{}{
+			"extension_version":   extension,
+			"extension_supported": extension != "" && ruleengine.ExtensionSupported(extension),
+			"capabilities":        report,
+		}); err != nil {
+			return err
+		}
+	} else {
+		switch {
+		case extension == "":
+			fmt.Printf("Extension: not installed\n\n")
+		case !ruleengine.ExtensionSupported(extension):
+			fmt.Printf("Extension: %s (unsupported, want %s up to %d.x)\n\n", extension, ruleengine.MinExtensionVersion, ruleengine.MaxExtensionMajor)
+		default:
+			fmt.Printf("Extension: %s\n\n", extension)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CAPABILITY\tAVAILABLE\tDATABASE\tMISSING\tDESCRIPTION")
+		for _, c := range report {
+			database, missing := "primary", "-"
+			if c.Ops {
+				database = "ops"
+			}
+			if len(c.Missing) > 0 {
+				missing = strings.Join(c.Missing, ", ")
+			}
+			fmt.Fprintf(w, "%s\t%t\t%s\t%s\t%s\n", c.Name, c.Available, database, missing, c.Description)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if *strict {
+		for _, c := range report {
+			if !c.Available {
+				os.Exit(1)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("webhook capture", "Record a webhook's requests and responses for debugging", webhookCapture)
+	register("messages capture", "Record the webhook requests and responses of one message for debugging", messagesCapture)
+	register("webhook captures", "Show recorded requests and responses, or export them as a HAR file", webhookCaptures)
+}
+
+func webhookCapture(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("webhook capture")
+	id := fs.Int("id", 0, "webhook id")
+	window := fs.Duration("for", time.Hour, "how long to capture")
+	stop := fs.Bool("stop", false, "stop capturing")
+	fs.Parse(args)
+
+	if *id == 0 {
+		return fmt.Errorf("-id is required")
+	}
+	if *stop {
+		if err := client.CaptureDestination(ctx, *id, time.Time{}); err != nil {
+			return err
+		}
+		fmt.Printf("Webhook %d is no longer captured\n", *id)
+		return nil
+	}
+	until := time.Now().Add(*window)
+	if err := client.CaptureDestination(ctx, *id, until); err != nil {
+		return err
+	}
+	fmt.Printf("Capturing webhook %d until %s (workers notice within 30s)\n", *id, until.Format(time.RFC3339))
+	return nil
+}
+
+func messagesCapture(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("messages capture")
+	id := fs.String("id", "", "Nats-Msg-Id or trace ID (X-Request-Id) of the message")
+	window := fs.Duration("for", 24*time.Hour, "how long to capture its deliveries")
+	stop := fs.Bool("stop", false, "stop capturing")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": *id}); err != nil {
+		return err
+	}
+	if *stop {
+		if err := client.CaptureMessage(ctx, *id, time.Time{}); err != nil {
+			return err
+		}
+		fmt.Printf("Message %s is no longer captured\n", *id)
+		return nil
+	}
+	until := time.Now().Add(*window)
+	if err := client.CaptureMessage(ctx, *id, until); err != nil {
+		return err
+	}
+	fmt.Printf("Capturing deliveries of %s until %s (workers notice within 30s)\n", *id, until.Format(time.RFC3339))
+	return nil
+}
+
+func webhookCaptures(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("webhook captures")
+	id := fs.Int("id", 0, "only this webhook")
+	trace := fs.String("trace", "", "only the message with this trace ID (X-Request-Id)")
+	message := fs.String("message", "", "only the message with this Nats-Msg-Id")
+	since := fs.Duration("since", 0, "only captures this recent, e.g. 1h")
+	limit := fs.Int("limit", 100, "maximum captures")
+	har := fs.String("har", "", "write the captures to this HAR file (- for stdout)")
+	asJSON := fs.Bool("json", false, "print the captures as JSON")
+	fs.Parse(args)
+
+	filter := ruleengine.CaptureFilter{WebhookID: *id, TraceID: *trace, MessageID: *message, Limit: *limit}
+	if *since > 0 {
+		filter.Since = time.Now().Add(-*since)
+	}
+	captures, err := client.ListCaptures(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *har != "":
+		out, err := ruleengine.CapturesHAR(captures)
+		if err != nil {
+			return err
+		}
+		if *har == "-" {
+			_, err = os.Stdout.Write(append(out, '\n'))
+			return err
+		}
+		if err := os.WriteFile(*har, out, 0o600); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %d capture(s) to %s\n", len(captures), *har)
+		return nil
+	case *asJSON:
+		return printJSON(captures)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCAPTURED\tDESTINATION\tREQUEST\tSTATUS\tMS\tTRACE")
+	for _, c := range captures {
+		request, status := "(encrypted)", "-"
+		if !c.Encrypted {
+			request = c.Request.Method + " " + c.Request.URL
+		}
+		if c.Status != 0 {
+			status = fmt.Sprint(c.Status)
+		} else if c.Error != "" {
+			status = "error"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			c.ID, c.CapturedAt.Format(time.RFC3339), c.Destination, request, status, c.DurationMs, c.TraceID)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("ruleset conflicts", "Find rules that can fire together and write the same field", rulesetConflicts)
+}
+
+func rulesetConflicts(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("ruleset conflicts")
+	id := fs.Int("id", 0, "rule set id")
+	overlaps := fs.Bool("overlaps", false, "also report overlapping rules without conflicting writes")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id)}); err != nil {
+		return err
+	}
+	report, err := client.DetectConflicts(ctx, *id, ruleengine.ConflictOptions{Overlaps: *overlaps})
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		for _, c := range report.Conflicts {
+			fmt.Printf("%s: %s and %s %s\n", c.Kind, c.Rules[0], c.Rules[1], c.Detail)
+			if c.Example != nil {
+				example, _ := json.Marshal(c.Example)
+				fmt.Printf("  e.g. %s\n", example)
+			}
+		}
+		if len(report.Unanalyzed) > 0 {
+			fmt.Printf("Not analyzed (complex conditions): %v\n", report.Unanalyzed)
+		}
+	}
+
+	// Non-zero exit for CI when rules contradict or stack
+	var conflicts int
+	for _, c := range report.Conflicts {
+		if c.Kind == ruleengine.ConflictContradiction || c.Kind == ruleengine.ConflictDoubleWrite {
+			conflicts++
+		}
+	}
+	if conflicts > 0 {
+		return fmt.Errorf("%d conflicting rule pairs in rule set %d", conflicts, *id)
+	}
+	return nil
+}
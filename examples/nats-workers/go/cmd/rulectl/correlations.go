@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("correlation create", "Join events by a key within a time window into a composite event", correlationCreate)
+	register("correlation list", "List correlations", correlationList)
+	register("correlation delete", "Remove a correlation and its partial matches", correlationDelete)
+	register("correlation matches", "Show a correlation's recent matches", correlationMatches)
+	register("correlation record", "Apply a JSON event as if it arrived on a subject", correlationRecord)
+}
+
+func correlationCreate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("correlation create")
+	name := fs.String("name", "", "correlation name")
+	steps := fs.String("steps", "", "comma-separated subject:key_path steps in order, e.g. order.created:id,payment.failed:order_id")
+	within := fs.Duration("within", 0, "time from the first step to the last, e.g. 30m")
+	emit := fs.String("emit", "", "NATS subject composite events are published to")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "steps": *steps, "within": nonZero(int(*within)), "emit": *emit}); err != nil {
+		return err
+	}
+	corr := ruleengine.Correlation{Name: *name, Within: *within, EmitSubject: *emit}
+	for _, step := range strings.Split(*steps, ",") {
+		subject, keyPath, ok := strings.Cut(strings.TrimSpace(step), ":")
+		if !ok {
+			return fmt.Errorf("invalid step %q: want subject:key_path", step)
+		}
+		corr.Steps = append(corr.Steps, ruleengine.CorrelationStep{Subject: subject, KeyPath: keyPath})
+	}
+	// Creates the correlation tables on first use
+	if err := client.EnableCorrelations(ctx); err != nil {
+		return err
+	}
+	return client.CreateCorrelation(ctx, corr)
+}
+
+func correlationList(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("correlation list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	correlations, err := client.ListCorrelations(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(correlations)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTEPS\tWITHIN\tEMIT")
+	for _, corr := range correlations {
+		steps := make([]string, len(corr.Steps))
+		for i, step := range corr.Steps {
+			steps[i] = step.Subject + ":" + step.KeyPath
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", corr.Name, strings.Join(steps, " → "), corr.Within, corr.EmitSubject)
+	}
+	return w.Flush()
+}
+
+func correlationDelete(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("correlation delete")
+	name := fs.String("name", "", "correlation name")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	return client.DeleteCorrelation(ctx, *name)
+}
+
+func correlationMatches(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("correlation matches")
+	name := fs.String("name", "", "correlation name")
+	limit := fs.Int("limit", 20, "matches to show")
+	asJSON := fs.Bool("json", false, "print JSON, including the events")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	matches, err := client.ListCorrelationMatches(ctx, *name, *limit)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(matches)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKEY\tSTARTED\tMATCHED\tPUBLISHED")
+	for _, m := range matches {
+		published := "pending"
+		if m.PublishedAt != nil {
+			published = m.PublishedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", m.ID, m.Key, m.StartedAt.Format(time.RFC3339),
+			m.MatchedAt.Format(time.RFC3339), published)
+	}
+	return w.Flush()
+}
+
+func correlationRecord(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("correlation record")
+	subject := fs.String("subject", "", "subject the event arrived on")
+	file := fs.String("event", "", "JSON event file ('-' for stdin)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"subject": *subject, "event": *file}); err != nil {
+		return err
+	}
+	event, err := readFacts(*file)
+	if err != nil {
+		return err
+	}
+	matches, err := client.RecordCorrelationEvent(ctx, *subject, event)
+	if err != nil {
+		return err
+	}
+	// Matches recorded here are published by a worker's outbox task
+	for _, m := range matches {
+		fmt.Printf("Completed %s for %s (match %d)\n", m.Correlation, m.Key, m.ID)
+	}
+	if len(matches) == 0 {
+		fmt.Println("No correlation completed")
+	}
+	return nil
+}
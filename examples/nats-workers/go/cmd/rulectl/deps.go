@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("graph", "Print the dependency graph of rules, fields, tables, and destinations", graph)
+	register("impact", "Show what changing a rule, field, column, table, or destination affects", impact)
+}
+
+func graph(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("graph")
+	format := fs.String("format", "json", "json or dot (Graphviz)")
+	fs.Parse(args)
+
+	g, err := client.DependencyGraph(ctx)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "json":
+		return printJSON(g)
+	case "dot":
+		fmt.Print(g.DOT())
+		return nil
+	default:
+		return fmt.Errorf("unknown --format %q (want json or dot)", *format)
+	}
+}
+
+func impact(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("impact")
+	rule := fs.String("rule", "", "rule name")
+	field := fs.String("field", "", "fact field, e.g. Order.Amount")
+	column := fs.String("column", "", "column, optionally table-qualified, e.g. orders.amount")
+	table := fs.String("table", "", "table name")
+	destination := fs.String("destination", "", "webhook or action name")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	var targets []string
+	for kind, name := range map[string]string{
+		ruleengine.NodeRule: *rule, ruleengine.NodeField: *field, "column": *column,
+		ruleengine.NodeTable: *table, ruleengine.NodeDestination: *destination,
+	} {
+		if name != "" {
+			targets = append(targets, kind+":"+name)
+		}
+	}
+	if len(targets) != 1 {
+		return fmt.Errorf("exactly one of --rule, --field, --column, --table, or --destination is required")
+	}
+
+	g, err := client.DependencyGraph(ctx)
+	if err != nil {
+		return err
+	}
+	report, err := g.Impact(targets[0])
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(report)
+	}
+
+	if len(report.Reasons) == 0 {
+		fmt.Printf("Nothing depends on %s\n", report.Target)
+		return nil
+	}
+	fmt.Printf("Changing %s may affect:\n", report.Target)
+	for _, section := range []struct {
+		title string
+		names []string
+	}{
+		{"Rules", report.Rules},
+		{"Rule sets", report.RuleSets},
+		{"Fields", report.Fields},
+		{"Destinations", report.Destinations},
+		{"Match views", report.MatchViews},
+	} {
+		if len(section.names) > 0 {
+			fmt.Printf("  %-13s %s\n", section.title+":", strings.Join(section.names, ", "))
+		}
+	}
+	fmt.Println("\nBecause:")
+	for _, r := range report.Reasons {
+		fmt.Printf("  %s via %s (%s)\n", r.Node, r.Via, r.Edge)
+	}
+	return nil
+}
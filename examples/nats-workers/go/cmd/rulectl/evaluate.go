@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("evaluate", "Evaluate a rule set against a JSON facts file", evaluate)
+	register("evaluate-batch", "Evaluate a rule set against newline-delimited JSON facts", evaluateBatch)
+	register("evaluate-stream", "Evaluate millions of newline-delimited JSON facts via COPY", evaluateStream)
+}
+
+func evaluate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("evaluate")
+	id := fs.Int("ruleset", 0, "rule set id")
+	file := fs.String("facts", "", "JSON facts file ('-' for stdin)")
+	trace := fs.Bool("trace", false, "include the engine trace")
+	explain := fs.Bool("explain", false, "report which conditions of each rule matched and the values compared")
+	windows := fs.Bool("windows", false, "add window aggregates to the facts as Windows.<name>")
+	responses := fs.Bool("responses", false, "add facts stored from webhook responses as Responses.<name>")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"ruleset": nonZero(*id), "facts": *file}); err != nil {
+		return err
+	}
+	if *windows {
+		if err := client.EnableWindows(ctx); err != nil {
+			return err
+		}
+	}
+	if *responses {
+		if err := client.EnableResponseFacts(ctx); err != nil {
+			return err
+		}
+	}
+	facts, err := readFacts(*file)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.EvaluateWithOptions(ctx, *id, facts, ruleengine.EvaluateOptions{Explain: *explain})
+	if err != nil {
+		return err
+	}
+	if !*trace {
+		result.Trace = nil
+	}
+	return printJSON(result)
+}
+
+// readFacts reads a JSON facts document from a file ('-' for stdin)
+func readFacts(path string) (map[string]interface{}, error) {
+	data, err := readInput(path)
+	if err != nil {
+		return nil, err
+	}
+	var facts map[string]interface{}
+	if err := json.Unmarshal(data, &facts); err != nil {
+		return nil, fmt.Errorf("invalid facts JSON: %w", err)
+	}
+	return facts, nil
+}
+
+func evaluateBatch(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("evaluate-batch")
+	id := fs.Int("ruleset", 0, "rule set id")
+	file := fs.String("facts", "", "newline-delimited JSON facts file ('-' for stdin)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"ruleset": nonZero(*id), "facts": *file}); err != nil {
+		return err
+	}
+	data, err := readInput(*file)
+	if err != nil {
+		return err
+	}
+
+	var docs []interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc map[string]interface{}
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("invalid facts JSON in document %d: %w", len(docs)+1, err)
+		}
+		docs = append(docs, doc)
+	}
+
+	results, err := client.EvaluateBatch(ctx, *id, docs)
+	if err != nil {
+		return err
+	}
+
+	// One line per input document, in input order
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range results {
+		line := map[string]interface{}{"facts": r.Facts}
+		if r.Err != nil {
+			line = map[string]interface{}{"error": r.Err.Error()}
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func evaluateStream(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("evaluate-stream")
+	id := fs.Int("ruleset", 0, "rule set id")
+	file := fs.String("facts", "", "newline-delimited JSON facts file ('-' for stdin)")
+	out := fs.String("out", "-", "output file ('-' for stdout)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"ruleset": nonZero(*id), "facts": *file}); err != nil {
+		return err
+	}
+	in := io.Reader(os.Stdin)
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	stats, err := client.EvaluateStream(ctx, *id, in, w)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Evaluated %d documents (%d failed) in %s\n", stats.Documents, stats.Failed, stats.Duration.Round(time.Millisecond))
+	return nil
+}
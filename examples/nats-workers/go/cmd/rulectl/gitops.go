@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("gitops sync", "Apply rule YAML files from a Git repository", gitopsSync)
+	register("gitops status", "Show the commit each GitOps-managed rule came from", gitopsStatus)
+}
+
+func gitopsSync(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("gitops sync")
+	repo := fs.String("repo", "", "Git repository URL or path")
+	ref := fs.String("ref", "main", "branch, tag, or commit to sync")
+	dir := fs.String("path", ".", "directory of rule files within the repository")
+	workdir := fs.String("workdir", filepath.Join(os.TempDir(), "rulectl-gitops"), "local checkout directory")
+	interval := fs.Duration("interval", 0, "poll interval; 0 syncs once and exits")
+	prune := fs.Bool("prune", false, "disable previously synced rules whose files were removed")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"repo": *repo}); err != nil {
+		return err
+	}
+
+	var last string
+	for {
+		commit, err := checkout(ctx, *repo, *ref, *workdir)
+		if err == nil && commit != last {
+			err = syncCommit(ctx, client, commit, filepath.Join(*workdir, *dir), *workdir, *prune)
+			if err == nil {
+				last = commit
+			}
+		}
+		if *interval == 0 {
+			return err
+		}
+		if err != nil {
+			// Keep watching; the next commit may fix the problem
+			log.Printf("gitops sync: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+func syncCommit(ctx context.Context, client *ruleengine.Client, commit, dir, root string, prune bool) error {
+	files, err := loadRuleFiles(dir, root)
+	if err != nil {
+		return err
+	}
+	result, err := client.SyncRules(ctx, commit, files, prune)
+	if err != nil {
+		return fmt.Errorf("commit %s: %w", commit, err)
+	}
+	return printJSON(result)
+}
+
+// checkout clones or fetches repo into workdir, checks out ref detached and
+// returns the commit SHA
+func checkout(ctx context.Context, repo, ref, workdir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(workdir, ".git")); os.IsNotExist(err) {
+		if _, err := git(ctx, "", "clone", "--quiet", "--no-checkout", repo, workdir); err != nil {
+			return "", err
+		}
+	}
+	if _, err := git(ctx, workdir, "fetch", "--quiet", "--tags", repo, ref); err != nil {
+		return "", err
+	}
+	if _, err := git(ctx, workdir, "checkout", "--quiet", "--force", "--detach", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	return git(ctx, workdir, "rev-parse", "HEAD")
+}
+
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// loadRuleFiles reads every *.yaml/*.yml file under dir, one rule per file.
+// Paths are recorded relative to the repository root.
+func loadRuleFiles(dir, root string) ([]ruleengine.RuleFile, error) {
+	var files []ruleengine.RuleFile
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		var f ruleengine.RuleFile
+		if err := yaml.Unmarshal(data, &f); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		f.Path = filepath.ToSlash(rel)
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+func gitopsStatus(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("gitops status")
+	fs.Parse(args)
+
+	states, err := client.ListGitOpsState(ctx)
+	if err != nil {
+		return err
+	}
+	return printJSON(states)
+}
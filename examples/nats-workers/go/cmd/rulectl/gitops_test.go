@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRuleFiles(t *testing.T) {
+	root := t.TempDir()
+	write := func(rel, content string) {
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("rules/b.yml", "name: B\nversion: 1.0.0\ngrl: rule B {}\nenabled: false\n")
+	write("rules/nested/a.yaml", "name: A\nversion: 2.0.0\ngrl: |\n  rule A {}\n")
+	write("rules/README.md", "not a rule")
+	write("rules/.git/config.yaml", "name: ignored")
+
+	files, err := loadRuleFiles(filepath.Join(root, "rules"), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("loaded %d files, want 2: %+v", len(files), files)
+	}
+	if files[0].Path != "rules/b.yml" || files[1].Path != "rules/nested/a.yaml" {
+		t.Fatalf("paths = %q, %q", files[0].Path, files[1].Path)
+	}
+	if files[0].Enabled == nil || *files[0].Enabled || files[1].Enabled != nil {
+		t.Fatal("enabled was not read")
+	}
+	if files[1].GRL != "rule A {}\n" {
+		t.Fatalf("grl = %q", files[1].GRL)
+	}
+
+	write("rules/bad.yaml", "name: [")
+	if _, err := loadRuleFiles(filepath.Join(root, "rules"), root); err == nil || !strings.Contains(err.Error(), "rules/bad.yaml") {
+		t.Fatalf("err = %v, want it to name the file", err)
+	}
+}
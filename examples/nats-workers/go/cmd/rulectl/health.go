@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("webhook health", "Show the health checks NATS workers run against webhook destinations", webhookHealth)
+}
+
+func webhookHealth(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("webhook health")
+	down := fs.Bool("down", false, "only show unhealthy destinations")
+	fs.Parse(args)
+
+	health, err := client.ListDestinationHealth(ctx)
+	if err != nil {
+		return err
+	}
+	if *down {
+		unhealthy := []ruleengine.DestinationHealth{}
+		for _, h := range health {
+			if !h.Healthy {
+				unhealthy = append(unhealthy, h)
+			}
+		}
+		health = unhealthy
+	}
+	return printJSON(health)
+}
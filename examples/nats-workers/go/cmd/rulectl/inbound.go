@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("inbound create", "Accept signed webhooks from a third party at the gateway's /inbound/<name>", inboundCreate)
+	register("inbound list", "List inbound webhook sources", inboundList)
+	register("inbound enable", "Resume accepting a source's webhooks", inboundEnable)
+	register("inbound disable", "Stop accepting a source's webhooks", inboundDisable)
+	register("inbound delete", "Remove an inbound source and its events", inboundDelete)
+	register("inbound events", "Show a source's recent events", inboundEvents)
+}
+
+func inboundCreate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("inbound create")
+	name := fs.String("name", "", "source name, used in the URL")
+	provider := fs.String("provider", "", "signature scheme: "+strings.Join(ruleengine.InboundProviders, ", "))
+	secret := fs.String("secret", "", "signing secret from the provider (generated for github, standard, and hmac if empty)")
+	ruleset := fs.Int("ruleset", 0, "rule set to evaluate each event against (default: store only)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "provider": *provider}); err != nil {
+		return err
+	}
+	generated := false
+	if *secret == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		switch *provider {
+		case "standard":
+			*secret = "whsec_" + base64.StdEncoding.EncodeToString(key)
+		case "github", "hmac":
+			*secret = hex.EncodeToString(key)
+		default:
+			return fmt.Errorf("-secret is required: use the signing secret %s gives you", *provider)
+		}
+		generated = true
+	}
+	// Creates the inbound tables on first use
+	if err := client.EnableInbound(ctx); err != nil {
+		return err
+	}
+	if err := client.CreateInboundSource(ctx, ruleengine.InboundSource{
+		Name: *name, Provider: *provider, Secret: *secret, RuleSetID: *ruleset,
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("Created inbound source %s; point %s at https://<gateway>/inbound/%s\n", *name, *provider, *name)
+	if generated {
+		fmt.Printf("Signing secret (shown once): %s\n", *secret)
+	}
+	return nil
+}
+
+func inboundList(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("inbound list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	sources, err := client.ListInboundSources(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(sources)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPROVIDER\tRULESET\tENABLED\tCREATED")
+	for _, s := range sources {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", s.Name, s.Provider, nonZero(s.RuleSetID), s.Enabled, s.CreatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func inboundEnable(ctx context.Context, client *ruleengine.Client, args []string) error {
+	return setInboundEnabled(ctx, client, "inbound enable", args, true)
+}
+
+func inboundDisable(ctx context.Context, client *ruleengine.Client, args []string) error {
+	return setInboundEnabled(ctx, client, "inbound disable", args, false)
+}
+
+func setInboundEnabled(ctx context.Context, client *ruleengine.Client, command string, args []string, enabled bool) error {
+	fs := newFlags(command)
+	name := fs.String("name", "", "source name")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	return client.SetInboundSourceEnabled(ctx, *name, enabled)
+}
+
+func inboundDelete(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("inbound delete")
+	name := fs.String("name", "", "source name")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	return client.DeleteInboundSource(ctx, *name)
+}
+
+func inboundEvents(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("inbound events")
+	name := fs.String("name", "", "source name")
+	limit := fs.Int("limit", 20, "maximum events")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	events, err := client.ListInboundEvents(ctx, *name, *limit)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(events)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RECEIVED\tEVENT ID\tTYPE\tRULES FIRED\tERROR")
+	for _, ev := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", ev.ReceivedAt.Format(time.RFC3339), ev.EventID, ev.Type,
+			len(ev.MatchedRules), ev.Error)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("rule from-logic", "Create a rule from a JSON Logic condition", ruleFromLogic)
+}
+
+func ruleFromLogic(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule from-logic")
+	file := fs.String("file", "", "rule document with name, when (JSON Logic), and then (JSON or YAML; '-' for stdin)")
+	notes := fs.String("notes", "", "change notes")
+	printOnly := fs.Bool("print", false, "print the generated GRL instead of saving it")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"file": *file}); err != nil {
+		return err
+	}
+	data, err := readInput(*file)
+	if err != nil {
+		return err
+	}
+
+	// JSON is valid YAML, so one decoder handles both formats
+	var rule ruleengine.LogicRule
+	if err := yaml.Unmarshal(data, &rule); err != nil {
+		return err
+	}
+
+	if *printOnly {
+		grl, err := rule.GRL()
+		if err != nil {
+			return err
+		}
+		fmt.Print(grl)
+		return nil
+	}
+
+	saved, err := client.SaveLogicRule(ctx, rule, *notes)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved rule %s version %s\n", saved.Name, saved.ActiveVersion)
+	return nil
+}
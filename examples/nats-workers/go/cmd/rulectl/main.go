@@ -0,0 +1,176 @@
+// Command rulectl manages rules and rule sets in a rule-engine-postgres
+// database using the ruleengine SDK.
+//
+//	rulectl rule create --name discount --file discount.grl
+//	rulectl ruleset add --id 1 --rule discount --order 10
+//	rulectl evaluate --ruleset 1 --facts order.json
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	_ "github.com/lib/pq"
+
+	"github.com/rule-engine/nats-webhook-worker/buildinfo"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine/envelope"
+)
+
+// version, commit, and date describe the build; cmd/release sets them
+// with -ldflags "-X main.version=v1.2.3 -X main.commit=… -X main.date=…"
+var (
+	version = "dev"
+	commit  string
+	date    string
+)
+
+// command is one "<group> <name>" subcommand
+type command struct {
+	usage string
+	run   func(ctx context.Context, client *ruleengine.Client, args []string) error
+}
+
+// commands is keyed by "<group> <name>", e.g. "rule create"
+var commands = map[string]command{}
+
+func register(name, usage string, run func(ctx context.Context, client *ruleengine.Client, args []string) error) {
+	commands[name] = command{usage: usage, run: run}
+}
+
+func main() {
+	global := flag.NewFlagSet("rulectl", flag.ExitOnError)
+	databaseURL := global.String("database-url", getEnv("DATABASE_URL", "postgresql://localhost/postgres?sslmode=disable"), "PostgreSQL connection string")
+	opsURL := global.String("ops-database-url", os.Getenv("OPS_DATABASE_URL"), "operational database with worker statistics and audit records (default: --database-url)")
+	actor := global.String("actor", getEnv("RULECTL_ACTOR", os.Getenv("USER")), "name recorded in the rule audit log")
+	showVersion := global.Bool("version", false, "print the version and exit")
+	global.Usage = usage
+	global.Parse(os.Args[1:])
+
+	if *showVersion {
+		fmt.Println("rulectl", buildinfo.Read(version, commit, date))
+		return
+	}
+
+	args := global.Args()
+	name, rest := commandName(args)
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("postgres", *databaseURL)
+	if err != nil {
+		fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *actor != "" {
+		ctx = ruleengine.WithActor(ctx, *actor)
+	}
+
+	// Payloads the worker encrypted are decrypted with the same keys
+	sealer, err := envelope.FromEnv()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	client := ruleengine.New(db)
+	client.SetPayloadSealer(sealer)
+	if *opsURL != "" {
+		opsDB, err := sql.Open("postgres", *opsURL)
+		if err != nil {
+			fatalf("failed to open operational database: %v", err)
+		}
+		defer opsDB.Close()
+		client.SetOpsDB(opsDB)
+	}
+
+	if err := cmd.run(ctx, client, rest); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+// commandName resolves "group name" or a single top-level command
+func commandName(args []string) (string, []string) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	if len(args) >= 2 {
+		if _, ok := commands[args[0]+" "+args[1]]; ok {
+			return args[0] + " " + args[1], args[2:]
+		}
+	}
+	return args[0], args[1:]
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: rulectl [--database-url URL] [--ops-database-url URL] [--actor NAME] [--version] <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-22s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun 'rulectl <command> --help' for command flags.")
+}
+
+// newFlags returns a flag set for a subcommand that exits on bad flags
+func newFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet("rulectl "+name, flag.ExitOnError)
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// readInput reads a file argument, with "-" meaning stdin
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+func required(flags map[string]string) error {
+	var missing []string
+	for name, value := range flags {
+		if value == "" {
+			missing = append(missing, "--"+name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing required flags: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "rulectl: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("matview create", "Materialize a rule set's results over a source table", matviewCreate)
+	register("matview list", "List match views and how stale they are", matviewList)
+	register("matview schedule", "Change how often a match view is refreshed", matviewSchedule)
+	register("matview refresh", "Refresh a match view now", matviewRefresh)
+	register("matview drop", "Remove a match view and its table", matviewDrop)
+	register("matview run", "Refresh match views on their schedules until interrupted", matviewRun)
+}
+
+func matviewCreate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("matview create")
+	name := fs.String("name", "", "view (and table) name")
+	ruleset := fs.Int("ruleset", 0, "rule set id")
+	source := fs.String("source", "", "source table or view")
+	key := fs.String("key", "id", "source key column")
+	facts := fs.String("facts-column", "", "JSON facts column (default the whole row)")
+	updated := fs.String("updated-column", "", "timestamp column for incremental refreshes")
+	full := fs.Duration("full-every", 24*time.Hour, "full refresh interval (0 disables)")
+	incremental := fs.Duration("incremental-every", 0, "incremental refresh interval (0 disables)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "ruleset": nonZero(*ruleset), "source": *source}); err != nil {
+		return err
+	}
+	// Creates the match view registry on first use
+	if err := client.EnableMatchViews(ctx); err != nil {
+		return err
+	}
+	return client.CreateMatchView(ctx, ruleengine.MatchView{
+		Name:                *name,
+		RuleSetID:           *ruleset,
+		Source:              *source,
+		KeyColumn:           *key,
+		FactsColumn:         *facts,
+		UpdatedColumn:       *updated,
+		FullInterval:        *full,
+		IncrementalInterval: *incremental,
+	})
+}
+
+func matviewList(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("matview list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	views, err := client.ListMatchViews(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(views)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tRULESET\tSOURCE\tFULL\tINCREMENTAL\tROWS\tLAST MS\tSTALENESS")
+	for _, v := range views {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%d\t%d\t%s\n", v.Name, v.RuleSetID, v.Source,
+			v.FullInterval, v.IncrementalInterval, v.LastRows, v.LastRefreshMS, v.Staleness.Round(time.Second))
+	}
+	return w.Flush()
+}
+
+func matviewSchedule(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("matview schedule")
+	name := fs.String("name", "", "view name")
+	full := fs.Duration("full-every", 0, "full refresh interval (0 disables)")
+	incremental := fs.Duration("incremental-every", 0, "incremental refresh interval (0 disables)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	return client.SetMatchViewSchedule(ctx, *name, *full, *incremental)
+}
+
+func matviewRefresh(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("matview refresh")
+	name := fs.String("name", "", "view name")
+	full := fs.Bool("full", false, "re-evaluate every row instead of those updated since the last refresh")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	refresh, err := client.RefreshMatchView(ctx, *name, *full)
+	if err != nil {
+		return err
+	}
+	return printJSON(refresh)
+}
+
+func matviewDrop(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("matview drop")
+	name := fs.String("name", "", "view name")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	return client.DropMatchView(ctx, *name)
+}
+
+func matviewRun(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("matview run")
+	poll := fs.Duration("poll", 30*time.Second, "how often to look for due views")
+	fs.Parse(args)
+
+	scheduler := client.NewMatchViewScheduler()
+	scheduler.Poll = *poll
+	scheduler.OnRefresh = func(view string, refresh *ruleengine.MatchViewRefresh, err error) {
+		switch {
+		case err != nil && view == "":
+			fmt.Fprintf(os.Stderr, "Failed to look up due views: %v\n", err)
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s: %v\n", view, err)
+		case refresh.Full:
+			fmt.Fprintf(os.Stderr, "%s: full refresh, %d rows in %s\n", view, refresh.Rows, refresh.Duration.Round(time.Millisecond))
+		default:
+			fmt.Fprintf(os.Stderr, "%s: incremental refresh, %d rows in %s\n", view, refresh.Rows, refresh.Duration.Round(time.Millisecond))
+		}
+	}
+	if err := scheduler.Run(ctx); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("messages expired", "Show messages the NATS worker skipped after their deadline", messagesExpired)
+}
+
+func messagesExpired(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("messages expired")
+	stream := fs.String("stream", "", "JetStream stream name")
+	consumer := fs.String("consumer", "", "consumer name")
+	trace := fs.String("trace", "", "only the message with this trace ID (X-Request-Id)")
+	limit := fs.Int("limit", 100, "maximum messages")
+	fs.Parse(args)
+
+	messages, err := client.ListExpiredMessages(ctx, ruleengine.ExpiredFilter{
+		Stream: *stream, Consumer: *consumer, TraceID: *trace, Limit: *limit,
+	})
+	if err != nil {
+		return err
+	}
+	return printJSON(messages)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("webhook pause", "Hold deliveries to a webhook during a maintenance window", webhookPause)
+	register("webhook resume", "End or cancel a webhook's maintenance window", webhookResume)
+	register("webhook pauses", "List current and upcoming maintenance windows", webhookPauses)
+	register("webhook hours", "Limit deliveries to a webhook to business hours in its time zone", webhookHours)
+}
+
+func webhookPause(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("webhook pause")
+	id := fs.Int("id", 0, "webhook id")
+	from := fs.String("from", "", "start of the window: RFC 3339 or a duration from now (default now)")
+	until := fs.String("until", "", "end of the window: RFC 3339 or a duration after its start (default until resumed)")
+	reason := fs.String("reason", "", "why, shown in worker logs")
+	fs.Parse(args)
+
+	if *id == 0 {
+		return fmt.Errorf("-id is required")
+	}
+	start, err := parseFutureTime(*from, time.Now())
+	if err != nil {
+		return err
+	}
+	base := start
+	if base.IsZero() {
+		base = time.Now()
+	}
+	end, err := parseFutureTime(*until, base)
+	if err != nil {
+		return err
+	}
+	if err := client.PauseDestination(ctx, *id, start, end, *reason); err != nil {
+		return err
+	}
+	if end.IsZero() {
+		fmt.Printf("Webhook %d paused until resumed\n", *id)
+	} else {
+		fmt.Printf("Webhook %d paused until %s\n", *id, end.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func webhookResume(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("webhook resume")
+	id := fs.Int("id", 0, "webhook id")
+	fs.Parse(args)
+
+	if *id == 0 {
+		return fmt.Errorf("-id is required")
+	}
+	return client.ResumeDestination(ctx, *id)
+}
+
+func webhookPauses(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("webhook pauses")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	pauses, err := client.ListDestinationPauses(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(pauses)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tFROM\tUNTIL\tACTIVE\tREASON")
+	for _, p := range pauses {
+		until := "resumed"
+		if p.Until != nil {
+			until = p.Until.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%t\t%s\n", p.WebhookID, p.Name, p.From.Format(time.RFC3339), until, p.Active, p.Reason)
+	}
+	return w.Flush()
+}
+
+func webhookHours(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("webhook hours")
+	id := fs.Int("id", 0, "webhook id")
+	hours := fs.String("hours", "", `delivery windows, e.g. "mon-fri 08:00-20:00, sat 10:00-14:00" (empty: any time)`)
+	timezone := fs.String("timezone", "UTC", "IANA time zone of the windows")
+	fs.Parse(args)
+
+	if *id == 0 {
+		return fmt.Errorf("-id is required")
+	}
+	if err := client.SetDeliveryHours(ctx, *id, *hours, *timezone); err != nil {
+		return err
+	}
+	if *hours == "" {
+		fmt.Printf("Webhook %d delivers at any time\n", *id)
+	} else {
+		fmt.Printf("Webhook %d delivers %s (%s)\n", *id, *hours, *timezone)
+	}
+	return nil
+}
+
+// parseFutureTime accepts an RFC 3339 timestamp or a duration after base
+func parseFutureTime(value string, base time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return base.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q (want RFC 3339 or a duration like 2h)", value)
+	}
+	return t, nil
+}
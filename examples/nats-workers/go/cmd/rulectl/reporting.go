@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("reporting install", "Install the delivery reporting views in the operational database", reportingInstall)
+	register("reporting dashboard", "Print a Grafana dashboard for the reporting views and worker metrics", reportingDashboard)
+}
+
+func reportingInstall(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("reporting install")
+	fs.Parse(args)
+
+	if err := client.InstallReportingViews(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Installed rule_report_minute, rule_report_hourly, and rule_report_daily")
+	return nil
+}
+
+func reportingDashboard(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("reporting dashboard")
+	title := fs.String("title", "", "dashboard title")
+	uid := fs.String("uid", "", "dashboard uid")
+	postgres := fs.String("postgres-datasource", "", "name of the Grafana PostgreSQL datasource for the operational database")
+	prometheus := fs.String("prometheus-datasource", "", "name of the Grafana Prometheus datasource scraping the workers")
+	postgresType := fs.String("postgres-type", "", `PostgreSQL datasource plugin id ("postgres" before Grafana 10.3)`)
+	out := fs.String("out", "-", "output file")
+	fs.Parse(args)
+
+	dashboard, err := ruleengine.GrafanaDashboard(ruleengine.DashboardOptions{
+		Title:                *title,
+		UID:                  *uid,
+		PostgresDatasource:   *postgres,
+		PrometheusDatasource: *prometheus,
+		PostgresType:         *postgresType,
+	})
+	if err != nil {
+		return err
+	}
+	dashboard = append(dashboard, '\n')
+	if *out == "-" {
+		_, err = os.Stdout.Write(dashboard)
+		return err
+	}
+	return os.WriteFile(*out, dashboard, 0o644)
+}
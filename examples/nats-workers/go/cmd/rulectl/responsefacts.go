@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("webhook response-mapping", "Store facts from a webhook's responses for other rules (Responses.<name>)", webhookResponseMapping)
+	register("webhook response-facts", "Show the response facts stored for a key", webhookResponseFacts)
+}
+
+func webhookResponseMapping(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("webhook response-mapping")
+	id := fs.Int("id", 0, "webhook id")
+	name := fs.String("name", "", "mapping name (rules test Responses.<name>.<field>)")
+	keyPath := fs.String("key-path", "", "dotted path of the key in the delivered message's data, e.g. customer_id")
+	factKeyPath := fs.String("fact-key-path", "", "dotted path of the key in facts, e.g. Order.customer_id (default: -key-path)")
+	fields := fs.String("fields", "", "comma-separated field=JSONPath pairs, e.g. score=$.result.score,tier=$.tier")
+	clear := fs.Bool("clear", false, "stop storing facts from the webhook's responses")
+	fs.Parse(args)
+
+	if *id == 0 {
+		return fmt.Errorf("-id is required")
+	}
+	if *clear {
+		if err := client.SetResponseMapping(ctx, *id, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Webhook %d no longer stores response facts\n", *id)
+		return nil
+	}
+	if err := required(map[string]string{"name": *name, "key-path": *keyPath, "fields": *fields}); err != nil {
+		return err
+	}
+	m := &ruleengine.ResponseMapping{Name: *name, KeyPath: *keyPath, FactKeyPath: *factKeyPath, Fields: map[string]string{}}
+	for _, pair := range strings.Split(*fields, ",") {
+		field, path, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("-fields: expected field=JSONPath, got %q", pair)
+		}
+		m.Fields[strings.TrimSpace(field)] = strings.TrimSpace(path)
+	}
+	// Creates the response facts table on first use
+	if err := client.EnableResponseFacts(ctx); err != nil {
+		return err
+	}
+	if err := client.SetResponseMapping(ctx, *id, m); err != nil {
+		return err
+	}
+	fmt.Printf("Webhook %d stores %d field(s) of its responses as Responses.%s, keyed by %s\n", *id, len(m.Fields), m.Name, m.FactKeyPath)
+	return nil
+}
+
+func webhookResponseFacts(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("webhook response-facts")
+	name := fs.String("name", "", "mapping name")
+	key := fs.String("key", "", "key value, e.g. a customer id")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "key": *key}); err != nil {
+		return err
+	}
+	facts, err := client.GetResponseFacts(ctx, *name, *key)
+	if err != nil {
+		return err
+	}
+	return printJSON(facts)
+}
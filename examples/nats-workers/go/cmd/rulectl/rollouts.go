@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("rollout start", "Shadow or canary a candidate rule version", rolloutStart)
+	register("rollout list", "List rollouts", rolloutList)
+	register("rollout percent", "Change the share of evaluations a rollout samples", rolloutPercent)
+	register("rollout stop", "End a rollout without changing the rule", rolloutStop)
+	register("rollout promote", "Activate the candidate version and end the rollout", rolloutPromote)
+	register("rollout report", "Show how often the candidate diverged", rolloutReport)
+}
+
+func rolloutStart(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rollout start")
+	ruleset := fs.Int("ruleset", 0, "rule set id")
+	rule := fs.String("rule", "", "rule name")
+	version := fs.String("version", "", "candidate version")
+	percent := fs.Float64("percent", 10, "percentage of evaluations to sample")
+	mode := fs.String("mode", ruleengine.RolloutShadow, "shadow (serve baseline) or canary (serve candidate)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"ruleset": nonZero(*ruleset), "rule": *rule, "version": *version}); err != nil {
+		return err
+	}
+	// Creates the rollout tables on first use
+	if err := client.EnableRollouts(ctx); err != nil {
+		return err
+	}
+	id, err := client.StartRollout(ctx, ruleengine.Rollout{
+		RuleSetID:        *ruleset,
+		Rule:             *rule,
+		CandidateVersion: *version,
+		Percent:          *percent,
+		Mode:             *mode,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(id)
+	return nil
+}
+
+func rolloutList(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rollout list")
+	ruleset := fs.Int("ruleset", 0, "rule set id (default all)")
+	fs.Parse(args)
+
+	rollouts, err := client.ListRollouts(ctx, *ruleset)
+	if err != nil {
+		return err
+	}
+	return printJSON(rollouts)
+}
+
+func rolloutPercent(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rollout percent")
+	id := fs.Int("id", 0, "rollout id")
+	percent := fs.Float64("percent", 0, "new percentage")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id)}); err != nil {
+		return err
+	}
+	return client.SetRolloutPercent(ctx, *id, *percent)
+}
+
+func rolloutStop(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rollout stop")
+	id := fs.Int("id", 0, "rollout id")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id)}); err != nil {
+		return err
+	}
+	return client.StopRollout(ctx, *id)
+}
+
+func rolloutPromote(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rollout promote")
+	id := fs.Int("id", 0, "rollout id")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id)}); err != nil {
+		return err
+	}
+	return client.PromoteRollout(ctx, *id)
+}
+
+func rolloutReport(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rollout report")
+	id := fs.Int("id", 0, "rollout id")
+	examples := fs.Int("examples", 5, "number of recent divergent evaluations to include")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id)}); err != nil {
+		return err
+	}
+	report, err := client.GetRolloutReport(ctx, *id, *examples)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(report)
+	}
+
+	r := report.Rollout
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Rollout\t%d (%s, %s)\n", r.ID, r.Mode, r.Status)
+	fmt.Fprintf(w, "Rule\t%s %s -> %s in rule set %d at %.2f%%\n", r.Rule, r.BaselineVersion, r.CandidateVersion, r.RuleSetID, r.Percent)
+	fmt.Fprintf(w, "Evaluations\t%d\n", report.Evaluations)
+	fmt.Fprintf(w, "Diverged\t%d (%.2f%%)\n", report.Diverged, report.DivergenceRate*100)
+	fmt.Fprintf(w, "Candidate errors\t%d\n", report.CandidateErrors)
+	fmt.Fprintf(w, "Served candidate\t%d\n", report.ServedCandidate)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(report.Examples) > 0 {
+		fmt.Println("\nRecent divergent evaluations:")
+		return printJSON(report.Examples)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("rule create", "Create a rule from a GRL file", ruleCreate)
+	register("rule update", "Save a new version of a rule", ruleUpdate)
+	register("rule get", "Show a rule and its active GRL", ruleGet)
+	register("rule list", "List rules", ruleList)
+	register("rule activate", "Make a version the active one", ruleActivate)
+	register("rule enable", "Allow a rule to execute", ruleEnable)
+	register("rule disable", "Stop a rule from executing", ruleDisable)
+	register("rule delete", "Delete a rule or one of its versions", ruleDelete)
+	register("rule validate", "Check GRL syntax without saving", ruleValidate)
+	register("rule dry-run", "Evaluate unsaved GRL against sample facts", ruleDryRun)
+}
+
+func ruleCreate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule create")
+	name := fs.String("name", "", "rule name")
+	file := fs.String("file", "", "GRL file ('-' for stdin)")
+	version := fs.String("version", "", "version (default 1.0.0)")
+	description := fs.String("description", "", "description")
+	notes := fs.String("notes", "", "change notes")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "file": *file}); err != nil {
+		return err
+	}
+	grl, err := readInput(*file)
+	if err != nil {
+		return err
+	}
+
+	rule, err := client.CreateRule(ctx, ruleengine.SaveRuleInput{
+		Name:        *name,
+		GRL:         string(grl),
+		Version:     *version,
+		Description: *description,
+		ChangeNotes: *notes,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created rule %s version %s\n", rule.Name, rule.ActiveVersion)
+	return nil
+}
+
+func ruleUpdate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule update")
+	name := fs.String("name", "", "rule name")
+	file := fs.String("file", "", "GRL file ('-' for stdin)")
+	version := fs.String("version", "", "new version (default: next patch)")
+	expect := fs.String("expect-version", "", "fail unless this is still the active version")
+	notes := fs.String("notes", "", "change notes")
+	activate := fs.Bool("activate", false, "make the new version active")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "file": *file}); err != nil {
+		return err
+	}
+	grl, err := readInput(*file)
+	if err != nil {
+		return err
+	}
+
+	rule, err := client.UpdateRule(ctx, ruleengine.SaveRuleInput{
+		Name:            *name,
+		GRL:             string(grl),
+		Version:         *version,
+		ChangeNotes:     *notes,
+		ExpectedVersion: *expect,
+		Activate:        *activate,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Updated rule %s (active version %s)\n", rule.Name, rule.ActiveVersion)
+	return nil
+}
+
+func ruleGet(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule get")
+	name := fs.String("name", "", "rule name")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	rule, err := client.GetRule(ctx, *name)
+	if err != nil {
+		return err
+	}
+	return printJSON(rule)
+}
+
+func ruleList(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	rules, err := client.ListRules(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(rules)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVERSION\tACTIVE\tUPDATED")
+	for _, r := range rules {
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\n", r.Name, r.ActiveVersion, r.IsActive, r.UpdatedAt.Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
+
+func ruleActivate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule activate")
+	name := fs.String("name", "", "rule name")
+	version := fs.String("version", "", "version to activate")
+	expect := fs.String("expect-version", "", "fail unless this is still the active version")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "version": *version}); err != nil {
+		return err
+	}
+	if err := client.ActivateVersion(ctx, *name, *version, *expect); err != nil {
+		return err
+	}
+	fmt.Printf("Activated %s version %s\n", *name, *version)
+	return nil
+}
+
+func ruleEnable(ctx context.Context, client *ruleengine.Client, args []string) error {
+	return ruleSetEnabled(ctx, client, "rule enable", args, true)
+}
+
+func ruleDisable(ctx context.Context, client *ruleengine.Client, args []string) error {
+	return ruleSetEnabled(ctx, client, "rule disable", args, false)
+}
+
+func ruleSetEnabled(ctx context.Context, client *ruleengine.Client, cmd string, args []string, enabled bool) error {
+	fs := newFlags(cmd)
+	name := fs.String("name", "", "rule name")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	if enabled {
+		return client.EnableRule(ctx, *name)
+	}
+	return client.DisableRule(ctx, *name)
+}
+
+func ruleDelete(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule delete")
+	name := fs.String("name", "", "rule name")
+	version := fs.String("version", "", "delete only this version")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	return client.DeleteRule(ctx, *name, *version)
+}
+
+func ruleValidate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule validate")
+	file := fs.String("file", "", "GRL file ('-' for stdin)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"file": *file}); err != nil {
+		return err
+	}
+	grl, err := readInput(*file)
+	if err != nil {
+		return err
+	}
+
+	report, err := client.ValidateRule(ctx, string(grl))
+	if err != nil {
+		return err
+	}
+	if err := printJSON(report); err != nil {
+		return err
+	}
+	if !report.Valid {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func ruleDryRun(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule dry-run")
+	file := fs.String("file", "", "GRL file ('-' for stdin)")
+	factsFile := fs.String("facts", "", "JSON facts file")
+	trace := fs.Bool("trace", false, "include the engine trace")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"file": *file, "facts": *factsFile}); err != nil {
+		return err
+	}
+	grl, err := readInput(*file)
+	if err != nil {
+		return err
+	}
+	facts, err := readFacts(*factsFile)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.DryRun(ctx, string(grl), facts)
+	if err != nil {
+		return err
+	}
+	if !*trace {
+		result.Trace = nil
+	}
+	return printJSON(result)
+}
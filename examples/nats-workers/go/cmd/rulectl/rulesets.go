@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("ruleset create", "Create a rule set", rulesetCreate)
+	register("ruleset get", "Show a rule set and its members", rulesetGet)
+	register("ruleset list", "List rule sets", rulesetList)
+	register("ruleset add", "Add a rule to a rule set", rulesetAdd)
+	register("ruleset remove", "Remove a rule from a rule set", rulesetRemove)
+	register("ruleset enable", "Allow a rule set to be evaluated", rulesetEnable)
+	register("ruleset disable", "Stop a rule set from being evaluated", rulesetDisable)
+	register("ruleset delete", "Delete a rule set", rulesetDelete)
+}
+
+func rulesetCreate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("ruleset create")
+	name := fs.String("name", "", "rule set name")
+	description := fs.String("description", "", "description")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	id, err := client.CreateRuleSet(ctx, *name, *description)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created rule set %s (id %d)\n", *name, id)
+	return nil
+}
+
+func rulesetGet(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("ruleset get")
+	id := fs.Int("id", 0, "rule set id")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id)}); err != nil {
+		return err
+	}
+	rs, err := client.GetRuleSet(ctx, *id)
+	if err != nil {
+		return err
+	}
+	return printJSON(rs)
+}
+
+func rulesetList(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("ruleset list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	sets, err := client.ListRuleSets(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(sets)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tACTIVE\tDESCRIPTION")
+	for _, rs := range sets {
+		fmt.Fprintf(w, "%d\t%s\t%v\t%s\n", rs.ID, rs.Name, rs.IsActive, rs.Description)
+	}
+	return w.Flush()
+}
+
+func rulesetAdd(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("ruleset add")
+	id := fs.Int("id", 0, "rule set id")
+	rule := fs.String("rule", "", "rule name")
+	version := fs.String("version", "", "pin a rule version (default: active version)")
+	order := fs.Int("order", 0, "execution order (lower runs first)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id), "rule": *rule}); err != nil {
+		return err
+	}
+	return client.AddRuleToSet(ctx, *id, ruleengine.RuleSetMember{Rule: *rule, Version: *version, Order: *order})
+}
+
+func rulesetRemove(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("ruleset remove")
+	id := fs.Int("id", 0, "rule set id")
+	rule := fs.String("rule", "", "rule name")
+	version := fs.String("version", "", "remove only this pinned version")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id), "rule": *rule}); err != nil {
+		return err
+	}
+	return client.RemoveRuleFromSet(ctx, *id, *rule, *version)
+}
+
+func rulesetEnable(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("ruleset enable")
+	id := fs.Int("id", 0, "rule set id")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id)}); err != nil {
+		return err
+	}
+	return client.EnableRuleSet(ctx, *id)
+}
+
+func rulesetDisable(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("ruleset disable")
+	id := fs.Int("id", 0, "rule set id")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id)}); err != nil {
+		return err
+	}
+	return client.DisableRuleSet(ctx, *id)
+}
+
+func rulesetDelete(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("ruleset delete")
+	id := fs.Int("id", 0, "rule set id")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id)}); err != nil {
+		return err
+	}
+	return client.DeleteRuleSet(ctx, *id)
+}
+
+// nonZero turns an unset integer flag into "" for required()
+func nonZero(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
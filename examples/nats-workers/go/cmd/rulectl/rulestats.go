@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("rule effectiveness", "Show how often each rule fires and how its actions fare, flagging dead and failing rules", ruleEffectiveness)
+	register("rule hits", "Show a rule's evaluations, firings, and action outcomes over time", ruleHits)
+}
+
+func ruleEffectiveness(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule effectiveness")
+	since := fs.Duration("since", 30*24*time.Hour, "period to report on")
+	failureRate := fs.Float64("failure-rate", 0.1, "action failure rate above which a rule is flagged")
+	minActions := fs.Int64("min-actions", 10, "actions a rule needs before its failure rate counts")
+	flagged := fs.Bool("flagged", false, "only show flagged rules")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	rules, err := client.RuleEffectiveness(ctx, ruleengine.RuleEffectivenessOptions{
+		Since:       time.Now().Add(-*since),
+		FailureRate: *failureRate,
+		MinActions:  *minActions,
+		FlaggedOnly: *flagged,
+	})
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(rules)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tEVALUATIONS\tFIRED\tMATCH RATE\tERRORS\tACTIONS OK\tACTIONS FAILED\tFAILURE RATE\tLAST FIRED\tFLAGS")
+	for _, r := range rules {
+		lastFired := "-"
+		if r.LastFiredAt != nil {
+			lastFired = r.LastFiredAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f%%\t%d\t%d\t%d\t%.1f%%\t%s\t%s\n", r.Rule, r.Evaluations, r.Fired,
+			r.MatchRate*100, r.Errors, r.ActionsSucceeded, r.ActionsFailed, r.ActionFailureRate*100,
+			lastFired, strings.Join(r.Flags, ","))
+	}
+	return w.Flush()
+}
+
+func ruleHits(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule hits")
+	name := fs.String("name", "", "rule name")
+	since := fs.Duration("since", 7*24*time.Hour, "period to show")
+	daily := fs.Bool("daily", false, "one row per day instead of per hour")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	buckets, err := client.RuleHitHistory(ctx, *name, time.Now().Add(-*since), *daily)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(buckets)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tEVALUATIONS\tFIRED\tERRORS\tACTIONS OK\tACTIONS FAILED")
+	for _, b := range buckets {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\n", b.Time.Format(time.RFC3339), b.Evaluations, b.Fired,
+			b.Errors, b.ActionsSucceeded, b.ActionsFailed)
+	}
+	return w.Flush()
+}
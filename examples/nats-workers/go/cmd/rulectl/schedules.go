@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("schedule create", "Evaluate a rule set on a cron schedule", scheduleCreate)
+	register("schedule list", "List schedules and their next run", scheduleList)
+	register("schedule enable", "Resume a paused schedule", scheduleEnable)
+	register("schedule disable", "Pause a schedule", scheduleDisable)
+	register("schedule delete", "Remove a schedule and its run history", scheduleDelete)
+	register("schedule runs", "Show a schedule's recent runs", scheduleRuns)
+	register("schedule run-due", "Run due schedules once (the worker's leader does this continuously)", scheduleRunDue)
+}
+
+func scheduleCreate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("schedule create")
+	name := fs.String("name", "", "schedule name")
+	ruleset := fs.Int("ruleset", 0, "rule set id")
+	cron := fs.String("cron", "", "cron expression, e.g. \"0 6 * * mon-fri\" or @hourly")
+	timezone := fs.String("timezone", "UTC", "IANA time zone of the cron expression")
+	file := fs.String("facts", "", "JSON facts file each run evaluates (default {})")
+	catchUp := fs.String("catch-up", ruleengine.CatchUpOnce, "missed runs: skip, once, or all")
+	maxCatchUp := fs.Int("max-catch-up", 100, "most missed runs recorded")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "ruleset": nonZero(*ruleset), "cron": *cron}); err != nil {
+		return err
+	}
+	s := ruleengine.Schedule{
+		Name: *name, RuleSetID: *ruleset, Cron: *cron, Timezone: *timezone,
+		CatchUp: *catchUp, MaxCatchUp: *maxCatchUp,
+	}
+	if *file != "" {
+		facts, err := readFacts(*file)
+		if err != nil {
+			return err
+		}
+		s.Facts = facts
+	}
+	// Creates the schedule tables on first use
+	if err := client.EnableSchedules(ctx); err != nil {
+		return err
+	}
+	if err := client.CreateSchedule(ctx, s); err != nil {
+		return err
+	}
+	created, err := client.GetSchedule(ctx, *name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created schedule %s; first run at %s\n", created.Name, created.NextRunAt.Format(time.RFC3339))
+	return nil
+}
+
+func scheduleList(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("schedule list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	schedules, err := client.ListSchedules(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(schedules)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tRULESET\tCRON\tTIMEZONE\tCATCH UP\tENABLED\tNEXT RUN")
+	for _, s := range schedules {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%t\t%s\n", s.Name, s.RuleSetID, s.Cron, s.Timezone,
+			s.CatchUp, s.Enabled, s.NextRunAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func scheduleEnable(ctx context.Context, client *ruleengine.Client, args []string) error {
+	return setScheduleEnabled(ctx, client, "schedule enable", args, true)
+}
+
+func scheduleDisable(ctx context.Context, client *ruleengine.Client, args []string) error {
+	return setScheduleEnabled(ctx, client, "schedule disable", args, false)
+}
+
+func setScheduleEnabled(ctx context.Context, client *ruleengine.Client, command string, args []string, enabled bool) error {
+	fs := newFlags(command)
+	name := fs.String("name", "", "schedule name")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	return client.SetScheduleEnabled(ctx, *name, enabled)
+}
+
+func scheduleDelete(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("schedule delete")
+	name := fs.String("name", "", "schedule name")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	return client.DeleteSchedule(ctx, *name)
+}
+
+func scheduleRuns(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("schedule runs")
+	name := fs.String("name", "", "schedule name")
+	limit := fs.Int("limit", 20, "maximum runs")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	runs, err := client.ListScheduleRuns(ctx, *name, *limit)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(runs)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCHEDULED FOR\tSTATUS\tCATCH UP\tRULES FIRED\tWORKER\tERROR")
+	for _, r := range runs {
+		fmt.Fprintf(w, "%s\t%s\t%t\t%d\t%s\t%s\n", r.ScheduledFor.Format(time.RFC3339), r.Status,
+			r.CatchUp, len(r.MatchedRules), r.Worker, r.Error)
+	}
+	return w.Flush()
+}
+
+func scheduleRunDue(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("schedule run-due")
+	fs.Parse(args)
+
+	host, _ := os.Hostname()
+	runs, err := client.RunDueSchedules(ctx, fmt.Sprintf("rulectl@%s", host))
+	if printErr := printJSON(runs); printErr != nil {
+		return printErr
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("simulate", "Run a rule or candidate GRL against historical rows without executing actions", simulate)
+}
+
+func simulate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("simulate")
+	rule := fs.String("rule", "", "saved rule name")
+	version := fs.String("version", "", "rule version (default the rule's default version)")
+	file := fs.String("file", "", "candidate GRL file ('-' for stdin) instead of a saved rule")
+	source := fs.String("source", "", "table or view of historical facts")
+	factsColumn := fs.String("facts-column", "", "JSON facts column (default the whole row)")
+	timeColumn := fs.String("time-column", "", "timestamp column for --since and --until")
+	since := fs.String("since", "", "RFC 3339 time or duration ago (e.g. 720h)")
+	until := fs.String("until", "", "RFC 3339 time or duration ago")
+	limit := fs.Int("limit", 0, "maximum rows (0 for all)")
+	samples := fs.Int("samples", 3, "matching rows to show")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"source": *source}); err != nil {
+		return err
+	}
+	if (*rule == "") == (*file == "") {
+		return fmt.Errorf("exactly one of --rule or --file is required")
+	}
+	opts := ruleengine.SimulationOptions{
+		Rule: *rule, Version: *version, Source: *source,
+		FactsColumn: *factsColumn, TimeColumn: *timeColumn,
+		Limit: *limit, Samples: *samples,
+	}
+	if *file != "" {
+		grl, err := readInput(*file)
+		if err != nil {
+			return err
+		}
+		opts.GRL = string(grl)
+	}
+	var err error
+	if opts.From, err = parseTime(*since); err != nil {
+		return err
+	}
+	if opts.To, err = parseTime(*until); err != nil {
+		return err
+	}
+
+	sim, err := client.Simulate(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(sim)
+	}
+
+	fmt.Printf("Simulated %s against %d rows of %s in %s\n", sim.Rule, sim.Rows, sim.Source, sim.Duration.Round(time.Millisecond))
+	fmt.Printf("  Matched: %d", sim.Matched)
+	if sim.Rows > 0 {
+		fmt.Printf(" (%.1f%%)", 100*float64(sim.Matched)/float64(sim.Rows))
+	}
+	fmt.Printf("\n  Failed:  %d\n", sim.Failed)
+	names := make([]string, 0, len(sim.Fired))
+	for name := range sim.Fired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  Fired %s on %d rows\n", name, sim.Fired[name])
+	}
+	if len(sim.Actions) > 0 {
+		fmt.Println("\nActions that would have run:")
+		for _, a := range sim.Actions {
+			fmt.Printf("  %6d  %s: %s\n", a.Count, a.Rule, a.Action)
+		}
+	}
+	if len(sim.Errors) > 0 {
+		fmt.Println("\nErrors:")
+		for _, e := range sim.Errors {
+			fmt.Printf("  %s\n", e)
+		}
+	}
+	if len(sim.Samples) > 0 {
+		fmt.Println("\nSamples:")
+		return printJSON(sim.Samples)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("rule import-table", "Compile a CSV/XLSX decision table into a rule", ruleImportTable)
+}
+
+func ruleImportTable(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule import-table")
+	name := fs.String("name", "", "rule name")
+	file := fs.String("file", "", "decision table (.csv or .xlsx)")
+	sheet := fs.String("sheet", "", "XLSX worksheet (default: first)")
+	hitPolicy := fs.String("hit-policy", ruleengine.HitFirst, "first or all")
+	notes := fs.String("notes", "", "change notes")
+	printOnly := fs.Bool("print", false, "print the generated GRL instead of saving it")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "file": *file}); err != nil {
+		return err
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var table *ruleengine.DecisionTable
+	switch strings.ToLower(filepath.Ext(*file)) {
+	case ".csv":
+		table, err = ruleengine.ParseDecisionTableCSV(*name, f)
+	case ".xlsx":
+		info, statErr := f.Stat()
+		if statErr != nil {
+			return statErr
+		}
+		table, err = ruleengine.ParseDecisionTableXLSX(*name, f, info.Size(), *sheet)
+	default:
+		return fmt.Errorf("unsupported file type %q (want .csv or .xlsx)", filepath.Ext(*file))
+	}
+	if err != nil {
+		return err
+	}
+	table.HitPolicy = *hitPolicy
+
+	if *printOnly {
+		grl, err := table.CompileGRL()
+		if err != nil {
+			return err
+		}
+		fmt.Print(grl)
+		return nil
+	}
+
+	if *notes == "" {
+		*notes = "Imported from " + filepath.Base(*file)
+	}
+	rule, err := client.ImportDecisionTable(ctx, table, *notes)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved rule %s version %s (%d rows)\n", rule.Name, rule.ActiveVersion, len(table.Rows))
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine/ruletest"
+)
+
+func init() {
+	register("test", "Run rule test suites (YAML fixtures and expectations)", ruleTest)
+}
+
+func ruleTest(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("test")
+	files := fs.String("files", "", "suite file glob, e.g. 'rules/tests/*.yaml'")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"files": *files}); err != nil {
+		return err
+	}
+	suites, err := ruletest.LoadGlob(*files)
+	if err != nil {
+		return err
+	}
+
+	report := &ruletest.Report{}
+	for _, s := range suites {
+		sr, err := ruletest.Run(ctx, client, s)
+		if err != nil {
+			return fmt.Errorf("suite %s: %w", s.Name, err)
+		}
+		report.Add(sr)
+	}
+
+	if *asJSON {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		report.WriteText(os.Stdout)
+	}
+	if !report.OK() {
+		return fmt.Errorf("%d of %d cases failed", report.Failed, report.Passed+report.Failed)
+	}
+	return nil
+}
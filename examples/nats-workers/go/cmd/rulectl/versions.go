@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("rule versions", "List a rule's version history", ruleVersions)
+	register("rule show", "Print the GRL of one version", ruleShow)
+	register("rule diff", "Diff the GRL of two versions", ruleDiff)
+	register("rule rollback", "Re-activate the previous version", ruleRollback)
+	register("ruleset pin", "Pin a rule set member to a version", rulesetPin)
+}
+
+func ruleVersions(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule versions")
+	name := fs.String("name", "", "rule name")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	versions, err := client.ListVersions(ctx, *name)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(versions)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tACTIVE\tCREATED\tBY\tNOTES")
+	for _, v := range versions {
+		active := ""
+		if v.IsActive {
+			active = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", v.Version, active, v.CreatedAt.Format("2006-01-02 15:04"), v.CreatedBy, v.ChangeNotes)
+	}
+	return w.Flush()
+}
+
+func ruleShow(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule show")
+	name := fs.String("name", "", "rule name")
+	version := fs.String("version", "", "version")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "version": *version}); err != nil {
+		return err
+	}
+	v, err := client.GetVersion(ctx, *name, *version)
+	if err != nil {
+		return err
+	}
+	fmt.Println(v.GRL)
+	return nil
+}
+
+func ruleDiff(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule diff")
+	name := fs.String("name", "", "rule name")
+	from := fs.String("from", "", "old version")
+	to := fs.String("to", "", "new version")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "from": *from, "to": *to}); err != nil {
+		return err
+	}
+	diff, err := client.DiffVersions(ctx, *name, *from, *to)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(diff)
+	}
+	fmt.Print(diff)
+	return nil
+}
+
+func ruleRollback(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("rule rollback")
+	name := fs.String("name", "", "rule name")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	version, err := client.RollbackRule(ctx, *name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rolled back %s to version %s\n", *name, version)
+	return nil
+}
+
+func rulesetPin(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("ruleset pin")
+	id := fs.Int("id", 0, "rule set id")
+	rule := fs.String("rule", "", "rule name")
+	version := fs.String("version", "", "version to pin (empty follows the active version)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"id": nonZero(*id), "rule": *rule}); err != nil {
+		return err
+	}
+	if err := client.PinRuleVersion(ctx, *id, *rule, *version); err != nil {
+		return err
+	}
+	if *version == "" {
+		fmt.Printf("Rule set %d now follows the active version of %s\n", *id, *rule)
+	} else {
+		fmt.Printf("Pinned %s to version %s in rule set %d\n", *rule, *version, *id)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("window create", "Aggregate events per key over a sliding time window", windowCreate)
+	register("window list", "List windows", windowList)
+	register("window delete", "Remove a window and its buckets", windowDelete)
+	register("window value", "Show a window's current value for a key", windowValue)
+	register("window record", "Record a JSON event as if it arrived on a subject", windowRecord)
+}
+
+func windowCreate(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("window create")
+	name := fs.String("name", "", "window name (rules test Windows.<name>)")
+	subject := fs.String("subject", "", "NATS subject pattern of the events")
+	key := fs.String("key", "", "grouping key path in events, e.g. user_id")
+	factKey := fs.String("fact-key", "", "grouping key path in facts, e.g. Login.user_id (default --key)")
+	value := fs.String("value", "", "numeric value path for sum, avg, min, and max")
+	aggregate := fs.String("aggregate", ruleengine.WindowCount, "count, sum, avg, min, or max")
+	duration := fs.Duration("duration", 0, "window length, e.g. 10m")
+	bucket := fs.Duration("bucket", 0, "bucket size (default duration/60)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "subject": *subject, "key": *key, "duration": nonZero(int(*duration))}); err != nil {
+		return err
+	}
+	// Creates the window tables on first use
+	if err := client.EnableWindows(ctx); err != nil {
+		return err
+	}
+	return client.CreateWindow(ctx, ruleengine.Window{
+		Name: *name, Subject: *subject, KeyPath: *key, FactKeyPath: *factKey, ValuePath: *value,
+		Aggregate: *aggregate, Duration: *duration, Bucket: *bucket,
+	})
+}
+
+func windowList(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("window list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	windows, err := client.ListWindows(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(windows)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSUBJECT\tKEY\tFACT KEY\tAGGREGATE\tDURATION\tBUCKET")
+	for _, win := range windows {
+		agg := win.Aggregate
+		if win.ValuePath != "" {
+			agg += "(" + win.ValuePath + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", win.Name, win.Subject, win.KeyPath, win.FactKeyPath,
+			agg, win.Duration, win.Bucket)
+	}
+	return w.Flush()
+}
+
+func windowDelete(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("window delete")
+	name := fs.String("name", "", "window name")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name}); err != nil {
+		return err
+	}
+	return client.DeleteWindow(ctx, *name)
+}
+
+func windowValue(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("window value")
+	name := fs.String("name", "", "window name")
+	key := fs.String("key", "", "grouping key value, e.g. a user id")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"name": *name, "key": *key}); err != nil {
+		return err
+	}
+	value, ok, err := client.WindowValue(ctx, *name, *key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println("no events")
+		return nil
+	}
+	fmt.Println(value)
+	return nil
+}
+
+func windowRecord(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("window record")
+	subject := fs.String("subject", "", "subject the event arrived on")
+	file := fs.String("event", "", "JSON event file ('-' for stdin)")
+	fs.Parse(args)
+
+	if err := required(map[string]string{"subject": *subject, "event": *file}); err != nil {
+		return err
+	}
+	event, err := readFacts(*file)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	n, err := client.RecordWindowEvent(ctx, *subject, event)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Counted into %d window(s) in %s\n", n, time.Since(start).Round(time.Millisecond))
+	return nil
+}
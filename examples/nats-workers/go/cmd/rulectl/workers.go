@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func init() {
+	register("worker list", "List registered NATS worker instances and flag stale ones", workerList)
+}
+
+func workerList(ctx context.Context, client *ruleengine.Client, args []string) error {
+	fs := newFlags("worker list")
+	all := fs.Bool("all", false, "include stopped workers")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	workers, err := client.ListWorkers(ctx, *all)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(workers)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKER\tSTATUS\tVERSION\tEXTENSION\tCONFIG\tCONSUMER\tPENDING\tPROCESSED\tSTARTED\tLAST SEEN")
+	for _, wk := range workers {
+		pending := "-"
+		if wk.ConsumerPending != nil {
+			pending = fmt.Sprint(*wk.ConsumerPending)
+		}
+		// An unsupported extension version is marked with a !
+		extension := "-"
+		if wk.ExtensionVersion != "" {
+			extension = wk.ExtensionVersion
+			if wk.ExtensionCompatible != nil && !*wk.ExtensionCompatible {
+				extension += "!"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s/%s\t%s\t%d\t%s\t%s ago\n", wk.ID, wk.Status, wk.Version, extension, wk.ConfigHash,
+			wk.Stream, wk.Consumer, pending, wk.MessagesProcessed, wk.StartedAt.Format(time.RFC3339),
+			time.Since(wk.LastSeenAt).Round(time.Second))
+	}
+	return w.Flush()
+}
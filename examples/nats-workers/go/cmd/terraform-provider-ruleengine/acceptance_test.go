@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-testing/helper/acctest"
+	tfresource "github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/terraform"
+
+	"github.com/rule-engine/nats-webhook-worker/internal/natstest"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine/ruletest"
+)
+
+// The acceptance tests run terraform (found on PATH or installed by the
+// test framework) against this provider, a database with the rule engine
+// extension in RULETEST_DATABASE_URL, and a natstest server. From this
+// module's directory:
+//
+//	TF_ACC=1 RULETEST_DATABASE_URL=postgres://... go test -run TestAcc .
+
+var protoV6ProviderFactories = map[string]func() (tfprotov6.ProviderServer, error){
+	"ruleengine": func() (tfprotov6.ProviderServer, error) { return newProvider(), nil },
+}
+
+// accEnv is what the acceptance tests run against
+type accEnv struct {
+	// provider is the provider block for the database and NATS server
+	provider string
+	rules    *ruleengine.Client
+	srv      *natstest.Server
+}
+
+// newAccEnv skips the test unless TF_ACC and RULETEST_DATABASE_URL are set
+func newAccEnv(t *testing.T) *accEnv {
+	t.Helper()
+	if os.Getenv(tfresource.EnvTfAcc) == "" {
+		t.Skipf("%s is not set", tfresource.EnvTfAcc)
+	}
+	db := ruletest.OpenDB(t, "postgres")
+	srv := natstest.NewServer(t)
+	srv.AddStream("WEBHOOKS", "webhooks.>")
+	return &accEnv{
+		provider: fmt.Sprintf("provider \"ruleengine\" {\n  database_url = %q\n  nats_url     = %q\n}\n",
+			os.Getenv(ruletest.DatabaseURLEnv), srv.URL()),
+		rules: ruleengine.New(db),
+		srv:   srv,
+	}
+}
+
+// checkDestroyed is a CheckDestroy that fails if a resource in s is left
+func (e *accEnv) checkDestroyed(s *terraform.State) error {
+	ctx := context.Background()
+	for addr, rs := range s.RootModule().Resources {
+		attrs := rs.Primary.Attributes
+		var err error
+		switch rs.Type {
+		case "ruleengine_rule":
+			if _, err = e.rules.GetRule(ctx, attrs["name"]); errors.Is(err, ruleengine.ErrRuleNotFound) {
+				continue
+			}
+		case "ruleengine_rule_set":
+			id, _ := strconv.Atoi(attrs["id"])
+			if _, err = e.rules.GetRuleSet(ctx, id); errors.Is(err, ruleengine.ErrRuleSetNotFound) {
+				continue
+			}
+		case "ruleengine_destination":
+			if _, _, err = e.rules.GetDestination(ctx, attrs["name"]); errors.Is(err, ruleengine.ErrWebhookNotFound) {
+				continue
+			}
+		case "ruleengine_consumer":
+			if _, ok := e.srv.Consumer(attrs["stream"], attrs["name"]); !ok {
+				continue
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+		return fmt.Errorf("%s still exists", addr)
+	}
+	return nil
+}
+
+func TestAccResources(t *testing.T) {
+	env := newAccEnv(t)
+	// GRL rule names are identifiers
+	name := fmt.Sprintf("tfacc_%d", acctest.RandInt())
+	rule := func(local, name string, amount int, extra string) string {
+		return fmt.Sprintf(`resource "ruleengine_rule" %q {
+  name = %q
+  grl  = <<-EOT
+    rule %s "Orders over %d" { when Order.Amount > %d then Order.Approved = true; Retract("%s"); }
+  EOT
+%s}
+`, local, name, name, amount, amount, name, extra)
+	}
+	tests := []struct {
+		name    string
+		address string
+		create  string
+		update  string
+		// createChecks hold after the first apply, updateChecks after the
+		// second
+		createChecks, updateChecks []tfresource.TestCheckFunc
+		// importAttribute holds the import id, when it is not id
+		importAttribute string
+		// importIgnore are attributes terraform import cannot read back
+		importIgnore []string
+	}{
+		{
+			name:    "rule",
+			address: "ruleengine_rule.test",
+			create:  rule("test", name, 1000, "  change_notes = \"first\"\n"),
+			update:  rule("test", name, 5000, "  description = \"High value orders\"\n  enabled     = false\n"),
+			createChecks: []tfresource.TestCheckFunc{
+				tfresource.TestCheckResourceAttr("ruleengine_rule.test", "id", name),
+				tfresource.TestCheckResourceAttr("ruleengine_rule.test", "enabled", "true"),
+				tfresource.TestCheckResourceAttrSet("ruleengine_rule.test", "version"),
+			},
+			updateChecks: []tfresource.TestCheckFunc{
+				tfresource.TestCheckResourceAttr("ruleengine_rule.test", "description", "High value orders"),
+				tfresource.TestCheckResourceAttr("ruleengine_rule.test", "enabled", "false"),
+			},
+			importIgnore: []string{"change_notes"},
+		},
+		{
+			name:    "rule set",
+			address: "ruleengine_rule_set.test",
+			create: rule("a", name+"_a", 1000, "") + rule("b", name+"_b", 2000, "") + fmt.Sprintf(`resource "ruleengine_rule_set" "test" {
+  name = %q
+  rule {
+    name = ruleengine_rule.a.name
+  }
+  rule {
+    name = ruleengine_rule.b.name
+  }
+}
+`, name),
+			update: rule("a", name+"_a", 1000, "") + rule("b", name+"_b", 2000, "") + fmt.Sprintf(`resource "ruleengine_rule_set" "test" {
+  name        = "%s renamed"
+  description = "Order checks"
+  rule {
+    name    = ruleengine_rule.b.name
+    version = ruleengine_rule.b.version
+  }
+}
+`, name),
+			createChecks: []tfresource.TestCheckFunc{
+				tfresource.TestCheckResourceAttrSet("ruleengine_rule_set.test", "id"),
+				tfresource.TestCheckResourceAttr("ruleengine_rule_set.test", "rule.#", "2"),
+				tfresource.TestCheckResourceAttr("ruleengine_rule_set.test", "rule.0.name", name+"_a"),
+			},
+			updateChecks: []tfresource.TestCheckFunc{
+				tfresource.TestCheckResourceAttr("ruleengine_rule_set.test", "name", name+" renamed"),
+				tfresource.TestCheckResourceAttr("ruleengine_rule_set.test", "rule.#", "1"),
+				tfresource.TestCheckResourceAttrPair("ruleengine_rule_set.test", "rule.0.version", "ruleengine_rule.b", "version"),
+			},
+		},
+		{
+			name:    "destination",
+			address: "ruleengine_destination.test",
+			create: fmt.Sprintf(`resource "ruleengine_destination" "test" {
+  name = %q
+  url  = "https://crm.example.com/hooks"
+  tags = ["acceptance"]
+}
+`, name),
+			update: fmt.Sprintf(`resource "ruleengine_destination" "test" {
+  name       = %q
+  url        = "https://crm.example.com/v2/hooks"
+  method     = "PUT"
+  headers    = { Authorization = "Bearer test" }
+  timeout_ms = 10000
+  tags       = ["acceptance", "v2"]
+}
+`, name),
+			createChecks: []tfresource.TestCheckFunc{
+				tfresource.TestCheckResourceAttrSet("ruleengine_destination.test", "id"),
+				tfresource.TestCheckResourceAttr("ruleengine_destination.test", "method", "POST"),
+				tfresource.TestCheckResourceAttr("ruleengine_destination.test", "max_retries", "3"),
+			},
+			updateChecks: []tfresource.TestCheckFunc{
+				tfresource.TestCheckResourceAttr("ruleengine_destination.test", "method", "PUT"),
+				tfresource.TestCheckResourceAttr("ruleengine_destination.test", "headers.Authorization", "Bearer test"),
+				tfresource.TestCheckResourceAttr("ruleengine_destination.test", "tags.#", "2"),
+			},
+			importAttribute: "name",
+		},
+		{
+			name:    "consumer",
+			address: "ruleengine_consumer.test",
+			create: fmt.Sprintf(`resource "ruleengine_consumer" "test" {
+  stream = "WEBHOOKS"
+  name   = %q
+}
+`, name),
+			update: fmt.Sprintf(`resource "ruleengine_consumer" "test" {
+  stream         = "WEBHOOKS"
+  name           = %q
+  filter_subject = "webhooks.orders"
+  max_deliver    = 5
+}
+`, name),
+			createChecks: []tfresource.TestCheckFunc{
+				tfresource.TestCheckResourceAttr("ruleengine_consumer.test", "id", "WEBHOOKS/"+name),
+				tfresource.TestCheckResourceAttr("ruleengine_consumer.test", "queue_group", name),
+				tfresource.TestCheckResourceAttr("ruleengine_consumer.test", "pull", "false"),
+			},
+			updateChecks: []tfresource.TestCheckFunc{
+				tfresource.TestCheckResourceAttr("ruleengine_consumer.test", "filter_subject", "webhooks.orders"),
+				tfresource.TestCheckResourceAttr("ruleengine_consumer.test", "max_deliver", "5"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			importAttribute := tt.importAttribute
+			if importAttribute == "" {
+				importAttribute = "id"
+			}
+			tfresource.Test(t, tfresource.TestCase{
+				ProtoV6ProviderFactories: protoV6ProviderFactories,
+				CheckDestroy:             env.checkDestroyed,
+				Steps: []tfresource.TestStep{
+					{Config: env.provider + tt.create, Check: tfresource.ComposeAggregateTestCheckFunc(tt.createChecks...)},
+					{Config: env.provider + tt.update, Check: tfresource.ComposeAggregateTestCheckFunc(tt.updateChecks...)},
+					{
+						ResourceName:      tt.address,
+						ImportState:       true,
+						ImportStateVerify: true,
+						ImportStateIdFunc: func(s *terraform.State) (string, error) {
+							rs, ok := s.RootModule().Resources[tt.address]
+							if !ok {
+								return "", fmt.Errorf("%s not in state", tt.address)
+							}
+							return rs.Primary.Attributes[importAttribute], nil
+						},
+						ImportStateVerifyIgnore: tt.importIgnore,
+					},
+				},
+			})
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/nats-io/nats.go"
+)
+
+// consumerResource is a durable JetStream consumer for webhook workers.
+// Its defaults match the settings the worker binds with, so workers
+// started with CONSUMER_NAME and QUEUE_GROUP set to the same names use it
+// as it is.
+type consumerResource struct{}
+
+var consumerSchema = &schema{
+	description: "A durable NATS JetStream consumer that webhook workers bind to.",
+	attributes: []attribute{
+		{name: "id", typ: typeString, computed: true, description: "STREAM/CONSUMER"},
+		{name: "stream", typ: typeString, required: true, forceNew: true},
+		{name: "name", typ: typeString, required: true, forceNew: true, description: "Durable name (the workers' CONSUMER_NAME)"},
+		{name: "filter_subject", typ: typeString, optional: true,
+			description: "Subject the consumer receives; every subject of the stream when unset"},
+		{name: "pull", typ: typeBool, optional: true, computed: true, forceNew: true, dflt: false,
+			description: "A pull consumer, for workers with FETCHERS above 0; defaults to false"},
+		{name: "queue_group", typ: typeString, optional: true, computed: true, forceNew: true,
+			description: "Queue group of a push consumer (the workers' QUEUE_GROUP); the consumer's name when unset"},
+		{name: "max_deliver", typ: typeNumber, optional: true, computed: true, dflt: int64(3),
+			description: "Deliveries before a message is given up; defaults to 3, as the worker binds with"},
+		{name: "ack_wait_seconds", typ: typeNumber, optional: true, computed: true, dflt: int64(30),
+			description: "Redelivery timeout; defaults to 30, as the worker binds with"},
+		{name: "max_ack_pending", typ: typeNumber, optional: true, computed: true,
+			description: "Unacknowledged messages at a time (the workers' MAX_ACK_PENDING); the server's default when unset"},
+	},
+}
+
+func (consumerResource) schema() *schema { return consumerSchema }
+
+func (consumerResource) validate(config object) []*tfprotov6.Diagnostic {
+	var diags []*tfprotov6.Diagnostic
+	if config.boolean("pull") && config.set("queue_group") {
+		diags = append(diags, invalid("queue_group", "pull consumers have no queue group"))
+	}
+	for _, name := range []string{"max_deliver", "ack_wait_seconds", "max_ack_pending"} {
+		if config.set(name) && config.num(name) < 1 {
+			diags = append(diags, invalid(name, "%s must be at least 1", name))
+		}
+	}
+	return diags
+}
+
+// plan defaults a new push consumer's queue group to its name
+func (consumerResource) plan(prior, planned object) {
+	if prior != nil || isKnown(planned["queue_group"]) || !isKnown(planned["pull"]) {
+		return
+	}
+	if planned.boolean("pull") {
+		planned["queue_group"] = nil
+	} else if isKnown(planned["name"]) {
+		planned["queue_group"] = planned["name"]
+	}
+}
+
+func (consumerResource) create(ctx context.Context, p *provider, planned object) (object, error) {
+	js, err := p.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	stream, name := planned.str("stream"), planned.str("name")
+	cfg := &nats.ConsumerConfig{
+		Durable:       name,
+		AckPolicy:     nats.AckExplicitPolicy,
+		FilterSubject: planned.str("filter_subject"),
+		MaxDeliver:    planned.num("max_deliver"),
+		AckWait:       time.Duration(planned.num("ack_wait_seconds")) * time.Second,
+		MaxAckPending: planned.num("max_ack_pending"),
+	}
+	if !planned.boolean("pull") {
+		cfg.DeliverSubject = nats.NewInbox()
+		cfg.DeliverGroup = planned.str("queue_group")
+		if cfg.DeliverGroup == "" {
+			cfg.DeliverGroup = name
+		}
+	}
+	info, err := js.AddConsumer(stream, cfg, nats.Context(ctx))
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return nil, fmt.Errorf("stream %s not found", stream)
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := copyObject(planned)
+	state["id"] = stream + "/" + name
+	state["queue_group"] = optionalString(nil, info.Config.DeliverGroup)
+	state["max_ack_pending"] = int64(info.Config.MaxAckPending)
+	return state, nil
+}
+
+func (consumerResource) read(ctx context.Context, p *provider, state object) (object, error) {
+	js, err := p.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	stream, name := state.str("stream"), state.str("name")
+	info, err := js.ConsumerInfo(stream, name, nats.Context(ctx))
+	if errors.Is(err, nats.ErrConsumerNotFound) || errors.Is(err, nats.ErrStreamNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := info.Config
+	current := copyObject(state)
+	current["id"] = stream + "/" + name
+	current["filter_subject"] = optionalString(state["filter_subject"], cfg.FilterSubject)
+	current["pull"] = cfg.DeliverSubject == ""
+	current["queue_group"] = optionalString(nil, cfg.DeliverGroup)
+	current["max_deliver"] = int64(cfg.MaxDeliver)
+	current["ack_wait_seconds"] = int64(cfg.AckWait / time.Second)
+	current["max_ack_pending"] = int64(cfg.MaxAckPending)
+	return current, nil
+}
+
+func (consumerResource) update(ctx context.Context, p *provider, prior, planned object) (object, error) {
+	js, err := p.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	stream, name := planned.str("stream"), planned.str("name")
+	info, err := js.ConsumerInfo(stream, name, nats.Context(ctx))
+	if err != nil {
+		return nil, err
+	}
+	cfg := info.Config
+	cfg.FilterSubject = planned.str("filter_subject")
+	cfg.MaxDeliver = planned.num("max_deliver")
+	cfg.AckWait = time.Duration(planned.num("ack_wait_seconds")) * time.Second
+	cfg.MaxAckPending = planned.num("max_ack_pending")
+	if _, err := js.UpdateConsumer(stream, &cfg, nats.Context(ctx)); err != nil {
+		return nil, err
+	}
+	return copyObject(planned), nil
+}
+
+func (consumerResource) delete(ctx context.Context, p *provider, state object) error {
+	js, err := p.jetStream()
+	if err != nil {
+		return err
+	}
+	err = js.DeleteConsumer(state.str("stream"), state.str("name"), nats.Context(ctx))
+	if errors.Is(err, nats.ErrConsumerNotFound) || errors.Is(err, nats.ErrStreamNotFound) {
+		return nil
+	}
+	return err
+}
+
+// importState takes STREAM/CONSUMER
+func (consumerResource) importState(id string) (object, error) {
+	stream, name, ok := strings.Cut(id, "/")
+	if !ok || stream == "" || name == "" {
+		return nil, errors.New("import a consumer as STREAM/CONSUMER")
+	}
+	return object{"id": id, "stream": stream, "name": name}, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// addWorkers creates the push consumer workers of stream WEBHOOKS as the
+// provider does with its defaults
+func addWorkers(t *testing.T, p *provider) {
+	t.Helper()
+	js, err := p.jetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddConsumer("WEBHOOKS", &nats.ConsumerConfig{Durable: "workers", AckPolicy: nats.AckExplicitPolicy,
+		DeliverSubject: nats.NewInbox(), DeliverGroup: "workers", MaxDeliver: 3, AckWait: 30 * time.Second, MaxAckPending: 1000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumerResource(t *testing.T) {
+	workers := object{"id": "WEBHOOKS/workers", "stream": "WEBHOOKS", "name": "workers", "pull": false, "queue_group": "workers",
+		"max_deliver": int64(3), "ack_wait_seconds": int64(30), "max_ack_pending": int64(1000)}
+	config := object{"stream": "WEBHOOKS", "name": "workers", "max_ack_pending": int64(1000)}
+	tests := []struct {
+		name     string
+		existing bool
+		prior    object
+		config   object
+		want     object
+		// wantConfig is the consumer on the server after, nil if none
+		wantConfig *nats.ConsumerConfig
+		wantErr    string
+	}{
+		{name: "create", config: config, want: workers,
+			wantConfig: &nats.ConsumerConfig{DeliverGroup: "workers", MaxDeliver: 3, AckWait: 30 * time.Second, MaxAckPending: 1000}},
+		{name: "create with a queue group", config: with(config, "queue_group", "delivery"),
+			want:       with(workers, "queue_group", "delivery"),
+			wantConfig: &nats.ConsumerConfig{DeliverGroup: "delivery", MaxDeliver: 3, AckWait: 30 * time.Second, MaxAckPending: 1000}},
+		{name: "create pull", config: with(config, "pull", true, "filter_subject", "webhooks.orders", "max_deliver", int64(5),
+			"ack_wait_seconds", int64(60), "max_ack_pending", int64(100)),
+			want: with(workers, "pull", true, "queue_group", nil, "filter_subject", "webhooks.orders", "max_deliver", int64(5),
+				"ack_wait_seconds", int64(60), "max_ack_pending", int64(100)),
+			wantConfig: &nats.ConsumerConfig{FilterSubject: "webhooks.orders", MaxDeliver: 5, AckWait: time.Minute, MaxAckPending: 100}},
+		{name: "create in a missing stream", config: with(config, "stream", "EVENTS"),
+			wantErr: "failed to create ruleengine_consumer: stream EVENTS not found"},
+		{name: "update", existing: true, prior: workers, config: with(config, "filter_subject", "webhooks.orders", "max_deliver", int64(5)),
+			want: with(workers, "filter_subject", "webhooks.orders", "max_deliver", int64(5)),
+			wantConfig: &nats.ConsumerConfig{DeliverGroup: "workers", FilterSubject: "webhooks.orders", MaxDeliver: 5,
+				AckWait: 30 * time.Second, MaxAckPending: 1000}},
+		{name: "update deleted elsewhere", prior: workers, config: with(config, "max_deliver", int64(5)),
+			want: workers, wantErr: "failed to update ruleengine_consumer"},
+		{name: "delete", existing: true, prior: workers},
+		{name: "delete gone", prior: workers},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _, srv := newTestProvider(t)
+			srv.AddStream("WEBHOOKS", "webhooks.>")
+			if tt.existing {
+				addWorkers(t, p)
+			}
+			state, errs := apply(t, p, "ruleengine_consumer", tt.prior, tt.config)
+			checkErrs(t, errs, tt.wantErr)
+			if tt.want == nil && state != nil {
+				t.Fatalf("state = %v, want none", state)
+			}
+			checkState(t, state, tt.want)
+
+			cfg, ok := srv.Consumer("WEBHOOKS", "workers")
+			if tt.wantConfig == nil {
+				if ok && tt.wantErr == "" {
+					t.Fatalf("consumer left: %+v", cfg)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("no consumer")
+			}
+			pull := tt.wantConfig.DeliverGroup == ""
+			if (cfg.DeliverSubject == "") != pull || cfg.DeliverGroup != tt.wantConfig.DeliverGroup ||
+				cfg.FilterSubject != tt.wantConfig.FilterSubject || cfg.MaxDeliver != tt.wantConfig.MaxDeliver ||
+				cfg.AckWait != tt.wantConfig.AckWait || cfg.MaxAckPending != tt.wantConfig.MaxAckPending ||
+				cfg.AckPolicy != nats.AckExplicitPolicy {
+				t.Fatalf("consumer = %+v, want %+v", cfg, tt.wantConfig)
+			}
+		})
+	}
+}
+
+func TestConsumerRead(t *testing.T) {
+	state := object{"id": "WEBHOOKS/workers", "stream": "WEBHOOKS", "name": "workers", "pull": false, "queue_group": "workers",
+		"max_deliver": int64(3), "ack_wait_seconds": int64(30), "max_ack_pending": int64(1000)}
+	tests := []struct {
+		name  string
+		setup func(js nats.JetStreamContext) error
+		want  object
+	}{
+		{name: "unchanged", setup: func(js nats.JetStreamContext) error {
+			_, err := js.AddConsumer("WEBHOOKS", &nats.ConsumerConfig{Durable: "workers", AckPolicy: nats.AckExplicitPolicy,
+				DeliverSubject: nats.NewInbox(), DeliverGroup: "workers", MaxDeliver: 3, AckWait: 30 * time.Second, MaxAckPending: 1000})
+			return err
+		}, want: with(state, "filter_subject", nil)},
+		{name: "changed elsewhere", setup: func(js nats.JetStreamContext) error {
+			_, err := js.AddConsumer("WEBHOOKS", &nats.ConsumerConfig{Durable: "workers", AckPolicy: nats.AckExplicitPolicy,
+				FilterSubject: "webhooks.orders", MaxDeliver: 10, AckWait: 5 * time.Minute, MaxAckPending: 50})
+			return err
+		}, want: with(state, "pull", true, "queue_group", nil, "filter_subject", "webhooks.orders", "max_deliver", int64(10),
+			"ack_wait_seconds", int64(300), "max_ack_pending", int64(50))},
+		{name: "gone", setup: func(js nats.JetStreamContext) error { return nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _, srv := newTestProvider(t)
+			srv.AddStream("WEBHOOKS", "webhooks.>")
+			js, err := p.jetStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.setup(js); err != nil {
+				t.Fatal(err)
+			}
+			current, errs := read(t, p, "ruleengine_consumer", state)
+			checkErrs(t, errs, "")
+			if tt.want == nil && current != nil {
+				t.Fatalf("state = %v, want none", current)
+			}
+			checkState(t, current, tt.want)
+		})
+	}
+}
+
+func TestConsumerImport(t *testing.T) {
+	p, _, srv := newTestProvider(t)
+	srv.AddStream("WEBHOOKS", "webhooks.>")
+	addWorkers(t, p)
+	state, errs := importState(t, p, "ruleengine_consumer", "WEBHOOKS/workers")
+	checkErrs(t, errs, "")
+	checkState(t, state, object{"id": "WEBHOOKS/workers", "stream": "WEBHOOKS", "name": "workers", "pull": false,
+		"queue_group": "workers", "filter_subject": nil, "max_deliver": int64(3), "ack_wait_seconds": int64(30), "max_ack_pending": int64(1000)})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// destinationResource is a registered webhook in rule_webhooks, written
+// with ApplyDestination. Pauses, delivery hours, and other columns set
+// elsewhere are left alone.
+type destinationResource struct{}
+
+var destinationSchema = &schema{
+	description: "A registered webhook destination (rule_webhooks row) that messages reference by id or name.",
+	attributes: []attribute{
+		{name: "id", typ: typeString, computed: true, description: "The webhook's id"},
+		{name: "name", typ: typeString, required: true, forceNew: true, description: "webhook_name"},
+		{name: "url", typ: typeString, required: true, description: "http or https URL"},
+		{name: "method", typ: typeString, optional: true, computed: true, dflt: "POST",
+			description: "GET, POST, PUT, PATCH, or DELETE; defaults to POST"},
+		{name: "headers", typ: typeStringMap, optional: true, sensitive: true,
+			description: "Request headers, such as Authorization"},
+		{name: "description", typ: typeString, optional: true},
+		{name: "timeout_ms", typ: typeNumber, optional: true, computed: true, dflt: int64(5000),
+			description: "Request timeout, 1 to 60000; defaults to 5000"},
+		{name: "max_retries", typ: typeNumber, optional: true, computed: true, dflt: int64(3),
+			description: "Retries, 0 to 10; defaults to 3"},
+		{name: "enabled", typ: typeBool, optional: true, computed: true, dflt: true,
+			description: "Whether workers deliver to the webhook; defaults to true"},
+		{name: "tags", typ: typeStringList, optional: true},
+	},
+}
+
+func (destinationResource) schema() *schema { return destinationSchema }
+
+func (destinationResource) validate(config object) []*tfprotov6.Diagnostic {
+	var diags []*tfprotov6.Diagnostic
+	if config.set("url") {
+		if u, err := url.Parse(config.str("url")); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			diags = append(diags, invalid("url", "url must be an http or https URL"))
+		}
+	}
+	if config.set("method") {
+		switch config.str("method") {
+		case "GET", "POST", "PUT", "PATCH", "DELETE":
+		default:
+			diags = append(diags, invalid("method", "method must be GET, POST, PUT, PATCH, or DELETE"))
+		}
+	}
+	if config.set("timeout_ms") {
+		if n := config.num("timeout_ms"); n < 1 || n > 60000 {
+			diags = append(diags, invalid("timeout_ms", "timeout_ms must be between 1 and 60000"))
+		}
+	}
+	if config.set("max_retries") {
+		if n := config.num("max_retries"); n < 0 || n > 10 {
+			diags = append(diags, invalid("max_retries", "max_retries must be between 0 and 10"))
+		}
+	}
+	return diags
+}
+
+func (destinationResource) plan(prior, planned object) {}
+
+func (destinationResource) create(ctx context.Context, p *provider, planned object) (object, error) {
+	return applyDestination(ctx, p, planned)
+}
+
+func (destinationResource) update(ctx context.Context, p *provider, prior, planned object) (object, error) {
+	return applyDestination(ctx, p, planned)
+}
+
+// applyDestination creates or replaces the webhook so it matches planned
+func applyDestination(ctx context.Context, p *provider, planned object) (object, error) {
+	rules, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	retries := planned.num("max_retries")
+	id, _, err := rules.ApplyDestination(ctx, ruleengine.Destination{
+		Name:        planned.str("name"),
+		URL:         planned.str("url"),
+		Method:      planned.str("method"),
+		Headers:     planned.stringMap("headers"),
+		Description: planned.str("description"),
+		TimeoutMs:   planned.num("timeout_ms"),
+		MaxRetries:  &retries,
+		Enabled:     planned.boolean("enabled"),
+		Tags:        planned.strings("tags"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	state := copyObject(planned)
+	state["id"] = strconv.Itoa(id)
+	return state, nil
+}
+
+func (destinationResource) read(ctx context.Context, p *provider, state object) (object, error) {
+	rules, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	id, d, err := rules.GetDestination(ctx, state.str("name"))
+	if errors.Is(err, ruleengine.ErrWebhookNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	current := copyObject(state)
+	current["id"], current["url"], current["method"] = strconv.Itoa(id), d.URL, d.Method
+	current["headers"] = optionalStringMap(state["headers"], d.Headers)
+	current["description"] = optionalString(state["description"], d.Description)
+	current["timeout_ms"], current["max_retries"] = int64(d.TimeoutMs), int64(*d.MaxRetries)
+	current["enabled"] = d.Enabled
+	current["tags"] = optionalStrings(state["tags"], d.Tags)
+	return current, nil
+}
+
+func (destinationResource) delete(ctx context.Context, p *provider, state object) error {
+	rules, err := p.client()
+	if err != nil {
+		return err
+	}
+	err = rules.DeleteDestination(ctx, state.str("name"))
+	if errors.Is(err, ruleengine.ErrWebhookNotFound) {
+		return nil
+	}
+	return err
+}
+
+// importState takes the webhook's name
+func (destinationResource) importState(id string) (object, error) {
+	if id == "" {
+		return nil, errors.New("import a destination by its webhook_name")
+	}
+	return object{"name": id}, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectApplyDestination expects the webhook crm to be written with args
+// after its name, returning id 7 as created or updated, or as unchanged
+// when created is nil
+func expectApplyDestination(mock sqlmock.Sqlmock, created interface{}, args ...driver.Value) {
+	q := mock.ExpectQuery(`INSERT INTO rule_webhooks`).WithArgs(append([]driver.Value{"crm"}, args...)...)
+	if created == nil {
+		q.WillReturnRows(sqlmock.NewRows([]string{"webhook_id", "created"}))
+		mock.ExpectQuery(`SELECT webhook_id FROM rule_webhooks`).WithArgs("crm").WillReturnRows(sqlmock.NewRows([]string{"webhook_id"}).AddRow(7))
+		return
+	}
+	q.WillReturnRows(sqlmock.NewRows([]string{"webhook_id", "created"}).AddRow(7, created))
+}
+
+// expectGetDestination expects GetDestination to find crm with columns
+func expectGetDestination(mock sqlmock.Sqlmock, columns ...driver.Value) {
+	mock.ExpectQuery(`FROM rule_webhooks WHERE webhook_name`).WithArgs("crm").WillReturnRows(sqlmock.NewRows(
+		[]string{"webhook_id", "url", "method", "headers", "description", "timeout_ms", "max_retries", "enabled", "tags"}).
+		AddRow(append([]driver.Value{7}, columns...)...))
+}
+
+func TestDestinationResource(t *testing.T) {
+	dest := object{"id": "7", "name": "crm", "url": "https://crm.example.com/hooks", "method": "POST",
+		"timeout_ms": int64(5000), "max_retries": int64(3), "enabled": true}
+	config := object{"name": "crm", "url": "https://crm.example.com/hooks"}
+	tests := []struct {
+		name    string
+		prior   object
+		config  object
+		expect  func(mock sqlmock.Sqlmock)
+		want    object
+		wantErr string
+	}{
+		{name: "create", config: config,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectApplyDestination(mock, true, "https://crm.example.com/hooks", "POST", "{}", "", 5000, 3, true, "{}")
+			},
+			want: with(dest, "headers", nil, "tags", nil)},
+		{name: "create with every setting", config: with(config, "method", "PUT", "description", "CRM sync",
+			"headers", map[string]interface{}{"Authorization": "Bearer t"}, "timeout_ms", int64(10000), "max_retries", int64(0),
+			"enabled", false, "tags", []interface{}{"crm", "prod"}),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectApplyDestination(mock, true, "https://crm.example.com/hooks", "PUT", `{"Authorization":"Bearer t"}`, "CRM sync",
+					10000, 0, false, `{"crm","prod"}`)
+			},
+			want: with(dest, "method", "PUT", "description", "CRM sync", "headers", map[string]interface{}{"Authorization": "Bearer t"},
+				"timeout_ms", int64(10000), "max_retries", int64(0), "enabled", false, "tags", []interface{}{"crm", "prod"})},
+		// A webhook of the name registered by hand is taken over
+		{name: "create over an existing webhook", config: config,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectApplyDestination(mock, false, "https://crm.example.com/hooks", "POST", "{}", "", 5000, 3, true, "{}")
+			},
+			want: dest},
+		{name: "create failed", config: config,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO rule_webhooks`).WillReturnError(errors.New("permission denied for table rule_webhooks"))
+			},
+			wantErr: "failed to create ruleengine_destination: permission denied"},
+		{name: "new url", prior: dest, config: with(config, "url", "https://crm.example.com/v2/hooks"),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectApplyDestination(mock, false, "https://crm.example.com/v2/hooks", "POST", "{}", "", 5000, 3, true, "{}")
+			},
+			want: with(dest, "url", "https://crm.example.com/v2/hooks")},
+		{name: "disable", prior: dest, config: with(config, "enabled", false),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectApplyDestination(mock, false, "https://crm.example.com/hooks", "POST", "{}", "", 5000, 3, false, "{}")
+			},
+			want: with(dest, "enabled", false)},
+		// Already as planned, for example after a failed apply
+		{name: "unchanged in the database", prior: dest, config: with(config, "tags", []interface{}{"prod"}),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectApplyDestination(mock, nil, "https://crm.example.com/hooks", "POST", "{}", "", 5000, 3, true, `{"prod"}`)
+			},
+			want: with(dest, "tags", []interface{}{"prod"})},
+		{name: "delete", prior: dest,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`DELETE FROM rule_webhooks`).WithArgs("crm").WillReturnResult(sqlmock.NewResult(0, 1))
+			}},
+		{name: "delete gone", prior: dest,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`DELETE FROM rule_webhooks`).WithArgs("crm").WillReturnResult(sqlmock.NewResult(0, 0))
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock, _ := newTestProvider(t)
+			tt.expect(mock)
+			state, errs := apply(t, p, "ruleengine_destination", tt.prior, tt.config)
+			checkErrs(t, errs, tt.wantErr)
+			if tt.want == nil && state != nil {
+				t.Fatalf("state = %v, want none", state)
+			}
+			checkState(t, state, tt.want)
+		})
+	}
+}
+
+func TestDestinationRead(t *testing.T) {
+	state := object{"id": "7", "name": "crm", "url": "https://crm.example.com/hooks", "method": "POST",
+		"timeout_ms": int64(5000), "max_retries": int64(3), "enabled": true}
+	tests := []struct {
+		name   string
+		state  object
+		expect func(mock sqlmock.Sqlmock)
+		want   object
+	}{
+		{name: "unchanged", state: state,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectGetDestination(mock, "https://crm.example.com/hooks", "POST", []byte(`{}`), "", 5000, 3, true, "{}")
+			},
+			want: with(state, "headers", nil, "description", nil, "tags", nil)},
+		// Configured empty rather than left unset
+		{name: "empty values kept", state: with(state, "headers", map[string]interface{}{}, "tags", []interface{}{}, "description", ""),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectGetDestination(mock, "https://crm.example.com/hooks", "POST", []byte(`{}`), "", 5000, 3, true, "{}")
+			},
+			want: with(state, "headers", map[string]interface{}{}, "tags", []interface{}{}, "description", "")},
+		{name: "changed elsewhere", state: state,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectGetDestination(mock, "https://crm.example.com/v2", "PUT", []byte(`{"X-Team":"sales"}`), "edited", 1000, 0, false, "{prod}")
+			},
+			want: with(state, "url", "https://crm.example.com/v2", "method", "PUT", "headers", map[string]interface{}{"X-Team": "sales"},
+				"description", "edited", "timeout_ms", int64(1000), "max_retries", int64(0), "enabled", false, "tags", []interface{}{"prod"})},
+		// Deleted and registered again under the same name
+		{name: "new id", state: state,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM rule_webhooks WHERE webhook_name`).WithArgs("crm").WillReturnRows(sqlmock.NewRows(
+					[]string{"webhook_id", "url", "method", "headers", "description", "timeout_ms", "max_retries", "enabled", "tags"}).
+					AddRow(9, "https://crm.example.com/hooks", "POST", []byte(`{}`), "", 5000, 3, true, "{}"))
+			},
+			want: with(state, "id", "9")},
+		{name: "gone", state: state,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM rule_webhooks WHERE webhook_name`).WithArgs("crm").WillReturnRows(sqlmock.NewRows([]string{"webhook_id"}))
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock, _ := newTestProvider(t)
+			tt.expect(mock)
+			current, errs := read(t, p, "ruleengine_destination", tt.state)
+			checkErrs(t, errs, "")
+			if tt.want == nil && current != nil {
+				t.Fatalf("state = %v, want none", current)
+			}
+			checkState(t, current, tt.want)
+		})
+	}
+}
+
+func TestDestinationImport(t *testing.T) {
+	p, mock, _ := newTestProvider(t)
+	expectGetDestination(mock, "https://crm.example.com/hooks", "PATCH", []byte(`{"Authorization":"Bearer t"}`), "CRM sync",
+		2000, 5, true, "{crm}")
+	state, errs := importState(t, p, "ruleengine_destination", "crm")
+	checkErrs(t, errs, "")
+	checkState(t, state, object{"id": "7", "name": "crm", "url": "https://crm.example.com/hooks", "method": "PATCH",
+		"headers": map[string]interface{}{"Authorization": "Bearer t"}, "description": "CRM sync",
+		"timeout_ms": int64(2000), "max_retries": int64(5), "enabled": true, "tags": []interface{}{"crm"}})
+}
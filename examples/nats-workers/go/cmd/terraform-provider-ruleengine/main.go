@@ -0,0 +1,62 @@
+// Command terraform-provider-ruleengine is a Terraform provider managing
+// the rule engine's configuration as resources:
+//
+//   - ruleengine_rule: a rule, with its active version's GRL
+//   - ruleengine_rule_set: a rule set and its ordered members
+//   - ruleengine_destination: a registered webhook in rule_webhooks
+//   - ruleengine_consumer: a durable NATS consumer for webhook workers
+//
+// Terraform starts it and talks to it over plugin protocol 6, served by
+// terraform-plugin-go; with -debug it runs on its own for a debugger and
+// prints the TF_REATTACH_PROVIDERS value to give Terraform. It uses the Go
+// SDK against the database directly, like rulectl.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6/tf6server"
+	_ "github.com/lib/pq"
+
+	"github.com/rule-engine/nats-webhook-worker/buildinfo"
+)
+
+// version, commit, and date describe the build; cmd/release sets them
+// with -ldflags "-X main.version=v1.2.3 -X main.commit=… -X main.date=…"
+var (
+	version = "dev"
+	commit  string
+	date    string
+)
+
+// providerAddress is the source address deploy/terraform uses
+const providerAddress = "registry.terraform.io/rule-engine/ruleengine"
+
+func main() {
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	debug := flag.Bool("debug", false, "run for a debugger, printing TF_REATTACH_PROVIDERS for Terraform")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println("terraform-provider-ruleengine", buildinfo.Read(version, commit, date))
+		return
+	}
+	// Terraform reads the handshake from stdout and logs stderr
+	log.SetOutput(os.Stderr)
+	log.SetFlags(0)
+
+	var opts []tf6server.ServeOpt
+	if *debug {
+		opts = append(opts, tf6server.WithManagedDebug())
+	}
+	p := newProvider()
+	log.Printf("🚀 terraform-provider-ruleengine %s", buildinfo.Read(version, commit, date))
+	err := tf6server.Serve(providerAddress, func() tfprotov6.ProviderServer { return p }, opts...)
+	p.close()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// resource is one resource type of the provider. Terraform plans and
+// applies it through the provider, which fills in defaults and
+// replacements from the schema.
+type resource interface {
+	schema() *schema
+	// validate checks a configuration, whose values may be unknown
+	validate(config object) []*tfprotov6.Diagnostic
+	// plan marks computed values that apply will change as unknown in
+	// planned; prior is nil for a new resource
+	plan(prior, planned object)
+	create(ctx context.Context, p *provider, planned object) (object, error)
+	// read returns the resource as it is now, or nil if it is gone
+	read(ctx context.Context, p *provider, state object) (object, error)
+	update(ctx context.Context, p *provider, prior, planned object) (object, error)
+	delete(ctx context.Context, p *provider, state object) error
+	// importState returns the state of an existing resource named by the
+	// id given to terraform import, for read to fill in
+	importState(id string) (object, error)
+}
+
+// provider serves Terraform's provider protocol for the rule engine's
+// resources
+type provider struct {
+	resources map[string]resource
+
+	// stopped is cancelled by StopProvider to abort running calls
+	stopped context.Context
+	stop    context.CancelFunc
+
+	mu    sync.Mutex
+	db    *sql.DB
+	rules *ruleengine.Client
+	// NATS is only connected once a consumer needs it
+	natsURL, natsUser, natsPass string
+	nc                          *nats.Conn
+	js                          nats.JetStreamContext
+}
+
+var _ tfprotov6.ProviderServer = (*provider)(nil)
+
+var providerSchema = &schema{
+	description: "Manages rules, rule sets, and webhook destinations of rule-engine-postgres, and the NATS consumers workers deliver them from.",
+	attributes: []attribute{
+		{name: "database_url", typ: typeString, optional: true, sensitive: true,
+			description: "PostgreSQL connection string of the rule engine's database; DATABASE_URL when unset"},
+		{name: "nats_url", typ: typeString, optional: true,
+			description: "NATS server for ruleengine_consumer resources; NATS_URL, then nats://127.0.0.1:4222 when unset"},
+		{name: "nats_user", typ: typeString, optional: true,
+			description: "NATS user; NATS_USER when unset"},
+		{name: "nats_password", typ: typeString, optional: true, sensitive: true,
+			description: "NATS password; NATS_PASS when unset"},
+	},
+}
+
+func newProvider() *provider {
+	p := &provider{resources: map[string]resource{
+		"ruleengine_rule":        ruleResource{},
+		"ruleengine_rule_set":    ruleSetResource{},
+		"ruleengine_destination": destinationResource{},
+		"ruleengine_consumer":    consumerResource{},
+	}}
+	p.stopped, p.stop = context.WithCancel(context.Background())
+	return p
+}
+
+// close releases the connections ConfigureProvider and consumers opened
+func (p *provider) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.db != nil {
+		p.db.Close()
+	}
+	if p.nc != nil {
+		p.nc.Close()
+	}
+}
+
+// client returns the SDK client ConfigureProvider set up
+func (p *provider) client() (*ruleengine.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rules == nil {
+		return nil, errors.New("the provider is not configured")
+	}
+	return p.rules, nil
+}
+
+// jetStream connects to NATS the first time it is called
+func (p *provider) jetStream() (nats.JetStreamContext, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.js != nil {
+		return p.js, nil
+	}
+	opts := []nats.Option{nats.Name("Rule Engine Terraform Provider")}
+	if p.natsUser != "" {
+		opts = append(opts, nats.UserInfo(p.natsUser, p.natsPass))
+	}
+	nc, err := nats.Connect(p.natsURL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS at %s: %w", p.natsURL, err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+	p.nc, p.js = nc, js
+	return js, nil
+}
+
+// withStop returns ctx, also cancelled when Terraform stops the provider
+func (p *provider) withStop(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	unregister := context.AfterFunc(p.stopped, cancel)
+	return ctx, func() {
+		unregister()
+		cancel()
+	}
+}
+
+func (p *provider) resource(typeName string) (resource, *tfprotov6.Diagnostic) {
+	r, ok := p.resources[typeName]
+	if !ok {
+		return nil, errorDiag(fmt.Errorf("unknown resource type %s", typeName))
+	}
+	return r, nil
+}
+
+// resourceTypes are the names of the resource types, sorted
+func (p *provider) resourceTypes() []string {
+	names := make([]string, 0, len(p.resources))
+	for name := range p.resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *provider) GetMetadata(ctx context.Context, req *tfprotov6.GetMetadataRequest) (*tfprotov6.GetMetadataResponse, error) {
+	resp := &tfprotov6.GetMetadataResponse{}
+	for _, name := range p.resourceTypes() {
+		resp.Resources = append(resp.Resources, tfprotov6.ResourceMetadata{TypeName: name})
+	}
+	return resp, nil
+}
+
+func (p *provider) GetProviderSchema(ctx context.Context, req *tfprotov6.GetProviderSchemaRequest) (*tfprotov6.GetProviderSchemaResponse, error) {
+	resp := &tfprotov6.GetProviderSchemaResponse{
+		Provider:                 providerSchema.proto(),
+		ResourceSchemas:          map[string]*tfprotov6.Schema{},
+		DataSourceSchemas:        map[string]*tfprotov6.Schema{},
+		Functions:                map[string]*tfprotov6.Function{},
+		EphemeralResourceSchemas: map[string]*tfprotov6.Schema{},
+	}
+	for name, r := range p.resources {
+		resp.ResourceSchemas[name] = r.schema().proto()
+	}
+	return resp, nil
+}
+
+// GetResourceIdentitySchemas returns no identities: resources are
+// imported by the ids in the README
+func (p *provider) GetResourceIdentitySchemas(ctx context.Context, req *tfprotov6.GetResourceIdentitySchemasRequest) (*tfprotov6.GetResourceIdentitySchemasResponse, error) {
+	return &tfprotov6.GetResourceIdentitySchemasResponse{IdentitySchemas: map[string]*tfprotov6.ResourceIdentitySchema{}}, nil
+}
+
+func (p *provider) ValidateProviderConfig(ctx context.Context, req *tfprotov6.ValidateProviderConfigRequest) (*tfprotov6.ValidateProviderConfigResponse, error) {
+	return &tfprotov6.ValidateProviderConfigResponse{PreparedConfig: req.Config}, nil
+}
+
+func (p *provider) ConfigureProvider(ctx context.Context, req *tfprotov6.ConfigureProviderRequest) (*tfprotov6.ConfigureProviderResponse, error) {
+	resp := &tfprotov6.ConfigureProviderResponse{}
+	config, err := providerSchema.decodeObject(req.Config)
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+		return resp, nil
+	}
+	if config == nil {
+		config = object{}
+	}
+	for _, a := range providerSchema.attributes {
+		if !isKnown(config[a.name]) {
+			resp.Diagnostics = append(resp.Diagnostics, errorDiag(
+				fmt.Errorf("%s must be known before apply; set it from values that do not depend on resources", a.name), a.name))
+		}
+	}
+	if len(resp.Diagnostics) > 0 {
+		return resp, nil
+	}
+	setting := func(name, env, fallback string) string {
+		if config.set(name) {
+			return config.str(name)
+		}
+		return getEnv(env, fallback)
+	}
+
+	databaseURL := setting("database_url", "DATABASE_URL", "")
+	if databaseURL == "" {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(errors.New("set database_url or DATABASE_URL"), "database_url"))
+		return resp, nil
+	}
+	// Opening does not connect, so plans without resources need no database
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(fmt.Errorf("failed to open database: %w", err), "database_url"))
+		return resp, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.db != nil {
+		p.db.Close()
+	}
+	p.db, p.rules = db, ruleengine.New(db)
+	p.natsURL = setting("nats_url", "NATS_URL", nats.DefaultURL)
+	p.natsUser = setting("nats_user", "NATS_USER", "")
+	p.natsPass = setting("nats_password", "NATS_PASS", "")
+	log.Printf("✅ Configured (Terraform %s)", req.TerraformVersion)
+	return resp, nil
+}
+
+func (p *provider) StopProvider(ctx context.Context, req *tfprotov6.StopProviderRequest) (*tfprotov6.StopProviderResponse, error) {
+	p.stop()
+	return &tfprotov6.StopProviderResponse{}, nil
+}
+
+func (p *provider) ValidateResourceConfig(ctx context.Context, req *tfprotov6.ValidateResourceConfigRequest) (*tfprotov6.ValidateResourceConfigResponse, error) {
+	resp := &tfprotov6.ValidateResourceConfigResponse{}
+	r, diag := p.resource(req.TypeName)
+	if diag != nil {
+		resp.Diagnostics = append(resp.Diagnostics, diag)
+		return resp, nil
+	}
+	config, err := r.schema().decodeObject(req.Config)
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+		return resp, nil
+	}
+	if config != nil {
+		resp.Diagnostics = r.validate(config)
+	}
+	return resp, nil
+}
+
+// UpgradeResourceState decodes stored state as it is, dropping attributes
+// a newer provider removed: every resource is still at schema version 0
+func (p *provider) UpgradeResourceState(ctx context.Context, req *tfprotov6.UpgradeResourceStateRequest) (*tfprotov6.UpgradeResourceStateResponse, error) {
+	resp := &tfprotov6.UpgradeResourceStateResponse{}
+	r, diag := p.resource(req.TypeName)
+	if diag != nil {
+		resp.Diagnostics = append(resp.Diagnostics, diag)
+		return resp, nil
+	}
+	if req.RawState == nil || len(req.RawState.JSON) == 0 {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(errors.New("state has no JSON value to upgrade")))
+		return resp, nil
+	}
+	typ := r.schema().objectType()
+	value, err := req.RawState.UnmarshalWithOpts(typ, tfprotov6.UnmarshalOpts{
+		ValueFromJSONOpts: tftypes.ValueFromJSONOpts{IgnoreUndefinedAttributes: true},
+	})
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(fmt.Errorf("failed to read state: %w", err)))
+		return resp, nil
+	}
+	upgraded, err := tfprotov6.NewDynamicValue(typ, value)
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+		return resp, nil
+	}
+	resp.UpgradedState = &upgraded
+	return resp, nil
+}
+
+func (p *provider) ReadResource(ctx context.Context, req *tfprotov6.ReadResourceRequest) (*tfprotov6.ReadResourceResponse, error) {
+	resp := &tfprotov6.ReadResourceResponse{NewState: req.CurrentState, Private: req.Private}
+	r, diag := p.resource(req.TypeName)
+	if diag != nil {
+		resp.Diagnostics = append(resp.Diagnostics, diag)
+		return resp, nil
+	}
+	s := r.schema()
+	state, err := s.decodeObject(req.CurrentState)
+	if err != nil || state == nil {
+		if err != nil {
+			resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+		}
+		return resp, nil
+	}
+	ctx, cancel := p.withStop(ctx)
+	defer cancel()
+	current, err := r.read(ctx, p, state)
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(fmt.Errorf("failed to read %s: %w", req.TypeName, err)))
+		return resp, nil
+	}
+	if current != nil {
+		current = s.complete(current)
+	}
+	if resp.NewState, err = s.dynamicValue(current); err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+	}
+	return resp, nil
+}
+
+func (p *provider) PlanResourceChange(ctx context.Context, req *tfprotov6.PlanResourceChangeRequest) (*tfprotov6.PlanResourceChangeResponse, error) {
+	resp := &tfprotov6.PlanResourceChangeResponse{PlannedState: req.ProposedNewState, PlannedPrivate: req.PriorPrivate}
+	r, diag := p.resource(req.TypeName)
+	if diag != nil {
+		resp.Diagnostics = append(resp.Diagnostics, diag)
+		return resp, nil
+	}
+	s := r.schema()
+	prior, err := s.decodeObject(req.PriorState)
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+		return resp, nil
+	}
+	planned, err := s.decodeObject(req.ProposedNewState)
+	if err != nil || planned == nil {
+		// Destroying needs no planning
+		if err != nil {
+			resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+		}
+		return resp, nil
+	}
+
+	for _, a := range s.attributes {
+		switch {
+		case prior == nil && a.computed && planned[a.name] == nil:
+			if a.dflt != nil {
+				planned[a.name] = a.dflt
+			} else {
+				planned[a.name] = unknown
+			}
+		case prior != nil && a.forceNew && !reflect.DeepEqual(prior[a.name], planned[a.name]):
+			resp.RequiresReplace = append(resp.RequiresReplace, attributePath(a.name))
+		}
+	}
+	// Terraform plans a replacement again as a create
+	if len(resp.RequiresReplace) == 0 {
+		r.plan(prior, planned)
+	}
+	if resp.PlannedState, err = s.dynamicValue(planned); err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+	}
+	return resp, nil
+}
+
+func (p *provider) ApplyResourceChange(ctx context.Context, req *tfprotov6.ApplyResourceChangeRequest) (*tfprotov6.ApplyResourceChangeResponse, error) {
+	resp := &tfprotov6.ApplyResourceChangeResponse{NewState: req.PriorState, Private: req.PlannedPrivate}
+	r, diag := p.resource(req.TypeName)
+	if diag != nil {
+		resp.Diagnostics = append(resp.Diagnostics, diag)
+		return resp, nil
+	}
+	s := r.schema()
+	prior, err := s.decodeObject(req.PriorState)
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+		return resp, nil
+	}
+	planned, err := s.decodeObject(req.PlannedState)
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+		return resp, nil
+	}
+
+	ctx, cancel := p.withStop(ctx)
+	defer cancel()
+	var state object
+	switch {
+	case planned == nil:
+		if err = r.delete(ctx, p, prior); err != nil {
+			err = fmt.Errorf("failed to delete %s: %w", req.TypeName, err)
+			state = prior
+		}
+	case prior == nil:
+		if state, err = r.create(ctx, p, planned); err != nil {
+			// A partly created resource is kept, tainted, so it is replaced
+			err = fmt.Errorf("failed to create %s: %w", req.TypeName, err)
+		}
+	default:
+		if state, err = r.update(ctx, p, prior, planned); err != nil {
+			err = fmt.Errorf("failed to update %s: %w", req.TypeName, err)
+			if state == nil {
+				state = prior
+			}
+		}
+	}
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+	}
+	if state != nil {
+		state = s.complete(state)
+	}
+	resp.NewState, err = s.dynamicValue(state)
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+	}
+	return resp, nil
+}
+
+func (p *provider) ImportResourceState(ctx context.Context, req *tfprotov6.ImportResourceStateRequest) (*tfprotov6.ImportResourceStateResponse, error) {
+	resp := &tfprotov6.ImportResourceStateResponse{}
+	r, diag := p.resource(req.TypeName)
+	if diag != nil {
+		resp.Diagnostics = append(resp.Diagnostics, diag)
+		return resp, nil
+	}
+	state, err := r.importState(req.ID)
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+		return resp, nil
+	}
+	value, err := r.schema().dynamicValue(r.schema().complete(state))
+	if err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+		return resp, nil
+	}
+	resp.ImportedResources = append(resp.ImportedResources, &tfprotov6.ImportedResource{
+		TypeName: req.TypeName,
+		State:    value,
+	})
+	return resp, nil
+}
+
+func (p *provider) MoveResourceState(ctx context.Context, req *tfprotov6.MoveResourceStateRequest) (*tfprotov6.MoveResourceStateResponse, error) {
+	return &tfprotov6.MoveResourceStateResponse{Diagnostics: []*tfprotov6.Diagnostic{
+		errorDiag(fmt.Errorf("%s cannot be moved to %s", req.SourceTypeName, req.TargetTypeName)),
+	}}, nil
+}
+
+func (p *provider) UpgradeResourceIdentity(ctx context.Context, req *tfprotov6.UpgradeResourceIdentityRequest) (*tfprotov6.UpgradeResourceIdentityResponse, error) {
+	return &tfprotov6.UpgradeResourceIdentityResponse{Diagnostics: []*tfprotov6.Diagnostic{
+		errorDiag(fmt.Errorf("%s has no resource identity", req.TypeName)),
+	}}, nil
+}
+
+// GenerateResourceConfig turns a state, such as an imported one, into
+// configuration: the state without the attributes only the provider sets
+func (p *provider) GenerateResourceConfig(ctx context.Context, req *tfprotov6.GenerateResourceConfigRequest) (*tfprotov6.GenerateResourceConfigResponse, error) {
+	resp := &tfprotov6.GenerateResourceConfigResponse{}
+	r, diag := p.resource(req.TypeName)
+	if diag != nil {
+		resp.Diagnostics = append(resp.Diagnostics, diag)
+		return resp, nil
+	}
+	s := r.schema()
+	state, err := s.decodeObject(req.State)
+	if err != nil || state == nil {
+		if err != nil {
+			resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+		}
+		return resp, nil
+	}
+	config := copyObject(state)
+	for _, a := range s.attributes {
+		if a.computed && !a.optional {
+			config[a.name] = nil
+		}
+	}
+	if resp.Config, err = s.dynamicValue(config); err != nil {
+		resp.Diagnostics = append(resp.Diagnostics, errorDiag(err))
+	}
+	return resp, nil
+}
+
+func (p *provider) ValidateDataResourceConfig(ctx context.Context, req *tfprotov6.ValidateDataResourceConfigRequest) (*tfprotov6.ValidateDataResourceConfigResponse, error) {
+	return &tfprotov6.ValidateDataResourceConfigResponse{Diagnostics: []*tfprotov6.Diagnostic{
+		errorDiag(fmt.Errorf("unknown data source %s", req.TypeName)),
+	}}, nil
+}
+
+func (p *provider) ReadDataSource(ctx context.Context, req *tfprotov6.ReadDataSourceRequest) (*tfprotov6.ReadDataSourceResponse, error) {
+	return &tfprotov6.ReadDataSourceResponse{Diagnostics: []*tfprotov6.Diagnostic{
+		errorDiag(fmt.Errorf("unknown data source %s", req.TypeName)),
+	}}, nil
+}
+
+func (p *provider) GetFunctions(ctx context.Context, req *tfprotov6.GetFunctionsRequest) (*tfprotov6.GetFunctionsResponse, error) {
+	return &tfprotov6.GetFunctionsResponse{Functions: map[string]*tfprotov6.Function{}}, nil
+}
+
+func (p *provider) CallFunction(ctx context.Context, req *tfprotov6.CallFunctionRequest) (*tfprotov6.CallFunctionResponse, error) {
+	return &tfprotov6.CallFunctionResponse{Error: &tfprotov6.FunctionError{Text: "unknown function " + req.Name}}, nil
+}
+
+func (p *provider) ValidateEphemeralResourceConfig(ctx context.Context, req *tfprotov6.ValidateEphemeralResourceConfigRequest) (*tfprotov6.ValidateEphemeralResourceConfigResponse, error) {
+	return &tfprotov6.ValidateEphemeralResourceConfigResponse{Diagnostics: unknownEphemeral(req.TypeName)}, nil
+}
+
+func (p *provider) OpenEphemeralResource(ctx context.Context, req *tfprotov6.OpenEphemeralResourceRequest) (*tfprotov6.OpenEphemeralResourceResponse, error) {
+	return &tfprotov6.OpenEphemeralResourceResponse{Diagnostics: unknownEphemeral(req.TypeName)}, nil
+}
+
+func (p *provider) RenewEphemeralResource(ctx context.Context, req *tfprotov6.RenewEphemeralResourceRequest) (*tfprotov6.RenewEphemeralResourceResponse, error) {
+	return &tfprotov6.RenewEphemeralResourceResponse{Diagnostics: unknownEphemeral(req.TypeName)}, nil
+}
+
+func (p *provider) CloseEphemeralResource(ctx context.Context, req *tfprotov6.CloseEphemeralResourceRequest) (*tfprotov6.CloseEphemeralResourceResponse, error) {
+	return &tfprotov6.CloseEphemeralResourceResponse{Diagnostics: unknownEphemeral(req.TypeName)}, nil
+}
+
+// unknownEphemeral reports an ephemeral resource type: the provider has
+// none
+func unknownEphemeral(typeName string) []*tfprotov6.Diagnostic {
+	return []*tfprotov6.Diagnostic{errorDiag(fmt.Errorf("unknown ephemeral resource type %s", typeName))}
+}
+
+// invalid reports a configuration error against attr
+func invalid(attr, format string, args ...interface{}) *tfprotov6.Diagnostic {
+	return errorDiag(fmt.Errorf(format, args...), attr)
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
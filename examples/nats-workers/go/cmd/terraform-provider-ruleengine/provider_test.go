@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+
+	"github.com/rule-engine/nats-webhook-worker/internal/natstest"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// newTestProvider is a provider configured with a database on sqlmock and
+// NATS on a natstest server
+func newTestProvider(t *testing.T) (*provider, sqlmock.Sqlmock, *natstest.Server) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := natstest.NewServer(t)
+	p := newProvider()
+	p.db, p.rules, p.natsURL = db, ruleengine.New(db), srv.URL()
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		p.close()
+	})
+	return p, mock, srv
+}
+
+// encode is o as a value of typeName's schema
+func encode(t *testing.T, p *provider, typeName string, o object) *tfprotov6.DynamicValue {
+	t.Helper()
+	s := p.resources[typeName].schema()
+	if o != nil {
+		o = s.complete(copyObject(o))
+	}
+	v, err := s.dynamicValue(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// decode is the object in v of typeName's schema
+func decode(t *testing.T, p *provider, typeName string, v *tfprotov6.DynamicValue) object {
+	t.Helper()
+	o, err := p.resources[typeName].schema().decodeObject(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// proposedNewState is what Terraform proposes for config over prior:
+// the configuration, with computed attributes it leaves unset kept from
+// prior
+func proposedNewState(s *schema, prior, config object) object {
+	if config == nil {
+		return nil
+	}
+	proposed := s.complete(copyObject(config))
+	for _, a := range s.attributes {
+		if a.computed && proposed[a.name] == nil && prior != nil {
+			proposed[a.name] = prior[a.name]
+		}
+	}
+	return proposed
+}
+
+// apply plans and applies config over prior as terraform apply does,
+// failing the test when the new state contradicts the plan, and returns
+// the new state and the summaries of the errors reported
+func apply(t *testing.T, p *provider, typeName string, prior, config object) (object, []string) {
+	t.Helper()
+	ctx := context.Background()
+	s := p.resources[typeName].schema()
+	if prior != nil {
+		prior = s.complete(copyObject(prior))
+	}
+	plan, err := p.PlanResourceChange(ctx, &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         typeName,
+		PriorState:       encode(t, p, typeName, prior),
+		ProposedNewState: encode(t, p, typeName, proposedNewState(s, prior, config)),
+		Config:           encode(t, p, typeName, config),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := summaries(plan.Diagnostics); len(errs) > 0 {
+		return prior, errs
+	}
+	planned := decode(t, p, typeName, plan.PlannedState)
+	if len(plan.RequiresReplace) > 0 {
+		t.Fatalf("plan replaces %v", plan.RequiresReplace)
+	}
+
+	resp, err := p.ApplyResourceChange(ctx, &tfprotov6.ApplyResourceChangeRequest{
+		TypeName:     typeName,
+		PriorState:   encode(t, p, typeName, prior),
+		PlannedState: plan.PlannedState,
+		Config:       encode(t, p, typeName, config),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := decode(t, p, typeName, resp.NewState)
+	errs := summaries(resp.Diagnostics)
+	// Terraform rejects a state whose values differ from known planned ones
+	if len(errs) == 0 && planned != nil {
+		for name, want := range planned {
+			if isKnown(want) && !reflect.DeepEqual(state[name], want) {
+				t.Errorf("%s = %#v after apply, planned %#v", name, state[name], want)
+			}
+		}
+	}
+	return state, errs
+}
+
+// read refreshes state as terraform plan does
+func read(t *testing.T, p *provider, typeName string, state object) (object, []string) {
+	t.Helper()
+	resp, err := p.ReadResource(context.Background(), &tfprotov6.ReadResourceRequest{
+		TypeName:     typeName,
+		CurrentState: encode(t, p, typeName, state),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decode(t, p, typeName, resp.NewState), summaries(resp.Diagnostics)
+}
+
+// importState imports id as terraform import does, reading the resource
+// after
+func importState(t *testing.T, p *provider, typeName, id string) (object, []string) {
+	t.Helper()
+	resp, err := p.ImportResourceState(context.Background(), &tfprotov6.ImportResourceStateRequest{TypeName: typeName, ID: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := summaries(resp.Diagnostics); len(errs) > 0 {
+		return nil, errs
+	}
+	if len(resp.ImportedResources) != 1 || resp.ImportedResources[0].TypeName != typeName {
+		t.Fatalf("imported %+v", resp.ImportedResources)
+	}
+	return read(t, p, typeName, decode(t, p, typeName, resp.ImportedResources[0].State))
+}
+
+// summaries are the summaries of the error diagnostics
+func summaries(diags []*tfprotov6.Diagnostic) []string {
+	var out []string
+	for _, d := range diags {
+		if d.Severity == tfprotov6.DiagnosticSeverityError {
+			out = append(out, d.Summary)
+		}
+	}
+	return out
+}
+
+// checkErrs fails the test unless errs has one error containing want, or
+// none when want is ""
+func checkErrs(t *testing.T, errs []string, want string) {
+	t.Helper()
+	if want == "" {
+		if len(errs) > 0 {
+			t.Fatalf("errors: %v", errs)
+		}
+		return
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0], want) {
+		t.Fatalf("errors = %v, want %q", errs, want)
+	}
+}
+
+// with is a copy of o with the attributes in kv, given as name, value
+// pairs
+func with(o object, kv ...interface{}) object {
+	o = copyObject(o)
+	for i := 0; i+1 < len(kv); i += 2 {
+		o[kv[i].(string)] = kv[i+1]
+	}
+	return o
+}
+
+// checkState fails the test unless state has the values in want
+func checkState(t *testing.T, state, want object) {
+	t.Helper()
+	for name, v := range want {
+		if !reflect.DeepEqual(state[name], v) {
+			t.Errorf("%s = %#v, want %#v", name, state[name], v)
+		}
+	}
+}
+
+func TestGetProviderSchema(t *testing.T) {
+	p := newProvider()
+	resp, err := p.GetProviderSchema(context.Background(), &tfprotov6.GetProviderSchemaRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := p.GetMetadata(context.Background(), &tfprotov6.GetMetadataRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ruleengine_consumer", "ruleengine_destination", "ruleengine_rule", "ruleengine_rule_set"}
+	var listed []string
+	for _, r := range meta.Resources {
+		listed = append(listed, r.TypeName)
+	}
+	if !reflect.DeepEqual(listed, want) || len(resp.ResourceSchemas) != len(want) {
+		t.Fatalf("resources = %v, schemas %v", listed, resp.ResourceSchemas)
+	}
+	tests := []struct {
+		typeName  string
+		attribute string
+		typ       tftypes.Type
+		sensitive bool
+	}{
+		{"ruleengine_rule", "grl", tftypes.String, false},
+		{"ruleengine_destination", "headers", tftypes.Map{ElementType: tftypes.String}, true},
+		{"ruleengine_destination", "tags", tftypes.List{ElementType: tftypes.String}, false},
+		{"ruleengine_consumer", "max_deliver", tftypes.Number, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typeName+"."+tt.attribute, func(t *testing.T) {
+			for _, a := range resp.ResourceSchemas[tt.typeName].Block.Attributes {
+				if a.Name == tt.attribute {
+					if !a.Type.Equal(tt.typ) || a.Sensitive != tt.sensitive {
+						t.Fatalf("attribute = %+v", a)
+					}
+					return
+				}
+			}
+			t.Fatal("missing")
+		})
+	}
+	if resp.ResourceSchemas["ruleengine_rule_set"].Block.BlockTypes[0].Nesting != tfprotov6.SchemaNestedBlockNestingModeList {
+		t.Fatal("rule blocks are not a list")
+	}
+}
+
+func TestConfigureProvider(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		config   object
+		wantErr  string
+		wantNATS string
+		wantUser string
+	}{
+		{name: "from config", config: object{"database_url": "postgresql://db/rules", "nats_url": "nats://nats:4222", "nats_user": "tf"},
+			wantNATS: "nats://nats:4222", wantUser: "tf"},
+		{name: "from environment", env: map[string]string{"DATABASE_URL": "postgresql://db/rules", "NATS_URL": "nats://env:4222", "NATS_USER": "env"},
+			config: object{}, wantNATS: "nats://env:4222", wantUser: "env"},
+		{name: "config over environment", env: map[string]string{"DATABASE_URL": "postgresql://db/rules", "NATS_URL": "nats://env:4222"},
+			config: object{"nats_url": "nats://nats:4222"}, wantNATS: "nats://nats:4222"},
+		{name: "default NATS", config: object{"database_url": "postgresql://db/rules"}, wantNATS: "nats://127.0.0.1:4222"},
+		{name: "no database", config: object{}, wantErr: "set database_url or DATABASE_URL"},
+		{name: "unknown setting", config: object{"database_url": unknown}, wantErr: "database_url must be known before apply"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"DATABASE_URL", "NATS_URL", "NATS_USER", "NATS_PASS"} {
+				t.Setenv(key, tt.env[key])
+			}
+			p := newProvider()
+			defer p.close()
+			config, err := providerSchema.dynamicValue(providerSchema.complete(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := p.ConfigureProvider(context.Background(), &tfprotov6.ConfigureProviderRequest{TerraformVersion: "1.9.0", Config: config})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkErrs(t, summaries(resp.Diagnostics), tt.wantErr)
+			if tt.wantErr != "" {
+				if _, err := p.client(); err == nil {
+					t.Fatal("configured")
+				}
+				return
+			}
+			if _, err := p.client(); err != nil || p.natsURL != tt.wantNATS || p.natsUser != tt.wantUser {
+				t.Fatalf("client %v, NATS %s as %q", err, p.natsURL, p.natsUser)
+			}
+		})
+	}
+}
+
+func TestUnconfigured(t *testing.T) {
+	p := newProvider()
+	for _, typeName := range []string{"ruleengine_rule", "ruleengine_rule_set", "ruleengine_destination"} {
+		t.Run(typeName, func(t *testing.T) {
+			config := map[string]object{
+				"ruleengine_rule":        {"name": "A", "grl": "rule A {}"},
+				"ruleengine_rule_set":    {"name": "orders"},
+				"ruleengine_destination": {"name": "crm", "url": "https://crm.example.com"},
+			}[typeName]
+			_, errs := apply(t, p, typeName, nil, config)
+			checkErrs(t, errs, "the provider is not configured")
+		})
+	}
+}
+
+func TestPlanResourceChange(t *testing.T) {
+	p := newProvider()
+	tests := []struct {
+		name        string
+		typeName    string
+		prior       object
+		config      object
+		want        object
+		wantReplace []string
+	}{
+		{name: "defaults and unknowns on create", typeName: "ruleengine_destination",
+			config: object{"name": "crm", "url": "https://crm.example.com"},
+			want: object{"id": unknown, "method": "POST", "timeout_ms": int64(5000), "max_retries": int64(3), "enabled": true,
+				"headers": nil, "tags": nil}},
+		{name: "set values kept", typeName: "ruleengine_destination",
+			config: object{"name": "crm", "url": "https://crm.example.com", "method": "PUT", "enabled": false},
+			want:   object{"method": "PUT", "enabled": false}},
+		{name: "computed values kept on update", typeName: "ruleengine_destination",
+			prior:  object{"id": "7", "name": "crm", "url": "https://crm.example.com", "method": "POST", "timeout_ms": int64(5000), "max_retries": int64(3), "enabled": true},
+			config: object{"name": "crm", "url": "https://crm.example.com/v2"},
+			want:   object{"id": "7", "url": "https://crm.example.com/v2", "method": "POST"}},
+		{name: "new name replaces", typeName: "ruleengine_destination",
+			prior:       object{"id": "7", "name": "crm", "url": "https://crm.example.com", "method": "POST", "timeout_ms": int64(5000), "max_retries": int64(3), "enabled": true},
+			config:      object{"name": "billing", "url": "https://crm.example.com"},
+			wantReplace: []string{"name"}},
+		{name: "new GRL makes a new version", typeName: "ruleengine_rule",
+			prior:  object{"id": "A", "name": "A", "grl": "rule A {}", "enabled": true, "version": "1.0.0"},
+			config: object{"name": "A", "grl": "rule A { }"},
+			want:   object{"version": unknown}},
+		{name: "same GRL keeps the version", typeName: "ruleengine_rule",
+			prior:  object{"id": "A", "name": "A", "grl": "rule A {}", "enabled": true, "version": "1.0.0"},
+			config: object{"name": "A", "grl": "rule A {}", "description": "now described"},
+			want:   object{"version": "1.0.0", "description": "now described"}},
+		{name: "push consumer's queue group", typeName: "ruleengine_consumer",
+			config: object{"stream": "WEBHOOKS", "name": "workers"},
+			want:   object{"queue_group": "workers", "pull": false, "max_ack_pending": unknown}},
+		{name: "pull consumer has none", typeName: "ruleengine_consumer",
+			config: object{"stream": "WEBHOOKS", "name": "workers", "pull": true},
+			want:   object{"queue_group": nil}},
+		{name: "unknown name leaves the queue group unknown", typeName: "ruleengine_consumer",
+			config: object{"stream": "WEBHOOKS", "name": unknown},
+			want:   object{"queue_group": unknown}},
+		{name: "pull flipped replaces", typeName: "ruleengine_consumer",
+			prior:       object{"id": "WEBHOOKS/workers", "stream": "WEBHOOKS", "name": "workers", "pull": false, "queue_group": "workers"},
+			config:      object{"stream": "WEBHOOKS", "name": "workers", "pull": true, "queue_group": nil},
+			wantReplace: []string{"pull"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := p.resources[tt.typeName].schema()
+			prior := tt.prior
+			if prior != nil {
+				prior = s.complete(copyObject(prior))
+			}
+			resp, err := p.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+				TypeName:         tt.typeName,
+				PriorState:       encode(t, p, tt.typeName, prior),
+				ProposedNewState: encode(t, p, tt.typeName, proposedNewState(s, prior, tt.config)),
+				Config:           encode(t, p, tt.typeName, tt.config),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkErrs(t, summaries(resp.Diagnostics), "")
+			var replaced []string
+			for _, path := range resp.RequiresReplace {
+				name, _ := path.Steps()[0].(tftypes.AttributeName)
+				replaced = append(replaced, string(name))
+			}
+			if !reflect.DeepEqual(replaced, tt.wantReplace) {
+				t.Fatalf("replaced %v, want %v", replaced, tt.wantReplace)
+			}
+			checkState(t, decode(t, p, tt.typeName, resp.PlannedState), tt.want)
+		})
+	}
+}
+
+func TestPlanDestroy(t *testing.T) {
+	p := newProvider()
+	prior := encode(t, p, "ruleengine_rule", object{"id": "A", "name": "A", "grl": "rule A {}", "enabled": true, "version": "1.0.0"})
+	resp, err := p.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "ruleengine_rule",
+		PriorState:       prior,
+		ProposedNewState: encode(t, p, "ruleengine_rule", nil),
+		Config:           encode(t, p, "ruleengine_rule", nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := decode(t, p, "ruleengine_rule", resp.PlannedState); o != nil || len(resp.Diagnostics) > 0 {
+		t.Fatalf("planned %v, %v", o, resp.Diagnostics)
+	}
+}
+
+func TestValidateResourceConfig(t *testing.T) {
+	p := newProvider()
+	tests := []struct {
+		name     string
+		typeName string
+		config   object
+		wantErr  string
+	}{
+		{name: "rule", typeName: "ruleengine_rule", config: object{"name": "HighValue_Order-1", "grl": "rule A {}"}},
+		{name: "rule name", typeName: "ruleengine_rule", config: object{"name": "1 bad", "grl": "rule A {}"}, wantErr: "name must start with a letter"},
+		{name: "unknown rule name", typeName: "ruleengine_rule", config: object{"name": unknown, "grl": "rule A {}"}},
+		{name: "rule set", typeName: "ruleengine_rule_set", config: object{"name": "orders",
+			"rule": []interface{}{map[string]interface{}{"name": "A"}, map[string]interface{}{"name": "A", "version": "1.0.0"}}}},
+		{name: "blank rule set name", typeName: "ruleengine_rule_set", config: object{"name": " "}, wantErr: "name must not be empty"},
+		{name: "rule listed twice", typeName: "ruleengine_rule_set", config: object{"name": "orders",
+			"rule": []interface{}{map[string]interface{}{"name": "A"}, map[string]interface{}{"name": "A"}}}, wantErr: "rule A is listed more than once"},
+		{name: "destination", typeName: "ruleengine_destination", config: object{"name": "crm", "url": "https://crm.example.com",
+			"method": "PATCH", "timeout_ms": int64(60000), "max_retries": int64(0)}},
+		{name: "destination url", typeName: "ruleengine_destination", config: object{"name": "crm", "url": "ftp://crm.example.com"},
+			wantErr: "url must be an http or https URL"},
+		{name: "destination method", typeName: "ruleengine_destination", config: object{"name": "crm", "url": "https://crm.example.com", "method": "SEND"},
+			wantErr: "method must be"},
+		{name: "destination timeout", typeName: "ruleengine_destination", config: object{"name": "crm", "url": "https://crm.example.com", "timeout_ms": int64(0)},
+			wantErr: "timeout_ms must be between 1 and 60000"},
+		{name: "destination retries", typeName: "ruleengine_destination", config: object{"name": "crm", "url": "https://crm.example.com", "max_retries": int64(11)},
+			wantErr: "max_retries must be between 0 and 10"},
+		{name: "consumer", typeName: "ruleengine_consumer", config: object{"stream": "WEBHOOKS", "name": "workers", "max_deliver": int64(5)}},
+		{name: "pull consumer queue group", typeName: "ruleengine_consumer", config: object{"stream": "WEBHOOKS", "name": "workers", "pull": true, "queue_group": "q"},
+			wantErr: "pull consumers have no queue group"},
+		{name: "consumer ack wait", typeName: "ruleengine_consumer", config: object{"stream": "WEBHOOKS", "name": "workers", "ack_wait_seconds": int64(0)},
+			wantErr: "ack_wait_seconds must be at least 1"},
+		{name: "unknown type", typeName: "ruleengine_rules", wantErr: "unknown resource type ruleengine_rules"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config *tfprotov6.DynamicValue
+			if _, ok := p.resources[tt.typeName]; ok {
+				config = encode(t, p, tt.typeName, tt.config)
+			}
+			resp, err := p.ValidateResourceConfig(context.Background(), &tfprotov6.ValidateResourceConfigRequest{TypeName: tt.typeName, Config: config})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkErrs(t, summaries(resp.Diagnostics), tt.wantErr)
+		})
+	}
+}
+
+func TestUpgradeResourceState(t *testing.T) {
+	p := newProvider()
+	tests := []struct {
+		name    string
+		json    string
+		want    object
+		wantErr string
+	}{
+		{name: "current", json: `{"id":"A","name":"A","grl":"rule A {}","description":null,"change_notes":null,"enabled":true,"version":"1.0.0"}`,
+			want: object{"id": "A", "name": "A", "grl": "rule A {}", "description": nil, "change_notes": nil, "enabled": true, "version": "1.0.0"}},
+		{name: "attribute since removed", json: `{"id":"A","name":"A","grl":"rule A {}","enabled":true,"version":"1.0.0","owner":"team"}`,
+			want: object{"id": "A", "version": "1.0.0", "description": nil}},
+		{name: "wrong type", json: `{"id":"A","name":"A","grl":"rule A {}","enabled":"yes"}`, wantErr: "failed to read state"},
+		{name: "empty", wantErr: "no JSON value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := p.UpgradeResourceState(context.Background(), &tfprotov6.UpgradeResourceStateRequest{
+				TypeName: "ruleengine_rule", RawState: &tfprotov6.RawState{JSON: []byte(tt.json)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkErrs(t, summaries(resp.Diagnostics), tt.wantErr)
+			if tt.wantErr == "" {
+				checkState(t, decode(t, p, "ruleengine_rule", resp.UpgradedState), tt.want)
+			}
+		})
+	}
+}
+
+func TestImportResourceStateIDs(t *testing.T) {
+	p := newProvider()
+	tests := []struct {
+		typeName string
+		id       string
+		want     object
+		wantErr  string
+	}{
+		{typeName: "ruleengine_rule", id: "HighValueOrder", want: object{"id": "HighValueOrder", "name": "HighValueOrder"}},
+		{typeName: "ruleengine_rule", id: "high value", wantErr: "import a rule by its name"},
+		{typeName: "ruleengine_rule_set", id: "12", want: object{"id": "12"}},
+		{typeName: "ruleengine_rule_set", id: "orders", wantErr: "numeric id"},
+		{typeName: "ruleengine_destination", id: "crm", want: object{"name": "crm"}},
+		{typeName: "ruleengine_destination", id: "", wantErr: "webhook_name"},
+		{typeName: "ruleengine_consumer", id: "WEBHOOKS/workers", want: object{"id": "WEBHOOKS/workers", "stream": "WEBHOOKS", "name": "workers"}},
+		{typeName: "ruleengine_consumer", id: "workers", wantErr: "STREAM/CONSUMER"},
+		{typeName: "ruleengine_consumer", id: "WEBHOOKS/", wantErr: "STREAM/CONSUMER"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typeName+" "+tt.id, func(t *testing.T) {
+			resp, err := p.ImportResourceState(context.Background(), &tfprotov6.ImportResourceStateRequest{TypeName: tt.typeName, ID: tt.id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkErrs(t, summaries(resp.Diagnostics), tt.wantErr)
+			if tt.wantErr == "" {
+				checkState(t, decode(t, p, tt.typeName, resp.ImportedResources[0].State), tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateResourceConfig(t *testing.T) {
+	p := newProvider()
+	state := object{"id": "A", "name": "A", "grl": "rule A {}", "description": "d", "enabled": true, "version": "1.0.0"}
+	resp, err := p.GenerateResourceConfig(context.Background(), &tfprotov6.GenerateResourceConfigRequest{
+		TypeName: "ruleengine_rule", State: encode(t, p, "ruleengine_rule", state),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErrs(t, summaries(resp.Diagnostics), "")
+	// Only the provider sets id and version
+	checkState(t, decode(t, p, "ruleengine_rule", resp.Config),
+		object{"id": nil, "version": nil, "name": "A", "grl": "rule A {}", "description": "d", "enabled": true})
+}
+
+func TestStopProvider(t *testing.T) {
+	p := newProvider()
+	ctx, cancel := p.withStop(context.Background())
+	defer cancel()
+	if _, err := p.StopProvider(context.Background(), &tfprotov6.StopProviderRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	<-ctx.Done()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// ruleNamePattern matches the names rule_definitions accepts
+var ruleNamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+// ruleResource is a rule in the repository. Changing its GRL saves and
+// activates a new version, checked against the version last read so a
+// version activated elsewhere in between fails the apply instead of being
+// overwritten.
+type ruleResource struct{}
+
+var ruleSchema = &schema{
+	description: "A rule in the rule repository, with its active version's GRL.",
+	attributes: []attribute{
+		{name: "id", typ: typeString, computed: true, description: "The rule's name"},
+		{name: "name", typ: typeString, required: true, forceNew: true,
+			description: "Rule name: a letter followed by letters, digits, '_', and '-'"},
+		{name: "grl", typ: typeString, required: true,
+			description: "GRL of the active version; a change saves and activates a new version"},
+		{name: "description", typ: typeString, optional: true},
+		{name: "change_notes", typ: typeString, optional: true,
+			description: "Notes stored with the versions this resource saves"},
+		{name: "enabled", typ: typeBool, optional: true, computed: true, dflt: true,
+			description: "Whether the rule executes; defaults to true"},
+		{name: "version", typ: typeString, computed: true, description: "The active version"},
+	},
+}
+
+func (ruleResource) schema() *schema { return ruleSchema }
+
+func (ruleResource) validate(config object) []*tfprotov6.Diagnostic {
+	var diags []*tfprotov6.Diagnostic
+	if config.set("name") && !ruleNamePattern.MatchString(config.str("name")) {
+		diags = append(diags, invalid("name", "name must start with a letter and contain only letters, digits, '_' and '-'"))
+	}
+	return diags
+}
+
+func (ruleResource) plan(prior, planned object) {
+	if prior != nil && !reflect.DeepEqual(prior["grl"], planned["grl"]) {
+		planned["version"] = unknown
+	}
+}
+
+func (ruleResource) create(ctx context.Context, p *provider, planned object) (object, error) {
+	rules, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	rule, err := rules.CreateRule(ctx, ruleengine.SaveRuleInput{
+		Name:        planned.str("name"),
+		GRL:         planned.str("grl"),
+		Description: planned.str("description"),
+		ChangeNotes: planned.str("change_notes"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	state := copyObject(planned)
+	state["id"], state["version"], state["enabled"] = rule.Name, rule.ActiveVersion, true
+	if !planned.boolean("enabled") {
+		if err := rules.DisableRule(ctx, rule.Name); err != nil {
+			return state, err
+		}
+		state["enabled"] = false
+	}
+	return state, nil
+}
+
+func (ruleResource) read(ctx context.Context, p *provider, state object) (object, error) {
+	rules, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	rule, err := rules.GetRule(ctx, state.str("name"))
+	if errors.Is(err, ruleengine.ErrRuleNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	current := copyObject(state)
+	current["id"], current["name"], current["grl"] = rule.Name, rule.Name, rule.GRL
+	current["description"] = optionalString(state["description"], rule.Description)
+	current["enabled"], current["version"] = rule.IsActive, rule.ActiveVersion
+	return current, nil
+}
+
+func (ruleResource) update(ctx context.Context, p *provider, prior, planned object) (object, error) {
+	rules, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	name := planned.str("name")
+	state := copyObject(prior)
+	if planned.str("grl") != prior.str("grl") {
+		rule, err := rules.UpdateRule(ctx, ruleengine.SaveRuleInput{
+			Name:            name,
+			GRL:             planned.str("grl"),
+			ChangeNotes:     planned.str("change_notes"),
+			ExpectedVersion: prior.str("version"),
+			Activate:        true,
+		})
+		if err != nil {
+			return state, err
+		}
+		state["grl"], state["version"] = planned["grl"], rule.ActiveVersion
+	}
+	state["change_notes"] = planned["change_notes"]
+	if planned.str("description") != prior.str("description") {
+		if err := rules.SetRuleDescription(ctx, name, planned.str("description")); err != nil {
+			return state, err
+		}
+	}
+	state["description"] = planned["description"]
+	if enabled := planned.boolean("enabled"); enabled != prior.boolean("enabled") {
+		if enabled {
+			err = rules.EnableRule(ctx, name)
+		} else {
+			err = rules.DisableRule(ctx, name)
+		}
+		if err != nil {
+			return state, err
+		}
+		state["enabled"] = enabled
+	}
+	return state, nil
+}
+
+func (ruleResource) delete(ctx context.Context, p *provider, state object) error {
+	rules, err := p.client()
+	if err != nil {
+		return err
+	}
+	err = rules.DeleteRule(ctx, state.str("name"), "")
+	if errors.Is(err, ruleengine.ErrRuleNotFound) {
+		return nil
+	}
+	return err
+}
+
+// importState takes the rule's name
+func (ruleResource) importState(id string) (object, error) {
+	if !ruleNamePattern.MatchString(id) {
+		return nil, errors.New("import a rule by its name")
+	}
+	return object{"id": id, "name": id}, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectGetRule expects GetRule to find the rule name
+func expectGetRule(mock sqlmock.Sqlmock, name, description string, active bool, version, grl string) {
+	now := time.Now()
+	mock.ExpectQuery(`FROM rule_definitions rd`).WithArgs(name).WillReturnRows(sqlmock.NewRows(
+		[]string{"id", "name", "description", "is_active", "version", "grl", "created_at", "updated_at", "updated_by"}).
+		AddRow(1, name, description, active, version, grl, now, now, "tf"))
+}
+
+// expectSetRuleActive expects the rule to be enabled or disabled
+func expectSetRuleActive(mock sqlmock.Sqlmock, name string, active bool) {
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE rule_definitions SET is_active`).WithArgs(name, active).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func TestRuleResource(t *testing.T) {
+	rule := object{"id": "A", "name": "A", "grl": "rule A {}", "enabled": true, "version": "1.0.0"}
+	config := object{"name": "A", "grl": "rule A {}"}
+	tests := []struct {
+		name    string
+		prior   object
+		config  object
+		expect  func(mock sqlmock.Sqlmock)
+		want    object
+		wantErr string
+	}{
+		{name: "create", config: with(config, "description", "Orders over 1000", "change_notes", "first"),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT EXISTS`).WithArgs("A").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`rule_save`).WithArgs("A", "rule A {}", nil, "Orders over 1000", "first").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectGetRule(mock, "A", "Orders over 1000", true, "1.0.0", "rule A {}")
+			},
+			want: with(rule, "description", "Orders over 1000", "change_notes", "first")},
+		{name: "create disabled", config: with(config, "enabled", false),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT EXISTS`).WithArgs("A").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`rule_save`).WithArgs("A", "rule A {}", nil, nil, nil).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectGetRule(mock, "A", "", true, "1.0.0", "rule A {}")
+				expectSetRuleActive(mock, "A", false)
+			},
+			want: with(rule, "enabled", false)},
+		{name: "create existing", config: config,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT EXISTS`).WithArgs("A").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectRollback()
+			},
+			wantErr: "failed to create ruleengine_rule: A: rule already exists"},
+		{name: "new GRL", prior: rule, config: with(config, "grl", "rule A { }", "change_notes", "spacing"),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FOR UPDATE OF rd`).WithArgs("A").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("1.0.0"))
+				mock.ExpectExec(`rule_save`).WithArgs("A", "rule A { }", nil, "spacing").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(`ORDER BY rv.created_at DESC`).WithArgs("A").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("1.0.1"))
+				mock.ExpectExec(`rule_activate`).WithArgs("A", "1.0.1").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectGetRule(mock, "A", "", true, "1.0.1", "rule A { }")
+			},
+			want: with(rule, "grl", "rule A { }", "version", "1.0.1", "change_notes", "spacing")},
+		// Another version was activated since the last refresh
+		{name: "new GRL over a newer version", prior: rule, config: with(config, "grl", "rule A { }"),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FOR UPDATE OF rd`).WithArgs("A").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("1.0.3"))
+				mock.ExpectRollback()
+			},
+			want: rule, wantErr: "failed to update ruleengine_rule"},
+		{name: "description", prior: rule, config: with(config, "description", "Orders over 1000"),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE rule_definitions SET description`).WithArgs("A", "Orders over 1000").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			want: with(rule, "description", "Orders over 1000")},
+		{name: "description cleared", prior: with(rule, "description", "Orders over 1000"), config: config,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE rule_definitions SET description`).WithArgs("A", nil).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			want: with(rule, "description", nil)},
+		{name: "disable", prior: rule, config: with(config, "enabled", false),
+			expect: func(mock sqlmock.Sqlmock) { expectSetRuleActive(mock, "A", false) },
+			want:   with(rule, "enabled", false)},
+		{name: "enable", prior: with(rule, "enabled", false), config: with(config, "enabled", true),
+			expect: func(mock sqlmock.Sqlmock) { expectSetRuleActive(mock, "A", true) },
+			want:   rule},
+		{name: "unchanged", prior: rule, config: config, expect: func(mock sqlmock.Sqlmock) {}, want: rule},
+		{name: "delete", prior: rule,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`rule_delete`).WithArgs("A", nil).WillReturnRows(sqlmock.NewRows([]string{"deleted"}).AddRow(true))
+				mock.ExpectCommit()
+			}},
+		{name: "delete gone", prior: rule,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`rule_delete`).WithArgs("A", nil).WillReturnRows(sqlmock.NewRows([]string{"deleted"}).AddRow(false))
+				mock.ExpectRollback()
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock, _ := newTestProvider(t)
+			tt.expect(mock)
+			state, errs := apply(t, p, "ruleengine_rule", tt.prior, tt.config)
+			checkErrs(t, errs, tt.wantErr)
+			if tt.want == nil && state != nil {
+				t.Fatalf("state = %v, want none", state)
+			}
+			checkState(t, state, tt.want)
+		})
+	}
+}
+
+func TestRuleRead(t *testing.T) {
+	state := object{"id": "A", "name": "A", "grl": "rule A {}", "enabled": true, "version": "1.0.0"}
+	tests := []struct {
+		name   string
+		state  object
+		expect func(mock sqlmock.Sqlmock)
+		want   object
+	}{
+		{name: "unchanged", state: state,
+			expect: func(mock sqlmock.Sqlmock) { expectGetRule(mock, "A", "", true, "1.0.0", "rule A {}") },
+			want:   object{"grl": "rule A {}", "version": "1.0.0", "enabled": true, "description": nil}},
+		{name: "changed elsewhere", state: state,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectGetRule(mock, "A", "set by hand", false, "1.0.4", "rule A { hotfix }")
+			},
+			want: object{"grl": "rule A { hotfix }", "version": "1.0.4", "enabled": false, "description": "set by hand"}},
+		{name: "gone", state: state,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM rule_definitions rd`).WithArgs("A").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock, _ := newTestProvider(t)
+			tt.expect(mock)
+			current, errs := read(t, p, "ruleengine_rule", tt.state)
+			checkErrs(t, errs, "")
+			if tt.want == nil && current != nil {
+				t.Fatalf("state = %v, want none", current)
+			}
+			checkState(t, current, tt.want)
+		})
+	}
+}
+
+func TestRuleImport(t *testing.T) {
+	p, mock, _ := newTestProvider(t)
+	expectGetRule(mock, "HighValueOrder", "Orders over 1000", true, "2.0.0", "rule HighValueOrder {}")
+	state, errs := importState(t, p, "ruleengine_rule", "HighValueOrder")
+	checkErrs(t, errs, "")
+	checkState(t, state, object{"id": "HighValueOrder", "name": "HighValueOrder", "grl": "rule HighValueOrder {}",
+		"description": "Orders over 1000", "enabled": true, "version": "2.0.0", "change_notes": nil})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// ruleSetResource is a rule set and its members. The rule blocks give the
+// execution order; a rule set renamed here keeps its id.
+type ruleSetResource struct{}
+
+var ruleSetSchema = &schema{
+	description: "A rule set: rules evaluated together, in the order of its rule blocks.",
+	attributes: []attribute{
+		{name: "id", typ: typeString, computed: true, description: "The rule set's id"},
+		{name: "name", typ: typeString, required: true},
+		{name: "description", typ: typeString, optional: true},
+		{name: "enabled", typ: typeBool, optional: true, computed: true, dflt: true,
+			description: "Whether the rule set can be evaluated; defaults to true"},
+	},
+	blocks: []nestedBlock{{
+		name:        "rule",
+		description: "A member rule; members run in the order of the blocks",
+		attributes: []attribute{
+			{name: "name", typ: typeString, required: true},
+			{name: "version", typ: typeString, optional: true,
+				description: "Pinned version; the rule's active version when unset"},
+		},
+	}},
+}
+
+func (ruleSetResource) schema() *schema { return ruleSetSchema }
+
+func (ruleSetResource) validate(config object) []*tfprotov6.Diagnostic {
+	var diags []*tfprotov6.Diagnostic
+	if config.set("name") && strings.TrimSpace(config.str("name")) == "" {
+		diags = append(diags, invalid("name", "name must not be empty"))
+	}
+	seen := map[string]bool{}
+	for _, m := range config.blocks("rule") {
+		if !m.set("name") || !isKnown(m["version"]) {
+			continue
+		}
+		key := m.str("name") + "@" + m.str("version")
+		if seen[key] {
+			diags = append(diags, invalid("rule", "rule %s is listed more than once", strings.TrimSuffix(key, "@")))
+		}
+		seen[key] = true
+	}
+	return diags
+}
+
+func (ruleSetResource) plan(prior, planned object) {}
+
+func (ruleSetResource) create(ctx context.Context, p *provider, planned object) (object, error) {
+	rules, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	id, err := rules.CreateRuleSet(ctx, planned.str("name"), planned.str("description"))
+	if err != nil {
+		return nil, err
+	}
+	state := copyObject(planned)
+	state["id"], state["enabled"], state["rule"] = strconv.Itoa(id), true, []interface{}{}
+	if !planned.boolean("enabled") {
+		if err := rules.DisableRuleSet(ctx, id); err != nil {
+			return state, err
+		}
+		state["enabled"] = false
+	}
+	if err := syncMembers(ctx, rules, id, nil, members(planned)); err != nil {
+		return state, err
+	}
+	state["rule"] = planned["rule"]
+	return state, nil
+}
+
+func (ruleSetResource) read(ctx context.Context, p *provider, state object) (object, error) {
+	rules, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.Atoi(state.str("id"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule set id %q", state.str("id"))
+	}
+	rs, err := rules.GetRuleSet(ctx, id)
+	if errors.Is(err, ruleengine.ErrRuleSetNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	current := copyObject(state)
+	current["name"], current["enabled"] = rs.Name, rs.IsActive
+	current["description"] = optionalString(state["description"], rs.Description)
+	// Keep the configuration's blocks when the members match, since a
+	// version left unset may be null or ""
+	if !sameMembers(members(state), rs.Members) {
+		blocks := make([]interface{}, len(rs.Members))
+		for i, m := range rs.Members {
+			blocks[i] = map[string]interface{}{"name": m.Rule, "version": optionalString(nil, m.Version)}
+		}
+		current["rule"] = blocks
+	}
+	return current, nil
+}
+
+func (ruleSetResource) update(ctx context.Context, p *provider, prior, planned object) (object, error) {
+	rules, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.Atoi(prior.str("id"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule set id %q", prior.str("id"))
+	}
+	state := copyObject(prior)
+	if planned.str("name") != prior.str("name") || planned.str("description") != prior.str("description") {
+		if err := rules.UpdateRuleSet(ctx, id, planned.str("name"), planned.str("description")); err != nil {
+			return state, err
+		}
+	}
+	state["name"], state["description"] = planned["name"], planned["description"]
+	if enabled := planned.boolean("enabled"); enabled != prior.boolean("enabled") {
+		if enabled {
+			err = rules.EnableRuleSet(ctx, id)
+		} else {
+			err = rules.DisableRuleSet(ctx, id)
+		}
+		if err != nil {
+			return state, err
+		}
+		state["enabled"] = enabled
+	}
+	if err := syncMembers(ctx, rules, id, members(prior), members(planned)); err != nil {
+		return state, err
+	}
+	state["rule"] = planned["rule"]
+	return state, nil
+}
+
+func (ruleSetResource) delete(ctx context.Context, p *provider, state object) error {
+	rules, err := p.client()
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(state.str("id"))
+	if err != nil {
+		return fmt.Errorf("invalid rule set id %q", state.str("id"))
+	}
+	err = rules.DeleteRuleSet(ctx, id)
+	if errors.Is(err, ruleengine.ErrRuleSetNotFound) {
+		return nil
+	}
+	return err
+}
+
+// importState takes the rule set's id
+func (ruleSetResource) importState(id string) (object, error) {
+	if _, err := strconv.Atoi(id); err != nil {
+		return nil, errors.New("import a rule set by its numeric id")
+	}
+	return object{"id": id}, nil
+}
+
+// members are the rule blocks of o as rule set members, ordered from 1
+func members(o object) []ruleengine.RuleSetMember {
+	blocks := o.blocks("rule")
+	out := make([]ruleengine.RuleSetMember, len(blocks))
+	for i, b := range blocks {
+		out[i] = ruleengine.RuleSetMember{Rule: b.str("name"), Version: b.str("version"), Order: i + 1}
+	}
+	return out
+}
+
+// sameMembers reports whether want and got list the same rules in the
+// same order, whatever their order numbers
+func sameMembers(want, got []ruleengine.RuleSetMember) bool {
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if want[i].Rule != got[i].Rule || want[i].Version != got[i].Version {
+			return false
+		}
+	}
+	return true
+}
+
+// syncMembers removes the members of have that want drops, then adds or
+// reorders want's
+func syncMembers(ctx context.Context, rules *ruleengine.Client, id int, have, want []ruleengine.RuleSetMember) error {
+	kept := map[string]bool{}
+	for _, m := range want {
+		kept[m.Rule+"@"+m.Version] = true
+	}
+	for _, m := range have {
+		if kept[m.Rule+"@"+m.Version] {
+			continue
+		}
+		err := rules.RemoveRuleFromSet(ctx, id, m.Rule, m.Version)
+		if err != nil && !errors.Is(err, ruleengine.ErrRuleNotFound) {
+			return err
+		}
+	}
+	for _, m := range want {
+		if err := rules.AddRuleToSet(ctx, id, m); err != nil {
+			return fmt.Errorf("rule %s: %w", m.Rule, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// ruleBlocks are rule blocks of the named rules, "NAME@VERSION" pinning a
+// version
+func ruleBlocks(rules ...string) []interface{} {
+	blocks := make([]interface{}, len(rules))
+	for i, r := range rules {
+		name, version, pinned := strings.Cut(r, "@")
+		m := map[string]interface{}{"name": name, "version": nil}
+		if pinned {
+			m["version"] = version
+		}
+		blocks[i] = m
+	}
+	return blocks
+}
+
+// expectGetRuleSet expects GetRuleSet to find rule set 12 with members
+// given as by ruleBlocks
+func expectGetRuleSet(mock sqlmock.Sqlmock, name, description string, active bool, rules ...string) {
+	mock.ExpectQuery(`FROM rule_sets WHERE ruleset_id`).WithArgs(12).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "description", "is_active", "created_at"}).AddRow(name, description, active, time.Now()))
+	rows := sqlmock.NewRows([]string{"rule_name", "rule_version", "execution_order"})
+	for i, b := range ruleBlocks(rules...) {
+		m := b.(map[string]interface{})
+		version, _ := m["version"].(string)
+		rows.AddRow(m["name"], version, i+1)
+	}
+	mock.ExpectQuery(`ruleset_get_rules`).WithArgs(12).WillReturnRows(rows)
+}
+
+func TestRuleSetResource(t *testing.T) {
+	set := object{"id": "12", "name": "orders", "enabled": true, "rule": ruleBlocks("A", "B")}
+	config := object{"name": "orders", "rule": ruleBlocks("A", "B")}
+	added := func(mock sqlmock.Sqlmock, rule string, version interface{}, order int) {
+		mock.ExpectExec(`ruleset_add_rule`).WithArgs(12, rule, version, order).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	tests := []struct {
+		name    string
+		prior   object
+		config  object
+		expect  func(mock sqlmock.Sqlmock)
+		want    object
+		wantErr string
+	}{
+		{name: "create", config: with(config, "description", "Order checks"),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`ruleset_create`).WithArgs("orders", "Order checks").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(12))
+				added(mock, "A", nil, 1)
+				added(mock, "B", nil, 2)
+			},
+			want: with(set, "description", "Order checks")},
+		{name: "create disabled and pinned", config: with(config, "enabled", false, "rule", ruleBlocks("A@1.0.0")),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`ruleset_create`).WithArgs("orders", nil).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(12))
+				mock.ExpectExec(`UPDATE rule_sets SET is_active`).WithArgs(12, false).WillReturnResult(sqlmock.NewResult(0, 1))
+				added(mock, "A", "1.0.0", 1)
+			},
+			want: with(set, "enabled", false, "rule", ruleBlocks("A@1.0.0"))},
+		// The rule set exists, so it is kept, tainted, without its members
+		{name: "create with a missing rule", config: config,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`ruleset_create`).WithArgs("orders", nil).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(12))
+				mock.ExpectExec(`ruleset_add_rule`).WithArgs(12, "A", nil, 1).WillReturnError(errors.New("rule A does not exist"))
+			},
+			want: with(set, "rule", []interface{}{}), wantErr: "failed to create ruleengine_rule_set: rule A: rule A does not exist"},
+		{name: "rename", prior: set, config: with(config, "name", "order checks"),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE rule_sets SET name`).WithArgs(12, "order checks", nil).WillReturnResult(sqlmock.NewResult(0, 1))
+				added(mock, "A", nil, 1)
+				added(mock, "B", nil, 2)
+			},
+			want: with(set, "name", "order checks")},
+		{name: "disable", prior: set, config: with(config, "enabled", false),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE rule_sets SET is_active`).WithArgs(12, false).WillReturnResult(sqlmock.NewResult(0, 1))
+				added(mock, "A", nil, 1)
+				added(mock, "B", nil, 2)
+			},
+			want: with(set, "enabled", false)},
+		{name: "members dropped and reordered", prior: set, config: with(config, "rule", ruleBlocks("C", "B")),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`ruleset_remove_rule`).WithArgs(12, "A", nil).WillReturnRows(sqlmock.NewRows([]string{"removed"}).AddRow(true))
+				added(mock, "C", nil, 1)
+				added(mock, "B", nil, 2)
+			},
+			want: with(set, "rule", ruleBlocks("C", "B"))},
+		// A member removed elsewhere is already gone
+		{name: "member gone", prior: set, config: with(config, "rule", ruleBlocks("B")),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`ruleset_remove_rule`).WithArgs(12, "A", nil).WillReturnRows(sqlmock.NewRows([]string{"removed"}).AddRow(false))
+				added(mock, "B", nil, 1)
+			},
+			want: with(set, "rule", ruleBlocks("B"))},
+		{name: "version pinned", prior: set, config: with(config, "rule", ruleBlocks("A@1.0.0", "B")),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`ruleset_remove_rule`).WithArgs(12, "A", nil).WillReturnRows(sqlmock.NewRows([]string{"removed"}).AddRow(true))
+				added(mock, "A", "1.0.0", 1)
+				added(mock, "B", nil, 2)
+			},
+			want: with(set, "rule", ruleBlocks("A@1.0.0", "B"))},
+		{name: "delete", prior: set,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`ruleset_delete`).WithArgs(12).WillReturnRows(sqlmock.NewRows([]string{"deleted"}).AddRow(true))
+			}},
+		{name: "delete gone", prior: set,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`ruleset_delete`).WithArgs(12).WillReturnRows(sqlmock.NewRows([]string{"deleted"}).AddRow(false))
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock, _ := newTestProvider(t)
+			tt.expect(mock)
+			state, errs := apply(t, p, "ruleengine_rule_set", tt.prior, tt.config)
+			checkErrs(t, errs, tt.wantErr)
+			if tt.want == nil && state != nil {
+				t.Fatalf("state = %v, want none", state)
+			}
+			checkState(t, state, tt.want)
+		})
+	}
+}
+
+func TestRuleSetRead(t *testing.T) {
+	state := object{"id": "12", "name": "orders", "enabled": true, "rule": ruleBlocks("A", "B")}
+	tests := []struct {
+		name   string
+		state  object
+		expect func(mock sqlmock.Sqlmock)
+		want   object
+	}{
+		{name: "unchanged", state: state,
+			expect: func(mock sqlmock.Sqlmock) { expectGetRuleSet(mock, "orders", "", true, "A", "B") },
+			want:   object{"name": "orders", "description": nil, "enabled": true, "rule": ruleBlocks("A", "B")}},
+		{name: "changed elsewhere", state: state,
+			expect: func(mock sqlmock.Sqlmock) { expectGetRuleSet(mock, "checks", "Order checks", false, "B", "A@1.0.0") },
+			want: object{"name": "checks", "description": "Order checks", "enabled": false,
+				"rule": ruleBlocks("B", "A@1.0.0")}},
+		{name: "gone", state: state,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM rule_sets WHERE ruleset_id`).WithArgs(12).WillReturnRows(sqlmock.NewRows([]string{"name"}))
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock, _ := newTestProvider(t)
+			tt.expect(mock)
+			current, errs := read(t, p, "ruleengine_rule_set", tt.state)
+			checkErrs(t, errs, "")
+			if tt.want == nil && current != nil {
+				t.Fatalf("state = %v, want none", current)
+			}
+			checkState(t, current, tt.want)
+		})
+	}
+}
+
+func TestRuleSetImport(t *testing.T) {
+	p, mock, _ := newTestProvider(t)
+	expectGetRuleSet(mock, "orders", "Order checks", true, "A", "B@2.0.0")
+	state, errs := importState(t, p, "ruleengine_rule_set", "12")
+	checkErrs(t, errs, "")
+	checkState(t, state, object{"id": "12", "name": "orders", "description": "Order checks", "enabled": true,
+		"rule": ruleBlocks("A", "B@2.0.0")})
+}
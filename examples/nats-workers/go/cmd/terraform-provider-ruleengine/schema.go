@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// Attribute types
+var (
+	typeString     tftypes.Type = tftypes.String
+	typeNumber     tftypes.Type = tftypes.Number
+	typeBool       tftypes.Type = tftypes.Bool
+	typeStringList tftypes.Type = tftypes.List{ElementType: tftypes.String}
+	typeStringMap  tftypes.Type = tftypes.Map{ElementType: tftypes.String}
+)
+
+// attribute is one attribute of a resource or the provider
+type attribute struct {
+	name        string
+	typ         tftypes.Type
+	description string
+
+	required, optional, computed, sensitive bool
+
+	// forceNew replaces the resource when the attribute changes
+	forceNew bool
+	// dflt is planned for an optional, computed attribute left unset when
+	// the resource is created; without one it is unknown until apply
+	dflt interface{}
+}
+
+// nestedBlock is a list of blocks, such as a rule set's rule blocks
+type nestedBlock struct {
+	name        string
+	description string
+	attributes  []attribute
+}
+
+type schema struct {
+	description string
+	attributes  []attribute
+	blocks      []nestedBlock
+}
+
+func (s *schema) proto() *tfprotov6.Schema {
+	return &tfprotov6.Schema{Block: protoBlock(s.description, s.attributes, s.blocks)}
+}
+
+// objectType is the type of the resource's state, plan, and configuration
+func (s *schema) objectType() tftypes.Type {
+	return s.proto().ValueType()
+}
+
+func protoBlock(description string, attrs []attribute, blocks []nestedBlock) *tfprotov6.SchemaBlock {
+	b := &tfprotov6.SchemaBlock{Description: description}
+	for _, a := range attrs {
+		b.Attributes = append(b.Attributes, &tfprotov6.SchemaAttribute{
+			Name:        a.name,
+			Type:        a.typ,
+			Description: a.description,
+			Required:    a.required,
+			Optional:    a.optional,
+			Computed:    a.computed,
+			Sensitive:   a.sensitive,
+		})
+	}
+	for _, nb := range blocks {
+		b.BlockTypes = append(b.BlockTypes, &tfprotov6.SchemaNestedBlock{
+			TypeName: nb.name,
+			Block:    protoBlock(nb.description, nb.attributes, nil),
+			Nesting:  tfprotov6.SchemaNestedBlockNestingModeList,
+		})
+	}
+	return b
+}
+
+// complete adds the attributes and blocks missing from o as null values
+// and empty lists: Terraform needs every one of them in a state
+func (s *schema) complete(o object) object {
+	for _, a := range s.attributes {
+		if _, ok := o[a.name]; !ok {
+			o[a.name] = nil
+		}
+	}
+	for _, nb := range s.blocks {
+		if o[nb.name] == nil {
+			o[nb.name] = []interface{}{}
+		}
+	}
+	return o
+}
+
+// object is a resource's state, plan, or configuration
+type object map[string]interface{}
+
+// decodeObject decodes a DynamicValue of s, returning nil for a null
+// object
+func (s *schema) decodeObject(v *tfprotov6.DynamicValue) (object, error) {
+	if v == nil {
+		return nil, nil
+	}
+	value, err := v.Unmarshal(s.objectType())
+	if err != nil {
+		return nil, err
+	}
+	if value.IsNull() {
+		return nil, nil
+	}
+	m, ok := fromValue(value).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a known object, got %v", value)
+	}
+	return object(m), nil
+}
+
+// dynamicValue encodes o, or a null value for a nil o
+func (s *schema) dynamicValue(o object) (*tfprotov6.DynamicValue, error) {
+	var v interface{}
+	if o != nil {
+		v = o
+	}
+	value, err := toValue(s.objectType(), v)
+	if err != nil {
+		return nil, err
+	}
+	dv, err := tfprotov6.NewDynamicValue(s.objectType(), value)
+	if err != nil {
+		return nil, err
+	}
+	return &dv, nil
+}
+
+// copyObject is a shallow copy of o
+func copyObject(o object) object {
+	c := make(object, len(o))
+	for k, v := range o {
+		c[k] = v
+	}
+	return c
+}
+
+// str returns a string attribute, "" when null or unknown
+func (o object) str(name string) string {
+	s, _ := o[name].(string)
+	return s
+}
+
+// num returns a number attribute, 0 when null or unknown
+func (o object) num(name string) int {
+	switch n := o[name].(type) {
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+// boolean returns a bool attribute, false when null or unknown
+func (o object) boolean(name string) bool {
+	b, _ := o[name].(bool)
+	return b
+}
+
+// set reports whether an attribute is known and not null
+func (o object) set(name string) bool {
+	return o[name] != nil && isKnown(o[name])
+}
+
+// strings returns a list of strings attribute
+func (o object) strings(name string) []string {
+	list, _ := o[name].([]interface{})
+	out := make([]string, 0, len(list))
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// stringMap returns a map of strings attribute
+func (o object) stringMap(name string) map[string]string {
+	m, _ := o[name].(map[string]interface{})
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		if s, ok := v.(string); ok {
+			out[k] = s
+		}
+	}
+	return out
+}
+
+// blocks returns a nested block list attribute
+func (o object) blocks(name string) []object {
+	list, _ := o[name].([]interface{})
+	out := make([]object, 0, len(list))
+	for _, v := range list {
+		if m, ok := v.(map[string]interface{}); ok {
+			out = append(out, object(m))
+		}
+	}
+	return out
+}
+
+// optionalString is s for an optional attribute read back, keeping
+// prior's null or "" when s is empty so reading does not report a change
+func optionalString(prior interface{}, s string) interface{} {
+	if s == "" {
+		if p, ok := prior.(string); ok && p == "" {
+			return ""
+		}
+		return nil
+	}
+	return s
+}
+
+// optionalStrings is optionalString for lists
+func optionalStrings(prior interface{}, list []string) interface{} {
+	if len(list) == 0 {
+		if p, ok := prior.([]interface{}); ok && len(p) == 0 {
+			return []interface{}{}
+		}
+		return nil
+	}
+	out := make([]interface{}, len(list))
+	for i, s := range list {
+		out[i] = s
+	}
+	return out
+}
+
+// optionalStringMap is optionalString for maps
+func optionalStringMap(prior interface{}, m map[string]string) interface{} {
+	if len(m) == 0 {
+		if p, ok := prior.(map[string]interface{}); ok && len(p) == 0 {
+			return map[string]interface{}{}
+		}
+		return nil
+	}
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// attributePath is the path of a top-level attribute
+func attributePath(name string) *tftypes.AttributePath {
+	return tftypes.NewAttributePath().WithAttributeName(name)
+}
+
+// errorDiag reports err, against an attribute when one is named
+func errorDiag(err error, attr ...string) *tfprotov6.Diagnostic {
+	d := &tfprotov6.Diagnostic{Severity: tfprotov6.DiagnosticSeverityError, Summary: err.Error()}
+	if len(attr) > 0 {
+		d.Attribute = attributePath(attr[0])
+	}
+	return d
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// Resources work on plain Go values rather than tftypes.Value: fromValue
+// turns a value into nil, string, bool, int64, float64, []interface{},
+// map[string]interface{}, or unknown, and toValue turns those back into a
+// value of the schema's type.
+
+// unknownValue is a value Terraform will only know after apply
+type unknownValue struct{}
+
+var unknown = unknownValue{}
+
+// isKnown reports whether v, or any value inside it, is unknown
+func isKnown(v interface{}) bool {
+	switch v := v.(type) {
+	case unknownValue:
+		return false
+	case []interface{}:
+		for _, e := range v {
+			if !isKnown(e) {
+				return false
+			}
+		}
+	case map[string]interface{}:
+		for _, e := range v {
+			if !isKnown(e) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fromValue converts v. The type switch picks the Go type As needs, so As
+// cannot fail.
+func fromValue(v tftypes.Value) interface{} {
+	if !v.IsKnown() {
+		return unknown
+	}
+	if v.IsNull() {
+		return nil
+	}
+	switch v.Type().(type) {
+	case tftypes.List, tftypes.Set, tftypes.Tuple:
+		var elems []tftypes.Value
+		_ = v.As(&elems)
+		list := make([]interface{}, len(elems))
+		for i, e := range elems {
+			list[i] = fromValue(e)
+		}
+		return list
+	case tftypes.Map, tftypes.Object:
+		var elems map[string]tftypes.Value
+		_ = v.As(&elems)
+		m := make(map[string]interface{}, len(elems))
+		for k, e := range elems {
+			m[k] = fromValue(e)
+		}
+		return m
+	}
+	switch {
+	case v.Type().Is(tftypes.String):
+		var s string
+		_ = v.As(&s)
+		return s
+	case v.Type().Is(tftypes.Bool):
+		var b bool
+		_ = v.As(&b)
+		return b
+	case v.Type().Is(tftypes.Number):
+		var f big.Float
+		_ = v.As(&f)
+		if n, acc := f.Int64(); acc == big.Exact {
+			return n
+		}
+		n, _ := f.Float64()
+		return n
+	}
+	return nil
+}
+
+// toValue converts v to a value of typ. Attributes missing from an object
+// are null.
+func toValue(typ tftypes.Type, v interface{}) (tftypes.Value, error) {
+	switch v.(type) {
+	case unknownValue:
+		return tftypes.NewValue(typ, tftypes.UnknownValue), nil
+	case nil:
+		return tftypes.NewValue(typ, nil), nil
+	}
+	switch t := typ.(type) {
+	case tftypes.Object:
+		m, ok := asMap(v)
+		if !ok {
+			return tftypes.Value{}, fmt.Errorf("expected an object, got %T", v)
+		}
+		attrs := make(map[string]tftypes.Value, len(t.AttributeTypes))
+		for name, at := range t.AttributeTypes {
+			av, err := toValue(at, m[name])
+			if err != nil {
+				return tftypes.Value{}, fmt.Errorf("%s: %w", name, err)
+			}
+			attrs[name] = av
+		}
+		return tftypes.NewValue(t, attrs), nil
+	case tftypes.List:
+		var list []interface{}
+		switch l := v.(type) {
+		case []interface{}:
+			list = l
+		case []string:
+			for _, s := range l {
+				list = append(list, s)
+			}
+		default:
+			return tftypes.Value{}, fmt.Errorf("expected a list, got %T", v)
+		}
+		elems := make([]tftypes.Value, len(list))
+		for i, e := range list {
+			ev, err := toValue(t.ElementType, e)
+			if err != nil {
+				return tftypes.Value{}, fmt.Errorf("element %d: %w", i, err)
+			}
+			elems[i] = ev
+		}
+		return tftypes.NewValue(t, elems), nil
+	case tftypes.Map:
+		m, ok := asMap(v)
+		if !ok {
+			return tftypes.Value{}, fmt.Errorf("expected a map, got %T", v)
+		}
+		elems := make(map[string]tftypes.Value, len(m))
+		for k, e := range m {
+			ev, err := toValue(t.ElementType, e)
+			if err != nil {
+				return tftypes.Value{}, fmt.Errorf("key %q: %w", k, err)
+			}
+			elems[k] = ev
+		}
+		return tftypes.NewValue(t, elems), nil
+	}
+
+	var goValue interface{}
+	switch v := v.(type) {
+	case string:
+		if typ.Is(tftypes.String) {
+			goValue = v
+		}
+	case bool:
+		if typ.Is(tftypes.Bool) {
+			goValue = v
+		}
+	case int, int64, float64:
+		if typ.Is(tftypes.Number) {
+			goValue = number(v)
+		}
+	}
+	if goValue == nil {
+		return tftypes.Value{}, fmt.Errorf("expected a %s, got %T", typ, v)
+	}
+	return tftypes.NewValue(typ, goValue), nil
+}
+
+// number converts an int, int64, or float64
+func number(v interface{}) *big.Float {
+	switch n := v.(type) {
+	case int:
+		return new(big.Float).SetInt64(int64(n))
+	case int64:
+		return new(big.Float).SetInt64(n)
+	}
+	return big.NewFloat(v.(float64))
+}
+
+// asMap returns the elements of an object or map
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case object:
+		return m, true
+	case map[string]interface{}:
+		return m, true
+	}
+	return nil, false
+}
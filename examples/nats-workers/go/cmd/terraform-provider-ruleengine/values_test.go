@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+func TestValueRoundTrip(t *testing.T) {
+	member := tftypes.Object{AttributeTypes: map[string]tftypes.Type{"name": tftypes.String, "version": tftypes.String}}
+	tests := []struct {
+		name string
+		typ  tftypes.Type
+		v    interface{}
+		want interface{} // v when nil
+	}{
+		{name: "string", typ: typeString, v: "rule A {}"},
+		{name: "empty string", typ: typeString, v: ""},
+		{name: "null", typ: typeString, v: nil},
+		{name: "unknown", typ: typeString, v: unknown},
+		{name: "bool", typ: typeBool, v: false},
+		{name: "integer", typ: typeNumber, v: int64(5000)},
+		{name: "int", typ: typeNumber, v: 3, want: int64(3)},
+		{name: "fraction", typ: typeNumber, v: 0.5},
+		{name: "list", typ: typeStringList, v: []interface{}{"b", "a"}},
+		{name: "string slice", typ: typeStringList, v: []string{"b", "a"}, want: []interface{}{"b", "a"}},
+		{name: "empty list", typ: typeStringList, v: []interface{}{}},
+		{name: "unknown element", typ: typeStringList, v: []interface{}{"a", unknown}},
+		{name: "map", typ: typeStringMap, v: map[string]interface{}{"Authorization": "Bearer t"}},
+		{name: "object", typ: member, v: object{"name": "A", "version": "1.0.0"},
+			want: map[string]interface{}{"name": "A", "version": "1.0.0"}},
+		{name: "missing attribute", typ: member, v: map[string]interface{}{"name": "A"},
+			want: map[string]interface{}{"name": "A", "version": nil}},
+		{name: "blocks", typ: tftypes.List{ElementType: member}, v: []interface{}{map[string]interface{}{"name": "A", "version": nil}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := toValue(tt.typ, tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !value.Type().Equal(tt.typ) {
+				t.Fatalf("type = %s, want %s", value.Type(), tt.typ)
+			}
+			want := tt.want
+			if want == nil {
+				want = tt.v
+			}
+			if got := fromValue(value); !reflect.DeepEqual(got, want) {
+				t.Fatalf("round trip = %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestToValueErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  tftypes.Type
+		v    interface{}
+	}{
+		{name: "number as string", typ: typeString, v: int64(1)},
+		{name: "string as number", typ: typeNumber, v: "5000"},
+		{name: "string as bool", typ: typeBool, v: "true"},
+		{name: "string as list", typ: typeStringList, v: "a"},
+		{name: "bad element", typ: typeStringList, v: []interface{}{"a", true}},
+		{name: "list as map", typ: typeStringMap, v: []interface{}{}},
+		{name: "bad attribute", typ: ruleSchema.objectType(), v: object{"enabled": "yes"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := toValue(tt.typ, tt.v); err == nil {
+				t.Fatal("converted")
+			}
+		})
+	}
+}
+
+func TestIsKnown(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want bool
+	}{
+		{name: "null", v: nil, want: true},
+		{name: "string", v: "a", want: true},
+		{name: "unknown", v: unknown},
+		{name: "list", v: []interface{}{"a"}, want: true},
+		{name: "unknown element", v: []interface{}{"a", unknown}},
+		{name: "unknown in a block", v: []interface{}{map[string]interface{}{"name": unknown}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isKnown(tt.v); got != tt.want {
+				t.Fatalf("isKnown = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
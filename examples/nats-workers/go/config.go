@@ -0,0 +1,697 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v3"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine/envelope"
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// Settings come from three layers: built-in defaults, an optional YAML or
+// TOML file (-config or CONFIG_FILE), and environment variables, which
+// override the file. Every setting has a file key ("worker.batch_size")
+// and an environment variable (BATCH_SIZE).
+
+// Where a setting's value came from
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+)
+
+// setting binds a config file key and an environment variable to a Config
+// field
+type setting struct {
+	Key      string
+	Env      string
+	Value    interface{} // *string, *int, or *bool; nil when another package reads Env itself
+	Secret   bool
+	Required bool // must not be empty
+	source   string
+}
+
+// configSettings lists every setting, in the order printConfig shows them
+func configSettings(c *Config) []*setting {
+	return []*setting{
+		{Key: "nats.url", Env: "NATS_URL", Value: &c.NATS.URL, Required: true},
+		{Key: "nats.user", Env: "NATS_USER", Value: &c.NATS.User},
+		{Key: "nats.pass", Env: "NATS_PASS", Value: &c.NATS.Pass, Secret: true},
+		{Key: "nats.journal_path", Env: "JOURNAL_PATH", Value: &c.NATS.JournalPath},
+
+		{Key: "postgres.url", Env: "DATABASE_URL", Value: &c.Postgres.URL, Required: true},
+		{Key: "postgres.ops_url", Env: "OPS_DATABASE_URL", Value: &c.Postgres.OpsURL},
+		{Key: "postgres.ops_max_conns", Env: "OPS_DATABASE_MAX_CONNS", Value: &c.Postgres.OpsMaxConns},
+		{Key: "postgres.ops_buffer_size", Env: "OPS_BUFFER_SIZE", Value: &c.Postgres.OpsBufferSize},
+		{Key: "postgres.replica_url", Env: "REPLICA_DATABASE_URL", Value: &c.Postgres.ReplicaURL},
+		{Key: "postgres.standby_url", Env: "STANDBY_DATABASE_URL", Value: &c.Postgres.StandbyURL},
+		{Key: "postgres.retry_attempts", Env: "DB_RETRY_ATTEMPTS", Value: &c.Postgres.RetryAttempts},
+		{Key: "postgres.extension_check", Env: "EXTENSION_CHECK", Value: &c.Postgres.ExtensionCheck},
+
+		{Key: "worker.stream_name", Env: "STREAM_NAME", Value: &c.Worker.StreamName, Required: true},
+		{Key: "worker.consumer_name", Env: "CONSUMER_NAME", Value: &c.Worker.ConsumerName, Required: true},
+		{Key: "worker.queue_group", Env: "QUEUE_GROUP", Value: &c.Worker.QueueGroup, Required: true},
+		{Key: "worker.subject", Env: "SUBJECT", Value: &c.Worker.Subject, Required: true},
+		{Key: "worker.batch_size", Env: "BATCH_SIZE", Value: &c.Worker.BatchSize},
+		{Key: "worker.handler_timeout_seconds", Env: "HANDLER_TIMEOUT_SECONDS", Value: &c.Worker.HandlerTimeoutSeconds},
+		{Key: "worker.nak_backoff", Env: "NAK_BACKOFF", Value: &c.Worker.NakBackoff},
+		{Key: "worker.ack_sync_subjects", Env: "ACK_SYNC_SUBJECTS", Value: &c.Worker.AckSyncSubjects},
+		{Key: "worker.exactly_once_subjects", Env: "EXACTLY_ONCE_SUBJECTS", Value: &c.Worker.ExactlyOnceSubjects},
+		{Key: "worker.exactly_once_retention_hours", Env: "EXACTLY_ONCE_RETENTION_HOURS", Value: &c.Worker.ExactlyOnceRetentionHours},
+		{Key: "worker.max_ack_pending", Env: "MAX_ACK_PENDING", Value: &c.Worker.MaxAckPending},
+		{Key: "worker.max_payload_bytes", Env: "MAX_PAYLOAD_BYTES", Value: &c.Worker.MaxPayloadBytes},
+		{Key: "worker.priority_lanes", Env: "PRIORITY_LANES", Value: &c.Worker.PriorityLanes},
+		{Key: "worker.subject_weight", Env: "SUBJECT_WEIGHT", Value: &c.Worker.SubjectWeight},
+		{Key: "worker.fetchers", Env: "FETCHERS", Value: &c.Worker.Fetchers},
+
+		{Key: "admin.addr", Env: "ADMIN_ADDR", Value: &c.Admin.Addr},
+		{Key: "admin.token", Env: "ADMIN_TOKEN", Value: &c.Admin.Token, Secret: true},
+		{Key: "admin.enable_pprof", Env: "ENABLE_PPROF", Value: &c.Admin.EnablePprof},
+		{Key: "admin.enable_ui", Env: "ENABLE_UI", Value: &c.Admin.EnableUI},
+		{Key: "admin.tls_cert_file", Env: "ADMIN_TLS_CERT_FILE", Value: &c.Admin.TLSCertFile},
+		{Key: "admin.tls_key_file", Env: "ADMIN_TLS_KEY_FILE", Value: &c.Admin.TLSKeyFile},
+		{Key: "admin.tls_client_ca_file", Env: "ADMIN_TLS_CLIENT_CA_FILE", Value: &c.Admin.TLSClientCAFile},
+		{Key: "admin.tls_allowed_sans", Env: "ADMIN_TLS_ALLOWED_SANS", Value: &c.Admin.TLSAllowedSANs},
+
+		{Key: "lag.sample_interval_seconds", Env: "LAG_SAMPLE_INTERVAL_SECONDS", Value: &c.Lag.IntervalSeconds},
+		{Key: "lag.alert_threshold", Env: "LAG_ALERT_THRESHOLD", Value: &c.Lag.AlertThreshold},
+		{Key: "lag.alert_subject", Env: "LAG_ALERT_SUBJECT", Value: &c.Lag.AlertSubject},
+		{Key: "lag.alert_webhook_url", Env: "LAG_ALERT_WEBHOOK_URL", Value: &c.Lag.AlertWebhookURL, Secret: true},
+
+		{Key: "heartbeat.interval_seconds", Env: "WORKER_HEARTBEAT_SECONDS", Value: &c.Heartbeat.IntervalSeconds},
+		{Key: "heartbeat.dead_after_seconds", Env: "WORKER_DEAD_AFTER_SECONDS", Value: &c.Heartbeat.DeadAfterSeconds},
+		{Key: "heartbeat.alert_ruleset", Env: "WORKER_ALERT_RULESET", Value: &c.Heartbeat.AlertRuleSet},
+
+		{Key: "dedup.window_seconds", Env: "DEDUP_WINDOW_SECONDS", Value: &c.Dedup.WindowSeconds},
+		{Key: "dedup.backend", Env: "DEDUP_BACKEND", Value: &c.Dedup.Backend},
+		{Key: "dedup.cache_size", Env: "DEDUP_CACHE_SIZE", Value: &c.Dedup.CacheSize},
+
+		{Key: "leader.election", Env: "LEADER_ELECTION", Value: &c.Leader.Backend},
+		{Key: "leader.group", Env: "LEADER_GROUP", Value: &c.Leader.Group},
+		{Key: "leader.lease_seconds", Env: "LEADER_LEASE_SECONDS", Value: &c.Leader.LeaseSeconds},
+		{Key: "leader.bucket", Env: "LEADER_BUCKET", Value: &c.Leader.Bucket},
+
+		{Key: "retention.window", Env: "RETENTION_WINDOW", Value: &c.Retention.Window},
+
+		{Key: "stored_payload.serializer", Env: "STORED_PAYLOAD_SERIALIZER", Value: &c.StoredPayload.Serializer},
+		{Key: "stored_payload.keep", Env: "STORED_PAYLOAD_KEEP", Value: &c.StoredPayload.Keep},
+		{Key: "stored_payload.max_array_items", Env: "STORED_PAYLOAD_MAX_ARRAY_ITEMS", Value: &c.StoredPayload.MaxArrayItems},
+
+		{Key: "audit.flush_interval_ms", Env: "AUDIT_FLUSH_INTERVAL_MS", Value: &c.Audit.FlushIntervalMs},
+		{Key: "audit.batch_size", Env: "AUDIT_BATCH_SIZE", Value: &c.Audit.BatchSize},
+		{Key: "audit.buffer_size", Env: "AUDIT_BUFFER_SIZE", Value: &c.Audit.BufferSize},
+		{Key: "audit.success_sample_percent", Env: "AUDIT_SUCCESS_SAMPLE_PERCENT", Value: &c.Audit.SuccessSamplePercent},
+		{Key: "audit.failure_sample_percent", Env: "AUDIT_FAILURE_SAMPLE_PERCENT", Value: &c.Audit.FailureSamplePercent},
+
+		{Key: "log.success_sample_percent", Env: "LOG_SUCCESS_SAMPLE_PERCENT", Value: &c.Log.SuccessSamplePercent},
+		{Key: "log.failure_sample_percent", Env: "LOG_FAILURE_SAMPLE_PERCENT", Value: &c.Log.FailureSamplePercent},
+
+		{Key: "stats.tenant_field", Env: "STATS_TENANT_FIELD", Value: &c.Stats.TenantField},
+		{Key: "stats.tenant_token", Env: "STATS_TENANT_TOKEN", Value: &c.Stats.TenantToken},
+		{Key: "stats.raw_retention_days", Env: "STATS_RAW_RETENTION_DAYS", Value: &c.Stats.RawRetentionDays},
+		{Key: "stats.rules", Env: "STATS_RULES", Value: &c.Stats.Rules},
+		{Key: "stats.transactional", Env: "STATS_TRANSACTIONAL", Value: &c.Stats.Transactional},
+
+		{Key: "health_check.interval_seconds", Env: "HEALTH_CHECK_INTERVAL_SECONDS", Value: &c.HealthCheck.IntervalSeconds},
+		{Key: "health_check.timeout_ms", Env: "HEALTH_CHECK_TIMEOUT_MS", Value: &c.HealthCheck.TimeoutMs},
+		{Key: "health_check.failure_threshold", Env: "HEALTH_CHECK_FAILURE_THRESHOLD", Value: &c.HealthCheck.FailureThreshold},
+		{Key: "health_check.open_circuit", Env: "HEALTH_CHECK_OPEN_CIRCUIT", Value: &c.HealthCheck.OpenCircuit},
+
+		{Key: "failure_alerts.minutes", Env: "FAILURE_ALERT_MINUTES", Value: &c.FailureAlerts.Minutes},
+		{Key: "failure_alerts.action", Env: "FAILURE_ALERT_ACTION", Value: &c.FailureAlerts.Action},
+		{Key: "failure_alerts.subject", Env: "FAILURE_ALERT_SUBJECT", Value: &c.FailureAlerts.Subject},
+		{Key: "failure_alerts.link", Env: "FAILURE_ALERT_LINK", Value: &c.FailureAlerts.Link},
+
+		{Key: "schedules.poll_seconds", Env: "SCHEDULE_POLL_SECONDS", Value: &c.Schedules.PollSeconds},
+
+		{Key: "windows.subjects", Env: "WINDOW_SUBJECTS", Value: &c.Windows.Subjects},
+		{Key: "correlations.subjects", Env: "CORRELATION_SUBJECTS", Value: &c.Correlations.Subjects},
+
+		{Key: "cloudevents.inbound", Env: "CLOUDEVENTS_INBOUND", Value: &c.CloudEvents.Inbound},
+		{Key: "cloudevents.outbound", Env: "CLOUDEVENTS_OUTBOUND", Value: &c.CloudEvents.Outbound},
+		{Key: "cloudevents.source", Env: "CLOUDEVENTS_SOURCE", Value: &c.CloudEvents.Source},
+		{Key: "cloudevents.type", Env: "CLOUDEVENTS_TYPE", Value: &c.CloudEvents.Type},
+
+		{Key: "decoders.subjects", Env: "DECODE_SUBJECTS", Value: &c.Decoders.Subjects},
+		{Key: "decoders.schema_registry_url", Env: "SCHEMA_REGISTRY_URL", Value: &c.Decoders.SchemaRegistryURL},
+		{Key: "decoders.schema_registry_user", Env: "SCHEMA_REGISTRY_USER", Value: &c.Decoders.SchemaRegistryUser},
+		{Key: "decoders.schema_registry_password", Env: "SCHEMA_REGISTRY_PASSWORD", Value: &c.Decoders.SchemaRegistryPassword, Secret: true},
+		{Key: "decoders.protobuf_descriptor_set", Env: "PROTOBUF_DESCRIPTOR_SET", Value: &c.Decoders.ProtobufDescriptorSet},
+
+		{Key: "mqtt.url", Env: "MQTT_URL", Value: &c.MQTT.URL},
+		{Key: "mqtt.user", Env: "MQTT_USER", Value: &c.MQTT.User},
+		{Key: "mqtt.pass", Env: "MQTT_PASS", Value: &c.MQTT.Pass, Secret: true},
+		{Key: "mqtt.client_id", Env: "MQTT_CLIENT_ID", Value: &c.MQTT.ClientID},
+		{Key: "mqtt.topics", Env: "MQTT_TOPICS", Value: &c.MQTT.Topics},
+		{Key: "mqtt.qos", Env: "MQTT_QOS", Value: &c.MQTT.QoS},
+		{Key: "mqtt.share_group", Env: "MQTT_SHARE_GROUP", Value: &c.MQTT.ShareGroup},
+		{Key: "mqtt.direct", Env: "MQTT_DIRECT", Value: &c.MQTT.Direct},
+		{Key: "mqtt.keepalive_seconds", Env: "MQTT_KEEPALIVE_SECONDS", Value: &c.MQTT.KeepAliveSeconds},
+
+		{Key: "cdc.database_url", Env: "CDC_DATABASE_URL", Value: &c.CDC.DatabaseURL},
+		{Key: "cdc.tables", Env: "CDC_TABLES", Value: &c.CDC.Tables},
+		{Key: "cdc.plugin", Env: "CDC_PLUGIN", Value: &c.CDC.Plugin},
+		{Key: "cdc.slot", Env: "CDC_SLOT", Value: &c.CDC.Slot},
+		{Key: "cdc.publication", Env: "CDC_PUBLICATION", Value: &c.CDC.Publication},
+		{Key: "cdc.subject_prefix", Env: "CDC_SUBJECT_PREFIX", Value: &c.CDC.SubjectPrefix},
+		{Key: "cdc.poll_interval_ms", Env: "CDC_POLL_INTERVAL_MS", Value: &c.CDC.PollIntervalMs},
+		{Key: "cdc.batch_size", Env: "CDC_BATCH_SIZE", Value: &c.CDC.BatchSize},
+
+		{Key: "chaos.enabled", Env: "CHAOS_ENABLED", Value: &c.Chaos.Enabled},
+		{Key: "chaos.db_delay_percent", Env: "CHAOS_DB_DELAY_PERCENT", Value: &c.Chaos.DBDelayPercent},
+		{Key: "chaos.db_delay_max_ms", Env: "CHAOS_DB_DELAY_MAX_MS", Value: &c.Chaos.DBDelayMaxMs},
+		{Key: "chaos.http_failure_percent", Env: "CHAOS_HTTP_FAILURE_PERCENT", Value: &c.Chaos.HTTPFailurePercent},
+		{Key: "chaos.ack_drop_percent", Env: "CHAOS_ACK_DROP_PERCENT", Value: &c.Chaos.AckDropPercent},
+		{Key: "chaos.conn_kill_percent", Env: "CHAOS_CONN_KILL_PERCENT", Value: &c.Chaos.ConnKillPercent},
+
+		// Read by ruleengine/envelope; a file value is exported to the
+		// environment unless the variable is already set
+		{Key: "encryption.mode", Env: "PAYLOAD_ENCRYPTION"},
+		{Key: "encryption.key", Env: "PAYLOAD_KEY", Secret: true},
+		{Key: "encryption.vault_addr", Env: "VAULT_ADDR"},
+		{Key: "encryption.vault_token", Env: "VAULT_TOKEN", Secret: true},
+		{Key: "encryption.vault_transit_mount", Env: "VAULT_TRANSIT_MOUNT"},
+		{Key: "encryption.vault_transit_key", Env: "VAULT_TRANSIT_KEY"},
+		{Key: "encryption.vault_namespace", Env: "VAULT_NAMESPACE"},
+	}
+}
+
+// defaultConfig returns the built-in defaults. NATS_URL and DATABASE_URL
+// have none: falling back to localhost hid missing settings in production.
+// LEADER_GROUP defaults to QUEUE_GROUP, so it is filled in after the other
+// layers.
+func defaultConfig() Config {
+	var c Config
+	c.Postgres.OpsMaxConns = 5
+	c.Postgres.OpsBufferSize = 10000
+	c.Postgres.RetryAttempts = 3
+	c.Postgres.ExtensionCheck = "strict"
+	c.Worker.StreamName = "WEBHOOKS"
+	c.Worker.ConsumerName = "webhook-worker-1"
+	c.Worker.QueueGroup = "webhook-workers"
+	c.Worker.Subject = "webhooks.*"
+	c.Worker.BatchSize = 10
+	c.Worker.SubjectWeight = 1
+	c.Worker.ExactlyOnceRetentionHours = 168
+	c.Lag.IntervalSeconds = 30
+	c.Heartbeat.IntervalSeconds = 30
+	c.Heartbeat.DeadAfterSeconds = 90
+	c.Dedup.Backend = "memory"
+	c.Dedup.CacheSize = 10000
+	c.Leader.Backend = "postgres"
+	c.Leader.LeaseSeconds = 15
+	c.Leader.Bucket = "rule_worker_leaders"
+	c.StoredPayload.Serializer = "full"
+	c.Audit.BatchSize = 500
+	c.Audit.BufferSize = 10000
+	c.Audit.SuccessSamplePercent = 100
+	c.Audit.FailureSamplePercent = 100
+	c.Log.SuccessSamplePercent = 100
+	c.Log.FailureSamplePercent = 100
+	c.Stats.TenantField = "tenant_id"
+	c.Stats.RawRetentionDays = 7
+	c.Stats.Rules = true
+	c.HealthCheck.IntervalSeconds = 30
+	c.HealthCheck.TimeoutMs = 5000
+	c.HealthCheck.FailureThreshold = 3
+	c.Schedules.PollSeconds = 15
+	c.FailureAlerts.Minutes = 15
+	c.FailureAlerts.Subject = "webhooks.failure_alerts"
+	c.CloudEvents.Inbound = true
+	c.CloudEvents.Outbound = "none"
+	c.CloudEvents.Source = "/rule-engine/nats-webhook-worker"
+	c.CloudEvents.Type = "com.rule-engine.webhook"
+	c.MQTT.QoS = 1
+	c.MQTT.KeepAliveSeconds = 30
+	c.CDC.Plugin = "pgoutput"
+	c.CDC.Slot = "rule_engine_cdc"
+	c.CDC.Publication = "rule_engine_cdc"
+	c.CDC.SubjectPrefix = "cdc"
+	c.CDC.PollIntervalMs = 1000
+	c.CDC.BatchSize = 1000
+	c.Chaos.DBDelayMaxMs = 1000
+	return c
+}
+
+// configError lists every problem found in the configuration
+type configError []error
+
+func (e configError) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = "  - " + err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// loadedSettings is the effective configuration, for printConfig
+var loadedSettings []*setting
+
+// loadConfig builds config from the defaults, the file at path (if any),
+// and the environment, and validates the result. The error is a
+// configError listing every problem found.
+func loadConfig(path string) error {
+	config = defaultConfig()
+	settings := configSettings(&config)
+	for _, s := range settings {
+		s.source = sourceDefault
+	}
+	loadedSettings = settings
+
+	var errs []error
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return configError{err}
+		}
+		byKey := make(map[string]*setting, len(settings))
+		for _, s := range settings {
+			byKey[s.Key] = s
+		}
+		for key, value := range values {
+			s, ok := byKey[key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %q", path, key))
+				continue
+			}
+			if err := s.setFromFile(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if s.Value == nil && s.source == sourceFile {
+			continue // exported from the file above
+		}
+		if value := os.Getenv(s.Env); value != "" {
+			s.source = sourceEnv
+			if err := s.set(value); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if config.Leader.Group == "" {
+		config.Leader.Group = config.Worker.QueueGroup
+	}
+
+	errs = append(errs, validateConfig(settings)...)
+	if len(errs) > 0 {
+		return configError(errs)
+	}
+	return nil
+}
+
+// mustLoadConfig loads and prints the configuration, or exits with every
+// problem found
+func mustLoadConfig() {
+	if err := loadConfig(configFile); err != nil {
+		log.Fatalf("❌ Invalid configuration (%d problem(s)):\n%v", len(err.(configError)), err)
+	}
+	printConfig()
+}
+
+func (s *setting) name() string {
+	return s.Env + " (" + s.Key + ")"
+}
+
+// set parses value into the setting's field
+func (s *setting) set(value string) error {
+	switch v := s.Value.(type) {
+	case *string:
+		*v = value
+	case *int:
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s must be an integer, got %q", s.name(), value)
+		}
+		*v = n
+	case *bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, got %q", s.name(), value)
+		}
+		*v = b
+	case nil:
+		if s.source == sourceFile {
+			return os.Setenv(s.Env, value)
+		}
+	}
+	return nil
+}
+
+// setFromFile applies a scalar from the config file. Environment-only
+// settings are left alone when the variable is already set.
+func (s *setting) setFromFile(value interface{}) error {
+	switch value.(type) {
+	case string, int, int64, float64, bool:
+	default:
+		return fmt.Errorf("%s must be a single value", s.Key)
+	}
+	if s.Value == nil && os.Getenv(s.Env) != "" {
+		return nil
+	}
+	s.source = sourceFile
+	return s.set(fmt.Sprint(value))
+}
+
+// String is the value as printConfig shows it: secrets masked and
+// passwords removed from URLs
+func (s *setting) String() string {
+	var value string
+	switch v := s.Value.(type) {
+	case *string:
+		value = *v
+	case *int:
+		value = strconv.Itoa(*v)
+	case *bool:
+		value = strconv.FormatBool(*v)
+	case nil:
+		value = os.Getenv(s.Env)
+	}
+	if value == "" {
+		return `""`
+	}
+	if s.Secret {
+		return "********"
+	}
+	if strings.Contains(value, "://") {
+		if u, err := url.Parse(value); err == nil {
+			return u.Redacted()
+		}
+	}
+	return value
+}
+
+// validateConfig checks for missing settings and values that parse but
+// cannot work
+func validateConfig(settings []*setting) []error {
+	byEnv := make(map[string]*setting, len(settings))
+	var errs []error
+	for _, s := range settings {
+		byEnv[s.Env] = s
+		if s.Required && s.String() == `""` {
+			errs = append(errs, fmt.Errorf("%s is required", s.name()))
+		}
+	}
+	check := func(env string, ok bool, rule string) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s must be %s, got %s", byEnv[env].name(), rule, byEnv[env]))
+		}
+	}
+	// checkErr reports a parse error for a setting that is set
+	checkErr := func(env string, err error) {
+		if err != nil && byEnv[env].String() != `""` {
+			errs = append(errs, fmt.Errorf("%s: %v", byEnv[env].name(), err))
+		}
+	}
+
+	check("BATCH_SIZE", config.Worker.BatchSize > 0, "greater than 0")
+	check("HANDLER_TIMEOUT_SECONDS", config.Worker.HandlerTimeoutSeconds >= 0, "0 or more")
+	check("MAX_ACK_PENDING", config.Worker.MaxAckPending >= 0, "0 or more")
+	check("MAX_PAYLOAD_BYTES", config.Worker.MaxPayloadBytes >= 0, "0 or more")
+	check("SUBJECT_WEIGHT", config.Worker.SubjectWeight > 0, "greater than 0")
+	check("FETCHERS", config.Worker.Fetchers >= 0, "0 or more")
+	check("EXACTLY_ONCE_RETENTION_HOURS", config.Worker.ExactlyOnceRetentionHours > 0, "greater than 0")
+	check("OPS_DATABASE_MAX_CONNS", config.Postgres.OpsMaxConns > 0, "greater than 0")
+	check("OPS_BUFFER_SIZE", config.Postgres.OpsBufferSize >= 0, "0 or more")
+	check("DB_RETRY_ATTEMPTS", config.Postgres.RetryAttempts > 0, "greater than 0")
+	check("LAG_SAMPLE_INTERVAL_SECONDS", config.Lag.IntervalSeconds >= 0, "0 or more")
+	check("LAG_ALERT_THRESHOLD", config.Lag.AlertThreshold >= 0, "0 or more")
+	check("WORKER_HEARTBEAT_SECONDS", config.Heartbeat.IntervalSeconds >= 0, "0 or more")
+	check("WORKER_DEAD_AFTER_SECONDS", config.Heartbeat.IntervalSeconds == 0 || config.Heartbeat.DeadAfterSeconds > config.Heartbeat.IntervalSeconds,
+		"more than WORKER_HEARTBEAT_SECONDS")
+	check("WORKER_ALERT_RULESET", config.Heartbeat.AlertRuleSet >= 0, "a rule set id")
+	check("DEDUP_WINDOW_SECONDS", config.Dedup.WindowSeconds >= 0, "0 or more")
+	check("EXTENSION_CHECK", oneOf(config.Postgres.ExtensionCheck, "strict", "warn", "off"), "strict, warn, or off")
+	check("DEDUP_BACKEND", oneOf(config.Dedup.Backend, "memory", "postgres"), "memory or postgres")
+	check("DEDUP_CACHE_SIZE", config.Dedup.CacheSize > 0, "greater than 0")
+	check("LEADER_ELECTION", oneOf(config.Leader.Backend, "postgres", "nats", "none"), "postgres, nats, or none")
+	check("LEADER_LEASE_SECONDS", config.Leader.LeaseSeconds > 0, "greater than 0")
+	_, ok := payloadSerializers[config.StoredPayload.Serializer]
+	check("STORED_PAYLOAD_SERIALIZER", ok, "one of "+strings.Join(registeredPayloadSerializers(), ", "))
+	check("STORED_PAYLOAD_MAX_ARRAY_ITEMS", config.StoredPayload.MaxArrayItems >= 0, "0 or more")
+	check("AUDIT_FLUSH_INTERVAL_MS", config.Audit.FlushIntervalMs >= 0, "0 or more")
+	check("AUDIT_BATCH_SIZE", config.Audit.BatchSize > 0, "greater than 0")
+	check("AUDIT_BUFFER_SIZE", config.Audit.BufferSize >= config.Audit.BatchSize, "at least AUDIT_BATCH_SIZE")
+	check("AUDIT_SUCCESS_SAMPLE_PERCENT", validPercent(config.Audit.SuccessSamplePercent), "between 0 and 100")
+	check("AUDIT_FAILURE_SAMPLE_PERCENT", validPercent(config.Audit.FailureSamplePercent), "between 0 and 100")
+	check("LOG_SUCCESS_SAMPLE_PERCENT", validPercent(config.Log.SuccessSamplePercent), "between 0 and 100")
+	check("LOG_FAILURE_SAMPLE_PERCENT", validPercent(config.Log.FailureSamplePercent), "between 0 and 100")
+	check("STATS_RAW_RETENTION_DAYS", config.Stats.RawRetentionDays > 0, "greater than 0")
+	check("STATS_TENANT_TOKEN", config.Stats.TenantToken == 0 || subjectWildcardAt(config.Worker.Subject, config.Stats.TenantToken),
+		"0 or the position of a * or > token in SUBJECT")
+	check("HEALTH_CHECK_INTERVAL_SECONDS", config.HealthCheck.IntervalSeconds >= 0, "0 or more")
+	check("HEALTH_CHECK_TIMEOUT_MS", config.HealthCheck.TimeoutMs > 0, "greater than 0")
+	check("HEALTH_CHECK_FAILURE_THRESHOLD", config.HealthCheck.FailureThreshold > 0, "greater than 0")
+	check("FAILURE_ALERT_MINUTES", config.FailureAlerts.Minutes >= 0, "0 or more")
+	check("FAILURE_ALERT_SUBJECT", config.FailureAlerts.Subject != "" && !strings.ContainsAny(config.FailureAlerts.Subject, "*> \t"), "a subject without wildcards")
+	check("SCHEDULE_POLL_SECONDS", config.Schedules.PollSeconds >= 0, "0 or more")
+	check("HEALTH_CHECK_OPEN_CIRCUIT", !config.HealthCheck.OpenCircuit || config.HealthCheck.IntervalSeconds > 0, "false when HEALTH_CHECK_INTERVAL_SECONDS is 0")
+	check("CHAOS_DB_DELAY_PERCENT", validPercent(config.Chaos.DBDelayPercent), "between 0 and 100")
+	check("CHAOS_HTTP_FAILURE_PERCENT", validPercent(config.Chaos.HTTPFailurePercent), "between 0 and 100")
+	check("CHAOS_ACK_DROP_PERCENT", validPercent(config.Chaos.AckDropPercent), "between 0 and 100")
+	check("CHAOS_CONN_KILL_PERCENT", validPercent(config.Chaos.ConnKillPercent), "between 0 and 100")
+	check("CHAOS_DB_DELAY_MAX_MS", config.Chaos.DBDelayMaxMs >= 0, "0 or more")
+	check("CLOUDEVENTS_OUTBOUND", oneOf(config.CloudEvents.Outbound, "none", "binary", "structured"), "none, binary, or structured")
+	check("CLOUDEVENTS_SOURCE", config.CloudEvents.Source != "", "set")
+	check("CLOUDEVENTS_TYPE", config.CloudEvents.Type != "", "set")
+	check("MQTT_QOS", config.MQTT.QoS == 0 || config.MQTT.QoS == 1, "0 or 1")
+	check("MQTT_KEEPALIVE_SECONDS", config.MQTT.KeepAliveSeconds > 0 && config.MQTT.KeepAliveSeconds <= 65535, "between 1 and 65535")
+	check("MQTT_TOPICS", config.MQTT.URL == "" || config.MQTT.Topics != "", "set with MQTT_URL")
+	check("CDC_PLUGIN", oneOf(config.CDC.Plugin, "pgoutput", "wal2json"), "pgoutput or wal2json")
+	check("CDC_SLOT", cdcSlotName.MatchString(config.CDC.Slot), "1 to 63 lowercase letters, digits, or underscores")
+	check("CDC_PUBLICATION", config.CDC.Plugin != "pgoutput" || config.CDC.Publication != "", "set for pgoutput")
+	check("CDC_SUBJECT_PREFIX", config.CDC.SubjectPrefix != "" && !strings.ContainsAny(config.CDC.SubjectPrefix, "*> \t"), "set, without wildcards or spaces")
+	check("CDC_POLL_INTERVAL_MS", config.CDC.PollIntervalMs > 0, "greater than 0")
+	check("CDC_BATCH_SIZE", config.CDC.BatchSize > 0, "greater than 0")
+
+	checkErr("NATS_URL", validateNATSURLs(config.NATS.URL))
+	checkErr("DATABASE_URL", validatePostgresURL(config.Postgres.URL))
+	checkErr("OPS_DATABASE_URL", validatePostgresURL(config.Postgres.OpsURL))
+	checkErr("REPLICA_DATABASE_URL", validatePostgresURL(config.Postgres.ReplicaURL))
+	checkErr("STANDBY_DATABASE_URL", validatePostgresURL(config.Postgres.StandbyURL))
+	checkErr("LAG_ALERT_WEBHOOK_URL", validateHTTPURL(config.Lag.AlertWebhookURL))
+	if config.Admin.Addr != "" {
+		_, _, err := net.SplitHostPort(config.Admin.Addr)
+		checkErr("ADMIN_ADDR", err)
+	}
+	_, _, err := parseRetentionWindow(config.Retention.Window)
+	checkErr("RETENTION_WINDOW", err)
+	_, err = parseNakBackoff(config.Worker.NakBackoff)
+	checkErr("NAK_BACKOFF", err)
+	_, err = parsePriorityLanes(config.Worker.PriorityLanes)
+	checkErr("PRIORITY_LANES", err)
+	checkErr("SCHEMA_REGISTRY_URL", validateHTTPURL(config.Decoders.SchemaRegistryURL))
+	checkErr("MQTT_URL", validateMQTTURL(config.MQTT.URL))
+	_, err = parseMQTTTopics(config.MQTT.Topics)
+	checkErr("MQTT_TOPICS", err)
+	checkErr("CDC_DATABASE_URL", validatePostgresURL(config.CDC.DatabaseURL))
+	_, err = parseCDCTables(config.CDC.Tables)
+	checkErr("CDC_TABLES", err)
+	rules, err := parseDecodeSubjects(config.Decoders.Subjects)
+	checkErr("DECODE_SUBJECTS", err)
+	if err == nil {
+		checkErr("DECODE_SUBJECTS", validateDecodeRules(rules))
+	}
+
+	if (config.NATS.User == "") != (config.NATS.Pass == "") {
+		errs = append(errs, fmt.Errorf("NATS_USER and NATS_PASS must be set together"))
+	}
+	if err := validateAdminTLS(); err != nil {
+		errs = append(errs, err)
+	}
+	if config.Admin.Addr == "" {
+		check("ENABLE_PPROF", !config.Admin.EnablePprof, "false without ADMIN_ADDR")
+		check("ENABLE_UI", !config.Admin.EnableUI, "false without ADMIN_ADDR")
+	}
+	// The UI's replay is a POST a browser would send cross-site without a
+	// token
+	check("ENABLE_UI", !config.Admin.EnableUI || config.Admin.Token != "", "false without ADMIN_TOKEN")
+	if _, err := envelope.FromEnv(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// validateNATSURLs checks a comma-separated list of NATS server URLs
+func validateNATSURLs(urls string) error {
+	for _, raw := range strings.Split(urls, ",") {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("invalid URL: %v", err)
+		}
+		if !oneOf(u.Scheme, "nats", "tls", "ws", "wss") || u.Host == "" {
+			return fmt.Errorf("must be nats://host:port (or tls, ws, wss), got %s", u.Redacted())
+		}
+	}
+	return nil
+}
+
+// validatePostgresURL parses a postgres:// URL or key=value connection
+// string without connecting
+func validatePostgresURL(dsn string) error {
+	if dsn == "" {
+		return nil
+	}
+	if _, err := pq.NewConnector(dsn); err != nil {
+		return errors.New(strings.TrimPrefix(err.Error(), "pq: "))
+	}
+	return nil
+}
+
+func validateHTTPURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !oneOf(u.Scheme, "http", "https") || u.Host == "" {
+		return errors.New("must be an http:// or https:// URL")
+	}
+	return nil
+}
+
+// validateMQTTURL checks an MQTT broker URL
+func validateMQTTURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !oneOf(u.Scheme, "tcp", "mqtt", "ssl", "tls", "mqtts") || u.Host == "" {
+		return errors.New("must be tcp://host:port (or mqtt, ssl, tls, mqtts)")
+	}
+	return nil
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+func validPercent(n int) bool {
+	return n >= 0 && n <= 100
+}
+
+// splitList splits a comma-separated setting, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parsePriorityLanes parses PRIORITY_LANES, a comma-separated list of
+// name=subject:weight lanes such as "urgent=webhooks.urgent.*:8". A third
+// number, as in "bulk=webhooks.bulk.*:1:4", makes a pull lane with that
+// many fetchers.
+func parsePriorityLanes(value string) ([]worker.Lane, error) {
+	var lanes []worker.Lane
+	for _, item := range splitList(value) {
+		name, rest, ok := strings.Cut(item, "=")
+		subject, rest, _ := strings.Cut(rest, ":")
+		weight, fetchers, pull := strings.Cut(rest, ":")
+		lane := worker.Lane{Name: strings.TrimSpace(name), Subject: strings.TrimSpace(subject), Weight: 1}
+		if weight != "" {
+			n, err := strconv.Atoi(strings.TrimSpace(weight))
+			if err != nil || n <= 0 {
+				ok = false
+			}
+			lane.Weight = n
+		}
+		if pull {
+			n, err := strconv.Atoi(strings.TrimSpace(fetchers))
+			if err != nil || n <= 0 {
+				ok = false
+			}
+			lane.Fetchers = n
+		}
+		if !ok || lane.Name == "" || lane.Subject == "" {
+			return nil, fmt.Errorf("must look like urgent=webhooks.urgent.*:8 or bulk=webhooks.bulk.*:1:4, got %q", item)
+		}
+		lanes = append(lanes, lane)
+	}
+	return lanes, nil
+}
+
+// parseNakBackoff parses NAK_BACKOFF, a comma-separated list of redelivery
+// delays by attempt such as "5s,30s,2m"
+func parseNakBackoff(value string) ([]time.Duration, error) {
+	var delays []time.Duration
+	for _, item := range splitList(value) {
+		d, err := time.ParseDuration(item)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("must look like 5s,30s,2m, got %q", value)
+		}
+		delays = append(delays, d)
+	}
+	return delays, nil
+}
+
+// readConfigFile reads a YAML (.yaml, .yml) or TOML (.toml) file into
+// "section.key" values
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var doc map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		_, err = toml.Decode(string(data), &doc)
+	default:
+		return nil, fmt.Errorf("%s: config file must end in .yaml, .yml, or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := map[string]interface{}{}
+	for section, body := range doc {
+		if body == nil {
+			continue // every key commented out
+		}
+		table, ok := body.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: %q must be a section of settings", path, section)
+		}
+		for key, value := range table {
+			values[section+"."+key] = value
+		}
+	}
+	return values, nil
+}
+
+// printConfig logs the effective configuration and where each value came
+// from, with secrets masked
+func printConfig() {
+	log.Printf("Configuration:")
+	for _, s := range loadedSettings {
+		if s.Value == nil && s.source == sourceDefault && os.Getenv(s.Env) == "" {
+			continue
+		}
+		log.Printf("  %-32s %s (%s)", s.Key, s, s.source)
+	}
+	log.Printf("  Action Types: %s", strings.Join(registeredActionTypes(), ", "))
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+)
+
+// "snapshot" writes the consumer's position in the stream and its
+// PostgreSQL statistics to a file; "restore" recreates the consumer from
+// that file, for moving a worker to another NATS cluster without
+// redelivering what it already processed or resetting its statistics.
+// Workers should be stopped for the snapshot: messages they hold unacked
+// are delivered again after the restore.
+
+// consumerSnapshot is the file written by snapshot and read by restore
+type consumerSnapshot struct {
+	TakenAt  time.Time          `json:"taken_at"`
+	Stream   string             `json:"stream"`
+	Consumer string             `json:"consumer"`
+	Lanes    []consumerPosition `json:"lanes"`
+	Stats    json.RawMessage    `json:"stats"` // rule_nats_consumer_stats row, or null
+	Usage    json.RawMessage    `json:"usage"` // rule_nats_consumer_usage rows
+}
+
+// consumerPosition is one lane's durable consumer
+type consumerPosition struct {
+	Lane           string              `json:"lane,omitempty"` // "" for the SUBJECT consumer
+	Config         nats.ConsumerConfig `json:"config"`
+	Delivered      nats.SequenceInfo   `json:"delivered"`
+	AckFloor       nats.SequenceInfo   `json:"ack_floor"`
+	NumAckPending  int                 `json:"num_ack_pending"`
+	NumRedelivered int                 `json:"num_redelivered"`
+	NumPending     uint64              `json:"num_pending"`
+	// ResumeTime is when the first unacknowledged message was published,
+	// or TakenAt if there was none; restore -by-time starts from it
+	ResumeTime *time.Time `json:"resume_time,omitempty"`
+}
+
+// consumerStateCommand runs snapshot, restore, or cutover and returns the
+// process exit code
+func consumerStateCommand(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&configFile, "config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file; environment variables override it")
+	var (
+		path           string
+		stream, target string
+		subject        string
+		byTime, force  bool
+		keepOld        bool
+		drain          time.Duration
+	)
+	switch name {
+	case "snapshot":
+		fs.StringVar(&path, "o", "-", "file to write the snapshot to (- for stdout)")
+	case "restore":
+		fs.StringVar(&path, "i", "-", "snapshot file to restore (- for stdin)")
+		fs.StringVar(&stream, "stream", "", "stream to restore into (default: the snapshot's)")
+		fs.StringVar(&target, "consumer", "", "consumer name to restore as (default: the snapshot's)")
+		fs.BoolVar(&byTime, "by-time", false, "resume from publish times instead of stream sequences, for streams copied without their sequences")
+		fs.BoolVar(&force, "force", false, "replace consumers that already exist")
+	case "cutover":
+		fs.StringVar(&target, "to", "", "consumer name to move to (default: CONSUMER_NAME, to change only the subject)")
+		fs.StringVar(&subject, "subject", "", "filter subject of the new consumer (default: SUBJECT)")
+		fs.DurationVar(&drain, "drain-timeout", 2*time.Minute, "how long to wait for the old consumer's unacknowledged messages")
+		fs.BoolVar(&keepOld, "keep-old", false, "leave the old consumer paused instead of deleting it")
+		fs.BoolVar(&force, "force", false, "replace consumers that already exist under the new name")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := loadConfig(configFile); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		return 1
+	}
+
+	nc, err := nats.Connect(config.NATS.URL,
+		nats.UserInfo(config.NATS.User, config.NATS.Pass),
+		nats.Name("Rule Engine Webhook Worker "+name))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: failed to connect to NATS: %v\n", name, err)
+		return 1
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+
+	// Statistics live in the operational database
+	dsn := config.Postgres.OpsURL
+	if dsn == "" {
+		dsn = config.Postgres.URL
+	}
+	if opsDB, err = openPostgres(dsn); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: failed to connect to PostgreSQL: %v\n", name, err)
+		return 1
+	}
+	defer opsDB.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute+drain)
+	defer cancel()
+	switch name {
+	case "snapshot":
+		err = snapshotConsumer(ctx, js, path)
+	case "restore":
+		err = restoreConsumer(ctx, js, path, stream, target, byTime, force)
+	case "cutover":
+		if target == "" {
+			target = config.Worker.ConsumerName
+		}
+		err = cutoverConsumer(ctx, js, target, subject, drain, keepOld, force)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// snapshotConsumer writes the configured consumer and its lanes to path
+func snapshotConsumer(ctx context.Context, js nats.JetStreamContext, path string) error {
+	snap := consumerSnapshot{
+		TakenAt:  time.Now().UTC(),
+		Stream:   config.Worker.StreamName,
+		Consumer: config.Worker.ConsumerName,
+	}
+	stream, err := js.StreamInfo(snap.Stream, nats.Context(ctx))
+	if err != nil {
+		return fmt.Errorf("stream %s: %w", snap.Stream, err)
+	}
+
+	// Checked by validateConfig
+	lanes, _ := parsePriorityLanes(config.Worker.PriorityLanes)
+	names := []string{""}
+	for _, l := range lanes {
+		names = append(names, l.Name)
+	}
+	for _, lane := range names {
+		durable := laneConsumer(snap.Consumer, lane)
+		info, err := js.ConsumerInfo(snap.Stream, durable, nats.Context(ctx))
+		if err != nil {
+			return fmt.Errorf("consumer %s: %w", durable, err)
+		}
+		pos := consumerPosition{
+			Lane:           lane,
+			Config:         info.Config,
+			Delivered:      info.Delivered,
+			AckFloor:       info.AckFloor,
+			NumAckPending:  info.NumAckPending,
+			NumRedelivered: info.NumRedelivered,
+			NumPending:     info.NumPending,
+		}
+		if info.NumAckPending > 0 {
+			log.Printf("⚠️  %s has %d unacknowledged message(s); they will be delivered again after a restore", durable, info.NumAckPending)
+		}
+
+		// The message after the ack floor may have been deleted, and
+		// resuming by time needs its publish time
+		resume := snap.TakenAt
+		if next := info.AckFloor.Stream + 1; next <= stream.State.LastSeq {
+			msg, err := js.GetMsg(snap.Stream, next, nats.Context(ctx))
+			switch {
+			case err == nil:
+				resume = msg.Time
+			case errors.Is(err, nats.ErrMsgNotFound):
+				resume = stream.State.FirstTime
+			default:
+				return fmt.Errorf("stream %s message %d: %w", snap.Stream, next, err)
+			}
+		}
+		pos.ResumeTime = &resume
+		snap.Lanes = append(snap.Lanes, pos)
+	}
+
+	err = opsDB.QueryRowContext(ctx,
+		`SELECT row_to_json(s) FROM rule_nats_consumer_stats s WHERE stream_name = $1 AND consumer_name = $2`,
+		snap.Stream, snap.Consumer,
+	).Scan(&snap.Stats)
+	if errors.Is(err, sql.ErrNoRows) {
+		snap.Stats = json.RawMessage("null")
+	} else if err != nil {
+		return fmt.Errorf("failed to read consumer statistics: %w", err)
+	}
+	err = opsDB.QueryRowContext(ctx,
+		`SELECT COALESCE(json_agg(u ORDER BY hour_start), '[]')
+		 FROM rule_nats_consumer_usage u WHERE stream_name = $1 AND consumer_name = $2`,
+		snap.Stream, snap.Consumer,
+	).Scan(&snap.Usage)
+	if err != nil {
+		return fmt.Errorf("failed to read consumer usage: %w", err)
+	}
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(path, data, 0o644)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("✅ Snapshot of %s/%s (%d consumer(s)) taken", snap.Stream, snap.Consumer, len(snap.Lanes))
+	return nil
+}
+
+// restoreConsumer recreates the consumers in the snapshot at path, each
+// starting after its ack floor, and upserts the statistics
+func restoreConsumer(ctx context.Context, js nats.JetStreamContext, path, stream, consumerName string, byTime, force bool) error {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	var snap consumerSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if stream == "" {
+		stream = snap.Stream
+	}
+	if consumerName == "" {
+		consumerName = snap.Consumer
+	}
+
+	// Refuse before changing anything
+	for _, pos := range snap.Lanes {
+		durable := laneConsumer(consumerName, pos.Lane)
+		_, err := js.ConsumerInfo(stream, durable, nats.Context(ctx))
+		switch {
+		case errors.Is(err, nats.ErrConsumerNotFound):
+		case err != nil:
+			return fmt.Errorf("consumer %s: %w", durable, err)
+		case !force:
+			return fmt.Errorf("consumer %s already exists on stream %s (use -force to replace it)", durable, stream)
+		}
+		if byTime && pos.ResumeTime == nil {
+			return fmt.Errorf("consumer %s: snapshot has no resume time", durable)
+		}
+	}
+
+	for _, pos := range snap.Lanes {
+		durable := laneConsumer(consumerName, pos.Lane)
+		cfg := pos.Config
+		cfg.Durable, cfg.Name = durable, ""
+		cfg.OptStartSeq, cfg.OptStartTime = 0, nil
+		if byTime {
+			cfg.DeliverPolicy = nats.DeliverByStartTimePolicy
+			cfg.OptStartTime = pos.ResumeTime
+		} else {
+			cfg.DeliverPolicy = nats.DeliverByStartSequencePolicy
+			cfg.OptStartSeq = pos.AckFloor.Stream + 1
+		}
+		// A fresh inbox, as in worker.Run, so the consumer outlives
+		// Pause
+		if cfg.DeliverSubject != "" {
+			cfg.DeliverSubject = nats.NewInbox()
+		}
+		if force {
+			if err := js.DeleteConsumer(stream, durable, nats.Context(ctx)); err != nil && !errors.Is(err, nats.ErrConsumerNotFound) {
+				return fmt.Errorf("failed to delete consumer %s: %w", durable, err)
+			}
+		}
+		if _, err := js.AddConsumer(stream, &cfg, nats.Context(ctx)); err != nil {
+			return fmt.Errorf("failed to create consumer %s: %w", durable, err)
+		}
+		if byTime {
+			log.Printf("✅ Restored %s on %s from %s", durable, stream, pos.ResumeTime.Format(time.RFC3339))
+		} else {
+			log.Printf("✅ Restored %s on %s from sequence %d", durable, stream, cfg.OptStartSeq)
+		}
+	}
+
+	if err := ensureOpsSchema(); err != nil {
+		return err
+	}
+	if err := restoreStats(ctx, &snap, stream, consumerName); err != nil {
+		return fmt.Errorf("consumers restored, but statistics were not: %w", err)
+	}
+	return nil
+}
+
+// restoreStats writes the snapshot's statistics and usage rows under
+// stream and consumerName, replacing any already there
+func restoreStats(ctx context.Context, snap *consumerSnapshot, stream, consumerName string) error {
+	tx, err := opsDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var row map[string]json.RawMessage
+	if len(snap.Stats) > 0 {
+		if err := json.Unmarshal(snap.Stats, &row); err != nil {
+			return fmt.Errorf("invalid statistics: %w", err)
+		}
+	}
+	if row != nil {
+		delete(row, "consumer_id")
+		row["stream_name"], _ = json.Marshal(stream)
+		row["consumer_name"], _ = json.Marshal(consumerName)
+		columns := make([]string, 0, len(row))
+		for column := range row {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		var updates []string
+		for i, column := range columns {
+			columns[i] = pq.QuoteIdentifier(column)
+			updates = append(updates, columns[i]+" = EXCLUDED."+columns[i])
+		}
+		record, _ := json.Marshal(row)
+		list := strings.Join(columns, ", ")
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO rule_nats_consumer_stats (`+list+`)
+			 SELECT `+list+` FROM json_populate_record(NULL::rule_nats_consumer_stats, $1)
+			 ON CONFLICT (stream_name, consumer_name) DO UPDATE SET `+strings.Join(updates, ", "),
+			string(record),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	usage := string(snap.Usage)
+	if usage == "" || usage == "null" {
+		usage = "[]"
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO rule_nats_consumer_usage (stream_name, consumer_name, hour_start, messages, bytes)
+		 SELECT $1, $2, hour_start, messages, bytes
+		 FROM json_populate_recordset(NULL::rule_nats_consumer_usage, $3)
+		 ON CONFLICT (stream_name, consumer_name, hour_start) DO UPDATE SET
+		     messages = EXCLUDED.messages,
+		     bytes = EXCLUDED.bytes`,
+		stream, consumerName, usage,
+	)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("✅ Restored statistics for %s/%s", stream, consumerName)
+	return nil
+}
+
+// laneConsumer is the durable name worker.Lane gives lane of consumer
+func laneConsumer(consumer, lane string) string {
+	if lane == "" {
+		return consumer
+	}
+	return consumer + "-" + lane
+}
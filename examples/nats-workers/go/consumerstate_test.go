@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/internal/natstest"
+)
+
+// consumerServer starts a fake NATS server with a RULES stream holding
+// messages published one millisecond apart
+func consumerServer(t *testing.T, messages int) (*natstest.Server, nats.JetStreamContext) {
+	t.Helper()
+	srv := natstest.NewServer(t)
+	srv.AddStream("RULES", "rules.>")
+	for i := 1; i <= messages; i++ {
+		srv.Publish("rules.orders", nil, []byte{byte('0' + i)})
+		time.Sleep(time.Millisecond)
+	}
+	nc, err := nats.Connect(srv.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, _ := nc.JetStream()
+	return srv, js
+}
+
+// setConsumerConfig points the configuration at RULES/webhooks
+func setConsumerConfig(t *testing.T, lanes string) {
+	t.Helper()
+	prev := config.Worker
+	t.Cleanup(func() { config.Worker = prev })
+	config.Worker.StreamName, config.Worker.ConsumerName, config.Worker.PriorityLanes = "RULES", "webhooks", lanes
+}
+
+// ackFirst takes delivery of every message of a push consumer and acks
+// the first n
+func ackFirst(t *testing.T, srv *natstest.Server, deliverSubject string, total, n int) {
+	t.Helper()
+	nc, err := nats.Connect(srv.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	sub, _ := nc.SubscribeSync(deliverSubject)
+	nc.Flush()
+	for i := 0; i < total; i++ {
+		msg, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < n {
+			msg.AckSync()
+		}
+	}
+}
+
+func TestLaneConsumer(t *testing.T) {
+	if got := laneConsumer("webhooks", ""); got != "webhooks" {
+		t.Errorf("subject lane = %s", got)
+	}
+	if got := laneConsumer("webhooks", "urgent"); got != "webhooks-urgent" {
+		t.Errorf("urgent lane = %s", got)
+	}
+}
+
+func TestSnapshotAndRestoreConsumer(t *testing.T) {
+	setConsumerConfig(t, "urgent=rules.urgent.>:4")
+	src, js := consumerServer(t, 5)
+	js.AddConsumer("RULES", &nats.ConsumerConfig{Durable: "webhooks", AckPolicy: nats.AckExplicitPolicy,
+		FilterSubject: "rules.>", DeliverSubject: "old.inbox", DeliverGroup: "webhooks", MaxDeliver: 3})
+	js.AddConsumer("RULES", &nats.ConsumerConfig{Durable: "webhooks-urgent", AckPolicy: nats.AckExplicitPolicy,
+		FilterSubject: "rules.urgent.>"})
+	// Of the subject lane's first five, three are acked and two held
+	ackFirst(t, src, "old.inbox", 5, 3)
+	fourth := src.Messages("RULES")[3].Time
+
+	ops := mockOpsDB(t)
+	// lib/pq returns json columns as bytes
+	ops.ExpectQuery(`SELECT row_to_json\(s\) FROM rule_nats_consumer_stats`).WithArgs("RULES", "webhooks").
+		WillReturnRows(sqlmock.NewRows([]string{"row"}).AddRow([]byte(`{"consumer_id": 7, "stream_name": "RULES", "consumer_name": "webhooks", "messages_processed": 42}`)))
+	ops.ExpectQuery(`FROM rule_nats_consumer_usage u`).WithArgs("RULES", "webhooks").
+		WillReturnRows(sqlmock.NewRows([]string{"usage"}).AddRow([]byte(`[{"hour_start": "2026-10-16T09:00:00Z", "messages": 40, "bytes": 4000}]`)))
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := snapshotConsumer(context.Background(), js, path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	var snap consumerSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Stream != "RULES" || snap.Consumer != "webhooks" || len(snap.Lanes) != 2 {
+		t.Fatalf("snapshot = %s", data)
+	}
+	lane, urgent := snap.Lanes[0], snap.Lanes[1]
+	if lane.Lane != "" || lane.AckFloor.Stream != 3 || lane.Config.FilterSubject != "rules.>" || !lane.ResumeTime.Equal(fourth) {
+		t.Fatalf("subject lane = %+v, want ack floor 3 resuming at %s", lane, fourth)
+	}
+	if urgent.Lane != "urgent" || urgent.AckFloor.Stream != 0 || urgent.ResumeTime == nil {
+		t.Fatalf("urgent lane = %+v", urgent)
+	}
+	if !strings.Contains(string(snap.Stats), `"messages_processed": 42`) || !strings.Contains(string(snap.Usage), `"messages": 40`) {
+		t.Fatalf("stats %s, usage %s", snap.Stats, snap.Usage)
+	}
+
+	tests := []struct {
+		name    string
+		byTime  bool
+		wantSeq uint64
+	}{
+		{name: "by sequence", wantSeq: 4},
+		{name: "by time", byTime: true, wantSeq: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Publish times only line up on the stream the snapshot came
+			// from; a copy by sequence gets new ones
+			dst, djs := src, js
+			if !tt.byTime {
+				dst, djs = consumerServer(t, 5)
+			}
+			ops := mockOpsDB(t)
+			ops.ExpectExec(regexp.QuoteMeta(opsSchemaSQL)).WillReturnResult(sqlmock.NewResult(0, 0))
+			ops.ExpectBegin()
+			ops.ExpectExec(`INSERT INTO rule_nats_consumer_stats \("consumer_name", "messages_processed", "stream_name"\)`).
+				WithArgs(`{"consumer_name":"moved","messages_processed":42,"stream_name":"RULES"}`).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			ops.ExpectExec(`INSERT INTO rule_nats_consumer_usage`).WithArgs("RULES", "moved", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			ops.ExpectCommit()
+
+			if err := restoreConsumer(context.Background(), djs, path, "", "moved", tt.byTime, false); err != nil {
+				t.Fatal(err)
+			}
+			cfg, ok := dst.Consumer("RULES", "moved")
+			if !ok || cfg.FilterSubject != "rules.>" || cfg.MaxDeliver != 3 || cfg.DeliverGroup != "webhooks" ||
+				cfg.DeliverSubject == "" || cfg.DeliverSubject == "old.inbox" {
+				t.Fatalf("restored consumer = %+v", cfg)
+			}
+			if tt.byTime {
+				if cfg.DeliverPolicy != nats.DeliverByStartTimePolicy || !cfg.OptStartTime.Equal(fourth) {
+					t.Fatalf("restored by time = %+v", cfg)
+				}
+			} else if cfg.DeliverPolicy != nats.DeliverByStartSequencePolicy || cfg.OptStartSeq != tt.wantSeq {
+				t.Fatalf("restored by sequence = %+v", cfg)
+			}
+			if _, ok := dst.Consumer("RULES", "moved-urgent"); !ok {
+				t.Fatal("urgent lane not restored")
+			}
+
+			// The restored consumer delivers the first unacked message
+			nc, err := nats.Connect(dst.URL())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nc.Close()
+			sub, _ := nc.SubscribeSync(cfg.DeliverSubject)
+			msg, err := sub.NextMsg(time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta, _ := msg.Metadata(); meta.Sequence.Stream != tt.wantSeq {
+				t.Fatalf("first delivery is sequence %d", meta.Sequence.Stream)
+			}
+		})
+	}
+}
+
+func TestRestoreConsumerRefuses(t *testing.T) {
+	setConsumerConfig(t, "")
+	snap := consumerSnapshot{Stream: "RULES", Consumer: "webhooks", Lanes: []consumerPosition{{
+		Config:   nats.ConsumerConfig{Durable: "webhooks", AckPolicy: nats.AckExplicitPolicy},
+		AckFloor: nats.SequenceInfo{Stream: 2},
+	}}}
+	data, _ := json.Marshal(snap)
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	os.WriteFile(path, data, 0o600)
+	bad := filepath.Join(t.TempDir(), "bad.json")
+	os.WriteFile(bad, []byte("{"), 0o600)
+
+	tests := []struct {
+		name    string
+		path    string
+		byTime  bool
+		wantErr string
+	}{
+		{name: "exists", path: path, wantErr: "consumer webhooks already exists on stream RULES (use -force to replace it)"},
+		{name: "invalid", path: bad, wantErr: "invalid snapshot"},
+		{name: "missing file", path: filepath.Join(t.TempDir(), "none.json"), wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, js := consumerServer(t, 3)
+			js.AddConsumer("RULES", &nats.ConsumerConfig{Durable: "webhooks", AckPolicy: nats.AckExplicitPolicy})
+			err := restoreConsumer(context.Background(), js, tt.path, "", "", tt.byTime, false)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			// Nothing was changed
+			if cfg, _ := srv.Consumer("RULES", "webhooks"); cfg.DeliverPolicy != nats.DeliverAllPolicy {
+				t.Fatalf("consumer changed: %+v", cfg)
+			}
+		})
+	}
+
+	t.Run("no resume time", func(t *testing.T) {
+		_, js := consumerServer(t, 3)
+		err := restoreConsumer(context.Background(), js, path, "", "fresh", true, false)
+		if err == nil || !strings.Contains(err.Error(), "consumer fresh: snapshot has no resume time") {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("force replaces", func(t *testing.T) {
+		srv, js := consumerServer(t, 3)
+		js.AddConsumer("RULES", &nats.ConsumerConfig{Durable: "webhooks", AckPolicy: nats.AckExplicitPolicy})
+		ops := mockOpsDB(t)
+		ops.ExpectExec(regexp.QuoteMeta(opsSchemaSQL)).WillReturnResult(sqlmock.NewResult(0, 0))
+		ops.ExpectBegin()
+		ops.ExpectExec(`INSERT INTO rule_nats_consumer_usage`).WithArgs("RULES", "webhooks", "[]").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		ops.ExpectCommit()
+		if err := restoreConsumer(context.Background(), js, path, "", "", false, true); err != nil {
+			t.Fatal(err)
+		}
+		if cfg, _ := srv.Consumer("RULES", "webhooks"); cfg.OptStartSeq != 3 {
+			t.Fatalf("consumer not replaced: %+v", cfg)
+		}
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// consumerMaxDeliver is the delivery attempts the worker's consumer allows
+const consumerMaxDeliver = 3
+
+// ensureConsumerStats creates the consumer's rule_nats_consumer_stats row
+// if it is missing and records the consumer's settings in it. Lag samples,
+// failure counts, and quotas then apply to a fresh consumer from its first
+// message, without setup SQL or waiting for the first statistics report.
+// It is idempotent, so every replica runs it on startup.
+func ensureConsumerStats() {
+	err := opsWrite("consumer_register",
+		`INSERT INTO rule_nats_consumer_stats (stream_name, consumer_name, queue_group, ack_policy, max_deliver, active)
+		 VALUES ($1, $2, $3, 'explicit', $4, true)
+		 ON CONFLICT (stream_name, consumer_name) DO UPDATE SET
+		     queue_group = EXCLUDED.queue_group, ack_policy = EXCLUDED.ack_policy,
+		     max_deliver = EXCLUDED.max_deliver, active = true`,
+		config.Worker.StreamName, config.Worker.ConsumerName, config.Worker.QueueGroup, consumerMaxDeliver,
+	)
+	if err != nil && !errors.Is(err, errOpsBuffered) {
+		log.Printf("⚠️  Failed to register consumer statistics: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+// useStats sets the worker's message counters for one test
+func useStats(t *testing.T, s Stats) {
+	t.Helper()
+	prev := stats
+	stats = s
+	t.Cleanup(func() { stats = prev })
+}
+
+// resetActionMetrics empties the per-action counters for one test, so
+// reportStatistics writes no action rows
+func resetActionMetrics(t *testing.T) {
+	t.Helper()
+	actionMetricsMu.Lock()
+	prev := actionMetrics
+	actionMetrics = map[string]*actionCounters{}
+	actionMetricsMu.Unlock()
+	t.Cleanup(func() {
+		actionMetricsMu.Lock()
+		actionMetrics = prev
+		actionMetricsMu.Unlock()
+	})
+}
+
+// useConsumer names the worker's stream and consumer for one test
+func useConsumer(t *testing.T) {
+	t.Helper()
+	prev := config.Worker
+	t.Cleanup(func() { config.Worker = prev })
+	config.Worker.StreamName, config.Worker.ConsumerName, config.Worker.QueueGroup = "RULES", "webhooks", "webhook-workers"
+}
+
+func TestEnsureConsumerStats(t *testing.T) {
+	const upsert = `INSERT INTO rule_nats_consumer_stats \(stream_name, consumer_name, queue_group, ack_policy, max_deliver, active\)` +
+		`\s+VALUES \(\$1, \$2, \$3, 'explicit', \$4, true\)\s+ON CONFLICT \(stream_name, consumer_name\) DO UPDATE`
+	tests := []struct {
+		name         string
+		err          error
+		wantBuffered int
+	}{
+		{name: "created or updated"},
+		// Kept until the database is back, so a fresh consumer still gets its row
+		{name: "database unavailable", err: &pq.Error{Code: "08006", Message: "connection failure"}, wantBuffered: 1},
+		{name: "failed", err: &pq.Error{Code: "42703", Message: `column "queue_group" does not exist`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetOpsBuffer(t, 10)
+			ops := mockOpsDB(t)
+			useConsumer(t)
+			prevAttempts := config.Postgres.RetryAttempts
+			t.Cleanup(func() { config.Postgres.RetryAttempts = prevAttempts })
+			config.Postgres.RetryAttempts = 1
+
+			exec := ops.ExpectExec(upsert).WithArgs("RULES", "webhooks", "webhook-workers", consumerMaxDeliver)
+			if tt.err != nil {
+				exec.WillReturnError(tt.err)
+			} else {
+				exec.WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			ensureConsumerStats()
+			if opsBuffered() != tt.wantBuffered {
+				t.Fatalf("%d writes buffered, want %d", opsBuffered(), tt.wantBuffered)
+			}
+		})
+	}
+}
+
+func TestRecordLag(t *testing.T) {
+	ops := mockOpsDB(t)
+	useConsumer(t)
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// An upsert, so a consumer without a statistics row still gets its lag
+	ops.ExpectExec(`INSERT INTO rule_nats_consumer_stats \(\s+stream_name, consumer_name, messages_pending, messages_redelivered,`+
+		`\s+ack_floor_stream_seq, ack_floor_consumer_seq, lag_sampled_at\s+\) VALUES .* ON CONFLICT \(stream_name, consumer_name\) DO UPDATE`).
+		WithArgs("RULES", "webhooks", int64(120), int64(4), int64(900), int64(880), at).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	recordLag(&LagSample{NumPending: 120, NumRedelivered: 4, AckFloorStream: 900, AckFloorConsumer: 880, SampledAt: at})
+}
+
+func TestReportStatistics(t *testing.T) {
+	tests := []struct {
+		name      string
+		functions []string // found by capability discovery; nil before it
+		wantStats bool
+	}{
+		{name: "before discovery", wantStats: true},
+		{name: "function found", functions: []string{"rule_nats_consumer_update_stats"}, wantStats: true},
+		{name: "function missing", functions: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := mockOpsDB(t)
+			useConsumer(t)
+			useExtension(t, "1.8.0", true)
+			resetActionMetrics(t)
+			useLag(t, &LagSample{NumPending: 7})
+			if tt.functions != nil {
+				useCapabilities(t, tt.functions...)
+			} else {
+				assumeCapabilities(t)
+			}
+			useStats(t, Stats{MessagesProcessed: 10, MessagesSucceeded: 4, MessagesFailed: 3, MessagesExpired: 2,
+				TotalProcessingTimeMs: 100, StartTime: time.Now()})
+
+			if tt.wantStats {
+				ops.ExpectExec(`SELECT rule_nats_consumer_update_stats\(\$1, \$2, \$3, \$4, \$5, \$6\)`).
+					WithArgs("RULES", "webhooks", int64(10), int64(4), int64(7), 25.0).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				// Upserted: the failure and expiry counts are not lost when
+				// the row does not exist yet
+				ops.ExpectExec(`INSERT INTO rule_nats_consumer_stats \(stream_name, consumer_name, messages_failed, messages_expired\)`+
+					` VALUES \(\$1, \$2, \$3, \$4\)\s+ON CONFLICT \(stream_name, consumer_name\) DO UPDATE SET`).
+					WithArgs("RULES", "webhooks", int64(3), int64(2)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			reportStatistics()
+		})
+	}
+}
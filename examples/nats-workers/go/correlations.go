@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+const (
+	// correlationOutboxInterval is how often the leader publishes matches
+	// left unpublished, e.g. by a worker that crashed after recording them
+	correlationOutboxInterval = 10 * time.Second
+
+	// correlationOutboxDelay keeps the leader from republishing matches the
+	// recording worker is still publishing
+	correlationOutboxDelay = 30 * time.Second
+
+	// correlationMatchRetention is how long published matches are kept
+	correlationMatchRetention = 7 * 24 * time.Hour
+)
+
+// correlationStats counts events applied to correlations and composite
+// events published (see ruleengine.Client.CreateCorrelation)
+var correlationStats = expvar.NewMap("correlation_events")
+
+func init() {
+	registerSingleton("correlation_outbox", correlationOutboxInterval, publishPendingCorrelations)
+}
+
+// startCorrelationEngine subscribes to CORRELATION_SUBJECTS and applies
+// every event to the correlations. Subscriptions share a queue group, so
+// each event is applied by one worker.
+func startCorrelationEngine(nc *nats.Conn) error {
+	subjects := splitList(config.Correlations.Subjects)
+	if len(subjects) == 0 {
+		return nil
+	}
+	client := ruleengine.New(db)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := client.EnableCorrelations(ctx); err != nil {
+		return err
+	}
+	for _, subject := range subjects {
+		if _, err := nc.QueueSubscribe(subject, config.Worker.QueueGroup+".correlations", func(msg *nats.Msg) {
+			recordCorrelationEvent(client, msg)
+		}); err != nil {
+			return err
+		}
+	}
+	log.Printf("🔗 Correlating events from %v", subjects)
+	return nil
+}
+
+func recordCorrelationEvent(client *ruleengine.Client, msg *nats.Msg) {
+	if !json.Valid(msg.Data) {
+		correlationStats.Add("invalid", 1)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	matches, err := client.RecordCorrelationEvent(ctx, msg.Subject, json.RawMessage(msg.Data))
+	if err != nil {
+		correlationStats.Add("failed", 1)
+		log.Printf("⚠️  Failed to correlate event from %s: %v", msg.Subject, err)
+		return
+	}
+	correlationStats.Add("recorded", 1)
+	for _, m := range matches {
+		// Left for the leader's outbox task on failure
+		if err := publishCorrelationMatch(ctx, client, &m); err != nil {
+			log.Printf("⚠️  Failed to publish correlation %s (%s): %v", m.Correlation, m.Key, err)
+		}
+	}
+}
+
+// publishCorrelationMatch publishes a match's composite event and marks it
+// published. JetStream deduplicates republished matches by Nats-Msg-Id.
+func publishCorrelationMatch(ctx context.Context, client *ruleengine.Client, m *ruleengine.CorrelationMatch) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	out := nats.NewMsg(m.EmitSubject)
+	out.Data = data
+	out.Header.Set(nats.MsgIdHdr, "correlation-"+strconv.FormatInt(m.ID, 10))
+	out.Header.Set("Rule-Correlation", m.Correlation)
+
+	if _, err := jetStream.PublishMsg(out, nats.Context(ctx)); errors.Is(err, nats.ErrNoStreamResponse) {
+		// No stream captures the subject; plain subscribers still get it
+		if err := natsConn.PublishMsg(out); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("publish to %s failed: %w", m.EmitSubject, err)
+	}
+	correlationStats.Add("matched", 1)
+	log.Printf("🔗 Correlation %s matched for %s, published to %s", m.Correlation, m.Key, m.EmitSubject)
+	return client.MarkCorrelationPublished(ctx, m.ID)
+}
+
+// publishPendingCorrelations publishes matches their recording worker did
+// not, then prunes expired correlation state
+func publishPendingCorrelations(ctx context.Context) error {
+	client := ruleengine.New(db)
+	if _, err := client.PruneCorrelations(ctx, correlationMatchRetention); err != nil {
+		return err
+	}
+	if len(splitList(config.Correlations.Subjects)) == 0 {
+		return nil
+	}
+	matches, err := client.PendingCorrelationMatches(ctx, correlationOutboxDelay, 100)
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		if err := publishCorrelationMatch(ctx, client, &m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/internal/natstest"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// useNATSConn swaps the worker's core NATS connection for one test
+func useNATSConn(t *testing.T, nc *nats.Conn) {
+	t.Helper()
+	prev := natsConn
+	natsConn = nc
+	t.Cleanup(func() { natsConn = prev })
+}
+
+func TestPublishCorrelationMatch(t *testing.T) {
+	match := ruleengine.CorrelationMatch{ID: 42, Correlation: "unpaid", Key: "o1", EmitSubject: "composite.unpaid",
+		Events: []ruleengine.CorrelatedEvent{{Subject: "orders.created", Event: json.RawMessage(`{"id":"o1"}`)}}}
+	tests := []struct {
+		name     string
+		jsErr    error
+		wantCore bool
+		wantErr  bool
+	}{
+		{name: "stream"},
+		{name: "no stream falls back to core NATS", jsErr: nats.ErrNoStreamResponse, wantCore: true},
+		{name: "publish failure", jsErr: errors.New("timeout"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := natstest.NewServer(t)
+			nc, err := nats.Connect(srv.URL())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nc.Close()
+			useNATSConn(t, nc)
+			sub, err := nc.SubscribeSync("composite.>")
+			if err != nil {
+				t.Fatal(err)
+			}
+			js := &fakeJetStream{err: tt.jsErr}
+			useJetStream(t, js)
+
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockDB.Close()
+			if !tt.wantErr {
+				// Marked published only once it is out
+				mock.ExpectExec(`UPDATE rule_correlation_matches SET published_at`).WithArgs(42).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			m := match
+			err = publishCorrelationMatch(context.Background(), ruleengine.New(mockDB), &m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var out *nats.Msg
+			if tt.wantCore {
+				if out, err = sub.NextMsg(2 * time.Second); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				if len(js.published) != 1 {
+					t.Fatalf("published %d to JetStream", len(js.published))
+				}
+				out = js.published[0]
+			}
+			var got ruleengine.CorrelationMatch
+			if err := json.Unmarshal(out.Data, &got); err != nil || got.Key != "o1" || len(got.Events) != 1 {
+				t.Fatalf("composite event = %s, %v", out.Data, err)
+			}
+			if out.Subject != "composite.unpaid" || out.Header.Get(nats.MsgIdHdr) != "correlation-42" ||
+				out.Header.Get("Rule-Correlation") != "unpaid" {
+				t.Fatalf("message = %s %v", out.Subject, out.Header)
+			}
+		})
+	}
+}
+
+func TestRecordCorrelationEvent(t *testing.T) {
+	count := func(key string) int64 {
+		if v, ok := correlationStats.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	tests := []struct {
+		name   string
+		data   string
+		expect func(mock sqlmock.Sqlmock)
+		want   string
+	}{
+		{name: "recorded", data: `{"id":"o1"}`, want: "recorded",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`rule_correlation_record`).WithArgs("orders.created", []byte(`{"id":"o1"}`)).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "correlation_name", "key", "emit_subject", "events",
+						"started_at", "matched_at", "published_at"}))
+			}},
+		{name: "failed", data: `{"id":"o1"}`, want: "failed",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`rule_correlation_record`).WillReturnError(errors.New("connection refused"))
+			}},
+		{name: "invalid JSON", data: `{"id"`, want: "invalid", expect: func(sqlmock.Sqlmock) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockDB.Close()
+			tt.expect(mock)
+
+			before := count(tt.want)
+			recordCorrelationEvent(ruleengine.New(mockDB), &nats.Msg{Subject: "orders.created", Data: []byte(tt.data)})
+			if got := count(tt.want) - before; got != 1 {
+				t.Fatalf("%s += %d, want 1", tt.want, got)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
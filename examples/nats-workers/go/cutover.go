@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// "cutover" moves the configured consumer (and each priority lane's
+// consumer) to a new durable name or filter subject without losing its
+// position: it pauses the old consumer, waits for the messages it has out
+// to be acknowledged, creates the new one after the old one's ack floor,
+// checks the two agree, and deletes the old one. Until the old consumer is
+// deleted, a failed step resumes it and removes what was created.
+
+// cutoverPollInterval is how often cutover checks whether the old
+// consumer's unacknowledged messages have been settled
+const cutoverPollInterval = time.Second
+
+// cutoverLane is one lane's old and new consumer
+type cutoverLane struct {
+	old, new string
+	subject  string // the new consumer's filter subject
+	// inbox is the old consumer's deliver subject, which the workers'
+	// subscriptions listen on; restoring it resumes them
+	inbox   string
+	info    *nats.ConsumerInfo // the old consumer once drained
+	created bool
+}
+
+// cutoverConsumer moves CONSUMER_NAME to target, filtering on subject
+// (SUBJECT when empty), and moves its statistics with it
+func cutoverConsumer(ctx context.Context, js nats.JetStreamContext, target, subject string, drain time.Duration, keepOld, force bool) error {
+	stream := config.Worker.StreamName
+	if subject == "" {
+		subject = config.Worker.Subject
+	}
+	// Checked by validateConfig
+	lanes, _ := parsePriorityLanes(config.Worker.PriorityLanes)
+	moves := []*cutoverLane{{old: config.Worker.ConsumerName, new: target, subject: subject}}
+	for _, l := range lanes {
+		moves = append(moves, &cutoverLane{
+			old:     laneConsumer(config.Worker.ConsumerName, l.Name),
+			new:     laneConsumer(target, l.Name),
+			subject: l.Subject,
+		})
+	}
+	if target == config.Worker.ConsumerName && subject == config.Worker.Subject {
+		return fmt.Errorf("consumer %s already filters on %s", target, subject)
+	}
+
+	// Refuse before changing anything. Lanes keeping their name and
+	// subject are left alone.
+	changing := moves[:0]
+	for _, m := range moves {
+		info, err := js.ConsumerInfo(stream, m.old, nats.Context(ctx))
+		if err != nil {
+			return fmt.Errorf("consumer %s: %w", m.old, err)
+		}
+		if info.Config.DeliverSubject == "" {
+			return fmt.Errorf("consumer %s is a pull consumer; cutover moves the worker's push consumers", m.old)
+		}
+		m.inbox = info.Config.DeliverSubject
+		if m.new == m.old {
+			if m.subject != info.Config.FilterSubject {
+				changing = append(changing, m)
+			}
+			continue
+		}
+		changing = append(changing, m)
+		_, err = js.ConsumerInfo(stream, m.new, nats.Context(ctx))
+		switch {
+		case errors.Is(err, nats.ErrConsumerNotFound):
+		case err != nil:
+			return fmt.Errorf("consumer %s: %w", m.new, err)
+		case !force:
+			return fmt.Errorf("consumer %s already exists on stream %s (use -force to replace it)", m.new, stream)
+		}
+	}
+	moves = changing
+
+	// Steps 1 and 2: pause the old consumers and let them drain
+	for _, m := range moves {
+		if err := setDeliverSubject(ctx, js, stream, m.old, nats.NewInbox()); err != nil {
+			rollbackCutover(js, stream, moves)
+			return fmt.Errorf("failed to pause consumer %s: %w", m.old, err)
+		}
+		log.Printf("⏸️  Paused %s", m.old)
+	}
+	for _, m := range moves {
+		info, err := drainConsumer(ctx, js, stream, m.old, drain)
+		if err != nil {
+			rollbackCutover(js, stream, moves)
+			return err
+		}
+		m.info = info
+	}
+
+	// Steps 3 and 4: create the new consumers after the old ack floors and
+	// check they start where the old ones stopped. A consumer keeping its
+	// name and changing its subject is replaced in place.
+	for _, m := range moves {
+		if m.new == m.old {
+			if err := js.DeleteConsumer(stream, m.old, nats.Context(ctx)); err != nil {
+				rollbackCutover(js, stream, moves)
+				return fmt.Errorf("failed to delete consumer %s: %w", m.old, err)
+			}
+		} else if force {
+			if err := js.DeleteConsumer(stream, m.new, nats.Context(ctx)); err != nil && !errors.Is(err, nats.ErrConsumerNotFound) {
+				rollbackCutover(js, stream, moves)
+				return fmt.Errorf("failed to delete consumer %s: %w", m.new, err)
+			}
+		}
+		cfg := m.info.Config
+		cfg.Durable, cfg.Name = m.new, ""
+		cfg.FilterSubject, cfg.FilterSubjects = m.subject, nil
+		cfg.DeliverPolicy = nats.DeliverByStartSequencePolicy
+		cfg.OptStartSeq, cfg.OptStartTime = m.info.AckFloor.Stream+1, nil
+		// Idle until the workers are restarted with the new settings
+		cfg.DeliverSubject = nats.NewInbox()
+		info, err := js.AddConsumer(stream, &cfg, nats.Context(ctx))
+		if err != nil {
+			rollbackCutover(js, stream, moves)
+			return fmt.Errorf("failed to create consumer %s: %w", m.new, err)
+		}
+		m.created = true
+		if err := verifyCutover(m, info); err != nil {
+			rollbackCutover(js, stream, moves)
+			return err
+		}
+		log.Printf("✅ Created %s on %s from sequence %d (%d pending)", m.new, stream, cfg.OptStartSeq, info.NumPending)
+	}
+
+	// Step 5: delete the old consumers
+	for _, m := range moves {
+		if m.new == m.old {
+			continue
+		}
+		if keepOld {
+			log.Printf("⏸️  Left %s paused; delete it with: nats consumer rm %s %s", m.old, stream, m.old)
+			continue
+		}
+		if err := js.DeleteConsumer(stream, m.old, nats.Context(ctx)); err != nil && !errors.Is(err, nats.ErrConsumerNotFound) {
+			// The new consumers are in place; the old one is only paused
+			return fmt.Errorf("consumers moved, but %s was not deleted: %w", m.old, err)
+		}
+		log.Printf("🗑️  Deleted %s", m.old)
+	}
+
+	if target != config.Worker.ConsumerName {
+		if err := ensureOpsSchema(); err != nil {
+			return err
+		}
+		if err := moveConsumerStats(ctx, stream, config.Worker.ConsumerName, target); err != nil {
+			return fmt.Errorf("consumers moved, but statistics were not: %w", err)
+		}
+	}
+	log.Printf("✅ Cut over to %s; restart the workers with CONSUMER_NAME=%s and SUBJECT=%s", target, target, subject)
+	return nil
+}
+
+// setDeliverSubject points a push consumer at inbox. Deliveries to an inbox
+// nobody subscribes to are held back, which pauses the consumer for every
+// worker bound to it.
+func setDeliverSubject(ctx context.Context, js nats.JetStreamContext, stream, durable, inbox string) error {
+	info, err := js.ConsumerInfo(stream, durable, nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	cfg := info.Config
+	cfg.DeliverSubject = inbox
+	_, err = js.UpdateConsumer(stream, &cfg, nats.Context(ctx))
+	return err
+}
+
+// drainConsumer waits up to timeout for a paused consumer to have no
+// unacknowledged messages, which would otherwise be delivered again by the
+// new consumer
+func drainConsumer(ctx context.Context, js nats.JetStreamContext, stream, durable string, timeout time.Duration) (*nats.ConsumerInfo, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := js.ConsumerInfo(stream, durable, nats.Context(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("consumer %s: %w", durable, err)
+		}
+		if info.NumAckPending == 0 {
+			log.Printf("✅ %s drained at sequence %d", durable, info.AckFloor.Stream)
+			return info, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("consumer %s still has %d unacknowledged message(s) after %s", durable, info.NumAckPending, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(cutoverPollInterval):
+		}
+	}
+}
+
+// verifyCutover checks that a new consumer starts where the old one
+// stopped. Both filter the same messages unless the filter changed, and
+// messages published since the old one drained only add to the new one's.
+func verifyCutover(m *cutoverLane, info *nats.ConsumerInfo) error {
+	if info.AckFloor.Stream != m.info.AckFloor.Stream {
+		return fmt.Errorf("consumer %s starts after sequence %d, but %s stopped at %d", m.new, info.AckFloor.Stream, m.old, m.info.AckFloor.Stream)
+	}
+	if m.subject == m.info.Config.FilterSubject && info.NumPending < m.info.NumPending {
+		return fmt.Errorf("consumer %s has %d message(s) pending, but %s had %d", m.new, info.NumPending, m.old, m.info.NumPending)
+	}
+	return nil
+}
+
+// rollbackCutover deletes the new consumers created so far and resumes the
+// old ones, recreating those replaced in place
+func rollbackCutover(js nats.JetStreamContext, stream string, moves []*cutoverLane) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, m := range moves {
+		if m.created {
+			if err := js.DeleteConsumer(stream, m.new, nats.Context(ctx)); err != nil && !errors.Is(err, nats.ErrConsumerNotFound) {
+				log.Printf("⚠️  Failed to delete %s: %v", m.new, err)
+			}
+		}
+		if m.new == m.old && m.info != nil {
+			// Deleted above, or about to be replaced
+			cfg := m.info.Config
+			cfg.DeliverSubject = m.inbox
+			cfg.DeliverPolicy = nats.DeliverByStartSequencePolicy
+			cfg.OptStartSeq, cfg.OptStartTime = m.info.AckFloor.Stream+1, nil
+			if _, err := js.ConsumerInfo(stream, m.old, nats.Context(ctx)); errors.Is(err, nats.ErrConsumerNotFound) {
+				if _, err := js.AddConsumer(stream, &cfg, nats.Context(ctx)); err != nil {
+					log.Printf("⚠️  Failed to recreate %s: %v", m.old, err)
+				}
+				continue
+			}
+		}
+		if err := setDeliverSubject(ctx, js, stream, m.old, m.inbox); err != nil {
+			log.Printf("⚠️  Failed to resume %s: %v", m.old, err)
+			continue
+		}
+		log.Printf("▶️  Resumed %s", m.old)
+	}
+}
+
+// moveConsumerStats renames a consumer's statistics and usage rows,
+// replacing any already under the new name
+func moveConsumerStats(ctx context.Context, stream, from, to string) error {
+	tx, err := opsDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"rule_nats_consumer_stats", "rule_nats_consumer_usage"} {
+		if _, err := tx.ExecContext(ctx,
+			`DELETE FROM `+table+` WHERE stream_name = $1 AND consumer_name = $2`, stream, to,
+		); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE `+table+` SET consumer_name = $3 WHERE stream_name = $1 AND consumer_name = $2`, stream, from, to,
+		); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("✅ Moved statistics for %s/%s to %s", stream, from, to)
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+)
+
+// expectStatsMove expects moveConsumerStats from webhooks to target
+func expectStatsMove(ops sqlmock.Sqlmock, target string) {
+	ops.ExpectExec(regexp.QuoteMeta(opsSchemaSQL)).WillReturnResult(sqlmock.NewResult(0, 0))
+	ops.ExpectBegin()
+	for _, table := range []string{"rule_nats_consumer_stats", "rule_nats_consumer_usage"} {
+		ops.ExpectExec(`DELETE FROM `+table).WithArgs("RULES", target).WillReturnResult(sqlmock.NewResult(0, 0))
+		ops.ExpectExec(`UPDATE `+table+` SET consumer_name = \$3`).WithArgs("RULES", "webhooks", target).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	ops.ExpectCommit()
+}
+
+func TestCutoverConsumer(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		subject     string
+		keepOld     bool
+		wantSubject string
+		wantOld     bool // the old consumer is left paused
+	}{
+		{name: "rename", target: "orders", wantSubject: "rules.>"},
+		{name: "rename and filter", target: "orders", subject: "rules.orders", wantSubject: "rules.orders"},
+		{name: "keep the old consumer", target: "orders", keepOld: true, wantSubject: "rules.>", wantOld: true},
+		{name: "filter in place", target: "webhooks", subject: "rules.orders", wantSubject: "rules.orders"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConsumerConfig(t, "")
+			config.Worker.Subject = "rules.>"
+			srv, js := consumerServer(t, 5)
+			js.AddConsumer("RULES", &nats.ConsumerConfig{Durable: "webhooks", AckPolicy: nats.AckExplicitPolicy,
+				FilterSubject: "rules.>", DeliverSubject: "old.inbox", DeliverGroup: "webhooks", MaxDeliver: 3})
+			ackFirst(t, srv, "old.inbox", 5, 5)
+
+			ops := mockOpsDB(t)
+			if tt.target != "webhooks" {
+				expectStatsMove(ops, tt.target)
+			}
+			if err := cutoverConsumer(context.Background(), js, tt.target, tt.subject, time.Second, tt.keepOld, false); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, ok := srv.Consumer("RULES", tt.target)
+			if !ok || cfg.FilterSubject != tt.wantSubject || cfg.DeliverPolicy != nats.DeliverByStartSequencePolicy ||
+				cfg.OptStartSeq != 6 || cfg.MaxDeliver != 3 || cfg.DeliverGroup != "webhooks" || cfg.DeliverSubject == "old.inbox" {
+				t.Fatalf("new consumer = %+v", cfg)
+			}
+			if tt.target != "webhooks" {
+				old, ok := srv.Consumer("RULES", "webhooks")
+				if ok != tt.wantOld || (ok && old.DeliverSubject == "old.inbox") {
+					t.Fatalf("old consumer = %+v, %v", old, ok)
+				}
+			}
+			// Published after the cutover; the new consumer delivers it
+			srv.Publish("rules.orders", nil, []byte("6"))
+			if info, err := js.ConsumerInfo("RULES", tt.target); err != nil || info.NumPending != 1 || info.AckFloor.Stream != 5 {
+				t.Fatalf("new consumer info = %+v, %v", info, err)
+			}
+		})
+	}
+}
+
+func TestCutoverConsumerRefuses(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		subject string
+		setup   func(js nats.JetStreamContext)
+		wantErr string
+	}{
+		{name: "nothing to change", target: "webhooks", wantErr: "consumer webhooks already filters on rules.>"},
+		{name: "target exists", target: "orders",
+			setup: func(js nats.JetStreamContext) {
+				js.AddConsumer("RULES", &nats.ConsumerConfig{Durable: "orders", AckPolicy: nats.AckExplicitPolicy, DeliverSubject: "x"})
+			},
+			wantErr: "consumer orders already exists on stream RULES (use -force to replace it)"},
+		{name: "pull consumer", target: "orders",
+			setup: func(js nats.JetStreamContext) {
+				js.DeleteConsumer("RULES", "webhooks")
+				js.AddConsumer("RULES", &nats.ConsumerConfig{Durable: "webhooks", AckPolicy: nats.AckExplicitPolicy})
+			},
+			wantErr: "consumer webhooks is a pull consumer; cutover moves the worker's push consumers"},
+		{name: "no consumer", target: "orders",
+			setup:   func(js nats.JetStreamContext) { js.DeleteConsumer("RULES", "webhooks") },
+			wantErr: "consumer webhooks: nats: consumer not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConsumerConfig(t, "")
+			config.Worker.Subject = "rules.>"
+			srv, js := consumerServer(t, 2)
+			js.AddConsumer("RULES", &nats.ConsumerConfig{Durable: "webhooks", AckPolicy: nats.AckExplicitPolicy,
+				FilterSubject: "rules.>", DeliverSubject: "old.inbox"})
+			if tt.setup != nil {
+				tt.setup(js)
+			}
+			mockOpsDB(t) // nothing is moved
+			err := cutoverConsumer(context.Background(), js, tt.target, tt.subject, time.Second, false, false)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			// Nothing was paused
+			if cfg, ok := srv.Consumer("RULES", "webhooks"); ok && cfg.DeliverSubject != "old.inbox" && cfg.DeliverSubject != "" {
+				t.Fatalf("old consumer = %+v", cfg)
+			}
+		})
+	}
+}
+
+// A consumer that does not drain is resumed and nothing is created
+func TestCutoverConsumerRollback(t *testing.T) {
+	for _, target := range []string{"orders", "webhooks"} {
+		t.Run(target, func(t *testing.T) {
+			setConsumerConfig(t, "")
+			config.Worker.Subject = "rules.>"
+			srv, js := consumerServer(t, 5)
+			js.AddConsumer("RULES", &nats.ConsumerConfig{Durable: "webhooks", AckPolicy: nats.AckExplicitPolicy,
+				FilterSubject: "rules.>", DeliverSubject: "old.inbox", AckWait: time.Hour})
+			ackFirst(t, srv, "old.inbox", 5, 3)
+			mockOpsDB(t)
+
+			err := cutoverConsumer(context.Background(), js, target, "rules.orders", 0, false, false)
+			if err == nil || err.Error() != "consumer webhooks still has 2 unacknowledged message(s) after 0s" {
+				t.Fatalf("err = %v", err)
+			}
+			cfg, ok := srv.Consumer("RULES", "webhooks")
+			if !ok || cfg.DeliverSubject != "old.inbox" || cfg.FilterSubject != "rules.>" {
+				t.Fatalf("old consumer = %+v, %v", cfg, ok)
+			}
+			if _, ok := srv.Consumer("RULES", "orders"); ok {
+				t.Fatal("new consumer left behind")
+			}
+		})
+	}
+}
+
+func TestVerifyCutover(t *testing.T) {
+	old := &nats.ConsumerInfo{Config: nats.ConsumerConfig{FilterSubject: "rules.>"}, AckFloor: nats.SequenceInfo{Stream: 5}, NumPending: 3}
+	tests := []struct {
+		name    string
+		subject string
+		info    nats.ConsumerInfo
+		wantErr string
+	}{
+		{name: "same position", subject: "rules.>", info: nats.ConsumerInfo{AckFloor: nats.SequenceInfo{Stream: 5}, NumPending: 3}},
+		{name: "published since", subject: "rules.>", info: nats.ConsumerInfo{AckFloor: nats.SequenceInfo{Stream: 5}, NumPending: 4}},
+		{name: "narrower filter", subject: "rules.orders", info: nats.ConsumerInfo{AckFloor: nats.SequenceInfo{Stream: 5}, NumPending: 1}},
+		{name: "wrong start", subject: "rules.>", info: nats.ConsumerInfo{AckFloor: nats.SequenceInfo{Stream: 4}, NumPending: 3},
+			wantErr: "consumer orders starts after sequence 4, but webhooks stopped at 5"},
+		{name: "messages lost", subject: "rules.>", info: nats.ConsumerInfo{AckFloor: nats.SequenceInfo{Stream: 5}, NumPending: 2},
+			wantErr: "consumer orders has 2 message(s) pending, but webhooks had 3"},
+	}
+	for _, tt := range tests {
+		err := verifyCutover(&cutoverLane{old: "webhooks", new: "orders", subject: tt.subject, info: old}, &tt.info)
+		if (tt.wantErr == "" && err != nil) || (tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// dbHealth tracks whether a database is answering. A pool is unhealthy
+// once an operation still fails with a retryable error after all retries,
+// and healthy again after the next successful operation or ping.
+type dbHealth struct {
+	name string
+
+	mu        sync.Mutex
+	healthy   bool
+	since     time.Time
+	lastError string
+}
+
+var (
+	primaryHealth = &dbHealth{name: "PostgreSQL", healthy: true, since: time.Now()}
+	opsHealth     = &dbHealth{name: "Operational PostgreSQL", healthy: true, since: time.Now()}
+	standbyHealth = &dbHealth{name: "Standby PostgreSQL", healthy: true, since: time.Now()}
+)
+
+func (h *dbHealth) ok() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.healthy
+}
+
+func (h *dbHealth) markHealthy() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.healthy {
+		log.Printf("✅ %s recovered after %s", h.name, time.Since(h.since).Round(time.Second))
+		h.healthy, h.since, h.lastError = true, time.Now(), ""
+	}
+}
+
+func (h *dbHealth) markUnhealthy(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastError = err.Error()
+	if h.healthy {
+		log.Printf("🚨 %s unavailable: %v", h.name, err)
+		h.healthy, h.since = false, time.Now()
+	}
+}
+
+// snapshot is the state reported by /readyz and /debug/vars
+func (h *dbHealth) snapshot() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := map[string]interface{}{"healthy": h.healthy, "since": h.since}
+	if h.lastError != "" {
+		s["last_error"] = h.lastError
+	}
+	return s
+}
+
+// isRetryableDBError reports whether err is a transient failure (lost or
+// refused connection, server restart, serialization conflict) that is worth
+// retrying, as opposed to a query error that would fail again
+func isRetryableDBError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code.Class() == "08": // connection exception
+			return true
+		case pqErr.Code == "40001", pqErr.Code == "40P01": // serialization failure, deadlock
+			return true
+		case pqErr.Code == "53300": // too many connections
+			return true
+		case pqErr.Code == "57P01", pqErr.Code == "57P02", pqErr.Code == "57P03": // shutdown, starting up
+			return true
+		}
+	}
+	return false
+}
+
+// withDBRetry runs op, retrying retryable errors up to DB_RETRY_ATTEMPTS
+// times with exponential backoff and jitter, and records the outcome in
+// health. Non-retryable errors (including sql.ErrNoRows) are returned at
+// once and count as the database answering. ctx is the caller's deadline:
+// once it is done, the last error is returned without blaming the database.
+func withDBRetry(ctx context.Context, health *dbHealth, op func() error) error {
+	backoff := 100 * time.Millisecond
+	var err error
+	for attempt := 1; ; attempt++ {
+		chaosDBDelay(ctx)
+		err = op()
+		if !isRetryableDBError(err) {
+			health.markHealthy()
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if attempt >= config.Postgres.RetryAttempts {
+			break
+		}
+		select {
+		case <-time.After(backoff + time.Duration(rand.Int63n(int64(backoff)))):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; backoff > 2*time.Second {
+			backoff = 2 * time.Second
+		}
+	}
+	health.markUnhealthy(err)
+	return err
+}
+
+// monitorDatabases pings unhealthy databases so health recovers even when
+// no messages arrive, and flushes buffered operational writes once the
+// operational database is back
+func monitorDatabases() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !primaryHealth.ok() {
+			pingHealth(db, primaryHealth)
+		}
+		if opsDB != db && !opsHealth.ok() {
+			pingHealth(opsDB, opsHealth)
+		}
+		if standbyDB != nil && !standbyHealth.ok() {
+			pingHealth(standbyDB, standbyHealth)
+		}
+		if opsHealth.ok() && opsBuffered() > 0 {
+			flushOpsBuffer()
+		}
+	}
+}
+
+func pingHealth(pool *sql.DB, health *dbHealth) {
+	ctx, cancel := context.WithTimeout(context.Background(), opsWriteTimeout)
+	defer cancel()
+	if err := pool.PingContext(ctx); err != nil {
+		health.markUnhealthy(err)
+		return
+	}
+	health.markHealthy()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestIsRetryableDBError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"no rows", sql.ErrNoRows, false},
+		{"bad conn", driver.ErrBadConn, true},
+		{"eof", io.EOF, true},
+		{"wrapped unexpected eof", fmt.Errorf("scan: %w", io.ErrUnexpectedEOF), true},
+		{"refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"reset", syscall.ECONNRESET, true},
+		{"deadline", context.DeadlineExceeded, true},
+		{"canceled", context.Canceled, false},
+		{"connection exception", &pq.Error{Code: "08006"}, true},
+		{"serialization failure", &pq.Error{Code: "40001"}, true},
+		{"deadlock", &pq.Error{Code: "40P01"}, true},
+		{"too many connections", &pq.Error{Code: "53300"}, true},
+		{"admin shutdown", &pq.Error{Code: "57P01"}, true},
+		{"starting up", &pq.Error{Code: "57P03"}, true},
+		{"unique violation", &pq.Error{Code: "23505"}, false},
+		{"undefined table", &pq.Error{Code: "42P01"}, false},
+		{"plain error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := isRetryableDBError(tt.err); got != tt.want {
+			t.Errorf("%s: isRetryableDBError(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWithDBRetry(t *testing.T) {
+	prevAttempts := config.Postgres.RetryAttempts
+	t.Cleanup(func() { config.Postgres.RetryAttempts = prevAttempts })
+	config.Postgres.RetryAttempts = 3
+
+	refused := &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}
+	tests := []struct {
+		name         string
+		errs         []error // returned by successive attempts; nil after the list
+		wantCalls    int
+		wantErr      error
+		wantHealthy  bool
+		startHealthy bool
+	}{
+		{name: "success", errs: nil, wantCalls: 1, wantHealthy: true, startHealthy: true},
+		{name: "query error is not retried", errs: []error{sql.ErrNoRows}, wantCalls: 1, wantErr: sql.ErrNoRows, wantHealthy: true, startHealthy: true},
+		{name: "transient error then success", errs: []error{driver.ErrBadConn}, wantCalls: 2, wantHealthy: true, startHealthy: true},
+		{name: "success marks a failed database healthy", errs: nil, wantCalls: 1, wantHealthy: true},
+		{name: "gives up after the attempts", errs: []error{refused, refused, refused, refused}, wantCalls: 3, wantErr: refused, startHealthy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health := &dbHealth{name: "test", healthy: tt.startHealthy, since: time.Now()}
+			calls := 0
+			err := withDBRetry(context.Background(), health, func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) && err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Fatalf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if health.ok() != tt.wantHealthy {
+				t.Fatalf("healthy = %v, want %v", health.ok(), tt.wantHealthy)
+			}
+		})
+	}
+}
+
+// A caller's expired deadline ends the retries without blaming the
+// database
+func TestWithDBRetryContextDone(t *testing.T) {
+	prevAttempts := config.Postgres.RetryAttempts
+	t.Cleanup(func() { config.Postgres.RetryAttempts = prevAttempts })
+	config.Postgres.RetryAttempts = 10
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	health := &dbHealth{name: "test", healthy: true}
+	calls := 0
+	start := time.Now()
+	err := withDBRetry(ctx, health, func() error {
+		calls++
+		return driver.ErrBadConn
+	})
+	if err != driver.ErrBadConn || time.Since(start) > time.Second {
+		t.Fatalf("err = %v after %s", err, time.Since(start))
+	}
+	if !health.ok() {
+		t.Fatal("database marked unhealthy for the caller's deadline")
+	}
+}
+
+// resetOpsBuffer empties the operational write buffer for one test
+func resetOpsBuffer(t *testing.T, size int) {
+	t.Helper()
+	prevSize := config.Postgres.OpsBufferSize
+	reset := func() {
+		opsBufferMu.Lock()
+		opsBuffer, opsDropped = nil, 0
+		opsBufferMu.Unlock()
+	}
+	reset()
+	config.Postgres.OpsBufferSize = size
+	t.Cleanup(func() {
+		reset()
+		config.Postgres.OpsBufferSize = prevSize
+	})
+}
+
+func TestBufferOpsWrite(t *testing.T) {
+	resetOpsBuffer(t, 3)
+
+	bufferOpsWrite(&bufferedWrite{key: "stats:orders", query: "stats", args: []interface{}{1}})
+	bufferOpsWrite(&bufferedWrite{query: "audit", args: []interface{}{"a"}})
+	bufferOpsWrite(&bufferedWrite{key: "stats:orders", query: "stats", args: []interface{}{2}})
+	if opsBuffered() != 2 || opsBuffer[0].args[0] != 2 {
+		t.Fatalf("keyed write did not supersede: %+v", opsBuffer)
+	}
+
+	bufferOpsWrite(&bufferedWrite{query: "audit", args: []interface{}{"b"}})
+	bufferOpsWrite(&bufferedWrite{query: "audit", args: []interface{}{"c"}})
+	var got []interface{}
+	for _, w := range opsBuffer {
+		got = append(got, w.args[0])
+	}
+	// Full: the oldest audit record goes, the statistics stay
+	if fmt.Sprint(got) != "[2 b c]" || opsDropped != 1 {
+		t.Fatalf("buffer = %v, dropped %d", got, opsDropped)
+	}
+}
+
+func TestOpsWriteBuffersAndFlushes(t *testing.T) {
+	resetOpsBuffer(t, 10)
+	ops := mockOpsDB(t)
+	prevAttempts := config.Postgres.RetryAttempts
+	t.Cleanup(func() { config.Postgres.RetryAttempts = prevAttempts })
+	config.Postgres.RetryAttempts = 1
+	ops.MatchExpectationsInOrder(true)
+	lostConn := &pq.Error{Code: "08006", Message: "connection failure"}
+
+	// The database goes away: the write is buffered and the pool marked
+	// unhealthy, so later writes are buffered without trying
+	ops.ExpectExec("INSERT INTO audit").WithArgs("a").WillReturnError(lostConn)
+	if err := opsWrite("", "INSERT INTO audit VALUES ($1)", "a"); !errors.Is(err, errOpsBuffered) {
+		t.Fatalf("err = %v", err)
+	}
+	if opsHealth.ok() {
+		t.Fatal("operational database still healthy")
+	}
+	for _, v := range []string{"b", "c"} {
+		if err := opsWrite("", "INSERT INTO audit VALUES ($1)", v); !errors.Is(err, errOpsBuffered) {
+			t.Fatalf("err = %v", err)
+		}
+	}
+
+	// On recovery they are written in order; a write that fails for good
+	// is discarded, and one that fails transiently stops the flush
+	ops.ExpectExec("INSERT INTO audit").WithArgs("a").WillReturnResult(sqlmock.NewResult(0, 1))
+	ops.ExpectExec("INSERT INTO audit").WithArgs("b").WillReturnError(&pq.Error{Code: "23505"})
+	ops.ExpectExec("INSERT INTO audit").WithArgs("c").WillReturnError(lostConn)
+	flushOpsBuffer()
+	if opsBuffered() != 1 || opsBuffer[0].args[0] != "c" {
+		t.Fatalf("buffer after flush = %+v", opsBuffer)
+	}
+
+	ops.ExpectExec("INSERT INTO audit").WithArgs("c").WillReturnResult(sqlmock.NewResult(0, 1))
+	flushOpsBuffer()
+	if opsBuffered() != 0 {
+		t.Fatalf("buffer = %d", opsBuffered())
+	}
+}
+
+func TestServeReadiness(t *testing.T) {
+	prevPrimary, prevOps := primaryHealth, opsHealth
+	t.Cleanup(func() { primaryHealth, opsHealth = prevPrimary, prevOps })
+	primaryHealth = &dbHealth{name: "PostgreSQL", healthy: true}
+	opsHealth = &dbHealth{name: "Operational PostgreSQL", healthy: false, lastError: "connection refused"}
+
+	// Without a NATS connection the worker is not ready, whatever the
+	// databases say
+	rec := httptest.NewRecorder()
+	serveReadiness(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["ready"] != false || body["nats_connected"] != false {
+		t.Fatalf("body = %v", body)
+	}
+	if ops, _ := body["ops_postgres"].(map[string]interface{}); ops["healthy"] != false || ops["last_error"] != "connection refused" {
+		t.Fatalf("ops_postgres = %v", body["ops_postgres"])
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// debeziumOps names Debezium's op codes the way CDC events do
+var debeziumOps = map[string]string{
+	"c": "insert",
+	"u": "update",
+	"d": "delete",
+	"r": "read", // snapshot
+	"t": "truncate",
+}
+
+// debeziumMappings are the shapes a change event can be delivered in:
+// change is the worker's own CDC event, row the row image alone, and
+// envelope Debezium's payload as it is
+var debeziumMappings = []string{"change", "row", "envelope"}
+
+// debeziumDecoder reads Debezium change-event envelopes, in JSON (with or
+// without the converter's schema) or, when SCHEMA_REGISTRY_URL is set, in
+// registry-framed Avro. The option picks the mapping, change by default.
+type debeziumDecoder struct{}
+
+func (debeziumDecoder) Decode(ctx context.Context, data []byte, option string) (map[string]interface{}, error) {
+	if len(data) == 0 || string(data) == "null" {
+		// The tombstone Kafka compaction needs after a delete
+		return nil, errSkipRecord
+	}
+	var envelope map[string]interface{}
+	var err error
+	if data[0] == 0 && getSchemaRegistry() != nil {
+		envelope, err = decoders["avro"].Decode(ctx, data, "")
+	} else {
+		envelope, err = decoders["json"].Decode(ctx, data, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	// JsonConverter with schemas.enable wraps the event
+	if payload, ok := envelope["payload"].(map[string]interface{}); ok {
+		if _, hasSchema := envelope["schema"]; hasSchema {
+			envelope = payload
+		}
+	}
+
+	code, _ := envelope["op"].(string)
+	op, ok := debeziumOps[code]
+	if !ok {
+		return nil, worker.Permanent(fmt.Errorf("not a Debezium change event (op %q)", code))
+	}
+	before, _ := envelope["before"].(map[string]interface{})
+	after, _ := envelope["after"].(map[string]interface{})
+	source, _ := envelope["source"].(map[string]interface{})
+
+	switch option {
+	case "envelope":
+		return envelope, nil
+	case "row":
+		row := after
+		if op == "delete" {
+			row = before
+		}
+		if row == nil {
+			return nil, errSkipRecord
+		}
+		return row, nil
+	}
+
+	change := map[string]interface{}{"op": op, "source": source}
+	if after != nil {
+		change["new"] = after
+	}
+	if before != nil {
+		change["old"] = before
+	}
+	// Postgres connectors name the schema; MySQL's schema is its database
+	if schema, ok := source["schema"].(string); ok {
+		change["schema"] = schema
+	} else if db, ok := source["db"].(string); ok {
+		change["schema"] = db
+	}
+	if table, ok := source["table"].(string); ok {
+		change["table"] = table
+	}
+	if ms, ok := debeziumMillis(source["ts_ms"]); ok {
+		change["commit_time"] = time.UnixMilli(ms).UTC().Format(time.RFC3339Nano)
+	}
+	return change, nil
+}
+
+// debeziumMillis reads ts_ms, a number in JSON and an int64 from Avro
+func debeziumMillis(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return int64(n), true
+	case int64:
+		return n, true
+	case json.Number:
+		ms, err := n.Int64()
+		return ms, err == nil
+	}
+	return 0, false
+}
+
+func init() {
+	registerDecoder("debezium", debeziumDecoder{})
+}
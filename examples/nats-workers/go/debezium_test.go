@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// debeziumAvroSchema is a trimmed Postgres connector envelope
+const debeziumAvroSchema = `{"type": "record", "name": "Envelope", "namespace": "pg.public.orders", "fields": [
+	{"name": "before", "type": ["null", {"type": "record", "name": "Value", "fields": [
+		{"name": "id", "type": "int"}, {"name": "status", "type": "string"}]}], "default": null},
+	{"name": "after", "type": ["null", "Value"], "default": null},
+	{"name": "source", "type": {"type": "record", "name": "Source", "namespace": "io.debezium.connector.postgresql", "fields": [
+		{"name": "db", "type": "string"}, {"name": "schema", "type": "string"}, {"name": "table", "type": "string"},
+		{"name": "ts_ms", "type": "long"}]}},
+	{"name": "op", "type": "string"},
+	{"name": "ts_ms", "type": ["null", "long"], "default": null}
+]}`
+
+func TestDebeziumDecoder(t *testing.T) {
+	useSchemaRegistry(t, "")
+	const (
+		pgSource = `{"connector":"postgresql","db":"shop","lsn":24023128,"schema":"public","table":"orders","ts_ms":1704164645123}`
+		update   = `{"before":{"id":1,"status":"new"},"after":{"id":1,"status":"paid"},"source":` + pgSource + `,"op":"u","ts_ms":1704164645200}`
+		pgChange = `{"commit_time":"2024-01-02T03:04:05.123Z","new":{"id":1,"status":"paid"},"old":{"id":1,"status":"new"},"op":"update",` +
+			`"schema":"public","source":` + pgSource + `,"table":"orders"}`
+	)
+	tests := []struct {
+		name    string
+		data    string
+		option  string
+		want    string
+		wantErr string // "skip" for errSkipRecord
+	}{
+		{name: "update", data: update, want: pgChange},
+		{name: "change is the default mapping", data: update, option: "change", want: pgChange},
+		{name: "JsonConverter with schemas", data: `{"schema":{"type":"struct"},"payload":` + update + `}`, want: pgChange},
+		{name: "insert",
+			data: `{"before":null,"after":{"id":2},"source":{"schema":"public","table":"orders","ts_ms":0},"op":"c"}`,
+			want: `{"commit_time":"1970-01-01T00:00:00Z","new":{"id":2},"op":"insert","schema":"public","source":{"schema":"public","table":"orders","ts_ms":0},"table":"orders"}`},
+		{name: "snapshot read", data: `{"after":{"id":3},"source":{"table":"orders"},"op":"r"}`,
+			want: `{"new":{"id":3},"op":"read","source":{"table":"orders"},"table":"orders"}`},
+		{name: "MySQL schema is its database",
+			data: `{"before":{"id":4},"after":null,"source":{"db":"inventory","table":"customers","ts_ms":1000},"op":"d"}`,
+			want: `{"commit_time":"1970-01-01T00:00:01Z","old":{"id":4},"op":"delete","schema":"inventory","source":{"db":"inventory","table":"customers","ts_ms":1000},"table":"customers"}`},
+		{name: "truncate", data: `{"source":{"schema":"public","table":"orders"},"op":"t"}`,
+			want: `{"op":"truncate","schema":"public","source":{"schema":"public","table":"orders"},"table":"orders"}`},
+
+		{name: "row of an update", data: update, option: "row", want: `{"id":1,"status":"paid"}`},
+		{name: "row of a delete is the old row", data: `{"before":{"id":4},"after":null,"source":{},"op":"d"}`, option: "row",
+			want: `{"id":4}`},
+		{name: "truncate has no row", data: `{"source":{},"op":"t"}`, option: "row", wantErr: "skip"},
+		{name: "envelope", data: `{"schema":{},"payload":{"after":{"id":1},"op":"c","x":1}}`, option: "envelope",
+			want: `{"after":{"id":1},"op":"c","x":1}`},
+		{name: "payload without a schema is not unwrapped", data: `{"payload":{"op":"c"},"op":"r"}`, option: "envelope",
+			want: `{"op":"r","payload":{"op":"c"}}`},
+
+		{name: "tombstone", data: ``, wantErr: "skip"},
+		{name: "null tombstone", data: `null`, wantErr: "skip"},
+		{name: "not a change event", data: `{"id":1}`, wantErr: `not a Debezium change event (op "")`},
+		{name: "unknown op", data: `{"op":"m"}`, wantErr: `not a Debezium change event (op "m")`},
+		{name: "not JSON", data: `{"op":`, wantErr: "not a JSON object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record, err := debeziumDecoder{}.Decode(context.Background(), []byte(tt.data), tt.option)
+			switch {
+			case tt.wantErr == "skip":
+				if !errors.Is(err, errSkipRecord) {
+					t.Fatalf("err = %v, want errSkipRecord", err)
+				}
+				return
+			case tt.wantErr != "":
+				if err == nil || !worker.IsPermanent(err) || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want permanent %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := json.Marshal(record); string(got) != tt.want {
+				t.Fatalf("record = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDebeziumDecoderAvro(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(registrySchema{Schema: debeziumAvroSchema})
+	}))
+	defer srv.Close()
+	useSchemaRegistry(t, srv.URL)
+
+	w := &avroWriter{}
+	w.write(mustParseAvro(t, debeziumAvroSchema), map[string]interface{}{
+		"before": avroUnion{0, nil},
+		"after":  avroUnion{1, map[string]interface{}{"id": int64(1), "status": "paid"}},
+		"source": map[string]interface{}{"db": "shop", "schema": "public", "table": "orders", "ts_ms": int64(1704164645123)},
+		"op":     "c",
+		"ts_ms":  avroUnion{1, int64(1704164645200)},
+	})
+	record, err := debeziumDecoder{}.Decode(context.Background(), wireFormat(1, w.buf), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(record)
+	const want = `{"commit_time":"2024-01-02T03:04:05.123Z","new":{"id":1,"status":"paid"},"op":"insert","schema":"public",` +
+		`"source":{"db":"shop","schema":"public","table":"orders","ts_ms":1704164645123},"table":"orders"}`
+	if string(got) != want {
+		t.Fatalf("record = %s, want %s", got, want)
+	}
+}
+
+func TestDebeziumMillis(t *testing.T) {
+	tests := []struct {
+		in     interface{}
+		want   int64
+		wantOK bool
+	}{
+		{1704164645123.0, 1704164645123, true},
+		{int64(5), 5, true},
+		{json.Number("7"), 7, true},
+		{json.Number("7.5"), 0, false},
+		{"7", 0, false},
+		{nil, 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := debeziumMillis(tt.in); got != tt.want || ok != tt.wantOK {
+			t.Errorf("debeziumMillis(%#v) = %d, %v", tt.in, got, ok)
+		}
+	}
+}
+
+func TestValidateDebeziumMapping(t *testing.T) {
+	for value, wantErr := range map[string]string{
+		"x=debezium":          "",
+		"x=debezium:row":      "",
+		"x=debezium:envelope": "",
+		"x=debezium:after":    `debezium mapping must be one of change, row, envelope, got "after"`,
+	} {
+		rules, err := parseDecodeSubjects(value)
+		if err == nil {
+			err = validateDecodeRules(rules)
+		}
+		if (wantErr == "" && err != nil) || (wantErr != "" && (err == nil || err.Error() != wantErr)) {
+			t.Errorf("%s: err = %v, want %q", value, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// Decoder turns a message body in some wire format into the data the
+// worker delivers. Decoders register themselves under a name;
+// DECODE_SUBJECTS picks one per subject, and messages on other subjects
+// are JSON.
+type Decoder interface {
+	// Decode parses data. option is the text after the decoder name in
+	// DECODE_SUBJECTS, such as a schema file or message type. Malformed
+	// data gives a worker.Permanent error, and a record that carries no
+	// event (a tombstone, say) errSkipRecord; other errors are retried.
+	Decode(ctx context.Context, data []byte, option string) (map[string]interface{}, error)
+}
+
+var decoders = map[string]Decoder{}
+
+// errSkipRecord is returned by decoders for records with nothing to
+// deliver; the message is acknowledged without delivery
+var errSkipRecord = errors.New("record has nothing to deliver")
+
+// registerDecoder makes a decoder available to DECODE_SUBJECTS. It is
+// called from init functions and panics on duplicate names.
+func registerDecoder(name string, d Decoder) {
+	if _, exists := decoders[name]; exists {
+		panic("decoder registered twice: " + name)
+	}
+	decoders[name] = d
+}
+
+// registeredDecoders lists the known decoders in name order
+func registeredDecoders() []string {
+	names := make([]string, 0, len(decoders))
+	for name := range decoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// decodeRule applies a decoder to the subjects matching pattern
+type decodeRule struct {
+	pattern []string
+	decoder string
+	option  string
+}
+
+// decodeRules is DECODE_SUBJECTS, parsed on startup
+var decodeRules []decodeRule
+
+// parseDecodeSubjects parses DECODE_SUBJECTS, a comma-separated list of
+// subject=decoder[:option] rules such as "kafka.orders.>=avro" or
+// "events.pb.*=protobuf:acme.v1.Order"
+func parseDecodeSubjects(value string) ([]decodeRule, error) {
+	var rules []decodeRule
+	for _, item := range splitList(value) {
+		subject, spec, ok := strings.Cut(item, "=")
+		name, option, _ := strings.Cut(strings.TrimSpace(spec), ":")
+		subject = strings.TrimSpace(subject)
+		if !ok || subject == "" || name == "" {
+			return nil, fmt.Errorf("must look like kafka.orders.>=avro, got %q", item)
+		}
+		if _, known := decoders[name]; !known {
+			return nil, fmt.Errorf("unknown decoder %q in %q (expected %s)", name, item, strings.Join(registeredDecoders(), ", "))
+		}
+		rules = append(rules, decodeRule{pattern: strings.Split(subject, "."), decoder: name, option: option})
+	}
+	return rules, nil
+}
+
+// validateDecodeRules checks that each rule has what its decoder needs
+func validateDecodeRules(rules []decodeRule) error {
+	for _, rule := range rules {
+		switch {
+		case rule.decoder == "avro" && rule.option == "" && config.Decoders.SchemaRegistryURL == "":
+			return fmt.Errorf("avro needs SCHEMA_REGISTRY_URL or a schema file (avro:path.avsc)")
+		case rule.decoder == "protobuf" && rule.option == "":
+			return fmt.Errorf("protobuf needs a message type (protobuf:acme.v1.Order)")
+		case rule.decoder == "protobuf" && config.Decoders.ProtobufDescriptorSet == "":
+			return fmt.Errorf("protobuf needs PROTOBUF_DESCRIPTOR_SET")
+		case rule.decoder == "debezium" && rule.option != "" && !oneOf(rule.option, debeziumMappings...):
+			return fmt.Errorf("debezium mapping must be one of %s, got %q", strings.Join(debeziumMappings, ", "), rule.option)
+		}
+	}
+	return nil
+}
+
+// decoderFor returns the first rule matching subject
+func decoderFor(subject string) (*decodeRule, bool) {
+	if len(decodeRules) == 0 {
+		return nil, false
+	}
+	tokens := strings.Split(subject, ".")
+	for i := range decodeRules {
+		if natsSubjectMatches(decodeRules[i].pattern, tokens) {
+			return &decodeRules[i], true
+		}
+	}
+	return nil, false
+}
+
+// natsSubjectMatches applies NATS wildcard rules to a tokenized subject
+func natsSubjectMatches(pattern, subject []string) bool {
+	for i, token := range pattern {
+		if token == ">" {
+			return len(subject) > i
+		}
+		if i >= len(subject) || (token != "*" && token != subject[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(subject)
+}
+
+// decodeData decodes data by its subject's rule and re-encodes it as JSON.
+// Data on subjects without a rule is returned unchanged.
+func decodeData(ctx context.Context, subject string, data []byte) ([]byte, error) {
+	rule, ok := decoderFor(subject)
+	if !ok {
+		return data, nil
+	}
+	record, err := decoders[rule.decoder].Decode(ctx, data, rule.option)
+	if err != nil {
+		return nil, fmt.Errorf("%s decoder: %w", rule.decoder, err)
+	}
+	return json.Marshal(record)
+}
+
+// jsonDecoder reads JSON objects, including those framed by the Confluent
+// JSON Schema serializer
+type jsonDecoder struct{}
+
+func (jsonDecoder) Decode(_ context.Context, data []byte, _ string) (map[string]interface{}, error) {
+	if len(data) > 0 && data[0] == 0 {
+		_, body, err := splitSchemaID(data)
+		if err != nil {
+			return nil, err
+		}
+		data = body
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(data, &record); err != nil || record == nil {
+		return nil, worker.Permanent(fmt.Errorf("not a JSON object"))
+	}
+	return record, nil
+}
+
+func init() {
+	registerDecoder("json", jsonDecoder{})
+}
+
+// splitSchemaID reads the Confluent wire format: a zero byte, the schema
+// id as a 4-byte big-endian integer, then the encoded data
+func splitSchemaID(data []byte) (uint32, []byte, error) {
+	if len(data) < 5 || data[0] != 0 {
+		return 0, nil, worker.Permanent(fmt.Errorf("data is not in the schema registry wire format"))
+	}
+	return binary.BigEndian.Uint32(data[1:5]), data[5:], nil
+}
+
+// schemaRegistry reads schemas from a Confluent-compatible schema registry
+// (SCHEMA_REGISTRY_URL). Schema ids are immutable, so each is fetched once.
+type schemaRegistry struct {
+	url, user, password string
+	client              *http.Client
+
+	mu     sync.Mutex
+	parsed map[uint32]interface{}
+}
+
+var (
+	registryOnce         sync.Once
+	schemaRegistryClient *schemaRegistry
+)
+
+// getSchemaRegistry returns the configured registry, or nil
+func getSchemaRegistry() *schemaRegistry {
+	registryOnce.Do(func() {
+		if config.Decoders.SchemaRegistryURL == "" {
+			return
+		}
+		schemaRegistryClient = &schemaRegistry{
+			url:      strings.TrimSuffix(config.Decoders.SchemaRegistryURL, "/"),
+			user:     config.Decoders.SchemaRegistryUser,
+			password: config.Decoders.SchemaRegistryPassword,
+			client:   &http.Client{Timeout: 10 * time.Second},
+			parsed:   map[uint32]interface{}{},
+		}
+	})
+	return schemaRegistryClient
+}
+
+// registrySchema is the registry's answer for a schema id
+type registrySchema struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType"` // empty for Avro
+}
+
+// schema returns schema id parsed by parse, fetching it on first use
+func (r *schemaRegistry) schema(ctx context.Context, id uint32, parse func(*registrySchema) (interface{}, error)) (interface{}, error) {
+	r.mu.Lock()
+	cached, ok := r.parsed[id]
+	r.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url+"/schemas/ids/"+strconv.FormatUint(uint64(id), 10), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if r.user != "" {
+		req.SetBasicAuth(r.user, r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("schema registry: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, fmt.Errorf("schema registry: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, worker.Permanent(fmt.Errorf("schema %d not found in the registry", id))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("schema registry: HTTP %d for schema %d", resp.StatusCode, id)
+	}
+
+	var schema registrySchema
+	if err := json.Unmarshal(body, &schema); err != nil {
+		return nil, fmt.Errorf("schema registry: %w", err)
+	}
+	parsed, err := parse(&schema)
+	if err != nil {
+		return nil, worker.Permanent(fmt.Errorf("schema %d: %w", id, err))
+	}
+
+	r.mu.Lock()
+	r.parsed[id] = parsed
+	r.mu.Unlock()
+	return parsed, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// useSchemaRegistry points SCHEMA_REGISTRY_URL at url ("" for none) for
+// one test
+func useSchemaRegistry(t *testing.T, url string) {
+	t.Helper()
+	prev := config.Decoders
+	config.Decoders.SchemaRegistryURL = url
+	config.Decoders.SchemaRegistryUser = "user"
+	config.Decoders.SchemaRegistryPassword = "pass"
+	registryOnce, schemaRegistryClient = sync.Once{}, nil
+	t.Cleanup(func() {
+		config.Decoders = prev
+		registryOnce, schemaRegistryClient = sync.Once{}, nil
+	})
+}
+
+// useDecodeRules sets DECODE_SUBJECTS for one test
+func useDecodeRules(t testing.TB, value string) {
+	t.Helper()
+	rules, err := parseDecodeSubjects(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := decodeRules
+	decodeRules = rules
+	t.Cleanup(func() { decodeRules = prev })
+}
+
+// wireFormat frames data with a schema registry id
+func wireFormat(id byte, data []byte) []byte {
+	return append([]byte{0, 0, 0, 0, id}, data...)
+}
+
+func TestParseDecodeSubjects(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []decodeRule
+		wantErr string
+	}{
+		{value: ""},
+		{value: "kafka.orders.>=avro, events.pb.* = protobuf:acme.v1.Order ,legacy=json",
+			want: []decodeRule{
+				{pattern: []string{"kafka", "orders", ">"}, decoder: "avro"},
+				{pattern: []string{"events", "pb", "*"}, decoder: "protobuf", option: "acme.v1.Order"},
+				{pattern: []string{"legacy"}, decoder: "json"},
+			}},
+		{value: "x=avro:schemas/order.avsc", want: []decodeRule{{pattern: []string{"x"}, decoder: "avro", option: "schemas/order.avsc"}}},
+		{value: "kafka.orders", wantErr: `must look like kafka.orders.>=avro, got "kafka.orders"`},
+		{value: "=avro", wantErr: `must look like kafka.orders.>=avro, got "=avro"`},
+		{value: "x=", wantErr: `must look like kafka.orders.>=avro, got "x="`},
+		{value: "x=xml", wantErr: `unknown decoder "xml" in "x=xml" (expected ` + strings.Join(registeredDecoders(), ", ") + ")"},
+	}
+	for _, tt := range tests {
+		got, err := parseDecodeSubjects(tt.value)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%q: err = %v, want %q", tt.value, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q = %+v, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestValidateDecodeRules(t *testing.T) {
+	tests := []struct {
+		value, registry, descriptors string
+		wantErr                      string
+	}{
+		{value: "x=avro", registry: "http://registry"},
+		{value: "x=avro:order.avsc"},
+		{value: "x=avro", wantErr: "avro needs SCHEMA_REGISTRY_URL or a schema file (avro:path.avsc)"},
+		{value: "x=protobuf:acme.Order", descriptors: "set.pb"},
+		{value: "x=protobuf", descriptors: "set.pb", wantErr: "protobuf needs a message type (protobuf:acme.v1.Order)"},
+		{value: "x=protobuf:acme.Order", wantErr: "protobuf needs PROTOBUF_DESCRIPTOR_SET"},
+		{value: "x=json"},
+	}
+	for _, tt := range tests {
+		prev := config.Decoders
+		config.Decoders.SchemaRegistryURL, config.Decoders.ProtobufDescriptorSet = tt.registry, tt.descriptors
+		rules, err := parseDecodeSubjects(tt.value)
+		if err == nil {
+			err = validateDecodeRules(rules)
+		}
+		config.Decoders = prev
+		if (tt.wantErr == "" && err != nil) || (tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr)) {
+			t.Errorf("%s: err = %v, want %q", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNATSSubjectMatches(t *testing.T) {
+	tests := []struct {
+		pattern, subject string
+		want             bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "orders.created", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.created.eu", false},
+		{"orders.>", "orders.created.eu", true},
+		{"orders.>", "orders", false},
+		{"*.created", "orders.created", true},
+		{">", "anything.at.all", true},
+		{"orders.created", "orders.updated", false},
+	}
+	for _, tt := range tests {
+		if got := natsSubjectMatches(strings.Split(tt.pattern, "."), strings.Split(tt.subject, ".")); got != tt.want {
+			t.Errorf("%s matches %s = %v", tt.pattern, tt.subject, got)
+		}
+	}
+}
+
+func TestDecodeData(t *testing.T) {
+	useDecodeRules(t, "raw.json=json,raw.>=json:ignored")
+	tests := []struct {
+		subject, data, want string
+		wantErr             string
+	}{
+		{subject: "orders", data: `not json`, want: `not json`},
+		{subject: "raw.json", data: `{"b":1,"a":2}`, want: `{"a":2,"b":1}`},
+		{subject: "raw.other.deep", data: string(wireFormat(9, []byte(`{"a":1}`))), want: `{"a":1}`},
+		{subject: "raw.json", data: `[1]`, wantErr: "json decoder: not a JSON object"},
+	}
+	for _, tt := range tests {
+		got, err := decodeData(context.Background(), tt.subject, []byte(tt.data))
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr || !worker.IsPermanent(err) {
+				t.Errorf("%s: err = %v, want %q", tt.subject, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: %s, %v, want %s", tt.subject, got, err, tt.want)
+		}
+	}
+}
+
+func TestJSONDecoder(t *testing.T) {
+	tests := []struct {
+		data    []byte
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{data: []byte(`{"a":1}`), want: map[string]interface{}{"a": 1.0}},
+		{data: wireFormat(3, []byte(`{"a":1}`)), want: map[string]interface{}{"a": 1.0}},
+		{data: []byte(`null`), wantErr: "not a JSON object"},
+		{data: []byte(`"a"`), wantErr: "not a JSON object"},
+		{data: []byte{0, 1}, wantErr: "data is not in the schema registry wire format"},
+	}
+	for _, tt := range tests {
+		got, err := jsonDecoder{}.Decode(context.Background(), tt.data, "")
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr || !worker.IsPermanent(err) {
+				t.Errorf("% x: err = %v, want %q", tt.data, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("% x = %v, %v", tt.data, got, err)
+		}
+	}
+}
+
+func TestSplitSchemaID(t *testing.T) {
+	id, body, err := splitSchemaID([]byte{0, 0, 1, 0, 2, 'x'})
+	if err != nil || id != 65538 || string(body) != "x" {
+		t.Fatalf("= %d, %q, %v", id, body, err)
+	}
+	for _, data := range [][]byte{nil, {0, 0, 0, 1}, {1, 0, 0, 0, 1}} {
+		if _, _, err := splitSchemaID(data); err == nil || !worker.IsPermanent(err) {
+			t.Errorf("% x: err = %v", data, err)
+		}
+	}
+}
+
+func TestAvroDecoderRegistry(t *testing.T) {
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/schemas/ids/1":
+			json.NewEncoder(w).Encode(registrySchema{Schema: `{"type": "record", "name": "R", "fields": [{"name": "n", "type": "long"}]}`})
+		case "/schemas/ids/2":
+			json.NewEncoder(w).Encode(registrySchema{Schema: `syntax = "proto3";`, SchemaType: "PROTOBUF"})
+		case "/schemas/ids/3":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/schemas/ids/4":
+			w.Write([]byte(`{"schema": "{\"type\": \"record\"}"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	useSchemaRegistry(t, srv.URL+"/")
+
+	tests := []struct {
+		name          string
+		data          []byte
+		want          string
+		wantErr       string
+		wantPermanent bool
+	}{
+		{name: "record", data: wireFormat(1, []byte{0x54}), want: `{"n":42}`},
+		{name: "not the wire format", data: []byte{0x54}, wantErr: "data is not in the schema registry wire format", wantPermanent: true},
+		{name: "not an Avro schema", data: wireFormat(2, nil), wantErr: "schema 2: is a PROTOBUF schema, not Avro", wantPermanent: true},
+		{name: "registry unavailable", data: wireFormat(3, nil), wantErr: "schema registry: HTTP 503 for schema 3"},
+		{name: "invalid schema", data: wireFormat(4, nil), wantErr: "schema 4: avro record without a name", wantPermanent: true},
+		{name: "unknown schema", data: wireFormat(5, nil), wantErr: "schema 5 not found in the registry", wantPermanent: true},
+	}
+	d := &avroDecoder{files: map[string]*avroSchema{}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record, err := d.Decode(context.Background(), tt.data, "")
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr || worker.IsPermanent(err) != tt.wantPermanent {
+					t.Fatalf("err = %v (permanent %v), want %q", err, worker.IsPermanent(err), tt.wantErr)
+				}
+				return
+			}
+			if got, _ := json.Marshal(record); err != nil || string(got) != tt.want {
+				t.Fatalf("record = %s, %v", got, err)
+			}
+		})
+	}
+
+	// Parsed schemas are kept
+	before := atomic.LoadInt32(&fetches)
+	if _, err := d.Decode(context.Background(), wireFormat(1, []byte{0x02}), ""); err != nil {
+		t.Fatal(err)
+	}
+	if after := atomic.LoadInt32(&fetches); after != before {
+		t.Fatalf("schema 1 fetched again")
+	}
+}
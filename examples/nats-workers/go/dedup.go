@@ -0,0 +1,198 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dedupStore remembers when an (destination, event key) pair was last
+// delivered so repeat rule firings inside the window can be suppressed.
+type dedupStore interface {
+	// Seen reports whether the pair was delivered within window
+	Seen(ctx context.Context, destination, eventKey string, window time.Duration) (bool, error)
+	// Mark records a successful delivery of the pair
+	Mark(ctx context.Context, destination, eventKey string) error
+}
+
+var dedup dedupStore
+
+// dedupPruneInterval is how often the leader deletes expired
+// rule_nats_dedup rows
+const dedupPruneInterval = 10 * time.Minute
+
+func init() {
+	registerSingleton("dedup_prune", dedupPruneInterval, pruneDedup)
+}
+
+// initDedup selects the dedup backend from config. A store is created even
+// without a worker-wide window because destinations can set their own.
+func initDedup() error {
+	switch config.Dedup.Backend {
+	case "", "memory":
+		dedup = newMemoryDedup(config.Dedup.CacheSize)
+	case "postgres":
+		dedup = postgresDedup{}
+	default:
+		return fmt.Errorf("unknown DEDUP_BACKEND %q (expected memory or postgres)", config.Dedup.Backend)
+	}
+	return nil
+}
+
+// dedupWindow returns the suppression window for a delivery. Destinations
+// may override the worker-wide DEDUP_WINDOW_SECONDS.
+func dedupWindow(dest *Destination) time.Duration {
+	seconds := config.Dedup.WindowSeconds
+	if dest != nil && dest.DedupWindowSeconds != nil {
+		seconds = *dest.DedupWindowSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// dedupDestination identifies the destination for dedup purposes: the
+// registered webhook when there is one, the URL otherwise.
+func dedupDestination(dest *Destination, webhookURL string) string {
+	if dest != nil {
+		return "webhook:" + strconv.Itoa(dest.ID)
+	}
+	return webhookURL
+}
+
+// isDuplicate checks the store, treating store errors as "not a duplicate"
+// so a dedup outage never blocks delivery.
+func isDuplicate(ctx context.Context, destination, eventKey string, window time.Duration) bool {
+	if eventKey == "" || window <= 0 {
+		return false
+	}
+	seen, err := dedup.Seen(ctx, destination, eventKey, window)
+	if err != nil {
+		log.Printf("⚠️  Dedup lookup failed: %v", err)
+		return false
+	}
+	return seen
+}
+
+// markDelivered records a successful delivery for later dedup checks
+func markDelivered(ctx context.Context, destination, eventKey string, window time.Duration) {
+	if eventKey == "" || window <= 0 {
+		return
+	}
+	if err := dedup.Mark(ctx, destination, eventKey); err != nil {
+		log.Printf("⚠️  Failed to record dedup key: %v", err)
+	}
+}
+
+// memoryDedup is a per-process LRU of recent deliveries. Duplicates that land
+// on different replicas are not caught; use the postgres backend for that.
+type memoryDedup struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key         string
+	deliveredAt time.Time
+}
+
+func newMemoryDedup(capacity int) *memoryDedup {
+	if capacity <= 0 {
+		capacity = 10000
+	}
+	return &memoryDedup{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryDedup) Seen(ctx context.Context, destination, eventKey string, window time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.entries[destination+"\x00"+eventKey]
+	if !ok {
+		return false, nil
+	}
+	return time.Since(elem.Value.(*dedupEntry).deliveredAt) < window, nil
+}
+
+func (m *memoryDedup) Mark(ctx context.Context, destination, eventKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := destination + "\x00" + eventKey
+	if elem, ok := m.entries[key]; ok {
+		elem.Value.(*dedupEntry).deliveredAt = time.Now()
+		m.order.MoveToFront(elem)
+		return nil
+	}
+
+	m.entries[key] = m.order.PushFront(&dedupEntry{key: key, deliveredAt: time.Now()})
+	if m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*dedupEntry).key)
+	}
+	return nil
+}
+
+// postgresDedup shares dedup state across all replicas via rule_nats_dedup
+type postgresDedup struct{}
+
+func (postgresDedup) Seen(ctx context.Context, destination, eventKey string, window time.Duration) (bool, error) {
+	var seen bool
+	err := withDBRetry(ctx, primaryHealth, func() error {
+		return db.QueryRowContext(ctx,
+			`SELECT EXISTS (
+			     SELECT 1 FROM rule_nats_dedup
+			     WHERE destination = $1 AND event_key = $2
+			       AND delivered_at > CURRENT_TIMESTAMP - make_interval(secs => $3)
+			 )`,
+			destination, eventKey, window.Seconds(),
+		).Scan(&seen)
+	})
+	return seen, err
+}
+
+func (postgresDedup) Mark(ctx context.Context, destination, eventKey string) error {
+	return withDBRetry(ctx, primaryHealth, func() error {
+		_, err := db.ExecContext(ctx,
+			`INSERT INTO rule_nats_dedup (destination, event_key, delivered_at)
+			 VALUES ($1, $2, CURRENT_TIMESTAMP)
+			 ON CONFLICT (destination, event_key) DO UPDATE SET delivered_at = EXCLUDED.delivered_at`,
+			destination, eventKey,
+		)
+		return err
+	})
+}
+
+// pruneDedup deletes rule_nats_dedup rows older than the longest window
+// any destination or action uses, since they can no longer suppress a
+// delivery. It runs on the leader only.
+func pruneDedup(ctx context.Context) error {
+	if config.Dedup.Backend != "postgres" {
+		return nil
+	}
+	result, err := db.ExecContext(ctx,
+		`DELETE FROM rule_nats_dedup
+		 WHERE delivered_at < CURRENT_TIMESTAMP - make_interval(secs => GREATEST(
+		     $1,
+		     (SELECT COALESCE(MAX(dedup_window_seconds), 0) FROM rule_webhooks),
+		     (SELECT COALESCE(MAX(dedup_window_seconds), 0) FROM rule_actions)
+		 ))`,
+		config.Dedup.WindowSeconds,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to prune dedup records: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("🧹 Pruned %d expired dedup record(s)", n)
+	}
+	return nil
+}
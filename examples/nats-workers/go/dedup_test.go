@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryDedup(t *testing.T) {
+	ctx := context.Background()
+	d := newMemoryDedup(2)
+
+	seen := func(dest, key string, window time.Duration) bool {
+		t.Helper()
+		ok, err := d.Seen(ctx, dest, key, window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if seen("webhook:1", "order-1", time.Hour) {
+		t.Fatal("unmarked key seen")
+	}
+	d.Mark(ctx, "webhook:1", "order-1")
+	if !seen("webhook:1", "order-1", time.Hour) {
+		t.Fatal("marked key not seen within the window")
+	}
+	if seen("webhook:2", "order-1", time.Hour) {
+		t.Fatal("key seen for another destination")
+	}
+	if seen("webhook:1", "order-1", 0) {
+		t.Fatal("key seen outside the window")
+	}
+
+	// Capacity 2: marking a third pair evicts the least recently marked
+	d.Mark(ctx, "webhook:1", "order-2")
+	d.Mark(ctx, "webhook:1", "order-1")
+	d.Mark(ctx, "webhook:1", "order-3")
+	if seen("webhook:1", "order-2", time.Hour) {
+		t.Fatal("least recently marked key not evicted")
+	}
+	if !seen("webhook:1", "order-1", time.Hour) || !seen("webhook:1", "order-3", time.Hour) {
+		t.Fatal("recent keys evicted")
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	defer func(seconds int) { config.Dedup.WindowSeconds = seconds }(config.Dedup.WindowSeconds)
+	config.Dedup.WindowSeconds = 60
+	override, zero := 5, 0
+
+	tests := []struct {
+		name string
+		dest *Destination
+		want time.Duration
+	}{
+		{name: "worker-wide", want: time.Minute},
+		{name: "destination without override", dest: &Destination{}, want: time.Minute},
+		{name: "destination override", dest: &Destination{DedupWindowSeconds: &override}, want: 5 * time.Second},
+		{name: "destination disables", dest: &Destination{DedupWindowSeconds: &zero}, want: 0},
+	}
+	for _, tt := range tests {
+		if got := dedupWindow(tt.dest); got != tt.want {
+			t.Errorf("%s: window = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDedupDestination(t *testing.T) {
+	if got := dedupDestination(&Destination{ID: 7}, "https://x.test"); got != "webhook:7" {
+		t.Errorf("registered destination = %q", got)
+	}
+	if got := dedupDestination(nil, "https://x.test"); got != "https://x.test" {
+		t.Errorf("ad hoc destination = %q", got)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Delivery statistics are counted in memory per minute, destination, and
+// tenant, and flushed to rule_delivery_stats once a minute. The leader rolls
+// them up into rule_delivery_stats_hourly and rule_delivery_stats_daily and
+// deletes raw rows after STATS_RAW_RETENTION_DAYS, so dashboards read small
+// summary tables however much traffic the workers see.
+
+const (
+	deliveryStatsFlushInterval = time.Minute
+	statsRollupInterval        = 5 * time.Minute
+)
+
+// Delivery outcomes counted by recordDelivery
+const (
+	outcomeDelivered = "delivered"
+	outcomeFailed    = "failed"
+	outcomeExpired   = "expired"
+	outcomeDuplicate = "duplicate"
+)
+
+// latencyBucketsMs are the upper bounds of the latency histogram buckets;
+// a final bucket counts slower deliveries. ops_schema.sql and the
+// reporting views assume these bounds.
+var latencyBucketsMs = [...]int64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+type deliveryStatsKey struct {
+	minute      time.Time
+	destination string
+	tenant      string
+}
+
+type deliveryStatsBucket struct {
+	delivered, failed, expired, duplicates int64
+	totalTimeMs, maxTimeMs                 int64
+	latency                                []int64
+}
+
+// maxMetricTenants bounds the tenants given their own Prometheus series;
+// later ones are counted as "other"
+const maxMetricTenants = 500
+
+// tenantCounters are the per-tenant totals behind the Prometheus metrics
+type tenantCounters struct {
+	outcomes    map[string]uint64
+	totalTimeMs uint64
+	latency     [len(latencyBucketsMs) + 1]uint64
+}
+
+var (
+	deliveryStatsMu sync.Mutex
+	deliveryStats   = map[deliveryStatsKey]*deliveryStatsBucket{}
+	tenantMetrics   = map[string]*tenantCounters{}
+)
+
+func init() {
+	registerSingleton("stats_rollup", statsRollupInterval, rollupDeliveryStats)
+}
+
+// recordDelivery counts one message outcome; duration is only summed for
+// delivered messages, matching the consumer statistics
+func recordDelivery(m *ActionMessage, outcome string, duration time.Duration) {
+	now := time.Now().UTC()
+	key := deliveryStatsKey{
+		minute:      now.Truncate(time.Minute),
+		destination: statsDestination(m),
+		tenant:      statsTenant(m),
+	}
+
+	trackDestination(key.destination, outcome)
+
+	// With STATS_TRANSACTIONAL the outcome is written on its own, with its
+	// rule_delivery_outcomes row, rather than counted for the next flush
+	var bucket *deliveryStatsBucket
+	if config.Stats.Transactional {
+		bucket = &deliveryStatsBucket{}
+	}
+	deliveryStatsMu.Lock()
+	if key.tenant != "" {
+		countTenant(key.tenant, outcome, duration)
+	}
+	if bucket == nil {
+		bucket = deliveryStats[key]
+		if bucket == nil {
+			bucket = &deliveryStatsBucket{}
+			deliveryStats[key] = bucket
+		}
+	}
+	bucket.add(outcome, duration)
+	deliveryStatsMu.Unlock()
+
+	if config.Stats.Transactional {
+		recordOutcome(m, now, key, bucket, outcome, duration)
+	}
+}
+
+// add counts one outcome
+func (bucket *deliveryStatsBucket) add(outcome string, duration time.Duration) {
+	switch outcome {
+	case outcomeDelivered:
+		bucket.delivered++
+		ms := duration.Milliseconds()
+		bucket.totalTimeMs += ms
+		if ms > bucket.maxTimeMs {
+			bucket.maxTimeMs = ms
+		}
+		if bucket.latency == nil {
+			bucket.latency = make([]int64, len(latencyBucketsMs)+1)
+		}
+		bucket.latency[latencyBucket(ms)]++
+	case outcomeFailed:
+		bucket.failed++
+	case outcomeExpired:
+		bucket.expired++
+	case outcomeDuplicate:
+		bucket.duplicates++
+	}
+}
+
+// latencyBucket returns the histogram bucket for a latency
+func latencyBucket(ms int64) int {
+	for i, bound := range latencyBucketsMs {
+		if ms <= bound {
+			return i
+		}
+	}
+	return len(latencyBucketsMs)
+}
+
+// statsDestination names the message's destination without the query
+// string or path of unregistered webhook URLs, which may carry tokens
+func statsDestination(m *ActionMessage) string {
+	switch {
+	case m.dedupKey == "":
+		return "unknown"
+	case strings.HasPrefix(m.dedupKey, "webhook:"), strings.HasPrefix(m.dedupKey, "action:"):
+		return m.dedupKey
+	}
+	if u, err := url.Parse(m.dedupKey); err == nil && u.Host != "" {
+		return "url:" + u.Host
+	}
+	return "unknown"
+}
+
+// countTenant adds an outcome to the tenant's Prometheus counters. The
+// caller holds deliveryStatsMu.
+func countTenant(tenant, outcome string, duration time.Duration) {
+	c, ok := tenantMetrics[tenant]
+	if !ok {
+		if len(tenantMetrics) >= maxMetricTenants {
+			tenant = "other"
+			c = tenantMetrics[tenant]
+		}
+		if c == nil {
+			c = &tenantCounters{outcomes: map[string]uint64{}}
+			tenantMetrics[tenant] = c
+		}
+	}
+	c.outcomes[outcome]++
+	if outcome == outcomeDelivered {
+		ms := duration.Milliseconds()
+		c.totalTimeMs += uint64(ms)
+		c.latency[latencyBucket(ms)]++
+	}
+}
+
+// snapshotTenantMetrics copies the per-tenant counters
+func snapshotTenantMetrics() map[string]tenantCounters {
+	deliveryStatsMu.Lock()
+	defer deliveryStatsMu.Unlock()
+	snapshot := make(map[string]tenantCounters, len(tenantMetrics))
+	for tenant, c := range tenantMetrics {
+		copied := *c
+		copied.outcomes = make(map[string]uint64, len(c.outcomes))
+		for outcome, n := range c.outcomes {
+			copied.outcomes[outcome] = n
+		}
+		snapshot[tenant] = copied
+	}
+	return snapshot
+}
+
+// statsTenant is the message's tenant: its subject's STATS_TENANT_TOKEN
+// token when set, or else its STATS_TENANT_FIELD value in data
+func statsTenant(m *ActionMessage) string {
+	if config.Stats.TenantToken > 0 && m.Msg != nil {
+		if token := subjectTokenAt(m.Msg.Subject, config.Stats.TenantToken); token != "" {
+			return token
+		}
+	}
+	if config.Stats.TenantField == "" || m.Payload == nil {
+		return ""
+	}
+	value, ok := m.Payload.Data[config.Stats.TenantField]
+	if !ok || value == nil {
+		return ""
+	}
+	tenant := fmt.Sprint(value)
+	if len(tenant) > 200 {
+		tenant = tenant[:200]
+	}
+	return tenant
+}
+
+// subjectTokenAt returns the subject's token at the 1-based position, or ""
+// if it is shorter
+func subjectTokenAt(subject string, position int) string {
+	tokens := strings.Split(subject, ".")
+	if position > len(tokens) {
+		return ""
+	}
+	return tokens[position-1]
+}
+
+// subjectWildcardAt reports whether the pattern's token at the 1-based
+// position is a wildcard, so subjects it matches vary there
+func subjectWildcardAt(pattern string, position int) bool {
+	tokens := strings.Split(pattern, ".")
+	switch {
+	case position <= 0:
+		return false
+	case position <= len(tokens) && tokens[position-1] == "*":
+		return true
+	}
+	return tokens[len(tokens)-1] == ">" && position >= len(tokens)
+}
+
+// startDeliveryStats flushes the counters once a minute
+func startDeliveryStats() {
+	go func() {
+		ticker := time.NewTicker(deliveryStatsFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			flushDeliveryStats()
+		}
+	}()
+}
+
+// flushDeliveryStats adds the counters collected since the last flush to
+// rule_delivery_stats. Rows are added to rather than replaced, so replicas
+// sharing a consumer name and buffered writes combine correctly.
+func flushDeliveryStats() {
+	deliveryStatsMu.Lock()
+	pending := deliveryStats
+	deliveryStats = map[deliveryStatsKey]*deliveryStatsBucket{}
+	deliveryStatsMu.Unlock()
+
+	percentiles := hasCapability("latency_percentiles")
+	var flushErr error
+	for key, bucket := range pending {
+		err := opsWrite("", deliveryStatsUpsert(percentiles), deliveryStatsArgs(key, bucket, percentiles)...)
+		if err != nil && !errors.Is(err, errOpsBuffered) && flushErr == nil {
+			flushErr = err
+		}
+	}
+	if flushErr != nil {
+		log.Printf("⚠️  Failed to record delivery statistics: %v", flushErr)
+	}
+}
+
+// deliveryStatsUpsert adds a bucket's counts ($1 to $12, see
+// deliveryStatsArgs) to rule_delivery_stats. Without rule_histogram_add,
+// counts are still recorded but latency percentiles are not.
+func deliveryStatsUpsert(percentiles bool) string {
+	histogram := "rule_histogram_add(rule_delivery_stats.latency_histogram, EXCLUDED.latency_histogram)"
+	if !percentiles {
+		histogram = "rule_delivery_stats.latency_histogram"
+	}
+	return `INSERT INTO rule_delivery_stats (
+	     bucket_start, stream_name, consumer_name, destination, tenant,
+	     delivered, failed, expired, duplicates, total_time_ms, max_time_ms, latency_histogram
+	 ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	 ON CONFLICT (bucket_start, stream_name, consumer_name, destination, tenant) DO UPDATE SET
+	     delivered = rule_delivery_stats.delivered + EXCLUDED.delivered,
+	     failed = rule_delivery_stats.failed + EXCLUDED.failed,
+	     expired = rule_delivery_stats.expired + EXCLUDED.expired,
+	     duplicates = rule_delivery_stats.duplicates + EXCLUDED.duplicates,
+	     total_time_ms = rule_delivery_stats.total_time_ms + EXCLUDED.total_time_ms,
+	     max_time_ms = GREATEST(rule_delivery_stats.max_time_ms, EXCLUDED.max_time_ms),
+	     latency_histogram = ` + histogram
+}
+
+// deliveryStatsArgs are deliveryStatsUpsert's parameters for a bucket
+func deliveryStatsArgs(key deliveryStatsKey, bucket *deliveryStatsBucket, percentiles bool) []interface{} {
+	var latency interface{}
+	if percentiles {
+		latency = pq.Array(bucket.latency)
+	}
+	return []interface{}{
+		key.minute, config.Worker.StreamName, config.Worker.ConsumerName, key.destination, key.tenant,
+		bucket.delivered, bucket.failed, bucket.expired, bucket.duplicates, bucket.totalTimeMs, bucket.maxTimeMs,
+		latency,
+	}
+}
+
+// rollupDeliveryStats refreshes the hourly and daily summaries. It runs on
+// the leader only.
+func rollupDeliveryStats(ctx context.Context) error {
+	if err := ensureOpsReady(); err != nil {
+		return err
+	}
+	if !hasCapability("delivery_rollup") {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, statsRollupInterval)
+	defer cancel()
+	if _, err := opsDB.ExecContext(ctx, `SELECT rule_delivery_stats_rollup($1)`, config.Stats.RawRetentionDays); err != nil {
+		return fmt.Errorf("failed to roll up delivery statistics: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+)
+
+// resetDeliveryStats empties the in-memory delivery counters for one test
+func resetDeliveryStats(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		deliveryStatsMu.Lock()
+		deliveryStats = map[deliveryStatsKey]*deliveryStatsBucket{}
+		tenantMetrics = map[string]*tenantCounters{}
+		deliveryStatsMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestLatencyBucket(t *testing.T) {
+	tests := []struct {
+		ms   int64
+		want int
+	}{
+		{0, 0}, {5, 0}, {6, 1}, {10, 1}, {99, 4}, {100, 4}, {101, 5},
+		{10000, len(latencyBucketsMs) - 1}, {10001, len(latencyBucketsMs)}, {1 << 40, len(latencyBucketsMs)},
+	}
+	for _, tt := range tests {
+		if got := latencyBucket(tt.ms); got != tt.want {
+			t.Errorf("latencyBucket(%d) = %d, want %d", tt.ms, got, tt.want)
+		}
+	}
+}
+
+func TestDeliveryStatsBucketAdd(t *testing.T) {
+	var b deliveryStatsBucket
+	b.add(outcomeDelivered, 3*time.Millisecond)
+	b.add(outcomeDelivered, 300*time.Millisecond)
+	b.add(outcomeFailed, time.Second)
+	b.add(outcomeExpired, 0)
+	b.add(outcomeDuplicate, 0)
+	b.add(outcomeDuplicate, 0)
+
+	if b.delivered != 2 || b.failed != 1 || b.expired != 1 || b.duplicates != 2 {
+		t.Fatalf("counts = %+v", b)
+	}
+	// Only deliveries count towards the time and the histogram
+	if b.totalTimeMs != 303 || b.maxTimeMs != 300 {
+		t.Fatalf("times = %d total, %d max", b.totalTimeMs, b.maxTimeMs)
+	}
+	want := make([]int64, len(latencyBucketsMs)+1)
+	want[0], want[6] = 1, 1
+	if !reflect.DeepEqual(b.latency, want) {
+		t.Fatalf("latency = %v, want %v", b.latency, want)
+	}
+}
+
+func TestStatsDestination(t *testing.T) {
+	tests := []struct {
+		dedupKey string
+		want     string
+	}{
+		{"", "unknown"},
+		{"webhook:crm", "webhook:crm"},
+		{"action:notify_slack", "action:notify_slack"},
+		{"https://hooks.example.com/services/T000/B000/SECRET?token=abc", "url:hooks.example.com"},
+		{"not a url", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := statsDestination(&ActionMessage{dedupKey: tt.dedupKey}); got != tt.want {
+			t.Errorf("statsDestination(%q) = %q, want %q", tt.dedupKey, got, tt.want)
+		}
+	}
+}
+
+func TestStatsTenant(t *testing.T) {
+	prev := config.Stats
+	t.Cleanup(func() { config.Stats = prev })
+
+	long := strings.Repeat("t", 300)
+	tests := []struct {
+		name    string
+		token   int
+		field   string
+		subject string
+		data    map[string]interface{}
+		want    string
+	}{
+		{name: "none configured", subject: "rules.acme.orders", want: ""},
+		{name: "subject token", token: 2, subject: "rules.acme.orders", want: "acme"},
+		{name: "short subject falls back to field", token: 5, field: "tenant_id", subject: "rules.acme", data: map[string]interface{}{"tenant_id": "globex"}, want: "globex"},
+		{name: "numeric field", field: "tenant_id", data: map[string]interface{}{"tenant_id": 42.0}, want: "42"},
+		{name: "missing field", field: "tenant_id", data: map[string]interface{}{}, want: ""},
+		{name: "null field", field: "tenant_id", data: map[string]interface{}{"tenant_id": nil}, want: ""},
+		{name: "long value truncated", field: "tenant_id", data: map[string]interface{}{"tenant_id": long}, want: long[:200]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Stats.TenantToken, config.Stats.TenantField = tt.token, tt.field
+			m := &ActionMessage{Msg: &nats.Msg{Subject: tt.subject}, Payload: &WebhookPayload{Data: tt.data}}
+			if got := statsTenant(m); got != tt.want {
+				t.Fatalf("statsTenant = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubjectTokens(t *testing.T) {
+	tokens := []struct {
+		subject  string
+		position int
+		want     string
+	}{
+		{"rules.acme.orders", 1, "rules"},
+		{"rules.acme.orders", 3, "orders"},
+		{"rules.acme.orders", 4, ""},
+	}
+	for _, tt := range tokens {
+		if got := subjectTokenAt(tt.subject, tt.position); got != tt.want {
+			t.Errorf("subjectTokenAt(%s, %d) = %q, want %q", tt.subject, tt.position, got, tt.want)
+		}
+	}
+
+	wildcards := []struct {
+		pattern  string
+		position int
+		want     bool
+	}{
+		{"rules.*.orders", 2, true},
+		{"rules.*.orders", 3, false},
+		{"rules.>", 2, true},
+		{"rules.>", 5, true},
+		{"rules.>", 1, false},
+		{"rules.acme", 3, false},
+		{"rules.*", 0, false},
+	}
+	for _, tt := range wildcards {
+		if got := subjectWildcardAt(tt.pattern, tt.position); got != tt.want {
+			t.Errorf("subjectWildcardAt(%s, %d) = %v, want %v", tt.pattern, tt.position, got, tt.want)
+		}
+	}
+}
+
+func TestFlushDeliveryStats(t *testing.T) {
+	resetDeliveryStats(t)
+	resetOpsBuffer(t, 10)
+	ops := mockOpsDB(t)
+	prevStats, prevWorker := config.Stats, config.Worker
+	t.Cleanup(func() { config.Stats, config.Worker = prevStats, prevWorker })
+	config.Stats.Transactional, config.Stats.TenantField, config.Stats.TenantToken = false, "tenant_id", 0
+	config.Worker.StreamName, config.Worker.ConsumerName = "RULES", "webhooks"
+
+	acme := &ActionMessage{dedupKey: "webhook:crm", Payload: &WebhookPayload{Data: map[string]interface{}{"tenant_id": "acme"}}}
+	recordDelivery(acme, outcomeDelivered, 20*time.Millisecond)
+	recordDelivery(acme, outcomeDelivered, 40*time.Millisecond)
+	recordDelivery(acme, outcomeFailed, time.Second)
+
+	deliveryStatsMu.Lock()
+	var key deliveryStatsKey
+	for k := range deliveryStats {
+		key = k
+	}
+	if len(deliveryStats) != 1 || key.destination != "webhook:crm" || key.tenant != "acme" || key.minute.Second() != 0 {
+		deliveryStatsMu.Unlock()
+		t.Fatalf("deliveryStats = %v", deliveryStats)
+	}
+	deliveryStatsMu.Unlock()
+
+	histogram := make([]int64, len(latencyBucketsMs)+1)
+	histogram[2], histogram[3] = 1, 1
+	ops.ExpectExec(`INSERT INTO rule_delivery_stats .* ON CONFLICT .* delivered = rule_delivery_stats.delivered \+ EXCLUDED.delivered`).
+		WithArgs(key.minute, "RULES", "webhooks", "webhook:crm", "acme", int64(2), int64(1), int64(0), int64(0), int64(60), int64(40),
+			pq.Array(histogram)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	flushDeliveryStats()
+
+	deliveryStatsMu.Lock()
+	defer deliveryStatsMu.Unlock()
+	if len(deliveryStats) != 0 {
+		t.Fatalf("counters not reset: %v", deliveryStats)
+	}
+	if c := tenantMetrics["acme"]; c == nil || c.outcomes[outcomeDelivered] != 2 || c.outcomes[outcomeFailed] != 1 || c.totalTimeMs != 60 {
+		t.Fatalf("tenant metrics = %+v", c)
+	}
+}
+
+func TestDeliveryStatsUpsertWithoutPercentiles(t *testing.T) {
+	query := deliveryStatsUpsert(false)
+	if strings.Contains(query, "rule_histogram_add") || !strings.HasSuffix(query, "latency_histogram = rule_delivery_stats.latency_histogram") {
+		t.Fatalf("query = %s", query)
+	}
+	args := deliveryStatsArgs(deliveryStatsKey{}, &deliveryStatsBucket{latency: []int64{1}}, false)
+	if len(args) != 12 || args[11] != nil {
+		t.Fatalf("args = %v", args)
+	}
+	if !strings.Contains(deliveryStatsUpsert(true), "rule_histogram_add(rule_delivery_stats.latency_histogram, EXCLUDED.latency_histogram)") {
+		t.Fatal("percentile upsert does not merge histograms")
+	}
+}
+
+func TestRollupDeliveryStats(t *testing.T) {
+	ops := mockOpsDB(t)
+	prev := config.Stats.RawRetentionDays
+	t.Cleanup(func() { config.Stats.RawRetentionDays = prev })
+	config.Stats.RawRetentionDays = 14
+
+	ops.ExpectExec(`SELECT rule_delivery_stats_rollup\(\$1\)`).WithArgs(14).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := rollupDeliveryStats(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCountTenantOverflow(t *testing.T) {
+	resetDeliveryStats(t)
+	deliveryStatsMu.Lock()
+	for i := 0; i < maxMetricTenants; i++ {
+		countTenant("tenant-"+strconv.Itoa(i), outcomeDelivered, time.Millisecond)
+	}
+	// Known tenants keep their series; new ones share "other"
+	countTenant("tenant-0", outcomeDelivered, time.Millisecond)
+	countTenant("late-1", outcomeFailed, 0)
+	countTenant("late-2", outcomeDelivered, 250*time.Millisecond)
+	deliveryStatsMu.Unlock()
+
+	snapshot := snapshotTenantMetrics()
+	if len(snapshot) != maxMetricTenants+1 || snapshot["tenant-0"].outcomes[outcomeDelivered] != 2 {
+		t.Fatalf("%d tenants, tenant-0 = %+v", len(snapshot), snapshot["tenant-0"])
+	}
+	other := snapshot["other"]
+	if other.outcomes[outcomeFailed] != 1 || other.outcomes[outcomeDelivered] != 1 || other.totalTimeMs != 250 {
+		t.Fatalf("other = %+v", other)
+	}
+	if _, ok := snapshot["late-1"]; ok {
+		t.Fatal("tenant over the cap got its own series")
+	}
+
+	// Snapshots are copies
+	other.outcomes[outcomeFailed] = 99
+	if snapshotTenantMetrics()["other"].outcomes[outcomeFailed] != 1 {
+		t.Fatal("snapshot shares counters")
+	}
+}
@@ -0,0 +1,64 @@
+# A rule, a rule set running it, a destination for its webhook calls, and
+# the consumer the workers deliver from. The provider reads DATABASE_URL
+# and NATS_URL when database_url and nats_url are unset; the README's
+# Terraform Provider section explains installing it.
+terraform {
+  required_providers {
+    ruleengine = {
+      source = "rule-engine/ruleengine"
+    }
+  }
+}
+
+provider "ruleengine" {}
+
+variable "crm_token" {
+  type      = string
+  sensitive = true
+}
+
+resource "ruleengine_rule" "high_value_order" {
+  name        = "HighValueOrder"
+  description = "Flag orders over $1000"
+  grl         = <<-GRL
+    rule HighValueOrder "Flag orders over $1000" salience 10 {
+      when
+        Order.total > 1000
+      then
+        Order.flagged = true;
+        Retract("HighValueOrder");
+    }
+  GRL
+}
+
+resource "ruleengine_rule_set" "orders" {
+  name        = "orders"
+  description = "Order checks"
+
+  rule {
+    name = ruleengine_rule.high_value_order.name
+  }
+}
+
+resource "ruleengine_destination" "crm" {
+  name = "crm"
+  url  = "https://crm.example.com/hooks/orders"
+  headers = {
+    "Content-Type"  = "application/json"
+    "Authorization" = "Bearer ${var.crm_token}"
+  }
+  timeout_ms  = 10000
+  max_retries = 5
+  tags        = ["crm", "orders"]
+}
+
+resource "ruleengine_consumer" "webhook_workers" {
+  stream          = "WEBHOOKS"
+  name            = "webhook-workers"
+  filter_subject  = "webhooks.*"
+  max_ack_pending = 500
+}
+
+output "orders_rule_set_id" {
+  value = ruleengine_rule_set.orders.id
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// Destination is a registered webhook (rule_webhooks row) a message can
+// reference by webhook_id instead of carrying the full delivery config.
+type Destination struct {
+	ID           int
+	Name         string
+	URL          string
+	Method       string
+	Headers      map[string]string
+	QueryParams  map[string]string
+	TimeoutMs    int
+	ContentType  string
+	BodyTemplate string
+
+	// CloudEvents is none, binary, or structured; empty uses
+	// CLOUDEVENTS_OUTBOUND
+	CloudEvents string
+
+	// DedupWindowSeconds overrides the worker-wide dedup window when set
+	DedupWindowSeconds *int
+
+	// PausedFrom and PausedUntil bound a maintenance window during which
+	// deliveries are held; a nil PausedUntil pauses until resumed
+	PausedFrom  *time.Time
+	PausedUntil *time.Time
+	PauseReason string
+
+	// DeliveryHours, when set, are the only times messages are sent
+	DeliveryHours *ruleengine.DeliveryHours
+
+	// ResponseMapping, when set, picks facts out of successful responses
+	ResponseMapping *ruleengine.ResponseMapping
+
+	// CaptureUntil, while in the future, records every exchange with the
+	// destination for debugging (see capture.go)
+	CaptureUntil *time.Time
+}
+
+// destinationCacheTTL bounds how stale a cached destination may be
+const destinationCacheTTL = 30 * time.Second
+
+type cachedDestination struct {
+	dest     *Destination
+	loadedAt time.Time
+}
+
+var (
+	destinationsMu sync.Mutex
+	destinations   = map[int]cachedDestination{}
+)
+
+// getDestination returns the destination with the given id, reading it from
+// Postgres at most once per destinationCacheTTL.
+func getDestination(ctx context.Context, id int) (*Destination, error) {
+	destinationsMu.Lock()
+	cached, ok := destinations[id]
+	destinationsMu.Unlock()
+	if ok && time.Since(cached.loadedAt) < destinationCacheTTL {
+		return cached.dest, nil
+	}
+
+	dest, err := loadDestination(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	destinationsMu.Lock()
+	destinations[id] = cachedDestination{dest: dest, loadedAt: time.Now()}
+	destinationsMu.Unlock()
+	return dest, nil
+}
+
+func loadDestination(ctx context.Context, id int) (*Destination, error) {
+	var (
+		dest         Destination
+		method       sql.NullString
+		headers      []byte
+		queryParams  []byte
+		timeoutMs    sql.NullInt64
+		contentType  sql.NullString
+		bodyTemplate sql.NullString
+		dedupWindow  sql.NullInt64
+		cloudEvents  sql.NullString
+		pausedFrom   sql.NullTime
+		pausedUntil  sql.NullTime
+		pauseReason  sql.NullString
+		hours        sql.NullString
+		timezone     sql.NullString
+		mapping      []byte
+		captureUntil sql.NullTime
+	)
+
+	err := lookupQueryRow(ctx,
+		`SELECT webhook_id, webhook_name, url, method, headers, timeout_ms, content_type, body_template, query_params,
+		        dedup_window_seconds, cloudevents, paused_from, paused_until, pause_reason,
+		        delivery_hours, delivery_timezone, response_mapping, capture_until
+		 FROM rule_webhooks
+		 WHERE webhook_id = $1 AND enabled = true`,
+		id,
+	).Scan(&dest.ID, &dest.Name, &dest.URL, &method, &headers, &timeoutMs, &contentType, &bodyTemplate, &queryParams,
+		&dedupWindow, &cloudEvents, &pausedFrom, &pausedUntil, &pauseReason,
+		&hours, &timezone, &mapping, &captureUntil)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("webhook %d not found or disabled", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load webhook %d: %w", id, err)
+	}
+
+	if len(headers) > 0 {
+		if err := json.Unmarshal(headers, &dest.Headers); err != nil {
+			return nil, fmt.Errorf("webhook %d has invalid headers: %w", id, err)
+		}
+	}
+	if len(queryParams) > 0 {
+		if err := json.Unmarshal(queryParams, &dest.QueryParams); err != nil {
+			return nil, fmt.Errorf("webhook %d has invalid query_params: %w", id, err)
+		}
+	}
+	dest.Method = method.String
+	dest.TimeoutMs = int(timeoutMs.Int64)
+	dest.ContentType = contentType.String
+	dest.BodyTemplate = bodyTemplate.String
+	dest.CloudEvents = cloudEvents.String
+	if dedupWindow.Valid {
+		seconds := int(dedupWindow.Int64)
+		dest.DedupWindowSeconds = &seconds
+	}
+	if pausedFrom.Valid {
+		dest.PausedFrom = &pausedFrom.Time
+		if pausedUntil.Valid {
+			dest.PausedUntil = &pausedUntil.Time
+		}
+		dest.PauseReason = pauseReason.String
+	}
+	if hours.String != "" {
+		if dest.DeliveryHours, err = ruleengine.ParseDeliveryHours(hours.String, timezone.String); err != nil {
+			return nil, fmt.Errorf("webhook %d has invalid delivery hours: %w", id, err)
+		}
+	}
+	if len(mapping) > 0 {
+		if err := json.Unmarshal(mapping, &dest.ResponseMapping); err != nil {
+			return nil, fmt.Errorf("webhook %d has an invalid response_mapping: %w", id, err)
+		}
+	}
+	if captureUntil.Valid {
+		dest.CaptureUntil = &captureUntil.Time
+	}
+	return &dest, nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emailAction renders and sends an email through a server registered in
+// rule_smtp_servers:
+//
+//	{"smtp": "ops_mail", "to": ["{{.owner_email}}"], "subject": "Order {{.order_id}} flagged",
+//	 "body": "...", "html": false}
+//
+// subject, body, and each recipient are Go templates over data.
+type emailAction struct{}
+
+type emailConfig struct {
+	SMTP    string   `json:"smtp"`
+	From    string   `json:"from"`
+	To      []string `json:"to"`
+	Cc      []string `json:"cc"`
+	Bcc     []string `json:"bcc"`
+	ReplyTo string   `json:"reply_to"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+	HTML    bool     `json:"html"`
+}
+
+// SMTPServer is a registered mail server (rule_smtp_servers row). The
+// password is stored encrypted and decrypted by Postgres on load.
+type SMTPServer struct {
+	ID       int
+	Name     string
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	TLSMode  string // starttls, tls, or none
+}
+
+func init() {
+	registerAction("email", emailAction{})
+}
+
+func (emailAction) Execute(ctx context.Context, m *ActionMessage) (string, error) {
+	var cfg emailConfig
+	if err := m.Config.decode(&cfg); err != nil {
+		return "", err
+	}
+	if cfg.SMTP == "" {
+		return "", fmt.Errorf("action %s has no smtp server", m.Config.Name)
+	}
+	server, err := getSMTPServer(ctx, cfg.SMTP)
+	if err != nil {
+		return "", err
+	}
+
+	data := m.Payload.Data
+	to, err := renderAddresses(cfg.To, data)
+	if err != nil {
+		return "", fmt.Errorf("to: %w", err)
+	}
+	cc, err := renderAddresses(cfg.Cc, data)
+	if err != nil {
+		return "", fmt.Errorf("cc: %w", err)
+	}
+	bcc, err := renderAddresses(cfg.Bcc, data)
+	if err != nil {
+		return "", fmt.Errorf("bcc: %w", err)
+	}
+	if len(to)+len(cc)+len(bcc) == 0 {
+		return "", fmt.Errorf("action %s has no recipients", m.Config.Name)
+	}
+
+	from := cfg.From
+	if from == "" {
+		from = server.From
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", fmt.Errorf("invalid from address %q: %w", from, err)
+	}
+
+	subject, err := renderBodyTemplate(cfg.Subject, data)
+	if err != nil {
+		return "", fmt.Errorf("subject: %w", err)
+	}
+	var body []byte
+	if cfg.HTML {
+		body, err = renderHTMLTemplate(cfg.Body, data)
+	} else {
+		body, err = renderBodyTemplate(cfg.Body, data)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	message, err := buildEmail(sender, to, cc, cfg.ReplyTo, string(subject), body, cfg.HTML)
+	if err != nil {
+		return "", err
+	}
+
+	recipients := make([]string, 0, len(to)+len(cc)+len(bcc))
+	for _, list := range [][]*mail.Address{to, cc, bcc} {
+		for _, addr := range list {
+			recipients = append(recipients, addr.Address)
+		}
+	}
+	if err := sendMail(ctx, server, sender.Address, recipients, message); err != nil {
+		return "", fmt.Errorf("smtp %s: %w", server.Name, err)
+	}
+	return fmt.Sprintf("emailed %d recipient(s) via %s", len(recipients), server.Name), nil
+}
+
+// renderAddresses renders each recipient template and parses the result,
+// which may hold several comma-separated addresses. Recipients that render
+// empty are skipped.
+func renderAddresses(templates []string, data map[string]interface{}) ([]*mail.Address, error) {
+	var addrs []*mail.Address
+	for _, text := range templates {
+		rendered, err := renderBodyTemplate(text, data)
+		if err != nil {
+			return nil, err
+		}
+		list := strings.TrimSpace(string(rendered))
+		if list == "" || list == "<no value>" {
+			continue
+		}
+		parsed, err := mail.ParseAddressList(list)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", list, err)
+		}
+		addrs = append(addrs, parsed...)
+	}
+	return addrs, nil
+}
+
+func renderHTMLTemplate(text string, data map[string]interface{}) ([]byte, error) {
+	tmpl, err := htmltemplate.New("body").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render body template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// buildEmail assembles a single-part MIME message with a quoted-printable
+// UTF-8 body. Bcc recipients are left out of the headers.
+func buildEmail(from *mail.Address, to, cc []*mail.Address, replyTo, subject string, body []byte, html bool) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+	}
+
+	header("From", from.String())
+	if len(to) > 0 {
+		header("To", joinAddresses(to))
+	}
+	if len(cc) > 0 {
+		header("Cc", joinAddresses(cc))
+	}
+	if replyTo != "" {
+		addr, err := mail.ParseAddress(replyTo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reply_to %q: %w", replyTo, err)
+		}
+		header("Reply-To", addr.String())
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", messageID(from.Address))
+	header("MIME-Version", "1.0")
+	if html {
+		header("Content-Type", "text/html; charset=utf-8")
+	} else {
+		header("Content-Type", "text/plain; charset=utf-8")
+	}
+	header("Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write(body); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func joinAddresses(addrs []*mail.Address) string {
+	parts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		parts[i] = addr.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func messageID(from string) string {
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = from[i+1:]
+	}
+	random := make([]byte, 12)
+	rand.Read(random)
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(random), domain)
+}
+
+// sendMail delivers message over SMTP. The connection is bounded by the
+// context deadline, since net/smtp has no context support of its own.
+func sendMail(ctx context.Context, server *SMTPServer, from string, recipients []string, message []byte) error {
+	addr := net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+	tlsConfig := &tls.Config{ServerName: server.Host}
+
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if server.TLSMode == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, server.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if server.TLSMode == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS: %w", err)
+		}
+	}
+	if server.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", server.Username, server.Password, server.Host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range recipients {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("recipient %s: %w", rcpt, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+type cachedSMTPServer struct {
+	server   *SMTPServer
+	loadedAt time.Time
+}
+
+var (
+	smtpServersMu sync.Mutex
+	smtpServers   = map[string]cachedSMTPServer{}
+)
+
+// getSMTPServer returns the enabled SMTP server with the given name, reading
+// it from Postgres at most once per actionCacheTTL.
+func getSMTPServer(ctx context.Context, name string) (*SMTPServer, error) {
+	smtpServersMu.Lock()
+	cached, ok := smtpServers[name]
+	smtpServersMu.Unlock()
+	if ok && time.Since(cached.loadedAt) < actionCacheTTL {
+		return cached.server, nil
+	}
+
+	server, err := loadSMTPServer(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	smtpServersMu.Lock()
+	smtpServers[name] = cachedSMTPServer{server: server, loadedAt: time.Now()}
+	smtpServersMu.Unlock()
+	return server, nil
+}
+
+func loadSMTPServer(ctx context.Context, name string) (*SMTPServer, error) {
+	var (
+		server   SMTPServer
+		username sql.NullString
+		password sql.NullString
+	)
+
+	err := lookupQueryRow(ctx,
+		`SELECT smtp_id, smtp_name, host, port, username, decrypt_credential(password_encrypted), from_address, tls_mode
+		 FROM rule_smtp_servers
+		 WHERE smtp_name = $1 AND enabled = true`,
+		name,
+	).Scan(&server.ID, &server.Name, &server.Host, &server.Port, &username, &password, &server.From, &server.TLSMode)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("smtp server %s not found or disabled", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load smtp server %s: %w", name, err)
+	}
+
+	server.Username = username.String
+	server.Password = password.String
+	return &server, nil
+}
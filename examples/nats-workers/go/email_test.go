@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRenderAddresses(t *testing.T) {
+	data := map[string]interface{}{
+		"owner": "ada@example.com",
+		"team":  "Ops <ops@example.com>, dev@example.com",
+		"bad":   "not an address",
+	}
+	tests := []struct {
+		name      string
+		templates []string
+		want      []string
+		wantErr   string
+	}{
+		{name: "literal", templates: []string{"a@example.com"}, want: []string{"a@example.com"}},
+		{name: "template", templates: []string{"{{.owner}}"}, want: []string{"ada@example.com"}},
+		{name: "list", templates: []string{"{{.team}}"}, want: []string{"ops@example.com", "dev@example.com"}},
+		{name: "missing key skipped", templates: []string{"{{.missing}}", " ", "{{.owner}}"}, want: []string{"ada@example.com"}},
+		{name: "invalid", templates: []string{"{{.bad}}"}, wantErr: `invalid address "not an address"`},
+		{name: "bad template", templates: []string{"{{"}, wantErr: "invalid body_template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs, err := renderAddresses(tt.templates, data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, addr := range addrs {
+				got = append(got, addr.Address)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("addresses = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildEmail(t *testing.T) {
+	from := &mail.Address{Name: "Rules", Address: "rules@example.com"}
+	to := []*mail.Address{{Address: "ada@example.com"}}
+	cc := []*mail.Address{{Name: "Ops", Address: "ops@example.com"}}
+
+	tests := []struct {
+		name        string
+		cc          []*mail.Address
+		replyTo     string
+		subject     string
+		body        string
+		html        bool
+		wantHeaders map[string]string
+		wantErr     string
+	}{
+		{name: "plain", subject: "Order 7 flagged", body: "Total: 12€",
+			wantHeaders: map[string]string{
+				"From": `"Rules" <rules@example.com>`, "To": "<ada@example.com>",
+				"Subject": "Order 7 flagged", "Content-Type": "text/plain; charset=utf-8",
+				"Content-Transfer-Encoding": "quoted-printable", "MIME-Version": "1.0",
+			}},
+		{name: "html with cc and reply-to", cc: cc, replyTo: "help@example.com", subject: "Ünïcode", body: "<b>hi</b>", html: true,
+			wantHeaders: map[string]string{
+				"Cc": `"Ops" <ops@example.com>`, "Reply-To": "<help@example.com>",
+				"Subject": "Ünïcode", "Content-Type": "text/html; charset=utf-8",
+			}},
+		{name: "invalid reply-to", replyTo: "nope", wantErr: `invalid reply_to "nope"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := buildEmail(from, to, tt.cc, tt.replyTo, tt.subject, []byte(tt.body), tt.html)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec := new(mime.WordDecoder)
+			for name, want := range tt.wantHeaders {
+				got := msg.Header.Get(name)
+				if name == "Subject" {
+					if got, err = dec.DecodeHeader(got); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if id := msg.Header.Get("Message-ID"); !strings.HasSuffix(id, "@example.com>") {
+				t.Errorf("Message-ID = %q", id)
+			}
+			body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+// smtpSession is what fakeSMTP received for one message
+type smtpSession struct {
+	from string
+	rcpt []string
+	data string
+}
+
+// fakeSMTP accepts one plain SMTP session on a local port and records it
+func fakeSMTP(t *testing.T) (port int, session func() smtpSession) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var (
+		mu  sync.Mutex
+		got smtpSession
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 fake ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch verb {
+			case "EHLO", "HELO":
+				reply("250-fake")
+				reply("250 8BITMIME")
+			case "MAIL":
+				mu.Lock()
+				got.from = angleAddr(line)
+				mu.Unlock()
+				reply("250 OK")
+			case "RCPT":
+				mu.Lock()
+				got.rcpt = append(got.rcpt, angleAddr(line))
+				mu.Unlock()
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				mu.Lock()
+				got.data = data.String()
+				mu.Unlock()
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 unsupported")
+			}
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr).Port, func() smtpSession {
+		<-done
+		mu.Lock()
+		defer mu.Unlock()
+		return got
+	}
+}
+
+// angleAddr returns the <address> of a MAIL or RCPT command
+func angleAddr(line string) string {
+	start, end := strings.IndexByte(line, '<'), strings.IndexByte(line, '>')
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func TestEmailActionSends(t *testing.T) {
+	port, session := fakeSMTP(t)
+	mock := mockDB(t)
+	resetSMTPServers := func() {
+		smtpServersMu.Lock()
+		smtpServers = map[string]cachedSMTPServer{}
+		smtpServersMu.Unlock()
+	}
+	resetSMTPServers()
+	t.Cleanup(resetSMTPServers)
+
+	mock.ExpectQuery("FROM rule_smtp_servers").WithArgs("ops_mail").
+		WillReturnRows(sqlmock.NewRows([]string{"smtp_id", "smtp_name", "host", "port", "username", "password", "from_address", "tls_mode"}).
+			AddRow(1, "ops_mail", "127.0.0.1", strconv.Itoa(port), nil, nil, "Rules <rules@example.com>", "none"))
+
+	actionConfig := `{"smtp": "ops_mail", "to": ["{{.owner}}"], "bcc": ["audit@example.com"],
+		"subject": "Order {{.order_id}} flagged", "body": "Order {{.order_id}} needs review"}`
+	m := &ActionMessage{
+		Payload: &WebhookPayload{Data: map[string]interface{}{"owner": "ada@example.com", "order_id": "7"}},
+		Config:  &ActionConfig{Name: "flagged", Type: "email", Config: json.RawMessage(actionConfig)},
+	}
+	detail, err := emailAction{}.Execute(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail != "emailed 2 recipient(s) via ops_mail" {
+		t.Fatalf("detail = %q", detail)
+	}
+
+	got := session()
+	if got.from != "rules@example.com" {
+		t.Errorf("MAIL FROM = %q", got.from)
+	}
+	if strings.Join(got.rcpt, ",") != "ada@example.com,audit@example.com" {
+		t.Errorf("RCPT TO = %v", got.rcpt)
+	}
+	if strings.Contains(got.data, "audit@example.com") {
+		t.Error("bcc recipient appears in the message")
+	}
+	if !strings.Contains(got.data, "Subject: Order 7 flagged\r\n") || !strings.Contains(got.data, "Order 7 needs review") {
+		t.Errorf("message = %q", got.data)
+	}
+}
+
+func TestEmailActionConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "no server", config: `{"to": ["a@example.com"]}`, wantErr: "action flagged has no smtp server"},
+		{name: "invalid config", config: `{"to": "a@example.com"}`, wantErr: "invalid config"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &ActionMessage{
+				Payload: &WebhookPayload{},
+				Config:  &ActionConfig{Name: "flagged", Type: "email", Config: json.RawMessage(tt.config)},
+			}
+			_, err := emailAction{}.Execute(context.Background(), m)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// exactlyOncePruneInterval is how often the leader deletes ledger rows
+// older than EXACTLY_ONCE_RETENTION_HOURS
+const exactlyOncePruneInterval = time.Hour
+
+// errDeliveryInFlight delays a message whose delivery another attempt has
+// claimed and may still be sending
+var errDeliveryInFlight = errors.New("delivery claimed by another attempt")
+
+// exactlyOncePatterns is EXACTLY_ONCE_SUBJECTS, tokenized on startup
+var exactlyOncePatterns [][]string
+
+// initExactlyOnce enables the delivery ledger for EXACTLY_ONCE_SUBJECTS
+func initExactlyOnce() {
+	for _, pattern := range splitList(config.Worker.ExactlyOnceSubjects) {
+		exactlyOncePatterns = append(exactlyOncePatterns, strings.Split(pattern, "."))
+	}
+	if len(exactlyOncePatterns) == 0 {
+		return
+	}
+	registerSingleton("exactly_once_prune", exactlyOncePruneInterval, pruneExactlyOnce)
+	log.Printf("🎯 Exactly-once delivery for %s", config.Worker.ExactlyOnceSubjects)
+}
+
+// exactlyOnce reports whether deliveries on subject go through the ledger
+func exactlyOnce(subject string) bool {
+	if len(exactlyOncePatterns) == 0 {
+		return false
+	}
+	tokens := strings.Split(subject, ".")
+	for _, pattern := range exactlyOncePatterns {
+		if natsSubjectMatches(pattern, tokens) {
+			return true
+		}
+	}
+	return false
+}
+
+// exactlyOnceLease is how long a claim keeps other attempts from sending:
+// longer than any attempt may run, so a live attempt is never overtaken
+func exactlyOnceLease() time.Duration {
+	run := time.Duration(config.Worker.HandlerTimeoutSeconds) * time.Second
+	if run < 30*time.Second {
+		run = 30 * time.Second // the consumer's AckWait
+	}
+	return run + 30*time.Second
+}
+
+// deliveryKey identifies one delivery across redeliveries and replicas:
+// the destination plus the message's event_key, its Nats-Msg-Id, or its
+// stream sequence, in that order
+func deliveryKey(m *ActionMessage) string {
+	if m.Payload.EventKey != "" {
+		return m.dedupKey + "|key:" + m.Payload.EventKey
+	}
+	if id := m.Msg.Header.Get(nats.MsgIdHdr); id != "" {
+		return m.dedupKey + "|msg:" + id
+	}
+	if meta, err := m.Msg.Metadata(); err == nil {
+		return m.dedupKey + "|seq:" + meta.Stream + ":" + strconv.FormatUint(meta.Sequence.Stream, 10)
+	}
+	return ""
+}
+
+// idempotencyKey is the Idempotency-Key header for a delivery, the same on
+// every attempt so the receiver can drop a request it already handled
+func idempotencyKey(deliveryKey string) string {
+	sum := sha256.Sum256([]byte(deliveryKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// claimDelivery takes the ledger row for m's delivery. It returns
+// delivered when an earlier attempt already completed it, and
+// errDeliveryInFlight (as a RetryAfter) while another attempt holds it.
+// Without a ledger row nothing is sent: database errors are retried.
+func claimDelivery(ctx context.Context, m *ActionMessage) (delivered bool, err error) {
+	key := deliveryKey(m)
+	if key == "" {
+		return false, worker.Permanent(fmt.Errorf("exactly-once delivery needs an event_key, Nats-Msg-Id, or JetStream message"))
+	}
+	lease := exactlyOnceLease()
+	var claimedUntil sql.NullTime
+	var deliveredAt sql.NullTime
+	err = withDBRetry(ctx, primaryHealth, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		res, err := tx.ExecContext(ctx,
+			`INSERT INTO rule_nats_exactly_once (delivery_key, destination, claimed_by, claimed_until, trace_id)
+			 VALUES ($1, $2, $3, CURRENT_TIMESTAMP + make_interval(secs => $4), $5)
+			 ON CONFLICT (delivery_key) DO UPDATE
+			     SET claimed_by = EXCLUDED.claimed_by, claimed_until = EXCLUDED.claimed_until, trace_id = EXCLUDED.trace_id,
+			         attempts = rule_nats_exactly_once.attempts + 1
+			     WHERE rule_nats_exactly_once.delivered_at IS NULL
+			       AND (rule_nats_exactly_once.claimed_until IS NULL
+			            OR rule_nats_exactly_once.claimed_until < CURRENT_TIMESTAMP)`,
+			key, m.dedupKey, workerID(), lease.Seconds(), m.traceID,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			if err := tx.QueryRowContext(ctx,
+				`SELECT delivered_at, claimed_until FROM rule_nats_exactly_once WHERE delivery_key = $1`, key,
+			).Scan(&deliveredAt, &claimedUntil); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	switch {
+	case err != nil:
+		return false, fmt.Errorf("failed to claim exactly-once delivery: %w", err)
+	case deliveredAt.Valid:
+		return true, nil
+	case claimedUntil.Valid:
+		return false, worker.RetryAfter(errDeliveryInFlight, time.Until(claimedUntil.Time)+time.Second)
+	}
+	m.deliveryKey = key
+	return false, nil
+}
+
+// confirmDelivery marks m's delivery done before the message is acked. A
+// redelivery after a lost ack then finds it delivered.
+func confirmDelivery(ctx context.Context, m *ActionMessage) {
+	err := withDBRetry(ctx, primaryHealth, func() error {
+		res, err := db.ExecContext(ctx,
+			`UPDATE rule_nats_exactly_once SET delivered_at = CURRENT_TIMESTAMP, claimed_until = NULL
+			 WHERE delivery_key = $1 AND claimed_by = $2 AND delivered_at IS NULL`,
+			m.deliveryKey, workerID(),
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			log.Printf("⚠️  [%d %s] Exactly-once claim expired while delivering; another attempt may have sent it too", m.num, m.traceID)
+		}
+		return nil
+	})
+	if err != nil {
+		// Acked anyway: the request was sent, and only a lost ack would
+		// bring the message back
+		log.Printf("⚠️  [%d %s] Failed to record exactly-once delivery: %v", m.num, m.traceID, err)
+	}
+}
+
+// releaseDelivery gives up m's claim after a failed attempt, so the retry
+// can claim it straight away
+func releaseDelivery(ctx context.Context, m *ActionMessage) {
+	if err := withDBRetry(ctx, primaryHealth, func() error {
+		_, err := db.ExecContext(ctx,
+			`UPDATE rule_nats_exactly_once SET claimed_until = NULL
+			 WHERE delivery_key = $1 AND claimed_by = $2 AND delivered_at IS NULL`,
+			m.deliveryKey, workerID(),
+		)
+		return err
+	}); err != nil {
+		log.Printf("⚠️  [%d %s] Failed to release exactly-once claim, the retry waits for it to expire: %v", m.num, m.traceID, err)
+	}
+}
+
+// pruneExactlyOnce deletes ledger rows past EXACTLY_ONCE_RETENTION_HOURS.
+// It runs on the leader only.
+func pruneExactlyOnce(ctx context.Context) error {
+	result, err := db.ExecContext(ctx,
+		`DELETE FROM rule_nats_exactly_once
+		 WHERE created_at < CURRENT_TIMESTAMP - make_interval(hours => $1)`,
+		config.Worker.ExactlyOnceRetentionHours,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to prune exactly-once ledger: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("🧹 Pruned %d exactly-once ledger row(s)", n)
+	}
+	return nil
+}
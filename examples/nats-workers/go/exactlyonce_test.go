@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// useExactlyOnce sets EXACTLY_ONCE_SUBJECTS for one test
+func useExactlyOnce(t testing.TB, patterns ...string) {
+	t.Helper()
+	prev := exactlyOncePatterns
+	exactlyOncePatterns = nil
+	for _, p := range patterns {
+		exactlyOncePatterns = append(exactlyOncePatterns, strings.Split(p, "."))
+	}
+	t.Cleanup(func() { exactlyOncePatterns = prev })
+}
+
+func TestExactlyOnceSubjects(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		subject  string
+		want     bool
+	}{
+		{nil, "webhooks.orders", false},
+		{[]string{"webhooks.orders"}, "webhooks.orders", true},
+		{[]string{"webhooks.orders"}, "webhooks.refunds", false},
+		{[]string{"payments.>", "webhooks.*"}, "payments.eu.card", true},
+		{[]string{"payments.>", "webhooks.*"}, "webhooks.orders", true},
+		{[]string{"payments.>", "webhooks.*"}, "webhooks.orders.eu", false},
+	}
+	for _, tt := range tests {
+		useExactlyOnce(t, tt.patterns...)
+		if got := exactlyOnce(tt.subject); got != tt.want {
+			t.Errorf("exactlyOnce(%s) with %v = %v", tt.subject, tt.patterns, got)
+		}
+	}
+}
+
+func TestExactlyOnceLease(t *testing.T) {
+	prev := config.Worker.HandlerTimeoutSeconds
+	defer func() { config.Worker.HandlerTimeoutSeconds = prev }()
+	for timeout, want := range map[int]time.Duration{0: time.Minute, 10: time.Minute, 30: time.Minute, 120: 150 * time.Second} {
+		config.Worker.HandlerTimeoutSeconds = timeout
+		if got := exactlyOnceLease(); got != want {
+			t.Errorf("HANDLER_TIMEOUT_SECONDS=%d: lease = %s, want %s", timeout, got, want)
+		}
+	}
+}
+
+func TestDeliveryKey(t *testing.T) {
+	jsMsg := func(header nats.Header) *nats.Msg {
+		// Metadata needs a bound message
+		return &nats.Msg{Sub: &nats.Subscription{}, Reply: "$JS.ACK.RULES.webhooks.1.42.7.1700000000000000000.0", Header: header}
+	}
+	tests := []struct {
+		name     string
+		eventKey string
+		msg      *nats.Msg
+		want     string
+	}{
+		{name: "event key", eventKey: "order-1", msg: jsMsg(nats.Header{nats.MsgIdHdr: {"m1"}}), want: "wh:3|key:order-1"},
+		{name: "message id", msg: jsMsg(nats.Header{nats.MsgIdHdr: {"m1"}}), want: "wh:3|msg:m1"},
+		{name: "stream sequence", msg: jsMsg(nats.Header{}), want: "wh:3|seq:RULES:42"},
+		{name: "core NATS message without ids", msg: &nats.Msg{Header: nats.Header{}}, want: ""},
+	}
+	for _, tt := range tests {
+		m := &ActionMessage{Msg: tt.msg, Payload: &WebhookPayload{EventKey: tt.eventKey}, dedupKey: "wh:3"}
+		if got := deliveryKey(m); got != tt.want {
+			t.Errorf("%s: deliveryKey = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	a, b := idempotencyKey("wh:3|key:order-1"), idempotencyKey("wh:3|key:order-2")
+	if len(a) != 64 || a == b || a != idempotencyKey("wh:3|key:order-1") {
+		t.Fatalf("idempotency keys %q, %q", a, b)
+	}
+}
+
+func TestClaimDelivery(t *testing.T) {
+	const claim = `INSERT INTO rule_nats_exactly_once`
+	const lookup = `SELECT delivered_at, claimed_until FROM rule_nats_exactly_once WHERE delivery_key = \$1`
+	tests := []struct {
+		name          string
+		eventKey      string
+		expect        func(mock sqlmock.Sqlmock)
+		wantDelivered bool
+		wantErr       string
+		wantInFlight  bool
+		wantPermanent bool
+	}{
+		{name: "claimed", eventKey: "o1",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(claim).WithArgs("wh:3|key:o1", "wh:3", workerID(), 90.0, "t1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}},
+		{name: "already delivered", eventKey: "o1",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(claim).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(lookup).WithArgs("wh:3|key:o1").
+					WillReturnRows(sqlmock.NewRows([]string{"delivered_at", "claimed_until"}).AddRow(time.Now(), nil))
+				mock.ExpectCommit()
+			},
+			wantDelivered: true},
+		{name: "claimed by a live attempt", eventKey: "o1",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(claim).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(lookup).
+					WillReturnRows(sqlmock.NewRows([]string{"delivered_at", "claimed_until"}).AddRow(nil, time.Now().Add(20*time.Second)))
+				mock.ExpectCommit()
+			},
+			wantErr: "delivery claimed by another attempt (retry after ", wantInFlight: true},
+		{name: "database error", eventKey: "o1",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(claim).WillReturnError(errors.New("permission denied"))
+				mock.ExpectRollback()
+			},
+			wantErr: "failed to claim exactly-once delivery: permission denied"},
+		{name: "no delivery key", expect: func(sqlmock.Sqlmock) {},
+			wantErr: "exactly-once delivery needs an event_key, Nats-Msg-Id, or JetStream message", wantPermanent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			prev := config.Worker.HandlerTimeoutSeconds
+			config.Worker.HandlerTimeoutSeconds = 60
+			defer func() { config.Worker.HandlerTimeoutSeconds = prev }()
+			tt.expect(mock)
+
+			m := &ActionMessage{Msg: &nats.Msg{Header: nats.Header{}}, Payload: &WebhookPayload{EventKey: tt.eventKey},
+				dedupKey: "wh:3", traceID: "t1"}
+			delivered, err := claimDelivery(context.Background(), m)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) || errors.Is(err, errDeliveryInFlight) != tt.wantInFlight ||
+					worker.IsPermanent(err) != tt.wantPermanent {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				if m.deliveryKey != "" {
+					t.Fatal("claim held after an error")
+				}
+				return
+			}
+			if err != nil || delivered != tt.wantDelivered {
+				t.Fatalf("= %v, %v, want %v", delivered, err, tt.wantDelivered)
+			}
+			// Only a claim taken by this attempt is settled later
+			if held := m.deliveryKey != ""; held == delivered {
+				t.Fatalf("deliveryKey = %q", m.deliveryKey)
+			}
+		})
+	}
+}
+
+func TestSettleDeliveryClaim(t *testing.T) {
+	m := &ActionMessage{deliveryKey: "wh:3|key:o1", traceID: "t1"}
+	tests := []struct {
+		name   string
+		settle func(context.Context, *ActionMessage)
+		query  string
+		rows   int64
+		result error
+	}{
+		{name: "confirm", settle: confirmDelivery, query: `SET delivered_at = CURRENT_TIMESTAMP, claimed_until = NULL`, rows: 1},
+		{name: "confirm after the claim expired", settle: confirmDelivery, query: `SET delivered_at = CURRENT_TIMESTAMP`},
+		{name: "confirm failure is only logged", settle: confirmDelivery, query: `SET delivered_at`, result: errors.New("boom")},
+		{name: "release", settle: releaseDelivery, query: `SET claimed_until = NULL\s+WHERE delivery_key = \$1 AND claimed_by = \$2 AND delivered_at IS NULL`, rows: 1},
+		{name: "release failure is only logged", settle: releaseDelivery, query: `SET claimed_until = NULL`, result: errors.New("boom")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			exec := mock.ExpectExec(tt.query).WithArgs("wh:3|key:o1", workerID())
+			if tt.result != nil {
+				exec.WillReturnError(tt.result)
+			} else {
+				exec.WillReturnResult(sqlmock.NewResult(0, tt.rows))
+			}
+			tt.settle(context.Background(), m)
+		})
+	}
+}
+
+func TestPruneExactlyOnce(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectExec(`DELETE FROM rule_nats_exactly_once`).WithArgs(config.Worker.ExactlyOnceRetentionHours).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`DELETE FROM rule_nats_exactly_once`).WillReturnError(errors.New("boom"))
+	if err := pruneExactlyOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := pruneExactlyOnce(context.Background()); err == nil || err.Error() != "failed to prune exactly-once ledger: boom" {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestWebhookIdempotencyKey(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Idempotency-Key"))
+	}))
+	defer srv.Close()
+
+	for _, key := range []string{"wh:3|key:o1", ""} {
+		m := &ActionMessage{Msg: &nats.Msg{Header: nats.Header{}}, deliveryKey: key,
+			Payload: &WebhookPayload{WebhookURL: srv.URL, Data: map[string]interface{}{"id": 1}}}
+		if _, err := (webhookAction{}).Execute(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 || got[0] != idempotencyKey("wh:3|key:o1") || got[1] != "" {
+		t.Fatalf("Idempotency-Key headers = %q", got)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine/envelope"
+)
+
+// payloadSealer encrypts payloads the worker stores, when
+// PAYLOAD_ENCRYPTION is set; nil stores them in plain text
+var payloadSealer *envelope.Sealer
+
+// messageDeadline returns the moment after which the message must not be
+// delivered. An explicit expires_at wins over ttl; ttl is counted from the
+// JetStream publish timestamp. ok is false when the payload has no TTL.
+func messageDeadline(msg *nats.Msg, payload *WebhookPayload) (deadline time.Time, ok bool) {
+	if payload.ExpiresAt != nil {
+		return *payload.ExpiresAt, true
+	}
+	if payload.TTL <= 0 {
+		return time.Time{}, false
+	}
+
+	// A deferred copy keeps the first publish time (see deferDelivery)
+	publishedAt := time.Now()
+	if t, err := time.Parse(time.RFC3339Nano, msg.Header.Get(publishedAtHeader)); err == nil {
+		publishedAt = t
+	} else if meta, err := msg.Metadata(); err == nil {
+		publishedAt = meta.Timestamp
+	}
+	return publishedAt.Add(time.Duration(payload.TTL) * time.Second), true
+}
+
+// recordExpired stores a skipped message so operators can see what was
+// dropped after an outage.
+func recordExpired(ctx context.Context, msg *nats.Msg, payload *WebhookPayload, deadline time.Time, traceID string) {
+	if !auditSampled(traceID, true) {
+		return
+	}
+	var sequence *uint64
+	var publishedAt *time.Time
+	if meta, err := msg.Metadata(); err == nil {
+		sequence = &meta.Sequence.Stream
+		publishedAt = &meta.Timestamp
+	}
+
+	stored, err := storedPayload(ctx, "rule_nats_expired_messages", msg.Data)
+	if err != nil {
+		log.Printf("⚠️  Failed to prepare expired message for storage, not recording it: %v", err)
+		return
+	}
+	var payloadColumn interface{}
+	if stored != nil {
+		payloadColumn = string(stored)
+	}
+
+	err = auditInsert("rule_nats_expired_messages",
+		[]string{"stream_name", "consumer_name", "subject", "stream_sequence", "webhook_url", "published_at", "expires_at", "payload", "trace_id"},
+		config.Worker.StreamName,
+		config.Worker.ConsumerName,
+		msg.Subject,
+		sequence,
+		payload.WebhookURL,
+		publishedAt,
+		deadline,
+		payloadColumn,
+		traceID,
+	)
+	if err != nil && !errors.Is(err, errOpsBuffered) {
+		log.Printf("⚠️  Failed to record expired message: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+)
+
+func TestMessageDeadline(t *testing.T) {
+	published := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	explicit := published.Add(time.Hour)
+
+	tests := []struct {
+		name      string
+		header    string
+		payload   WebhookPayload
+		want      time.Time
+		wantOK    bool
+		fromNowOK bool
+	}{
+		{name: "no ttl", payload: WebhookPayload{}},
+		{name: "negative ttl", payload: WebhookPayload{TTL: -5}},
+		{name: "expires_at", payload: WebhookPayload{ExpiresAt: &explicit}, want: explicit, wantOK: true},
+		{name: "expires_at wins over ttl", header: published.Format(time.RFC3339Nano),
+			payload: WebhookPayload{ExpiresAt: &explicit, TTL: 60}, want: explicit, wantOK: true},
+		{name: "ttl from first publish", header: published.Format(time.RFC3339Nano),
+			payload: WebhookPayload{TTL: 90}, want: published.Add(90 * time.Second), wantOK: true},
+		{name: "ttl without publish time", header: "not a time",
+			payload: WebhookPayload{TTL: 30}, wantOK: true, fromNowOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := nats.NewMsg("webhooks.test")
+			if tt.header != "" {
+				msg.Header.Set(publishedAtHeader, tt.header)
+			}
+			before := time.Now()
+			got, ok := messageDeadline(msg, &tt.payload)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if tt.fromNowOK {
+				// Counted from now when the message has no publish time
+				ttl := time.Duration(tt.payload.TTL) * time.Second
+				if got.Before(before.Add(ttl)) || got.After(time.Now().Add(ttl)) {
+					t.Fatalf("deadline = %v, want about %v from now", got, ttl)
+				}
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Fatalf("deadline = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordExpiredPayload(t *testing.T) {
+	setScrubRules(t, map[string]string{})
+	prevAudit, prevWorker := config.Audit, config.Worker
+	t.Cleanup(func() { config.Audit, config.Worker = prevAudit, prevWorker })
+	config.Audit.FailureSamplePercent = 100
+	config.Worker.StreamName, config.Worker.ConsumerName = "RULES", "webhooks"
+	deadline := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		serializer string
+		keep       string
+		want       interface{} // the payload column; nil when no row is written
+		written    bool
+	}{
+		{serializer: "full", want: `{"id":7,"note":"gift"}`, written: true},
+		{serializer: "compact", keep: "id", want: `{"id":7}`, written: true},
+		{serializer: "none", want: nil, written: true},
+		{serializer: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serializer, func(t *testing.T) {
+			useStoredPayload(t, tt.serializer, tt.keep, 0)
+			ops := mockOpsDB(t)
+			if tt.written {
+				ops.ExpectExec(`INSERT INTO rule_nats_expired_messages`).
+					WithArgs("RULES", "webhooks", "webhooks.orders", nil, "https://crm.example.com", nil, deadline, tt.want, "trace-7").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			msg := &nats.Msg{Subject: "webhooks.orders", Data: []byte(`{"id":7,"note":"gift"}`)}
+			recordExpired(context.Background(), msg, &WebhookPayload{WebhookURL: "https://crm.example.com"}, deadline, "trace-7")
+		})
+	}
+}
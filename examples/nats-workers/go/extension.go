@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+var (
+	// extensionVersion is the rule engine extension installed in the
+	// primary, recorded with the worker's registration
+	extensionVersion string
+	// extensionCompatible is false when EXTENSION_CHECK=warn let the worker
+	// start against an extension it does not support; consumer statistics
+	// are then not reported, as the extension's functions may differ
+	extensionCompatible = true
+)
+
+func init() {
+	expvar.Publish("extension", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"version":    extensionVersion,
+			"compatible": extensionCompatible,
+			"supported":  fmt.Sprintf("%s up to %d.x", ruleengine.MinExtensionVersion, ruleengine.MaxExtensionMajor),
+		}
+	}))
+}
+
+// checkExtension reads the installed extension's version and, with
+// EXTENSION_CHECK=strict, refuses to start on one the worker does not
+// support. With warn the worker starts without reporting consumer
+// statistics; with off the version is only recorded.
+func checkExtension() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	version, err := ruleengine.New(db).CheckExtension(ctx)
+	extensionVersion = version
+	var versionErr *ruleengine.ExtensionVersionError
+	switch {
+	case err == nil:
+		log.Printf("✅ Rule engine extension %s", version)
+		return nil
+	case config.Postgres.ExtensionCheck == "off":
+		return nil
+	case errors.Is(err, ruleengine.ErrExtensionNotInstalled), errors.As(err, &versionErr):
+		if config.Postgres.ExtensionCheck == "strict" {
+			return fmt.Errorf("%w (EXTENSION_CHECK=warn starts anyway)", err)
+		}
+		extensionCompatible = false
+		log.Printf("⚠️  %v; consumer statistics will not be reported", err)
+		return nil
+	default:
+		return fmt.Errorf("failed to read the extension version: %w", err)
+	}
+}
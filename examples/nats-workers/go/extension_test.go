@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// useExtension sets the extension found at startup for one test
+func useExtension(t *testing.T, version string, compatible bool) {
+	t.Helper()
+	prevVersion, prevCompatible := extensionVersion, extensionCompatible
+	extensionVersion, extensionCompatible = version, compatible
+	t.Cleanup(func() { extensionVersion, extensionCompatible = prevVersion, prevCompatible })
+}
+
+func TestCheckExtension(t *testing.T) {
+	const query = `SELECT extversion FROM pg_extension`
+	version := func(v string) *sqlmock.Rows { return sqlmock.NewRows([]string{"extversion"}).AddRow(v) }
+	tests := []struct {
+		name           string
+		check          string
+		rows           *sqlmock.Rows
+		err            error
+		wantVersion    string
+		wantCompatible bool
+		wantErr        string
+	}{
+		{name: "supported", check: "strict", rows: version("1.8.2"), wantVersion: "1.8.2", wantCompatible: true},
+		{name: "strict refuses an old version", check: "strict", rows: version("1.7.0"), wantVersion: "1.7.0", wantCompatible: true,
+			wantErr: "extension rule_engine_postgre_extensions 1.7.0 is not supported (want 1.8.0 up to 2.x) (EXTENSION_CHECK=warn starts anyway)"},
+		{name: "strict refuses a missing extension", check: "strict", rows: sqlmock.NewRows([]string{"extversion"}), wantCompatible: true,
+			wantErr: "extension rule_engine_postgre_extensions is not installed"},
+		{name: "warn starts without statistics", check: "warn", rows: version("3.1.0"), wantVersion: "3.1.0"},
+		{name: "warn on a missing extension", check: "warn", rows: sqlmock.NewRows([]string{"extversion"})},
+		{name: "off only records", check: "off", rows: version("3.1.0"), wantVersion: "3.1.0", wantCompatible: true},
+		{name: "off ignores a missing extension", check: "off", rows: sqlmock.NewRows([]string{"extversion"}), wantCompatible: true},
+		{name: "database error", check: "warn", err: errors.New("connection refused"), wantCompatible: true,
+			wantErr: "failed to read the extension version: connection refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			useExtension(t, "", true)
+			prev := config.Postgres.ExtensionCheck
+			t.Cleanup(func() { config.Postgres.ExtensionCheck = prev })
+			config.Postgres.ExtensionCheck = tt.check
+
+			q := mock.ExpectQuery(query)
+			if tt.err != nil {
+				q.WillReturnError(tt.err)
+			} else {
+				q.WillReturnRows(tt.rows)
+			}
+			err := checkExtension()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if extensionVersion != tt.wantVersion || extensionCompatible != tt.wantCompatible {
+				t.Fatalf("version = %q, compatible = %v", extensionVersion, extensionCompatible)
+			}
+		})
+	}
+}
+
+func TestReportStatisticsUnsupportedExtension(t *testing.T) {
+	mockOpsDB(t) // no expectations: consumer statistics are not written
+	useExtension(t, "3.1.0", false)
+	resetActionMetrics(t)
+	reportStatistics()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// failureAlertInterval is how often the leader looks for destinations that
+// keep failing; rule_delivery_stats is flushed once a minute
+const failureAlertInterval = time.Minute
+
+// initFailureAlerts registers the task that tells destination owners about
+// persistent failures (FAILURE_ALERT_MINUTES)
+func initFailureAlerts() {
+	if config.FailureAlerts.Minutes <= 0 {
+		return
+	}
+	registerSingleton("failure_alerts", failureAlertInterval, checkFailingDestinations)
+	if !natsSubjectMatches(strings.Split(config.Worker.Subject, "."), strings.Split(config.FailureAlerts.Subject, ".")) {
+		log.Printf("⚠️  FAILURE_ALERT_SUBJECT %s is not a SUBJECT this worker consumes; alerts are published but not sent", config.FailureAlerts.Subject)
+	}
+}
+
+// failureOwner is who hears about a destination's failures, from the
+// owner and failure_alert_action columns of rule_webhooks or rule_actions
+type failureOwner struct {
+	name   string
+	owner  string
+	action string
+}
+
+// lookupFailureOwner finds the owner of a statistics destination
+// (webhook:<id>, action:<name>, or url:<host>). Destinations without their
+// own action use FAILURE_ALERT_ACTION.
+func lookupFailureOwner(ctx context.Context, destination string) (failureOwner, error) {
+	o := failureOwner{name: destination}
+	var err error
+	switch kind, id, _ := strings.Cut(destination, ":"); kind {
+	case "webhook":
+		webhookID, convErr := strconv.Atoi(id)
+		if convErr != nil {
+			break
+		}
+		err = lookupQueryRow(ctx,
+			`SELECT webhook_name, COALESCE(owner, ''), COALESCE(failure_alert_action, '') FROM rule_webhooks WHERE webhook_id = $1`, webhookID,
+		).Scan(&o.name, &o.owner, &o.action)
+	case "action":
+		err = lookupQueryRow(ctx,
+			`SELECT action_name, COALESCE(owner, ''), COALESCE(failure_alert_action, '') FROM rule_actions WHERE action_name = $1`, id,
+		).Scan(&o.name, &o.owner, &o.action)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return o, err
+	}
+	if o.action == "" {
+		o.action = config.FailureAlerts.Action
+	}
+	return o, nil
+}
+
+// checkFailingDestinations alerts the owners of destinations with failures
+// and no successful delivery for FAILURE_ALERT_MINUTES, and tells them again
+// once deliveries succeed. rule_failure_alerts holds the open alerts, so a
+// new leader does not repeat them. It runs on the leader only.
+func checkFailingDestinations(ctx context.Context) error {
+	rows, err := opsDB.QueryContext(ctx,
+		`SELECT destination, MIN(bucket_start) FILTER (WHERE failed > 0), SUM(failed)
+		 FROM rule_delivery_stats
+		 WHERE bucket_start >= date_trunc('minute', CURRENT_TIMESTAMP) - make_interval(mins => $1)
+		 GROUP BY destination
+		 HAVING SUM(delivered) = 0 AND SUM(failed) > 0
+		    AND MIN(bucket_start) FILTER (WHERE failed > 0)
+		        <= date_trunc('minute', CURRENT_TIMESTAMP) - make_interval(mins => $1 - 1)`,
+		config.FailureAlerts.Minutes,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to find failing destinations: %w", err)
+	}
+	type failing struct {
+		destination string
+		since       time.Time
+		failures    int64
+	}
+	var found []failing
+	for rows.Next() {
+		var f failing
+		if err := rows.Scan(&f.destination, &f.since, &f.failures); err != nil {
+			rows.Close()
+			return err
+		}
+		found = append(found, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var alertErr error
+	for _, f := range found {
+		if err := openFailureAlert(ctx, f.destination, f.since, f.failures); err != nil && alertErr == nil {
+			alertErr = err
+		}
+	}
+	if err := closeFailureAlerts(ctx); err != nil && alertErr == nil {
+		alertErr = err
+	}
+	return alertErr
+}
+
+// openFailureAlert records and sends the alert for a failing destination,
+// unless one is already open
+func openFailureAlert(ctx context.Context, destination string, since time.Time, failures int64) error {
+	o, err := lookupFailureOwner(ctx, destination)
+	if err != nil {
+		return err
+	}
+	res, err := opsDB.ExecContext(ctx,
+		`INSERT INTO rule_failure_alerts (destination, failing_since, failures, action_name)
+		 VALUES ($1, $2, $3, NULLIF($4, ''))
+		 ON CONFLICT (destination) DO NOTHING`,
+		destination, since, failures, o.action,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	minutes := int(time.Since(since).Minutes())
+	log.Printf("🚨 %s has failed every delivery for %d minutes (%d failures)", o.name, minutes, failures)
+	// An alert action that is itself failing cannot report that
+	if o.action == "" || destination == "action:"+o.action {
+		return nil
+	}
+	data := failureAlertData(destination, o, "failing", since)
+	data["failures"] = failures
+	data["summary"] = fmt.Sprintf("%s has failed every delivery for %d minutes (%d failures)", o.name, minutes, failures)
+	if err := publishFailureAlert(ctx, o.action, data, fmt.Sprintf("failure-alert:%s:%d", destination, since.Unix())); err != nil {
+		// Forget the alert so the next check sends it
+		opsDB.ExecContext(ctx, `DELETE FROM rule_failure_alerts WHERE destination = $1`, destination)
+		return fmt.Errorf("failed to alert the owner of %s: %w", o.name, err)
+	}
+	return nil
+}
+
+// closeFailureAlerts ends the alerts for destinations that have delivered
+// since, telling their owners
+func closeFailureAlerts(ctx context.Context) error {
+	rows, err := opsDB.QueryContext(ctx,
+		`DELETE FROM rule_failure_alerts a
+		 WHERE EXISTS (
+		     SELECT 1 FROM rule_delivery_stats s
+		     WHERE s.destination = a.destination AND s.delivered > 0
+		       AND s.bucket_start >= date_trunc('minute', a.notified_at)
+		 )
+		 RETURNING destination, failing_since, COALESCE(action_name, '')`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to close failure alerts: %w", err)
+	}
+	defer rows.Close()
+	var publishErr error
+	for rows.Next() {
+		var destination, action string
+		var since time.Time
+		if err := rows.Scan(&destination, &since, &action); err != nil {
+			return err
+		}
+		o, err := lookupFailureOwner(ctx, destination)
+		if err != nil {
+			o = failureOwner{name: destination}
+		}
+		log.Printf("✅ %s is delivering again after failing since %s", o.name, since.Format(time.RFC3339))
+		if action == "" || destination == "action:"+action {
+			continue
+		}
+		data := failureAlertData(destination, o, "recovered", since)
+		data["summary"] = fmt.Sprintf("%s is delivering again after %d minutes of failures", o.name, int(time.Since(since).Minutes()))
+		if err := publishFailureAlert(ctx, action, data, fmt.Sprintf("failure-recovered:%s:%d", destination, since.Unix())); err != nil && publishErr == nil {
+			publishErr = fmt.Errorf("failed to tell the owner of %s it recovered: %w", o.name, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return publishErr
+}
+
+// failureAlertData is the data an alert action is run with
+func failureAlertData(destination string, o failureOwner, status string, since time.Time) map[string]interface{} {
+	data := map[string]interface{}{
+		"status":        status,
+		"destination":   destination,
+		"name":          o.name,
+		"owner":         o.owner,
+		"failing_since": since.UTC().Format(time.RFC3339),
+	}
+	recentMu.Lock()
+	if health := destinationStates[destination]; health != nil && health.LastError != "" {
+		data["last_error"] = health.LastError
+	}
+	recentMu.Unlock()
+	if link, err := renderText(config.FailureAlerts.Link, data); err == nil && link != "" {
+		data["dead_letters_url"] = link
+	}
+	return data
+}
+
+// publishFailureAlert runs action with data by publishing it to
+// FAILURE_ALERT_SUBJECT, so a failed notification is retried like any
+// other delivery
+func publishFailureAlert(ctx context.Context, action string, data map[string]interface{}, id string) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	out := nats.NewMsg(config.FailureAlerts.Subject)
+	out.Data = body
+	out.Header.Set(actionHeader, action)
+	out.Header.Set(nats.MsgIdHdr, id)
+	if _, err := jetStream.PublishMsg(out, nats.Context(ctx)); errors.Is(err, nats.ErrNoStreamResponse) {
+		return natsConn.PublishMsg(out)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+)
+
+// useFailureAlerts sets the FAILURE_ALERT_* settings for one test
+func useFailureAlerts(t *testing.T, action, link string) {
+	t.Helper()
+	prev := config.FailureAlerts
+	config.FailureAlerts.Minutes = 15
+	config.FailureAlerts.Action = action
+	config.FailureAlerts.Subject = "webhooks.failure_alerts"
+	config.FailureAlerts.Link = link
+	t.Cleanup(func() { config.FailureAlerts = prev })
+}
+
+var ownerColumns = []string{"name", "owner", "failure_alert_action"}
+
+func TestLookupFailureOwner(t *testing.T) {
+	useFailureAlerts(t, "ops_pager", "")
+	const webhookQuery = `FROM rule_webhooks WHERE webhook_id = \$1`
+	const actionQuery = `FROM rule_actions WHERE action_name = \$1`
+	tests := []struct {
+		destination string
+		expect      func(mock sqlmock.Sqlmock)
+		want        failureOwner
+		wantErr     bool
+	}{
+		{destination: "webhook:3",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(webhookQuery).WithArgs(3).
+					WillReturnRows(sqlmock.NewRows(ownerColumns).AddRow("crm_sync", "#crm", "crm_slack"))
+			},
+			want: failureOwner{name: "crm_sync", owner: "#crm", action: "crm_slack"}},
+		{destination: "webhook:4",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(webhookQuery).WithArgs(4).WillReturnRows(sqlmock.NewRows(ownerColumns).AddRow("erp", "", ""))
+			},
+			want: failureOwner{name: "erp", action: "ops_pager"}},
+		{destination: "webhook:5",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(webhookQuery).WithArgs(5).WillReturnRows(sqlmock.NewRows(ownerColumns))
+			},
+			want: failureOwner{name: "webhook:5", action: "ops_pager"}},
+		{destination: "action:notify",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(actionQuery).WithArgs("notify").
+					WillReturnRows(sqlmock.NewRows(ownerColumns).AddRow("notify", "ops@example.com", ""))
+			},
+			want: failureOwner{name: "notify", owner: "ops@example.com", action: "ops_pager"}},
+		{destination: "url:hooks.example.com", expect: func(sqlmock.Sqlmock) {},
+			want: failureOwner{name: "url:hooks.example.com", action: "ops_pager"}},
+		{destination: "webhook:abc", expect: func(sqlmock.Sqlmock) {},
+			want: failureOwner{name: "webhook:abc", action: "ops_pager"}},
+		{destination: "action:notify",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(actionQuery).WillReturnError(errors.New("permission denied"))
+			},
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.destination, func(t *testing.T) {
+			mock := mockDB(t)
+			tt.expect(mock)
+			got, err := lookupFailureOwner(context.Background(), tt.destination)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v", err)
+			}
+			if err == nil && got != tt.want {
+				t.Fatalf("owner = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckFailingDestinations(t *testing.T) {
+	useFailureAlerts(t, "ops_pager", "https://ops.example.com/ui/?destination={{.destination}}")
+	js := &fakeJetStream{}
+	useJetStream(t, js)
+	mock, ops := mockDB(t), mockOpsDB(t)
+	since := time.Now().Add(-20 * time.Minute).Truncate(time.Second)
+
+	ops.ExpectQuery(`FROM rule_delivery_stats`).WithArgs(15).
+		WillReturnRows(sqlmock.NewRows([]string{"destination", "since", "failures"}).
+			AddRow("webhook:3", since, 212).
+			AddRow("webhook:4", since, 9).
+			AddRow("action:ops_pager", since, 4))
+	mock.ExpectQuery(`FROM rule_webhooks`).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(ownerColumns).AddRow("crm_sync", "#crm", "crm_slack"))
+	mock.ExpectQuery(`FROM rule_webhooks`).WithArgs(4).
+		WillReturnRows(sqlmock.NewRows(ownerColumns).AddRow("erp", "", ""))
+	mock.ExpectQuery(`FROM rule_actions`).WithArgs("ops_pager").
+		WillReturnRows(sqlmock.NewRows(ownerColumns).AddRow("ops_pager", "", ""))
+
+	// webhook:3 is new, webhook:4 was already alerted, and the alert
+	// action's own failures are recorded but not sent through it
+	ops.ExpectExec(`INSERT INTO rule_failure_alerts`).WithArgs("webhook:3", since, int64(212), "crm_slack").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	ops.ExpectExec(`INSERT INTO rule_failure_alerts`).WithArgs("webhook:4", since, int64(9), "ops_pager").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	ops.ExpectExec(`INSERT INTO rule_failure_alerts`).WithArgs("action:ops_pager", since, int64(4), "ops_pager").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// webhook:7 delivered again
+	ops.ExpectQuery(`DELETE FROM rule_failure_alerts a`).
+		WillReturnRows(sqlmock.NewRows([]string{"destination", "failing_since", "action_name"}).AddRow("webhook:7", since, "ops_pager"))
+	mock.ExpectQuery(`FROM rule_webhooks`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(ownerColumns).AddRow("billing", "#billing", ""))
+
+	if err := checkFailingDestinations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(js.published) != 2 {
+		t.Fatalf("published %d alerts, want 2", len(js.published))
+	}
+	tests := []struct {
+		id     string
+		action string
+		want   map[string]interface{}
+	}{
+		{id: "failure-alert:webhook:3:" + strconv.FormatInt(since.Unix(), 10), action: "crm_slack",
+			want: map[string]interface{}{"status": "failing", "destination": "webhook:3", "name": "crm_sync", "owner": "#crm",
+				"failing_since": since.UTC().Format(time.RFC3339), "failures": 212.0,
+				"summary":          "crm_sync has failed every delivery for 20 minutes (212 failures)",
+				"dead_letters_url": "https://ops.example.com/ui/?destination=webhook:3"}},
+		{id: "failure-recovered:webhook:7:" + strconv.FormatInt(since.Unix(), 10), action: "ops_pager",
+			want: map[string]interface{}{"status": "recovered", "destination": "webhook:7", "name": "billing", "owner": "#billing",
+				"failing_since":    since.UTC().Format(time.RFC3339),
+				"summary":          "billing is delivering again after 20 minutes of failures",
+				"dead_letters_url": "https://ops.example.com/ui/?destination=webhook:7"}},
+	}
+	for i, tt := range tests {
+		msg := js.published[i]
+		if msg.Subject != "webhooks.failure_alerts" || msg.Header.Get(actionHeader) != tt.action || msg.Header.Get(nats.MsgIdHdr) != tt.id {
+			t.Errorf("alert %d: %s %v", i, msg.Subject, msg.Header)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(msg.Data, &got); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("alert %d = %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestOpenFailureAlertPublishFails(t *testing.T) {
+	useFailureAlerts(t, "ops_pager", "")
+	useJetStream(t, &fakeJetStream{err: errors.New("nats: timeout")})
+	mock, ops := mockDB(t), mockOpsDB(t)
+	since := time.Now().Add(-time.Hour)
+
+	mock.ExpectQuery(`FROM rule_webhooks`).WithArgs(3).WillReturnRows(sqlmock.NewRows(ownerColumns).AddRow("crm_sync", "", ""))
+	ops.ExpectExec(`INSERT INTO rule_failure_alerts`).WillReturnResult(sqlmock.NewResult(0, 1))
+	// The alert is forgotten so the next check sends it
+	ops.ExpectExec(`DELETE FROM rule_failure_alerts WHERE destination = \$1`).WithArgs("webhook:3").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := openFailureAlert(context.Background(), "webhook:3", since, 5)
+	if err == nil || err.Error() != "failed to alert the owner of crm_sync: nats: timeout" {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestFailureAlertData(t *testing.T) {
+	useFailureAlerts(t, "", "https://ops.example.com/dlq?d={{.destination}}&owner={{.owner}}")
+	recentMu.Lock()
+	prev := destinationStates
+	destinationStates = map[string]*destinationHealth{"webhook:3": {LastError: "HTTP 503"}}
+	recentMu.Unlock()
+	defer func() {
+		recentMu.Lock()
+		destinationStates = prev
+		recentMu.Unlock()
+	}()
+
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	got := failureAlertData("webhook:3", failureOwner{name: "crm_sync", owner: "crm"}, "failing", since)
+	want := map[string]interface{}{"status": "failing", "destination": "webhook:3", "name": "crm_sync", "owner": "crm",
+		"failing_since": "2024-01-02T02:04:05Z", "last_error": "HTTP 503",
+		"dead_letters_url": "https://ops.example.com/dlq?d=webhook:3&owner=crm"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("data = %v, want %v", got, want)
+	}
+
+	// No link template, no health
+	config.FailureAlerts.Link = ""
+	got = failureAlertData("webhook:9", failureOwner{name: "erp"}, "recovered", since)
+	if _, ok := got["dead_letters_url"]; ok || got["last_error"] != nil {
+		t.Fatalf("data = %v", got)
+	}
+}
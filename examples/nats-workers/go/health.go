@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// Health checks probe registered webhooks that have a health_check
+// (rule_webhooks column) every HEALTH_CHECK_INTERVAL_SECONDS, on the
+// leader:
+//
+//   - "tcp" connects to the host and port of the webhook URL
+//   - a path or URL, resolved against the webhook URL, is requested with
+//     HEAD, or GET if HEAD is refused; any 2xx or 3xx response is healthy.
+//     On the webhook's own host the request carries the webhook's headers,
+//     so endpoints behind the same auth as deliveries can be probed.
+//
+// A destination is down after HEALTH_CHECK_FAILURE_THRESHOLD failed probes
+// in a row, and up again after one success. Results are kept in
+// rule_webhook_health, which every worker reads back each interval. With
+// HEALTH_CHECK_OPEN_CIRCUIT, messages for a down destination are not sent
+// but deferred until the next probe (see deferDelivery).
+
+// probeConcurrency bounds how many destinations are probed at once
+const probeConcurrency = 8
+
+// Headers on messages deferDelivery puts back on the stream
+const (
+	deferredUntilHeader = "Rule-Deferred-Until"
+	publishedAtHeader   = "Rule-Published-At" // when the first copy was published, for TTLs
+)
+
+// DestinationHealth is the latest health check of a webhook destination
+type DestinationHealth struct {
+	WebhookID           int       `json:"webhook_id"`
+	Name                string    `json:"webhook_name"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Detail              string    `json:"detail"`
+	LatencyMs           *int      `json:"latency_ms"`
+	CheckedAt           time.Time `json:"checked_at"`
+	ChangedAt           time.Time `json:"changed_at"`
+}
+
+var (
+	healthMu sync.Mutex
+	// probeResults holds current health check results, by webhook id
+	probeResults = map[int]DestinationHealth{}
+)
+
+func init() {
+	expvar.Publish("destination_health", expvar.Func(func() interface{} {
+		return healthSnapshot()
+	}))
+}
+
+// healthSnapshot returns the current results in webhook id order
+func healthSnapshot() []DestinationHealth {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	results := make([]DestinationHealth, 0, len(probeResults))
+	for _, h := range probeResults {
+		results = append(results, h)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].WebhookID < results[j].WebhookID })
+	return results
+}
+
+// initHealthChecks registers the probe task and starts reading results
+func initHealthChecks() {
+	if config.HealthCheck.IntervalSeconds <= 0 {
+		return
+	}
+	interval := healthCheckInterval()
+	registerSingleton("health_check", interval, probeDestinations)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			refreshDestinationHealth()
+			<-ticker.C
+		}
+	}()
+}
+
+func healthCheckInterval() time.Duration {
+	return time.Duration(config.HealthCheck.IntervalSeconds) * time.Second
+}
+
+// probeTarget is a destination to probe
+type probeTarget struct {
+	id      int
+	name    string
+	url     string
+	check   string
+	headers map[string]string
+}
+
+// probeDestinations probes every destination with a health check and
+// records the results
+func probeDestinations(ctx context.Context) error {
+	rows, err := lookupQuery(ctx,
+		`SELECT webhook_id, webhook_name, url, health_check, headers
+		 FROM rule_webhooks
+		 WHERE enabled = true AND COALESCE(health_check, '') <> ''`)
+	if err != nil {
+		return err
+	}
+	var targets []probeTarget
+	for rows.Next() {
+		var t probeTarget
+		var headers []byte
+		if err := rows.Scan(&t.id, &t.name, &t.url, &t.check, &headers); err != nil {
+			rows.Close()
+			return err
+		}
+		if len(headers) > 0 {
+			if err := json.Unmarshal(headers, &t.headers); err != nil {
+				log.Printf("⚠️  Webhook %d has invalid headers, probing without them: %v", t.id, err)
+			}
+		}
+		targets = append(targets, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, probeConcurrency)
+	ids := make([]int64, len(targets))
+	for i, t := range targets {
+		ids[i] = int64(t.id)
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(t probeTarget) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			start := time.Now()
+			detail, err := probeDestination(ctx, t)
+			recordProbe(t, detail, err, time.Since(start))
+		}(t)
+	}
+	wg.Wait()
+
+	// Forget destinations that are no longer probed
+	err = opsWrite("webhook_health_prune",
+		`DELETE FROM rule_webhook_health WHERE NOT (webhook_id = ANY($1))`,
+		pq.Array(ids),
+	)
+	if err != nil && !errors.Is(err, errOpsBuffered) {
+		return err
+	}
+	return nil
+}
+
+// probeDestination runs t's health check and describes the result
+func probeDestination(ctx context.Context, t probeTarget) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.HealthCheck.TimeoutMs)*time.Millisecond)
+	defer cancel()
+
+	base, err := url.Parse(t.url)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+	if strings.EqualFold(t.check, "tcp") {
+		port := base.Port()
+		if port == "" {
+			port = "80"
+			if base.Scheme == "https" {
+				port = "443"
+			}
+		}
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(base.Hostname(), port))
+		if err != nil {
+			return "", err
+		}
+		conn.Close()
+		return "TCP connect", nil
+	}
+
+	target, err := base.Parse(t.check)
+	if err != nil {
+		return "", fmt.Errorf("invalid health_check: %w", err)
+	}
+	// The webhook's headers often hold its credentials; they go only to
+	// the host deliveries go to
+	var headers map[string]string
+	if strings.EqualFold(target.Host, base.Host) && target.Scheme == base.Scheme {
+		headers = t.headers
+	}
+	status, err := probeHTTP(ctx, http.MethodHead, target.String(), headers)
+	if err == nil && (status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented) {
+		status, err = probeHTTP(ctx, http.MethodGet, target.String(), headers)
+	}
+	if err != nil {
+		return "", err
+	}
+	if status < 200 || status >= 400 {
+		return "", fmt.Errorf("HTTP %d", status)
+	}
+	return fmt.Sprintf("HTTP %d", status), nil
+}
+
+// probeHTTP requests target with headers and returns the response status
+func probeHTTP(ctx context.Context, method, target string, headers map[string]string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// recordProbe stores a probe result. The destination stays healthy until
+// HEALTH_CHECK_FAILURE_THRESHOLD probes in a row have failed.
+func recordProbe(t probeTarget, detail string, err error, latency time.Duration) {
+	ok := err == nil
+	if !ok {
+		detail = err.Error()
+	}
+	err = opsWrite(fmt.Sprintf("webhook_health:%d", t.id),
+		`INSERT INTO rule_webhook_health AS h
+		     (webhook_id, webhook_name, healthy, consecutive_failures, detail, latency_ms, checked_at, changed_at)
+		 VALUES ($1, $2, $3 OR $6 > 1, CASE WHEN $3 THEN 0 ELSE 1 END, $4, $5, now(), now())
+		 ON CONFLICT (webhook_id) DO UPDATE SET
+		     webhook_name = EXCLUDED.webhook_name,
+		     healthy = $3 OR h.consecutive_failures + 1 < $6,
+		     consecutive_failures = CASE WHEN $3 THEN 0 ELSE h.consecutive_failures + 1 END,
+		     detail = EXCLUDED.detail,
+		     latency_ms = EXCLUDED.latency_ms,
+		     checked_at = EXCLUDED.checked_at,
+		     changed_at = CASE WHEN h.healthy = ($3 OR h.consecutive_failures + 1 < $6)
+		                       THEN h.changed_at ELSE EXCLUDED.checked_at END`,
+		t.id, t.name, ok, detail, latency.Milliseconds(), config.HealthCheck.FailureThreshold,
+	)
+	if err != nil && !errors.Is(err, errOpsBuffered) {
+		log.Printf("⚠️  Failed to record health of webhook %d: %v", t.id, err)
+	}
+}
+
+// refreshDestinationHealth reads the latest results. Results older than
+// three intervals are ignored, so destinations nobody probes any more are
+// not held down.
+func refreshDestinationHealth() {
+	var data []byte
+	err := opsQueryRow([]interface{}{&data},
+		`SELECT COALESCE(json_agg(h), '[]') FROM rule_webhook_health h
+		 WHERE checked_at > now() - make_interval(secs => $1)`,
+		3*config.HealthCheck.IntervalSeconds,
+	)
+	var results []DestinationHealth
+	if err == nil {
+		err = json.Unmarshal(data, &results)
+	}
+	if err != nil {
+		log.Printf("⚠️  Failed to read destination health: %v", err)
+		return
+	}
+
+	current := make(map[int]DestinationHealth, len(results))
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	for _, h := range results {
+		current[h.WebhookID] = h
+		previous, known := probeResults[h.WebhookID]
+		switch {
+		case !h.Healthy && (!known || previous.Healthy):
+			log.Printf("🔴 Webhook %d (%s) is down: %s", h.WebhookID, h.Name, h.Detail)
+		case h.Healthy && known && !previous.Healthy:
+			log.Printf("🟢 Webhook %d (%s) is healthy again", h.WebhookID, h.Name)
+		}
+	}
+	probeResults = current
+}
+
+// destinationDownError is returned instead of calling a destination whose
+// circuit is open or that is paused
+type destinationDownError struct {
+	id    int
+	name  string
+	state string    // down, or why it is paused
+	until time.Time // the next probe, or the end of the pause
+}
+
+func (e *destinationDownError) Error() string {
+	return fmt.Sprintf("webhook %d (%s) is %s, deferred until %s", e.id, e.name, e.state, e.until.Format(time.RFC3339))
+}
+
+// checkCircuit returns a destinationDownError if dest failed its health
+// checks and HEALTH_CHECK_OPEN_CIRCUIT is set
+func checkCircuit(dest *Destination) error {
+	if !config.HealthCheck.OpenCircuit || dest == nil || dest.ID == 0 {
+		return nil
+	}
+	healthMu.Lock()
+	h, ok := probeResults[dest.ID]
+	healthMu.Unlock()
+	if !ok || h.Healthy {
+		return nil
+	}
+	until := h.CheckedAt.Add(healthCheckInterval())
+	if now := time.Now(); until.Before(now) {
+		until = now.Add(healthCheckInterval())
+	}
+	return &destinationDownError{id: dest.ID, name: dest.Name, state: "down", until: until}
+}
+
+// deferDelivery publishes a copy of m that waits on the stream until down's
+// next probe or the end of its pause, then acks m. The copy starts with a
+// fresh delivery count, so waiting for a destination uses up none of m's
+// attempts.
+func (m *ActionMessage) deferDelivery(down *destinationDownError) {
+	copied := nats.NewMsg(m.Msg.Subject)
+	copied.Data = m.Msg.Data
+	for key, values := range m.Msg.Header {
+		// The stream would drop a copy with the same message id
+		if key == nats.MsgIdHdr || strings.HasPrefix(key, "Nats-Expected-") {
+			continue
+		}
+		copied.Header[key] = values
+	}
+	copied.Header.Set(deferredUntilHeader, down.until.UTC().Format(time.RFC3339Nano))
+	copied.Header.Set(traceIDHeader, m.traceID)
+	if copied.Header.Get(publishedAtHeader) == "" {
+		if meta, err := m.Msg.Metadata(); err == nil {
+			copied.Header.Set(publishedAtHeader, meta.Timestamp.UTC().Format(time.RFC3339Nano))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opsWriteTimeout)
+	defer cancel()
+	if _, err := jetStream.PublishMsg(copied, nats.Context(ctx)); err != nil {
+		log.Printf("   ⚠️  [%d %s] Failed to defer message, redelivering it instead: %v", m.num, m.traceID, err)
+		settleMessage(m.Msg, worker.RetryAfter(down, time.Until(down.until)), nil)
+		return
+	}
+	logMessage(m.traceID, false, "   ⏸️  [%d %s] %v", m.num, m.traceID, down)
+	settleMessage(m.Msg, nil, worker.Counts{"deferred": 1})
+}
+
+// deferredUntil returns when a deferred message may be delivered, if that
+// is still in the future
+func deferredUntil(msg *nats.Msg) (time.Duration, bool) {
+	until, err := time.Parse(time.RFC3339Nano, msg.Header.Get(deferredUntilHeader))
+	if err != nil {
+		return 0, false
+	}
+	wait := time.Until(until)
+	return wait, wait > 0
+}
+
+// errDeferred is the reason a deferred message is put back unprocessed
+var errDeferred = errors.New("deferred until its destination is available")
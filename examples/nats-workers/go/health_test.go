@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+)
+
+// setHealthCheck replaces the health check settings for the test
+func setHealthCheck(t *testing.T, openCircuit bool) {
+	t.Helper()
+	prev := config.HealthCheck
+	healthMu.Lock()
+	prevResults := probeResults
+	healthMu.Unlock()
+	t.Cleanup(func() {
+		config.HealthCheck = prev
+		healthMu.Lock()
+		probeResults = prevResults
+		healthMu.Unlock()
+	})
+	config.HealthCheck.IntervalSeconds, config.HealthCheck.TimeoutMs = 30, 2000
+	config.HealthCheck.FailureThreshold, config.HealthCheck.OpenCircuit = 3, openCircuit
+}
+
+// healthServer answers /healthz with the status for its method, and
+// only with a bearer token when auth is set
+func healthServer(t *testing.T, head, get int, auth string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth != "" && r.Header.Get("Authorization") != auth {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path != "/healthz":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(head)
+		default:
+			w.WriteHeader(get)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestProbeDestination(t *testing.T) {
+	setHealthCheck(t, false)
+	open := healthServer(t, 200, 200, "")
+	noHead := healthServer(t, 405, 204, "")
+	failing := healthServer(t, 503, 503, "")
+	protected := healthServer(t, 200, 200, "Bearer s3cret")
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := ln.Addr().String()
+	ln.Close()
+	auth := map[string]string{"Authorization": "Bearer s3cret"}
+
+	tests := []struct {
+		name       string
+		target     probeTarget
+		wantDetail string
+		wantErr    string
+	}{
+		{name: "head", target: probeTarget{url: open.URL + "/hook", check: "/healthz"}, wantDetail: "HTTP 200"},
+		{name: "absolute url", target: probeTarget{url: "http://example.invalid/hook", check: open.URL + "/healthz"}, wantDetail: "HTTP 200"},
+		{name: "head refused falls back to get", target: probeTarget{url: noHead.URL, check: "/healthz"}, wantDetail: "HTTP 204"},
+		{name: "server error", target: probeTarget{url: failing.URL, check: "/healthz"}, wantErr: "HTTP 503"},
+		{name: "not found", target: probeTarget{url: open.URL, check: "/missing"}, wantErr: "HTTP 404"},
+		{name: "auth from webhook headers", target: probeTarget{url: protected.URL + "/hook", check: "/healthz", headers: auth},
+			wantDetail: "HTTP 200"},
+		{name: "no headers", target: probeTarget{url: protected.URL + "/hook", check: "/healthz"}, wantErr: "HTTP 401"},
+		{name: "wrong credentials", target: probeTarget{url: protected.URL, check: "/healthz",
+			headers: map[string]string{"Authorization": "Bearer old"}}, wantErr: "HTTP 401"},
+		// Credentials stay with the webhook's host
+		{name: "headers not sent elsewhere", target: probeTarget{url: "http://hooks.example.com/hook", check: protected.URL + "/healthz",
+			headers: auth}, wantErr: "HTTP 401"},
+		{name: "tcp", target: probeTarget{url: open.URL + "/hook", check: "TCP"}, wantDetail: "TCP connect"},
+		{name: "tcp refused", target: probeTarget{url: "http://" + closedAddr, check: "tcp"}, wantErr: "connection refused"},
+		{name: "invalid url", target: probeTarget{url: "http://[::1", check: "/healthz"}, wantErr: "invalid URL"},
+		{name: "invalid check", target: probeTarget{url: open.URL, check: "http://[::1"}, wantErr: "invalid health_check"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detail, err := probeDestination(context.Background(), tt.target)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || detail != tt.wantDetail {
+				t.Fatalf("probe = %q, %v; want %q", detail, err, tt.wantDetail)
+			}
+		})
+	}
+}
+
+func TestProbeDestinationTimeout(t *testing.T) {
+	setHealthCheck(t, false)
+	config.HealthCheck.TimeoutMs = 50
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	start := time.Now()
+	if _, err := probeDestination(context.Background(), probeTarget{url: srv.URL, check: "/"}); err == nil {
+		t.Fatal("slow endpoint passed")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("probe took %s", elapsed)
+	}
+}
+
+func TestProbeDestinations(t *testing.T) {
+	setHealthCheck(t, false)
+	protected := healthServer(t, 200, 200, "Bearer s3cret")
+	primary := mockDB(t)
+	ops := mockOpsDB(t)
+
+	primary.ExpectQuery(`SELECT webhook_id, webhook_name, url, health_check, headers\s+FROM rule_webhooks`).
+		WillReturnRows(sqlmock.NewRows([]string{"webhook_id", "webhook_name", "url", "health_check", "headers"}).
+			AddRow(7, "billing", protected.URL+"/hook", "/healthz", []byte(`{"Authorization": "Bearer s3cret"}`)).
+			AddRow(8, "crm", protected.URL+"/hook", "/healthz", nil).
+			AddRow(9, "legacy", protected.URL+"/hook", "/healthz", []byte(`not json`)))
+	ops.ExpectExec(`INSERT INTO rule_webhook_health`).
+		WithArgs(7, "billing", true, "HTTP 200", sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	ops.ExpectExec(`INSERT INTO rule_webhook_health`).
+		WithArgs(8, "crm", false, "HTTP 401", sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	ops.ExpectExec(`INSERT INTO rule_webhook_health`).
+		WithArgs(9, "legacy", false, "HTTP 401", sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	ops.ExpectExec(`DELETE FROM rule_webhook_health WHERE NOT \(webhook_id = ANY\(\$1\)\)`).
+		WithArgs("{7,8,9}").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := probeDestinations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefreshDestinationHealthAndCircuit(t *testing.T) {
+	setHealthCheck(t, true)
+	ops := mockOpsDB(t)
+	checked := time.Now().Add(-5 * time.Second).UTC()
+	ops.ExpectQuery(`FROM rule_webhook_health h`).WithArgs(90).
+		WillReturnRows(sqlmock.NewRows([]string{"json"}).AddRow([]byte(`[
+			{"webhook_id": 7, "webhook_name": "billing", "healthy": false, "consecutive_failures": 3, "detail": "HTTP 503", "checked_at": "` +
+			checked.Format(time.RFC3339Nano) + `"},
+			{"webhook_id": 8, "webhook_name": "crm", "healthy": true, "detail": "HTTP 200", "checked_at": "` + checked.Format(time.RFC3339Nano) + `"}
+		]`)))
+	refreshDestinationHealth()
+	if got := healthSnapshot(); len(got) != 2 || got[0].WebhookID != 7 || got[0].Healthy || !got[1].Healthy {
+		t.Fatalf("snapshot = %+v", got)
+	}
+
+	tests := []struct {
+		name        string
+		dest        *Destination
+		openCircuit bool
+		wantDown    bool
+	}{
+		{name: "down", dest: &Destination{ID: 7, Name: "billing"}, openCircuit: true, wantDown: true},
+		{name: "healthy", dest: &Destination{ID: 8}, openCircuit: true},
+		{name: "never probed", dest: &Destination{ID: 9}, openCircuit: true},
+		{name: "inline webhook", dest: nil, openCircuit: true},
+		{name: "circuit off", dest: &Destination{ID: 7}, openCircuit: false},
+	}
+	for _, tt := range tests {
+		config.HealthCheck.OpenCircuit = tt.openCircuit
+		err := checkCircuit(tt.dest)
+		if (err != nil) != tt.wantDown {
+			t.Errorf("%s: checkCircuit = %v", tt.name, err)
+			continue
+		}
+		if down, ok := err.(*destinationDownError); ok {
+			// Deferred until the next probe
+			if want := checked.Add(30 * time.Second); !down.until.Equal(want) ||
+				!strings.HasPrefix(err.Error(), "webhook 7 (billing) is down, deferred until ") {
+				t.Errorf("%s: %v, want until %s", tt.name, err, want)
+			}
+		}
+	}
+}
+
+func TestDeferredUntil(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{name: "future", header: time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano), want: true},
+		{name: "past", header: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)},
+		{name: "missing"},
+		{name: "garbage", header: "soon"},
+	}
+	for _, tt := range tests {
+		msg := nats.NewMsg("rules.orders")
+		if tt.header != "" {
+			msg.Header.Set(deferredUntilHeader, tt.header)
+		}
+		wait, ok := deferredUntil(msg)
+		if ok != tt.want || (ok && (wait <= 0 || wait > time.Minute)) {
+			t.Errorf("%s: deferredUntil = %s, %v", tt.name, wait, ok)
+		}
+	}
+}
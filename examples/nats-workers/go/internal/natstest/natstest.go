@@ -0,0 +1,936 @@
+// Package natstest is an in-process NATS server for tests. It speaks the
+// core client protocol and answers the JetStream API calls the worker and
+// the operator make: stream create, update, delete, info, and lookup,
+// message get, consumer create (with its start position), info, and
+// delete, push and pull delivery, and acks, naks, terms, and progress
+// reports, with redelivery after AckWait. It keeps everything in memory
+// and is not a JetStream implementation; anything else gets an API error.
+//
+//	srv := natstest.NewServer(t)
+//	srv.AddStream("RULES", "rules.>")
+//	nc, _ := nats.Connect(srv.URL())
+//	...
+//	acks := srv.WaitForAcks(1)
+package natstest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Ack is a settlement a client sent for a JetStream message
+type Ack struct {
+	Stream    string
+	Consumer  string
+	Sequence  uint64        // stream sequence
+	Delivered uint64        // delivery attempt it settles
+	Kind      string        // "+ACK", "-NAK", "+TERM", or "+WPI"
+	Delay     time.Duration // NakWithDelay's delay
+	Sync      bool          // the client waited for confirmation
+}
+
+// Msg is a message stored in a stream
+type Msg struct {
+	Sequence uint64
+	Subject  string
+	Header   nats.Header
+	Data     []byte
+	Time     time.Time
+}
+
+// Server is a fake NATS server listening on a local port
+type Server struct {
+	t    testing.TB
+	addr string
+
+	mu      sync.Mutex
+	ln      net.Listener
+	clients map[*client]bool
+	streams map[string]*stream
+	acks    []Ack
+	stopped bool
+}
+
+type client struct {
+	srv  *Server
+	conn net.Conn
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	subs map[string]*subscription // by sid; guarded by Server.mu
+}
+
+type subscription struct {
+	c       *client
+	subject []string
+	queue   string
+	sid     string
+	max     int // auto-unsubscribe after max messages, 0 for never
+	count   int
+}
+
+type stream struct {
+	nats.StreamConfig
+	created   time.Time
+	msgs      []*storedMsg // msgs[i] has sequence i+1
+	consumers map[string]*consumer
+}
+
+type storedMsg struct {
+	seq     uint64
+	subject string
+	header  []byte
+	data    []byte
+	at      time.Time
+}
+
+type consumer struct {
+	stream  *stream
+	cfg     nats.ConsumerConfig
+	created time.Time
+
+	next      uint64 // next stream sequence not yet delivered
+	delivered uint64 // consumer sequence
+	pending   map[uint64]*delivery
+	ready     []uint64 // redeliveries due
+	waiting   []*pullRequest
+}
+
+type delivery struct {
+	count int
+	timer *time.Timer
+}
+
+type pullRequest struct {
+	reply   string
+	batch   int
+	expires time.Time
+}
+
+// NewServer starts a server that is closed when the test ends
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	s := &Server{t: t, clients: map[*client]bool{}, streams: map[string]*stream{}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("natstest: %v", err)
+	}
+	s.ln, s.addr = ln, ln.Addr().String()
+	go s.accept(ln)
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// URL is the nats:// URL to connect to
+func (s *Server) URL() string {
+	return "nats://" + s.addr
+}
+
+// Stop closes the listener and every client connection, as a server
+// going down would. Streams, consumers, and unacked messages are kept for
+// Start.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	s.ln.Close()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// Start listens again on the same address after Stop
+func (s *Server) Start() {
+	s.t.Helper()
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		s.t.Fatalf("natstest: %v", err)
+	}
+	s.mu.Lock()
+	s.ln, s.stopped = ln, false
+	s.mu.Unlock()
+	go s.accept(ln)
+}
+
+// AddStream creates a stream storing messages published to subjects
+func (s *Server) AddStream(name string, subjects ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[name] = &stream{
+		StreamConfig: nats.StreamConfig{Name: name, Subjects: subjects},
+		created:      time.Now(),
+		consumers:    map[string]*consumer{},
+	}
+}
+
+// Publish stores a message in the stream whose subjects match, delivers it
+// to its consumers and to core subscribers, and returns its sequence
+func (s *Server) Publish(subject string, header nats.Header, data []byte) uint64 {
+	var hdr []byte
+	if len(header) > 0 {
+		hdr = encodeHeader(header)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.route(subject, subject, "", hdr, data)
+	seq, _ := s.store(subject, hdr, data)
+	return seq
+}
+
+// Stream returns a stream's config
+func (s *Server) Stream(name string) (nats.StreamConfig, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.streams[name]; st != nil {
+		return st.StreamConfig, true
+	}
+	return nats.StreamConfig{}, false
+}
+
+// Consumer returns a consumer's config
+func (s *Server) Consumer(streamName, name string) (nats.ConsumerConfig, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.streams[streamName]; st != nil {
+		if c := st.consumers[name]; c != nil {
+			return c.cfg, true
+		}
+	}
+	return nats.ConsumerConfig{}, false
+}
+
+// Messages returns the messages stored in a stream
+func (s *Server) Messages(streamName string) []Msg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.streams[streamName]
+	if st == nil {
+		return nil
+	}
+	msgs := make([]Msg, len(st.msgs))
+	for i, m := range st.msgs {
+		msgs[i] = Msg{Sequence: m.seq, Subject: m.subject, Header: decodeHeader(m.header), Data: m.data, Time: m.at}
+	}
+	return msgs
+}
+
+// Acks returns the settlements received so far, in order
+func (s *Server) Acks() []Ack {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Ack(nil), s.acks...)
+}
+
+// WaitForAcks waits up to five seconds for n settlements and returns them
+func (s *Server) WaitForAcks(n int) []Ack {
+	s.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		acks := s.Acks()
+		if len(acks) >= n {
+			return acks
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("natstest: %d settlement(s) after 5s, want %d: %+v", len(acks), n, acks)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (s *Server) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{srv: s, conn: conn, w: bufio.NewWriter(conn), subs: map[string]*subscription{}}
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[c] = true
+		s.mu.Unlock()
+		go c.run()
+	}
+}
+
+// run reads the client's protocol lines until the connection closes
+func (c *client) run() {
+	defer func() {
+		c.conn.Close()
+		c.srv.mu.Lock()
+		delete(c.srv.clients, c)
+		c.srv.mu.Unlock()
+	}()
+
+	port, _ := strconv.Atoi(c.srv.addr[strings.LastIndex(c.srv.addr, ":")+1:])
+	info, _ := json.Marshal(map[string]interface{}{
+		"server_id": "NATSTEST", "server_name": "natstest", "version": "2.10.0", "go": "go1.21",
+		"host": "127.0.0.1", "port": port, "headers": true, "max_payload": 1 << 20, "proto": 1, "jetstream": true,
+	})
+	c.write([]byte("INFO " + string(info) + "\r\n"))
+
+	r := bufio.NewReader(c.conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToUpper(args[0]) {
+		case "CONNECT":
+		case "PING":
+			c.write([]byte("PONG\r\n"))
+		case "PONG":
+		case "SUB":
+			if len(args) < 3 {
+				return
+			}
+			sub := &subscription{c: c, subject: strings.Split(args[1], "."), sid: args[len(args)-1]}
+			if len(args) == 4 {
+				sub.queue = args[2]
+			}
+			c.srv.subscribe(sub)
+		case "UNSUB":
+			if len(args) < 2 {
+				return
+			}
+			max := 0
+			if len(args) == 3 {
+				max, _ = strconv.Atoi(args[2])
+			}
+			c.srv.unsubscribe(c, args[1], max)
+		case "PUB", "HPUB":
+			headers := strings.ToUpper(args[0]) == "HPUB"
+			subject, reply, hdrLen, total, ok := parsePub(args[1:], headers)
+			if !ok {
+				return
+			}
+			payload := make([]byte, total+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			c.srv.publish(subject, reply, payload[:hdrLen], payload[hdrLen:total])
+		default:
+			c.write([]byte("-ERR 'Unknown Protocol Operation'\r\n"))
+			return
+		}
+	}
+}
+
+// parsePub parses the arguments of PUB subject [reply] size or HPUB
+// subject [reply] header-size total-size
+func parsePub(args []string, headers bool) (subject, reply string, hdrLen, total int, ok bool) {
+	sizes := 1
+	if headers {
+		sizes = 2
+	}
+	if len(args) != 1+sizes && len(args) != 2+sizes {
+		return "", "", 0, 0, false
+	}
+	subject = args[0]
+	if len(args) == 2+sizes {
+		reply = args[1]
+	}
+	var err error
+	if total, err = strconv.Atoi(args[len(args)-1]); err != nil {
+		return "", "", 0, 0, false
+	}
+	if headers {
+		if hdrLen, err = strconv.Atoi(args[len(args)-2]); err != nil || hdrLen > total {
+			return "", "", 0, 0, false
+		}
+	}
+	return subject, reply, hdrLen, total, true
+}
+
+func (c *client) write(b []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.w.Write(b)
+	c.w.Flush()
+}
+
+// send writes a MSG or HMSG to the client for sub
+func (c *client) send(sub *subscription, subject, reply string, hdr, data []byte) {
+	var buf bytes.Buffer
+	if reply != "" {
+		reply += " "
+	}
+	if len(hdr) > 0 {
+		fmt.Fprintf(&buf, "HMSG %s %s %s%d %d\r\n", subject, sub.sid, reply, len(hdr), len(hdr)+len(data))
+		buf.Write(hdr)
+	} else {
+		fmt.Fprintf(&buf, "MSG %s %s %s%d\r\n", subject, sub.sid, reply, len(data))
+	}
+	buf.Write(data)
+	buf.WriteString("\r\n")
+	c.write(buf.Bytes())
+}
+
+func (s *Server) subscribe(sub *subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub.c.subs[sub.sid] = sub
+	// A push consumer may have been waiting for interest
+	for _, st := range s.streams {
+		for _, c := range st.consumers {
+			if c.cfg.DeliverSubject != "" {
+				s.pump(c)
+			}
+		}
+	}
+}
+
+func (s *Server) unsubscribe(c *client, sid string, max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := c.subs[sid]
+	if sub == nil {
+		return
+	}
+	if max > 0 && sub.count < max {
+		sub.max = max
+		return
+	}
+	delete(c.subs, sid)
+}
+
+// publish handles a PUB or HPUB from a client
+func (s *Server) publish(subject, reply string, hdr, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasPrefix(subject, "$JS.ACK."):
+		s.ack(subject, reply, data)
+		return
+	case strings.HasPrefix(subject, "$JS.API."):
+		s.api(strings.TrimPrefix(subject, "$JS.API."), reply, data)
+		return
+	}
+	s.route(subject, subject, reply, hdr, data)
+	seq, st := s.store(subject, hdr, data)
+	if st != nil && reply != "" {
+		s.respond(reply, map[string]interface{}{"stream": st.Name, "seq": seq})
+	}
+}
+
+// route delivers a message to the subscriptions interested in target:
+// every plain subscription and one member of each queue group. It
+// reports whether anyone received it.
+func (s *Server) route(target, subject, reply string, hdr, data []byte) bool {
+	tokens := strings.Split(target, ".")
+	groups := map[string]bool{}
+	delivered := false
+	for c := range s.clients {
+		for sid, sub := range c.subs {
+			if !matches(sub.subject, tokens) || (sub.queue != "" && groups[sub.queue]) {
+				continue
+			}
+			if sub.queue != "" {
+				groups[sub.queue] = true
+			}
+			c.send(sub, subject, reply, hdr, data)
+			delivered = true
+			if sub.count++; sub.max > 0 && sub.count >= sub.max {
+				delete(c.subs, sid)
+			}
+		}
+	}
+	return delivered
+}
+
+// interest reports whether any subscription matches subject
+func (s *Server) interest(subject string) bool {
+	tokens := strings.Split(subject, ".")
+	for c := range s.clients {
+		for _, sub := range c.subs {
+			if matches(sub.subject, tokens) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// store appends a message to the stream for subject, if any, and
+// delivers it to the stream's consumers
+func (s *Server) store(subject string, hdr, data []byte) (uint64, *stream) {
+	tokens := strings.Split(subject, ".")
+	for _, st := range s.streams {
+		for _, pattern := range st.Subjects {
+			if !matches(strings.Split(pattern, "."), tokens) {
+				continue
+			}
+			m := &storedMsg{seq: uint64(len(st.msgs) + 1), subject: subject, header: hdr, data: data, at: time.Now()}
+			st.msgs = append(st.msgs, m)
+			for _, c := range st.consumers {
+				s.pump(c)
+			}
+			return m.seq, st
+		}
+	}
+	return 0, nil
+}
+
+// pump delivers what c has ready: redeliveries first, then new messages
+// matching its filter, to the deliver subject of a push consumer with
+// interest or to waiting pull requests
+func (s *Server) pump(c *consumer) {
+	for {
+		if c.cfg.DeliverSubject != "" {
+			if !s.interest(c.cfg.DeliverSubject) {
+				return
+			}
+		} else {
+			now := time.Now()
+			for len(c.waiting) > 0 && now.After(c.waiting[0].expires) {
+				c.waiting = c.waiting[1:]
+			}
+			if len(c.waiting) == 0 {
+				return
+			}
+		}
+		seq, ok := c.nextReady()
+		if !ok {
+			return
+		}
+		s.deliver(c, seq)
+	}
+}
+
+// nextReady takes the next stream sequence c should deliver
+func (c *consumer) nextReady() (uint64, bool) {
+	if len(c.ready) > 0 {
+		seq := c.ready[0]
+		c.ready = c.ready[1:]
+		return seq, true
+	}
+	for c.next <= uint64(len(c.stream.msgs)) {
+		seq := c.next
+		c.next++
+		if c.filters(c.stream.msgs[seq-1].subject) {
+			return seq, true
+		}
+	}
+	return 0, false
+}
+
+func (c *consumer) filters(subject string) bool {
+	return c.cfg.FilterSubject == "" || matches(strings.Split(c.cfg.FilterSubject, "."), strings.Split(subject, "."))
+}
+
+// deliver sends a message to c and starts its AckWait
+func (s *Server) deliver(c *consumer, seq uint64) {
+	d := c.pending[seq]
+	if d == nil {
+		d = &delivery{}
+		c.pending[seq] = d
+	}
+	d.count++
+	c.delivered++
+	m := c.stream.msgs[seq-1]
+	reply := fmt.Sprintf("$JS.ACK.%s.%s.%d.%d.%d.%d.%d",
+		c.stream.Name, c.cfg.Durable, d.count, seq, c.delivered, m.at.UnixNano(), c.numPending())
+
+	if c.cfg.DeliverSubject != "" {
+		s.route(c.cfg.DeliverSubject, m.subject, reply, m.header, m.data)
+	} else {
+		req := c.waiting[0]
+		s.route(req.reply, m.subject, reply, m.header, m.data)
+		if req.batch--; req.batch == 0 {
+			c.waiting = c.waiting[1:]
+		}
+	}
+	s.startAckWait(c, seq, d)
+}
+
+// numPending counts the messages c has not delivered yet
+func (c *consumer) numPending() int {
+	n := len(c.ready)
+	for seq := c.next; seq <= uint64(len(c.stream.msgs)); seq++ {
+		if c.filters(c.stream.msgs[seq-1].subject) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) startAckWait(c *consumer, seq uint64, d *delivery) {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	wait := c.cfg.AckWait
+	if wait <= 0 {
+		wait = 30 * time.Second
+	}
+	count := d.count
+	d.timer = time.AfterFunc(wait, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if c.pending[seq] == d && d.count == count {
+			s.redeliver(c, seq, d)
+		}
+	})
+}
+
+// redeliver queues seq again unless it has used up MaxDeliver
+func (s *Server) redeliver(c *consumer, seq uint64, d *delivery) {
+	if c.cfg.MaxDeliver > 0 && d.count >= c.cfg.MaxDeliver {
+		delete(c.pending, seq)
+		return
+	}
+	c.ready = append(c.ready, seq)
+	s.pump(c)
+}
+
+// ack handles a settlement published to $JS.ACK.<stream>.<consumer>.
+// <delivered>.<stream seq>.<consumer seq>.<timestamp>.<pending>
+func (s *Server) ack(subject, reply string, body []byte) {
+	tokens := strings.Split(subject, ".")
+	if len(tokens) < 9 {
+		return
+	}
+	delivered, _ := strconv.ParseUint(tokens[4], 10, 64)
+	seq, _ := strconv.ParseUint(tokens[5], 10, 64)
+	a := Ack{Stream: tokens[2], Consumer: tokens[3], Sequence: seq, Delivered: delivered, Sync: reply != ""}
+	kind, rest, _ := strings.Cut(string(body), " ")
+	a.Kind = kind
+	if kind == "-NAK" && rest != "" {
+		var opts struct {
+			Delay int64 `json:"delay"`
+		}
+		json.Unmarshal([]byte(rest), &opts)
+		a.Delay = time.Duration(opts.Delay)
+	}
+	s.acks = append(s.acks, a)
+	if reply != "" {
+		s.route(reply, reply, "", nil, nil)
+	}
+
+	st := s.streams[a.Stream]
+	if st == nil || st.consumers[a.Consumer] == nil {
+		return
+	}
+	c := st.consumers[a.Consumer]
+	d := c.pending[seq]
+	if d == nil || uint64(d.count) != delivered {
+		return // settled already, or a stale delivery
+	}
+	switch kind {
+	case "+ACK", "+TERM":
+		d.timer.Stop()
+		delete(c.pending, seq)
+	case "+WPI":
+		s.startAckWait(c, seq, d)
+	case "-NAK":
+		d.timer.Stop()
+		if a.Delay > 0 {
+			count := d.count
+			d.timer = time.AfterFunc(a.Delay, func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				if c.pending[seq] == d && d.count == count {
+					s.redeliver(c, seq, d)
+				}
+			})
+		} else {
+			s.redeliver(c, seq, d)
+		}
+	}
+}
+
+// respond sends v as JSON to a request's reply subject
+func (s *Server) respond(reply string, v interface{}) {
+	data, _ := json.Marshal(v)
+	s.route(reply, reply, "", nil, data)
+}
+
+// apiError is a JetStream API error response
+func apiError(code, errCode int, description string) map[string]interface{} {
+	return map[string]interface{}{"error": map[string]interface{}{"code": code, "err_code": errCode, "description": description}}
+}
+
+// api answers a JetStream API request
+func (s *Server) api(call, reply string, body []byte) {
+	if reply == "" {
+		return
+	}
+	tokens := strings.Split(call, ".")
+	switch {
+	case call == "STREAM.NAMES":
+		var req struct {
+			Subject string `json:"subject"`
+		}
+		json.Unmarshal(body, &req)
+		var names []string
+		for name, st := range s.streams {
+			for _, pattern := range st.Subjects {
+				if req.Subject == "" || matches(strings.Split(pattern, "."), strings.Split(req.Subject, ".")) ||
+					matches(strings.Split(req.Subject, "."), strings.Split(pattern, ".")) {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+		s.respond(reply, map[string]interface{}{"streams": names, "total": len(names), "offset": 0, "limit": 1024})
+
+	case strings.HasPrefix(call, "STREAM.INFO.") && len(tokens) == 3:
+		st := s.streams[tokens[2]]
+		if st == nil {
+			s.respond(reply, apiError(404, 10059, "stream not found"))
+			return
+		}
+		state := nats.StreamState{Msgs: uint64(len(st.msgs)), LastSeq: uint64(len(st.msgs)), Consumers: len(st.consumers)}
+		if n := len(st.msgs); n > 0 {
+			state.FirstSeq, state.FirstTime, state.LastTime = 1, st.msgs[0].at, st.msgs[n-1].at
+		}
+		s.respond(reply, nats.StreamInfo{Config: st.StreamConfig, Created: st.created, State: state})
+
+	case (strings.HasPrefix(call, "STREAM.CREATE.") || strings.HasPrefix(call, "STREAM.UPDATE.")) && len(tokens) == 3:
+		var cfg nats.StreamConfig
+		if err := json.Unmarshal(body, &cfg); err != nil {
+			s.respond(reply, apiError(400, 10025, err.Error()))
+			return
+		}
+		st := s.streams[tokens[2]]
+		switch {
+		case tokens[1] == "CREATE" && st != nil:
+			s.respond(reply, apiError(400, 10058, "stream name already in use"))
+			return
+		case tokens[1] == "UPDATE" && st == nil:
+			s.respond(reply, apiError(404, 10059, "stream not found"))
+			return
+		case st == nil:
+			st = &stream{created: time.Now(), consumers: map[string]*consumer{}}
+			s.streams[tokens[2]] = st
+		}
+		st.StreamConfig = cfg
+		s.respond(reply, nats.StreamInfo{Config: cfg, Created: st.created,
+			State: nats.StreamState{Msgs: uint64(len(st.msgs)), Consumers: len(st.consumers)}})
+
+	case strings.HasPrefix(call, "STREAM.DELETE.") && len(tokens) == 3:
+		if s.streams[tokens[2]] == nil {
+			s.respond(reply, apiError(404, 10059, "stream not found"))
+			return
+		}
+		delete(s.streams, tokens[2])
+		s.respond(reply, map[string]interface{}{"success": true})
+
+	case strings.HasPrefix(call, "STREAM.MSG.GET.") && len(tokens) == 4:
+		st := s.streams[tokens[3]]
+		if st == nil {
+			s.respond(reply, apiError(404, 10059, "stream not found"))
+			return
+		}
+		var req struct {
+			Seq uint64 `json:"seq"`
+		}
+		json.Unmarshal(body, &req)
+		if req.Seq == 0 || req.Seq > uint64(len(st.msgs)) {
+			s.respond(reply, apiError(404, 10037, "no message found"))
+			return
+		}
+		m := st.msgs[req.Seq-1]
+		s.respond(reply, map[string]interface{}{"message": map[string]interface{}{
+			"subject": m.subject, "seq": m.seq, "hdrs": m.header, "data": m.data, "time": m.at,
+		}})
+
+	case strings.HasPrefix(call, "CONSUMER.CREATE.") || strings.HasPrefix(call, "CONSUMER.DURABLE.CREATE."):
+		var req struct {
+			Config nats.ConsumerConfig `json:"config"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.respond(reply, apiError(400, 10025, err.Error()))
+			return
+		}
+		streamName := tokens[2]
+		if tokens[1] == "DURABLE" {
+			streamName = tokens[3]
+		}
+		st := s.streams[streamName]
+		if st == nil {
+			s.respond(reply, apiError(404, 10059, "stream not found"))
+			return
+		}
+		cfg := req.Config
+		if cfg.Durable == "" {
+			cfg.Durable = cfg.Name
+		}
+		c := st.consumers[cfg.Durable]
+		if c == nil {
+			c = &consumer{stream: st, created: time.Now(), next: st.startSeq(cfg), pending: map[uint64]*delivery{}}
+			st.consumers[cfg.Durable] = c
+		}
+		c.cfg = cfg
+		s.respond(reply, c.info())
+		s.pump(c)
+
+	case strings.HasPrefix(call, "CONSUMER.INFO.") && len(tokens) == 4:
+		c := s.consumer(tokens[2], tokens[3])
+		if c == nil {
+			s.respond(reply, apiError(404, 10014, "consumer not found"))
+			return
+		}
+		s.respond(reply, c.info())
+
+	case strings.HasPrefix(call, "CONSUMER.DELETE.") && len(tokens) == 4:
+		c := s.consumer(tokens[2], tokens[3])
+		if c == nil {
+			s.respond(reply, apiError(404, 10014, "consumer not found"))
+			return
+		}
+		for _, d := range c.pending {
+			d.timer.Stop()
+		}
+		delete(c.stream.consumers, tokens[3])
+		s.respond(reply, map[string]interface{}{"success": true})
+
+	case strings.HasPrefix(call, "CONSUMER.MSG.NEXT.") && len(tokens) == 5:
+		c := s.consumer(tokens[3], tokens[4])
+		if c == nil {
+			return
+		}
+		var req struct {
+			Batch   int           `json:"batch"`
+			Expires time.Duration `json:"expires"`
+			NoWait  bool          `json:"no_wait"`
+		}
+		json.Unmarshal(body, &req)
+		if req.Batch <= 0 {
+			req.Batch = 1
+		}
+		expires := time.Now().Add(req.Expires)
+		if req.Expires <= 0 {
+			expires = time.Now().Add(time.Hour)
+		}
+		pr := &pullRequest{reply: reply, batch: req.Batch, expires: expires}
+		c.waiting = append(c.waiting, pr)
+		s.pump(c)
+		// A no-wait request ends once the consumer runs out, full or not
+		if n := len(c.waiting); req.NoWait && n > 0 && c.waiting[n-1] == pr {
+			c.waiting = c.waiting[:n-1]
+			s.route(reply, reply, "", []byte("NATS/1.0 404 No Messages\r\n\r\n"), nil)
+		}
+
+	default:
+		s.respond(reply, apiError(503, 10000, "natstest does not implement "+call))
+	}
+}
+
+// startSeq is the first stream sequence a new consumer with cfg delivers
+func (st *stream) startSeq(cfg nats.ConsumerConfig) uint64 {
+	last := uint64(len(st.msgs))
+	switch cfg.DeliverPolicy {
+	case nats.DeliverByStartSequencePolicy:
+		return cfg.OptStartSeq
+	case nats.DeliverByStartTimePolicy:
+		for _, m := range st.msgs {
+			if cfg.OptStartTime != nil && !m.at.Before(*cfg.OptStartTime) {
+				return m.seq
+			}
+		}
+		return last + 1
+	case nats.DeliverNewPolicy:
+		return last + 1
+	case nats.DeliverLastPolicy:
+		if last == 0 {
+			return 1
+		}
+		return last
+	}
+	return 1
+}
+
+func (s *Server) consumer(streamName, name string) *consumer {
+	if st := s.streams[streamName]; st != nil {
+		return st.consumers[name]
+	}
+	return nil
+}
+
+func (c *consumer) info() nats.ConsumerInfo {
+	return nats.ConsumerInfo{
+		Stream:         c.stream.Name,
+		Name:           c.cfg.Durable,
+		Created:        c.created,
+		Config:         c.cfg,
+		Delivered:      nats.SequenceInfo{Consumer: c.delivered, Stream: c.next - 1},
+		AckFloor:       nats.SequenceInfo{Stream: c.ackFloor()},
+		NumAckPending:  len(c.pending),
+		NumPending:     uint64(c.numPending()),
+		NumWaiting:     len(c.waiting),
+		NumRedelivered: len(c.ready),
+	}
+}
+
+// ackFloor is the stream sequence below which c has nothing unacked
+func (c *consumer) ackFloor() uint64 {
+	floor := c.next - 1
+	for seq := range c.pending {
+		if seq <= floor {
+			floor = seq - 1
+		}
+	}
+	return floor
+}
+
+// matches applies NATS wildcard rules to tokenized subjects
+func matches(pattern, subject []string) bool {
+	for i, token := range pattern {
+		if token == ">" {
+			return len(subject) > i
+		}
+		if i >= len(subject) || (token != "*" && token != subject[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(subject)
+}
+
+func encodeHeader(h nats.Header) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("NATS/1.0\r\n")
+	for key, values := range h {
+		for _, v := range values {
+			fmt.Fprintf(&buf, "%s: %s\r\n", key, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+func decodeHeader(hdr []byte) nats.Header {
+	if len(hdr) == 0 {
+		return nil
+	}
+	h := nats.Header{}
+	lines := strings.Split(string(hdr), "\r\n")
+	for _, line := range lines[1:] {
+		key, value, ok := strings.Cut(line, ":")
+		if ok {
+			h[key] = append(h[key], strings.TrimSpace(value))
+		}
+	}
+	return h
+}
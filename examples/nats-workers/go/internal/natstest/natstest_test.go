@@ -0,0 +1,325 @@
+package natstest
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func connect(t *testing.T, s *Server) *nats.Conn {
+	t.Helper()
+	nc, err := nats.Connect(s.URL(), nats.ReconnectWait(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func TestCorePubSub(t *testing.T) {
+	s := NewServer(t)
+	nc := connect(t, s)
+
+	sub, err := nc.SubscribeSync("orders.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue1, _ := nc.QueueSubscribeSync("orders.>", "workers")
+	queue2, _ := nc.QueueSubscribeSync("orders.>", "workers")
+	msg := nats.NewMsg("orders.created")
+	msg.Header.Set("Trace", "abc")
+	msg.Data = []byte("hello")
+	if err := nc.PublishMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := sub.NextMsg(time.Second)
+	if err != nil || string(got.Data) != "hello" || got.Header.Get("Trace") != "abc" {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	// One member of the queue group gets it
+	n1, _, _ := queue1.Pending()
+	n2, _, _ := queue2.Pending()
+	if n1+n2 != 1 {
+		time.Sleep(50 * time.Millisecond)
+		n1, _, _ = queue1.Pending()
+		n2, _, _ = queue2.Pending()
+		if n1+n2 != 1 {
+			t.Fatalf("queue group got %d and %d", n1, n2)
+		}
+	}
+
+	nc.Subscribe("echo", func(m *nats.Msg) { m.Respond(m.Data) })
+	reply, err := nc.Request("echo", []byte("ping"), time.Second)
+	if err != nil || string(reply.Data) != "ping" {
+		t.Fatalf("request: %v, %v", reply, err)
+	}
+}
+
+func TestJetStreamPushConsumer(t *testing.T) {
+	s := NewServer(t)
+	s.AddStream("RULES", "rules.>")
+	nc := connect(t, s)
+	js, _ := nc.JetStream()
+
+	if _, err := js.StreamInfo("RULES"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.StreamInfo("MISSING"); err != nats.ErrStreamNotFound {
+		t.Fatalf("missing stream: %v", err)
+	}
+	_, err := js.AddConsumer("RULES", &nats.ConsumerConfig{
+		Durable: "webhooks", AckPolicy: nats.AckExplicitPolicy, FilterSubject: "rules.orders.*",
+		DeliverSubject: nats.NewInbox(), DeliverGroup: "workers", MaxDeliver: 2, AckWait: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.ConsumerInfo("RULES", "missing"); err != nats.ErrConsumerNotFound {
+		t.Fatalf("missing consumer: %v", err)
+	}
+
+	ack, err := js.Publish("rules.orders.created", []byte("1"))
+	if err != nil || ack.Stream != "RULES" || ack.Sequence != 1 {
+		t.Fatalf("publish = %+v, %v", ack, err)
+	}
+	s.Publish("rules.invoices.created", nil, []byte("filtered out"))
+	s.Publish("rules.orders.updated", nil, []byte("2"))
+
+	msgs := make(chan *nats.Msg, 10)
+	_, err = js.ChanQueueSubscribe("rules.orders.*", "workers", msgs, nats.Durable("webhooks"), nats.ManualAck(),
+		nats.MaxDeliver(2), nats.AckWait(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := <-msgs
+	meta, err := first.Metadata()
+	if err != nil || string(first.Data) != "1" || meta.Sequence.Stream != 1 || meta.NumDelivered != 1 || meta.Consumer != "webhooks" {
+		t.Fatalf("first = %s %+v %v", first.Data, meta, err)
+	}
+	first.Ack()
+	second := <-msgs
+	if string(second.Data) != "2" {
+		t.Fatalf("second = %s", second.Data)
+	}
+	// A nak redelivers until MaxDeliver
+	second.Nak()
+	again := <-msgs
+	if meta, _ := again.Metadata(); meta.NumDelivered != 2 || meta.Sequence.Stream != 3 {
+		t.Fatalf("redelivery = %+v", meta)
+	}
+	if err := again.AckSync(); err != nil {
+		t.Fatal(err)
+	}
+
+	acks := s.WaitForAcks(3)
+	want := []Ack{
+		{Stream: "RULES", Consumer: "webhooks", Sequence: 1, Delivered: 1, Kind: "+ACK"},
+		{Stream: "RULES", Consumer: "webhooks", Sequence: 3, Delivered: 1, Kind: "-NAK"},
+		{Stream: "RULES", Consumer: "webhooks", Sequence: 3, Delivered: 2, Kind: "+ACK", Sync: true},
+	}
+	for i, a := range want {
+		if acks[i] != a {
+			t.Errorf("ack %d = %+v, want %+v", i, acks[i], a)
+		}
+	}
+	if info, _ := js.ConsumerInfo("RULES", "webhooks"); info.NumAckPending != 0 || info.NumPending != 0 {
+		t.Fatalf("info = %+v", info)
+	}
+}
+
+func TestStreamManagement(t *testing.T) {
+	s := NewServer(t)
+	nc := connect(t, s)
+	js, _ := nc.JetStream()
+
+	tests := []struct {
+		name    string
+		call    func() error
+		wantErr error
+		want    []string // RULES's subjects, nil when it is gone
+	}{
+		{name: "create", call: func() error {
+			_, err := js.AddStream(&nats.StreamConfig{Name: "RULES", Subjects: []string{"rules.>"}})
+			return err
+		}, want: []string{"rules.>"}},
+		{name: "create again", call: func() error {
+			_, err := js.AddStream(&nats.StreamConfig{Name: "RULES", Subjects: []string{"other.>"}})
+			return err
+		}, wantErr: nats.ErrStreamNameAlreadyInUse, want: []string{"rules.>"}},
+		{name: "update", call: func() error {
+			_, err := js.UpdateStream(&nats.StreamConfig{Name: "RULES", Subjects: []string{"rules.>", "audit.>"}})
+			return err
+		}, want: []string{"rules.>", "audit.>"}},
+		{name: "update missing", call: func() error {
+			_, err := js.UpdateStream(&nats.StreamConfig{Name: "MISSING", Subjects: []string{"missing.>"}})
+			return err
+		}, wantErr: nats.ErrStreamNotFound, want: []string{"rules.>", "audit.>"}},
+		{name: "delete", call: func() error { return js.DeleteStream("RULES") }},
+		{name: "delete missing", call: func() error { return js.DeleteStream("RULES") }, wantErr: nats.ErrStreamNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			cfg, ok := s.Stream("RULES")
+			if ok != (tt.want != nil) || !reflect.DeepEqual(cfg.Subjects, tt.want) {
+				t.Fatalf("RULES = %+v (%v), want subjects %v", cfg, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestJetStreamAckWaitAndDelay(t *testing.T) {
+	s := NewServer(t)
+	s.AddStream("RULES", "rules.>")
+	nc := connect(t, s)
+	js, _ := nc.JetStream()
+	js.AddConsumer("RULES", &nats.ConsumerConfig{Durable: "w", AckPolicy: nats.AckExplicitPolicy,
+		DeliverSubject: "deliver.w", AckWait: 50 * time.Millisecond, MaxDeliver: 3})
+	sub, _ := nc.SubscribeSync("deliver.w")
+	s.Publish("rules.a", nil, []byte("a"))
+
+	var deliveries []uint64
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		m, err := sub.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, _ := m.Metadata()
+		deliveries = append(deliveries, meta.NumDelivered)
+		if i == 1 {
+			m.NakWithDelay(100 * time.Millisecond)
+		}
+	}
+	if deliveries[2] != 3 || time.Since(start) < 150*time.Millisecond {
+		t.Fatalf("deliveries %v after %s", deliveries, time.Since(start))
+	}
+	// MaxDeliver reached: no more
+	if m, err := sub.NextMsg(200 * time.Millisecond); err == nil {
+		t.Fatalf("delivered again: %s", m.Reply)
+	}
+	if a := s.WaitForAcks(1)[0]; a.Kind != "-NAK" || a.Delay != 100*time.Millisecond {
+		t.Fatalf("ack = %+v", a)
+	}
+}
+
+func TestJetStreamPullConsumer(t *testing.T) {
+	s := NewServer(t)
+	s.AddStream("RULES", "rules.>")
+	nc := connect(t, s)
+	js, _ := nc.JetStream()
+	js.AddConsumer("RULES", &nats.ConsumerConfig{Durable: "pull", AckPolicy: nats.AckExplicitPolicy, FilterSubject: "rules.>"})
+	sub, err := js.PullSubscribe("rules.>", "pull", nats.Bind("RULES", "pull"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sub.Fetch(5, nats.MaxWait(100*time.Millisecond)); err != nats.ErrTimeout {
+		t.Fatalf("empty fetch: %v", err)
+	}
+	for _, d := range []string{"a", "b", "c"} {
+		s.Publish("rules.x", nil, []byte(d))
+	}
+	msgs, err := sub.Fetch(2, nats.MaxWait(time.Second))
+	if err != nil || len(msgs) != 2 || string(msgs[0].Data) != "a" {
+		t.Fatalf("fetch = %d, %v", len(msgs), err)
+	}
+	msgs, err = sub.Fetch(2, nats.MaxWait(200*time.Millisecond))
+	if err != nil || len(msgs) != 1 || string(msgs[0].Data) != "c" {
+		t.Fatalf("fetch = %d, %v", len(msgs), err)
+	}
+}
+
+func TestStopStart(t *testing.T) {
+	s := NewServer(t)
+	disconnected, reconnected := make(chan bool, 1), make(chan bool, 1)
+	nc, err := nats.Connect(s.URL(), nats.ReconnectWait(10*time.Millisecond), nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(*nats.Conn, error) { disconnected <- true }),
+		nats.ReconnectHandler(func(*nats.Conn) { reconnected <- true }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	s.Stop()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not disconnected")
+	}
+	s.Start()
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reconnected")
+	}
+}
+
+func TestStartPositionsAndGetMsg(t *testing.T) {
+	s := NewServer(t)
+	s.AddStream("RULES", "rules.>")
+	nc := connect(t, s)
+	js, _ := nc.JetStream()
+	for _, d := range []string{"a", "b", "c"} {
+		s.Publish("rules.x", nil, []byte(d))
+		time.Sleep(2 * time.Millisecond)
+	}
+	second := s.Messages("RULES")[1].Time
+
+	info, err := js.StreamInfo("RULES")
+	if err != nil || info.State.FirstSeq != 1 || info.State.LastSeq != 3 || info.State.FirstTime.IsZero() {
+		t.Fatalf("stream state = %+v, %v", info.State, err)
+	}
+	msg, err := js.GetMsg("RULES", 2)
+	if err != nil || string(msg.Data) != "b" || msg.Sequence != 2 || !msg.Time.Equal(second) {
+		t.Fatalf("GetMsg = %+v, %v", msg, err)
+	}
+	if _, err := js.GetMsg("RULES", 9); err != nats.ErrMsgNotFound {
+		t.Fatalf("missing message: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  nats.ConsumerConfig
+		want string
+	}{
+		{name: "all", cfg: nats.ConsumerConfig{}, want: "a"},
+		{name: "by sequence", cfg: nats.ConsumerConfig{DeliverPolicy: nats.DeliverByStartSequencePolicy, OptStartSeq: 3}, want: "c"},
+		{name: "by time", cfg: nats.ConsumerConfig{DeliverPolicy: nats.DeliverByStartTimePolicy, OptStartTime: &second}, want: "b"},
+		{name: "last", cfg: nats.ConsumerConfig{DeliverPolicy: nats.DeliverLastPolicy}, want: "c"},
+	}
+	for _, tt := range tests {
+		tt.cfg.Durable, tt.cfg.AckPolicy = tt.name, nats.AckExplicitPolicy
+		tt.cfg.Durable = strings.ReplaceAll(tt.cfg.Durable, " ", "-")
+		if _, err := js.AddConsumer("RULES", &tt.cfg); err != nil {
+			t.Fatal(err)
+		}
+		sub, _ := js.PullSubscribe("", tt.cfg.Durable, nats.Bind("RULES", tt.cfg.Durable))
+		msgs, err := sub.Fetch(1, nats.MaxWait(time.Second))
+		if err != nil || string(msgs[0].Data) != tt.want {
+			t.Fatalf("%s: fetched %v, %v; want %s", tt.name, msgs, err, tt.want)
+		}
+	}
+
+	// The ack floor stays below the oldest unacked message
+	js.AddConsumer("RULES", &nats.ConsumerConfig{Durable: "floor", AckPolicy: nats.AckExplicitPolicy})
+	sub, _ := js.PullSubscribe("", "floor", nats.Bind("RULES", "floor"))
+	msgs, _ := sub.Fetch(3, nats.MaxWait(time.Second))
+	msgs[0].AckSync()
+	msgs[2].AckSync()
+	if info, _ := js.ConsumerInfo("RULES", "floor"); info.AckFloor.Stream != 1 || info.Delivered.Stream != 3 {
+		t.Fatalf("ack floor %+v, delivered %+v", info.AckFloor, info.Delivered)
+	}
+	msgs[1].AckSync()
+	if info, _ := js.ConsumerInfo("RULES", "floor"); info.AckFloor.Stream != 3 {
+		t.Fatalf("ack floor %+v", info.AckFloor)
+	}
+}
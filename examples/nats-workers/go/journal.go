@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// processingTimeCount is the journaled count for TotalProcessingTimeMs
+const processingTimeCount = "processing_ms"
+
+// statsCounter is one of the message counters in stats
+type statsCounter struct {
+	outcome string
+	value   *uint64
+}
+
+// statsCounters are the message counters by outcome, as exported in
+// rule_worker_messages_total and journaled with settlements
+func statsCounters() []statsCounter {
+	return []statsCounter{
+		{"processed", &stats.MessagesProcessed},
+		{"succeeded", &stats.MessagesSucceeded},
+		{"failed", &stats.MessagesFailed},
+		{"expired", &stats.MessagesExpired},
+		{"duplicate", &stats.MessagesDuplicate},
+		{"deferred", &stats.MessagesDeferred},
+	}
+}
+
+// addStats adds counts to stats, by outcome or processingTimeCount
+func addStats(counts worker.Counts) {
+	for _, c := range statsCounters() {
+		if n := counts[c.outcome]; n > 0 {
+			atomic.AddUint64(c.value, n)
+		}
+	}
+	if n := counts[processingTimeCount]; n > 0 {
+		atomic.AddUint64(&stats.TotalProcessingTimeMs, n)
+	}
+}
+
+// settleMessage counts msg's outcome in stats and settles it. The counts,
+// with the "processed" counted when msg arrived, go into JOURNAL_PATH with
+// a settlement NATS cannot take yet, so a worker stopping before NATS is
+// back does not lose them.
+func settleMessage(msg *nats.Msg, err error, counts worker.Counts) {
+	addStats(counts)
+	journaled := worker.Counts{"processed": 1}
+	for name, n := range counts {
+		journaled[name] = n
+	}
+	consumer.SettleCounted(msg, err, journaled)
+}
+
+// replayJournalCounts adds the counts of messages a stopped worker
+// journaled but never reported to this worker's statistics, and writes
+// them through rule_nats_consumer_update_stats at once. An error leaves
+// them in the journal for the next try; the counters are only added to
+// once they are written.
+func replayJournalCounts(counts worker.Counts) error {
+	if extensionCompatible && hasCapability("consumer_stats") {
+		total := func(value *uint64, name string) uint64 {
+			return atomic.LoadUint64(value) + counts[name]
+		}
+		succeeded := total(&stats.MessagesSucceeded, "succeeded")
+		var avgTime float64
+		if succeeded > 0 {
+			avgTime = float64(total(&stats.TotalProcessingTimeMs, processingTimeCount)) / float64(succeeded)
+		}
+		var pending uint64
+		if lag := latestLag(); lag != nil {
+			pending = lag.NumPending
+		}
+		err := opsExec(consumerStatsUpdate, config.Worker.StreamName, config.Worker.ConsumerName,
+			total(&stats.MessagesProcessed, "processed"), succeeded, pending, avgTime)
+		if err != nil {
+			return err
+		}
+		err = opsExec(consumerCountsUpsert, config.Worker.StreamName, config.Worker.ConsumerName,
+			total(&stats.MessagesFailed, "failed"), total(&stats.MessagesExpired, "expired"))
+		if err != nil {
+			return err
+		}
+	}
+	addStats(counts)
+	return nil
+}
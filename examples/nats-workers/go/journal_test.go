@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/internal/natstest"
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+func TestAddStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts worker.Counts
+		want   Stats
+	}{
+		{name: "none"},
+		{name: "delivered", counts: worker.Counts{"succeeded": 1, processingTimeCount: 40},
+			want: Stats{MessagesSucceeded: 1, TotalProcessingTimeMs: 40}},
+		{name: "every outcome", counts: worker.Counts{"processed": 6, "succeeded": 1, "failed": 1, "expired": 1, "duplicate": 1, "deferred": 1},
+			want: Stats{MessagesProcessed: 6, MessagesSucceeded: 1, MessagesFailed: 1, MessagesExpired: 1, MessagesDuplicate: 1, MessagesDeferred: 1}},
+		{name: "unknown names are ignored", counts: worker.Counts{"retried": 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useStats(t, Stats{})
+			addStats(tt.counts)
+			if stats != tt.want {
+				t.Fatalf("stats = %+v, want %+v", stats, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayJournalCounts(t *testing.T) {
+	counts := worker.Counts{"processed": 3, "succeeded": 1, "failed": 1, "expired": 1, processingTimeCount: 60}
+	tests := []struct {
+		name       string
+		compatible bool
+		functions  []string // nil: every capability
+		err        error
+		wantWrite  bool
+		want       Stats // added to on success only
+	}{
+		{name: "written", compatible: true, wantWrite: true,
+			want: Stats{MessagesProcessed: 13, MessagesSucceeded: 5, MessagesFailed: 4, MessagesExpired: 3, TotalProcessingTimeMs: 160}},
+		// Kept in the journal: the counters are not added to twice
+		{name: "database unavailable", compatible: true, wantWrite: true, err: &pq.Error{Code: "57P01", Message: "terminating connection"},
+			want: Stats{MessagesProcessed: 10, MessagesSucceeded: 4, MessagesFailed: 3, MessagesExpired: 2, TotalProcessingTimeMs: 100}},
+		{name: "unsupported extension", compatible: false,
+			want: Stats{MessagesProcessed: 13, MessagesSucceeded: 5, MessagesFailed: 4, MessagesExpired: 3, TotalProcessingTimeMs: 160}},
+		{name: "function missing", compatible: true, functions: []string{},
+			want: Stats{MessagesProcessed: 13, MessagesSucceeded: 5, MessagesFailed: 4, MessagesExpired: 3, TotalProcessingTimeMs: 160}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := mockOpsDB(t)
+			useConsumer(t)
+			useExtension(t, "1.8.0", tt.compatible)
+			useLag(t, &LagSample{NumPending: 7})
+			if tt.functions != nil {
+				useCapabilities(t, tt.functions...)
+			} else {
+				assumeCapabilities(t)
+			}
+			useStats(t, Stats{MessagesProcessed: 10, MessagesSucceeded: 4, MessagesFailed: 3, MessagesExpired: 2, TotalProcessingTimeMs: 100})
+			prevAttempts := config.Postgres.RetryAttempts
+			t.Cleanup(func() { config.Postgres.RetryAttempts = prevAttempts })
+			config.Postgres.RetryAttempts = 1
+
+			if tt.wantWrite {
+				// The totals with the journaled counts: 160ms over 5 deliveries
+				exec := ops.ExpectExec(`SELECT rule_nats_consumer_update_stats\(\$1, \$2, \$3, \$4, \$5, \$6\)`).
+					WithArgs("RULES", "webhooks", int64(13), int64(5), int64(7), 32.0)
+				if tt.err != nil {
+					exec.WillReturnError(tt.err)
+				} else {
+					exec.WillReturnResult(sqlmock.NewResult(0, 1))
+					ops.ExpectExec(`INSERT INTO rule_nats_consumer_stats \(stream_name, consumer_name, messages_failed, messages_expired\)`).
+						WithArgs("RULES", "webhooks", int64(4), int64(3)).
+						WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+			}
+			err := replayJournalCounts(counts)
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if got := stats; got.MessagesProcessed != tt.want.MessagesProcessed || got.MessagesSucceeded != tt.want.MessagesSucceeded ||
+				got.MessagesFailed != tt.want.MessagesFailed || got.MessagesExpired != tt.want.MessagesExpired ||
+				got.TotalProcessingTimeMs != tt.want.TotalProcessingTimeMs {
+				t.Fatalf("stats = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSettleMessageJournalsCounts(t *testing.T) {
+	prevConsumer := consumer
+	t.Cleanup(func() { consumer = prevConsumer })
+	useStats(t, Stats{})
+	srv := natstest.NewServer(t)
+	srv.AddStream("RULES", "rules.>")
+	path := filepath.Join(t.TempDir(), "acks.journal")
+	opts := worker.Options{NATSURL: srv.URL(), Stream: "RULES", Consumer: "webhooks", Subject: "rules.>", JournalPath: path,
+		Logger: log.New(io.Discard, "", 0), NATSOptions: []nats.Option{nats.ReconnectWait(10 * time.Millisecond), nats.MaxReconnects(-1)}}
+	w, err := worker.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer = w
+
+	srv.Stop()
+	waitFor(t, "disconnect", func() bool { return !w.Conn().IsConnected() })
+	msg := &nats.Msg{Subject: "rules.orders", Reply: "$JS.ACK.RULES.webhooks.1.5.5.1714564800000000000.0", Sub: &nats.Subscription{}}
+	settleMessage(msg, nil, worker.Counts{"succeeded": 1, processingTimeCount: 40})
+	if stats.MessagesSucceeded != 1 || stats.TotalProcessingTimeMs != 40 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if w.JournalPending() != 1 {
+		t.Fatalf("%d settlement(s) journaled", w.JournalPending())
+	}
+	// Stopped before NATS is back
+	w.Close()
+
+	srv.Start()
+	replayed := make(chan worker.Counts, 1)
+	opts.ReplayCounts = func(c worker.Counts) error {
+		replayed <- c
+		return nil
+	}
+	next, err := worker.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(next.Close)
+	next.RegisterHandler("rules.>", func(context.Context, *nats.Msg) error { return nil })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- next.Run(ctx) }()
+	t.Cleanup(func() { cancel(); <-done })
+
+	select {
+	case c := <-replayed:
+		// With the processed count taken when the message arrived
+		if want := (worker.Counts{"processed": 1, "succeeded": 1, processingTimeCount: 40}); !reflect.DeepEqual(c, want) {
+			t.Fatalf("replayed %v, want %v", c, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("counts not replayed")
+	}
+	if a := srv.WaitForAcks(1)[0]; a.Kind != "+ACK" || a.Sequence != 5 {
+		t.Fatalf("ack = %+v", a)
+	}
+}
+
+func TestSettleMessageConnectionClosed(t *testing.T) {
+	prevConsumer := consumer
+	t.Cleanup(func() { consumer = prevConsumer })
+	useStats(t, Stats{})
+	srv := natstest.NewServer(t)
+	srv.AddStream("RULES", "rules.>")
+	w, err := worker.New(worker.Options{NATSURL: srv.URL(), Stream: "RULES", Consumer: "webhooks", Subject: "rules.>",
+		JournalPath: filepath.Join(t.TempDir(), "acks.journal"), Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.Close)
+	consumer = w
+	// A closed connection is not coming back on its own: the settlement
+	// waits in the journal for the next start
+	w.Conn().Close()
+	msg := &nats.Msg{Subject: "rules.orders", Reply: "$JS.ACK.RULES.webhooks.1.6.6.1714564800000000000.0", Sub: &nats.Subscription{}}
+	settleMessage(msg, errors.New("timeout"), worker.Counts{"failed": 1})
+	if w.JournalPending() != 1 || stats.MessagesFailed != 1 {
+		t.Fatalf("%d journaled, stats = %+v", w.JournalPending(), stats)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// LagSample is a point-in-time view of the durable consumer's backlog
+type LagSample struct {
+	NumPending       uint64    `json:"num_pending"`
+	NumRedelivered   int       `json:"num_redelivered"`
+	NumAckPending    int       `json:"num_ack_pending"`
+	AckFloorStream   uint64    `json:"ack_floor_stream_seq"`
+	AckFloorConsumer uint64    `json:"ack_floor_consumer_seq"`
+	SampledAt        time.Time `json:"sampled_at"`
+}
+
+var (
+	lagMu      sync.Mutex
+	lastLag    *LagSample
+	lagAlerted bool
+)
+
+func init() {
+	expvar.Publish("consumer_lag", expvar.Func(func() interface{} {
+		return latestLag()
+	}))
+}
+
+// latestLag returns the most recent sample, or nil before the first one
+func latestLag() *LagSample {
+	lagMu.Lock()
+	defer lagMu.Unlock()
+	return lastLag
+}
+
+// startLagMonitor samples consumer info every LAG_SAMPLE_INTERVAL_SECONDS,
+// records it in Postgres, and fires the lag alert when the backlog crosses
+// LAG_ALERT_THRESHOLD.
+func startLagMonitor(nc *nats.Conn, js nats.JetStreamContext) {
+	if config.Lag.IntervalSeconds <= 0 {
+		return
+	}
+	interval := time.Duration(config.Lag.IntervalSeconds) * time.Second
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			sample, err := sampleLag(js)
+			if err != nil {
+				log.Printf("⚠️  Failed to sample consumer lag: %v", err)
+				continue
+			}
+			recordLag(sample)
+			checkLagAlert(nc, sample)
+		}
+	}()
+}
+
+func sampleLag(js nats.JetStreamContext) (*LagSample, error) {
+	info, err := js.ConsumerInfo(config.Worker.StreamName, config.Worker.ConsumerName)
+	if err != nil {
+		return nil, err
+	}
+
+	sample := &LagSample{
+		NumPending:       info.NumPending,
+		NumRedelivered:   info.NumRedelivered,
+		NumAckPending:    info.NumAckPending,
+		AckFloorStream:   info.AckFloor.Stream,
+		AckFloorConsumer: info.AckFloor.Consumer,
+		SampledAt:        time.Now(),
+	}
+
+	lagMu.Lock()
+	lastLag = sample
+	lagMu.Unlock()
+	return sample, nil
+}
+
+func recordLag(sample *LagSample) {
+	err := opsWrite("lag",
+		`INSERT INTO rule_nats_consumer_stats (
+		     stream_name, consumer_name, messages_pending, messages_redelivered,
+		     ack_floor_stream_seq, ack_floor_consumer_seq, lag_sampled_at
+		 ) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 ON CONFLICT (stream_name, consumer_name) DO UPDATE SET
+		     messages_pending = EXCLUDED.messages_pending,
+		     messages_redelivered = EXCLUDED.messages_redelivered,
+		     ack_floor_stream_seq = EXCLUDED.ack_floor_stream_seq,
+		     ack_floor_consumer_seq = EXCLUDED.ack_floor_consumer_seq,
+		     lag_sampled_at = EXCLUDED.lag_sampled_at`,
+		config.Worker.StreamName,
+		config.Worker.ConsumerName,
+		sample.NumPending,
+		sample.NumRedelivered,
+		sample.AckFloorStream,
+		sample.AckFloorConsumer,
+		sample.SampledAt,
+	)
+	if err != nil && !errors.Is(err, errOpsBuffered) {
+		log.Printf("⚠️  Failed to record consumer lag: %v", err)
+	}
+}
+
+// checkLagAlert alerts once when pending crosses the threshold and again
+// only after the backlog has drained below it.
+func checkLagAlert(nc *nats.Conn, sample *LagSample) {
+	if config.Lag.AlertThreshold <= 0 {
+		return
+	}
+	over := sample.NumPending >= uint64(config.Lag.AlertThreshold)
+
+	lagMu.Lock()
+	fire := over && !lagAlerted
+	recovered := !over && lagAlerted
+	lagAlerted = over
+	lagMu.Unlock()
+
+	if recovered {
+		log.Printf("✅ Consumer lag recovered: %d pending", sample.NumPending)
+	}
+	if !fire {
+		return
+	}
+
+	log.Printf("🚨 Consumer lag %d exceeds threshold %d", sample.NumPending, config.Lag.AlertThreshold)
+
+	sendAlert(nc, "lag", map[string]interface{}{
+		"event":     "consumer.lag_exceeded",
+		"stream":    config.Worker.StreamName,
+		"consumer":  config.Worker.ConsumerName,
+		"threshold": config.Lag.AlertThreshold,
+		"lag":       sample,
+	})
+}
+
+// sendAlert publishes an alert event to LAG_ALERT_SUBJECT and posts it to
+// LAG_ALERT_WEBHOOK_URL, whichever are set. kind names it in log lines.
+func sendAlert(nc *nats.Conn, kind string, event map[string]interface{}) {
+	alert, _ := json.Marshal(event)
+
+	if config.Lag.AlertSubject != "" {
+		if err := nc.Publish(config.Lag.AlertSubject, alert); err != nil {
+			log.Printf("⚠️  Failed to publish %s alert: %v", kind, err)
+		}
+	}
+
+	if config.Lag.AlertWebhookURL != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(config.Lag.AlertWebhookURL, "application/json", bytes.NewReader(alert))
+		if err != nil {
+			log.Printf("⚠️  Failed to send %s alert: %v", kind, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("⚠️  Alert webhook returned %d for the %s alert", resp.StatusCode, kind)
+		}
+	}
+}
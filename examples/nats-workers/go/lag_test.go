@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestCheckLagAlert(t *testing.T) {
+	var mu sync.Mutex
+	var alerts []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("alert body: %v", err)
+		}
+		mu.Lock()
+		alerts = append(alerts, event)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	saved := config.Lag
+	defer func() { config.Lag = saved; lagAlerted = false }()
+	config.Lag.AlertThreshold = 100
+	config.Lag.AlertSubject = ""
+	config.Lag.AlertWebhookURL = srv.URL
+	lagAlerted = false
+
+	// Alerts fire on crossing the threshold, not on every sample above it
+	steps := []struct {
+		pending uint64
+		alerts  int
+	}{
+		{pending: 10, alerts: 0},
+		{pending: 100, alerts: 1},
+		{pending: 500, alerts: 1},
+		{pending: 99, alerts: 1},
+		{pending: 150, alerts: 2},
+	}
+	for i, step := range steps {
+		checkLagAlert(nil, &LagSample{NumPending: step.pending})
+		mu.Lock()
+		got := len(alerts)
+		mu.Unlock()
+		if got != step.alerts {
+			t.Fatalf("step %d (pending %d): %d alerts, want %d", i, step.pending, got, step.alerts)
+		}
+	}
+	if alerts[0]["event"] != "consumer.lag_exceeded" {
+		t.Fatalf("event = %v", alerts[0]["event"])
+	}
+}
+
+func TestCheckLagAlertDisabled(t *testing.T) {
+	saved := config.Lag
+	defer func() { config.Lag = saved; lagAlerted = false }()
+	config.Lag.AlertThreshold = 0
+	lagAlerted = false
+	checkLagAlert(nil, &LagSample{NumPending: 1 << 40})
+	if lagAlerted {
+		t.Fatal("alert state changed with no threshold")
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Singleton tasks (housekeeping that must run on exactly one replica) run
+// only on the elected leader of LEADER_GROUP. Election uses a Postgres
+// advisory lock held on a dedicated connection, or a key in a NATS
+// key-value bucket whose TTL expires when the leader stops refreshing it.
+// Either way a leader that dies is replaced within a lease or two.
+
+// leaderElector is one election backend
+type leaderElector interface {
+	// campaign tries to become leader, or to stay leader, and reports
+	// whether this worker leads
+	campaign(ctx context.Context) (bool, error)
+	// resign gives up leadership, if held
+	resign()
+}
+
+// singletonTask is housekeeping registered with registerSingleton
+type singletonTask struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+}
+
+var (
+	singletonTasks []*singletonTask
+
+	// leaderStop ends campaignLoop, which resigns and closes leaderDone
+	leaderStop = make(chan struct{})
+	leaderDone = make(chan struct{})
+
+	leaderMu    sync.Mutex
+	isLeader    bool
+	leaderSince time.Time
+)
+
+// registerSingleton adds a task that runs every interval on the leader
+func registerSingleton(name string, interval time.Duration, run func(ctx context.Context) error) {
+	singletonTasks = append(singletonTasks, &singletonTask{name: name, interval: interval, run: run})
+}
+
+// workerID identifies this process in elections and logs
+func workerID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// startLeaderElection campaigns in the background and runs the singleton
+// tasks while this worker leads. With LEADER_ELECTION=none every worker
+// runs them, which is only correct for a single replica.
+func startLeaderElection(js nats.JetStreamContext) error {
+	if len(singletonTasks) == 0 {
+		return nil
+	}
+
+	var elector leaderElector
+	switch config.Leader.Backend {
+	case "none":
+		log.Printf("👑 Leader election off, running singleton tasks on this worker")
+		setLeader(true)
+		go runSingletonTasks(context.Background())
+		return nil
+	case "postgres":
+		elector = &postgresElector{key: "rule-engine-worker:" + config.Leader.Group}
+	case "nats":
+		kv, err := leaderBucket(js)
+		if err != nil {
+			return err
+		}
+		elector = &natsElector{kv: kv, key: natsLeaderKey(config.Leader.Group), id: workerID()}
+	default:
+		return fmt.Errorf("LEADER_ELECTION must be postgres, nats, or none, not %q", config.Leader.Backend)
+	}
+
+	go campaignLoop(elector)
+	return nil
+}
+
+// stopLeaderElection resigns leadership on shutdown so another replica
+// takes over without waiting for the lease to expire
+func stopLeaderElection() {
+	select {
+	case <-leaderStop:
+		return
+	default:
+	}
+	close(leaderStop)
+	select {
+	case <-leaderDone:
+	case <-time.After(10 * time.Second):
+	}
+}
+
+// campaignLoop renews or seeks leadership three times per lease
+func campaignLoop(elector leaderElector) {
+	defer close(leaderDone)
+	lease := time.Duration(config.Leader.LeaseSeconds) * time.Second
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+
+	var cancelTasks context.CancelFunc
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), lease/3)
+		leading, err := elector.campaign(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("⚠️  Leader election: %v", err)
+		}
+
+		switch {
+		case leading && cancelTasks == nil:
+			log.Printf("👑 Elected leader of %s (%s)", config.Leader.Group, config.Leader.Backend)
+			setLeader(true)
+			var tasksCtx context.Context
+			tasksCtx, cancelTasks = context.WithCancel(context.Background())
+			go runSingletonTasks(tasksCtx)
+		case !leading && cancelTasks != nil:
+			log.Printf("👑 Lost leadership of %s, stopping singleton tasks", config.Leader.Group)
+			setLeader(false)
+			cancelTasks()
+			cancelTasks = nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-leaderStop:
+			if cancelTasks != nil {
+				cancelTasks()
+				setLeader(false)
+			}
+			elector.resign()
+			return
+		}
+	}
+}
+
+func setLeader(leading bool) {
+	leaderMu.Lock()
+	defer leaderMu.Unlock()
+	isLeader = leading
+	leaderSince = time.Now()
+}
+
+// runSingletonTasks runs each task once immediately and then every
+// interval until ctx is cancelled
+func runSingletonTasks(ctx context.Context) {
+	for _, task := range singletonTasks {
+		go func(task *singletonTask) {
+			ticker := time.NewTicker(task.interval)
+			defer ticker.Stop()
+			for {
+				if err := task.run(ctx); err != nil && ctx.Err() == nil {
+					log.Printf("⚠️  Singleton task %s failed: %v", task.name, err)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(task)
+	}
+}
+
+// postgresElector holds a session-level advisory lock on a dedicated
+// connection. Postgres releases the lock when that session ends, so a
+// crashed leader's lock is freed with its connection.
+type postgresElector struct {
+	key  string
+	conn *sql.Conn
+}
+
+func (e *postgresElector) campaign(ctx context.Context) (bool, error) {
+	if e.conn != nil {
+		// Still leader as long as the session holding the lock is alive
+		if err := e.conn.PingContext(ctx); err != nil {
+			e.discard()
+			return false, fmt.Errorf("lost leader session: %w", err)
+		}
+		return true, nil
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	e.conn = conn
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`, e.key).Scan(&acquired); err != nil {
+		// The lock may have been granted before the error; never return
+		// this session to the pool
+		e.discard()
+		return false, err
+	}
+	if !acquired {
+		conn.Close()
+		e.conn = nil
+		return false, nil
+	}
+	return true, nil
+}
+
+// discard closes the leader session instead of returning it to the pool,
+// where it would keep holding the lock
+func (e *postgresElector) discard() {
+	e.conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	e.conn.Close()
+	e.conn = nil
+}
+
+func (e *postgresElector) resign() {
+	if e.conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e.conn.ExecContext(ctx, `SELECT pg_advisory_unlock(hashtext($1))`, e.key)
+	e.conn.Close()
+	e.conn = nil
+}
+
+// natsElector owns a key in a KV bucket whose TTL is the lease. The leader
+// rewrites the key at its last revision; if it stops, the key expires and
+// another worker can create it.
+type natsElector struct {
+	kv       nats.KeyValue
+	key      string
+	id       string
+	revision uint64
+}
+
+// leaderBucket returns the election bucket, creating it with the lease as
+// its TTL
+func leaderBucket(js nats.JetStreamContext) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(config.Leader.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  config.Leader.Bucket,
+			History: 1,
+			TTL:     time.Duration(config.Leader.LeaseSeconds) * time.Second,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("leader election bucket %s: %w", config.Leader.Bucket, err)
+	}
+	return kv, nil
+}
+
+var natsKeyUnsafe = regexp.MustCompile(`[^-/_=.a-zA-Z0-9]`)
+
+func natsLeaderKey(group string) string {
+	return natsKeyUnsafe.ReplaceAllString(group, "_")
+}
+
+func (e *natsElector) campaign(ctx context.Context) (bool, error) {
+	if e.revision != 0 {
+		revision, err := e.kv.Update(e.key, []byte(e.id), e.revision)
+		if err != nil {
+			e.revision = 0
+			return false, fmt.Errorf("lost leader key: %w", err)
+		}
+		e.revision = revision
+		return true, nil
+	}
+
+	revision, err := e.kv.Create(e.key, []byte(e.id))
+	if errors.Is(err, nats.ErrKeyExists) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	e.revision = revision
+	return true, nil
+}
+
+func (e *natsElector) resign() {
+	if e.revision == 0 {
+		return
+	}
+	e.kv.Delete(e.key, nats.LastRevision(e.revision))
+	e.revision = 0
+}
+
+func init() {
+	expvar.Publish("leader", expvar.Func(func() interface{} {
+		leaderMu.Lock()
+		defer leaderMu.Unlock()
+		tasks := make([]string, len(singletonTasks))
+		for i, task := range singletonTasks {
+			tasks[i] = task.name
+		}
+		return map[string]interface{}{
+			"backend": config.Leader.Backend,
+			"group":   config.Leader.Group,
+			"leader":  isLeader,
+			"since":   leaderSince,
+			"tasks":   tasks,
+		}
+	}))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+)
+
+func TestPostgresElector(t *testing.T) {
+	mock := mockDB(t)
+	mock.MatchExpectationsInOrder(true)
+	e := &postgresElector{key: "rule-engine-worker:orders"}
+	ctx := context.Background()
+
+	// Another worker holds the lock
+	mock.ExpectQuery(`pg_try_advisory_lock\(hashtext\(\$1\)\)`).WithArgs(e.key).
+		WillReturnRows(sqlmock.NewRows([]string{"acquired"}).AddRow(false))
+	if leading, err := e.campaign(ctx); leading || err != nil {
+		t.Fatalf("campaign = %v, %v", leading, err)
+	}
+	if e.conn != nil {
+		t.Fatal("session kept without the lock")
+	}
+
+	// Acquired, then kept while the session answers
+	mock.ExpectQuery("pg_try_advisory_lock").WithArgs(e.key).
+		WillReturnRows(sqlmock.NewRows([]string{"acquired"}).AddRow(true))
+	if leading, err := e.campaign(ctx); !leading || err != nil {
+		t.Fatalf("campaign = %v, %v", leading, err)
+	}
+	if leading, err := e.campaign(ctx); !leading || err != nil {
+		t.Fatalf("renewal = %v, %v", leading, err)
+	}
+
+	mock.ExpectExec(`pg_advisory_unlock\(hashtext\(\$1\)\)`).WithArgs(e.key).WillReturnResult(sqlmock.NewResult(0, 0))
+	e.resign()
+	if e.conn != nil {
+		t.Fatal("session kept after resign")
+	}
+	e.resign() // not leading: nothing to do
+}
+
+func TestPostgresElectorDiscardsFailedSession(t *testing.T) {
+	mock := mockDB(t)
+	e := &postgresElector{key: "rule-engine-worker:orders"}
+
+	mock.ExpectQuery("pg_try_advisory_lock").WillReturnError(errors.New("canceling statement due to statement timeout"))
+	if leading, err := e.campaign(context.Background()); leading || err == nil {
+		t.Fatalf("campaign = %v, %v", leading, err)
+	}
+	if e.conn != nil {
+		t.Fatal("a session that may hold the lock went back to the pool")
+	}
+}
+
+// fakeKV is an in-memory nats.KeyValue with the revision checks of a
+// real bucket; only the methods the elector uses are implemented
+type fakeKV struct {
+	nats.KeyValue
+	mu       sync.Mutex
+	values   map[string]string
+	revision map[string]uint64
+	next     uint64
+}
+
+func newFakeKV() *fakeKV {
+	return &fakeKV{values: map[string]string{}, revision: map[string]uint64{}}
+}
+
+func (kv *fakeKV) Create(key string, value []byte) (uint64, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if _, ok := kv.values[key]; ok {
+		return 0, nats.ErrKeyExists
+	}
+	kv.next++
+	kv.values[key], kv.revision[key] = string(value), kv.next
+	return kv.next, nil
+}
+
+func (kv *fakeKV) Update(key string, value []byte, last uint64) (uint64, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.revision[key] != last {
+		return 0, errors.New("nats: wrong last sequence")
+	}
+	kv.next++
+	kv.values[key], kv.revision[key] = string(value), kv.next
+	return kv.next, nil
+}
+
+func (kv *fakeKV) Delete(key string, opts ...nats.DeleteOpt) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	delete(kv.values, key)
+	delete(kv.revision, key)
+	return nil
+}
+
+// expire drops a key, as the bucket TTL does
+func (kv *fakeKV) expire(key string) {
+	kv.Delete(key)
+}
+
+func TestNATSElector(t *testing.T) {
+	kv := newFakeKV()
+	ctx := context.Background()
+	a := &natsElector{kv: kv, key: natsLeaderKey("orders"), id: "host-a/1"}
+	b := &natsElector{kv: kv, key: natsLeaderKey("orders"), id: "host-b/2"}
+
+	steps := []struct {
+		name  string
+		do    func()
+		a, b  bool
+		owner string
+	}{
+		{name: "a creates the key", a: true, b: false, owner: "host-a/1"},
+		{name: "a renews", a: true, b: false, owner: "host-a/1"},
+		{name: "lease expires, b takes over", do: func() { kv.expire("orders") }, a: false, b: true, owner: "host-b/2"},
+		{name: "b resigns, a returns", do: func() { b.resign() }, a: true, b: false, owner: "host-a/1"},
+	}
+	for _, step := range steps {
+		if step.do != nil {
+			step.do()
+		}
+		// The deposed leader campaigns first, so it sees the key gone
+		leadingA, _ := a.campaign(ctx)
+		leadingB, _ := b.campaign(ctx)
+		if leadingA != step.a || leadingB != step.b || kv.values["orders"] != step.owner {
+			t.Fatalf("%s: a=%v b=%v owner=%q", step.name, leadingA, leadingB, kv.values["orders"])
+		}
+	}
+}
+
+func TestNATSLeaderKey(t *testing.T) {
+	tests := map[string]string{
+		"orders":           "orders",
+		"prod/orders-eu.1": "prod/orders-eu.1",
+		"team a:orders*":   "team_a_orders_",
+	}
+	for group, want := range tests {
+		if got := natsLeaderKey(group); got != want {
+			t.Errorf("natsLeaderKey(%q) = %q, want %q", group, got, want)
+		}
+	}
+}
+
+// scriptedElector reports the leadership results it is given, in turn
+type scriptedElector struct {
+	mu       sync.Mutex
+	results  []bool
+	calls    int
+	resigned bool
+}
+
+func (e *scriptedElector) campaign(ctx context.Context) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.calls++
+	if e.calls > len(e.results) {
+		return e.results[len(e.results)-1], nil
+	}
+	return e.results[e.calls-1], nil
+}
+
+func (e *scriptedElector) resign() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.resigned = true
+}
+
+func TestCampaignLoopRunsTasksWhileLeading(t *testing.T) {
+	prevTasks, prevStop, prevDone, prevLease := singletonTasks, leaderStop, leaderDone, config.Leader.LeaseSeconds
+	t.Cleanup(func() {
+		singletonTasks, leaderStop, leaderDone, config.Leader.LeaseSeconds = prevTasks, prevStop, prevDone, prevLease
+		setLeader(false)
+	})
+	leaderStop, leaderDone = make(chan struct{}), make(chan struct{})
+	config.Leader.LeaseSeconds = 1
+
+	var mu sync.Mutex
+	running, cancelled := 0, 0
+	singletonTasks = []*singletonTask{{name: "retention", interval: time.Hour, run: func(ctx context.Context) error {
+		mu.Lock()
+		running++
+		mu.Unlock()
+		<-ctx.Done()
+		mu.Lock()
+		cancelled++
+		mu.Unlock()
+		return nil
+	}}}
+
+	// Leads for two rounds, loses it, then leads again
+	elector := &scriptedElector{results: []bool{true, true, false, true}}
+	go campaignLoop(elector)
+
+	waitFor(t, "second term", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return running == 2 && cancelled == 1
+	})
+	leaderMu.Lock()
+	leading := isLeader
+	leaderMu.Unlock()
+	if !leading {
+		t.Fatal("not marked leader")
+	}
+
+	stopLeaderElection()
+	waitFor(t, "resignation", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return cancelled == 2
+	})
+	elector.mu.Lock()
+	defer elector.mu.Unlock()
+	if !elector.resigned {
+		t.Fatal("did not resign on shutdown")
+	}
+}
+
+// waitFor polls cond until it holds or five seconds pass
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,32 +1,44 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
-	"os/signal"
+	"strings"
 	"sync/atomic"
-	"syscall"
 	"time"
 
-	"github.com/nats-io/nats.go"
 	_ "github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/buildinfo"
+	"github.com/rule-engine/nats-webhook-worker/ruleengine/envelope"
+	"github.com/rule-engine/nats-webhook-worker/worker"
 )
 
-// Configuration loaded from environment variables
+// Configuration loaded from defaults, a config file, and environment
+// variables (see config.go)
 type Config struct {
 	NATS struct {
-		URL        string
-		User       string
-		Pass       string
+		URL         string
+		User        string
+		Pass        string
+		JournalPath string
 	}
 	Postgres struct {
-		URL string
+		URL            string
+		OpsURL         string
+		OpsMaxConns    int
+		OpsBufferSize  int
+		ReplicaURL     string
+		StandbyURL     string
+		RetryAttempts  int
+		ExtensionCheck string
 	}
 	Worker struct {
 		StreamName   string
@@ -34,41 +46,237 @@ type Config struct {
 		QueueGroup   string
 		Subject      string
 		BatchSize    int
+
+		HandlerTimeoutSeconds     int
+		NakBackoff                string
+		AckSyncSubjects           string
+		ExactlyOnceSubjects       string
+		ExactlyOnceRetentionHours int
+		MaxAckPending             int
+		MaxPayloadBytes           int
+		PriorityLanes             string
+		SubjectWeight             int
+		Fetchers                  int
+	}
+	Admin struct {
+		Addr        string
+		Token       string
+		EnablePprof bool
+		EnableUI    bool
+
+		TLSCertFile     string
+		TLSKeyFile      string
+		TLSClientCAFile string
+		TLSAllowedSANs  string
+	}
+	Lag struct {
+		IntervalSeconds int
+		AlertThreshold  int
+		AlertSubject    string
+		AlertWebhookURL string
+	}
+	Heartbeat struct {
+		IntervalSeconds  int
+		DeadAfterSeconds int
+		AlertRuleSet     int
+	}
+	Dedup struct {
+		WindowSeconds int
+		Backend       string
+		CacheSize     int
+	}
+	Leader struct {
+		Backend      string
+		Group        string
+		LeaseSeconds int
+		Bucket       string
+	}
+	Retention struct {
+		Window string
+	}
+	StoredPayload struct {
+		Serializer    string
+		Keep          string
+		MaxArrayItems int
+	}
+	Audit struct {
+		FlushIntervalMs      int
+		BatchSize            int
+		BufferSize           int
+		SuccessSamplePercent int
+		FailureSamplePercent int
+	}
+	Log struct {
+		SuccessSamplePercent int
+		FailureSamplePercent int
+	}
+	Stats struct {
+		TenantField      string
+		TenantToken      int
+		RawRetentionDays int
+		Rules            bool
+		Transactional    bool
+	}
+	HealthCheck struct {
+		IntervalSeconds  int
+		TimeoutMs        int
+		FailureThreshold int
+		OpenCircuit      bool
+	}
+	Schedules struct {
+		PollSeconds int
+	}
+	Windows struct {
+		Subjects string
+	}
+	Correlations struct {
+		Subjects string
+	}
+	CloudEvents struct {
+		Inbound  bool
+		Outbound string
+		Source   string
+		Type     string
+	}
+	Decoders struct {
+		Subjects               string
+		SchemaRegistryURL      string
+		SchemaRegistryUser     string
+		SchemaRegistryPassword string
+		ProtobufDescriptorSet  string
+	}
+	MQTT struct {
+		URL              string
+		User             string
+		Pass             string
+		ClientID         string
+		Topics           string
+		QoS              int
+		ShareGroup       string
+		Direct           bool
+		KeepAliveSeconds int
+	}
+	FailureAlerts struct {
+		Minutes int
+		Action  string
+		Subject string
+		Link    string
+	}
+	CDC struct {
+		DatabaseURL    string
+		Tables         string
+		Plugin         string
+		Slot           string
+		Publication    string
+		SubjectPrefix  string
+		PollIntervalMs int
+		BatchSize      int
+	}
+	Chaos struct {
+		Enabled            bool
+		DBDelayPercent     int
+		DBDelayMaxMs       int
+		HTTPFailurePercent int
+		AckDropPercent     int
+		ConnKillPercent    int
 	}
 }
 
 // WebhookPayload represents the expected message format
 type WebhookPayload struct {
-	WebhookURL string                 `json:"webhook_url"`
-	Data       map[string]interface{} `json:"data"`
-	Headers    map[string]string      `json:"headers"`
+	WebhookURL   string                 `json:"webhook_url"`
+	WebhookID    int                    `json:"webhook_id,omitempty"` // Registered destination in rule_webhooks
+	Data         map[string]interface{} `json:"data"`
+	Headers      map[string]string      `json:"headers"`
+	ExpiresAt    *time.Time             `json:"expires_at,omitempty"` // Absolute delivery deadline
+	TTL          int64                  `json:"ttl,omitempty"`        // Seconds after publish before the message goes stale
+	Method       string                 `json:"method,omitempty"`     // GET, POST, PUT, PATCH, or DELETE
+	Query        map[string]string      `json:"query,omitempty"`      // Query parameters added to the URL
+	EventKey     string                 `json:"event_key,omitempty"`  // Identifies the entity/event for dedup
+	ContentType  string                 `json:"content_type,omitempty"`
+	Body         string                 `json:"body,omitempty"`        // Literal text/XML body
+	BodyBase64   string                 `json:"body_base64,omitempty"` // Raw binary body
+	BodyTemplate string                 `json:"body_template,omitempty"`
+	Action       string                 `json:"action,omitempty"` // Configured action in rule_actions; webhook when empty
+	Rule         string                 `json:"rule,omitempty"`   // Rule that produced the message, for rule statistics
+
+	// rawData is Data's JSON as received (see dataJSON)
+	rawData json.RawMessage
 }
 
 // Statistics tracker
 type Stats struct {
-	MessagesProcessed uint64
-	MessagesSucceeded uint64
-	MessagesFailed    uint64
+	MessagesProcessed     uint64
+	MessagesSucceeded     uint64
+	MessagesFailed        uint64
+	MessagesExpired       uint64
+	MessagesDuplicate     uint64
+	MessagesDeferred      uint64
 	TotalProcessingTimeMs uint64
-	StartTime         time.Time
+	StartTime             time.Time
 }
 
 var (
-	config Config
-	stats  Stats
-	db     *sql.DB
+	config     Config
+	configFile string
+	stats      Stats
+	db         *sql.DB
+
+	// consumer settles messages by its ack policy, including those whose
+	// actions finish after the handler returns
+	consumer *worker.Worker
 )
 
+// journalPending is the number of settlements waiting in JOURNAL_PATH
+func journalPending() int {
+	if consumer == nil {
+		return 0
+	}
+	return consumer.JournalPending()
+}
+
 func main() {
-	log.Println("🚀 Starting NATS Webhook Worker (Go)")
+	// install/uninstall register the worker with systemd or Windows;
+	// snapshot/restore move its consumer to another NATS cluster, and
+	// cutover to another name or subject
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		if os.Args[1] == "snapshot" || os.Args[1] == "restore" || os.Args[1] == "cutover" {
+			os.Exit(consumerStateCommand(os.Args[1], os.Args[2:]))
+		}
+		os.Exit(serviceCommand(os.Args[1], os.Args[2:]))
+	}
+	flag.StringVar(&configFile, "config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file; environment variables override it")
+	validateOnly := flag.Bool("validate-only", false, "check the configuration, print it, and exit (1 if invalid)")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
 
-	// Load configuration
-	loadConfig()
-	printConfig()
+	if *showVersion {
+		fmt.Println("webhook-worker", buildinfo.Read(version, commit, date))
+		return
+	}
+
+	if *validateOnly {
+		mustLoadConfig()
+		log.Println("✅ Configuration is valid")
+		return
+	}
+	if runningAsService() {
+		runService()
+		return
+	}
+	run()
+}
+
+func run() {
+	log.Printf("🚀 Starting NATS Webhook Worker (Go) %s", buildinfo.Read(version, commit, date))
+
+	// Load configuration, refusing to start on any problem
+	mustLoadConfig()
+	initChaos()
 
 	// Initialize PostgreSQL connection
 	var err error
-	db, err = sql.Open("postgres", config.Postgres.URL)
+	db, err = openPostgres(config.Postgres.URL)
 	if err != nil {
 		log.Fatalf("❌ Failed to connect to PostgreSQL: %v", err)
 	}
@@ -80,6 +288,57 @@ func main() {
 	}
 	log.Println("✅ Connected to PostgreSQL")
 
+	if err := checkExtension(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if err := ensureSchema(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if err := openOpsDB(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if opsDB != db {
+		defer opsDB.Close()
+	}
+	if opsSchemaReady.Load() {
+		discoverCapabilities()
+	}
+	if err := openReplicaDB(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if replicaDB != nil {
+		defer replicaDB.Close()
+	}
+	if err := openStandbyDB(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if standbyDB != nil {
+		defer standbyDB.Close()
+	}
+	go monitorDatabases()
+	if err := initDedup(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if err := initRetention(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	initHealthChecks()
+	initSchedules()
+	initExactlyOnce()
+	initFailureAlerts()
+	if err := initCDC(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if err := initRuleStats(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if payloadSealer, err = envelope.FromEnv(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if payloadSealer != nil {
+		log.Printf("🔒 Payload encryption: %s", payloadSealer.KeyID())
+	}
+
 	// Start worker
 	stats.StartTime = time.Now()
 	if err := startWorker(); err != nil {
@@ -87,204 +346,229 @@ func main() {
 	}
 }
 
-func loadConfig() {
-	config = Config{}
-
-	// NATS configuration
-	config.NATS.URL = getEnv("NATS_URL", "nats://localhost:4222")
-	config.NATS.User = getEnv("NATS_USER", "")
-	config.NATS.Pass = getEnv("NATS_PASS", "")
-
-	// PostgreSQL configuration
-	config.Postgres.URL = getEnv("DATABASE_URL", "postgresql://localhost/postgres?sslmode=disable")
-
-	// Worker configuration
-	config.Worker.StreamName = getEnv("STREAM_NAME", "WEBHOOKS")
-	config.Worker.ConsumerName = getEnv("CONSUMER_NAME", "webhook-worker-1")
-	config.Worker.QueueGroup = getEnv("QUEUE_GROUP", "webhook-workers")
-	config.Worker.Subject = getEnv("SUBJECT", "webhooks.*")
-	config.Worker.BatchSize = getEnvInt("BATCH_SIZE", 10)
-}
-
-func printConfig() {
-	log.Printf("Configuration:")
-	log.Printf("  NATS URL: %s", config.NATS.URL)
-	log.Printf("  Stream: %s", config.Worker.StreamName)
-	log.Printf("  Consumer: %s", config.Worker.ConsumerName)
-	log.Printf("  Queue Group: %s", config.Worker.QueueGroup)
-	log.Printf("  Subject: %s", config.Worker.Subject)
-	log.Printf("  Batch Size: %d", config.Worker.BatchSize)
-}
-
 func startWorker() error {
-	// Connect to NATS
-	opts := []nats.Option{
-		nats.Name("Rule Engine Webhook Worker"),
+	// Checked by validateConfig
+	backoff, _ := parseNakBackoff(config.Worker.NakBackoff)
+	lanes, _ := parsePriorityLanes(config.Worker.PriorityLanes)
+	decodeRules, _ = parseDecodeSubjects(config.Decoders.Subjects)
+	w, err := worker.New(worker.Options{
+		NATSURL:        config.NATS.URL,
+		User:           config.NATS.User,
+		Password:       config.NATS.Pass,
+		Name:           "Rule Engine Webhook Worker",
+		Stream:         config.Worker.StreamName,
+		Consumer:       config.Worker.ConsumerName,
+		QueueGroup:     config.Worker.QueueGroup,
+		Subject:        config.Worker.Subject,
+		MaxDeliver:     consumerMaxDeliver,
+		AckWait:        30 * time.Second,
+		HandlerTimeout: time.Duration(config.Worker.HandlerTimeoutSeconds) * time.Second,
+		Backoff:        backoff,
+		MaxAckPending:  config.Worker.MaxAckPending,
+		Concurrency:    config.Worker.BatchSize,
+		Lanes:          lanes,
+		Weight:         config.Worker.SubjectWeight,
+		Fetchers:       config.Worker.Fetchers,
+		NATSOptions:    chaosNATSOptions(),
+		DropAck:        chaosDropAck,
+		JournalPath:    config.NATS.JournalPath,
+		ReplayCounts:   replayJournalCounts,
+		OnSubscribe: func(*nats.Subscription) {
+			markReady()
+		},
+	})
+	if err != nil {
+		return err
 	}
-
-	if config.NATS.User != "" && config.NATS.Pass != "" {
-		opts = append(opts, nats.UserInfo(config.NATS.User, config.NATS.Pass))
+	defer w.Close()
+	natsConn, jetStream, consumer = w.Conn(), w.JetStream(), w
+
+	// Subjects whose acks must be confirmed go first, so they win the
+	// match; exactly-once deliveries are among them
+	for _, pattern := range splitList(config.Worker.AckSyncSubjects + "," + config.Worker.ExactlyOnceSubjects) {
+		if err := w.RegisterHandler(pattern, handleMessage, worker.AckSync()); err != nil {
+			return err
+		}
 	}
-
-	nc, err := nats.Connect(config.NATS.URL, opts...)
-	if err != nil {
-		return fmt.Errorf("failed to connect to NATS: %w", err)
+	if err := w.RegisterHandler(config.Worker.Subject, handleMessage); err != nil {
+		return err
 	}
-	defer nc.Close()
 
-	log.Printf("✅ Connected to NATS at %s", nc.ConnectedUrl())
-
-	// Get JetStream context
-	js, err := nc.JetStream()
-	if err != nil {
-		return fmt.Errorf("failed to get JetStream context: %w", err)
+	if err := startAdminServer(); err != nil {
+		return err
 	}
-
-	// Check if stream exists
-	_, err = js.StreamInfo(config.Worker.StreamName)
-	if err != nil {
-		log.Printf("⚠️  Stream '%s' not found - will be created by first publish", config.Worker.StreamName)
-	} else {
-		log.Printf("✅ Stream '%s' found", config.Worker.StreamName)
+	registerWorker()
+	ensureConsumerStats()
+	startLagMonitor(natsConn, jetStream)
+	startDeliveryStats()
+	startAuditBuffer()
+	startQuotaMonitor(natsConn, w)
+	if err := startWindowRecorder(natsConn); err != nil {
+		return err
 	}
-
-	// Create or get durable consumer
-	consumerConfig := &nats.ConsumerConfig{
-		Durable:       config.Worker.ConsumerName,
-		AckPolicy:     nats.AckExplicitPolicy,
-		FilterSubject: config.Worker.Subject,
-		DeliverGroup:  config.Worker.QueueGroup,
-		MaxDeliver:    3,           // Max 3 delivery attempts
-		AckWait:       30 * time.Second,
+	if err := startCorrelationEngine(natsConn); err != nil {
+		return err
 	}
-
-	_, err = js.AddConsumer(config.Worker.StreamName, consumerConfig)
-	if err != nil {
-		// Consumer might already exist
-		log.Printf("⚠️  Consumer may already exist: %v", err)
+	if err := startLeaderElection(jetStream); err != nil {
+		return err
 	}
-
-	log.Printf("✅ Consumer '%s' ready", config.Worker.ConsumerName)
-
-	// Subscribe to messages
-	log.Printf("📥 Listening for messages on '%s'...\n", config.Worker.Subject)
-
-	sub, err := js.QueueSubscribe(
-		config.Worker.Subject,
-		config.Worker.QueueGroup,
-		processMessage,
-		nats.Durable(config.Worker.ConsumerName),
-		nats.ManualAck(),
-		nats.MaxDeliver(3),
-		nats.AckWait(30*time.Second),
-	)
-	if err != nil {
-		return fmt.Errorf("failed to subscribe: %w", err)
+	startWatchdog(natsConn)
+
+	// Run until SIGINT/SIGTERM or a service stop request
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		waitForShutdown()
+		log.Println("\n🛑 Received shutdown signal, stopping gracefully...")
+		sdNotify("STOPPING=1")
+		cancel()
+	}()
+	startMQTTBridge(ctx)
+	if err := w.Run(ctx); err != nil {
+		return err
 	}
-	defer sub.Unsubscribe()
-
-	// Setup graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	<-sigChan
-	log.Println("\n🛑 Received shutdown signal, stopping gracefully...")
+	// Hand singleton tasks to another replica straight away
+	stopLeaderElection()
+	deregisterWorker()
 
-	// Report final statistics
+	// Settle buffered archive batches, then report final statistics
+	flushArchives()
+	flushAudit()
+	flushDeliveryStats()
+	flushUsage()
+	closeRuleStats()
 	reportStatistics()
+	if n := opsBuffered(); n > 0 {
+		flushOpsBuffer()
+		if n = opsBuffered(); n > 0 {
+			log.Printf("⚠️  %d buffered operational write(s) lost: PostgreSQL is still unavailable", n)
+		}
+	}
 
 	log.Println("👋 Worker stopped")
 	return nil
 }
 
-func processMessage(msg *nats.Msg) {
-	startTime := time.Now()
-	messageNum := atomic.AddUint64(&stats.MessagesProcessed, 1)
+// handleMessage adapts processMessage, which settles every message itself,
+// to the worker's handler API
+func handleMessage(ctx context.Context, msg *nats.Msg) error {
+	processMessage(ctx, msg)
+	return worker.ErrSettled
+}
 
-	// Parse payload
-	var payload WebhookPayload
-	if err := json.Unmarshal(msg.Data, &payload); err != nil {
-		log.Printf("❌ [%d] Failed to parse payload: %v", messageNum, err)
-		atomic.AddUint64(&stats.MessagesFailed, 1)
-		msg.Nak()
+// processMessage delivers one message. ctx ends at the message's AckWait
+// or when shutdown gives up waiting, and bounds every lookup and delivery.
+func processMessage(ctx context.Context, msg *nats.Msg) {
+	// A deferred message waits on the stream for its destination's next
+	// health check
+	if wait, ok := deferredUntil(msg); ok {
+		consumer.Settle(msg, worker.RetryAfter(errDeferred, wait))
 		return
 	}
 
-	log.Printf("📨 [%d] Processing: %s", messageNum, msg.Subject)
+	startTime := time.Now()
+	messageNum := atomic.AddUint64(&stats.MessagesProcessed, 1)
+	traceID := messageTraceID(msg)
+	recordUsage(len(msg.Data))
 
-	// Extract webhook URL
-	webhookURL := payload.WebhookURL
-	if webhookURL == "" {
-		log.Printf("❌ [%d] Missing webhook_url in payload", messageNum)
-		atomic.AddUint64(&stats.MessagesFailed, 1)
-		msg.Nak()
+	// Refuse oversized messages before decoding multiplies their size
+	if err := checkPayloadSize(msg); err != nil {
+		logMessage(traceID, true, "❌ [%d %s] %v", messageNum, traceID, err)
+		settleMessage(msg, err, worker.Counts{"failed": 1})
 		return
 	}
 
-	// Prepare request body
-	var requestBody []byte
-	var err error
-	if payload.Data != nil {
-		requestBody, err = json.Marshal(payload.Data)
-	} else {
-		requestBody = msg.Data
+	// Parse payload, unwrapping CloudEvents and decoding Avro or Protobuf
+	payload, event, data, err := decodeMessage(ctx, msg)
+	if errors.Is(err, errSkipRecord) {
+		logMessage(traceID, false, "⏭️  [%d %s] Nothing to deliver on %s: %v", messageNum, traceID, msg.Subject, err)
+		settleMessage(msg, nil, nil)
+		return
+	}
+	if err != nil {
+		logMessage(traceID, true, "❌ [%d %s] Failed to parse payload: %v", messageNum, traceID, err)
+		settleMessage(msg, err, worker.Counts{"failed": 1})
+		return
 	}
 
+	logMessage(traceID, false, "📨 [%d %s] Processing: %s", messageNum, traceID, msg.Subject)
+
+	// Resolve the action: a configured rule_actions row, or a plain webhook
+	action, actionConfig, err := resolveAction(ctx, payload)
 	if err != nil {
-		log.Printf("❌ [%d] Failed to marshal request body: %v", messageNum, err)
-		atomic.AddUint64(&stats.MessagesFailed, 1)
-		msg.Nak()
+		logMessage(traceID, true, "❌ [%d %s] %v", messageNum, traceID, err)
+		settleMessage(msg, err, worker.Counts{"failed": 1})
 		return
 	}
+	m := &ActionMessage{Msg: msg, Payload: payload, Event: event, Config: actionConfig, data: data, num: messageNum, traceID: traceID, start: startTime}
 
-	// Make HTTP request
-	req, err := http.NewRequestWithContext(
-		context.Background(),
-		"POST",
-		webhookURL,
-		bytes.NewBuffer(requestBody),
-	)
+	m.dedupKey, m.window, err = m.dedupTarget(ctx)
 	if err != nil {
-		log.Printf("❌ [%d] Failed to create request: %v", messageNum, err)
-		atomic.AddUint64(&stats.MessagesFailed, 1)
-		msg.Nak()
+		logMessage(traceID, true, "❌ [%d %s] %v", messageNum, traceID, err)
+		settleMessage(msg, err, worker.Counts{"failed": 1})
 		return
 	}
 
-	// Set headers
-	if payload.Headers != nil {
-		for key, value := range payload.Headers {
-			req.Header.Set(key, value)
+	// Skip stale messages: a late notification is worse than none
+	if deadline, ok := messageDeadline(msg, payload); ok {
+		if !time.Now().Before(deadline) {
+			logMessage(traceID, true, "⌛ [%d %s] Expired at %s, skipping delivery", messageNum, traceID, deadline.Format(time.RFC3339))
+			recordDelivery(m, outcomeExpired, 0)
+			recordExpired(ctx, msg, payload, deadline, traceID)
+			settleMessage(msg, nil, worker.Counts{"expired": 1})
+			return
 		}
-	} else {
-		req.Header.Set("Content-Type", "application/json")
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
 	}
 
-	// Execute request
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	// Suppress repeat firings for the same entity within the dedup window
+	if isDuplicate(ctx, m.dedupKey, payload.EventKey, m.window) {
+		logMessage(traceID, false, "🔁 [%d %s] Duplicate event_key %q within %s, skipping delivery", messageNum, traceID, scrubField("$.event_key", payload.EventKey), m.window)
+		recordDelivery(m, outcomeDuplicate, 0)
+		settleMessage(msg, nil, worker.Counts{"duplicate": 1})
+		return
+	}
 
-	duration := time.Since(startTime)
-	durationMs := duration.Milliseconds()
+	// Exactly-once subjects claim the delivery in the ledger first
+	if exactlyOnce(msg.Subject) {
+		delivered, err := claimDelivery(ctx, m)
+		switch {
+		case errors.Is(err, errDeliveryInFlight):
+			logMessage(traceID, false, "⏳ [%d %s] %v, retrying later", messageNum, traceID, err)
+			settleMessage(msg, err, nil)
+			return
+		case err != nil:
+			logMessage(traceID, true, "❌ [%d %s] %v", messageNum, traceID, err)
+			settleMessage(msg, err, worker.Counts{"failed": 1})
+			return
+		case delivered:
+			logMessage(traceID, false, "🔁 [%d %s] Already delivered, skipping", messageNum, traceID)
+			recordDelivery(m, outcomeDuplicate, 0)
+			settleMessage(msg, nil, worker.Counts{"duplicate": 1})
+			return
+		}
+	}
 
-	if err != nil {
-		log.Printf("   ❌ Request failed: %v (%dms)", err, durationMs)
-		atomic.AddUint64(&stats.MessagesFailed, 1)
-		msg.Nak()
-		return
+	// Configured actions get a timeout; webhooks apply their own per request
+	if actionConfig != nil {
+		timeout := 30 * time.Second
+		if actionConfig.TimeoutMs > 0 {
+			timeout = time.Duration(actionConfig.TimeoutMs) * time.Millisecond
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-	defer resp.Body.Close()
 
-	// Check response status
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		log.Printf("   ✅ Success: %d (%dms)", resp.StatusCode, durationMs)
-		atomic.AddUint64(&stats.MessagesSucceeded, 1)
-		atomic.AddUint64(&stats.TotalProcessingTimeMs, uint64(durationMs))
-		msg.Ack()
+	detail, err := action.Execute(ctx, m)
+	if m.deferred && err == nil {
+		logMessage(traceID, false, "   ⏳ %s", detail)
 	} else {
-		log.Printf("   ⚠️  HTTP Error: %d (%dms)", resp.StatusCode, durationMs)
-		atomic.AddUint64(&stats.MessagesFailed, 1)
-		msg.Nak()
+		m.complete(detail, err)
 	}
 
 	// Report statistics periodically
@@ -293,10 +577,22 @@ func processMessage(msg *nats.Msg) {
 	}
 }
 
+// consumerStatsUpdate and consumerCountsUpsert write the cumulative
+// consumer statistics: stream, consumer, processed, succeeded, pending,
+// and average time; then stream, consumer, failed, and expired
+const (
+	consumerStatsUpdate  = "SELECT rule_nats_consumer_update_stats($1, $2, $3, $4, $5, $6)"
+	consumerCountsUpsert = `INSERT INTO rule_nats_consumer_stats (stream_name, consumer_name, messages_failed, messages_expired) VALUES ($1, $2, $3, $4)
+				 ON CONFLICT (stream_name, consumer_name) DO UPDATE SET
+				     messages_failed = EXCLUDED.messages_failed, messages_expired = EXCLUDED.messages_expired`
+)
+
 func reportStatistics() {
 	processed := atomic.LoadUint64(&stats.MessagesProcessed)
 	succeeded := atomic.LoadUint64(&stats.MessagesSucceeded)
 	failed := atomic.LoadUint64(&stats.MessagesFailed)
+	expired := atomic.LoadUint64(&stats.MessagesExpired)
+	duplicate := atomic.LoadUint64(&stats.MessagesDuplicate)
 	totalTime := atomic.LoadUint64(&stats.TotalProcessingTimeMs)
 
 	var avgTime float64
@@ -310,24 +606,58 @@ func reportStatistics() {
 	log.Printf("   Processed: %d", processed)
 	log.Printf("   Succeeded: %d", succeeded)
 	log.Printf("   Failed: %d", failed)
+	log.Printf("   Expired: %d", expired)
+	log.Printf("   Duplicates: %d", duplicate)
 	log.Printf("   Avg Time: %.2fms", avgTime)
 	log.Printf("   Uptime: %.0fs\n", uptime)
 
-	// Update PostgreSQL consumer stats
-	_, err := db.Exec(
-		"SELECT rule_nats_consumer_update_stats($1, $2, $3, $4, $5, $6)",
-		config.Worker.StreamName,
-		config.Worker.ConsumerName,
-		processed,
-		succeeded,
-		failed,
-		avgTime,
-	)
+	// Pending comes from the latest JetStream lag sample, not local counters
+	var pending uint64
+	if lag := latestLag(); lag != nil {
+		pending = lag.NumPending
+	}
 
-	if err != nil {
-		log.Printf("⚠️  Failed to report statistics to PostgreSQL: %v", err)
-	} else {
-		log.Println("✅ Statistics reported to PostgreSQL\n")
+	// Update PostgreSQL consumer stats. Counters are cumulative, so while
+	// PostgreSQL is down only the latest report is buffered. They go
+	// through the extension's function, so are left out when its version
+	// is not supported (EXTENSION_CHECK=warn) or the function is missing.
+	buffered := false
+	var reportErr error
+	var errs []error
+	if extensionCompatible && hasCapability("consumer_stats") {
+		errs = append(errs,
+			opsWrite("consumer_stats", consumerStatsUpdate,
+				config.Worker.StreamName,
+				config.Worker.ConsumerName,
+				processed,
+				succeeded,
+				pending,
+				avgTime,
+			),
+			opsWrite("consumer_counts", consumerCountsUpsert,
+				config.Worker.StreamName,
+				config.Worker.ConsumerName,
+				failed,
+				expired,
+			),
+		)
+	}
+	errs = append(errs, reportActionStatistics())
+	for _, err := range errs {
+		if errors.Is(err, errOpsBuffered) {
+			buffered = true
+		} else if err != nil && reportErr == nil {
+			reportErr = err
+		}
+	}
+
+	switch {
+	case reportErr != nil:
+		log.Printf("⚠️  Failed to report statistics to PostgreSQL: %v", reportErr)
+	case buffered:
+		log.Printf("💾 Statistics buffered until PostgreSQL recovers")
+	default:
+		log.Println("✅ Statistics reported to PostgreSQL")
 	}
 }
 
@@ -339,12 +669,3 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
-
-func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		var intValue int
-		fmt.Sscanf(value, "%d", &intValue)
-		return intValue
-	}
-	return defaultValue
-}
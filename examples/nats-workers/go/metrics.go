@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// serveMetrics exposes worker counters in the Prometheus text format on
+// /metrics. They mirror /debug/vars, so the expvar JSON and Prometheus
+// scrapes never disagree.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	consumer := fmt.Sprintf(`stream=%q,consumer=%q`, config.Worker.StreamName, config.Worker.ConsumerName)
+
+	writeMetricHeader(w, "rule_worker_messages_total", "counter", "Messages handled by outcome")
+	for _, m := range statsCounters() {
+		fmt.Fprintf(w, "rule_worker_messages_total{%s,outcome=%q} %d\n", consumer, m.outcome, atomic.LoadUint64(m.value))
+	}
+
+	actions := snapshotActionMetrics()
+	names := make([]string, 0, len(actions))
+	for name := range actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeMetricHeader(w, "rule_worker_action_executions_total", "counter", "Action executions by result")
+	for _, name := range names {
+		c := actions[name]
+		fmt.Fprintf(w, "rule_worker_action_executions_total{%s,action=%q,result=\"succeeded\"} %d\n", consumer, name, c.Succeeded)
+		fmt.Fprintf(w, "rule_worker_action_executions_total{%s,action=%q,result=\"failed\"} %d\n", consumer, name, c.Failed)
+	}
+
+	writeMetricHeader(w, "rule_worker_action_duration_seconds", "histogram", "Duration of successful action executions")
+	for _, name := range names {
+		c := actions[name]
+		var cumulative uint64
+		for i, bound := range latencyBucketsMs {
+			cumulative += c.latency[i]
+			le := strconv.FormatFloat(float64(bound)/1000, 'f', -1, 64)
+			fmt.Fprintf(w, "rule_worker_action_duration_seconds_bucket{%s,action=%q,le=%q} %d\n", consumer, name, le, cumulative)
+		}
+		fmt.Fprintf(w, "rule_worker_action_duration_seconds_bucket{%s,action=%q,le=\"+Inf\"} %d\n", consumer, name, c.Succeeded)
+		fmt.Fprintf(w, "rule_worker_action_duration_seconds_sum{%s,action=%q} %g\n", consumer, name, float64(c.TotalTimeMs)/1000)
+		fmt.Fprintf(w, "rule_worker_action_duration_seconds_count{%s,action=%q} %d\n", consumer, name, c.Succeeded)
+	}
+
+	// Broken out by STATS_TENANT_TOKEN or STATS_TENANT_FIELD, for messages
+	// that have a tenant
+	if tenantStats := snapshotTenantMetrics(); len(tenantStats) > 0 {
+		tenants := make([]string, 0, len(tenantStats))
+		for tenant := range tenantStats {
+			tenants = append(tenants, tenant)
+		}
+		sort.Strings(tenants)
+
+		writeMetricHeader(w, "rule_worker_tenant_messages_total", "counter", "Messages delivered, failed, expired, or skipped as duplicates by tenant")
+		for _, tenant := range tenants {
+			c := tenantStats[tenant]
+			for _, outcome := range []string{outcomeDelivered, outcomeFailed, outcomeExpired, outcomeDuplicate} {
+				fmt.Fprintf(w, "rule_worker_tenant_messages_total{%s,tenant=%q,outcome=%q} %d\n", consumer, tenant, outcome, c.outcomes[outcome])
+			}
+		}
+
+		writeMetricHeader(w, "rule_worker_tenant_delivery_duration_seconds", "histogram", "Duration of successful deliveries by tenant")
+		for _, tenant := range tenants {
+			c := tenantStats[tenant]
+			var cumulative uint64
+			for i, bound := range latencyBucketsMs {
+				cumulative += c.latency[i]
+				le := strconv.FormatFloat(float64(bound)/1000, 'f', -1, 64)
+				fmt.Fprintf(w, "rule_worker_tenant_delivery_duration_seconds_bucket{%s,tenant=%q,le=%q} %d\n", consumer, tenant, le, cumulative)
+			}
+			delivered := c.outcomes[outcomeDelivered]
+			fmt.Fprintf(w, "rule_worker_tenant_delivery_duration_seconds_bucket{%s,tenant=%q,le=\"+Inf\"} %d\n", consumer, tenant, delivered)
+			fmt.Fprintf(w, "rule_worker_tenant_delivery_duration_seconds_sum{%s,tenant=%q} %g\n", consumer, tenant, float64(c.totalTimeMs)/1000)
+			fmt.Fprintf(w, "rule_worker_tenant_delivery_duration_seconds_count{%s,tenant=%q} %d\n", consumer, tenant, delivered)
+		}
+	}
+
+	if lag := latestLag(); lag != nil {
+		writeMetricHeader(w, "rule_worker_consumer_pending", "gauge", "Messages waiting in the stream for the consumer")
+		fmt.Fprintf(w, "rule_worker_consumer_pending{%s} %d\n", consumer, lag.NumPending)
+		writeMetricHeader(w, "rule_worker_consumer_ack_pending", "gauge", "Messages delivered but not yet acknowledged")
+		fmt.Fprintf(w, "rule_worker_consumer_ack_pending{%s} %d\n", consumer, lag.NumAckPending)
+		writeMetricHeader(w, "rule_worker_consumer_redelivered", "gauge", "Messages redelivered at least once")
+		fmt.Fprintf(w, "rule_worker_consumer_redelivered{%s} %d\n", consumer, lag.NumRedelivered)
+	}
+
+	if subs := subscriptionStats(); len(subs) > 0 {
+		writeMetricHeader(w, "rule_worker_subscription_messages_total", "counter", "Messages received and settled by each lane's subscription")
+		for _, s := range subs {
+			labels := fmt.Sprintf("%s,subscription=%q,lane=%q", consumer, s.Consumer, s.Lane)
+			fmt.Fprintf(w, "rule_worker_subscription_messages_total{%s,outcome=\"received\"} %d\n", labels, s.Received)
+			fmt.Fprintf(w, "rule_worker_subscription_messages_total{%s,outcome=\"acked\"} %d\n", labels, s.Acked)
+			fmt.Fprintf(w, "rule_worker_subscription_messages_total{%s,outcome=\"naked\"} %d\n", labels, s.Naked)
+			fmt.Fprintf(w, "rule_worker_subscription_messages_total{%s,outcome=\"terminated\"} %d\n", labels, s.Terminated)
+		}
+		writeMetricHeader(w, "rule_worker_subscription_queued", "gauge", "Messages a lane has received that no handler has started")
+		for _, s := range subs {
+			fmt.Fprintf(w, "rule_worker_subscription_queued{%s,subscription=%q,lane=%q} %d\n", consumer, s.Consumer, s.Lane, s.Queued)
+		}
+	}
+
+	if health := healthSnapshot(); len(health) > 0 {
+		writeMetricHeader(w, "rule_worker_destination_up", "gauge", "Whether a probed webhook destination passes its health checks")
+		for _, h := range health {
+			fmt.Fprintf(w, "rule_worker_destination_up{%s,webhook_id=\"%d\",webhook=%q} %d\n", consumer, h.WebhookID, h.Name, boolMetric(h.Healthy))
+		}
+	}
+
+	writeMetricHeader(w, "rule_worker_postgres_up", "gauge", "Whether the database is answering")
+	fmt.Fprintf(w, "rule_worker_postgres_up{%s,database=\"primary\"} %d\n", consumer, boolMetric(primaryHealth.ok()))
+	fmt.Fprintf(w, "rule_worker_postgres_up{%s,database=\"ops\"} %d\n", consumer, boolMetric(opsHealth.ok()))
+	if standbyDB != nil {
+		fmt.Fprintf(w, "rule_worker_postgres_up{%s,database=\"standby\"} %d\n", consumer, boolMetric(standbyHealth.ok()))
+		writeMetricHeader(w, "rule_worker_postgres_standby_serving", "gauge", "Whether reads are failed over to the standby")
+		fmt.Fprintf(w, "rule_worker_postgres_standby_serving{%s} %d\n", consumer, boolMetric(standbyServing.Load()))
+	}
+	writeMetricHeader(w, "rule_worker_ops_buffered", "gauge", "Operational writes buffered while the database is unavailable")
+	fmt.Fprintf(w, "rule_worker_ops_buffered{%s} %d\n", consumer, opsBuffered())
+
+	writeMetricHeader(w, "rule_worker_nats_connected", "gauge", "Whether the worker is connected to NATS")
+	fmt.Fprintf(w, "rule_worker_nats_connected{%s} %d\n", consumer, boolMetric(natsConn != nil && natsConn.IsConnected()))
+	if config.NATS.JournalPath != "" {
+		writeMetricHeader(w, "rule_worker_journal_pending", "gauge", "Settlements journaled while NATS was unavailable and not yet sent")
+		fmt.Fprintf(w, "rule_worker_journal_pending{%s} %d\n", consumer, journalPending())
+	}
+
+	leaderMu.Lock()
+	leading := isLeader
+	leaderMu.Unlock()
+	writeMetricHeader(w, "rule_worker_leader", "gauge", "Whether the worker runs the singleton tasks")
+	fmt.Fprintf(w, "rule_worker_leader{%s,group=%q} %d\n", consumer, config.Leader.Group, boolMetric(leading))
+
+	writeMetricHeader(w, "rule_worker_uptime_seconds", "gauge", "Seconds since the worker started")
+	fmt.Fprintf(w, "rule_worker_uptime_seconds{%s} %g\n", consumer, time.Since(stats.StartTime).Seconds())
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
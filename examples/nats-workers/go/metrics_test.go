@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/internal/natstest"
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// metricLine is one sample of the Prometheus text format
+var metricLine = regexp.MustCompile(`^([a-z_]+)\{(.*)\} (\S+)$`)
+
+// scrapeMetrics returns the /metrics samples by name and label string, and
+// the declared type of each metric
+func scrapeMetrics(t *testing.T) (samples map[string]map[string]float64, types map[string]string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	samples, types = map[string]map[string]float64{}, map[string]string{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			if _, dup := types[fields[2]]; dup {
+				t.Errorf("metric %s declared twice", fields[2])
+			}
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := metricLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("malformed line %q", line)
+		}
+		value, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Fatalf("malformed value in %q", line)
+		}
+		family := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(m[1], "_bucket"), "_sum"), "_count")
+		if _, ok := types[m[1]]; !ok {
+			if _, ok := types[family]; !ok {
+				t.Errorf("sample %s before its TYPE line", m[1])
+			}
+		}
+		if samples[m[1]] == nil {
+			samples[m[1]] = map[string]float64{}
+		}
+		samples[m[1]][m[2]] = value
+	}
+	return samples, types
+}
+
+// checkHistogram checks that a histogram's buckets are cumulative and end
+// in a +Inf bucket equal to its count
+func checkHistogram(t *testing.T, samples map[string]map[string]float64, name, labels string, wantCount float64) {
+	t.Helper()
+	previous := -1.0
+	for _, bound := range latencyBucketsMs {
+		le := strconv.FormatFloat(float64(bound)/1000, 'f', -1, 64)
+		v, ok := samples[name+"_bucket"][fmt.Sprintf("%s,le=%q", labels, le)]
+		if !ok {
+			t.Fatalf("%s bucket le=%s missing", name, le)
+		}
+		if v < previous {
+			t.Fatalf("%s bucket le=%s = %v is below the previous bucket", name, le, v)
+		}
+		previous = v
+	}
+	inf := samples[name+"_bucket"][labels+`,le="+Inf"`]
+	count := samples[name+"_count"][labels]
+	if inf != wantCount || count != wantCount || inf < previous {
+		t.Fatalf("%s +Inf = %v, count = %v, want %v", name, inf, count, wantCount)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	resetDeliveryStats(t)
+	prevWorker, prevStats := config.Worker, config.Stats
+	t.Cleanup(func() { config.Worker, config.Stats = prevWorker, prevStats })
+	config.Worker.StreamName, config.Worker.ConsumerName = "RULES", "webhooks"
+	config.Stats.Transactional = false
+	config.Stats.TenantField = "tenant"
+
+	const action = "test-metrics-action"
+	t.Cleanup(func() {
+		actionMetricsMu.Lock()
+		delete(actionMetrics, action)
+		actionMetricsMu.Unlock()
+	})
+	recordActionResult(action, 4*time.Millisecond, nil, "")
+	recordActionResult(action, 30*time.Millisecond, nil, "")
+	recordActionResult(action, 20*time.Second, nil, "")
+	recordActionResult(action, time.Second, fmt.Errorf("refused"), "")
+
+	for _, d := range []struct {
+		tenant  string
+		outcome string
+		ms      int
+	}{{"acme", outcomeDelivered, 7}, {"acme", outcomeDelivered, 600}, {"acme", outcomeFailed, 0}, {"globex", outcomeDuplicate, 0}} {
+		m := &ActionMessage{dedupKey: "webhook:crm", Payload: &WebhookPayload{Data: map[string]interface{}{"tenant": d.tenant}}}
+		recordDelivery(m, d.outcome, time.Duration(d.ms)*time.Millisecond)
+	}
+
+	samples, types := scrapeMetrics(t)
+	consumer := `stream="RULES",consumer="webhooks"`
+
+	for name, kind := range map[string]string{
+		"rule_worker_messages_total":                   "counter",
+		"rule_worker_action_executions_total":          "counter",
+		"rule_worker_action_duration_seconds":          "histogram",
+		"rule_worker_tenant_messages_total":            "counter",
+		"rule_worker_tenant_delivery_duration_seconds": "histogram",
+		"rule_worker_postgres_up":                      "gauge",
+		"rule_worker_nats_connected":                   "gauge",
+		"rule_worker_leader":                           "gauge",
+	} {
+		if types[name] != kind {
+			t.Errorf("%s type = %q, want %s", name, types[name], kind)
+		}
+	}
+
+	actionLabels := fmt.Sprintf("%s,action=%q", consumer, action)
+	if v := samples["rule_worker_action_executions_total"][actionLabels+`,result="succeeded"`]; v != 3 {
+		t.Errorf("succeeded = %v", v)
+	}
+	if v := samples["rule_worker_action_executions_total"][actionLabels+`,result="failed"`]; v != 1 {
+		t.Errorf("failed = %v", v)
+	}
+	checkHistogram(t, samples, "rule_worker_action_duration_seconds", actionLabels, 3)
+	if v := samples["rule_worker_action_duration_seconds_bucket"][actionLabels+`,le="0.005"`]; v != 1 {
+		t.Errorf("le=0.005 = %v", v)
+	}
+	// The 20s execution is only in +Inf
+	if v := samples["rule_worker_action_duration_seconds_bucket"][actionLabels+`,le="10"`]; v != 2 {
+		t.Errorf("le=10 = %v", v)
+	}
+	if v := samples["rule_worker_action_duration_seconds_sum"][actionLabels]; v != 20.034 {
+		t.Errorf("sum = %v", v)
+	}
+
+	acme := consumer + `,tenant="acme"`
+	if samples["rule_worker_tenant_messages_total"][acme+`,outcome="delivered"`] != 2 ||
+		samples["rule_worker_tenant_messages_total"][acme+`,outcome="failed"`] != 1 ||
+		samples["rule_worker_tenant_messages_total"][consumer+`,tenant="globex",outcome="duplicate"`] != 1 {
+		t.Errorf("tenant messages = %v", samples["rule_worker_tenant_messages_total"])
+	}
+	checkHistogram(t, samples, "rule_worker_tenant_delivery_duration_seconds", acme, 2)
+}
+
+// Tenants past maxMetricTenants share one "other" series
+func TestCountTenantCardinality(t *testing.T) {
+	resetDeliveryStats(t)
+	deliveryStatsMu.Lock()
+	for i := 0; i < maxMetricTenants+10; i++ {
+		countTenant(fmt.Sprintf("tenant-%d", i), outcomeDelivered, time.Millisecond)
+	}
+	countTenant("tenant-0", outcomeFailed, 0)
+	deliveryStatsMu.Unlock()
+
+	snapshot := snapshotTenantMetrics()
+	if len(snapshot) != maxMetricTenants+1 {
+		t.Fatalf("%d series, want %d", len(snapshot), maxMetricTenants+1)
+	}
+	if other := snapshot["other"]; other.outcomes[outcomeDelivered] != 10 {
+		t.Fatalf("other = %+v", other)
+	}
+	// Tenants already tracked keep their series
+	if c := snapshot["tenant-0"]; c.outcomes[outcomeFailed] != 1 {
+		t.Fatalf("tenant-0 = %+v", c)
+	}
+}
+
+func TestServeMetricsSubscriptions(t *testing.T) {
+	prevWorker, prevConsumer := config.Worker, consumer
+	t.Cleanup(func() { config.Worker, consumer = prevWorker, prevConsumer })
+	config.Worker.StreamName, config.Worker.ConsumerName = "RULES", "webhooks"
+
+	srv := natstest.NewServer(t)
+	srv.AddStream("RULES", "rules.>")
+	w, err := worker.New(worker.Options{NATSURL: srv.URL(), Stream: "RULES", Consumer: "webhooks", Subject: "rules.normal.>",
+		Lanes: []worker.Lane{{Name: "bulk", Subject: "rules.bulk.>", Fetchers: 1}}, Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.Close)
+	w.RegisterHandler("rules.>", func(_ context.Context, msg *nats.Msg) error {
+		if msg.Subject == "rules.bulk.bad" {
+			return worker.Permanent(errors.New("malformed"))
+		}
+		return nil
+	})
+	consumer = w
+	srv.Publish("rules.normal.a", nil, []byte("{}"))
+	srv.Publish("rules.bulk.a", nil, []byte("{}"))
+	srv.Publish("rules.bulk.bad", nil, []byte("{}"))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+	t.Cleanup(func() { cancel(); <-done })
+	srv.WaitForAcks(3)
+
+	samples, types := scrapeMetrics(t)
+	if types["rule_worker_subscription_messages_total"] != "counter" || types["rule_worker_subscription_queued"] != "gauge" {
+		t.Fatalf("types = %v", types)
+	}
+	base := `stream="RULES",consumer="webhooks"`
+	tests := []struct {
+		labels string
+		want   float64
+	}{
+		{base + `,subscription="webhooks",lane="",outcome="received"`, 1},
+		{base + `,subscription="webhooks",lane="",outcome="acked"`, 1},
+		{base + `,subscription="webhooks-bulk",lane="bulk",outcome="received"`, 2},
+		{base + `,subscription="webhooks-bulk",lane="bulk",outcome="acked"`, 1},
+		{base + `,subscription="webhooks-bulk",lane="bulk",outcome="terminated"`, 1},
+		{base + `,subscription="webhooks-bulk",lane="bulk",outcome="naked"`, 0},
+	}
+	for _, tt := range tests {
+		if got, ok := samples["rule_worker_subscription_messages_total"][tt.labels]; !ok || got != tt.want {
+			t.Errorf("messages{%s} = %v, want %v", tt.labels, got, tt.want)
+		}
+	}
+	if got, ok := samples["rule_worker_subscription_queued"][base+`,subscription="webhooks-bulk",lane="bulk"`]; !ok || got != 0 {
+		t.Errorf("queued = %v", got)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// mqttStats counts messages taken from MQTT by the bridge
+var mqttStats = expvar.NewMap("mqtt_messages")
+
+// mqttTopicHeader carries the MQTT topic of a bridged message
+const mqttTopicHeader = "Rule-Mqtt-Topic"
+
+// mqttMaxPacket bounds the packets the bridge accepts; NATS would reject
+// larger payloads anyway
+const mqttMaxPacket = 8 << 20
+
+// mqttRoute maps the MQTT topics matching filter to a NATS subject
+type mqttRoute struct {
+	filter  []string // topic levels, with + and # wildcards
+	subject string   // a trailing > takes the levels the wildcards matched
+	action  string   // sent as Rule-Action, for data that is not a worker payload
+}
+
+// parseMQTTTopics parses MQTT_TOPICS, a comma-separated list of
+// filter=subject[@action] routes such as "sensors/+/temperature=iot.temperature.>"
+func parseMQTTTopics(value string) ([]mqttRoute, error) {
+	var routes []mqttRoute
+	for _, item := range splitList(value) {
+		filter, target, ok := strings.Cut(item, "=")
+		subject, action, _ := strings.Cut(strings.TrimSpace(target), "@")
+		filter = strings.TrimSpace(filter)
+		if !ok || filter == "" || subject == "" {
+			return nil, fmt.Errorf("must look like sensors/+/temperature=iot.temperature.>, got %q", item)
+		}
+		levels := strings.Split(filter, "/")
+		for i, level := range levels {
+			if (strings.ContainsAny(level, "+#") && len(level) > 1) || (level == "#" && i != len(levels)-1) {
+				return nil, fmt.Errorf("invalid MQTT topic filter %q", filter)
+			}
+		}
+		tokens := strings.Split(subject, ".")
+		for i, token := range tokens {
+			if token == "" || token == "*" || (token == ">" && i != len(tokens)-1) || strings.ContainsAny(token, " \t") {
+				return nil, fmt.Errorf("invalid NATS subject %q: wildcards other than a trailing > are not allowed", subject)
+			}
+		}
+		routes = append(routes, mqttRoute{filter: levels, subject: subject, action: strings.TrimSpace(action)})
+	}
+	return routes, nil
+}
+
+// match reports whether topic matches the route's filter, returning the
+// levels matched by wildcards
+func (r *mqttRoute) match(topic []string) ([]string, bool) {
+	var wild []string
+	for i, level := range r.filter {
+		if level == "#" {
+			return append(wild, topic[i:]...), true
+		}
+		if i >= len(topic) {
+			return nil, false
+		}
+		switch level {
+		case "+":
+			wild = append(wild, topic[i])
+		case topic[i]:
+		default:
+			return nil, false
+		}
+	}
+	return wild, len(r.filter) == len(topic)
+}
+
+// subjectFor fills a trailing > with the wildcard levels, made safe for
+// NATS subjects
+func (r *mqttRoute) subjectFor(wild []string) string {
+	if !strings.HasSuffix(r.subject, ">") {
+		return r.subject
+	}
+	base := strings.TrimSuffix(r.subject, ">")
+	if len(wild) == 0 {
+		return strings.TrimSuffix(base, ".")
+	}
+	tokens := make([]string, len(wild))
+	for i, level := range wild {
+		tokens[i] = subjectToken(level)
+	}
+	return base + strings.Join(tokens, ".")
+}
+
+// subjectToken makes s usable as one NATS subject token
+func subjectToken(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '.' || r == '*' || r == '>' || r <= ' ' {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "_"
+	}
+	return s
+}
+
+// startMQTTBridge subscribes to MQTT_TOPICS on MQTT_URL and republishes
+// every message to its subject until ctx ends, reconnecting as needed
+func startMQTTBridge(ctx context.Context) {
+	if config.MQTT.URL == "" {
+		return
+	}
+	routes, _ := parseMQTTTopics(config.MQTT.Topics) // checked by validateConfig
+	clientID := config.MQTT.ClientID
+	if clientID == "" {
+		host, _ := os.Hostname()
+		clientID = "rule-worker-" + host
+	}
+	go func() {
+		delay := time.Second
+		for {
+			start := time.Now()
+			err := runMQTTSession(ctx, clientID, routes)
+			if ctx.Err() != nil {
+				return
+			}
+			if time.Since(start) > time.Minute {
+				delay = time.Second
+			}
+			log.Printf("⚠️  MQTT bridge: %v; reconnecting in %s", err, delay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > 30*time.Second {
+				delay = 30 * time.Second
+			}
+		}
+	}()
+}
+
+// runMQTTSession connects, subscribes, and forwards messages until the
+// connection fails or ctx ends. QoS 1 messages are acknowledged only once
+// forwarded, so the broker redelivers what a failed session left behind.
+func runMQTTSession(ctx context.Context, clientID string, routes []mqttRoute) error {
+	c, err := dialMQTT(ctx, config.MQTT.URL)
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	keepAlive := time.Duration(config.MQTT.KeepAliveSeconds) * time.Second
+	if err := c.connect(clientID, config.MQTT.User, config.MQTT.Pass, keepAlive); err != nil {
+		return err
+	}
+	filters := make([]string, len(routes))
+	for i, r := range routes {
+		filters[i] = strings.Join(r.filter, "/")
+		if config.MQTT.ShareGroup != "" {
+			// Replicas in the group share the messages instead of each
+			// getting every one
+			filters[i] = "$share/" + config.MQTT.ShareGroup + "/" + filters[i]
+		}
+	}
+	if err := c.subscribe(filters, byte(config.MQTT.QoS)); err != nil {
+		return err
+	}
+	log.Printf("📡 MQTT bridge connected to %s, subscribed to %v", c.conn.RemoteAddr(), filters)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(keepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				c.write(mqttDisconnect, nil)
+				c.conn.Close()
+				return
+			case <-ticker.C:
+				c.write(mqttPingReq, nil)
+			}
+		}
+	}()
+
+	forward := func(msg *mqttMessage) error {
+		if err := forwardMQTTMessage(routes, msg); err != nil {
+			mqttStats.Add("failed", 1)
+			return fmt.Errorf("forwarding %s: %w", msg.topic, err)
+		}
+		if msg.qos == 0 {
+			return nil
+		}
+		return c.write(mqttPubAck, binary.BigEndian.AppendUint16(nil, msg.packetID))
+	}
+	for _, msg := range c.pending {
+		if err := forward(msg); err != nil {
+			return err
+		}
+	}
+	for {
+		// The broker answers pings, so silence means a dead connection
+		c.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		header, body, err := c.read()
+		if err != nil {
+			return err
+		}
+		if header>>4 != mqttPublish>>4 {
+			continue
+		}
+		msg, err := parseMQTTPublish(header, body)
+		if err != nil {
+			return err
+		}
+		if err := forward(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// forwardMQTTMessage publishes a message to the subject of the first
+// route matching its topic, or with MQTT_DIRECT processes it in place
+func forwardMQTTMessage(routes []mqttRoute, m *mqttMessage) error {
+	mqttStats.Add("received", 1)
+	levels := strings.Split(m.topic, "/")
+	for i := range routes {
+		wild, ok := routes[i].match(levels)
+		if !ok {
+			continue
+		}
+		out := nats.NewMsg(routes[i].subjectFor(wild))
+		out.Data = m.payload
+		out.Header.Set(mqttTopicHeader, m.topic)
+		if routes[i].action != "" {
+			out.Header.Set(actionHeader, routes[i].action)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if config.MQTT.Direct {
+			// No stream holds the message, so nothing retries it
+			processMessage(ctx, out)
+			return nil
+		}
+		if _, err := jetStream.PublishMsg(out, nats.Context(ctx)); errors.Is(err, nats.ErrNoStreamResponse) {
+			if err := natsConn.PublishMsg(out); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		mqttStats.Add("forwarded", 1)
+		return nil
+	}
+	// A shared or overlapping subscription can deliver other topics
+	mqttStats.Add("unrouted", 1)
+	return nil
+}
+
+// MQTT 3.1.1 control packet types, with the flags the bridge sends
+const (
+	mqttConnect    byte = 0x10
+	mqttConnAck    byte = 0x20
+	mqttPublish    byte = 0x30
+	mqttPubAck     byte = 0x40
+	mqttSubscribe  byte = 0x82
+	mqttSubAck     byte = 0x90
+	mqttPingReq    byte = 0xC0
+	mqttDisconnect byte = 0xE0
+)
+
+// mqttConn is a connection to an MQTT broker
+type mqttConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	wmu     sync.Mutex
+	pending []*mqttMessage // received while subscribing
+}
+
+type mqttMessage struct {
+	topic    string
+	qos      byte
+	packetID uint16
+	payload  []byte
+}
+
+// dialMQTT connects to tcp:// or mqtt:// brokers, and to ssl://, tls://,
+// or mqtts:// brokers over TLS
+func dialMQTT(ctx context.Context, rawURL string) (*mqttConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	secure := oneOf(u.Scheme, "ssl", "tls", "mqtts")
+	host := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if secure {
+			port = "8883"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if secure {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: u.Hostname()}}).DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mqttConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// connect opens a persistent session, so QoS 1 messages published while
+// the bridge is away are kept for it
+func (c *mqttConn) connect(clientID, user, pass string, keepAlive time.Duration) error {
+	var flags byte // clean session off
+	body := mqttString(nil, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+	if user != "" {
+		flags |= 0x80
+		if pass != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(keepAlive/time.Second))
+	body = mqttString(body, clientID)
+	if user != "" {
+		body = mqttString(body, user)
+		if pass != "" {
+			body = mqttString(body, pass)
+		}
+	}
+
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+	if err := c.write(mqttConnect, body); err != nil {
+		return err
+	}
+	header, ack, err := c.read()
+	if err != nil {
+		return err
+	}
+	if header != mqttConnAck || len(ack) != 2 {
+		return fmt.Errorf("unexpected reply to CONNECT")
+	}
+	if ack[1] != 0 {
+		reasons := map[byte]string{1: "unsupported protocol version", 2: "client id rejected", 3: "server unavailable", 4: "bad user name or password", 5: "not authorized"}
+		return fmt.Errorf("connection refused: %s", reasons[ack[1]])
+	}
+	return nil
+}
+
+func (c *mqttConn) subscribe(filters []string, qos byte) error {
+	body := binary.BigEndian.AppendUint16(nil, 1) // packet id
+	for _, f := range filters {
+		body = append(mqttString(body, f), qos)
+	}
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+	if err := c.write(mqttSubscribe, body); err != nil {
+		return err
+	}
+	// Messages for a resumed session may arrive before the SUBACK
+	for {
+		header, ack, err := c.read()
+		if err != nil {
+			return err
+		}
+		if header>>4 == mqttPublish>>4 {
+			msg, err := parseMQTTPublish(header, ack)
+			if err != nil {
+				return err
+			}
+			c.pending = append(c.pending, msg)
+			continue
+		}
+		if header != mqttSubAck {
+			continue
+		}
+		if len(ack) != 2+len(filters) {
+			return fmt.Errorf("unexpected SUBACK")
+		}
+		for i, code := range ack[2:] {
+			if code == 0x80 {
+				return fmt.Errorf("subscription to %s refused", filters[i])
+			}
+		}
+		return nil
+	}
+}
+
+func (c *mqttConn) write(header byte, body []byte) error {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(append(packet, body...))
+	return err
+}
+
+func (c *mqttConn) read() (byte, []byte, error) {
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, fmt.Errorf("malformed MQTT packet length")
+		}
+	}
+	if n > mqttMaxPacket {
+		return 0, nil, fmt.Errorf("MQTT packet of %d bytes is too large", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func parseMQTTPublish(header byte, body []byte) (*mqttMessage, error) {
+	m := &mqttMessage{qos: header >> 1 & 3}
+	if len(body) < 2 {
+		return nil, fmt.Errorf("malformed PUBLISH")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return nil, fmt.Errorf("malformed PUBLISH")
+	}
+	m.topic, body = string(body[2:2+n]), body[2+n:]
+	if m.qos > 0 {
+		if len(body) < 2 {
+			return nil, fmt.Errorf("malformed PUBLISH")
+		}
+		m.packetID, body = binary.BigEndian.Uint16(body), body[2:]
+	}
+	m.payload = body
+	return m, nil
+}
+
+func mqttString(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(s))), s...)
+}
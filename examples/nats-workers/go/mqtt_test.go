@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/internal/natstest"
+)
+
+func mqttCount(key string) int64 {
+	if v, ok := mqttStats.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// mqttPipe connects a client mqttConn to a broker end for one test
+func mqttPipe(t *testing.T) (client, broker *mqttConn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return &mqttConn{conn: a, r: bufio.NewReader(a)}, &mqttConn{conn: b, r: bufio.NewReader(b)}
+}
+
+func TestParseMQTTTopics(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []mqttRoute
+		wantErr string
+	}{
+		{value: "sensors/+/temperature=iot.temperature.>, alarms/#=iot.alarms.>@notify ,status=iot.status",
+			want: []mqttRoute{
+				{filter: []string{"sensors", "+", "temperature"}, subject: "iot.temperature.>"},
+				{filter: []string{"alarms", "#"}, subject: "iot.alarms.>", action: "notify"},
+				{filter: []string{"status"}, subject: "iot.status"},
+			}},
+		{value: "sensors", wantErr: `must look like sensors/+/temperature=iot.temperature.>, got "sensors"`},
+		{value: "=iot", wantErr: `must look like sensors/+/temperature=iot.temperature.>, got "=iot"`},
+		{value: "a/b+=iot", wantErr: `invalid MQTT topic filter "a/b+"`},
+		{value: "a/#/b=iot", wantErr: `invalid MQTT topic filter "a/#/b"`},
+		{value: "a/x#=iot", wantErr: `invalid MQTT topic filter "a/x#"`},
+		{value: "a=iot.*", wantErr: `invalid NATS subject "iot.*": wildcards other than a trailing > are not allowed`},
+		{value: "a=iot.>.x", wantErr: `invalid NATS subject "iot.>.x": wildcards other than a trailing > are not allowed`},
+		{value: "a=iot..x", wantErr: `invalid NATS subject "iot..x": wildcards other than a trailing > are not allowed`},
+	}
+	for _, tt := range tests {
+		got, err := parseMQTTTopics(tt.value)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%q: err = %v, want %q", tt.value, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q = %+v, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestMQTTRoute(t *testing.T) {
+	tests := []struct {
+		route, topic string
+		want         string // subject; empty for no match
+	}{
+		{"sensors/+/temperature=iot.temperature.>", "sensors/s1/temperature", "iot.temperature.s1"},
+		{"sensors/+/temperature=iot.temperature.>", "sensors/s1/humidity", ""},
+		{"sensors/+/temperature=iot.temperature.>", "sensors/s1", ""},
+		{"sensors/+/temperature=iot.temperature.>", "sensors/s1/temperature/x", ""},
+		{"sensors/+/temperature=iot.temperature", "sensors/s1/temperature", "iot.temperature"},
+		{"alarms/#=iot.alarms.>", "alarms/fire/floor.2", "iot.alarms.fire.floor_2"},
+		{"alarms/#=iot.alarms.>", "alarms", "iot.alarms"},
+		{"#=all.>", "a/b c/*/>/", "all.a.b_c._._._"},
+		{"+/+=pair.>", "a/b", "pair.a.b"},
+		{"status=iot.status.>", "status", "iot.status"},
+	}
+	for _, tt := range tests {
+		routes, err := parseMQTTTopics(tt.route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wild, ok := routes[0].match(strings.Split(tt.topic, "/"))
+		got := ""
+		if ok {
+			got = routes[0].subjectFor(wild)
+		}
+		if got != tt.want {
+			t.Errorf("%s on %q = %q, want %q", tt.route, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	// The remaining length examples of MQTT 3.1.1 section 2.2.3
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		client, broker := mqttPipe(t)
+		body := bytes.Repeat([]byte{'x'}, tt.n)
+		go client.write(mqttPublish, body)
+
+		raw := make([]byte, 1+len(tt.want)+tt.n)
+		if _, err := io.ReadFull(broker.r, raw); err != nil {
+			t.Fatal(err)
+		}
+		if raw[0] != mqttPublish || !bytes.Equal(raw[1:1+len(tt.want)], tt.want) {
+			t.Errorf("length %d encoded as % x, want % x", tt.n, raw[1:1+len(tt.want)], tt.want)
+		}
+
+		// And read back
+		reader := &mqttConn{r: bufio.NewReader(bytes.NewReader(append(append([]byte{mqttPublish}, tt.want...), body...)))}
+		header, got, err := reader.read()
+		if err != nil || header != mqttPublish || len(got) != tt.n {
+			t.Errorf("length %d read as %d, %v", tt.n, len(got), err)
+		}
+	}
+}
+
+func TestMQTTReadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "EOF"},
+		{"length ends early", []byte{0x30, 0x80}, "EOF"},
+		{"length over four bytes", []byte{0x30, 0x80, 0x80, 0x80, 0x80, 0x01}, "malformed MQTT packet length"},
+		{"too large", []byte{0x30, 0x81, 0x80, 0x80, 0x04}, "MQTT packet of 8388609 bytes is too large"},
+		{"body ends early", []byte{0x30, 0x03, 'a'}, "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		c := &mqttConn{r: bufio.NewReader(bytes.NewReader(tt.data))}
+		if _, _, err := c.read(); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParseMQTTPublish(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  byte
+		body    []byte
+		want    mqttMessage
+		wantErr bool
+	}{
+		{name: "QoS 0", header: 0x30, body: []byte{0x00, 0x03, 'a', '/', 'b', 'h', 'i'},
+			want: mqttMessage{topic: "a/b", payload: []byte("hi")}},
+		{name: "QoS 1", header: 0x32, body: []byte{0x00, 0x01, 'a', 0x12, 0x34, '{', '}'},
+			want: mqttMessage{topic: "a", qos: 1, packetID: 0x1234, payload: []byte("{}")}},
+		{name: "retained duplicate", header: 0x3b, body: []byte{0x00, 0x01, 'a', 0x00, 0x07},
+			want: mqttMessage{topic: "a", qos: 1, packetID: 7, payload: []byte{}}},
+		{name: "no topic length", header: 0x30, body: []byte{0x00}, wantErr: true},
+		{name: "topic ends early", header: 0x30, body: []byte{0x00, 0x05, 'a'}, wantErr: true},
+		{name: "no packet id", header: 0x32, body: []byte{0x00, 0x01, 'a', 0x00}, wantErr: true},
+	}
+	for _, tt := range tests {
+		m, err := parseMQTTPublish(tt.header, tt.body)
+		if tt.wantErr {
+			if err == nil || err.Error() != "malformed PUBLISH" {
+				t.Errorf("%s: err = %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(*m, tt.want) {
+			t.Errorf("%s = %+v, %v", tt.name, m, err)
+		}
+	}
+}
+
+func TestMQTTConnect(t *testing.T) {
+	tests := []struct {
+		name       string
+		user, pass string
+		reply      []byte // CONNACK body; nil for another packet
+		wantBody   []byte
+		wantErr    string
+	}{
+		{name: "anonymous", reply: []byte{0, 0},
+			wantBody: []byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0x00, 0, 30, 0, 2, 'c', '1'}},
+		{name: "user and password", user: "u", pass: "p", reply: []byte{0, 0},
+			wantBody: []byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0xc0, 0, 30, 0, 2, 'c', '1', 0, 1, 'u', 0, 1, 'p'}},
+		{name: "user only", user: "u", reply: []byte{0, 0},
+			wantBody: []byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0x80, 0, 30, 0, 2, 'c', '1', 0, 1, 'u'}},
+		{name: "refused", reply: []byte{0, 4}, wantErr: "connection refused: bad user name or password"},
+		{name: "not authorized", reply: []byte{0, 5}, wantErr: "connection refused: not authorized"},
+		{name: "not a CONNACK", wantErr: "unexpected reply to CONNECT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, broker := mqttPipe(t)
+			got := make(chan []byte, 1)
+			go func() {
+				header, body, err := broker.read()
+				if err != nil || header != mqttConnect {
+					got <- nil
+					return
+				}
+				got <- body
+				if tt.reply == nil {
+					broker.write(mqttPingReq, nil)
+				} else {
+					broker.write(mqttConnAck, tt.reply)
+				}
+			}()
+			err := client.connect("c1", tt.user, tt.pass, 30*time.Second)
+			body := <-got
+			if tt.wantBody != nil && !bytes.Equal(body, tt.wantBody) {
+				t.Fatalf("CONNECT = % x, want % x", body, tt.wantBody)
+			}
+			if (tt.wantErr == "" && err != nil) || (tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMQTTSubscribe(t *testing.T) {
+	filters := []string{"a/+", "$share/g/b/#"}
+	wantBody := []byte{0, 1, 0, 3, 'a', '/', '+', 1, 0, 12, '$', 's', 'h', 'a', 'r', 'e', '/', 'g', '/', 'b', '/', '#', 1}
+	tests := []struct {
+		name        string
+		before      [][2][]byte // packets sent ahead of the SUBACK
+		suback      []byte
+		wantErr     string
+		wantPending int
+	}{
+		{name: "granted", suback: []byte{0, 1, 1, 0}},
+		{name: "messages before the SUBACK", suback: []byte{0, 1, 1, 1},
+			before: [][2][]byte{
+				{{0x32}, {0, 1, 'a', 0, 9, 'x'}},
+				{{0xd0}, nil}, // PINGRESP is skipped
+				{{0x30}, {0, 1, 'b', 'y'}},
+			},
+			wantPending: 2},
+		{name: "refused", suback: []byte{0, 1, 1, 0x80}, wantErr: "subscription to $share/g/b/# refused"},
+		{name: "wrong count", suback: []byte{0, 1, 1}, wantErr: "unexpected SUBACK"},
+		{name: "malformed message", before: [][2][]byte{{{0x32}, {0, 9}}}, wantErr: "malformed PUBLISH"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, broker := mqttPipe(t)
+			got := make(chan []byte, 1)
+			go func() {
+				header, body, err := broker.read()
+				if err != nil || header != mqttSubscribe {
+					got <- nil
+					return
+				}
+				got <- body
+				for _, p := range tt.before {
+					broker.write(p[0][0], p[1])
+				}
+				if tt.suback != nil {
+					broker.write(mqttSubAck, tt.suback)
+				}
+			}()
+			err := client.subscribe(filters, 1)
+			if body := <-got; !bytes.Equal(body, wantBody) {
+				t.Fatalf("SUBSCRIBE = % x, want % x", body, wantBody)
+			}
+			if (tt.wantErr == "" && err != nil) || (tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if len(client.pending) != tt.wantPending {
+				t.Fatalf("pending = %+v", client.pending)
+			}
+			if tt.wantPending > 0 && (client.pending[0].packetID != 9 || client.pending[1].topic != "b") {
+				t.Fatalf("pending = %+v", client.pending)
+			}
+		})
+	}
+}
+
+func TestForwardMQTTMessage(t *testing.T) {
+	routes, err := parseMQTTTopics("sensors/+/temperature=iot.temperature.>,alarms/#=iot.alarms@notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		topic       string
+		jsErr       error
+		wantSubject string
+		wantAction  string
+		wantCore    bool
+		wantErr     bool
+		wantCounter string
+	}{
+		{name: "to the stream", topic: "sensors/s1/temperature", wantSubject: "iot.temperature.s1", wantCounter: "forwarded"},
+		{name: "with an action", topic: "alarms/fire", wantSubject: "iot.alarms", wantAction: "notify", wantCounter: "forwarded"},
+		{name: "no stream", topic: "alarms/fire", jsErr: nats.ErrNoStreamResponse, wantSubject: "iot.alarms", wantAction: "notify",
+			wantCore: true, wantCounter: "forwarded"},
+		{name: "publish failure", topic: "alarms/fire", jsErr: errors.New("timeout"), wantErr: true},
+		{name: "unrouted", topic: "other", wantCounter: "unrouted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := natstest.NewServer(t)
+			nc, err := nats.Connect(srv.URL())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nc.Close()
+			useNATSConn(t, nc)
+			sub, err := nc.SubscribeSync("iot.>")
+			if err != nil {
+				t.Fatal(err)
+			}
+			js := &fakeJetStream{err: tt.jsErr}
+			useJetStream(t, js)
+
+			received := mqttCount("received")
+			before := mqttCount(tt.wantCounter)
+			err = forwardMQTTMessage(routes, &mqttMessage{topic: tt.topic, payload: []byte(`{"c":21}`)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v", err)
+			}
+			if mqttCount("received") != received+1 {
+				t.Fatal("received not counted")
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := mqttCount(tt.wantCounter) - before; got != 1 {
+				t.Fatalf("%s += %d", tt.wantCounter, got)
+			}
+			if tt.wantSubject == "" {
+				if len(js.published) != 0 {
+					t.Fatalf("published %+v", js.published)
+				}
+				return
+			}
+
+			var out *nats.Msg
+			if tt.wantCore {
+				if out, err = sub.NextMsg(2 * time.Second); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				if len(js.published) != 1 {
+					t.Fatalf("published %d to JetStream", len(js.published))
+				}
+				out = js.published[0]
+			}
+			if out.Subject != tt.wantSubject || string(out.Data) != `{"c":21}` || out.Header.Get(mqttTopicHeader) != tt.topic ||
+				out.Header.Get(actionHeader) != tt.wantAction {
+				t.Fatalf("message = %s %s %v", out.Subject, out.Data, out.Header)
+			}
+		})
+	}
+}
+
+func TestRunMQTTSession(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	prev := config.MQTT
+	config.MQTT.URL = "tcp://" + ln.Addr().String()
+	config.MQTT.KeepAliveSeconds = 30
+	config.MQTT.QoS = 1
+	config.MQTT.ShareGroup = "workers"
+	t.Cleanup(func() { config.MQTT = prev })
+	js := &fakeJetStream{}
+	useJetStream(t, js)
+	routes, err := parseMQTTTopics("sensors/+/temperature=iot.temperature.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The broker sends one QoS 1 message ahead of the SUBACK and one
+	// unrouted QoS 0 message after it, then waits for the PUBACK
+	brokerErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			brokerErr <- err
+			return
+		}
+		defer conn.Close()
+		b := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+		if header, _, err := b.read(); err != nil || header != mqttConnect {
+			brokerErr <- errors.New("no CONNECT")
+			return
+		}
+		b.write(mqttConnAck, []byte{0, 0})
+		_, body, err := b.read()
+		if err != nil || !bytes.Contains(body, []byte("$share/workers/sensors/+/temperature")) {
+			brokerErr <- errors.New("no shared SUBSCRIBE")
+			return
+		}
+		b.write(0x32, append(mqttString(nil, "sensors/s1/temperature"), 0, 7, '{', '}'))
+		b.write(mqttSubAck, []byte{0, 1, 1})
+		b.write(0x30, append(mqttString(nil, "other/topic"), 'x'))
+		header, ack, err := b.read()
+		if err != nil || header != mqttPubAck || !bytes.Equal(ack, []byte{0, 7}) {
+			brokerErr <- errors.New("no PUBACK for packet 7")
+			return
+		}
+		brokerErr <- nil
+	}()
+
+	unrouted := mqttCount("unrouted")
+	err = runMQTTSession(context.Background(), "c1", routes)
+	if err == nil {
+		t.Fatal("session ended without an error")
+	}
+	if err := <-brokerErr; err != nil {
+		t.Fatal(err)
+	}
+	if len(js.published) != 1 || js.published[0].Subject != "iot.temperature.s1" {
+		t.Fatalf("published %+v", js.published)
+	}
+	if mqttCount("unrouted") != unrouted+1 {
+		t.Fatal("unrouted message not counted")
+	}
+}
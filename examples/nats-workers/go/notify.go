@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// notifyAction sends an SMS or push notification to each recipient through
+// a pluggable provider (twilio, fcm, apns):
+//
+//	{"provider": "twilio", "credentials_secret": "twilio_main", "from": "+15550100",
+//	 "to": ["{{.phone}}"], "body": "Your order {{.order_id}} shipped"}
+//
+// Credentials are a JSON document in rule_action_secrets. Every recipient
+// gets a row in rule_notification_receipts; on redelivery, recipients
+// already sent for the same stream message are skipped.
+type notifyAction struct{}
+
+type notifyConfig struct {
+	Provider          string            `json:"provider"`
+	CredentialsSecret string            `json:"credentials_secret"`
+	To                []string          `json:"to"`
+	Title             string            `json:"title"`
+	Body              string            `json:"body"`
+	Data              map[string]string `json:"data"`
+}
+
+// notification is one message to one recipient. Options is the action's
+// config, from which providers read their own settings.
+type notification struct {
+	Recipient string
+	Title     string
+	Body      string
+	Data      map[string]string
+	Options   json.RawMessage
+}
+
+// notifyProvider delivers notifications for one service. Send returns the
+// provider's message id; worker.Permanent errors, such as an invalid phone
+// number or an unregistered device token, are recorded as rejected and not
+// retried.
+type notifyProvider interface {
+	Send(ctx context.Context, credentials []byte, n *notification) (string, error)
+}
+
+var notifyProviders = map[string]notifyProvider{}
+
+// registerNotifyProvider makes a provider available to notify actions
+func registerNotifyProvider(name string, provider notifyProvider) {
+	if _, exists := notifyProviders[name]; exists {
+		panic("notify provider registered twice: " + name)
+	}
+	notifyProviders[name] = provider
+}
+
+func init() {
+	registerAction("notify", notifyAction{})
+}
+
+func (notifyAction) Execute(ctx context.Context, m *ActionMessage) (string, error) {
+	var cfg notifyConfig
+	if err := m.Config.decode(&cfg); err != nil {
+		return "", err
+	}
+	provider, ok := notifyProviders[cfg.Provider]
+	if !ok {
+		names := make([]string, 0, len(notifyProviders))
+		for name := range notifyProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("action %s has unknown provider %q (expected %s)", m.Config.Name, cfg.Provider, strings.Join(names, ", "))
+	}
+	if cfg.CredentialsSecret == "" {
+		return "", fmt.Errorf("action %s has no credentials_secret", m.Config.Name)
+	}
+	credentials, err := getSecret(ctx, cfg.CredentialsSecret)
+	if err != nil {
+		return "", err
+	}
+
+	data := m.Payload.Data
+	recipients, err := renderRecipients(cfg.To, data)
+	if err != nil {
+		return "", fmt.Errorf("to: %w", err)
+	}
+	if len(recipients) == 0 {
+		return "", fmt.Errorf("action %s has no recipients", m.Config.Name)
+	}
+	title, err := renderText(cfg.Title, data)
+	if err != nil {
+		return "", fmt.Errorf("title: %w", err)
+	}
+	body, err := renderText(cfg.Body, data)
+	if err != nil {
+		return "", fmt.Errorf("body: %w", err)
+	}
+	extra := make(map[string]string, len(cfg.Data))
+	for key, text := range cfg.Data {
+		if extra[key], err = renderText(text, data); err != nil {
+			return "", fmt.Errorf("data.%s: %w", key, err)
+		}
+	}
+
+	var sequence *uint64
+	if meta, err := m.Msg.Metadata(); err == nil {
+		sequence = &meta.Sequence.Stream
+	}
+
+	var sent, skipped, rejected int
+	var retryErr error
+	for _, recipient := range recipients {
+		if sequence != nil && alreadyNotified(m.Config.Name, *sequence, recipient) {
+			skipped++
+			continue
+		}
+
+		n := &notification{Recipient: recipient, Title: title, Body: body, Data: extra, Options: m.Config.Config}
+		messageID, err := provider.Send(ctx, []byte(credentials), n)
+
+		status := "sent"
+		switch {
+		case err == nil:
+			sent++
+		case worker.IsPermanent(err):
+			status = "rejected"
+			rejected++
+		default:
+			status = "failed"
+			retryErr = err
+		}
+		recordReceipt(m, cfg.Provider, sequence, recipient, status, messageID, err)
+	}
+
+	summary := fmt.Sprintf("%s: %d sent, %d rejected, %d already sent", cfg.Provider, sent, rejected, skipped)
+	if retryErr != nil {
+		return "", fmt.Errorf("%s; retrying failures: %w", summary, retryErr)
+	}
+	return summary, nil
+}
+
+// renderRecipients renders each recipient template; a template may yield
+// several comma-separated recipients, and empty results are skipped
+func renderRecipients(templates []string, data map[string]interface{}) ([]string, error) {
+	var recipients []string
+	for _, text := range templates {
+		rendered, err := renderText(text, data)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range strings.Split(rendered, ",") {
+			if r = strings.TrimSpace(r); r != "" && r != "<no value>" {
+				recipients = append(recipients, r)
+			}
+		}
+	}
+	return recipients, nil
+}
+
+// alreadyNotified reports whether a previous delivery of the same stream
+// message reached the recipient. Lookup errors count as "not sent".
+func alreadyNotified(action string, sequence uint64, recipient string) bool {
+	var exists bool
+	err := opsQueryRow([]interface{}{&exists},
+		`SELECT EXISTS (
+		     SELECT 1 FROM rule_notification_receipts
+		     WHERE action_name = $1 AND stream_name = $2 AND stream_sequence = $3
+		       AND recipient = $4 AND status IN ('sent', 'delivered')
+		 )`,
+		action, config.Worker.StreamName, sequence, recipient,
+	)
+	if err != nil {
+		log.Printf("⚠️  Receipt lookup failed: %v", err)
+		return false
+	}
+	return exists
+}
+
+// recordReceipt stores the outcome for one recipient, if the message is
+// in the audit sample. Failing to record a receipt does not fail the
+// delivery.
+func recordReceipt(m *ActionMessage, provider string, sequence *uint64, recipient, status, messageID string, sendErr error) {
+	if !auditSampled(m.traceID, sendErr != nil) {
+		return
+	}
+	var errText, providerID sql.NullString
+	if sendErr != nil {
+		errText = sql.NullString{String: sendErr.Error(), Valid: true}
+	}
+	if messageID != "" {
+		providerID = sql.NullString{String: messageID, Valid: true}
+	}
+	var eventKey sql.NullString
+	if m.Payload.EventKey != "" {
+		eventKey = sql.NullString{String: scrubField("$.event_key", m.Payload.EventKey), Valid: true}
+	}
+
+	err := auditInsert("rule_notification_receipts",
+		[]string{"action_name", "provider", "recipient", "status", "provider_message_id", "error", "stream_name", "stream_sequence", "event_key", "trace_id"},
+		m.Config.Name, provider, recipient, status, providerID, errText,
+		config.Worker.StreamName, sequence, eventKey, m.traceID,
+	)
+	if err != nil && !errors.Is(err, errOpsBuffered) {
+		log.Printf("⚠️  Failed to record notification receipt: %v", err)
+	}
+}
+
+// signJWT builds a compact JWS from header and claims, signing the
+// "header.claims" input with sign
+func signJWT(header, claims interface{}, sign func(digest []byte) ([]byte, error)) (string, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// cryptoSigner adapts a crypto.Signer to signJWT for SHA-256 digests
+func cryptoSigner(signer crypto.Signer) func([]byte) ([]byte, error) {
+	return func(digest []byte) ([]byte, error) {
+		return signer.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+func TestRenderRecipients(t *testing.T) {
+	data := map[string]interface{}{"phone": "+15550100", "devices": "tok-a, tok-b,"}
+	tests := []struct {
+		name      string
+		templates []string
+		want      []string
+	}{
+		{name: "literal", templates: []string{"+15550199"}, want: []string{"+15550199"}},
+		{name: "template", templates: []string{"{{.phone}}"}, want: []string{"+15550100"}},
+		{name: "comma separated", templates: []string{"{{.devices}}"}, want: []string{"tok-a", "tok-b"}},
+		{name: "missing skipped", templates: []string{"{{.missing}}", "", "{{.phone}}"}, want: []string{"+15550100"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderRecipients(tt.templates, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Fatalf("recipients = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := renderRecipients([]string{"{{"}, data); err == nil {
+		t.Fatal("bad template accepted")
+	}
+}
+
+// splitJWT decodes a compact JWS and returns its claims, signing input,
+// and signature
+func splitJWT(t *testing.T, token string) (header, claims map[string]interface{}, input string, signature []byte) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token has %d parts", len(parts))
+	}
+	decode := func(s string, v interface{}) {
+		raw, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == nil {
+			signature = raw
+			return
+		}
+		if err := json.Unmarshal(raw, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decode(parts[0], &header)
+	decode(parts[1], &claims)
+	decode(parts[2], nil)
+	return header, claims, parts[0] + "." + parts[1], signature
+}
+
+func testRSAKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func testECKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestSignJWT(t *testing.T) {
+	rsaKey, _ := testRSAKey(t)
+	token, err := signJWT(map[string]string{"alg": "RS256"}, map[string]interface{}{"iss": "svc"}, cryptoSigner(rsaKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, claims, input, signature := splitJWT(t, token)
+	if header["alg"] != "RS256" || claims["iss"] != "svc" {
+		t.Fatalf("header %v claims %v", header, claims)
+	}
+	digest := sha256.Sum256([]byte(input))
+	if err := rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatalf("RS256 signature does not verify: %v", err)
+	}
+
+	ecKey, ecPEM := testECKey(t)
+	token, err = apnsProviderToken(&apnsCredentials{TeamID: "TEAM", KeyID: "KEY1", PrivateKey: ecPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, claims, input, signature = splitJWT(t, token)
+	if header["alg"] != "ES256" || header["kid"] != "KEY1" || claims["iss"] != "TEAM" {
+		t.Fatalf("header %v claims %v", header, claims)
+	}
+	if len(signature) != 64 {
+		t.Fatalf("ES256 signature is %d bytes, want raw r||s (64)", len(signature))
+	}
+	digest = sha256.Sum256([]byte(input))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&ecKey.PublicKey, digest[:], r, s) {
+		t.Fatal("ES256 signature does not verify")
+	}
+
+	// APNs needs an EC key
+	_, rsaPEM := testRSAKey(t)
+	if _, err := apnsProviderToken(&apnsCredentials{TeamID: "T", KeyID: "K", PrivateKey: rsaPEM}); err == nil {
+		t.Fatal("RSA key accepted for APNs")
+	}
+	if _, err := parsePrivateKey("not pem"); err == nil {
+		t.Fatal("non-PEM key accepted")
+	}
+}
+
+func resetPushTokens(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		pushTokensMu.Lock()
+		pushTokens = map[string]bearerToken{}
+		pushTokensMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestTwilioProvider(t *testing.T) {
+	const creds = `{"account_sid": "AC1", "auth_token": "secret"}`
+	tests := []struct {
+		name          string
+		credentials   string
+		options       string
+		status        int
+		reply         string
+		wantID        string
+		wantForm      url.Values
+		wantErr       string
+		wantPermanent bool
+	}{
+		{name: "sent from number", credentials: creds, options: `{"from": "+15550100", "status_callback": "https://cb.test/sms"}`,
+			status: 201, reply: `{"sid": "SM1", "status": "queued"}`, wantID: "SM1",
+			wantForm: url.Values{"To": {"+15550199"}, "Body": {"hi"}, "From": {"+15550100"}, "StatusCallback": {"https://cb.test/sms"}}},
+		{name: "messaging service wins", credentials: creds, options: `{"from": "+15550100", "messaging_service_sid": "MG1"}`,
+			status: 201, reply: `{"sid": "SM2"}`, wantID: "SM2",
+			wantForm: url.Values{"To": {"+15550199"}, "Body": {"hi"}, "MessagingServiceSid": {"MG1"}}},
+		{name: "invalid number", credentials: creds, options: `{"from": "+15550100"}`,
+			status: 400, reply: `{"code": 21211, "message": "Invalid 'To' Phone Number"}`,
+			wantErr: "twilio 21211: Invalid 'To' Phone Number", wantPermanent: true},
+		{name: "server error", credentials: creds, options: `{"from": "+15550100"}`,
+			status: 503, reply: `{"message": "unavailable"}`, wantErr: "twilio HTTP 503: unavailable"},
+		{name: "no sender", credentials: creds, options: `{}`, wantErr: "needs from or messaging_service_sid"},
+		{name: "bad credentials", credentials: `{"account_sid": "AC1"}`, options: `{}`, wantErr: "need account_sid and auth_token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/Accounts/AC1/Messages.json" {
+					t.Errorf("path = %s", r.URL.Path)
+				}
+				if user, pass, _ := r.BasicAuth(); user != "AC1" || pass != "secret" {
+					t.Errorf("basic auth = %s:%s", user, pass)
+				}
+				r.ParseForm()
+				if tt.wantForm != nil && r.PostForm.Encode() != tt.wantForm.Encode() {
+					t.Errorf("form = %s, want %s", r.PostForm.Encode(), tt.wantForm.Encode())
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.reply)
+			}))
+			defer srv.Close()
+			defer func(u string) { twilioAPIURL = u }(twilioAPIURL)
+			twilioAPIURL = srv.URL
+
+			id, err := twilioProvider{}.Send(context.Background(), []byte(tt.credentials),
+				&notification{Recipient: "+15550199", Body: "hi", Options: json.RawMessage(tt.options)})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if worker.IsPermanent(err) != tt.wantPermanent {
+					t.Fatalf("permanent = %v, want %v", worker.IsPermanent(err), tt.wantPermanent)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.wantID {
+				t.Fatalf("id = %q, want %q", id, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestFCMProvider(t *testing.T) {
+	resetPushTokens(t)
+	rsaKey, rsaPEM := testRSAKey(t)
+
+	var exchanges atomic.Int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchanges.Add(1)
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("grant_type = %q", r.PostForm.Get("grant_type"))
+		}
+		_, claims, input, signature := splitJWT(t, r.PostForm.Get("assertion"))
+		digest := sha256.Sum256([]byte(input))
+		if err := rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			t.Errorf("assertion signature: %v", err)
+		}
+		if claims["iss"] != "push@proj.iam" || claims["scope"] != fcmScope {
+			t.Errorf("claims = %v", claims)
+		}
+		io.WriteString(w, `{"access_token": "ya29", "expires_in": 3600}`)
+	}))
+	defer tokenSrv.Close()
+
+	sendSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/proj/messages:send" || r.Header.Get("Authorization") != "Bearer ya29" {
+			t.Errorf("%s with %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		var body struct {
+			Message struct {
+				Token        string            `json:"token"`
+				Notification map[string]string `json:"notification"`
+				Data         map[string]string `json:"data"`
+			} `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch body.Message.Token {
+		case "gone":
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error": {"status": "NOT_FOUND", "message": "Requested entity was not found."}}`)
+		case "busy":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `{"error": {"status": "UNAVAILABLE", "message": "try later"}}`)
+		default:
+			if body.Message.Notification["title"] != "Shipped" || body.Message.Data["order_id"] != "7" {
+				t.Errorf("message = %+v", body.Message)
+			}
+			io.WriteString(w, `{"name": "projects/proj/messages/0:1"}`)
+		}
+	}))
+	defer sendSrv.Close()
+	defer func(u string) { fcmAPIURL = u }(fcmAPIURL)
+	fcmAPIURL = sendSrv.URL
+
+	credentials, _ := json.Marshal(fcmServiceAccount{
+		ProjectID: "proj", ClientEmail: "push@proj.iam", PrivateKey: rsaPEM, TokenURI: tokenSrv.URL,
+	})
+
+	tests := []struct {
+		name          string
+		token         string
+		wantID        string
+		wantErr       string
+		wantPermanent bool
+	}{
+		{name: "sent", token: "device-1", wantID: "projects/proj/messages/0:1"},
+		{name: "unregistered", token: "gone", wantErr: "fcm NOT_FOUND", wantPermanent: true},
+		{name: "unavailable", token: "busy", wantErr: "fcm HTTP 503: try later"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := fcmProvider{}.Send(context.Background(), credentials, &notification{
+				Recipient: tt.token, Title: "Shipped", Body: "Order 7", Data: map[string]string{"order_id": "7"},
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if worker.IsPermanent(err) != tt.wantPermanent {
+					t.Fatalf("permanent = %v, want %v", worker.IsPermanent(err), tt.wantPermanent)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.wantID {
+				t.Fatalf("id = %q, want %q", id, tt.wantID)
+			}
+		})
+	}
+
+	// The access token is exchanged once and reused
+	if n := exchanges.Load(); n != 1 {
+		t.Fatalf("token exchanged %d times, want 1", n)
+	}
+
+	if _, err := (fcmProvider{}).Send(context.Background(), []byte(`{"project_id": "p"}`), &notification{}); err == nil {
+		t.Fatal("credentials without client_email accepted")
+	}
+}
+
+func TestAPNsProvider(t *testing.T) {
+	resetPushTokens(t)
+	_, ecPEM := testECKey(t)
+	credentials, _ := json.Marshal(apnsCredentials{TeamID: "TEAM", KeyID: "KEY1", PrivateKey: ecPEM})
+
+	tests := []struct {
+		name          string
+		options       string
+		status        int
+		reason        string
+		wantID        string
+		wantHost      string
+		wantErr       string
+		wantPermanent bool
+	}{
+		{name: "sent", options: `{"topic": "com.example.app", "sound": "default"}`, status: 200, wantID: "apns-1", wantHost: "production"},
+		{name: "sandbox", options: `{"topic": "com.example.app", "sandbox": true}`, status: 200, wantID: "apns-1", wantHost: "sandbox"},
+		{name: "unregistered", options: `{"topic": "com.example.app"}`, status: 410, reason: "Unregistered",
+			wantErr: "apns 410: Unregistered", wantPermanent: true},
+		{name: "bad token", options: `{"topic": "com.example.app"}`, status: 400, reason: "BadDeviceToken",
+			wantErr: "apns 400: BadDeviceToken", wantPermanent: true},
+		{name: "idle timeout is retried", options: `{"topic": "com.example.app"}`, status: 400, reason: "IdleTimeout",
+			wantErr: "apns HTTP 400: IdleTimeout"},
+		{name: "no topic", options: `{}`, wantErr: "apns needs a topic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serve := func(host string) *httptest.Server {
+				return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if want := tt.wantHost; host != want && !(want == "" && host == "production") {
+						t.Errorf("sent to %s, want %s", host, want)
+					}
+					if r.URL.Path != "/3/device/device-1" || r.Header.Get("apns-topic") != "com.example.app" ||
+						!strings.HasPrefix(r.Header.Get("Authorization"), "bearer ") {
+						t.Errorf("%s topic %q auth %q", r.URL.Path, r.Header.Get("apns-topic"), r.Header.Get("Authorization"))
+					}
+					var payload map[string]interface{}
+					json.NewDecoder(r.Body).Decode(&payload)
+					if payload["order_id"] != "7" || payload["aps"] == nil {
+						t.Errorf("payload = %v", payload)
+					}
+					if tt.status != http.StatusOK {
+						w.WriteHeader(tt.status)
+						json.NewEncoder(w).Encode(map[string]string{"reason": tt.reason})
+						return
+					}
+					w.Header().Set("apns-id", "apns-1")
+				}))
+			}
+			production, sandbox := serve("production"), serve("sandbox")
+			defer production.Close()
+			defer sandbox.Close()
+			defer func(p, d string) { apnsProduction, apnsDevelopment = p, d }(apnsProduction, apnsDevelopment)
+			apnsProduction, apnsDevelopment = production.URL, sandbox.URL
+
+			id, err := apnsProvider{}.Send(context.Background(), credentials, &notification{
+				Recipient: "device-1", Title: "Shipped", Data: map[string]string{"order_id": "7"},
+				Options: json.RawMessage(tt.options),
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if worker.IsPermanent(err) != tt.wantPermanent {
+					t.Fatalf("permanent = %v, want %v", worker.IsPermanent(err), tt.wantPermanent)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.wantID {
+				t.Fatalf("id = %q, want %q", id, tt.wantID)
+			}
+		})
+	}
+}
+
+// fakeNotifier fails recipients by prefix: "bad" permanently, "down" with
+// a retryable error
+type fakeNotifier struct{ sent []string }
+
+func (f *fakeNotifier) Send(ctx context.Context, credentials []byte, n *notification) (string, error) {
+	if string(credentials) != "creds" {
+		return "", errors.New("wrong credentials")
+	}
+	switch {
+	case strings.HasPrefix(n.Recipient, "bad"):
+		return "", worker.Permanent(errors.New("invalid recipient"))
+	case strings.HasPrefix(n.Recipient, "down"):
+		return "", errors.New("provider unavailable")
+	}
+	f.sent = append(f.sent, n.Recipient+":"+n.Title+":"+n.Body+":"+n.Data["ref"])
+	return "id-" + n.Recipient, nil
+}
+
+func TestNotifyAction(t *testing.T) {
+	tests := []struct {
+		name     string
+		to       string
+		provider string
+		want     string
+		wantSent []string
+		wantErr  string
+	}{
+		{name: "all sent", to: `["a", "{{.phone}}"]`, provider: "fake",
+			want: "fake: 2 sent, 0 rejected, 0 already sent", wantSent: []string{"a:Hi:Order 7:r-7", "+1555:Hi:Order 7:r-7"}},
+		{name: "rejected recipients are not retried", to: `["a", "bad-1"]`, provider: "fake",
+			want: "fake: 1 sent, 1 rejected, 0 already sent", wantSent: []string{"a:Hi:Order 7:r-7"}},
+		{name: "failures are retried", to: `["a", "down-1"]`, provider: "fake",
+			wantErr: "fake: 1 sent, 0 rejected, 0 already sent; retrying failures: provider unavailable"},
+		{name: "no recipients", to: `["{{.missing}}"]`, provider: "fake", wantErr: "has no recipients"},
+		{name: "unknown provider", to: `["a"]`, provider: "pigeon", wantErr: `unknown provider "pigeon" (expected apns, fake, fcm, twilio)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeNotifier{}
+			notifyProviders["fake"] = fake
+			defer delete(notifyProviders, "fake")
+
+			mock := mockDB(t)
+			secretsMu.Lock()
+			secrets = map[string]cachedSecret{}
+			secretsMu.Unlock()
+			if tt.provider == "fake" {
+				mock.ExpectQuery("FROM rule_action_secrets").WithArgs("fake_creds").
+					WillReturnRows(sqlmock.NewRows([]string{"decrypt_credential"}).AddRow("creds"))
+			}
+
+			cfg := `{"provider": "` + tt.provider + `", "credentials_secret": "fake_creds", "to": ` + tt.to + `,
+				"title": "Hi", "body": "Order {{.order_id}}", "data": {"ref": "r-{{.order_id}}"}}`
+			m := &ActionMessage{
+				Msg:     nats.NewMsg("rules.notify"),
+				Payload: &WebhookPayload{Data: map[string]interface{}{"order_id": "7", "phone": "+1555"}},
+				Config:  &ActionConfig{Name: "shipped", Type: "notify", Config: json.RawMessage(cfg)},
+			}
+			got, err := notifyAction{}.Execute(context.Background(), m)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("summary = %q, want %q", got, tt.want)
+			}
+			if strings.Join(fake.sent, ",") != strings.Join(tt.wantSent, ",") {
+				t.Fatalf("sent = %v, want %v", fake.sent, tt.wantSent)
+			}
+		})
+	}
+}
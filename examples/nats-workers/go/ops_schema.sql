@@ -0,0 +1,444 @@
+-- Operational tables: statistics and audit records written by the worker.
+--
+-- Applied idempotently on startup to OPS_DATABASE_URL, which defaults to
+-- DATABASE_URL. A separate operational database does not need the rule
+-- engine extension, so the extension's consumer statistics table and
+-- function are created here when missing.
+
+-- Consumer statistics (created by the extension in the rule engine database)
+CREATE TABLE IF NOT EXISTS rule_nats_consumer_stats (
+    consumer_id SERIAL PRIMARY KEY,
+    stream_name TEXT NOT NULL,
+    consumer_name TEXT NOT NULL,
+    queue_group TEXT,
+    ack_policy TEXT,
+    max_deliver INTEGER,
+    messages_delivered BIGINT DEFAULT 0,
+    messages_acknowledged BIGINT DEFAULT 0,
+    messages_pending BIGINT DEFAULT 0,
+    messages_redelivered BIGINT DEFAULT 0,
+    avg_processing_time_ms NUMERIC(10,2),
+    last_active_at TIMESTAMPTZ,
+    active BOOLEAN DEFAULT true,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(stream_name, consumer_name)
+);
+
+DO $do$
+BEGIN
+    IF to_regproc('rule_nats_consumer_update_stats') IS NULL THEN
+        CREATE FUNCTION rule_nats_consumer_update_stats(
+            p_stream_name TEXT,
+            p_consumer_name TEXT,
+            p_messages_delivered BIGINT,
+            p_messages_acknowledged BIGINT,
+            p_messages_pending BIGINT,
+            p_avg_processing_time_ms NUMERIC DEFAULT NULL
+        ) RETURNS BOOLEAN AS $fn$
+            INSERT INTO rule_nats_consumer_stats (
+                stream_name, consumer_name, messages_delivered, messages_acknowledged,
+                messages_pending, avg_processing_time_ms, last_active_at, updated_at
+            ) VALUES (
+                p_stream_name, p_consumer_name, p_messages_delivered, p_messages_acknowledged,
+                p_messages_pending, p_avg_processing_time_ms, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+            )
+            ON CONFLICT (stream_name, consumer_name) DO UPDATE SET
+                messages_delivered = EXCLUDED.messages_delivered,
+                messages_acknowledged = EXCLUDED.messages_acknowledged,
+                messages_pending = EXCLUDED.messages_pending,
+                avg_processing_time_ms = COALESCE(EXCLUDED.avg_processing_time_ms, rule_nats_consumer_stats.avg_processing_time_ms),
+                last_active_at = EXCLUDED.last_active_at,
+                updated_at = EXCLUDED.updated_at
+            RETURNING true;
+        $fn$ LANGUAGE sql;
+    END IF;
+END
+$do$;
+
+-- Consumer lag samples and failure counts reported by workers
+ALTER TABLE rule_nats_consumer_stats ADD COLUMN IF NOT EXISTS messages_failed BIGINT DEFAULT 0;
+ALTER TABLE rule_nats_consumer_stats ADD COLUMN IF NOT EXISTS messages_expired BIGINT DEFAULT 0;
+ALTER TABLE rule_nats_consumer_stats ADD COLUMN IF NOT EXISTS ack_floor_stream_seq BIGINT;
+ALTER TABLE rule_nats_consumer_stats ADD COLUMN IF NOT EXISTS ack_floor_consumer_seq BIGINT;
+ALTER TABLE rule_nats_consumer_stats ADD COLUMN IF NOT EXISTS lag_sampled_at TIMESTAMPTZ;
+
+COMMENT ON COLUMN rule_nats_consumer_stats.messages_expired IS 'Messages acknowledged without delivery because they outlived their TTL';
+COMMENT ON COLUMN rule_nats_consumer_stats.ack_floor_stream_seq IS 'Stream sequence below which every message is acknowledged';
+COMMENT ON COLUMN rule_nats_consumer_stats.lag_sampled_at IS 'When messages_pending/messages_redelivered were last sampled from JetStream';
+
+-- Optional hourly quotas, enforced by every worker sharing the consumer
+ALTER TABLE rule_nats_consumer_stats ADD COLUMN IF NOT EXISTS max_messages_per_hour BIGINT;
+ALTER TABLE rule_nats_consumer_stats ADD COLUMN IF NOT EXISTS max_bytes_per_hour BIGINT;
+
+COMMENT ON COLUMN rule_nats_consumer_stats.max_messages_per_hour IS 'Workers pause the consumer for the rest of the hour after this many messages (NULL = unlimited)';
+COMMENT ON COLUMN rule_nats_consumer_stats.max_bytes_per_hour IS 'Workers pause the consumer for the rest of the hour after this many payload bytes (NULL = unlimited)';
+
+-- Messages and payload bytes processed per consumer and hour, summed
+-- across workers
+CREATE TABLE IF NOT EXISTS rule_nats_consumer_usage (
+    usage_id BIGSERIAL PRIMARY KEY,
+    stream_name TEXT NOT NULL,
+    consumer_name TEXT NOT NULL,
+    hour_start TIMESTAMPTZ NOT NULL,
+    messages BIGINT NOT NULL DEFAULT 0,
+    bytes BIGINT NOT NULL DEFAULT 0,
+    UNIQUE (stream_name, consumer_name, hour_start)
+);
+
+-- Latest health check of each probed webhook destination (rule_webhooks
+-- with a health_check), written by the leader worker
+CREATE TABLE IF NOT EXISTS rule_webhook_health (
+    webhook_id INTEGER PRIMARY KEY,
+    webhook_name TEXT NOT NULL,
+    healthy BOOLEAN NOT NULL,
+    consecutive_failures INTEGER NOT NULL DEFAULT 0,
+    detail TEXT,
+    latency_ms INTEGER,
+    checked_at TIMESTAMPTZ NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL
+);
+
+-- Messages skipped because they outlived their TTL before delivery
+CREATE TABLE IF NOT EXISTS rule_nats_expired_messages (
+    expired_id BIGSERIAL PRIMARY KEY,
+    stream_name TEXT NOT NULL,
+    consumer_name TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    stream_sequence BIGINT,
+    webhook_url TEXT,
+    published_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ NOT NULL,
+    expired_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    payload JSONB
+);
+
+CREATE INDEX IF NOT EXISTS idx_nats_expired_consumer ON rule_nats_expired_messages(stream_name, consumer_name);
+CREATE INDEX IF NOT EXISTS idx_nats_expired_time ON rule_nats_expired_messages(expired_at DESC);
+
+ALTER TABLE rule_nats_expired_messages ADD COLUMN IF NOT EXISTS replayed_at TIMESTAMPTZ;
+ALTER TABLE rule_nats_expired_messages ADD COLUMN IF NOT EXISTS replay_count INTEGER NOT NULL DEFAULT 0;
+
+COMMENT ON COLUMN rule_nats_expired_messages.replayed_at IS 'Last time an operator republished the message from the admin UI';
+ALTER TABLE rule_nats_expired_messages ADD COLUMN IF NOT EXISTS trace_id TEXT;
+CREATE INDEX IF NOT EXISTS idx_nats_expired_trace ON rule_nats_expired_messages(trace_id);
+
+-- Per-action execution counters reported by each worker
+CREATE TABLE IF NOT EXISTS rule_action_stats (
+    action_name TEXT NOT NULL,
+    stream_name TEXT NOT NULL,
+    consumer_name TEXT NOT NULL,
+    executed BIGINT NOT NULL DEFAULT 0,
+    succeeded BIGINT NOT NULL DEFAULT 0,
+    failed BIGINT NOT NULL DEFAULT 0,
+    avg_time_ms DOUBLE PRECISION,
+    last_error TEXT,
+    last_executed_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (action_name, stream_name, consumer_name)
+);
+
+ALTER TABLE rule_action_stats ADD COLUMN IF NOT EXISTS last_error_trace_id TEXT;
+
+COMMENT ON COLUMN rule_action_stats.last_error_trace_id IS 'Trace ID (X-Request-Id) of the message that failed with last_error';
+
+-- One row per recipient of each notify action delivery
+CREATE TABLE IF NOT EXISTS rule_notification_receipts (
+    receipt_id BIGSERIAL PRIMARY KEY,
+    action_name TEXT NOT NULL,
+    provider TEXT NOT NULL,
+    recipient TEXT NOT NULL,
+    status TEXT NOT NULL,
+    provider_message_id TEXT,
+    error TEXT,
+    stream_name TEXT,
+    stream_sequence BIGINT,
+    event_key TEXT,
+    sent_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_receipts_message ON rule_notification_receipts(action_name, stream_name, stream_sequence);
+CREATE INDEX IF NOT EXISTS idx_notification_receipts_provider_id ON rule_notification_receipts(provider, provider_message_id);
+CREATE INDEX IF NOT EXISTS idx_notification_receipts_sent ON rule_notification_receipts(sent_at DESC);
+ALTER TABLE rule_notification_receipts ADD COLUMN IF NOT EXISTS trace_id TEXT;
+CREATE INDEX IF NOT EXISTS idx_notification_receipts_trace ON rule_notification_receipts(trace_id);
+
+COMMENT ON COLUMN rule_notification_receipts.status IS 'sent, rejected (not retried), or failed (retried) by the worker; delivered/undelivered etc. from provider callbacks';
+
+-- Applies a provider delivery status callback (e.g. Twilio StatusCallback)
+CREATE OR REPLACE FUNCTION rule_notification_receipt_update(
+    p_provider TEXT,
+    p_provider_message_id TEXT,
+    p_status TEXT,
+    p_error TEXT DEFAULT NULL
+)
+RETURNS INTEGER AS $$
+    WITH updated AS (
+        UPDATE rule_notification_receipts
+        SET status = p_status,
+            error = COALESCE(p_error, error),
+            updated_at = CURRENT_TIMESTAMP
+        WHERE provider = p_provider AND provider_message_id = p_provider_message_id
+        RETURNING 1
+    )
+    SELECT count(*)::INTEGER FROM updated;
+$$ LANGUAGE sql;
+
+-- Per-minute delivery counts by destination and tenant, flushed by each
+-- worker; rolled up into hourly and daily summaries and kept short-term
+CREATE TABLE IF NOT EXISTS rule_delivery_stats (
+    bucket_start TIMESTAMPTZ NOT NULL,
+    stream_name TEXT NOT NULL,
+    consumer_name TEXT NOT NULL,
+    destination TEXT NOT NULL,
+    tenant TEXT NOT NULL DEFAULT '',
+    delivered BIGINT NOT NULL DEFAULT 0,
+    failed BIGINT NOT NULL DEFAULT 0,
+    expired BIGINT NOT NULL DEFAULT 0,
+    duplicates BIGINT NOT NULL DEFAULT 0,
+    total_time_ms BIGINT NOT NULL DEFAULT 0,
+    max_time_ms BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (bucket_start, stream_name, consumer_name, destination, tenant)
+);
+
+CREATE TABLE IF NOT EXISTS rule_delivery_stats_hourly (
+    period_start TIMESTAMPTZ NOT NULL,
+    stream_name TEXT NOT NULL,
+    consumer_name TEXT NOT NULL,
+    destination TEXT NOT NULL,
+    tenant TEXT NOT NULL DEFAULT '',
+    delivered BIGINT NOT NULL DEFAULT 0,
+    failed BIGINT NOT NULL DEFAULT 0,
+    expired BIGINT NOT NULL DEFAULT 0,
+    duplicates BIGINT NOT NULL DEFAULT 0,
+    total_time_ms BIGINT NOT NULL DEFAULT 0,
+    max_time_ms BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (period_start, stream_name, consumer_name, destination, tenant)
+);
+
+CREATE TABLE IF NOT EXISTS rule_delivery_stats_daily (
+    period_start TIMESTAMPTZ NOT NULL,
+    stream_name TEXT NOT NULL,
+    consumer_name TEXT NOT NULL,
+    destination TEXT NOT NULL,
+    tenant TEXT NOT NULL DEFAULT '',
+    delivered BIGINT NOT NULL DEFAULT 0,
+    failed BIGINT NOT NULL DEFAULT 0,
+    expired BIGINT NOT NULL DEFAULT 0,
+    duplicates BIGINT NOT NULL DEFAULT 0,
+    total_time_ms BIGINT NOT NULL DEFAULT 0,
+    max_time_ms BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (period_start, stream_name, consumer_name, destination, tenant)
+);
+
+-- Latency histogram of delivered messages: counts per bucket with upper
+-- bounds of 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, and 10000 ms,
+-- plus one for slower deliveries (latencyBucketsMs in deliverystats.go)
+ALTER TABLE rule_delivery_stats ADD COLUMN IF NOT EXISTS latency_histogram BIGINT[];
+ALTER TABLE rule_delivery_stats_hourly ADD COLUMN IF NOT EXISTS latency_histogram BIGINT[];
+ALTER TABLE rule_delivery_stats_daily ADD COLUMN IF NOT EXISTS latency_histogram BIGINT[];
+
+-- Adds two histograms element by element; NULL is an empty histogram
+CREATE OR REPLACE FUNCTION rule_histogram_add(a BIGINT[], b BIGINT[])
+RETURNS BIGINT[] AS $$
+    SELECT CASE
+        WHEN a IS NULL THEN b
+        WHEN b IS NULL THEN a
+        ELSE ARRAY(
+            SELECT COALESCE(x, 0) + COALESCE(y, 0)
+            FROM unnest(a, b) WITH ORDINALITY AS t(x, y, i)
+            ORDER BY i
+        )
+    END;
+$$ LANGUAGE sql IMMUTABLE;
+
+DO $do$
+BEGIN
+    IF to_regproc('rule_histogram_sum') IS NULL THEN
+        CREATE AGGREGATE rule_histogram_sum(BIGINT[]) (
+            SFUNC = rule_histogram_add,
+            STYPE = BIGINT[]
+        );
+    END IF;
+END
+$do$;
+
+COMMENT ON COLUMN rule_delivery_stats.destination IS 'webhook:<id>, action:<name>, or url:<host> for unregistered webhooks';
+COMMENT ON COLUMN rule_delivery_stats.tenant IS 'Value of STATS_TENANT_FIELD in the message data; empty when absent';
+COMMENT ON COLUMN rule_delivery_stats_daily.period_start IS 'Midnight UTC';
+
+-- Destinations whose owners were told deliveries keep failing (see
+-- FAILURE_ALERT_MINUTES); a row is removed once the destination delivers
+-- again
+CREATE TABLE IF NOT EXISTS rule_failure_alerts (
+    destination TEXT PRIMARY KEY,
+    failing_since TIMESTAMPTZ NOT NULL,
+    failures BIGINT NOT NULL,
+    action_name TEXT,
+    notified_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Recomputes recent hourly and daily summaries and prunes rolled-up raw
+-- rows older than p_raw_keep_days. Recent periods are recomputed, not
+-- appended to, so running it again (or after buffered writes arrive) is safe.
+CREATE OR REPLACE FUNCTION rule_delivery_stats_rollup(p_raw_keep_days INTEGER)
+RETURNS VOID AS $$
+DECLARE
+    v_hourly_from TIMESTAMPTZ;
+    v_daily_from TIMESTAMPTZ;
+BEGIN
+    SELECT date_trunc('hour', COALESCE(
+        (SELECT max(period_start) - INTERVAL '6 hours' FROM rule_delivery_stats_hourly),
+        (SELECT min(bucket_start) FROM rule_delivery_stats),
+        CURRENT_TIMESTAMP
+    )) INTO v_hourly_from;
+
+    INSERT INTO rule_delivery_stats_hourly (
+        period_start, stream_name, consumer_name, destination, tenant,
+        delivered, failed, expired, duplicates, total_time_ms, max_time_ms, latency_histogram
+    )
+    SELECT date_trunc('hour', bucket_start), stream_name, consumer_name, destination, tenant,
+           sum(delivered), sum(failed), sum(expired), sum(duplicates), sum(total_time_ms), max(max_time_ms),
+           rule_histogram_sum(latency_histogram)
+    FROM rule_delivery_stats
+    WHERE bucket_start >= v_hourly_from
+    GROUP BY 1, 2, 3, 4, 5
+    ON CONFLICT (period_start, stream_name, consumer_name, destination, tenant) DO UPDATE SET
+        delivered = EXCLUDED.delivered,
+        failed = EXCLUDED.failed,
+        expired = EXCLUDED.expired,
+        duplicates = EXCLUDED.duplicates,
+        total_time_ms = EXCLUDED.total_time_ms,
+        max_time_ms = EXCLUDED.max_time_ms,
+        latency_histogram = EXCLUDED.latency_histogram;
+
+    SELECT (date_trunc('day', COALESCE(
+        (SELECT max(period_start) - INTERVAL '1 day' FROM rule_delivery_stats_daily),
+        (SELECT min(period_start) FROM rule_delivery_stats_hourly),
+        CURRENT_TIMESTAMP
+    ) AT TIME ZONE 'UTC')) AT TIME ZONE 'UTC' INTO v_daily_from;
+
+    INSERT INTO rule_delivery_stats_daily (
+        period_start, stream_name, consumer_name, destination, tenant,
+        delivered, failed, expired, duplicates, total_time_ms, max_time_ms, latency_histogram
+    )
+    SELECT date_trunc('day', period_start AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+           stream_name, consumer_name, destination, tenant,
+           sum(delivered), sum(failed), sum(expired), sum(duplicates), sum(total_time_ms), max(max_time_ms),
+           rule_histogram_sum(latency_histogram)
+    FROM rule_delivery_stats_hourly
+    WHERE period_start >= v_daily_from
+    GROUP BY 1, 2, 3, 4, 5
+    ON CONFLICT (period_start, stream_name, consumer_name, destination, tenant) DO UPDATE SET
+        delivered = EXCLUDED.delivered,
+        failed = EXCLUDED.failed,
+        expired = EXCLUDED.expired,
+        duplicates = EXCLUDED.duplicates,
+        total_time_ms = EXCLUDED.total_time_ms,
+        max_time_ms = EXCLUDED.max_time_ms,
+        latency_histogram = EXCLUDED.latency_histogram;
+
+    -- Rows before the recompute window were rolled up by earlier runs
+    DELETE FROM rule_delivery_stats
+    WHERE bucket_start < CURRENT_TIMESTAMP - make_interval(days => p_raw_keep_days)
+      AND bucket_start < v_hourly_from;
+END;
+$$ LANGUAGE plpgsql;
+
+-- One row per message outcome, written with the rule_delivery_stats
+-- increment in the same transaction when STATS_TRANSACTIONAL is set, so the
+-- two can be reconciled exactly
+CREATE TABLE IF NOT EXISTS rule_delivery_outcomes (
+    outcome_id BIGSERIAL PRIMARY KEY,
+    stream_name TEXT NOT NULL,
+    consumer_name TEXT NOT NULL,
+    destination TEXT NOT NULL,
+    tenant TEXT NOT NULL,
+    recorded_at TIMESTAMPTZ NOT NULL,
+    stream_sequence BIGINT,
+    trace_id TEXT,
+    subject TEXT NOT NULL,
+    action TEXT NOT NULL,
+    outcome TEXT NOT NULL,
+    duration_ms BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_delivery_outcomes_time ON rule_delivery_outcomes(recorded_at);
+CREATE INDEX IF NOT EXISTS idx_delivery_outcomes_trace ON rule_delivery_outcomes(trace_id);
+
+-- Running worker instances. Each registers on startup and heartbeats every
+-- WORKER_HEARTBEAT_SECONDS with its consumer's lag; one not seen for
+-- dead_after_seconds that did not stop is dead, and the leader sets dead_at.
+CREATE TABLE IF NOT EXISTS rule_nats_workers (
+    worker_id TEXT PRIMARY KEY,
+    hostname TEXT NOT NULL,
+    pid INTEGER NOT NULL,
+    version TEXT NOT NULL,
+    config_hash TEXT NOT NULL,
+    stream_name TEXT NOT NULL,
+    consumer_name TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    stopped_at TIMESTAMPTZ
+);
+
+ALTER TABLE rule_nats_workers ADD COLUMN IF NOT EXISTS dead_after_seconds INTEGER;
+ALTER TABLE rule_nats_workers ADD COLUMN IF NOT EXISTS dead_at TIMESTAMPTZ;
+ALTER TABLE rule_nats_workers ADD COLUMN IF NOT EXISTS consumer_pending BIGINT;
+ALTER TABLE rule_nats_workers ADD COLUMN IF NOT EXISTS consumer_ack_pending BIGINT;
+ALTER TABLE rule_nats_workers ADD COLUMN IF NOT EXISTS lag_sampled_at TIMESTAMPTZ;
+ALTER TABLE rule_nats_workers ADD COLUMN IF NOT EXISTS messages_processed BIGINT;
+ALTER TABLE rule_nats_workers ADD COLUMN IF NOT EXISTS messages_failed BIGINT;
+ALTER TABLE rule_nats_workers ADD COLUMN IF NOT EXISTS extension_version TEXT;
+ALTER TABLE rule_nats_workers ADD COLUMN IF NOT EXISTS extension_compatible BOOLEAN;
+
+COMMENT ON COLUMN rule_nats_workers.config_hash IS 'Fingerprint of the worker''s settings, secrets excluded; replicas that differ run different configuration';
+COMMENT ON COLUMN rule_nats_workers.dead_after_seconds IS 'WORKER_DEAD_AFTER_SECONDS of the worker; NULL when it does not heartbeat';
+COMMENT ON COLUMN rule_nats_workers.extension_version IS 'Rule engine extension version in the worker''s primary database when it started';
+COMMENT ON COLUMN rule_nats_workers.extension_compatible IS 'False when the worker started with EXTENSION_CHECK=warn against a version it does not support';
+COMMENT ON COLUMN rule_nats_workers.consumer_pending IS 'Messages waiting on the worker''s consumer at its last lag sample';
+
+CREATE OR REPLACE VIEW rule_nats_workers_status AS
+SELECT worker_id, hostname, pid, version, config_hash, stream_name, consumer_name, subject,
+       started_at, last_seen_at, stopped_at,
+       CASE
+           WHEN stopped_at IS NOT NULL THEN 'stopped'
+           WHEN last_seen_at < CURRENT_TIMESTAMP - make_interval(secs => dead_after_seconds) THEN 'stale'
+           ELSE 'live'
+       END AS status,
+       consumer_pending, consumer_ack_pending, lag_sampled_at, messages_processed, messages_failed, dead_at,
+       extension_version, extension_compatible
+FROM rule_nats_workers;
+
+-- Requests and responses recorded for debugging while rule_webhooks.
+-- capture_until is in the future or the message is in
+-- rule_capture_requests. exchange holds {"request", "response"} with
+-- credentials redacted and the scrub rules applied to bodies, encrypted
+-- when PAYLOAD_ENCRYPTION is set.
+CREATE TABLE IF NOT EXISTS rule_webhook_captures (
+    capture_id BIGSERIAL PRIMARY KEY,
+    captured_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    webhook_id INTEGER,
+    destination TEXT NOT NULL,
+    trace_id TEXT,
+    message_id TEXT,
+    subject TEXT NOT NULL,
+    status INTEGER,
+    duration_ms INTEGER NOT NULL,
+    error TEXT,
+    exchange JSONB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_captures_time ON rule_webhook_captures(captured_at DESC);
+CREATE INDEX IF NOT EXISTS idx_webhook_captures_webhook ON rule_webhook_captures(webhook_id, captured_at DESC);
+CREATE INDEX IF NOT EXISTS idx_webhook_captures_trace ON rule_webhook_captures(trace_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_captures_message ON rule_webhook_captures(message_id);
+
+-- Messages to capture, by Nats-Msg-Id or trace ID, until expires_at
+CREATE TABLE IF NOT EXISTS rule_capture_requests (
+    message_id TEXT PRIMARY KEY,
+    requested_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL
+);
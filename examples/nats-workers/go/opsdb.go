@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// opsDB receives statistics and audit writes: consumer and action stats,
+// lag samples, expired messages, and notification receipts. It is db
+// unless OPS_DATABASE_URL names a separate database, so heavy audit
+// traffic cannot slow rule lookups on the primary.
+//
+// Writes go through opsWrite with a short timeout and never fail a
+// delivery. While the operational database is unreachable they are
+// buffered in memory (OPS_BUFFER_SIZE) and written once it recovers.
+var opsDB *sql.DB
+
+// opsWriteTimeout bounds each operational write; processMessage runs
+// serially, so a hung write would stall the consumer
+const opsWriteTimeout = 5 * time.Second
+
+// errOpsBuffered is returned by opsWrite when the write was kept for later
+var errOpsBuffered = errors.New("operational database unavailable, write buffered")
+
+var (
+	// opsSchemaReady is set once ops_schema.sql has been applied
+	opsSchemaReady atomic.Bool
+	// opsSchemaAttempt is the last time (Unix nanoseconds) a write tried to
+	// apply it, so an unavailable database is retried once per minute
+	opsSchemaAttempt atomic.Int64
+)
+
+// bufferedWrite is an operational write waiting for the database
+type bufferedWrite struct {
+	key   string
+	query string
+	args  []interface{}
+}
+
+var (
+	opsBufferMu  sync.Mutex
+	opsBuffer    []*bufferedWrite
+	opsDropped   uint64
+	opsBufferLog time.Time
+)
+
+// openOpsDB connects to the operational database. A separate database
+// that is down at startup is only logged; its schema is applied on the
+// first write after it recovers.
+func openOpsDB() error {
+	if config.Postgres.OpsURL == "" {
+		opsDB = db
+		opsHealth = primaryHealth
+		if err := ensureOpsSchema(); err != nil {
+			return err
+		}
+		opsSchemaReady.Store(true)
+		return nil
+	}
+
+	pool, err := openPostgres(config.Postgres.OpsURL)
+	if err != nil {
+		return fmt.Errorf("invalid OPS_DATABASE_URL: %w", err)
+	}
+	pool.SetMaxOpenConns(config.Postgres.OpsMaxConns)
+	pool.SetMaxIdleConns(config.Postgres.OpsMaxConns)
+	opsDB = pool
+
+	ctx, cancel := context.WithTimeout(context.Background(), opsWriteTimeout)
+	defer cancel()
+	if err := pool.PingContext(ctx); err != nil {
+		opsHealth.markUnhealthy(err)
+		log.Printf("⚠️  Operational database unavailable, statistics and audit records are buffered until it recovers")
+		return nil
+	}
+	log.Println("✅ Connected to operational PostgreSQL")
+	if err := ensureOpsSchema(); err != nil {
+		log.Printf("⚠️  %v", err)
+		return nil
+	}
+	opsSchemaReady.Store(true)
+	return nil
+}
+
+// opsWrite runs a statistics or audit write against opsDB. If the database
+// is unreachable the write is buffered and errOpsBuffered returned. Writes
+// with the same non-empty key supersede each other in the buffer, so
+// cumulative counters keep only their latest value.
+func opsWrite(key, query string, args ...interface{}) error {
+	if !opsHealth.ok() {
+		bufferOpsWrite(&bufferedWrite{key: key, query: query, args: args})
+		return errOpsBuffered
+	}
+	err := opsExec(query, args...)
+	if isRetryableDBError(err) || errors.Is(err, errOpsUnavailable) {
+		bufferOpsWrite(&bufferedWrite{key: key, query: query, args: args})
+		return errOpsBuffered
+	}
+	return err
+}
+
+// opsExec runs a write against opsDB with retries
+func opsExec(query string, args ...interface{}) error {
+	if err := ensureOpsReady(); err != nil {
+		return err
+	}
+	return withDBRetry(context.Background(), opsHealth, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), opsWriteTimeout)
+		defer cancel()
+		_, err := opsDB.ExecContext(ctx, query, args...)
+		return err
+	})
+}
+
+// opsQueryRow runs a lookup against opsDB. The row's context is released
+// once Scan has been called. When opsDB is the primary, the standby
+// answers while it is unavailable.
+func opsQueryRow(dest []interface{}, query string, args ...interface{}) error {
+	if err := ensureOpsReady(); err != nil {
+		return err
+	}
+	if opsDB == db {
+		return withPrimaryRead(context.Background(), func(pool *sql.DB) error {
+			ctx, cancel := context.WithTimeout(context.Background(), opsWriteTimeout)
+			defer cancel()
+			return pool.QueryRowContext(ctx, query, args...).Scan(dest...)
+		})
+	}
+	return withDBRetry(context.Background(), opsHealth, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), opsWriteTimeout)
+		defer cancel()
+		return opsDB.QueryRowContext(ctx, query, args...).Scan(dest...)
+	})
+}
+
+// errOpsUnavailable is returned while the operational schema cannot be
+// applied
+var errOpsUnavailable = errors.New("operational database unavailable")
+
+func ensureOpsReady() error {
+	if opsSchemaReady.Load() {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	last := opsSchemaAttempt.Load()
+	if now-last < int64(time.Minute) || !opsSchemaAttempt.CompareAndSwap(last, now) {
+		return errOpsUnavailable
+	}
+	if err := ensureOpsSchema(); err != nil {
+		log.Printf("⚠️  %v", err)
+		return errOpsUnavailable
+	}
+	opsSchemaReady.Store(true)
+	discoverCapabilities()
+	return nil
+}
+
+// bufferOpsWrite keeps a write for flushOpsBuffer, dropping the oldest
+// audit record when the buffer is full
+func bufferOpsWrite(w *bufferedWrite) {
+	opsBufferMu.Lock()
+	defer opsBufferMu.Unlock()
+
+	if w.key != "" {
+		for i, pending := range opsBuffer {
+			if pending.key == w.key {
+				opsBuffer[i] = w
+				return
+			}
+		}
+	}
+	if len(opsBuffer) >= config.Postgres.OpsBufferSize {
+		// Drop the oldest record; keyed statistics are few and kept
+		drop := 0
+		for i, pending := range opsBuffer {
+			if pending.key == "" {
+				drop = i
+				break
+			}
+		}
+		opsBuffer = append(opsBuffer[:drop], opsBuffer[drop+1:]...)
+		opsDropped++
+	}
+	opsBuffer = append(opsBuffer, w)
+
+	if time.Since(opsBufferLog) > time.Minute {
+		log.Printf("💾 Buffering operational writes until PostgreSQL recovers (%d pending, %d dropped)", len(opsBuffer), opsDropped)
+		opsBufferLog = time.Now()
+	}
+}
+
+func opsBuffered() int {
+	opsBufferMu.Lock()
+	defer opsBufferMu.Unlock()
+	return len(opsBuffer)
+}
+
+// flushOpsBuffer writes buffered writes in order, stopping at the first
+// one that fails with a retryable error. Writes that fail otherwise are
+// logged and discarded.
+func flushOpsBuffer() {
+	opsBufferMu.Lock()
+	pending := opsBuffer
+	opsBuffer = nil
+	opsBufferMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	written := 0
+	for i, w := range pending {
+		err := opsExec(w.query, w.args...)
+		if isRetryableDBError(err) || errors.Is(err, errOpsUnavailable) {
+			// Put the rest back ahead of anything buffered meanwhile
+			opsBufferMu.Lock()
+			opsBuffer = append(pending[i:], opsBuffer...)
+			opsBufferMu.Unlock()
+			break
+		}
+		if err != nil {
+			log.Printf("⚠️  Discarding buffered write: %v", err)
+			continue
+		}
+		written++
+	}
+	if written > 0 {
+		log.Printf("💾 Wrote %d buffered operational write(s)", written)
+	}
+}
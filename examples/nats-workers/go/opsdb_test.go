@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// mockOpsDB points opsDB at its own sqlmock for one test, with a ready
+// schema and a healthy database
+func mockOpsDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	pool, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.MatchExpectationsInOrder(false)
+
+	prevDB, prevHealth, prevReady, prevAttempt := opsDB, opsHealth, opsSchemaReady.Load(), opsSchemaAttempt.Load()
+	opsDB, opsHealth = pool, &dbHealth{name: "Operational PostgreSQL", healthy: true}
+	opsSchemaReady.Store(true)
+	t.Cleanup(func() {
+		opsDB, opsHealth = prevDB, prevHealth
+		opsSchemaReady.Store(prevReady)
+		opsSchemaAttempt.Store(prevAttempt)
+		pool.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return mock
+}
+
+func TestOpsWriteUsesOpsDB(t *testing.T) {
+	mockDB(t) // no expectations: nothing may reach the primary
+	ops := mockOpsDB(t)
+
+	ops.ExpectExec("INSERT INTO rule_nats_lag_samples").WithArgs("orders", 12).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := opsWrite("", "INSERT INTO rule_nats_lag_samples (consumer, pending) VALUES ($1, $2)", "orders", 12); err != nil {
+		t.Fatal(err)
+	}
+
+	var pending int
+	ops.ExpectQuery("SELECT pending FROM rule_nats_lag_samples").WillReturnRows(sqlmock.NewRows([]string{"pending"}).AddRow(12))
+	if err := opsQueryRow([]interface{}{&pending}, "SELECT pending FROM rule_nats_lag_samples LIMIT 1"); err != nil || pending != 12 {
+		t.Fatalf("opsQueryRow = %d, %v", pending, err)
+	}
+
+	// A query error is returned, not buffered
+	ops.ExpectExec("INSERT INTO rule_nats_lag_samples").WillReturnError(errors.New(`column "pending" does not exist`))
+	if err := opsWrite("", "INSERT INTO rule_nats_lag_samples (pending) VALUES ($1)", 1); err == nil || errors.Is(err, errOpsBuffered) {
+		t.Fatalf("err = %v", err)
+	}
+	if opsBuffered() != 0 {
+		t.Fatalf("buffered = %d", opsBuffered())
+	}
+}
+
+func TestOpenOpsDBDefaultsToPrimary(t *testing.T) {
+	primary := mockDB(t)
+	prevDB, prevHealth, prevURL := opsDB, opsHealth, config.Postgres.OpsURL
+	t.Cleanup(func() {
+		opsDB, opsHealth, config.Postgres.OpsURL = prevDB, prevHealth, prevURL
+		opsSchemaReady.Store(false)
+	})
+	config.Postgres.OpsURL = ""
+	opsSchemaReady.Store(false)
+
+	primary.ExpectExec("CREATE TABLE IF NOT EXISTS").WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := openOpsDB(); err != nil {
+		t.Fatal(err)
+	}
+	if opsDB != db || opsHealth != primaryHealth || !opsSchemaReady.Load() {
+		t.Fatal("operational writes are not routed to the primary")
+	}
+}
+
+// A separate operational database that was down at startup gets its
+// schema on the first write after it recovers, at most once a minute
+func TestEnsureOpsReady(t *testing.T) {
+	primary := mockDB(t)
+	ops := mockOpsDB(t)
+	opsSchemaReady.Store(false)
+	opsSchemaAttempt.Store(0)
+
+	ops.ExpectExec("CREATE TABLE IF NOT EXISTS").WillReturnError(errors.New("connection refused"))
+	if err := ensureOpsReady(); !errors.Is(err, errOpsUnavailable) {
+		t.Fatalf("err = %v", err)
+	}
+	// Within a minute of the failed attempt the schema is not retried
+	if err := ensureOpsReady(); !errors.Is(err, errOpsUnavailable) {
+		t.Fatalf("err = %v", err)
+	}
+
+	opsSchemaAttempt.Store(0)
+	ops.ExpectExec("CREATE TABLE IF NOT EXISTS").WillReturnResult(sqlmock.NewResult(0, 0))
+	// Capabilities are rediscovered once the schema is in place
+	primary.ExpectQuery("pg_proc").WillReturnRows(sqlmock.NewRows([]string{"proname"}))
+	ops.ExpectQuery("pg_proc").WillReturnRows(sqlmock.NewRows([]string{"proname"}))
+	if err := ensureOpsReady(); err != nil {
+		t.Fatal(err)
+	}
+	if !opsSchemaReady.Load() {
+		t.Fatal("schema not marked ready")
+	}
+	if err := ensureOpsReady(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// recordOutcome writes a message's outcome to rule_delivery_outcomes and
+// adds it to rule_delivery_stats in one statement, so in one transaction,
+// before the message is settled (STATS_TRANSACTIONAL). The two tables then
+// agree after any crash: either both have the outcome or neither does. A
+// write the operational database cannot take is buffered whole.
+func recordOutcome(m *ActionMessage, at time.Time, key deliveryStatsKey, bucket *deliveryStatsBucket, outcome string, duration time.Duration) {
+	percentiles := hasCapability("latency_percentiles")
+	args := deliveryStatsArgs(key, bucket, percentiles)
+	var seq sql.NullInt64
+	if meta, err := m.Msg.Metadata(); err == nil {
+		seq = sql.NullInt64{Int64: int64(meta.Sequence.Stream), Valid: true}
+	}
+	args = append(args, at, seq, m.traceID, m.Msg.Subject, m.metricsName(), outcome, duration.Milliseconds())
+
+	// An unreferenced data-modifying CTE still runs, in the statement's
+	// transaction
+	err := opsWrite("", fmt.Sprintf(
+		`WITH outcome AS (
+		     INSERT INTO rule_delivery_outcomes (
+		         stream_name, consumer_name, destination, tenant, recorded_at,
+		         stream_sequence, trace_id, subject, action, outcome, duration_ms
+		     ) VALUES ($2, $3, $4, $5, $13, $14, $15, $16, $17, $18, $19)
+		 )
+		 %s`, deliveryStatsUpsert(percentiles)), args...)
+	if err != nil && !errors.Is(err, errOpsBuffered) {
+		log.Printf("⚠️  [%d %s] Failed to record the %s outcome: %v", m.num, m.traceID, outcome, err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+)
+
+func TestRecordOutcome(t *testing.T) {
+	const insert = `WITH outcome AS \(\s+INSERT INTO rule_delivery_outcomes \(.*\) VALUES \(\$2, \$3, \$4, \$5, \$13, \$14, \$15, \$16, \$17, \$18, \$19\)\s+\)` +
+		`\s+INSERT INTO rule_delivery_stats`
+	histogram := make([]int64, len(latencyBucketsMs)+1)
+	histogram[latencyBucket(40)] = 1
+	tests := []struct {
+		name         string
+		outcome      string
+		duration     time.Duration
+		reply        string
+		functions    []string // nil: every capability
+		counts       []interface{}
+		latency      interface{}
+		seq          interface{} // nil: no stream sequence
+		err          error
+		wantBuffered int
+	}{
+		{name: "delivered", outcome: outcomeDelivered, duration: 40 * time.Millisecond,
+			reply:  "$JS.ACK.RULES.webhooks.1.42.7.1714564800000000000.0",
+			counts: []interface{}{int64(1), int64(0), int64(0), int64(0), int64(40), int64(40)}, latency: pq.Array(histogram),
+			seq: int64(42)},
+		{name: "failed", outcome: outcomeFailed, duration: time.Second,
+			counts: []interface{}{int64(0), int64(1), int64(0), int64(0), int64(0), int64(0)}},
+		{name: "without percentiles", outcome: outcomeDelivered, duration: 40 * time.Millisecond, functions: []string{},
+			counts: []interface{}{int64(1), int64(0), int64(0), int64(0), int64(40), int64(40)}, latency: nil},
+		// Buffered whole: the outcome and its increment still go together
+		{name: "database unavailable", outcome: outcomeDuplicate,
+			counts: []interface{}{int64(0), int64(0), int64(0), int64(1), int64(0), int64(0)},
+			err:    &pq.Error{Code: "57P01", Message: "terminating connection"}, wantBuffered: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetDeliveryStats(t)
+			resetOpsBuffer(t, 10)
+			ops := mockOpsDB(t)
+			useConsumer(t)
+			if tt.functions != nil {
+				useCapabilities(t, tt.functions...)
+			} else {
+				assumeCapabilities(t)
+			}
+			prevStats, prevAttempts := config.Stats, config.Postgres.RetryAttempts
+			t.Cleanup(func() { config.Stats, config.Postgres.RetryAttempts = prevStats, prevAttempts })
+			config.Stats.Transactional, config.Stats.TenantField, config.Stats.TenantToken = true, "tenant_id", 0
+			config.Postgres.RetryAttempts = 1
+
+			args := append([]interface{}{sqlmock.AnyArg(), "RULES", "webhooks", "webhook:crm", "acme"}, tt.counts...)
+			args = append(args, tt.latency, sqlmock.AnyArg(), tt.seq, "trace-7", "webhooks.orders", "webhook", tt.outcome, tt.duration.Milliseconds())
+			values := make([]driver.Value, len(args))
+			for i, a := range args {
+				values[i] = a
+			}
+			exec := ops.ExpectExec(insert).WithArgs(values...)
+			if tt.err != nil {
+				exec.WillReturnError(tt.err)
+			} else {
+				exec.WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			// Bound to a subscription, as JetStream metadata needs
+			msg := &nats.Msg{Subject: "webhooks.orders", Reply: tt.reply, Sub: &nats.Subscription{}}
+			m := &ActionMessage{Msg: msg, dedupKey: "webhook:crm", traceID: "trace-7",
+				Payload: &WebhookPayload{Data: map[string]interface{}{"tenant_id": "acme"}}}
+			recordDelivery(m, tt.outcome, tt.duration)
+
+			deliveryStatsMu.Lock()
+			pending := len(deliveryStats)
+			deliveryStatsMu.Unlock()
+			// Written with the outcome, so nothing is left for the next flush
+			if pending != 0 {
+				t.Fatalf("%d buckets left to flush", pending)
+			}
+			if opsBuffered() != tt.wantBuffered {
+				t.Fatalf("%d writes buffered, want %d", opsBuffered(), tt.wantBuffered)
+			}
+		})
+	}
+}
+
+func TestRecordDeliveryBatched(t *testing.T) {
+	resetDeliveryStats(t)
+	mockOpsDB(t) // no expectations: counted for the next flush instead
+	prev := config.Stats
+	t.Cleanup(func() { config.Stats = prev })
+	config.Stats.Transactional, config.Stats.TenantField = false, ""
+
+	m := &ActionMessage{Msg: &nats.Msg{Subject: "webhooks.orders"}, dedupKey: "webhook:crm", Payload: &WebhookPayload{}}
+	recordDelivery(m, outcomeDelivered, 10*time.Millisecond)
+	recordDelivery(m, outcomeDelivered, 30*time.Millisecond)
+	deliveryStatsMu.Lock()
+	defer deliveryStatsMu.Unlock()
+	for _, bucket := range deliveryStats {
+		if bucket.delivered != 2 || bucket.totalTimeMs != 40 {
+			t.Fatalf("bucket = %+v", bucket)
+		}
+	}
+	if len(deliveryStats) != 1 {
+		t.Fatalf("%d buckets", len(deliveryStats))
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+)
+
+// A minimal Parquet writer for archive batches: one row group of REQUIRED
+// columns, one PLAIN-encoded, GZIP-compressed data page per column. The
+// file metadata is Thrift compact protocol, written by hand to keep the
+// worker free of a Parquet dependency.
+
+// Parquet enum values used below
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetRequired = 0
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+	parquetJSON            = 19
+
+	parquetPlain    = 0
+	parquetGzip     = 2
+	parquetDataPage = 0
+	parquetRLE      = 3
+)
+
+// parquetColumn is one column of the file
+type parquetColumn struct {
+	Name          string
+	Type          int32
+	ConvertedType int32
+	Int64s        []int64
+	Strings       [][]byte
+}
+
+// archiveParquetColumns lays out archive records as columns
+func archiveParquetColumns(records []archiveRecord) []*parquetColumn {
+	columns := []*parquetColumn{
+		{Name: "published_at", Type: parquetInt64, ConvertedType: parquetTimestampMillis},
+		{Name: "subject", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		{Name: "stream_sequence", Type: parquetInt64, ConvertedType: -1},
+		{Name: "event_key", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		{Name: "action", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		{Name: "payload", Type: parquetByteArray, ConvertedType: parquetJSON},
+	}
+	for _, r := range records {
+		columns[0].Int64s = append(columns[0].Int64s, r.PublishedAt.UnixMilli())
+		columns[1].Strings = append(columns[1].Strings, []byte(r.Subject))
+		columns[2].Int64s = append(columns[2].Int64s, int64(r.StreamSequence))
+		columns[3].Strings = append(columns[3].Strings, []byte(r.EventKey))
+		columns[4].Strings = append(columns[4].Strings, []byte(r.Action))
+		columns[5].Strings = append(columns[5].Strings, r.Payload)
+	}
+	return columns
+}
+
+// writeParquet writes numRows rows of the given columns as a Parquet file
+func writeParquet(w io.Writer, columns []*parquetColumn, numRows int) error {
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+
+	type chunk struct {
+		offset, uncompressed, compressed int64
+	}
+	chunks := make([]chunk, len(columns))
+	var totalSize int64
+
+	for i, col := range columns {
+		var values bytes.Buffer
+		if col.Type == parquetInt64 {
+			for _, v := range col.Int64s {
+				binary.Write(&values, binary.LittleEndian, v)
+			}
+		} else {
+			for _, v := range col.Strings {
+				binary.Write(&values, binary.LittleEndian, uint32(len(v)))
+				values.Write(v)
+			}
+		}
+
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(values.Bytes())
+		if err := gz.Close(); err != nil {
+			return err
+		}
+
+		var header thriftWriter
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(values.Len()))
+		header.i32(3, int32(compressed.Len()))
+		header.beginStruct(5)
+		header.i32(1, int32(numRows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.endStruct()
+		header.stop()
+
+		chunks[i] = chunk{
+			offset:       int64(file.Len()),
+			uncompressed: int64(header.buf.Len() + values.Len()),
+			compressed:   int64(header.buf.Len() + compressed.Len()),
+		}
+		totalSize += chunks[i].uncompressed
+		file.Write(header.buf.Bytes())
+		file.Write(compressed.Bytes())
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.listHeader(2, len(columns)+1)
+	meta.beginListStruct()
+	meta.str(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.endStruct()
+	for _, col := range columns {
+		meta.beginListStruct()
+		meta.i32(1, col.Type)
+		meta.i32(3, parquetRequired)
+		meta.str(4, col.Name)
+		if col.ConvertedType >= 0 {
+			meta.i32(6, col.ConvertedType)
+		}
+		meta.endStruct()
+	}
+	meta.i64(3, int64(numRows))
+	meta.listHeader(4, 1)
+	meta.beginListStruct()
+	meta.listHeader(1, len(columns))
+	for i, col := range columns {
+		meta.beginListStruct()
+		meta.i64(2, chunks[i].offset)
+		meta.beginStruct(3)
+		meta.i32(1, col.Type)
+		meta.listHeaderOf(2, 1, thriftI32)
+		meta.buf.Write(zigzag32(parquetPlain))
+		meta.listHeaderOf(3, 1, thriftBinary)
+		meta.rawString(col.Name)
+		meta.i32(4, parquetGzip)
+		meta.i64(5, int64(numRows))
+		meta.i64(6, chunks[i].uncompressed)
+		meta.i64(7, chunks[i].compressed)
+		meta.i64(9, chunks[i].offset)
+		meta.endStruct()
+		meta.endStruct()
+	}
+	meta.i64(2, totalSize)
+	meta.i64(3, int64(numRows))
+	meta.endStruct()
+	meta.str(6, "rule-engine nats-webhook-worker")
+	meta.stop()
+
+	file.Write(meta.buf.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(meta.buf.Len()))
+	file.WriteString("PAR1")
+
+	_, err := w.Write(file.Bytes())
+	return err
+}
+
+// Thrift compact protocol type ids
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter writes Thrift compact protocol structs. Field ids must be
+// written in increasing order within each struct.
+type thriftWriter struct {
+	buf       bytes.Buffer
+	lastField int16
+	stack     []int16
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	if delta := id - t.lastField; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.buf.Write(zigzag32(int32(id)))
+	}
+	t.lastField = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.buf.Write(zigzag32(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.buf.Write(zigzag64(v))
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.fieldHeader(id, thriftBinary)
+	t.rawString(s)
+}
+
+func (t *thriftWriter) rawString(s string) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+	t.buf.WriteString(s)
+}
+
+// beginStruct starts a struct-typed field
+func (t *thriftWriter) beginStruct(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.beginListStruct()
+}
+
+// beginListStruct starts a struct that is a list element
+func (t *thriftWriter) beginListStruct() {
+	t.stack = append(t.stack, t.lastField)
+	t.lastField = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.stop()
+	t.lastField = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
+
+// listHeader starts a list-of-structs field with n elements
+func (t *thriftWriter) listHeader(id int16, n int) {
+	t.listHeaderOf(id, n, thriftStruct)
+}
+
+func (t *thriftWriter) listHeaderOf(id int16, n int, elem byte) {
+	t.fieldHeader(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xF0 | elem)
+		t.buf.Write(binary.AppendUvarint(nil, uint64(n)))
+	}
+}
+
+func zigzag32(v int32) []byte {
+	return binary.AppendUvarint(nil, uint64(uint32((v<<1)^(v>>31))))
+}
+
+func zigzag64(v int64) []byte {
+	return binary.AppendUvarint(nil, uint64((v<<1)^(v>>63)))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/deprecated"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// Files written by writeParquet are read back with an independent Parquet
+// implementation
+func TestWriteParquetReadBack(t *testing.T) {
+	published := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		records []archiveRecord
+	}{
+		{name: "empty", records: nil},
+		{name: "one", records: []archiveRecord{
+			{PublishedAt: published, Subject: "rules.orders", StreamSequence: 1, EventKey: "o-1", Action: "archive", Payload: json.RawMessage(`{"id":1}`)},
+		}},
+		{name: "many with empty strings", records: func() []archiveRecord {
+			var records []archiveRecord
+			for i := 0; i < 40; i++ {
+				records = append(records, archiveRecord{
+					PublishedAt:    published.Add(time.Duration(i) * time.Second),
+					Subject:        "rules.orders.ünï",
+					StreamSequence: uint64(1000 + i),
+					Action:         "archive",
+					Payload:        json.RawMessage(`{"n":` + string(rune('0'+i%10)) + `}`),
+				})
+			}
+			return records
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeParquet(&buf, archiveParquetColumns(tt.records), len(tt.records)); err != nil {
+				t.Fatal(err)
+			}
+			f, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.NumRows() != int64(len(tt.records)) {
+				t.Fatalf("NumRows = %d, want %d", f.NumRows(), len(tt.records))
+			}
+
+			wantSchema := []struct {
+				name      string
+				typ       format.Type
+				converted deprecated.ConvertedType
+			}{
+				{"published_at", format.Int64, deprecated.TimestampMillis},
+				{"subject", format.ByteArray, deprecated.UTF8},
+				{"stream_sequence", format.Int64, -1},
+				{"event_key", format.ByteArray, deprecated.UTF8},
+				{"action", format.ByteArray, deprecated.UTF8},
+				{"payload", format.ByteArray, deprecated.Json},
+			}
+			schema := f.Metadata().Schema[1:]
+			if len(schema) != len(wantSchema) {
+				t.Fatalf("schema has %d columns", len(schema))
+			}
+			for i, want := range wantSchema {
+				got := schema[i]
+				if got.Name != want.name || got.Type == nil || *got.Type != want.typ {
+					t.Errorf("column %d = %s %v, want %s %v", i, got.Name, got.Type, want.name, want.typ)
+				}
+				if want.converted < 0 && got.ConvertedType != nil || want.converted >= 0 && (got.ConvertedType == nil || *got.ConvertedType != want.converted) {
+					t.Errorf("column %s converted type = %v, want %v", got.Name, got.ConvertedType, want.converted)
+				}
+			}
+
+			var rows []parquet.Row
+			for _, rg := range f.RowGroups() {
+				r := rg.Rows()
+				batch := make([]parquet.Row, len(tt.records)+1)
+				for {
+					n, err := r.ReadRows(batch)
+					for _, row := range batch[:n] {
+						rows = append(rows, row.Clone())
+					}
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				r.Close()
+			}
+			if len(rows) != len(tt.records) {
+				t.Fatalf("read %d rows, want %d", len(rows), len(tt.records))
+			}
+			for i, rec := range tt.records {
+				row := rows[i]
+				got := archiveRecord{
+					PublishedAt:    time.UnixMilli(row[0].Int64()).UTC(),
+					Subject:        string(row[1].ByteArray()),
+					StreamSequence: uint64(row[2].Int64()),
+					EventKey:       string(row[3].ByteArray()),
+					Action:         string(row[4].ByteArray()),
+					Payload:        json.RawMessage(row[5].ByteArray()),
+				}
+				if !got.PublishedAt.Equal(rec.PublishedAt) || got.Subject != rec.Subject || got.StreamSequence != rec.StreamSequence ||
+					got.EventKey != rec.EventKey || got.Action != rec.Action || string(got.Payload) != string(rec.Payload) {
+					t.Fatalf("row %d = %+v, want %+v", i, got, rec)
+				}
+			}
+		})
+	}
+}
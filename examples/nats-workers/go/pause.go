@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+	// Delivery hours are in each destination's time zone, and the runtime
+	// image has no zoneinfo
+	_ "time/tzdata"
+)
+
+// pauseRecheckInterval is the longest a held message waits on the stream
+// before it looks at its destination's pause again, so resuming early
+// releases it within this long
+const pauseRecheckInterval = 5 * time.Minute
+
+// checkPause returns a destinationDownError if dest is inside a
+// maintenance window (rule_webhooks.paused_from/paused_until). Held
+// messages are deferred like those for a down destination.
+func checkPause(dest *Destination) error {
+	if dest == nil || dest.PausedFrom == nil {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(*dest.PausedFrom) || (dest.PausedUntil != nil && !now.Before(*dest.PausedUntil)) {
+		return nil
+	}
+	until := now.Add(pauseRecheckInterval)
+	if dest.PausedUntil != nil && dest.PausedUntil.Before(until) {
+		until = *dest.PausedUntil
+	}
+	state := "paused"
+	if dest.PauseReason != "" {
+		state = "paused (" + dest.PauseReason + ")"
+	}
+	return &destinationDownError{id: dest.ID, name: dest.Name, state: state, until: until}
+}
+
+// checkDeliveryHours returns a destinationDownError deferring a message
+// for dest until its next delivery window when it arrives outside them
+func checkDeliveryHours(dest *Destination) error {
+	if dest == nil || dest.DeliveryHours == nil {
+		return nil
+	}
+	open, next := dest.DeliveryHours.Open(time.Now())
+	if open {
+		return nil
+	}
+	return &destinationDownError{id: dest.ID, name: dest.Name, state: "outside its delivery hours", until: next}
+}
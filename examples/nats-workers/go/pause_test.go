@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// useDestination caches dest as if it had just been loaded
+func useDestination(t *testing.T, dest *Destination) {
+	t.Helper()
+	destinationsMu.Lock()
+	destinations[dest.ID] = cachedDestination{dest: dest, loadedAt: time.Now()}
+	destinationsMu.Unlock()
+	t.Cleanup(func() {
+		destinationsMu.Lock()
+		delete(destinations, dest.ID)
+		destinationsMu.Unlock()
+	})
+}
+
+func TestCheckPause(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time { t := now.Add(d); return &t }
+	tests := []struct {
+		name      string
+		dest      *Destination
+		wantState string // empty: not paused
+		wantUntil time.Duration
+	}{
+		{name: "inline webhook", dest: nil},
+		{name: "not paused", dest: &Destination{ID: 3, Name: "crm"}},
+		{name: "paused until resumed", dest: &Destination{ID: 3, Name: "crm", PausedFrom: at(-time.Hour)},
+			wantState: "paused", wantUntil: pauseRecheckInterval},
+		{name: "long window rechecks", dest: &Destination{ID: 3, Name: "crm", PausedFrom: at(-time.Hour), PausedUntil: at(time.Hour)},
+			wantState: "paused", wantUntil: pauseRecheckInterval},
+		{name: "ends soon", dest: &Destination{ID: 3, Name: "crm", PausedFrom: at(-time.Hour), PausedUntil: at(time.Minute), PauseReason: "upgrade"},
+			wantState: "paused (upgrade)", wantUntil: time.Minute},
+		{name: "upcoming", dest: &Destination{ID: 3, Name: "crm", PausedFrom: at(time.Hour)}},
+		{name: "over", dest: &Destination{ID: 3, Name: "crm", PausedFrom: at(-2 * time.Hour), PausedUntil: at(-time.Hour)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPause(tt.dest)
+			if tt.wantState == "" {
+				if err != nil {
+					t.Fatalf("checkPause = %v", err)
+				}
+				return
+			}
+			down, ok := err.(*destinationDownError)
+			if !ok || down.state != tt.wantState || !strings.HasPrefix(err.Error(), "webhook 3 (crm) is "+tt.wantState+", deferred until ") {
+				t.Fatalf("checkPause = %v", err)
+			}
+			// The end is computed from a slightly later clock
+			if wait := down.until.Sub(now); wait < tt.wantUntil || wait > tt.wantUntil+time.Second {
+				t.Fatalf("deferred for %s, want %s", wait, tt.wantUntil)
+			}
+		})
+	}
+}
+
+func TestLoadDestinationPause(t *testing.T) {
+	columns := []string{"webhook_id", "webhook_name", "url", "method", "headers", "timeout_ms", "content_type", "body_template",
+		"query_params", "dedup_window_seconds", "cloudevents", "paused_from", "paused_until", "pause_reason",
+		"delivery_hours", "delivery_timezone", "response_mapping", "capture_until"}
+	from, until := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tests := []struct {
+		name                    string
+		pausedFrom, pausedUntil interface{}
+		reason                  interface{}
+		wantPaused, wantUntil   bool
+	}{
+		{name: "not paused"},
+		{name: "paused until resumed", pausedFrom: from, reason: "upgrade", wantPaused: true},
+		{name: "window", pausedFrom: from, pausedUntil: until, wantPaused: true, wantUntil: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectQuery(`FROM rule_webhooks\s+WHERE webhook_id = \$1 AND enabled = true`).WithArgs(3).
+				WillReturnRows(sqlmock.NewRows(columns).AddRow(3, "crm", "https://crm.example.com", nil, nil, nil, nil, nil,
+					nil, nil, nil, tt.pausedFrom, tt.pausedUntil, tt.reason, nil, nil, nil, nil))
+			dest, err := loadDestination(context.Background(), 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (dest.PausedFrom != nil) != tt.wantPaused || (dest.PausedUntil != nil) != tt.wantUntil {
+				t.Fatalf("pause = %v..%v", dest.PausedFrom, dest.PausedUntil)
+			}
+			if tt.reason != nil && dest.PauseReason != tt.reason {
+				t.Fatalf("reason = %q", dest.PauseReason)
+			}
+		})
+	}
+}
+
+func TestWebhookActionPaused(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	defer srv.Close()
+	from := time.Now().Add(-time.Minute)
+	useDestination(t, &Destination{ID: 3, Name: "crm", URL: srv.URL, PausedFrom: &from, PauseReason: "upgrade"})
+
+	m := &ActionMessage{Msg: &nats.Msg{Header: nats.Header{}}, Payload: &WebhookPayload{WebhookID: 3}}
+	_, err := (webhookAction{}).Execute(context.Background(), m)
+	var down *destinationDownError
+	if !errors.As(err, &down) || down.state != "paused (upgrade)" {
+		t.Fatalf("err = %v, want the delivery held", err)
+	}
+	if called {
+		t.Fatal("paused destination was called")
+	}
+}
+
+func TestCheckDeliveryHours(t *testing.T) {
+	always, _ := ruleengine.ParseDeliveryHours("00:00-24:00", "UTC")
+	// A one-minute window an hour from now is closed now
+	opens := time.Now().UTC().Add(time.Hour).Truncate(time.Minute)
+	later, err := ruleengine.ParseDeliveryHours(opens.Format("15:04")+"-"+opens.Add(time.Minute).Format("15:04"), "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		dest *Destination
+		want bool // held
+	}{
+		{name: "inline webhook"},
+		{name: "no delivery hours", dest: &Destination{ID: 3, Name: "crm"}},
+		{name: "open", dest: &Destination{ID: 3, Name: "crm", DeliveryHours: always}},
+		{name: "closed", dest: &Destination{ID: 3, Name: "crm", DeliveryHours: later}, want: true},
+	}
+	for _, tt := range tests {
+		err := checkDeliveryHours(tt.dest)
+		if !tt.want {
+			if err != nil {
+				t.Errorf("%s: checkDeliveryHours = %v", tt.name, err)
+			}
+			continue
+		}
+		down, ok := err.(*destinationDownError)
+		if !ok || down.state != "outside its delivery hours" || !down.until.Equal(opens) {
+			t.Errorf("%s: checkDeliveryHours = %v, want deferred until %s", tt.name, err, opens)
+		}
+	}
+}
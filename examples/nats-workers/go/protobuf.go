@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// protobufDecoder reads Protobuf messages of the type named by the option,
+// described by PROTOBUF_DESCRIPTOR_SET (protoc --include_imports
+// --descriptor_set_out). Data from the Confluent serializer has its
+// registry framing removed; the option still picks the type.
+type protobufDecoder struct {
+	once  sync.Once
+	files *protoregistry.Files
+	err   error
+}
+
+func init() {
+	registerDecoder("protobuf", &protobufDecoder{})
+}
+
+func (d *protobufDecoder) Decode(_ context.Context, data []byte, option string) (map[string]interface{}, error) {
+	d.once.Do(func() {
+		d.files, d.err = loadDescriptorSet(config.Decoders.ProtobufDescriptorSet)
+	})
+	if d.err != nil {
+		return nil, d.err
+	}
+	desc, err := d.files.FindDescriptorByName(protoreflect.FullName(option))
+	if err != nil {
+		return nil, worker.Permanent(fmt.Errorf("message type %s: %w", option, err))
+	}
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, worker.Permanent(fmt.Errorf("%s is not a message type", option))
+	}
+
+	// A message cannot start with a zero byte, which is field number 0
+	if len(data) > 0 && data[0] == 0 {
+		if data, err = stripMessageIndexes(data); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, worker.Permanent(fmt.Errorf("invalid %s: %w", option, err))
+	}
+	encoded, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+	if err != nil {
+		return nil, worker.Permanent(err)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return nil, worker.Permanent(err)
+	}
+	return record, nil
+}
+
+// stripMessageIndexes removes the registry wire format from a Protobuf
+// message: the schema id, then a count of message indexes and the indexes
+// themselves, as zigzag varints
+func stripMessageIndexes(data []byte) ([]byte, error) {
+	_, data, err := splitSchemaID(data)
+	if err != nil {
+		return nil, err
+	}
+	count, n := binary.Varint(data)
+	if n <= 0 || count < 0 {
+		return nil, worker.Permanent(fmt.Errorf("invalid protobuf message indexes"))
+	}
+	data = data[n:]
+	for ; count > 0; count-- {
+		if _, n = binary.Varint(data); n <= 0 {
+			return nil, worker.Permanent(fmt.Errorf("invalid protobuf message indexes"))
+		}
+		data = data[n:]
+	}
+	return data, nil
+}
+
+// loadDescriptorSet reads a serialized FileDescriptorSet
+func loadDescriptorSet(path string) (*protoregistry.Files, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("PROTOBUF_DESCRIPTOR_SET: %w", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("PROTOBUF_DESCRIPTOR_SET %s: %w", path, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("PROTOBUF_DESCRIPTOR_SET %s: %w", path, err)
+	}
+	return files, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// writeDescriptorSet writes a descriptor set with acme.v1.Order and the
+// acme.v1.Status enum, as protoc --descriptor_set_out would, and returns
+// its path
+func writeDescriptorSet(t *testing.T) string {
+	t.Helper()
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, repeated bool) *descriptorpb.FieldDescriptorProto {
+		label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		if repeated {
+			label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+		}
+		return &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Type: typ.Enum(),
+			Label: label.Enum(), JsonName: proto.String(name)}
+	}
+	status := field("status", 5, descriptorpb.FieldDescriptorProto_TYPE_ENUM, false)
+	status.TypeName = proto.String(".acme.v1.Status")
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("acme/v1/order.proto"),
+		Package: proto.String("acme.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Order"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("order_id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, false),
+				field("total", 2, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, false),
+				field("items", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, true),
+				field("count", 4, descriptorpb.FieldDescriptorProto_TYPE_INT64, false),
+				status,
+			},
+		}},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Status"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("NEW"), Number: proto.Int32(0)},
+				{Name: proto.String("PAID"), Number: proto.Int32(1)},
+			},
+		}},
+	}}}
+	raw, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "set.pb")
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProtobufDecoder(t *testing.T) {
+	path := writeDescriptorSet(t)
+	prev := config.Decoders
+	config.Decoders.ProtobufDescriptorSet = path
+	t.Cleanup(func() { config.Decoders = prev })
+
+	d := &protobufDecoder{}
+	files, err := loadDescriptorSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := files.FindDescriptorByName("acme.v1.Order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := desc.(protoreflect.MessageDescriptor)
+	order := dynamicpb.NewMessage(md)
+	order.Set(md.Fields().ByName("order_id"), protoreflect.ValueOfString("o1"))
+	order.Set(md.Fields().ByName("total"), protoreflect.ValueOfFloat64(12.5))
+	items := order.Mutable(md.Fields().ByName("items")).List()
+	items.Append(protoreflect.ValueOfString("a"))
+	items.Append(protoreflect.ValueOfString("b"))
+	order.Set(md.Fields().ByName("count"), protoreflect.ValueOfInt64(3))
+	order.Set(md.Fields().ByName("status"), protoreflect.ValueOfEnum(1))
+	data, err := proto.Marshal(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"count":"3","items":["a","b"],"order_id":"o1","status":"PAID","total":12.5}`
+
+	tests := []struct {
+		name    string
+		data    []byte
+		option  string
+		want    string
+		wantErr string
+	}{
+		{name: "message", data: data, option: "acme.v1.Order", want: want},
+		{name: "registry framing", data: append(wireFormat(7, []byte{0x00}), data...), option: "acme.v1.Order", want: want},
+		{name: "registry framing with indexes", data: append(wireFormat(7, []byte{0x04, 0x00, 0x02}), data...), option: "acme.v1.Order", want: want},
+		{name: "empty message", data: nil, option: "acme.v1.Order", want: `{}`},
+		{name: "unknown type", data: data, option: "acme.v1.Refund", wantErr: "message type acme.v1.Refund: "},
+		{name: "not a message", data: data, option: "acme.v1.Status", wantErr: "acme.v1.Status is not a message type"},
+		{name: "invalid data", data: []byte{0x0a, 0x05, 'o'}, option: "acme.v1.Order", wantErr: "invalid acme.v1.Order: "},
+		{name: "invalid indexes", data: wireFormat(7, []byte{0x04, 0x80}), option: "acme.v1.Order", wantErr: "invalid protobuf message indexes"},
+		{name: "negative index count", data: wireFormat(7, []byte{0x01}), option: "acme.v1.Order", wantErr: "invalid protobuf message indexes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record, err := d.Decode(context.Background(), tt.data, tt.option)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) || !worker.IsPermanent(err) {
+					t.Fatalf("err = %v, want permanent %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := json.Marshal(record); string(got) != tt.want {
+				t.Fatalf("record = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDescriptorSet(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bad.pb"), []byte{0xff}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ path, want string }{
+		{filepath.Join(dir, "missing.pb"), "PROTOBUF_DESCRIPTOR_SET: open "},
+		{filepath.Join(dir, "bad.pb"), "PROTOBUF_DESCRIPTOR_SET " + filepath.Join(dir, "bad.pb") + ": "},
+	} {
+		if _, err := loadDescriptorSet(tt.path); err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.path, err, tt.want)
+		}
+	}
+
+	// The decoder keeps the error rather than rereading the file
+	prev := config.Decoders
+	config.Decoders.ProtobufDescriptorSet = filepath.Join(dir, "missing.pb")
+	defer func() { config.Decoders = prev }()
+	d := &protobufDecoder{}
+	for i := 0; i < 2; i++ {
+		if _, err := d.Decode(context.Background(), nil, "acme.v1.Order"); err == nil || worker.IsPermanent(err) {
+			t.Fatalf("err = %v", err)
+		}
+	}
+}
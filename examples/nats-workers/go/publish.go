@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsConn and jetStream are the worker's NATS handles, shared with actions
+// that publish
+var (
+	natsConn  *nats.Conn
+	jetStream nats.JetStreamContext
+)
+
+// natsPublishAction republishes the message data to another subject:
+//
+//	{"subject": "alerts.{{.region}}", "headers": {...}, "body_template": "...", "jetstream": true}
+//
+// The subject may be a template over data. The body is body_template
+// rendered with data, or data as JSON. With jetstream the publish waits for
+// the stream's acknowledgement.
+type natsPublishAction struct{}
+
+type natsPublishConfig struct {
+	Subject      string            `json:"subject"`
+	Headers      map[string]string `json:"headers"`
+	BodyTemplate string            `json:"body_template"`
+	JetStream    bool              `json:"jetstream"`
+}
+
+func init() {
+	registerAction("nats_publish", natsPublishAction{})
+}
+
+func (natsPublishAction) Execute(ctx context.Context, m *ActionMessage) (string, error) {
+	var cfg natsPublishConfig
+	if err := m.Config.decode(&cfg); err != nil {
+		return "", err
+	}
+
+	subject := cfg.Subject
+	if strings.Contains(subject, "{{") {
+		rendered, err := renderBodyTemplate(subject, m.Payload.Data)
+		if err != nil {
+			return "", fmt.Errorf("subject: %w", err)
+		}
+		subject = string(rendered)
+	}
+	if subject == "" {
+		return "", fmt.Errorf("action %s has no subject", m.Config.Name)
+	}
+
+	var body []byte
+	var err error
+	if cfg.BodyTemplate != "" {
+		body, err = renderBodyTemplate(cfg.BodyTemplate, m.Payload.Data)
+	} else {
+		body, err = m.Payload.dataJSON()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	out := nats.NewMsg(subject)
+	out.Data = body
+	out.Header.Set(traceIDHeader, m.traceID)
+	for key, value := range cfg.Headers {
+		out.Header.Set(key, value)
+	}
+	for key, value := range m.Payload.Headers {
+		out.Header.Set(key, value)
+	}
+
+	if cfg.JetStream {
+		ack, err := jetStream.PublishMsg(out, nats.Context(ctx))
+		if err != nil {
+			return "", fmt.Errorf("publish to %s failed: %w", subject, err)
+		}
+		return fmt.Sprintf("published to %s (%s #%d)", subject, ack.Stream, ack.Sequence), nil
+	}
+	if err := natsConn.PublishMsg(out); err != nil {
+		return "", fmt.Errorf("publish to %s failed: %w", subject, err)
+	}
+	return "published to " + subject, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// Quotas cap the messages and payload bytes a consumer processes per hour,
+// across every worker sharing it. Limits are the max_messages_per_hour and
+// max_bytes_per_hour columns of rule_nats_consumer_stats. Each worker adds
+// its counts to rule_nats_consumer_usage every quotaCheckInterval and reads
+// back the hour's total; once a limit is reached it pauses its
+// subscription until the hour ends, so messages wait in the stream instead
+// of running up downstream bills.
+
+// quotaCheckInterval bounds how far workers overshoot a quota together
+const quotaCheckInterval = 15 * time.Second
+
+// QuotaStatus is the consumer's usage for the current hour
+type QuotaStatus struct {
+	HourStart   time.Time  `json:"hour_start"`
+	Messages    int64      `json:"messages"`
+	Bytes       int64      `json:"bytes"`
+	MaxMessages *int64     `json:"max_messages_per_hour"`
+	MaxBytes    *int64     `json:"max_bytes_per_hour"`
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+}
+
+var (
+	// Counted since the last flush to rule_nats_consumer_usage
+	usageMessages atomic.Int64
+	usageBytes    atomic.Int64
+
+	quotaMu    sync.Mutex
+	quotaState QuotaStatus
+)
+
+func init() {
+	expvar.Publish("consumer_quota", expvar.Func(func() interface{} {
+		quotaMu.Lock()
+		defer quotaMu.Unlock()
+		return quotaState
+	}))
+}
+
+// recordUsage counts one message of size bytes against the quotas
+func recordUsage(bytes int) {
+	usageMessages.Add(1)
+	usageBytes.Add(int64(bytes))
+}
+
+// startQuotaMonitor flushes usage and enforces quotas on w
+func startQuotaMonitor(nc *nats.Conn, w *worker.Worker) {
+	go func() {
+		ticker := time.NewTicker(quotaCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			flushUsage()
+			checkQuota(nc, w)
+		}
+	}()
+}
+
+// flushUsage adds the counts since the last flush to the current hour.
+// Rows are added to, so every worker's counts combine.
+func flushUsage() {
+	messages, bytes := usageMessages.Swap(0), usageBytes.Swap(0)
+	if messages == 0 {
+		return
+	}
+	err := opsWrite("",
+		`INSERT INTO rule_nats_consumer_usage (stream_name, consumer_name, hour_start, messages, bytes)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (stream_name, consumer_name, hour_start) DO UPDATE SET
+		     messages = rule_nats_consumer_usage.messages + EXCLUDED.messages,
+		     bytes = rule_nats_consumer_usage.bytes + EXCLUDED.bytes`,
+		config.Worker.StreamName, config.Worker.ConsumerName, time.Now().UTC().Truncate(time.Hour), messages, bytes,
+	)
+	if err != nil && !errors.Is(err, errOpsBuffered) {
+		log.Printf("⚠️  Failed to record consumer usage: %v", err)
+	}
+}
+
+// checkQuota pauses w once the hour's usage reaches a quota and resumes it
+// in the next hour, or as soon as the quota is raised or removed
+func checkQuota(nc *nats.Conn, w *worker.Worker) {
+	now := time.Now().UTC()
+	status := QuotaStatus{HourStart: now.Truncate(time.Hour)}
+	err := opsQueryRow(
+		[]interface{}{&status.MaxMessages, &status.MaxBytes, &status.Messages, &status.Bytes},
+		`SELECT s.max_messages_per_hour, s.max_bytes_per_hour, COALESCE(u.messages, 0), COALESCE(u.bytes, 0)
+		 FROM rule_nats_consumer_stats s
+		 LEFT JOIN rule_nats_consumer_usage u
+		     ON u.stream_name = s.stream_name AND u.consumer_name = s.consumer_name AND u.hour_start = $3
+		 WHERE s.stream_name = $1 AND s.consumer_name = $2`,
+		config.Worker.StreamName, config.Worker.ConsumerName, status.HourStart,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil // no statistics row yet, so no quotas
+	}
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if err != nil {
+		// Without usage figures, hold a pause only until its hour ends
+		if paused := quotaState.PausedUntil; paused != nil && !now.Before(*paused) {
+			resumeConsumer(w, "the quota hour ended")
+		}
+		log.Printf("⚠️  Failed to check consumer quota: %v", err)
+		return
+	}
+
+	exceeded := quotaExceeded(&status)
+	switch {
+	case exceeded != "" && quotaState.PausedUntil == nil:
+		if err := w.Pause(); err != nil {
+			log.Printf("⚠️  Failed to pause for quota: %v", err)
+			break
+		}
+		until := status.HourStart.Add(time.Hour)
+		status.PausedUntil = &until
+		log.Printf("🚨 Consumer quota exceeded (%s), paused until %s", exceeded, until.Format(time.RFC3339))
+		sendAlert(nc, "quota", map[string]interface{}{
+			"event":        "consumer.quota_exceeded",
+			"stream":       config.Worker.StreamName,
+			"consumer":     config.Worker.ConsumerName,
+			"exceeded":     exceeded,
+			"usage":        status,
+			"paused_until": until,
+		})
+	case exceeded != "":
+		status.PausedUntil = quotaState.PausedUntil
+	case quotaState.PausedUntil != nil:
+		if !resumeConsumer(w, "usage is within quota") {
+			status.PausedUntil = quotaState.PausedUntil
+		}
+	}
+	quotaState = status
+}
+
+// quotaExceeded describes the quota status has reached, or returns ""
+func quotaExceeded(status *QuotaStatus) string {
+	switch {
+	case status.MaxMessages != nil && status.Messages >= *status.MaxMessages:
+		return fmt.Sprintf("%d of %d messages this hour", status.Messages, *status.MaxMessages)
+	case status.MaxBytes != nil && status.Bytes >= *status.MaxBytes:
+		return fmt.Sprintf("%d of %d bytes this hour", status.Bytes, *status.MaxBytes)
+	}
+	return ""
+}
+
+// resumeConsumer ends a quota pause. The caller holds quotaMu.
+func resumeConsumer(w *worker.Worker, reason string) bool {
+	if err := w.Resume(); err != nil {
+		log.Printf("⚠️  Failed to resume after quota pause: %v", err)
+		return false
+	}
+	quotaState.PausedUntil = nil
+	log.Printf("✅ Consumer resumed: %s", reason)
+	return true
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/internal/natstest"
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+const quotaQuery = `SELECT s.max_messages_per_hour, s.max_bytes_per_hour`
+
+// runQuotaWorker runs a worker against a fake NATS server for the quota
+// checks to pause and resume
+func runQuotaWorker(t *testing.T) (*natstest.Server, *worker.Worker) {
+	t.Helper()
+	srv := natstest.NewServer(t)
+	srv.AddStream("RULES", "rules.>")
+	w, err := worker.New(worker.Options{
+		NATSURL: srv.URL(), Stream: "RULES", Consumer: "webhooks", Subject: "rules.>",
+		AckWait: time.Minute, Logger: log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.RegisterHandler("rules.>", func(context.Context, *nats.Msg) error { return nil })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		w.Close()
+	})
+	waitFor(t, "subscription", func() bool { return len(w.Subscriptions()) > 0 })
+	return srv, w
+}
+
+// resetQuota restores the quota state and settings a test changes
+func resetQuota(t *testing.T) {
+	t.Helper()
+	prevWorker, prevLag := config.Worker, config.Lag
+	config.Worker.StreamName, config.Worker.ConsumerName = "RULES", "webhooks"
+	usageMessages.Store(0)
+	usageBytes.Store(0)
+	t.Cleanup(func() {
+		config.Worker, config.Lag = prevWorker, prevLag
+		usageMessages.Store(0)
+		usageBytes.Store(0)
+		quotaMu.Lock()
+		quotaState = QuotaStatus{}
+		quotaMu.Unlock()
+	})
+}
+
+func quotaRow(maxMessages, maxBytes interface{}, messages, bytes int64) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"max_messages_per_hour", "max_bytes_per_hour", "messages", "bytes"}).
+		AddRow(maxMessages, maxBytes, messages, bytes)
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	limit := func(n int64) *int64 { return &n }
+	tests := []struct {
+		name   string
+		status QuotaStatus
+		want   string
+	}{
+		{name: "no quotas", status: QuotaStatus{Messages: 1e6, Bytes: 1e9}},
+		{name: "under both", status: QuotaStatus{Messages: 9, Bytes: 99, MaxMessages: limit(10), MaxBytes: limit(100)}},
+		{name: "messages reached", status: QuotaStatus{Messages: 10, MaxMessages: limit(10)}, want: "10 of 10 messages this hour"},
+		{name: "bytes over", status: QuotaStatus{Bytes: 150, MaxBytes: limit(100)}, want: "150 of 100 bytes this hour"},
+		{name: "messages win", status: QuotaStatus{Messages: 11, Bytes: 150, MaxMessages: limit(10), MaxBytes: limit(100)},
+			want: "11 of 10 messages this hour"},
+		{name: "zero quota", status: QuotaStatus{MaxMessages: limit(0)}, want: "0 of 0 messages this hour"},
+	}
+	for _, tt := range tests {
+		if got := quotaExceeded(&tt.status); got != tt.want {
+			t.Errorf("%s: quotaExceeded = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFlushUsage(t *testing.T) {
+	resetQuota(t)
+	ops := mockOpsDB(t)
+
+	flushUsage() // nothing counted: no write
+
+	recordUsage(100)
+	recordUsage(50)
+	ops.ExpectExec(`INSERT INTO rule_nats_consumer_usage`).
+		WithArgs("RULES", "webhooks", time.Now().UTC().Truncate(time.Hour), int64(2), int64(150)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	flushUsage()
+	if usageMessages.Load() != 0 || usageBytes.Load() != 0 {
+		t.Fatal("usage not reset after the flush")
+	}
+}
+
+func TestCheckQuotaPausesAndResumes(t *testing.T) {
+	resetQuota(t)
+	ops := mockOpsDB(t)
+	_, w := runQuotaWorker(t)
+	nc, err := nats.Connect(w.Conn().ConnectedUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	alerts, _ := nc.SubscribeSync("alerts.quota")
+	nc.Flush()
+	config.Lag.AlertSubject, config.Lag.AlertWebhookURL = "alerts.quota", ""
+	hourEnd := time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+
+	steps := []struct {
+		name       string
+		row        *sqlmock.Rows
+		err        error
+		wantPaused bool
+		wantAlert  bool
+	}{
+		{name: "under quota", row: quotaRow(int64(10), nil, 3, 300)},
+		{name: "messages reached", row: quotaRow(int64(10), nil, 10, 1000), wantPaused: true, wantAlert: true},
+		{name: "still over", row: quotaRow(int64(10), nil, 12, 1200), wantPaused: true},
+		{name: "lookup fails mid-pause", err: errors.New("permission denied for table rule_nats_consumer_usage"), wantPaused: true},
+		{name: "quota raised", row: quotaRow(int64(100), nil, 12, 1200)},
+		{name: "bytes reached", row: quotaRow(nil, int64(1000), 12, 1200), wantPaused: true, wantAlert: true},
+		{name: "quota removed", row: quotaRow(nil, nil, 12, 1200)},
+		{name: "no statistics row", err: nil},
+	}
+	for _, step := range steps {
+		query := ops.ExpectQuery(quotaQuery).WithArgs("RULES", "webhooks", sqlmock.AnyArg())
+		switch {
+		case step.row != nil:
+			query.WillReturnRows(step.row)
+		case step.err != nil:
+			query.WillReturnError(step.err)
+		default:
+			query.WillReturnError(sql.ErrNoRows)
+		}
+		checkQuota(nc, w)
+
+		quotaMu.Lock()
+		state := quotaState
+		quotaMu.Unlock()
+		if w.Paused() != step.wantPaused || (state.PausedUntil != nil) != step.wantPaused {
+			t.Fatalf("%s: worker paused %v, state %+v; want paused %v", step.name, w.Paused(), state, step.wantPaused)
+		}
+		if step.wantPaused && !state.PausedUntil.Equal(hourEnd) {
+			t.Fatalf("%s: paused until %s, want the end of the hour %s", step.name, state.PausedUntil, hourEnd)
+		}
+		if step.wantPaused && len(w.Subscriptions()) != 0 {
+			t.Fatalf("%s: still subscribed while paused", step.name)
+		}
+		if !step.wantPaused && len(w.Subscriptions()) == 0 {
+			t.Fatalf("%s: not subscribed", step.name)
+		}
+
+		msg, err := alerts.NextMsg(50 * time.Millisecond)
+		if (err == nil) != step.wantAlert {
+			t.Fatalf("%s: alert %v, %v; want one %v", step.name, msg, err, step.wantAlert)
+		}
+		if step.wantAlert {
+			var event map[string]interface{}
+			json.Unmarshal(msg.Data, &event)
+			if event["event"] != "consumer.quota_exceeded" || event["consumer"] != "webhooks" || event["exceeded"] == "" {
+				t.Fatalf("%s: alert = %s", step.name, msg.Data)
+			}
+		}
+	}
+}
+
+func TestCheckQuotaResumesWhenHourEndsWithoutUsage(t *testing.T) {
+	resetQuota(t)
+	ops := mockOpsDB(t)
+	_, w := runQuotaWorker(t)
+
+	ops.ExpectQuery(quotaQuery).WillReturnRows(quotaRow(int64(1), nil, 5, 50))
+	checkQuota(w.Conn(), w)
+	if !w.Paused() {
+		t.Fatal("not paused")
+	}
+
+	// The hour has ended but the usage lookup fails: the pause still ends
+	quotaMu.Lock()
+	ended := time.Now().Add(-time.Second)
+	quotaState.PausedUntil = &ended
+	quotaMu.Unlock()
+	ops.ExpectQuery(quotaQuery).WillReturnError(errors.New("permission denied for table rule_nats_consumer_usage"))
+	checkQuota(w.Conn(), w)
+	if w.Paused() || quotaState.PausedUntil != nil {
+		t.Fatalf("still paused: %+v", quotaState)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// version, commit, and date describe the worker's build; cmd/release sets
+// them with -ldflags "-X main.version=v1.2.3 -X main.commit=… -X main.date=…"
+var (
+	version = "dev"
+	commit  string
+	date    string
+)
+
+// configHash fingerprints the loaded configuration as printConfig shows it,
+// with secrets masked, so replicas running different settings stand out
+func configHash() string {
+	h := sha256.New()
+	for _, s := range loadedSettings {
+		fmt.Fprintf(h, "%s=%s\n", s.Key, s)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// stopHeartbeat ends the heartbeat started by registerWorker
+var stopHeartbeat = make(chan struct{})
+
+// registerWorker records this instance in rule_nats_workers and, every
+// WORKER_HEARTBEAT_SECONDS until deregisterWorker, refreshes its
+// last_seen_at and consumer lag. The leader watches for workers whose
+// heartbeats stop.
+func registerWorker() {
+	host, _ := os.Hostname()
+	started := time.Now()
+	var deadAfter *int
+	if config.Heartbeat.IntervalSeconds > 0 {
+		deadAfter = &config.Heartbeat.DeadAfterSeconds
+	}
+	err := opsWrite("",
+		`INSERT INTO rule_nats_workers
+		 (worker_id, hostname, pid, version, config_hash, stream_name, consumer_name, subject, started_at, last_seen_at,
+		  dead_after_seconds, extension_version, extension_compatible)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $9, $10, $11, $12)
+		 ON CONFLICT (worker_id) DO UPDATE SET
+		     hostname = EXCLUDED.hostname, pid = EXCLUDED.pid, version = EXCLUDED.version,
+		     config_hash = EXCLUDED.config_hash, stream_name = EXCLUDED.stream_name,
+		     consumer_name = EXCLUDED.consumer_name, subject = EXCLUDED.subject,
+		     started_at = EXCLUDED.started_at, last_seen_at = EXCLUDED.last_seen_at,
+		     dead_after_seconds = EXCLUDED.dead_after_seconds, extension_version = EXCLUDED.extension_version,
+		     extension_compatible = EXCLUDED.extension_compatible, stopped_at = NULL, dead_at = NULL`,
+		workerID(), host, os.Getpid(), version, configHash(),
+		config.Worker.StreamName, config.Worker.ConsumerName, config.Worker.Subject, started, deadAfter,
+		sql.NullString{String: extensionVersion, Valid: extensionVersion != ""}, extensionCompatible,
+	)
+	if err != nil && !errors.Is(err, errOpsBuffered) {
+		log.Printf("⚠️  Failed to register worker: %v", err)
+	}
+
+	if config.Heartbeat.IntervalSeconds <= 0 {
+		return
+	}
+	interval := time.Duration(config.Heartbeat.IntervalSeconds) * time.Second
+	registerSingleton("dead_workers", interval, checkDeadWorkers)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				workerHeartbeat(time.Now(), false)
+			case <-stopHeartbeat:
+				return
+			}
+		}
+	}()
+}
+
+// deregisterWorker marks this worker stopped, so it is not taken for a
+// crashed one
+func deregisterWorker() {
+	close(stopHeartbeat)
+	workerHeartbeat(time.Now(), true)
+}
+
+// workerHeartbeat refreshes this worker's row; buffered heartbeats keep
+// only the latest, and none revives a stopped worker
+func workerHeartbeat(at time.Time, stopped bool) {
+	var stoppedAt *time.Time
+	if stopped {
+		stoppedAt = &at
+	}
+	var pending, ackPending *int64
+	var sampledAt *time.Time
+	if lag := latestLag(); lag != nil {
+		p, a := int64(lag.NumPending), int64(lag.NumAckPending)
+		pending, ackPending, sampledAt = &p, &a, &lag.SampledAt
+	}
+	err := opsWrite("worker_heartbeat",
+		`UPDATE rule_nats_workers
+		 SET last_seen_at = $2, stopped_at = $3, dead_at = NULL,
+		     consumer_pending = $4, consumer_ack_pending = $5, lag_sampled_at = $6,
+		     messages_processed = $7, messages_failed = $8
+		 WHERE worker_id = $1 AND stopped_at IS NULL`,
+		workerID(), at, stoppedAt, pending, ackPending, sampledAt,
+		int64(atomic.LoadUint64(&stats.MessagesProcessed)), int64(atomic.LoadUint64(&stats.MessagesFailed)),
+	)
+	if err != nil && !errors.Is(err, errOpsBuffered) {
+		log.Printf("⚠️  Failed to record worker heartbeat: %v", err)
+	}
+}
+
+// checkDeadWorkers marks workers that stopped heartbeating without
+// shutting down as dead, once each, and evaluates WORKER_ALERT_RULESET
+// with a Worker fact for them. It runs on the leader only.
+func checkDeadWorkers(ctx context.Context) error {
+	rows, err := opsDB.QueryContext(ctx,
+		`UPDATE rule_nats_workers SET dead_at = CURRENT_TIMESTAMP
+		 WHERE stopped_at IS NULL AND dead_at IS NULL AND dead_after_seconds IS NOT NULL
+		   AND last_seen_at < CURRENT_TIMESTAMP - make_interval(secs => dead_after_seconds)
+		 RETURNING worker_id, hostname, version, stream_name, consumer_name, started_at, last_seen_at, consumer_pending`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to find dead workers: %w", err)
+	}
+	type deadWorker struct {
+		facts    map[string]interface{}
+		id       string
+		lastSeen time.Time
+	}
+	var dead []deadWorker
+	for rows.Next() {
+		var id, host, ver, stream, consumerName string
+		var started, lastSeen time.Time
+		var pending sql.NullInt64
+		if err := rows.Scan(&id, &host, &ver, &stream, &consumerName, &started, &lastSeen, &pending); err != nil {
+			rows.Close()
+			return err
+		}
+		worker := map[string]interface{}{
+			"id":           id,
+			"hostname":     host,
+			"version":      ver,
+			"stream":       stream,
+			"consumer":     consumerName,
+			"started_at":   started.UTC().Format(time.RFC3339),
+			"last_seen_at": lastSeen.UTC().Format(time.RFC3339),
+			"silent_for":   int(time.Since(lastSeen).Seconds()),
+		}
+		if pending.Valid {
+			worker["consumer_pending"] = pending.Int64
+		}
+		dead = append(dead, deadWorker{facts: map[string]interface{}{"Worker": worker}, id: id, lastSeen: lastSeen})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var alertErr error
+	for _, w := range dead {
+		log.Printf("💀 Worker %s has not been seen since %s", w.id, w.lastSeen.Format(time.RFC3339))
+		if config.Heartbeat.AlertRuleSet == 0 {
+			continue
+		}
+		result, err := ruleengine.New(db).Evaluate(ctx, config.Heartbeat.AlertRuleSet, w.facts)
+		if err != nil {
+			// Evaluate it again on the next check
+			opsDB.ExecContext(ctx, `UPDATE rule_nats_workers SET dead_at = NULL WHERE worker_id = $1`, w.id)
+			if alertErr == nil {
+				alertErr = fmt.Errorf("failed to evaluate the dead worker rule set for %s: %w", w.id, err)
+			}
+			continue
+		}
+		log.Printf("💀 Worker alert rule set %d: %d rule(s) fired for %s", config.Heartbeat.AlertRuleSet, len(result.MatchedRules), w.id)
+	}
+	return alertErr
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestConfigHash(t *testing.T) {
+	prev := loadedSettings
+	t.Cleanup(func() { loadedSettings = prev })
+	url, password, batch := "nats://nats:4222", "hunter2", 10
+	loadedSettings = []*setting{
+		{Key: "nats.url", Value: &url},
+		{Key: "postgres.password", Value: &password, Secret: true},
+		{Key: "worker.batch_size", Value: &batch},
+	}
+
+	base := configHash()
+	if len(base) != 16 || configHash() != base {
+		t.Fatalf("configHash = %q", base)
+	}
+	tests := []struct {
+		name     string
+		edit     func()
+		wantSame bool
+	}{
+		{name: "setting changed", edit: func() { batch = 20 }},
+		{name: "secrets are masked", edit: func() { password = "swordfish" }, wantSame: true},
+	}
+	for _, tt := range tests {
+		url, password, batch = "nats://nats:4222", "hunter2", 10
+		tt.edit()
+		if got := configHash(); (got == base) != tt.wantSame {
+			t.Errorf("%s: configHash = %s, base %s", tt.name, got, base)
+		}
+	}
+}
+
+func TestRegisterWorker(t *testing.T) {
+	ops := mockOpsDB(t)
+	prevHeartbeat, prevStop := config.Heartbeat, stopHeartbeat
+	t.Cleanup(func() { config.Heartbeat, stopHeartbeat = prevHeartbeat, prevStop })
+	config.Heartbeat.IntervalSeconds = 0
+	stopHeartbeat = make(chan struct{})
+	useLag(t, nil)
+	useExtension(t, "3.1.0", false)
+
+	host, _ := os.Hostname()
+	ops.ExpectExec(`INSERT INTO rule_nats_workers`).
+		WithArgs(workerID(), host, os.Getpid(), version, configHash(), config.Worker.StreamName, config.Worker.ConsumerName,
+			config.Worker.Subject, sqlmock.AnyArg(), nil, "3.1.0", false).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	registerWorker()
+
+	// A stopped worker is not taken for a crashed one
+	ops.ExpectExec(`UPDATE rule_nats_workers\s+SET last_seen_at = \$2, stopped_at = \$3`).
+		WithArgs(workerID(), sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	deregisterWorker()
+}
+
+// useLag sets the latest consumer lag sample for one test
+func useLag(t *testing.T, sample *LagSample) {
+	t.Helper()
+	lagMu.Lock()
+	prev := lastLag
+	lastLag = sample
+	lagMu.Unlock()
+	t.Cleanup(func() {
+		lagMu.Lock()
+		lastLag = prev
+		lagMu.Unlock()
+	})
+}
+
+func TestWorkerHeartbeat(t *testing.T) {
+	sampled := time.Now()
+	tests := []struct {
+		name                             string
+		lag                              *LagSample
+		stopped                          bool
+		wantPending, wantAck, wantSample interface{}
+	}{
+		{name: "before the first lag sample"},
+		{name: "with lag", lag: &LagSample{NumPending: 12, NumAckPending: 3, SampledAt: sampled},
+			wantPending: int64(12), wantAck: int64(3), wantSample: sampled},
+		{name: "stopping", stopped: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := mockOpsDB(t)
+			useLag(t, tt.lag)
+			at := time.Now()
+			var stoppedAt interface{}
+			if tt.stopped {
+				stoppedAt = at
+			}
+			ops.ExpectExec(`UPDATE rule_nats_workers\s+SET last_seen_at = \$2, stopped_at = \$3, dead_at = NULL`).
+				WithArgs(workerID(), at, stoppedAt, tt.wantPending, tt.wantAck, tt.wantSample, sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			workerHeartbeat(at, tt.stopped)
+		})
+	}
+}
+
+func TestRegisterWorkerHeartbeat(t *testing.T) {
+	ops := mockOpsDB(t)
+	prevHeartbeat, prevStop, prevTasks := config.Heartbeat, stopHeartbeat, singletonTasks
+	t.Cleanup(func() { config.Heartbeat, stopHeartbeat, singletonTasks = prevHeartbeat, prevStop, prevTasks })
+	config.Heartbeat.IntervalSeconds, config.Heartbeat.DeadAfterSeconds = 30, 90
+	stopHeartbeat, singletonTasks = make(chan struct{}), nil
+	useLag(t, nil)
+
+	// Other workers learn when to call this one dead
+	ops.ExpectExec(`INSERT INTO rule_nats_workers`).
+		WithArgs(workerID(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 90, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	registerWorker()
+	if len(singletonTasks) != 1 || singletonTasks[0].name != "dead_workers" || singletonTasks[0].interval != 30*time.Second {
+		t.Fatalf("singleton tasks = %+v", singletonTasks)
+	}
+	ops.ExpectExec(`UPDATE rule_nats_workers`).WillReturnResult(sqlmock.NewResult(0, 1))
+	deregisterWorker()
+}
+
+// expectAlertRuleSet expects one evaluation of rule set 9, which has a
+// single rule firing on a dead worker
+func expectAlertRuleSet(mock sqlmock.Sqlmock, err error) {
+	active := mock.ExpectQuery(`SELECT is_active FROM rule_sets`).WithArgs(9)
+	if err != nil {
+		active.WillReturnError(err)
+		return
+	}
+	active.WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(true))
+	mock.ExpectQuery(`ruleset_get_rules`).WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_name", "rule_version"}).AddRow("PageOnCall", nil))
+	mock.ExpectQuery(`rule_get`).WithArgs("PageOnCall", nil).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(`rule PageOnCall "" { when Worker.silent_for > 60 then Worker.paged = true; }`))
+	mock.ExpectQuery(`run_rule_engine_debug`).
+		WillReturnRows(sqlmock.NewRows([]string{"session_id", "result"}).AddRow("s1", `{"Worker":{"paged":true}}`))
+	mock.ExpectQuery(`debug_get_events`).WithArgs("s1").
+		WillReturnRows(sqlmock.NewRows([]string{"step", "event_type", "description", "event_data"}).
+			AddRow(1, "RuleFired", "fired PageOnCall", []byte(`{"rule_name":"PageOnCall","actions_executed":["Worker.paged = true"]}`)))
+	mock.ExpectExec(`debug_delete_session`).WithArgs("s1").WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestCheckDeadWorkers(t *testing.T) {
+	columns := []string{"worker_id", "hostname", "version", "stream_name", "consumer_name", "started_at", "last_seen_at", "consumer_pending"}
+	lastSeen := time.Now().Add(-5 * time.Minute)
+	tests := []struct {
+		name     string
+		ruleSet  int
+		evalErr  error
+		wantErr  string
+		wantKept bool // dead_at is reset to alert again
+	}{
+		{name: "logged only"},
+		{name: "alert rule set", ruleSet: 9},
+		{name: "alert rule set fails", ruleSet: 9, evalErr: errors.New("connection refused"),
+			wantErr: "failed to evaluate the dead worker rule set for w1/1: connection refused", wantKept: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, ops := mockDB(t), mockOpsDB(t)
+			prev := config.Heartbeat
+			t.Cleanup(func() { config.Heartbeat = prev })
+			config.Heartbeat.AlertRuleSet = tt.ruleSet
+
+			ops.ExpectQuery(`UPDATE rule_nats_workers SET dead_at = CURRENT_TIMESTAMP`).
+				WillReturnRows(sqlmock.NewRows(columns).AddRow("w1/1", "w1", "v1.2.0", "RULES", "webhooks", lastSeen, lastSeen, 40))
+			if tt.ruleSet != 0 {
+				expectAlertRuleSet(mock, tt.evalErr)
+			}
+			if tt.wantKept {
+				ops.ExpectExec(`UPDATE rule_nats_workers SET dead_at = NULL WHERE worker_id = \$1`).WithArgs("w1/1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			err := checkDeadWorkers(context.Background())
+			if (tt.wantErr == "" && err != nil) || (tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// replicaDB serves configuration lookups (actions, destinations, SMTP
+// servers, secrets, SQL statements, scrub rules) when REPLICA_DATABASE_URL
+// is set, keeping that read load off the primary. Writes, and reads that
+// must see the worker's own writes (dedup, chat threads), stay on db.
+var replicaDB *sql.DB
+
+// replicaRetryAfter is how long lookups skip a replica that failed
+const replicaRetryAfter = 30 * time.Second
+
+// replicaDownUntil is when (Unix nanoseconds) lookups may use the replica
+// again after a failure
+var replicaDownUntil atomic.Int64
+
+// openReplicaDB connects to the read replica, if one is configured. An
+// unreachable replica is not fatal: lookups fall back to the primary.
+func openReplicaDB() error {
+	if config.Postgres.ReplicaURL == "" {
+		return nil
+	}
+	pool, err := openPostgres(config.Postgres.ReplicaURL)
+	if err != nil {
+		return fmt.Errorf("invalid REPLICA_DATABASE_URL: %w", err)
+	}
+	replicaDB = pool
+	if err := pool.Ping(); err != nil {
+		markReplicaDown(err)
+		return nil
+	}
+	log.Println("✅ Connected to PostgreSQL read replica")
+	return nil
+}
+
+// activeReplica returns the replica, or nil when none is configured or it
+// recently failed
+func activeReplica() *sql.DB {
+	if replicaDB == nil || time.Now().UnixNano() < replicaDownUntil.Load() {
+		return nil
+	}
+	return replicaDB
+}
+
+func markReplicaDown(err error) {
+	until := time.Now().Add(replicaRetryAfter).UnixNano()
+	if previous := replicaDownUntil.Swap(until); time.Now().UnixNano() >= previous {
+		log.Printf("⚠️  Read replica unavailable, using the primary for %s: %v", replicaRetryAfter, err)
+	}
+}
+
+// lookupRow is a single-row lookup that is run on the replica when one is
+// available, and on the primary otherwise. A row missing on the replica is
+// looked up again on the primary, since the replica may lag behind.
+type lookupRow struct {
+	ctx   context.Context
+	query string
+	args  []interface{}
+}
+
+// lookupQueryRow is db.QueryRowContext for configuration lookups
+func lookupQueryRow(ctx context.Context, query string, args ...interface{}) *lookupRow {
+	return &lookupRow{ctx: ctx, query: query, args: args}
+}
+
+func (r *lookupRow) Scan(dest ...interface{}) error {
+	if replica := activeReplica(); replica != nil {
+		err := replica.QueryRowContext(r.ctx, r.query, r.args...).Scan(dest...)
+		if err == nil {
+			return nil
+		}
+		if err != sql.ErrNoRows && r.ctx.Err() == nil {
+			markReplicaDown(err)
+		}
+	}
+	return withPrimaryRead(r.ctx, func(pool *sql.DB) error {
+		return pool.QueryRowContext(r.ctx, r.query, r.args...).Scan(dest...)
+	})
+}
+
+// lookupQuery is db.QueryContext for configuration lookups
+func lookupQuery(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if replica := activeReplica(); replica != nil {
+		rows, err := replica.QueryContext(ctx, query, args...)
+		if err == nil {
+			return rows, nil
+		}
+		if ctx.Err() == nil {
+			markReplicaDown(err)
+		}
+	}
+	var rows *sql.Rows
+	err := withPrimaryRead(ctx, func(pool *sql.DB) (err error) {
+		rows, err = pool.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// mockReplica points replicaDB at its own sqlmock for one test
+func mockReplica(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	pool, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := replicaDB
+	replicaDB = pool
+	replicaDownUntil.Store(0)
+	t.Cleanup(func() {
+		replicaDB = prev
+		replicaDownUntil.Store(0)
+		pool.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return mock
+}
+
+func TestLookupQueryRow(t *testing.T) {
+	const query = "SELECT url FROM rule_webhook_destinations WHERE name = \\$1"
+	tests := []struct {
+		name        string
+		replica     func(m sqlmock.Sqlmock)
+		primary     func(m sqlmock.Sqlmock)
+		want        string
+		wantDown    bool
+		noReplicaDB bool
+	}{
+		{name: "replica answers",
+			replica: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(query).WithArgs("crm").WillReturnRows(sqlmock.NewRows([]string{"url"}).AddRow("https://replica"))
+			},
+			want: "https://replica"},
+		{name: "row missing on a lagging replica is read from the primary",
+			replica: func(m sqlmock.Sqlmock) { m.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"url"})) },
+			primary: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"url"}).AddRow("https://primary"))
+			},
+			want: "https://primary"},
+		{name: "failed replica is skipped",
+			replica: func(m sqlmock.Sqlmock) { m.ExpectQuery(query).WillReturnError(errors.New("connection refused")) },
+			primary: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"url"}).AddRow("https://primary"))
+			},
+			want: "https://primary", wantDown: true},
+		{name: "no replica", noReplicaDB: true,
+			primary: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"url"}).AddRow("https://primary"))
+			},
+			want: "https://primary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := mockDB(t)
+			replica := mockReplica(t)
+			if tt.noReplicaDB {
+				replicaDB = nil
+			}
+			if tt.replica != nil {
+				tt.replica(replica)
+			}
+			if tt.primary != nil {
+				tt.primary(primary)
+			}
+
+			var url string
+			err := lookupQueryRow(context.Background(), "SELECT url FROM rule_webhook_destinations WHERE name = $1", "crm").Scan(&url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if url != tt.want {
+				t.Fatalf("url = %q, want %q", url, tt.want)
+			}
+			if down := activeReplica() == nil && !tt.noReplicaDB; down != tt.wantDown {
+				t.Fatalf("replica down = %v, want %v", down, tt.wantDown)
+			}
+		})
+	}
+}
+
+func TestLookupQuerySkipsReplicaWhileDown(t *testing.T) {
+	primary := mockDB(t)
+	replica := mockReplica(t)
+
+	replica.ExpectQuery("FROM rule_scrub_rules").WillReturnError(errors.New("connection reset"))
+	primary.ExpectQuery("FROM rule_scrub_rules").WillReturnRows(sqlmock.NewRows([]string{"path"}).AddRow("$.a"))
+	rows, err := lookupQuery(context.Background(), "SELECT path FROM rule_scrub_rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+
+	// The replica is not asked again until replicaRetryAfter has passed
+	primary.ExpectQuery("FROM rule_scrub_rules").WillReturnRows(sqlmock.NewRows([]string{"path"}).AddRow("$.a"))
+	rows, err = lookupQuery(context.Background(), "SELECT path FROM rule_scrub_rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+
+	replicaDownUntil.Store(0)
+	replica.ExpectQuery("FROM rule_scrub_rules").WillReturnRows(sqlmock.NewRows([]string{"path"}).AddRow("$.a"))
+	rows, err = lookupQuery(context.Background(), "SELECT path FROM rule_scrub_rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+}
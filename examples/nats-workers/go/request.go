@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Methods accepted for webhook delivery, matching the rule_webhooks.method
+// constraint
+var allowedMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// resolveMethod picks the HTTP method for a delivery: the message's method,
+// then the destination's, then POST.
+func resolveMethod(payload *WebhookPayload, dest *Destination) (string, error) {
+	method := payload.Method
+	if method == "" && dest != nil {
+		method = dest.Method
+	}
+	if method == "" {
+		return http.MethodPost, nil
+	}
+
+	method = strings.ToUpper(method)
+	if !allowedMethods[method] {
+		return "", fmt.Errorf("unsupported HTTP method %q", method)
+	}
+	return method, nil
+}
+
+// buildURL appends destination and message query parameters to the target
+// URL. Message parameters override destination parameters with the same name.
+func buildURL(target string, payload *WebhookPayload, dest *Destination) (string, error) {
+	if len(payload.Query) == 0 && (dest == nil || len(dest.QueryParams) == 0) {
+		return target, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid webhook URL: %w", err)
+	}
+
+	query := u.Query()
+	if dest != nil {
+		for key, value := range dest.QueryParams {
+			query.Set(key, value)
+		}
+	}
+	for key, value := range payload.Query {
+		query.Set(key, value)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
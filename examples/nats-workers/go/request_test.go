@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestResolveMethod(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		dest    *Destination
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: "POST"},
+		{name: "destination", dest: &Destination{Method: "PUT"}, want: "PUT"},
+		{name: "message wins", payload: "patch", dest: &Destination{Method: "PUT"}, want: "PATCH"},
+		{name: "destination without method", dest: &Destination{}, want: "POST"},
+		{name: "unsupported", payload: "TRACE", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveMethod(&WebhookPayload{Method: tt.payload}, tt.dest)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("method = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		query   map[string]string
+		dest    *Destination
+		want    string
+		wantErr bool
+	}{
+		{name: "unchanged", target: "https://x.test/hook?a=1", want: "https://x.test/hook?a=1"},
+		{name: "message query", target: "https://x.test/hook",
+			query: map[string]string{"b": "2 3"}, want: "https://x.test/hook?b=2+3"},
+		{name: "merged with existing", target: "https://x.test/hook?a=1",
+			dest: &Destination{QueryParams: map[string]string{"c": "3"}}, want: "https://x.test/hook?a=1&c=3"},
+		{name: "message overrides destination", target: "https://x.test/hook",
+			query: map[string]string{"k": "msg"},
+			dest:  &Destination{QueryParams: map[string]string{"k": "dest", "z": "1"}},
+			want:  "https://x.test/hook?k=msg&z=1"},
+		{name: "invalid url", target: "http://[::1", query: map[string]string{"a": "1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildURL(tt.target, &WebhookPayload{Query: tt.query}, tt.dest)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("url = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// maxResponseFactsBody bounds how much of a response is read for its facts
+const maxResponseFactsBody = 1 << 20
+
+// responseFactStats counts responses by what became of their facts (see
+// ruleengine.ResponseMapping)
+var responseFactStats = expvar.NewMap("response_facts")
+
+// recordResponseFacts stores the facts the destination's response mapping
+// selects from a successful response, keyed by the message's key_path
+// value. The request has already succeeded, so failures are only logged.
+func recordResponseFacts(ctx context.Context, m *ActionMessage, dest *Destination, resp *http.Response) {
+	mapping := dest.ResponseMapping
+	key, ok := dataPathValue(m.Payload.Data, mapping.KeyPath)
+	if !ok {
+		responseFactStats.Add("no_key", 1)
+		log.Printf("   ⚠️  [%d %s] No %s in the message data, response facts not stored", m.num, m.traceID, mapping.KeyPath)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseFactsBody+1))
+	switch {
+	case err != nil:
+		responseFactStats.Add("failed", 1)
+		log.Printf("   ⚠️  [%d %s] Failed to read the response for its facts: %v", m.num, m.traceID, err)
+		return
+	case len(body) > maxResponseFactsBody:
+		responseFactStats.Add("too_large", 1)
+		log.Printf("   ⚠️  [%d %s] Response larger than %d bytes, facts not stored", m.num, m.traceID, maxResponseFactsBody)
+		return
+	case !json.Valid(body):
+		responseFactStats.Add("invalid", 1)
+		log.Printf("   ⚠️  [%d %s] Response is not JSON, facts not stored", m.num, m.traceID)
+		return
+	}
+
+	n, err := ruleengine.New(db).RecordResponseFacts(ctx, *mapping, key, body, m.traceID)
+	switch {
+	case err != nil:
+		responseFactStats.Add("failed", 1)
+		log.Printf("   ⚠️  [%d %s] Failed to store response facts: %v", m.num, m.traceID, err)
+	case n == 0:
+		responseFactStats.Add("unmatched", 1)
+	default:
+		responseFactStats.Add("recorded", 1)
+	}
+}
+
+// dataPathValue returns the scalar at a dotted path in message data, as
+// text
+func dataPathValue(data map[string]interface{}, path string) (string, bool) {
+	var value interface{} = data
+	for _, field := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = object[field]; !ok {
+			return "", false
+		}
+	}
+	switch v := value.(type) {
+	case nil, map[string]interface{}, []interface{}:
+		return "", false
+	case string:
+		return v, true
+	case float64:
+		// As Postgres prints it for the fact key, not 1.2e+06
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
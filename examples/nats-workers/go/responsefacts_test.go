@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func TestDataPathValue(t *testing.T) {
+	data := map[string]interface{}{
+		"customer_id": "c-42",
+		"order": map[string]interface{}{
+			"id":      1.2e6,
+			"express": true,
+			"lines":   []interface{}{1.0},
+			"coupon":  nil,
+		},
+	}
+	tests := []struct {
+		path   string
+		want   string
+		wantOK bool
+	}{
+		{path: "customer_id", want: "c-42", wantOK: true},
+		{path: "order.id", want: "1200000", wantOK: true},
+		{path: "order.express", want: "true", wantOK: true},
+		{path: "order"},
+		{path: "order.lines"},
+		{path: "order.coupon"},
+		{path: "order.missing"},
+		{path: "customer_id.name"},
+	}
+	for _, tt := range tests {
+		got, ok := dataPathValue(data, tt.path)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("dataPathValue(%q) = %q, %v, want %q, %v", tt.path, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// responseFactCount returns the response_facts counter for outcome
+func responseFactCount(outcome string) int64 {
+	if v, ok := responseFactStats.Get(outcome).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestRecordResponseFacts(t *testing.T) {
+	const recordQuery = `SELECT rule_response_facts_record\(\$1, \$2, \$3, \$4, NULLIF\(\$5, ''\)\)`
+	mapping := &ruleengine.ResponseMapping{Name: "Scoring", KeyPath: "customer_id", Fields: map[string]string{"score": "$.score"}}
+	tests := []struct {
+		name    string
+		data    map[string]interface{}
+		body    string
+		expect  func(mock sqlmock.Sqlmock)
+		outcome string
+	}{
+		{name: "recorded", data: map[string]interface{}{"customer_id": "c-42"}, body: `{"score":0.9}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(recordQuery).WithArgs("Scoring", "c-42", []byte(`{"score":"$.score"}`), []byte(`{"score":0.9}`), "t-1").
+					WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(1))
+			},
+			outcome: "recorded"},
+		{name: "unmatched", data: map[string]interface{}{"customer_id": "c-42"}, body: `{"other":1}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(recordQuery).WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(0))
+			},
+			outcome: "unmatched"},
+		{name: "store fails", data: map[string]interface{}{"customer_id": "c-42"}, body: `{"score":0.9}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(recordQuery).WillReturnError(errors.New("connection refused"))
+			},
+			outcome: "failed"},
+		{name: "no key", data: map[string]interface{}{}, body: `{"score":0.9}`, outcome: "no_key"},
+		{name: "not JSON", data: map[string]interface{}{"customer_id": "c-42"}, body: `<html>OK</html>`, outcome: "invalid"},
+		{name: "too large", data: map[string]interface{}{"customer_id": "c-42"},
+			body: `"` + strings.Repeat("x", maxResponseFactsBody) + `"`, outcome: "too_large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+			before := responseFactCount(tt.outcome)
+			m := &ActionMessage{traceID: "t-1", Payload: &WebhookPayload{Data: tt.data}}
+			resp := &http.Response{Body: io.NopCloser(strings.NewReader(tt.body))}
+			recordResponseFacts(context.Background(), m, &Destination{ID: 3, ResponseMapping: mapping}, resp)
+			if got := responseFactCount(tt.outcome) - before; got != 1 {
+				t.Fatalf("%s count went up by %d, want 1", tt.outcome, got)
+			}
+		})
+	}
+}
+
+func TestWebhookActionRecordsResponseFacts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"result":{"score":0.9}}`)
+	}))
+	defer srv.Close()
+	useDestination(t, &Destination{ID: 3, Name: "scoring", URL: srv.URL, ResponseMapping: &ruleengine.ResponseMapping{
+		Name: "Scoring", KeyPath: "customer_id", Fields: map[string]string{"score": "$.result.score"},
+	}})
+	mock := mockDB(t)
+	mock.ExpectQuery(`rule_response_facts_record`).
+		WithArgs("Scoring", "c-42", sqlmock.AnyArg(), []byte(`{"result":{"score":0.9}}`), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(1))
+
+	m := &ActionMessage{Msg: &nats.Msg{Header: nats.Header{}},
+		Payload: &WebhookPayload{WebhookID: 3, Data: map[string]interface{}{"customer_id": "c-42"}}}
+	if _, err := (webhookAction{}).Execute(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+}
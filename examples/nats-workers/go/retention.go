@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The retention janitor deletes rows older than each table's keep_days in
+// rule_retention_policies, optionally copying them to object storage first
+// as gzipped NDJSON. It works in batches during RETENTION_WINDOW so large
+// backlogs are cleared off-peak without long locks, and runs on the leader
+// only.
+
+// retentionInterval is how often the leader checks for prunable rows
+const retentionInterval = 15 * time.Minute
+
+// retentionBatchPause spaces batches so pruning does not starve deliveries
+const retentionBatchPause = 200 * time.Millisecond
+
+// retentionTable is a table the janitor knows how to prune
+type retentionTable struct {
+	timeColumn string
+	idColumn   string
+	// where limits pruning to rows in a final state
+	where string
+	// ops is set for tables in the operational database
+	ops bool
+}
+
+var retentionTables = map[string]retentionTable{
+	"rule_webhook_calls":         {timeColumn: "created_at", idColumn: "call_id", where: "status IN ('success', 'failed')"},
+	"rule_webhook_call_history":  {timeColumn: "started_at", idColumn: "history_id"},
+	"rule_nats_publish_history":  {timeColumn: "published_at", idColumn: "publish_id"},
+	"rule_nats_expired_messages": {timeColumn: "expired_at", idColumn: "expired_id", ops: true},
+	"rule_notification_receipts": {timeColumn: "sent_at", idColumn: "receipt_id", ops: true},
+	"rule_nats_consumer_usage":   {timeColumn: "hour_start", idColumn: "usage_id", ops: true},
+	"rule_nats_workers":          {timeColumn: "last_seen_at", idColumn: "worker_id", ops: true},
+	"rule_webhook_captures":      {timeColumn: "captured_at", idColumn: "capture_id", ops: true},
+	"rule_delivery_outcomes":     {timeColumn: "recorded_at", idColumn: "outcome_id", ops: true},
+}
+
+// retentionPolicy is one rule_retention_policies row
+type retentionPolicy struct {
+	Table     string
+	KeepDays  int
+	Archive   *retentionArchive
+	BatchSize int
+}
+
+// retentionArchive is where pruned rows are copied
+type retentionArchive struct {
+	Endpoint          string `json:"endpoint"`
+	Region            string `json:"region"`
+	Bucket            string `json:"bucket"`
+	PathStyle         bool   `json:"path_style"`
+	CredentialsSecret string `json:"credentials_secret"`
+	Prefix            string `json:"prefix"`
+}
+
+// retentionWindow is the daily UTC window, in minutes since midnight, in
+// which the janitor runs; start == end means any time
+var retentionWindow struct {
+	start, end int
+}
+
+// initRetention applies RETENTION_WINDOW ("HH:MM-HH:MM", UTC)
+func initRetention() error {
+	start, end, err := parseRetentionWindow(config.Retention.Window)
+	if err != nil {
+		return fmt.Errorf("RETENTION_WINDOW %v", err)
+	}
+	retentionWindow.start, retentionWindow.end = start, end
+	return nil
+}
+
+// parseRetentionWindow returns the window in minutes since midnight; an
+// empty window is any time
+func parseRetentionWindow(window string) (start, end int, err error) {
+	if window == "" {
+		return 0, 0, nil
+	}
+	from, to, ok := strings.Cut(window, "-")
+	start, err1 := parseClock(from)
+	end, err2 := parseClock(to)
+	if !ok || err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("must look like 01:00-05:00 (UTC), not %q", window)
+	}
+	return start, end, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// inRetentionWindow reports whether now falls in RETENTION_WINDOW, which
+// may wrap past midnight
+func inRetentionWindow(now time.Time) bool {
+	start, end := retentionWindow.start, retentionWindow.end
+	if start == end {
+		return true
+	}
+	now = now.UTC()
+	minute := now.Hour()*60 + now.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+func init() {
+	registerSingleton("retention", retentionInterval, runRetention)
+}
+
+// runRetention applies every enabled policy, stopping when the window
+// closes or leadership is lost
+func runRetention(ctx context.Context) error {
+	if !inRetentionWindow(time.Now()) {
+		return nil
+	}
+	policies, err := loadRetentionPolicies(ctx)
+	if err != nil {
+		return err
+	}
+	for _, policy := range policies {
+		pruned, err := applyRetention(ctx, policy)
+		if pruned > 0 {
+			log.Printf("🧹 Retention: pruned %d row(s) from %s older than %d day(s)", pruned, policy.Table, policy.KeepDays)
+		}
+		if err != nil {
+			log.Printf("⚠️  Retention for %s stopped: %v", policy.Table, err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+func loadRetentionPolicies(ctx context.Context) ([]*retentionPolicy, error) {
+	rows, err := lookupQuery(ctx,
+		`SELECT table_name, keep_days, archive, batch_size
+		 FROM rule_retention_policies WHERE enabled = true ORDER BY table_name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load retention policies: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []*retentionPolicy
+	for rows.Next() {
+		policy := &retentionPolicy{}
+		var archive []byte
+		if err := rows.Scan(&policy.Table, &policy.KeepDays, &archive, &policy.BatchSize); err != nil {
+			return nil, err
+		}
+		if _, ok := retentionTables[policy.Table]; !ok {
+			log.Printf("⚠️  Ignoring retention policy for unknown table %s", policy.Table)
+			continue
+		}
+		if len(archive) > 0 && string(archive) != "null" {
+			policy.Archive = &retentionArchive{}
+			if err := json.Unmarshal(archive, policy.Archive); err != nil {
+				log.Printf("⚠️  Ignoring retention policy for %s: invalid archive: %v", policy.Table, err)
+				continue
+			}
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+// applyRetention prunes one table batch by batch and returns the number of
+// rows deleted
+func applyRetention(ctx context.Context, policy *retentionPolicy) (int, error) {
+	table := retentionTables[policy.Table]
+	pool := db
+	if table.ops {
+		if err := ensureOpsReady(); err != nil {
+			return 0, err
+		}
+		pool = opsDB
+	}
+
+	// Tables from the extension are absent when only the worker schema is
+	// installed
+	var exists bool
+	if err := pool.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, policy.Table).Scan(&exists); err != nil || !exists {
+		return 0, err
+	}
+
+	where := fmt.Sprintf("%s < CURRENT_TIMESTAMP - make_interval(days => $1)", table.timeColumn)
+	if table.where != "" {
+		where += " AND " + table.where
+	}
+	selectBatch := fmt.Sprintf("SELECT %s, row_to_json(t)::text FROM %s t WHERE %s ORDER BY %s LIMIT $2",
+		table.idColumn, policy.Table, where, table.idColumn)
+	deleteBatch := fmt.Sprintf("DELETE FROM %s WHERE %s = ANY($1)", policy.Table, table.idColumn)
+
+	pruned := 0
+	for ctx.Err() == nil && inRetentionWindow(time.Now()) {
+		ids, rows, err := retentionBatch(ctx, pool, selectBatch, policy)
+		if err != nil || len(ids) == 0 {
+			return pruned, err
+		}
+		if policy.Archive != nil {
+			if err := archiveRetained(ctx, policy, rows); err != nil {
+				return pruned, fmt.Errorf("archive failed, rows kept: %w", err)
+			}
+		}
+		result, err := pool.ExecContext(ctx, deleteBatch, pq.Array(ids))
+		if err != nil {
+			return pruned, err
+		}
+		n, _ := result.RowsAffected()
+		pruned += int(n)
+		if len(ids) < policy.BatchSize {
+			return pruned, nil
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(retentionBatchPause):
+		}
+	}
+	return pruned, nil
+}
+
+// retentionBatch returns the ids and JSON rows of the next batch to prune
+func retentionBatch(ctx context.Context, pool *sql.DB, query string, policy *retentionPolicy) ([]int64, []string, error) {
+	rows, err := pool.QueryContext(ctx, query, policy.KeepDays, policy.BatchSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	var records []string
+	for rows.Next() {
+		var id int64
+		var record string
+		if err := rows.Scan(&id, &record); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		records = append(records, record)
+	}
+	return ids, records, rows.Err()
+}
+
+// archiveRetained uploads rows as one gzipped NDJSON object under
+// <prefix><table>/dt=<date>/
+func archiveRetained(ctx context.Context, policy *retentionPolicy, records []string) error {
+	cfg := policy.Archive
+	store, err := newObjectStore(ctx, cfg.Endpoint, cfg.Region, cfg.Bucket, cfg.PathStyle, cfg.CredentialsSecret)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	for _, record := range records {
+		gz.Write([]byte(record))
+		gz.Write([]byte("\n"))
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	random := make([]byte, 4)
+	rand.Read(random)
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%s%s/dt=%s/%s-%s.ndjson.gz",
+		cfg.Prefix, policy.Table, now.Format("2006-01-02"), now.Format("20060102T150405.000Z"), hex.EncodeToString(random))
+	key = strings.TrimLeft(key, "/")
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	return store.Put(ctx, key, "application/x-ndjson", "gzip", body.Bytes())
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+// setSecret puts a decrypted secret in the cache for one test
+func setSecret(t *testing.T, name, value string) {
+	t.Helper()
+	secretsMu.Lock()
+	secrets[name] = cachedSecret{value: value, loadedAt: time.Now()}
+	secretsMu.Unlock()
+	t.Cleanup(func() {
+		secretsMu.Lock()
+		delete(secrets, name)
+		secretsMu.Unlock()
+	})
+}
+
+func TestParseRetentionWindow(t *testing.T) {
+	tests := []struct {
+		window     string
+		start, end int
+		wantErr    bool
+	}{
+		{window: "", start: 0, end: 0},
+		{window: "01:00-05:00", start: 60, end: 300},
+		{window: "22:30 - 04:15", start: 22*60 + 30, end: 4*60 + 15},
+		{window: "01:00", wantErr: true},
+		{window: "1am-5am", wantErr: true},
+		{window: "25:00-05:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		start, end, err := parseRetentionWindow(tt.window)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRetentionWindow(%q) err = %v", tt.window, err)
+			continue
+		}
+		if start != tt.start || end != tt.end {
+			t.Errorf("parseRetentionWindow(%q) = %d-%d, want %d-%d", tt.window, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestInRetentionWindow(t *testing.T) {
+	prev := retentionWindow
+	t.Cleanup(func() { retentionWindow = prev })
+	at := func(clock string) time.Time {
+		tm, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 3, 1, tm.Hour(), tm.Minute(), 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		window string
+		now    time.Time
+		want   bool
+	}{
+		{"", at("13:00"), true},
+		{"01:00-05:00", at("00:59"), false},
+		{"01:00-05:00", at("01:00"), true},
+		{"01:00-05:00", at("04:59"), true},
+		{"01:00-05:00", at("05:00"), false},
+		{"22:00-04:00", at("23:30"), true},
+		{"22:00-04:00", at("03:59"), true},
+		{"22:00-04:00", at("12:00"), false},
+		// The window is UTC whatever the local zone
+		{"01:00-05:00", time.Date(2024, 3, 1, 3, 0, 0, 0, time.FixedZone("EST", -5*3600)), false},
+		{"01:00-05:00", time.Date(2024, 2, 29, 22, 0, 0, 0, time.FixedZone("EST", -5*3600)), true},
+	}
+	for _, tt := range tests {
+		start, end, err := parseRetentionWindow(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		retentionWindow.start, retentionWindow.end = start, end
+		if got := inRetentionWindow(tt.now); got != tt.want {
+			t.Errorf("inRetentionWindow(%s, %s) = %v, want %v", tt.window, tt.now.Format(time.RFC3339), got, tt.want)
+		}
+	}
+}
+
+func TestLoadRetentionPolicies(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectQuery("FROM rule_retention_policies WHERE enabled = true").
+		WillReturnRows(sqlmock.NewRows([]string{"table_name", "keep_days", "archive", "batch_size"}).
+			AddRow("rule_webhook_calls", 30, nil, 1000).
+			AddRow("pg_authid", 1, nil, 1000).
+			AddRow("rule_nats_publish_history", 7, []byte(`{"bucket": "archive", "credentials_secret": "s3"}`), 500).
+			AddRow("rule_webhook_call_history", 7, []byte(`{"bucket": 1}`), 500))
+
+	policies, err := loadRetentionPolicies(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 {
+		t.Fatalf("policies = %+v", policies)
+	}
+	if policies[0].Table != "rule_webhook_calls" || policies[0].Archive != nil {
+		t.Errorf("first = %+v", policies[0])
+	}
+	if policies[1].Archive == nil || policies[1].Archive.Bucket != "archive" || policies[1].BatchSize != 500 {
+		t.Errorf("second = %+v", policies[1])
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	prev := retentionWindow
+	t.Cleanup(func() { retentionWindow = prev })
+	retentionWindow.start, retentionWindow.end = 0, 0
+
+	mock := mockDB(t)
+	mock.MatchExpectationsInOrder(true)
+	policy := &retentionPolicy{Table: "rule_webhook_calls", KeepDays: 30, BatchSize: 2}
+
+	mock.ExpectQuery(`SELECT to_regclass\(\$1\) IS NOT NULL`).WithArgs("rule_webhook_calls").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	// Only finished calls are pruned, oldest first, batch by batch
+	selectBatch := `SELECT call_id, row_to_json\(t\)::text FROM rule_webhook_calls t WHERE created_at < CURRENT_TIMESTAMP - ` +
+		`make_interval\(days => \$1\) AND status IN \('success', 'failed'\) ORDER BY call_id LIMIT \$2`
+	mock.ExpectQuery(selectBatch).WithArgs(30, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"call_id", "row"}).AddRow(1, `{"call_id":1}`).AddRow(2, `{"call_id":2}`))
+	mock.ExpectExec(`DELETE FROM rule_webhook_calls WHERE call_id = ANY\(\$1\)`).WithArgs(pq.Array([]int64{1, 2})).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery(selectBatch).WithArgs(30, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"call_id", "row"}).AddRow(5, `{"call_id":5}`))
+	mock.ExpectExec(`DELETE FROM rule_webhook_calls`).WithArgs(pq.Array([]int64{5})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	pruned, err := applyRetention(context.Background(), policy)
+	if err != nil || pruned != 3 {
+		t.Fatalf("applyRetention = %d, %v", pruned, err)
+	}
+}
+
+func TestApplyRetentionMissingTable(t *testing.T) {
+	mock := mockDB(t)
+	mock.ExpectQuery("to_regclass").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	pruned, err := applyRetention(context.Background(), &retentionPolicy{Table: "rule_nats_publish_history", KeepDays: 7, BatchSize: 10})
+	if err != nil || pruned != 0 {
+		t.Fatalf("applyRetention = %d, %v", pruned, err)
+	}
+}
+
+func TestApplyRetentionArchives(t *testing.T) {
+	prev := retentionWindow
+	t.Cleanup(func() { retentionWindow = prev })
+	retentionWindow.start, retentionWindow.end = 0, 0
+	setSecret(t, "archive_s3", `{"access_key_id": "AK", "secret_access_key": "SK"}`)
+
+	var (
+		mu      sync.Mutex
+		keys    []string
+		objects []string
+		fail    bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := io.ReadAll(gz)
+		keys = append(keys, r.URL.Path)
+		objects = append(objects, string(body))
+	}))
+	defer srv.Close()
+
+	policy := &retentionPolicy{Table: "rule_nats_publish_history", KeepDays: 7, BatchSize: 10,
+		Archive: &retentionArchive{Endpoint: srv.URL, Bucket: "cold", PathStyle: true, CredentialsSecret: "archive_s3", Prefix: "/worker/"}}
+
+	mock := mockDB(t)
+	mock.MatchExpectationsInOrder(true)
+	mock.ExpectQuery("to_regclass").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("FROM rule_nats_publish_history t").
+		WillReturnRows(sqlmock.NewRows([]string{"publish_id", "row"}).AddRow(7, `{"publish_id":7}`).AddRow(8, `{"publish_id":8}`))
+	mock.ExpectExec("DELETE FROM rule_nats_publish_history").WithArgs(pq.Array([]int64{7, 8})).WillReturnResult(sqlmock.NewResult(0, 2))
+	if pruned, err := applyRetention(context.Background(), policy); err != nil || pruned != 2 {
+		t.Fatalf("applyRetention = %d, %v", pruned, err)
+	}
+	if len(keys) != 1 || !strings.HasPrefix(keys[0], "/cold/worker/rule_nats_publish_history/dt="+time.Now().UTC().Format("2006-01-02")+"/") ||
+		!strings.HasSuffix(keys[0], ".ndjson.gz") {
+		t.Fatalf("keys = %v", keys)
+	}
+	if objects[0] != "{\"publish_id\":7}\n{\"publish_id\":8}\n" {
+		t.Fatalf("object = %q", objects[0])
+	}
+
+	// When the upload fails the rows stay
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	mock.ExpectQuery("to_regclass").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("FROM rule_nats_publish_history t").
+		WillReturnRows(sqlmock.NewRows([]string{"publish_id", "row"}).AddRow(9, `{"publish_id":9}`))
+	pruned, err := applyRetention(context.Background(), policy)
+	if pruned != 0 || err == nil || !strings.Contains(err.Error(), "archive failed, rows kept") {
+		t.Fatalf("applyRetention = %d, %v", pruned, err)
+	}
+}
+
+func TestRunRetentionOutsideWindow(t *testing.T) {
+	prev := retentionWindow
+	t.Cleanup(func() { retentionWindow = prev })
+	now := time.Now().UTC()
+	minute := now.Hour()*60 + now.Minute()
+	// A one-minute window that closed two minutes ago
+	retentionWindow.start, retentionWindow.end = (minute+1440-3)%1440, (minute+1440-2)%1440
+
+	mockDB(t) // no queries expected
+	if err := runRetention(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunRetentionReportsLoadFailure(t *testing.T) {
+	prev := retentionWindow
+	t.Cleanup(func() { retentionWindow = prev })
+	retentionWindow.start, retentionWindow.end = 0, 0
+
+	mock := mockDB(t)
+	mock.ExpectQuery("FROM rule_retention_policies").WillReturnError(errors.New(`relation "rule_retention_policies" does not exist`))
+	err := runRetention(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "failed to load retention policies") {
+		t.Fatalf("err = %v", err)
+	}
+}
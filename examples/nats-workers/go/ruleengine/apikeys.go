@@ -0,0 +1,326 @@
+package ruleengine
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//go:embed apikeys.sql
+var apiKeysSQL string
+
+// Roles an API key can hold. Each includes the ones before it.
+const (
+	// RoleViewer reads rules, rule sets, and statistics and evaluates
+	RoleViewer = "viewer"
+
+	// RoleOperator also enables and disables rules and rule sets
+	RoleOperator = "operator"
+
+	// RoleRuleAuthor also creates, changes, and deletes rules and rule sets
+	RoleRuleAuthor = "rule-author"
+
+	// RoleAdmin may do everything
+	RoleAdmin = "admin"
+)
+
+// Roles lists the valid roles
+var Roles = []string{RoleViewer, RoleOperator, RoleRuleAuthor, RoleAdmin}
+
+// apiKeyPrefix starts every issued key so leaked keys are easy to spot
+const apiKeyPrefix = "rek_"
+
+// ErrAPIKeyInvalid is returned by AuthenticateAPIKey for unknown, expired,
+// and revoked keys
+var ErrAPIKeyInvalid = errors.New("invalid API key")
+
+// ErrAPIKeyNotFound is returned for an unknown API key id
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKey describes a gateway API key. The secret itself is only returned
+// when the key is created or rotated.
+type APIKey struct {
+	ID    int      `json:"id"`
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+
+	// RuleSetIDs limits the key to these rule sets; empty means all
+	RuleSetIDs []int  `json:"ruleset_ids,omitempty"`
+	Tenant     string `json:"tenant,omitempty"`
+
+	// Prefix is the public start of the key, e.g. for finding it in logs
+	Prefix     string     `json:"prefix"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	ReplacedBy int        `json:"replaced_by,omitempty"`
+}
+
+// Active reports whether the key is neither revoked nor expired
+func (k *APIKey) Active() bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || k.ExpiresAt.After(time.Now()))
+}
+
+// EnableAPIKeys creates the API key table if needed. It is idempotent.
+func (c *Client) EnableAPIKeys(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, apiKeysSQL); err != nil {
+		return fmt.Errorf("failed to install API keys: %w", err)
+	}
+	return nil
+}
+
+// CreateAPIKey issues a key with k's name, roles, scope, and expiry and
+// returns it with its secret, which is not stored and cannot be shown
+// again. The actor of ctx is recorded as its creator.
+func (c *Client) CreateAPIKey(ctx context.Context, k APIKey) (*APIKey, string, error) {
+	if err := validateAPIKey(&k); err != nil {
+		return nil, "", err
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	created, secret, err := insertAPIKey(ctx, tx, k, ActorFromContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	return created, secret, tx.Commit()
+}
+
+func validateAPIKey(k *APIKey) error {
+	k.Name = strings.TrimSpace(k.Name)
+	if k.Name == "" {
+		return &ValidationError{Field: "name", Message: "is required"}
+	}
+	if len(k.Roles) == 0 {
+		return &ValidationError{Field: "roles", Message: "at least one role is required"}
+	}
+	for _, role := range k.Roles {
+		if !validRole(role) {
+			return &ValidationError{Field: "roles", Message: fmt.Sprintf("unknown role %q (expected %s)", role, strings.Join(Roles, ", "))}
+		}
+	}
+	for _, id := range k.RuleSetIDs {
+		if id <= 0 {
+			return &ValidationError{Field: "ruleset_ids", Message: "must be positive rule set ids"}
+		}
+	}
+	if k.ExpiresAt != nil && !k.ExpiresAt.After(time.Now()) {
+		return &ValidationError{Field: "expires_at", Message: "must be in the future"}
+	}
+	return nil
+}
+
+func validRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func insertAPIKey(ctx context.Context, tx *sql.Tx, k APIKey, createdBy string) (*APIKey, string, error) {
+	prefix, secret, err := newAPIKeySecret()
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.Sum256([]byte(secret))
+	row := tx.QueryRowContext(ctx,
+		`INSERT INTO rule_api_keys (name, prefix, key_hash, roles, ruleset_ids, tenant, created_by, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8)
+		 RETURNING `+apiKeyColumns,
+		k.Name, prefix, hash[:], pq.Array(k.Roles), pq.Array(k.RuleSetIDs), k.Tenant, createdBy, k.ExpiresAt,
+	)
+	created, err := scanAPIKey(row)
+	if err != nil {
+		return nil, "", err
+	}
+	return created, secret, nil
+}
+
+// newAPIKeySecret returns a random key "rek_<prefix>_<secret>" and its
+// prefix, which is unique per key and stored in clear
+func newAPIKeySecret() (string, string, error) {
+	buf := make([]byte, 6+32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	prefix := apiKeyPrefix + hex.EncodeToString(buf[:6])
+	return prefix, prefix + "_" + base64.RawURLEncoding.EncodeToString(buf[6:]), nil
+}
+
+const apiKeyColumns = `key_id, name, roles, ruleset_ids, COALESCE(tenant, ''), prefix,
+	COALESCE(created_by, ''), created_at, expires_at, last_used_at, revoked_at, COALESCE(replaced_by, 0)`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var k APIKey
+	var rulesets pq.Int64Array
+	var expires, lastUsed, revoked sql.NullTime
+	if err := row.Scan(&k.ID, &k.Name, pq.Array(&k.Roles), &rulesets, &k.Tenant, &k.Prefix,
+		&k.CreatedBy, &k.CreatedAt, &expires, &lastUsed, &revoked, &k.ReplacedBy); err != nil {
+		return nil, err
+	}
+	for _, id := range rulesets {
+		k.RuleSetIDs = append(k.RuleSetIDs, int(id))
+	}
+	if expires.Valid {
+		k.ExpiresAt = &expires.Time
+	}
+	if lastUsed.Valid {
+		k.LastUsedAt = &lastUsed.Time
+	}
+	if revoked.Valid {
+		k.RevokedAt = &revoked.Time
+	}
+	return &k, nil
+}
+
+// GetAPIKey returns one API key
+func (c *Client) GetAPIKey(ctx context.Context, id int) (*APIKey, error) {
+	k, err := scanAPIKey(c.db.QueryRowContext(ctx,
+		"SELECT "+apiKeyColumns+" FROM rule_api_keys WHERE key_id = $1", id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("API key %d: %w", id, ErrAPIKeyNotFound)
+	}
+	return k, err
+}
+
+// ListAPIKeys returns API keys, newest first. Revoked and expired keys are
+// included only with all.
+func (c *Client) ListAPIKeys(ctx context.Context, all bool) ([]APIKey, error) {
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT `+apiKeyColumns+` FROM rule_api_keys
+		 WHERE $1 OR (revoked_at IS NULL AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP))
+		 ORDER BY key_id DESC`,
+		all,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+	return keys, rows.Err()
+}
+
+// RotateAPIKey issues a new key with the same name, roles, scope, and
+// expiry as key id and returns it with its secret. The old key keeps
+// working for grace (0 ends it immediately) so clients can switch over.
+func (c *Client) RotateAPIKey(ctx context.Context, id int, grace time.Duration) (*APIKey, string, error) {
+	if grace < 0 {
+		return nil, "", &ValidationError{Field: "grace", Message: "must not be negative"}
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	old, err := scanAPIKey(tx.QueryRowContext(ctx,
+		"SELECT "+apiKeyColumns+" FROM rule_api_keys WHERE key_id = $1 FOR UPDATE", id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, "", fmt.Errorf("API key %d: %w", id, ErrAPIKeyNotFound)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if !old.Active() {
+		return nil, "", &ValidationError{Field: "key", Message: fmt.Sprintf("API key %d is revoked or expired", id)}
+	}
+
+	created, secret, err := insertAPIKey(ctx, tx, *old, ActorFromContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE rule_api_keys
+		 SET replaced_by = $2,
+		     expires_at = LEAST(COALESCE(expires_at, 'infinity'), CURRENT_TIMESTAMP + make_interval(secs => $3))
+		 WHERE key_id = $1`,
+		id, created.ID, grace.Seconds(),
+	); err != nil {
+		return nil, "", err
+	}
+	return created, secret, tx.Commit()
+}
+
+// RevokeAPIKey stops key id from working. Revoking a revoked key is a
+// no-op.
+func (c *Client) RevokeAPIKey(ctx context.Context, id int) error {
+	res, err := c.db.ExecContext(ctx,
+		"UPDATE rule_api_keys SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP) WHERE key_id = $1",
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("API key %d: %w", id, ErrAPIKeyNotFound)
+	}
+	return nil
+}
+
+// AuthenticateAPIKey returns the active key matching secret, or
+// ErrAPIKeyInvalid. It records when the key was last used, at most once a
+// minute.
+func (c *Client) AuthenticateAPIKey(ctx context.Context, secret string) (*APIKey, error) {
+	prefix, _, ok := strings.Cut(strings.TrimPrefix(secret, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(secret, apiKeyPrefix) {
+		return nil, ErrAPIKeyInvalid
+	}
+	var id int
+	var hash []byte
+	err := c.db.QueryRowContext(ctx,
+		`SELECT key_id, key_hash FROM rule_api_keys
+		 WHERE prefix = $1 AND revoked_at IS NULL
+		   AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)`,
+		apiKeyPrefix+prefix,
+	).Scan(&id, &hash)
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	presented := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(presented[:], hash) != 1 {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	k, err := scanAPIKey(c.db.QueryRowContext(ctx,
+		`UPDATE rule_api_keys SET last_used_at = CURRENT_TIMESTAMP
+		 WHERE key_id = $1 AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - interval '1 minute')
+		 RETURNING `+apiKeyColumns,
+		id,
+	))
+	if err == sql.ErrNoRows {
+		// Used within the last minute
+		return c.GetAPIKey(ctx, id)
+	}
+	return k, err
+}
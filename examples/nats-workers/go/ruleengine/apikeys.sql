@@ -0,0 +1,22 @@
+-- Gateway API keys (see EnableAPIKeys). Only a SHA-256 hash of each
+-- secret is stored; the prefix finds the row to compare against.
+
+CREATE TABLE IF NOT EXISTS rule_api_keys (
+    key_id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL UNIQUE,
+    key_hash BYTEA NOT NULL,
+    roles TEXT[] NOT NULL,
+    ruleset_ids INTEGER[] NOT NULL DEFAULT '{}',
+    tenant TEXT,
+    created_by TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    replaced_by INTEGER REFERENCES rule_api_keys(key_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rule_api_keys_name ON rule_api_keys(name);
+
+COMMENT ON TABLE rule_api_keys IS 'Hashed API keys accepted by the rule-api gateway';
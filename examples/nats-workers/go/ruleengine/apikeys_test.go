@@ -0,0 +1,254 @@
+package ruleengine
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var apiKeyRowColumns = []string{"key_id", "name", "roles", "ruleset_ids", "tenant", "prefix",
+	"created_by", "created_at", "expires_at", "last_used_at", "revoked_at", "replaced_by"}
+
+// apiKeyRow is key id as the database returns it; lib/pq returns arrays
+// as text
+func apiKeyRow(id int, name, roles, rulesets string, expires, revoked interface{}) *sqlmock.Rows {
+	var sets interface{}
+	if rulesets != "" {
+		sets = []byte(rulesets)
+	}
+	return sqlmock.NewRows(apiKeyRowColumns).AddRow(id, name, []byte(roles), sets, "acme", "rek_0123456789ab",
+		"alice", time.Now(), expires, nil, revoked, 0)
+}
+
+// captureBytes matches any []byte argument and keeps it
+type captureBytes struct{ got *[]byte }
+
+func (c captureBytes) Match(v driver.Value) bool {
+	b, ok := v.([]byte)
+	*c.got = b
+	return ok
+}
+
+func TestValidateAPIKey(t *testing.T) {
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	tests := []struct {
+		name  string
+		key   APIKey
+		field string
+	}{
+		{name: "valid", key: APIKey{Name: " ci ", Roles: []string{RoleViewer, RoleOperator}, RuleSetIDs: []int{3}, ExpiresAt: &future}},
+		{name: "every role", key: APIKey{Name: "ci", Roles: Roles}},
+		{name: "no name", key: APIKey{Name: "  ", Roles: []string{RoleViewer}}, field: "name"},
+		{name: "no roles", key: APIKey{Name: "ci"}, field: "roles"},
+		{name: "unknown role", key: APIKey{Name: "ci", Roles: []string{"root"}}, field: "roles"},
+		{name: "bad rule set", key: APIKey{Name: "ci", Roles: []string{RoleViewer}, RuleSetIDs: []int{3, 0}}, field: "ruleset_ids"},
+		{name: "already expired", key: APIKey{Name: "ci", Roles: []string{RoleViewer}, ExpiresAt: &past}, field: "expires_at"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAPIKey(&tt.key)
+			if tt.field == "" {
+				if err != nil || tt.key.Name != "ci" {
+					t.Fatalf("err = %v, name %q", err, tt.key.Name)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) || verr.Field != tt.field {
+				t.Fatalf("err = %v, want a ValidationError on %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestNewAPIKeySecret(t *testing.T) {
+	format := regexp.MustCompile(`^rek_[0-9a-f]{12}_[A-Za-z0-9_-]{43}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		prefix, secret, err := newAPIKeySecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !format.MatchString(secret) || !strings.HasPrefix(secret, prefix+"_") || seen[prefix] {
+			t.Fatalf("prefix %q, secret %q", prefix, secret)
+		}
+		seen[prefix] = true
+	}
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	client, mock := newMock(t)
+	ctx := WithActor(context.Background(), "alice")
+	var hash []byte
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO rule_api_keys`).
+		WithArgs("ci", sqlmock.AnyArg(), captureBytes{&hash}, `{"viewer","operator"}`, "{3,5}", "acme", "alice", nil).
+		WillReturnRows(apiKeyRow(7, "ci", "{viewer,operator}", "{3,5}", nil, nil))
+	mock.ExpectCommit()
+
+	key, secret, err := client.CreateAPIKey(ctx, APIKey{Name: "ci", Roles: []string{RoleViewer, RoleOperator}, RuleSetIDs: []int{3, 5}, Tenant: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != 7 || len(key.Roles) != 2 || len(key.RuleSetIDs) != 2 || key.RuleSetIDs[1] != 5 || !key.Active() {
+		t.Fatalf("key = %+v", key)
+	}
+	// Only the hash of the secret is stored
+	if sum := sha256.Sum256([]byte(secret)); !strings.HasPrefix(secret, apiKeyPrefix) || string(hash) != string(sum[:]) {
+		t.Fatalf("secret %q stored as %x", secret, hash)
+	}
+
+	if _, _, err := client.CreateAPIKey(ctx, APIKey{Name: "ci"}); err == nil {
+		t.Fatal("key without roles created")
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	const secret = "rek_0123456789ab_c2VjcmV0"
+	hash := sha256.Sum256([]byte(secret))
+	other := sha256.Sum256([]byte("rek_0123456789ab_b3RoZXI"))
+	lookup := `SELECT key_id, key_hash FROM rule_api_keys`
+
+	tests := []struct {
+		name      string
+		presented string
+		setup     func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{name: "no prefix", presented: "c2VjcmV0", wantErr: ErrAPIKeyInvalid},
+		{name: "no separator", presented: "rek_0123456789ab", wantErr: ErrAPIKeyInvalid},
+		{name: "unknown, revoked or expired", presented: secret, wantErr: ErrAPIKeyInvalid, setup: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery(lookup).WithArgs("rek_0123456789ab").WillReturnRows(sqlmock.NewRows([]string{"key_id", "key_hash"}))
+		}},
+		{name: "wrong secret", presented: secret, wantErr: ErrAPIKeyInvalid, setup: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery(lookup).WillReturnRows(sqlmock.NewRows([]string{"key_id", "key_hash"}).AddRow(7, other[:]))
+		}},
+		{name: "lookup fails", presented: secret, wantErr: errors.New("connection reset"), setup: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery(lookup).WillReturnError(errors.New("connection reset"))
+		}},
+		{name: "valid", presented: secret, setup: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery(lookup).WillReturnRows(sqlmock.NewRows([]string{"key_id", "key_hash"}).AddRow(7, hash[:]))
+			m.ExpectQuery(`UPDATE rule_api_keys SET last_used_at`).WithArgs(7).
+				WillReturnRows(apiKeyRow(7, "ci", "{viewer}", "{3}", nil, nil))
+		}},
+		{name: "used within the minute", presented: secret, setup: func(m sqlmock.Sqlmock) {
+			m.ExpectQuery(lookup).WillReturnRows(sqlmock.NewRows([]string{"key_id", "key_hash"}).AddRow(7, hash[:]))
+			m.ExpectQuery(`UPDATE rule_api_keys SET last_used_at`).WillReturnRows(sqlmock.NewRows(apiKeyRowColumns))
+			m.ExpectQuery(`FROM rule_api_keys WHERE key_id = \$1`).WithArgs(7).
+				WillReturnRows(apiKeyRow(7, "ci", "{viewer}", "{3}", nil, nil))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			if tt.setup != nil {
+				tt.setup(mock)
+			}
+			key, err := client.AuthenticateAPIKey(context.Background(), tt.presented)
+			if tt.wantErr != nil {
+				if err == nil || err.Error() != tt.wantErr.Error() {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil || key.ID != 7 || key.Tenant != "acme" || key.RuleSetIDs[0] != 3 {
+				t.Fatalf("key = %+v, %v", key, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRotateAPIKey(t *testing.T) {
+	revoked := time.Now().Add(-time.Hour)
+	selectOld := `FROM rule_api_keys WHERE key_id = \$1 FOR UPDATE`
+
+	tests := []struct {
+		name    string
+		grace   time.Duration
+		setup   func(sqlmock.Sqlmock)
+		wantErr string
+	}{
+		{name: "negative grace", grace: -time.Second, wantErr: "grace: must not be negative"},
+		{name: "not found", setup: func(m sqlmock.Sqlmock) {
+			m.ExpectBegin()
+			m.ExpectQuery(selectOld).WithArgs(7).WillReturnRows(sqlmock.NewRows(apiKeyRowColumns))
+			m.ExpectRollback()
+		}, wantErr: "API key 7: API key not found"},
+		{name: "revoked", setup: func(m sqlmock.Sqlmock) {
+			m.ExpectBegin()
+			m.ExpectQuery(selectOld).WillReturnRows(apiKeyRow(7, "ci", "{viewer}", "", nil, revoked))
+			m.ExpectRollback()
+		}, wantErr: "API key 7 is revoked or expired"},
+		{name: "rotated with grace", grace: 10 * time.Minute, setup: func(m sqlmock.Sqlmock) {
+			m.ExpectBegin()
+			m.ExpectQuery(selectOld).WillReturnRows(apiKeyRow(7, "ci", "{operator}", "{3}", nil, nil))
+			// Same name, roles, scope, and tenant; the rotating actor is the creator
+			m.ExpectQuery(`INSERT INTO rule_api_keys`).
+				WithArgs("ci", sqlmock.AnyArg(), sqlmock.AnyArg(), `{"operator"}`, "{3}", "acme", "bob", nil).
+				WillReturnRows(apiKeyRow(8, "ci", "{operator}", "{3}", nil, nil))
+			m.ExpectExec(`UPDATE rule_api_keys\s+SET replaced_by = \$2`).WithArgs(7, 8, float64(600)).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			m.ExpectCommit()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			mock.MatchExpectationsInOrder(true)
+			if tt.setup != nil {
+				tt.setup(mock)
+			}
+			key, secret, err := client.RotateAPIKey(WithActor(context.Background(), "bob"), 7, tt.grace)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil || key.ID != 8 || !strings.HasPrefix(secret, apiKeyPrefix) {
+				t.Fatalf("key = %+v, %q, %v", key, secret, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectExec(`SET revoked_at = COALESCE\(revoked_at, CURRENT_TIMESTAMP\)`).WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := client.RevokeAPIKey(context.Background(), 7); err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec(`SET revoked_at`).WithArgs(9).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := client.RevokeAPIKey(context.Background(), 9); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestListAPIKeys(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+	for _, all := range []bool{false, true} {
+		client, mock := newMock(t)
+		rows := apiKeyRow(8, "ci", "{viewer}", "", nil, nil)
+		if all {
+			rows.AddRow(7, "ci", []byte("{viewer}"), nil, "", "rek_ba9876543210", "", time.Now(), expired, nil, nil, 8)
+		}
+		mock.ExpectQuery(`FROM rule_api_keys\s+WHERE \$1 OR`).WithArgs(all).WillReturnRows(rows)
+		keys, err := client.ListAPIKeys(context.Background(), all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if all && (len(keys) != 2 || keys[1].Active() || keys[1].ReplacedBy != 8) || !all && len(keys) != 1 {
+			t.Fatalf("all=%v: keys = %+v", all, keys)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+//go:embed audit.sql
+var auditSQL string
+
+type actorKey struct{}
+
+// WithActor attributes rule changes made with ctx to actor (a user name,
+// API key name, service account, ...) in the audit log
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set by WithActor, if any
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// InstallAuditLog creates rule_change_audit and the triggers that fill it.
+// It is idempotent; run it once per database (it needs permission to
+// create triggers on the repository tables). Changes made outside the SDK
+// are recorded too, with only the database role as attribution.
+func (c *Client) InstallAuditLog(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, auditSQL); err != nil {
+		return fmt.Errorf("failed to install audit log: %w", err)
+	}
+	return nil
+}
+
+// begin starts a transaction carrying ctx's actor for the audit triggers
+func (c *Client) begin(ctx context.Context) (*sql.Tx, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if actor := ActorFromContext(ctx); actor != "" {
+		if _, err := tx.ExecContext(ctx, "SELECT set_config('ruleengine.actor', $1, true)", actor); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// AuditEntry is one recorded rule change
+type AuditEntry struct {
+	ID            int64           `json:"id"`
+	Rule          string          `json:"rule"`
+	Action        string          `json:"action"` // create, update, enable, disable, save_version, activate, delete_version, delete
+	Actor         string          `json:"actor,omitempty"`
+	DBUser        string          `json:"db_user"`
+	ChangedAt     time.Time       `json:"changed_at"`
+	VersionBefore string          `json:"version_before,omitempty"`
+	VersionAfter  string          `json:"version_after,omitempty"`
+	Before        json.RawMessage `json:"before,omitempty"`
+	After         json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditFilter narrows ListAuditLog. Zero values match everything.
+type AuditFilter struct {
+	Rule   string
+	Actor  string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int // Default 100, at most 1000
+}
+
+// ListAuditLog returns recorded rule changes, newest first. Requires
+// InstallAuditLog.
+func (c *Client) ListAuditLog(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	if filter.Limit > 1000 {
+		filter.Limit = 1000
+	}
+
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT id, rule_name, action, COALESCE(actor, ''), db_user, changed_at,
+		        COALESCE(version_before, ''), COALESCE(version_after, ''), before, after
+		 FROM rule_change_audit
+		 WHERE ($1 = '' OR rule_name = $1)
+		   AND ($2 = '' OR actor = $2)
+		   AND ($3 = '' OR action = $3)
+		   AND ($4::TIMESTAMPTZ IS NULL OR changed_at >= $4)
+		   AND ($5::TIMESTAMPTZ IS NULL OR changed_at < $5)
+		 ORDER BY changed_at DESC, id DESC
+		 LIMIT $6`,
+		filter.Rule, filter.Actor, filter.Action,
+		nullTime(filter.Since), nullTime(filter.Until), filter.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var before, after []byte
+		if err := rows.Scan(&e.ID, &e.Rule, &e.Action, &e.Actor, &e.DBUser, &e.ChangedAt,
+			&e.VersionBefore, &e.VersionAfter, &before, &after); err != nil {
+			return nil, err
+		}
+		if before != nil {
+			e.Before = before
+		}
+		if after != nil {
+			e.After = after
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
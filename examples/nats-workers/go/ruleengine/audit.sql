@@ -0,0 +1,135 @@
+-- Rule change audit trail with actor attribution (see InstallAuditLog).
+--
+-- The extension's rule_audit_log only knows the database role. These
+-- triggers also record the application-level actor, which the SDK passes
+-- per transaction in the ruleengine.actor setting (see WithActor), and the
+-- rule definition before and after each change.
+
+CREATE TABLE IF NOT EXISTS rule_change_audit (
+    id BIGSERIAL PRIMARY KEY,
+    rule_name TEXT NOT NULL,
+    action TEXT NOT NULL,
+    actor TEXT,
+    db_user TEXT NOT NULL DEFAULT SESSION_USER,
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    version_before TEXT,
+    version_after TEXT,
+    before JSONB,
+    after JSONB
+);
+
+CREATE INDEX IF NOT EXISTS idx_rule_change_audit_rule ON rule_change_audit(rule_name, changed_at DESC);
+CREATE INDEX IF NOT EXISTS idx_rule_change_audit_changed_at ON rule_change_audit(changed_at DESC);
+CREATE INDEX IF NOT EXISTS idx_rule_change_audit_actor ON rule_change_audit(actor, changed_at DESC);
+
+COMMENT ON TABLE rule_change_audit IS 'Who changed which rule, when, with before/after definitions';
+
+-- Current definition of a rule: metadata plus its active version
+CREATE OR REPLACE FUNCTION ruleengine_rule_snapshot(p_rule_id INTEGER) RETURNS JSONB AS $$
+    SELECT jsonb_build_object(
+        'name', rd.name,
+        'description', rd.description,
+        'is_active', rd.is_active,
+        'version', rv.version,
+        'grl', rv.grl_content
+    )
+    FROM rule_definitions rd
+    LEFT JOIN rule_versions rv ON rv.rule_id = rd.id AND rv.is_default
+    WHERE rd.id = p_rule_id
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION ruleengine_audit_actor() RETURNS TEXT AS $$
+    SELECT NULLIF(current_setting('ruleengine.actor', true), '')
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION ruleengine_audit_rule() RETURNS TRIGGER AS $$
+DECLARE
+    v_before JSONB;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO rule_change_audit (rule_name, action, actor, after)
+        VALUES (NEW.name, 'create', ruleengine_audit_actor(), ruleengine_rule_snapshot(NEW.id));
+    ELSIF TG_OP = 'UPDATE' THEN
+        IF OLD.is_active IS DISTINCT FROM NEW.is_active
+           OR OLD.description IS DISTINCT FROM NEW.description
+           OR OLD.name IS DISTINCT FROM NEW.name THEN
+            v_before := ruleengine_rule_snapshot(NEW.id) || jsonb_build_object(
+                'name', OLD.name, 'description', OLD.description, 'is_active', OLD.is_active);
+            INSERT INTO rule_change_audit (rule_name, action, actor, before, after)
+            VALUES (
+                NEW.name,
+                CASE
+                    WHEN OLD.is_active IS DISTINCT FROM NEW.is_active
+                    THEN CASE WHEN NEW.is_active THEN 'enable' ELSE 'disable' END
+                    ELSE 'update'
+                END,
+                ruleengine_audit_actor(),
+                v_before,
+                ruleengine_rule_snapshot(NEW.id)
+            );
+        END IF;
+    ELSE
+        -- BEFORE DELETE, while the versions still exist
+        v_before := ruleengine_rule_snapshot(OLD.id);
+        INSERT INTO rule_change_audit (rule_name, action, actor, version_before, before)
+        VALUES (OLD.name, 'delete', ruleengine_audit_actor(), v_before->>'version', v_before);
+        RETURN OLD;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- BEFORE triggers run in name order, so this sees the previous default
+-- version before trigger_single_default_version clears it
+CREATE OR REPLACE FUNCTION ruleengine_audit_version() RETURNS TRIGGER AS $$
+DECLARE
+    v_name TEXT;
+    v_before JSONB;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        SELECT name INTO v_name FROM rule_definitions WHERE id = OLD.rule_id;
+        -- Versions removed by deleting the whole rule are covered by 'delete'
+        IF v_name IS NOT NULL THEN
+            INSERT INTO rule_change_audit (rule_name, action, actor, version_before, before)
+            VALUES (v_name, 'delete_version', ruleengine_audit_actor(), OLD.version,
+                    jsonb_build_object('version', OLD.version, 'grl', OLD.grl_content));
+        END IF;
+        RETURN OLD;
+    END IF;
+
+    SELECT name INTO v_name FROM rule_definitions WHERE id = NEW.rule_id;
+
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO rule_change_audit (rule_name, action, actor, version_after, after)
+        VALUES (v_name, 'save_version', ruleengine_audit_actor(), NEW.version,
+                jsonb_build_object('version', NEW.version, 'grl', NEW.grl_content,
+                                   'change_notes', NEW.change_notes));
+    END IF;
+
+    IF NEW.is_default AND (TG_OP = 'INSERT' OR NOT OLD.is_default) THEN
+        v_before := ruleengine_rule_snapshot(NEW.rule_id);
+        INSERT INTO rule_change_audit (rule_name, action, actor, version_before, version_after, before, after)
+        VALUES (
+            v_name, 'activate', ruleengine_audit_actor(),
+            v_before->>'version', NEW.version, v_before,
+            v_before || jsonb_build_object('version', NEW.version, 'grl', NEW.grl_content)
+        );
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS ruleengine_audit ON rule_definitions;
+CREATE TRIGGER ruleengine_audit
+    AFTER INSERT OR UPDATE ON rule_definitions
+    FOR EACH ROW EXECUTE FUNCTION ruleengine_audit_rule();
+
+DROP TRIGGER IF EXISTS ruleengine_audit_delete ON rule_definitions;
+CREATE TRIGGER ruleengine_audit_delete
+    BEFORE DELETE ON rule_definitions
+    FOR EACH ROW EXECUTE FUNCTION ruleengine_audit_rule();
+
+DROP TRIGGER IF EXISTS ruleengine_audit ON rule_versions;
+CREATE TRIGGER ruleengine_audit
+    BEFORE INSERT OR UPDATE OF is_default OR DELETE ON rule_versions
+    FOR EACH ROW EXECUTE FUNCTION ruleengine_audit_version();
@@ -0,0 +1,92 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	_ "github.com/lib/pq"
+)
+
+// testDB connects to RULETEST_DATABASE_URL, a database with the
+// rule engine extension installed, or skips the test
+func testDB(t *testing.T) *Client {
+	t.Helper()
+	url := os.Getenv("RULETEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("RULETEST_DATABASE_URL is not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return New(db)
+}
+
+func TestListAuditLogFilter(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		args   []driver.Value
+	}{
+		{"defaults", AuditFilter{}, []driver.Value{"", "", "", nil, nil, 100}},
+		{"capped limit", AuditFilter{Limit: 5000}, []driver.Value{"", "", "", nil, nil, 1000}},
+		{"all fields", AuditFilter{Rule: "A", Actor: "ci", Action: "update", Since: since, Limit: 10},
+			[]driver.Value{"A", "ci", "update", since, nil, 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			mock.ExpectQuery(`FROM rule_change_audit`).WithArgs(tt.args...).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "rule_name", "action", "actor", "db_user", "changed_at",
+					"version_before", "version_after", "before", "after"}).
+					AddRow(1, "A", "update", "ci", "app", since, "1.0.0", "1.0.1", []byte(`{"v":1}`), nil))
+
+			entries, err := client.ListAuditLog(context.Background(), tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || string(entries[0].Before) != `{"v":1}` || entries[0].After != nil {
+				t.Fatalf("entries = %+v", entries)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestAuditLogRecordsActor(t *testing.T) {
+	client := testDB(t)
+	ctx := WithActor(context.Background(), "audit-test")
+	if err := client.InstallAuditLog(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	name := "AuditTest" + time.Now().Format("150405")
+	if _, err := client.CreateRule(ctx, SaveRuleInput{Name: name, GRL: `rule ` + name + ` "" { when true then Retract("` + name + `"); }`}); err != nil {
+		t.Fatal(err)
+	}
+	defer client.DeleteRule(context.Background(), name, "")
+	if err := client.DisableRule(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := client.ListAuditLog(context.Background(), AuditFilter{Rule: name, Actor: "audit-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := map[string]bool{}
+	for _, e := range entries {
+		actions[e.Action] = true
+	}
+	if !actions["create"] || !actions["disable"] {
+		t.Fatalf("audit actions = %v, want create and disable", actions)
+	}
+}
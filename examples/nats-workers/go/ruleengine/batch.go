@@ -0,0 +1,116 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// batchChunkSize bounds how many documents are sent in one statement
+const batchChunkSize = 1000
+
+// BatchResult is the outcome for one document of EvaluateBatch, at the
+// same index as its input
+type BatchResult struct {
+	Facts map[string]interface{} `json:"facts,omitempty"`
+	Err   error                  `json:"-"`
+}
+
+// EvaluateBatch runs a rule set against many fact documents, sending up to
+// 1000 documents per statement via ruleset_execute instead of one round
+// trip each. Unlike Evaluate it returns only the final facts (no matched
+// rules, actions, or trace).
+//
+// If a statement fails, its documents are retried one by one so a single
+// bad document is reported in its BatchResult.Err without failing the rest.
+// The returned error is only set when the batch as a whole cannot run.
+func (c *Client) EvaluateBatch(ctx context.Context, rulesetID int, facts []interface{}) ([]BatchResult, error) {
+	docs := make([]json.RawMessage, len(facts))
+	for i, f := range facts {
+		b, err := json.Marshal(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode facts[%d]: %w", i, err)
+		}
+		docs[i] = b
+	}
+
+	var active bool
+	err := c.db.QueryRowContext(ctx,
+		"SELECT is_active FROM rule_sets WHERE ruleset_id = $1", rulesetID,
+	).Scan(&active)
+	if err == sql.ErrNoRows || (err == nil && !active) {
+		return nil, fmt.Errorf("rule set %d: %w", rulesetID, ErrRuleSetNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(docs))
+	for start := 0; start < len(docs); start += batchChunkSize {
+		end := start + batchChunkSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+
+		err := c.evaluateChunk(ctx, rulesetID, docs[start:end], results[start:end])
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		for i := start; i < end; i++ {
+			results[i] = c.evaluateOne(ctx, rulesetID, docs[i])
+		}
+	}
+	return results, nil
+}
+
+// evaluateChunk evaluates docs in a single statement, unnesting them from
+// one JSON array parameter so any driver can bind it
+func (c *Client) evaluateChunk(ctx context.Context, rulesetID int, docs []json.RawMessage, results []BatchResult) error {
+	array, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT t.ord, ruleset_execute($1, t.doc::TEXT)
+		 FROM jsonb_array_elements($2::JSONB) WITH ORDINALITY AS t(doc, ord)
+		 ORDER BY t.ord`,
+		rulesetID, string(array),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ord int
+		var output string
+		if err := rows.Scan(&ord, &output); err != nil {
+			return err
+		}
+		results[ord-1] = decodeBatchFacts(output)
+	}
+	return rows.Err()
+}
+
+func (c *Client) evaluateOne(ctx context.Context, rulesetID int, doc json.RawMessage) BatchResult {
+	var output string
+	if err := c.db.QueryRowContext(ctx,
+		"SELECT ruleset_execute($1, $2)", rulesetID, string(doc),
+	).Scan(&output); err != nil {
+		return BatchResult{Err: err}
+	}
+	return decodeBatchFacts(output)
+}
+
+func decodeBatchFacts(output string) BatchResult {
+	var r BatchResult
+	if err := json.Unmarshal([]byte(output), &r.Facts); err != nil {
+		r.Err = fmt.Errorf("engine returned invalid facts: %w", err)
+	}
+	return r
+}
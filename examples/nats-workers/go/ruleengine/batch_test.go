@@ -0,0 +1,108 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestEvaluateBatch(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectQuery(`SELECT is_active FROM rule_sets`).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(true))
+	// Rows may come back in any order; ord puts them at their input index
+	mock.ExpectQuery(`jsonb_array_elements\(\$2::JSONB\) WITH ORDINALITY`).
+		WithArgs(3, `[{"n":1},{"n":2}]`).
+		WillReturnRows(sqlmock.NewRows([]string{"ord", "ruleset_execute"}).
+			AddRow(2, `{"n":2,"ok":true}`).AddRow(1, `{"n":1,"ok":false}`))
+
+	results, err := client.EvaluateBatch(context.Background(), 3, []interface{}{
+		map[string]interface{}{"n": 1}, map[string]interface{}{"n": 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Facts["ok"] != false || results[1].Facts["ok"] != true {
+		t.Fatalf("results = %+v", results)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvaluateBatchRetriesChunkOneByOne(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectQuery(`SELECT is_active FROM rule_sets`).
+		WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(true))
+	mock.ExpectQuery(`WITH ORDINALITY`).WillReturnError(errors.New("pq: bad fact"))
+	mock.ExpectQuery(`SELECT ruleset_execute\(\$1, \$2\)`).WithArgs(3, `{"n":1}`).
+		WillReturnRows(sqlmock.NewRows([]string{"ruleset_execute"}).AddRow(`{"n":1}`))
+	mock.ExpectQuery(`SELECT ruleset_execute\(\$1, \$2\)`).WithArgs(3, `{"n":"x"}`).
+		WillReturnError(errors.New("pq: bad fact"))
+
+	results, err := client.EvaluateBatch(context.Background(), 3, []interface{}{
+		map[string]interface{}{"n": 1}, map[string]interface{}{"n": "x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil || results[0].Facts["n"] != 1.0 {
+		t.Fatalf("good document = %+v", results[0])
+	}
+	if results[1].Err == nil {
+		t.Fatal("bad document has no error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvaluateBatchErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		facts  []interface{}
+		active interface{} // nil: rule set missing
+		want   error
+	}{
+		{name: "missing rule set", facts: []interface{}{1}, want: ErrRuleSetNotFound},
+		{name: "inactive rule set", facts: []interface{}{1}, active: false, want: ErrRuleSetNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			rows := sqlmock.NewRows([]string{"is_active"})
+			if tt.active != nil {
+				rows.AddRow(tt.active)
+			}
+			mock.ExpectQuery(`SELECT is_active FROM rule_sets`).WillReturnRows(rows)
+			if _, err := client.EvaluateBatch(context.Background(), 1, tt.facts); !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	client, _ := newMock(t)
+	if _, err := client.EvaluateBatch(context.Background(), 1, []interface{}{make(chan int)}); err == nil {
+		t.Fatal("unencodable facts were accepted")
+	}
+}
+
+func TestDecodeBatchFacts(t *testing.T) {
+	tests := []struct {
+		output  string
+		wantErr bool
+	}{
+		{`{"a":1}`, false},
+		{`{}`, false},
+		{`not json`, true},
+		{`[1,2]`, true},
+	}
+	for _, tt := range tests {
+		r := decodeBatchFacts(tt.output)
+		if (r.Err != nil) != tt.wantErr {
+			t.Errorf("decodeBatchFacts(%q) err = %v, wantErr %v", tt.output, r.Err, tt.wantErr)
+		}
+	}
+}
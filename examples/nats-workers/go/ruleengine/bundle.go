@@ -0,0 +1,452 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BundleVersion identifies the bundle document format
+const BundleVersion = "ruleengine/v1"
+
+// Bundle is a portable rule set: its rules (with the versions it uses),
+// membership, and optionally the webhook destinations its actions call
+type Bundle struct {
+	APIVersion   string                   `json:"api_version" yaml:"api_version"`
+	ExportedAt   time.Time                `json:"exported_at" yaml:"exported_at"`
+	RuleSet      BundleRuleSet            `json:"ruleset" yaml:"ruleset"`
+	Rules        []BundleRule             `json:"rules" yaml:"rules"`
+	Destinations []map[string]interface{} `json:"destinations,omitempty" yaml:"destinations,omitempty"`
+}
+
+// BundleRuleSet is the rule set part of a bundle
+type BundleRuleSet struct {
+	Name        string          `json:"name" yaml:"name"`
+	Description string          `json:"description,omitempty" yaml:"description,omitempty"`
+	IsActive    bool            `json:"is_active" yaml:"is_active"`
+	Members     []RuleSetMember `json:"members" yaml:"members"`
+}
+
+// BundleRule is a rule with the versions referenced by the rule set and
+// the version that was active when exported
+type BundleRule struct {
+	Name          string              `json:"name" yaml:"name"`
+	Description   string              `json:"description,omitempty" yaml:"description,omitempty"`
+	ActiveVersion string              `json:"active_version" yaml:"active_version"`
+	Versions      []BundleRuleVersion `json:"versions" yaml:"versions"`
+}
+
+// BundleRuleVersion is one exported rule version
+type BundleRuleVersion struct {
+	Version     string `json:"version" yaml:"version"`
+	ChangeNotes string `json:"change_notes,omitempty" yaml:"change_notes,omitempty"`
+	GRL         string `json:"grl" yaml:"grl"`
+}
+
+// ExportOptions selects what ExportRuleSet includes besides the rules
+type ExportOptions struct {
+	// Destinations are rule_webhooks names to include. Headers are exported
+	// verbatim; secrets in rule_webhook_secrets are never exported.
+	Destinations []string
+}
+
+// ExportRuleSet builds a bundle for a rule set
+func (c *Client) ExportRuleSet(ctx context.Context, id int, opts ExportOptions) (*Bundle, error) {
+	rs, err := c.GetRuleSet(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bundle{
+		APIVersion: BundleVersion,
+		ExportedAt: time.Now().UTC(),
+		RuleSet: BundleRuleSet{
+			Name:        rs.Name,
+			Description: rs.Description,
+			IsActive:    rs.IsActive,
+			Members:     rs.Members,
+		},
+	}
+
+	// Export each rule's active version plus any pinned versions
+	wanted := map[string]map[string]bool{}
+	var names []string
+	for _, m := range rs.Members {
+		if wanted[m.Rule] == nil {
+			wanted[m.Rule] = map[string]bool{}
+			names = append(names, m.Rule)
+		}
+		if m.Version != "" {
+			wanted[m.Rule][m.Version] = true
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rule, err := c.GetRule(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		wanted[name][rule.ActiveVersion] = true
+
+		br := BundleRule{Name: name, Description: rule.Description, ActiveVersion: rule.ActiveVersion}
+		versions := make([]string, 0, len(wanted[name]))
+		for v := range wanted[name] {
+			versions = append(versions, v)
+		}
+		sort.Strings(versions)
+		for _, version := range versions {
+			v, err := c.GetVersion(ctx, name, version)
+			if err != nil {
+				return nil, err
+			}
+			br.Versions = append(br.Versions, BundleRuleVersion{Version: version, ChangeNotes: v.ChangeNotes, GRL: v.GRL})
+		}
+		b.Rules = append(b.Rules, br)
+	}
+
+	for _, name := range opts.Destinations {
+		var raw []byte
+		err := c.db.QueryRowContext(ctx,
+			`SELECT to_jsonb(w) - 'webhook_id' - 'created_at' - 'updated_at' - 'created_by' - 'nats_config_id'
+			 FROM rule_webhooks w WHERE webhook_name = $1`,
+			name,
+		).Scan(&raw)
+		if err == sql.ErrNoRows {
+			return nil, &ValidationError{Field: "destinations", Message: fmt.Sprintf("unknown webhook %q", name)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		var dest map[string]interface{}
+		if err := json.Unmarshal(raw, &dest); err != nil {
+			return nil, err
+		}
+		b.Destinations = append(b.Destinations, dest)
+	}
+	return b, nil
+}
+
+// ConflictStrategy decides what ImportBundle does with names that already
+// exist in the target database
+type ConflictStrategy string
+
+const (
+	// ConflictSkip keeps the existing object and ignores the bundle's
+	ConflictSkip ConflictStrategy = "skip"
+	// ConflictOverwrite makes the existing object match the bundle. Rule
+	// versions are immutable, so a version that exists with different GRL
+	// is an error.
+	ConflictOverwrite ConflictStrategy = "overwrite"
+	// ConflictRename imports the bundle's object under name + RenameSuffix
+	ConflictRename ConflictStrategy = "rename"
+)
+
+// ImportOptions configures ImportBundle
+type ImportOptions struct {
+	Strategy     ConflictStrategy // Default ConflictSkip
+	RenameSuffix string           // Default "_imported"
+}
+
+// ImportReport lists what ImportBundle did with each object, keyed by the
+// name in the bundle. Values are "created", "skipped", "overwritten", or
+// "renamed to <name>".
+type ImportReport struct {
+	RuleSetID    int               `json:"ruleset_id"`
+	RuleSet      string            `json:"ruleset"`
+	Rules        map[string]string `json:"rules"`
+	Destinations map[string]string `json:"destinations,omitempty"`
+}
+
+// ImportBundle applies a bundle in a single transaction: either everything
+// is imported or nothing is.
+func (c *Client) ImportBundle(ctx context.Context, b *Bundle, opts ImportOptions) (*ImportReport, error) {
+	if b.APIVersion != BundleVersion {
+		return nil, &ValidationError{Field: "api_version", Message: fmt.Sprintf("unsupported bundle version %q", b.APIVersion)}
+	}
+	if opts.Strategy == "" {
+		opts.Strategy = ConflictSkip
+	}
+	switch opts.Strategy {
+	case ConflictSkip, ConflictOverwrite, ConflictRename:
+	default:
+		return nil, &ValidationError{Field: "strategy", Message: "must be skip, overwrite, or rename"}
+	}
+	if opts.RenameSuffix == "" {
+		opts.RenameSuffix = "_imported"
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	report := &ImportReport{Rules: map[string]string{}, Destinations: map[string]string{}}
+
+	for _, dest := range b.Destinations {
+		name, _ := dest["webhook_name"].(string)
+		outcome, err := importDestination(ctx, tx, dest, opts)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: %w", name, err)
+		}
+		report.Destinations[name] = outcome
+	}
+
+	// Bundle rule name -> name in the target database
+	renamed := map[string]string{}
+	for _, rule := range b.Rules {
+		target, outcome, err := importRule(ctx, tx, rule, opts)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		renamed[rule.Name] = target
+		report.Rules[rule.Name] = outcome
+	}
+
+	if err := importRuleSet(ctx, tx, b.RuleSet, renamed, opts, report); err != nil {
+		return nil, fmt.Errorf("rule set %s: %w", b.RuleSet.Name, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func importRule(ctx context.Context, tx *sql.Tx, rule BundleRule, opts ImportOptions) (string, string, error) {
+	if err := validateRuleName(rule.Name); err != nil {
+		return "", "", err
+	}
+	if len(rule.Versions) == 0 {
+		return "", "", &ValidationError{Field: "versions", Message: "at least one version is required"}
+	}
+
+	target := rule.Name
+	outcome := "created"
+	exists, err := ruleExists(ctx, tx, rule.Name)
+	if err != nil {
+		return "", "", err
+	}
+	if exists {
+		switch opts.Strategy {
+		case ConflictSkip:
+			return rule.Name, "skipped", nil
+		case ConflictOverwrite:
+			outcome = "overwritten"
+		case ConflictRename:
+			target = rule.Name + opts.RenameSuffix
+			if taken, err := ruleExists(ctx, tx, target); err != nil {
+				return "", "", err
+			} else if taken {
+				return "", "", fmt.Errorf("%s: %w", target, ErrRuleExists)
+			}
+			outcome = "renamed to " + target
+		}
+	}
+
+	for _, v := range rule.Versions {
+		if err := validateVersion("version", v.Version); err != nil {
+			return "", "", err
+		}
+		if err := validateGRL(v.GRL); err != nil {
+			return "", "", err
+		}
+
+		var existing sql.NullString
+		err := tx.QueryRowContext(ctx,
+			`SELECT rv.grl_content FROM rule_versions rv
+			 JOIN rule_definitions rd ON rv.rule_id = rd.id
+			 WHERE rd.name = $1 AND rv.version = $2`,
+			target, v.Version,
+		).Scan(&existing)
+		if err != nil && err != sql.ErrNoRows {
+			return "", "", err
+		}
+		if existing.Valid {
+			if existing.String != v.GRL {
+				return "", "", fmt.Errorf("version %s already exists with different GRL", v.Version)
+			}
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx,
+			"SELECT rule_save($1, $2, $3, $4, $5)",
+			target, v.GRL, v.Version, nullString(rule.Description), nullString(v.ChangeNotes),
+		); err != nil {
+			return "", "", err
+		}
+	}
+
+	if rule.ActiveVersion != "" {
+		if _, err := tx.ExecContext(ctx, "SELECT rule_activate($1, $2)", target, rule.ActiveVersion); err != nil {
+			return "", "", err
+		}
+	}
+	return target, outcome, nil
+}
+
+func ruleExists(ctx context.Context, tx *sql.Tx, name string) (bool, error) {
+	var exists bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM rule_definitions WHERE name = $1)", name,
+	).Scan(&exists)
+	return exists, err
+}
+
+func importRuleSet(ctx context.Context, tx *sql.Tx, rs BundleRuleSet, renamed map[string]string, opts ImportOptions, report *ImportReport) error {
+	if strings.TrimSpace(rs.Name) == "" {
+		return &ValidationError{Field: "ruleset.name", Message: "must not be empty"}
+	}
+
+	var id int
+	err := tx.QueryRowContext(ctx, "SELECT ruleset_id FROM rule_sets WHERE name = $1", rs.Name).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	name := rs.Name
+	report.RuleSet = "created"
+	if err == nil {
+		switch opts.Strategy {
+		case ConflictSkip:
+			report.RuleSetID = id
+			report.RuleSet = "skipped"
+			return nil
+		case ConflictOverwrite:
+			if _, err := tx.ExecContext(ctx,
+				"UPDATE rule_sets SET description = $2, is_active = $3 WHERE ruleset_id = $1",
+				id, nullString(rs.Description), rs.IsActive,
+			); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM rule_set_members WHERE ruleset_id = $1", id); err != nil {
+				return err
+			}
+			report.RuleSet = "overwritten"
+		case ConflictRename:
+			name = rs.Name + opts.RenameSuffix
+			report.RuleSet = "renamed to " + name
+			err = sql.ErrNoRows
+		}
+	}
+
+	if err == sql.ErrNoRows {
+		if err := tx.QueryRowContext(ctx,
+			"SELECT ruleset_create($1, $2)", name, nullString(rs.Description),
+		).Scan(&id); err != nil {
+			return err
+		}
+		if !rs.IsActive {
+			if _, err := tx.ExecContext(ctx, "UPDATE rule_sets SET is_active = false WHERE ruleset_id = $1", id); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, m := range rs.Members {
+		rule := m.Rule
+		if target, ok := renamed[rule]; ok {
+			rule = target
+		}
+		if _, err := tx.ExecContext(ctx,
+			"SELECT ruleset_add_rule($1, $2, $3, $4)",
+			id, rule, nullString(m.Version), m.Order,
+		); err != nil {
+			return err
+		}
+	}
+	report.RuleSetID = id
+	return nil
+}
+
+func importDestination(ctx context.Context, tx *sql.Tx, dest map[string]interface{}, opts ImportOptions) (string, error) {
+	name, _ := dest["webhook_name"].(string)
+	if name == "" {
+		return "", &ValidationError{Field: "destinations", Message: "webhook_name is required"}
+	}
+
+	// Only copy columns that exist here; the source may have had extra
+	// (or fewer) optional columns
+	rows, err := tx.QueryContext(ctx,
+		`SELECT column_name FROM information_schema.columns
+		 WHERE table_name = 'rule_webhooks' AND table_schema = current_schema()
+		   AND column_name NOT IN ('webhook_id', 'created_at', 'updated_at', 'created_by', 'nats_config_id')`,
+	)
+	if err != nil {
+		return "", err
+	}
+	var columns []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			rows.Close()
+			return "", err
+		}
+		if _, ok := dest[col]; ok {
+			columns = append(columns, `"`+strings.ReplaceAll(col, `"`, `""`)+`"`)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM rule_webhooks WHERE webhook_name = $1)", name,
+	).Scan(&exists); err != nil {
+		return "", err
+	}
+
+	outcome := "created"
+	if exists {
+		switch opts.Strategy {
+		case ConflictSkip:
+			return "skipped", nil
+		case ConflictRename:
+			renamed := make(map[string]interface{}, len(dest))
+			for k, v := range dest {
+				renamed[k] = v
+			}
+			renamed["webhook_name"] = name + opts.RenameSuffix
+			dest = renamed
+			outcome = "renamed to " + name + opts.RenameSuffix
+		case ConflictOverwrite:
+			data, err := json.Marshal(dest)
+			if err != nil {
+				return "", err
+			}
+			cols := strings.Join(columns, ", ")
+			_, err = tx.ExecContext(ctx,
+				`UPDATE rule_webhooks SET (`+cols+`) =
+				   (SELECT `+cols+` FROM jsonb_populate_record(NULL::rule_webhooks, $1::JSONB)),
+				   updated_at = CURRENT_TIMESTAMP
+				 WHERE webhook_name = $2`,
+				string(data), name,
+			)
+			if err != nil {
+				return "", err
+			}
+			return "overwritten", nil
+		}
+	}
+
+	data, err := json.Marshal(dest)
+	if err != nil {
+		return "", err
+	}
+	cols := strings.Join(columns, ", ")
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO rule_webhooks (`+cols+`)
+		 SELECT `+cols+` FROM jsonb_populate_record(NULL::rule_webhooks, $1::JSONB)`,
+		string(data),
+	); err != nil {
+		return "", err
+	}
+	return outcome, nil
+}
@@ -0,0 +1,196 @@
+package ruleengine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"gopkg.in/yaml.v3"
+)
+
+func testBundle() *Bundle {
+	return &Bundle{
+		APIVersion: BundleVersion,
+		ExportedAt: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		RuleSet: BundleRuleSet{
+			Name:     "orders",
+			IsActive: true,
+			Members:  []RuleSetMember{{Rule: "HighValue", Order: 1}},
+		},
+		Rules: []BundleRule{{
+			Name:          "HighValue",
+			ActiveVersion: "1.0.0",
+			Versions:      []BundleRuleVersion{{Version: "1.0.0", GRL: "rule HighValue {}"}},
+		}},
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	b := testBundle()
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON Bundle
+	if err := json.Unmarshal(data, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*b, fromJSON) {
+		t.Fatalf("JSON round trip = %+v", fromJSON)
+	}
+
+	data, err = yaml.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromYAML Bundle
+	if err := yaml.Unmarshal(data, &fromYAML); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*b, fromYAML) {
+		t.Fatalf("YAML round trip = %+v", fromYAML)
+	}
+}
+
+func TestImportBundleValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(*Bundle)
+		opts  ImportOptions
+		field string
+	}{
+		{name: "api version", edit: func(b *Bundle) { b.APIVersion = "v0" }, field: "api_version"},
+		{name: "strategy", opts: ImportOptions{Strategy: "merge"}, field: "strategy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newMock(t)
+			b := testBundle()
+			if tt.edit != nil {
+				tt.edit(b)
+			}
+			_, err := client.ImportBundle(context.Background(), b, tt.opts)
+			var validation *ValidationError
+			if !errors.As(err, &validation) || validation.Field != tt.field {
+				t.Fatalf("err = %v, want a validation error on %s", err, tt.field)
+			}
+		})
+	}
+}
+
+// newOrderedMock is newMock with expectations met in order, for
+// transactions that repeat the same statements
+func newOrderedMock(t *testing.T) (*Client, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return New(db), mock
+}
+
+func TestImportBundle(t *testing.T) {
+	exists := func(v bool) *sqlmock.Rows { return sqlmock.NewRows([]string{"exists"}).AddRow(v) }
+	tests := []struct {
+		name     string
+		strategy ConflictStrategy
+		expect   func(sqlmock.Sqlmock)
+		rule     string
+		ruleSet  string
+		wantErr  string
+	}{
+		{
+			name: "new",
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(`SELECT EXISTS`).WithArgs("HighValue").WillReturnRows(exists(false))
+				m.ExpectQuery(`SELECT rv.grl_content`).WillReturnRows(sqlmock.NewRows([]string{"grl_content"}))
+				m.ExpectExec(`rule_save`).WithArgs("HighValue", "rule HighValue {}", "1.0.0", nil, nil).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec(`rule_activate`).WithArgs("HighValue", "1.0.0").WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectQuery(`SELECT ruleset_id FROM rule_sets`).WillReturnRows(sqlmock.NewRows([]string{"ruleset_id"}))
+				m.ExpectQuery(`ruleset_create`).WithArgs("orders", nil).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+				m.ExpectExec(`ruleset_add_rule`).WithArgs(4, "HighValue", nil, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectCommit()
+			},
+			rule: "created", ruleSet: "created",
+		},
+		{
+			name:     "skip existing",
+			strategy: ConflictSkip,
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(`SELECT EXISTS`).WillReturnRows(exists(true))
+				m.ExpectQuery(`SELECT ruleset_id FROM rule_sets`).WillReturnRows(sqlmock.NewRows([]string{"ruleset_id"}).AddRow(2))
+				m.ExpectCommit()
+			},
+			rule: "skipped", ruleSet: "skipped",
+		},
+		{
+			name:     "rename existing",
+			strategy: ConflictRename,
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(`SELECT EXISTS`).WithArgs("HighValue").WillReturnRows(exists(true))
+				m.ExpectQuery(`SELECT EXISTS`).WithArgs("HighValue_imported").WillReturnRows(exists(false))
+				m.ExpectQuery(`SELECT rv.grl_content`).WillReturnRows(sqlmock.NewRows([]string{"grl_content"}))
+				m.ExpectExec(`rule_save`).WithArgs("HighValue_imported", sqlmock.AnyArg(), "1.0.0", nil, nil).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec(`rule_activate`).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectQuery(`SELECT ruleset_id FROM rule_sets`).WillReturnRows(sqlmock.NewRows([]string{"ruleset_id"}).AddRow(2))
+				m.ExpectQuery(`ruleset_create`).WithArgs("orders_imported", nil).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+				m.ExpectExec(`ruleset_add_rule`).WithArgs(5, "HighValue_imported", nil, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectCommit()
+			},
+			rule: "renamed to HighValue_imported", ruleSet: "renamed to orders_imported",
+		},
+		{
+			name:     "overwrite with identical version",
+			strategy: ConflictOverwrite,
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(`SELECT EXISTS`).WillReturnRows(exists(true))
+				m.ExpectQuery(`SELECT rv.grl_content`).WillReturnRows(sqlmock.NewRows([]string{"grl_content"}).AddRow("rule HighValue {}"))
+				m.ExpectExec(`rule_activate`).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectQuery(`SELECT ruleset_id FROM rule_sets`).WillReturnRows(sqlmock.NewRows([]string{"ruleset_id"}).AddRow(2))
+				m.ExpectExec(`UPDATE rule_sets SET description`).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectExec(`DELETE FROM rule_set_members`).WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 3))
+				m.ExpectExec(`ruleset_add_rule`).WithArgs(2, "HighValue", nil, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectCommit()
+			},
+			rule: "overwritten", ruleSet: "overwritten",
+		},
+		{
+			name:     "overwrite with changed version",
+			strategy: ConflictOverwrite,
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(`SELECT EXISTS`).WillReturnRows(exists(true))
+				m.ExpectQuery(`SELECT rv.grl_content`).WillReturnRows(sqlmock.NewRows([]string{"grl_content"}).AddRow("rule HighValue { changed }"))
+				m.ExpectRollback()
+			},
+			wantErr: "already exists with different GRL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newOrderedMock(t)
+			mock.ExpectBegin()
+			tt.expect(mock)
+
+			report, err := client.ImportBundle(context.Background(), testBundle(), ImportOptions{Strategy: tt.strategy})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if report.Rules["HighValue"] != tt.rule || report.RuleSet != tt.ruleSet {
+				t.Fatalf("report = %+v", report)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package ruleengine
+
+import (
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// changeChannel is the NOTIFY channel written by the triggers in notify.sql
+const changeChannel = "rule_engine_rule_changes"
+
+//go:embed notify.sql
+var notifySQL string
+
+// CacheOptions configures the client-side rule cache
+type CacheOptions struct {
+	// DatabaseURL is used for a dedicated LISTEN connection (lib/pq)
+	DatabaseURL string
+
+	// LocalEvaluation evaluates rule sets whose rules are all simple
+	// predicates (field-vs-literal comparisons and literal assignments) in
+	// Go, without a Postgres round trip. Other rule sets still run in the
+	// extension.
+	LocalEvaluation bool
+
+	// ResultCacheSize caches up to this many evaluation results in memory,
+	// for high-QPS evaluation of repeating facts. Results are keyed by a
+	// fingerprint of the rule set's members and their GRL plus a hash of
+	// the facts, so any rule or rule set change invalidates them. 0
+	// disables result caching unless ResultStore is set.
+	ResultCacheSize int
+
+	// ResultTTL bounds how long a result is served; 0 keeps it until the
+	// rules change or it is evicted
+	ResultTTL time.Duration
+
+	// ResultStore replaces the in-memory result store, e.g. with Redis
+	ResultStore ResultStore
+
+	// ResultKey derives the cache key material from the facts JSON, e.g.
+	// to ignore a request timestamp; returning false skips the cache.
+	// Default: the whole document.
+	ResultKey func(facts []byte) ([]byte, bool)
+}
+
+// ruleKey identifies a cached GRL document; an empty version is the rule's
+// active version
+type ruleKey struct {
+	name    string
+	version string
+}
+
+type cachedRule struct {
+	grl   string
+	sum   [sha256.Size]byte // of grl, for result cache keys
+	local []localRule       // nil unless LocalEvaluation and the GRL is simple
+}
+
+// ruleCache holds rule set members and GRL until a change notification (or
+// a listener reconnect, which may have missed some) invalidates them
+type ruleCache struct {
+	mu       sync.RWMutex
+	gen      uint64 // bumped on every invalidation
+	rulesets map[int][]ruleSetMember
+	rules    map[ruleKey]cachedRule
+	local    bool
+	listener *pq.Listener
+	stop     chan struct{}
+}
+
+// InstallChangeNotifications creates the triggers that notify caches of
+// rule and rule set changes. It is idempotent; run it once per database
+// (it needs permission to create triggers on the repository tables).
+func (c *Client) InstallChangeNotifications(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, notifySQL); err != nil {
+		return fmt.Errorf("failed to install change notifications: %w", err)
+	}
+	return nil
+}
+
+// EnableCache caches rule set members and rule definitions in memory,
+// invalidated via LISTEN on rule changes. Requires
+// InstallChangeNotifications to have been run against the database. Call it
+// before sharing the client between goroutines.
+func (c *Client) EnableCache(ctx context.Context, opts CacheOptions) error {
+	if c.cache != nil {
+		return fmt.Errorf("cache already enabled")
+	}
+
+	cache := &ruleCache{
+		rulesets: make(map[int][]ruleSetMember),
+		rules:    make(map[ruleKey]cachedRule),
+		local:    opts.LocalEvaluation,
+		stop:     make(chan struct{}),
+	}
+	cache.listener = pq.NewListener(opts.DatabaseURL, time.Second, time.Minute, nil)
+	if err := cache.listener.Listen(changeChannel); err != nil {
+		cache.listener.Close()
+		return fmt.Errorf("failed to LISTEN on %s: %w", changeChannel, err)
+	}
+
+	go cache.run()
+	c.cache = cache
+	if opts.ResultCacheSize > 0 || opts.ResultStore != nil {
+		c.results = newResultCache(opts)
+	}
+	return nil
+}
+
+// Close stops the cache listener, if any, and writes buffered rule
+// statistics. It does not close the database handle passed to New.
+func (c *Client) Close() error {
+	var err error
+	if c.hits != nil {
+		err = c.hits.close()
+		c.hits = nil
+	}
+	if c.cache == nil {
+		return err
+	}
+	close(c.cache.stop)
+	if closeErr := c.cache.listener.Close(); err == nil {
+		err = closeErr
+	}
+	c.cache, c.results = nil, nil
+	return err
+}
+
+func (rc *ruleCache) run() {
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-rc.stop:
+			return
+		case n := <-rc.listener.Notify:
+			if n == nil {
+				rc.flush()
+			} else {
+				rc.invalidate(n.Extra)
+			}
+		case <-ping.C:
+			go rc.listener.Ping()
+		}
+	}
+}
+
+func (rc *ruleCache) flush() {
+	rc.mu.Lock()
+	rc.gen++
+	rc.rulesets = make(map[int][]ruleSetMember)
+	rc.rules = make(map[ruleKey]cachedRule)
+	rc.mu.Unlock()
+}
+
+func (rc *ruleCache) invalidate(payload string) {
+	kind, value, _ := strings.Cut(payload, ":")
+	switch {
+	case kind == "ruleset":
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			rc.flush()
+			return
+		}
+		rc.mu.Lock()
+		rc.gen++
+		delete(rc.rulesets, id)
+		rc.mu.Unlock()
+	case kind == "rule" && value != "*":
+		rc.mu.Lock()
+		rc.gen++
+		for key := range rc.rules {
+			if key.name == value {
+				delete(rc.rules, key)
+			}
+		}
+		rc.mu.Unlock()
+	default:
+		rc.flush()
+	}
+}
+
+// generation returns the invalidation counter; values loaded from the
+// database are only stored if no invalidation happened since
+func (rc *ruleCache) generation() uint64 {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	return rc.gen
+}
+
+func (rc *ruleCache) members(id int) ([]ruleSetMember, bool) {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	m, ok := rc.rulesets[id]
+	return m, ok
+}
+
+func (rc *ruleCache) storeMembers(gen uint64, id int, members []ruleSetMember) {
+	rc.mu.Lock()
+	if rc.gen == gen {
+		rc.rulesets[id] = members
+	}
+	rc.mu.Unlock()
+}
+
+func (rc *ruleCache) rule(key ruleKey) (cachedRule, bool) {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	r, ok := rc.rules[key]
+	return r, ok
+}
+
+func (rc *ruleCache) storeRule(gen uint64, key ruleKey, grl string) {
+	entry := cachedRule{grl: grl, sum: sha256.Sum256([]byte(grl))}
+	if rc.local {
+		if rules, ok := compileLocal(grl); ok {
+			entry.local = rules
+		}
+	}
+	rc.mu.Lock()
+	if rc.gen == gen {
+		rc.rules[key] = entry
+	}
+	rc.mu.Unlock()
+}
+
+// fingerprint identifies the content of a rule set: its members and their
+// GRL. ok is false unless all of them are cached.
+func (rc *ruleCache) fingerprint(rulesetID int) (string, bool) {
+	members, ok := rc.members(rulesetID)
+	if !ok {
+		return "", false
+	}
+	h := sha256.New()
+	for _, m := range members {
+		r, ok := rc.rule(ruleKey{m.name, m.version.String})
+		if !ok {
+			return "", false
+		}
+		fmt.Fprintf(h, "%s@%s:%x\n", m.name, m.version.String, r.sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), true
+}
+
+// evaluateLocal runs a rule set in Go when its members and their GRL are
+// cached and every rule is a simple predicate. ok is false otherwise.
+func (rc *ruleCache) evaluateLocal(rulesetID int, factsJSON []byte, start time.Time) (*Result, bool) {
+	if !rc.local {
+		return nil, false
+	}
+	members, ok := rc.members(rulesetID)
+	if !ok {
+		return nil, false
+	}
+
+	compiled := make([][]localRule, 0, len(members))
+	for _, m := range members {
+		r, ok := rc.rule(ruleKey{m.name, m.version.String})
+		if !ok || r.local == nil {
+			return nil, false
+		}
+		compiled = append(compiled, r.local)
+	}
+
+	result := &Result{MatchedRules: []string{}, Actions: []Action{}, Trace: []TraceEvent{}}
+	if err := json.Unmarshal(factsJSON, &result.Facts); err != nil || result.Facts == nil {
+		return nil, false
+	}
+	result.RuleFirings = make(map[string]int, len(members))
+	for i, rules := range compiled {
+		firedBefore := len(result.MatchedRules)
+		evaluateLocal(rules, result.Facts, result)
+		result.RuleFirings[members[i].name] += len(result.MatchedRules) - firedBefore
+	}
+	result.Duration = time.Since(start)
+	return result, true
+}
@@ -0,0 +1,116 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// Capability is a feature that needs SQL functions in the database, from
+// the extension or installed by this package or a worker
+type Capability struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Functions   []string `json:"functions"`
+	// Ops is set for functions looked up in the operational database
+	// (see SetOpsDB)
+	Ops       bool     `json:"ops"`
+	Available bool     `json:"available"`
+	Missing   []string `json:"missing,omitempty"`
+}
+
+// capabilities are the features discovered by Capabilities, in report
+// order
+var capabilities = []Capability{
+	{Name: "evaluate", Description: "Rule set evaluation",
+		Functions: []string{"ruleset_get_rules", "rule_get", "run_rule_engine_debug", "debug_get_events", "debug_delete_session"}},
+	{Name: "rule_management", Description: "Creating, activating, and validating rules",
+		Functions: []string{"rule_save", "rule_activate", "rule_delete", "rule_validate"}},
+	{Name: "consumer_stats", Description: "NATS consumer statistics", Ops: true,
+		Functions: []string{"rule_nats_consumer_update_stats"}},
+	{Name: "latency_percentiles", Description: "Delivery latency histograms and percentiles", Ops: true,
+		Functions: []string{"rule_histogram_add", "rule_histogram_sum", "rule_histogram_quantile"}},
+	{Name: "delivery_rollup", Description: "Hourly and daily delivery summaries", Ops: true,
+		Functions: []string{"rule_delivery_stats_rollup"}},
+	{Name: "rule_stats", Description: "Rule hit statistics (EnableRuleStats)",
+		Functions: []string{"rule_hit_stats_add"}},
+	{Name: "windows", Description: "Windowed aggregates (EnableWindows)",
+		Functions: []string{"rule_window_record", "rule_window_facts", "rule_window_value", "rule_window_prune"}},
+	{Name: "correlations", Description: "Event correlation (EnableCorrelations)",
+		Functions: []string{"rule_correlation_record", "rule_correlation_prune"}},
+	{Name: "response_facts", Description: "Response facts (EnableResponseFacts)",
+		Functions: []string{"rule_response_facts_record", "rule_response_facts_add"}},
+	{Name: "match_views", Description: "Match views (EnableMatchViews)",
+		Functions: []string{"rule_match_view_refresh"}},
+}
+
+// Capabilities looks up the SQL functions each feature calls and reports
+// which features the databases support. The result is kept for Supports.
+func (c *Client) Capabilities(ctx context.Context) ([]Capability, error) {
+	var names []string
+	for _, capability := range capabilities {
+		names = append(names, capability.Functions...)
+	}
+	found, err := visibleFunctions(ctx, c.db, names)
+	if err != nil {
+		return nil, err
+	}
+	foundOps := found
+	if c.opsDB != nil {
+		if foundOps, err = visibleFunctions(ctx, c.opsDB, names); err != nil {
+			return nil, err
+		}
+	}
+
+	report := make([]Capability, len(capabilities))
+	supported := make(map[string]bool, len(capabilities))
+	for i, capability := range capabilities {
+		in := found
+		if capability.Ops {
+			in = foundOps
+		}
+		for _, fn := range capability.Functions {
+			if !in[fn] {
+				capability.Missing = append(capability.Missing, fn)
+			}
+		}
+		capability.Available = len(capability.Missing) == 0
+		supported[capability.Name] = capability.Available
+		report[i] = capability
+	}
+	c.supported.Store(&supported)
+	return report, nil
+}
+
+// Supports reports whether the last Capabilities call found the functions
+// of the named capability. Before any call every capability is assumed.
+func (c *Client) Supports(name string) bool {
+	supported := c.supported.Load()
+	if supported == nil {
+		return true
+	}
+	available, known := (*supported)[name]
+	return available || !known
+}
+
+// visibleFunctions returns which of names are functions on the search path
+func visibleFunctions(ctx context.Context, db *sql.DB, names []string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT DISTINCT proname FROM pg_proc WHERE proname = ANY($1) AND pg_function_is_visible(oid)`,
+		pq.Array(names),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := make(map[string]bool, len(names))
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		found[name] = true
+	}
+	return found, rows.Err()
+}
@@ -0,0 +1,129 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// functionRows is a pg_proc lookup finding names
+func functionRows(names ...string) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"proname"})
+	for _, name := range names {
+		rows.AddRow(name)
+	}
+	return rows
+}
+
+// allFunctions are the functions of every capability
+func allFunctions(except ...string) []string {
+	skip := map[string]bool{}
+	for _, name := range except {
+		skip[name] = true
+	}
+	var names []string
+	for _, c := range capabilities {
+		for _, fn := range c.Functions {
+			if !skip[fn] {
+				names = append(names, fn)
+			}
+		}
+	}
+	return names
+}
+
+func TestCapabilities(t *testing.T) {
+	const lookup = `SELECT DISTINCT proname FROM pg_proc WHERE proname = ANY\(\$1\) AND pg_function_is_visible\(oid\)`
+	tests := []struct {
+		name        string
+		primary     []string
+		ops         []string // nil for no separate operational database
+		wantMissing map[string][]string
+	}{
+		{name: "everything", primary: allFunctions(), wantMissing: map[string][]string{}},
+		{name: "old extension", primary: allFunctions("rule_hit_stats_add", "rule_window_record", "rule_window_prune"),
+			wantMissing: map[string][]string{
+				"rule_stats": {"rule_hit_stats_add"},
+				"windows":    {"rule_window_record", "rule_window_prune"},
+			}},
+		// Statistics functions are looked up in the operational database,
+		// the rest in the primary
+		{name: "separate operational database",
+			primary: allFunctions("rule_nats_consumer_update_stats", "rule_delivery_stats_rollup"),
+			ops:     []string{"rule_nats_consumer_update_stats", "rule_histogram_add", "rule_histogram_sum", "rule_histogram_quantile"},
+			wantMissing: map[string][]string{
+				"delivery_rollup": {"rule_delivery_stats_rollup"},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mock := newMock(t)
+			mock.ExpectQuery(lookup).WillReturnRows(functionRows(tt.primary...))
+			if tt.ops != nil {
+				ops, opsMock, err := sqlmock.New()
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { ops.Close() })
+				c.SetOpsDB(ops)
+				opsMock.ExpectQuery(lookup).WillReturnRows(functionRows(tt.ops...))
+			}
+
+			report, err := c.Capabilities(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report) != len(capabilities) {
+				t.Fatalf("%d capabilities reported", len(report))
+			}
+			for _, capability := range report {
+				want := tt.wantMissing[capability.Name]
+				if !reflect.DeepEqual(capability.Missing, want) || capability.Available != (want == nil) {
+					t.Errorf("%s: available %v, missing %v, want missing %v", capability.Name, capability.Available, capability.Missing, want)
+				}
+				if c.Supports(capability.Name) != capability.Available {
+					t.Errorf("Supports(%s) = %v", capability.Name, !capability.Available)
+				}
+			}
+			// The package's own table is left as it was
+			for _, capability := range capabilities {
+				if capability.Missing != nil || capability.Available {
+					t.Fatalf("capabilities changed: %+v", capability)
+				}
+			}
+		})
+	}
+}
+
+func TestCapabilitiesError(t *testing.T) {
+	c, mock := newMock(t)
+	mock.ExpectQuery(`FROM pg_proc`).WillReturnError(errors.New("permission denied for table pg_proc"))
+	if _, err := c.Capabilities(context.Background()); err == nil {
+		t.Fatal("no error")
+	}
+	// Nothing was found out, so everything is still assumed
+	if !c.Supports("windows") {
+		t.Fatal("a failed lookup disabled windows")
+	}
+}
+
+func TestSupports(t *testing.T) {
+	c, mock := newMock(t)
+	if !c.Supports("windows") || !c.Supports("no_such_capability") {
+		t.Fatal("capabilities not assumed before discovery")
+	}
+	mock.ExpectQuery(`FROM pg_proc`).WillReturnRows(functionRows())
+	if _, err := c.Capabilities(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.Supports("windows") {
+		t.Fatal("windows supported without its functions")
+	}
+	// A name this package does not know is not a feature it can rule out
+	if !c.Supports("no_such_capability") {
+		t.Fatal("unknown capability not supported")
+	}
+}
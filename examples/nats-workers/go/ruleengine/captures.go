@@ -0,0 +1,266 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// CapturedHTTP is a request or response as NATS webhook workers capture it
+// for debugging. Credentials in headers and fields matched by the scrub
+// rules are redacted.
+type CapturedHTTP struct {
+	Method  string      `json:"method,omitempty"` // requests only
+	URL     string      `json:"url,omitempty"`    // requests only
+	Status  int         `json:"status,omitempty"` // responses only
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body,omitempty"`
+	// Encoding is "base64" for a body that is not UTF-8 text
+	Encoding string `json:"encoding,omitempty"`
+	// Truncated is set when the body was longer than workers keep
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// CapturedExchange is the stored form of one captured delivery
+type CapturedExchange struct {
+	Request  CapturedHTTP  `json:"request"`
+	Response *CapturedHTTP `json:"response,omitempty"` // nil when no response arrived
+}
+
+// WebhookCapture is one delivery recorded in rule_webhook_captures while
+// capture was on for its webhook (CaptureDestination) or message
+// (CaptureMessage)
+type WebhookCapture struct {
+	ID          int64     `json:"id"`
+	CapturedAt  time.Time `json:"captured_at"`
+	WebhookID   *int      `json:"webhook_id,omitempty"` // nil for unregistered URLs
+	Destination string    `json:"destination"`
+	TraceID     string    `json:"trace_id,omitempty"`
+	MessageID   string    `json:"message_id,omitempty"` // Nats-Msg-Id
+	Subject     string    `json:"subject"`
+	Status      int       `json:"status,omitempty"`
+	DurationMs  int       `json:"duration_ms"`
+	Error       string    `json:"error,omitempty"`
+	CapturedExchange
+	Encrypted bool `json:"encrypted,omitempty"` // the exchange is still an envelope; see SetPayloadSealer
+}
+
+// CaptureFilter narrows ListCaptures. Zero values match everything.
+type CaptureFilter struct {
+	WebhookID int
+	TraceID   string
+	MessageID string
+	Since     time.Time
+	Limit     int // Default 100, at most 1000
+}
+
+// CaptureDestination makes NATS webhook workers record every request to a
+// webhook, and its response, until until; a zero until stops. Workers
+// notice within 30 seconds.
+func (c *Client) CaptureDestination(ctx context.Context, webhookID int, until time.Time) error {
+	var end *time.Time
+	if !until.IsZero() {
+		end = &until
+	}
+	res, err := c.db.ExecContext(ctx,
+		`UPDATE rule_webhooks SET capture_until = $2 WHERE webhook_id = $1`, webhookID, end,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%d: %w", webhookID, ErrWebhookNotFound)
+	}
+	return nil
+}
+
+// CaptureMessage makes NATS webhook workers record the deliveries of the
+// message with this Nats-Msg-Id or trace ID until until, including
+// redeliveries and replays; a zero until stops. Workers notice within 30
+// seconds.
+func (c *Client) CaptureMessage(ctx context.Context, id string, until time.Time) error {
+	if id == "" {
+		return &ValidationError{Field: "id", Message: "is required"}
+	}
+	if until.IsZero() {
+		_, err := c.ops().ExecContext(ctx, `DELETE FROM rule_capture_requests WHERE message_id = $1`, id)
+		return err
+	}
+	_, err := c.ops().ExecContext(ctx,
+		`INSERT INTO rule_capture_requests (message_id, expires_at) VALUES ($1, $2)
+		 ON CONFLICT (message_id) DO UPDATE SET expires_at = EXCLUDED.expires_at`,
+		id, until,
+	)
+	return err
+}
+
+// ListCaptures returns captured deliveries, newest first. Encrypted
+// exchanges are decrypted with the client's payload sealer when one is set.
+func (c *Client) ListCaptures(ctx context.Context, filter CaptureFilter) ([]WebhookCapture, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	if filter.Limit > 1000 {
+		filter.Limit = 1000
+	}
+	var since *time.Time
+	if !filter.Since.IsZero() {
+		since = &filter.Since
+	}
+
+	rows, err := c.ops().QueryContext(ctx,
+		`SELECT capture_id, captured_at, webhook_id, destination, COALESCE(trace_id, ''), COALESCE(message_id, ''),
+		        subject, COALESCE(status, 0), duration_ms, COALESCE(error, ''), exchange
+		 FROM rule_webhook_captures
+		 WHERE ($1 = 0 OR webhook_id = $1)
+		   AND ($2 = '' OR trace_id = $2)
+		   AND ($3 = '' OR message_id = $3)
+		   AND ($4::TIMESTAMPTZ IS NULL OR captured_at >= $4)
+		 ORDER BY captured_at DESC, capture_id DESC
+		 LIMIT $5`,
+		filter.WebhookID, filter.TraceID, filter.MessageID, since, filter.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	captures := []WebhookCapture{}
+	for rows.Next() {
+		var w WebhookCapture
+		var webhookID sql.NullInt64
+		var exchange []byte
+		if err := rows.Scan(&w.ID, &w.CapturedAt, &webhookID, &w.Destination, &w.TraceID, &w.MessageID,
+			&w.Subject, &w.Status, &w.DurationMs, &w.Error, &exchange); err != nil {
+			return nil, err
+		}
+		if webhookID.Valid {
+			id := int(webhookID.Int64)
+			w.WebhookID = &id
+		}
+		plain, encrypted, err := c.openPayload(ctx, exchange)
+		if err != nil {
+			return nil, fmt.Errorf("capture %d: %w", w.ID, err)
+		}
+		w.Encrypted = encrypted
+		if !encrypted {
+			if err := json.Unmarshal(plain, &w.CapturedExchange); err != nil {
+				return nil, fmt.Errorf("capture %d: %w", w.ID, err)
+			}
+		}
+		captures = append(captures, w)
+	}
+	return captures, rows.Err()
+}
+
+// harNameValue is a HAR header or query parameter
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// CapturesHAR exports captures as an HTTP Archive (HAR 1.2), oldest
+// first, for browser developer tools and HAR viewers. Deliveries without
+// a response get status 0 and their error in _error.
+func CapturesHAR(captures []WebhookCapture) ([]byte, error) {
+	sorted := append([]WebhookCapture(nil), captures...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].CapturedAt.Before(sorted[j].CapturedAt) })
+
+	entries := []map[string]interface{}{}
+	for _, w := range sorted {
+		if w.Encrypted {
+			continue
+		}
+		req := w.Request
+		query := []harNameValue{}
+		if u, err := url.Parse(req.URL); err == nil {
+			for name, values := range u.Query() {
+				for _, value := range values {
+					query = append(query, harNameValue{name, value})
+				}
+			}
+			sort.Slice(query, func(i, j int) bool { return query[i].Name < query[j].Name })
+		}
+		request := map[string]interface{}{
+			"method":      req.Method,
+			"url":         req.URL,
+			"httpVersion": "HTTP/1.1",
+			"cookies":     []interface{}{},
+			"headers":     harHeaders(req.Headers),
+			"queryString": query,
+			"headersSize": -1,
+			"bodySize":    len(req.Body),
+		}
+		if req.Body != "" {
+			postData := map[string]interface{}{"mimeType": req.Headers.Get("Content-Type"), "text": req.Body}
+			if req.Encoding != "" {
+				postData["encoding"] = req.Encoding
+			}
+			request["postData"] = postData
+		}
+
+		response := map[string]interface{}{
+			"status":      0,
+			"statusText":  "",
+			"httpVersion": "HTTP/1.1",
+			"cookies":     []interface{}{},
+			"headers":     []harNameValue{},
+			"content":     map[string]interface{}{"size": 0, "mimeType": "x-unknown"},
+			"redirectURL": "",
+			"headersSize": -1,
+			"bodySize":    -1,
+		}
+		if resp := w.Response; resp != nil {
+			content := map[string]interface{}{
+				"size":     len(resp.Body),
+				"mimeType": resp.Headers.Get("Content-Type"),
+				"text":     resp.Body,
+			}
+			if resp.Encoding != "" {
+				content["encoding"] = resp.Encoding
+			}
+			response["status"] = resp.Status
+			response["statusText"] = http.StatusText(resp.Status)
+			response["headers"] = harHeaders(resp.Headers)
+			response["content"] = content
+			response["bodySize"] = len(resp.Body)
+		}
+		if w.Error != "" {
+			response["_error"] = w.Error
+		}
+
+		entries = append(entries, map[string]interface{}{
+			"startedDateTime": w.CapturedAt.Format(time.RFC3339Nano),
+			"time":            w.DurationMs,
+			"request":         request,
+			"response":        response,
+			"cache":           map[string]interface{}{},
+			"timings":         map[string]int{"send": 0, "wait": w.DurationMs, "receive": 0},
+			"comment":         fmt.Sprintf("capture %d, %s, trace %s", w.ID, w.Destination, w.TraceID),
+		})
+	}
+	return json.MarshalIndent(map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]string{"name": "rule-engine-nats-worker", "version": "1"},
+			"entries": entries,
+		},
+	}, "", "  ")
+}
+
+// harHeaders flattens headers into HAR name/value pairs, sorted by name
+func harHeaders(h http.Header) []harNameValue {
+	pairs := []harNameValue{}
+	for name, values := range h {
+		for _, value := range values {
+			pairs = append(pairs, harNameValue{name, value})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+	return pairs
+}
@@ -0,0 +1,227 @@
+package ruleengine
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine/envelope"
+)
+
+func TestCaptureDestination(t *testing.T) {
+	const update = `UPDATE rule_webhooks SET capture_until = \$2 WHERE webhook_id = \$1`
+	until := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		until   time.Time
+		arg     interface{}
+		rows    int64
+		wantErr error
+	}{
+		{name: "start", until: until, arg: until, rows: 1},
+		{name: "stop", arg: nil, rows: 1},
+		{name: "unknown webhook", until: until, arg: until, wantErr: ErrWebhookNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			mock.ExpectExec(update).WithArgs(3, tt.arg).WillReturnResult(sqlmock.NewResult(0, tt.rows))
+			err := client.CaptureDestination(context.Background(), 3, tt.until)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCaptureMessage(t *testing.T) {
+	until := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		id        string
+		until     time.Time
+		expect    func(mock sqlmock.Sqlmock)
+		wantField string
+	}{
+		{name: "start", id: "msg-8", until: until,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`INSERT INTO rule_capture_requests .* ON CONFLICT \(message_id\) DO UPDATE`).
+					WithArgs("msg-8", until).WillReturnResult(sqlmock.NewResult(0, 1))
+			}},
+		{name: "stop", id: "msg-8",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`DELETE FROM rule_capture_requests WHERE message_id = \$1`).
+					WithArgs("msg-8").WillReturnResult(sqlmock.NewResult(0, 1))
+			}},
+		{name: "no id", until: until, expect: func(sqlmock.Sqlmock) {}, wantField: "id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			tt.expect(mock)
+			err := client.CaptureMessage(context.Background(), tt.id, tt.until)
+			var verr *ValidationError
+			if tt.wantField != "" {
+				if !errors.As(err, &verr) || verr.Field != tt.wantField {
+					t.Fatalf("err = %v, want an invalid %s", err, tt.wantField)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestListCaptures(t *testing.T) {
+	columns := []string{"capture_id", "captured_at", "webhook_id", "destination", "trace_id", "message_id",
+		"subject", "status", "duration_ms", "error", "exchange"}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	exchange := CapturedExchange{
+		Request:  CapturedHTTP{Method: "POST", URL: "https://crm.example.com/hook", Headers: http.Header{"Content-Type": {"application/json"}}, Body: `{"order":1}`},
+		Response: &CapturedHTTP{Status: 200, Headers: http.Header{}, Body: `{"ok":true}`},
+	}
+	plain, _ := json.Marshal(exchange)
+	key, err := envelope.NewLocalKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer := envelope.New(key)
+	sealed, err := sealer.Seal(context.Background(), plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		filter    CaptureFilter
+		args      []interface{}
+		sealer    *envelope.Sealer
+		exchange  []byte
+		encrypted bool
+	}{
+		{name: "defaults", args: []interface{}{0, "", "", nil, 100}, exchange: plain},
+		{name: "filtered", filter: CaptureFilter{WebhookID: 3, TraceID: "trace-7", MessageID: "msg-8", Since: at, Limit: 5000},
+			args: []interface{}{3, "trace-7", "msg-8", at, 1000}, exchange: plain},
+		{name: "sealed without a sealer", args: []interface{}{0, "", "", nil, 100}, exchange: sealed, encrypted: true},
+		{name: "sealed", args: []interface{}{0, "", "", nil, 100}, sealer: sealer, exchange: sealed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			client.SetPayloadSealer(tt.sealer)
+			args := make([]driver.Value, len(tt.args))
+			for i, a := range tt.args {
+				args[i] = a
+			}
+			mock.ExpectQuery(`FROM rule_webhook_captures`).WithArgs(args...).
+				WillReturnRows(sqlmock.NewRows(columns).
+					AddRow(int64(11), at, int64(3), "crm", "trace-7", "", "webhooks.orders", 200, 42, "", tt.exchange).
+					AddRow(int64(10), at.Add(-time.Minute), nil, "hooks.example.com", "", "msg-8", "webhooks.orders", 0, 30000, "timeout", plain))
+			captures, err := client.ListCaptures(context.Background(), tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(captures) != 2 {
+				t.Fatalf("captures = %+v", captures)
+			}
+			first, second := captures[0], captures[1]
+			if first.ID != 11 || first.WebhookID == nil || *first.WebhookID != 3 || first.Status != 200 || first.Encrypted != tt.encrypted {
+				t.Fatalf("first = %+v", first)
+			}
+			if !tt.encrypted && !reflect.DeepEqual(first.CapturedExchange, exchange) {
+				t.Fatalf("exchange = %+v, want %+v", first.CapturedExchange, exchange)
+			}
+			if second.WebhookID != nil || second.MessageID != "msg-8" || second.Error != "timeout" {
+				t.Fatalf("second = %+v", second)
+			}
+		})
+	}
+}
+
+func TestCapturesHAR(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	webhookID := 3
+	captures := []WebhookCapture{
+		{ID: 2, CapturedAt: at.Add(time.Minute), Destination: "hooks.example.com", DurationMs: 30000, Error: "timeout",
+			CapturedExchange: CapturedExchange{Request: CapturedHTTP{Method: "POST", URL: "https://hooks.example.com/", Headers: http.Header{}}}},
+		{ID: 1, CapturedAt: at, WebhookID: &webhookID, Destination: "crm", TraceID: "trace-7", Status: 200, DurationMs: 42,
+			CapturedExchange: CapturedExchange{
+				Request: CapturedHTTP{Method: "POST", URL: "https://crm.example.com/hook?b=2&a=1",
+					Headers: http.Header{"Content-Type": {"application/json"}, "Authorization": {"[REDACTED]"}}, Body: `{"order":1}`},
+				Response: &CapturedHTTP{Status: 200, Headers: http.Header{"Content-Type": {"application/octet-stream"}},
+					Body: "//4A", Encoding: "base64"},
+			}},
+		{ID: 3, CapturedAt: at, Encrypted: true},
+	}
+	out, err := CapturesHAR(captures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har struct {
+		Log struct {
+			Version string                   `json:"version"`
+			Entries []map[string]interface{} `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(out, &har); err != nil {
+		t.Fatal(err)
+	}
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 2 {
+		t.Fatalf("har = %s", out)
+	}
+
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		// Oldest first, encrypted captures left out
+		{"0.startedDateTime", "2024-05-01T12:00:00Z"},
+		{"0.time", 42.0},
+		{"0.comment", "capture 1, crm, trace trace-7"},
+		{"0.request.url", "https://crm.example.com/hook?b=2&a=1"},
+		{"0.request.queryString", []interface{}{
+			map[string]interface{}{"name": "a", "value": "1"}, map[string]interface{}{"name": "b", "value": "2"}}},
+		{"0.request.headers", []interface{}{
+			map[string]interface{}{"name": "Authorization", "value": "[REDACTED]"},
+			map[string]interface{}{"name": "Content-Type", "value": "application/json"}}},
+		{"0.request.postData", map[string]interface{}{"mimeType": "application/json", "text": `{"order":1}`}},
+		{"0.response.status", 200.0},
+		{"0.response.statusText", "OK"},
+		{"0.response.content", map[string]interface{}{"size": 4.0, "mimeType": "application/octet-stream", "text": "//4A", "encoding": "base64"}},
+		{"1.response.status", 0.0},
+		{"1.response._error", "timeout"},
+		{"1.timings", map[string]interface{}{"send": 0.0, "wait": 30000.0, "receive": 0.0}},
+	}
+	for _, tt := range tests {
+		var got interface{} = har.Log.Entries
+		for _, key := range strings.Split(tt.path, ".") {
+			switch v := got.(type) {
+			case []map[string]interface{}:
+				i, _ := strconv.Atoi(key)
+				got = v[i]
+			case map[string]interface{}:
+				got = v[key]
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %#v, want %#v", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Package ruleengine is a Go client for the rule-engine-postgres extension.
+//
+// It calls the extension's SQL functions over a regular database/sql
+// connection, so any Postgres driver works:
+//
+//	db, _ := sql.Open("postgres", dsn)
+//	client := ruleengine.New(db)
+//	result, err := client.Evaluate(ctx, rulesetID, map[string]interface{}{
+//	    "Order": map[string]interface{}{"total": 1200},
+//	})
+package ruleengine
+
+import (
+	"database/sql"
+	"sync/atomic"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine/envelope"
+)
+
+// Client wraps a database handle with typed access to the rule engine
+type Client struct {
+	db            *sql.DB
+	cache         *ruleCache       // nil unless EnableCache was called
+	results       *resultCache     // nil unless EnableCache enabled result caching
+	rollouts      bool             // set by EnableRollouts
+	windows       bool             // set by EnableWindows
+	responseFacts bool             // set by EnableResponseFacts
+	hits          *hitRecorder     // nil unless EnableRuleStats was called
+	sealer        *envelope.Sealer // set by SetPayloadSealer
+	opsDB         *sql.DB          // set by SetOpsDB; nil means db
+
+	supported atomic.Pointer[map[string]bool] // set by Capabilities
+}
+
+// New returns a client using db. The client does not take ownership of db.
+func New(db *sql.DB) *Client {
+	return &Client{db: db}
+}
+
+// DB returns the underlying database handle
+func (c *Client) DB() *sql.DB {
+	return c.db
+}
+
+// SetPayloadSealer makes the client decrypt payloads that workers stored
+// with envelope encryption (PAYLOAD_ENCRYPTION). Without it, encrypted
+// payloads are returned as their envelopes.
+func (c *Client) SetPayloadSealer(s *envelope.Sealer) {
+	c.sealer = s
+}
+
+// SetOpsDB points reads of worker statistics and audit records (consumer
+// stats, expired messages) at the operational database workers write to
+// with OPS_DATABASE_URL. The client does not take ownership of ops.
+func (c *Client) SetOpsDB(ops *sql.DB) {
+	c.opsDB = ops
+}
+
+// ops returns the database holding worker statistics and audit records
+func (c *Client) ops() *sql.DB {
+	if c.opsDB != nil {
+		return c.opsDB
+	}
+	return c.db
+}
@@ -0,0 +1,444 @@
+package ruleengine
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Conflict kinds reported by DetectConflicts
+const (
+	// ConflictContradiction: some facts match both rules and they set a
+	// field to different values, so the result depends on firing order
+	ConflictContradiction = "contradiction"
+
+	// ConflictDoubleWrite: some facts match both rules and both compute a
+	// new value for the same field, e.g. two discounts applied on top of
+	// each other
+	ConflictDoubleWrite = "double_write"
+
+	// ConflictPossible: both rules change the same field but at least one
+	// condition is too complex to analyze, so they may or may not overlap
+	ConflictPossible = "possible"
+
+	// ConflictRedundant: some facts match both rules and they set a field
+	// to the same value (reported with ConflictOptions.Overlaps)
+	ConflictRedundant = "redundant"
+
+	// ConflictOverlap: some facts match both rules, which change different
+	// fields (reported with ConflictOptions.Overlaps)
+	ConflictOverlap = "overlap"
+)
+
+// maxConditionTerms bounds the disjunctive normal form of a condition;
+// larger conditions are reported as unanalyzed
+const maxConditionTerms = 256
+
+// ConflictOptions configures DetectConflicts
+type ConflictOptions struct {
+	// Overlaps also reports rule pairs whose conditions overlap without
+	// conflicting writes
+	Overlaps bool
+}
+
+// RuleConflict is a pair of rules that can both fire on the same facts
+// and whose actions may interfere
+type RuleConflict struct {
+	Kind   string   `json:"kind"`
+	Rules  []string `json:"rules"`
+	Fields []string `json:"fields,omitempty"`
+	Detail string   `json:"detail"`
+
+	// Example is a fact document both conditions match; nil for
+	// ConflictPossible
+	Example map[string]interface{} `json:"example,omitempty"`
+}
+
+// ConflictReport lists the conflicts found in one rule set
+type ConflictReport struct {
+	RuleSetID int            `json:"ruleset_id"`
+	Rules     int            `json:"rules"`
+	Conflicts []RuleConflict `json:"conflicts"`
+
+	// Unanalyzed names rules whose conditions use more than comparisons
+	// of fact fields with literals joined by && and ||; they only appear
+	// in ConflictPossible entries
+	Unanalyzed []string `json:"unanalyzed"`
+}
+
+// DetectConflicts compares every pair of rules in a rule set (the GRL
+// each member resolves to) and reports pairs that can fire on the same
+// facts and write the same field, with an example fact document that
+// matches both conditions. It does not follow chaining: a rule enabled by
+// another rule's action is compared on its own condition only.
+func (c *Client) DetectConflicts(ctx context.Context, rulesetID int, opts ConflictOptions) (*ConflictReport, error) {
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	members, err := c.ruleSetMembers(ctx, conn, rulesetID)
+	if err != nil {
+		return nil, err
+	}
+	var rules []analyzedRule
+	for _, m := range members {
+		grl, err := c.memberGRL(ctx, conn, m)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, analyzeGRL(grl)...)
+	}
+
+	report := detectConflicts(rules, opts)
+	report.RuleSetID = rulesetID
+	return report, nil
+}
+
+// analyzedRule is one GRL rule block reduced to what conflict detection
+// needs
+type analyzedRule struct {
+	name string
+
+	// terms is the condition in disjunctive normal form; nil when the
+	// condition could not be analyzed
+	terms [][]comparison
+	when  condition
+
+	// writes maps each written field to its literal value, or to
+	// computedValue when the action computes it
+	writes map[string]interface{}
+}
+
+// computedValue marks a write whose value is not a literal
+type computedValue struct{}
+
+// analyzeGRL splits a GRL document into rule blocks and analyzes each
+func analyzeGRL(grl string) []analyzedRule {
+	var rules []analyzedRule
+	for _, block := range splitGRLRules(grl) {
+		r := analyzedRule{name: block.name, writes: map[string]interface{}{}}
+
+		if tokens := tokenizeGRL(block.when); tokens != nil {
+			p := &grlParser{tokens: tokens}
+			if cond, err := p.or(); err == nil && p.done() {
+				if terms, ok := dnf(cond); ok {
+					r.terms, r.when = terms, cond
+				}
+			}
+		}
+
+		literal := false
+		if tokens := tokenizeGRL(block.then); tokens != nil {
+			p := &grlParser{tokens: tokens}
+			var assignments []assignment
+			for !p.done() {
+				a, err := p.assignment()
+				if err != nil {
+					assignments = nil
+					break
+				}
+				assignments = append(assignments, a)
+			}
+			if p.done() && assignments != nil {
+				literal = true
+				for _, a := range assignments {
+					r.writes[strings.Join(a.path, ".")] = a.value
+				}
+			}
+		}
+		if !literal {
+			for _, field := range scanGRLRefs("then " + block.then).writes {
+				r.writes[field] = computedValue{}
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// dnf expands a condition into OR-ed terms of AND-ed comparisons
+func dnf(c condition) ([][]comparison, bool) {
+	switch c := c.(type) {
+	case comparison:
+		return [][]comparison{{c}}, true
+	case logical:
+		left, ok := dnf(c.left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := dnf(c.right)
+		if !ok {
+			return nil, false
+		}
+		if c.op == "||" {
+			if len(left)+len(right) > maxConditionTerms {
+				return nil, false
+			}
+			return append(left, right...), true
+		}
+		if len(left)*len(right) > maxConditionTerms {
+			return nil, false
+		}
+		var terms [][]comparison
+		for _, l := range left {
+			for _, r := range right {
+				term := append(append([]comparison{}, l...), r...)
+				terms = append(terms, term)
+			}
+		}
+		return terms, true
+	}
+	return nil, false
+}
+
+func detectConflicts(rules []analyzedRule, opts ConflictOptions) *ConflictReport {
+	report := &ConflictReport{Rules: len(rules), Conflicts: []RuleConflict{}, Unanalyzed: []string{}}
+	for _, r := range rules {
+		if r.terms == nil {
+			report.Unanalyzed = append(report.Unanalyzed, r.name)
+		}
+	}
+
+	for i := range rules {
+		for j := i + 1; j < len(rules); j++ {
+			a, b := rules[i], rules[j]
+			var shared []string
+			for field := range a.writes {
+				if _, ok := b.writes[field]; ok {
+					shared = append(shared, field)
+				}
+			}
+			sort.Strings(shared)
+
+			if a.terms == nil || b.terms == nil {
+				if len(shared) > 0 {
+					report.Conflicts = append(report.Conflicts, RuleConflict{
+						Kind:   ConflictPossible,
+						Rules:  []string{a.name, b.name},
+						Fields: shared,
+						Detail: fmt.Sprintf("both change %s; conditions could not be compared", strings.Join(shared, ", ")),
+					})
+				}
+				continue
+			}
+
+			example, ok := overlapExample(a, b)
+			if !ok {
+				continue
+			}
+			conflict := RuleConflict{Rules: []string{a.name, b.name}, Fields: shared, Example: example}
+			var contradictions, computed []string
+			for _, field := range shared {
+				va, vb := a.writes[field], b.writes[field]
+				_, ca := va.(computedValue)
+				_, cb := vb.(computedValue)
+				switch {
+				case ca || cb:
+					computed = append(computed, field)
+				case !reflect.DeepEqual(va, vb):
+					contradictions = append(contradictions, fmt.Sprintf("%s to %v and %v", field, literalText(va), literalText(vb)))
+				}
+			}
+			switch {
+			case len(contradictions) > 0:
+				conflict.Kind = ConflictContradiction
+				conflict.Detail = "set " + strings.Join(contradictions, "; ")
+			case len(computed) > 0:
+				conflict.Kind = ConflictDoubleWrite
+				conflict.Detail = "both change " + strings.Join(computed, ", ")
+			case len(shared) > 0 && opts.Overlaps:
+				conflict.Kind = ConflictRedundant
+				conflict.Detail = "both set " + strings.Join(shared, ", ") + " to the same value"
+			case len(shared) == 0 && opts.Overlaps:
+				conflict.Kind = ConflictOverlap
+				conflict.Detail = "conditions overlap"
+			default:
+				continue
+			}
+			report.Conflicts = append(report.Conflicts, conflict)
+		}
+	}
+	return report
+}
+
+func literalText(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(v)
+}
+
+// overlapExample searches for facts matching both rules: for every pair of
+// terms it picks, for each field, a value satisfying all comparisons on
+// it. Candidates are the literals compared against and values just around
+// and between them, which covers every region the comparisons distinguish.
+func overlapExample(a, b analyzedRule) (map[string]interface{}, bool) {
+	for _, ta := range a.terms {
+		for _, tb := range b.terms {
+			byPath := map[string][]comparison{}
+			var order []string
+			for _, c := range append(append([]comparison{}, ta...), tb...) {
+				key := strings.Join(c.path, ".")
+				if _, ok := byPath[key]; !ok {
+					order = append(order, key)
+				}
+				byPath[key] = append(byPath[key], c)
+			}
+
+			facts := map[string]interface{}{}
+			ok := true
+			for _, key := range order {
+				value, found := satisfying(byPath[key])
+				if !found {
+					ok = false
+					break
+				}
+				setPath(facts, byPath[key][0].path, value)
+			}
+			if ok && a.when.eval(facts) && b.when.eval(facts) {
+				return facts, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// satisfying returns a value for which every comparison holds
+func satisfying(comparisons []comparison) (interface{}, bool) {
+	var numbers []float64
+	var strs []string
+	for _, c := range comparisons {
+		switch v := c.value.(type) {
+		case float64:
+			numbers = append(numbers, v)
+		case string:
+			strs = append(strs, v)
+		}
+	}
+	sort.Float64s(numbers)
+	sort.Strings(strs)
+
+	var candidates []interface{}
+	for i, n := range numbers {
+		candidates = append(candidates, n, n-1, n+1)
+		if i > 0 {
+			candidates = append(candidates, (numbers[i-1]+n)/2)
+		}
+	}
+	for _, s := range strs {
+		candidates = append(candidates, s, s+"a", nextString(s))
+	}
+	candidates = append(candidates, "", true, false, float64(0))
+
+	for _, candidate := range candidates {
+		ok := true
+		for _, c := range comparisons {
+			facts := map[string]interface{}{}
+			setPath(facts, c.path, candidate)
+			if !c.eval(facts) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return candidate, true
+		}
+	}
+	return nil, false
+}
+
+// nextString returns the smallest string greater than s, e.g. for a field
+// that must be > "a" but < "b"
+func nextString(s string) string {
+	return s + "\x00"
+}
+
+// grlRuleText is one rule block of a GRL document
+type grlRuleText struct {
+	name, when, then string
+}
+
+// splitGRLRules finds the rule blocks of a GRL document and the text of
+// their when and then sections, skipping strings and comments
+func splitGRLRules(grl string) []grlRuleText {
+	rs := []rune(grl)
+	var blocks []grlRuleText
+	var cur *grlRuleText
+	depth, whenAt, thenAt := 0, -1, -1
+	word := func(i int, w string) bool {
+		end := i + len(w)
+		return end <= len(rs) && string(rs[i:end]) == w &&
+			(i == 0 || !isIdentRune(rs[i-1])) && (end == len(rs) || !isIdentRune(rs[end]))
+	}
+
+	for i := 0; i < len(rs); i++ {
+		switch r := rs[i]; {
+		case r == '/' && i+1 < len(rs) && rs[i+1] == '/':
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < len(rs) && rs[i+1] == '*':
+			for i += 2; i+1 < len(rs) && !(rs[i] == '*' && rs[i+1] == '/'); i++ {
+			}
+			i++
+		case r == '"' || r == '`':
+			start := i
+			for i++; i < len(rs) && rs[i] != r; i++ {
+				if rs[i] == '\\' {
+					i++
+				}
+			}
+			if cur != nil && cur.name == "" && depth == 0 {
+				if name, err := strconv.Unquote(string(rs[start:min(i+1, len(rs))])); err == nil {
+					cur.name = name
+				}
+			}
+		case depth == 0 && word(i, "rule"):
+			blocks = append(blocks, grlRuleText{})
+			cur = &blocks[len(blocks)-1]
+			i += len("rule")
+			for i < len(rs) && unicode.IsSpace(rs[i]) {
+				i++
+			}
+			j := i
+			for j < len(rs) && isIdentRune(rs[j]) {
+				j++
+			}
+			cur.name = string(rs[i:j])
+			i = j - 1
+		case r == '{':
+			depth++
+		case r == '}':
+			depth--
+			if depth == 0 && cur != nil && whenAt >= 0 && thenAt >= 0 {
+				cur.then = string(rs[thenAt:i])
+			}
+			if depth == 0 {
+				whenAt, thenAt = -1, -1
+			}
+		case depth == 1 && cur != nil && whenAt < 0 && word(i, "when"):
+			whenAt = i + len("when")
+		case depth == 1 && cur != nil && whenAt >= 0 && thenAt < 0 && word(i, "then"):
+			cur.when = string(rs[whenAt:i])
+			thenAt = i + len("then")
+		}
+	}
+
+	var complete []grlRuleText
+	for _, b := range blocks {
+		if b.name != "" && strings.TrimSpace(b.when) != "" {
+			complete = append(complete, b)
+		}
+	}
+	return complete
+}
+
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
@@ -0,0 +1,214 @@
+package ruleengine
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSplitGRLRules(t *testing.T) {
+	grl := `// rule Commented "" { when X.a > 1 then X.b = 1; }
+rule First "when then" salience 5 {
+	when
+		Order.Total > 100 /* then */
+	then
+		Order.Note = "then { }";
+}
+rule Second "" { when Order.Total < 10 then Order.Small = true; }
+rule Broken "" { Order.Total > 1 }`
+	got := splitGRLRules(grl)
+	want := []grlRuleText{
+		{name: "First", when: "\n\t\tOrder.Total > 100 /* then */\n\t", then: "\n\t\tOrder.Note = \"then { }\";\n"},
+		{name: "Second", when: " Order.Total < 10 ", then: " Order.Small = true; "},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("splitGRLRules = %#v", got)
+	}
+}
+
+func TestAnalyzeGRL(t *testing.T) {
+	tests := []struct {
+		name       string
+		grl        string
+		analyzed   bool
+		terms      int
+		wantWrites map[string]interface{}
+	}{
+		{name: "literal writes", grl: `rule A "" { when Order.Total > 1 && (Order.Kind == "x" || Order.Kind == "y") then Order.Flag = true; Order.Rate = 0.5; }`,
+			analyzed: true, terms: 2, wantWrites: map[string]interface{}{"Order.Flag": true, "Order.Rate": 0.5}},
+		{name: "computed writes", grl: `rule A "" { when Order.Total > 1 then Order.Total = Order.Total * 0.9; Retract("A"); }`,
+			analyzed: true, terms: 1, wantWrites: map[string]interface{}{"Order.Total": computedValue{}}},
+		{name: "function in the condition", grl: `rule A "" { when Order.Items.Len() > 1 then Order.Bulk = true; }`,
+			wantWrites: map[string]interface{}{"Order.Bulk": true}},
+		{name: "bare identifier", grl: `rule A "" { when Total > 1 then Order.Bulk = true; }`,
+			wantWrites: map[string]interface{}{"Order.Bulk": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := analyzeGRL(tt.grl)
+			if len(rules) != 1 {
+				t.Fatalf("%d rules", len(rules))
+			}
+			r := rules[0]
+			if (r.terms != nil) != tt.analyzed || len(r.terms) != tt.terms {
+				t.Errorf("terms = %v", r.terms)
+			}
+			if !reflect.DeepEqual(r.writes, tt.wantWrites) {
+				t.Errorf("writes = %#v", r.writes)
+			}
+		})
+	}
+}
+
+func TestDNFLimit(t *testing.T) {
+	// (a1 || a2) && (b1 || b2) && ... expands to 2^n terms
+	var parts []string
+	for i := 0; i < 9; i++ {
+		parts = append(parts, `(X.a == 1 || X.b == 2)`)
+	}
+	r := analyzeGRL(`rule A "" { when ` + strings.Join(parts, " && ") + ` then X.c = 1; }`)[0]
+	if r.terms != nil {
+		t.Fatalf("%d terms kept past the limit", len(r.terms))
+	}
+	r = analyzeGRL(`rule A "" { when ` + strings.Join(parts[:8], " && ") + ` then X.c = 1; }`)[0]
+	if len(r.terms) != maxConditionTerms {
+		t.Fatalf("%d terms, want %d", len(r.terms), maxConditionTerms)
+	}
+}
+
+func TestSatisfying(t *testing.T) {
+	tests := []struct {
+		name string
+		cond string
+		ok   bool
+	}{
+		{"range", `X.v > 10 && X.v < 20`, true},
+		{"open interval between literals", `X.v > 10 && X.v < 11`, true},
+		{"empty range", `X.v > 10 && X.v < 10`, false},
+		{"equal and not equal", `X.v == 5 && X.v != 5`, false},
+		{"string range", `X.s > "a" && X.s < "b"`, true},
+		{"string equality", `X.s == "gold" && X.s != "silver"`, true},
+		{"boolean", `X.b == true`, true},
+		{"type clash", `X.v == "a" && X.v > 1`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			terms := analyzeGRL(`rule A "" { when ` + tt.cond + ` then X.z = 1; }`)[0].terms
+			if len(terms) != 1 {
+				t.Fatalf("terms = %v", terms)
+			}
+			value, ok := satisfying(terms[0])
+			if ok != tt.ok {
+				t.Fatalf("satisfying = %v, %v; want ok %v", value, ok, tt.ok)
+			}
+			for _, c := range terms[0] {
+				facts := map[string]interface{}{}
+				setPath(facts, c.path, value)
+				if ok && !c.eval(facts) {
+					t.Fatalf("%v does not satisfy %v", value, c)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     string
+		overlaps bool
+		want     string // kind, or "" for no conflict
+		detail   string
+		example  bool
+	}{
+		{name: "contradiction",
+			a: `Order.Total > 100 then Order.Tier = "gold";`, b: `Order.Total > 500 then Order.Tier = "platinum";`,
+			want: ConflictContradiction, detail: `set Order.Tier to "gold" and "platinum"`, example: true},
+		{name: "disjoint conditions",
+			a: `Order.Total > 100 then Order.Tier = "gold";`, b: `Order.Total <= 100 then Order.Tier = "basic";`},
+		{name: "double write",
+			a: `Order.Total > 100 then Order.Discount = Order.Discount + 5;`, b: `Customer.Vip == true then Order.Discount = 10;`,
+			want: ConflictDoubleWrite, detail: "both change Order.Discount", example: true},
+		{name: "same value without overlaps",
+			a: `Order.Total > 100 then Order.Flag = true;`, b: `Order.Total > 200 then Order.Flag = true;`},
+		{name: "same value", overlaps: true,
+			a: `Order.Total > 100 then Order.Flag = true;`, b: `Order.Total > 200 then Order.Flag = true;`,
+			want: ConflictRedundant, detail: "both set Order.Flag to the same value", example: true},
+		{name: "different fields", overlaps: true,
+			a: `Order.Total > 100 then Order.A = 1;`, b: `Order.Country == "NL" then Order.B = 1;`,
+			want: ConflictOverlap, detail: "conditions overlap", example: true},
+		{name: "disjoint strings", overlaps: true,
+			a: `Order.Country == "NL" then Order.A = 1;`, b: `Order.Country == "DE" then Order.A = 2;`},
+		{name: "one disjunct overlaps",
+			a: `Order.Country == "NL" || Order.Total > 1000 then Order.Review = true;`, b: `Order.Total < 2000 && Order.Country == "DE" then Order.Review = false;`,
+			want: ConflictContradiction, example: true},
+		{name: "unanalyzed condition",
+			a: `Order.Items.Len() > 3 then Order.Bulk = true;`, b: `Order.Total > 1 then Order.Bulk = false;`,
+			want: ConflictPossible, detail: "both change Order.Bulk; conditions could not be compared"},
+		{name: "unanalyzed without shared writes", overlaps: true,
+			a: `Order.Items.Len() > 3 then Order.Bulk = true;`, b: `Order.Total > 1 then Order.Big = false;`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := analyzeGRL(`rule A "" { when ` + tt.a + ` } rule B "" { when ` + tt.b + ` }`)
+			report := detectConflicts(rules, ConflictOptions{Overlaps: tt.overlaps})
+			if report.Rules != 2 {
+				t.Fatalf("rules = %d", report.Rules)
+			}
+			if tt.want == "" {
+				if len(report.Conflicts) != 0 {
+					t.Fatalf("conflicts = %+v", report.Conflicts)
+				}
+				return
+			}
+			if len(report.Conflicts) != 1 {
+				t.Fatalf("conflicts = %+v", report.Conflicts)
+			}
+			c := report.Conflicts[0]
+			if c.Kind != tt.want || !reflect.DeepEqual(c.Rules, []string{"A", "B"}) ||
+				(tt.detail != "" && c.Detail != tt.detail) {
+				t.Fatalf("conflict = %+v", c)
+			}
+			if (c.Example != nil) != tt.example {
+				t.Fatalf("example = %v", c.Example)
+			}
+			// The example matches both conditions
+			if c.Example != nil && (!rules[0].when.eval(c.Example) || !rules[1].when.eval(c.Example)) {
+				t.Fatalf("example %v does not match both rules", c.Example)
+			}
+		})
+	}
+}
+
+func TestDetectConflictsRuleSet(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectQuery(`SELECT is_active FROM rule_sets`).WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(true))
+	mock.ExpectQuery(`ruleset_get_rules`).WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_name", "rule_version"}).AddRow("Gold", nil).AddRow("Tiers", "2.0.0"))
+	mock.ExpectQuery(`rule_get`).WithArgs("Gold", nil).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(`rule Gold "" { when Order.Total > 100 then Order.Tier = "gold"; }`))
+	// One member may hold several rules
+	mock.ExpectQuery(`rule_get`).WithArgs("Tiers", "2.0.0").
+		WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(
+			`rule Silver "" { when Order.Total > 50 then Order.Tier = "silver"; }
+			 rule Complex "" { when Order.Items.Len() > 0 then Order.Seen = true; }`))
+
+	report, err := client.DetectConflicts(context.Background(), 4, ConflictOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.RuleSetID != 4 || report.Rules != 3 || !reflect.DeepEqual(report.Unanalyzed, []string{"Complex"}) {
+		t.Fatalf("report = %+v", report)
+	}
+	if len(report.Conflicts) != 1 || report.Conflicts[0].Kind != ConflictContradiction ||
+		!reflect.DeepEqual(report.Conflicts[0].Rules, []string{"Gold", "Silver"}) {
+		t.Fatalf("conflicts = %+v", report.Conflicts)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
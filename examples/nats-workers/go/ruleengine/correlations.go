@@ -0,0 +1,279 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//go:embed correlations.sql
+var correlationsSQL string
+
+// ErrCorrelationNotFound is returned for an unknown correlation name
+var ErrCorrelationNotFound = errors.New("correlation not found")
+
+// Correlation joins events of several types by a shared key within a time
+// window, e.g. an order.created followed by a payment.failed for the same
+// order within 30 minutes. When the last step arrives the correlation
+// matches and a composite event is published to EmitSubject, so rules can
+// react to the sequence as a whole.
+type Correlation struct {
+	// Name is a plain identifier
+	Name string `json:"name"`
+
+	// Steps are the events to join, in the order they must arrive; at
+	// least two
+	Steps []CorrelationStep `json:"steps"`
+
+	// Within bounds the time from the first step to the last
+	Within time.Duration `json:"within"`
+
+	// EmitSubject is the NATS subject composite events are published to
+	EmitSubject string `json:"emit_subject"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CorrelationStep is one event of a Correlation
+type CorrelationStep struct {
+	// Subject is the NATS subject pattern the event arrives on (* and >
+	// wildcards)
+	Subject string `json:"subject"`
+
+	// KeyPath is the dotted path of the correlation key in the event, e.g.
+	// id for order.created and order_id for payment.failed
+	KeyPath string `json:"key_path"`
+}
+
+// CorrelationMatch is a completed correlation. Its composite event, as
+// published to EmitSubject, is the match as JSON.
+type CorrelationMatch struct {
+	ID          int64             `json:"id"`
+	Correlation string            `json:"correlation"`
+	Key         string            `json:"key"`
+	EmitSubject string            `json:"emit_subject"`
+	Events      []CorrelatedEvent `json:"events"`
+	StartedAt   time.Time         `json:"started_at"`
+	MatchedAt   time.Time         `json:"matched_at"`
+	PublishedAt *time.Time        `json:"published_at,omitempty"`
+}
+
+// CorrelatedEvent is one step's event in a CorrelationMatch
+type CorrelatedEvent struct {
+	Subject string          `json:"subject"`
+	At      time.Time       `json:"at"`
+	Event   json.RawMessage `json:"event"`
+}
+
+// EnableCorrelations creates the correlation tables and functions if
+// needed. It is idempotent.
+func (c *Client) EnableCorrelations(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, correlationsSQL); err != nil {
+		return fmt.Errorf("failed to install correlations: %w", err)
+	}
+	return nil
+}
+
+// CreateCorrelation registers corr. Only events recorded from then on
+// count toward it.
+func (c *Client) CreateCorrelation(ctx context.Context, corr Correlation) error {
+	if !identifierPattern.MatchString(corr.Name) {
+		return &ValidationError{Field: "name", Message: "must be a plain identifier"}
+	}
+	if len(corr.Steps) < 2 {
+		return &ValidationError{Field: "steps", Message: "must have at least two steps"}
+	}
+	for i, step := range corr.Steps {
+		if step.Subject == "" {
+			return &ValidationError{Field: fmt.Sprintf("steps[%d].subject", i), Message: "is required"}
+		}
+		if !jsonPathPattern.MatchString(step.KeyPath) {
+			return &ValidationError{Field: fmt.Sprintf("steps[%d].key_path", i), Message: "must be a dotted path like order_id or order.id"}
+		}
+	}
+	if corr.Within < time.Second {
+		return &ValidationError{Field: "within", Message: "must be at least a second"}
+	}
+	if corr.EmitSubject == "" {
+		return &ValidationError{Field: "emit_subject", Message: "is required"}
+	}
+	steps, err := json.Marshal(corr.Steps)
+	if err != nil {
+		return err
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO rule_correlations (name, steps, within, emit_subject)
+		 VALUES ($1, $2, $3::FLOAT8 * INTERVAL '1 second', $4)`,
+		corr.Name, steps, corr.Within.Seconds(), corr.EmitSubject,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const correlationColumns = `name, steps, EXTRACT(EPOCH FROM within)::FLOAT8, emit_subject, created_at`
+
+func scanCorrelation(row interface{ Scan(...interface{}) error }) (*Correlation, error) {
+	var corr Correlation
+	var steps []byte
+	var within float64
+	if err := row.Scan(&corr.Name, &steps, &within, &corr.EmitSubject, &corr.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(steps, &corr.Steps); err != nil {
+		return nil, fmt.Errorf("correlation %s: invalid steps: %w", corr.Name, err)
+	}
+	corr.Within = time.Duration(within * float64(time.Second))
+	return &corr, nil
+}
+
+// GetCorrelation returns one correlation
+func (c *Client) GetCorrelation(ctx context.Context, name string) (*Correlation, error) {
+	corr, err := scanCorrelation(c.db.QueryRowContext(ctx,
+		"SELECT "+correlationColumns+" FROM rule_correlations WHERE name = $1", name,
+	))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s: %w", name, ErrCorrelationNotFound)
+	}
+	return corr, err
+}
+
+// ListCorrelations returns all correlations by name
+func (c *Client) ListCorrelations(ctx context.Context) ([]Correlation, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT "+correlationColumns+" FROM rule_correlations ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	correlations := []Correlation{}
+	for rows.Next() {
+		corr, err := scanCorrelation(rows)
+		if err != nil {
+			return nil, err
+		}
+		correlations = append(correlations, *corr)
+	}
+	return correlations, rows.Err()
+}
+
+// DeleteCorrelation removes a correlation with its partial matches and
+// recorded matches
+func (c *Client) DeleteCorrelation(ctx context.Context, name string) error {
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM rule_correlations WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", name, ErrCorrelationNotFound)
+	}
+	return tx.Commit()
+}
+
+// RecordCorrelationEvent applies event, which arrived on subject, to every
+// correlation and returns the matches it completed. Completed matches stay
+// unpublished until MarkCorrelationPublished, so a caller that crashes
+// before publishing leaves them for PendingCorrelationMatches. The NATS
+// webhook worker records events from CORRELATION_SUBJECTS this way.
+func (c *Client) RecordCorrelationEvent(ctx context.Context, subject string, event interface{}) ([]CorrelationMatch, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode event: %w", err)
+	}
+	return c.queryCorrelationMatches(ctx,
+		"SELECT "+correlationMatchColumns+" FROM rule_correlation_record($1, $2)", subject, data)
+}
+
+// PendingCorrelationMatches returns up to limit unpublished matches that
+// completed more than olderThan ago, oldest first
+func (c *Client) PendingCorrelationMatches(ctx context.Context, olderThan time.Duration, limit int) ([]CorrelationMatch, error) {
+	return c.queryCorrelationMatches(ctx,
+		"SELECT "+correlationMatchColumns+` FROM rule_correlation_matches
+		 WHERE published_at IS NULL AND matched_at < now() - $1::FLOAT8 * INTERVAL '1 second'
+		 ORDER BY matched_at LIMIT $2`,
+		olderThan.Seconds(), limit)
+}
+
+// ListCorrelationMatches returns up to limit of a correlation's most
+// recent matches
+func (c *Client) ListCorrelationMatches(ctx context.Context, name string, limit int) ([]CorrelationMatch, error) {
+	if _, err := c.GetCorrelation(ctx, name); err != nil {
+		return nil, err
+	}
+	return c.queryCorrelationMatches(ctx,
+		"SELECT "+correlationMatchColumns+` FROM rule_correlation_matches
+		 WHERE correlation_name = $1 ORDER BY matched_at DESC, id DESC LIMIT $2`,
+		name, limit)
+}
+
+// MarkCorrelationPublished records that a match's composite event was
+// published
+func (c *Client) MarkCorrelationPublished(ctx context.Context, id int64) error {
+	_, err := c.db.ExecContext(ctx,
+		"UPDATE rule_correlation_matches SET published_at = now() WHERE id = $1 AND published_at IS NULL", id)
+	return err
+}
+
+// PruneCorrelations deletes expired partial matches and published matches
+// older than keep, and returns how many rows that was. The NATS webhook
+// worker's leader runs it with its correlation outbox. Before EnableCorrelations it does
+// nothing.
+func (c *Client) PruneCorrelations(ctx context.Context, keep time.Duration) (int64, error) {
+	var installed bool
+	if err := c.db.QueryRowContext(ctx, "SELECT to_regclass('rule_correlations') IS NOT NULL").Scan(&installed); err != nil {
+		return 0, err
+	}
+	if !installed {
+		return 0, nil
+	}
+	var n int64
+	err := c.db.QueryRowContext(ctx,
+		"SELECT rule_correlation_prune($1::FLOAT8 * INTERVAL '1 second')", keep.Seconds(),
+	).Scan(&n)
+	return n, err
+}
+
+const correlationMatchColumns = `id, correlation_name, key, emit_subject, events, started_at, matched_at, published_at`
+
+func (c *Client) queryCorrelationMatches(ctx context.Context, query string, args ...interface{}) ([]CorrelationMatch, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := []CorrelationMatch{}
+	for rows.Next() {
+		var m CorrelationMatch
+		var events []byte
+		var published sql.NullTime
+		if err := rows.Scan(&m.ID, &m.Correlation, &m.Key, &m.EmitSubject, &events, &m.StartedAt, &m.MatchedAt, &published); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(events, &m.Events); err != nil {
+			return nil, fmt.Errorf("correlation match %d: invalid events: %w", m.ID, err)
+		}
+		if published.Valid {
+			m.PublishedAt = &published.Time
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
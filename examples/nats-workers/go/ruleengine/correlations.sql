@@ -0,0 +1,139 @@
+-- Event correlation (see EnableCorrelations). A correlation is a sequence
+-- of event steps, e.g. order.created followed by payment.failed, joined by
+-- a key that each step reads from its own path. rule_correlation_record
+-- advances partial matches held in rule_correlation_state and moves
+-- complete ones into rule_correlation_matches, an outbox the NATS webhook
+-- worker publishes composite events from. Both survive worker crashes.
+
+CREATE TABLE IF NOT EXISTS rule_correlations (
+    name TEXT PRIMARY KEY,
+    steps JSONB NOT NULL CHECK (jsonb_typeof(steps) = 'array' AND jsonb_array_length(steps) >= 2),
+    within INTERVAL NOT NULL,
+    emit_subject TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS rule_correlation_state (
+    correlation_name TEXT NOT NULL REFERENCES rule_correlations (name) ON DELETE CASCADE,
+    key TEXT NOT NULL,
+    step INTEGER NOT NULL,
+    events JSONB NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (correlation_name, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rule_correlation_state_expires ON rule_correlation_state (expires_at);
+
+CREATE TABLE IF NOT EXISTS rule_correlation_matches (
+    id BIGSERIAL PRIMARY KEY,
+    correlation_name TEXT NOT NULL REFERENCES rule_correlations (name) ON DELETE CASCADE,
+    key TEXT NOT NULL,
+    emit_subject TEXT NOT NULL,
+    events JSONB NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    matched_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    published_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_rule_correlation_matches_pending
+    ON rule_correlation_matches (matched_at) WHERE published_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_rule_correlation_matches_name
+    ON rule_correlation_matches (correlation_name, matched_at DESC);
+
+-- NATS subject matching: * matches one token, a trailing > the rest
+CREATE OR REPLACE FUNCTION rule_correlation_subject_matches(p_pattern TEXT, p_subject TEXT)
+RETURNS BOOLEAN AS $$
+    SELECT p_subject ~ ('^' || replace(replace(
+        regexp_replace(p_pattern, '([.+?^$()\[\]{}|\\])', '\\\1', 'g'),
+        '*', '[^.]+'), '>', '.+') || '$')
+$$ LANGUAGE sql IMMUTABLE;
+
+-- Applies one event to every correlation. An event matching the step a
+-- partial match waits for advances it; one matching the first step starts
+-- a partial match for its key unless one is already running. Returns the
+-- matches the event completed.
+CREATE OR REPLACE FUNCTION rule_correlation_record(p_subject TEXT, p_event JSONB, p_at TIMESTAMPTZ DEFAULT now())
+RETURNS SETOF rule_correlation_matches AS $$
+DECLARE
+    c RECORD;
+    s rule_correlation_state%ROWTYPE;
+    m rule_correlation_matches%ROWTYPE;
+    v_step JSONB;
+    v_index INTEGER;
+    v_steps INTEGER;
+    v_key TEXT;
+    v_start_key TEXT;
+    v_entry JSONB;
+    v_advanced BOOLEAN;
+BEGIN
+    FOR c IN SELECT * FROM rule_correlations ORDER BY name LOOP
+        v_steps := jsonb_array_length(c.steps);
+        v_advanced := FALSE;
+        v_start_key := NULL;
+        v_entry := jsonb_build_object('subject', p_subject, 'at', p_at, 'event', p_event);
+
+        FOR v_step, v_index IN
+            SELECT value, ordinality::INTEGER - 1 FROM jsonb_array_elements(c.steps) WITH ORDINALITY
+        LOOP
+            CONTINUE WHEN NOT rule_correlation_subject_matches(v_step ->> 'subject', p_subject);
+            v_key := p_event #>> string_to_array(v_step ->> 'key_path', '.');
+            CONTINUE WHEN v_key IS NULL;
+            IF v_index = 0 THEN
+                v_start_key := v_key;
+                CONTINUE;
+            END IF;
+
+            SELECT * INTO s FROM rule_correlation_state
+            WHERE correlation_name = c.name AND key = v_key AND step = v_index AND expires_at > p_at
+            FOR UPDATE;
+            CONTINUE WHEN NOT FOUND;
+
+            v_advanced := TRUE;
+            IF v_index + 1 < v_steps THEN
+                UPDATE rule_correlation_state
+                SET step = v_index + 1, events = events || jsonb_build_array(v_entry)
+                WHERE correlation_name = c.name AND key = v_key;
+            ELSE
+                DELETE FROM rule_correlation_state WHERE correlation_name = c.name AND key = v_key;
+                INSERT INTO rule_correlation_matches (correlation_name, key, emit_subject, events, started_at, matched_at)
+                VALUES (c.name, v_key, c.emit_subject, s.events || jsonb_build_array(v_entry), s.started_at, p_at)
+                RETURNING * INTO m;
+                RETURN NEXT m;
+            END IF;
+            EXIT;
+        END LOOP;
+
+        IF NOT v_advanced AND v_start_key IS NOT NULL THEN
+            INSERT INTO rule_correlation_state AS st (correlation_name, key, step, events, started_at, expires_at)
+            VALUES (c.name, v_start_key, 1, jsonb_build_array(v_entry), p_at, p_at + c.within)
+            ON CONFLICT (correlation_name, key) DO UPDATE SET
+                step = EXCLUDED.step,
+                events = EXCLUDED.events,
+                started_at = EXCLUDED.started_at,
+                expires_at = EXCLUDED.expires_at
+            WHERE st.expires_at <= p_at;
+        END IF;
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Deletes expired partial matches, and published matches older than
+-- p_keep, and returns how many rows that was
+CREATE OR REPLACE FUNCTION rule_correlation_prune(p_keep INTERVAL DEFAULT INTERVAL '7 days')
+RETURNS BIGINT AS $$
+DECLARE
+    v_state BIGINT;
+    v_matches BIGINT;
+BEGIN
+    DELETE FROM rule_correlation_state WHERE expires_at <= now();
+    GET DIAGNOSTICS v_state = ROW_COUNT;
+    DELETE FROM rule_correlation_matches WHERE published_at IS NOT NULL AND matched_at < now() - p_keep;
+    GET DIAGNOSTICS v_matches = ROW_COUNT;
+    RETURN v_state + v_matches;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON TABLE rule_correlations IS 'Sequences of events joined by a key within a time window';
+COMMENT ON TABLE rule_correlation_state IS 'Partial matches of each correlation and key';
+COMMENT ON TABLE rule_correlation_matches IS 'Completed correlations; an outbox of composite events to publish';
@@ -0,0 +1,244 @@
+package ruleengine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCreateCorrelationValidation(t *testing.T) {
+	steps := []CorrelationStep{{Subject: "orders.created", KeyPath: "id"}, {Subject: "payments.failed", KeyPath: "order_id"}}
+	valid := Correlation{Name: "unpaid", Steps: steps, Within: 30 * time.Minute, EmitSubject: "composite.unpaid"}
+	tests := []struct {
+		name      string
+		edit      func(c *Correlation)
+		wantField string
+	}{
+		{name: "bad name", edit: func(c *Correlation) { c.Name = "un paid" }, wantField: "name"},
+		{name: "one step", edit: func(c *Correlation) { c.Steps = steps[:1] }, wantField: "steps"},
+		{name: "step without subject", edit: func(c *Correlation) {
+			c.Steps = []CorrelationStep{steps[0], {KeyPath: "order_id"}}
+		}, wantField: "steps[1].subject"},
+		{name: "bad key path", edit: func(c *Correlation) {
+			c.Steps = []CorrelationStep{{Subject: "a", KeyPath: "order-id"}, steps[1]}
+		}, wantField: "steps[0].key_path"},
+		{name: "short window", edit: func(c *Correlation) { c.Within = time.Millisecond }, wantField: "within"},
+		{name: "no emit subject", edit: func(c *Correlation) { c.EmitSubject = "" }, wantField: "emit_subject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newMock(t)
+			c := valid
+			tt.edit(&c)
+			var verr *ValidationError
+			if err := client.CreateCorrelation(context.Background(), c); !errors.As(err, &verr) || verr.Field != tt.wantField {
+				t.Fatalf("err = %v, want a %s validation error", err, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestCreateCorrelation(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO rule_correlations`).
+		WithArgs("unpaid", []byte(`[{"subject":"orders.created","key_path":"id"},{"subject":"payments.failed","key_path":"order_id"}]`),
+			1800.0, "composite.unpaid").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := client.CreateCorrelation(context.Background(), Correlation{Name: "unpaid",
+		Steps:  []CorrelationStep{{Subject: "orders.created", KeyPath: "id"}, {Subject: "payments.failed", KeyPath: "order_id"}},
+		Within: 30 * time.Minute, EmitSubject: "composite.unpaid"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetCorrelation(t *testing.T) {
+	client, mock := newMock(t)
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	columns := []string{"name", "steps", "within", "emit_subject", "created_at"}
+	mock.ExpectQuery(`FROM rule_correlations WHERE name = \$1`).WithArgs("unpaid").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("unpaid", []byte(`[{"subject":"a","key_path":"id"},{"subject":"b","key_path":"x.id"}]`), 90.0, "c", created))
+	got, err := client.GetCorrelation(context.Background(), "unpaid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Correlation{Name: "unpaid", Steps: []CorrelationStep{{"a", "id"}, {"b", "x.id"}}, Within: 90 * time.Second,
+		EmitSubject: "c", CreatedAt: created}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("correlation = %+v", got)
+	}
+
+	mock.ExpectQuery(`FROM rule_correlations WHERE name = \$1`).WithArgs("broken").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("broken", []byte(`{}`), 1.0, "c", created))
+	if _, err := client.GetCorrelation(context.Background(), "broken"); err == nil {
+		t.Fatal("expected an error for invalid steps")
+	}
+	mock.ExpectQuery(`FROM rule_correlations WHERE name = \$1`).WithArgs("nope").WillReturnRows(sqlmock.NewRows(columns))
+	if _, err := client.GetCorrelation(context.Background(), "nope"); !errors.Is(err, ErrCorrelationNotFound) {
+		t.Fatalf("err = %v, want ErrCorrelationNotFound", err)
+	}
+	// Listing matches checks the correlation first
+	mock.ExpectQuery(`FROM rule_correlations WHERE name = \$1`).WithArgs("nope").WillReturnRows(sqlmock.NewRows(columns))
+	if _, err := client.ListCorrelationMatches(context.Background(), "nope", 10); !errors.Is(err, ErrCorrelationNotFound) {
+		t.Fatalf("err = %v, want ErrCorrelationNotFound", err)
+	}
+}
+
+var correlationMatchRowColumns = []string{"id", "correlation_name", "key", "emit_subject", "events", "started_at", "matched_at", "published_at"}
+
+func TestRecordCorrelationEvent(t *testing.T) {
+	client, mock := newMock(t)
+	started := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	matched := started.Add(5 * time.Minute)
+	events := `[{"subject":"orders.created","at":"2024-01-01T10:00:00Z","event":{"id":"o1"}},` +
+		`{"subject":"payments.failed","at":"2024-01-01T10:05:00Z","event":{"order_id":"o1"}}]`
+	mock.ExpectQuery(`FROM rule_correlation_record\(\$1, \$2\)`).WithArgs("payments.failed", []byte(`{"order_id":"o1"}`)).
+		WillReturnRows(sqlmock.NewRows(correlationMatchRowColumns).
+			AddRow(4, "unpaid", "o1", "composite.unpaid", []byte(events), started, matched, nil))
+
+	matches, err := client.RecordCorrelationEvent(context.Background(), "payments.failed", map[string]string{"order_id": "o1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CorrelationMatch{{ID: 4, Correlation: "unpaid", Key: "o1", EmitSubject: "composite.unpaid",
+		Events: []CorrelatedEvent{
+			{Subject: "orders.created", At: started, Event: json.RawMessage(`{"id":"o1"}`)},
+			{Subject: "payments.failed", At: matched, Event: json.RawMessage(`{"order_id":"o1"}`)},
+		}, StartedAt: started, MatchedAt: matched}}
+	if !reflect.DeepEqual(matches, want) {
+		t.Fatalf("matches = %+v", matches)
+	}
+
+	// Events that complete nothing return an empty list, not nil
+	mock.ExpectQuery(`rule_correlation_record`).WillReturnRows(sqlmock.NewRows(correlationMatchRowColumns))
+	if matches, err := client.RecordCorrelationEvent(context.Background(), "orders.created", map[string]string{}); err != nil || matches == nil || len(matches) != 0 {
+		t.Fatalf("matches = %#v, %v", matches, err)
+	}
+	mock.ExpectQuery(`rule_correlation_record`).WillReturnRows(sqlmock.NewRows(correlationMatchRowColumns).
+		AddRow(5, "unpaid", "o2", "c", []byte(`{`), started, matched, nil))
+	if _, err := client.RecordCorrelationEvent(context.Background(), "orders.created", map[string]string{}); err == nil {
+		t.Fatal("expected an error for invalid events")
+	}
+}
+
+func TestPendingCorrelationMatches(t *testing.T) {
+	client, mock := newMock(t)
+	published := time.Date(2024, 1, 1, 10, 6, 0, 0, time.UTC)
+	mock.ExpectQuery(`WHERE published_at IS NULL AND matched_at < now\(\) - \$1::FLOAT8 \* INTERVAL '1 second'\s+ORDER BY matched_at LIMIT \$2`).
+		WithArgs(30.0, 100).
+		WillReturnRows(sqlmock.NewRows(correlationMatchRowColumns).
+			AddRow(4, "unpaid", "o1", "c", []byte(`[]`), published, published, published))
+	matches, err := client.PendingCorrelationMatches(context.Background(), 30*time.Second, 100)
+	if err != nil || len(matches) != 1 || matches[0].PublishedAt == nil || !matches[0].PublishedAt.Equal(published) {
+		t.Fatalf("matches = %+v, %v", matches, err)
+	}
+
+	mock.ExpectExec(`UPDATE rule_correlation_matches SET published_at = now\(\) WHERE id = \$1 AND published_at IS NULL`).
+		WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := client.MarkCorrelationPublished(context.Background(), 4); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPruneCorrelations(t *testing.T) {
+	client, mock := newMock(t)
+	mock.MatchExpectationsInOrder(true)
+	mock.ExpectQuery(`to_regclass\('rule_correlations'\)`).WillReturnRows(sqlmock.NewRows([]string{"installed"}).AddRow(false))
+	if n, err := client.PruneCorrelations(context.Background(), time.Hour); n != 0 || err != nil {
+		t.Fatalf("PruneCorrelations = %d, %v", n, err)
+	}
+	mock.ExpectQuery(`to_regclass\('rule_correlations'\)`).WillReturnRows(sqlmock.NewRows([]string{"installed"}).AddRow(true))
+	mock.ExpectQuery(`SELECT rule_correlation_prune\(\$1::FLOAT8 \* INTERVAL '1 second'\)`).WithArgs(3600.0).
+		WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(3))
+	if n, err := client.PruneCorrelations(context.Background(), time.Hour); n != 3 || err != nil {
+		t.Fatalf("PruneCorrelations = %d, %v", n, err)
+	}
+}
+
+func TestCorrelationsDB(t *testing.T) {
+	client := testDB(t)
+	ctx := context.Background()
+	if err := client.EnableCorrelations(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db := client.DB()
+	suffix := time.Now().Format("150405")
+	name := "unpaid_" + suffix
+	created, paid, failed := "orders."+suffix+".created", "payments."+suffix+".captured", "payments."+suffix+".failed"
+	if err := client.CreateCorrelation(ctx, Correlation{Name: name, Steps: []CorrelationStep{
+		{Subject: "orders." + suffix + ".created", KeyPath: "id"},
+		{Subject: "payments." + suffix + ".*", KeyPath: "order.id"},
+		{Subject: failed, KeyPath: "order_id"},
+	}, Within: 10 * time.Minute, EmitSubject: "composite.unpaid"}); err != nil {
+		t.Fatal(err)
+	}
+	defer client.DeleteCorrelation(ctx, name)
+
+	start := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name       string
+		subject    string
+		event      string
+		after      time.Duration // since start
+		wantKey    string        // key of the completed match, if any
+		wantEvents int
+	}{
+		{name: "later steps first start nothing", subject: failed, event: `{"order_id":"o1"}`},
+		{name: "first step", subject: created, event: `{"id":"o1"}`, after: time.Minute},
+		{name: "first step again keeps the running match", subject: created, event: `{"id":"o1","again":true}`, after: 2 * time.Minute},
+		{name: "other key", subject: paid, event: `{"order":{"id":"o2"}}`, after: 3 * time.Minute},
+		{name: "second step", subject: paid, event: `{"order":{"id":"o1"}}`, after: 4 * time.Minute},
+		{name: "last step", subject: failed, event: `{"order_id":"o1"}`, after: 5 * time.Minute, wantKey: "o1", wantEvents: 3},
+		{name: "expired match", subject: created, event: `{"id":"o3"}`, after: 6 * time.Minute},
+		{name: "too late", subject: paid, event: `{"order":{"id":"o3"}}`, after: 17 * time.Minute},
+	}
+	for _, tt := range tests {
+		rows, err := db.QueryContext(ctx, "SELECT "+correlationMatchColumns+" FROM rule_correlation_record($1, $2, $3)",
+			tt.subject, tt.event, start.Add(tt.after))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var keys []string
+		var events []byte
+		for rows.Next() {
+			var m CorrelationMatch
+			var published *time.Time
+			if err := rows.Scan(&m.ID, &m.Correlation, &m.Key, &m.EmitSubject, &events, &m.StartedAt, &m.MatchedAt, &published); err != nil {
+				t.Fatal(err)
+			}
+			if m.Correlation == name {
+				keys = append(keys, m.Key)
+				json.Unmarshal(events, &m.Events)
+				if len(m.Events) != tt.wantEvents || string(m.Events[0].Event) != `{"id": "o1"}` {
+					t.Errorf("%s: events = %s", tt.name, events)
+				}
+			}
+		}
+		rows.Close()
+		if tt.wantKey == "" && len(keys) != 0 || tt.wantKey != "" && !reflect.DeepEqual(keys, []string{tt.wantKey}) {
+			t.Errorf("%s: matched %v, want %q", tt.name, keys, tt.wantKey)
+		}
+	}
+
+	matches, err := client.ListCorrelationMatches(ctx, name, 10)
+	if err != nil || len(matches) != 1 || matches[0].PublishedAt != nil {
+		t.Fatalf("matches = %+v, %v", matches, err)
+	}
+	if err := client.MarkCorrelationPublished(ctx, matches[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	// The o3 partial match has expired and the match is published
+	if n, err := client.PruneCorrelations(ctx, 0); err != nil || n < 2 {
+		t.Fatalf("PruneCorrelations = %d, %v", n, err)
+	}
+}
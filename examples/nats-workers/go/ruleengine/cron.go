@@ -0,0 +1,220 @@
+package ruleengine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day
+// of month, month, and day of week, each a bit set of allowed values
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// A restricted day of month and day of week match when either does,
+	// as in Vixie cron
+	domAny, dowAny bool
+
+	// fixed is set when neither minute nor hour starts with *. Fixed
+	// times run once a day across DST changes; others follow real time.
+	fixed bool
+}
+
+// cronField is the valid range and value names of one field
+type cronField struct {
+	name     string
+	min, max int
+	names    []string // names[i] is min+i
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a standard five-field cron expression ("*/15 9-17 * *
+// mon-fri") or one of the @hourly, @daily, @weekly, @monthly, and @yearly
+// macros
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.ToLower(strings.TrimSpace(expr))
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("expected %d fields (minute hour day-of-month month day-of-week), got %d", len(cronFields), len(parts))
+	}
+
+	var bits [5]uint64
+	for i, part := range parts {
+		b, err := parseCronField(part, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = b
+	}
+	// Sunday may be written as 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &cronSchedule{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domAny: strings.HasPrefix(parts[2], "*"), dowAny: strings.HasPrefix(parts[4], "*"),
+		fixed: !strings.HasPrefix(parts[0], "*") && !strings.HasPrefix(parts[1], "*"),
+	}, nil
+}
+
+// parseCronField parses a comma-separated list of *, values, ranges, and
+// steps
+func parseCronField(text string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(text, ",") {
+		rangeText, step := item, 1
+		if i := strings.IndexByte(item, '/'); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("%s: invalid step in %q", f.name, item)
+			}
+			rangeText, step = item[:i], n
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case rangeText == "*":
+		case strings.Contains(rangeText, "-"):
+			bounds := strings.SplitN(rangeText, "-", 2)
+			var err error
+			if lo, err = cronValue(bounds[0], f); err != nil {
+				return 0, err
+			}
+			if hi, err = cronValue(bounds[1], f); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("%s: range %q is backwards", f.name, rangeText)
+			}
+		default:
+			v, err := cronValue(rangeText, f)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if step == 1 {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(text string, f cronField) (int, error) {
+	for i, name := range f.names {
+		if text == name {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(text)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s: %q is not between %d and %d", f.name, text, f.min, f.max)
+	}
+	return v, nil
+}
+
+// next returns the first time after t, in t's location, that matches the
+// schedule, or the zero time if none does within five years (e.g. Feb 30).
+// As in Vixie cron, a fixed time that a DST change skips runs when the
+// clock resumes, and one it repeats runs only the first time.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	// Truncating in absolute time keeps t in the right half of an hour
+	// that a DST change repeats, which time.Date would not
+	loc := t.Location()
+	prev := t.Truncate(time.Minute)
+	t = prev.Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.fixed && s.skipped(prev, t) {
+			return t
+		}
+		prev = t
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			prev = t
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			prev = t
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			if !next.After(t) {
+				// A DST change repeated the hour; step to the next hour in
+				// absolute time
+				next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			}
+			t = next
+		case s.minute&(1<<uint(t.Minute())) == 0, s.fixed && repeated(t):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// skipped reports whether the wall clock jumped past a matching minute
+// between prev and t, one hour or minute step apart
+func (s *cronSchedule) skipped(prev, t time.Time) bool {
+	gap := wallClock(t).Sub(wallClock(prev)) - t.Sub(prev)
+	if gap <= 0 || s.month&(1<<uint(t.Month())) == 0 || !s.dayMatches(t) {
+		return false
+	}
+	for m := wallClock(t).Add(-gap); m.Before(wallClock(t)); m = m.Add(time.Minute) {
+		if s.hour&(1<<uint(m.Hour())) != 0 && s.minute&(1<<uint(m.Minute())) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// repeated reports whether t's wall clock time already occurred before a
+// DST change set the clock back
+func repeated(t time.Time) bool {
+	_, offset := t.Zone()
+	_, before := t.Add(-time.Hour).Zone()
+	if before <= offset {
+		return false
+	}
+	return wallClock(t.Add(-time.Duration(before-offset) * time.Second)).Equal(wallClock(t))
+}
+
+// wallClock returns t's date and time of day as if in UTC, for comparing
+// wall clocks across offsets
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
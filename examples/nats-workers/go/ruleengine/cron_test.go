@@ -0,0 +1,213 @@
+package ruleengine
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// bits returns the bit set of values
+func bits(values ...int) uint64 {
+	var b uint64
+	for _, v := range values {
+		b |= 1 << uint(v)
+	}
+	return b
+}
+
+func TestParseCronField(t *testing.T) {
+	minute, hour, month, dow := cronFields[0], cronFields[1], cronFields[3], cronFields[4]
+	tests := []struct {
+		text    string
+		field   cronField
+		want    uint64
+		wantErr string
+	}{
+		{text: "*", field: hour, want: 1<<24 - 1},
+		{text: "7", field: hour, want: bits(7)},
+		{text: "*/15", field: minute, want: bits(0, 15, 30, 45)},
+		{text: "5/15", field: minute, want: bits(5, 20, 35, 50)},
+		{text: "1-10/3", field: minute, want: bits(1, 4, 7, 10)},
+		{text: "1,3,5-6", field: hour, want: bits(1, 3, 5, 6)},
+		{text: "22-23,0-1", field: hour, want: bits(22, 23, 0, 1)},
+		{text: "jan,mar-may", field: month, want: bits(1, 3, 4, 5)},
+		{text: "*/4", field: month, want: bits(1, 5, 9)},
+		{text: "mon-fri", field: dow, want: bits(1, 2, 3, 4, 5)},
+		{text: "sat,sun", field: dow, want: bits(6, 0)},
+		{text: "60", field: minute, wantErr: `minute: "60" is not between 0 and 59`},
+		{text: "24", field: hour, wantErr: `hour: "24" is not between 0 and 23`},
+		{text: "0", field: month, wantErr: "month"},
+		{text: "8", field: dow, wantErr: "day of week"},
+		{text: "5-1", field: hour, wantErr: `hour: range "5-1" is backwards`},
+		{text: "fri-sun", field: dow, wantErr: "backwards"},
+		{text: "*/0", field: minute, wantErr: `minute: invalid step in "*/0"`},
+		{text: "*/x", field: minute, wantErr: "invalid step"},
+		{text: "1-", field: minute, wantErr: `"" is not between`},
+		{text: "1-2-3", field: minute, wantErr: `"2-3" is not between`},
+		{text: "jan", field: minute, wantErr: `"jan" is not between`},
+		{text: "1,,2", field: minute, wantErr: `"" is not between`},
+	}
+	for _, tt := range tests {
+		got, err := parseCronField(tt.text, tt.field)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseCronField(%q) err = %v, want %q", tt.text, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseCronField(%q) = %b, %v; want %b", tt.text, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    cronSchedule
+		wantErr string
+	}{
+		{expr: "@daily", want: cronSchedule{minute: bits(0), hour: bits(0), dom: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31),
+			month: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12), dow: bits(0, 1, 2, 3, 4, 5, 6, 7), domAny: true, dowAny: true, fixed: true}},
+		{expr: "  @HOURLY ", want: cronSchedule{minute: bits(0), hour: 1<<24 - 1, dom: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31),
+			month: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12), dow: bits(0, 1, 2, 3, 4, 5, 6, 7), domAny: true, dowAny: true}},
+		// Sunday is 0 or 7
+		{expr: "0 12 1 * 7", want: cronSchedule{minute: bits(0), hour: bits(12), dom: bits(1),
+			month: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12), dow: bits(0, 7), fixed: true}},
+		{expr: "*/5 9 */2 JAN MON", want: cronSchedule{minute: bits(0, 5, 10, 15, 20, 25, 30, 35, 40, 45, 50, 55), hour: bits(9),
+			dom: bits(1, 3, 5, 7, 9, 11, 13, 15, 17, 19, 21, 23, 25, 27, 29, 31), month: bits(1), dow: bits(1), domAny: true}},
+		{expr: "", wantErr: "expected 5 fields (minute hour day-of-month month day-of-week), got 0"},
+		{expr: "* * * *", wantErr: "got 4"},
+		{expr: "* * * * * *", wantErr: "got 6"},
+		{expr: "@fortnightly", wantErr: "got 1"},
+		{expr: "* * 32 * *", wantErr: "day of month"},
+	}
+	for _, tt := range tests {
+		got, err := parseCron(tt.expr)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseCron(%q) err = %v, want %q", tt.expr, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || *got != tt.want {
+			t.Errorf("parseCron(%q) = %+v, %v; want %+v", tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		expr, after, want string // want "" for never
+	}{
+		{"0 * * * *", "2024-09-10 10:00:00", "2024-09-10 11:00:00"},
+		{"0 * * * *", "2024-09-10 10:00:30", "2024-09-10 11:00:00"},
+		{"30 * * * *", "2024-09-10 10:29:59", "2024-09-10 10:30:00"},
+		{"*/15 9-17 * * mon-fri", "2024-03-01 17:50:00", "2024-03-04 09:00:00"}, // Friday evening to Monday
+		{"*/15 9-17 * * mon-fri", "2024-03-04 09:00:00", "2024-03-04 09:15:00"},
+		{"0 0 1 */3 *", "2024-02-10 00:00:00", "2024-04-01 00:00:00"},
+		{"@yearly", "2024-06-01 00:00:00", "2025-01-01 00:00:00"},
+		{"0 12 * * 0", "2024-09-07 12:00:00", "2024-09-08 12:00:00"},
+		{"0 12 * * 7", "2024-09-07 12:00:00", "2024-09-08 12:00:00"},
+		{"59 23 31 12 *", "2024-12-31 23:59:00", "2025-12-31 23:59:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00:00", "2028-02-29 00:00:00"},
+		{"0 0 30 2 *", "2024-01-01 00:00:00", ""},
+		{"0 0 31 4 *", "2024-01-01 00:00:00", ""},
+		// Restricted day of month and day of week: either matches. The
+		// 13th (a Friday) comes before the next Monday.
+		{"0 12 13 * mon", "2024-09-10 00:00:00", "2024-09-13 12:00:00"},
+		{"0 12 13 * mon", "2024-09-13 12:00:00", "2024-09-16 12:00:00"},
+		// A day field starting with * restricts with AND: odd days that
+		// are Mondays
+		{"0 12 */2 * mon", "2024-09-01 00:00:00", "2024-09-09 12:00:00"},
+		{"0 12 1-7 * *", "2024-09-08 00:00:00", "2024-10-01 12:00:00"},
+		{"0 12 * * mon", "2024-09-03 00:00:00", "2024-09-09 12:00:00"},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := s.next(at(tt.after))
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q after %s = %s, want never", tt.expr, tt.after, got)
+			}
+			continue
+		}
+		if !got.Equal(at(tt.want)) {
+			t.Errorf("%q after %s = %s, want %s", tt.expr, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 2024-03-10 02:00 EST jumps to 03:00 EDT; 2024-11-03 02:00 EDT falls
+	// back to 01:00 EST. Berlin jumps from 02:00 to 03:00 on 2024-03-31.
+	est, edt := -5*3600, -4*3600
+	in := func(loc *time.Location, offset int, s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), 0, 0, time.FixedZone("", offset)).In(loc)
+	}
+	tests := []struct {
+		name        string
+		expr        string
+		after, want time.Time
+	}{
+		{"skipped fixed time runs when the clock resumes", "30 2 * * *",
+			in(newYork, est, "2024-03-10 01:00"), in(newYork, edt, "2024-03-10 03:00")},
+		{"and at its time the next day", "30 2 * * *",
+			in(newYork, edt, "2024-03-10 03:00"), in(newYork, edt, "2024-03-11 02:30")},
+		{"skipped during the first step", "30 2 * * *",
+			in(newYork, est, "2024-03-10 01:59"), in(newYork, edt, "2024-03-10 03:00")},
+		{"fixed time after the gap", "0 3 * * *",
+			in(newYork, est, "2024-03-10 01:00"), in(newYork, edt, "2024-03-10 03:00")},
+		{"wildcard hour follows real time", "30 * * * *",
+			in(newYork, est, "2024-03-10 01:45"), in(newYork, edt, "2024-03-10 03:30")},
+		{"skipped time on a day that does not match", "30 2 * * mon",
+			in(newYork, est, "2024-03-10 01:00"), in(newYork, edt, "2024-03-11 02:30")},
+		{"Berlin", "15 2 * * *",
+			in(berlin, 3600, "2024-03-31 00:00"), in(berlin, 7200, "2024-03-31 03:00")},
+		{"repeated fixed time runs once", "30 1 * * *",
+			in(newYork, edt, "2024-11-03 00:00"), in(newYork, edt, "2024-11-03 01:30")},
+		{"not again after the clock falls back", "30 1 * * *",
+			in(newYork, edt, "2024-11-03 01:30"), in(newYork, est, "2024-11-04 01:30")},
+		{"fixed time after the repeated hour", "0 2 * * *",
+			in(newYork, edt, "2024-11-03 01:30"), in(newYork, est, "2024-11-03 02:00")},
+		{"wildcard minute repeats with the hour", "*/30 1 * * *",
+			in(newYork, edt, "2024-11-03 01:30"), in(newYork, est, "2024-11-03 01:00")},
+		{"wildcard hour repeats", "0,30 * * * *",
+			in(newYork, edt, "2024-11-03 01:59"), in(newYork, est, "2024-11-03 01:00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.next(tt.after); !got.Equal(tt.want) {
+				t.Fatalf("%q after %s = %s, want %s", tt.expr, tt.after, got, tt.want)
+			}
+		})
+	}
+}
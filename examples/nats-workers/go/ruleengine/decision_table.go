@@ -0,0 +1,362 @@
+package ruleengine
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Hit policies for decision tables
+const (
+	// HitFirst applies only the first matching row, in table order
+	HitFirst = "first"
+
+	// HitAll applies every matching row, in table order; later rows
+	// overwrite values set by earlier ones
+	HitAll = "all"
+)
+
+// DecisionTable is a spreadsheet-style rule: each row is a rule whose
+// condition columns must all match for its action columns to be assigned.
+//
+// The header row names the columns:
+//
+//	when Customer.Tier | when Order.Amount >= | then Order.Discount | description
+//
+// "when <path>" columns hold conditions ("gold", ">= 100", "100..500",
+// "gold, silver"; empty, "-" or "*" match anything). A header with an
+// operator ("when Order.Amount >=") makes each cell the right-hand side.
+// "then <path>" columns hold the value to assign, or "=<GRL expression>";
+// empty cells assign nothing. An optional "description" column labels the
+// row's rule.
+type DecisionTable struct {
+	Name       string
+	HitPolicy  string // HitFirst (default) or HitAll
+	Conditions []TableColumn
+	Actions    []TableColumn
+	Rows       []DecisionRow
+}
+
+// TableColumn is a condition or action column
+type TableColumn struct {
+	Path     string
+	Operator string // Condition columns only; empty when cells carry it
+}
+
+// DecisionRow is one row of a decision table
+type DecisionRow struct {
+	Line        int // Spreadsheet row number, used in rule names and errors
+	Description string
+	Conditions  []string
+	Actions     []string
+}
+
+var (
+	factPathPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)+$`)
+	operators       = []string{">=", "<=", "!=", "==", ">", "<", "="}
+)
+
+// ParseDecisionTableCSV reads a decision table from CSV, header row first
+func ParseDecisionTableCSV(name string, r io.Reader) (*DecisionTable, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	return NewDecisionTable(name, records)
+}
+
+// NewDecisionTable builds a table from rows of cells, header row first.
+// Blank rows are skipped.
+func NewDecisionTable(name string, records [][]string) (*DecisionTable, error) {
+	if err := validateRuleName(name); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, &ValidationError{Field: "table", Message: "is empty"}
+	}
+
+	t := &DecisionTable{Name: name, HitPolicy: HitFirst}
+	type colRef struct {
+		kind  byte // 'w', 't', or 'd'
+		index int
+	}
+	var cols []colRef
+	for i, cell := range records[0] {
+		header := strings.TrimSpace(cell)
+		lower := strings.ToLower(header)
+		switch {
+		case header == "":
+			cols = append(cols, colRef{})
+		case strings.HasPrefix(lower, "when "):
+			col, err := parseConditionHeader(strings.TrimSpace(header[5:]))
+			if err != nil {
+				return nil, fmt.Errorf("column %d: %w", i+1, err)
+			}
+			cols = append(cols, colRef{'w', len(t.Conditions)})
+			t.Conditions = append(t.Conditions, col)
+		case strings.HasPrefix(lower, "then "):
+			path := strings.TrimSpace(header[5:])
+			if !factPathPattern.MatchString(path) {
+				return nil, &ValidationError{Field: "header", Message: fmt.Sprintf("column %d: %q is not a fact path like Order.Discount", i+1, path)}
+			}
+			cols = append(cols, colRef{'t', len(t.Actions)})
+			t.Actions = append(t.Actions, TableColumn{Path: path})
+		case lower == "description" || lower == "rule":
+			cols = append(cols, colRef{'d', 0})
+		default:
+			return nil, &ValidationError{Field: "header", Message: fmt.Sprintf("column %d: %q must start with \"when \" or \"then \", or be \"description\"", i+1, header)}
+		}
+	}
+	if len(t.Actions) == 0 {
+		return nil, &ValidationError{Field: "header", Message: "needs at least one \"then <path>\" column"}
+	}
+
+	for n, record := range records[1:] {
+		row := DecisionRow{
+			Line:       n + 2,
+			Conditions: make([]string, len(t.Conditions)),
+			Actions:    make([]string, len(t.Actions)),
+		}
+		blank := true
+		for i, cell := range record {
+			if i >= len(cols) {
+				break
+			}
+			cell = strings.TrimSpace(cell)
+			if cell != "" {
+				blank = false
+			}
+			switch cols[i].kind {
+			case 'w':
+				row.Conditions[cols[i].index] = cell
+			case 't':
+				row.Actions[cols[i].index] = cell
+			case 'd':
+				row.Description = cell
+			}
+		}
+		if !blank {
+			t.Rows = append(t.Rows, row)
+		}
+	}
+	if len(t.Rows) == 0 {
+		return nil, &ValidationError{Field: "table", Message: "has no rows"}
+	}
+	return t, nil
+}
+
+func parseConditionHeader(header string) (TableColumn, error) {
+	col := TableColumn{Path: header}
+	for _, op := range operators {
+		if strings.HasSuffix(header, op) {
+			col = TableColumn{Path: strings.TrimSpace(strings.TrimSuffix(header, op)), Operator: normalizeOperator(op)}
+			break
+		}
+	}
+	if !factPathPattern.MatchString(col.Path) {
+		return col, &ValidationError{Field: "header", Message: fmt.Sprintf("%q is not a fact path like Order.Amount", col.Path)}
+	}
+	return col, nil
+}
+
+func normalizeOperator(op string) string {
+	if op == "=" {
+		return "=="
+	}
+	return op
+}
+
+// CompileGRL translates the table into one GRL document with a rule per
+// row, named <table>_<line>. Rows run in table order (descending salience).
+func (t *DecisionTable) CompileGRL() (string, error) {
+	policy := t.HitPolicy
+	if policy == "" {
+		policy = HitFirst
+	}
+	if policy != HitFirst && policy != HitAll {
+		return "", &ValidationError{Field: "hit_policy", Message: "must be first or all"}
+	}
+
+	names := make([]string, len(t.Rows))
+	for i, row := range t.Rows {
+		names[i] = fmt.Sprintf("%s_%d", t.Name, row.Line)
+	}
+
+	var b strings.Builder
+	for i, row := range t.Rows {
+		var conds []string
+		for j, cell := range row.Conditions {
+			cond, err := compileCondition(t.Conditions[j], cell)
+			if err != nil {
+				return "", fmt.Errorf("row %d, %s: %w", row.Line, t.Conditions[j].Path, err)
+			}
+			if cond != "" {
+				conds = append(conds, cond)
+			}
+		}
+		when := "true"
+		if len(conds) > 0 {
+			when = strings.Join(conds, " && ")
+		}
+
+		var then []string
+		for j, cell := range row.Actions {
+			if cell == "" {
+				continue
+			}
+			value, err := compileValue(cell)
+			if err != nil {
+				return "", fmt.Errorf("row %d, %s: %w", row.Line, t.Actions[j].Path, err)
+			}
+			then = append(then, fmt.Sprintf("%s = %s;", t.Actions[j].Path, value))
+		}
+		// Retract stops a rule re-firing on its own assignments; with
+		// first-hit, later rows are retracted too
+		then = append(then, fmt.Sprintf("Retract(%q);", names[i]))
+		if policy == HitFirst {
+			for _, later := range names[i+1:] {
+				then = append(then, fmt.Sprintf("Retract(%q);", later))
+			}
+		}
+
+		description := row.Description
+		if description == "" {
+			description = fmt.Sprintf("%s row %d", t.Name, row.Line)
+		}
+		fmt.Fprintf(&b, "rule %s %s salience %d {\n    when\n        %s\n    then\n", names[i], strconv.Quote(description), len(t.Rows)-i, when)
+		for _, stmt := range then {
+			fmt.Fprintf(&b, "        %s\n", stmt)
+		}
+		b.WriteString("}\n\n")
+	}
+	return strings.TrimRight(b.String(), "\n") + "\n", nil
+}
+
+// compileCondition turns one cell into a GRL boolean expression ("" for a
+// wildcard)
+func compileCondition(col TableColumn, cell string) (string, error) {
+	if cell == "" || cell == "-" || cell == "*" {
+		return "", nil
+	}
+	if col.Operator != "" {
+		value, err := compileLiteral(cell)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %s", col.Path, col.Operator, value), nil
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(cell, op) {
+			value, err := compileLiteral(strings.TrimSpace(cell[len(op):]))
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s %s %s", col.Path, normalizeOperator(op), value), nil
+		}
+	}
+
+	if lo, hi, ok := strings.Cut(cell, ".."); ok {
+		low, err1 := strconv.ParseFloat(strings.TrimSpace(lo), 64)
+		high, err2 := strconv.ParseFloat(strings.TrimSpace(hi), 64)
+		if err1 != nil || err2 != nil {
+			return "", errors.New("ranges must be numeric, like 100..500")
+		}
+		return fmt.Sprintf("(%s >= %s && %s <= %s)", col.Path, formatNumber(low), col.Path, formatNumber(high)), nil
+	}
+
+	if !strings.HasPrefix(cell, `"`) && strings.Contains(cell, ",") {
+		var alts []string
+		for _, part := range strings.Split(cell, ",") {
+			value, err := compileLiteral(strings.TrimSpace(part))
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, fmt.Sprintf("%s == %s", col.Path, value))
+		}
+		return "(" + strings.Join(alts, " || ") + ")", nil
+	}
+
+	value, err := compileLiteral(cell)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s == %s", col.Path, value), nil
+}
+
+// compileValue turns an action cell into a GRL expression
+func compileValue(cell string) (string, error) {
+	if expr := strings.TrimPrefix(cell, "="); expr != cell {
+		expr = strings.TrimSpace(expr)
+		if expr == "" || strings.ContainsAny(expr, ";{}") {
+			return "", fmt.Errorf("invalid expression %q", cell)
+		}
+		return expr, nil
+	}
+	return compileLiteral(cell)
+}
+
+// compileLiteral renders a cell as a GRL number, boolean, or string
+func compileLiteral(cell string) (string, error) {
+	if cell == "" {
+		return "", errors.New("missing value")
+	}
+	if unquoted, err := strconv.Unquote(cell); err == nil && strings.HasPrefix(cell, `"`) {
+		return strconv.Quote(unquoted), nil
+	}
+	if n, err := strconv.ParseFloat(cell, 64); err == nil {
+		return formatNumber(n), nil
+	}
+	switch strings.ToLower(cell) {
+	case "true", "false":
+		return strings.ToLower(cell), nil
+	}
+	return strconv.Quote(cell), nil
+}
+
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// ImportDecisionTable compiles t and saves it as rule t.Name: created when
+// new, otherwise saved as a new active version. notes become the version's
+// change notes.
+func (c *Client) ImportDecisionTable(ctx context.Context, t *DecisionTable, notes string) (*Rule, error) {
+	grl, err := t.CompileGRL()
+	if err != nil {
+		return nil, err
+	}
+	in := SaveRuleInput{
+		Name:        t.Name,
+		GRL:         grl,
+		Description: fmt.Sprintf("Decision table %s (%d rows, %s hit)", t.Name, len(t.Rows), orDefault(t.HitPolicy, HitFirst)),
+		ChangeNotes: notes,
+	}
+	return c.saveGenerated(ctx, in)
+}
+
+// saveGenerated creates a rule from generated GRL, or saves it as a new
+// active version when the rule exists
+func (c *Client) saveGenerated(ctx context.Context, in SaveRuleInput) (*Rule, error) {
+	in.Activate = true
+	rule, err := c.CreateRule(ctx, in)
+	if errors.Is(err, ErrRuleExists) {
+		return c.UpdateRule(ctx, in)
+	}
+	return rule, err
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
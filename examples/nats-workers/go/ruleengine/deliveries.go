@@ -0,0 +1,285 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine/envelope"
+)
+
+// Delivery is one webhook call recorded in rule_webhook_calls
+type Delivery struct {
+	ID             int             `json:"id"`
+	WebhookID      int             `json:"webhook_id"`
+	Status         string          `json:"status"`
+	Rule           string          `json:"rule,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+	RetryCount     int             `json:"retry_count"`
+	ResponseStatus *int            `json:"response_status,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	DurationMs     *float64        `json:"duration_ms,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	CompletedAt    *time.Time      `json:"completed_at,omitempty"`
+}
+
+// DeliveryFilter narrows ListDeliveries. Zero values match everything.
+type DeliveryFilter struct {
+	WebhookID int
+	Status    string // pending, processing, success, failed, retrying
+	Limit     int    // Default 100, at most 1000
+}
+
+// ListDeliveries returns recent webhook deliveries, newest first
+func (c *Client) ListDeliveries(ctx context.Context, filter DeliveryFilter) ([]Delivery, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	if filter.Limit > 1000 {
+		filter.Limit = 1000
+	}
+
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT call_id, webhook_id, status, COALESCE(rule_name, ''), payload,
+		        retry_count, response_status, COALESCE(error_message, ''),
+		        execution_time_ms, created_at, completed_at
+		 FROM rule_webhook_calls
+		 WHERE ($1 = 0 OR webhook_id = $1)
+		   AND ($2 = '' OR status = $2)
+		 ORDER BY created_at DESC, call_id DESC
+		 LIMIT $3`,
+		filter.WebhookID, filter.Status, filter.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		var payload []byte
+		var status sql.NullInt64
+		var duration sql.NullFloat64
+		var completed sql.NullTime
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Status, &d.Rule, &payload,
+			&d.RetryCount, &status, &d.Error, &duration, &d.CreatedAt, &completed); err != nil {
+			return nil, err
+		}
+		d.Payload = payload
+		if status.Valid {
+			s := int(status.Int64)
+			d.ResponseStatus = &s
+		}
+		if duration.Valid {
+			d.DurationMs = &duration.Float64
+		}
+		if completed.Valid {
+			d.CompletedAt = &completed.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// ConsumerStats is the last reported state of a NATS consumer
+type ConsumerStats struct {
+	Stream              string     `json:"stream"`
+	Consumer            string     `json:"consumer"`
+	QueueGroup          string     `json:"queue_group,omitempty"`
+	Delivered           int64      `json:"messages_delivered"`
+	Acknowledged        int64      `json:"messages_acknowledged"`
+	Pending             int64      `json:"messages_pending"`
+	Redelivered         int64      `json:"messages_redelivered"`
+	Failed              int64      `json:"messages_failed"`
+	Expired             int64      `json:"messages_expired"`
+	AvgProcessingTimeMs *float64   `json:"avg_processing_time_ms,omitempty"`
+	LastActiveAt        *time.Time `json:"last_active_at,omitempty"`
+	LagSampledAt        *time.Time `json:"lag_sampled_at,omitempty"`
+	Active              bool       `json:"active"`
+}
+
+// ListConsumerStats returns the statistics reported by NATS workers
+func (c *Client) ListConsumerStats(ctx context.Context) ([]ConsumerStats, error) {
+	rows, err := c.ops().QueryContext(ctx,
+		`SELECT stream_name, consumer_name, COALESCE(queue_group, ''),
+		        COALESCE(messages_delivered, 0), COALESCE(messages_acknowledged, 0),
+		        COALESCE(messages_pending, 0), COALESCE(messages_redelivered, 0),
+		        COALESCE(messages_failed, 0), COALESCE(messages_expired, 0), avg_processing_time_ms,
+		        last_active_at, lag_sampled_at, COALESCE(active, false)
+		 FROM rule_nats_consumer_stats
+		 ORDER BY stream_name, consumer_name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []ConsumerStats{}
+	for rows.Next() {
+		var s ConsumerStats
+		var avg sql.NullFloat64
+		var lastActive, sampled sql.NullTime
+		if err := rows.Scan(&s.Stream, &s.Consumer, &s.QueueGroup,
+			&s.Delivered, &s.Acknowledged, &s.Pending, &s.Redelivered, &s.Failed, &s.Expired,
+			&avg, &lastActive, &sampled, &s.Active); err != nil {
+			return nil, err
+		}
+		if avg.Valid {
+			s.AvgProcessingTimeMs = &avg.Float64
+		}
+		if lastActive.Valid {
+			s.LastActiveAt = &lastActive.Time
+		}
+		if sampled.Valid {
+			s.LagSampledAt = &sampled.Time
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// DestinationHealth is the latest health check of a webhook destination
+// (rule_webhook_health), probed by NATS workers
+type DestinationHealth struct {
+	WebhookID           int       `json:"webhook_id"`
+	Name                string    `json:"webhook_name"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Detail              string    `json:"detail,omitempty"`
+	LatencyMs           *int      `json:"latency_ms,omitempty"`
+	CheckedAt           time.Time `json:"checked_at"`
+	ChangedAt           time.Time `json:"changed_at"` // when Healthy last flipped
+}
+
+// ListDestinationHealth returns the health of every probed destination,
+// unhealthy ones first
+func (c *Client) ListDestinationHealth(ctx context.Context) ([]DestinationHealth, error) {
+	rows, err := c.ops().QueryContext(ctx,
+		`SELECT webhook_id, webhook_name, healthy, consecutive_failures,
+		        COALESCE(detail, ''), latency_ms, checked_at, changed_at
+		 FROM rule_webhook_health
+		 ORDER BY healthy, webhook_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	health := []DestinationHealth{}
+	for rows.Next() {
+		var h DestinationHealth
+		var latency sql.NullInt64
+		if err := rows.Scan(&h.WebhookID, &h.Name, &h.Healthy, &h.ConsecutiveFailures,
+			&h.Detail, &latency, &h.CheckedAt, &h.ChangedAt); err != nil {
+			return nil, err
+		}
+		if latency.Valid {
+			ms := int(latency.Int64)
+			h.LatencyMs = &ms
+		}
+		health = append(health, h)
+	}
+	return health, rows.Err()
+}
+
+// ExpiredMessage is a NATS message the worker skipped because it was
+// dequeued after its deadline (rule_nats_expired_messages)
+type ExpiredMessage struct {
+	ID             int64           `json:"id"`
+	Stream         string          `json:"stream"`
+	Consumer       string          `json:"consumer"`
+	Subject        string          `json:"subject"`
+	StreamSequence *int64          `json:"stream_sequence,omitempty"`
+	WebhookURL     string          `json:"webhook_url,omitempty"`
+	PublishedAt    *time.Time      `json:"published_at,omitempty"`
+	ExpiresAt      time.Time       `json:"expires_at"`
+	ExpiredAt      time.Time       `json:"expired_at"`
+	Payload        json.RawMessage `json:"payload"`
+	Encrypted      bool            `json:"encrypted,omitempty"` // Payload is still an envelope; see SetPayloadSealer
+	ReplayedAt     *time.Time      `json:"replayed_at,omitempty"`
+	ReplayCount    int             `json:"replay_count,omitempty"`
+	TraceID        string          `json:"trace_id,omitempty"` // X-Request-Id the worker logged it under
+}
+
+// ExpiredFilter narrows ListExpiredMessages. Zero values match everything.
+type ExpiredFilter struct {
+	Stream   string
+	Consumer string
+	TraceID  string
+	Limit    int // Default 100, at most 1000
+}
+
+// ListExpiredMessages returns expired messages, newest first. Encrypted
+// payloads are decrypted with the client's payload sealer when one is set.
+func (c *Client) ListExpiredMessages(ctx context.Context, filter ExpiredFilter) ([]ExpiredMessage, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	if filter.Limit > 1000 {
+		filter.Limit = 1000
+	}
+
+	rows, err := c.ops().QueryContext(ctx,
+		`SELECT expired_id, stream_name, consumer_name, subject, stream_sequence,
+		        COALESCE(webhook_url, ''), published_at, expires_at, expired_at, payload,
+		        replayed_at, replay_count, COALESCE(trace_id, '')
+		 FROM rule_nats_expired_messages
+		 WHERE ($1 = '' OR stream_name = $1)
+		   AND ($2 = '' OR consumer_name = $2)
+		   AND ($4 = '' OR trace_id = $4)
+		 ORDER BY expired_at DESC, expired_id DESC
+		 LIMIT $3`,
+		filter.Stream, filter.Consumer, filter.Limit, filter.TraceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []ExpiredMessage{}
+	for rows.Next() {
+		var m ExpiredMessage
+		var payload []byte
+		var sequence sql.NullInt64
+		var published, replayed sql.NullTime
+		if err := rows.Scan(&m.ID, &m.Stream, &m.Consumer, &m.Subject, &sequence,
+			&m.WebhookURL, &published, &m.ExpiresAt, &m.ExpiredAt, &payload,
+			&replayed, &m.ReplayCount, &m.TraceID); err != nil {
+			return nil, err
+		}
+		if sequence.Valid {
+			m.StreamSequence = &sequence.Int64
+		}
+		if published.Valid {
+			m.PublishedAt = &published.Time
+		}
+		if replayed.Valid {
+			m.ReplayedAt = &replayed.Time
+		}
+		m.Payload, m.Encrypted, err = c.openPayload(ctx, payload)
+		if err != nil {
+			return nil, fmt.Errorf("expired message %d: %w", m.ID, err)
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// openPayload decrypts an enveloped payload with the client's sealer.
+// Without a sealer the envelope is returned as is and encrypted is true.
+func (c *Client) openPayload(ctx context.Context, payload []byte) (json.RawMessage, bool, error) {
+	if !envelope.IsSealed(payload) {
+		return payload, false, nil
+	}
+	if c.sealer == nil {
+		return payload, true, nil
+	}
+	plain, err := c.sealer.Open(ctx, payload)
+	if err != nil {
+		return nil, true, err
+	}
+	return plain, false, nil
+}
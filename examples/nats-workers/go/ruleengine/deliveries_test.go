@@ -0,0 +1,44 @@
+package ruleengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestListExpiredMessages(t *testing.T) {
+	columns := []string{"expired_id", "stream_name", "consumer_name", "subject", "stream_sequence", "webhook_url",
+		"published_at", "expires_at", "expired_at", "payload", "replayed_at", "replay_count", "trace_id"}
+	tests := []struct {
+		name      string
+		filter    ExpiredFilter
+		wantLimit int
+	}{
+		{name: "defaults", wantLimit: 100},
+		{name: "by trace ID", filter: ExpiredFilter{TraceID: "0af7651916cd43dd8448eb211c80319c"}, wantLimit: 100},
+		{name: "limit is capped", filter: ExpiredFilter{Stream: "RULES", Consumer: "webhooks", Limit: 5000}, wantLimit: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mock := newMock(t)
+			now := time.Now()
+			mock.ExpectQuery(`FROM rule_nats_expired_messages`).
+				WithArgs(tt.filter.Stream, tt.filter.Consumer, tt.wantLimit, tt.filter.TraceID).
+				WillReturnRows(sqlmock.NewRows(columns).
+					AddRow(7, "RULES", "webhooks", "rules.orders", 42, "", nil, now, now, []byte(`{"id":1}`), nil, 0, "0af7651916cd43dd8448eb211c80319c"))
+			messages, err := c.ListExpiredMessages(context.Background(), tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 1 || messages[0].TraceID != "0af7651916cd43dd8448eb211c80319c" || *messages[0].StreamSequence != 42 ||
+				string(messages[0].Payload) != `{"id":1}` || messages[0].PublishedAt != nil {
+				t.Fatalf("messages = %+v", messages)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package ruleengine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DeliveryHours are the times of the week a webhook accepts deliveries, in
+// its own time zone, e.g. "mon-fri 08:00-20:00, sat 10:00-14:00". NATS
+// workers hold messages that arrive outside them until the next window
+// opens.
+type DeliveryHours struct {
+	loc     *time.Location
+	windows []deliveryWindow
+}
+
+// deliveryWindow is one daily window on a set of weekdays
+type deliveryWindow struct {
+	days       uint8 // bit per weekday, Sunday = 0
+	start, end int   // minutes after midnight; end <= start runs past midnight
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseDeliveryHours parses comma-separated windows of an optional day or
+// day range (every day if omitted) and a time range, evaluated in the IANA
+// time zone (UTC if empty). A window ending at or before its start, such as
+// 22:00-06:00, runs past midnight; 00:00-24:00 is the whole day.
+func ParseDeliveryHours(spec, timezone string) (*DeliveryHours, error) {
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, &ValidationError{Field: "timezone", Message: fmt.Sprintf("unknown time zone %q", timezone)}
+	}
+	h := &DeliveryHours{loc: loc}
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.Fields(strings.ToLower(part))
+		w := deliveryWindow{days: 0x7f}
+		switch len(fields) {
+		case 1:
+		case 2:
+			if w.days, err = parseWeekdays(fields[0]); err != nil {
+				return nil, err
+			}
+			fields = fields[1:]
+		default:
+			return nil, &ValidationError{Field: "delivery_hours", Message: fmt.Sprintf("%q is not [days] HH:MM-HH:MM", strings.TrimSpace(part))}
+		}
+		from, to, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			return nil, &ValidationError{Field: "delivery_hours", Message: fmt.Sprintf("%q is not a time range", fields[0])}
+		}
+		if w.start, err = parseClock(from, false); err != nil {
+			return nil, err
+		}
+		if w.end, err = parseClock(to, true); err != nil {
+			return nil, err
+		}
+		if w.start == w.end {
+			return nil, &ValidationError{Field: "delivery_hours", Message: fmt.Sprintf("%q is empty; use 00:00-24:00 for the whole day", fields[0])}
+		}
+		h.windows = append(h.windows, w)
+	}
+	return h, nil
+}
+
+// parseWeekdays parses a day name or a range of them, which may wrap
+// (fri-mon)
+func parseWeekdays(s string) (uint8, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		to = from
+	}
+	first, last := weekdayIndex(from), weekdayIndex(to)
+	if first < 0 || last < 0 {
+		return 0, &ValidationError{Field: "delivery_hours", Message: fmt.Sprintf("%q is not a day or range of days like mon-fri", s)}
+	}
+	var days uint8
+	for d := first; ; d = (d + 1) % 7 {
+		days |= 1 << d
+		if d == last {
+			return days, nil
+		}
+	}
+}
+
+func weekdayIndex(name string) int {
+	for i, n := range weekdayNames {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseClock parses HH:MM into minutes after midnight; 24:00 only ends a
+// range
+func parseClock(s string, end bool) (int, error) {
+	var hour, minute int
+	if n, err := fmt.Sscanf(s, "%d:%d", &hour, &minute); err != nil || n != 2 || len(s) != 5 ||
+		hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && (minute != 0 || !end)) {
+		return 0, &ValidationError{Field: "delivery_hours", Message: fmt.Sprintf("%q is not a time like 08:00", s)}
+	}
+	return hour*60 + minute, nil
+}
+
+// Open reports whether t falls in a window and, if not, when the next
+// window opens
+func (h *DeliveryHours) Open(t time.Time) (bool, time.Time) {
+	local := t.In(h.loc)
+	year, month, day := local.Date()
+	var next time.Time
+	// Yesterday's window may run past midnight; every window recurs
+	// within a week
+	for offset := -1; offset <= 7; offset++ {
+		weekday := time.Date(year, month, day+offset, 12, 0, 0, 0, h.loc).Weekday()
+		for _, w := range h.windows {
+			if w.days&(1<<weekday) == 0 {
+				continue
+			}
+			end := w.end
+			if end <= w.start {
+				end += 24 * 60
+			}
+			start := time.Date(year, month, day+offset, 0, w.start, 0, 0, h.loc)
+			if !t.Before(start) && t.Before(time.Date(year, month, day+offset, 0, end, 0, 0, h.loc)) {
+				return true, time.Time{}
+			}
+			if start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+	}
+	return false, next
+}
+
+// SetDeliveryHours limits deliveries to a webhook to hours (see
+// ParseDeliveryHours) in timezone; empty hours delivers at any time. The
+// columns are added by the NATS worker's schema, and workers see the
+// change within 30 seconds.
+func (c *Client) SetDeliveryHours(ctx context.Context, webhookID int, hours, timezone string) error {
+	if hours != "" {
+		if _, err := ParseDeliveryHours(hours, timezone); err != nil {
+			return err
+		}
+	} else {
+		timezone = ""
+	}
+	res, err := c.db.ExecContext(ctx,
+		`UPDATE rule_webhooks SET delivery_hours = NULLIF($2, ''), delivery_timezone = NULLIF($3, '')
+		 WHERE webhook_id = $1`,
+		webhookID, hours, timezone,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%d: %w", webhookID, ErrWebhookNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseDeliveryHours(t *testing.T) {
+	tests := []struct {
+		spec, timezone string
+		wantErr        string
+	}{
+		{spec: "mon-fri 08:00-20:00, sat 10:00-14:00", timezone: "Europe/Berlin"},
+		{spec: "22:00-06:00"},
+		{spec: "fri-mon 00:00-24:00", timezone: "UTC"},
+		{spec: "SUN 09:30-12:00"},
+		{spec: "08:00-20:00", timezone: "Mars/Olympus", wantErr: `invalid timezone: unknown time zone "Mars/Olympus"`},
+		{spec: "weekdays 08:00-20:00", wantErr: `invalid delivery_hours: "weekdays" is not a day or range of days like mon-fri`},
+		{spec: "mon-fri", wantErr: `invalid delivery_hours: "mon" is not a time like 08:00`},
+		{spec: "mon 08:00 20:00", wantErr: `invalid delivery_hours: "mon 08:00 20:00" is not [days] HH:MM-HH:MM`},
+		{spec: "8:00-20:00", wantErr: `invalid delivery_hours: "8:00" is not a time like 08:00`},
+		{spec: "08:00-20:60", wantErr: `invalid delivery_hours: "20:60" is not a time like 08:00`},
+		{spec: "24:00-06:00", wantErr: `invalid delivery_hours: "24:00" is not a time like 08:00`},
+		{spec: "08:00-08:00", wantErr: `invalid delivery_hours: "08:00-08:00" is empty; use 00:00-24:00 for the whole day`},
+		{spec: "", wantErr: `invalid delivery_hours: "" is not [days] HH:MM-HH:MM`},
+	}
+	for _, tt := range tests {
+		_, err := ParseDeliveryHours(tt.spec, tt.timezone)
+		var verr *ValidationError
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+		} else if tt.wantErr != "" && (!errors.As(err, &verr) || err.Error() != tt.wantErr) {
+			t.Errorf("%q: err = %v, want %q", tt.spec, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDeliveryHoursOpen(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	tests := []struct {
+		name     string
+		spec     string
+		at       time.Time
+		want     bool
+		wantNext time.Time
+	}{
+		{name: "inside", spec: "mon-fri 08:00-20:00", at: time.Date(2024, 1, 3, 12, 0, 0, 0, berlin), want: true},
+		{name: "opens at the start", spec: "mon-fri 08:00-20:00", at: time.Date(2024, 1, 3, 8, 0, 0, 0, berlin), want: true},
+		{name: "closed at the end", spec: "mon-fri 08:00-20:00", at: time.Date(2024, 1, 3, 20, 0, 0, 0, berlin),
+			wantNext: time.Date(2024, 1, 4, 8, 0, 0, 0, berlin)},
+		{name: "weekend waits for monday", spec: "mon-fri 08:00-20:00, sat 10:00-14:00", at: time.Date(2024, 1, 6, 15, 0, 0, 0, berlin),
+			wantNext: time.Date(2024, 1, 8, 8, 0, 0, 0, berlin)},
+		{name: "saturday window", spec: "mon-fri 08:00-20:00, sat 10:00-14:00", at: time.Date(2024, 1, 6, 9, 0, 0, 0, berlin),
+			wantNext: time.Date(2024, 1, 6, 10, 0, 0, 0, berlin)},
+		{name: "evaluated in the webhook's zone", spec: "mon-fri 08:00-20:00", at: time.Date(2024, 1, 3, 7, 30, 0, 0, time.UTC), want: true},
+		{name: "across a clock change", spec: "mon-fri 08:00-20:00", at: time.Date(2024, 3, 29, 21, 0, 0, 0, berlin),
+			wantNext: time.Date(2024, 4, 1, 6, 0, 0, 0, time.UTC)},
+		{name: "past midnight from yesterday", spec: "sat 22:00-06:00", at: time.Date(2024, 1, 7, 5, 0, 0, 0, berlin), want: true},
+		{name: "after an overnight window", spec: "sat 22:00-06:00", at: time.Date(2024, 1, 7, 6, 0, 0, 0, berlin),
+			wantNext: time.Date(2024, 1, 13, 22, 0, 0, 0, berlin)},
+		{name: "wrapping day range", spec: "fri-mon 00:00-24:00", at: time.Date(2024, 1, 7, 23, 59, 0, 0, berlin), want: true},
+		{name: "outside a wrapping day range", spec: "fri-mon 00:00-24:00", at: time.Date(2024, 1, 3, 12, 0, 0, 0, berlin),
+			wantNext: time.Date(2024, 1, 5, 0, 0, 0, 0, berlin)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ParseDeliveryHours(tt.spec, "Europe/Berlin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			open, next := h.Open(tt.at)
+			if open != tt.want || !next.Equal(tt.wantNext) {
+				t.Fatalf("Open = %v, %s, want %v, %s", open, next, tt.want, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestSetDeliveryHours(t *testing.T) {
+	tests := []struct {
+		name, hours, timezone string
+		wantTimezone          string
+		rows                  int64
+		wantErr               string
+	}{
+		{name: "set", hours: "mon-fri 08:00-20:00", timezone: "Europe/Berlin", wantTimezone: "Europe/Berlin", rows: 1},
+		{name: "clear drops the zone", timezone: "Europe/Berlin", rows: 1},
+		{name: "invalid", hours: "always", wantErr: `invalid delivery_hours: "always" is not a time range`},
+		{name: "unknown webhook", hours: "08:00-20:00", wantErr: "3: webhook not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mock := newMock(t)
+			if tt.rows > 0 || tt.wantErr == "3: webhook not found" {
+				mock.ExpectExec(`UPDATE rule_webhooks SET delivery_hours = NULLIF\(\$2, ''\), delivery_timezone = NULLIF\(\$3, ''\)`).
+					WithArgs(3, tt.hours, tt.wantTimezone).WillReturnResult(sqlmock.NewResult(0, tt.rows))
+			}
+			err := c.SetDeliveryHours(context.Background(), 3, tt.hours, tt.timezone)
+			if (tt.wantErr == "" && err != nil) || (tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,570 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrGraphNodeNotFound is returned by Impact for a target the graph does
+// not contain
+var ErrGraphNodeNotFound = errors.New("not found in the dependency graph")
+
+// Node kinds of a DependencyGraph
+const (
+	NodeRule        = "rule"
+	NodeRuleSet     = "ruleset"
+	NodeField       = "field"       // a fact field such as Order.Amount
+	NodeTable       = "table"       // a table whose rows trigger rules or feed a match view
+	NodeDestination = "destination" // a webhook or worker action
+	NodeMatchView   = "matview"
+)
+
+// Edge kinds of a DependencyGraph, read as "From <kind> To"
+const (
+	EdgeContains     = "contains"     // rule set -> rule
+	EdgeReads        = "reads"        // rule -> field
+	EdgeWrites       = "writes"       // rule -> field
+	EdgeSends        = "sends"        // rule -> destination
+	EdgeTriggers     = "triggers"     // table -> rule (rule_triggers)
+	EdgeSource       = "source"       // table -> match view
+	EdgeMaterializes = "materializes" // rule set -> match view
+)
+
+// GraphNode is a rule, rule set, fact field, table, destination, or match
+// view. ID is "<kind>:<name>", e.g. "rule:HighValueOrder".
+type GraphNode struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// GraphEdge links two nodes by ID
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// DependencyGraph relates rules to the rule sets that contain them, the
+// fact fields their conditions read and actions write, the destinations
+// they name, and the tables that trigger them or feed match views of
+// their rule sets
+type DependencyGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+
+	nodes map[string]GraphNode
+	out   map[string][]GraphEdge
+	in    map[string][]GraphEdge
+}
+
+// ImpactReason records why a node is affected: Via is the affected node
+// it depends on through an edge of kind Edge
+type ImpactReason struct {
+	Node string `json:"node"`
+	Via  string `json:"via"`
+	Edge string `json:"edge"`
+}
+
+// Impact lists what a change to one node may affect
+type Impact struct {
+	Target       string         `json:"target"`
+	Rules        []string       `json:"rules"`
+	RuleSets     []string       `json:"rulesets"`
+	Fields       []string       `json:"fields"`
+	Destinations []string       `json:"destinations"`
+	MatchViews   []string       `json:"matviews"`
+	Reasons      []ImpactReason `json:"reasons"`
+}
+
+// DependencyGraph builds the graph from the rule repository. Each rule
+// contributes its active version and any version a rule set pins. Fields
+// are found by scanning GRL, so a field built at runtime (e.g. by a
+// function) is not seen. A rule sends to a destination when a string
+// literal in its GRL is the name of a webhook (rule_webhooks) or worker
+// action (rule_actions). Tables come from rule_triggers and match views.
+// Optional tables that are not installed are skipped.
+func (c *Client) DependencyGraph(ctx context.Context) (*DependencyGraph, error) {
+	g := newDependencyGraph()
+
+	destinations := map[string]bool{}
+	for _, q := range []struct{ table, query string }{
+		{"rule_webhooks", "SELECT webhook_name FROM rule_webhooks"},
+		{"rule_actions", "SELECT action_name FROM rule_actions"},
+	} {
+		names, err := c.optionalStrings(ctx, q.table, q.query)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			destinations[name] = true
+		}
+	}
+
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT rd.name, rv.grl_content
+		 FROM rule_definitions rd
+		 JOIN rule_versions rv ON rv.rule_id = rd.id
+		 WHERE rv.is_default
+		    OR EXISTS (SELECT 1 FROM rule_set_members m WHERE m.rule_name = rd.name AND m.rule_version = rv.version)
+		 ORDER BY rd.name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, grl string
+		if err := rows.Scan(&name, &grl); err != nil {
+			return nil, err
+		}
+		rule := g.node(NodeRule, name)
+		refs := scanGRLRefs(grl)
+		for _, f := range refs.reads {
+			g.edge(rule, g.node(NodeField, f), EdgeReads)
+		}
+		for _, f := range refs.writes {
+			g.edge(rule, g.node(NodeField, f), EdgeWrites)
+		}
+		for _, s := range refs.literals {
+			if destinations[s] {
+				g.edge(rule, g.node(NodeDestination, s), EdgeSends)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	members, err := c.db.QueryContext(ctx,
+		"SELECT DISTINCT ruleset_id, rule_name FROM rule_set_members ORDER BY 1, 2",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer members.Close()
+	for members.Next() {
+		var id int
+		var rule string
+		if err := members.Scan(&id, &rule); err != nil {
+			return nil, err
+		}
+		g.edge(g.node(NodeRuleSet, strconv.Itoa(id)), g.node(NodeRule, rule), EdgeContains)
+	}
+	if err := members.Err(); err != nil {
+		return nil, err
+	}
+
+	triggers, err := c.optionalPairs(ctx, "rule_triggers",
+		"SELECT DISTINCT table_name::TEXT, rule_name::TEXT FROM rule_triggers WHERE enabled IS NOT FALSE")
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range triggers {
+		g.edge(g.node(NodeTable, t[0]), g.node(NodeRule, t[1]), EdgeTriggers)
+	}
+
+	views, err := c.optionalPairs(ctx, "rule_match_views",
+		"SELECT name, source || E'\\t' || ruleset_id FROM rule_match_views")
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range views {
+		source, ruleset, _ := strings.Cut(v[1], "\t")
+		view := g.node(NodeMatchView, v[0])
+		g.edge(g.node(NodeTable, source), view, EdgeSource)
+		g.edge(g.node(NodeRuleSet, ruleset), view, EdgeMaterializes)
+	}
+
+	g.finish()
+	return g, nil
+}
+
+// optionalStrings runs a one-column query if table exists
+func (c *Client) optionalStrings(ctx context.Context, table, query string) ([]string, error) {
+	pairs, err := c.optionalPairs(ctx, table, "SELECT x, '' FROM ("+query+") q(x)")
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, len(pairs))
+	for i, p := range pairs {
+		values[i] = p[0]
+	}
+	return values, nil
+}
+
+// optionalPairs runs a two-column query if table exists
+func (c *Client) optionalPairs(ctx context.Context, table, query string) ([][2]string, error) {
+	var exists bool
+	if err := c.db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	rows, err := c.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pairs [][2]string
+	for rows.Next() {
+		var p [2]string
+		if err := rows.Scan(&p[0], &p[1]); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, p)
+	}
+	return pairs, rows.Err()
+}
+
+func newDependencyGraph() *DependencyGraph {
+	return &DependencyGraph{
+		nodes: map[string]GraphNode{},
+		out:   map[string][]GraphEdge{},
+		in:    map[string][]GraphEdge{},
+	}
+}
+
+func (g *DependencyGraph) node(kind, name string) string {
+	id := kind + ":" + name
+	if _, ok := g.nodes[id]; !ok {
+		g.nodes[id] = GraphNode{ID: id, Kind: kind, Name: name}
+	}
+	return id
+}
+
+func (g *DependencyGraph) edge(from, to, kind string) {
+	for _, e := range g.out[from] {
+		if e.To == to && e.Kind == kind {
+			return
+		}
+	}
+	e := GraphEdge{From: from, To: to, Kind: kind}
+	g.out[from] = append(g.out[from], e)
+	g.in[to] = append(g.in[to], e)
+}
+
+// finish fills Nodes and Edges in a stable order
+func (g *DependencyGraph) finish() {
+	g.Nodes = make([]GraphNode, 0, len(g.nodes))
+	for _, n := range g.nodes {
+		g.Nodes = append(g.Nodes, n)
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].ID < g.Nodes[j].ID })
+	g.Edges = nil
+	for _, n := range g.Nodes {
+		g.Edges = append(g.Edges, g.out[n.ID]...)
+	}
+}
+
+// Impact reports what changing target may affect. Target is a node ID:
+//
+//   - rule:NAME: its rule sets and match views, the fields it writes, the
+//     rules reading those fields (transitively), and their destinations
+//   - field:Order.Amount: the rules reading the field and, transitively,
+//     what they affect
+//   - column:amount or column:orders.amount: like field, for every field
+//     whose last segment is the column; with a table, only rules that table
+//     triggers or whose rule set a match view over it materializes
+//   - table:orders: the rules it triggers and the match views it feeds
+//   - destination:NAME: the rules that send to it
+//   - ruleset:ID: its match views
+func (g *DependencyGraph) Impact(target string) (*Impact, error) {
+	kind, name, ok := strings.Cut(target, ":")
+	if !ok || name == "" {
+		return nil, &ValidationError{Field: "target", Message: "must look like rule:NAME, field:PATH, column:[TABLE.]COLUMN, table:NAME, destination:NAME, or ruleset:ID"}
+	}
+
+	w := &impactWalk{g: g, seen: map[string]bool{target: true}}
+	switch kind {
+	case NodeRule, NodeField, NodeTable, NodeRuleSet:
+		if _, ok := g.nodes[target]; !ok {
+			return nil, fmt.Errorf("%s: %w", target, ErrGraphNodeNotFound)
+		}
+		w.push(target)
+	case NodeDestination:
+		if _, ok := g.nodes[target]; !ok {
+			return nil, fmt.Errorf("%s: %w", target, ErrGraphNodeNotFound)
+		}
+		// Changing a destination does not change what rules compute
+		for _, e := range g.in[target] {
+			w.affect(e.From, target, e.Kind, false)
+		}
+	case "column":
+		if !w.seedColumn(name) {
+			return nil, fmt.Errorf("%s: %w", target, ErrGraphNodeNotFound)
+		}
+	default:
+		return nil, &ValidationError{Field: "target", Message: fmt.Sprintf("unknown kind %q", kind)}
+	}
+	w.run()
+
+	impact := &Impact{Target: target, Rules: []string{}, RuleSets: []string{}, Fields: []string{},
+		Destinations: []string{}, MatchViews: []string{}, Reasons: w.reasons}
+	if impact.Reasons == nil {
+		impact.Reasons = []ImpactReason{}
+	}
+	for _, r := range w.reasons {
+		n := g.nodes[r.Node]
+		switch n.Kind {
+		case NodeRule:
+			impact.Rules = append(impact.Rules, n.Name)
+		case NodeRuleSet:
+			impact.RuleSets = append(impact.RuleSets, n.Name)
+		case NodeField:
+			impact.Fields = append(impact.Fields, n.Name)
+		case NodeDestination:
+			impact.Destinations = append(impact.Destinations, n.Name)
+		case NodeMatchView:
+			impact.MatchViews = append(impact.MatchViews, n.Name)
+		}
+	}
+	return impact, nil
+}
+
+type impactWalk struct {
+	g       *DependencyGraph
+	seen    map[string]bool
+	queue   []string
+	reasons []ImpactReason
+}
+
+func (w *impactWalk) push(id string) {
+	w.queue = append(w.queue, id)
+}
+
+// affect marks node as affected through via, queueing it when its own
+// dependents should be followed
+func (w *impactWalk) affect(node, via, edge string, follow bool) {
+	if w.seen[node] {
+		return
+	}
+	w.seen[node] = true
+	w.reasons = append(w.reasons, ImpactReason{Node: node, Via: via, Edge: edge})
+	if follow {
+		w.push(node)
+	}
+}
+
+func (w *impactWalk) run() {
+	for len(w.queue) > 0 {
+		id := w.queue[0]
+		w.queue = w.queue[1:]
+		switch w.g.nodes[id].Kind {
+		case NodeRule:
+			for _, e := range w.g.in[id] {
+				if e.Kind == EdgeContains {
+					w.affect(e.From, id, e.Kind, true)
+				}
+			}
+			for _, e := range w.g.out[id] {
+				switch e.Kind {
+				case EdgeWrites:
+					w.affect(e.To, id, e.Kind, true)
+				case EdgeSends:
+					w.affect(e.To, id, e.Kind, false)
+				}
+			}
+		case NodeField:
+			for _, e := range w.g.in[id] {
+				if e.Kind == EdgeReads {
+					w.affect(e.From, id, e.Kind, true)
+				}
+			}
+		case NodeTable:
+			for _, e := range w.g.out[id] {
+				w.affect(e.To, id, e.Kind, e.Kind == EdgeTriggers)
+			}
+		case NodeRuleSet:
+			for _, e := range w.g.out[id] {
+				if e.Kind == EdgeMaterializes {
+					w.affect(e.To, id, e.Kind, false)
+				}
+			}
+		}
+	}
+}
+
+// seedColumn affects the rules reading fields named column, limited to
+// rules linked to the table when column is qualified. It returns false
+// when no field has that name.
+func (w *impactWalk) seedColumn(column string) bool {
+	table, col := "", column
+	if i := strings.LastIndex(column, "."); i >= 0 {
+		table, col = column[:i], column[i+1:]
+	}
+
+	var linked map[string]bool
+	if table != "" {
+		linked = map[string]bool{}
+		for _, e := range w.g.out[NodeTable+":"+table] {
+			switch e.Kind {
+			case EdgeTriggers:
+				linked[e.To] = true
+			case EdgeSource:
+				for _, m := range w.g.in[e.To] {
+					if m.Kind == EdgeMaterializes {
+						for _, r := range w.g.out[m.From] {
+							if r.Kind == EdgeContains {
+								linked[r.To] = true
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	found := false
+	for _, n := range w.g.Nodes {
+		if n.Kind != NodeField {
+			continue
+		}
+		segments := strings.Split(n.Name, ".")
+		if !strings.EqualFold(segments[len(segments)-1], col) {
+			continue
+		}
+		found = true
+		for _, e := range w.g.in[n.ID] {
+			if e.Kind == EdgeReads && (linked == nil || linked[e.From]) {
+				w.affect(e.From, n.ID, e.Kind, true)
+			}
+		}
+	}
+	return found
+}
+
+// DOT renders the graph in Graphviz format
+func (g *DependencyGraph) DOT() string {
+	shapes := map[string]string{
+		NodeRule: "box", NodeRuleSet: "folder", NodeField: "ellipse",
+		NodeTable: "cylinder", NodeDestination: "cds", NodeMatchView: "tab",
+	}
+	var b strings.Builder
+	b.WriteString("digraph rules {\n  rankdir=LR;\n")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(&b, "  %q [label=%q, shape=%s];\n", n.ID, n.Name, shapes[n.Kind])
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&b, "  %q -> %q [label=%q];\n", e.From, e.To, e.Kind)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// grlRefs lists what a GRL document refers to
+type grlRefs struct {
+	reads, writes, literals []string
+}
+
+// scanGRLRefs finds the fact fields a GRL document reads and writes and
+// its string literals. Unlike the local evaluator's parser it accepts any
+// GRL: a dotted name is written when an action assigns to it and read
+// anywhere else; a dotted call such as Order.Items.Len() reads Order.Items.
+func scanGRLRefs(grl string) grlRefs {
+	type token struct {
+		ident, str, op string
+	}
+	var tokens []token
+	rs := []rune(grl)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '/' && i+1 < len(rs) && rs[i+1] == '/':
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < len(rs) && rs[i+1] == '*':
+			i += 2
+			for i+1 < len(rs) && !(rs[i] == '*' && rs[i+1] == '/') {
+				i++
+			}
+			i += 2
+		case r == '"' || r == '`':
+			j := i + 1
+			for j < len(rs) && rs[j] != r {
+				if rs[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j > len(rs) {
+				j = len(rs)
+			}
+			s := string(rs[i+1 : j])
+			if r == '"' && j < len(rs) {
+				if unquoted, err := strconv.Unquote(string(rs[i : j+1])); err == nil {
+					s = unquoted
+				}
+			}
+			tokens = append(tokens, token{str: s})
+			i = j + 1
+		case unicode.IsDigit(r):
+			for i < len(rs) && (unicode.IsDigit(rs[i]) || rs[i] == '.' || unicode.IsLetter(rs[i])) {
+				i++
+			}
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_' || rs[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{ident: strings.TrimSuffix(string(rs[i:j]), ".")})
+			i = j
+		default:
+			op := string(r)
+			if i+1 < len(rs) {
+				switch two := string(rs[i : i+2]); two {
+				case "==", "!=", ">=", "<=", "&&", "||", "+=", "-=", "*=", "/=", "++", "--":
+					op = two
+				}
+			}
+			tokens = append(tokens, token{op: op})
+			i += len([]rune(op))
+		}
+	}
+
+	var refs grlRefs
+	seen := map[string]bool{}
+	add := func(list *[]string, kind, value string) {
+		if !seen[kind+value] {
+			seen[kind+value] = true
+			*list = append(*list, value)
+		}
+	}
+	inThen := false
+	for i, t := range tokens {
+		switch {
+		case t.str != "":
+			add(&refs.literals, "s", t.str)
+		case t.ident == "when" || t.ident == "rule":
+			inThen = false
+		case t.ident == "then":
+			inThen = true
+		case strings.Contains(t.ident, "."):
+			next := ""
+			if i+1 < len(tokens) {
+				next = tokens[i+1].op
+			}
+			switch {
+			case next == "(":
+				add(&refs.reads, "r", t.ident[:strings.LastIndex(t.ident, ".")])
+			case inThen && (next == "=" || next == "+=" || next == "-=" || next == "*=" || next == "/=" || next == "++" || next == "--"):
+				add(&refs.writes, "w", t.ident)
+				if next != "=" {
+					add(&refs.reads, "r", t.ident)
+				}
+			default:
+				add(&refs.reads, "r", t.ident)
+			}
+		}
+	}
+	return refs
+}
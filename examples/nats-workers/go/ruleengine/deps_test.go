@@ -0,0 +1,253 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestScanGRLRefs(t *testing.T) {
+	tests := []struct {
+		name                    string
+		grl                     string
+		reads, writes, literals []string
+	}{
+		{
+			name:   "condition and assignment",
+			grl:    `rule A "desc" salience 10 { when Order.Amount > 100 && Customer.Tier == "gold" then Order.Discount = 0.1; Retract("A"); }`,
+			reads:  []string{"Order.Amount", "Customer.Tier"},
+			writes: []string{"Order.Discount"}, literals: []string{"desc", "gold", "A"},
+		},
+		{
+			name:  "compound assignment reads too",
+			grl:   `rule A "" { when true then Order.Score += 5; Order.Count++; }`,
+			reads: []string{"Order.Score", "Order.Count"}, writes: []string{"Order.Score", "Order.Count"},
+		},
+		{
+			name:  "method call reads its receiver",
+			grl:   `rule A "" { when Order.Items.Len() > 3 then Order.Tags.Append("bulk"); }`,
+			reads: []string{"Order.Items", "Order.Tags"}, literals: []string{"bulk"},
+		},
+		{
+			name:  "comparison in then is a read",
+			grl:   `rule A "" { when true then Order.Flag = Order.Total >= 10; }`,
+			reads: []string{"Order.Total"}, writes: []string{"Order.Flag"},
+		},
+		{
+			name:  "comments and numbers are skipped",
+			grl:   "rule A \"\" { // Order.Ignored = 1\n /* Order.Also */ when Order.Total > 1.5e3 then Order.Big = true; }",
+			reads: []string{"Order.Total"}, writes: []string{"Order.Big"},
+		},
+		{
+			name:     "escaped and raw strings",
+			grl:      "rule A \"say \\\"hi\\\"\" { when Order.Note == `raw \"x\"` then Retract(\"A\"); }",
+			reads:    []string{"Order.Note"},
+			literals: []string{`say "hi"`, `raw "x"`, "A"},
+		},
+		{
+			name:  "each rule starts in its condition",
+			grl:   `rule A "" { when true then Order.X = 1; } rule B "" { when Order.X = 1 then Retract("B"); }`,
+			reads: []string{"Order.X"}, writes: []string{"Order.X"}, literals: []string{"B"},
+		},
+		{
+			name:     "unterminated string",
+			grl:      `rule A "oops`,
+			literals: []string{"oops"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refs := scanGRLRefs(tt.grl)
+			for _, c := range []struct {
+				what      string
+				got, want []string
+			}{{"reads", refs.reads, tt.reads}, {"writes", refs.writes, tt.writes}, {"literals", refs.literals, tt.literals}} {
+				if len(c.got) != 0 || len(c.want) != 0 {
+					if !reflect.DeepEqual(c.got, c.want) {
+						t.Errorf("%s = %q, want %q", c.what, c.got, c.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// testGraph: orders triggers Score, which feeds Flag, which feeds Notify
+// (sending to slack); rule set 1 (Score, Flag) is materialized over orders
+func testGraph() *DependencyGraph {
+	g := newDependencyGraph()
+	rule := func(name string) string { return g.node(NodeRule, name) }
+	field := func(name string) string { return g.node(NodeField, name) }
+	g.edge(rule("Score"), field("Order.Amount"), EdgeReads)
+	g.edge(rule("Score"), field("Order.Score"), EdgeWrites)
+	g.edge(rule("Flag"), field("Order.Score"), EdgeReads)
+	g.edge(rule("Flag"), field("Order.Flagged"), EdgeWrites)
+	g.edge(rule("Notify"), field("Order.Flagged"), EdgeReads)
+	g.edge(rule("Notify"), g.node(NodeDestination, "slack"), EdgeSends)
+	g.edge(rule("Other"), field("Customer.Amount"), EdgeReads)
+	g.edge(g.node(NodeRuleSet, "1"), rule("Score"), EdgeContains)
+	g.edge(g.node(NodeRuleSet, "1"), rule("Flag"), EdgeContains)
+	g.edge(g.node(NodeRuleSet, "2"), rule("Notify"), EdgeContains)
+	g.edge(g.node(NodeRuleSet, "3"), rule("Other"), EdgeContains)
+	g.edge(g.node(NodeTable, "orders"), rule("Score"), EdgeTriggers)
+	g.edge(g.node(NodeTable, "orders"), g.node(NodeMatchView, "hot"), EdgeSource)
+	g.edge(g.node(NodeRuleSet, "1"), g.node(NodeMatchView, "hot"), EdgeMaterializes)
+	// Duplicate edges are ignored
+	g.edge(rule("Score"), field("Order.Amount"), EdgeReads)
+	g.finish()
+	return g
+}
+
+func TestImpact(t *testing.T) {
+	type want struct {
+		rules, rulesets, fields, destinations, matviews string
+	}
+	fromScore := want{rules: "Flag,Notify", rulesets: "1,2", fields: "Order.Flagged,Order.Score",
+		destinations: "slack", matviews: "hot"}
+	tests := []struct {
+		target  string
+		want    want
+		wantErr string
+	}{
+		{target: "rule:Score", want: fromScore},
+		{target: "rule:Notify", want: want{rulesets: "2", destinations: "slack"}},
+		{target: "field:Order.Amount", want: want{rules: "Flag,Notify,Score", rulesets: "1,2",
+			fields: "Order.Flagged,Order.Score", destinations: "slack", matviews: "hot"}},
+		{target: "column:AMOUNT", want: want{rules: "Flag,Notify,Other,Score", rulesets: "1,2,3",
+			fields: "Order.Flagged,Order.Score", destinations: "slack", matviews: "hot"}},
+		// Other reads an amount too, but nothing links it to orders
+		{target: "column:orders.amount", want: want{rules: "Flag,Notify,Score", rulesets: "1,2",
+			fields: "Order.Flagged,Order.Score", destinations: "slack", matviews: "hot"}},
+		{target: "table:orders", want: want{rules: "Flag,Notify,Score", rulesets: "1,2",
+			fields: "Order.Flagged,Order.Score", destinations: "slack", matviews: "hot"}},
+		{target: "destination:slack", want: want{rules: "Notify"}},
+		{target: "ruleset:1", want: want{matviews: "hot"}},
+		{target: "ruleset:3"},
+		{target: "rule:Missing", wantErr: "rule:Missing: not found in the dependency graph"},
+		{target: "destination:pager", wantErr: "not found"},
+		{target: "column:nothing", wantErr: "not found"},
+		{target: "widget:x", wantErr: `unknown kind "widget"`},
+		{target: "rule:", wantErr: "must look like"},
+		{target: "Score", wantErr: "must look like"},
+	}
+	g := testGraph()
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			impact, err := g.Impact(tt.target)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			join := func(s []string) string {
+				s = append([]string(nil), s...)
+				sort.Strings(s)
+				return strings.Join(s, ",")
+			}
+			got := want{join(impact.Rules), join(impact.RuleSets), join(impact.Fields),
+				join(impact.Destinations), join(impact.MatchViews)}
+			if got != tt.want {
+				t.Fatalf("impact = %+v, want %+v", got, tt.want)
+			}
+			if impact.Reasons == nil || impact.Rules == nil {
+				t.Fatal("nil lists encode as null")
+			}
+		})
+	}
+}
+
+func TestImpactReasons(t *testing.T) {
+	impact, err := testGraph().Impact("rule:Flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ImpactReason{
+		{Node: "ruleset:1", Via: "rule:Flag", Edge: EdgeContains},
+		{Node: "field:Order.Flagged", Via: "rule:Flag", Edge: EdgeWrites},
+		{Node: "matview:hot", Via: "ruleset:1", Edge: EdgeMaterializes},
+		{Node: "rule:Notify", Via: "field:Order.Flagged", Edge: EdgeReads},
+		{Node: "ruleset:2", Via: "rule:Notify", Edge: EdgeContains},
+		{Node: "destination:slack", Via: "rule:Notify", Edge: EdgeSends},
+	}
+	if !reflect.DeepEqual(impact.Reasons, want) {
+		t.Fatalf("reasons = %+v", impact.Reasons)
+	}
+}
+
+func TestDependencyGraphDOT(t *testing.T) {
+	dot := testGraph().DOT()
+	for _, want := range []string{
+		"digraph rules {",
+		`"rule:Score" [label="Score", shape=box];`,
+		`"table:orders" [label="orders", shape=cylinder];`,
+		`"rule:Notify" -> "destination:slack" [label="sends"];`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("DOT lacks %s:\n%s", want, dot)
+		}
+	}
+	if strings.Count(dot, `"rule:Score" -> "field:Order.Amount"`) != 1 {
+		t.Error("duplicate edge rendered")
+	}
+}
+
+func TestDependencyGraph(t *testing.T) {
+	client, mock := newMock(t)
+	exists := func(table string, ok bool) {
+		mock.ExpectQuery(`SELECT to_regclass\(\$1\) IS NOT NULL`).WithArgs(table).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(ok))
+	}
+	exists("rule_webhooks", true)
+	mock.ExpectQuery(`SELECT webhook_name FROM rule_webhooks`).
+		WillReturnRows(sqlmock.NewRows([]string{"x", ""}).AddRow("slack", ""))
+	// Optional tables that are not installed are skipped
+	exists("rule_actions", false)
+	exists("rule_triggers", false)
+	exists("rule_match_views", true)
+	mock.ExpectQuery(`FROM rule_match_views`).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "source"}).AddRow("hot", "orders\t1"))
+	mock.ExpectQuery(`FROM rule_definitions rd`).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "grl"}).
+			AddRow("Notify", `rule Notify "" { when Order.Flagged then Send("slack"); Send("nobody"); }`))
+	mock.ExpectQuery(`FROM rule_set_members`).
+		WillReturnRows(sqlmock.NewRows([]string{"ruleset_id", "rule_name"}).AddRow(1, "Notify"))
+
+	g, err := client.DependencyGraph(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	var edges []string
+	for _, e := range g.Edges {
+		edges = append(edges, e.From+" "+e.Kind+" "+e.To)
+	}
+	want := []string{
+		"rule:Notify reads field:Order.Flagged",
+		"rule:Notify sends destination:slack",
+		"ruleset:1 contains rule:Notify",
+		"ruleset:1 materializes matview:hot",
+		"table:orders source matview:hot",
+	}
+	if !reflect.DeepEqual(edges, want) {
+		t.Fatalf("edges = %q", edges)
+	}
+	if len(g.Nodes) != 6 || g.Nodes[0].ID != "destination:slack" {
+		t.Fatalf("nodes = %+v", g.Nodes)
+	}
+
+	mock.ExpectQuery(`to_regclass`).WillReturnError(errors.New("permission denied for function to_regclass"))
+	if _, err := client.DependencyGraph(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+}
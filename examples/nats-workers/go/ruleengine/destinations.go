@@ -0,0 +1,147 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Destination is a registered webhook (rule_webhooks row) as kept by
+// ApplyDestination. Messages reference it by id or name.
+type Destination struct {
+	Name        string            `json:"webhook_name"`
+	URL         string            `json:"url"`
+	Method      string            `json:"method,omitempty"` // POST when empty
+	Headers     map[string]string `json:"headers,omitempty"`
+	Description string            `json:"description,omitempty"`
+	TimeoutMs   int               `json:"timeout_ms,omitempty"` // 5000 when 0
+	MaxRetries  *int              `json:"max_retries,omitempty"`
+	Enabled     bool              `json:"enabled"`
+	Tags        []string          `json:"tags,omitempty"`
+}
+
+// ApplyDestination creates the webhook named d.Name, or replaces the
+// fields above of an existing one, so it matches d. Columns it does not
+// cover, such as pauses and delivery hours, are left alone. It returns
+// the webhook's id and "created", "updated", or "unchanged"; an unchanged
+// webhook is not written.
+func (c *Client) ApplyDestination(ctx context.Context, d Destination) (int, string, error) {
+	if d.Name == "" {
+		return 0, "", &ValidationError{Field: "webhook_name", Message: "is required"}
+	}
+	if u, err := url.Parse(d.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 0, "", &ValidationError{Field: "url", Message: "must be an http or https URL"}
+	}
+	method := strings.ToUpper(d.Method)
+	switch method {
+	case "":
+		method = "POST"
+	case "GET", "POST", "PUT", "PATCH", "DELETE":
+	default:
+		return 0, "", &ValidationError{Field: "method", Message: "must be GET, POST, PUT, PATCH, or DELETE"}
+	}
+	timeout := d.TimeoutMs
+	if timeout == 0 {
+		timeout = 5000
+	}
+	if timeout < 0 || timeout > 60000 {
+		return 0, "", &ValidationError{Field: "timeout_ms", Message: "must be between 1 and 60000"}
+	}
+	retries := 3
+	if d.MaxRetries != nil {
+		retries = *d.MaxRetries
+	}
+	if retries < 0 || retries > 10 {
+		return 0, "", &ValidationError{Field: "max_retries", Message: "must be between 0 and 10"}
+	}
+	headers := d.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	headersJSON, err := json.Marshal(headers)
+	if err != nil {
+		return 0, "", err
+	}
+	tags := d.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	args := []interface{}{d.Name, d.URL, method, string(headersJSON), d.Description, timeout, retries, d.Enabled, pq.Array(tags)}
+	var id int
+	var created bool
+	err = c.db.QueryRowContext(ctx,
+		`INSERT INTO rule_webhooks (webhook_name, url, method, headers, description, timeout_ms, max_retries, enabled, tags)
+		 VALUES ($1, $2, $3, $4::JSONB, NULLIF($5, ''), $6, $7, $8, $9)
+		 ON CONFLICT (webhook_name) DO UPDATE SET
+		     url = EXCLUDED.url,
+		     method = EXCLUDED.method,
+		     headers = EXCLUDED.headers,
+		     description = EXCLUDED.description,
+		     timeout_ms = EXCLUDED.timeout_ms,
+		     max_retries = EXCLUDED.max_retries,
+		     enabled = EXCLUDED.enabled,
+		     tags = EXCLUDED.tags,
+		     updated_at = CURRENT_TIMESTAMP
+		 WHERE (rule_webhooks.url, rule_webhooks.method, rule_webhooks.headers, rule_webhooks.description,
+		        rule_webhooks.timeout_ms, rule_webhooks.max_retries, rule_webhooks.enabled, rule_webhooks.tags)
+		       IS DISTINCT FROM
+		       (EXCLUDED.url, EXCLUDED.method, EXCLUDED.headers, EXCLUDED.description,
+		        EXCLUDED.timeout_ms, EXCLUDED.max_retries, EXCLUDED.enabled, EXCLUDED.tags)
+		 RETURNING webhook_id, xmax = 0`,
+		args...,
+	).Scan(&id, &created)
+	switch {
+	case err == sql.ErrNoRows:
+		// The row matched already, so the update was skipped
+		err = c.db.QueryRowContext(ctx, `SELECT webhook_id FROM rule_webhooks WHERE webhook_name = $1`, d.Name).Scan(&id)
+		return id, "unchanged", err
+	case err != nil:
+		return 0, "", err
+	case created:
+		return id, "created", nil
+	}
+	return id, "updated", nil
+}
+
+// GetDestination returns the named webhook's id and the fields
+// ApplyDestination keeps. It returns ErrWebhookNotFound if there is none.
+func (c *Client) GetDestination(ctx context.Context, name string) (int, *Destination, error) {
+	var id, retries int
+	var headers []byte
+	d := Destination{Name: name}
+	err := c.db.QueryRowContext(ctx,
+		`SELECT webhook_id, url, COALESCE(method, 'POST'), COALESCE(headers, '{}'::JSONB), COALESCE(description, ''),
+		        COALESCE(timeout_ms, 5000), COALESCE(max_retries, 3), COALESCE(enabled, true), COALESCE(tags, '{}')
+		 FROM rule_webhooks WHERE webhook_name = $1`,
+		name,
+	).Scan(&id, &d.URL, &d.Method, &headers, &d.Description, &d.TimeoutMs, &retries, &d.Enabled, pq.Array(&d.Tags))
+	if err == sql.ErrNoRows {
+		return 0, nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := json.Unmarshal(headers, &d.Headers); err != nil {
+		return 0, nil, err
+	}
+	d.MaxRetries = &retries
+	return id, &d, nil
+}
+
+// DeleteDestination deletes the named webhook with its secrets. It
+// returns ErrWebhookNotFound if there is none.
+func (c *Client) DeleteDestination(ctx context.Context, name string) error {
+	res, err := c.db.ExecContext(ctx, `DELETE FROM rule_webhooks WHERE webhook_name = $1`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package ruleengine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VersionDiff is a line diff between two versions of a rule's GRL
+type VersionDiff struct {
+	Rule  string     `json:"rule"`
+	From  string     `json:"from"`
+	To    string     `json:"to"`
+	Lines []DiffLine `json:"lines"`
+}
+
+// DiffLine is one line of a diff. Op is " " (unchanged), "-" (only in
+// From), or "+" (only in To).
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// Changed reports whether the two versions differ
+func (d *VersionDiff) Changed() bool {
+	for _, l := range d.Lines {
+		if l.Op != " " {
+			return true
+		}
+	}
+	return false
+}
+
+// String renders the diff in unified style without hunk headers
+func (d *VersionDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s@%s\n+++ %s@%s\n", d.Rule, d.From, d.Rule, d.To)
+	for _, l := range d.Lines {
+		b.WriteString(l.Op)
+		b.WriteString(l.Text)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// diffLines computes a minimal line diff with Myers' algorithm
+func diffLines(a, b string) []DiffLine {
+	x := strings.Split(strings.TrimRight(a, "\n"), "\n")
+	y := strings.Split(strings.TrimRight(b, "\n"), "\n")
+	n, m := len(x), len(y)
+	total := n + m
+	offset := total + 1
+
+	// trace[d] is the furthest-reaching x per diagonal after d edits
+	v := make([]int, 2*total+2)
+	var trace [][]int
+	for d := 0; d <= total; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var i int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				i = v[offset+k+1]
+			} else {
+				i = v[offset+k-1] + 1
+			}
+			j := i - k
+			for i < n && j < m && x[i] == y[j] {
+				i++
+				j++
+			}
+			v[offset+k] = i
+			if i >= n && j >= m {
+				return backtrack(trace, x, y, d, offset)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrack(trace [][]int, x, y []string, d, offset int) []DiffLine {
+	var lines []DiffLine
+	i, j := len(x), len(y)
+	for ; d > 0; d-- {
+		v := trace[d]
+		k := i - j
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevI := v[offset+prevK]
+		prevJ := prevI - prevK
+		for i > prevI && j > prevJ {
+			i--
+			j--
+			lines = append(lines, DiffLine{Op: " ", Text: x[i]})
+		}
+		if i == prevI {
+			j--
+			lines = append(lines, DiffLine{Op: "+", Text: y[j]})
+		} else {
+			i--
+			lines = append(lines, DiffLine{Op: "-", Text: x[i]})
+		}
+	}
+	for i > 0 && j > 0 {
+		i--
+		j--
+		lines = append(lines, DiffLine{Op: " ", Text: x[i]})
+	}
+
+	for l, r := 0, len(lines)-1; l < r; l, r = l+1, r-1 {
+		lines[l], lines[r] = lines[r], lines[l]
+	}
+	return lines
+}
@@ -0,0 +1,60 @@
+package ruleengine
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string // ops, one per line
+	}{
+		{name: "equal", a: "a\nb\nc", b: "a\nb\nc", want: "   "},
+		{name: "trailing newline ignored", a: "a\nb\n", b: "a\nb", want: "  "},
+		{name: "append", a: "a", b: "a\nb", want: " +"},
+		{name: "remove first", a: "a\nb\nc", b: "b\nc", want: "-  "},
+		{name: "replace middle", a: "a\nb\nc", b: "a\nx\nc", want: " -+ "},
+		{name: "all different", a: "a\nb", b: "c\nd", want: "--++"},
+		{name: "from empty", a: "", b: "a", want: "-+"},
+		{name: "classic", a: "a\nb\nc\na\nb\nb\na", b: "c\nb\na\nb\na\nc", want: "--  -  -+"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := diffLines(tt.a, tt.b)
+			var ops strings.Builder
+			var from, to []string
+			for _, l := range lines {
+				ops.WriteString(l.Op)
+				if l.Op != "+" {
+					from = append(from, l.Text)
+				}
+				if l.Op != "-" {
+					to = append(to, l.Text)
+				}
+			}
+			// Edit count is minimal; the exact interleaving may vary
+			if got := ops.String(); strings.Count(got, " ") != strings.Count(tt.want, " ") || len(got) != len(tt.want) {
+				t.Fatalf("ops = %q, want %q", got, tt.want)
+			}
+			if strings.Join(from, "\n") != strings.TrimRight(tt.a, "\n") || strings.Join(to, "\n") != strings.TrimRight(tt.b, "\n") {
+				t.Fatalf("diff does not reproduce its inputs: %+v", lines)
+			}
+		})
+	}
+}
+
+func TestVersionDiffString(t *testing.T) {
+	d := &VersionDiff{Rule: "A", From: "1.0.0", To: "1.0.1", Lines: diffLines("x\ny", "x\nz")}
+	if !d.Changed() {
+		t.Fatal("Changed = false")
+	}
+	want := "--- A@1.0.0\n+++ A@1.0.1\n x\n-y\n+z\n"
+	if got := d.String(); got != want {
+		t.Fatalf("String = %q, want %q", got, want)
+	}
+	if (&VersionDiff{Lines: diffLines("x", "x")}).Changed() {
+		t.Fatal("identical versions reported as changed")
+	}
+}
@@ -0,0 +1,257 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingWrapper counts calls to another wrapper
+type countingWrapper struct {
+	KeyWrapper
+	mu             sync.Mutex
+	wraps, unwraps int
+}
+
+func (c *countingWrapper) Wrap(ctx context.Context, dataKey []byte) (string, error) {
+	c.mu.Lock()
+	c.wraps++
+	c.mu.Unlock()
+	return c.KeyWrapper.Wrap(ctx, dataKey)
+}
+
+func (c *countingWrapper) Unwrap(ctx context.Context, wrapped string) ([]byte, error) {
+	c.mu.Lock()
+	c.unwraps++
+	c.mu.Unlock()
+	return c.KeyWrapper.Unwrap(ctx, wrapped)
+}
+
+func testKey(t *testing.T, fill byte) *LocalKey {
+	t.Helper()
+	key, err := NewLocalKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	ctx := context.Background()
+	s := New(testKey(t, 1))
+
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{name: "object", payload: `{"order_id":7,"email":"ada@example.com"}`},
+		{name: "array", payload: `[1,2,3]`},
+		{name: "empty", payload: ``},
+		{name: "looks like an envelope", payload: `{"enc":"v1","key":"","data":""}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealedPayload, err := s.Seal(ctx, []byte(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsSealed(sealedPayload) {
+				t.Fatalf("Seal returned %s", sealedPayload)
+			}
+			if tt.payload != "" && bytes.Contains(sealedPayload, []byte(tt.payload)) {
+				t.Fatal("sealed payload contains the plain text")
+			}
+			var env map[string]string
+			if err := json.Unmarshal(sealedPayload, &env); err != nil {
+				t.Fatalf("sealed payload is not JSON: %v", err)
+			}
+			if env["enc"] != Version || env["kid"] != s.KeyID() {
+				t.Fatalf("envelope = %v", env)
+			}
+
+			plain, err := s.Open(ctx, sealedPayload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plain) != tt.payload {
+				t.Fatalf("Open = %q, want %q", plain, tt.payload)
+			}
+		})
+	}
+}
+
+func TestOpenPassesPlainPayloadsThrough(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		sealer  *Sealer
+		payload string
+	}{
+		{name: "plain object", sealer: New(testKey(t, 1)), payload: `{"order_id":7}`},
+		{name: "plain array", sealer: New(testKey(t, 1)), payload: `[{"enc":"v1"}]`},
+		{name: "other enc version", sealer: New(testKey(t, 1)), payload: `{"enc":"v2","kid":"x","key":"k","data":"d"}`},
+		{name: "nil sealer", payload: `{"order_id":7}`},
+		{name: "not JSON", payload: `{order_id`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.sealer.Open(ctx, []byte(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.payload {
+				t.Fatalf("Open = %q", got)
+			}
+		})
+	}
+
+	var nilSealer *Sealer
+	got, err := nilSealer.Seal(ctx, []byte(`{"a":1}`))
+	if err != nil || string(got) != `{"a":1}` {
+		t.Fatalf("nil Seal = %q, %v", got, err)
+	}
+	if nilSealer.KeyID() != "" {
+		t.Fatalf("nil KeyID = %q", nilSealer.KeyID())
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	ctx := context.Background()
+	s := New(testKey(t, 1))
+	sealedPayload, err := s.Seal(ctx, []byte(`{"secret":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env sealed
+	json.Unmarshal(sealedPayload, &env)
+
+	modified := func(change func(e *sealed)) []byte {
+		e := env
+		change(&e)
+		out, _ := json.Marshal(e)
+		return out
+	}
+	data, _ := base64.StdEncoding.DecodeString(env.Data)
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		sealer  *Sealer
+		payload []byte
+		wantErr string
+		is      error
+	}{
+		{name: "no key configured", payload: sealedPayload, is: ErrNoKey},
+		{name: "other key id", sealer: New(testKey(t, 2)), payload: sealedPayload, wantErr: "was sealed with key " + env.KID},
+		{name: "tampered data", sealer: s, payload: modified(func(e *sealed) { e.Data = base64.StdEncoding.EncodeToString(flipped) }), wantErr: "decryption failed"},
+		{name: "short data", sealer: s, payload: modified(func(e *sealed) { e.Data = base64.StdEncoding.EncodeToString(data[:4]) }), wantErr: "data too short"},
+		{name: "bad base64", sealer: s, payload: modified(func(e *sealed) { e.Data = "!!" }), wantErr: "invalid data"},
+		{name: "wrapped key not from this kek", sealer: s, payload: modified(func(e *sealed) { e.Key = "AAAA" }), wantErr: "failed to unwrap data key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.sealer.Open(ctx, tt.payload)
+			if tt.is != nil {
+				if !errors.Is(err, tt.is) {
+					t.Fatalf("err = %v, want %v", err, tt.is)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// The wrapped key is the GCM additional data, so a payload cannot be
+// moved under another envelope's data key
+func TestOpenRejectsSwappedKey(t *testing.T) {
+	ctx := context.Background()
+	s := New(testKey(t, 1))
+	first, _ := s.Seal(ctx, []byte(`"first"`))
+	s.createdAt = time.Now().Add(-2 * dataKeyLifetime)
+	second, _ := s.Seal(ctx, []byte(`"second"`))
+
+	var a, b sealed
+	json.Unmarshal(first, &a)
+	json.Unmarshal(second, &b)
+	if a.Key == b.Key {
+		t.Fatal("data key was not rotated")
+	}
+	a.Key = b.Key
+	swapped, _ := json.Marshal(a)
+	if _, err := s.Open(ctx, swapped); err == nil {
+		t.Fatal("Open accepted a payload under another data key")
+	}
+}
+
+func TestDataKeyReuseAndRotation(t *testing.T) {
+	ctx := context.Background()
+	wrapper := &countingWrapper{KeyWrapper: testKey(t, 1)}
+	s := New(wrapper)
+
+	var payloads [][]byte
+	for i := 0; i < 3; i++ {
+		p, err := s.Seal(ctx, []byte(`{"i":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, p)
+	}
+	if wrapper.wraps != 1 {
+		t.Fatalf("wraps = %d, want one data key for the batch", wrapper.wraps)
+	}
+
+	s.createdAt = time.Now().Add(-dataKeyLifetime)
+	rotated, err := s.Seal(ctx, []byte(`{"i":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapper.wraps != 2 {
+		t.Fatalf("wraps = %d after the key lifetime, want 2", wrapper.wraps)
+	}
+
+	// A fresh sealer has to unwrap each data key once
+	reader := New(wrapper)
+	for _, p := range append(payloads, rotated) {
+		if _, err := reader.Open(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wrapper.unwraps != 2 {
+		t.Fatalf("unwraps = %d, want 2", wrapper.unwraps)
+	}
+}
+
+func TestSealConcurrent(t *testing.T) {
+	ctx := context.Background()
+	s := New(testKey(t, 1))
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := s.Seal(ctx, []byte(`{"n":1}`))
+			if err == nil {
+				_, err = s.Open(ctx, p)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// FromEnv builds a sealer from PAYLOAD_ENCRYPTION:
+//
+//	local  PAYLOAD_KEY (base64 of 32 bytes)
+//	vault  VAULT_ADDR, VAULT_TOKEN, VAULT_TRANSIT_KEY, VAULT_TRANSIT_MOUNT
+//	       (default "transit"), VAULT_NAMESPACE (optional)
+//
+// It returns a nil sealer, which leaves payloads in plain text, when
+// PAYLOAD_ENCRYPTION is unset or "none".
+func FromEnv() (*Sealer, error) {
+	switch mode := os.Getenv("PAYLOAD_ENCRYPTION"); mode {
+	case "", "none":
+		return nil, nil
+	case "local":
+		wrapper, err := NewLocalKey(os.Getenv("PAYLOAD_KEY"))
+		if err != nil {
+			return nil, err
+		}
+		return New(wrapper), nil
+	case "vault":
+		mount := os.Getenv("VAULT_TRANSIT_MOUNT")
+		if mount == "" {
+			mount = "transit"
+		}
+		wrapper, err := NewVaultTransit(os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN"), mount, os.Getenv("VAULT_TRANSIT_KEY"))
+		if err != nil {
+			return nil, err
+		}
+		wrapper.Namespace = os.Getenv("VAULT_NAMESPACE")
+		return New(wrapper), nil
+	default:
+		return nil, fmt.Errorf("PAYLOAD_ENCRYPTION must be none, local, or vault, not %q", mode)
+	}
+}
+
+// LocalKey wraps data keys with AES-256-GCM under a key held in process
+// memory. It suits development and single-host deployments; production
+// should keep the key-encryption key in Vault.
+type LocalKey struct {
+	key []byte
+	id  string
+}
+
+// NewLocalKey parses a base64-encoded 32-byte key
+func NewLocalKey(encoded string) (*LocalKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("PAYLOAD_KEY must be 32 bytes, base64-encoded (openssl rand -base64 32)")
+	}
+	// The id is a fingerprint, so envelopes name their key without
+	// revealing it
+	sum := sha256.Sum256(key)
+	return &LocalKey{key: key, id: "local:" + hex.EncodeToString(sum[:4])}, nil
+}
+
+func (k *LocalKey) ID() string {
+	return k.id
+}
+
+func (k *LocalKey) Wrap(ctx context.Context, dataKey []byte) (string, error) {
+	gcm, err := newGCM(k.key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, dataKey, nil)), nil
+}
+
+func (k *LocalKey) Unwrap(ctx context.Context, wrapped string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(k.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// VaultTransit wraps data keys with a Vault Transit key. Vault rotates the
+// key itself; wrapped keys carry their key version, so older envelopes
+// still open after a rotation.
+type VaultTransit struct {
+	Addr      string
+	Token     string
+	Mount     string
+	Key       string
+	Namespace string
+
+	client *http.Client
+}
+
+// NewVaultTransit returns a wrapper for the named key under mount
+func NewVaultTransit(addr, token, mount, key string) (*VaultTransit, error) {
+	if addr == "" || token == "" || key == "" {
+		return nil, fmt.Errorf("vault payload encryption needs VAULT_ADDR, VAULT_TOKEN, and VAULT_TRANSIT_KEY")
+	}
+	return &VaultTransit{
+		Addr:   strings.TrimRight(addr, "/"),
+		Token:  token,
+		Mount:  strings.Trim(mount, "/"),
+		Key:    key,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (v *VaultTransit) ID() string {
+	return "vault:" + v.Mount + "/" + v.Key
+}
+
+func (v *VaultTransit) Wrap(ctx context.Context, dataKey []byte) (string, error) {
+	var result struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := v.call(ctx, "encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey)}, &result)
+	if err != nil {
+		return "", err
+	}
+	return result.Ciphertext, nil
+}
+
+func (v *VaultTransit) Unwrap(ctx context.Context, wrapped string) ([]byte, error) {
+	var result struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := v.call(ctx, "decrypt", map[string]string{"ciphertext": wrapped}, &result); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(result.Plaintext)
+}
+
+// call POSTs to /v1/<mount>/<operation>/<key> and decodes the response's
+// data field into out
+func (v *VaultTransit) call(ctx context.Context, operation string, body interface{}, out interface{}) error {
+	encoded, _ := json.Marshal(body)
+	endpoint := fmt.Sprintf("%s/v1/%s/%s/%s", v.Addr, v.Mount, operation, v.Key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	req.Header.Set("Content-Type", "application/json")
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s: %w", operation, err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	json.Unmarshal(raw, &result)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault %s: HTTP %d: %s", operation, resp.StatusCode, strings.Join(result.Errors, "; "))
+	}
+	return json.Unmarshal(result.Data, out)
+}
@@ -0,0 +1,198 @@
+package envelope
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewLocalKey(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		name    string
+		encoded string
+		wantErr bool
+	}{
+		{name: "valid", encoded: valid},
+		{name: "trailing newline", encoded: valid + "\n"},
+		{name: "empty", encoded: "", wantErr: true},
+		{name: "16 bytes", encoded: base64.StdEncoding.EncodeToString(make([]byte, 16)), wantErr: true},
+		{name: "not base64", encoded: "not base64!", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := NewLocalKey(tt.encoded)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(key.ID(), "local:") || len(key.ID()) != len("local:")+8 {
+				t.Fatalf("ID = %q", key.ID())
+			}
+		})
+	}
+}
+
+func TestLocalKeyWrap(t *testing.T) {
+	ctx := context.Background()
+	a, b := testKey(t, 1), testKey(t, 2)
+	if a.ID() == b.ID() {
+		t.Fatal("different keys share an id")
+	}
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := a.Wrap(ctx, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := a.Wrap(ctx, dataKey)
+	if wrapped == again {
+		t.Fatal("wrapping is deterministic; nonce not random")
+	}
+	got, err := a.Unwrap(ctx, wrapped)
+	if err != nil || string(got) != string(dataKey) {
+		t.Fatalf("Unwrap = %q, %v", got, err)
+	}
+	if _, err := b.Unwrap(ctx, wrapped); err == nil {
+		t.Fatal("another key unwrapped the data key")
+	}
+	if _, err := a.Unwrap(ctx, "AAAA"); err == nil {
+		t.Fatal("short wrapped key accepted")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantID  string
+		wantErr string
+	}{
+		{name: "unset", env: map[string]string{}},
+		{name: "none", env: map[string]string{"PAYLOAD_ENCRYPTION": "none"}},
+		{name: "local", env: map[string]string{"PAYLOAD_ENCRYPTION": "local", "PAYLOAD_KEY": key}, wantID: "local:"},
+		{name: "local without key", env: map[string]string{"PAYLOAD_ENCRYPTION": "local"}, wantErr: "PAYLOAD_KEY must be 32 bytes"},
+		{name: "vault default mount", env: map[string]string{"PAYLOAD_ENCRYPTION": "vault", "VAULT_ADDR": "http://vault:8200/",
+			"VAULT_TOKEN": "t", "VAULT_TRANSIT_KEY": "payloads"}, wantID: "vault:transit/payloads"},
+		{name: "vault custom mount", env: map[string]string{"PAYLOAD_ENCRYPTION": "vault", "VAULT_ADDR": "http://vault:8200",
+			"VAULT_TOKEN": "t", "VAULT_TRANSIT_KEY": "payloads", "VAULT_TRANSIT_MOUNT": "/kms/"}, wantID: "vault:kms/payloads"},
+		{name: "vault without token", env: map[string]string{"PAYLOAD_ENCRYPTION": "vault", "VAULT_ADDR": "http://vault:8200",
+			"VAULT_TRANSIT_KEY": "payloads"}, wantErr: "needs VAULT_ADDR, VAULT_TOKEN"},
+		{name: "unknown", env: map[string]string{"PAYLOAD_ENCRYPTION": "kms"}, wantErr: `not "kms"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"PAYLOAD_ENCRYPTION", "PAYLOAD_KEY", "VAULT_ADDR", "VAULT_TOKEN",
+				"VAULT_TRANSIT_KEY", "VAULT_TRANSIT_MOUNT", "VAULT_NAMESPACE"} {
+				t.Setenv(name, tt.env[name])
+			}
+			s, err := FromEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantID == "" {
+				if s != nil {
+					t.Fatalf("sealer = %v, want nil", s)
+				}
+				return
+			}
+			if !strings.HasPrefix(s.KeyID(), tt.wantID) {
+				t.Fatalf("KeyID = %q, want prefix %q", s.KeyID(), tt.wantID)
+			}
+		})
+	}
+}
+
+// fakeTransit implements the Vault Transit encrypt and decrypt endpoints by
+// prefixing the plaintext
+func fakeTransit(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" || r.Header.Get("X-Vault-Namespace") != "team-a" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/payloads":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"ciphertext": "vault:v1:" + body["plaintext"]}})
+		case "/v1/transit/decrypt/payloads":
+			plain, ok := strings.CutPrefix(body["ciphertext"], "vault:v1:")
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string][]string{"errors": {"invalid ciphertext"}})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": plain}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestVaultTransit(t *testing.T) {
+	ctx := context.Background()
+	srv := fakeTransit(t)
+	v, err := NewVaultTransit(srv.URL+"/", "s.token", "transit", "payloads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Namespace = "team-a"
+
+	s := New(v)
+	sealedPayload, err := s.Seal(ctx, []byte(`{"card":"4111"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env sealed
+	json.Unmarshal(sealedPayload, &env)
+	if env.KID != "vault:transit/payloads" || !strings.HasPrefix(env.Key, "vault:v1:") {
+		t.Fatalf("envelope = %+v", env)
+	}
+	plain, err := New(v).Open(ctx, sealedPayload)
+	if err != nil || string(plain) != `{"card":"4111"}` {
+		t.Fatalf("Open = %q, %v", plain, err)
+	}
+
+	tests := []struct {
+		name    string
+		change  func(v *VaultTransit)
+		wrapped string
+		wantErr string
+	}{
+		{name: "bad ciphertext", wrapped: "garbage", wantErr: "vault decrypt: HTTP 400: invalid ciphertext"},
+		{name: "wrong token", change: func(v *VaultTransit) { v.Token = "other" }, wrapped: env.Key, wantErr: "HTTP 403: permission denied"},
+		{name: "unknown key", change: func(v *VaultTransit) { v.Key = "other" }, wrapped: env.Key, wantErr: "HTTP 404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := *v
+			if tt.change != nil {
+				tt.change(&c)
+			}
+			_, err := c.Unwrap(ctx, tt.wrapped)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package ruleengine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrRuleSetNotFound is returned when a rule set does not exist or is inactive
+var ErrRuleSetNotFound = errors.New("rule set not found or inactive")
+
+// EvaluationError reports a failure inside the engine while running one rule
+// of a rule set, e.g. a GRL syntax error or invalid facts.
+type EvaluationError struct {
+	Rule    string
+	Version string
+	Err     error
+}
+
+func (e *EvaluationError) Error() string {
+	if e.Version != "" {
+		return fmt.Sprintf("rule %s@%s: %v", e.Rule, e.Version, e.Err)
+	}
+	return fmt.Sprintf("rule %s: %v", e.Rule, e.Err)
+}
+
+func (e *EvaluationError) Unwrap() error {
+	return e.Err
+}
+
+// ErrRuleNotFound is returned when a rule (or rule version) does not exist
+var ErrRuleNotFound = errors.New("rule not found")
+
+// ErrRolloutNotFound is returned for an unknown rollout id
+var ErrRolloutNotFound = errors.New("rollout not found")
+
+// ErrRuleExists is returned by CreateRule when the name is already taken
+var ErrRuleExists = errors.New("rule already exists")
+
+// ValidationError reports invalid input rejected before reaching Postgres
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Message)
+}
+
+// ConflictError is returned when an optimistic concurrency check fails:
+// the rule's active version changed since the caller last read it.
+type ConflictError struct {
+	Rule            string
+	ExpectedVersion string
+	ActualVersion   string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("rule %s: expected active version %s, found %s", e.Rule, e.ExpectedVersion, e.ActualVersion)
+}
@@ -0,0 +1,350 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Result is the outcome of evaluating a rule set against a fact document
+type Result struct {
+	// Facts is the fact document after all rules have run
+	Facts map[string]interface{} `json:"facts"`
+
+	// MatchedRules lists fired rules in firing order (a rule may repeat)
+	MatchedRules []string `json:"matched_rules"`
+
+	// Actions lists the actions executed by fired rules
+	Actions []Action `json:"actions"`
+
+	// Trace is the full engine event log, one entry per debug event
+	Trace []TraceEvent `json:"trace,omitempty"`
+
+	// Explanation reports which conditions of each rule matched, when
+	// requested with EvaluateOptions.Explain
+	Explanation []RuleExplanation `json:"explanation,omitempty"`
+
+	// Rollout is set when the evaluation was sampled by a running rollout
+	Rollout *RolloutOutcome `json:"rollout,omitempty"`
+
+	// RuleFirings counts how often each rule set member fired, by
+	// repository rule name; members that did not fire count 0
+	RuleFirings map[string]int `json:"rule_firings,omitempty"`
+
+	Duration time.Duration `json:"duration"`
+}
+
+// Action is one consequence executed by a fired rule
+type Action struct {
+	Rule   string `json:"rule"`
+	Action string `json:"action"`
+}
+
+// TraceEvent is one step recorded by the engine during evaluation
+type TraceEvent struct {
+	// RuleSetMember is the repository rule whose GRL produced the event
+	RuleSetMember string          `json:"ruleset_member"`
+	Step          int64           `json:"step"`
+	Type          string          `json:"type"`
+	Description   string          `json:"description"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// querier is the subset of *sql.Conn and *sql.Tx used to run the engine
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// ruleSetMember is one rule of a rule set, in execution order
+type ruleSetMember struct {
+	name    string
+	version sql.NullString
+}
+
+// EvaluateOptions configures EvaluateWithOptions
+type EvaluateOptions struct {
+	// Explain reports, per rule, which conditions matched or failed and
+	// the fact values they were compared with. Explained evaluations skip
+	// the result cache, local evaluation, and rollout sampling.
+	Explain bool
+}
+
+// Evaluate runs every rule of the rule set against facts in execution order,
+// feeding each rule the facts produced by the previous one (the same
+// semantics as ruleset_execute). facts may be any JSON-marshalable value.
+//
+// Rules are run through the engine's debug executor so the result can report
+// which rules fired and what they did.
+func (c *Client) Evaluate(ctx context.Context, rulesetID int, facts interface{}) (*Result, error) {
+	return c.EvaluateWithOptions(ctx, rulesetID, facts, EvaluateOptions{})
+}
+
+// EvaluateWithOptions is Evaluate with options
+func (c *Client) EvaluateWithOptions(ctx context.Context, rulesetID int, facts interface{}, opts EvaluateOptions) (*Result, error) {
+	result, err := c.evaluate(ctx, rulesetID, facts, opts)
+	if c.hits != nil && !opts.Explain {
+		c.hits.recordEvaluation(result, err)
+	}
+	return result, err
+}
+
+func (c *Client) evaluate(ctx context.Context, rulesetID int, facts interface{}, opts EvaluateOptions) (*Result, error) {
+	start := time.Now()
+
+	factsJSON, err := json.Marshal(facts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode facts: %w", err)
+	}
+	if c.windows {
+		if factsJSON, err = c.windowFacts(ctx, factsJSON); err != nil {
+			return nil, err
+		}
+	}
+	if c.responseFacts {
+		if factsJSON, err = c.responseFactsAdd(ctx, factsJSON); err != nil {
+			return nil, err
+		}
+	}
+
+	var rollout *Rollout
+	if c.rollouts && !opts.Explain {
+		if rollout, err = c.sampleRollout(ctx, rulesetID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Results are stored only if no rule changed while evaluating
+	var resultKey string
+	var gen uint64
+	if c.results != nil && rollout == nil && !opts.Explain {
+		gen = c.cache.generation()
+		if key, ok := c.results.lookupKey(c.cache, rulesetID, factsJSON); ok {
+			if result, ok := c.results.get(ctx, key); ok {
+				result.Duration = time.Since(start)
+				return result, nil
+			}
+			resultKey = key
+		}
+	}
+
+	if c.cache != nil && rollout == nil && !opts.Explain {
+		if result, ok := c.cache.evaluateLocal(rulesetID, factsJSON, start); ok {
+			return result, nil
+		}
+	}
+
+	// Debug sessions live in the backend's memory, so every call must share
+	// one connection
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	members, err := c.ruleSetMembers(ctx, conn, rulesetID)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *Result
+	if rollout != nil {
+		result, err = c.evaluateRollout(ctx, conn, rollout, members, factsJSON)
+	} else {
+		result, err = c.evaluateMembers(ctx, conn, members, factsJSON, opts.Explain)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Duration = time.Since(start)
+
+	if c.results != nil && rollout == nil && !opts.Explain && c.cache.generation() == gen {
+		if resultKey == "" {
+			// The first evaluation of a rule set fills the rule cache
+			resultKey, _ = c.results.lookupKey(c.cache, rulesetID, factsJSON)
+		}
+		if resultKey != "" {
+			c.results.set(ctx, resultKey, result)
+		}
+	}
+	return result, nil
+}
+
+// evaluateMembers runs members in order, chaining facts between them, and
+// explains each member's rules when explain is set
+func (c *Client) evaluateMembers(ctx context.Context, conn *sql.Conn, members []ruleSetMember, factsJSON []byte, explain bool) (*Result, error) {
+	result := &Result{MatchedRules: []string{}, Actions: []Action{}, Trace: []TraceEvent{}, RuleFirings: map[string]int{}}
+	if explain {
+		result.Explanation = []RuleExplanation{}
+	}
+	current := string(factsJSON)
+	var err error
+	for _, member := range members {
+		current, err = c.evaluateMember(ctx, conn, member, current, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := json.Unmarshal([]byte(current), &result.Facts); err != nil {
+		return nil, fmt.Errorf("engine returned invalid facts: %w", err)
+	}
+	return result, nil
+}
+
+// ruleSetMembers returns the members of an active rule set, from the cache
+// when enabled
+func (c *Client) ruleSetMembers(ctx context.Context, conn *sql.Conn, rulesetID int) ([]ruleSetMember, error) {
+	if c.cache == nil {
+		return loadRuleSetMembers(ctx, conn, rulesetID)
+	}
+	if members, ok := c.cache.members(rulesetID); ok {
+		return members, nil
+	}
+
+	gen := c.cache.generation()
+	members, err := loadRuleSetMembers(ctx, conn, rulesetID)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.storeMembers(gen, rulesetID, members)
+	return members, nil
+}
+
+func loadRuleSetMembers(ctx context.Context, conn *sql.Conn, rulesetID int) ([]ruleSetMember, error) {
+	var active bool
+	err := conn.QueryRowContext(ctx,
+		"SELECT is_active FROM rule_sets WHERE ruleset_id = $1", rulesetID,
+	).Scan(&active)
+	if err == sql.ErrNoRows || (err == nil && !active) {
+		return nil, fmt.Errorf("rule set %d: %w", rulesetID, ErrRuleSetNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx,
+		"SELECT rule_name, rule_version FROM ruleset_get_rules($1)", rulesetID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []ruleSetMember
+	for rows.Next() {
+		var m ruleSetMember
+		if err := rows.Scan(&m.name, &m.version); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// evaluateMember loads one rule set member's GRL and runs it, returning the
+// updated facts. Rules are explained against facts when result.Explanation
+// is non-nil.
+func (c *Client) evaluateMember(ctx context.Context, conn *sql.Conn, member ruleSetMember, facts string, result *Result) (string, error) {
+	grl, err := c.memberGRL(ctx, conn, member)
+	if err != nil {
+		return "", &EvaluationError{Rule: member.name, Version: member.version.String, Err: err}
+	}
+
+	firedBefore := len(result.MatchedRules)
+	output, err := runDebug(ctx, conn, member.name, grl, facts, result)
+	if err != nil {
+		return "", &EvaluationError{Rule: member.name, Version: member.version.String, Err: err}
+	}
+	result.RuleFirings[member.name] += len(result.MatchedRules) - firedBefore
+
+	if result.Explanation != nil {
+		var input map[string]interface{}
+		if err := json.Unmarshal([]byte(facts), &input); err != nil {
+			return "", fmt.Errorf("engine returned invalid facts: %w", err)
+		}
+		fired := make(map[string]bool)
+		for _, name := range result.MatchedRules[firedBefore:] {
+			fired[name] = true
+		}
+		result.Explanation = append(result.Explanation, explainGRL(member.name, grl, input, fired)...)
+	}
+	return output, nil
+}
+
+// memberGRL returns a member's GRL, from the cache when enabled
+func (c *Client) memberGRL(ctx context.Context, conn *sql.Conn, member ruleSetMember) (string, error) {
+	key := ruleKey{member.name, member.version.String}
+	var gen uint64
+	if c.cache != nil {
+		if cached, ok := c.cache.rule(key); ok {
+			return cached.grl, nil
+		}
+		gen = c.cache.generation()
+	}
+
+	var grl string
+	if err := conn.QueryRowContext(ctx,
+		"SELECT rule_get($1, $2)", member.name, member.version,
+	).Scan(&grl); err != nil {
+		return "", err
+	}
+	if c.cache != nil {
+		c.cache.storeRule(gen, key, grl)
+	}
+	return grl, nil
+}
+
+// runDebug executes grl with the engine's debug executor, appends fired
+// rules, actions, and trace events (labelled with member) to result, and
+// returns the updated facts.
+func runDebug(ctx context.Context, q querier, member, grl, facts string, result *Result) (string, error) {
+	var sessionID string
+	var output []byte
+	if err := q.QueryRowContext(ctx,
+		"SELECT session_id, result FROM run_rule_engine_debug($1, $2)", facts, grl,
+	).Scan(&sessionID, &output); err != nil {
+		return "", err
+	}
+	defer q.ExecContext(context.WithoutCancel(ctx), "SELECT debug_delete_session($1)", sessionID)
+
+	rows, err := q.QueryContext(ctx,
+		"SELECT step, event_type, description, event_data FROM debug_get_events($1)", sessionID,
+	)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event := TraceEvent{RuleSetMember: member}
+		var data []byte
+		if err := rows.Scan(&event.Step, &event.Type, &event.Description, &data); err != nil {
+			return "", err
+		}
+		event.Data = data
+		result.Trace = append(result.Trace, event)
+
+		if event.Type == "RuleFired" {
+			var fired struct {
+				RuleName        string   `json:"rule_name"`
+				ActionsExecuted []string `json:"actions_executed"`
+			}
+			if err := json.Unmarshal(data, &fired); err != nil {
+				return "", fmt.Errorf("invalid RuleFired event: %w", err)
+			}
+			result.MatchedRules = append(result.MatchedRules, fired.RuleName)
+			for _, action := range fired.ActionsExecuted {
+				result.Actions = append(result.Actions, Action{Rule: fired.RuleName, Action: action})
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	return string(output), nil
+}
@@ -0,0 +1,182 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newMock returns a client over a sqlmock database whose expectations may
+// be met in any order
+func newMock(t *testing.T) (*Client, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.MatchExpectationsInOrder(false)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return New(db), mock
+}
+
+// expectDebugRun expects one run_rule_engine_debug call returning output,
+// with one RuleFired event per fired rule
+func expectDebugRun(mock sqlmock.Sqlmock, session, output string, fired ...string) {
+	mock.ExpectQuery(`run_rule_engine_debug`).
+		WillReturnRows(sqlmock.NewRows([]string{"session_id", "result"}).AddRow(session, output))
+	events := sqlmock.NewRows([]string{"step", "event_type", "description", "event_data"}).
+		AddRow(1, "SessionStarted", "started", []byte(`{}`))
+	for i, name := range fired {
+		events.AddRow(i+2, "RuleFired", "fired "+name,
+			[]byte(`{"rule_name":"`+name+`","actions_executed":["Order.flagged = true"]}`))
+	}
+	mock.ExpectQuery(`debug_get_events`).WithArgs(session).WillReturnRows(events)
+	mock.ExpectExec(`debug_delete_session`).WithArgs(session).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestEvaluate(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectQuery(`SELECT is_active FROM rule_sets`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(true))
+	mock.ExpectQuery(`ruleset_get_rules`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_name", "rule_version"}).
+			AddRow("HighValue", "1.0.0").AddRow("Audit", nil))
+	mock.ExpectQuery(`rule_get`).WithArgs("HighValue", "1.0.0").
+		WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(`rule HighValue "" { when Order.total > 1000 then Order.flagged = true; }`))
+	mock.ExpectQuery(`rule_get`).WithArgs("Audit", nil).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(`rule Audit "" { when true then Order.audited = true; }`))
+	expectDebugRun(mock, "s1", `{"Order":{"total":1200,"flagged":true}}`, "HighValue")
+	expectDebugRun(mock, "s2", `{"Order":{"total":1200,"flagged":true,"audited":true}}`)
+
+	result, err := client.Evaluate(context.Background(), 7, map[string]interface{}{"Order": map[string]interface{}{"total": 1200}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.MatchedRules) != 1 || result.MatchedRules[0] != "HighValue" {
+		t.Fatalf("matched rules = %v", result.MatchedRules)
+	}
+	if len(result.Actions) != 1 || result.Actions[0] != (Action{Rule: "HighValue", Action: "Order.flagged = true"}) {
+		t.Fatalf("actions = %v", result.Actions)
+	}
+	if result.RuleFirings["HighValue"] != 1 || result.RuleFirings["Audit"] != 0 {
+		t.Fatalf("rule firings = %v", result.RuleFirings)
+	}
+	if len(result.Trace) != 3 || result.Trace[0].RuleSetMember != "HighValue" || result.Trace[2].RuleSetMember != "Audit" {
+		t.Fatalf("trace = %+v", result.Trace)
+	}
+	order := result.Facts["Order"].(map[string]interface{})
+	if order["audited"] != true {
+		t.Fatalf("facts were not chained between members: %v", result.Facts)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	ruleSet := func(mock sqlmock.Sqlmock, active bool) {
+		mock.ExpectQuery(`SELECT is_active FROM rule_sets`).
+			WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(active))
+	}
+	members := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(`ruleset_get_rules`).
+			WillReturnRows(sqlmock.NewRows([]string{"rule_name", "rule_version"}).AddRow("Broken", "2.0.0"))
+		mock.ExpectQuery(`rule_get`).
+			WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(`rule Broken`))
+	}
+	engineErr := errors.New("parse error at line 1")
+
+	tests := []struct {
+		name  string
+		setup func(sqlmock.Sqlmock)
+		check func(*testing.T, error)
+	}{
+		{
+			name: "missing rule set",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT is_active FROM rule_sets`).WillReturnRows(sqlmock.NewRows([]string{"is_active"}))
+			},
+			check: func(t *testing.T, err error) {
+				if !errors.Is(err, ErrRuleSetNotFound) {
+					t.Fatalf("err = %v, want ErrRuleSetNotFound", err)
+				}
+			},
+		},
+		{
+			name:  "inactive rule set",
+			setup: func(mock sqlmock.Sqlmock) { ruleSet(mock, false) },
+			check: func(t *testing.T, err error) {
+				if !errors.Is(err, ErrRuleSetNotFound) {
+					t.Fatalf("err = %v, want ErrRuleSetNotFound", err)
+				}
+			},
+		},
+		{
+			name: "engine error names the member",
+			setup: func(mock sqlmock.Sqlmock) {
+				ruleSet(mock, true)
+				members(mock)
+				mock.ExpectQuery(`run_rule_engine_debug`).WillReturnError(engineErr)
+			},
+			check: func(t *testing.T, err error) {
+				var evalErr *EvaluationError
+				if !errors.As(err, &evalErr) || evalErr.Rule != "Broken" || evalErr.Version != "2.0.0" {
+					t.Fatalf("err = %v, want an EvaluationError for Broken@2.0.0", err)
+				}
+				if !errors.Is(err, engineErr) {
+					t.Fatalf("err = %v does not wrap the engine error", err)
+				}
+			},
+		},
+		{
+			name: "invalid facts from the engine",
+			setup: func(mock sqlmock.Sqlmock) {
+				ruleSet(mock, true)
+				members(mock)
+				expectDebugRun(mock, "s1", `not json`)
+			},
+			check: func(t *testing.T, err error) {
+				if err == nil {
+					t.Fatal("invalid engine output accepted")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			tt.setup(mock)
+			_, err := client.Evaluate(context.Background(), 1, map[string]interface{}{})
+			tt.check(t, err)
+		})
+	}
+}
+
+func TestEvaluateUnencodableFacts(t *testing.T) {
+	client, _ := newMock(t)
+	if _, err := client.Evaluate(context.Background(), 1, make(chan int)); err == nil {
+		t.Fatal("facts that cannot be encoded were accepted")
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	inner := errors.New("boom")
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&EvaluationError{Rule: "A", Err: inner}, "rule A: boom"},
+		{&EvaluationError{Rule: "A", Version: "1.2.0", Err: inner}, "rule A@1.2.0: boom"},
+		{&ValidationError{Field: "name", Message: "must not be empty"}, "invalid name: must not be empty"},
+		{&ConflictError{Rule: "A", ExpectedVersion: "1.0.0", ActualVersion: "1.1.0"}, "rule A: expected active version 1.0.0, found 1.1.0"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+}
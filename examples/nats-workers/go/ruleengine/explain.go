@@ -0,0 +1,194 @@
+package ruleengine
+
+import "strings"
+
+// RuleExplanation reports how one rule's condition evaluated against the
+// facts its rule set member received
+type RuleExplanation struct {
+	// RuleSetMember is the repository rule whose GRL contains the rule
+	RuleSetMember string `json:"ruleset_member"`
+	Rule          string `json:"rule"`
+
+	// Fired is whether the engine fired the rule
+	Fired bool `json:"fired"`
+
+	// Matched is whether the whole condition holds; nil when the condition
+	// uses something explain cannot evaluate (function calls, arithmetic,
+	// field-to-field comparisons)
+	Matched *bool `json:"matched"`
+
+	Condition  string            `json:"condition"`
+	Conditions []ConditionResult `json:"conditions"`
+}
+
+// ConditionResult is one comparison of a rule's condition and the value it
+// was compared with
+type ConditionResult struct {
+	Condition string `json:"condition"`
+
+	// Field, Operator, and Expected are empty when the comparison could not
+	// be parsed
+	Field    string      `json:"field,omitempty"`
+	Operator string      `json:"operator,omitempty"`
+	Expected interface{} `json:"expected"`
+
+	// Actual is the fact value of Field; Found is false when the field is
+	// missing
+	Actual interface{} `json:"actual"`
+	Found  bool        `json:"found"`
+
+	// Matched is nil when the comparison could not be evaluated
+	Matched *bool `json:"matched"`
+}
+
+// explainGRL explains every rule block of a member's GRL against the facts
+// the member received. Conditions are evaluated once against those facts,
+// so a rule that only matched after another rule changed the facts shows
+// Fired without Matched.
+func explainGRL(member, grl string, facts map[string]interface{}, fired map[string]bool) []RuleExplanation {
+	var explanations []RuleExplanation
+	for _, block := range splitGRLRules(grl) {
+		e := RuleExplanation{
+			RuleSetMember: member,
+			Rule:          block.name,
+			Fired:         fired[block.name],
+			Condition:     strings.TrimSpace(block.when),
+			Conditions:    []ConditionResult{},
+		}
+		if cond, ok := parseCondition(block.when); ok {
+			matched := cond.eval(facts)
+			e.Matched = &matched
+		}
+		for _, leaf := range conditionLeaves(block.when) {
+			e.Conditions = append(e.Conditions, explainComparison(leaf, facts))
+		}
+		explanations = append(explanations, e)
+	}
+	return explanations
+}
+
+// parseCondition parses condition text in the local GRL subset
+func parseCondition(text string) (condition, bool) {
+	tokens := tokenizeGRL(text)
+	if tokens == nil {
+		return nil, false
+	}
+	p := &grlParser{tokens: tokens}
+	cond, err := p.or()
+	if err != nil || !p.done() {
+		return nil, false
+	}
+	return cond, true
+}
+
+// explainComparison evaluates one comparison, falling back to reporting
+// just the field value when the comparison is outside the local subset
+func explainComparison(text string, facts map[string]interface{}) ConditionResult {
+	r := ConditionResult{Condition: text}
+	tokens := tokenizeGRL(text)
+	if tokens != nil {
+		p := &grlParser{tokens: tokens}
+		if cond, err := p.primary(); err == nil && p.done() {
+			if c, ok := cond.(comparison); ok {
+				matched := c.eval(facts)
+				r.Field = strings.Join(c.path, ".")
+				r.Operator = c.op
+				r.Expected = c.value
+				r.Actual, r.Found = getPath(facts, c.path)
+				r.Matched = &matched
+				return r
+			}
+		}
+	}
+
+	// Report the leading fact field, if any, so the value is still visible
+	field := text
+	if i := strings.IndexAny(field, " \t\n!=<>("); i >= 0 {
+		field = field[:i]
+	}
+	if strings.Contains(field, ".") {
+		r.Field = field
+		r.Actual, r.Found = getPath(facts, strings.Split(field, "."))
+	}
+	return r
+}
+
+// conditionLeaves splits condition text on && and || outside strings and
+// parentheses, recursing into fully parenthesized groups
+func conditionLeaves(text string) []string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+	for strings.HasPrefix(text, "!(") || strings.HasPrefix(text, "(") {
+		inner, ok := unwrapParens(strings.TrimPrefix(text, "!"))
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(text, "!") {
+			// Negated groups are reported whole
+			return []string{text}
+		}
+		text = strings.TrimSpace(inner)
+	}
+
+	var leaves []string
+	depth, start := 0, 0
+	rs := []rune(text)
+	for i := 0; i < len(rs); i++ {
+		switch r := rs[i]; {
+		case r == '"' || r == '`':
+			for i++; i < len(rs) && rs[i] != r; i++ {
+				if rs[i] == '\\' {
+					i++
+				}
+			}
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case depth == 0 && i+1 < len(rs) && (r == '&' && rs[i+1] == '&' || r == '|' && rs[i+1] == '|'):
+			leaves = append(leaves, string(rs[start:i]))
+			start = i + 2
+			i++
+		}
+	}
+	if len(leaves) == 0 {
+		return []string{text}
+	}
+	leaves = append(leaves, string(rs[start:]))
+
+	var flat []string
+	for _, leaf := range leaves {
+		flat = append(flat, conditionLeaves(leaf)...)
+	}
+	return flat
+}
+
+// unwrapParens returns the inside of text when one pair of parentheses
+// encloses all of it
+func unwrapParens(text string) (string, bool) {
+	if !strings.HasPrefix(text, "(") || !strings.HasSuffix(text, ")") {
+		return "", false
+	}
+	depth := 0
+	rs := []rune(text)
+	for i := 0; i < len(rs); i++ {
+		switch r := rs[i]; r {
+		case '"', '`':
+			for i++; i < len(rs) && rs[i] != r; i++ {
+				if rs[i] == '\\' {
+					i++
+				}
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 && i < len(rs)-1 {
+				return "", false
+			}
+		}
+	}
+	return string(rs[1 : len(rs)-1]), depth == 0
+}
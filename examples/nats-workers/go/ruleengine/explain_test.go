@@ -0,0 +1,141 @@
+package ruleengine
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestConditionLeaves(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{" Order.Total > 1 ", []string{"Order.Total > 1"}},
+		{"Order.A > 1 && Order.B < 2 || Order.C == 3", []string{"Order.A > 1", "Order.B < 2", "Order.C == 3"}},
+		{"(Order.A > 1 && (Order.B == 2 || Order.C == 3))", []string{"Order.A > 1", "Order.B == 2", "Order.C == 3"}},
+		{"(Order.A > 1) && (Order.B < 2)", []string{"Order.A > 1", "Order.B < 2"}},
+		{`Order.Note == "a && b" || Order.X == 1`, []string{`Order.Note == "a && b"`, "Order.X == 1"}},
+		{"!(Order.A > 1 && Order.B > 2)", []string{"!(Order.A > 1 && Order.B > 2)"}},
+		{"Order.Items.Len() > 3", []string{"Order.Items.Len() > 3"}},
+	}
+	for _, tt := range tests {
+		if got := conditionLeaves(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("conditionLeaves(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUnwrapParens(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"(a)", "a", true},
+		{"((a) && (b))", "(a) && (b)", true},
+		{"(a) && (b)", "", false},
+		{`(x == ")")`, `x == ")"`, true},
+		{"(a", "", false},
+		{"a", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := unwrapParens(tt.in); got != tt.want || ok != tt.ok {
+			t.Errorf("unwrapParens(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestExplainComparison(t *testing.T) {
+	facts := map[string]interface{}{"Order": map[string]interface{}{"Total": 150.0, "Country": "NL"}}
+	yes, no := true, false
+	tests := []struct {
+		text string
+		want ConditionResult
+	}{
+		{"Order.Total > 100", ConditionResult{Field: "Order.Total", Operator: ">", Expected: 100.0,
+			Actual: 150.0, Found: true, Matched: &yes}},
+		{`Order.Country == "DE"`, ConditionResult{Field: "Order.Country", Operator: "==", Expected: "DE",
+			Actual: "NL", Found: true, Matched: &no}},
+		{"Order.Missing >= 1", ConditionResult{Field: "Order.Missing", Operator: ">=", Expected: 1.0, Matched: &no}},
+		// Outside the local subset: the leading field is still reported
+		{"Order.Total * 2 > 100", ConditionResult{Field: "Order.Total", Actual: 150.0, Found: true}},
+		{"Order.Items.Len() > 3", ConditionResult{Field: "Order.Items.Len"}},
+		{"IsWeekend()", ConditionResult{}},
+	}
+	for _, tt := range tests {
+		tt.want.Condition = tt.text
+		if got := explainComparison(tt.text, facts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("explainComparison(%q) = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestExplainGRL(t *testing.T) {
+	grl := `rule Big "" { when Order.Total > 100 && Order.Country == "DE" then Order.Big = true; }
+rule Weekend "" { when IsWeekend() || Order.Total > 1 then Order.W = true; }`
+	facts := map[string]interface{}{"Order": map[string]interface{}{"Total": 150.0, "Country": "NL"}}
+	got := explainGRL("Member", grl, facts, map[string]bool{"Weekend": true})
+	if len(got) != 2 {
+		t.Fatalf("explanations = %+v", got)
+	}
+	big, weekend := got[0], got[1]
+	if big.RuleSetMember != "Member" || big.Rule != "Big" || big.Fired || big.Matched == nil || *big.Matched ||
+		big.Condition != `Order.Total > 100 && Order.Country == "DE"` || len(big.Conditions) != 2 ||
+		!*big.Conditions[0].Matched || *big.Conditions[1].Matched {
+		t.Errorf("Big = %+v", big)
+	}
+	// The function call cannot be evaluated, so neither can the whole
+	// condition
+	if !weekend.Fired || weekend.Matched != nil || len(weekend.Conditions) != 2 ||
+		weekend.Conditions[0].Matched != nil || !*weekend.Conditions[1].Matched {
+		t.Errorf("Weekend = %+v", weekend)
+	}
+}
+
+func TestEvaluateExplain(t *testing.T) {
+	client, mock := newMock(t)
+	// Explain skips the result cache and local evaluation
+	grlA := `rule A "" { when Order.total > 1000 then Order.flagged = true; }`
+	client.cache = cachedRuleSet(grlA)
+	client.cache.local = true
+	client.cache.storeRule(0, ruleKey{"A", ""}, grlA) // compiled for local evaluation
+	client.results = newResultCache(CacheOptions{ResultCacheSize: 10})
+
+	expectDebugRun(mock, "s1", `{"Order":{"total":1200,"flagged":true}}`, "A")
+	expectDebugRun(mock, "s2", `{"Order":{"total":1200,"flagged":true}}`)
+	result, err := client.EvaluateWithOptions(context.Background(), 7,
+		map[string]interface{}{"Order": map[string]interface{}{"total": 1200}}, EvaluateOptions{Explain: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Explanation) != 2 {
+		t.Fatalf("explanation = %+v", result.Explanation)
+	}
+	a, b := result.Explanation[0], result.Explanation[1]
+	if a.Rule != "A" || !a.Fired || a.Matched == nil || !*a.Matched {
+		t.Errorf("A = %+v", a)
+	}
+	// B's condition has no fact field to report
+	if b.RuleSetMember != "B" || b.Fired || len(b.Conditions) != 1 || b.Conditions[0].Field != "" {
+		t.Errorf("B = %+v", b)
+	}
+	if s := client.ResultCacheStats(); s.Hits+s.Misses != 0 || s.Entries != 0 {
+		t.Errorf("explain used the result cache: %+v", s)
+	}
+
+	// Without explain the result has no explanation
+	mock.ExpectQuery(`SELECT is_active`).WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(true))
+	client.cache, client.results = nil, nil
+	mock.ExpectQuery(`ruleset_get_rules`).WillReturnRows(sqlmock.NewRows([]string{"rule_name", "rule_version"}).AddRow("A", nil))
+	mock.ExpectQuery(`rule_get`).WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(`rule A "" { when true then Retract("A"); }`))
+	expectDebugRun(mock, "s3", `{}`)
+	if result, err := client.Evaluate(context.Background(), 7, map[string]interface{}{}); err != nil || result.Explanation != nil {
+		t.Fatalf("Evaluate = %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,98 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExtensionName is the name the extension is installed under
+const ExtensionName = "rule_engine_postgre_extensions"
+
+// The extension versions this package works with: from 1.8.0, which added
+// the NATS consumer statistics, up to the next major version, which may
+// change the SQL functions it calls
+const (
+	MinExtensionVersion = "1.8.0"
+	MaxExtensionMajor   = 2
+)
+
+// ErrExtensionNotInstalled is returned when the database does not have the
+// extension
+var ErrExtensionNotInstalled = errors.New("extension " + ExtensionName + " is not installed")
+
+// ExtensionVersionError reports an installed extension this package was
+// not built for
+type ExtensionVersionError struct {
+	Version string
+}
+
+func (e *ExtensionVersionError) Error() string {
+	return fmt.Sprintf("extension %s %s is not supported (want %s up to %d.x)",
+		ExtensionName, e.Version, MinExtensionVersion, MaxExtensionMajor)
+}
+
+// ExtensionVersion returns the version of the extension installed in the
+// database, or ErrExtensionNotInstalled
+func (c *Client) ExtensionVersion(ctx context.Context) (string, error) {
+	var version string
+	err := c.db.QueryRowContext(ctx,
+		`SELECT extversion FROM pg_extension WHERE extname = $1`, ExtensionName,
+	).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrExtensionNotInstalled
+	}
+	return version, err
+}
+
+// CheckExtension returns the installed extension's version, with an
+// *ExtensionVersionError when it is outside MinExtensionVersion and
+// MaxExtensionMajor
+func (c *Client) CheckExtension(ctx context.Context) (string, error) {
+	version, err := c.ExtensionVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !ExtensionSupported(version) {
+		return version, &ExtensionVersionError{Version: version}
+	}
+	return version, nil
+}
+
+// ExtensionSupported reports whether this package works with the extension
+// version, e.g. "2.0.0"
+func ExtensionSupported(version string) bool {
+	v, ok := parseExtensionVersion(version)
+	if !ok {
+		return false
+	}
+	min, _ := parseExtensionVersion(MinExtensionVersion)
+	for i := range v {
+		if v[i] != min[i] {
+			return v[i] > min[i] && v[0] <= MaxExtensionMajor
+		}
+	}
+	return true
+}
+
+// parseExtensionVersion splits major.minor.patch; a missing patch is 0 and
+// a suffix such as "-beta" is ignored
+func parseExtensionVersion(version string) ([3]int, bool) {
+	var v [3]int
+	version, _, _ = strings.Cut(version, "-")
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
@@ -0,0 +1,87 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestExtensionSupported(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"1.8.0", true},
+		{"1.8", true},
+		{"1.8.3", true},
+		{"1.10.0", true},
+		{"2.0.0", true},
+		{"2.9.1-beta", true},
+		{"1.7.9", false},
+		{"1.7", false},
+		{"0.9.0", false},
+		{"3.0.0", false},
+		{"1", false},
+		{"1.8.0.1", false},
+		{"1.x.0", false},
+		{"1.-8.0", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := ExtensionSupported(tt.version); got != tt.want {
+			t.Errorf("ExtensionSupported(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestCheckExtension(t *testing.T) {
+	const query = `SELECT extversion FROM pg_extension WHERE extname = \$1`
+	dbErr := errors.New("connection refused")
+	tests := []struct {
+		name        string
+		rows        *sqlmock.Rows
+		err         error
+		want        string
+		wantErr     error
+		wantVersion bool // an *ExtensionVersionError
+	}{
+		{name: "supported", rows: sqlmock.NewRows([]string{"extversion"}).AddRow("1.9.0"), want: "1.9.0"},
+		{name: "too old", rows: sqlmock.NewRows([]string{"extversion"}).AddRow("1.6.2"), want: "1.6.2", wantVersion: true},
+		{name: "next major", rows: sqlmock.NewRows([]string{"extversion"}).AddRow("3.0.0"), want: "3.0.0", wantVersion: true},
+		{name: "not installed", rows: sqlmock.NewRows([]string{"extversion"}), wantErr: ErrExtensionNotInstalled},
+		{name: "database error", err: dbErr, wantErr: dbErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mock := newMock(t)
+			q := mock.ExpectQuery(query).WithArgs(ExtensionName)
+			if tt.err != nil {
+				q.WillReturnError(tt.err)
+			} else {
+				q.WillReturnRows(tt.rows)
+			}
+			version, err := c.CheckExtension(context.Background())
+			if version != tt.want {
+				t.Fatalf("version = %q, want %q", version, tt.want)
+			}
+			var versionErr *ExtensionVersionError
+			switch {
+			case tt.wantVersion:
+				if !errors.As(err, &versionErr) || versionErr.Version != tt.want {
+					t.Fatalf("err = %v, want an unsupported %s", err, tt.want)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExtensionVersionError(t *testing.T) {
+	err := &ExtensionVersionError{Version: "3.0.0"}
+	if want := "extension rule_engine_postgre_extensions 3.0.0 is not supported (want 1.8.0 up to 2.x)"; err.Error() != want {
+		t.Fatalf("Error = %q, want %q", err.Error(), want)
+	}
+}
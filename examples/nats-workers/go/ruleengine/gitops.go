@@ -0,0 +1,257 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"sort"
+)
+
+//go:embed gitops.sql
+var gitopsSQL string
+
+// RuleFile is one rule as declared in a Git repository
+type RuleFile struct {
+	Path        string `json:"-" yaml:"-"`
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Version     string `json:"version" yaml:"version"`
+	GRL         string `json:"grl" yaml:"grl"`
+	ChangeNotes string `json:"change_notes,omitempty" yaml:"change_notes,omitempty"`
+	Enabled     *bool  `json:"enabled,omitempty" yaml:"enabled,omitempty"` // Default true
+}
+
+// SyncedRule reports what SyncRules did with one rule: "created",
+// "updated" (new version saved and activated), "activated" (existing
+// version re-activated), "unchanged", or "pruned"
+type SyncedRule struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Action  string `json:"action"`
+}
+
+// SyncResult is the outcome of SyncRules
+type SyncResult struct {
+	Commit string       `json:"commit"`
+	Rules  []SyncedRule `json:"rules"`
+}
+
+// SyncRules makes the repository match files, as of commit, in one
+// transaction. Each file's version becomes the rule's active version;
+// versions are immutable, so reusing a version number with different GRL
+// fails the whole sync. The commit SHA is recorded per changed rule in
+// rule_gitops_state. With prune, rules previously synced but no longer
+// present are disabled.
+func (c *Client) SyncRules(ctx context.Context, commit string, files []RuleFile, prune bool) (*SyncResult, error) {
+	seen := map[string]string{}
+	for _, f := range files {
+		if err := validateRuleName(f.Name); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Path, err)
+		}
+		if f.Version == "" {
+			return nil, fmt.Errorf("%s: %w", f.Path, &ValidationError{Field: "version", Message: "is required"})
+		}
+		if err := validateVersion("version", f.Version); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Path, err)
+		}
+		if err := validateGRL(f.GRL); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Path, err)
+		}
+		if other, dup := seen[f.Name]; dup {
+			return nil, &ValidationError{Field: "name", Message: fmt.Sprintf("%s is declared in both %s and %s", f.Name, other, f.Path)}
+		}
+		seen[f.Name] = f.Path
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, gitopsSQL); err != nil {
+		return nil, fmt.Errorf("failed to prepare rule_gitops_state: %w", err)
+	}
+	// Serialize concurrent syncs (e.g. two replicas of a sync daemon)
+	if _, err := tx.ExecContext(ctx, "LOCK TABLE rule_gitops_state IN EXCLUSIVE MODE"); err != nil {
+		return nil, err
+	}
+
+	result := &SyncResult{Commit: commit, Rules: []SyncedRule{}}
+	for _, f := range files {
+		action, err := syncRule(ctx, tx, commit, f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Path, err)
+		}
+		result.Rules = append(result.Rules, SyncedRule{Name: f.Name, Version: f.Version, Path: f.Path, Action: action})
+	}
+
+	if prune {
+		pruned, err := pruneRules(ctx, tx, seen)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range pruned {
+			result.Rules = append(result.Rules, SyncedRule{Name: name, Action: "pruned"})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func syncRule(ctx context.Context, tx *sql.Tx, commit string, f RuleFile) (string, error) {
+	var active, existingGRL sql.NullString
+	var isActive sql.NullBool
+	err := tx.QueryRowContext(ctx,
+		`SELECT rd.is_active,
+		        (SELECT version FROM rule_versions WHERE rule_id = rd.id AND is_default),
+		        (SELECT grl_content FROM rule_versions WHERE rule_id = rd.id AND version = $2)
+		 FROM rule_definitions rd WHERE rd.name = $1
+		 FOR UPDATE`,
+		f.Name, f.Version,
+	).Scan(&isActive, &active, &existingGRL)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	ruleExists := err == nil
+
+	action := "unchanged"
+	switch {
+	case !ruleExists:
+		action = "created"
+	case existingGRL.Valid && existingGRL.String != f.GRL:
+		return "", fmt.Errorf("version %s of %s already exists with different GRL; bump the version", f.Version, f.Name)
+	case !existingGRL.Valid:
+		action = "updated"
+	case active.String != f.Version:
+		action = "activated"
+	}
+
+	if action == "created" || action == "updated" {
+		notes := f.ChangeNotes
+		if notes == "" {
+			notes = "gitops " + commit + ": " + f.Path
+		}
+		if _, err := tx.ExecContext(ctx,
+			"SELECT rule_save($1, $2, $3, $4, $5)",
+			f.Name, f.GRL, f.Version, nullString(f.Description), notes,
+		); err != nil {
+			return "", err
+		}
+	}
+	if action != "unchanged" {
+		if _, err := tx.ExecContext(ctx, "SELECT rule_activate($1, $2)", f.Name, f.Version); err != nil {
+			return "", err
+		}
+	}
+
+	enabled := f.Enabled == nil || *f.Enabled
+	if !ruleExists || isActive.Bool != enabled {
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE rule_definitions SET is_active = $2, updated_at = NOW(), updated_by = CURRENT_USER WHERE name = $1",
+			f.Name, enabled,
+		); err != nil {
+			return "", err
+		}
+		if action == "unchanged" {
+			action = "updated"
+		}
+	}
+
+	if action != "unchanged" {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO rule_gitops_state (rule_name, path, version, commit_sha, applied_at)
+			 VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+			 ON CONFLICT (rule_name) DO UPDATE
+			 SET path = EXCLUDED.path, version = EXCLUDED.version,
+			     commit_sha = EXCLUDED.commit_sha, applied_at = EXCLUDED.applied_at`,
+			f.Name, f.Path, f.Version, commit,
+		); err != nil {
+			return "", err
+		}
+	}
+	return action, nil
+}
+
+// pruneRules disables GitOps-managed rules missing from the repository
+func pruneRules(ctx context.Context, tx *sql.Tx, present map[string]string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT rule_name FROM rule_gitops_state")
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if _, ok := present[name]; !ok {
+			stale = append(stale, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(stale)
+
+	for _, name := range stale {
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE rule_definitions SET is_active = false, updated_at = NOW(), updated_by = CURRENT_USER WHERE name = $1",
+			name,
+		); err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM rule_gitops_state WHERE rule_name = $1", name); err != nil {
+			return nil, err
+		}
+	}
+	return stale, nil
+}
+
+// GitOpsState is the last applied commit for one GitOps-managed rule
+type GitOpsState struct {
+	Rule      string `json:"rule"`
+	Path      string `json:"path"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	AppliedAt string `json:"applied_at"`
+}
+
+// ListGitOpsState returns the commit each GitOps-managed rule came from
+func (c *Client) ListGitOpsState(ctx context.Context) ([]GitOpsState, error) {
+	states := []GitOpsState{}
+
+	// The table is created by the first sync
+	var exists bool
+	if err := c.db.QueryRowContext(ctx, "SELECT to_regclass('rule_gitops_state') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return states, nil
+	}
+
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT rule_name, path, version, commit_sha, applied_at::TEXT
+		 FROM rule_gitops_state ORDER BY rule_name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s GitOpsState
+		if err := rows.Scan(&s.Rule, &s.Path, &s.Version, &s.Commit, &s.AppliedAt); err != nil {
+			return nil, err
+		}
+		states = append(states, s)
+	}
+	return states, rows.Err()
+}
@@ -0,0 +1,11 @@
+-- State for GitOps-managed rules (see Client.SyncRules): which commit last
+-- changed each rule and the file it came from.
+CREATE TABLE IF NOT EXISTS rule_gitops_state (
+    rule_name TEXT PRIMARY KEY,
+    path TEXT NOT NULL,
+    version TEXT NOT NULL,
+    commit_sha TEXT NOT NULL,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE rule_gitops_state IS 'Git commit last applied to each GitOps-managed rule';
@@ -0,0 +1,133 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSyncRulesValidation(t *testing.T) {
+	good := RuleFile{Path: "rules/a.yaml", Name: "A", Version: "1.0.0", GRL: "rule A {}"}
+	tests := []struct {
+		name  string
+		files []RuleFile
+		want  string
+	}{
+		{"bad name", []RuleFile{{Path: "x.yaml", Name: "has space", Version: "1.0.0", GRL: "r"}}, "x.yaml"},
+		{"no version", []RuleFile{{Path: "x.yaml", Name: "A", GRL: "r"}}, "version"},
+		{"bad version", []RuleFile{{Path: "x.yaml", Name: "A", Version: "v1", GRL: "r"}}, "version"},
+		{"empty grl", []RuleFile{{Path: "x.yaml", Name: "A", Version: "1.0.0"}}, "grl"},
+		{"duplicate", []RuleFile{good, {Path: "rules/b.yaml", Name: "A", Version: "1.0.1", GRL: "r"}},
+			"declared in both rules/a.yaml and rules/b.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newMock(t)
+			_, err := client.SyncRules(context.Background(), "abc", tt.files, false)
+			var validation *ValidationError
+			if !errors.As(err, &validation) || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want a validation error mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncRules(t *testing.T) {
+	state := func(isActive bool, active, grl interface{}) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"is_active", "version", "grl_content"}).AddRow(isActive, active, grl)
+	}
+	disabled := false
+	tests := []struct {
+		name    string
+		file    RuleFile
+		row     *sqlmock.Rows // nil: rule does not exist
+		save    bool
+		enable  bool
+		want    string
+		wantErr string
+	}{
+		{name: "new rule", save: true, enable: true, want: "created"},
+		{name: "new version", row: state(true, "1.0.0", nil), save: true, want: "updated"},
+		{name: "older version re-activated", row: state(true, "2.0.0", "rule A {}"), want: "activated"},
+		{name: "unchanged", row: state(true, "1.0.0", "rule A {}"), want: "unchanged"},
+		{name: "disabled in git", file: RuleFile{Enabled: &disabled}, row: state(true, "1.0.0", "rule A {}"),
+			enable: true, want: "updated"},
+		{name: "version reused", row: state(true, "1.0.0", "rule A { other }"), wantErr: "bump the version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newOrderedMock(t)
+			f := RuleFile{Path: "rules/a.yaml", Name: "A", Version: "1.0.0", GRL: "rule A {}", Enabled: tt.file.Enabled}
+			mock.ExpectBegin()
+			mock.ExpectExec(`CREATE TABLE IF NOT EXISTS rule_gitops_state`).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(`LOCK TABLE rule_gitops_state`).WillReturnResult(sqlmock.NewResult(0, 0))
+			row := tt.row
+			if row == nil {
+				row = sqlmock.NewRows([]string{"is_active", "version", "grl_content"})
+			}
+			mock.ExpectQuery(`FROM rule_definitions rd WHERE rd.name = \$1`).WithArgs("A", "1.0.0").WillReturnRows(row)
+			if tt.wantErr != "" {
+				mock.ExpectRollback()
+			} else {
+				if tt.save {
+					mock.ExpectExec(`rule_save`).WithArgs("A", f.GRL, "1.0.0", nil, "gitops abc: rules/a.yaml").
+						WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				if tt.want == "created" || tt.want == "activated" || tt.save {
+					mock.ExpectExec(`rule_activate`).WithArgs("A", "1.0.0").WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				if tt.enable {
+					mock.ExpectExec(`UPDATE rule_definitions SET is_active`).WithArgs("A", f.Enabled == nil).
+						WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				if tt.want != "unchanged" {
+					mock.ExpectExec(`INSERT INTO rule_gitops_state`).WithArgs("A", f.Path, "1.0.0", "abc").
+						WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				mock.ExpectCommit()
+			}
+
+			result, err := client.SyncRules(context.Background(), "abc", []RuleFile{f}, false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if result.Rules[0].Action != tt.want {
+				t.Fatalf("action = %q, want %q", result.Rules[0].Action, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSyncRulesPrune(t *testing.T) {
+	client, mock := newOrderedMock(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS rule_gitops_state`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`LOCK TABLE`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT rule_name FROM rule_gitops_state`).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_name"}).AddRow("Old").AddRow("Gone"))
+	for _, name := range []string{"Gone", "Old"} {
+		mock.ExpectExec(`SET is_active = false`).WithArgs(name).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`DELETE FROM rule_gitops_state`).WithArgs(name).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	result, err := client.SyncRules(context.Background(), "abc", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rules) != 2 || result.Rules[0].Name != "Gone" || result.Rules[1].Action != "pruned" {
+		t.Fatalf("rules = %+v", result.Rules)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
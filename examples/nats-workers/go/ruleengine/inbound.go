@@ -0,0 +1,274 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//go:embed inbound.sql
+var inboundSQL string
+
+// ErrInboundSourceNotFound is returned for an unknown inbound source name
+var ErrInboundSourceNotFound = errors.New("inbound source not found")
+
+// InboundProviders are the signature schemes an inbound source can use
+var InboundProviders = []string{"stripe", "github", "slack", "shopify", "standard", "hmac"}
+
+// InboundSource is a third party allowed to send webhooks to the gateway
+type InboundSource struct {
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+
+	// Secret verifies the provider's signatures. It is stored encrypted
+	// with the extension's encrypt_credential(); GetInboundSource returns
+	// it decrypted, ListInboundSources not at all.
+	Secret string `json:"secret,omitempty"`
+
+	// RuleSetID is evaluated against every event; 0 only stores events
+	RuleSetID int       `json:"ruleset_id,omitempty"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InboundEvent is one accepted webhook. Facts is the document rules see:
+// an Event fact with source, provider, type, id, received_at, and data.
+type InboundEvent struct {
+	ID           int64           `json:"id"`
+	Source       string          `json:"source"`
+	EventID      string          `json:"event_id"`
+	Type         string          `json:"type,omitempty"`
+	Facts        json.RawMessage `json:"facts"`
+	MatchedRules []string        `json:"matched_rules,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	ReceivedAt   time.Time       `json:"received_at"`
+	EvaluatedAt  *time.Time      `json:"evaluated_at,omitempty"`
+}
+
+// EnableInbound creates the inbound source and event tables if needed,
+// encrypting the secrets of sources stored before they were. It is
+// idempotent and needs the extension's credential encryption.
+func (c *Client) EnableInbound(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, inboundSQL); err != nil {
+		return fmt.Errorf("failed to install inbound webhooks: %w", err)
+	}
+	return nil
+}
+
+// CreateInboundSource registers a sender
+func (c *Client) CreateInboundSource(ctx context.Context, s InboundSource) error {
+	if s.Name == "" || strings.ContainsAny(s.Name, "/?#") {
+		return &ValidationError{Field: "name", Message: "is required and must be usable in a URL path"}
+	}
+	known := false
+	for _, p := range InboundProviders {
+		known = known || p == s.Provider
+	}
+	if !known {
+		return &ValidationError{Field: "provider", Message: "must be one of " + strings.Join(InboundProviders, ", ")}
+	}
+	if s.Secret == "" {
+		return &ValidationError{Field: "secret", Message: "is required"}
+	}
+	if s.RuleSetID < 0 {
+		return &ValidationError{Field: "ruleset_id", Message: "must not be negative"}
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO rule_inbound_sources (name, provider, secret_encrypted, ruleset_id) VALUES ($1, $2, encrypt_credential($3), NULLIF($4, 0))`,
+		s.Name, s.Provider, s.Secret, s.RuleSetID,
+	); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return &ValidationError{Field: "name", Message: "already exists"}
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+const inboundSourceColumns = `name, provider, COALESCE(ruleset_id, 0), enabled, created_at`
+
+// scanInboundSource scans inboundSourceColumns and then, with secret,
+// the decrypted secret
+func scanInboundSource(row interface{ Scan(...interface{}) error }, secret bool) (*InboundSource, error) {
+	var s InboundSource
+	dest := []interface{}{&s.Name, &s.Provider, &s.RuleSetID, &s.Enabled, &s.CreatedAt}
+	if secret {
+		dest = append(dest, &s.Secret)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GetInboundSource returns one source, with its secret
+func (c *Client) GetInboundSource(ctx context.Context, name string) (*InboundSource, error) {
+	s, err := scanInboundSource(c.db.QueryRowContext(ctx,
+		"SELECT "+inboundSourceColumns+", decrypt_credential(secret_encrypted) FROM rule_inbound_sources WHERE name = $1", name,
+	), true)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s: %w", name, ErrInboundSourceNotFound)
+	}
+	return s, err
+}
+
+// ListInboundSources returns all sources by name, without their secrets
+func (c *Client) ListInboundSources(ctx context.Context) ([]InboundSource, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT "+inboundSourceColumns+" FROM rule_inbound_sources ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sources := []InboundSource{}
+	for rows.Next() {
+		s, err := scanInboundSource(rows, false)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, *s)
+	}
+	return sources, rows.Err()
+}
+
+// SetInboundSourceEnabled stops or resumes accepting a source's webhooks
+func (c *Client) SetInboundSourceEnabled(ctx context.Context, name string, enabled bool) error {
+	res, err := c.db.ExecContext(ctx, "UPDATE rule_inbound_sources SET enabled = $2 WHERE name = $1", name, enabled)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", name, ErrInboundSourceNotFound)
+	}
+	return nil
+}
+
+// DeleteInboundSource removes a source and its events
+func (c *Client) DeleteInboundSource(ctx context.Context, name string) error {
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "DELETE FROM rule_inbound_sources WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", name, ErrInboundSourceNotFound)
+	}
+	return tx.Commit()
+}
+
+// IngestInboundEvent stores an event a source sent and, when the source
+// has a rule set, evaluates it. eventID identifies the event at the
+// provider: an event already stored is returned with duplicate set and is
+// not evaluated again. An evaluation error is recorded on the event, not
+// returned.
+func (c *Client) IngestInboundEvent(ctx context.Context, s *InboundSource, eventID, eventType string, data interface{}) (ev *InboundEvent, duplicate bool, err error) {
+	now := time.Now().UTC()
+	facts := map[string]interface{}{
+		"Event": map[string]interface{}{
+			"source":      s.Name,
+			"provider":    s.Provider,
+			"type":        eventType,
+			"id":          eventID,
+			"received_at": now.Format(time.RFC3339),
+			"data":        data,
+		},
+	}
+	factsJSON, err := json.Marshal(facts)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode facts: %w", err)
+	}
+
+	ev = &InboundEvent{Source: s.Name, EventID: eventID, Type: eventType, Facts: factsJSON}
+	err = c.db.QueryRowContext(ctx,
+		`INSERT INTO rule_inbound_events (source, event_id, event_type, facts, received_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (source, event_id) DO NOTHING
+		 RETURNING id, received_at`,
+		s.Name, eventID, eventType, factsJSON, now,
+	).Scan(&ev.ID, &ev.ReceivedAt)
+	if err == sql.ErrNoRows {
+		ev, err = scanInboundEvent(c.db.QueryRowContext(ctx,
+			"SELECT "+inboundEventColumns+" FROM rule_inbound_events WHERE source = $1 AND event_id = $2", s.Name, eventID,
+		))
+		return ev, true, err
+	}
+	if err != nil || s.RuleSetID == 0 {
+		return ev, false, err
+	}
+
+	result, evalErr := c.Evaluate(ctx, s.RuleSetID, facts)
+	if evalErr == nil {
+		ev.MatchedRules = result.MatchedRules
+	} else {
+		ev.Error = evalErr.Error()
+	}
+	var evaluated time.Time
+	if err := c.db.QueryRowContext(ctx,
+		`UPDATE rule_inbound_events SET matched_rules = $2, error = NULLIF($3, ''), evaluated_at = now()
+		 WHERE id = $1 RETURNING evaluated_at`,
+		ev.ID, pq.Array(ev.MatchedRules), ev.Error,
+	).Scan(&evaluated); err != nil {
+		return ev, false, err
+	}
+	ev.EvaluatedAt = &evaluated
+	return ev, false, nil
+}
+
+const inboundEventColumns = `id, source, event_id, event_type, facts, matched_rules, COALESCE(error, ''),
+	received_at, evaluated_at`
+
+func scanInboundEvent(row interface{ Scan(...interface{}) error }) (*InboundEvent, error) {
+	var ev InboundEvent
+	var evaluated sql.NullTime
+	if err := row.Scan(&ev.ID, &ev.Source, &ev.EventID, &ev.Type, &ev.Facts, pq.Array(&ev.MatchedRules), &ev.Error,
+		&ev.ReceivedAt, &evaluated); err != nil {
+		return nil, err
+	}
+	if evaluated.Valid {
+		ev.EvaluatedAt = &evaluated.Time
+	}
+	return &ev, nil
+}
+
+// ListInboundEvents returns a source's most recent events, newest first
+func (c *Client) ListInboundEvents(ctx context.Context, source string, limit int) ([]InboundEvent, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	rows, err := c.db.QueryContext(ctx,
+		"SELECT "+inboundEventColumns+" FROM rule_inbound_events WHERE source = $1 ORDER BY received_at DESC LIMIT $2",
+		source, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []InboundEvent{}
+	for rows.Next() {
+		ev, err := scanInboundEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *ev)
+	}
+	return events, rows.Err()
+}
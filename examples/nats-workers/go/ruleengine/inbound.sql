@@ -0,0 +1,47 @@
+-- Webhooks received from third parties (see EnableInbound). Each source
+-- names a provider whose signature scheme the gateway verifies; accepted
+-- events are stored once per provider event id and, when the source has a
+-- rule set, evaluated as facts. Signing secrets are encrypted with the
+-- extension's encrypt_credential(), like rule_action_secrets.
+
+CREATE TABLE IF NOT EXISTS rule_inbound_sources (
+    name TEXT PRIMARY KEY,
+    provider TEXT NOT NULL CHECK (provider IN ('stripe', 'github', 'slack', 'shopify', 'standard', 'hmac')),
+    secret_encrypted TEXT NOT NULL,
+    ruleset_id INTEGER,
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Sources created before secrets were encrypted keep them in plain text
+ALTER TABLE rule_inbound_sources ADD COLUMN IF NOT EXISTS secret_encrypted TEXT;
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_schema = current_schema() AND table_name = 'rule_inbound_sources' AND column_name = 'secret') THEN
+        UPDATE rule_inbound_sources SET secret_encrypted = encrypt_credential(secret) WHERE secret_encrypted IS NULL;
+        ALTER TABLE rule_inbound_sources DROP COLUMN secret;
+    END IF;
+END $$;
+ALTER TABLE rule_inbound_sources ALTER COLUMN secret_encrypted SET NOT NULL;
+
+REVOKE ALL ON rule_inbound_sources FROM PUBLIC;
+
+CREATE TABLE IF NOT EXISTS rule_inbound_events (
+    id BIGSERIAL PRIMARY KEY,
+    source TEXT NOT NULL REFERENCES rule_inbound_sources (name) ON DELETE CASCADE,
+    event_id TEXT NOT NULL,
+    event_type TEXT NOT NULL DEFAULT '',
+    facts JSONB NOT NULL,
+    matched_rules TEXT[],
+    error TEXT,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    evaluated_at TIMESTAMPTZ,
+    UNIQUE (source, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rule_inbound_events_source ON rule_inbound_events (source, received_at DESC);
+
+COMMENT ON TABLE rule_inbound_sources IS 'Third-party webhook senders accepted at /inbound/{name}';
+COMMENT ON COLUMN rule_inbound_sources.secret_encrypted IS 'Signing secret shared with the provider, encrypted with encrypt_credential()';
+COMMENT ON TABLE rule_inbound_events IS 'Verified inbound webhooks, one row per provider event id';
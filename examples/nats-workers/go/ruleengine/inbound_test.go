@@ -0,0 +1,85 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCreateInboundSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  InboundSource
+		wantErr string
+	}{
+		{name: "stored encrypted", source: InboundSource{Name: "stripe", Provider: "stripe", Secret: "whsec_1", RuleSetID: 3}},
+		{name: "no name", source: InboundSource{Provider: "stripe", Secret: "s"},
+			wantErr: "invalid name: is required and must be usable in a URL path"},
+		{name: "name with a slash", source: InboundSource{Name: "a/b", Provider: "stripe", Secret: "s"},
+			wantErr: "invalid name: is required and must be usable in a URL path"},
+		{name: "unknown provider", source: InboundSource{Name: "x", Provider: "paypal", Secret: "s"},
+			wantErr: "invalid provider: must be one of stripe, github, slack, shopify, standard, hmac"},
+		{name: "no secret", source: InboundSource{Name: "x", Provider: "github"}, wantErr: "invalid secret: is required"},
+		{name: "negative rule set", source: InboundSource{Name: "x", Provider: "github", Secret: "s", RuleSetID: -1},
+			wantErr: "invalid ruleset_id: must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mock := newMock(t)
+			if tt.wantErr == "" {
+				mock.ExpectBegin()
+				mock.ExpectExec(`VALUES \(\$1, \$2, encrypt_credential\(\$3\), NULLIF\(\$4, 0\)\)`).
+					WithArgs(tt.source.Name, tt.source.Provider, tt.source.Secret, tt.source.RuleSetID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+			err := c.CreateInboundSource(context.Background(), tt.source)
+			var validation *ValidationError
+			if tt.wantErr != "" {
+				if !errors.As(err, &validation) || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestInboundSourceSecrets(t *testing.T) {
+	c, mock := newMock(t)
+	created := time.Now()
+	mock.ExpectQuery(`^SELECT name, provider, COALESCE\(ruleset_id, 0\), enabled, created_at, decrypt_credential\(secret_encrypted\) FROM rule_inbound_sources WHERE name = \$1$`).
+		WithArgs("stripe").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "provider", "ruleset_id", "enabled", "created_at", "decrypt_credential"}).
+			AddRow("stripe", "stripe", 3, true, created, "whsec_1"))
+	mock.ExpectQuery(`^SELECT name, provider, COALESCE\(ruleset_id, 0\), enabled, created_at FROM rule_inbound_sources ORDER BY name$`).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "provider", "ruleset_id", "enabled", "created_at"}).
+			AddRow("stripe", "stripe", 3, true, created))
+	mock.ExpectQuery("FROM rule_inbound_sources WHERE name").WithArgs("missing").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "provider", "ruleset_id", "enabled", "created_at", "decrypt_credential"}))
+
+	s, err := c.GetInboundSource(context.Background(), "stripe")
+	if err != nil || s.Secret != "whsec_1" || s.RuleSetID != 3 || !s.Enabled {
+		t.Fatalf("GetInboundSource = %+v, %v", s, err)
+	}
+	// Listing never decrypts secrets
+	sources, err := c.ListInboundSources(context.Background())
+	if err != nil || len(sources) != 1 || sources[0].Secret != "" || sources[0].Name != "stripe" {
+		t.Fatalf("ListInboundSources = %+v, %v", sources, err)
+	}
+	if _, err := c.GetInboundSource(context.Background(), "missing"); !errors.Is(err, ErrInboundSourceNotFound) {
+		t.Fatalf("err = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
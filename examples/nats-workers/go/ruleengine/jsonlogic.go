@@ -0,0 +1,509 @@
+package ruleengine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSON Logic (https://jsonlogic.com) conditions give rule authors a
+// portable, data-only format that can be stored, generated by UIs, and
+// checked before it reaches the engine. CompileJSONLogic translates the
+// subset below into a GRL condition; EvalJSONLogic evaluates the same
+// subset in Go.
+//
+//	var (dotted fact paths), ==, ===, !=, !==, >, >=, <, <= (including the
+//	3-argument "between" forms of < and <=), and, or, !, in (value in a
+//	literal array), +, -, *, /, %
+
+// ParseJSONLogic decodes a JSON Logic document, keeping numbers exact
+func ParseJSONLogic(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	var logic interface{}
+	if err := dec.Decode(&logic); err != nil {
+		return nil, &ValidationError{Field: "logic", Message: err.Error()}
+	}
+	return logic, nil
+}
+
+// CompileJSONLogic translates a JSON Logic condition into a GRL boolean
+// expression for a rule's when clause
+func CompileJSONLogic(logic interface{}) (string, error) {
+	expr, err := compileLogic(logic)
+	if err != nil {
+		return "", &ValidationError{Field: "logic", Message: err.Error()}
+	}
+	return expr, nil
+}
+
+// LogicRule is a rule whose condition is JSON Logic
+type LogicRule struct {
+	Name        string                 `json:"name" yaml:"name"`
+	Description string                 `json:"description,omitempty" yaml:"description,omitempty"`
+	Salience    int                    `json:"salience,omitempty" yaml:"salience,omitempty"`
+	When        interface{}            `json:"when" yaml:"when"`
+	Then        map[string]interface{} `json:"then" yaml:"then"` // Fact path → literal value
+}
+
+// GRL renders the rule as a GRL document. The rule retracts itself after
+// firing so its own assignments cannot re-trigger it.
+func (r LogicRule) GRL() (string, error) {
+	if err := validateRuleName(r.Name); err != nil {
+		return "", err
+	}
+	when, err := CompileJSONLogic(r.When)
+	if err != nil {
+		return "", err
+	}
+	if len(r.Then) == 0 {
+		return "", &ValidationError{Field: "then", Message: "needs at least one assignment"}
+	}
+
+	paths := make([]string, 0, len(r.Then))
+	for path := range r.Then {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	description := r.Description
+	if description == "" {
+		description = r.Name
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "rule %s %s salience %d {\n    when\n        %s\n    then\n", r.Name, strconv.Quote(description), r.Salience, when)
+	for _, path := range paths {
+		if !factPathPattern.MatchString(path) {
+			return "", &ValidationError{Field: "then", Message: fmt.Sprintf("%q is not a fact path like Order.Discount", path)}
+		}
+		value, err := logicLiteral(r.Then[path])
+		if err != nil {
+			return "", &ValidationError{Field: "then", Message: fmt.Sprintf("%s: %v", path, err)}
+		}
+		fmt.Fprintf(&b, "        %s = %s;\n", path, value)
+	}
+	fmt.Fprintf(&b, "        Retract(%q);\n}\n", r.Name)
+	return b.String(), nil
+}
+
+// SaveLogicRule compiles r and saves it: created when new, otherwise saved
+// as a new active version
+func (c *Client) SaveLogicRule(ctx context.Context, r LogicRule, notes string) (*Rule, error) {
+	grl, err := r.GRL()
+	if err != nil {
+		return nil, err
+	}
+	return c.saveGenerated(ctx, SaveRuleInput{
+		Name:        r.Name,
+		GRL:         grl,
+		Description: r.Description,
+		ChangeNotes: notes,
+	})
+}
+
+var logicComparisons = map[string]string{
+	"==": "==", "===": "==", "!=": "!=", "!==": "!=",
+	">": ">", ">=": ">=", "<": "<", "<=": "<=",
+}
+
+var logicArithmetic = map[string]string{"+": "+", "-": "-", "*": "*", "/": "/", "%": "%"}
+
+// logicOperation splits {"op": args} into op and its argument list
+func logicOperation(m map[string]interface{}) (string, []interface{}, error) {
+	if len(m) != 1 {
+		return "", nil, fmt.Errorf("an operation must have exactly one key, got %d", len(m))
+	}
+	for op, raw := range m {
+		if args, ok := raw.([]interface{}); ok {
+			return op, args, nil
+		}
+		return op, []interface{}{raw}, nil
+	}
+	panic("unreachable")
+}
+
+func compileLogic(node interface{}) (string, error) {
+	m, ok := node.(map[string]interface{})
+	if !ok {
+		return logicLiteral(node)
+	}
+	op, args, err := logicOperation(m)
+	if err != nil {
+		return "", err
+	}
+
+	if op == "var" {
+		return compileVar(args)
+	}
+	if grlOp, ok := logicComparisons[op]; ok {
+		if (op == "<" || op == "<=") && len(args) == 3 {
+			return compileBetween(grlOp, args)
+		}
+		if len(args) != 2 {
+			return "", fmt.Errorf("%s takes 2 arguments", op)
+		}
+		return compileBinary(grlOp, args[0], args[1])
+	}
+	if grlOp, ok := logicArithmetic[op]; ok {
+		if len(args) == 1 && op == "-" {
+			operand, err := compileLogic(args[0])
+			if err != nil {
+				return "", err
+			}
+			return "(-" + operand + ")", nil
+		}
+		if len(args) < 2 || ((op == "-" || op == "/" || op == "%") && len(args) != 2) {
+			return "", fmt.Errorf("wrong number of arguments for %s", op)
+		}
+		return compileChain(" "+grlOp+" ", args)
+	}
+
+	switch op {
+	case "and", "or":
+		if len(args) == 0 {
+			return "", fmt.Errorf("%s needs arguments", op)
+		}
+		sep := " && "
+		if op == "or" {
+			sep = " || "
+		}
+		return compileChain(sep, args)
+	case "!":
+		if len(args) != 1 {
+			return "", fmt.Errorf("! takes 1 argument")
+		}
+		operand, err := compileLogic(args[0])
+		if err != nil {
+			return "", err
+		}
+		return "!(" + operand + ")", nil
+	case "in":
+		if len(args) != 2 {
+			return "", fmt.Errorf("in takes 2 arguments")
+		}
+		list, ok := args[1].([]interface{})
+		if !ok || len(list) == 0 {
+			return "", fmt.Errorf("in needs a non-empty literal array as its second argument")
+		}
+		var alts []string
+		for _, item := range list {
+			alt, err := compileBinary("==", args[0], item)
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, alt)
+		}
+		return "(" + strings.Join(alts, " || ") + ")", nil
+	}
+	return "", fmt.Errorf("unsupported operation %q", op)
+}
+
+func compileVar(args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("var defaults are not supported")
+	}
+	path, ok := args[0].(string)
+	if !ok || !factPathPattern.MatchString(path) {
+		return "", fmt.Errorf("var must be a fact path like Order.Amount, got %v", args[0])
+	}
+	return path, nil
+}
+
+func compileBinary(op string, left, right interface{}) (string, error) {
+	l, err := compileLogic(left)
+	if err != nil {
+		return "", err
+	}
+	r, err := compileLogic(right)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s", l, op, r), nil
+}
+
+func compileBetween(op string, args []interface{}) (string, error) {
+	lower, err := compileBinary(op, args[0], args[1])
+	if err != nil {
+		return "", err
+	}
+	upper, err := compileBinary(op, args[1], args[2])
+	if err != nil {
+		return "", err
+	}
+	return "(" + lower + " && " + upper + ")", nil
+}
+
+func compileChain(sep string, args []interface{}) (string, error) {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		part, err := compileLogic(arg)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = part
+	}
+	return "(" + strings.Join(parts, sep) + ")", nil
+}
+
+// logicLiteral renders a JSON scalar as a GRL literal
+func logicLiteral(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if _, err := v.Float64(); err != nil {
+			return "", err
+		}
+		return v.String(), nil
+	case float64:
+		return formatNumber(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case string:
+		return strconv.Quote(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", fmt.Errorf("null is not supported")
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// EvalJSONLogic evaluates a JSON Logic expression against data (e.g. a
+// decoded fact document) without the engine, for previews and tests
+func EvalJSONLogic(logic interface{}, data map[string]interface{}) (interface{}, error) {
+	v, err := evalLogic(logic, data)
+	if err != nil {
+		return nil, &ValidationError{Field: "logic", Message: err.Error()}
+	}
+	return v, nil
+}
+
+func evalLogic(node interface{}, data map[string]interface{}) (interface{}, error) {
+	switch n := node.(type) {
+	case json.Number:
+		return n.Float64()
+	case int:
+		return float64(n), nil
+	case []interface{}:
+		out := make([]interface{}, len(n))
+		for i, item := range n {
+			v, err := evalLogic(item, data)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	case map[string]interface{}:
+	default:
+		return n, nil
+	}
+
+	op, args, err := logicOperation(node.(map[string]interface{}))
+	if err != nil {
+		return nil, err
+	}
+
+	// and/or short-circuit and return the deciding operand
+	switch op {
+	case "and", "or":
+		var last interface{}
+		for _, arg := range args {
+			v, err := evalLogic(arg, data)
+			if err != nil {
+				return nil, err
+			}
+			last = v
+			if truthy(v) == (op == "or") {
+				return v, nil
+			}
+		}
+		return last, nil
+	}
+
+	vals := make([]interface{}, len(args))
+	for i, arg := range args {
+		if vals[i], err = evalLogic(arg, data); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op {
+	case "var":
+		path, _ := vals[0].(string)
+		if v, ok := getPath(data, strings.Split(path, ".")); ok {
+			return v, nil
+		}
+		if len(vals) > 1 {
+			return vals[1], nil
+		}
+		return nil, nil
+	case "==":
+		return looseEqual(vals[0], vals[1]), nil
+	case "!=":
+		return !looseEqual(vals[0], vals[1]), nil
+	case "===":
+		return strictEqual(vals[0], vals[1]), nil
+	case "!==":
+		return !strictEqual(vals[0], vals[1]), nil
+	case "!":
+		return !truthy(vals[0]), nil
+	case ">", ">=", "<", "<=":
+		if len(vals) == 3 {
+			a, b := compareNumbers(op, vals[0], vals[1]), compareNumbers(op, vals[1], vals[2])
+			return a && b, nil
+		}
+		if len(vals) != 2 {
+			return nil, fmt.Errorf("%s takes 2 arguments", op)
+		}
+		return compareNumbers(op, vals[0], vals[1]), nil
+	case "in":
+		if list, ok := vals[1].([]interface{}); ok {
+			for _, item := range list {
+				if looseEqual(vals[0], item) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		if s, ok := vals[1].(string); ok {
+			return strings.Contains(s, fmt.Sprint(vals[0])), nil
+		}
+		return false, nil
+	case "+", "*":
+		total := 0.0
+		if op == "*" {
+			total = 1
+		}
+		for _, v := range vals {
+			n, ok := toNumber(v)
+			if !ok {
+				return nil, fmt.Errorf("%s: %v is not a number", op, v)
+			}
+			if op == "+" {
+				total += n
+			} else {
+				total *= n
+			}
+		}
+		return total, nil
+	case "-", "/", "%":
+		if op == "-" && len(vals) == 1 {
+			n, ok := toNumber(vals[0])
+			if !ok {
+				return nil, fmt.Errorf("-: %v is not a number", vals[0])
+			}
+			return -n, nil
+		}
+		if len(vals) != 2 {
+			return nil, fmt.Errorf("%s takes 2 arguments", op)
+		}
+		a, ok1 := toNumber(vals[0])
+		b, ok2 := toNumber(vals[1])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%s: arguments must be numbers", op)
+		}
+		switch op {
+		case "-":
+			return a - b, nil
+		case "/":
+			return a / b, nil
+		}
+		return math.Mod(a, b), nil
+	}
+	return nil, fmt.Errorf("unsupported operation %q", op)
+}
+
+// truthy follows JSON Logic: 0, "", [], null, and false are false
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case int:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// looseEqual compares numerically when both sides are numeric, otherwise
+// by value
+func looseEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if x, ok := toNumber(a); ok {
+		if y, ok := toNumber(b); ok {
+			return x == y
+		}
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// strictEqual is looseEqual without type coercion: numbers only equal
+// numbers, strings only strings
+func strictEqual(a, b interface{}) bool {
+	_, aStr := a.(string)
+	_, bStr := b.(string)
+	_, aBool := a.(bool)
+	_, bBool := b.(bool)
+	if aStr != bStr || aBool != bBool {
+		return false
+	}
+	return looseEqual(a, b)
+}
+
+func compareNumbers(op string, a, b interface{}) bool {
+	x, ok1 := toNumber(a)
+	y, ok2 := toNumber(b)
+	if !ok1 || !ok2 {
+		sa, sb := fmt.Sprint(a), fmt.Sprint(b)
+		switch op {
+		case ">":
+			return sa > sb
+		case ">=":
+			return sa >= sb
+		case "<":
+			return sa < sb
+		}
+		return sa <= sb
+	}
+	switch op {
+	case ">":
+		return x > y
+	case ">=":
+		return x >= y
+	case "<":
+		return x < y
+	}
+	return x <= y
+}
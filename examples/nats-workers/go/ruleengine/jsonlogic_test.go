@@ -0,0 +1,173 @@
+package ruleengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// logicSupported lists the operations EvalJSONLogic implements
+var logicSupported = map[string]bool{
+	"var": true, "==": true, "===": true, "!=": true, "!==": true,
+	">": true, ">=": true, "<": true, "<=": true,
+	"and": true, "or": true, "!": true, "in": true,
+	"+": true, "-": true, "*": true, "/": true, "%": true,
+}
+
+// usesUnsupported reports whether logic uses an operation outside the
+// supported subset, or a var that is not a dotted object path
+func usesUnsupported(node interface{}) bool {
+	switch n := node.(type) {
+	case []interface{}:
+		for _, item := range n {
+			if usesUnsupported(item) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for op, args := range n {
+			if !logicSupported[op] {
+				return true
+			}
+			if op == "var" {
+				path := args
+				if list, ok := args.([]interface{}); ok && len(list) > 0 {
+					path = list[0]
+				}
+				if s, ok := path.(string); !ok || s == "" {
+					return true
+				}
+			}
+			if usesUnsupported(args) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TestJSONLogicSuite runs the official JSON Logic test cases in
+// testdata/jsonlogic/tests.json that fall within the supported subset
+func TestJSONLogicSuite(t *testing.T) {
+	raw, err := os.ReadFile("testdata/jsonlogic/tests.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseJSONLogic(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	section := ""
+	ran, skipped := 0, 0
+	for i, entry := range parsed.([]interface{}) {
+		if comment, ok := entry.(string); ok {
+			section = comment
+			continue
+		}
+		tc := entry.([]interface{})
+		logic, data, want := tc[0], tc[1], tc[2]
+
+		facts, isObject := data.(map[string]interface{})
+		if (!isObject && data != nil) || usesUnsupported(logic) {
+			skipped++
+			continue
+		}
+		ran++
+
+		name := fmt.Sprintf("%d %s", i, encodeLogic(logic))
+		t.Run(name, func(t *testing.T) {
+			got, err := EvalJSONLogic(logic, facts)
+			if err != nil {
+				t.Fatalf("%s: %v", section, err)
+			}
+			if !sameJSON(got, want) {
+				t.Fatalf("%s: %s with %s = %s, want %s", section, encodeLogic(logic), encodeLogic(data), encodeLogic(got), encodeLogic(want))
+			}
+		})
+	}
+	if ran == 0 {
+		t.Fatal("no cases ran")
+	}
+	t.Logf("%d cases ran, %d outside the supported subset skipped", ran, skipped)
+}
+
+func encodeLogic(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// sameJSON compares values by their JSON form, so 3 equals 3.0
+func sameJSON(a, b interface{}) bool {
+	var x, y interface{}
+	json.Unmarshal([]byte(encodeLogic(a)), &x)
+	json.Unmarshal([]byte(encodeLogic(b)), &y)
+	return reflect.DeepEqual(x, y)
+}
+
+func TestCompileJSONLogic(t *testing.T) {
+	tests := []struct {
+		logic   string
+		want    string
+		wantErr string
+	}{
+		{`{"==":[{"var":"Customer.Tier"},"gold"]}`, `Customer.Tier == "gold"`, ""},
+		{`{"!==":[{"var":"Order.Amount"},0]}`, `Order.Amount != 0`, ""},
+		{`{"<=":[100,{"var":"Order.Amount"},500]}`, `(100 <= Order.Amount && Order.Amount <= 500)`, ""},
+		{`{"and":[{">":[{"var":"Order.Amount"},10]},{"!":{"var":"Order.Paid"}}]}`,
+			`(Order.Amount > 10 && !(Order.Paid))`, ""},
+		{`{"in":[{"var":"Order.Country"},["DE","FR"]]}`, `(Order.Country == "DE" || Order.Country == "FR")`, ""},
+		{`{">":[{"*":[{"var":"Order.Qty"},{"var":"Order.Price"},1.2]},{"-":5}]}`,
+			`(Order.Qty * Order.Price * 1.2) > (-5)`, ""},
+		{`{"var":"Amount"}`, "", "fact path"},
+		{`{"var":["Order.Amount",0]}`, "", "defaults are not supported"},
+		{`{"if":[true,1,2]}`, "", `unsupported operation "if"`},
+		{`{"==":[1]}`, "", "takes 2 arguments"},
+		{`{"in":["a","abc"]}`, "", "literal array"},
+		{`{"==":[{"var":"Order.A"},null]}`, "", "null is not supported"},
+		{`{"and":[],"or":[]}`, "", "exactly one key"},
+		{`{"-":[1,2,3]}`, "", "wrong number of arguments"},
+	}
+	for _, tt := range tests {
+		logic, err := ParseJSONLogic([]byte(tt.logic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := CompileJSONLogic(logic)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want %q", tt.logic, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s = %q, %v; want %q", tt.logic, got, err, tt.want)
+		}
+	}
+}
+
+func TestLogicRuleGRL(t *testing.T) {
+	when, _ := ParseJSONLogic([]byte(`{">":[{"var":"Order.Amount"},1000]}`))
+	r := LogicRule{Name: "Big", When: when, Then: map[string]interface{}{"Order.Review": true, "Order.Lane": "slow"}}
+	grl, err := r.GRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "rule Big \"Big\" salience 0 {\n    when\n        Order.Amount > 1000\n    then\n" +
+		"        Order.Lane = \"slow\";\n        Order.Review = true;\n        Retract(\"Big\");\n}\n"
+	if grl != want {
+		t.Fatalf("GRL = %q, want %q", grl, want)
+	}
+
+	r.Then = map[string]interface{}{"Review": true}
+	if _, err := r.GRL(); err == nil {
+		t.Fatal("bare then path was accepted")
+	}
+	r.Then = nil
+	if _, err := r.GRL(); err == nil {
+		t.Fatal("rule without assignments was accepted")
+	}
+}
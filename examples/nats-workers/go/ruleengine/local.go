@@ -0,0 +1,447 @@
+package ruleengine
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// localRule is a GRL rule simple enough to evaluate in Go: a condition made
+// of comparisons between fact fields and literals, joined by && and ||,
+// and actions that assign literals to fact fields.
+type localRule struct {
+	name     string
+	salience int
+	when     condition
+	then     []assignment
+}
+
+type condition interface {
+	eval(facts map[string]interface{}) bool
+}
+
+type comparison struct {
+	path  []string
+	op    string
+	value interface{} // float64, string, or bool
+}
+
+type logical struct {
+	op          string // "&&" or "||"
+	left, right condition
+}
+
+type assignment struct {
+	path   []string
+	value  interface{}
+	source string
+}
+
+// compileLocal parses a GRL document into local rules. ok is false when any
+// rule uses something outside the supported subset; such documents are
+// always evaluated by the extension.
+func compileLocal(grl string) (rules []localRule, ok bool) {
+	p := &grlParser{tokens: tokenizeGRL(grl)}
+	if p.tokens == nil {
+		return nil, false
+	}
+	for !p.done() {
+		rule, err := p.rule()
+		if err != nil {
+			return nil, false
+		}
+		rules = append(rules, rule)
+	}
+	return rules, len(rules) > 0
+}
+
+// evaluateLocal runs rules against facts in salience order (ties keep
+// source order), repeating until no further rule fires. Each rule fires at
+// most once, which matches the extension for literal-only actions.
+func evaluateLocal(rules []localRule, facts map[string]interface{}, result *Result) {
+	ordered := make([]localRule, len(rules))
+	copy(ordered, rules)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].salience > ordered[j].salience })
+
+	fired := make([]bool, len(ordered))
+	for progress := true; progress; {
+		progress = false
+		for i, rule := range ordered {
+			if fired[i] || !rule.when.eval(facts) {
+				continue
+			}
+			fired[i] = true
+			progress = true
+			result.MatchedRules = append(result.MatchedRules, rule.name)
+			for _, a := range rule.then {
+				setPath(facts, a.path, a.value)
+				result.Actions = append(result.Actions, Action{Rule: rule.name, Action: a.source})
+			}
+			break // re-scan from the highest salience after every firing
+		}
+	}
+}
+
+func (c comparison) eval(facts map[string]interface{}) bool {
+	actual, found := getPath(facts, c.path)
+	if !found {
+		return false
+	}
+
+	switch want := c.value.(type) {
+	case float64:
+		got, ok := toFloat(actual)
+		if !ok {
+			return false
+		}
+		switch c.op {
+		case "==":
+			return got == want
+		case "!=":
+			return got != want
+		case ">":
+			return got > want
+		case ">=":
+			return got >= want
+		case "<":
+			return got < want
+		case "<=":
+			return got <= want
+		}
+	case string:
+		got, ok := actual.(string)
+		if !ok {
+			return false
+		}
+		switch c.op {
+		case "==":
+			return got == want
+		case "!=":
+			return got != want
+		case ">":
+			return got > want
+		case ">=":
+			return got >= want
+		case "<":
+			return got < want
+		case "<=":
+			return got <= want
+		}
+	case bool:
+		got, ok := actual.(bool)
+		if !ok {
+			return false
+		}
+		switch c.op {
+		case "==":
+			return got == want
+		case "!=":
+			return got != want
+		}
+	}
+	return false
+}
+
+func (l logical) eval(facts map[string]interface{}) bool {
+	if l.op == "&&" {
+		return l.left.eval(facts) && l.right.eval(facts)
+	}
+	return l.left.eval(facts) || l.right.eval(facts)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func getPath(facts map[string]interface{}, path []string) (interface{}, bool) {
+	var cur interface{} = facts
+	for _, key := range path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func setPath(facts map[string]interface{}, path []string, value interface{}) {
+	m := facts
+	for _, key := range path[:len(path)-1] {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			m[key] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = value
+}
+
+// GRL subset parser
+
+type grlToken struct {
+	kind string // ident, string, number, op
+	text string
+}
+
+// tokenizeGRL returns nil on characters outside the subset
+func tokenizeGRL(src string) []grlToken {
+	var tokens []grlToken
+	rs := []rune(src)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '/' && i+1 < len(rs) && rs[i+1] == '/':
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+		case r == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' {
+				if rs[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(rs) {
+				return nil
+			}
+			s, err := strconv.Unquote(string(rs[i : j+1]))
+			if err != nil {
+				return nil
+			}
+			tokens = append(tokens, grlToken{"string", s})
+			i = j + 1
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			j := i + 1
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, grlToken{"number", string(rs[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_' || rs[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, grlToken{"ident", string(rs[i:j])})
+			i = j
+		default:
+			if i+1 < len(rs) {
+				two := string(rs[i : i+2])
+				switch two {
+				case "==", "!=", ">=", "<=", "&&", "||":
+					tokens = append(tokens, grlToken{"op", two})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("<>=(){};", r) {
+				return nil
+			}
+			tokens = append(tokens, grlToken{"op", string(r)})
+			i++
+		}
+	}
+	if tokens == nil {
+		tokens = []grlToken{}
+	}
+	return tokens
+}
+
+type grlParser struct {
+	tokens []grlToken
+	pos    int
+}
+
+func (p *grlParser) done() bool { return p.pos >= len(p.tokens) }
+
+func (p *grlParser) peek() grlToken {
+	if p.done() {
+		return grlToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *grlParser) next() grlToken {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *grlParser) expect(kind, text string) error {
+	t := p.next()
+	if t.kind != kind || (text != "" && t.text != text) {
+		return fmt.Errorf("expected %s %q, got %q", kind, text, t.text)
+	}
+	return nil
+}
+
+// rule parses: rule <"Name" | Name ["desc"]> [salience N] { when C then A; ... }
+func (p *grlParser) rule() (localRule, error) {
+	var r localRule
+	if err := p.expect("ident", "rule"); err != nil {
+		return r, err
+	}
+	name := p.next()
+	if name.kind != "string" && name.kind != "ident" {
+		return r, fmt.Errorf("expected rule name")
+	}
+	r.name = name.text
+	if name.kind == "ident" && p.peek().kind == "string" {
+		p.next() // description
+	}
+	if t := p.peek(); t.kind == "ident" && t.text == "salience" {
+		p.next()
+		n, err := strconv.Atoi(p.next().text)
+		if err != nil {
+			return r, err
+		}
+		r.salience = n
+	}
+	if err := p.expect("op", "{"); err != nil {
+		return r, err
+	}
+	if err := p.expect("ident", "when"); err != nil {
+		return r, err
+	}
+	when, err := p.or()
+	if err != nil {
+		return r, err
+	}
+	r.when = when
+	if err := p.expect("ident", "then"); err != nil {
+		return r, err
+	}
+	for t := p.peek(); !(t.kind == "op" && t.text == "}"); t = p.peek() {
+		a, err := p.assignment()
+		if err != nil {
+			return r, err
+		}
+		r.then = append(r.then, a)
+	}
+	p.next()
+	return r, nil
+}
+
+func (p *grlParser) or() (condition, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == "op" && t.text == "||"; t = p.peek() {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *grlParser) and() (condition, error) {
+	left, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == "op" && t.text == "&&"; t = p.peek() {
+		p.next()
+		right, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *grlParser) primary() (condition, error) {
+	if t := p.peek(); t.kind == "op" && t.text == "(" {
+		p.next()
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expect("op", ")")
+	}
+
+	field := p.next()
+	if field.kind != "ident" || !strings.Contains(field.text, ".") {
+		return nil, fmt.Errorf("expected fact field, got %q", field.text)
+	}
+	op := p.next()
+	switch op.text {
+	case "==", "!=", ">", ">=", "<", "<=":
+	default:
+		return nil, fmt.Errorf("unsupported operator %q", op.text)
+	}
+	value, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	return comparison{path: strings.Split(field.text, "."), op: op.text, value: value}, nil
+}
+
+func (p *grlParser) assignment() (assignment, error) {
+	field := p.next()
+	if field.kind != "ident" || !strings.Contains(field.text, ".") {
+		return assignment{}, fmt.Errorf("expected fact field, got %q", field.text)
+	}
+	if err := p.expect("op", "="); err != nil {
+		return assignment{}, err
+	}
+	start := p.pos
+	value, err := p.literal()
+	if err != nil {
+		return assignment{}, err
+	}
+	if err := p.expect("op", ";"); err != nil {
+		return assignment{}, err
+	}
+	return assignment{
+		path:   strings.Split(field.text, "."),
+		value:  value,
+		source: field.text + " = " + literalSource(p.tokens[start]),
+	}, nil
+}
+
+func (p *grlParser) literal() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case "number":
+		return strconv.ParseFloat(t.text, 64)
+	case "string":
+		return t.text, nil
+	case "ident":
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+	}
+	return nil, fmt.Errorf("expected literal, got %q", t.text)
+}
+
+func literalSource(t grlToken) string {
+	if t.kind == "string" {
+		return strconv.Quote(t.text)
+	}
+	return t.text
+}
@@ -0,0 +1,181 @@
+package ruleengine
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompileLocal(t *testing.T) {
+	tests := []struct {
+		name string
+		grl  string
+		want []string // rule names; nil: not compilable
+	}{
+		{name: "quoted name", grl: `rule "HighValue" { when Order.total > 1000 then Order.flagged = true; }`,
+			want: []string{"HighValue"}},
+		{name: "ident with description and salience",
+			grl:  `rule Vip "VIP customers" salience 10 { when Customer.tier == "gold" && (Order.total >= 50.5 || Order.rush == true) then Order.priority = 1; Order.lane = "fast"; }`,
+			want: []string{"Vip"}},
+		{name: "two rules and a comment",
+			grl:  "// pricing\nrule A { when X.a != -1 then X.b = 2; }\nrule B { when X.b <= 2 then X.c = \"ok\"; }",
+			want: []string{"A", "B"}},
+		{name: "empty", grl: ""},
+		{name: "function call", grl: `rule A { when X.a > 1 then Retract("A"); }`},
+		{name: "arithmetic", grl: `rule A { when X.a + 1 > 2 then X.b = 1; }`},
+		{name: "field to field", grl: `rule A { when X.a > X.b then X.c = 1; }`},
+		{name: "bare identifier", grl: `rule A { when enabled == true then X.c = 1; }`},
+		{name: "assign expression", grl: `rule A { when X.a > 1 then X.b = X.a; }`},
+		{name: "unterminated string", grl: `rule "A { when X.a > 1 then X.b = 1; }`},
+		{name: "missing brace", grl: `rule A { when X.a > 1 then X.b = 1;`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, ok := compileLocal(tt.grl)
+			if ok != (tt.want != nil) {
+				t.Fatalf("ok = %v, want %v", ok, tt.want != nil)
+			}
+			var names []string
+			for _, r := range rules {
+				names = append(names, r.name)
+			}
+			if ok && !reflect.DeepEqual(names, tt.want) {
+				t.Fatalf("rules = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestComparisonEval(t *testing.T) {
+	facts := map[string]interface{}{
+		"Order": map[string]interface{}{"total": 100.0, "qty": 3, "state": "open", "paid": true},
+	}
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{"Order.total == 100", true},
+		{"Order.total > 99.5", true},
+		{"Order.total < 100", false},
+		{"Order.qty >= 3", true},
+		{`Order.state == "open"`, true},
+		{`Order.state < "p"`, true},
+		{`Order.state != "open"`, false},
+		{"Order.paid == true", true},
+		{"Order.paid != true", false},
+		{`Order.total == "100"`, false}, // no coercion between types
+		{"Order.missing == 1", false},
+		{"Order.total.deep == 1", false},
+		{"Order.paid > 1", false},
+	}
+	for _, tt := range tests {
+		rules, ok := compileLocal("rule R { when " + tt.cond + " then X.y = 1; }")
+		if !ok {
+			t.Fatalf("%s: not compilable", tt.cond)
+		}
+		if got := rules[0].when.eval(facts); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.cond, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateLocal(t *testing.T) {
+	// B has the higher salience but only matches once A has fired; each
+	// rule fires at most once
+	rules, ok := compileLocal(`
+		rule A salience 1 { when Order.total > 100 then Order.big = true; }
+		rule B salience 5 { when Order.big == true then Order.lane = "review"; }
+		rule C salience 9 { when Order.total > 0 then Order.seen = true; }
+	`)
+	if !ok {
+		t.Fatal("not compilable")
+	}
+	facts := map[string]interface{}{"Order": map[string]interface{}{"total": 150.0}}
+	result := &Result{}
+	evaluateLocal(rules, facts, result)
+
+	if want := []string{"C", "A", "B"}; !reflect.DeepEqual(result.MatchedRules, want) {
+		t.Fatalf("matched = %v, want %v", result.MatchedRules, want)
+	}
+	if result.Actions[2] != (Action{Rule: "B", Action: `Order.lane = "review"`}) {
+		t.Fatalf("actions = %v", result.Actions)
+	}
+	order := facts["Order"].(map[string]interface{})
+	if order["lane"] != "review" || order["seen"] != true {
+		t.Fatalf("facts = %v", facts)
+	}
+}
+
+func TestRuleCacheInvalidate(t *testing.T) {
+	newCache := func() *ruleCache {
+		rc := &ruleCache{rulesets: map[int][]ruleSetMember{}, rules: map[ruleKey]cachedRule{}}
+		rc.rulesets[1] = nil
+		rc.rulesets[2] = nil
+		rc.rules[ruleKey{"A", ""}] = cachedRule{}
+		rc.rules[ruleKey{"A", "1.0.0"}] = cachedRule{}
+		rc.rules[ruleKey{"B", ""}] = cachedRule{}
+		return rc
+	}
+	tests := []struct {
+		payload  string
+		rulesets int
+		rules    int
+	}{
+		{"ruleset:1", 1, 3},
+		{"ruleset:x", 0, 0},
+		{"rule:A", 2, 1},
+		{"rule:*", 0, 0},
+		{"unknown", 0, 0},
+	}
+	for _, tt := range tests {
+		rc := newCache()
+		rc.invalidate(tt.payload)
+		if len(rc.rulesets) != tt.rulesets || len(rc.rules) != tt.rules {
+			t.Errorf("%s: %d rule sets, %d rules left; want %d, %d",
+				tt.payload, len(rc.rulesets), len(rc.rules), tt.rulesets, tt.rules)
+		}
+		if rc.generation() != 1 {
+			t.Errorf("%s: generation not bumped", tt.payload)
+		}
+	}
+
+	// A load that raced an invalidation is not stored
+	rc := newCache()
+	gen := rc.generation()
+	rc.invalidate("ruleset:1")
+	rc.storeMembers(gen, 1, []ruleSetMember{{name: "A"}})
+	if _, ok := rc.members(1); ok {
+		t.Fatal("stale members were stored")
+	}
+}
+
+func TestRuleCacheEvaluateLocal(t *testing.T) {
+	rc := &ruleCache{rulesets: map[int][]ruleSetMember{}, rules: map[ruleKey]cachedRule{}, local: true}
+	rc.storeMembers(0, 1, []ruleSetMember{{name: "A"}, {name: "B", version: sql.NullString{String: "2.0.0", Valid: true}}})
+	rc.storeRule(0, ruleKey{"A", ""}, `rule A { when X.n > 1 then X.a = true; }`)
+
+	if _, ok := rc.evaluateLocal(1, []byte(`{"X":{"n":2}}`), time.Now()); ok {
+		t.Fatal("evaluated with a member missing from the cache")
+	}
+	rc.storeRule(0, ruleKey{"B", "2.0.0"}, `rule B { when X.a == true then X.b = 1; }`)
+
+	result, ok := rc.evaluateLocal(1, []byte(`{"X":{"n":2}}`), time.Now())
+	if !ok {
+		t.Fatal("not evaluated locally")
+	}
+	if result.RuleFirings["A"] != 1 || result.RuleFirings["B"] != 1 {
+		t.Fatalf("firings = %v", result.RuleFirings)
+	}
+	if result.Facts["X"].(map[string]interface{})["b"] != 1.0 {
+		t.Fatalf("facts = %v", result.Facts)
+	}
+	if fp, ok := rc.fingerprint(1); !ok || len(fp) != 32 {
+		t.Fatalf("fingerprint = %q, %v", fp, ok)
+	}
+
+	rc.storeRule(0, ruleKey{"B", "2.0.0"}, `rule B { when X.a == true then Retract("B"); }`)
+	if _, ok := rc.evaluateLocal(1, []byte(`{"X":{"n":2}}`), time.Now()); ok {
+		t.Fatal("evaluated a rule outside the local subset")
+	}
+}
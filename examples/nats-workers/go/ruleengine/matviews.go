@@ -0,0 +1,449 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+//go:embed matviews.sql
+var matviewsSQL string
+
+// ErrMatchViewNotFound is returned for an unknown match view name
+var ErrMatchViewNotFound = errors.New("match view not found")
+
+var identifierPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,62}$`)
+
+// MatchView stores the result of evaluating a rule set against every row
+// of a source table or view in a table named Name, with columns key,
+// facts (JSONB, NULL when evaluation failed), error, and evaluated_at.
+// Reporting queries join it instead of evaluating rules on each read.
+type MatchView struct {
+	Name      string `json:"name"`
+	RuleSetID int    `json:"ruleset_id"`
+
+	// Source is the table or view to evaluate, optionally schema-qualified
+	Source    string `json:"source"`
+	KeyColumn string `json:"key_column"`
+
+	// FactsColumn holds each row's facts as JSON; when empty the whole row
+	// is the facts
+	FactsColumn string `json:"facts_column,omitempty"`
+
+	// UpdatedColumn is a timestamp set when a row changes. It enables
+	// incremental refreshes, which evaluate only rows updated since the
+	// previous refresh.
+	UpdatedColumn string `json:"updated_column,omitempty"`
+
+	// How often MatchViewScheduler refreshes the view fully and
+	// incrementally; 0 disables that kind of refresh
+	FullInterval        time.Duration `json:"full_interval"`
+	IncrementalInterval time.Duration `json:"incremental_interval"`
+
+	Watermark     *time.Time `json:"watermark,omitempty"`
+	LastFullAt    *time.Time `json:"last_full_at,omitempty"`
+	LastRefreshAt *time.Time `json:"last_refresh_at,omitempty"`
+	LastRefreshMS int64      `json:"last_refresh_ms"`
+	LastRows      int64      `json:"last_rows"`
+
+	// Staleness is the time since the last refresh started, or since the
+	// view was created if it was never refreshed
+	Staleness time.Duration `json:"staleness"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// MatchViewRefresh reports one refresh of a match view
+type MatchViewRefresh struct {
+	View     string        `json:"view"`
+	Full     bool          `json:"full"`
+	Rows     int64         `json:"rows"`
+	Duration time.Duration `json:"duration"`
+}
+
+// EnableMatchViews creates the match view registry and refresh function
+// if needed. It is idempotent.
+func (c *Client) EnableMatchViews(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, matviewsSQL); err != nil {
+		return fmt.Errorf("failed to install match views: %w", err)
+	}
+	return nil
+}
+
+// CreateMatchView registers v and creates its table. The view is empty
+// until its first refresh.
+func (c *Client) CreateMatchView(ctx context.Context, v MatchView) error {
+	if !identifierPattern.MatchString(v.Name) {
+		return &ValidationError{Field: "name", Message: "must be a plain SQL identifier"}
+	}
+	if v.RuleSetID <= 0 {
+		return &ValidationError{Field: "ruleset_id", Message: "is required"}
+	}
+	for field, column := range map[string]string{"key_column": v.KeyColumn, "facts_column": v.FactsColumn, "updated_column": v.UpdatedColumn} {
+		if (column != "" || field == "key_column") && !identifierPattern.MatchString(column) {
+			return &ValidationError{Field: field, Message: "must be a plain SQL identifier"}
+		}
+	}
+	if v.FullInterval < 0 || v.IncrementalInterval < 0 {
+		return &ValidationError{Field: "interval", Message: "must not be negative"}
+	}
+	if v.IncrementalInterval > 0 && v.UpdatedColumn == "" {
+		return &ValidationError{Field: "updated_column", Message: "is required for incremental refreshes"}
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found bool
+	if err := tx.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", v.Source).Scan(&found); err != nil {
+		return err
+	}
+	if !found {
+		return &ValidationError{Field: "source", Message: fmt.Sprintf("table or view %q not found", v.Source)}
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+		`CREATE TABLE %q (
+			key TEXT PRIMARY KEY,
+			facts JSONB,
+			error TEXT,
+			evaluated_at TIMESTAMPTZ NOT NULL
+		)`, v.Name),
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO rule_match_views
+		 (name, ruleset_id, source, key_column, facts_column, updated_column, full_interval, incremental_interval)
+		 VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''),
+		         NULLIF($7::FLOAT8, 0) * INTERVAL '1 second', NULLIF($8::FLOAT8, 0) * INTERVAL '1 second')`,
+		v.Name, v.RuleSetID, v.Source, v.KeyColumn, v.FactsColumn, v.UpdatedColumn,
+		v.FullInterval.Seconds(), v.IncrementalInterval.Seconds(),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const matchViewColumns = `name, ruleset_id, source, key_column, COALESCE(facts_column, ''), COALESCE(updated_column, ''),
+	COALESCE(EXTRACT(EPOCH FROM full_interval), 0)::FLOAT8, COALESCE(EXTRACT(EPOCH FROM incremental_interval), 0)::FLOAT8,
+	watermark, last_full_at, last_refresh_at, COALESCE(last_refresh_ms, 0), COALESCE(last_rows, 0),
+	EXTRACT(EPOCH FROM now() - COALESCE(last_refresh_at, created_at))::FLOAT8, created_at`
+
+func scanMatchView(row interface{ Scan(...interface{}) error }) (*MatchView, error) {
+	var v MatchView
+	var full, incremental, staleness float64
+	var watermark, lastFull, lastRefresh sql.NullTime
+	if err := row.Scan(&v.Name, &v.RuleSetID, &v.Source, &v.KeyColumn, &v.FactsColumn, &v.UpdatedColumn,
+		&full, &incremental, &watermark, &lastFull, &lastRefresh, &v.LastRefreshMS, &v.LastRows,
+		&staleness, &v.CreatedAt); err != nil {
+		return nil, err
+	}
+	v.FullInterval = time.Duration(full * float64(time.Second))
+	v.IncrementalInterval = time.Duration(incremental * float64(time.Second))
+	v.Staleness = time.Duration(staleness * float64(time.Second))
+	if watermark.Valid {
+		v.Watermark = &watermark.Time
+	}
+	if lastFull.Valid {
+		v.LastFullAt = &lastFull.Time
+	}
+	if lastRefresh.Valid {
+		v.LastRefreshAt = &lastRefresh.Time
+	}
+	return &v, nil
+}
+
+// GetMatchView returns one match view and its refresh status
+func (c *Client) GetMatchView(ctx context.Context, name string) (*MatchView, error) {
+	v, err := scanMatchView(c.db.QueryRowContext(ctx,
+		"SELECT "+matchViewColumns+" FROM rule_match_views WHERE name = $1", name,
+	))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s: %w", name, ErrMatchViewNotFound)
+	}
+	return v, err
+}
+
+// ListMatchViews returns all match views and their refresh status
+func (c *Client) ListMatchViews(ctx context.Context) ([]MatchView, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT "+matchViewColumns+" FROM rule_match_views ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := []MatchView{}
+	for rows.Next() {
+		v, err := scanMatchView(rows)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, *v)
+	}
+	return views, rows.Err()
+}
+
+// SetMatchViewSchedule changes how often a view is refreshed fully and
+// incrementally; 0 disables that kind of refresh
+func (c *Client) SetMatchViewSchedule(ctx context.Context, name string, full, incremental time.Duration) error {
+	if full < 0 || incremental < 0 {
+		return &ValidationError{Field: "interval", Message: "must not be negative"}
+	}
+	res, err := c.db.ExecContext(ctx,
+		`UPDATE rule_match_views SET
+		     full_interval = NULLIF($2::FLOAT8, 0) * INTERVAL '1 second',
+		     incremental_interval = NULLIF($3::FLOAT8, 0) * INTERVAL '1 second'
+		 WHERE name = $1 AND ($3 = 0 OR updated_column IS NOT NULL)`,
+		name, full.Seconds(), incremental.Seconds(),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := c.GetMatchView(ctx, name); err != nil {
+			return err
+		}
+		return &ValidationError{Field: "updated_column", Message: "is required for incremental refreshes"}
+	}
+	return nil
+}
+
+// DropMatchView removes a match view and its table
+func (c *Client) DropMatchView(ctx context.Context, name string) error {
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM rule_match_views WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", name, ErrMatchViewNotFound)
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %q", name)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RefreshMatchView re-evaluates a view now, waiting for a refresh already
+// running elsewhere to finish. An incremental refresh (full false)
+// becomes a full one when the view has no UpdatedColumn or its rules
+// changed since the last refresh.
+func (c *Client) RefreshMatchView(ctx context.Context, name string, full bool) (*MatchViewRefresh, error) {
+	if _, err := c.GetMatchView(ctx, name); err != nil {
+		return nil, err
+	}
+	refresh, _, err := c.refreshMatchView(ctx, name, full, true)
+	return refresh, err
+}
+
+// refreshMatchView runs one refresh under a per-view advisory lock. With
+// wait false it returns ok false instead of waiting for the lock.
+func (c *Client) refreshMatchView(ctx context.Context, name string, full, wait bool) (*MatchViewRefresh, bool, error) {
+	start := time.Now()
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	locked := true
+	if wait {
+		_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('rule_match_view:' || $1))", name)
+	} else {
+		err = tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock(hashtext('rule_match_view:' || $1))", name).Scan(&locked)
+	}
+	if err != nil || !locked {
+		return nil, false, err
+	}
+
+	var rows int64
+	if err := tx.QueryRowContext(ctx, "SELECT rule_match_view_refresh($1, $2)", name, full).Scan(&rows); err != nil {
+		return nil, false, fmt.Errorf("failed to refresh match view %s: %w", name, err)
+	}
+	// The refresh function upgrades to a full refresh when needed
+	var ranFull bool
+	if err := tx.QueryRowContext(ctx,
+		"SELECT last_full_at = last_refresh_at FROM rule_match_views WHERE name = $1", name,
+	).Scan(&ranFull); err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return &MatchViewRefresh{View: name, Full: ranFull, Rows: rows, Duration: time.Since(start)}, true, nil
+}
+
+// MatchViewScheduler refreshes match views on their FullInterval and
+// IncrementalInterval. Any number of processes may run one against the
+// same database; a per-view advisory lock makes each refresh run once.
+type MatchViewScheduler struct {
+	client *Client
+
+	// Poll is how often due views are looked up. Default 30s.
+	Poll time.Duration
+
+	// OnRefresh, if set, is called after each refresh attempt with its
+	// result or error, e.g. for logging. view is empty when looking up due
+	// views failed.
+	OnRefresh func(view string, refresh *MatchViewRefresh, err error)
+
+	mu    sync.Mutex
+	stats map[string]*MatchViewStats
+}
+
+// MatchViewStats counts the refreshes of one view by a scheduler. Use
+// MatchView.Staleness for the age of the data across all schedulers.
+type MatchViewStats struct {
+	View          string            `json:"view"`
+	Refreshes     uint64            `json:"refreshes"`
+	FullRefreshes uint64            `json:"full_refreshes"`
+	Failures      uint64            `json:"failures"`
+	LastRefresh   *MatchViewRefresh `json:"last_refresh,omitempty"`
+	LastError     string            `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time        `json:"last_error_at,omitempty"`
+
+	retryAt time.Time
+}
+
+// NewMatchViewScheduler returns a scheduler for c's match views; start it
+// with Run
+func (c *Client) NewMatchViewScheduler() *MatchViewScheduler {
+	return &MatchViewScheduler{client: c, Poll: 30 * time.Second, stats: map[string]*MatchViewStats{}}
+}
+
+// Run refreshes due views until ctx is done. A view whose refresh failed
+// is retried after its shorter interval rather than on every poll.
+func (s *MatchViewScheduler) Run(ctx context.Context) error {
+	poll := s.Poll
+	if poll <= 0 {
+		poll = 30 * time.Second
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		s.refreshDue(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+type dueMatchView struct {
+	name    string
+	full    bool
+	backoff time.Duration
+}
+
+func (s *MatchViewScheduler) refreshDue(ctx context.Context) {
+	due, err := s.dueViews(ctx)
+	if err != nil {
+		if s.OnRefresh != nil && ctx.Err() == nil {
+			s.OnRefresh("", nil, err)
+		}
+		return
+	}
+	for _, d := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Now().Before(s.viewStats(d.name).retryAt) {
+			continue
+		}
+		refresh, ok, err := s.client.refreshMatchView(ctx, d.name, d.full, false)
+		if err == nil && !ok {
+			// Another process is refreshing it
+			continue
+		}
+		s.record(d, refresh, err)
+		if s.OnRefresh != nil {
+			s.OnRefresh(d.name, refresh, err)
+		}
+	}
+}
+
+func (s *MatchViewScheduler) dueViews(ctx context.Context) ([]dueMatchView, error) {
+	rows, err := s.client.db.QueryContext(ctx,
+		`SELECT name, full_due, EXTRACT(EPOCH FROM LEAST(full_interval, incremental_interval))::FLOAT8
+		 FROM (SELECT name, full_interval, incremental_interval,
+		              full_interval IS NOT NULL AND (last_full_at IS NULL OR last_full_at + full_interval <= now()) AS full_due,
+		              incremental_interval IS NOT NULL AND (last_refresh_at IS NULL OR last_refresh_at + incremental_interval <= now()) AS incremental_due
+		       FROM rule_match_views) v
+		 WHERE full_due OR incremental_due
+		 ORDER BY name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []dueMatchView
+	for rows.Next() {
+		var d dueMatchView
+		var backoff float64
+		if err := rows.Scan(&d.name, &d.full, &backoff); err != nil {
+			return nil, err
+		}
+		d.backoff = time.Duration(backoff * float64(time.Second))
+		due = append(due, d)
+	}
+	return due, rows.Err()
+}
+
+func (s *MatchViewScheduler) viewStats(name string) *MatchViewStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.stats[name]
+	if !ok {
+		st = &MatchViewStats{View: name}
+		s.stats[name] = st
+	}
+	return st
+}
+
+func (s *MatchViewScheduler) record(d dueMatchView, refresh *MatchViewRefresh, err error) {
+	st := s.viewStats(d.name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		now := time.Now()
+		st.Failures++
+		st.LastError = err.Error()
+		st.LastErrorAt = &now
+		st.retryAt = now.Add(d.backoff)
+		return
+	}
+	st.Refreshes++
+	if refresh.Full {
+		st.FullRefreshes++
+	}
+	st.LastRefresh = refresh
+	st.retryAt = time.Time{}
+}
+
+// Stats returns the scheduler's counters for each view it refreshed or
+// tried to, by name
+func (s *MatchViewScheduler) Stats() []MatchViewStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]MatchViewStats, 0, len(s.stats))
+	for _, st := range s.stats {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].View < stats[j].View })
+	return stats
+}
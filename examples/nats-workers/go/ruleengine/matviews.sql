@@ -0,0 +1,126 @@
+-- Materialized rule-match views (see EnableMatchViews). Each view stores
+-- the result of evaluating a rule set against every row of a source table
+-- in a table of its own, refreshed by MatchViewScheduler, so reporting
+-- queries read stored results instead of evaluating rules.
+
+CREATE TABLE IF NOT EXISTS rule_match_views (
+    name TEXT PRIMARY KEY,
+    ruleset_id INTEGER NOT NULL,
+    source TEXT NOT NULL,
+    key_column TEXT NOT NULL,
+    facts_column TEXT,
+    updated_column TEXT,
+    full_interval INTERVAL,
+    incremental_interval INTERVAL,
+    rules_fingerprint TEXT,
+    watermark TIMESTAMPTZ,
+    last_full_at TIMESTAMPTZ,
+    last_refresh_at TIMESTAMPTZ,
+    last_refresh_ms BIGINT,
+    last_rows BIGINT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Identifies the rules a view was computed with: the members of the rule
+-- set and the GRL they resolve to
+CREATE OR REPLACE FUNCTION rule_match_view_fingerprint(p_ruleset_id INTEGER)
+RETURNS TEXT AS $$
+    SELECT md5(COALESCE(string_agg(r.rule_name || '@' || COALESCE(r.rule_version, '') || ':' || md5(rule_get(r.rule_name, r.rule_version)), E'\n'), ''))
+    FROM ruleset_get_rules(p_ruleset_id) r
+$$ LANGUAGE sql STABLE;
+
+-- Re-evaluates a view's source rows and returns how many were evaluated.
+-- An incremental refresh evaluates only rows whose updated_column is past
+-- the watermark; it becomes a full refresh when the view has no
+-- updated_column, has never been refreshed, or its rules changed. A full
+-- refresh also removes rows that left the source. Callers serialize
+-- refreshes of a view (MatchViewScheduler takes an advisory lock).
+CREATE OR REPLACE FUNCTION rule_match_view_refresh(p_name TEXT, p_full BOOLEAN)
+RETURNS BIGINT AS $$
+DECLARE
+    v rule_match_views%ROWTYPE;
+    v_fingerprint TEXT;
+    v_started TIMESTAMPTZ := clock_timestamp();
+    v_facts TEXT;
+    v_updated TEXT;
+    v_select TEXT;
+    v_watermark TIMESTAMPTZ;
+    v_rows BIGINT := 0;
+    r RECORD;
+    v_result JSONB;
+    v_error TEXT;
+BEGIN
+    SELECT * INTO v FROM rule_match_views WHERE name = p_name;
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'match view % not found', p_name USING ERRCODE = 'no_data_found';
+    END IF;
+
+    v_fingerprint := rule_match_view_fingerprint(v.ruleset_id);
+    IF v.updated_column IS NULL OR v.last_full_at IS NULL
+        OR v.rules_fingerprint IS DISTINCT FROM v_fingerprint THEN
+        p_full := true;
+    END IF;
+
+    v_facts := CASE WHEN v.facts_column IS NULL THEN 'to_jsonb(s)::TEXT'
+                    ELSE format('s.%I::TEXT', v.facts_column) END;
+    v_updated := CASE WHEN v.updated_column IS NULL THEN 'NULL::TIMESTAMPTZ'
+                      ELSE format('s.%I::TIMESTAMPTZ', v.updated_column) END;
+    v_select := format('SELECT s.%I::TEXT AS key, %s AS facts, %s AS updated FROM %s s',
+                       v.key_column, v_facts, v_updated, v.source::regclass);
+    -- Fix the new watermark first so rows updated during the refresh are
+    -- picked up by the next one
+    IF v.updated_column IS NOT NULL THEN
+        EXECUTE format('SELECT max(updated) FROM (%s) src', v_select) INTO v_watermark;
+    END IF;
+    IF NOT p_full THEN
+        v_select := v_select || format(' WHERE s.%I > %L AND s.%I <= %L',
+                                       v.updated_column, v.watermark, v.updated_column, v_watermark);
+    END IF;
+
+    -- One statement for all rows; if any row fails, fall back to one row at
+    -- a time so only the failing rows record an error
+    BEGIN
+        EXECUTE format(
+            'INSERT INTO %I (key, facts, error, evaluated_at)
+             SELECT key, ruleset_execute(%s, facts)::JSONB, NULL, %L FROM (%s) src
+             ON CONFLICT (key) DO UPDATE
+                 SET facts = EXCLUDED.facts, error = NULL, evaluated_at = EXCLUDED.evaluated_at',
+            v.name, v.ruleset_id, v_started, v_select);
+        GET DIAGNOSTICS v_rows = ROW_COUNT;
+    EXCEPTION WHEN OTHERS THEN
+        v_rows := 0;
+        FOR r IN EXECUTE v_select LOOP
+            BEGIN
+                v_result := ruleset_execute(v.ruleset_id, r.facts)::JSONB;
+                v_error := NULL;
+            EXCEPTION WHEN OTHERS THEN
+                v_result := NULL;
+                v_error := SQLERRM;
+            END;
+            EXECUTE format(
+                'INSERT INTO %I (key, facts, error, evaluated_at) VALUES ($1, $2, $3, $4)
+                 ON CONFLICT (key) DO UPDATE
+                     SET facts = EXCLUDED.facts, error = EXCLUDED.error, evaluated_at = EXCLUDED.evaluated_at',
+                v.name) USING r.key, v_result, v_error, v_started;
+            v_rows := v_rows + 1;
+        END LOOP;
+    END;
+
+    IF p_full THEN
+        EXECUTE format('DELETE FROM %I WHERE evaluated_at < %L', v.name, v_started);
+    END IF;
+
+    UPDATE rule_match_views SET
+        rules_fingerprint = v_fingerprint,
+        watermark = CASE WHEN p_full THEN v_watermark ELSE GREATEST(watermark, v_watermark) END,
+        last_full_at = CASE WHEN p_full THEN v_started ELSE last_full_at END,
+        last_refresh_at = v_started,
+        last_refresh_ms = (extract(epoch FROM clock_timestamp() - v_started) * 1000)::BIGINT,
+        last_rows = v_rows
+    WHERE name = p_name;
+    RETURN v_rows;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON TABLE rule_match_views IS 'Materialized results of evaluating a rule set against a source table';
+COMMENT ON FUNCTION rule_match_view_refresh IS 'Re-evaluates a match view''s source rows (fully or past its watermark)';
@@ -0,0 +1,368 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCreateMatchViewValidation(t *testing.T) {
+	valid := MatchView{Name: "hot_orders", RuleSetID: 3, Source: "orders", KeyColumn: "id"}
+	tests := []struct {
+		name      string
+		edit      func(v *MatchView)
+		wantField string
+	}{
+		{name: "name with a quote", edit: func(v *MatchView) { v.Name = `hot"; DROP TABLE x; --` }, wantField: "name"},
+		{name: "name too long", edit: func(v *MatchView) { v.Name = strings.Repeat("a", 64) }, wantField: "name"},
+		{name: "no rule set", edit: func(v *MatchView) { v.RuleSetID = 0 }, wantField: "ruleset_id"},
+		{name: "no key column", edit: func(v *MatchView) { v.KeyColumn = "" }, wantField: "key_column"},
+		{name: "bad facts column", edit: func(v *MatchView) { v.FactsColumn = "data->'x'" }, wantField: "facts_column"},
+		{name: "bad updated column", edit: func(v *MatchView) { v.UpdatedColumn = "1st" }, wantField: "updated_column"},
+		{name: "negative interval", edit: func(v *MatchView) { v.FullInterval = -time.Second }, wantField: "interval"},
+		{name: "incremental without updated column", edit: func(v *MatchView) { v.IncrementalInterval = time.Minute },
+			wantField: "updated_column"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newMock(t)
+			v := valid
+			tt.edit(&v)
+			var verr *ValidationError
+			if err := client.CreateMatchView(context.Background(), v); !errors.As(err, &verr) || verr.Field != tt.wantField {
+				t.Fatalf("err = %v, want a %s validation error", err, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestCreateMatchView(t *testing.T) {
+	client, mock := newMock(t)
+	v := MatchView{Name: "hot_orders", RuleSetID: 3, Source: "sales.orders", KeyColumn: "id",
+		UpdatedColumn: "updated_at", FullInterval: time.Hour, IncrementalInterval: 90 * time.Second}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT to_regclass\(\$1\) IS NOT NULL`).WithArgs("sales.orders").
+		WillReturnRows(sqlmock.NewRows([]string{"found"}).AddRow(true))
+	mock.ExpectExec(`CREATE TABLE "hot_orders"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO rule_match_views`).
+		WithArgs("hot_orders", 3, "sales.orders", "id", "", "updated_at", 3600.0, 90.0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := client.CreateMatchView(context.Background(), v); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`to_regclass`).WillReturnRows(sqlmock.NewRows([]string{"found"}).AddRow(false))
+	mock.ExpectRollback()
+	var verr *ValidationError
+	if err := client.CreateMatchView(context.Background(), v); !errors.As(err, &verr) || verr.Field != "source" {
+		t.Fatalf("missing source: err = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func matchViewRow(name string, refreshed *time.Time) []driver.Value {
+	created := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	var watermark, last interface{}
+	if refreshed != nil {
+		watermark, last = *refreshed, *refreshed
+	}
+	return []driver.Value{name, 3, "orders", "id", "", "updated_at", 3600.0, 90.5,
+		watermark, last, last, int64(120), int64(42), 30.25, created}
+}
+
+var matchViewRowColumns = []string{"name", "ruleset_id", "source", "key_column", "facts_column", "updated_column",
+	"full", "incremental", "watermark", "last_full_at", "last_refresh_at", "last_refresh_ms", "last_rows",
+	"staleness", "created_at"}
+
+func TestGetMatchView(t *testing.T) {
+	client, mock := newMock(t)
+	refreshed := time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`FROM rule_match_views WHERE name = \$1`).WithArgs("hot").
+		WillReturnRows(sqlmock.NewRows(matchViewRowColumns).AddRow(matchViewRow("hot", &refreshed)...))
+	v, err := client.GetMatchView(context.Background(), "hot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.FullInterval != time.Hour || v.IncrementalInterval != 90500*time.Millisecond ||
+		v.Staleness != 30250*time.Millisecond || v.LastRows != 42 || v.LastRefreshMS != 120 ||
+		v.Watermark == nil || !v.Watermark.Equal(refreshed) || v.LastFullAt == nil {
+		t.Fatalf("view = %+v", v)
+	}
+
+	mock.ExpectQuery(`FROM rule_match_views ORDER BY name`).
+		WillReturnRows(sqlmock.NewRows(matchViewRowColumns).AddRow(matchViewRow("a", nil)...).AddRow(matchViewRow("b", nil)...))
+	views, err := client.ListMatchViews(context.Background())
+	if err != nil || len(views) != 2 || views[1].Name != "b" || views[0].Watermark != nil || views[0].LastRefreshAt != nil {
+		t.Fatalf("ListMatchViews = %+v, %v", views, err)
+	}
+
+	mock.ExpectQuery(`FROM rule_match_views WHERE name`).WithArgs("nope").
+		WillReturnRows(sqlmock.NewRows(matchViewRowColumns))
+	if _, err := client.GetMatchView(context.Background(), "nope"); !errors.Is(err, ErrMatchViewNotFound) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestSetMatchViewSchedule(t *testing.T) {
+	tests := []struct {
+		name         string
+		full, incr   time.Duration
+		updated      int64
+		exists       bool
+		wantErr      error
+		wantField    string
+		wantNoLookup bool
+	}{
+		{name: "updated", full: time.Hour, incr: time.Minute, updated: 1, wantNoLookup: true},
+		{name: "negative", full: -time.Hour, wantField: "interval", wantNoLookup: true},
+		{name: "no updated column", incr: time.Minute, exists: true, wantField: "updated_column"},
+		{name: "unknown view", full: time.Hour, wantErr: ErrMatchViewNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			if tt.full >= 0 {
+				mock.ExpectExec(`UPDATE rule_match_views SET`).WithArgs("hot", tt.full.Seconds(), tt.incr.Seconds()).
+					WillReturnResult(sqlmock.NewResult(0, tt.updated))
+			}
+			if !tt.wantNoLookup {
+				rows := sqlmock.NewRows(matchViewRowColumns)
+				if tt.exists {
+					rows.AddRow(matchViewRow("hot", nil)...)
+				}
+				mock.ExpectQuery(`FROM rule_match_views WHERE name`).WillReturnRows(rows)
+			}
+			err := client.SetMatchViewSchedule(context.Background(), "hot", tt.full, tt.incr)
+			var verr *ValidationError
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantField != "":
+				if !errors.As(err, &verr) || verr.Field != tt.wantField {
+					t.Fatalf("err = %v, want a %s validation error", err, tt.wantField)
+				}
+			case err != nil:
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDropMatchView(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM rule_match_views`).WithArgs("hot").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DROP TABLE IF EXISTS "hot"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	if err := client.DropMatchView(context.Background(), "hot"); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM rule_match_views`).WithArgs("gone").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	if err := client.DropMatchView(context.Background(), "gone"); !errors.Is(err, ErrMatchViewNotFound) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+// expectRefresh expects one refresh of view that takes the lock (waiting
+// or not) and evaluates rows, reporting ranFull
+func expectRefresh(mock sqlmock.Sqlmock, view string, wait bool, rows int64, ranFull bool) {
+	mock.ExpectBegin()
+	if wait {
+		mock.ExpectExec(`SELECT pg_advisory_xact_lock`).WithArgs(view).WillReturnResult(sqlmock.NewResult(0, 0))
+	} else {
+		mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock`).WithArgs(view).
+			WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	}
+	mock.ExpectQuery(`SELECT rule_match_view_refresh\(\$1, \$2\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"rows"}).AddRow(rows))
+	mock.ExpectQuery(`SELECT last_full_at = last_refresh_at`).WithArgs(view).
+		WillReturnRows(sqlmock.NewRows([]string{"full"}).AddRow(ranFull))
+	mock.ExpectCommit()
+}
+
+func TestRefreshMatchView(t *testing.T) {
+	client, mock := newMock(t)
+	mock.MatchExpectationsInOrder(true)
+	mock.ExpectQuery(`FROM rule_match_views WHERE name`).WithArgs("hot").
+		WillReturnRows(sqlmock.NewRows(matchViewRowColumns).AddRow(matchViewRow("hot", nil)...))
+	expectRefresh(mock, "hot", true, 42, true)
+
+	// Asked for incremental, upgraded to full by the refresh function
+	refresh, err := client.RefreshMatchView(context.Background(), "hot", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refresh.View != "hot" || refresh.Rows != 42 || !refresh.Full {
+		t.Fatalf("refresh = %+v", refresh)
+	}
+
+	mock.ExpectQuery(`FROM rule_match_views WHERE name`).WithArgs("gone").
+		WillReturnRows(sqlmock.NewRows(matchViewRowColumns))
+	if _, err := client.RefreshMatchView(context.Background(), "gone", true); !errors.Is(err, ErrMatchViewNotFound) {
+		t.Fatalf("err = %v", err)
+	}
+
+	// Without waiting, a view locked elsewhere is skipped
+	mock.ExpectBegin()
+	mock.ExpectQuery(`pg_try_advisory_xact_lock`).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+	mock.ExpectRollback()
+	if refresh, ok, err := client.refreshMatchView(context.Background(), "hot", true, false); refresh != nil || ok || err != nil {
+		t.Fatalf("locked view: %v, %v, %v", refresh, ok, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchViewScheduler(t *testing.T) {
+	client, mock := newMock(t)
+	mock.MatchExpectationsInOrder(true)
+	s := client.NewMatchViewScheduler()
+	var calls []string
+	s.OnRefresh = func(view string, refresh *MatchViewRefresh, err error) {
+		calls = append(calls, fmt.Sprintf("%s:%v", view, err))
+	}
+	due := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"name", "full_due", "backoff"}).
+			AddRow("a", true, 3600.0).AddRow("b", false, 60.0).AddRow("c", false, 60.0)
+	}
+
+	// a refreshes fully, b is locked by another process, c fails
+	mock.ExpectQuery(`FROM rule_match_views\) v`).WillReturnRows(due())
+	expectRefresh(mock, "a", false, 10, true)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`pg_try_advisory_xact_lock`).WithArgs("b").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`pg_try_advisory_xact_lock`).WithArgs("c").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery(`rule_match_view_refresh`).WillReturnError(errors.New(`relation "orders" does not exist`))
+	mock.ExpectRollback()
+	s.refreshDue(context.Background())
+
+	// c is not retried before its backoff
+	mock.ExpectQuery(`FROM rule_match_views\) v`).WillReturnRows(due())
+	expectRefresh(mock, "a", false, 1, false)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`pg_try_advisory_xact_lock`).WithArgs("b").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+	mock.ExpectRollback()
+	s.refreshDue(context.Background())
+
+	// A failed lookup is reported without a view
+	mock.ExpectQuery(`FROM rule_match_views\) v`).WillReturnError(errors.New("connection reset"))
+	s.refreshDue(context.Background())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a:<nil>",
+		`c:failed to refresh match view c: relation "orders" does not exist`,
+		"a:<nil>", ":connection reset"}
+	if strings.Join(calls, "|") != strings.Join(want, "|") {
+		t.Fatalf("OnRefresh calls %q, want %q", calls, want)
+	}
+
+	stats := s.Stats()
+	if len(stats) != 3 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	a, b, c := stats[0], stats[1], stats[2]
+	if a.View != "a" || a.Refreshes != 2 || a.FullRefreshes != 1 || a.LastRefresh.Rows != 1 || a.Failures != 0 {
+		t.Errorf("a = %+v", a)
+	}
+	if b.Refreshes != 0 || b.Failures != 0 {
+		t.Errorf("b = %+v", b)
+	}
+	if c.Failures != 1 || c.LastErrorAt == nil || !strings.Contains(c.LastError, "does not exist") ||
+		time.Until(c.retryAt) < 59*time.Second {
+		t.Errorf("c = %+v", c)
+	}
+}
+
+// TestMatchViewRefreshDB needs RULETEST_DATABASE_URL
+func TestMatchViewRefreshDB(t *testing.T) {
+	client := testDB(t)
+	ctx := context.Background()
+	if err := client.EnableMatchViews(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	suffix := time.Now().Format("150405")
+	source, view, rule := "matview_src_"+suffix, "matview_"+suffix, "MatViewTest"+suffix
+	db := client.DB()
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(
+		`CREATE TABLE %q (id INT PRIMARY KEY, total INT, updated_at TIMESTAMPTZ NOT NULL DEFAULT now())`, source)); err != nil {
+		t.Fatal(err)
+	}
+	defer db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %q", source))
+	if _, err := client.CreateRule(ctx, SaveRuleInput{Name: rule,
+		GRL: `rule ` + rule + ` "" { when total > 100 then big = true; Retract("` + rule + `"); }`}); err != nil {
+		t.Fatal(err)
+	}
+	defer client.DeleteRule(ctx, rule, "")
+	id, err := client.CreateRuleSet(ctx, "matview-"+suffix, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.DeleteRuleSet(ctx, id)
+	if err := client.AddRuleToSet(ctx, id, RuleSetMember{Rule: rule, Order: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %q (id, total) VALUES (1, 50), (2, 500)`, source)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CreateMatchView(ctx, MatchView{Name: view, RuleSetID: id, Source: source, KeyColumn: "id",
+		UpdatedColumn: "updated_at"}); err != nil {
+		t.Fatal(err)
+	}
+	defer client.DropMatchView(ctx, view)
+
+	// The first refresh is always full
+	refresh, err := client.RefreshMatchView(ctx, view, false)
+	if err != nil || !refresh.Full || refresh.Rows != 2 {
+		t.Fatalf("first refresh = %+v, %v", refresh, err)
+	}
+	var big bool
+	if err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COALESCE((facts->>'big')::BOOLEAN, false) FROM %q WHERE key = '2'`, view)).Scan(&big); err != nil || !big {
+		t.Fatalf("row 2 big = %v, %v", big, err)
+	}
+
+	// Only the updated row is evaluated incrementally
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(`UPDATE %q SET total = 200, updated_at = now() + INTERVAL '1 second' WHERE id = 1`, source)); err != nil {
+		t.Fatal(err)
+	}
+	if refresh, err = client.RefreshMatchView(ctx, view, false); err != nil || refresh.Full || refresh.Rows != 1 {
+		t.Fatalf("incremental refresh = %+v, %v", refresh, err)
+	}
+
+	// A full refresh drops rows that left the source
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %q WHERE id = 2`, source)); err != nil {
+		t.Fatal(err)
+	}
+	if refresh, err = client.RefreshMatchView(ctx, view, true); err != nil || !refresh.Full || refresh.Rows != 1 {
+		t.Fatalf("full refresh = %+v, %v", refresh, err)
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT count(*) FROM %q`, view)).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("rows = %d, %v", n, err)
+	}
+}
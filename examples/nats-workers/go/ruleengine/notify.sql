@@ -0,0 +1,48 @@
+-- Change notifications for the SDK's rule cache (see EnableCache).
+--
+-- Installed by Client.InstallChangeNotifications. Payloads are
+-- "rule:<name>", "ruleset:<id>", or "rule:*" when the rule name is no
+-- longer known.
+
+CREATE OR REPLACE FUNCTION ruleengine_notify_rule_change() RETURNS TRIGGER AS $$
+DECLARE
+    v_name TEXT;
+BEGIN
+    IF TG_TABLE_NAME = 'rule_definitions' THEN
+        v_name := COALESCE(NEW.name, OLD.name);
+    ELSE
+        SELECT name INTO v_name FROM rule_definitions
+        WHERE id = COALESCE(NEW.rule_id, OLD.rule_id);
+    END IF;
+    PERFORM pg_notify('rule_engine_rule_changes', 'rule:' || COALESCE(v_name, '*'));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION ruleengine_notify_ruleset_change() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('rule_engine_rule_changes',
+        'ruleset:' || COALESCE(NEW.ruleset_id, OLD.ruleset_id));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS ruleengine_cache ON rule_definitions;
+CREATE TRIGGER ruleengine_cache
+    AFTER UPDATE OR DELETE ON rule_definitions
+    FOR EACH ROW EXECUTE FUNCTION ruleengine_notify_rule_change();
+
+DROP TRIGGER IF EXISTS ruleengine_cache ON rule_versions;
+CREATE TRIGGER ruleengine_cache
+    AFTER INSERT OR UPDATE OR DELETE ON rule_versions
+    FOR EACH ROW EXECUTE FUNCTION ruleengine_notify_rule_change();
+
+DROP TRIGGER IF EXISTS ruleengine_cache ON rule_sets;
+CREATE TRIGGER ruleengine_cache
+    AFTER UPDATE OR DELETE ON rule_sets
+    FOR EACH ROW EXECUTE FUNCTION ruleengine_notify_ruleset_change();
+
+DROP TRIGGER IF EXISTS ruleengine_cache ON rule_set_members;
+CREATE TRIGGER ruleengine_cache
+    AFTER INSERT OR UPDATE OR DELETE ON rule_set_members
+    FOR EACH ROW EXECUTE FUNCTION ruleengine_notify_ruleset_change();
@@ -0,0 +1,104 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrWebhookNotFound is returned for an unknown webhook id
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// DestinationPause is a webhook's maintenance window. NATS workers hold
+// its deliveries on the stream from From until Until and send them
+// afterwards; they are delayed, not retried and failed. The columns are
+// added by the NATS worker's schema.
+type DestinationPause struct {
+	WebhookID int        `json:"webhook_id"`
+	Name      string     `json:"webhook_name"`
+	From      time.Time  `json:"from"`
+	Until     *time.Time `json:"until,omitempty"` // nil: until ResumeDestination
+	Reason    string     `json:"reason,omitempty"`
+	Active    bool       `json:"active"`
+}
+
+// PauseDestination holds deliveries to a webhook from from (now if zero)
+// until until (until resumed if zero), replacing any earlier window.
+// Workers see the change within 30 seconds.
+func (c *Client) PauseDestination(ctx context.Context, webhookID int, from, until time.Time, reason string) error {
+	if from.IsZero() {
+		from = time.Now()
+	}
+	var end sql.NullTime
+	if !until.IsZero() {
+		if !until.After(from) {
+			return &ValidationError{Field: "until", Message: "must be after the start of the pause"}
+		}
+		if !until.After(time.Now()) {
+			return &ValidationError{Field: "until", Message: "must be in the future"}
+		}
+		end = sql.NullTime{Time: until, Valid: true}
+	}
+	res, err := c.db.ExecContext(ctx,
+		`UPDATE rule_webhooks SET paused_from = $2, paused_until = $3, pause_reason = NULLIF($4, '')
+		 WHERE webhook_id = $1`,
+		webhookID, from, end, reason,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%d: %w", webhookID, ErrWebhookNotFound)
+	}
+	return nil
+}
+
+// ResumeDestination ends or cancels a webhook's pause. Held messages are
+// sent within five minutes.
+func (c *Client) ResumeDestination(ctx context.Context, webhookID int) error {
+	res, err := c.db.ExecContext(ctx,
+		`UPDATE rule_webhooks SET paused_from = NULL, paused_until = NULL, pause_reason = NULL
+		 WHERE webhook_id = $1`,
+		webhookID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%d: %w", webhookID, ErrWebhookNotFound)
+	}
+	return nil
+}
+
+// ListDestinationPauses returns the current and upcoming maintenance
+// windows, soonest first
+func (c *Client) ListDestinationPauses(ctx context.Context) ([]DestinationPause, error) {
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT webhook_id, webhook_name, paused_from, paused_until, COALESCE(pause_reason, ''),
+		        paused_from <= CURRENT_TIMESTAMP
+		 FROM rule_webhooks
+		 WHERE paused_from IS NOT NULL
+		   AND (paused_until IS NULL OR paused_until > CURRENT_TIMESTAMP)
+		 ORDER BY paused_from, webhook_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pauses := []DestinationPause{}
+	for rows.Next() {
+		var p DestinationPause
+		var until sql.NullTime
+		if err := rows.Scan(&p.WebhookID, &p.Name, &p.From, &until, &p.Reason, &p.Active); err != nil {
+			return nil, err
+		}
+		if until.Valid {
+			p.Until = &until.Time
+		}
+		pauses = append(pauses, p)
+	}
+	return pauses, rows.Err()
+}
@@ -0,0 +1,78 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPauseDestination(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		from, until time.Time
+		rows        int64
+		wantErr     string
+		wantMissing bool
+	}{
+		{name: "until resumed", rows: 1},
+		{name: "window", from: now.Add(time.Hour), until: now.Add(2 * time.Hour), rows: 1},
+		{name: "ends before it starts", from: now.Add(2 * time.Hour), until: now.Add(time.Hour),
+			wantErr: "invalid until: must be after the start of the pause"},
+		{name: "already over", from: now.Add(-2 * time.Hour), until: now.Add(-time.Hour),
+			wantErr: "invalid until: must be in the future"},
+		{name: "unknown webhook", wantErr: "3: webhook not found", wantMissing: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mock := newMock(t)
+			if tt.wantErr == "" || tt.wantMissing {
+				mock.ExpectExec(`UPDATE rule_webhooks SET paused_from = \$2, paused_until = \$3, pause_reason = NULLIF\(\$4, ''\)`).
+					WithArgs(3, sqlmock.AnyArg(), sqlmock.AnyArg(), "upgrade").
+					WillReturnResult(sqlmock.NewResult(0, tt.rows))
+			}
+			err := c.PauseDestination(context.Background(), 3, tt.from, tt.until, "upgrade")
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr || errors.Is(err, ErrWebhookNotFound) != tt.wantMissing {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestResumeDestination(t *testing.T) {
+	for rows, wantErr := range map[int64]error{1: nil, 0: ErrWebhookNotFound} {
+		c, mock := newMock(t)
+		mock.ExpectExec(`UPDATE rule_webhooks SET paused_from = NULL, paused_until = NULL, pause_reason = NULL`).WithArgs(3).
+			WillReturnResult(sqlmock.NewResult(0, rows))
+		if err := c.ResumeDestination(context.Background(), 3); !errors.Is(err, wantErr) || (wantErr == nil && err != nil) {
+			t.Errorf("%d rows: err = %v", rows, err)
+		}
+	}
+}
+
+func TestListDestinationPauses(t *testing.T) {
+	c, mock := newMock(t)
+	from, until := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	mock.ExpectQuery(`FROM rule_webhooks\s+WHERE paused_from IS NOT NULL`).
+		WillReturnRows(sqlmock.NewRows([]string{"webhook_id", "webhook_name", "paused_from", "paused_until", "pause_reason", "active"}).
+			AddRow(3, "crm", from, until, "upgrade", true).
+			AddRow(4, "erp", until, nil, "", false))
+	pauses, err := c.ListDestinationPauses(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pauses) != 2 || pauses[0].Until == nil || !pauses[0].Until.Equal(until) || !pauses[0].Active ||
+		pauses[1].Until != nil || pauses[1].Active || pauses[1].Name != "erp" {
+		t.Fatalf("pauses = %+v", pauses)
+	}
+}
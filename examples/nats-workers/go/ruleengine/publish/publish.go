@@ -0,0 +1,275 @@
+// Package publish emits rule events to JetStream for NATS workers, with
+// the parts services tend to get wrong done once:
+//
+//   - every message carries a Nats-Msg-Id, so a retry after a lost ack is
+//     dropped by the stream's duplicate window instead of delivered twice
+//   - publishes are asynchronous, but at most MaxPending await their acks;
+//     Publish blocks (until its context ends) once the window is full, so
+//     a slow or unavailable stream pushes back on the caller instead of
+//     growing memory without bound
+//   - a publish that fails after Publish returned is retried with the same
+//     message id and, if it still fails, reported to OnError
+//
+// For example:
+//
+//	p := publish.New(js, publish.Options{OnError: func(m publish.Message, err error) {
+//		log.Printf("lost %s: %v", m.MsgID, err)
+//	}})
+//	defer p.Close(context.Background())
+//	err := p.Publish(ctx, publish.Message{
+//		Subject: "webhooks.orders",
+//		MsgID:   "order-42-created",
+//		Data:    map[string]interface{}{"webhook_id": 7, "data": order},
+//	})
+package publish
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrClosed is returned by Publish after Close
+var ErrClosed = errors.New("publish: publisher is closed")
+
+// Message is one event to publish
+type Message struct {
+	Subject string
+
+	// MsgID is the Nats-Msg-Id the stream deduplicates on. Use an id of the
+	// event itself (order-42-created) so publishing it twice is harmless;
+	// when empty a random id is used, which still makes retries safe.
+	MsgID string
+
+	// Data is sent as is when it is []byte or json.RawMessage and encoded
+	// as JSON otherwise
+	Data interface{}
+
+	Header nats.Header
+}
+
+// Options tune a Publisher. Zero values use the defaults.
+type Options struct {
+	// MaxPending bounds publishes awaiting their acks (default 256)
+	MaxPending int
+
+	// AckTimeout is how long to wait for each ack (default 5s)
+	AckTimeout time.Duration
+
+	// Retries is how often a failed publish is tried again (default 3);
+	// use a negative value for none
+	Retries int
+
+	// RetryBackoff is the wait before the first retry, doubled for each
+	// further one (default 250ms)
+	RetryBackoff time.Duration
+
+	// OnError is called, from another goroutine, for every message that
+	// could not be published after Publish returned
+	OnError func(Message, error)
+}
+
+// Publisher publishes messages asynchronously with a bounded window of
+// pending acks. It is safe for concurrent use.
+type Publisher struct {
+	js   nats.JetStreamContext
+	opts Options
+
+	slots chan struct{} // one per pending publish
+	wg    sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// New returns a Publisher on js
+func New(js nats.JetStreamContext, opts Options) *Publisher {
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 256
+	}
+	if opts.AckTimeout <= 0 {
+		opts.AckTimeout = 5 * time.Second
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 3
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 250 * time.Millisecond
+	}
+	return &Publisher{js: js, opts: opts, slots: make(chan struct{}, opts.MaxPending)}
+}
+
+// Publish sends m without waiting for its ack. It blocks while MaxPending
+// publishes are pending, returning ctx's error if that ends first, and
+// returns errors that make m unpublishable, such as data that does not
+// encode. Failures after it returns go to OnError.
+func (p *Publisher) Publish(ctx context.Context, m Message) error {
+	msg, err := p.encode(&m)
+	if err != nil {
+		return err
+	}
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return ErrClosed
+	}
+	p.wg.Add(1)
+	p.mu.Unlock()
+
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.slots }()
+		if err := p.send(msg); err != nil && p.opts.OnError != nil {
+			p.opts.OnError(m, err)
+		}
+	}()
+	return nil
+}
+
+// PublishSync sends m and waits for its ack, retrying like Publish. It
+// counts against MaxPending while it waits.
+func (p *Publisher) PublishSync(ctx context.Context, m Message) (*nats.PubAck, error) {
+	msg, err := p.encode(&m)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	var ack *nats.PubAck
+	err = p.retry(ctx, func() error {
+		var err error
+		ack, err = p.js.PublishMsg(msg, nats.Context(ctx))
+		return err
+	})
+	return ack, err
+}
+
+// Pending returns how many publishes await their acks
+func (p *Publisher) Pending() int {
+	return len(p.slots)
+}
+
+// Flush waits until every pending publish has been acked or reported to
+// OnError, or ctx ends
+func (p *Publisher) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting messages and flushes the pending ones
+func (p *Publisher) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	return p.Flush(ctx)
+}
+
+// encode builds the NATS message for m, filling in its MsgID
+func (p *Publisher) encode(m *Message) (*nats.Msg, error) {
+	if m.Subject == "" {
+		return nil, errors.New("publish: message has no subject")
+	}
+	var data []byte
+	switch d := m.Data.(type) {
+	case []byte:
+		data = d
+	case json.RawMessage:
+		data = d
+	default:
+		var err error
+		if data, err = json.Marshal(d); err != nil {
+			return nil, fmt.Errorf("publish: failed to encode %s: %w", m.Subject, err)
+		}
+	}
+	if m.MsgID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		m.MsgID = hex.EncodeToString(id)
+	}
+
+	msg := nats.NewMsg(m.Subject)
+	msg.Data = data
+	for key, values := range m.Header {
+		msg.Header[key] = values
+	}
+	msg.Header.Set(nats.MsgIdHdr, m.MsgID)
+	return msg, nil
+}
+
+// send publishes msg asynchronously and waits for its ack, retrying
+func (p *Publisher) send(msg *nats.Msg) error {
+	return p.retry(context.Background(), func() error {
+		future, err := p.js.PublishMsgAsync(msg)
+		if err != nil {
+			return err
+		}
+		timer := time.NewTimer(p.opts.AckTimeout)
+		defer timer.Stop()
+		select {
+		case <-future.Ok():
+			return nil
+		case err := <-future.Err():
+			return err
+		case <-timer.C:
+			return nats.ErrTimeout
+		}
+	})
+}
+
+// retry runs publish until it succeeds, fails for good, or is out of
+// retries. A stream rejecting the message is not retried.
+func (p *Publisher) retry(ctx context.Context, publish func() error) error {
+	backoff := p.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := publish()
+		if err == nil || attempt >= p.opts.Retries || !retryable(err) {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// retryable reports whether a publish error may pass: a timeout or no
+// responders while a stream leader is elected, not an API error such as
+// a wrong sequence or an oversized message
+func retryable(err error) bool {
+	var apiErr *nats.APIError
+	if errors.As(err, &apiErr) {
+		return false
+	}
+	return !errors.Is(err, nats.ErrConnectionClosed) && !errors.Is(err, nats.ErrMaxPayload)
+}
@@ -0,0 +1,245 @@
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// fakeStream answers publishes with errs in order (nil acks), then acks.
+// Async acks wait for hold to close when it is set and never come when
+// silent is.
+type fakeStream struct {
+	nats.JetStreamContext
+	hold   chan struct{}
+	silent bool
+
+	mu       sync.Mutex
+	errs     []error
+	attempts []*nats.Msg
+}
+
+func (s *fakeStream) next(m *nats.Msg) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts = append(s.attempts, m)
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func (s *fakeStream) PublishMsg(m *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	if err := s.next(m); err != nil {
+		return nil, err
+	}
+	return &nats.PubAck{Stream: "RULES", Sequence: 7}, nil
+}
+
+func (s *fakeStream) PublishMsgAsync(m *nats.Msg, opts ...nats.PubOpt) (nats.PubAckFuture, error) {
+	f := &fakeFuture{msg: m, ok: make(chan *nats.PubAck, 1), err: make(chan error, 1)}
+	err := s.next(m)
+	if s.silent {
+		return f, nil
+	}
+	go func() {
+		if s.hold != nil {
+			<-s.hold
+		}
+		if err != nil {
+			f.err <- err
+		} else {
+			f.ok <- &nats.PubAck{Stream: "RULES"}
+		}
+	}()
+	return f, nil
+}
+
+func (s *fakeStream) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.attempts)
+}
+
+type fakeFuture struct {
+	msg *nats.Msg
+	ok  chan *nats.PubAck
+	err chan error
+}
+
+func (f *fakeFuture) Ok() <-chan *nats.PubAck { return f.ok }
+func (f *fakeFuture) Err() <-chan error       { return f.err }
+func (f *fakeFuture) Msg() *nats.Msg          { return f.msg }
+
+func TestPublishEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		m        Message
+		wantData string
+		wantErr  string
+	}{
+		{name: "bytes", m: Message{Subject: "webhooks.orders", MsgID: "o1", Data: []byte("raw")}, wantData: "raw"},
+		{name: "raw JSON", m: Message{Subject: "webhooks.orders", MsgID: "o1", Data: json.RawMessage(`{"a": 1}`)}, wantData: `{"a": 1}`},
+		{name: "encoded", m: Message{Subject: "webhooks.orders", MsgID: "o1", Data: map[string]int{"webhook_id": 7}},
+			wantData: `{"webhook_id":7}`},
+		{name: "headers kept", m: Message{Subject: "webhooks.orders", MsgID: "o1", Data: nil, Header: nats.Header{"X-Request-Id": {"t1"}}},
+			wantData: "null"},
+		{name: "random id", m: Message{Subject: "webhooks.orders", Data: 1}, wantData: "1"},
+		{name: "no subject", m: Message{Data: 1}, wantErr: "publish: message has no subject"},
+		{name: "unencodable", m: Message{Subject: "webhooks.orders", Data: make(chan int)},
+			wantErr: "publish: failed to encode webhooks.orders: json: unsupported type: chan int"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js := &fakeStream{}
+			p := New(js, Options{})
+			err := p.Publish(context.Background(), tt.m)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Close(context.Background())
+			msg := js.attempts[0]
+			if string(msg.Data) != tt.wantData || msg.Subject != tt.m.Subject {
+				t.Fatalf("published %s %q", msg.Subject, msg.Data)
+			}
+			id := msg.Header.Get(nats.MsgIdHdr)
+			if (tt.m.MsgID != "" && id != tt.m.MsgID) || (tt.m.MsgID == "" && len(id) != 32) {
+				t.Fatalf("Nats-Msg-Id = %q", id)
+			}
+			for key := range tt.m.Header {
+				if msg.Header.Get(key) != tt.m.Header.Get(key) {
+					t.Fatalf("header %s = %q", key, msg.Header.Get(key))
+				}
+			}
+		})
+	}
+}
+
+func TestPublishRetries(t *testing.T) {
+	apiErr := &nats.APIError{Code: 400, ErrorCode: nats.JSErrCodeStreamWrongLastSequence, Description: "wrong last sequence"}
+	tests := []struct {
+		name         string
+		retries      int
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{name: "acked", wantAttempts: 1},
+		{name: "retried after a timeout", errs: []error{nats.ErrTimeout}, wantAttempts: 2},
+		{name: "out of retries", errs: []error{nats.ErrTimeout, nats.ErrNoResponders, nats.ErrTimeout, nats.ErrTimeout},
+			wantAttempts: 4, wantErr: nats.ErrTimeout},
+		{name: "no retries", retries: -1, errs: []error{nats.ErrTimeout}, wantAttempts: 1, wantErr: nats.ErrTimeout},
+		{name: "rejected by the stream", errs: []error{apiErr}, wantAttempts: 1, wantErr: apiErr},
+		{name: "connection closed", errs: []error{nats.ErrConnectionClosed}, wantAttempts: 1, wantErr: nats.ErrConnectionClosed},
+		{name: "too large", errs: []error{nats.ErrMaxPayload}, wantAttempts: 1, wantErr: nats.ErrMaxPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js := &fakeStream{errs: append([]error(nil), tt.errs...)}
+			var mu sync.Mutex
+			var failed []error
+			p := New(js, Options{Retries: tt.retries, RetryBackoff: time.Millisecond, OnError: func(m Message, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if m.MsgID != "o1" {
+					t.Errorf("OnError for %q", m.MsgID)
+				}
+				failed = append(failed, err)
+			}})
+			if err := p.Publish(context.Background(), Message{Subject: "webhooks.orders", MsgID: "o1", Data: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if js.count() != tt.wantAttempts {
+				t.Fatalf("%d attempts, want %d", js.count(), tt.wantAttempts)
+			}
+			// Every retry reuses the message id
+			for _, m := range js.attempts {
+				if m.Header.Get(nats.MsgIdHdr) != "o1" {
+					t.Fatalf("retried as %q", m.Header.Get(nats.MsgIdHdr))
+				}
+			}
+			if tt.wantErr == nil && len(failed) != 0 || tt.wantErr != nil && (len(failed) != 1 || !errors.Is(failed[0], tt.wantErr)) {
+				t.Fatalf("OnError got %v, want %v", failed, tt.wantErr)
+			}
+
+			// PublishSync retries the same way and returns the error
+			js = &fakeStream{errs: append([]error(nil), tt.errs...)}
+			p = New(js, Options{Retries: tt.retries, RetryBackoff: time.Millisecond})
+			ack, err := p.PublishSync(context.Background(), Message{Subject: "webhooks.orders", MsgID: "o1", Data: 1})
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (ack != nil) || js.count() != tt.wantAttempts {
+				t.Fatalf("PublishSync = %v, %v after %d attempts", ack, err, js.count())
+			}
+		})
+	}
+}
+
+func TestPublishAckTimeout(t *testing.T) {
+	js := &fakeStream{silent: true}
+	errs := make(chan error, 1)
+	p := New(js, Options{AckTimeout: 10 * time.Millisecond, Retries: -1, OnError: func(_ Message, err error) { errs <- err }})
+	if err := p.Publish(context.Background(), Message{Subject: "webhooks.orders", Data: 1}); err != nil {
+		t.Fatal(err)
+	}
+	p.Flush(context.Background())
+	if err := <-errs; err != nats.ErrTimeout {
+		t.Fatalf("OnError got %v", err)
+	}
+}
+
+func TestPublishBackpressure(t *testing.T) {
+	js := &fakeStream{hold: make(chan struct{})}
+	p := New(js, Options{MaxPending: 2})
+	for i := 0; i < 2; i++ {
+		if err := p.Publish(context.Background(), Message{Subject: "webhooks.orders", Data: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.Pending() != 2 {
+		t.Fatalf("Pending = %d", p.Pending())
+	}
+
+	// The window is full: publishing waits for an ack or the context
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Publish(ctx, Message{Subject: "webhooks.orders", Data: 2}); err != context.DeadlineExceeded {
+		t.Fatalf("Publish on a full window = %v", err)
+	}
+	if _, err := p.PublishSync(ctx, Message{Subject: "webhooks.orders", Data: 2}); err != context.DeadlineExceeded {
+		t.Fatalf("PublishSync on a full window = %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Flush with pending acks = %v", err)
+	}
+
+	close(js.hold)
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if p.Pending() != 0 || js.count() != 2 {
+		t.Fatalf("Pending = %d after %d publishes", p.Pending(), js.count())
+	}
+	if err := p.Publish(context.Background(), Message{Subject: "webhooks.orders", Data: 3}); err != ErrClosed {
+		t.Fatalf("Publish after Close = %v", err)
+	}
+	if p.Pending() != 0 {
+		t.Fatal("a closed publisher kept its slot")
+	}
+}
@@ -0,0 +1,226 @@
+package ruleengine
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+)
+
+//go:embed reporting.sql
+var reportingSQL string
+
+// InstallReportingViews creates rule_report_minute, rule_report_hourly,
+// and rule_report_daily (throughput, error rate, and latency percentiles
+// by destination and tenant) in the operational database (see SetOpsDB).
+// It is idempotent. A worker must have started against that database
+// first, since the views read the tables it creates.
+func (c *Client) InstallReportingViews(ctx context.Context) error {
+	var ready bool
+	err := c.ops().QueryRowContext(ctx,
+		`SELECT to_regclass('rule_delivery_stats_daily') IS NOT NULL AND to_regproc('rule_histogram_sum') IS NOT NULL`,
+	).Scan(&ready)
+	if err != nil {
+		return fmt.Errorf("failed to install reporting views: %w", err)
+	}
+	if !ready {
+		return fmt.Errorf("delivery statistics tables not found; start a worker against this database first")
+	}
+	if _, err := c.ops().ExecContext(ctx, reportingSQL); err != nil {
+		return fmt.Errorf("failed to install reporting views: %w", err)
+	}
+	return nil
+}
+
+// DashboardOptions configures GrafanaDashboard
+type DashboardOptions struct {
+	Title string // Default "Rule Engine Deliveries"
+	UID   string // Default "rule-engine-deliveries"
+
+	// Datasource names selected by default; both can be changed from the
+	// dashboard's variables after import
+	PostgresDatasource   string
+	PrometheusDatasource string
+
+	// PostgresType is the Postgres datasource plugin id. Default
+	// "grafana-postgresql-datasource"; Grafana before 10.3 uses "postgres".
+	PostgresType string
+}
+
+// GrafanaDashboard returns a dashboard definition, ready to import, with
+// panels over the reporting views (see InstallReportingViews) and the
+// worker's Prometheus metrics (/metrics on its admin server)
+func GrafanaDashboard(opts DashboardOptions) ([]byte, error) {
+	if opts.Title == "" {
+		opts.Title = "Rule Engine Deliveries"
+	}
+	if opts.UID == "" {
+		opts.UID = "rule-engine-deliveries"
+	}
+	if opts.PostgresType == "" {
+		opts.PostgresType = "grafana-postgresql-datasource"
+	}
+
+	pg := map[string]string{"type": opts.PostgresType, "uid": "${postgres}"}
+	prom := map[string]string{"type": "prometheus", "uid": "${prometheus}"}
+
+	// Every SQL panel reads the view chosen by $granularity, filtered by
+	// the destination and tenant variables
+	const filter = `FROM rule_report_$granularity
+WHERE $__timeFilter(time) AND destination IN ($destination) AND tenant IN ($tenant)`
+
+	b := &dashboardBuilder{}
+	b.row("Deliveries (PostgreSQL)")
+	b.sqlPanel("timeseries", "Throughput by destination", "short", pg, 12,
+		"SELECT time, destination AS metric, sum(messages) AS messages\n"+filter+"\nGROUP BY 1, 2 ORDER BY 1")
+	b.sqlPanel("timeseries", "Error rate by destination", "percentunit", pg, 12,
+		"SELECT time, destination AS metric,\n  sum(failed)::float / NULLIF(sum(delivered + failed), 0) AS error_rate\n"+filter+"\nGROUP BY 1, 2 ORDER BY 1")
+	b.sqlPanel("timeseries", "p95 latency by destination", "ms", pg, 12,
+		"SELECT time, destination AS metric,\n  rule_histogram_quantile(0.95, rule_histogram_sum(latency_histogram)) AS p95\n"+filter+"\nGROUP BY 1, 2 ORDER BY 1")
+	b.sqlPanel("timeseries", "Latency percentiles", "ms", pg, 12,
+		"SELECT time,\n  rule_histogram_quantile(0.5, rule_histogram_sum(latency_histogram)) AS p50,\n  rule_histogram_quantile(0.95, rule_histogram_sum(latency_histogram)) AS p95,\n  rule_histogram_quantile(0.99, rule_histogram_sum(latency_histogram)) AS p99\n"+filter+"\nGROUP BY 1 ORDER BY 1")
+	b.sqlPanel("timeseries", "Throughput by tenant", "short", pg, 12,
+		"SELECT time, CASE WHEN tenant = '' THEN '(none)' ELSE tenant END AS metric, sum(messages) AS messages\n"+filter+"\nGROUP BY 1, 2 ORDER BY 1")
+	b.sqlPanel("table", "Destinations", "short", pg, 12,
+		"SELECT destination, sum(delivered) AS delivered, sum(failed) AS failed,\n  round(sum(failed)::numeric / NULLIF(sum(delivered + failed), 0), 4) AS error_rate,\n  rule_histogram_quantile(0.95, rule_histogram_sum(latency_histogram)) AS p95_ms\n"+filter+"\nGROUP BY 1 ORDER BY failed DESC, delivered DESC")
+
+	b.row("Workers (Prometheus)")
+	b.promPanel("timeseries", "Messages per second", "ops", prom, 12,
+		`sum by (outcome) (rate(rule_worker_messages_total{outcome!="processed"}[$__rate_interval]))`, "{{outcome}}")
+	b.promPanel("timeseries", "Action p95 duration", "s", prom, 12,
+		`histogram_quantile(0.95, sum by (action, le) (rate(rule_worker_action_duration_seconds_bucket[$__rate_interval])))`, "{{action}}")
+	b.promPanel("timeseries", "Failures per second by tenant", "ops", prom, 12,
+		`sum by (tenant) (rate(rule_worker_tenant_messages_total{outcome="failed"}[$__rate_interval]))`, "{{tenant}}")
+	b.promPanel("timeseries", "Delivery p95 duration by tenant", "s", prom, 12,
+		`histogram_quantile(0.95, sum by (tenant, le) (rate(rule_worker_tenant_delivery_duration_seconds_bucket[$__rate_interval])))`, "{{tenant}}")
+	b.promPanel("timeseries", "Consumer backlog", "short", prom, 12,
+		`sum by (stream, consumer) (rule_worker_consumer_pending)`, "{{consumer}}")
+	b.promPanel("timeseries", "Buffered operational writes", "short", prom, 12,
+		`sum by (consumer) (rule_worker_ops_buffered)`, "{{consumer}}")
+	b.promPanel("stat", "PostgreSQL up", "short", prom, 8,
+		`min by (database) (rule_worker_postgres_up)`, "{{database}}")
+	b.promPanel("stat", "NATS connected workers", "short", prom, 8,
+		`sum(rule_worker_nats_connected)`, "connected")
+	b.promPanel("stat", "Leaders", "short", prom, 8,
+		`sum by (group) (rule_worker_leader)`, "{{group}}")
+
+	dashboard := map[string]interface{}{
+		"title":         opts.Title,
+		"uid":           opts.UID,
+		"tags":          []string{"rule-engine", "nats"},
+		"timezone":      "utc",
+		"schemaVersion": 39,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-24h", "to": "now"},
+		"panels":        b.panels,
+		"templating": map[string]interface{}{
+			"list": []interface{}{
+				datasourceVariable("postgres", "PostgreSQL", opts.PostgresType, opts.PostgresDatasource),
+				datasourceVariable("prometheus", "Prometheus", "prometheus", opts.PrometheusDatasource),
+				map[string]interface{}{
+					"name":    "granularity",
+					"label":   "Granularity",
+					"type":    "custom",
+					"query":   "minute,hourly,daily",
+					"current": map[string]interface{}{"text": "hourly", "value": "hourly"},
+				},
+				queryVariable("destination", "Destination", pg, "SELECT DISTINCT destination FROM rule_report_daily ORDER BY 1"),
+				queryVariable("tenant", "Tenant", pg, "SELECT DISTINCT tenant FROM rule_report_daily ORDER BY 1"),
+			},
+		},
+	}
+	return json.MarshalIndent(dashboard, "", "  ")
+}
+
+// dashboardBuilder lays panels out left to right on Grafana's 24-column grid
+type dashboardBuilder struct {
+	panels []interface{}
+	x, y   int
+}
+
+const dashboardPanelHeight = 8
+
+func (b *dashboardBuilder) place(width int) map[string]int {
+	if b.x+width > 24 {
+		b.x, b.y = 0, b.y+dashboardPanelHeight
+	}
+	pos := map[string]int{"x": b.x, "y": b.y, "w": width, "h": dashboardPanelHeight}
+	b.x += width
+	return pos
+}
+
+func (b *dashboardBuilder) row(title string) {
+	if b.x > 0 {
+		b.x, b.y = 0, b.y+dashboardPanelHeight
+	}
+	b.panels = append(b.panels, map[string]interface{}{
+		"id":        len(b.panels) + 1,
+		"type":      "row",
+		"title":     title,
+		"collapsed": false,
+		"gridPos":   map[string]int{"x": 0, "y": b.y, "w": 24, "h": 1},
+		"panels":    []interface{}{},
+	})
+	b.y++
+}
+
+func (b *dashboardBuilder) panel(kind, title, unit string, datasource interface{}, width int, target map[string]interface{}) {
+	target["refId"] = "A"
+	target["datasource"] = datasource
+	b.panels = append(b.panels, map[string]interface{}{
+		"id":          len(b.panels) + 1,
+		"type":        kind,
+		"title":       title,
+		"datasource":  datasource,
+		"gridPos":     b.place(width),
+		"fieldConfig": map[string]interface{}{"defaults": map[string]interface{}{"unit": unit}, "overrides": []interface{}{}},
+		"targets":     []interface{}{target},
+	})
+}
+
+func (b *dashboardBuilder) sqlPanel(kind, title, unit string, datasource interface{}, width int, query string) {
+	format := "time_series"
+	if kind == "table" {
+		format = "table"
+	}
+	b.panel(kind, title, unit, datasource, width, map[string]interface{}{
+		"rawQuery":   true,
+		"editorMode": "code",
+		"format":     format,
+		"rawSql":     query,
+	})
+}
+
+func (b *dashboardBuilder) promPanel(kind, title, unit string, datasource interface{}, width int, expr, legend string) {
+	b.panel(kind, title, unit, datasource, width, map[string]interface{}{
+		"expr":         expr,
+		"legendFormat": legend,
+	})
+}
+
+func datasourceVariable(name, label, pluginType, current string) map[string]interface{} {
+	v := map[string]interface{}{
+		"name":  name,
+		"label": label,
+		"type":  "datasource",
+		"query": pluginType,
+	}
+	if current != "" {
+		v["current"] = map[string]interface{}{"text": current, "value": current}
+	}
+	return v
+}
+
+func queryVariable(name, label string, datasource interface{}, query string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":       name,
+		"label":      label,
+		"type":       "query",
+		"datasource": datasource,
+		"query":      query,
+		"refresh":    2, // on time range change
+		"multi":      true,
+		"includeAll": true,
+		"current":    map[string]interface{}{"text": "All", "value": "$__all"},
+	}
+}
@@ -0,0 +1,105 @@
+-- Reporting views over the worker's delivery summaries, for Grafana or any
+-- SQL client. Installed into the operational database by
+-- Client.InstallReportingViews (rulectl reporting install) after a worker
+-- has created rule_delivery_stats and rule_histogram_sum there.
+
+-- Estimates a latency quantile in milliseconds from a histogram whose
+-- buckets end at 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, and
+-- 10000 ms, interpolating linearly within the bucket. Latencies beyond the
+-- last bound are reported as 10000.
+CREATE OR REPLACE FUNCTION rule_histogram_quantile(p_quantile DOUBLE PRECISION, p_histogram BIGINT[])
+RETURNS NUMERIC AS $$
+DECLARE
+    v_bounds NUMERIC[] := ARRAY[5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000];
+    v_total NUMERIC;
+    v_rank NUMERIC;
+    v_seen NUMERIC := 0;
+    v_lower NUMERIC := 0;
+    v_count NUMERIC;
+BEGIN
+    SELECT sum(x) INTO v_total FROM unnest(p_histogram) AS x;
+    IF v_total IS NULL OR v_total = 0 THEN
+        RETURN NULL;
+    END IF;
+    v_rank := p_quantile * v_total;
+
+    FOR i IN 1 .. array_length(p_histogram, 1) LOOP
+        v_count := COALESCE(p_histogram[i], 0);
+        IF v_count > 0 AND v_seen + v_count >= v_rank THEN
+            IF i > array_length(v_bounds, 1) THEN
+                RETURN v_lower;
+            END IF;
+            RETURN round(v_lower + (v_bounds[i] - v_lower) * (v_rank - v_seen) / v_count, 1);
+        END IF;
+        v_seen := v_seen + v_count;
+        IF i <= array_length(v_bounds, 1) THEN
+            v_lower := v_bounds[i];
+        END IF;
+    END LOOP;
+    RETURN v_lower;
+END;
+$$ LANGUAGE plpgsql IMMUTABLE;
+
+-- One row per period, destination, and tenant across all consumers.
+-- latency_histogram is kept so queries that combine rows can compute
+-- their own percentiles with rule_histogram_sum.
+CREATE OR REPLACE VIEW rule_report_minute AS
+SELECT bucket_start AS time,
+       destination,
+       tenant,
+       sum(delivered + failed + expired + duplicates) AS messages,
+       sum(delivered) AS delivered,
+       sum(failed) AS failed,
+       sum(expired) AS expired,
+       sum(duplicates) AS duplicates,
+       round(sum(failed)::NUMERIC / NULLIF(sum(delivered + failed), 0), 4) AS error_rate,
+       round(sum(total_time_ms)::NUMERIC / NULLIF(sum(delivered), 0), 1) AS avg_ms,
+       max(max_time_ms) AS max_ms,
+       rule_histogram_quantile(0.5, rule_histogram_sum(latency_histogram)) AS p50_ms,
+       rule_histogram_quantile(0.95, rule_histogram_sum(latency_histogram)) AS p95_ms,
+       rule_histogram_quantile(0.99, rule_histogram_sum(latency_histogram)) AS p99_ms,
+       rule_histogram_sum(latency_histogram) AS latency_histogram
+FROM rule_delivery_stats
+GROUP BY bucket_start, destination, tenant;
+
+CREATE OR REPLACE VIEW rule_report_hourly AS
+SELECT period_start AS time,
+       destination,
+       tenant,
+       sum(delivered + failed + expired + duplicates) AS messages,
+       sum(delivered) AS delivered,
+       sum(failed) AS failed,
+       sum(expired) AS expired,
+       sum(duplicates) AS duplicates,
+       round(sum(failed)::NUMERIC / NULLIF(sum(delivered + failed), 0), 4) AS error_rate,
+       round(sum(total_time_ms)::NUMERIC / NULLIF(sum(delivered), 0), 1) AS avg_ms,
+       max(max_time_ms) AS max_ms,
+       rule_histogram_quantile(0.5, rule_histogram_sum(latency_histogram)) AS p50_ms,
+       rule_histogram_quantile(0.95, rule_histogram_sum(latency_histogram)) AS p95_ms,
+       rule_histogram_quantile(0.99, rule_histogram_sum(latency_histogram)) AS p99_ms,
+       rule_histogram_sum(latency_histogram) AS latency_histogram
+FROM rule_delivery_stats_hourly
+GROUP BY period_start, destination, tenant;
+
+CREATE OR REPLACE VIEW rule_report_daily AS
+SELECT period_start AS time,
+       destination,
+       tenant,
+       sum(delivered + failed + expired + duplicates) AS messages,
+       sum(delivered) AS delivered,
+       sum(failed) AS failed,
+       sum(expired) AS expired,
+       sum(duplicates) AS duplicates,
+       round(sum(failed)::NUMERIC / NULLIF(sum(delivered + failed), 0), 4) AS error_rate,
+       round(sum(total_time_ms)::NUMERIC / NULLIF(sum(delivered), 0), 1) AS avg_ms,
+       max(max_time_ms) AS max_ms,
+       rule_histogram_quantile(0.5, rule_histogram_sum(latency_histogram)) AS p50_ms,
+       rule_histogram_quantile(0.95, rule_histogram_sum(latency_histogram)) AS p95_ms,
+       rule_histogram_quantile(0.99, rule_histogram_sum(latency_histogram)) AS p99_ms,
+       rule_histogram_sum(latency_histogram) AS latency_histogram
+FROM rule_delivery_stats_daily
+GROUP BY period_start, destination, tenant;
+
+COMMENT ON VIEW rule_report_minute IS 'Delivery throughput, error rate, and latency per minute; raw data is kept for STATS_RAW_RETENTION_DAYS';
+COMMENT ON VIEW rule_report_hourly IS 'Delivery throughput, error rate, and latency per hour';
+COMMENT ON VIEW rule_report_daily IS 'Delivery throughput, error rate, and latency per UTC day';
@@ -0,0 +1,179 @@
+package ruleengine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestInstallReportingViews(t *testing.T) {
+	tests := []struct {
+		name    string
+		ready   bool
+		execErr error
+		wantErr string
+	}{
+		{name: "installed", ready: true},
+		{name: "no worker tables", ready: false, wantErr: "start a worker against this database first"},
+		{name: "view error", ready: true, execErr: errors.New("permission denied for schema public"), wantErr: "permission denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			opsPool, ops, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer opsPool.Close()
+			client.SetOpsDB(opsPool)
+
+			// Everything goes to the operational database
+			ops.ExpectQuery(`to_regclass\('rule_delivery_stats_daily'\)`).
+				WillReturnRows(sqlmock.NewRows([]string{"ready"}).AddRow(tt.ready))
+			if tt.ready {
+				exec := ops.ExpectExec("CREATE OR REPLACE VIEW rule_report_minute")
+				if tt.execErr != nil {
+					exec.WillReturnError(tt.execErr)
+				} else {
+					exec.WillReturnResult(sqlmock.NewResult(0, 0))
+				}
+			}
+
+			err = client.InstallReportingViews(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if err := ops.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+type dashboardPanel struct {
+	ID         int               `json:"id"`
+	Type       string            `json:"type"`
+	Title      string            `json:"title"`
+	GridPos    map[string]int    `json:"gridPos"`
+	Datasource map[string]string `json:"datasource"`
+	Targets    []struct {
+		RawSQL string `json:"rawSql"`
+		Expr   string `json:"expr"`
+	} `json:"targets"`
+}
+
+type dashboard struct {
+	Title      string           `json:"title"`
+	UID        string           `json:"uid"`
+	Panels     []dashboardPanel `json:"panels"`
+	Templating struct {
+		List []map[string]interface{} `json:"list"`
+	} `json:"templating"`
+}
+
+func TestGrafanaDashboard(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         DashboardOptions
+		wantTitle    string
+		wantUID      string
+		wantPGType   string
+		wantPGSource string
+	}{
+		{name: "defaults", wantTitle: "Rule Engine Deliveries", wantUID: "rule-engine-deliveries", wantPGType: "grafana-postgresql-datasource"},
+		{name: "options", opts: DashboardOptions{Title: "Ops", UID: "ops", PostgresType: "postgres", PostgresDatasource: "ops-db"},
+			wantTitle: "Ops", wantUID: "ops", wantPGType: "postgres", wantPGSource: "ops-db"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := GrafanaDashboard(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var d dashboard
+			if err := json.Unmarshal(raw, &d); err != nil {
+				t.Fatal(err)
+			}
+			if d.Title != tt.wantTitle || d.UID != tt.wantUID {
+				t.Fatalf("title %q uid %q", d.Title, d.UID)
+			}
+
+			variables := map[string]map[string]interface{}{}
+			for _, v := range d.Templating.List {
+				variables[v["name"].(string)] = v
+			}
+			for _, name := range []string{"postgres", "prometheus", "granularity", "destination", "tenant"} {
+				if variables[name] == nil {
+					t.Errorf("variable %s missing", name)
+				}
+			}
+			if variables["postgres"]["query"] != tt.wantPGType {
+				t.Errorf("postgres variable = %v", variables["postgres"])
+			}
+			current, _ := variables["postgres"]["current"].(map[string]interface{})
+			if tt.wantPGSource == "" && current != nil || tt.wantPGSource != "" && (current == nil || current["value"] != tt.wantPGSource) {
+				t.Errorf("postgres current = %v", current)
+			}
+
+			checkDashboardLayout(t, d.Panels, tt.wantPGType)
+		})
+	}
+}
+
+// checkDashboardLayout checks that panels have unique ids, sit on the
+// 24-column grid without overlapping, and query the right datasource
+func checkDashboardLayout(t *testing.T, panels []dashboardPanel, pgType string) {
+	t.Helper()
+	ids := map[int]bool{}
+	type cell struct{ x, y int }
+	used := map[cell]string{}
+	for _, p := range panels {
+		if ids[p.ID] {
+			t.Errorf("duplicate panel id %d", p.ID)
+		}
+		ids[p.ID] = true
+		pos := p.GridPos
+		if pos["x"] < 0 || pos["w"] <= 0 || pos["x"]+pos["w"] > 24 {
+			t.Errorf("panel %q is off the grid: %v", p.Title, pos)
+		}
+		for x := pos["x"]; x < pos["x"]+pos["w"]; x++ {
+			for y := pos["y"]; y < pos["y"]+pos["h"]; y++ {
+				if other, ok := used[cell{x, y}]; ok {
+					t.Fatalf("panel %q overlaps %q at %d,%d", p.Title, other, x, y)
+				}
+				used[cell{x, y}] = p.Title
+			}
+		}
+		if p.Type == "row" {
+			continue
+		}
+		if len(p.Targets) != 1 {
+			t.Errorf("panel %q has %d targets", p.Title, len(p.Targets))
+			continue
+		}
+		target := p.Targets[0]
+		switch {
+		case target.RawSQL != "":
+			if p.Datasource["type"] != pgType || !strings.Contains(target.RawSQL, "FROM rule_report_$granularity") {
+				t.Errorf("SQL panel %q: datasource %v, query %s", p.Title, p.Datasource, target.RawSQL)
+			}
+		case target.Expr != "":
+			if p.Datasource["type"] != "prometheus" || !strings.Contains(target.Expr, "rule_worker_") {
+				t.Errorf("Prometheus panel %q: datasource %v, expr %s", p.Title, p.Datasource, target.Expr)
+			}
+		default:
+			t.Errorf("panel %q has no query", p.Title)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//go:embed responsefacts.sql
+var responseFactsSQL string
+
+// ErrResponseFactsNotFound is returned when nothing is stored for a key
+var ErrResponseFactsNotFound = errors.New("response facts not found")
+
+// ResponseMapping makes the NATS webhook worker extract facts from a
+// webhook destination's successful JSON responses, e.g. the score a
+// scoring API returns. Evaluations on a client with EnableResponseFacts
+// see the latest values for the facts' key as Responses.<Name>.<field>.
+type ResponseMapping struct {
+	// Name is a plain identifier, used in rules as Responses.<Name>.
+	// Destinations may share one.
+	Name string `json:"name"`
+
+	// KeyPath is the dotted path of the key in the delivered message's
+	// data, e.g. customer_id; FactKeyPath is the same key in fact
+	// documents, e.g. Order.customer_id (default KeyPath)
+	KeyPath     string `json:"key_path"`
+	FactKeyPath string `json:"fact_key_path"`
+
+	// Fields maps fact fields to PostgreSQL JSONPath expressions into the
+	// response body, e.g. {"score": "$.result.score"}. A path that selects
+	// nothing leaves the field's earlier value.
+	Fields map[string]string `json:"fields"`
+}
+
+// ResponseFacts are the facts stored for one mapping name and key
+type ResponseFacts struct {
+	Name      string                 `json:"name"`
+	Key       string                 `json:"key"`
+	Facts     map[string]interface{} `json:"facts"`
+	TraceID   string                 `json:"trace_id,omitempty"` // of the message whose response last set them
+	UpdatedAt time.Time              `json:"updated_at"`
+}
+
+// EnableResponseFacts creates the response facts table and functions if
+// needed and makes Evaluate add stored response facts to facts, at the
+// cost of one query per evaluation.
+func (c *Client) EnableResponseFacts(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, responseFactsSQL); err != nil {
+		return fmt.Errorf("failed to install response facts: %w", err)
+	}
+	c.responseFacts = true
+	return nil
+}
+
+// SetResponseMapping sets the facts extracted from a webhook's responses;
+// nil stops extracting them. Facts already stored are kept. Call
+// EnableResponseFacts first.
+func (c *Client) SetResponseMapping(ctx context.Context, webhookID int, m *ResponseMapping) error {
+	var mapping interface{} // NULL, not an empty []byte, which isn't JSON
+	if m != nil {
+		if !identifierPattern.MatchString(m.Name) {
+			return &ValidationError{Field: "name", Message: "must be a plain identifier"}
+		}
+		if m.FactKeyPath == "" {
+			m.FactKeyPath = m.KeyPath
+		}
+		// key_path first: fact_key_path defaults to it, and the error should
+		// name the path that was given
+		for _, p := range []struct{ field, path string }{{"key_path", m.KeyPath}, {"fact_key_path", m.FactKeyPath}} {
+			if !jsonPathPattern.MatchString(p.path) {
+				return &ValidationError{Field: p.field, Message: "must be a dotted path like customer_id or Order.customer_id"}
+			}
+		}
+		if len(m.Fields) == 0 {
+			return &ValidationError{Field: "fields", Message: "must map at least one fact field to a JSONPath"}
+		}
+		for field, path := range m.Fields {
+			if !identifierPattern.MatchString(field) {
+				return &ValidationError{Field: "fields", Message: fmt.Sprintf("%q is not a plain identifier", field)}
+			}
+			if _, err := c.db.ExecContext(ctx, "SELECT $1::jsonpath", path); err != nil {
+				return &ValidationError{Field: "fields", Message: fmt.Sprintf("%s: invalid JSONPath %q", field, path)}
+			}
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		mapping = b
+	}
+	res, err := c.db.ExecContext(ctx,
+		`UPDATE rule_webhooks SET response_mapping = $2 WHERE webhook_id = $1`, webhookID, mapping,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%d: %w", webhookID, ErrWebhookNotFound)
+	}
+	return nil
+}
+
+// RecordResponseFacts stores the fields of m that response, a JSON body,
+// has under m's name and key, and returns how many that was. The NATS
+// webhook worker records each successful response of a mapped webhook
+// this way, with the trace ID of the message it delivered.
+func (c *Client) RecordResponseFacts(ctx context.Context, m ResponseMapping, key string, response []byte, traceID string) (int, error) {
+	fields, err := json.Marshal(m.Fields)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = c.db.QueryRowContext(ctx,
+		"SELECT rule_response_facts_record($1, $2, $3, $4, NULLIF($5, ''))", m.Name, key, fields, response, traceID,
+	).Scan(&n)
+	return n, err
+}
+
+// GetResponseFacts returns the facts stored for a mapping name and key
+func (c *Client) GetResponseFacts(ctx context.Context, name, key string) (*ResponseFacts, error) {
+	f := ResponseFacts{Name: name, Key: key}
+	var facts []byte
+	var traceID sql.NullString
+	err := c.db.QueryRowContext(ctx,
+		"SELECT facts, trace_id, updated_at FROM rule_response_facts WHERE name = $1 AND key = $2", name, key,
+	).Scan(&facts, &traceID, &f.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s/%s: %w", name, key, ErrResponseFactsNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(facts, &f.Facts); err != nil {
+		return nil, err
+	}
+	f.TraceID = traceID.String
+	return &f, nil
+}
+
+// responseFactsAdd adds Responses.<name> facts to a JSON fact document
+func (c *Client) responseFactsAdd(ctx context.Context, factsJSON []byte) ([]byte, error) {
+	var out []byte
+	if err := c.db.QueryRowContext(ctx, "SELECT rule_response_facts_add($1)", factsJSON).Scan(&out); err != nil {
+		return nil, fmt.Errorf("failed to add response facts: %w", err)
+	}
+	return out, nil
+}
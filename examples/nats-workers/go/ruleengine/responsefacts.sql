@@ -0,0 +1,74 @@
+-- Facts extracted from webhook responses (see EnableResponseFacts). A
+-- destination's response_mapping names JSONPath expressions into its
+-- response body; the NATS webhook worker stores their values per key with
+-- rule_response_facts_record, and rule_response_facts_add puts them in
+-- fact documents as Responses.<name>, so rules can use e.g. a score a
+-- scoring API returned for the same customer.
+
+-- The worker's schema.sql adds it too, with its comment
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS response_mapping JSONB;
+
+CREATE TABLE IF NOT EXISTS rule_response_facts (
+    name TEXT NOT NULL,
+    key TEXT NOT NULL,
+    facts JSONB NOT NULL,
+    trace_id TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (name, key)
+);
+
+-- Stores the values that p_fields (fact field -> JSONPath) select from
+-- p_response under p_name and p_key, keeping earlier fields this response
+-- lacks. Returns the number of fields stored.
+CREATE OR REPLACE FUNCTION rule_response_facts_record(p_name TEXT, p_key TEXT, p_fields JSONB, p_response JSONB,
+                                                      p_trace_id TEXT DEFAULT NULL)
+RETURNS INTEGER AS $$
+DECLARE
+    v_facts JSONB;
+BEGIN
+    SELECT jsonb_object_agg(f.key, v.value) INTO v_facts
+    FROM jsonb_each_text(p_fields) f
+    CROSS JOIN LATERAL (SELECT jsonb_path_query_first(p_response, f.value::jsonpath) AS value) v
+    WHERE v.value IS NOT NULL;
+    IF v_facts IS NULL THEN
+        RETURN 0;
+    END IF;
+    INSERT INTO rule_response_facts AS r (name, key, facts, trace_id)
+    VALUES (p_name, p_key, v_facts, p_trace_id)
+    ON CONFLICT (name, key) DO UPDATE SET
+        facts = r.facts || EXCLUDED.facts,
+        trace_id = EXCLUDED.trace_id,
+        updated_at = CURRENT_TIMESTAMP;
+    RETURN (SELECT count(*) FROM jsonb_object_keys(v_facts));
+END;
+$$ LANGUAGE plpgsql;
+
+-- Adds Responses.<name> to p_facts for every response mapping whose fact
+-- key is present and has stored facts, e.g. {"Order": {"customer_id":
+-- "c1"}} becomes {"Order": ..., "Responses": {"scoring": {"score": 0.92}}}
+CREATE OR REPLACE FUNCTION rule_response_facts_add(p_facts JSONB)
+RETURNS JSONB AS $$
+DECLARE
+    m RECORD;
+    v_key TEXT;
+    v_stored JSONB;
+    v_responses JSONB := '{}';
+BEGIN
+    FOR m IN SELECT DISTINCT response_mapping ->> 'name' AS name, response_mapping ->> 'fact_key_path' AS fact_key_path
+             FROM rule_webhooks WHERE response_mapping IS NOT NULL LOOP
+        v_key := p_facts #>> string_to_array(m.fact_key_path, '.');
+        CONTINUE WHEN v_key IS NULL;
+        SELECT facts INTO v_stored FROM rule_response_facts WHERE name = m.name AND key = v_key;
+        IF FOUND THEN
+            v_responses := v_responses || jsonb_build_object(m.name, COALESCE(v_responses -> m.name, '{}') || v_stored);
+        END IF;
+    END LOOP;
+    IF v_responses = '{}' THEN
+        RETURN p_facts;
+    END IF;
+    RETURN p_facts || jsonb_build_object('Responses', COALESCE(p_facts -> 'Responses', '{}') || v_responses);
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+COMMENT ON TABLE rule_response_facts IS 'Latest facts extracted from webhook responses, per response mapping name and key';
+COMMENT ON FUNCTION rule_response_facts_add IS 'Adds Responses.<name> facts stored from webhook responses to a fact document';
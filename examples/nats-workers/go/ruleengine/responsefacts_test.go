@@ -0,0 +1,140 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSetResponseMapping(t *testing.T) {
+	const update = `UPDATE rule_webhooks SET response_mapping = \$2 WHERE webhook_id = \$1`
+	valid := func() *ResponseMapping {
+		return &ResponseMapping{Name: "Scoring", KeyPath: "customer_id", Fields: map[string]string{"score": "$.result.score"}}
+	}
+	tests := []struct {
+		name      string
+		mapping   *ResponseMapping
+		expect    func(mock sqlmock.Sqlmock)
+		wantField string // of the ValidationError
+		wantErr   error
+	}{
+		{name: "set", mapping: valid(),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`SELECT \$1::jsonpath`).WithArgs("$.result.score").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(update).WithArgs(3,
+					[]byte(`{"name":"Scoring","key_path":"customer_id","fact_key_path":"customer_id","fields":{"score":"$.result.score"}}`)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}},
+		{name: "clear",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(update).WithArgs(3, nil).WillReturnResult(sqlmock.NewResult(0, 1))
+			}},
+		{name: "unknown webhook",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(update).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			wantErr: ErrWebhookNotFound},
+		{name: "bad name", mapping: &ResponseMapping{Name: "my scoring", KeyPath: "customer_id", Fields: map[string]string{"score": "$.score"}},
+			wantField: "name"},
+		{name: "bad key path", mapping: &ResponseMapping{Name: "Scoring", KeyPath: "customer id", Fields: map[string]string{"score": "$.score"}},
+			wantField: "key_path"},
+		{name: "bad fact key path", mapping: &ResponseMapping{Name: "Scoring", KeyPath: "customer_id", FactKeyPath: "Order..id", Fields: map[string]string{"score": "$.score"}},
+			wantField: "fact_key_path"},
+		{name: "no fields", mapping: &ResponseMapping{Name: "Scoring", KeyPath: "customer_id"},
+			wantField: "fields"},
+		{name: "bad field name", mapping: &ResponseMapping{Name: "Scoring", KeyPath: "customer_id", Fields: map[string]string{"risk-score": "$.score"}},
+			wantField: "fields"},
+		{name: "bad JSONPath", mapping: &ResponseMapping{Name: "Scoring", KeyPath: "customer_id", Fields: map[string]string{"score": "$.[["}},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`SELECT \$1::jsonpath`).WillReturnError(errors.New("syntax error at or near \"[\" of jsonpath input"))
+			},
+			wantField: "fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+			err := client.SetResponseMapping(context.Background(), 3, tt.mapping)
+			var verr *ValidationError
+			switch {
+			case tt.wantField != "":
+				if !errors.As(err, &verr) || verr.Field != tt.wantField {
+					t.Fatalf("err = %v, want an invalid %s", err, tt.wantField)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestGetResponseFacts(t *testing.T) {
+	const query = `SELECT facts, trace_id, updated_at FROM rule_response_facts WHERE name = \$1 AND key = \$2`
+	updated := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	columns := []string{"facts", "trace_id", "updated_at"}
+
+	client, mock := newMock(t)
+	mock.ExpectQuery(query).WithArgs("Scoring", "c-42").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow([]byte(`{"score":0.9}`), "t-1", updated))
+	f, err := client.GetResponseFacts(context.Background(), "Scoring", "c-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "Scoring" || f.Key != "c-42" || f.Facts["score"] != 0.9 || f.TraceID != "t-1" || !f.UpdatedAt.Equal(updated) {
+		t.Fatalf("facts = %+v", f)
+	}
+
+	mock.ExpectQuery(query).WithArgs("Scoring", "c-43").WillReturnRows(sqlmock.NewRows(columns))
+	if _, err := client.GetResponseFacts(context.Background(), "Scoring", "c-43"); !errors.Is(err, ErrResponseFactsNotFound) {
+		t.Fatalf("err = %v, want ErrResponseFactsNotFound", err)
+	}
+}
+
+func TestEvaluateWithResponseFacts(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectExec(regexp.QuoteMeta(responseFactsSQL)).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := client.EnableResponseFacts(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(`SELECT rule_response_facts_add\(\$1\)`).WithArgs([]byte(`{"Order":{"customer_id":"c-42"}}`)).
+		WillReturnRows(sqlmock.NewRows([]string{"facts"}).
+			AddRow([]byte(`{"Order":{"customer_id":"c-42"},"Responses":{"Scoring":{"score":0.9}}}`)))
+	mock.ExpectQuery(`SELECT is_active FROM rule_sets`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(true))
+	mock.ExpectQuery(`ruleset_get_rules`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_name", "rule_version"}).AddRow("Risky", "1.0.0"))
+	mock.ExpectQuery(`rule_get`).WithArgs("Risky", "1.0.0").
+		WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(`rule Risky "" { when Responses.Scoring.score > 0.8 then Order.review = true; }`))
+	expectDebugRun(mock, "s1", `{"Order":{"customer_id":"c-42","review":true},"Responses":{"Scoring":{"score":0.9}}}`, "Risky")
+
+	result, err := client.Evaluate(context.Background(), 7, map[string]interface{}{"Order": map[string]interface{}{"customer_id": "c-42"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.MatchedRules) != 1 || result.MatchedRules[0] != "Risky" {
+		t.Fatalf("matched rules = %v", result.MatchedRules)
+	}
+
+	// A failed lookup fails the evaluation rather than silently dropping facts
+	mock.ExpectQuery(`SELECT rule_response_facts_add`).WillReturnError(errors.New("connection refused"))
+	if _, err := client.Evaluate(context.Background(), 7, map[string]interface{}{}); err == nil {
+		t.Fatal("evaluation succeeded without its response facts")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,166 @@
+package ruleengine
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ResultStore holds encoded evaluation results for the result cache. The
+// built-in store is an in-memory LRU; implement ResultStore to share
+// results between processes, e.g. in Redis. Keys embed the rule set's
+// content, so a shared store never serves results of changed rules.
+type ResultStore interface {
+	// Get returns the value stored under key; failures count as misses
+	Get(ctx context.Context, key string) ([]byte, bool)
+
+	// Set stores value under key for ttl (0 means no expiry)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration)
+}
+
+// ResultCacheStats counts result cache lookups since EnableCache
+type ResultCacheStats struct {
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+
+	// Entries is the number of cached results (built-in store only)
+	Entries int `json:"entries"`
+}
+
+// resultCache caches whole evaluation results, keyed by a fingerprint of
+// the rule set's members and their GRL and a hash of the facts
+type resultCache struct {
+	store ResultStore
+	ttl   time.Duration
+	key   func(facts []byte) ([]byte, bool)
+
+	hits, misses atomic.Uint64
+}
+
+func newResultCache(opts CacheOptions) *resultCache {
+	rc := &resultCache{store: opts.ResultStore, ttl: opts.ResultTTL, key: opts.ResultKey}
+	if rc.store == nil {
+		rc.store = newLRUStore(opts.ResultCacheSize)
+	}
+	if rc.key == nil {
+		rc.key = func(facts []byte) ([]byte, bool) { return facts, true }
+	}
+	return rc
+}
+
+// lookupKey returns the key for evaluating rulesetID against factsJSON,
+// or false when the rule set's members or GRL are not cached yet (they are
+// after its first evaluation) or ResultKey declined the facts
+func (rc *resultCache) lookupKey(rules *ruleCache, rulesetID int, factsJSON []byte) (string, bool) {
+	fingerprint, ok := rules.fingerprint(rulesetID)
+	if !ok {
+		return "", false
+	}
+	material, ok := rc.key(factsJSON)
+	if !ok {
+		return "", false
+	}
+	facts := sha256.Sum256(material)
+	return fmt.Sprintf("ruleengine:result:%d:%s:%s", rulesetID, fingerprint, hex.EncodeToString(facts[:])), true
+}
+
+func (rc *resultCache) get(ctx context.Context, key string) (*Result, bool) {
+	data, ok := rc.store.Get(ctx, key)
+	var result Result
+	if ok && json.Unmarshal(data, &result) == nil {
+		rc.hits.Add(1)
+		return &result, true
+	}
+	rc.misses.Add(1)
+	return nil, false
+}
+
+func (rc *resultCache) set(ctx context.Context, key string, result *Result) {
+	if data, err := json.Marshal(result); err == nil {
+		rc.store.Set(ctx, key, data, rc.ttl)
+	}
+}
+
+// ResultCacheStats reports the result cache's hit rate. It is zero unless
+// EnableCache was called with ResultCacheSize or ResultStore.
+func (c *Client) ResultCacheStats() ResultCacheStats {
+	if c.results == nil {
+		return ResultCacheStats{}
+	}
+	s := ResultCacheStats{Hits: c.results.hits.Load(), Misses: c.results.misses.Load()}
+	if total := s.Hits + s.Misses; total > 0 {
+		s.HitRate = float64(s.Hits) / float64(total)
+	}
+	if lru, ok := c.results.store.(*lruStore); ok {
+		s.Entries = lru.len()
+	}
+	return s
+}
+
+// lruStore is the built-in ResultStore
+type lruStore struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time // zero means never
+}
+
+func newLRUStore(size int) *lruStore {
+	return &lruStore{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (s *lruStore) Get(_ context.Context, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		s.order.Remove(el)
+		delete(s.entries, key)
+		return nil, false
+	}
+	s.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (s *lruStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) {
+	entry := &lruEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok {
+		el.Value = entry
+		s.order.MoveToFront(el)
+		return
+	}
+	s.entries[key] = s.order.PushFront(entry)
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (s *lruStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
@@ -0,0 +1,286 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLRUStore(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		run  func(s *lruStore)
+		want map[string]string // key -> value, "" for absent
+	}{
+		{
+			name: "evicts the least recently set",
+			run: func(s *lruStore) {
+				s.Set(ctx, "a", []byte("1"), 0)
+				s.Set(ctx, "b", []byte("2"), 0)
+				s.Set(ctx, "c", []byte("3"), 0)
+			},
+			want: map[string]string{"a": "", "b": "2", "c": "3"},
+		},
+		{
+			name: "get refreshes recency",
+			run: func(s *lruStore) {
+				s.Set(ctx, "a", []byte("1"), 0)
+				s.Set(ctx, "b", []byte("2"), 0)
+				s.Get(ctx, "a")
+				s.Set(ctx, "c", []byte("3"), 0)
+			},
+			want: map[string]string{"a": "1", "b": "", "c": "3"},
+		},
+		{
+			name: "overwrite keeps one entry",
+			run: func(s *lruStore) {
+				s.Set(ctx, "a", []byte("1"), 0)
+				s.Set(ctx, "b", []byte("2"), 0)
+				s.Set(ctx, "a", []byte("9"), 0)
+				s.Set(ctx, "c", []byte("3"), 0)
+			},
+			want: map[string]string{"a": "9", "b": "", "c": "3"},
+		},
+		{
+			name: "expired entries are dropped",
+			run: func(s *lruStore) {
+				s.Set(ctx, "a", []byte("1"), time.Nanosecond)
+				s.Set(ctx, "b", []byte("2"), time.Hour)
+				time.Sleep(time.Millisecond)
+			},
+			want: map[string]string{"a": "", "b": "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newLRUStore(2)
+			tt.run(s)
+			for key, want := range tt.want {
+				got, ok := s.Get(ctx, key)
+				if ok != (want != "") || string(got) != want {
+					t.Errorf("Get(%q) = %q, %v; want %q", key, got, ok, want)
+				}
+			}
+			if s.len() > 2 {
+				t.Errorf("len = %d", s.len())
+			}
+		})
+	}
+}
+
+// cachedRuleSet returns a rule cache holding rule set 7 with members A and
+// B@1.0.0
+func cachedRuleSet(grlA string) *ruleCache {
+	rc := &ruleCache{rulesets: map[int][]ruleSetMember{}, rules: map[ruleKey]cachedRule{}}
+	rc.storeMembers(0, 7, []ruleSetMember{
+		{name: "A"},
+		{name: "B", version: sql.NullString{String: "1.0.0", Valid: true}},
+	})
+	rc.storeRule(0, ruleKey{"A", ""}, grlA)
+	rc.storeRule(0, ruleKey{"B", "1.0.0"}, `rule B "" { when true then Retract("B"); }`)
+	return rc
+}
+
+func TestResultCacheLookupKey(t *testing.T) {
+	facts := []byte(`{"Order":{"total":5,"at":"10:00"}}`)
+	base, _ := newResultCache(CacheOptions{ResultCacheSize: 1}).lookupKey(cachedRuleSet("A1"), 7, facts)
+	if !strings.HasPrefix(base, "ruleengine:result:7:") {
+		t.Fatalf("key = %q", base)
+	}
+
+	// Ignores the timestamp; declines documents without an order
+	orderOnly := func(f []byte) ([]byte, bool) {
+		i := strings.Index(string(f), `,"at"`)
+		if i < 0 {
+			return nil, false
+		}
+		return f[:i], true
+	}
+
+	tests := []struct {
+		name     string
+		opts     CacheOptions
+		rules    func() *ruleCache
+		id       int
+		facts    string
+		wantOK   bool
+		wantSame bool
+	}{
+		{name: "same input", rules: func() *ruleCache { return cachedRuleSet("A1") }, id: 7,
+			facts: string(facts), wantOK: true, wantSame: true},
+		{name: "other facts", rules: func() *ruleCache { return cachedRuleSet("A1") }, id: 7,
+			facts: `{"Order":{"total":6,"at":"10:00"}}`, wantOK: true},
+		{name: "other GRL", rules: func() *ruleCache { return cachedRuleSet("A2") }, id: 7,
+			facts: string(facts), wantOK: true},
+		{name: "other member version", rules: func() *ruleCache {
+			rc := cachedRuleSet("A1")
+			rc.storeMembers(0, 7, []ruleSetMember{{name: "A"}, {name: "B", version: sql.NullString{String: "2.0.0", Valid: true}}})
+			rc.storeRule(0, ruleKey{"B", "2.0.0"}, `rule B "" { when true then Retract("B"); }`)
+			return rc
+		}, id: 7, facts: string(facts), wantOK: true},
+		{name: "members not cached", rules: func() *ruleCache { return cachedRuleSet("A1") }, id: 8,
+			facts: string(facts)},
+		{name: "GRL not cached", rules: func() *ruleCache {
+			rc := cachedRuleSet("A1")
+			rc.invalidate("rule:B")
+			return rc
+		}, id: 7, facts: string(facts)},
+		{name: "ResultKey ignores a field", opts: CacheOptions{ResultKey: orderOnly},
+			rules: func() *ruleCache { return cachedRuleSet("A1") }, id: 7,
+			facts: `{"Order":{"total":5,"at":"11:00"}}`, wantOK: true},
+		{name: "ResultKey declines", opts: CacheOptions{ResultKey: orderOnly},
+			rules: func() *ruleCache { return cachedRuleSet("A1") }, id: 7, facts: `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := newResultCache(tt.opts)
+			key, ok := rc.lookupKey(tt.rules(), tt.id, []byte(tt.facts))
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			want := base
+			if tt.opts.ResultKey != nil {
+				// Same key for both timestamps
+				want, _ = rc.lookupKey(tt.rules(), tt.id, facts)
+				tt.wantSame = true
+			}
+			if same := key == want; same != tt.wantSame {
+				t.Fatalf("key %q vs %q: same = %v", key, want, same)
+			}
+		})
+	}
+}
+
+func TestResultCacheStats(t *testing.T) {
+	client, _ := newMock(t)
+	if s := client.ResultCacheStats(); s != (ResultCacheStats{}) {
+		t.Fatalf("stats without a result cache = %+v", s)
+	}
+
+	ctx := context.Background()
+	client.results = newResultCache(CacheOptions{ResultCacheSize: 10})
+	client.results.set(ctx, "k", &Result{MatchedRules: []string{"A"}})
+	client.results.store.Set(ctx, "broken", []byte("{"), 0)
+	for _, key := range []string{"k", "k", "k", "missing", "broken"} {
+		client.results.get(ctx, key)
+	}
+	want := ResultCacheStats{Hits: 3, Misses: 2, HitRate: 0.6, Entries: 2}
+	if s := client.ResultCacheStats(); s != want {
+		t.Fatalf("stats = %+v, want %+v", s, want)
+	}
+}
+
+// hookStore runs onGet before each lookup
+type hookStore struct {
+	*lruStore
+	onGet func()
+}
+
+func (s *hookStore) Get(ctx context.Context, key string) ([]byte, bool) {
+	s.onGet()
+	return s.lruStore.Get(ctx, key)
+}
+
+func expectMembers(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT is_active FROM rule_sets`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(true))
+	mock.ExpectQuery(`ruleset_get_rules`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_name", "rule_version"}).AddRow("A", nil))
+	mock.ExpectQuery(`rule_get`).WithArgs("A", nil).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(`rule A "" { when Order.total > 1 then Order.flagged = true; }`))
+}
+
+func TestEvaluateResultCache(t *testing.T) {
+	ctx := context.Background()
+	facts := map[string]interface{}{"Order": map[string]interface{}{"total": 5}}
+
+	t.Run("second evaluation is served from the cache", func(t *testing.T) {
+		client, mock := newMock(t)
+		client.cache = &ruleCache{rulesets: map[int][]ruleSetMember{}, rules: map[ruleKey]cachedRule{}}
+		client.results = newResultCache(CacheOptions{ResultCacheSize: 10})
+		expectMembers(mock)
+		expectDebugRun(mock, "s1", `{"Order":{"total":5,"flagged":true}}`, "A")
+
+		first, err := client.Evaluate(ctx, 7, facts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// No further queries are expected
+		second, err := client.Evaluate(ctx, 7, facts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+		if len(second.MatchedRules) != 1 || second.MatchedRules[0] != "A" || second.Facts["Order"] == nil ||
+			len(first.Actions) != len(second.Actions) {
+			t.Fatalf("cached result = %+v", second)
+		}
+		if s := client.ResultCacheStats(); s.Hits != 1 || s.Misses != 0 || s.Entries != 1 {
+			t.Fatalf("stats = %+v", s)
+		}
+
+		// Changing the rule changes the key
+		client.cache.invalidate("rule:A")
+		mock.ExpectQuery(`rule_get`).WithArgs("A", nil).
+			WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(`rule A "" { when Order.total > 9 then Order.flagged = true; }`))
+		expectDebugRun(mock, "s2", `{"Order":{"total":5}}`)
+		third, err := client.Evaluate(ctx, 7, facts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(third.MatchedRules) != 0 {
+			t.Fatalf("stale result served: %+v", third)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("invalidation during evaluation skips storing", func(t *testing.T) {
+		client, mock := newMock(t)
+		client.cache = &ruleCache{rulesets: map[int][]ruleSetMember{}, rules: map[ruleKey]cachedRule{}}
+		client.cache.storeMembers(0, 7, []ruleSetMember{{name: "A"}})
+		client.cache.storeRule(0, ruleKey{"A", ""}, `rule A "" { when true then Retract("A"); }`)
+		store := &hookStore{lruStore: newLRUStore(10)}
+		store.onGet = func() { client.cache.invalidate("rule:A") }
+		client.results = newResultCache(CacheOptions{ResultStore: store})
+
+		mock.ExpectQuery(`rule_get`).WithArgs("A", nil).
+			WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(`rule A "" { when true then Retract("A"); }`))
+		expectDebugRun(mock, "s1", `{"Order":{"total":5}}`)
+		if _, err := client.Evaluate(ctx, 7, facts); err != nil {
+			t.Fatal(err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+		if store.len() != 0 {
+			t.Fatal("stored a result computed while the rules changed")
+		}
+	})
+
+	t.Run("explain bypasses the cache", func(t *testing.T) {
+		client, _ := newMock(t)
+		client.cache = cachedRuleSet("A1")
+		client.results = newResultCache(CacheOptions{ResultCacheSize: 10})
+		key, _ := client.results.lookupKey(client.cache, 7, []byte(`{"Order":{"total":5}}`))
+		client.results.set(ctx, key, &Result{MatchedRules: []string{"cached"}})
+		if r, err := client.Evaluate(ctx, 7, facts); err != nil || r.MatchedRules[0] != "cached" {
+			t.Fatalf("Evaluate = %+v, %v", r, err)
+		}
+		// Explain goes to the database, which has no expectations set
+		if _, err := client.EvaluateWithOptions(ctx, 7, facts, EvaluateOptions{Explain: true}); err == nil {
+			t.Fatal("explain served from the result cache")
+		}
+	})
+}
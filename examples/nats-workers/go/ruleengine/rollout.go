@@ -0,0 +1,419 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//go:embed rollout.sql
+var rolloutSQL string
+
+// Rollout modes
+const (
+	// RolloutShadow serves the baseline and evaluates the candidate only
+	// for comparison
+	RolloutShadow = "shadow"
+
+	// RolloutCanary serves the candidate's result to sampled evaluations
+	RolloutCanary = "canary"
+)
+
+// Rollout evaluates a candidate version of one rule of a rule set alongside
+// the version the set currently uses, on Percent of evaluations
+type Rollout struct {
+	ID        int     `json:"id"`
+	RuleSetID int     `json:"ruleset_id"`
+	Rule      string  `json:"rule"`
+	Percent   float64 `json:"percent"`
+	Mode      string  `json:"mode"`
+
+	// BaselineVersion is the version the rule set used when the rollout
+	// started (informational; the baseline always follows the rule set)
+	BaselineVersion  string     `json:"baseline_version,omitempty"`
+	CandidateVersion string     `json:"candidate_version"`
+	Status           string     `json:"status"` // running, stopped, promoted
+	CreatedAt        time.Time  `json:"created_at"`
+	EndedAt          *time.Time `json:"ended_at,omitempty"`
+}
+
+// RolloutOutcome reports how a rollout handled one evaluation
+type RolloutOutcome struct {
+	ID       int    `json:"id"`
+	Served   string `json:"served"` // baseline or candidate
+	Diverged bool   `json:"diverged"`
+}
+
+// EnableRollouts creates the rollout tables if needed and makes Evaluate
+// apply running rollouts. Each evaluation then costs one extra query to
+// look them up; sampled evaluations run the rule set twice. Call it before
+// sharing the client between goroutines.
+func (c *Client) EnableRollouts(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, rolloutSQL); err != nil {
+		return fmt.Errorf("failed to install rollouts: %w", err)
+	}
+	c.rollouts = true
+	return nil
+}
+
+// StartRollout begins evaluating r.CandidateVersion of r.Rule within rule
+// set r.RuleSetID on r.Percent of evaluations. Mode defaults to shadow.
+// It returns the rollout id.
+func (c *Client) StartRollout(ctx context.Context, r Rollout) (int, error) {
+	if err := validateRuleName(r.Rule); err != nil {
+		return 0, err
+	}
+	if r.CandidateVersion == "" {
+		return 0, &ValidationError{Field: "candidate_version", Message: "is required"}
+	}
+	if err := validateVersion("candidate_version", r.CandidateVersion); err != nil {
+		return 0, err
+	}
+	if r.Percent <= 0 || r.Percent > 100 {
+		return 0, &ValidationError{Field: "percent", Message: "must be greater than 0 and at most 100"}
+	}
+	if r.Mode == "" {
+		r.Mode = RolloutShadow
+	}
+	if r.Mode != RolloutShadow && r.Mode != RolloutCanary {
+		return 0, &ValidationError{Field: "mode", Message: "must be shadow or canary"}
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var baseline sql.NullString
+	err = tx.QueryRowContext(ctx,
+		`SELECT COALESCE(m.rule_version, rv.version)
+		 FROM rule_set_members m
+		 JOIN rule_definitions rd ON rd.name = m.rule_name
+		 LEFT JOIN rule_versions rv ON rv.rule_id = rd.id AND rv.is_default
+		 WHERE m.ruleset_id = $1 AND m.rule_name = $2
+		 LIMIT 1`,
+		r.RuleSetID, r.Rule,
+	).Scan(&baseline)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%s in rule set %d: %w", r.Rule, r.RuleSetID, ErrRuleNotFound)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if baseline.String == r.CandidateVersion {
+		return 0, &ValidationError{Field: "candidate_version", Message: fmt.Sprintf("rule set %d already uses %s@%s", r.RuleSetID, r.Rule, r.CandidateVersion)}
+	}
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM rule_versions rv
+		 JOIN rule_definitions rd ON rv.rule_id = rd.id
+		 WHERE rd.name = $1 AND rv.version = $2)`,
+		r.Rule, r.CandidateVersion,
+	).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, fmt.Errorf("%s@%s: %w", r.Rule, r.CandidateVersion, ErrRuleNotFound)
+	}
+
+	var running bool
+	if err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM rule_rollouts WHERE ruleset_id = $1 AND rule_name = $2 AND status = 'running')",
+		r.RuleSetID, r.Rule,
+	).Scan(&running); err != nil {
+		return 0, err
+	}
+	if running {
+		return 0, &ValidationError{Field: "rule", Message: fmt.Sprintf("%s already has a running rollout in rule set %d", r.Rule, r.RuleSetID)}
+	}
+
+	var id int
+	if err := tx.QueryRowContext(ctx,
+		`INSERT INTO rule_rollouts (ruleset_id, rule_name, baseline_version, candidate_version, percent, mode)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING rollout_id`,
+		r.RuleSetID, r.Rule, baseline, r.CandidateVersion, r.Percent, r.Mode,
+	).Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+const rolloutColumns = `rollout_id, ruleset_id, rule_name, percent::FLOAT8, mode,
+	COALESCE(baseline_version, ''), candidate_version, status, created_at, ended_at`
+
+func scanRollout(row interface{ Scan(...interface{}) error }) (*Rollout, error) {
+	var r Rollout
+	var ended sql.NullTime
+	if err := row.Scan(&r.ID, &r.RuleSetID, &r.Rule, &r.Percent, &r.Mode,
+		&r.BaselineVersion, &r.CandidateVersion, &r.Status, &r.CreatedAt, &ended); err != nil {
+		return nil, err
+	}
+	if ended.Valid {
+		r.EndedAt = &ended.Time
+	}
+	return &r, nil
+}
+
+// GetRollout returns one rollout
+func (c *Client) GetRollout(ctx context.Context, id int) (*Rollout, error) {
+	r, err := scanRollout(c.db.QueryRowContext(ctx,
+		"SELECT "+rolloutColumns+" FROM rule_rollouts WHERE rollout_id = $1", id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("rollout %d: %w", id, ErrRolloutNotFound)
+	}
+	return r, err
+}
+
+// ListRollouts returns the rollouts of a rule set (all rule sets when
+// rulesetID is 0), newest first
+func (c *Client) ListRollouts(ctx context.Context, rulesetID int) ([]Rollout, error) {
+	rows, err := c.db.QueryContext(ctx,
+		"SELECT "+rolloutColumns+" FROM rule_rollouts WHERE ($1 = 0 OR ruleset_id = $1) ORDER BY rollout_id DESC",
+		rulesetID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rollouts := []Rollout{}
+	for rows.Next() {
+		r, err := scanRollout(rows)
+		if err != nil {
+			return nil, err
+		}
+		rollouts = append(rollouts, *r)
+	}
+	return rollouts, rows.Err()
+}
+
+// SetRolloutPercent changes the share of evaluations a running rollout
+// samples, e.g. to ramp a canary from 1% to 10%
+func (c *Client) SetRolloutPercent(ctx context.Context, id int, percent float64) error {
+	if percent <= 0 || percent > 100 {
+		return &ValidationError{Field: "percent", Message: "must be greater than 0 and at most 100"}
+	}
+	return c.updateRunningRollout(ctx, id, "percent = $2", percent)
+}
+
+// StopRollout ends a rollout; evaluations go back to the baseline only.
+// Recorded results are kept for reporting.
+func (c *Client) StopRollout(ctx context.Context, id int) error {
+	return c.updateRunningRollout(ctx, id, "status = 'stopped', ended_at = CURRENT_TIMESTAMP")
+}
+
+// PromoteRollout activates the candidate version and ends the rollout. A
+// rule set member pinned to the baseline version stays pinned; use
+// PinRuleVersion to move it.
+func (c *Client) PromoteRollout(ctx context.Context, id int) error {
+	r, err := c.GetRollout(ctx, id)
+	if err != nil {
+		return err
+	}
+	if r.Status != "running" {
+		return &ValidationError{Field: "rollout", Message: fmt.Sprintf("rollout %d is %s", id, r.Status)}
+	}
+	if err := c.ActivateVersion(ctx, r.Rule, r.CandidateVersion, ""); err != nil {
+		return err
+	}
+	return c.updateRunningRollout(ctx, id, "status = 'promoted', ended_at = CURRENT_TIMESTAMP")
+}
+
+func (c *Client) updateRunningRollout(ctx context.Context, id int, set string, args ...interface{}) error {
+	res, err := c.db.ExecContext(ctx,
+		"UPDATE rule_rollouts SET "+set+" WHERE rollout_id = $1 AND status = 'running'",
+		append([]interface{}{id}, args...)...,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := c.GetRollout(ctx, id); err != nil {
+			return err
+		}
+		return &ValidationError{Field: "rollout", Message: fmt.Sprintf("rollout %d is not running", id)}
+	}
+	return nil
+}
+
+// sampleRollout returns the running rollout that samples this evaluation,
+// if any. With several running rollouts in one rule set, at most one
+// applies per evaluation so outcomes stay attributable.
+func (c *Client) sampleRollout(ctx context.Context, rulesetID int) (*Rollout, error) {
+	rows, err := c.db.QueryContext(ctx,
+		"SELECT "+rolloutColumns+" FROM rule_rollouts WHERE ruleset_id = $1 AND status = 'running' ORDER BY rollout_id",
+		rulesetID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanRollout(rows)
+		if err != nil {
+			return nil, err
+		}
+		if rand.Float64()*100 < r.Percent {
+			return r, nil
+		}
+	}
+	return nil, rows.Err()
+}
+
+// evaluateRollout runs the rule set as configured (baseline) and with the
+// candidate version substituted, records both outcomes, and returns the
+// one the rollout serves. A failing candidate is recorded as divergent and
+// the baseline is served.
+func (c *Client) evaluateRollout(ctx context.Context, conn *sql.Conn, r *Rollout, members []ruleSetMember, factsJSON []byte) (*Result, error) {
+	baseline, err := c.evaluateMembers(ctx, conn, members, factsJSON, false)
+	if err != nil {
+		return nil, err
+	}
+
+	candidateMembers := make([]ruleSetMember, len(members))
+	for i, m := range members {
+		if m.name == r.Rule {
+			m.version = sql.NullString{String: r.CandidateVersion, Valid: true}
+		}
+		candidateMembers[i] = m
+	}
+	candidate, candidateErr := c.evaluateMembers(ctx, conn, candidateMembers, factsJSON, false)
+
+	outcome := &RolloutOutcome{ID: r.ID, Served: "baseline"}
+	served := baseline
+	if candidateErr != nil {
+		outcome.Diverged = true
+	} else {
+		outcome.Diverged = !reflect.DeepEqual(baseline.Facts, candidate.Facts) ||
+			!reflect.DeepEqual(baseline.MatchedRules, candidate.MatchedRules)
+		if r.Mode == RolloutCanary {
+			outcome.Served = "candidate"
+			served = candidate
+		}
+	}
+	served.Rollout = outcome
+
+	// Recording is best effort: a full or missing results table must not
+	// fail the caller's evaluation
+	recordRolloutResult(ctx, conn, outcome, factsJSON, baseline, candidate, candidateErr)
+	return served, nil
+}
+
+func recordRolloutResult(ctx context.Context, conn *sql.Conn, outcome *RolloutOutcome, input []byte, baseline, candidate *Result, candidateErr error) {
+	baselineFacts, _ := json.Marshal(baseline.Facts)
+	var candidateFacts []byte
+	var candidateRules []string
+	var errText sql.NullString
+	if candidateErr != nil {
+		errText = sql.NullString{String: candidateErr.Error(), Valid: true}
+	} else {
+		candidateFacts, _ = json.Marshal(candidate.Facts)
+		candidateRules = candidate.MatchedRules
+	}
+
+	conn.ExecContext(ctx,
+		`INSERT INTO rule_rollout_results
+		 (rollout_id, served, diverged, input, baseline_facts, baseline_rules,
+		  candidate_facts, candidate_rules, candidate_error)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		outcome.ID, outcome.Served, outcome.Diverged, input,
+		baselineFacts, pq.Array(baseline.MatchedRules),
+		candidateFacts, pq.Array(candidateRules), errText,
+	)
+}
+
+// RolloutSample is one recorded evaluation of a rollout
+type RolloutSample struct {
+	Served         string          `json:"served"`
+	Diverged       bool            `json:"diverged"`
+	Input          json.RawMessage `json:"input"`
+	BaselineFacts  json.RawMessage `json:"baseline_facts,omitempty"`
+	BaselineRules  []string        `json:"baseline_rules"`
+	CandidateFacts json.RawMessage `json:"candidate_facts,omitempty"`
+	CandidateRules []string        `json:"candidate_rules"`
+	CandidateError string          `json:"candidate_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// RolloutReport summarizes how often the candidate disagreed with the
+// baseline
+type RolloutReport struct {
+	Rollout         Rollout         `json:"rollout"`
+	Evaluations     int64           `json:"evaluations"`
+	Diverged        int64           `json:"diverged"`
+	CandidateErrors int64           `json:"candidate_errors"`
+	ServedCandidate int64           `json:"served_candidate"`
+	DivergenceRate  float64         `json:"divergence_rate"`
+	Examples        []RolloutSample `json:"examples"` // Most recent divergent evaluations
+}
+
+// GetRolloutReport returns divergence counts for a rollout and up to
+// examples of the most recent divergent evaluations
+func (c *Client) GetRolloutReport(ctx context.Context, id, examples int) (*RolloutReport, error) {
+	r, err := c.GetRollout(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RolloutReport{Rollout: *r, Examples: []RolloutSample{}}
+	if err := c.db.QueryRowContext(ctx,
+		`SELECT COUNT(*),
+		        COUNT(*) FILTER (WHERE diverged),
+		        COUNT(*) FILTER (WHERE candidate_error IS NOT NULL),
+		        COUNT(*) FILTER (WHERE served = 'candidate')
+		 FROM rule_rollout_results WHERE rollout_id = $1`,
+		id,
+	).Scan(&report.Evaluations, &report.Diverged, &report.CandidateErrors, &report.ServedCandidate); err != nil {
+		return nil, err
+	}
+	if report.Evaluations > 0 {
+		report.DivergenceRate = float64(report.Diverged) / float64(report.Evaluations)
+	}
+	if examples <= 0 {
+		return report, nil
+	}
+
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT served, diverged, input, baseline_facts, baseline_rules,
+		        candidate_facts, candidate_rules, COALESCE(candidate_error, ''), created_at
+		 FROM rule_rollout_results
+		 WHERE rollout_id = $1 AND diverged
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT $2`,
+		id, examples,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s RolloutSample
+		var input, baselineFacts, candidateFacts []byte
+		if err := rows.Scan(&s.Served, &s.Diverged, &input, &baselineFacts, pq.Array(&s.BaselineRules),
+			&candidateFacts, pq.Array(&s.CandidateRules), &s.CandidateError, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		s.Input = input
+		if baselineFacts != nil {
+			s.BaselineFacts = baselineFacts
+		}
+		if candidateFacts != nil {
+			s.CandidateFacts = candidateFacts
+		}
+		report.Examples = append(report.Examples, s)
+	}
+	return report, rows.Err()
+}
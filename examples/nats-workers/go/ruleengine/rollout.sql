@@ -0,0 +1,38 @@
+-- Shadow and canary rollouts of rule versions (see EnableRollouts).
+
+CREATE TABLE IF NOT EXISTS rule_rollouts (
+    rollout_id SERIAL PRIMARY KEY,
+    ruleset_id INTEGER NOT NULL,
+    rule_name TEXT NOT NULL,
+    baseline_version TEXT,
+    candidate_version TEXT NOT NULL,
+    percent NUMERIC(5,2) NOT NULL CHECK (percent >= 0 AND percent <= 100),
+    mode TEXT NOT NULL CHECK (mode IN ('shadow', 'canary')),
+    status TEXT NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'stopped', 'promoted')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ended_at TIMESTAMPTZ
+);
+
+-- One running rollout per rule of a rule set
+CREATE UNIQUE INDEX IF NOT EXISTS idx_rule_rollouts_running
+    ON rule_rollouts(ruleset_id, rule_name) WHERE status = 'running';
+
+CREATE TABLE IF NOT EXISTS rule_rollout_results (
+    id BIGSERIAL PRIMARY KEY,
+    rollout_id INTEGER NOT NULL REFERENCES rule_rollouts(rollout_id) ON DELETE CASCADE,
+    served TEXT NOT NULL,
+    diverged BOOLEAN NOT NULL,
+    input JSONB NOT NULL,
+    baseline_facts JSONB,
+    baseline_rules TEXT[],
+    candidate_facts JSONB,
+    candidate_rules TEXT[],
+    candidate_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_rule_rollout_results_rollout
+    ON rule_rollout_results(rollout_id, created_at DESC);
+
+COMMENT ON TABLE rule_rollouts IS 'Shadow/canary evaluation of a candidate rule version';
+COMMENT ON TABLE rule_rollout_results IS 'Baseline and candidate outcome of each sampled evaluation';
@@ -0,0 +1,149 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestStartRolloutValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		r     Rollout
+		field string
+	}{
+		{"no candidate", Rollout{Rule: "A", Percent: 10}, "candidate_version"},
+		{"bad candidate", Rollout{Rule: "A", CandidateVersion: "two", Percent: 10}, "candidate_version"},
+		{"zero percent", Rollout{Rule: "A", CandidateVersion: "2.0.0"}, "percent"},
+		{"over 100 percent", Rollout{Rule: "A", CandidateVersion: "2.0.0", Percent: 101}, "percent"},
+		{"bad mode", Rollout{Rule: "A", CandidateVersion: "2.0.0", Percent: 5, Mode: "blue-green"}, "mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newMock(t)
+			_, err := client.StartRollout(context.Background(), tt.r)
+			var validation *ValidationError
+			if !errors.As(err, &validation) || validation.Field != tt.field {
+				t.Fatalf("err = %v, want a validation error on %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestStartRolloutSameVersion(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM rule_set_members m`).WithArgs(1, "A").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("2.0.0"))
+	mock.ExpectRollback()
+
+	_, err := client.StartRollout(context.Background(), Rollout{RuleSetID: 1, Rule: "A", CandidateVersion: "2.0.0", Percent: 5})
+	var validation *ValidationError
+	if !errors.As(err, &validation) {
+		t.Fatalf("err = %v, want *ValidationError", err)
+	}
+}
+
+func TestEvaluateRollout(t *testing.T) {
+	const (
+		baselineGRL  = `rule A "" { when Order.total > 10 then Order.flag = 1; }`
+		candidateGRL = `rule A "" { when Order.total > 10 then Order.flag = 2; }`
+	)
+	tests := []struct {
+		name         string
+		mode         string
+		candidate    string // engine output for the candidate; "" fails it
+		wantServed   string
+		wantDiverged bool
+		wantFlag     float64
+	}{
+		{name: "shadow agrees", mode: RolloutShadow, candidate: `{"Order":{"flag":1}}`,
+			wantServed: "baseline", wantFlag: 1},
+		{name: "shadow diverges", mode: RolloutShadow, candidate: `{"Order":{"flag":2}}`,
+			wantServed: "baseline", wantDiverged: true, wantFlag: 1},
+		{name: "canary serves candidate", mode: RolloutCanary, candidate: `{"Order":{"flag":2}}`,
+			wantServed: "candidate", wantDiverged: true, wantFlag: 2},
+		{name: "failing candidate falls back", mode: RolloutCanary,
+			wantServed: "baseline", wantDiverged: true, wantFlag: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			client.rollouts = true
+
+			mock.ExpectQuery(`FROM rule_rollouts WHERE ruleset_id = \$1 AND status = 'running'`).WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"rollout_id", "ruleset_id", "rule_name", "percent", "mode",
+					"baseline_version", "candidate_version", "status", "created_at", "ended_at"}).
+					AddRow(9, 1, "A", 100.0, tt.mode, "1.0.0", "2.0.0", "running", time.Now(), nil))
+			mock.ExpectQuery(`SELECT is_active FROM rule_sets`).
+				WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(true))
+			mock.ExpectQuery(`ruleset_get_rules`).
+				WillReturnRows(sqlmock.NewRows([]string{"rule_name", "rule_version"}).AddRow("A", nil))
+			mock.ExpectQuery(`rule_get`).WithArgs("A", nil).
+				WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(baselineGRL))
+			expectDebugRunOf(mock, baselineGRL, "s1", `{"Order":{"flag":1}}`)
+			if tt.candidate == "" {
+				mock.ExpectQuery(`rule_get`).WithArgs("A", "2.0.0").WillReturnError(errors.New("pq: version not found"))
+			} else {
+				mock.ExpectQuery(`rule_get`).WithArgs("A", "2.0.0").
+					WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(candidateGRL))
+				expectDebugRunOf(mock, candidateGRL, "s2", tt.candidate)
+			}
+			mock.ExpectExec(`INSERT INTO rule_rollout_results`).
+				WithArgs(9, tt.wantServed, tt.wantDiverged, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+					sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			result, err := client.Evaluate(context.Background(), 1, map[string]interface{}{"Order": map[string]interface{}{"total": 20}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Rollout == nil || result.Rollout.Served != tt.wantServed || result.Rollout.Diverged != tt.wantDiverged {
+				t.Fatalf("rollout outcome = %+v", result.Rollout)
+			}
+			if flag := result.Facts["Order"].(map[string]interface{})["flag"]; flag != tt.wantFlag {
+				t.Fatalf("served flag = %v, want %v", flag, tt.wantFlag)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// expectDebugRunOf is expectDebugRun for one specific GRL document, so
+// baseline and candidate runs can be told apart
+func expectDebugRunOf(mock sqlmock.Sqlmock, grl, session, output string) {
+	mock.ExpectQuery(`run_rule_engine_debug`).WithArgs(sqlmock.AnyArg(), grl).
+		WillReturnRows(sqlmock.NewRows([]string{"session_id", "result"}).AddRow(session, output))
+	mock.ExpectQuery(`debug_get_events`).WithArgs(session).
+		WillReturnRows(sqlmock.NewRows([]string{"step", "event_type", "description", "event_data"}))
+	mock.ExpectExec(`debug_delete_session`).WithArgs(session).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestGetRolloutReport(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectQuery(`FROM rule_rollouts WHERE rollout_id`).WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"rollout_id", "ruleset_id", "rule_name", "percent", "mode",
+			"baseline_version", "candidate_version", "status", "created_at", "ended_at"}).
+			AddRow(9, 1, "A", 10.0, RolloutShadow, "1.0.0", "2.0.0", "running", time.Now(), nil))
+	mock.ExpectQuery(`COUNT\(\*\) FILTER`).WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"n", "diverged", "errors", "served"}).AddRow(200, 50, 2, 0))
+
+	report, err := client.GetRolloutReport(context.Background(), 9, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DivergenceRate != 0.25 || len(report.Examples) != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	mock.ExpectQuery(`FROM rule_rollouts WHERE rollout_id`).WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"rollout_id"}))
+	if _, err := client.GetRolloutReport(context.Background(), 10, 0); !errors.Is(err, ErrRolloutNotFound) {
+		t.Fatalf("err = %v, want ErrRolloutNotFound", err)
+	}
+}
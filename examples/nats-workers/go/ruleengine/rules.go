@@ -0,0 +1,320 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Rule is a repository rule with its active (default) version
+type Rule struct {
+	ID            int       `json:"id"`
+	Name          string    `json:"name"`
+	Description   string    `json:"description,omitempty"`
+	IsActive      bool      `json:"is_active"`
+	ActiveVersion string    `json:"active_version"`
+	GRL           string    `json:"grl"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	UpdatedBy     string    `json:"updated_by,omitempty"`
+}
+
+// SaveRuleInput describes a new rule or a new version of an existing rule
+type SaveRuleInput struct {
+	Name        string
+	GRL         string
+	Version     string // Empty: 1.0.0 for new rules, next patch for updates
+	Description string // Only used when the rule is created
+	ChangeNotes string
+
+	// ExpectedVersion is the active version the caller based its edit on.
+	// UpdateRule fails with *ConflictError if it no longer matches.
+	ExpectedVersion string
+
+	// Activate makes the new version the active one (UpdateRule only; the
+	// first version of a new rule is always active)
+	Activate bool
+}
+
+func (in *SaveRuleInput) validate() error {
+	if err := validateRuleName(in.Name); err != nil {
+		return err
+	}
+	if err := validateVersion("version", in.Version); err != nil {
+		return err
+	}
+	return validateGRL(in.GRL)
+}
+
+// CreateRule stores a new rule with its first version
+func (c *Client) CreateRule(ctx context.Context, in SaveRuleInput) (*Rule, error) {
+	if err := in.validate(); err != nil {
+		return nil, err
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM rule_definitions WHERE name = $1)", in.Name,
+	).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("%s: %w", in.Name, ErrRuleExists)
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"SELECT rule_save($1, $2, $3, $4, $5)",
+		in.Name, in.GRL, nullString(in.Version), nullString(in.Description), nullString(in.ChangeNotes),
+	); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return c.GetRule(ctx, in.Name)
+}
+
+// UpdateRule saves a new version of an existing rule. When ExpectedVersion
+// is set, the update only succeeds if it is still the active version.
+func (c *Client) UpdateRule(ctx context.Context, in SaveRuleInput) (*Rule, error) {
+	if err := in.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateVersion("expected_version", in.ExpectedVersion); err != nil {
+		return nil, err
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the rule so concurrent updates serialize on the version check
+	var active sql.NullString
+	err = tx.QueryRowContext(ctx,
+		`SELECT rv.version
+		 FROM rule_definitions rd
+		 LEFT JOIN rule_versions rv ON rv.rule_id = rd.id AND rv.is_default
+		 WHERE rd.name = $1
+		 FOR UPDATE OF rd`,
+		in.Name,
+	).Scan(&active)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s: %w", in.Name, ErrRuleNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if in.ExpectedVersion != "" && in.ExpectedVersion != active.String {
+		return nil, &ConflictError{Rule: in.Name, ExpectedVersion: in.ExpectedVersion, ActualVersion: active.String}
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"SELECT rule_save($1, $2, $3, NULL, $4)",
+		in.Name, in.GRL, nullString(in.Version), nullString(in.ChangeNotes),
+	); err != nil {
+		return nil, err
+	}
+
+	if in.Activate {
+		var saved string
+		if err := tx.QueryRowContext(ctx,
+			`SELECT rv.version FROM rule_versions rv
+			 JOIN rule_definitions rd ON rv.rule_id = rd.id
+			 WHERE rd.name = $1
+			 ORDER BY rv.created_at DESC, rv.id DESC LIMIT 1`,
+			in.Name,
+		).Scan(&saved); err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "SELECT rule_activate($1, $2)", in.Name, saved); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return c.GetRule(ctx, in.Name)
+}
+
+// GetRule returns a rule with its active version
+func (c *Client) GetRule(ctx context.Context, name string) (*Rule, error) {
+	rules, err := c.queryRules(ctx, "WHERE rd.name = $1", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%s: %w", name, ErrRuleNotFound)
+	}
+	return &rules[0], nil
+}
+
+// ListRules returns all rules ordered by name
+func (c *Client) ListRules(ctx context.Context) ([]Rule, error) {
+	return c.queryRules(ctx, "")
+}
+
+// GetRules returns the named rules with their active versions, ordered by
+// name, in one query. Names that do not exist are left out.
+func (c *Client) GetRules(ctx context.Context, names []string) ([]Rule, error) {
+	return c.queryRules(ctx, "WHERE rd.name = ANY($1)", pq.Array(names))
+}
+
+func (c *Client) queryRules(ctx context.Context, where string, args ...interface{}) ([]Rule, error) {
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT rd.id, rd.name, COALESCE(rd.description, ''), rd.is_active,
+		        COALESCE(rv.version, ''), COALESCE(rv.grl_content, ''),
+		        rd.created_at, rd.updated_at, COALESCE(rd.updated_by, '')
+		 FROM rule_definitions rd
+		 LEFT JOIN rule_versions rv ON rv.rule_id = rd.id AND rv.is_default
+		 `+where+`
+		 ORDER BY rd.name`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []Rule
+	for rows.Next() {
+		var r Rule
+		if err := rows.Scan(&r.ID, &r.Name, &r.Description, &r.IsActive,
+			&r.ActiveVersion, &r.GRL, &r.CreatedAt, &r.UpdatedAt, &r.UpdatedBy); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// ActivateVersion makes version the rule's active version. When
+// expectedVersion is non-empty it must match the currently active version.
+func (c *Client) ActivateVersion(ctx context.Context, name, version, expectedVersion string) error {
+	if err := validateRuleName(name); err != nil {
+		return err
+	}
+	if err := validateVersion("version", version); err != nil {
+		return err
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var active sql.NullString
+	err = tx.QueryRowContext(ctx,
+		`SELECT rv.version
+		 FROM rule_definitions rd
+		 LEFT JOIN rule_versions rv ON rv.rule_id = rd.id AND rv.is_default
+		 WHERE rd.name = $1
+		 FOR UPDATE OF rd`,
+		name,
+	).Scan(&active)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%s: %w", name, ErrRuleNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if expectedVersion != "" && expectedVersion != active.String {
+		return &ConflictError{Rule: name, ExpectedVersion: expectedVersion, ActualVersion: active.String}
+	}
+
+	if _, err := tx.ExecContext(ctx, "SELECT rule_activate($1, $2)", name, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// EnableRule makes a rule executable again
+func (c *Client) EnableRule(ctx context.Context, name string) error {
+	return c.setRuleActive(ctx, name, true)
+}
+
+// DisableRule keeps a rule and its history but stops it from executing
+func (c *Client) DisableRule(ctx context.Context, name string) error {
+	return c.setRuleActive(ctx, name, false)
+}
+
+func (c *Client) setRuleActive(ctx context.Context, name string, active bool) error {
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		"UPDATE rule_definitions SET is_active = $2, updated_at = NOW(), updated_by = CURRENT_USER WHERE name = $1",
+		name, active,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", name, ErrRuleNotFound)
+	}
+	return tx.Commit()
+}
+
+// SetRuleDescription replaces a rule's description; "" clears it
+func (c *Client) SetRuleDescription(ctx context.Context, name, description string) error {
+	res, err := c.db.ExecContext(ctx,
+		"UPDATE rule_definitions SET description = $2, updated_at = NOW(), updated_by = CURRENT_USER WHERE name = $1",
+		name, nullString(description),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", name, ErrRuleNotFound)
+	}
+	return nil
+}
+
+// DeleteRule deletes one version of a rule, or the whole rule when version
+// is empty. The active version cannot be deleted on its own.
+func (c *Client) DeleteRule(ctx context.Context, name, version string) error {
+	if err := validateRuleName(name); err != nil {
+		return err
+	}
+	if err := validateVersion("version", version); err != nil {
+		return err
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deleted bool
+	if err := tx.QueryRowContext(ctx,
+		"SELECT rule_delete($1, $2)", name, nullString(version),
+	).Scan(&deleted); err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("%s: %w", name, ErrRuleNotFound)
+	}
+	return tx.Commit()
+}
+
+// nullString maps "" to SQL NULL for optional function arguments
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,193 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSaveRuleInputValidate(t *testing.T) {
+	grl := `rule A "" { when true then Retract("A"); }`
+	tests := []struct {
+		name  string
+		in    SaveRuleInput
+		field string
+	}{
+		{name: "valid", in: SaveRuleInput{Name: "HighValue_Order-1", GRL: grl}},
+		{name: "valid version", in: SaveRuleInput{Name: "A", GRL: grl, Version: "1.2.3-rc1"}},
+		{name: "empty name", in: SaveRuleInput{GRL: grl}, field: "name"},
+		{name: "name starts with digit", in: SaveRuleInput{Name: "1A", GRL: grl}, field: "name"},
+		{name: "name with space", in: SaveRuleInput{Name: "A B", GRL: grl}, field: "name"},
+		{name: "short version", in: SaveRuleInput{Name: "A", GRL: grl, Version: "1.2"}, field: "version"},
+		{name: "blank grl", in: SaveRuleInput{Name: "A", GRL: " \n\t"}, field: "grl"},
+		{name: "oversized grl", in: SaveRuleInput{Name: "A", GRL: strings.Repeat("x", maxGRLSize+1)}, field: "grl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.in.validate()
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) || verr.Field != tt.field {
+				t.Fatalf("err = %v, want a ValidationError on %s", err, tt.field)
+			}
+		})
+	}
+}
+
+var ruleColumns = []string{"id", "name", "description", "is_active", "version", "grl", "created_at", "updated_at", "updated_by"}
+
+func TestCreateRule(t *testing.T) {
+	grl := `rule A "" { when true then Retract("A"); }`
+
+	t.Run("created", func(t *testing.T) {
+		client, mock := newMock(t)
+		mock.MatchExpectationsInOrder(true)
+		mock.ExpectBegin()
+		mock.ExpectExec(`set_config\('ruleengine.actor'`).WithArgs("alice").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(`SELECT EXISTS`).WithArgs("A").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectExec(`rule_save`).WithArgs("A", grl, nil, "desc", nil).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		now := time.Now()
+		mock.ExpectQuery(`FROM rule_definitions rd`).WithArgs("A").
+			WillReturnRows(sqlmock.NewRows(ruleColumns).AddRow(1, "A", "desc", true, "1.0.0", grl, now, now, "alice"))
+
+		rule, err := client.CreateRule(WithActor(context.Background(), "alice"), SaveRuleInput{Name: "A", GRL: grl, Description: "desc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.ActiveVersion != "1.0.0" || rule.UpdatedBy != "alice" {
+			t.Fatalf("rule = %+v", rule)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("exists", func(t *testing.T) {
+		client, mock := newMock(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT EXISTS`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectRollback()
+		_, err := client.CreateRule(context.Background(), SaveRuleInput{Name: "A", GRL: grl})
+		if !errors.Is(err, ErrRuleExists) {
+			t.Fatalf("err = %v, want ErrRuleExists", err)
+		}
+	})
+
+	t.Run("invalid input never reaches the database", func(t *testing.T) {
+		client, mock := newMock(t)
+		if _, err := client.CreateRule(context.Background(), SaveRuleInput{Name: "bad name", GRL: grl}); err == nil {
+			t.Fatal("invalid name accepted")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestUpdateRule(t *testing.T) {
+	grl := `rule A "" { when true then Retract("A"); }`
+
+	t.Run("conflict", func(t *testing.T) {
+		client, mock := newMock(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(`FOR UPDATE OF rd`).WithArgs("A").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("1.0.1"))
+		mock.ExpectRollback()
+		_, err := client.UpdateRule(context.Background(), SaveRuleInput{Name: "A", GRL: grl, ExpectedVersion: "1.0.0"})
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) || conflict.ActualVersion != "1.0.1" {
+			t.Fatalf("err = %v, want a ConflictError reporting 1.0.1", err)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		client, mock := newMock(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(`FOR UPDATE OF rd`).WillReturnRows(sqlmock.NewRows([]string{"version"}))
+		mock.ExpectRollback()
+		_, err := client.UpdateRule(context.Background(), SaveRuleInput{Name: "A", GRL: grl})
+		if !errors.Is(err, ErrRuleNotFound) {
+			t.Fatalf("err = %v, want ErrRuleNotFound", err)
+		}
+	})
+
+	t.Run("saved and activated", func(t *testing.T) {
+		client, mock := newMock(t)
+		mock.MatchExpectationsInOrder(true)
+		mock.ExpectBegin()
+		mock.ExpectQuery(`FOR UPDATE OF rd`).WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("1.0.0"))
+		mock.ExpectExec(`rule_save`).WithArgs("A", grl, nil, "notes").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(`ORDER BY rv.created_at DESC`).WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("1.0.1"))
+		mock.ExpectExec(`rule_activate`).WithArgs("A", "1.0.1").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		now := time.Now()
+		mock.ExpectQuery(`FROM rule_definitions rd`).
+			WillReturnRows(sqlmock.NewRows(ruleColumns).AddRow(1, "A", "", true, "1.0.1", grl, now, now, ""))
+		rule, err := client.UpdateRule(context.Background(), SaveRuleInput{
+			Name: "A", GRL: grl, ChangeNotes: "notes", ExpectedVersion: "1.0.0", Activate: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.ActiveVersion != "1.0.1" {
+			t.Fatalf("active version = %s", rule.ActiveVersion)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestGetRuleSet(t *testing.T) {
+	t.Run("members in order", func(t *testing.T) {
+		client, mock := newMock(t)
+		mock.ExpectQuery(`FROM rule_sets WHERE ruleset_id`).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"name", "description", "is_active", "created_at"}).AddRow("orders", "", true, time.Now()))
+		mock.ExpectQuery(`ruleset_get_rules`).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"rule_name", "rule_version", "execution_order"}).
+				AddRow("A", "", 1).AddRow("B", "2.0.0", 2))
+		rs, err := client.GetRuleSet(context.Background(), 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []RuleSetMember{{Rule: "A", Order: 1}, {Rule: "B", Version: "2.0.0", Order: 2}}
+		if len(rs.Members) != 2 || rs.Members[0] != want[0] || rs.Members[1] != want[1] {
+			t.Fatalf("members = %+v", rs.Members)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		client, mock := newMock(t)
+		mock.ExpectQuery(`FROM rule_sets WHERE ruleset_id`).
+			WillReturnRows(sqlmock.NewRows([]string{"name", "description", "is_active", "created_at"}))
+		if _, err := client.GetRuleSet(context.Background(), 3); !errors.Is(err, ErrRuleSetNotFound) {
+			t.Fatalf("err = %v, want ErrRuleSetNotFound", err)
+		}
+	})
+}
+
+func TestRuleSetInputValidation(t *testing.T) {
+	client, mock := newMock(t)
+	ctx := context.Background()
+	if _, err := client.CreateRuleSet(ctx, "  ", ""); err == nil {
+		t.Error("blank rule set name accepted")
+	}
+	if err := client.AddRuleToSet(ctx, 1, RuleSetMember{Rule: "not valid"}); err == nil {
+		t.Error("invalid member rule name accepted")
+	}
+	if err := client.AddRuleToSet(ctx, 1, RuleSetMember{Rule: "A", Version: "v1"}); err == nil {
+		t.Error("invalid member version accepted")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,235 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RuleSet is a named, ordered collection of rules evaluated together
+type RuleSet struct {
+	ID          int             `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	IsActive    bool            `json:"is_active"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Members     []RuleSetMember `json:"members,omitempty"`
+}
+
+// RuleSetMember is a rule within a rule set. An empty Version follows the
+// rule's active version.
+type RuleSetMember struct {
+	Rule    string `json:"rule" yaml:"rule"`
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+	Order   int    `json:"order" yaml:"order"`
+}
+
+// CreateRuleSet creates an empty rule set and returns its id
+func (c *Client) CreateRuleSet(ctx context.Context, name, description string) (int, error) {
+	if strings.TrimSpace(name) == "" {
+		return 0, &ValidationError{Field: "name", Message: "must not be empty"}
+	}
+
+	var id int
+	err := c.db.QueryRowContext(ctx,
+		"SELECT ruleset_create($1, $2)", name, nullString(description),
+	).Scan(&id)
+	return id, err
+}
+
+// GetRuleSet returns a rule set with its members in execution order
+func (c *Client) GetRuleSet(ctx context.Context, id int) (*RuleSet, error) {
+	rs := RuleSet{ID: id}
+	err := c.db.QueryRowContext(ctx,
+		"SELECT name, COALESCE(description, ''), is_active, created_at FROM rule_sets WHERE ruleset_id = $1",
+		id,
+	).Scan(&rs.Name, &rs.Description, &rs.IsActive, &rs.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("rule set %d: %w", id, ErrRuleSetNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := c.db.QueryContext(ctx,
+		"SELECT rule_name, COALESCE(rule_version, ''), execution_order FROM ruleset_get_rules($1)", id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m RuleSetMember
+		if err := rows.Scan(&m.Rule, &m.Version, &m.Order); err != nil {
+			return nil, err
+		}
+		rs.Members = append(rs.Members, m)
+	}
+	return &rs, rows.Err()
+}
+
+// ListRuleSets returns all rule sets (without members) ordered by name
+func (c *Client) ListRuleSets(ctx context.Context) ([]RuleSet, error) {
+	rows, err := c.db.QueryContext(ctx,
+		"SELECT ruleset_id, name, COALESCE(description, ''), is_active, created_at FROM ruleset_list()",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sets []RuleSet
+	for rows.Next() {
+		var rs RuleSet
+		if err := rows.Scan(&rs.ID, &rs.Name, &rs.Description, &rs.IsActive, &rs.CreatedAt); err != nil {
+			return nil, err
+		}
+		sets = append(sets, rs)
+	}
+	return sets, rows.Err()
+}
+
+// RuleSetMembers returns the members of several rule sets in one query,
+// keyed by rule set id and each in execution order. Rule sets without
+// members are left out.
+func (c *Client) RuleSetMembers(ctx context.Context, ids []int) (map[int][]RuleSetMember, error) {
+	int64IDs := make(pq.Int64Array, len(ids))
+	for i, id := range ids {
+		int64IDs[i] = int64(id)
+	}
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT ruleset_id, rule_name, COALESCE(rule_version, ''), execution_order
+		 FROM rule_set_members
+		 WHERE ruleset_id = ANY($1)
+		 ORDER BY ruleset_id, execution_order, rule_name`,
+		int64IDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := map[int][]RuleSetMember{}
+	for rows.Next() {
+		var id int
+		var m RuleSetMember
+		if err := rows.Scan(&id, &m.Rule, &m.Version, &m.Order); err != nil {
+			return nil, err
+		}
+		members[id] = append(members[id], m)
+	}
+	return members, rows.Err()
+}
+
+// RuleSetsOf returns the ids of the rule sets rule is a member of, in
+// ascending order
+func (c *Client) RuleSetsOf(ctx context.Context, rule string) ([]int, error) {
+	rows, err := c.db.QueryContext(ctx,
+		"SELECT DISTINCT ruleset_id FROM rule_set_members WHERE rule_name = $1 ORDER BY ruleset_id",
+		rule,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// AddRuleToSet adds a rule to a rule set, or updates its order if present
+func (c *Client) AddRuleToSet(ctx context.Context, rulesetID int, member RuleSetMember) error {
+	if err := validateRuleName(member.Rule); err != nil {
+		return err
+	}
+	if err := validateVersion("version", member.Version); err != nil {
+		return err
+	}
+
+	_, err := c.db.ExecContext(ctx,
+		"SELECT ruleset_add_rule($1, $2, $3, $4)",
+		rulesetID, member.Rule, nullString(member.Version), member.Order,
+	)
+	return err
+}
+
+// RemoveRuleFromSet removes a rule (or one pinned version of it) from a set
+func (c *Client) RemoveRuleFromSet(ctx context.Context, rulesetID int, rule, version string) error {
+	var removed bool
+	if err := c.db.QueryRowContext(ctx,
+		"SELECT ruleset_remove_rule($1, $2, $3)", rulesetID, rule, nullString(version),
+	).Scan(&removed); err != nil {
+		return err
+	}
+	if !removed {
+		return fmt.Errorf("%s in rule set %d: %w", rule, rulesetID, ErrRuleNotFound)
+	}
+	return nil
+}
+
+// UpdateRuleSet renames a rule set and replaces its description. Messages
+// and callers refer to rule sets by id, so renaming does not affect them.
+func (c *Client) UpdateRuleSet(ctx context.Context, id int, name, description string) error {
+	if strings.TrimSpace(name) == "" {
+		return &ValidationError{Field: "name", Message: "must not be empty"}
+	}
+	res, err := c.db.ExecContext(ctx,
+		"UPDATE rule_sets SET name = $2, description = $3, updated_at = CURRENT_TIMESTAMP WHERE ruleset_id = $1",
+		id, name, nullString(description),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("rule set %d: %w", id, ErrRuleSetNotFound)
+	}
+	return nil
+}
+
+// EnableRuleSet allows a rule set to be evaluated
+func (c *Client) EnableRuleSet(ctx context.Context, id int) error {
+	return c.setRuleSetActive(ctx, id, true)
+}
+
+// DisableRuleSet stops a rule set from being evaluated
+func (c *Client) DisableRuleSet(ctx context.Context, id int) error {
+	return c.setRuleSetActive(ctx, id, false)
+}
+
+func (c *Client) setRuleSetActive(ctx context.Context, id int, active bool) error {
+	res, err := c.db.ExecContext(ctx,
+		"UPDATE rule_sets SET is_active = $2, updated_at = CURRENT_TIMESTAMP WHERE ruleset_id = $1",
+		id, active,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("rule set %d: %w", id, ErrRuleSetNotFound)
+	}
+	return nil
+}
+
+// DeleteRuleSet deletes a rule set and its membership (not the rules)
+func (c *Client) DeleteRuleSet(ctx context.Context, id int) error {
+	var deleted bool
+	if err := c.db.QueryRowContext(ctx, "SELECT ruleset_delete($1)", id).Scan(&deleted); err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("rule set %d: %w", id, ErrRuleSetNotFound)
+	}
+	return nil
+}
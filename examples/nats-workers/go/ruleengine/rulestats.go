@@ -0,0 +1,373 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//go:embed rulestats.sql
+var ruleStatsSQL string
+
+// RuleStatsOptions configures EnableRuleStats
+type RuleStatsOptions struct {
+	// FlushInterval is how often counts are written to rule_hit_stats;
+	// default 10s
+	FlushInterval time.Duration
+}
+
+// hitKey is one rule's hourly bucket
+type hitKey struct {
+	rule   string
+	bucket time.Time
+}
+
+type hitCounts struct {
+	evaluations, fired, firings, errors int64
+	actionsSucceeded, actionsFailed     int64
+	lastFiredAt                         time.Time
+}
+
+// hitRecorder accumulates rule statistics in memory and flushes them
+// periodically, so evaluations pay no extra round trip
+type hitRecorder struct {
+	db     *sql.DB
+	mu     sync.Mutex
+	counts map[hitKey]*hitCounts
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// EnableRuleStats creates rule_hit_stats if needed and makes the client
+// count, per rule and hour, how often each rule was evaluated, fired, and
+// failed, and how its actions turned out (see RecordRuleAction). Counts
+// are buffered and written every FlushInterval and by Close.
+func (c *Client) EnableRuleStats(ctx context.Context, opts RuleStatsOptions) error {
+	if c.hits != nil {
+		return fmt.Errorf("rule statistics already enabled")
+	}
+	if _, err := c.db.ExecContext(ctx, ruleStatsSQL); err != nil {
+		return fmt.Errorf("failed to install rule statistics: %w", err)
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 10 * time.Second
+	}
+	c.hits = &hitRecorder{
+		db:     c.db,
+		counts: make(map[hitKey]*hitCounts),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go c.hits.run(opts.FlushInterval)
+	return nil
+}
+
+// RecordRuleAction counts the outcome of an action produced by rule: a
+// success when err is nil, a failure otherwise. It does nothing before
+// EnableRuleStats or for an empty rule.
+func (c *Client) RecordRuleAction(rule string, err error) {
+	if c.hits == nil || rule == "" {
+		return
+	}
+	c.hits.add(rule, func(h *hitCounts) {
+		if err == nil {
+			h.actionsSucceeded++
+		} else {
+			h.actionsFailed++
+		}
+	})
+}
+
+// FlushRuleStats writes buffered rule statistics now
+func (c *Client) FlushRuleStats(ctx context.Context) error {
+	if c.hits == nil {
+		return nil
+	}
+	return c.hits.flush(ctx)
+}
+
+// recordEvaluation counts an evaluation's rules, or the rule that failed it
+func (r *hitRecorder) recordEvaluation(result *Result, err error) {
+	var evalErr *EvaluationError
+	if errors.As(err, &evalErr) {
+		r.add(evalErr.Rule, func(h *hitCounts) {
+			h.evaluations++
+			h.errors++
+		})
+		return
+	}
+	if result == nil {
+		return
+	}
+	now := time.Now()
+	for rule, firings := range result.RuleFirings {
+		r.add(rule, func(h *hitCounts) {
+			h.evaluations++
+			if firings > 0 {
+				h.fired++
+				h.firings += int64(firings)
+				h.lastFiredAt = now
+			}
+		})
+	}
+}
+
+func (r *hitRecorder) add(rule string, update func(*hitCounts)) {
+	key := hitKey{rule: rule, bucket: time.Now().UTC().Truncate(time.Hour)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.counts[key]
+	if !ok {
+		h = &hitCounts{}
+		r.counts[key] = h
+	}
+	update(h)
+}
+
+func (r *hitRecorder) run(interval time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := r.flush(ctx); err != nil {
+				log.Printf("ruleengine: failed to write rule statistics: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// flush writes and clears the buffered counts. Counts that fail to write
+// are kept for the next flush.
+func (r *hitRecorder) flush(ctx context.Context) error {
+	r.mu.Lock()
+	counts := r.counts
+	r.counts = make(map[hitKey]*hitCounts)
+	r.mu.Unlock()
+
+	var firstErr error
+	for key, h := range counts {
+		var lastFired sql.NullTime
+		if !h.lastFiredAt.IsZero() {
+			lastFired = sql.NullTime{Time: h.lastFiredAt, Valid: true}
+		}
+		_, err := r.db.ExecContext(ctx,
+			"SELECT rule_hit_stats_add($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+			key.rule, key.bucket, h.evaluations, h.fired, h.firings, h.errors,
+			h.actionsSucceeded, h.actionsFailed, lastFired,
+		)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			r.restore(key, h)
+		}
+	}
+	return firstErr
+}
+
+// restore puts counts that failed to write back into the buffer
+func (r *hitRecorder) restore(key hitKey, h *hitCounts) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.counts[key]; ok {
+		existing.merge(h)
+	} else {
+		r.counts[key] = h
+	}
+}
+
+func (h *hitCounts) merge(o *hitCounts) {
+	h.evaluations += o.evaluations
+	h.fired += o.fired
+	h.firings += o.firings
+	h.errors += o.errors
+	h.actionsSucceeded += o.actionsSucceeded
+	h.actionsFailed += o.actionsFailed
+	if o.lastFiredAt.After(h.lastFiredAt) {
+		h.lastFiredAt = o.lastFiredAt
+	}
+}
+
+// close stops the flusher and writes what is left
+func (r *hitRecorder) close() error {
+	close(r.stop)
+	<-r.done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return r.flush(ctx)
+}
+
+// Rule effectiveness flags
+const (
+	// FlagNeverFired marks an active rule that did not fire in the period
+	FlagNeverFired = "never_fired"
+
+	// FlagHighFailureRate marks a rule whose actions failed more often
+	// than RuleEffectivenessOptions.FailureRate
+	FlagHighFailureRate = "high_failure_rate"
+
+	// FlagErrors marks a rule whose evaluation failed in the period
+	FlagErrors = "errors"
+)
+
+// RuleEffectivenessOptions configures RuleEffectiveness
+type RuleEffectivenessOptions struct {
+	// Since is the start of the period; default 30 days ago
+	Since time.Time
+
+	// FailureRate is the action failure rate above which a rule is
+	// flagged; default 0.1
+	FailureRate float64
+
+	// MinActions is how many actions a rule needs before its failure rate
+	// counts; default 10
+	MinActions int64
+
+	// FlaggedOnly leaves out rules without flags
+	FlaggedOnly bool
+}
+
+// RuleEffectiveness is one rule's statistics over a period
+type RuleEffectiveness struct {
+	Rule     string `json:"rule"`
+	IsActive bool   `json:"is_active"`
+
+	Evaluations int64 `json:"evaluations"`
+	Fired       int64 `json:"fired"`   // evaluations in which it fired
+	Firings     int64 `json:"firings"` // including repeats
+	Errors      int64 `json:"errors"`
+
+	// MatchRate is Fired / Evaluations
+	MatchRate float64 `json:"match_rate"`
+
+	ActionsSucceeded int64 `json:"actions_succeeded"`
+	ActionsFailed    int64 `json:"actions_failed"`
+
+	// ActionFailureRate is ActionsFailed over all actions
+	ActionFailureRate float64 `json:"action_failure_rate"`
+
+	LastFiredAt *time.Time `json:"last_fired_at,omitempty"`
+	Flags       []string   `json:"flags"`
+}
+
+// RuleEffectiveness reports every rule in the repository with its
+// statistics since opts.Since, never-firing rules and those with high
+// failure rates flagged. Flagged rules come first, each group by name.
+func (c *Client) RuleEffectiveness(ctx context.Context, opts RuleEffectivenessOptions) ([]RuleEffectiveness, error) {
+	if opts.Since.IsZero() {
+		opts.Since = time.Now().AddDate(0, 0, -30)
+	}
+	if opts.FailureRate <= 0 {
+		opts.FailureRate = 0.1
+	}
+	if opts.MinActions <= 0 {
+		opts.MinActions = 10
+	}
+
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT rd.name, rd.is_active,
+		        COALESCE(SUM(s.evaluations), 0), COALESCE(SUM(s.fired), 0), COALESCE(SUM(s.firings), 0),
+		        COALESCE(SUM(s.errors), 0), COALESCE(SUM(s.actions_succeeded), 0), COALESCE(SUM(s.actions_failed), 0),
+		        MAX(s.last_fired_at)
+		 FROM rule_definitions rd
+		 LEFT JOIN rule_hit_stats s ON s.rule_name = rd.name AND s.bucket >= date_trunc('hour', $1::TIMESTAMPTZ)
+		 GROUP BY rd.name, rd.is_active
+		 ORDER BY rd.name`,
+		opts.Since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var flagged, rest []RuleEffectiveness
+	for rows.Next() {
+		r := RuleEffectiveness{Flags: []string{}}
+		var lastFired sql.NullTime
+		if err := rows.Scan(&r.Rule, &r.IsActive, &r.Evaluations, &r.Fired, &r.Firings, &r.Errors,
+			&r.ActionsSucceeded, &r.ActionsFailed, &lastFired); err != nil {
+			return nil, err
+		}
+		if lastFired.Valid {
+			r.LastFiredAt = &lastFired.Time
+		}
+		if r.Evaluations > 0 {
+			r.MatchRate = float64(r.Fired) / float64(r.Evaluations)
+		}
+		actions := r.ActionsSucceeded + r.ActionsFailed
+		if actions > 0 {
+			r.ActionFailureRate = float64(r.ActionsFailed) / float64(actions)
+		}
+
+		if r.IsActive && r.Fired == 0 {
+			r.Flags = append(r.Flags, FlagNeverFired)
+		}
+		if actions >= opts.MinActions && r.ActionFailureRate > opts.FailureRate {
+			r.Flags = append(r.Flags, FlagHighFailureRate)
+		}
+		if r.Errors > 0 {
+			r.Flags = append(r.Flags, FlagErrors)
+		}
+		if len(r.Flags) > 0 {
+			flagged = append(flagged, r)
+		} else if !opts.FlaggedOnly {
+			rest = append(rest, r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return append(append([]RuleEffectiveness{}, flagged...), rest...), nil
+}
+
+// RuleHitBucket is one rule's statistics for an hour or a day
+type RuleHitBucket struct {
+	Time             time.Time `json:"time"`
+	Evaluations      int64     `json:"evaluations"`
+	Fired            int64     `json:"fired"`
+	Errors           int64     `json:"errors"`
+	ActionsSucceeded int64     `json:"actions_succeeded"`
+	ActionsFailed    int64     `json:"actions_failed"`
+}
+
+// RuleHitHistory returns a rule's statistics since since, oldest first,
+// per hour or, with daily, per UTC day
+func (c *Client) RuleHitHistory(ctx context.Context, rule string, since time.Time, daily bool) ([]RuleHitBucket, error) {
+	unit := "hour"
+	if daily {
+		unit = "day"
+	}
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT date_trunc($3, bucket AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+		        SUM(evaluations), SUM(fired), SUM(errors), SUM(actions_succeeded), SUM(actions_failed)
+		 FROM rule_hit_stats
+		 WHERE rule_name = $1 AND bucket >= $2
+		 GROUP BY 1 ORDER BY 1`,
+		rule, since, unit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []RuleHitBucket{}
+	for rows.Next() {
+		var b RuleHitBucket
+		if err := rows.Scan(&b.Time, &b.Evaluations, &b.Fired, &b.Errors, &b.ActionsSucceeded, &b.ActionsFailed); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
@@ -0,0 +1,42 @@
+-- Rule effectiveness statistics (see EnableRuleStats). Evaluations made by
+-- the SDK add hourly per-rule counts of evaluations, firings, and errors;
+-- the NATS webhook worker adds the outcomes of actions whose messages name
+-- the rule that produced them.
+
+CREATE TABLE IF NOT EXISTS rule_hit_stats (
+    rule_name TEXT NOT NULL,
+    bucket TIMESTAMPTZ NOT NULL,
+    evaluations BIGINT NOT NULL DEFAULT 0,
+    fired BIGINT NOT NULL DEFAULT 0,
+    firings BIGINT NOT NULL DEFAULT 0,
+    errors BIGINT NOT NULL DEFAULT 0,
+    actions_succeeded BIGINT NOT NULL DEFAULT 0,
+    actions_failed BIGINT NOT NULL DEFAULT 0,
+    last_fired_at TIMESTAMPTZ,
+    PRIMARY KEY (rule_name, bucket)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rule_hit_stats_bucket ON rule_hit_stats (bucket);
+
+-- Adds counts to one rule's bucket
+CREATE OR REPLACE FUNCTION rule_hit_stats_add(
+    p_rule TEXT, p_bucket TIMESTAMPTZ, p_evaluations BIGINT, p_fired BIGINT, p_firings BIGINT,
+    p_errors BIGINT, p_actions_succeeded BIGINT, p_actions_failed BIGINT, p_last_fired_at TIMESTAMPTZ)
+RETURNS VOID AS $$
+    INSERT INTO rule_hit_stats AS s (rule_name, bucket, evaluations, fired, firings, errors,
+                                     actions_succeeded, actions_failed, last_fired_at)
+    VALUES (p_rule, date_trunc('hour', p_bucket), p_evaluations, p_fired, p_firings, p_errors,
+            p_actions_succeeded, p_actions_failed, p_last_fired_at)
+    ON CONFLICT (rule_name, bucket) DO UPDATE SET
+        evaluations = s.evaluations + EXCLUDED.evaluations,
+        fired = s.fired + EXCLUDED.fired,
+        firings = s.firings + EXCLUDED.firings,
+        errors = s.errors + EXCLUDED.errors,
+        actions_succeeded = s.actions_succeeded + EXCLUDED.actions_succeeded,
+        actions_failed = s.actions_failed + EXCLUDED.actions_failed,
+        last_fired_at = GREATEST(s.last_fired_at, EXCLUDED.last_fired_at)
+$$ LANGUAGE sql;
+
+COMMENT ON TABLE rule_hit_stats IS 'Hourly per-rule evaluations, firings, errors, and action outcomes';
+COMMENT ON COLUMN rule_hit_stats.fired IS 'Evaluations in which the rule fired at least once';
+COMMENT ON COLUMN rule_hit_stats.firings IS 'Times the rule fired, counting repeats within an evaluation';
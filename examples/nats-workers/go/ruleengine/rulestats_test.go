@@ -0,0 +1,239 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newHitRecorder returns a recorder without its flusher
+func newHitRecorder(client *Client) *hitRecorder {
+	return &hitRecorder{db: client.db, counts: make(map[hitKey]*hitCounts)}
+}
+
+// hitCountsOf returns rule's counts in the current hour, without the time
+// it last fired
+func hitCountsOf(r *hitRecorder, rule string) hitCounts {
+	h := r.counts[hitKey{rule: rule, bucket: time.Now().UTC().Truncate(time.Hour)}]
+	if h == nil {
+		return hitCounts{}
+	}
+	c := *h
+	c.lastFiredAt = time.Time{}
+	return c
+}
+
+func TestHitRecorderRecordEvaluation(t *testing.T) {
+	tests := []struct {
+		name   string
+		result *Result
+		err    error
+		want   map[string]hitCounts
+	}{
+		{name: "fired and not fired", result: &Result{RuleFirings: map[string]int{"A": 2, "B": 0}},
+			want: map[string]hitCounts{"A": {evaluations: 1, fired: 1, firings: 2}, "B": {evaluations: 1}}},
+		{name: "failed rule", err: &EvaluationError{Rule: "C", Err: errors.New("bad")},
+			want: map[string]hitCounts{"C": {evaluations: 1, errors: 1}}},
+		{name: "other errors count nothing", err: errors.New("connection refused"), want: map[string]hitCounts{}},
+		{name: "cached results without firings", result: &Result{}, want: map[string]hitCounts{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newMock(t)
+			r := newHitRecorder(client)
+			r.recordEvaluation(tt.result, tt.err)
+			got := map[string]hitCounts{}
+			for key := range r.counts {
+				got[key.rule] = hitCountsOf(r, key.rule)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("counts = %+v, want %+v", got, tt.want)
+			}
+			if tt.result != nil && tt.result.RuleFirings["A"] > 0 && r.counts[hitKey{"A", time.Now().UTC().Truncate(time.Hour)}].lastFiredAt.IsZero() {
+				t.Fatal("last fired time not set")
+			}
+		})
+	}
+}
+
+func TestRecordRuleAction(t *testing.T) {
+	client, _ := newMock(t)
+	// Before EnableRuleStats it does nothing
+	client.RecordRuleAction("A", nil)
+
+	client.hits = newHitRecorder(client)
+	client.RecordRuleAction("A", nil)
+	client.RecordRuleAction("A", errors.New("timeout"))
+	client.RecordRuleAction("A", nil)
+	client.RecordRuleAction("", nil)
+	if got := hitCountsOf(client.hits, "A"); got != (hitCounts{actionsSucceeded: 2, actionsFailed: 1}) {
+		t.Fatalf("counts = %+v", got)
+	}
+	if len(client.hits.counts) != 1 {
+		t.Fatalf("counts = %+v", client.hits.counts)
+	}
+}
+
+func TestHitRecorderFlush(t *testing.T) {
+	client, mock := newMock(t)
+	r := newHitRecorder(client)
+	bucket := time.Now().UTC().Truncate(time.Hour)
+	r.recordEvaluation(&Result{RuleFirings: map[string]int{"A": 3}}, nil)
+	r.add("A", func(h *hitCounts) { h.actionsFailed++ })
+
+	mock.ExpectExec(`SELECT rule_hit_stats_add\(\$1, \$2, \$3, \$4, \$5, \$6, \$7, \$8, \$9\)`).
+		WithArgs("A", bucket, int64(1), int64(1), int64(3), int64(0), int64(0), int64(1), sqlmock.AnyArg()).
+		WillReturnError(errors.New("connection refused"))
+	if err := r.flush(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	// Failed counts are kept and merged with new ones
+	r.recordEvaluation(&Result{RuleFirings: map[string]int{"A": 1}}, nil)
+	if got := hitCountsOf(r, "A"); got != (hitCounts{evaluations: 2, fired: 2, firings: 4, actionsFailed: 1}) {
+		t.Fatalf("counts = %+v", got)
+	}
+
+	mock.ExpectExec(`rule_hit_stats_add`).
+		WithArgs("A", bucket, int64(2), int64(2), int64(4), int64(0), int64(0), int64(1), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := r.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.counts) != 0 {
+		t.Fatalf("counts left after flush: %+v", r.counts)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHitCountsMerge(t *testing.T) {
+	early, late := time.Unix(100, 0), time.Unix(200, 0)
+	h := hitCounts{evaluations: 1, fired: 1, firings: 1, errors: 1, actionsSucceeded: 1, actionsFailed: 1, lastFiredAt: late}
+	h.merge(&hitCounts{evaluations: 2, fired: 2, firings: 2, errors: 2, actionsSucceeded: 2, actionsFailed: 2, lastFiredAt: early})
+	want := hitCounts{evaluations: 3, fired: 3, firings: 3, errors: 3, actionsSucceeded: 3, actionsFailed: 3, lastFiredAt: late}
+	if h != want {
+		t.Fatalf("merged = %+v", h)
+	}
+}
+
+func TestRuleEffectiveness(t *testing.T) {
+	lastFired := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"name", "is_active", "evaluations", "fired", "firings", "errors",
+			"actions_succeeded", "actions_failed", "last_fired_at"}).
+			AddRow("Broken", true, 10, 0, 0, 3, 0, 0, nil).            // errors and never fired
+			AddRow("FewActions", true, 10, 5, 5, 0, 1, 4, lastFired).  // 80% failures, but few actions
+			AddRow("Flaky", true, 20, 10, 20, 0, 8, 12, lastFired).    // 60% failures
+			AddRow("Healthy", true, 100, 50, 60, 0, 45, 5, lastFired). // 10% is not above the rate
+			AddRow("Inactive", false, 0, 0, 0, 0, 0, 0, nil).          // not active, so not unused
+			AddRow("Never", true, 40, 0, 0, 0, 0, 0, nil)
+	}
+	tests := []struct {
+		name string
+		opts RuleEffectivenessOptions
+		want []string // "rule [flags]", flagged rules first
+	}{
+		{name: "defaults",
+			want: []string{"Broken [never_fired errors]", "Flaky [high_failure_rate]", "Never [never_fired]",
+				"FewActions []", "Healthy []", "Inactive []"}},
+		{name: "flagged only, with fewer actions", opts: RuleEffectivenessOptions{Since: lastFired, MinActions: 5, FlaggedOnly: true},
+			want: []string{"Broken [never_fired errors]", "FewActions [high_failure_rate]", "Flaky [high_failure_rate]",
+				"Never [never_fired]"}},
+		{name: "higher failure rate", opts: RuleEffectivenessOptions{Since: lastFired, FailureRate: 0.7, FlaggedOnly: true},
+			want: []string{"Broken [never_fired errors]", "Never [never_fired]"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			var since interface{} = tt.opts.Since
+			if tt.opts.Since.IsZero() {
+				since = sqlmock.AnyArg() // 30 days ago
+			}
+			mock.ExpectQuery(`FROM rule_definitions rd\s+LEFT JOIN rule_hit_stats s`).WithArgs(since).WillReturnRows(rows())
+			report, err := client.RuleEffectiveness(context.Background(), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range report {
+				got = append(got, fmt.Sprintf("%s %v", r.Rule, r.Flags))
+				if r.Rule == "Flaky" && (r.MatchRate != 0.5 || r.ActionFailureRate != 0.6 || !r.LastFiredAt.Equal(lastFired)) {
+					t.Errorf("Flaky = %+v", r)
+				}
+				if r.Rule == "Never" && (r.MatchRate != 0 || r.ActionFailureRate != 0 || r.LastFiredAt != nil) {
+					t.Errorf("Never = %+v", r)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("report = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleHitHistory(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, daily := range []bool{false, true} {
+		unit := map[bool]string{false: "hour", true: "day"}[daily]
+		client, mock := newMock(t)
+		mock.ExpectQuery(`SELECT date_trunc\(\$3, bucket AT TIME ZONE 'UTC'\) AT TIME ZONE 'UTC'`).WithArgs("A", since, unit).
+			WillReturnRows(sqlmock.NewRows([]string{"time", "evaluations", "fired", "errors", "succeeded", "failed"}).
+				AddRow(since, 10, 4, 1, 3, 1))
+		buckets, err := client.RuleHitHistory(context.Background(), "A", since, daily)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []RuleHitBucket{{Time: since, Evaluations: 10, Fired: 4, Errors: 1, ActionsSucceeded: 3, ActionsFailed: 1}}
+		if !reflect.DeepEqual(buckets, want) {
+			t.Fatalf("%s buckets = %+v", unit, buckets)
+		}
+	}
+}
+
+func TestEvaluateRuleStats(t *testing.T) {
+	client, mock := newMock(t)
+	client.cache = cachedRuleSet(`rule A "" { when Order.total > 1000 then Order.flagged = true; }`)
+	client.hits = newHitRecorder(client)
+
+	expectDebugRun(mock, "s1", `{"Order":{"total":1200,"flagged":true}}`, "A")
+	expectDebugRun(mock, "s2", `{"Order":{"total":1200,"flagged":true}}`)
+	result, err := client.Evaluate(context.Background(), 7, map[string]interface{}{"Order": map[string]interface{}{"total": 1200}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"A": 1, "B": 0}; !reflect.DeepEqual(result.RuleFirings, want) {
+		t.Fatalf("firings = %v", result.RuleFirings)
+	}
+	if a, b := hitCountsOf(client.hits, "A"), hitCountsOf(client.hits, "B"); a != (hitCounts{evaluations: 1, fired: 1, firings: 1}) ||
+		b != (hitCounts{evaluations: 1}) {
+		t.Fatalf("counts = %+v, %+v", a, b)
+	}
+
+	// Explained evaluations are not counted
+	expectDebugRun(mock, "s3", `{}`)
+	expectDebugRun(mock, "s4", `{}`)
+	if _, err := client.EvaluateWithOptions(context.Background(), 7, map[string]interface{}{}, EvaluateOptions{Explain: true}); err != nil {
+		t.Fatal(err)
+	}
+	if a := hitCountsOf(client.hits, "A"); a.evaluations != 1 {
+		t.Fatalf("counts = %+v", a)
+	}
+
+	// A failing member counts an error
+	mock.ExpectQuery(`run_rule_engine_debug`).WillReturnError(errors.New("pq: rule engine error: bad facts"))
+	if _, err := client.Evaluate(context.Background(), 7, map[string]interface{}{}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if a := hitCountsOf(client.hits, "A"); a.evaluations != 2 || a.errors != 1 {
+		t.Fatalf("counts = %+v", a)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
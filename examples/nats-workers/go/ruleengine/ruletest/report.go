@@ -0,0 +1,65 @@
+package ruletest
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// SuiteReport is the outcome of one suite, i.e. one rule or rule set
+type SuiteReport struct {
+	Name   string       `json:"name"`
+	Target string       `json:"target"`
+	Passed int          `json:"passed"`
+	Failed int          `json:"failed"`
+	Cases  []CaseResult `json:"cases"`
+}
+
+// CaseResult is the outcome of one case
+type CaseResult struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Failures []string      `json:"failures,omitempty"`
+	Fired    []string      `json:"fired,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Report collects suite reports
+type Report struct {
+	Suites []*SuiteReport `json:"suites"`
+	Passed int            `json:"passed"`
+	Failed int            `json:"failed"`
+}
+
+// Add appends a suite report and updates the totals
+func (r *Report) Add(s *SuiteReport) {
+	r.Suites = append(r.Suites, s)
+	r.Passed += s.Passed
+	r.Failed += s.Failed
+}
+
+// OK reports whether every case passed
+func (r *Report) OK() bool {
+	return r.Failed == 0
+}
+
+// WriteText prints a per-rule summary with the failures of each case
+func (r *Report) WriteText(w io.Writer) {
+	for _, s := range r.Suites {
+		status := "ok  "
+		if s.Failed > 0 {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%s %s (%s): %d passed, %d failed\n", status, s.Name, s.Target, s.Passed, s.Failed)
+		for _, c := range s.Cases {
+			if c.Passed {
+				continue
+			}
+			fmt.Fprintf(w, "     ✗ %s\n", c.Name)
+			for _, f := range c.Failures {
+				fmt.Fprintf(w, "         %s\n", f)
+			}
+		}
+	}
+	fmt.Fprintf(w, "\n%d passed, %d failed\n", r.Passed, r.Failed)
+}
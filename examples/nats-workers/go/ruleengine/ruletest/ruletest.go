@@ -0,0 +1,316 @@
+// Package ruletest runs unit tests for business rules: fact fixtures with
+// expected fired rules and resulting facts, evaluated by the rule engine in
+// a real Postgres database.
+//
+// Suites are usually YAML files next to the rules they cover:
+//
+//	rule: HighValueOrder
+//	cases:
+//	  - name: flags large orders
+//	    facts: {Order: {Amount: 20000}}
+//	    expect:
+//	      fired: [HighValueOrder]
+//	      facts: {Order.Flagged: true}
+//
+// and run from a Go test with RunFiles, or with "rulectl test".
+package ruletest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// Suite is a set of cases against one target: a stored rule (Rule, at
+// Version or its active version), inline GRL, a GRL file, or a rule set.
+// Rules are evaluated with DryRun, so nothing is persisted; rule sets are
+// evaluated with Evaluate.
+type Suite struct {
+	Name    string `yaml:"name,omitempty"`
+	Rule    string `yaml:"rule,omitempty"`
+	Version string `yaml:"version,omitempty"`
+	GRL     string `yaml:"grl,omitempty"`
+	GRLFile string `yaml:"grl_file,omitempty"` // Relative to the suite file
+	RuleSet int    `yaml:"ruleset,omitempty"`
+	Cases   []Case `yaml:"cases"`
+
+	path string
+}
+
+// Case is one fact fixture and what evaluating it must produce
+type Case struct {
+	Name   string                 `yaml:"name"`
+	Facts  map[string]interface{} `yaml:"facts"`
+	Expect Expectation            `yaml:"expect"`
+}
+
+// Expectation lists assertions on a case's result. Empty fields are not
+// checked.
+type Expectation struct {
+	// Fired rules must each fire at least once
+	Fired []string `yaml:"fired,omitempty"`
+
+	// NotFired rules must not fire
+	NotFired []string `yaml:"not_fired,omitempty"`
+
+	// FiredExactly, when set, must equal the fired rules in order
+	FiredExactly []string `yaml:"fired_exactly,omitempty"`
+
+	// Actions must each appear among executed actions, as "Rule: action" or
+	// just the action text
+	Actions []string `yaml:"actions,omitempty"`
+
+	// Facts maps dotted paths (Order.Discount) to expected values; a null
+	// value asserts the path is absent
+	Facts map[string]interface{} `yaml:"facts,omitempty"`
+
+	// Error, when set, expects evaluation to fail with a message containing
+	// it
+	Error string `yaml:"error,omitempty"`
+}
+
+// Load reads a YAML suite file
+func Load(path string) (*Suite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Suite
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	s.path = path
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return &s, nil
+}
+
+// LoadGlob loads every suite file matching pattern, in name order
+func LoadGlob(pattern string) ([]*Suite, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no suite files match %s", pattern)
+	}
+	suites := make([]*Suite, 0, len(paths))
+	for _, path := range paths {
+		s, err := Load(path)
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, s)
+	}
+	return suites, nil
+}
+
+// target describes what a suite evaluates, for reports
+func (s *Suite) target() string {
+	switch {
+	case s.RuleSet != 0:
+		return fmt.Sprintf("rule set %d", s.RuleSet)
+	case s.Rule != "" && s.Version != "":
+		return s.Rule + "@" + s.Version
+	case s.Rule != "":
+		return s.Rule
+	case s.GRLFile != "":
+		return s.GRLFile
+	default:
+		return "inline GRL"
+	}
+}
+
+// evaluator returns a function evaluating one fixture against the suite's
+// target
+func (s *Suite) evaluator(ctx context.Context, client *ruleengine.Client) (func(facts map[string]interface{}) (*ruleengine.Result, error), error) {
+	if s.RuleSet != 0 {
+		return func(facts map[string]interface{}) (*ruleengine.Result, error) {
+			return client.Evaluate(ctx, s.RuleSet, facts)
+		}, nil
+	}
+
+	grl := s.GRL
+	switch {
+	case grl != "":
+	case s.GRLFile != "":
+		path := s.GRLFile
+		if !filepath.IsAbs(path) && s.path != "" {
+			path = filepath.Join(filepath.Dir(s.path), path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		grl = string(data)
+	case s.Rule != "" && s.Version != "":
+		v, err := client.GetVersion(ctx, s.Rule, s.Version)
+		if err != nil {
+			return nil, err
+		}
+		grl = v.GRL
+	case s.Rule != "":
+		r, err := client.GetRule(ctx, s.Rule)
+		if err != nil {
+			return nil, err
+		}
+		grl = r.GRL
+	default:
+		return nil, fmt.Errorf("suite %s: set one of rule, grl, grl_file, or ruleset", s.Name)
+	}
+
+	return func(facts map[string]interface{}) (*ruleengine.Result, error) {
+		return client.DryRun(ctx, grl, facts)
+	}, nil
+}
+
+// Run evaluates every case of the suite and reports the outcome. An error
+// is returned only when the target itself cannot be loaded.
+func Run(ctx context.Context, client *ruleengine.Client, s *Suite) (*SuiteReport, error) {
+	report := &SuiteReport{Name: s.Name, Target: s.target(), Cases: []CaseResult{}}
+	eval, err := s.evaluator(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, c := range s.Cases {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("case %d", i+1)
+		}
+		start := time.Now()
+		facts := c.Facts
+		if facts == nil {
+			facts = map[string]interface{}{}
+		}
+		result, err := eval(facts)
+		cr := CaseResult{Name: name, Failures: check(c.Expect, result, err)}
+		cr.Duration = time.Since(start)
+		cr.Passed = len(cr.Failures) == 0
+		if result != nil {
+			cr.Fired = result.MatchedRules
+		}
+		if cr.Passed {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+		report.Cases = append(report.Cases, cr)
+	}
+	return report, nil
+}
+
+// check returns a message for every unmet expectation
+func check(want Expectation, result *ruleengine.Result, err error) []string {
+	var failures []string
+	if want.Error != "" {
+		if err == nil {
+			return []string{fmt.Sprintf("expected an error containing %q, evaluation succeeded", want.Error)}
+		}
+		if !strings.Contains(err.Error(), want.Error) {
+			return []string{fmt.Sprintf("expected an error containing %q, got %v", want.Error, err)}
+		}
+		return nil
+	}
+	if err != nil {
+		return []string{fmt.Sprintf("evaluation failed: %v", err)}
+	}
+
+	fired := map[string]bool{}
+	for _, name := range result.MatchedRules {
+		fired[name] = true
+	}
+	for _, name := range want.Fired {
+		if !fired[name] {
+			failures = append(failures, fmt.Sprintf("expected %s to fire; fired %v", name, result.MatchedRules))
+		}
+	}
+	for _, name := range want.NotFired {
+		if fired[name] {
+			failures = append(failures, fmt.Sprintf("expected %s not to fire", name))
+		}
+	}
+	if want.FiredExactly != nil && !reflect.DeepEqual(want.FiredExactly, result.MatchedRules) {
+		failures = append(failures, fmt.Sprintf("expected fired rules %v, got %v", want.FiredExactly, result.MatchedRules))
+	}
+
+	for _, action := range want.Actions {
+		found := false
+		for _, a := range result.Actions {
+			if a.Action == action || a.Rule+": "+a.Action == action {
+				found = true
+				break
+			}
+		}
+		if !found {
+			failures = append(failures, fmt.Sprintf("expected action %q", action))
+		}
+	}
+
+	for path, expected := range want.Facts {
+		actual, ok := lookup(result.Facts, path)
+		if expected == nil {
+			if ok {
+				failures = append(failures, fmt.Sprintf("expected %s to be absent, got %s", path, encode(actual)))
+			}
+			continue
+		}
+		if !ok {
+			failures = append(failures, fmt.Sprintf("expected %s = %s, path not found", path, encode(expected)))
+			continue
+		}
+		if !equalJSON(expected, actual) {
+			failures = append(failures, fmt.Sprintf("expected %s = %s, got %s", path, encode(expected), encode(actual)))
+		}
+	}
+	return failures
+}
+
+// lookup resolves a dotted path in a JSON object
+func lookup(facts map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = facts
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// equalJSON compares values by their JSON form, so YAML's 10 equals the
+// engine's 10.0
+func equalJSON(a, b interface{}) bool {
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+func normalize(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out interface{}
+	json.Unmarshal(data, &out)
+	return out
+}
+
+func encode(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
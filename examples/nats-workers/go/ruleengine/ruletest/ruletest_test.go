@@ -0,0 +1,124 @@
+package ruletest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+func TestCheck(t *testing.T) {
+	result := &ruleengine.Result{
+		MatchedRules: []string{"A", "B"},
+		Actions:      []ruleengine.Action{{Rule: "A", Action: "Order.Flagged = true"}},
+		Facts: map[string]interface{}{
+			"Order": map[string]interface{}{"Amount": 20000.0, "Flagged": true, "Tags": []interface{}{"vip"}},
+		},
+	}
+	tests := []struct {
+		name   string
+		want   Expectation
+		err    error
+		failed int
+	}{
+		{name: "nothing expected"},
+		{name: "fired", want: Expectation{Fired: []string{"A", "B"}}},
+		{name: "not fired", want: Expectation{Fired: []string{"C"}, NotFired: []string{"B"}}, failed: 2},
+		{name: "fired exactly", want: Expectation{FiredExactly: []string{"A", "B"}}},
+		{name: "fired exactly out of order", want: Expectation{FiredExactly: []string{"B", "A"}}, failed: 1},
+		{name: "action text", want: Expectation{Actions: []string{"Order.Flagged = true", "A: Order.Flagged = true"}}},
+		{name: "action of other rule", want: Expectation{Actions: []string{"B: Order.Flagged = true"}}, failed: 1},
+		{name: "facts", want: Expectation{Facts: map[string]interface{}{
+			"Order.Amount": 20000, "Order.Flagged": true, "Order.Tags": []interface{}{"vip"}, "Order.Missing": nil}}},
+		{name: "wrong and missing facts", want: Expectation{Facts: map[string]interface{}{
+			"Order.Amount": 1, "Order.Nope": "x", "Order.Flagged": nil}}, failed: 3},
+		{name: "expected error", want: Expectation{Error: "syntax"}, err: errors.New("GRL syntax error")},
+		{name: "wrong error", want: Expectation{Error: "syntax"}, err: errors.New("timeout"), failed: 1},
+		{name: "expected error missing", want: Expectation{Error: "syntax"}, failed: 1},
+		{name: "unexpected error", want: Expectation{Fired: []string{"A"}}, err: errors.New("boom"), failed: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := result
+			if tt.err != nil {
+				r = nil
+			}
+			if got := check(tt.want, r, tt.err); len(got) != tt.failed {
+				t.Fatalf("failures = %q, want %d", got, tt.failed)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "high_value.yaml"), []byte(`
+rule: HighValueOrder
+grl_file: high_value.grl
+cases:
+  - name: flags large orders
+    facts: {Order: {Amount: 20000}}
+    expect:
+      fired: [HighValueOrder]
+      facts: {Order.Flagged: true}
+`), 0o644)
+	os.WriteFile(filepath.Join(dir, "b.yaml"), []byte("ruleset: 3\ncases: []\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "high_value.grl"), []byte("rule HighValueOrder {}"), 0o644)
+
+	suites, err := LoadGlob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suites) != 2 || suites[0].Name != "b" || suites[1].Name != "high_value" {
+		t.Fatalf("suites = %+v", suites)
+	}
+	s := suites[1]
+	if s.target() != "HighValueOrder" || suites[0].target() != "rule set 3" {
+		t.Fatalf("targets = %q, %q", s.target(), suites[0].target())
+	}
+	c := s.Cases[0]
+	if c.Expect.Facts["Order.Flagged"] != true || c.Expect.Fired[0] != "HighValueOrder" {
+		t.Fatalf("case = %+v", c)
+	}
+
+	// grl_file is read relative to the suite file, before any rule lookup
+	if _, err := s.evaluator(context.Background(), ruleengine.New(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Suite{Name: "empty"}).evaluator(context.Background(), ruleengine.New(nil)); err == nil {
+		t.Fatal("suite without a target was accepted")
+	}
+
+	if _, err := LoadGlob(filepath.Join(dir, "*.json")); err == nil {
+		t.Fatal("empty glob was accepted")
+	}
+}
+
+func TestReportWriteText(t *testing.T) {
+	var r Report
+	r.Add(&SuiteReport{Name: "a", Target: "A", Passed: 2})
+	r.Add(&SuiteReport{Name: "b", Target: "rule set 1", Passed: 1, Failed: 1, Cases: []CaseResult{
+		{Name: "ok", Passed: true},
+		{Name: "broken", Failures: []string{"expected B to fire; fired []"}},
+	}})
+	if r.OK() || r.Passed != 3 || r.Failed != 1 {
+		t.Fatalf("totals = %+v", r)
+	}
+
+	var buf bytes.Buffer
+	r.WriteText(&buf)
+	out := buf.String()
+	for _, want := range []string{"ok   a (A): 2 passed, 0 failed", "FAIL b (rule set 1)", "✗ broken", "expected B to fire", "3 passed, 1 failed"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report is missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "✗ ok") {
+		t.Error("passing case listed as a failure")
+	}
+}
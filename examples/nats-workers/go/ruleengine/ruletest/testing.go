@@ -0,0 +1,67 @@
+package ruletest
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// DatabaseURLEnv names the variable OpenDB reads
+const DatabaseURLEnv = "RULETEST_DATABASE_URL"
+
+// OpenDB connects to the Postgres instance in RULETEST_DATABASE_URL (with
+// the extension installed), or skips the test when it is unset. The
+// connection is closed when the test ends. driver is a database/sql driver
+// name such as "postgres"; import the driver in the test.
+func OpenDB(t testing.TB, driver string) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv(DatabaseURLEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", DatabaseURLEnv)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Fatalf("connect to database: %v", err)
+	}
+	return db
+}
+
+// RunFiles runs every suite file matching pattern as a subtest per suite
+// and case, so "go test -run" can select them and failures are reported
+// per rule
+func RunFiles(t *testing.T, client *ruleengine.Client, pattern string) {
+	t.Helper()
+	suites, err := LoadGlob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range suites {
+		RunSuite(t, client, s)
+	}
+}
+
+// RunSuite runs one suite as subtests
+func RunSuite(t *testing.T, client *ruleengine.Client, s *Suite) {
+	t.Helper()
+	t.Run(s.Name, func(t *testing.T) {
+		report, err := Run(context.Background(), client, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range report.Cases {
+			c := c
+			t.Run(c.Name, func(t *testing.T) {
+				for _, f := range c.Failures {
+					t.Error(f)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,502 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//go:embed schedules.sql
+var schedulesSQL string
+
+// ErrScheduleNotFound is returned for an unknown schedule name
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// Catch-up policies decide what happens to runs that came due while no
+// worker was running
+const (
+	// CatchUpSkip records missed runs as skipped and waits for the next one
+	CatchUpSkip = "skip"
+
+	// CatchUpOnce runs the most recent missed run and skips the rest
+	CatchUpOnce = "once"
+
+	// CatchUpAll runs every missed run, oldest first, up to MaxCatchUp
+	CatchUpAll = "all"
+)
+
+// Run statuses
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	RunSkipped   = "skipped"
+)
+
+// scheduleGrace is how late a run may start before it counts as missed
+const scheduleGrace = 2 * time.Minute
+
+// Schedule evaluates a rule set at the times a cron expression gives
+type Schedule struct {
+	Name      string `json:"name"`
+	RuleSetID int    `json:"ruleset_id"`
+
+	// Cron is a five-field expression ("0 6 * * mon-fri") or a macro
+	// such as @hourly, evaluated in Timezone (default UTC)
+	Cron     string `json:"cron"`
+	Timezone string `json:"timezone"`
+
+	// Facts is the fact document each run evaluates. Runs add a Schedule
+	// fact with name, scheduled_for, and catch_up.
+	Facts map[string]interface{} `json:"facts"`
+
+	// CatchUp is CatchUpSkip, CatchUpOnce (default), or CatchUpAll
+	CatchUp string `json:"catch_up"`
+
+	// MaxCatchUp bounds how many missed runs are recorded (default 100)
+	MaxCatchUp int `json:"max_catch_up"`
+
+	Enabled   bool       `json:"enabled"`
+	NextRunAt time.Time  `json:"next_run_at"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ScheduleRun is one recorded run of a schedule
+type ScheduleRun struct {
+	ID           int64     `json:"id"`
+	Schedule     string    `json:"schedule"`
+	ScheduledFor time.Time `json:"scheduled_for"`
+	Status       string    `json:"status"`
+
+	// CatchUp is set for runs that started after they were missed
+	CatchUp      bool            `json:"catch_up"`
+	Worker       string          `json:"worker,omitempty"`
+	MatchedRules []string        `json:"matched_rules,omitempty"`
+	Facts        json.RawMessage `json:"facts,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	StartedAt    time.Time       `json:"started_at"`
+	FinishedAt   *time.Time      `json:"finished_at,omitempty"`
+}
+
+// EnableSchedules creates the schedule and run tables if needed. It is
+// idempotent.
+func (c *Client) EnableSchedules(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, schedulesSQL); err != nil {
+		return fmt.Errorf("failed to install schedules: %w", err)
+	}
+	return nil
+}
+
+// CreateSchedule registers s; its first run is the next time its cron
+// expression matches
+func (c *Client) CreateSchedule(ctx context.Context, s Schedule) error {
+	if s.Name == "" {
+		return &ValidationError{Field: "name", Message: "is required"}
+	}
+	if s.RuleSetID <= 0 {
+		return &ValidationError{Field: "ruleset_id", Message: "is required"}
+	}
+	if s.Timezone == "" {
+		s.Timezone = "UTC"
+	}
+	if s.CatchUp == "" {
+		s.CatchUp = CatchUpOnce
+	}
+	if s.MaxCatchUp == 0 {
+		s.MaxCatchUp = 100
+	}
+	if s.Facts == nil {
+		s.Facts = map[string]interface{}{}
+	}
+	switch s.CatchUp {
+	case CatchUpSkip, CatchUpOnce, CatchUpAll:
+	default:
+		return &ValidationError{Field: "catch_up", Message: fmt.Sprintf("must be %s, %s, or %s", CatchUpSkip, CatchUpOnce, CatchUpAll)}
+	}
+	if s.MaxCatchUp < 0 {
+		return &ValidationError{Field: "max_catch_up", Message: "must not be negative"}
+	}
+	next, err := nextScheduleRun(s.Cron, s.Timezone, time.Now())
+	if err != nil {
+		return err
+	}
+	facts, err := json.Marshal(s.Facts)
+	if err != nil {
+		return fmt.Errorf("failed to encode facts: %w", err)
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO rule_schedules (name, ruleset_id, cron, timezone, facts, catch_up, max_catch_up, next_run_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		s.Name, s.RuleSetID, s.Cron, s.Timezone, facts, s.CatchUp, s.MaxCatchUp, next,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// nextScheduleRun validates a cron expression and time zone and returns
+// the first matching time after after
+func nextScheduleRun(expr, timezone string, after time.Time) (time.Time, error) {
+	cron, err := parseCron(expr)
+	if err != nil {
+		return time.Time{}, &ValidationError{Field: "cron", Message: err.Error()}
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, &ValidationError{Field: "timezone", Message: fmt.Sprintf("unknown time zone %q", timezone)}
+	}
+	next := cron.next(after.In(loc))
+	if next.IsZero() {
+		return time.Time{}, &ValidationError{Field: "cron", Message: "never matches"}
+	}
+	return next, nil
+}
+
+const scheduleColumns = `name, ruleset_id, cron, timezone, facts, catch_up, max_catch_up,
+	enabled, next_run_at, last_run_at, created_at`
+
+func scanSchedule(row interface{ Scan(...interface{}) error }) (*Schedule, error) {
+	var s Schedule
+	var facts []byte
+	var lastRun sql.NullTime
+	if err := row.Scan(&s.Name, &s.RuleSetID, &s.Cron, &s.Timezone, &facts, &s.CatchUp, &s.MaxCatchUp,
+		&s.Enabled, &s.NextRunAt, &lastRun, &s.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(facts, &s.Facts); err != nil {
+		return nil, fmt.Errorf("schedule %s has invalid facts: %w", s.Name, err)
+	}
+	if lastRun.Valid {
+		s.LastRunAt = &lastRun.Time
+	}
+	return &s, nil
+}
+
+// GetSchedule returns one schedule
+func (c *Client) GetSchedule(ctx context.Context, name string) (*Schedule, error) {
+	s, err := scanSchedule(c.db.QueryRowContext(ctx,
+		"SELECT "+scheduleColumns+" FROM rule_schedules WHERE name = $1", name,
+	))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s: %w", name, ErrScheduleNotFound)
+	}
+	return s, err
+}
+
+// ListSchedules returns all schedules by name
+func (c *Client) ListSchedules(ctx context.Context) ([]Schedule, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT "+scheduleColumns+" FROM rule_schedules ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []Schedule{}
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, *s)
+	}
+	return schedules, rows.Err()
+}
+
+// SetScheduleEnabled pauses or resumes a schedule. Times that pass while a
+// schedule is paused are not missed runs: a resumed schedule next runs the
+// next time its cron expression matches.
+func (c *Client) SetScheduleEnabled(ctx context.Context, name string, enabled bool) error {
+	s, err := c.GetSchedule(ctx, name)
+	if err != nil {
+		return err
+	}
+	next, err := nextScheduleRun(s.Cron, s.Timezone, time.Now())
+	if err != nil {
+		return err
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE rule_schedules SET enabled = $2,
+		     next_run_at = CASE WHEN $2 AND NOT enabled THEN $3 ELSE next_run_at END
+		 WHERE name = $1`,
+		name, enabled, next,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", name, ErrScheduleNotFound)
+	}
+	return tx.Commit()
+}
+
+// DeleteSchedule removes a schedule and its run history
+func (c *Client) DeleteSchedule(ctx context.Context, name string) error {
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM rule_schedules WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", name, ErrScheduleNotFound)
+	}
+	return tx.Commit()
+}
+
+const scheduleRunColumns = `run_id, schedule, scheduled_for, status, catch_up, COALESCE(worker, ''),
+	matched_rules, result, COALESCE(error, ''), started_at, finished_at`
+
+func scanScheduleRun(row interface{ Scan(...interface{}) error }) (*ScheduleRun, error) {
+	var r ScheduleRun
+	var facts []byte
+	var finished sql.NullTime
+	if err := row.Scan(&r.ID, &r.Schedule, &r.ScheduledFor, &r.Status, &r.CatchUp, &r.Worker,
+		pq.Array(&r.MatchedRules), &facts, &r.Error, &r.StartedAt, &finished); err != nil {
+		return nil, err
+	}
+	if facts != nil {
+		r.Facts = facts
+	}
+	if finished.Valid {
+		r.FinishedAt = &finished.Time
+	}
+	return &r, nil
+}
+
+// ListScheduleRuns returns a schedule's most recent runs, newest first
+func (c *Client) ListScheduleRuns(ctx context.Context, name string, limit int) ([]ScheduleRun, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	rows, err := c.db.QueryContext(ctx,
+		"SELECT "+scheduleRunColumns+" FROM rule_schedule_runs WHERE schedule = $1 ORDER BY scheduled_for DESC LIMIT $2",
+		name, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []ScheduleRun{}
+	for rows.Next() {
+		r, err := scanScheduleRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, *r)
+	}
+	return runs, rows.Err()
+}
+
+// RunDueSchedules evaluates every enabled schedule whose next run time has
+// passed and returns the runs it recorded, including skipped ones. worker
+// identifies the caller in the run history.
+//
+// Each schedule is claimed with FOR UPDATE SKIP LOCKED and its runs are
+// recorded (unique per scheduled time) before any of them is evaluated, so
+// concurrent callers never run the same time twice. Still, it is meant to
+// be called periodically by a single process, such as the worker's elected
+// leader. Before EnableSchedules it does nothing.
+func (c *Client) RunDueSchedules(ctx context.Context, worker string) ([]ScheduleRun, error) {
+	var installed bool
+	if err := c.db.QueryRowContext(ctx, "SELECT to_regclass('rule_schedules') IS NOT NULL").Scan(&installed); err != nil {
+		return nil, err
+	}
+	if !installed {
+		return nil, nil
+	}
+
+	rows, err := c.db.QueryContext(ctx,
+		"SELECT name FROM rule_schedules WHERE enabled AND next_run_at <= now() ORDER BY next_run_at",
+	)
+	if err != nil {
+		return nil, err
+	}
+	var due []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	all := []ScheduleRun{}
+	for _, name := range due {
+		s, runs, err := c.claimScheduleRuns(ctx, name, worker)
+		if err != nil {
+			return all, fmt.Errorf("schedule %s: %w", name, err)
+		}
+		for i := range runs {
+			if runs[i].Status == RunRunning {
+				if err := c.executeScheduleRun(ctx, s, &runs[i]); err != nil {
+					return append(all, runs[:i+1]...), fmt.Errorf("schedule %s: %w", name, err)
+				}
+			}
+		}
+		all = append(all, runs...)
+	}
+	return all, nil
+}
+
+// claimScheduleRuns records a due schedule's runs, applying its catch-up
+// policy, and advances its next run time past now
+func (c *Client) claimScheduleRuns(ctx context.Context, name, worker string) (*Schedule, []ScheduleRun, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	s, err := scanSchedule(tx.QueryRowContext(ctx,
+		"SELECT "+scheduleColumns+" FROM rule_schedules WHERE name = $1 AND enabled AND next_run_at <= now() FOR UPDATE SKIP LOCKED",
+		name,
+	))
+	if err == sql.ErrNoRows {
+		// Claimed by another caller, or no longer due
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var now time.Time
+	if err := tx.QueryRowContext(ctx, "SELECT now()").Scan(&now); err != nil {
+		return nil, nil, err
+	}
+	cron, err := parseCron(s.Cron)
+	if err != nil {
+		return nil, nil, err
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The most recent due times, oldest first
+	keep := s.MaxCatchUp
+	if keep < 1 {
+		keep = 1
+	}
+	var times []time.Time
+	for t := s.NextRunAt.In(loc); !t.IsZero() && !t.After(now); t = cron.next(t) {
+		times = append(times, t)
+		if len(times) > keep {
+			times = times[1:]
+		}
+	}
+
+	var runs []ScheduleRun
+	for i, t := range times {
+		latest := i == len(times)-1
+		missed := !latest || now.Sub(t) > scheduleGrace
+		run := ScheduleRun{Schedule: s.Name, ScheduledFor: t, Status: RunSkipped, CatchUp: missed, Worker: worker}
+		switch {
+		case !missed,
+			s.CatchUp == CatchUpOnce && latest,
+			s.CatchUp == CatchUpAll:
+			run.Status = RunRunning
+		}
+		if err := tx.QueryRowContext(ctx,
+			`INSERT INTO rule_schedule_runs (schedule, scheduled_for, status, catch_up, worker, finished_at)
+			 VALUES ($1, $2, $3, $4, $5, CASE WHEN $3 = 'skipped' THEN now() END)
+			 ON CONFLICT (schedule, scheduled_for) DO NOTHING
+			 RETURNING run_id, started_at`,
+			s.Name, t, run.Status, run.CatchUp, worker,
+		).Scan(&run.ID, &run.StartedAt); err == sql.ErrNoRows {
+			continue // already recorded
+		} else if err != nil {
+			return nil, nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	next := cron.next(now.In(loc))
+	if next.IsZero() {
+		return nil, nil, fmt.Errorf("cron %q never matches again", s.Cron)
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE rule_schedules SET next_run_at = $2, last_run_at = $3 WHERE name = $1",
+		s.Name, next, now,
+	); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return s, runs, nil
+}
+
+// executeScheduleRun evaluates a claimed run and records its outcome. An
+// evaluation error fails the run; only errors recording it are returned.
+func (c *Client) executeScheduleRun(ctx context.Context, s *Schedule, run *ScheduleRun) error {
+	facts := make(map[string]interface{}, len(s.Facts)+1)
+	for k, v := range s.Facts {
+		facts[k] = v
+	}
+	facts["Schedule"] = map[string]interface{}{
+		"name":          s.Name,
+		"scheduled_for": run.ScheduledFor.Format(time.RFC3339),
+		"catch_up":      run.CatchUp,
+	}
+
+	var output []byte
+	result, err := c.Evaluate(ctx, s.RuleSetID, facts)
+	if err == nil {
+		run.Status = RunSucceeded
+		run.MatchedRules = result.MatchedRules
+		if output, err = json.Marshal(result.Facts); err != nil {
+			return err
+		}
+		run.Facts = output
+	} else {
+		if ctx.Err() != nil {
+			// Leave the run as running; it was interrupted, not failed
+			return ctx.Err()
+		}
+		run.Status = RunFailed
+		run.Error = err.Error()
+	}
+
+	var finished time.Time
+	if err := c.db.QueryRowContext(ctx,
+		`UPDATE rule_schedule_runs
+		 SET status = $2, matched_rules = $3, result = $4, error = NULLIF($5, ''), finished_at = now()
+		 WHERE run_id = $1
+		 RETURNING finished_at`,
+		run.ID, run.Status, pq.Array(run.MatchedRules), output, run.Error,
+	).Scan(&finished); err != nil {
+		return err
+	}
+	run.FinishedAt = &finished
+	return nil
+}
@@ -0,0 +1,40 @@
+-- Scheduled rule set evaluations (see EnableSchedules). The worker that
+-- leads its group evaluates due schedules and records every run; a
+-- schedule's catch_up policy decides what happens to runs missed while no
+-- worker was running.
+
+CREATE TABLE IF NOT EXISTS rule_schedules (
+    name TEXT PRIMARY KEY,
+    ruleset_id INTEGER NOT NULL,
+    cron TEXT NOT NULL,
+    timezone TEXT NOT NULL DEFAULT 'UTC',
+    facts JSONB NOT NULL DEFAULT '{}',
+    catch_up TEXT NOT NULL DEFAULT 'once' CHECK (catch_up IN ('skip', 'once', 'all')),
+    max_catch_up INTEGER NOT NULL DEFAULT 100,
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    next_run_at TIMESTAMPTZ NOT NULL,
+    last_run_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_rule_schedules_due ON rule_schedules (next_run_at) WHERE enabled;
+
+CREATE TABLE IF NOT EXISTS rule_schedule_runs (
+    run_id BIGSERIAL PRIMARY KEY,
+    schedule TEXT NOT NULL REFERENCES rule_schedules (name) ON DELETE CASCADE,
+    scheduled_for TIMESTAMPTZ NOT NULL,
+    status TEXT NOT NULL CHECK (status IN ('running', 'succeeded', 'failed', 'skipped')),
+    catch_up BOOLEAN NOT NULL DEFAULT false,
+    worker TEXT,
+    matched_rules TEXT[],
+    result JSONB,
+    error TEXT,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMPTZ,
+    UNIQUE (schedule, scheduled_for)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rule_schedule_runs_schedule ON rule_schedule_runs (schedule, scheduled_for DESC);
+
+COMMENT ON TABLE rule_schedules IS 'Rule set evaluations triggered by cron expressions';
+COMMENT ON TABLE rule_schedule_runs IS 'One row per scheduled (or skipped) evaluation';
@@ -0,0 +1,215 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCreateScheduleValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		s         Schedule
+		wantField string
+		wantMsg   string
+	}{
+		{name: "no name", s: Schedule{RuleSetID: 1, Cron: "@daily"}, wantField: "name"},
+		{name: "no rule set", s: Schedule{Name: "n", Cron: "@daily"}, wantField: "ruleset_id"},
+		{name: "bad catch-up", s: Schedule{Name: "n", RuleSetID: 1, Cron: "@daily", CatchUp: "some"}, wantField: "catch_up"},
+		{name: "negative max catch-up", s: Schedule{Name: "n", RuleSetID: 1, Cron: "@daily", MaxCatchUp: -1}, wantField: "max_catch_up"},
+		{name: "bad cron", s: Schedule{Name: "n", RuleSetID: 1, Cron: "* * *"}, wantField: "cron", wantMsg: "expected 5 fields"},
+		{name: "never", s: Schedule{Name: "n", RuleSetID: 1, Cron: "0 0 30 2 *"}, wantField: "cron", wantMsg: "never matches"},
+		{name: "bad time zone", s: Schedule{Name: "n", RuleSetID: 1, Cron: "@daily", Timezone: "Mars/Olympus"}, wantField: "timezone",
+			wantMsg: `unknown time zone "Mars/Olympus"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newMock(t)
+			var verr *ValidationError
+			err := client.CreateSchedule(context.Background(), tt.s)
+			if !errors.As(err, &verr) || verr.Field != tt.wantField || !strings.Contains(verr.Message, tt.wantMsg) {
+				t.Fatalf("err = %v, want a %s validation error", err, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestCreateSchedule(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectBegin()
+	// Defaults: UTC, catch up once, at most 100 runs, no facts
+	mock.ExpectExec(`INSERT INTO rule_schedules`).
+		WithArgs("nightly", 3, "@daily", "UTC", []byte(`{}`), CatchUpOnce, 100, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := client.CreateSchedule(context.Background(), Schedule{Name: "nightly", RuleSetID: 3, Cron: "@daily"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNextScheduleRun(t *testing.T) {
+	after := time.Date(2024, 9, 10, 10, 0, 0, 0, time.UTC)
+	next, err := nextScheduleRun("0 9 * * *", "Europe/Amsterdam", after)
+	if err != nil {
+		t.Skip(err) // no time zone database
+	}
+	// 09:00 in Amsterdam (UTC+2) has passed; the next is tomorrow
+	if want := time.Date(2024, 9, 11, 7, 0, 0, 0, time.UTC); !next.Equal(want) || next.Location().String() != "Europe/Amsterdam" {
+		t.Fatalf("next = %s, want %s in Europe/Amsterdam", next, want)
+	}
+}
+
+var scheduleRowColumns = []string{"name", "ruleset_id", "cron", "timezone", "facts", "catch_up", "max_catch_up",
+	"enabled", "next_run_at", "last_run_at", "created_at"}
+
+// expectClaim expects a schedule to be claimed at now
+func expectClaim(mock sqlmock.Sqlmock, s Schedule, now time.Time) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM rule_schedules WHERE name = \$1 AND enabled AND next_run_at <= now\(\) FOR UPDATE SKIP LOCKED`).
+		WithArgs(s.Name).
+		WillReturnRows(sqlmock.NewRows(scheduleRowColumns).AddRow(s.Name, s.RuleSetID, s.Cron, s.Timezone, []byte(`{"Region":"eu"}`),
+			s.CatchUp, s.MaxCatchUp, true, s.NextRunAt, nil, s.NextRunAt))
+	mock.ExpectQuery(`SELECT now\(\)`).WillReturnRows(sqlmock.NewRows([]string{"now"}).AddRow(now))
+}
+
+func TestClaimScheduleRuns(t *testing.T) {
+	day := func(hour, minute int) time.Time { return time.Date(2024, 9, 10, hour, minute, 0, 0, time.UTC) }
+	// Hourly from 09:00; 09:00 to 12:00 are due. Each insert is "hour
+	// status [catch_up]", or "hour recorded" when another caller already
+	// recorded that time.
+	tests := []struct {
+		name    string
+		catchUp string
+		max     int
+		now     time.Time
+		inserts []string
+	}{
+		{name: "skip", catchUp: CatchUpSkip, max: 100, now: day(12, 5),
+			inserts: []string{"9 skipped catch_up", "10 skipped catch_up", "11 skipped catch_up", "12 skipped catch_up"}},
+		{name: "skip within the grace period", catchUp: CatchUpSkip, max: 100, now: day(12, 1),
+			inserts: []string{"9 skipped catch_up", "10 skipped catch_up", "11 skipped catch_up", "12 running"}},
+		{name: "once", catchUp: CatchUpOnce, max: 100, now: day(12, 5),
+			inserts: []string{"9 skipped catch_up", "10 skipped catch_up", "11 skipped catch_up", "12 running catch_up"}},
+		{name: "all", catchUp: CatchUpAll, max: 100, now: day(12, 5),
+			inserts: []string{"9 running catch_up", "10 running catch_up", "11 running catch_up", "12 running catch_up"}},
+		{name: "all up to max", catchUp: CatchUpAll, max: 2, now: day(12, 5),
+			inserts: []string{"11 running catch_up", "12 running catch_up"}},
+		{name: "max 0 keeps the latest", catchUp: CatchUpAll, max: 0, now: day(12, 0),
+			inserts: []string{"12 running"}},
+		{name: "already recorded", catchUp: CatchUpOnce, max: 100, now: day(12, 0),
+			inserts: []string{"9 skipped catch_up", "10 recorded", "11 skipped catch_up", "12 running"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			mock.MatchExpectationsInOrder(true)
+			s := Schedule{Name: "hourly", RuleSetID: 3, Cron: "@hourly", Timezone: "UTC", CatchUp: tt.catchUp,
+				MaxCatchUp: tt.max, NextRunAt: day(9, 0)}
+			expectClaim(mock, s, tt.now)
+
+			var want []ScheduleRun
+			for i, insert := range tt.inserts {
+				fields := strings.Fields(insert)
+				var hour int
+				for _, c := range fields[0] {
+					hour = hour*10 + int(c-'0')
+				}
+				q := mock.ExpectQuery(`INSERT INTO rule_schedule_runs .* ON CONFLICT \(schedule, scheduled_for\) DO NOTHING`)
+				if fields[1] == "recorded" {
+					q.WithArgs("hourly", day(hour, 0), sqlmock.AnyArg(), sqlmock.AnyArg(), "w1").WillReturnError(sql.ErrNoRows)
+					continue
+				}
+				run := ScheduleRun{ID: int64(i + 1), Schedule: "hourly", ScheduledFor: day(hour, 0), Status: fields[1],
+					CatchUp: len(fields) > 2, Worker: "w1", StartedAt: tt.now}
+				q.WithArgs("hourly", run.ScheduledFor, run.Status, run.CatchUp, "w1").
+					WillReturnRows(sqlmock.NewRows([]string{"run_id", "started_at"}).AddRow(run.ID, tt.now))
+				want = append(want, run)
+			}
+			// The next run is after now, not after the last missed time
+			next := tt.now.Truncate(time.Hour).Add(time.Hour)
+			mock.ExpectExec(`UPDATE rule_schedules SET next_run_at = \$2, last_run_at = \$3`).
+				WithArgs("hourly", next, tt.now).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			got, runs, err := client.claimScheduleRuns(context.Background(), "hourly", "w1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != "hourly" || got.Facts["Region"] != "eu" {
+				t.Fatalf("schedule = %+v", got)
+			}
+			if !reflect.DeepEqual(runs, want) {
+				t.Fatalf("runs = %+v\nwant %+v", runs, want)
+			}
+		})
+	}
+}
+
+func TestClaimScheduleRunsClaimed(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FOR UPDATE SKIP LOCKED`).WillReturnRows(sqlmock.NewRows(scheduleRowColumns))
+	mock.ExpectRollback()
+	s, runs, err := client.claimScheduleRuns(context.Background(), "hourly", "w1")
+	if s != nil || runs != nil || err != nil {
+		t.Fatalf("claim = %v, %v, %v; want nothing", s, runs, err)
+	}
+}
+
+func TestRunDueSchedules(t *testing.T) {
+	client, mock := newMock(t)
+	mock.MatchExpectationsInOrder(true)
+
+	// Not installed
+	mock.ExpectQuery(`to_regclass\('rule_schedules'\)`).WillReturnRows(sqlmock.NewRows([]string{"installed"}).AddRow(false))
+	if runs, err := client.RunDueSchedules(context.Background(), "w1"); runs != nil || err != nil {
+		t.Fatalf("RunDueSchedules = %v, %v", runs, err)
+	}
+
+	now := time.Date(2024, 9, 10, 12, 0, 30, 0, time.UTC)
+	mock.ExpectQuery(`to_regclass\('rule_schedules'\)`).WillReturnRows(sqlmock.NewRows([]string{"installed"}).AddRow(true))
+	mock.ExpectQuery(`SELECT name FROM rule_schedules WHERE enabled AND next_run_at <= now\(\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("hourly").AddRow("daily"))
+	expectClaim(mock, Schedule{Name: "hourly", RuleSetID: 3, Cron: "@hourly", Timezone: "UTC", CatchUp: CatchUpSkip,
+		MaxCatchUp: 100, NextRunAt: now.Truncate(time.Hour)}, now)
+	mock.ExpectQuery(`INSERT INTO rule_schedule_runs`).
+		WillReturnRows(sqlmock.NewRows([]string{"run_id", "started_at"}).AddRow(1, now))
+	mock.ExpectExec(`UPDATE rule_schedules SET next_run_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// The run evaluates the rule set with the schedule's facts
+	mock.ExpectQuery(`SELECT is_active`).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(true))
+	mock.ExpectQuery(`ruleset_get_rules`).WillReturnRows(sqlmock.NewRows([]string{"rule_name", "rule_version"}).AddRow("A", nil))
+	mock.ExpectQuery(`rule_get`).WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(`rule A "" { when true then Retract("A"); }`))
+	expectDebugRun(mock, "s1", `{"Region":"eu"}`, "A")
+	mock.ExpectQuery(`UPDATE rule_schedule_runs\s+SET status = \$2`).
+		WithArgs(1, RunSucceeded, `{"A"}`, []byte(`{"Region":"eu"}`), "").
+		WillReturnRows(sqlmock.NewRows([]string{"finished_at"}).AddRow(now))
+	// Another caller claimed the second schedule
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FOR UPDATE SKIP LOCKED`).WithArgs("daily").WillReturnRows(sqlmock.NewRows(scheduleRowColumns))
+	mock.ExpectRollback()
+
+	runs, err := client.RunDueSchedules(context.Background(), "w1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Status != RunSucceeded || runs[0].CatchUp || runs[0].FinishedAt == nil ||
+		!reflect.DeepEqual(runs[0].MatchedRules, []string{"A"}) {
+		t.Fatalf("runs = %+v", runs)
+	}
+}
@@ -0,0 +1,295 @@
+package ruleengine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// simulationBatch is how many source rows are fetched from the cursor at a
+// time
+const simulationBatch = 500
+
+// SimulationOptions selects the rule and the historical rows Simulate runs
+// it against
+type SimulationOptions struct {
+	// Rule and Version name a saved rule; Version defaults to the rule's
+	// default version
+	Rule    string
+	Version string
+
+	// GRL simulates an unsaved candidate instead of a saved rule
+	GRL string
+
+	// Source is the table or view holding historical facts, optionally
+	// schema-qualified
+	Source string
+
+	// FactsColumn holds each row's facts as JSON; when empty the whole row
+	// is the facts
+	FactsColumn string
+
+	// TimeColumn restricts rows to From <= TimeColumn < To (either bound
+	// may be zero) and orders them by time
+	TimeColumn string
+	From, To   time.Time
+
+	// Limit caps how many rows are simulated; 0 simulates all of them
+	Limit int
+
+	// Samples is how many matching rows to return as examples
+	Samples int
+}
+
+// Simulation summarizes what a rule would have done to historical rows
+type Simulation struct {
+	Rule    string `json:"rule"`
+	Version string `json:"version,omitempty"`
+	Source  string `json:"source"`
+
+	Rows    int64 `json:"rows"`
+	Matched int64 `json:"matched"`
+	Failed  int64 `json:"failed"`
+
+	// Fired counts, per rule block of the GRL, the rows it fired on
+	Fired map[string]int64 `json:"fired"`
+
+	// Actions counts each action the fired rules would have executed, most
+	// frequent first
+	Actions []SimulatedAction `json:"actions"`
+
+	// Errors holds the first few engine errors, one per failed row
+	Errors []string `json:"errors,omitempty"`
+
+	Samples  []SimulationSample `json:"samples,omitempty"`
+	Duration time.Duration      `json:"duration"`
+}
+
+// SimulatedAction is an action and how many times it would have run
+type SimulatedAction struct {
+	Rule   string `json:"rule"`
+	Action string `json:"action"`
+	Count  int64  `json:"count"`
+}
+
+// SimulationSample is one matching row before and after the rule ran
+type SimulationSample struct {
+	Facts        map[string]interface{} `json:"facts"`
+	Result       map[string]interface{} `json:"result"`
+	MatchedRules []string               `json:"matched_rules"`
+}
+
+// maxSimulationErrors bounds Simulation.Errors
+const maxSimulationErrors = 10
+
+// Simulate runs a saved rule version or candidate GRL against historical
+// rows and reports how many would have matched and which actions would
+// have fired. Everything runs in a transaction that is rolled back, and
+// each row in its own savepoint, so no action takes effect and a failing
+// row does not stop the run.
+func (c *Client) Simulate(ctx context.Context, opts SimulationOptions) (*Simulation, error) {
+	start := time.Now()
+	if opts.Rule == "" && opts.GRL == "" {
+		return nil, &ValidationError{Field: "rule", Message: "a rule or GRL is required"}
+	}
+	if opts.Source == "" {
+		return nil, &ValidationError{Field: "source", Message: "is required"}
+	}
+	for field, column := range map[string]string{"facts_column": opts.FactsColumn, "time_column": opts.TimeColumn} {
+		if column != "" && !identifierPattern.MatchString(column) {
+			return nil, &ValidationError{Field: field, Message: "must be a plain SQL identifier"}
+		}
+	}
+	if opts.TimeColumn == "" && (!opts.From.IsZero() || !opts.To.IsZero()) {
+		return nil, &ValidationError{Field: "time_column", Message: "is required for a time range"}
+	}
+	if opts.Limit < 0 {
+		return nil, &ValidationError{Field: "limit", Message: "must not be negative"}
+	}
+	if opts.Samples < 0 {
+		return nil, &ValidationError{Field: "samples", Message: "must not be negative"}
+	}
+
+	grl := opts.GRL
+	sim := &Simulation{Rule: opts.Rule, Version: opts.Version, Fired: map[string]int64{}, Actions: []SimulatedAction{}}
+	if grl != "" {
+		if err := validateGRL(grl); err != nil {
+			return nil, err
+		}
+		if sim.Rule == "" {
+			sim.Rule = "candidate"
+		}
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if grl == "" {
+		var exists bool
+		if err := tx.QueryRowContext(ctx,
+			`SELECT EXISTS (SELECT 1 FROM rule_versions rv
+			 JOIN rule_definitions rd ON rv.rule_id = rd.id
+			 WHERE rd.name = $1 AND ($2 = '' OR rv.version = $2))`,
+			opts.Rule, opts.Version,
+		).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists && opts.Version == "" {
+			return nil, fmt.Errorf("%s: %w", opts.Rule, ErrRuleNotFound)
+		}
+		if !exists {
+			return nil, fmt.Errorf("%s@%s: %w", opts.Rule, opts.Version, ErrRuleNotFound)
+		}
+		if err := tx.QueryRowContext(ctx,
+			"SELECT rule_get($1, NULLIF($2, ''))", opts.Rule, opts.Version,
+		).Scan(&grl); err != nil {
+			return nil, err
+		}
+	}
+
+	// The regclass cast resolves and quotes the source, so it is safe to
+	// interpolate
+	var found bool
+	if err := tx.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", opts.Source).Scan(&found); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &ValidationError{Field: "source", Message: fmt.Sprintf("table or view %q not found", opts.Source)}
+	}
+	if err := tx.QueryRowContext(ctx, "SELECT $1::regclass::text", opts.Source).Scan(&sim.Source); err != nil {
+		return nil, err
+	}
+
+	facts := "to_jsonb(s)"
+	if opts.FactsColumn != "" {
+		facts = fmt.Sprintf("s.%q::jsonb", opts.FactsColumn)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s s", facts, sim.Source)
+	var args []interface{}
+	if opts.TimeColumn != "" {
+		var where []string
+		if !opts.From.IsZero() {
+			args = append(args, opts.From)
+			where = append(where, fmt.Sprintf("s.%q >= $%d", opts.TimeColumn, len(args)))
+		}
+		if !opts.To.IsZero() {
+			args = append(args, opts.To)
+			where = append(where, fmt.Sprintf("s.%q < $%d", opts.TimeColumn, len(args)))
+		}
+		if len(where) > 0 {
+			query += " WHERE " + strings.Join(where, " AND ")
+		}
+		query += fmt.Sprintf(" ORDER BY s.%q", opts.TimeColumn)
+	}
+	if opts.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", opts.Limit)
+	}
+	if _, err := tx.ExecContext(ctx, "DECLARE ruleengine_simulation NO SCROLL CURSOR FOR "+query, args...); err != nil {
+		return nil, err
+	}
+
+	actions := make(map[Action]int64)
+	for {
+		batch, err := fetchSimulationBatch(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, doc := range batch {
+			if err := simulateRow(ctx, tx, grl, doc, sim, actions, opts.Samples); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for a, n := range actions {
+		sim.Actions = append(sim.Actions, SimulatedAction{Rule: a.Rule, Action: a.Action, Count: n})
+	}
+	sort.Slice(sim.Actions, func(i, j int) bool {
+		if sim.Actions[i].Count != sim.Actions[j].Count {
+			return sim.Actions[i].Count > sim.Actions[j].Count
+		}
+		if sim.Actions[i].Rule != sim.Actions[j].Rule {
+			return sim.Actions[i].Rule < sim.Actions[j].Rule
+		}
+		return sim.Actions[i].Action < sim.Actions[j].Action
+	})
+	sim.Duration = time.Since(start)
+	return sim, nil
+}
+
+func fetchSimulationBatch(ctx context.Context, q querier) ([]string, error) {
+	rows, err := q.QueryContext(ctx, fmt.Sprintf("FETCH %d FROM ruleengine_simulation", simulationBatch))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []string
+	for rows.Next() {
+		var doc string
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+		batch = append(batch, doc)
+	}
+	return batch, rows.Err()
+}
+
+// simulateRow runs grl against one row inside a savepoint that is always
+// rolled back, and adds the outcome to sim
+func simulateRow(ctx context.Context, q querier, grl, doc string, sim *Simulation, actions map[Action]int64, samples int) error {
+	if _, err := q.ExecContext(ctx, "SAVEPOINT ruleengine_simulation_row"); err != nil {
+		return err
+	}
+	sim.Rows++
+	result := &Result{MatchedRules: []string{}, Actions: []Action{}, Trace: []TraceEvent{}}
+	output, runErr := runDebug(ctx, q, sim.Rule, grl, doc, result)
+	if _, err := q.ExecContext(ctx, "ROLLBACK TO SAVEPOINT ruleengine_simulation_row"); err != nil {
+		return err
+	}
+	if runErr != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		sim.Failed++
+		if len(sim.Errors) < maxSimulationErrors {
+			sim.Errors = append(sim.Errors, runErr.Error())
+		}
+		return nil
+	}
+	if len(result.MatchedRules) == 0 {
+		return nil
+	}
+
+	sim.Matched++
+	seen := make(map[string]bool)
+	for _, name := range result.MatchedRules {
+		if !seen[name] {
+			seen[name] = true
+			sim.Fired[name]++
+		}
+	}
+	for _, a := range result.Actions {
+		actions[a]++
+	}
+	if len(sim.Samples) < samples {
+		sample := SimulationSample{MatchedRules: result.MatchedRules}
+		if err := json.Unmarshal([]byte(doc), &sample.Facts); err != nil {
+			return fmt.Errorf("invalid facts in %s: %w", sim.Source, err)
+		}
+		if err := json.Unmarshal([]byte(output), &sample.Result); err != nil {
+			return fmt.Errorf("engine returned invalid facts: %w", err)
+		}
+		sim.Samples = append(sim.Samples, sample)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSimulateValidation(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		opts      SimulationOptions
+		wantField string
+	}{
+		{name: "no rule", opts: SimulationOptions{Source: "orders"}, wantField: "rule"},
+		{name: "no source", opts: SimulationOptions{Rule: "A"}, wantField: "source"},
+		{name: "bad facts column", opts: SimulationOptions{Rule: "A", Source: "orders", FactsColumn: `x"y`}, wantField: "facts_column"},
+		{name: "bad time column", opts: SimulationOptions{Rule: "A", Source: "orders", TimeColumn: "created at"}, wantField: "time_column"},
+		{name: "range without time column", opts: SimulationOptions{Rule: "A", Source: "orders", From: from}, wantField: "time_column"},
+		{name: "negative limit", opts: SimulationOptions{Rule: "A", Source: "orders", Limit: -1}, wantField: "limit"},
+		{name: "negative samples", opts: SimulationOptions{Rule: "A", Source: "orders", Samples: -1}, wantField: "samples"},
+		{name: "blank GRL", opts: SimulationOptions{GRL: "  ", Source: "orders"}, wantField: "grl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newMock(t)
+			var verr *ValidationError
+			if _, err := client.Simulate(context.Background(), tt.opts); !errors.As(err, &verr) || verr.Field != tt.wantField {
+				t.Fatalf("err = %v, want a %s validation error", err, tt.wantField)
+			}
+		})
+	}
+}
+
+// expectSimulatedRow expects one row's savepoint, debug run, and rollback
+func expectSimulatedRow(mock sqlmock.Sqlmock, session, output string, fired ...string) {
+	mock.ExpectExec(`SAVEPOINT ruleengine_simulation_row`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectDebugRun(mock, session, output, fired...)
+	mock.ExpectExec(`ROLLBACK TO SAVEPOINT ruleengine_simulation_row`).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestSimulate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	client := New(db)
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT EXISTS`).WithArgs("HighValue", "2.0.0").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`SELECT rule_get\(\$1, NULLIF\(\$2, ''\)\)`).WithArgs("HighValue", "2.0.0").
+		WillReturnRows(sqlmock.NewRows([]string{"grl"}).AddRow(`rule HighValue "" { when Order.total > 1000 then Order.flagged = true; }`))
+	mock.ExpectQuery(`SELECT to_regclass`).WithArgs("orders").WillReturnRows(sqlmock.NewRows([]string{"found"}).AddRow(true))
+	mock.ExpectQuery(`SELECT \$1::regclass::text`).WithArgs("orders").WillReturnRows(sqlmock.NewRows([]string{"source"}).AddRow("sales.orders"))
+	mock.ExpectExec(`DECLARE ruleengine_simulation NO SCROLL CURSOR FOR SELECT s."doc"::jsonb FROM sales.orders s `+
+		`WHERE s."created_at" >= \$1 AND s."created_at" < \$2 ORDER BY s."created_at" LIMIT 10`).
+		WithArgs(from, to).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectQuery(`FETCH 500 FROM ruleengine_simulation`).WillReturnRows(sqlmock.NewRows([]string{"doc"}).
+		AddRow(`{"Order":{"total":1200}}`).AddRow(`{"Order":{"total":5}}`).AddRow(`{"Order":{"total":1}}`))
+	expectSimulatedRow(mock, "s1", `{"Order":{"total":1200,"flagged":true}}`, "HighValue")
+	expectSimulatedRow(mock, "s2", `{"Order":{"total":5}}`)
+	mock.ExpectExec(`SAVEPOINT`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`run_rule_engine_debug`).WillReturnError(errors.New("pq: rule engine error: bad facts"))
+	mock.ExpectExec(`ROLLBACK TO SAVEPOINT`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`FETCH 500`).WillReturnRows(sqlmock.NewRows([]string{"doc"}).AddRow(`{"Order":{"total":2000}}`))
+	expectSimulatedRow(mock, "s3", `{"Order":{"total":2000,"flagged":true}}`, "HighValue")
+	mock.ExpectQuery(`FETCH 500`).WillReturnRows(sqlmock.NewRows([]string{"doc"}))
+	// Nothing is kept
+	mock.ExpectRollback()
+
+	sim, err := client.Simulate(context.Background(), SimulationOptions{
+		Rule: "HighValue", Version: "2.0.0", Source: "orders", FactsColumn: "doc",
+		TimeColumn: "created_at", From: from, To: to, Limit: 10, Samples: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if sim.Source != "sales.orders" || sim.Rows != 4 || sim.Matched != 2 || sim.Failed != 1 ||
+		sim.Fired["HighValue"] != 2 || len(sim.Errors) != 1 || !strings.Contains(sim.Errors[0], "bad facts") {
+		t.Fatalf("simulation = %+v", sim)
+	}
+	if want := []SimulatedAction{{Rule: "HighValue", Action: "Order.flagged = true", Count: 2}}; !reflect.DeepEqual(sim.Actions, want) {
+		t.Fatalf("actions = %+v", sim.Actions)
+	}
+	if len(sim.Samples) != 1 || sim.Samples[0].Result["Order"].(map[string]interface{})["flagged"] != true ||
+		sim.Samples[0].Facts["Order"].(map[string]interface{})["total"] != 1200.0 {
+		t.Fatalf("samples = %+v", sim.Samples)
+	}
+}
+
+func TestSimulateNotFound(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    SimulationOptions
+		expect  func(mock sqlmock.Sqlmock)
+		wantErr string
+	}{
+		{name: "unknown rule", opts: SimulationOptions{Rule: "Nope", Source: "orders"},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).WithArgs("Nope", "").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			},
+			wantErr: "Nope: rule not found"},
+		{name: "unknown version", opts: SimulationOptions{Rule: "A", Version: "9.0.0", Source: "orders"},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			},
+			wantErr: "A@9.0.0: rule not found"},
+		{name: "unknown source", opts: SimulationOptions{GRL: `rule A "" { when true then Retract("A"); }`, Source: "nowhere"},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`to_regclass`).WithArgs("nowhere").WillReturnRows(sqlmock.NewRows([]string{"found"}).AddRow(false))
+			},
+			wantErr: `table or view "nowhere" not found`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			mock.ExpectBegin()
+			tt.expect(mock)
+			mock.ExpectRollback()
+			_, err := client.Simulate(context.Background(), tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if strings.Contains(tt.wantErr, "rule not found") && !errors.Is(err, ErrRuleNotFound) {
+				t.Fatalf("err = %v, want ErrRuleNotFound", err)
+			}
+		})
+	}
+}
+
+func TestSimulateCandidate(t *testing.T) {
+	client, mock := newMock(t)
+	mock.MatchExpectationsInOrder(true)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`to_regclass`).WillReturnRows(sqlmock.NewRows([]string{"found"}).AddRow(true))
+	mock.ExpectQuery(`regclass::text`).WillReturnRows(sqlmock.NewRows([]string{"source"}).AddRow("orders"))
+	// The whole row is the facts; no time range
+	mock.ExpectExec(`DECLARE ruleengine_simulation NO SCROLL CURSOR FOR SELECT to_jsonb\(s\) FROM orders s$`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`FETCH`).WillReturnRows(sqlmock.NewRows([]string{"doc"}))
+	mock.ExpectRollback()
+
+	sim, err := client.Simulate(context.Background(), SimulationOptions{GRL: `rule A "" { when true then Retract("A"); }`, Source: "orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sim.Rule != "candidate" || sim.Rows != 0 || sim.Actions == nil || sim.Fired == nil {
+		t.Fatalf("simulation = %+v", sim)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,184 @@
+package ruleengine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// streamStepFunc runs one rule over every pending row of the stream table,
+// recording a failure on its row instead of aborting the statement. It is
+// only used when the set-based UPDATE fails.
+const streamStepFunc = `CREATE FUNCTION pg_temp.ruleengine_stream_step(p_rule TEXT, p_grl TEXT) RETURNS void AS $$
+DECLARE
+    r RECORD;
+BEGIN
+    FOR r IN SELECT ord, doc FROM ruleengine_stream WHERE err IS NULL LOOP
+        BEGIN
+            UPDATE ruleengine_stream SET doc = run_rule_engine(r.doc, p_grl) WHERE ord = r.ord;
+        EXCEPTION WHEN OTHERS THEN
+            UPDATE ruleengine_stream SET err = 'rule ' || p_rule || ': ' || SQLERRM WHERE ord = r.ord;
+        END;
+    END LOOP;
+END
+$$ LANGUAGE plpgsql`
+
+// StreamStats summarizes an EvaluateStream run
+type StreamStats struct {
+	Documents int64         `json:"documents"`
+	Failed    int64         `json:"failed"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// EvaluateStream evaluates a rule set against newline-delimited JSON
+// documents read from in and writes one line per document to out, in input
+// order: {"facts": {...}} or {"error": "..."}. Documents are loaded with
+// COPY into a temporary table and each rule runs once over the whole table
+// with the GRL fetched once, instead of a function call per document and
+// rule, so it suits nightly batches of millions of documents. Like
+// EvaluateBatch it returns only the final facts.
+//
+// Everything runs in one transaction on one connection (requires lib/pq).
+// If a rule fails on some document, that rule is run again row by row so
+// only the failing documents are reported as errors.
+func (c *Client) EvaluateStream(ctx context.Context, rulesetID int, in io.Reader, out io.Writer) (*StreamStats, error) {
+	start := time.Now()
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	members, err := c.ruleSetMembers(ctx, conn, rulesetID)
+	if err != nil {
+		return nil, err
+	}
+	grls := make([]string, len(members))
+	for i, m := range members {
+		if grls[i], err = c.memberGRL(ctx, conn, m); err != nil {
+			return nil, &EvaluationError{Rule: m.name, Version: m.version.String, Err: err}
+		}
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		"CREATE TEMP TABLE ruleengine_stream (ord BIGINT NOT NULL, doc TEXT, err TEXT) ON COMMIT DROP",
+	); err != nil {
+		return nil, err
+	}
+
+	stats := &StreamStats{}
+	copyIn, err := tx.PrepareContext(ctx, pq.CopyIn("ruleengine_stream", "ord", "doc", "err"))
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReaderSize(in, 1<<20)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			stats.Documents++
+			var doc, docErr interface{}
+			if json.Valid(line) && line[0] == '{' {
+				doc = string(line)
+			} else {
+				docErr = "invalid JSON object"
+			}
+			if _, err := copyIn.ExecContext(ctx, stats.Documents, doc, docErr); err != nil {
+				copyIn.Close()
+				return nil, fmt.Errorf("COPY failed at document %d: %w", stats.Documents, err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			copyIn.Close()
+			return nil, readErr
+		}
+	}
+	if _, err := copyIn.ExecContext(ctx); err != nil {
+		copyIn.Close()
+		return nil, fmt.Errorf("COPY failed: %w", err)
+	}
+	if err := copyIn.Close(); err != nil {
+		return nil, err
+	}
+
+	stepCreated := false
+	for i, m := range members {
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT ruleengine_step"); err != nil {
+			return nil, err
+		}
+		_, err := tx.ExecContext(ctx,
+			"UPDATE ruleengine_stream SET doc = run_rule_engine(doc, $1) WHERE err IS NULL", grls[i],
+		)
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT ruleengine_step"); err != nil {
+			return nil, err
+		}
+		if !stepCreated {
+			if _, err := tx.ExecContext(ctx, "CREATE INDEX ON ruleengine_stream (ord)"); err != nil {
+				return nil, err
+			}
+			if _, err := tx.ExecContext(ctx, streamStepFunc); err != nil {
+				return nil, err
+			}
+			stepCreated = true
+		}
+		if _, err := tx.ExecContext(ctx,
+			"SELECT pg_temp.ruleengine_stream_step($1, $2)", m.name, grls[i],
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT doc, err FROM ruleengine_stream ORDER BY ord")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	w := bufio.NewWriterSize(out, 1<<20)
+	for rows.Next() {
+		var doc, docErr []byte
+		if err := rows.Scan(&doc, &docErr); err != nil {
+			return nil, err
+		}
+		if docErr != nil {
+			stats.Failed++
+			line, _ := json.Marshal(map[string]string{"error": string(docErr)})
+			w.Write(line)
+		} else {
+			w.WriteString(`{"facts":`)
+			w.Write(doc)
+			w.WriteString("}")
+		}
+		if err := w.WriteByte('\n'); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	stats.Duration = time.Since(start)
+	return stats, tx.Commit()
+}
@@ -0,0 +1,151 @@
+package ruleengine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestEvaluateStream(t *testing.T) {
+	const input = "{\"n\":1}\n\n  not json\n[1]\n{\"n\":2}"
+	grl := `rule A "" { when n > 0 then n = n + 1; }`
+	results := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"doc", "err"}).
+			AddRow([]byte(`{"n":2}`), nil).
+			AddRow(nil, []byte("invalid JSON object")).
+			AddRow(nil, []byte("invalid JSON object")).
+			AddRow(nil, []byte("rule A: overflow"))
+	}
+
+	tests := []struct {
+		name      string
+		expect    func(mock sqlmock.Sqlmock)
+		want      string
+		wantStats StreamStats
+		wantErr   string
+	}{
+		{
+			name: "set-based update",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`SAVEPOINT ruleengine_step`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`UPDATE ruleengine_stream SET doc = run_rule_engine\(doc, \$1\) WHERE err IS NULL`).
+					WithArgs(grl).WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectQuery(`SELECT doc, err FROM ruleengine_stream ORDER BY ord`).WillReturnRows(results())
+				mock.ExpectCommit()
+			},
+			want: `{"facts":{"n":2}}` + "\n" + `{"error":"invalid JSON object"}` + "\n" +
+				`{"error":"invalid JSON object"}` + "\n" + `{"error":"rule A: overflow"}` + "\n",
+			wantStats: StreamStats{Documents: 4, Failed: 3},
+		},
+		{
+			name: "failing rule runs row by row",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`SAVEPOINT ruleengine_step`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`UPDATE ruleengine_stream`).WillReturnError(errors.New("integer out of range"))
+				mock.ExpectExec(`ROLLBACK TO SAVEPOINT ruleengine_step`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`CREATE INDEX ON ruleengine_stream \(ord\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`CREATE FUNCTION pg_temp.ruleengine_stream_step`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`SELECT pg_temp.ruleengine_stream_step\(\$1, \$2\)`).
+					WithArgs("A", grl).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(`SELECT doc, err FROM ruleengine_stream`).WillReturnRows(results())
+				mock.ExpectCommit()
+			},
+			want: `{"facts":{"n":2}}` + "\n" + `{"error":"invalid JSON object"}` + "\n" +
+				`{"error":"invalid JSON object"}` + "\n" + `{"error":"rule A: overflow"}` + "\n",
+			wantStats: StreamStats{Documents: 4, Failed: 3},
+		},
+		{
+			name: "row by row fails too",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`SAVEPOINT`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`UPDATE ruleengine_stream`).WillReturnError(errors.New("boom"))
+				mock.ExpectExec(`ROLLBACK TO SAVEPOINT`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`CREATE INDEX`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`CREATE FUNCTION`).WillReturnError(errors.New("permission denied for schema pg_temp"))
+				mock.ExpectRollback()
+			},
+			wantErr: "permission denied",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			client := New(db)
+
+			mock.ExpectQuery(`SELECT is_active FROM rule_sets`).WithArgs(7).
+				WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(true))
+			mock.ExpectQuery(`ruleset_get_rules`).WithArgs(7).
+				WillReturnRows(sqlmock.NewRows([]string{"rule_name", "rule_version"}).AddRow("A", nil))
+			mock.ExpectQuery(`rule_get`).WithArgs("A", nil).
+				WillReturnRows(sqlmock.NewRows([]string{"rule_get"}).AddRow(grl))
+			mock.ExpectBegin()
+			mock.ExpectExec(`CREATE TEMP TABLE ruleengine_stream .* ON COMMIT DROP`).WillReturnResult(sqlmock.NewResult(0, 0))
+			// Blank lines are skipped; invalid ones are loaded with an error
+			copyIn := mock.ExpectPrepare(`COPY "ruleengine_stream" \("ord", "doc", "err"\) FROM STDIN`)
+			copyIn.ExpectExec().WithArgs(1, `{"n":1}`, nil).WillReturnResult(sqlmock.NewResult(0, 0))
+			copyIn.ExpectExec().WithArgs(2, nil, "invalid JSON object").WillReturnResult(sqlmock.NewResult(0, 0))
+			copyIn.ExpectExec().WithArgs(3, nil, "invalid JSON object").WillReturnResult(sqlmock.NewResult(0, 0))
+			copyIn.ExpectExec().WithArgs(4, `{"n":2}`, nil).WillReturnResult(sqlmock.NewResult(0, 0))
+			copyIn.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+			tt.expect(mock)
+
+			var out bytes.Buffer
+			stats, err := client.EvaluateStream(context.Background(), 7, strings.NewReader(input), &out)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if out.String() != tt.want {
+					t.Errorf("output:\n%s\nwant:\n%s", out.String(), tt.want)
+				}
+				if stats.Documents != tt.wantStats.Documents || stats.Failed != tt.wantStats.Failed {
+					t.Errorf("stats = %+v", stats)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestEvaluateStreamCopyError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	client := New(db)
+
+	mock.ExpectQuery(`SELECT is_active FROM rule_sets`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"is_active"}).AddRow(true))
+	mock.ExpectQuery(`ruleset_get_rules`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_name", "rule_version"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TEMP TABLE`).WillReturnResult(sqlmock.NewResult(0, 0))
+	copyIn := mock.ExpectPrepare(`COPY`)
+	copyIn.ExpectExec().WithArgs(1, `{}`, nil).WillReturnResult(sqlmock.NewResult(0, 0))
+	copyIn.ExpectExec().WithArgs(2, `{}`, nil).WillReturnError(errors.New("disk full"))
+	copyIn.WillBeClosed()
+	mock.ExpectRollback()
+
+	_, err = client.EvaluateStream(context.Background(), 7, strings.NewReader("{}\n{}\n{}\n"), &bytes.Buffer{})
+	if err == nil || err.Error() != "COPY failed at document 2: disk full" {
+		t.Fatalf("err = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	_ "embed"
+	"errors"
+	"fmt"
+)
+
+//go:embed tenancy.sql
+var tenancySQL string
+
+// EnableTenancy adds a tenant_id column and row-level security policies to
+// the rule repository tables (rule_definitions, rule_versions, rule_sets,
+// rule_set_members) and, if installed, the audit log; call it after
+// InstallAuditLog. It is idempotent; run it once per database as the owner
+// of those tables. Existing rows get no tenant, so only sessions without
+// one see them.
+func (c *Client) EnableTenancy(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, tenancySQL); err != nil {
+		return fmt.Errorf("failed to install tenancy: %w", err)
+	}
+	return nil
+}
+
+// TenantConnector wraps a driver connector so that every connection it
+// opens belongs to tenant: rules and rule sets it creates are the
+// tenant's, and it can only see, evaluate, and change the tenant's. Use it
+// with sql.OpenDB and New, or WithDB:
+//
+//	connector, _ := pq.NewConnector(dsn)
+//	acme := client.WithDB(sql.OpenDB(ruleengine.TenantConnector(connector, "acme")))
+//
+// The database role must not be a superuser or have BYPASSRLS, which
+// Postgres exempts from row-level security.
+func TenantConnector(base driver.Connector, tenant string) driver.Connector {
+	return &tenantConnector{base: base, tenant: tenant}
+}
+
+type tenantConnector struct {
+	base   driver.Connector
+	tenant string
+}
+
+func (t *tenantConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if t.tenant == "" {
+		return nil, errors.New("tenant must not be empty")
+	}
+	conn, err := t.base.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("driver connection does not implement ExecerContext")
+	}
+	// Session-level, so it holds for every statement the pool runs on this
+	// connection
+	if _, err := execer.ExecContext(ctx,
+		"SELECT set_config('ruleengine.tenant', $1, false)",
+		[]driver.NamedValue{{Ordinal: 1, Value: t.tenant}},
+	); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set tenant: %w", err)
+	}
+	return conn, nil
+}
+
+func (t *tenantConnector) Driver() driver.Driver {
+	return t.base.Driver()
+}
+
+// WithDB returns a client using db with c's payload sealer, operational
+// database, and rollout setting, e.g. for a tenant's database handle. The
+// rule cache is not shared; call EnableCache on the new client if needed.
+// Rule statistics are shared and written through c's database.
+func (c *Client) WithDB(db *sql.DB) *Client {
+	return &Client{db: db, rollouts: c.rollouts, windows: c.windows, hits: c.hits, sealer: c.sealer, opsDB: c.opsDB}
+}
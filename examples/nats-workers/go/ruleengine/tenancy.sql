@@ -0,0 +1,49 @@
+-- Per-tenant row-level security on the rule repository (see EnableTenancy).
+-- Rows belong to the tenant of the session that created them
+-- (ruleengine.tenant); a session with a tenant sees and changes only its
+-- own rows, a session without one sees everything.
+
+ALTER TABLE rule_definitions ADD COLUMN IF NOT EXISTS tenant_id TEXT
+    DEFAULT NULLIF(current_setting('ruleengine.tenant', true), '');
+ALTER TABLE rule_versions ADD COLUMN IF NOT EXISTS tenant_id TEXT
+    DEFAULT NULLIF(current_setting('ruleengine.tenant', true), '');
+ALTER TABLE rule_sets ADD COLUMN IF NOT EXISTS tenant_id TEXT
+    DEFAULT NULLIF(current_setting('ruleengine.tenant', true), '');
+ALTER TABLE rule_set_members ADD COLUMN IF NOT EXISTS tenant_id TEXT
+    DEFAULT NULLIF(current_setting('ruleengine.tenant', true), '');
+
+CREATE INDEX IF NOT EXISTS idx_rule_definitions_tenant ON rule_definitions(tenant_id);
+CREATE INDEX IF NOT EXISTS idx_rule_sets_tenant ON rule_sets(tenant_id);
+
+CREATE OR REPLACE FUNCTION rule_tenant_visible(row_tenant TEXT)
+RETURNS BOOLEAN AS $$
+    SELECT NULLIF(current_setting('ruleengine.tenant', true), '') IS NULL
+        OR row_tenant = current_setting('ruleengine.tenant', true)
+$$ LANGUAGE sql STABLE;
+
+DO $$
+DECLARE
+    t TEXT;
+    tables TEXT[] := ARRAY['rule_definitions', 'rule_versions', 'rule_sets', 'rule_set_members'];
+BEGIN
+    -- The audit log, when installed (InstallAuditLog), records the tenant
+    -- of the session that made the change
+    IF to_regclass('rule_change_audit') IS NOT NULL THEN
+        ALTER TABLE rule_change_audit ADD COLUMN IF NOT EXISTS tenant_id TEXT
+            DEFAULT NULLIF(current_setting('ruleengine.tenant', true), '');
+        tables := array_append(tables, 'rule_change_audit');
+    END IF;
+
+    FOREACH t IN ARRAY tables LOOP
+        EXECUTE format('ALTER TABLE %I ENABLE ROW LEVEL SECURITY', t);
+        -- Also applies to the table owner, which the SDK usually connects as
+        EXECUTE format('ALTER TABLE %I FORCE ROW LEVEL SECURITY', t);
+        EXECUTE format('DROP POLICY IF EXISTS rule_tenant_isolation ON %I', t);
+        EXECUTE format(
+            'CREATE POLICY rule_tenant_isolation ON %I
+                USING (rule_tenant_visible(tenant_id))
+                WITH CHECK (rule_tenant_visible(tenant_id))', t);
+    END LOOP;
+END $$;
+
+COMMENT ON FUNCTION rule_tenant_visible IS 'Whether a row of the given tenant is visible to the session''s ruleengine.tenant';
@@ -0,0 +1,198 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+// fakeConnector hands out fakeConns that record their statements
+type fakeConnector struct {
+	connectErr error
+	execErr    error
+	noExecer   bool
+	conns      []*fakeConn
+}
+
+func (f *fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	if f.connectErr != nil {
+		return nil, f.connectErr
+	}
+	c := &fakeConn{execErr: f.execErr}
+	f.conns = append(f.conns, c)
+	if f.noExecer {
+		return struct{ driver.Conn }{c}, nil
+	}
+	return c, nil
+}
+
+func (f *fakeConnector) Driver() driver.Driver { return nil }
+
+type fakeConn struct {
+	execErr error
+	execs   []string
+	args    []driver.NamedValue
+	closed  bool
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.execs, c.args = append(c.execs, query), args
+	return driver.RowsAffected(0), c.execErr
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { c.closed = true; return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func TestTenantConnector(t *testing.T) {
+	tests := []struct {
+		name       string
+		tenant     string
+		base       *fakeConnector
+		wantErr    string
+		wantClosed bool
+	}{
+		{name: "sets the tenant", tenant: "acme", base: &fakeConnector{}},
+		{name: "empty tenant", tenant: "", base: &fakeConnector{}, wantErr: "tenant must not be empty"},
+		{name: "connect fails", tenant: "acme", base: &fakeConnector{connectErr: errors.New("refused")}, wantErr: "refused"},
+		{name: "no ExecerContext", tenant: "acme", base: &fakeConnector{noExecer: true},
+			wantErr: "does not implement ExecerContext", wantClosed: true},
+		{name: "set_config fails", tenant: "acme", base: &fakeConnector{execErr: errors.New("read-only")},
+			wantErr: "failed to set tenant: read-only", wantClosed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := TenantConnector(tt.base, tt.tenant).Connect(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				if conn != nil {
+					t.Fatal("returned a connection with an error")
+				}
+				if tt.wantClosed && !tt.base.conns[0].closed {
+					t.Fatal("connection left open")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := conn.(*fakeConn)
+			// Session-level (is_local false), so it outlives transactions
+			if len(c.execs) != 1 || c.execs[0] != "SELECT set_config('ruleengine.tenant', $1, false)" ||
+				c.args[0].Value != "acme" {
+				t.Fatalf("statements %v with %v", c.execs, c.args)
+			}
+		})
+	}
+}
+
+func TestTenantConnectorPool(t *testing.T) {
+	base := &fakeConnector{}
+	db := sql.OpenDB(TenantConnector(base, "acme"))
+	defer db.Close()
+	// Every pooled connection gets the tenant when it is opened
+	db.SetMaxIdleConns(0)
+	for i := 0; i < 3; i++ {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if len(base.conns) != 3 {
+		t.Fatalf("%d connections opened", len(base.conns))
+	}
+	for i, c := range base.conns {
+		if len(c.execs) != 1 || c.args[0].Value != "acme" {
+			t.Fatalf("connection %d: %v", i, c.execs)
+		}
+	}
+}
+
+func TestEnableTenancy(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectExec(`ALTER TABLE rule_definitions ADD COLUMN IF NOT EXISTS tenant_id`).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := client.EnableTenancy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec(`tenant_id`).WillReturnError(errors.New("must be owner of table rule_definitions"))
+	if err := client.EnableTenancy(context.Background()); err == nil || !strings.Contains(err.Error(), "failed to install tenancy") {
+		t.Fatalf("err = %v", err)
+	}
+
+	// Every repository table gets the policy, forced for the owner too
+	for _, want := range []string{"'rule_definitions', 'rule_versions', 'rule_sets', 'rule_set_members'",
+		"ENABLE ROW LEVEL SECURITY", "FORCE ROW LEVEL SECURITY", "WITH CHECK (rule_tenant_visible(tenant_id))"} {
+		if !strings.Contains(tenancySQL, want) {
+			t.Errorf("tenancy.sql lacks %q", want)
+		}
+	}
+}
+
+func TestWithDB(t *testing.T) {
+	client, _ := newMock(t)
+	client.rollouts = true
+	other, _ := newMock(t)
+	scoped := client.WithDB(other.DB())
+	if scoped.DB() != other.DB() || !scoped.rollouts || scoped.hits != client.hits || scoped.opsDB != client.opsDB {
+		t.Fatalf("WithDB = %+v", scoped)
+	}
+}
+
+// TestTenantIsolation needs RULETEST_DATABASE_URL for a role that is
+// neither a superuser nor BYPASSRLS
+func TestTenantIsolation(t *testing.T) {
+	client := testDB(t)
+	ctx := context.Background()
+	var bypass bool
+	if err := client.DB().QueryRowContext(ctx,
+		"SELECT rolsuper OR rolbypassrls FROM pg_roles WHERE rolname = current_user").Scan(&bypass); err != nil {
+		t.Fatal(err)
+	}
+	if bypass {
+		t.Skip("the test role bypasses row-level security")
+	}
+	if err := client.EnableTenancy(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tenant := func(name string) *Client {
+		connector, err := pq.NewConnector(os.Getenv("RULETEST_DATABASE_URL"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := sql.OpenDB(TenantConnector(connector, name))
+		t.Cleanup(func() { db.Close() })
+		return client.WithDB(db)
+	}
+	acme, globex := tenant("acme"), tenant("globex")
+
+	name := "TenantTest" + time.Now().Format("150405")
+	if _, err := acme.CreateRule(ctx, SaveRuleInput{Name: name, GRL: `rule ` + name + ` "" { when true then Retract("` + name + `"); }`}); err != nil {
+		t.Fatal(err)
+	}
+	defer acme.DeleteRule(ctx, name, "")
+
+	if _, err := acme.GetRule(ctx, name); err != nil {
+		t.Fatalf("owner cannot see its rule: %v", err)
+	}
+	if _, err := globex.GetRule(ctx, name); !errors.Is(err, ErrRuleNotFound) {
+		t.Fatalf("another tenant sees the rule: %v", err)
+	}
+	if err := globex.DisableRule(ctx, name); err == nil {
+		t.Fatal("another tenant disabled the rule")
+	}
+	if _, err := client.GetRule(ctx, name); err != nil {
+		t.Fatalf("a session without a tenant cannot see the rule: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package ruleengine
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Limits mirror the extension's table constraints so bad input fails fast
+// with a typed error instead of a Postgres exception.
+var (
+	ruleNamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+	versionPattern  = regexp.MustCompile(`^\d+\.\d+\.\d+(-[a-zA-Z0-9]+)?$`)
+)
+
+const maxGRLSize = 1048576
+
+func validateRuleName(name string) error {
+	if !ruleNamePattern.MatchString(name) {
+		return &ValidationError{Field: "name", Message: "must start with a letter and contain only letters, digits, '_' and '-'"}
+	}
+	return nil
+}
+
+func validateVersion(field, version string) error {
+	if version != "" && !versionPattern.MatchString(version) {
+		return &ValidationError{Field: field, Message: "must be a semantic version like 1.2.3"}
+	}
+	return nil
+}
+
+func validateGRL(grl string) error {
+	if strings.TrimSpace(grl) == "" {
+		return &ValidationError{Field: "grl", Message: "must not be empty"}
+	}
+	if len(grl) > maxGRLSize {
+		return &ValidationError{Field: "grl", Message: "exceeds 1MB"}
+	}
+	return nil
+}
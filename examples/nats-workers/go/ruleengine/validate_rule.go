@@ -0,0 +1,66 @@
+package ruleengine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ValidationReport is the extension's verdict on a candidate rule
+type ValidationReport struct {
+	Valid    bool     `json:"valid"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+// ValidateRule checks GRL syntax and lints it with rule_validate. Nothing is
+// stored; a report with Valid=false is not an error.
+func (c *Client) ValidateRule(ctx context.Context, grl string) (*ValidationReport, error) {
+	if err := validateGRL(grl); err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	if err := c.db.QueryRowContext(ctx, "SELECT rule_validate($1)", grl).Scan(&raw); err != nil {
+		return nil, err
+	}
+
+	var report ValidationReport
+	if err := json.Unmarshal(raw, &report); err != nil {
+		return nil, fmt.Errorf("invalid rule_validate response: %w", err)
+	}
+	return &report, nil
+}
+
+// DryRun evaluates a candidate GRL document against sample facts and returns
+// the hypothetical result. It runs inside a transaction that is always
+// rolled back, so neither the rule nor any debug events are persisted.
+func (c *Client) DryRun(ctx context.Context, grl string, facts interface{}) (*Result, error) {
+	start := time.Now()
+	if err := validateGRL(grl); err != nil {
+		return nil, err
+	}
+	factsJSON, err := json.Marshal(facts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode facts: %w", err)
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result := &Result{MatchedRules: []string{}, Actions: []Action{}, Trace: []TraceEvent{}}
+	output, err := runDebug(ctx, tx, "dry-run", grl, string(factsJSON), result)
+	if err != nil {
+		return nil, &EvaluationError{Rule: "dry-run", Err: err}
+	}
+
+	if err := json.Unmarshal([]byte(output), &result.Facts); err != nil {
+		return nil, fmt.Errorf("engine returned invalid facts: %w", err)
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestValidateRule(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     ValidationReport
+		wantErr  bool
+	}{
+		{name: "valid", response: `{"valid":true,"errors":[],"warnings":["no salience"]}`,
+			want: ValidationReport{Valid: true, Errors: []string{}, Warnings: []string{"no salience"}}},
+		{name: "invalid is not an error", response: `{"valid":false,"errors":["unexpected token"],"warnings":[]}`,
+			want: ValidationReport{Errors: []string{"unexpected token"}, Warnings: []string{}}},
+		{name: "garbage response", response: `<html>`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			mock.ExpectQuery(`rule_validate`).WillReturnRows(sqlmock.NewRows([]string{"rule_validate"}).AddRow([]byte(tt.response)))
+			report, err := client.ValidateRule(context.Background(), `rule A "" { when true then Retract("A"); }`)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if report.Valid != tt.want.Valid || len(report.Errors) != len(tt.want.Errors) || len(report.Warnings) != len(tt.want.Warnings) {
+				t.Fatalf("report = %+v, want %+v", report, tt.want)
+			}
+		})
+	}
+
+	client, _ := newMock(t)
+	var verr *ValidationError
+	if _, err := client.ValidateRule(context.Background(), ""); !errors.As(err, &verr) {
+		t.Fatalf("empty GRL: err = %v, want a ValidationError", err)
+	}
+}
+
+func TestDryRunRollsBack(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectBegin()
+	expectDebugRun(mock, "dry", `{"Order":{"flagged":true}}`, "A")
+	mock.ExpectRollback()
+
+	result, err := client.DryRun(context.Background(), `rule A "" { when true then Order.flagged = true; }`, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.MatchedRules) != 1 || result.Trace[0].RuleSetMember != "dry-run" {
+		t.Fatalf("result = %+v", result)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("dry run was not rolled back: %v", err)
+	}
+}
+
+func TestDryRunEngineError(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`run_rule_engine_debug`).WillReturnError(errors.New("syntax error"))
+	mock.ExpectRollback()
+
+	_, err := client.DryRun(context.Background(), `rule A`, nil)
+	var evalErr *EvaluationError
+	if !errors.As(err, &evalErr) || evalErr.Rule != "dry-run" {
+		t.Fatalf("err = %v, want an EvaluationError for dry-run", err)
+	}
+}
@@ -0,0 +1,177 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// RuleVersion is one saved version of a rule
+type RuleVersion struct {
+	Version     string    `json:"version"`
+	ChangeNotes string    `json:"change_notes,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	IsActive    bool      `json:"is_active"`
+	GRL         string    `json:"grl,omitempty"` // Only set by GetVersion
+}
+
+// ListVersions returns a rule's version history, newest first
+func (c *Client) ListVersions(ctx context.Context, name string) ([]RuleVersion, error) {
+	if err := validateRuleName(name); err != nil {
+		return nil, err
+	}
+
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT rv.version, COALESCE(rv.change_notes, ''), rv.created_at,
+		        COALESCE(rv.created_by, ''), rv.is_default
+		 FROM rule_versions rv
+		 JOIN rule_definitions rd ON rv.rule_id = rd.id
+		 WHERE rd.name = $1
+		 ORDER BY rv.created_at DESC, rv.id DESC`,
+		name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []RuleVersion
+	for rows.Next() {
+		var v RuleVersion
+		if err := rows.Scan(&v.Version, &v.ChangeNotes, &v.CreatedAt, &v.CreatedBy, &v.IsActive); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%s: %w", name, ErrRuleNotFound)
+	}
+	return versions, nil
+}
+
+// GetVersion returns one version of a rule including its GRL
+func (c *Client) GetVersion(ctx context.Context, name, version string) (*RuleVersion, error) {
+	if err := validateRuleName(name); err != nil {
+		return nil, err
+	}
+	if err := validateVersion("version", version); err != nil {
+		return nil, err
+	}
+
+	v := RuleVersion{Version: version}
+	err := c.db.QueryRowContext(ctx,
+		`SELECT COALESCE(rv.change_notes, ''), rv.created_at, COALESCE(rv.created_by, ''),
+		        rv.is_default, rv.grl_content
+		 FROM rule_versions rv
+		 JOIN rule_definitions rd ON rv.rule_id = rd.id
+		 WHERE rd.name = $1 AND rv.version = $2`,
+		name, version,
+	).Scan(&v.ChangeNotes, &v.CreatedAt, &v.CreatedBy, &v.IsActive, &v.GRL)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s@%s: %w", name, version, ErrRuleNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// DiffVersions compares the GRL of two versions of a rule line by line
+func (c *Client) DiffVersions(ctx context.Context, name, from, to string) (*VersionDiff, error) {
+	a, err := c.GetVersion(ctx, name, from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.GetVersion(ctx, name, to)
+	if err != nil {
+		return nil, err
+	}
+	return &VersionDiff{Rule: name, From: from, To: to, Lines: diffLines(a.GRL, b.GRL)}, nil
+}
+
+// RollbackRule re-activates the version saved immediately before the
+// active one and returns it. It fails with *ConflictError if another
+// change activated a different version concurrently.
+func (c *Client) RollbackRule(ctx context.Context, name string) (string, error) {
+	versions, err := c.ListVersions(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	for i, v := range versions {
+		if !v.IsActive {
+			continue
+		}
+		if i+1 >= len(versions) {
+			return "", &ValidationError{Field: "version", Message: fmt.Sprintf("%s has no version older than %s", name, v.Version)}
+		}
+		previous := versions[i+1].Version
+		if err := c.ActivateVersion(ctx, name, previous, v.Version); err != nil {
+			return "", err
+		}
+		return previous, nil
+	}
+	return "", &ValidationError{Field: "version", Message: fmt.Sprintf("%s has no active version", name)}
+}
+
+// PinRuleVersion makes a rule set evaluate a specific version of one of its
+// rules instead of following the active version. An empty version unpins.
+func (c *Client) PinRuleVersion(ctx context.Context, rulesetID int, rule, version string) error {
+	if err := validateRuleName(rule); err != nil {
+		return err
+	}
+	if err := validateVersion("version", version); err != nil {
+		return err
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if version != "" {
+		var exists bool
+		if err := tx.QueryRowContext(ctx,
+			`SELECT EXISTS (SELECT 1 FROM rule_versions rv
+			 JOIN rule_definitions rd ON rv.rule_id = rd.id
+			 WHERE rd.name = $1 AND rv.version = $2)`,
+			rule, version,
+		).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%s@%s: %w", rule, version, ErrRuleNotFound)
+		}
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE rule_set_members SET rule_version = $3
+		 WHERE ruleset_id = $1 AND rule_name = $2
+		   AND (SELECT COUNT(*) FROM rule_set_members
+		        WHERE ruleset_id = $1 AND rule_name = $2) = 1`,
+		rulesetID, rule, nullString(version),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var count int
+		if err := tx.QueryRowContext(ctx,
+			"SELECT COUNT(*) FROM rule_set_members WHERE ruleset_id = $1 AND rule_name = $2",
+			rulesetID, rule,
+		).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("%s in rule set %d: %w", rule, rulesetID, ErrRuleNotFound)
+		}
+		return &ValidationError{Field: "rule", Message: fmt.Sprintf("%s is in rule set %d %d times; remove the extra memberships first", rule, rulesetID, count)}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,120 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func versionRows(active string, versions ...string) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"version", "change_notes", "created_at", "created_by", "is_default"})
+	for _, v := range versions {
+		rows.AddRow(v, "", time.Now(), "", v == active)
+	}
+	return rows
+}
+
+func TestRollbackRule(t *testing.T) {
+	t.Run("activates the previous version", func(t *testing.T) {
+		client, mock := newMock(t)
+		mock.ExpectQuery(`FROM rule_versions rv`).WithArgs("A").
+			WillReturnRows(versionRows("1.0.1", "1.0.2", "1.0.1", "1.0.0"))
+		mock.ExpectBegin()
+		mock.ExpectQuery(`FOR UPDATE OF rd`).WithArgs("A").
+			WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("1.0.1"))
+		mock.ExpectExec(`rule_activate`).WithArgs("A", "1.0.0").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		got, err := client.RollbackRule(context.Background(), "A")
+		if err != nil || got != "1.0.0" {
+			t.Fatalf("RollbackRule = %q, %v", got, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		versions *sqlmock.Rows
+	}{
+		{"oldest is active", versionRows("1.0.0", "1.0.1", "1.0.0")},
+		{"nothing active", versionRows("", "1.0.1", "1.0.0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			mock.ExpectQuery(`FROM rule_versions rv`).WillReturnRows(tt.versions)
+			var validation *ValidationError
+			if _, err := client.RollbackRule(context.Background(), "A"); !errors.As(err, &validation) {
+				t.Fatalf("err = %v, want *ValidationError", err)
+			}
+		})
+	}
+
+	t.Run("unknown rule", func(t *testing.T) {
+		client, mock := newMock(t)
+		mock.ExpectQuery(`FROM rule_versions rv`).WillReturnRows(versionRows(""))
+		if _, err := client.RollbackRule(context.Background(), "A"); !errors.Is(err, ErrRuleNotFound) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+}
+
+func TestPinRuleVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  string
+		exists   bool
+		affected int64
+		count    int
+		wantErr  error // nil: success; errValidation: *ValidationError
+	}{
+		{name: "pin", version: "1.0.0", exists: true, affected: 1},
+		{name: "unpin", affected: 1},
+		{name: "unknown version", version: "9.9.9", wantErr: ErrRuleNotFound},
+		{name: "not a member", version: "1.0.0", exists: true, wantErr: ErrRuleNotFound},
+		{name: "duplicate member", version: "1.0.0", exists: true, count: 2, wantErr: errValidation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			mock.ExpectBegin()
+			if tt.version != "" {
+				mock.ExpectQuery(`SELECT EXISTS`).WithArgs("A", tt.version).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.exists))
+			}
+			if tt.exists || tt.version == "" {
+				mock.ExpectExec(`UPDATE rule_set_members`).WillReturnResult(sqlmock.NewResult(0, tt.affected))
+			}
+			if tt.exists && tt.affected == 0 {
+				mock.ExpectQuery(`SELECT COUNT`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.count))
+			}
+			if tt.wantErr == nil {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			err := client.PinRuleVersion(context.Background(), 1, "A", tt.version)
+			switch {
+			case tt.wantErr == errValidation:
+				var validation *ValidationError
+				if !errors.As(err, &validation) {
+					t.Fatalf("err = %v, want *ValidationError", err)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// errValidation marks table cases that expect a *ValidationError
+var errValidation = errors.New("validation error")
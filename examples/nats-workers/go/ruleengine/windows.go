@@ -0,0 +1,254 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+//go:embed windows.sql
+var windowsSQL string
+
+// ErrWindowNotFound is returned for an unknown window name
+var ErrWindowNotFound = errors.New("window not found")
+
+// Window aggregates
+const (
+	WindowCount = "count"
+	WindowSum   = "sum"
+	WindowAvg   = "avg"
+	WindowMin   = "min"
+	WindowMax   = "max"
+)
+
+// jsonPathPattern matches dotted paths into JSON documents, including
+// top-level keys
+var jsonPathPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// Window aggregates events arriving on a NATS subject per key over a
+// sliding time window, e.g. failed logins per user over ten minutes.
+// Evaluations on a client with EnableWindows see each window's current
+// value for the facts' key as Windows.<Name>.
+type Window struct {
+	// Name is a plain identifier, used in rules as Windows.<Name>
+	Name string `json:"name"`
+
+	// Subject is the NATS subject pattern events arrive on (* and >
+	// wildcards)
+	Subject string `json:"subject"`
+
+	// KeyPath is the dotted path of the grouping key in events, e.g.
+	// user_id; FactKeyPath is the same key in fact documents, e.g.
+	// Login.user_id (default KeyPath)
+	KeyPath     string `json:"key_path"`
+	FactKeyPath string `json:"fact_key_path"`
+
+	// ValuePath is the dotted path of the numeric value that sum, avg,
+	// min, and max aggregate
+	ValuePath string `json:"value_path,omitempty"`
+
+	// Aggregate is WindowCount (default), WindowSum, WindowAvg,
+	// WindowMin, or WindowMax
+	Aggregate string `json:"aggregate"`
+
+	// Duration is the window length. Events are counted into buckets of
+	// Bucket (default Duration/60, at least a second), so the window
+	// slides in steps of Bucket.
+	Duration time.Duration `json:"duration"`
+	Bucket   time.Duration `json:"bucket"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// EnableWindows creates the window tables and functions if needed and
+// makes Evaluate add window values to facts, at the cost of one query per
+// evaluation.
+func (c *Client) EnableWindows(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, windowsSQL); err != nil {
+		return fmt.Errorf("failed to install windows: %w", err)
+	}
+	c.windows = true
+	return nil
+}
+
+// CreateWindow registers w. It starts empty; events recorded from then on
+// count toward it.
+func (c *Client) CreateWindow(ctx context.Context, w Window) error {
+	if !identifierPattern.MatchString(w.Name) {
+		return &ValidationError{Field: "name", Message: "must be a plain identifier"}
+	}
+	if w.Subject == "" {
+		return &ValidationError{Field: "subject", Message: "is required"}
+	}
+	if w.FactKeyPath == "" {
+		w.FactKeyPath = w.KeyPath
+	}
+	if w.Aggregate == "" {
+		w.Aggregate = WindowCount
+	}
+	// key_path first: fact_key_path defaults to it
+	for _, f := range []struct{ field, path string }{{"key_path", w.KeyPath}, {"fact_key_path", w.FactKeyPath}} {
+		if !jsonPathPattern.MatchString(f.path) {
+			return &ValidationError{Field: f.field, Message: "must be a dotted path like user_id or Login.user_id"}
+		}
+	}
+	switch w.Aggregate {
+	case WindowCount:
+	case WindowSum, WindowAvg, WindowMin, WindowMax:
+		if !jsonPathPattern.MatchString(w.ValuePath) {
+			return &ValidationError{Field: "value_path", Message: fmt.Sprintf("is required for %s windows", w.Aggregate)}
+		}
+	default:
+		return &ValidationError{Field: "aggregate", Message: "must be count, sum, avg, min, or max"}
+	}
+	if w.Duration < time.Second {
+		return &ValidationError{Field: "duration", Message: "must be at least a second"}
+	}
+	if w.Bucket == 0 {
+		w.Bucket = (w.Duration / 60).Round(time.Second)
+		if w.Bucket < time.Second {
+			w.Bucket = time.Second
+		}
+	}
+	if w.Bucket < time.Second || w.Bucket > w.Duration {
+		return &ValidationError{Field: "bucket", Message: "must be between a second and the duration"}
+	}
+
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO rule_windows (name, subject, key_path, fact_key_path, value_path, aggregate, duration, bucket)
+		 VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7::FLOAT8 * INTERVAL '1 second', $8::FLOAT8 * INTERVAL '1 second')`,
+		w.Name, w.Subject, w.KeyPath, w.FactKeyPath, w.ValuePath, w.Aggregate, w.Duration.Seconds(), w.Bucket.Seconds(),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const windowColumns = `name, subject, key_path, fact_key_path, COALESCE(value_path, ''), aggregate,
+	EXTRACT(EPOCH FROM duration)::FLOAT8, EXTRACT(EPOCH FROM bucket)::FLOAT8, created_at`
+
+func scanWindow(row interface{ Scan(...interface{}) error }) (*Window, error) {
+	var w Window
+	var duration, bucket float64
+	if err := row.Scan(&w.Name, &w.Subject, &w.KeyPath, &w.FactKeyPath, &w.ValuePath, &w.Aggregate,
+		&duration, &bucket, &w.CreatedAt); err != nil {
+		return nil, err
+	}
+	w.Duration = time.Duration(duration * float64(time.Second))
+	w.Bucket = time.Duration(bucket * float64(time.Second))
+	return &w, nil
+}
+
+// GetWindow returns one window
+func (c *Client) GetWindow(ctx context.Context, name string) (*Window, error) {
+	w, err := scanWindow(c.db.QueryRowContext(ctx,
+		"SELECT "+windowColumns+" FROM rule_windows WHERE name = $1", name,
+	))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s: %w", name, ErrWindowNotFound)
+	}
+	return w, err
+}
+
+// ListWindows returns all windows by name
+func (c *Client) ListWindows(ctx context.Context) ([]Window, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT "+windowColumns+" FROM rule_windows ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	windows := []Window{}
+	for rows.Next() {
+		w, err := scanWindow(rows)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, *w)
+	}
+	return windows, rows.Err()
+}
+
+// DeleteWindow removes a window and its buckets
+func (c *Client) DeleteWindow(ctx context.Context, name string) error {
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM rule_windows WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", name, ErrWindowNotFound)
+	}
+	return tx.Commit()
+}
+
+// RecordWindowEvent counts event, which arrived on subject, into every
+// window it matches and returns how many that was. The NATS webhook
+// worker records events from WINDOW_SUBJECTS this way; services can also
+// record events directly.
+func (c *Client) RecordWindowEvent(ctx context.Context, subject string, event interface{}) (int, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode event: %w", err)
+	}
+	var n int
+	err = c.db.QueryRowContext(ctx, "SELECT rule_window_record($1, $2)", subject, data).Scan(&n)
+	return n, err
+}
+
+// WindowValue returns a window's current aggregate for key. ok is false
+// when an avg, min, or max window has no events for key in its duration.
+func (c *Client) WindowValue(ctx context.Context, name, key string) (value float64, ok bool, err error) {
+	var v sql.NullFloat64
+	var exists bool
+	if err := c.db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM rule_windows WHERE name = $1), rule_window_value($1, $2)", name, key,
+	).Scan(&exists, &v); err != nil {
+		return 0, false, err
+	}
+	if !exists {
+		return 0, false, fmt.Errorf("%s: %w", name, ErrWindowNotFound)
+	}
+	return v.Float64, v.Valid, nil
+}
+
+// PruneWindows deletes buckets that have left their windows and returns
+// how many. The NATS webhook worker's leader runs it every minute. Before
+// EnableWindows it does nothing.
+func (c *Client) PruneWindows(ctx context.Context) (int64, error) {
+	var installed bool
+	if err := c.db.QueryRowContext(ctx, "SELECT to_regclass('rule_windows') IS NOT NULL").Scan(&installed); err != nil {
+		return 0, err
+	}
+	if !installed {
+		return 0, nil
+	}
+	var n int64
+	err := c.db.QueryRowContext(ctx, "SELECT rule_window_prune()").Scan(&n)
+	return n, err
+}
+
+// windowFacts adds Windows.<name> values to a JSON fact document
+func (c *Client) windowFacts(ctx context.Context, factsJSON []byte) ([]byte, error) {
+	var out []byte
+	if err := c.db.QueryRowContext(ctx, "SELECT rule_window_facts($1)", factsJSON).Scan(&out); err != nil {
+		return nil, fmt.Errorf("failed to add window values: %w", err)
+	}
+	return out, nil
+}
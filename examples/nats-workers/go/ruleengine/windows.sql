@@ -0,0 +1,131 @@
+-- Windowed aggregates (see EnableWindows). Events recorded with
+-- rule_window_record are counted into fixed-size time buckets per window
+-- and key; rule_window_facts adds each window's current value to a fact
+-- document so rules can test conditions such as "more than 5 failed logins
+-- in 10 minutes" as Windows.failed_logins > 5.
+
+CREATE TABLE IF NOT EXISTS rule_windows (
+    name TEXT PRIMARY KEY,
+    subject TEXT NOT NULL,
+    key_path TEXT NOT NULL,
+    fact_key_path TEXT NOT NULL,
+    value_path TEXT,
+    aggregate TEXT NOT NULL DEFAULT 'count' CHECK (aggregate IN ('count', 'sum', 'avg', 'min', 'max')),
+    duration INTERVAL NOT NULL,
+    bucket INTERVAL NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS rule_window_buckets (
+    window_name TEXT NOT NULL REFERENCES rule_windows (name) ON DELETE CASCADE,
+    key TEXT NOT NULL,
+    bucket_start TIMESTAMPTZ NOT NULL,
+    count BIGINT NOT NULL,
+    sum DOUBLE PRECISION NOT NULL DEFAULT 0,
+    min DOUBLE PRECISION,
+    max DOUBLE PRECISION,
+    PRIMARY KEY (window_name, key, bucket_start)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rule_window_buckets_start ON rule_window_buckets (bucket_start);
+
+-- NATS subject matching: * matches one token, a trailing > the rest
+CREATE OR REPLACE FUNCTION rule_window_subject_matches(p_pattern TEXT, p_subject TEXT)
+RETURNS BOOLEAN AS $$
+    SELECT p_subject ~ ('^' || replace(replace(
+        regexp_replace(p_pattern, '([.+?^$()\[\]{}|\\])', '\\\1', 'g'),
+        '*', '[^.]+'), '>', '.+') || '$')
+$$ LANGUAGE sql IMMUTABLE;
+
+-- Counts one event into every window whose subject pattern matches and
+-- whose key (and, except for count windows, numeric value) the event has.
+-- Returns the number of windows updated.
+CREATE OR REPLACE FUNCTION rule_window_record(p_subject TEXT, p_event JSONB, p_at TIMESTAMPTZ DEFAULT now())
+RETURNS INTEGER AS $$
+DECLARE
+    v_rows INTEGER;
+BEGIN
+    INSERT INTO rule_window_buckets AS b (window_name, key, bucket_start, count, sum, min, max)
+    SELECT w.name, e.key,
+           to_timestamp(floor(EXTRACT(EPOCH FROM p_at) / EXTRACT(EPOCH FROM w.bucket)) * EXTRACT(EPOCH FROM w.bucket)),
+           1, COALESCE(e.value, 0), e.value, e.value
+    FROM rule_windows w
+    CROSS JOIN LATERAL (
+        SELECT p_event #>> string_to_array(w.key_path, '.') AS key,
+               CASE WHEN jsonb_typeof(p_event #> string_to_array(w.value_path, '.')) = 'number'
+                    THEN (p_event #>> string_to_array(w.value_path, '.'))::DOUBLE PRECISION
+               END AS value
+    ) e
+    WHERE rule_window_subject_matches(w.subject, p_subject)
+      AND e.key IS NOT NULL
+      AND (w.aggregate = 'count' OR e.value IS NOT NULL)
+    ON CONFLICT (window_name, key, bucket_start) DO UPDATE SET
+        count = b.count + 1,
+        sum = b.sum + EXCLUDED.sum,
+        min = LEAST(b.min, EXCLUDED.min),
+        max = GREATEST(b.max, EXCLUDED.max);
+    GET DIAGNOSTICS v_rows = ROW_COUNT;
+    RETURN v_rows;
+END;
+$$ LANGUAGE plpgsql;
+
+-- A window's aggregate for one key over the buckets that start within its
+-- duration before p_at; NULL for an unknown window, or for avg, min, and
+-- max with no events
+CREATE OR REPLACE FUNCTION rule_window_value(p_name TEXT, p_key TEXT, p_at TIMESTAMPTZ DEFAULT now())
+RETURNS DOUBLE PRECISION AS $$
+    SELECT CASE w.aggregate
+               WHEN 'count' THEN COALESCE(SUM(b.count), 0)::DOUBLE PRECISION
+               WHEN 'sum' THEN COALESCE(SUM(b.sum), 0)
+               WHEN 'avg' THEN SUM(b.sum) / NULLIF(SUM(b.count), 0)
+               WHEN 'min' THEN MIN(b.min)
+               WHEN 'max' THEN MAX(b.max)
+           END
+    FROM rule_windows w
+    LEFT JOIN rule_window_buckets b
+           ON b.window_name = w.name AND b.key = p_key
+          AND b.bucket_start > p_at - w.duration AND b.bucket_start <= p_at
+    WHERE w.name = p_name
+    GROUP BY w.aggregate
+$$ LANGUAGE sql STABLE;
+
+-- Adds Windows.<name> to p_facts for every window whose fact key is
+-- present, e.g. {"Login": {"user": "u1"}} becomes {"Login": ...,
+-- "Windows": {"failed_logins": 6}}
+CREATE OR REPLACE FUNCTION rule_window_facts(p_facts JSONB)
+RETURNS JSONB AS $$
+DECLARE
+    w RECORD;
+    v_key TEXT;
+    v_windows JSONB := '{}';
+BEGIN
+    FOR w IN SELECT name, fact_key_path FROM rule_windows LOOP
+        v_key := p_facts #>> string_to_array(w.fact_key_path, '.');
+        IF v_key IS NOT NULL THEN
+            v_windows := v_windows || jsonb_build_object(w.name, rule_window_value(w.name, v_key));
+        END IF;
+    END LOOP;
+    IF v_windows = '{}' THEN
+        RETURN p_facts;
+    END IF;
+    RETURN p_facts || jsonb_build_object('Windows', COALESCE(p_facts -> 'Windows', '{}') || v_windows);
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+-- Deletes buckets that have left their window and returns how many
+CREATE OR REPLACE FUNCTION rule_window_prune()
+RETURNS BIGINT AS $$
+DECLARE
+    v_rows BIGINT;
+BEGIN
+    DELETE FROM rule_window_buckets b
+    USING rule_windows w
+    WHERE b.window_name = w.name AND b.bucket_start <= now() - w.duration;
+    GET DIAGNOSTICS v_rows = ROW_COUNT;
+    RETURN v_rows;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON TABLE rule_windows IS 'Time-windowed aggregates of events that rules can test';
+COMMENT ON TABLE rule_window_buckets IS 'Per-bucket event counts and value totals of each window and key';
+COMMENT ON FUNCTION rule_window_facts IS 'Adds Windows.<name> aggregates to a fact document';
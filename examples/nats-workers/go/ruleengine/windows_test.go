@@ -0,0 +1,258 @@
+package ruleengine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCreateWindowValidation(t *testing.T) {
+	valid := Window{Name: "failed_logins", Subject: "auth.failed", KeyPath: "user_id", Duration: 10 * time.Minute}
+	tests := []struct {
+		name      string
+		edit      func(w *Window)
+		wantField string
+	}{
+		{name: "bad name", edit: func(w *Window) { w.Name = "failed-logins" }, wantField: "name"},
+		{name: "no subject", edit: func(w *Window) { w.Subject = "" }, wantField: "subject"},
+		{name: "no key path", edit: func(w *Window) { w.KeyPath = "" }, wantField: "key_path"},
+		{name: "bad key path", edit: func(w *Window) { w.KeyPath = "user..id" }, wantField: "key_path"},
+		{name: "bad fact key path", edit: func(w *Window) { w.FactKeyPath = "Login.user id" }, wantField: "fact_key_path"},
+		{name: "sum without a value", edit: func(w *Window) { w.Aggregate = WindowSum }, wantField: "value_path"},
+		{name: "unknown aggregate", edit: func(w *Window) { w.Aggregate = "median" }, wantField: "aggregate"},
+		{name: "short duration", edit: func(w *Window) { w.Duration = time.Millisecond }, wantField: "duration"},
+		{name: "bucket longer than duration", edit: func(w *Window) { w.Bucket = time.Hour }, wantField: "bucket"},
+		{name: "sub-second bucket", edit: func(w *Window) { w.Bucket = time.Millisecond }, wantField: "bucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newMock(t)
+			w := valid
+			tt.edit(&w)
+			var verr *ValidationError
+			if err := client.CreateWindow(context.Background(), w); !errors.As(err, &verr) || verr.Field != tt.wantField {
+				t.Fatalf("err = %v, want a %s validation error", err, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestCreateWindow(t *testing.T) {
+	tests := []struct {
+		name string
+		w    Window
+		// fact key path, value path, aggregate, duration and bucket
+		// seconds as inserted
+		factKey, value, aggregate string
+		duration, bucket          float64
+	}{
+		{name: "defaults", w: Window{Name: "w", Subject: "auth.>", KeyPath: "user_id", Duration: 10 * time.Minute},
+			factKey: "user_id", aggregate: WindowCount, duration: 600, bucket: 10},
+		{name: "short windows use one-second buckets", w: Window{Name: "w", Subject: "auth.>", KeyPath: "user_id", Duration: 30 * time.Second},
+			factKey: "user_id", aggregate: WindowCount, duration: 30, bucket: 1},
+		{name: "explicit", w: Window{Name: "w", Subject: "orders.*", KeyPath: "customer", FactKeyPath: "Order.customer",
+			ValuePath: "total", Aggregate: WindowAvg, Duration: time.Hour, Bucket: 5 * time.Minute},
+			factKey: "Order.customer", value: "total", aggregate: WindowAvg, duration: 3600, bucket: 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			mock.ExpectBegin()
+			mock.ExpectExec(`INSERT INTO rule_windows`).
+				WithArgs(tt.w.Name, tt.w.Subject, tt.w.KeyPath, tt.factKey, tt.value, tt.aggregate, tt.duration, tt.bucket).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			if err := client.CreateWindow(context.Background(), tt.w); err != nil {
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestGetWindow(t *testing.T) {
+	client, mock := newMock(t)
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`FROM rule_windows WHERE name = \$1`).WithArgs("spend").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "subject", "key_path", "fact_key_path", "value_path", "aggregate",
+			"duration", "bucket", "created_at"}).
+			AddRow("spend", "orders.*", "customer", "Order.customer", "total", WindowSum, 86400.0, 1.5, created))
+	w, err := client.GetWindow(context.Background(), "spend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Window{Name: "spend", Subject: "orders.*", KeyPath: "customer", FactKeyPath: "Order.customer", ValuePath: "total",
+		Aggregate: WindowSum, Duration: 24 * time.Hour, Bucket: 1500 * time.Millisecond, CreatedAt: created}
+	if *w != want {
+		t.Fatalf("window = %+v", w)
+	}
+
+	mock.ExpectQuery(`FROM rule_windows WHERE name = \$1`).WithArgs("nope").WillReturnRows(sqlmock.NewRows(nil))
+	if _, err := client.GetWindow(context.Background(), "nope"); !errors.Is(err, ErrWindowNotFound) {
+		t.Fatalf("err = %v, want ErrWindowNotFound", err)
+	}
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM rule_windows`).WithArgs("nope").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	if err := client.DeleteWindow(context.Background(), "nope"); !errors.Is(err, ErrWindowNotFound) {
+		t.Fatalf("err = %v, want ErrWindowNotFound", err)
+	}
+}
+
+func TestWindowValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		exists  bool
+		value   interface{}
+		want    float64
+		ok      bool
+		wantErr error
+	}{
+		{name: "value", exists: true, value: 6.0, want: 6, ok: true},
+		{name: "no events for an avg window", exists: true, value: nil},
+		{name: "unknown window", value: nil, wantErr: ErrWindowNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMock(t)
+			mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM rule_windows WHERE name = \$1\), rule_window_value\(\$1, \$2\)`).
+				WithArgs("failed_logins", "u1").
+				WillReturnRows(sqlmock.NewRows([]string{"exists", "value"}).AddRow(tt.exists, tt.value))
+			got, ok, err := client.WindowValue(context.Background(), "failed_logins", "u1")
+			if !errors.Is(err, tt.wantErr) || got != tt.want || ok != tt.ok {
+				t.Fatalf("WindowValue = %v, %v, %v; want %v, %v, %v", got, ok, err, tt.want, tt.ok, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRecordWindowEvent(t *testing.T) {
+	client, mock := newMock(t)
+	mock.ExpectQuery(`SELECT rule_window_record\(\$1, \$2\)`).WithArgs("auth.failed", []byte(`{"user_id":"u1"}`)).
+		WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(2))
+	if n, err := client.RecordWindowEvent(context.Background(), "auth.failed", map[string]string{"user_id": "u1"}); n != 2 || err != nil {
+		t.Fatalf("RecordWindowEvent = %d, %v", n, err)
+	}
+	if _, err := client.RecordWindowEvent(context.Background(), "auth.failed", func() {}); err == nil {
+		t.Fatal("expected an encoding error")
+	}
+}
+
+func TestPruneWindows(t *testing.T) {
+	client, mock := newMock(t)
+	mock.MatchExpectationsInOrder(true)
+	mock.ExpectQuery(`to_regclass\('rule_windows'\)`).WillReturnRows(sqlmock.NewRows([]string{"installed"}).AddRow(false))
+	if n, err := client.PruneWindows(context.Background()); n != 0 || err != nil {
+		t.Fatalf("PruneWindows = %d, %v", n, err)
+	}
+	mock.ExpectQuery(`to_regclass\('rule_windows'\)`).WillReturnRows(sqlmock.NewRows([]string{"installed"}).AddRow(true))
+	mock.ExpectQuery(`SELECT rule_window_prune\(\)`).WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(12))
+	if n, err := client.PruneWindows(context.Background()); n != 12 || err != nil {
+		t.Fatalf("PruneWindows = %d, %v", n, err)
+	}
+}
+
+func TestEvaluateWindows(t *testing.T) {
+	client, mock := newMock(t)
+	client.windows = true
+	grl := `rule Lock "" { when Windows.failed_logins > 5 then Login.locked = true; }`
+	client.cache = &ruleCache{rulesets: map[int][]ruleSetMember{}, rules: map[ruleKey]cachedRule{}}
+	client.cache.storeMembers(0, 7, []ruleSetMember{{name: "Lock"}})
+	client.cache.storeRule(0, ruleKey{"Lock", ""}, grl)
+
+	withWindows := `{"Login":{"user":"u1"},"Windows":{"failed_logins":6}}`
+	mock.ExpectQuery(`SELECT rule_window_facts\(\$1\)`).WithArgs([]byte(`{"Login":{"user":"u1"}}`)).
+		WillReturnRows(sqlmock.NewRows([]string{"facts"}).AddRow([]byte(withWindows)))
+	// The engine sees the window values
+	mock.ExpectQuery(`run_rule_engine_debug`).WithArgs(withWindows, grl).
+		WillReturnRows(sqlmock.NewRows([]string{"session_id", "result"}).AddRow("s1", `{"Login":{"locked":true}}`))
+	mock.ExpectQuery(`debug_get_events`).WillReturnRows(sqlmock.NewRows([]string{"step", "event_type", "description", "event_data"}))
+	mock.ExpectExec(`debug_delete_session`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if _, err := client.Evaluate(context.Background(), 7, map[string]interface{}{"Login": map[string]interface{}{"user": "u1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(`rule_window_facts`).WillReturnError(errors.New("permission denied for function rule_window_facts"))
+	if _, err := client.Evaluate(context.Background(), 7, map[string]interface{}{}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestWindowsDB(t *testing.T) {
+	client := testDB(t)
+	ctx := context.Background()
+	if err := client.EnableWindows(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db := client.DB()
+	suffix := time.Now().Format("150405")
+	count, avg := "logins_"+suffix, "spend_"+suffix
+	if err := client.CreateWindow(ctx, Window{Name: count, Subject: "auth." + suffix + ".*", KeyPath: "user",
+		FactKeyPath: "Login.user", Duration: 10 * time.Minute, Bucket: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	defer client.DeleteWindow(ctx, count)
+	if err := client.CreateWindow(ctx, Window{Name: avg, Subject: "orders." + suffix + ".>", KeyPath: "customer",
+		ValuePath: "total", Aggregate: WindowAvg, Duration: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	defer client.DeleteWindow(ctx, avg)
+
+	now := time.Now()
+	record := func(subject, event string, at time.Time) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRowContext(ctx, "SELECT rule_window_record($1, $2, $3)", subject, event, at).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	tests := []struct {
+		subject, event string
+		at             time.Time
+		want           int
+	}{
+		{"auth." + suffix + ".failed", `{"user":"u1"}`, now, 1},
+		{"auth." + suffix + ".failed", `{"user":"u1"}`, now.Add(-5 * time.Minute), 1},
+		{"auth." + suffix + ".failed", `{"user":"u1"}`, now.Add(-20 * time.Minute), 1}, // outside the window
+		{"auth." + suffix + ".failed.twice", `{"user":"u1"}`, now, 0},                  // * is one token
+		{"auth." + suffix + ".failed", `{"other":"u1"}`, now, 0},                       // no key
+		{"orders." + suffix + ".eu.paid", `{"customer":"c1","total":10}`, now, 1},
+		{"orders." + suffix + ".eu.paid", `{"customer":"c1","total":30}`, now, 1},
+		{"orders." + suffix + ".eu.paid", `{"customer":"c1","total":"n/a"}`, now, 0}, // not a number
+	}
+	for _, tt := range tests {
+		if n := record(tt.subject, tt.event, tt.at); n != tt.want {
+			t.Errorf("record %s %s = %d, want %d", tt.subject, tt.event, n, tt.want)
+		}
+	}
+
+	if v, ok, err := client.WindowValue(ctx, count, "u1"); err != nil || !ok || v != 2 {
+		t.Errorf("%s(u1) = %v, %v, %v; want 2", count, v, ok, err)
+	}
+	if v, ok, err := client.WindowValue(ctx, avg, "c1"); err != nil || !ok || v != 20 {
+		t.Errorf("%s(c1) = %v, %v, %v; want 20", avg, v, ok, err)
+	}
+	if _, ok, err := client.WindowValue(ctx, avg, "c2"); err != nil || ok {
+		t.Errorf("%s(c2) = %v, %v; want no value", avg, ok, err)
+	}
+	var facts string
+	if err := db.QueryRowContext(ctx, "SELECT rule_window_facts($1)::TEXT", `{"Login":{"user":"u1"}}`).Scan(&facts); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"Login": {"user": "u1"}, "Windows": {"` + count + `": 2}}`; facts != want {
+		t.Errorf("facts = %s, want %s", facts, want)
+	}
+	if n, err := client.PruneWindows(ctx); err != nil || n < 1 {
+		t.Errorf("PruneWindows = %d, %v; want the expired bucket", n, err)
+	}
+}
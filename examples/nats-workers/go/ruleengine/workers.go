@@ -0,0 +1,89 @@
+package ruleengine
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Worker is a NATS worker instance registered in rule_nats_workers
+type Worker struct {
+	ID         string     `json:"worker_id"` // hostname/pid
+	Hostname   string     `json:"hostname"`
+	PID        int        `json:"pid"`
+	Version    string     `json:"version"`
+	ConfigHash string     `json:"config_hash"`
+	Stream     string     `json:"stream"`
+	Consumer   string     `json:"consumer"`
+	Subject    string     `json:"subject"`
+	StartedAt  time.Time  `json:"started_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	StoppedAt  *time.Time `json:"stopped_at,omitempty"`
+	Status     string     `json:"status"`            // live, stale (stopped heartbeating without stopping), or stopped
+	DeadAt     *time.Time `json:"dead_at,omitempty"` // when the leader flagged a stale worker
+
+	// The rule engine extension the worker found at startup; not compatible
+	// when it started with EXTENSION_CHECK=warn against an unsupported one
+	ExtensionVersion    string `json:"extension_version,omitempty"`
+	ExtensionCompatible *bool  `json:"extension_compatible,omitempty"`
+
+	// From the last heartbeat
+	ConsumerPending    *int64     `json:"consumer_pending,omitempty"`
+	ConsumerAckPending *int64     `json:"consumer_ack_pending,omitempty"`
+	LagSampledAt       *time.Time `json:"lag_sampled_at,omitempty"`
+	MessagesProcessed  int64      `json:"messages_processed"`
+	MessagesFailed     int64      `json:"messages_failed"`
+}
+
+// ListWorkers returns the registered NATS workers, live ones first and
+// newest first within a status. Stopped workers are only included with
+// includeStopped.
+func (c *Client) ListWorkers(ctx context.Context, includeStopped bool) ([]Worker, error) {
+	rows, err := c.ops().QueryContext(ctx,
+		`SELECT worker_id, hostname, pid, version, config_hash, stream_name, consumer_name, subject,
+		        started_at, last_seen_at, stopped_at, status, dead_at, consumer_pending, consumer_ack_pending,
+		        lag_sampled_at, COALESCE(messages_processed, 0), COALESCE(messages_failed, 0),
+		        COALESCE(extension_version, ''), extension_compatible
+		 FROM rule_nats_workers_status
+		 WHERE $1 OR status <> 'stopped'
+		 ORDER BY status = 'live' DESC, status = 'stale' DESC, started_at DESC`,
+		includeStopped,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workers := []Worker{}
+	for rows.Next() {
+		var w Worker
+		var stopped, dead, sampled sql.NullTime
+		var pending, ackPending sql.NullInt64
+		var compatible sql.NullBool
+		if err := rows.Scan(&w.ID, &w.Hostname, &w.PID, &w.Version, &w.ConfigHash, &w.Stream, &w.Consumer,
+			&w.Subject, &w.StartedAt, &w.LastSeenAt, &stopped, &w.Status, &dead, &pending, &ackPending,
+			&sampled, &w.MessagesProcessed, &w.MessagesFailed, &w.ExtensionVersion, &compatible); err != nil {
+			return nil, err
+		}
+		if stopped.Valid {
+			w.StoppedAt = &stopped.Time
+		}
+		if dead.Valid {
+			w.DeadAt = &dead.Time
+		}
+		if pending.Valid {
+			w.ConsumerPending = &pending.Int64
+		}
+		if ackPending.Valid {
+			w.ConsumerAckPending = &ackPending.Int64
+		}
+		if sampled.Valid {
+			w.LagSampledAt = &sampled.Time
+		}
+		if compatible.Valid {
+			w.ExtensionCompatible = &compatible.Bool
+		}
+		workers = append(workers, w)
+	}
+	return workers, rows.Err()
+}
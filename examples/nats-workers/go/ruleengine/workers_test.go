@@ -0,0 +1,43 @@
+package ruleengine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestListWorkers(t *testing.T) {
+	columns := []string{"worker_id", "hostname", "pid", "version", "config_hash", "stream_name", "consumer_name", "subject",
+		"started_at", "last_seen_at", "stopped_at", "status", "dead_at", "consumer_pending", "consumer_ack_pending",
+		"lag_sampled_at", "messages_processed", "messages_failed", "extension_version", "extension_compatible"}
+	now := time.Now()
+	for _, includeStopped := range []bool{false, true} {
+		c, mock := newMock(t)
+		mock.ExpectQuery(`FROM rule_nats_workers_status\s+WHERE \$1 OR status <> 'stopped'`).WithArgs(includeStopped).
+			WillReturnRows(sqlmock.NewRows(columns).
+				AddRow("w1/1", "w1", 1, "v1.2.0", "abc", "RULES", "webhooks", "webhooks.>", now, now, nil, "live", nil,
+					12, 3, now, 100, 2, "1.8.0", true).
+				AddRow("w2/7", "w2", 7, "v1.1.0", "def", "RULES", "webhooks", "webhooks.>", now, now, now, "stopped", nil,
+					nil, nil, nil, 0, 0, "", nil))
+		workers, err := c.ListWorkers(context.Background(), includeStopped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(workers) != 2 {
+			t.Fatalf("%d workers", len(workers))
+		}
+		live, stopped := workers[0], workers[1]
+		if live.Status != "live" || *live.ConsumerPending != 12 || *live.ConsumerAckPending != 3 ||
+			live.LagSampledAt == nil || live.StoppedAt != nil || !*live.ExtensionCompatible || live.MessagesProcessed != 100 {
+			t.Fatalf("live worker = %+v", live)
+		}
+		if stopped.StoppedAt == nil || stopped.ConsumerPending != nil || stopped.ExtensionCompatible != nil || stopped.PID != 7 {
+			t.Fatalf("stopped worker = %+v", stopped)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package ruleengine
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ParseDecisionTableXLSX reads a decision table from an Excel workbook.
+// sheet selects a worksheet by name; empty uses the first one. Only cell
+// values are read: formulas contribute their cached results.
+func ParseDecisionTableXLSX(name string, r io.ReaderAt, size int64, sheet string) (*DecisionTable, error) {
+	records, err := readXLSXSheet(r, size, sheet)
+	if err != nil {
+		return nil, fmt.Errorf("xlsx: %w", err)
+	}
+	return NewDecisionTable(name, records)
+}
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+// xlsxText is plain (<t>) or rich (<r><t>) text
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+	var b strings.Builder
+	for _, r := range t.Runs {
+		b.WriteString(r.T)
+	}
+	return b.String()
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Ref   int `xml:"r,attr"` // 1-based; Excel omits empty rows
+		Cells []struct {
+			Ref    string   `xml:"r,attr"`
+			Type   string   `xml:"t,attr"`
+			Value  string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func readXLSXSheet(r io.ReaderAt, size int64, sheet string) ([][]string, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var wb xlsxWorkbook
+	if err := decodeZipXML(files, "xl/workbook.xml", &wb); err != nil {
+		return nil, err
+	}
+	var rels xlsxRelationships
+	if err := decodeZipXML(files, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+
+	var rid string
+	for _, s := range wb.Sheets {
+		if sheet == "" || s.Name == sheet {
+			rid = s.RID
+			break
+		}
+	}
+	if rid == "" {
+		return nil, fmt.Errorf("sheet %q not found", sheet)
+	}
+	var target string
+	for _, rel := range rels.Relationships {
+		if rel.ID == rid {
+			target = rel.Target
+		}
+	}
+	if strings.HasPrefix(target, "/") {
+		target = strings.TrimPrefix(target, "/")
+	} else {
+		target = path.Join("xl", target)
+	}
+
+	var shared xlsxSharedStrings
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		if err := decodeZipXML(files, "xl/sharedStrings.xml", &shared); err != nil {
+			return nil, err
+		}
+	}
+
+	var ws xlsxSheet
+	if err := decodeZipXML(files, target, &ws); err != nil {
+		return nil, err
+	}
+
+	records := make([][]string, 0, len(ws.Rows))
+	for _, row := range ws.Rows {
+		// Keep omitted rows as blank records so row numbers in errors and
+		// rule names match the spreadsheet
+		for row.Ref > len(records)+1 {
+			records = append(records, nil)
+		}
+		var record []string
+		for i, c := range row.Cells {
+			col := i
+			if c.Ref != "" {
+				if col, err = xlsxColumn(c.Ref); err != nil {
+					return nil, err
+				}
+			}
+			for len(record) <= col {
+				record = append(record, "")
+			}
+			switch c.Type {
+			case "s":
+				idx, err := strconv.Atoi(c.Value)
+				if err != nil || idx < 0 || idx >= len(shared.Items) {
+					return nil, fmt.Errorf("cell %s: invalid shared string %q", c.Ref, c.Value)
+				}
+				record[col] = shared.Items[idx].String()
+			case "inlineStr":
+				record[col] = c.Inline.String()
+			case "b":
+				record[col] = map[string]string{"1": "true", "0": "false"}[c.Value]
+			default:
+				record[col] = c.Value
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func decodeZipXML(files map[string]*zip.File, name string, v interface{}) error {
+	f, ok := files[name]
+	if !ok {
+		return fmt.Errorf("%s missing", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := xml.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// xlsxColumn returns the zero-based column of a cell reference like "AB12"
+func xlsxColumn(ref string) (int, error) {
+	col := 0
+	n := 0
+	for _, ch := range ref {
+		if ch < 'A' || ch > 'Z' {
+			break
+		}
+		col = col*26 + int(ch-'A'+1)
+		n++
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("invalid cell reference %q", ref)
+	}
+	return col - 1, nil
+}
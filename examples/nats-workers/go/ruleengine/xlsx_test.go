@@ -0,0 +1,223 @@
+package ruleengine
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// xlsxFixture builds a workbook with the parts Excel writes. sheets maps
+// sheet names (in order) to their sheetData XML.
+func xlsxFixture(t *testing.T, sharedStrings string, sheets ...[2]string) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	add := func(name, content string) {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+
+	add("[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="xml" ContentType="application/xml"/></Types>`)
+	var wbSheets, rels strings.Builder
+	for i, s := range sheets {
+		id := string(rune('1' + i))
+		wbSheets.WriteString(`<sheet name="` + s[0] + `" sheetId="` + id + `" r:id="rId` + id + `"/>`)
+		rels.WriteString(`<Relationship Id="rId` + id + `" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet` + id + `.xml"/>`)
+		add("xl/worksheets/sheet"+id+".xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><dimension ref="A1:D4"/><sheetData>`+s[1]+`</sheetData><pageMargins left="0.7" right="0.7" top="0.75" bottom="0.75" header="0.3" footer="0.3"/></worksheet>`)
+	}
+	rels.WriteString(`<Relationship Id="rId9" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/sharedStrings" Target="sharedStrings.xml"/>`)
+	add("xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`+wbSheets.String()+`</sheets></workbook>`)
+	add("xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`+rels.String()+`</Relationships>`)
+	if sharedStrings != "" {
+		add("xl/sharedStrings.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`+sharedStrings+`</sst>`)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestReadXLSXSheet(t *testing.T) {
+	shared := `<si><t>when Customer.Tier</t></si>` +
+		`<si><t>then Order.Discount</t></si>` +
+		`<si><t>gold</t></si>` +
+		`<si><r><t>sil</t></r><r><rPr><b/></rPr><t>ver</t></r></si>` +
+		`<si><t xml:space="preserve"> padded </t></si>`
+
+	tests := []struct {
+		name    string
+		shared  string
+		rows    string
+		want    [][]string
+		wantErr string
+	}{
+		{
+			name:   "shared strings, rich text and numbers",
+			shared: shared,
+			rows: `<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c></row>` +
+				`<row r="2"><c r="A2" t="s"><v>2</v></c><c r="B2"><v>0.15</v></c></row>` +
+				`<row r="3"><c r="A3" t="s"><v>3</v></c><c r="B3" s="1"><f>B2/3</f><v>0.05</v></c></row>`,
+			want: [][]string{{"when Customer.Tier", "then Order.Discount"}, {"gold", "0.15"}, {"silver", "0.05"}},
+		},
+		{
+			name: "inline strings and booleans",
+			rows: `<row r="1"><c r="A1" t="inlineStr"><is><t>when Order.Rush</t></is></c>` +
+				`<c r="B1" t="inlineStr"><is><r><t>then </t></r><r><t>Order.Lane</t></r></is></c></row>` +
+				`<row r="2"><c r="A2" t="b"><v>1</v></c><c r="B2" t="str"><f>"fa"&amp;"st"</f><v>fast</v></c></row>` +
+				`<row r="3"><c r="A3" t="b"><v>0</v></c><c r="B3" t="inlineStr"><is><t>slow</t></is></c></row>`,
+			want: [][]string{{"when Order.Rush", "then Order.Lane"}, {"true", "fast"}, {"false", "slow"}},
+		},
+		{
+			name:   "empty and skipped cells",
+			shared: shared,
+			// A styled empty cell has no value; C2 is omitted entirely
+			rows: `<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" s="2"/><c r="C1" t="s"><v>1</v></c></row>` +
+				`<row r="2"><c r="B2" s="2"/><c r="D2" t="s"><v>4</v></c></row>`,
+			want: [][]string{{"when Customer.Tier", "", "then Order.Discount"}, {"", "", "", " padded "}},
+		},
+		{
+			name:   "omitted rows",
+			shared: shared,
+			rows:   `<row r="1"><c r="A1" t="s"><v>2</v></c></row><row r="4"><c r="B4"><v>7</v></c></row>`,
+			want:   [][]string{{"gold"}, nil, nil, {"", "7"}},
+		},
+		{
+			name:    "shared string out of range",
+			shared:  shared,
+			rows:    `<row r="1"><c r="A1" t="s"><v>99</v></c></row>`,
+			wantErr: "invalid shared string",
+		},
+		{
+			name:    "bad reference",
+			rows:    `<row r="1"><c r="11"><v>1</v></c></row>`,
+			wantErr: "invalid cell reference",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := xlsxFixture(t, tt.shared, [2]string{"Sheet1", tt.rows})
+			got, err := readXLSXSheet(r, r.Size(), "")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("records = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadXLSXSheetByName(t *testing.T) {
+	r := xlsxFixture(t, "",
+		[2]string{"Notes", `<row r="1"><c r="A1" t="inlineStr"><is><t>ignore me</t></is></c></row>`},
+		[2]string{"Discounts", `<row r="1"><c r="A1"><v>42</v></c></row>`},
+	)
+	got, err := readXLSXSheet(r, r.Size(), "Discounts")
+	if err != nil || !reflect.DeepEqual(got, [][]string{{"42"}}) {
+		t.Fatalf("records = %q, %v", got, err)
+	}
+	if _, err := readXLSXSheet(r, r.Size(), "Missing"); err == nil {
+		t.Fatal("missing sheet was accepted")
+	}
+	if _, err := readXLSXSheet(bytes.NewReader([]byte("not a zip")), 9, ""); err == nil {
+		t.Fatal("non-zip input was accepted")
+	}
+}
+
+func TestParseDecisionTableXLSX(t *testing.T) {
+	r := xlsxFixture(t, `<si><t>when Customer.Tier</t></si><si><t>then Order.Discount</t></si><si><t>gold</t></si>`,
+		[2]string{"Sheet1", `<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c></row>` +
+			`<row r="3"><c r="A3" t="s"><v>2</v></c><c r="B3"><v>0.1</v></c></row>`})
+	table, err := ParseDecisionTableXLSX("Discounts", r, r.Size(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Row 2 is empty in the sheet, so the rule is named after row 3
+	if len(table.Rows) != 1 || table.Rows[0].Line != 3 || table.Rows[0].Conditions[0] != "gold" {
+		t.Fatalf("rows = %+v", table.Rows)
+	}
+}
+
+func TestCompileCondition(t *testing.T) {
+	col := TableColumn{Path: "Order.Amount"}
+	tests := []struct {
+		col     TableColumn
+		cell    string
+		want    string
+		wantErr bool
+	}{
+		{col: col, cell: "", want: ""},
+		{col: col, cell: "-", want: ""},
+		{col: col, cell: "*", want: ""},
+		{col: col, cell: "100", want: "Order.Amount == 100"},
+		{col: col, cell: ">= 100", want: "Order.Amount >= 100"},
+		{col: col, cell: "=gold", want: `Order.Amount == "gold"`},
+		{col: col, cell: "100..500", want: "(Order.Amount >= 100 && Order.Amount <= 500)"},
+		{col: col, cell: "a..b", wantErr: true},
+		{col: col, cell: "gold, silver", want: `(Order.Amount == "gold" || Order.Amount == "silver")`},
+		{col: col, cell: `"a, b"`, want: `Order.Amount == "a, b"`},
+		{col: col, cell: "TRUE", want: "Order.Amount == true"},
+		{col: TableColumn{Path: "Order.Amount", Operator: ">"}, cell: "5", want: "Order.Amount > 5"},
+	}
+	for _, tt := range tests {
+		got, err := compileCondition(tt.col, tt.cell)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("compileCondition(%q) = %q, %v; want %q", tt.cell, got, err, tt.want)
+		}
+	}
+}
+
+func TestDecisionTableCSV(t *testing.T) {
+	csv := "when Customer.Tier,when Order.Amount >=,then Order.Discount,description\n" +
+		"gold,100,0.2,Gold\n" +
+		",,,\n" +
+		"*,0,=Order.Amount * 0.01,\n"
+	table, err := ParseDecisionTableCSV("Discounts", strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grl, err := table.CompileGRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`rule Discounts_2 "Gold" salience 2 {`,
+		`Customer.Tier == "gold" && Order.Amount >= 100`,
+		`Retract("Discounts_4");`, // first hit retracts later rows
+		`rule Discounts_4 "Discounts row 4" salience 1 {`,
+		`Order.Discount = Order.Amount * 0.01;`,
+	} {
+		if !strings.Contains(grl, want) {
+			t.Errorf("GRL is missing %q:\n%s", want, grl)
+		}
+	}
+
+	bad := []string{
+		"",
+		"when Customer.Tier\ngold\n",
+		"when Tier,then Order.X\na,1\n",
+		"colour,then Order.X\na,1\n",
+		"when Order.A,then Order.X\n",
+	}
+	for _, in := range bad {
+		if _, err := ParseDecisionTableCSV("T", strings.NewReader(in)); err == nil {
+			t.Errorf("accepted %q", in)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// ruleStats counts action outcomes per rule in rule_hit_stats for messages
+// that name their rule (see ruleengine.Client.RuleEffectiveness); nil when
+// STATS_RULES is off
+var ruleStats *ruleengine.Client
+
+// initRuleStats creates rule_hit_stats if needed and starts buffering
+// per-rule action outcomes
+func initRuleStats() error {
+	if !config.Stats.Rules {
+		return nil
+	}
+	client := ruleengine.New(db)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := client.EnableRuleStats(ctx, ruleengine.RuleStatsOptions{}); err != nil {
+		return err
+	}
+	ruleStats = client
+	return nil
+}
+
+// recordRuleAction counts one action outcome for the rule that produced
+// the message, if it named one
+func recordRuleAction(rule string, err error) {
+	if ruleStats != nil {
+		ruleStats.RecordRuleAction(rule, err)
+	}
+}
+
+// closeRuleStats writes buffered rule statistics before shutdown
+func closeRuleStats() {
+	if ruleStats == nil {
+		return
+	}
+	if err := ruleStats.Close(); err != nil {
+		log.Printf("⚠️  Failed to write rule statistics: %v", err)
+	}
+}
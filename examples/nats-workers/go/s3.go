@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// objectStore is a bucket on an S3-compatible service: AWS S3, MinIO, or
+// Google Cloud Storage through its XML API with HMAC keys. Requests are
+// signed with AWS Signature Version 4.
+type objectStore struct {
+	Endpoint  string // e.g. https://s3.amazonaws.com, http://minio:9000, https://storage.googleapis.com
+	Region    string
+	Bucket    string
+	PathStyle bool // bucket in the path rather than the host name; needed by MinIO
+
+	credentials s3Credentials
+}
+
+// s3Credentials are stored as a JSON secret
+type s3Credentials struct {
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+}
+
+func newObjectStore(ctx context.Context, endpoint, region, bucket string, pathStyle bool, credentialsSecret string) (*objectStore, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	store := &objectStore{Endpoint: strings.TrimRight(endpoint, "/"), Region: region, Bucket: bucket, PathStyle: pathStyle}
+
+	secret, err := getSecret(ctx, credentialsSecret)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(secret), &store.credentials); err != nil || store.credentials.AccessKeyID == "" {
+		return nil, fmt.Errorf("secret %s must be {\"access_key_id\", \"secret_access_key\"}", credentialsSecret)
+	}
+	return store, nil
+}
+
+// Put uploads body as the object key
+func (s *objectStore) Put(ctx context.Context, key, contentType, contentEncoding string, body []byte) error {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %w", err)
+	}
+	host := endpoint.Host
+	path := "/" + uriEncode(key, false)
+	if s.PathStyle {
+		path = "/" + uriEncode(s.Bucket, true) + path
+	} else {
+		host = s.Bucket + "." + host
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint.Scheme+"://"+host+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	s.sign(req, path, body, time.Now().UTC())
+
+	resp, err := (&http.Client{Timeout: 2 * time.Minute}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("PUT %s: HTTP %d: %s", key, resp.StatusCode, bytes.TrimSpace(detail))
+	}
+	return nil
+}
+
+// sign adds SigV4 headers for a request without a query string. Host and
+// every header already set on the request are signed.
+func (s *objectStore) sign(req *http.Request, path string, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.credentials.SessionToken)
+	}
+
+	values := map[string]string{"host": req.URL.Host}
+	for name, v := range req.Header {
+		if name = strings.ToLower(name); name != "authorization" {
+			values[name] = strings.Join(v, ",")
+		}
+	}
+	signed := make([]string, 0, len(values))
+	for name := range values {
+		signed = append(signed, name)
+	}
+	sort.Strings(signed)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range signed {
+		canonicalHeaders.WriteString(name + ":" + strings.Join(strings.Fields(values[name]), " ") + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, "", canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.credentials.SecretAccessKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// uriEncode percent-encodes everything but unreserved characters, keeping
+// '/' unless encodeSlash is set, as SigV4 canonical URIs require
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"expvar"
+	"log"
+)
+
+// samplingStats counts log lines and audit rows left out by sampling
+var samplingStats = expvar.NewMap("sampling")
+
+// sampled reports whether the message with traceID falls in a sample of
+// percent of all messages. The choice is a hash of the trace ID, so a
+// sampled message has all its lines logged and its rows stored, and
+// workers agree on it after a redelivery.
+func sampled(traceID string, percent int) bool {
+	if percent >= 100 {
+		return true
+	}
+	if percent <= 0 {
+		return false
+	}
+	// FNV-1a, inline so sampling does not allocate
+	h := uint32(2166136261)
+	for i := 0; i < len(traceID); i++ {
+		h ^= uint32(traceID[i])
+		h *= 16777619
+	}
+	return h%100 < uint32(percent)
+}
+
+// logMessage logs a line about a message, if the message is in the
+// LOG_SUCCESS_SAMPLE_PERCENT or, for lines about failures,
+// LOG_FAILURE_SAMPLE_PERCENT sample
+func logMessage(traceID string, failed bool, format string, args ...interface{}) {
+	percent := config.Log.SuccessSamplePercent
+	if failed {
+		percent = config.Log.FailureSamplePercent
+	}
+	if !sampled(traceID, percent) {
+		samplingStats.Add("log_lines_skipped", 1)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// auditSampled reports whether a message's audit row is stored, by
+// AUDIT_SUCCESS_SAMPLE_PERCENT or, for rows recording a failure or a
+// message that was not delivered, AUDIT_FAILURE_SAMPLE_PERCENT
+func auditSampled(traceID string, failed bool) bool {
+	percent := config.Audit.SuccessSamplePercent
+	if failed {
+		percent = config.Audit.FailureSamplePercent
+	}
+	if !sampled(traceID, percent) {
+		samplingStats.Add("audit_rows_skipped", 1)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// samplingCount returns the sampling counter for name
+func samplingCount(name string) int64 {
+	if v, ok := samplingStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestSampled(t *testing.T) {
+	tests := []struct {
+		percent int
+		want    int // of 10000 trace IDs, within 2%
+	}{
+		{percent: 0, want: 0},
+		{percent: -5, want: 0},
+		{percent: 1, want: 100},
+		{percent: 25, want: 2500},
+		{percent: 50, want: 5000},
+		{percent: 100, want: 10000},
+		{percent: 150, want: 10000},
+	}
+	for _, tt := range tests {
+		got := 0
+		for i := 0; i < 10000; i++ {
+			traceID := fmt.Sprintf("%032x", i*7919)
+			in := sampled(traceID, tt.percent)
+			if in {
+				got++
+			}
+			// The same trace ID is always in or out, by its FNV-1a hash
+			if tt.percent > 0 && tt.percent < 100 {
+				h := fnv.New32a()
+				h.Write([]byte(traceID))
+				if want := h.Sum32()%100 < uint32(tt.percent); in != want {
+					t.Fatalf("sampled(%q, %d) = %v, want %v", traceID, tt.percent, in, want)
+				}
+			}
+		}
+		if diff := got - tt.want; diff < -200 || diff > 200 {
+			t.Errorf("sampled %d of 10000 at %d%%, want about %d", got, tt.percent, tt.want)
+		}
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { sampled("4bf92f3577b34da6a3ce929d0e0e4736", 50) }); allocs != 0 {
+		t.Errorf("sampled allocates %v times", allocs)
+	}
+}
+
+func TestLogMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		success int
+		failure int
+		failed  bool
+		logged  bool
+	}{
+		{name: "success logged", success: 100, failure: 0, logged: true},
+		{name: "success skipped", success: 0, failure: 100},
+		{name: "failure logged", success: 0, failure: 100, failed: true, logged: true},
+		{name: "failure skipped", success: 100, failure: 0, failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev, prevLog := config.Log, log.Writer()
+			t.Cleanup(func() {
+				config.Log = prev
+				log.SetOutput(prevLog)
+			})
+			config.Log.SuccessSamplePercent, config.Log.FailureSamplePercent = tt.success, tt.failure
+			var out bytes.Buffer
+			log.SetOutput(&out)
+
+			skipped := samplingCount("log_lines_skipped")
+			logMessage("trace-7", tt.failed, "📨 [%d %s] Processing: %s", 1, "trace-7", "webhooks.orders")
+			if logged := bytes.Contains(out.Bytes(), []byte("📨 [1 trace-7] Processing: webhooks.orders")); logged != tt.logged {
+				t.Fatalf("logged = %v, want %v: %q", logged, tt.logged, out.String())
+			}
+			if got, want := samplingCount("log_lines_skipped")-skipped, int64(boolMetric(!tt.logged)); got != want {
+				t.Fatalf("skipped count went up by %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestAuditSampled(t *testing.T) {
+	tests := []struct {
+		name    string
+		success int
+		failure int
+		failed  bool
+		want    bool
+	}{
+		{name: "success stored", success: 100, failure: 0, want: true},
+		{name: "success skipped", success: 0, failure: 100},
+		{name: "failure stored", success: 0, failure: 100, failed: true, want: true},
+		{name: "failure skipped", success: 100, failure: 0, failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := config.Audit
+			t.Cleanup(func() { config.Audit = prev })
+			config.Audit.SuccessSamplePercent, config.Audit.FailureSamplePercent = tt.success, tt.failure
+
+			skipped := samplingCount("audit_rows_skipped")
+			if got := auditSampled("trace-7", tt.failed); got != tt.want {
+				t.Fatalf("auditSampled = %v, want %v", got, tt.want)
+			}
+			if got, want := samplingCount("audit_rows_skipped")-skipped, int64(boolMetric(!tt.want)); got != want {
+				t.Fatalf("skipped count went up by %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestRecordExpiredOutOfSample(t *testing.T) {
+	prev := config.Audit
+	t.Cleanup(func() { config.Audit = prev })
+	config.Audit.FailureSamplePercent = 0
+	mockOpsDB(t) // no expectations: no row is written
+
+	msg := &nats.Msg{Subject: "webhooks.orders", Data: []byte(`{"id":7}`)}
+	recordExpired(context.Background(), msg, &WebhookPayload{WebhookURL: "https://crm.example.com"}, time.Now(), "trace-7")
+}
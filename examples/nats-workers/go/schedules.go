@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// initSchedules registers the task that runs due rule schedules (see
+// ruleengine.Client.CreateSchedule) on the leader
+func initSchedules() {
+	if config.Schedules.PollSeconds <= 0 {
+		return
+	}
+	registerSingleton("rule_schedules", time.Duration(config.Schedules.PollSeconds)*time.Second, runSchedules)
+}
+
+// runSchedules evaluates every due schedule, applying its catch-up policy
+// to runs missed while no worker led
+func runSchedules(ctx context.Context) error {
+	runs, err := ruleengine.New(db).RunDueSchedules(ctx, workerID())
+	for _, run := range runs {
+		switch run.Status {
+		case ruleengine.RunSucceeded:
+			log.Printf("⏰ Schedule %s (%s): %d rule(s) fired", run.Schedule, run.ScheduledFor.Format(time.RFC3339), len(run.MatchedRules))
+		case ruleengine.RunFailed:
+			log.Printf("⚠️  Schedule %s (%s) failed: %s", run.Schedule, run.ScheduledFor.Format(time.RFC3339), run.Error)
+		case ruleengine.RunSkipped:
+			log.Printf("⏰ Schedule %s: skipped missed run at %s", run.Schedule, run.ScheduledFor.Format(time.RFC3339))
+		}
+	}
+	return err
+}
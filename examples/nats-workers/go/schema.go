@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Worker-owned tables, created on startup if missing
+//
+//go:embed schema.sql
+var schemaSQL string
+
+// Statistics and audit tables, created in the operational database
+//
+//go:embed ops_schema.sql
+var opsSchemaSQL string
+
+// ensureSchema applies schema.sql. Every statement is idempotent so it is
+// safe to run from every worker replica on each start.
+func ensureSchema() error {
+	if _, err := db.Exec(schemaSQL); err != nil {
+		return fmt.Errorf("failed to apply worker schema: %w", err)
+	}
+	log.Println("✅ Worker schema ready")
+	return nil
+}
+
+// ensureOpsSchema applies ops_schema.sql to the operational database
+func ensureOpsSchema() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := opsDB.ExecContext(ctx, opsSchemaSQL); err != nil {
+		return fmt.Errorf("failed to apply operational schema: %w", err)
+	}
+	log.Println("✅ Operational schema ready")
+	return nil
+}
@@ -0,0 +1,225 @@
+-- Worker-owned tables for the NATS webhook worker.
+--
+-- Applied idempotently on startup (see ensureSchema in schema.go). These
+-- tables complement the extension's rule_nats_* tables and only hold data
+-- produced by external workers. Statistics and audit tables are in
+-- ops_schema.sql.
+
+-- Delivery options on registered webhook destinations
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS content_type TEXT;
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS body_template TEXT;
+
+COMMENT ON COLUMN rule_webhooks.content_type IS 'Body encoding used by NATS workers: json, form, text, xml, or binary (default json)';
+COMMENT ON COLUMN rule_webhooks.body_template IS 'Optional Go text/template rendered with the message data as the request body';
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS query_params JSONB DEFAULT '{}'::JSONB;
+
+COMMENT ON COLUMN rule_webhooks.query_params IS 'Query parameters appended to the URL by NATS workers, e.g. {"api_version": "2"}';
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS dedup_window_seconds INTEGER;
+
+COMMENT ON COLUMN rule_webhooks.dedup_window_seconds IS 'Suppress repeat deliveries of the same event_key within this many seconds (overrides DEDUP_WINDOW_SECONDS)';
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS health_check TEXT;
+
+COMMENT ON COLUMN rule_webhooks.health_check IS 'How NATS workers probe the destination: a path or URL requested with HEAD (GET if HEAD is refused), or tcp to connect to the URL''s host; NULL = not probed';
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS cloudevents TEXT;
+
+COMMENT ON COLUMN rule_webhooks.cloudevents IS 'Send requests as CloudEvents: binary (ce-* headers), structured (application/cloudevents+json), or none; NULL = CLOUDEVENTS_OUTBOUND';
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS paused_from TIMESTAMPTZ;
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS paused_until TIMESTAMPTZ;
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS pause_reason TEXT;
+
+COMMENT ON COLUMN rule_webhooks.paused_from IS 'Start of a maintenance window: NATS workers hold deliveries from then until paused_until; NULL = not paused';
+COMMENT ON COLUMN rule_webhooks.paused_until IS 'When held deliveries resume; NULL with paused_from set = paused until resumed';
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS delivery_hours TEXT;
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS delivery_timezone TEXT;
+
+COMMENT ON COLUMN rule_webhooks.delivery_hours IS 'When NATS workers deliver, e.g. mon-fri 08:00-20:00, sat 10:00-14:00; other messages wait for the next window; NULL = any time';
+COMMENT ON COLUMN rule_webhooks.delivery_timezone IS 'IANA time zone of delivery_hours, e.g. America/New_York (default UTC)';
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS response_mapping JSONB;
+
+COMMENT ON COLUMN rule_webhooks.response_mapping IS 'Facts NATS workers extract from successful responses into rule_response_facts: {"name", "key_path", "fact_key_path", "fields": {"<fact field>": "<JSONPath>"}}; NULL = none';
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS capture_until TIMESTAMPTZ;
+
+COMMENT ON COLUMN rule_webhooks.capture_until IS 'NATS workers record every request and response of the webhook in rule_webhook_captures until then, for debugging; NULL = not captured';
+
+-- Last delivery per (destination, event key), used by DEDUP_BACKEND=postgres
+CREATE TABLE IF NOT EXISTS rule_nats_dedup (
+    destination TEXT NOT NULL,
+    event_key TEXT NOT NULL,
+    delivered_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (destination, event_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_nats_dedup_delivered ON rule_nats_dedup(delivered_at);
+
+-- Delivery ledger for EXACTLY_ONCE_SUBJECTS. A worker claims the row
+-- before sending and marks it delivered before acking, so a redelivered
+-- message is never sent twice; an expired claim means the worker died.
+CREATE TABLE IF NOT EXISTS rule_nats_exactly_once (
+    delivery_key TEXT PRIMARY KEY,
+    destination TEXT NOT NULL,
+    claimed_by TEXT,
+    claimed_until TIMESTAMPTZ,
+    attempts INTEGER NOT NULL DEFAULT 1,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_nats_exactly_once_created ON rule_nats_exactly_once(created_at);
+ALTER TABLE rule_nats_exactly_once ADD COLUMN IF NOT EXISTS trace_id TEXT;
+
+-- Configured actions a message can name in its "action" field. action_type
+-- selects a built-in executor (webhook, nats_publish, insert_row, function);
+-- config holds that executor's settings.
+CREATE TABLE IF NOT EXISTS rule_actions (
+    action_id SERIAL PRIMARY KEY,
+    action_name TEXT NOT NULL UNIQUE,
+    action_type TEXT NOT NULL,
+    config JSONB NOT NULL DEFAULT '{}'::JSONB,
+    description TEXT,
+    timeout_ms INTEGER,
+    dedup_window_seconds INTEGER,
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON COLUMN rule_actions.action_type IS 'Executor type; workers log the types they support on startup';
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS owner TEXT;
+ALTER TABLE rule_webhooks ADD COLUMN IF NOT EXISTS failure_alert_action TEXT;
+ALTER TABLE rule_actions ADD COLUMN IF NOT EXISTS owner TEXT;
+ALTER TABLE rule_actions ADD COLUMN IF NOT EXISTS failure_alert_action TEXT;
+
+COMMENT ON COLUMN rule_webhooks.owner IS 'Who to tell when deliveries keep failing, e.g. an email address or Slack channel, passed to failure_alert_action';
+COMMENT ON COLUMN rule_webhooks.failure_alert_action IS 'rule_actions row run when deliveries fail for FAILURE_ALERT_MINUTES; NULL = FAILURE_ALERT_ACTION';
+COMMENT ON COLUMN rule_actions.owner IS 'Who to tell when the action keeps failing, passed to failure_alert_action';
+COMMENT ON COLUMN rule_actions.failure_alert_action IS 'rule_actions row run when the action fails for FAILURE_ALERT_MINUTES; NULL = FAILURE_ALERT_ACTION';
+
+COMMENT ON COLUMN rule_actions.config IS 'Executor settings, e.g. {"subject": "alerts.{{.region}}"} for nats_publish';
+
+-- SMTP servers used by email actions. Passwords are encrypted with the
+-- extension's encrypt_credential(); set them with rule_smtp_server_set.
+CREATE TABLE IF NOT EXISTS rule_smtp_servers (
+    smtp_id SERIAL PRIMARY KEY,
+    smtp_name TEXT NOT NULL UNIQUE,
+    host TEXT NOT NULL,
+    port INTEGER NOT NULL DEFAULT 587,
+    username TEXT,
+    password_encrypted TEXT,
+    from_address TEXT NOT NULL,
+    tls_mode TEXT NOT NULL DEFAULT 'starttls' CHECK (tls_mode IN ('starttls', 'tls', 'none')),
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+REVOKE ALL ON rule_smtp_servers FROM PUBLIC;
+
+CREATE OR REPLACE FUNCTION rule_smtp_server_set(
+    p_name TEXT,
+    p_host TEXT,
+    p_port INTEGER,
+    p_username TEXT,
+    p_password TEXT,
+    p_from_address TEXT,
+    p_tls_mode TEXT DEFAULT 'starttls'
+)
+RETURNS INTEGER AS $$
+    INSERT INTO rule_smtp_servers (smtp_name, host, port, username, password_encrypted, from_address, tls_mode)
+    VALUES (p_name, p_host, p_port, p_username, encrypt_credential(p_password), p_from_address, p_tls_mode)
+    ON CONFLICT (smtp_name) DO UPDATE SET
+        host = EXCLUDED.host,
+        port = EXCLUDED.port,
+        username = EXCLUDED.username,
+        password_encrypted = EXCLUDED.password_encrypted,
+        from_address = EXCLUDED.from_address,
+        tls_mode = EXCLUDED.tls_mode,
+        updated_at = CURRENT_TIMESTAMP
+    RETURNING smtp_id;
+$$ LANGUAGE sql;
+
+COMMENT ON FUNCTION rule_smtp_server_set(TEXT, TEXT, INTEGER, TEXT, TEXT, TEXT, TEXT) IS 'Registers or updates an SMTP server for email actions, encrypting the password';
+
+-- Credentials referenced by action configs (e.g. "token_secret": "slack_bot"),
+-- encrypted with the extension's encrypt_credential()
+CREATE TABLE IF NOT EXISTS rule_action_secrets (
+    secret_name TEXT PRIMARY KEY,
+    secret_value TEXT NOT NULL,
+    description TEXT,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+REVOKE ALL ON rule_action_secrets FROM PUBLIC;
+
+CREATE OR REPLACE FUNCTION rule_action_secret_set(p_name TEXT, p_value TEXT, p_description TEXT DEFAULT NULL)
+RETURNS VOID AS $$
+    INSERT INTO rule_action_secrets (secret_name, secret_value, description)
+    VALUES (p_name, encrypt_credential(p_value), p_description)
+    ON CONFLICT (secret_name) DO UPDATE SET
+        secret_value = EXCLUDED.secret_value,
+        description = COALESCE(EXCLUDED.description, rule_action_secrets.description),
+        updated_at = CURRENT_TIMESTAMP;
+$$ LANGUAGE sql;
+
+COMMENT ON FUNCTION rule_action_secret_set(TEXT, TEXT, TEXT) IS 'Stores an encrypted credential for action configs to reference by name';
+
+-- First message of each chat thread, so later messages with the same
+-- thread key are posted as replies
+CREATE TABLE IF NOT EXISTS rule_chat_threads (
+    action_name TEXT NOT NULL,
+    thread_key TEXT NOT NULL,
+    channel TEXT NOT NULL,
+    thread_id TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (action_name, thread_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_threads_created ON rule_chat_threads(created_at);
+
+-- Allow-listed SQL for sql, insert_row, and function actions. Action
+-- configs can only name statements, tables, and functions from this table,
+-- so only its owners decide what SQL runs.
+CREATE TABLE IF NOT EXISTS rule_sql_statements (
+    statement_name TEXT PRIMARY KEY,
+    statement TEXT NOT NULL,
+    kind TEXT NOT NULL DEFAULT 'statement' CHECK (kind IN ('statement', 'table', 'function')),
+    database_secret TEXT,
+    description TEXT,
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE rule_sql_statements ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'statement'
+    CHECK (kind IN ('statement', 'table', 'function'));
+
+REVOKE ALL ON rule_sql_statements FROM PUBLIC;
+
+COMMENT ON COLUMN rule_sql_statements.statement IS 'SQL with :path placeholders bound from message data, e.g. VALUES (:customer.id, :score); for kind table or function, the allowed table or function name as actions write it, e.g. reporting.churn';
+COMMENT ON COLUMN rule_sql_statements.database_secret IS 'rule_action_secrets entry holding the target connection URL; NULL for the worker database';
+
+-- Personal data masked before payloads are logged or stored by the worker
+CREATE TABLE IF NOT EXISTS rule_scrub_rules (
+    rule_id SERIAL PRIMARY KEY,
+    path TEXT NOT NULL UNIQUE,
+    strategy TEXT NOT NULL DEFAULT 'mask' CHECK (strategy IN ('mask', 'hash', 'last4', 'remove')),
+    description TEXT,
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON COLUMN rule_scrub_rules.path IS 'JSONPath into the message, e.g. $.data.ssn, $.data.items[*].card, or $..email';
+
+-- How long the retention janitor keeps rows of each delivery and audit
+-- table; tables without a row are never pruned
+CREATE TABLE IF NOT EXISTS rule_retention_policies (
+    table_name TEXT PRIMARY KEY,
+    keep_days INTEGER NOT NULL CHECK (keep_days > 0),
+    archive JSONB,
+    batch_size INTEGER NOT NULL DEFAULT 1000 CHECK (batch_size > 0),
+    enabled BOOLEAN NOT NULL DEFAULT true,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON COLUMN rule_retention_policies.table_name IS 'rule_webhook_calls, rule_webhook_call_history, rule_nats_publish_history, rule_nats_expired_messages, rule_notification_receipts, or rule_nats_consumer_usage';
+COMMENT ON COLUMN rule_retention_policies.archive IS 'Copy rows to object storage before deleting them: {"bucket", "prefix", "endpoint", "region", "path_style", "credentials_secret"}';
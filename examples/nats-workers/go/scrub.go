@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scrub rules mask personal data in payloads before the worker writes them
+// anywhere other than their destination: logs and stored payloads such as
+// rule_nats_expired_messages. Rules live in rule_scrub_rules so every
+// worker applies the same policy:
+//
+//	$.data.ssn               one field
+//	$.data.customer.*        every field of an object
+//	$.data.items[*].card     a field of every array element
+//	$..email                 a field at any depth
+//
+// Strategies: mask (replace with "[REDACTED]"), hash (stable SHA-256 prefix,
+// so equal values can still be correlated), last4 (keep the last four
+// characters), and remove.
+
+const scrubMask = "[REDACTED]"
+
+// scrubRule is one rule_scrub_rules row with its path parsed
+type scrubRule struct {
+	Path     string
+	Strategy string
+	segments []string // "..", "*", "[*]", "[n]", or a field name
+}
+
+var (
+	scrubRulesMu       sync.Mutex
+	scrubRules         []*scrubRule
+	scrubRulesLoadedAt time.Time
+)
+
+// parseScrubPath splits a JSONPath-style path into segments
+func parseScrubPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("scrub path %q must start with $", path)
+	}
+	var segments []string
+	rest := path[1:]
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			segments = append(segments, "..")
+			rest = rest[2:]
+		case rest[0] == '.':
+			rest = rest[1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("scrub path %q: unclosed [", path)
+			}
+			index := rest[1:end]
+			if index != "*" {
+				if _, err := strconv.Atoi(index); err != nil {
+					return nil, fmt.Errorf("scrub path %q: index must be a number or *", path)
+				}
+			}
+			segments = append(segments, "["+index+"]")
+			rest = rest[end+1:]
+			continue
+		}
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		if end == 0 {
+			continue
+		}
+		segments = append(segments, rest[:end])
+		rest = rest[end:]
+	}
+	if len(segments) == 0 || segments[len(segments)-1] == ".." {
+		return nil, fmt.Errorf("scrub path %q does not name a field", path)
+	}
+	return segments, nil
+}
+
+// matches reports whether the rule applies to the value at path, where
+// path holds field names and "[n]" array indexes
+func (r *scrubRule) matches(path []string) bool {
+	return matchScrubPath(r.segments, path)
+}
+
+func matchScrubPath(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == ".." {
+		for skip := 0; skip <= len(path); skip++ {
+			if matchScrubPath(pattern[1:], path[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	ok := pattern[0] == path[0] ||
+		(pattern[0] == "*" && !strings.HasPrefix(path[0], "[")) ||
+		(pattern[0] == "[*]" && strings.HasPrefix(path[0], "["))
+	return ok && matchScrubPath(pattern[1:], path[1:])
+}
+
+// apply returns the replacement for value, or remove=true to drop it
+func (r *scrubRule) apply(value interface{}) (replacement interface{}, remove bool) {
+	switch r.Strategy {
+	case "remove":
+		return nil, true
+	case "hash":
+		encoded, _ := json.Marshal(value)
+		sum := sha256.Sum256(encoded)
+		return "sha256:" + hex.EncodeToString(sum[:8]), false
+	case "last4":
+		s := fmt.Sprint(value)
+		if f, ok := value.(float64); ok {
+			// JSON numbers decode as float64; keep their digits
+			s = strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		if len(s) <= 4 {
+			return scrubMask, false
+		}
+		return strings.Repeat("*", len(s)-4) + s[len(s)-4:], false
+	default:
+		return scrubMask, false
+	}
+}
+
+// getScrubRules returns the enabled scrub rules, reading them from Postgres
+// at most once per actionCacheTTL. If Postgres is unavailable the last
+// rules read are kept.
+func getScrubRules(ctx context.Context) ([]*scrubRule, error) {
+	scrubRulesMu.Lock()
+	defer scrubRulesMu.Unlock()
+	if !scrubRulesLoadedAt.IsZero() && time.Since(scrubRulesLoadedAt) < actionCacheTTL {
+		return scrubRules, nil
+	}
+
+	rows, err := lookupQuery(ctx, `SELECT path, strategy FROM rule_scrub_rules WHERE enabled = true ORDER BY rule_id`)
+	if err != nil {
+		if !scrubRulesLoadedAt.IsZero() {
+			return scrubRules, nil
+		}
+		return nil, fmt.Errorf("failed to load scrub rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []*scrubRule
+	for rows.Next() {
+		rule := &scrubRule{}
+		if err := rows.Scan(&rule.Path, &rule.Strategy); err != nil {
+			return nil, err
+		}
+		if rule.segments, err = parseScrubPath(rule.Path); err != nil {
+			log.Printf("⚠️  Ignoring scrub rule: %v", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	scrubRules, scrubRulesLoadedAt = rules, time.Now()
+	return rules, nil
+}
+
+// scrubPayload returns a copy of a JSON payload with the scrub rules
+// applied. Payloads that are not JSON objects or arrays are returned
+// unchanged. When no rules can be loaded it fails rather than let personal
+// data through.
+func scrubPayload(ctx context.Context, raw []byte) ([]byte, error) {
+	rules, err := getScrubRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return raw, nil
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return raw, nil
+	}
+	if _, ok := doc.(string); ok {
+		return raw, nil
+	}
+	doc = scrubValue(rules, doc, nil)
+	return json.Marshal(doc)
+}
+
+// scrubValue applies rules to value, found at path, and to its children
+func scrubValue(rules []*scrubRule, value interface{}, path []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			childPath := append(path[:len(path):len(path)], key)
+			if replacement, remove, ok := scrubMatch(rules, child, childPath); ok {
+				if remove {
+					delete(v, key)
+				} else {
+					v[key] = replacement
+				}
+				continue
+			}
+			v[key] = scrubValue(rules, child, childPath)
+		}
+	case []interface{}:
+		kept := v[:0]
+		for i, child := range v {
+			childPath := append(path[:len(path):len(path)], "["+strconv.Itoa(i)+"]")
+			if replacement, remove, ok := scrubMatch(rules, child, childPath); ok {
+				if !remove {
+					kept = append(kept, replacement)
+				}
+				continue
+			}
+			kept = append(kept, scrubValue(rules, child, childPath))
+		}
+		return kept
+	}
+	return value
+}
+
+// scrubMatch applies the first rule matching path
+func scrubMatch(rules []*scrubRule, value interface{}, path []string) (interface{}, bool, bool) {
+	for _, rule := range rules {
+		if rule.matches(path) {
+			replacement, remove := rule.apply(value)
+			return replacement, remove, true
+		}
+	}
+	return nil, false, false
+}
+
+// scrubField returns value as it may be logged, given its path in the
+// payload (e.g. "$.event_key")
+func scrubField(path, value string) string {
+	if value == "" {
+		return value
+	}
+	segments, err := parseScrubPath(path)
+	if err != nil {
+		return value
+	}
+	// Used in log lines and audit records, which outlive the message
+	ctx, cancel := context.WithTimeout(context.Background(), opsWriteTimeout)
+	defer cancel()
+	rules, err := getScrubRules(ctx)
+	if err != nil {
+		return scrubMask
+	}
+	replacement, remove, ok := scrubMatch(rules, value, segments)
+	if !ok {
+		return value
+	}
+	if remove {
+		return scrubMask
+	}
+	return fmt.Sprint(replacement)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// setScrubRules installs rules in the scrub rule cache for one test; nil
+// empties the cache so the next lookup reads the database
+func setScrubRules(t *testing.T, rules map[string]string, order ...string) {
+	t.Helper()
+	var parsed []*scrubRule
+	for _, path := range order {
+		segments, err := parseScrubPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, &scrubRule{Path: path, Strategy: rules[path], segments: segments})
+	}
+	scrubRulesMu.Lock()
+	scrubRules, scrubRulesLoadedAt = parsed, time.Now()
+	if rules == nil {
+		scrubRulesLoadedAt = time.Time{}
+	}
+	scrubRulesMu.Unlock()
+	t.Cleanup(func() {
+		scrubRulesMu.Lock()
+		scrubRules, scrubRulesLoadedAt = nil, time.Time{}
+		scrubRulesMu.Unlock()
+	})
+}
+
+func TestParseScrubPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []string
+		wantErr string
+	}{
+		{path: "$.data.ssn", want: []string{"data", "ssn"}},
+		{path: "$.data.customer.*", want: []string{"data", "customer", "*"}},
+		{path: "$.data.items[*].card", want: []string{"data", "items", "[*]", "card"}},
+		{path: "$.data.items[2]", want: []string{"data", "items", "[2]"}},
+		{path: "$..email", want: []string{"..", "email"}},
+		{path: "$.data..card.number", want: []string{"data", "..", "card", "number"}},
+		{path: "data.ssn", wantErr: "must start with $"},
+		{path: "$.items[*", wantErr: "unclosed ["},
+		{path: "$.items[first]", wantErr: "index must be a number or *"},
+		{path: "$", wantErr: "does not name a field"},
+		{path: "$.data..", wantErr: "does not name a field"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := parseScrubPath(tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("segments = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchScrubPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    []string
+		want    bool
+	}{
+		{"$.data.ssn", []string{"data", "ssn"}, true},
+		{"$.data.ssn", []string{"data", "ssn", "x"}, false},
+		{"$.data.ssn", []string{"ssn"}, false},
+		{"$.data.*", []string{"data", "anything"}, true},
+		{"$.data.*", []string{"data", "[0]"}, false},
+		{"$.data.items[*].card", []string{"data", "items", "[3]", "card"}, true},
+		{"$.data.items[*].card", []string{"data", "items", "card"}, false},
+		{"$.data.items[1]", []string{"data", "items", "[1]"}, true},
+		{"$.data.items[1]", []string{"data", "items", "[0]"}, false},
+		{"$..email", []string{"email"}, true},
+		{"$..email", []string{"data", "customer", "[0]", "email"}, true},
+		{"$..email", []string{"data", "email_verified"}, false},
+		{"$.data..number", []string{"data", "card", "number"}, true},
+		{"$.data..number", []string{"meta", "number"}, false},
+	}
+	for _, tt := range tests {
+		segments, err := parseScrubPath(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := matchScrubPath(segments, tt.path); got != tt.want {
+			t.Errorf("match(%s, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestScrubRuleApply(t *testing.T) {
+	tests := []struct {
+		strategy   string
+		value      interface{}
+		want       interface{}
+		wantRemove bool
+	}{
+		{strategy: "mask", value: "123-45-6789", want: scrubMask},
+		{strategy: "", value: 42.0, want: scrubMask},
+		{strategy: "remove", value: "x", wantRemove: true},
+		{strategy: "last4", value: "4111111111111111", want: "************1111"},
+		{strategy: "last4", value: "123", want: scrubMask},
+		{strategy: "last4", value: 12345678.0, want: "****5678"},
+		{strategy: "hash", value: "ada@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			rule := &scrubRule{Strategy: tt.strategy}
+			got, remove := rule.apply(tt.value)
+			if remove != tt.wantRemove {
+				t.Fatalf("remove = %v", remove)
+			}
+			if tt.strategy == "hash" {
+				// Stable and value-dependent rather than a fixed digest
+				again, _ := rule.apply(tt.value)
+				other, _ := rule.apply("bob@example.com")
+				s, _ := got.(string)
+				if !strings.HasPrefix(s, "sha256:") || len(s) != len("sha256:")+16 || again != got || other == got {
+					t.Fatalf("hash = %v (again %v, other %v)", got, again, other)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Fatalf("apply(%v) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrubPayload(t *testing.T) {
+	setScrubRules(t, map[string]string{
+		"$.data.ssn":           "mask",
+		"$.data.card":          "last4",
+		"$.data.items[*].note": "remove",
+		"$..email":             "hash",
+		"$.data.secrets.*":     "mask",
+		"$.data.tags[0]":       "remove",
+	}, "$.data.ssn", "$.data.card", "$.data.items[*].note", "$..email", "$.data.secrets.*", "$.data.tags[0]")
+
+	raw := `{"data": {"ssn": "123-45-6789", "card": "4111111111111111", "amount": 10,
+		"items": [{"sku": "a", "note": "gift for Ada"}, {"sku": "b"}],
+		"customer": {"email": "ada@example.com", "name": "Ada"},
+		"secrets": {"a": 1, "b": {"c": 2}}, "tags": ["vip", "new"]}}`
+	out, err := scrubPayload(context.Background(), []byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		t.Fatal(err)
+	}
+	d := doc.Data
+	if d["ssn"] != scrubMask || d["card"] != "************1111" || d["amount"] != 10.0 {
+		t.Errorf("data = %v", d)
+	}
+	items := d["items"].([]interface{})
+	if _, ok := items[0].(map[string]interface{})["note"]; ok || items[0].(map[string]interface{})["sku"] != "a" {
+		t.Errorf("items = %v", items)
+	}
+	customer := d["customer"].(map[string]interface{})
+	if email, _ := customer["email"].(string); !strings.HasPrefix(email, "sha256:") || customer["name"] != "Ada" {
+		t.Errorf("customer = %v", customer)
+	}
+	if !reflect.DeepEqual(d["secrets"], map[string]interface{}{"a": scrubMask, "b": scrubMask}) {
+		t.Errorf("secrets = %v", d["secrets"])
+	}
+	if !reflect.DeepEqual(d["tags"], []interface{}{"new"}) {
+		t.Errorf("tags = %v", d["tags"])
+	}
+	if strings.Contains(string(out), "ada@example.com") || strings.Contains(string(out), "123-45") {
+		t.Errorf("personal data left in %s", out)
+	}
+
+	for _, passthrough := range []string{`"just a string"`, `not json`} {
+		got, err := scrubPayload(context.Background(), []byte(passthrough))
+		if err != nil || string(got) != passthrough {
+			t.Errorf("scrubPayload(%s) = %s, %v", passthrough, got, err)
+		}
+	}
+}
+
+func TestScrubField(t *testing.T) {
+	setScrubRules(t, map[string]string{"$.event_key": "last4", "$.subject": "remove"}, "$.event_key", "$.subject")
+	tests := []struct {
+		path, value, want string
+	}{
+		{"$.event_key", "customer-00042", "**********0042"},
+		{"$.subject", "orders.ada", scrubMask},
+		{"$.action", "notify", "notify"},
+		{"$.event_key", "", ""},
+		{"bad path", "value", "value"},
+	}
+	for _, tt := range tests {
+		if got := scrubField(tt.path, tt.value); got != tt.want {
+			t.Errorf("scrubField(%s, %q) = %q, want %q", tt.path, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestGetScrubRules(t *testing.T) {
+	mock := mockDB(t)
+	setScrubRules(t, nil)
+
+	mock.ExpectQuery("FROM rule_scrub_rules WHERE enabled = true").
+		WillReturnRows(sqlmock.NewRows([]string{"path", "strategy"}).
+			AddRow("$.data.ssn", "mask").
+			AddRow("data.invalid", "mask").
+			AddRow("$..email", "hash"))
+	rules, err := getScrubRules(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Path != "$.data.ssn" || rules[1].Path != "$..email" {
+		t.Fatalf("rules = %+v", rules)
+	}
+	// Cached: no second query
+	if again, _ := getScrubRules(context.Background()); len(again) != 2 {
+		t.Fatalf("cached rules = %+v", again)
+	}
+
+	// After the TTL a failed reload keeps the last rules
+	scrubRulesMu.Lock()
+	scrubRulesLoadedAt = time.Now().Add(-2 * actionCacheTTL)
+	scrubRulesMu.Unlock()
+	mock.ExpectQuery("FROM rule_scrub_rules").WillReturnError(errors.New("relation does not exist"))
+	if kept, err := getScrubRules(context.Background()); err != nil || len(kept) != 2 {
+		t.Fatalf("after failed reload: %v, %v", kept, err)
+	}
+}
+
+// With no rules ever loaded, scrubbing fails closed
+func TestScrubFailsClosed(t *testing.T) {
+	mock := mockDB(t)
+	setScrubRules(t, nil)
+	mock.ExpectQuery("FROM rule_scrub_rules").WillReturnError(errors.New("relation does not exist"))
+	mock.ExpectQuery("FROM rule_scrub_rules").WillReturnError(errors.New("relation does not exist"))
+
+	if _, err := scrubPayload(context.Background(), []byte(`{"ssn":"1"}`)); err == nil {
+		t.Fatal("scrubPayload let the payload through without rules")
+	}
+	if got := scrubField("$.event_key", "customer-42"); got != scrubMask {
+		t.Fatalf("scrubField = %q, want the mask", got)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// sdNotify sends a state such as "READY=1" to systemd when the worker runs
+// as a Type=notify unit (NOTIFY_SOCKET is set). It is a no-op otherwise.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("⚠️  systemd notify failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("⚠️  systemd notify failed: %v", err)
+	}
+}
+
+// watchdogInterval is the WatchdogSec systemd expects pings within, or 0
+// when the watchdog is off or meant for another process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startWatchdog pings systemd at half the watchdog interval and reports
+// readiness in the unit's status line. Pings stop once the NATS connection
+// is closed for good, so systemd restarts the worker; a PostgreSQL outage
+// does not stop them, since writes are retried and buffered meanwhile.
+func startWatchdog(nc *nats.Conn) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	log.Printf("🐕 systemd watchdog: %s", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if nc.IsClosed() {
+				log.Printf("⚠️  NATS connection closed, stopping watchdog pings")
+				return
+			}
+			status := "STATUS=Processing messages"
+			if ready, _ := readiness(); !ready {
+				status = "STATUS=Not ready (see /readyz)"
+			}
+			sdNotify("WATCHDOG=1\n" + status)
+		}
+	}()
+}
@@ -0,0 +1,103 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify stands in for systemd's notify socket and returns the
+// datagrams the worker sends to it
+func listenNotify(t *testing.T, name string) <-chan string {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets unavailable: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	states := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			states <- string(buf[:n])
+		}
+	}()
+	return states
+}
+
+func TestSDNotify(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen string
+		socket string
+	}{
+		{name: "path", listen: filepath.Join(t.TempDir(), "notify.sock")},
+		// systemd passes abstract sockets with a leading @
+		{name: "abstract", listen: "\x00rule-worker-test-" + strconv.Itoa(os.Getpid()), socket: "@rule-worker-test-" + strconv.Itoa(os.Getpid())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			states := listenNotify(t, tt.listen)
+			socket := tt.socket
+			if socket == "" {
+				socket = tt.listen
+			}
+			t.Setenv("NOTIFY_SOCKET", socket)
+
+			sdNotify("READY=1")
+			select {
+			case got := <-states:
+				if got != "READY=1" {
+					t.Fatalf("got %q", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("nothing sent")
+			}
+		})
+	}
+}
+
+func TestSDNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	sdNotify("READY=1") // must not fail or block
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	sdNotify("READY=1") // logged, not fatal
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name string
+		usec string
+		pid  string
+		want time.Duration
+	}{
+		{name: "off", want: 0},
+		{name: "30s", usec: "30000000", want: 30 * time.Second},
+		{name: "for this process", usec: "30000000", pid: self, want: 30 * time.Second},
+		{name: "for another process", usec: "30000000", pid: "1", want: 0},
+		{name: "zero", usec: "0", want: 0},
+		{name: "negative", usec: "-5", want: 0},
+		{name: "garbage", usec: "30s", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+			if got := watchdogInterval(); got != tt.want {
+				t.Fatalf("watchdogInterval = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Action credentials (API tokens, webhook URLs with embedded keys) live in
+// rule_action_secrets, encrypted with the extension's encrypt_credential().
+// Action configs reference them by name so rule_actions stays readable.
+
+type cachedSecret struct {
+	value    string
+	loadedAt time.Time
+}
+
+var (
+	secretsMu sync.Mutex
+	secrets   = map[string]cachedSecret{}
+)
+
+// getSecret returns the decrypted secret with the given name, reading it
+// from Postgres at most once per actionCacheTTL.
+func getSecret(ctx context.Context, name string) (string, error) {
+	secretsMu.Lock()
+	cached, ok := secrets[name]
+	secretsMu.Unlock()
+	if ok && time.Since(cached.loadedAt) < actionCacheTTL {
+		return cached.value, nil
+	}
+
+	var value string
+	err := lookupQueryRow(ctx,
+		`SELECT decrypt_credential(secret_value) FROM rule_action_secrets WHERE secret_name = $1`,
+		name,
+	).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("secret %s not found", name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load secret %s: %w", name, err)
+	}
+
+	secretsMu.Lock()
+	secrets[name] = cachedSecret{value: value, loadedAt: time.Now()}
+	secretsMu.Unlock()
+	return value, nil
+}
+
+// secretOr returns value, or the named secret when value is empty
+func secretOr(ctx context.Context, value, secretName string) (string, error) {
+	if value != "" || secretName == "" {
+		return value, nil
+	}
+	return getSecret(ctx, secretName)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The worker runs in the foreground by default. "install" and "uninstall"
+// register it with the service manager: a systemd unit on Linux, the
+// Service Control Manager on Windows (see service_windows.go).
+
+// defaultServiceName is the unit or service name used by install/uninstall
+const defaultServiceName = "rule-webhook-worker"
+
+// serviceOptions configures install and uninstall
+type serviceOptions struct {
+	Name     string
+	EnvFile  string        // KEY=VALUE settings for the service
+	User     string        // systemd only: account to run as
+	UnitDir  string        // systemd only: where the unit file is written
+	Watchdog time.Duration // systemd only: WatchdogSec (0 = off)
+}
+
+var (
+	shutdownOnce      sync.Once
+	shutdownRequested = make(chan struct{})
+
+	readyOnce   sync.Once
+	workerReady = make(chan struct{})
+)
+
+// requestShutdown stops the worker as SIGTERM would
+func requestShutdown() {
+	shutdownOnce.Do(func() { close(shutdownRequested) })
+}
+
+// waitForShutdown blocks until SIGINT/SIGTERM or requestShutdown
+func waitForShutdown() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	select {
+	case <-sigChan:
+	case <-shutdownRequested:
+	}
+}
+
+// markReady tells the service manager the worker is consuming messages
+func markReady() {
+	readyOnce.Do(func() {
+		close(workerReady)
+		sdNotify("READY=1")
+	})
+}
+
+// serviceCommand runs a subcommand and returns the process exit code
+func serviceCommand(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	opts := serviceOptions{}
+	fs.StringVar(&opts.Name, "name", defaultServiceName, "service name")
+
+	switch name {
+	case "install":
+		fs.StringVar(&opts.EnvFile, "env-file", "", "file of KEY=VALUE settings for the service")
+		fs.StringVar(&opts.User, "user", "", "systemd: user to run the worker as")
+		fs.StringVar(&opts.UnitDir, "unit-dir", "/etc/systemd/system", "systemd: directory for the unit file")
+		fs.DurationVar(&opts.Watchdog, "watchdog", 30*time.Second, "systemd: watchdog timeout (0 = off)")
+	case "uninstall":
+		fs.StringVar(&opts.UnitDir, "unit-dir", "/etc/systemd/system", "systemd: directory of the unit file")
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q (expected install, uninstall, snapshot, restore, or cutover)\n", name)
+		return 2
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if name == "install" {
+		err = installService(opts)
+	} else {
+		err = uninstallService(opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// readEnvFile parses KEY=VALUE lines, skipping blanks and # comments and
+// stripping matching quotes around values
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(text, "export "), "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, line)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env = append(env, strings.TrimSpace(key)+"="+value)
+	}
+	return env, scanner.Err()
+}
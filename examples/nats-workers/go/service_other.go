@@ -0,0 +1,92 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=Rule Engine NATS Webhook Worker
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart={{.Exec}}
+{{- if .EnvFile}}
+EnvironmentFile={{.EnvFile}}
+{{- end}}
+{{- if .User}}
+User={{.User}}
+{{- end}}
+Restart=on-failure
+RestartSec=5
+TimeoutStopSec=60
+{{- if .WatchdogSec}}
+WatchdogSec={{.WatchdogSec}}
+{{- end}}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// runningAsService is only true for Windows services; systemd units run
+// the worker in the foreground
+func runningAsService() bool { return false }
+
+func runService() {}
+
+// installService writes a systemd unit that runs this binary
+func installService(opts serviceOptions) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+
+	data := struct {
+		Exec, EnvFile, User string
+		WatchdogSec         int
+	}{Exec: exe, User: opts.User, WatchdogSec: int(opts.Watchdog.Seconds())}
+	if opts.EnvFile != "" {
+		if _, err := readEnvFile(opts.EnvFile); err != nil {
+			return err
+		}
+		if data.EnvFile, err = filepath.Abs(opts.EnvFile); err != nil {
+			return err
+		}
+	}
+
+	var unit bytes.Buffer
+	if err := unitTemplate.Execute(&unit, data); err != nil {
+		return err
+	}
+	path := filepath.Join(opts.UnitDir, opts.Name+".service")
+	if err := os.WriteFile(path, unit.Bytes(), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\nStart it with:\n  systemctl daemon-reload\n  systemctl enable --now %s\n", path, opts.Name)
+	return nil
+}
+
+// uninstallService removes the unit written by installService
+func uninstallService(opts serviceOptions) error {
+	path := filepath.Join(opts.UnitDir, opts.Name+".service")
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s is not installed", path)
+		}
+		return err
+	}
+	fmt.Printf("Removed %s\nReload systemd with:\n  systemctl daemon-reload\n", path)
+	return nil
+}
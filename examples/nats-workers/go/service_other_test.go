@@ -0,0 +1,86 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstallService(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		t.Fatal(err)
+	}
+	envFile := filepath.Join(t.TempDir(), "worker.env")
+	if err := os.WriteFile(envFile, []byte("NATS_URL=nats://nats:4222\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	badEnvFile := filepath.Join(t.TempDir(), "bad.env")
+	if err := os.WriteFile(badEnvFile, []byte("NATS_URL\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    serviceOptions
+		want    []string
+		notWant []string
+		wantErr string
+	}{
+		{name: "defaults", opts: serviceOptions{Name: "rule-webhook-worker", Watchdog: 30 * time.Second},
+			want:    []string{"Type=notify", "ExecStart=" + exe + "\n", "WatchdogSec=30\n", "WantedBy=multi-user.target"},
+			notWant: []string{"EnvironmentFile=", "User="}},
+		{name: "env file and user", opts: serviceOptions{Name: "orders-worker", EnvFile: envFile, User: "worker"},
+			want:    []string{"EnvironmentFile=" + envFile + "\n", "User=worker\n"},
+			notWant: []string{"WatchdogSec="}},
+		{name: "invalid env file", opts: serviceOptions{Name: "w", EnvFile: badEnvFile}, wantErr: "expected KEY=VALUE"},
+		{name: "missing env file", opts: serviceOptions{Name: "w", EnvFile: envFile + ".missing"}, wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.UnitDir = t.TempDir()
+			err := installService(tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(tt.opts.UnitDir, tt.opts.Name+".service")
+			unit, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.want {
+				if !strings.Contains(string(unit), s) {
+					t.Errorf("unit lacks %q:\n%s", s, unit)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(string(unit), s) {
+					t.Errorf("unit has %q:\n%s", s, unit)
+				}
+			}
+
+			if err := uninstallService(tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("unit still there: %v", err)
+			}
+			if err := uninstallService(tt.opts); err == nil || !strings.Contains(err.Error(), "is not installed") {
+				t.Fatalf("second uninstall: %v", err)
+			}
+		})
+	}
+}
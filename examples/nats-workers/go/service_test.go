@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr string
+	}{
+		{name: "empty", content: "", want: nil},
+		{name: "plain", content: "NATS_URL=nats://localhost:4222\nDB_HOST=db\n",
+			want: []string{"NATS_URL=nats://localhost:4222", "DB_HOST=db"}},
+		{name: "comments and blanks", content: "# worker settings\n\n  DB_HOST = db  \n",
+			want: []string{"DB_HOST=db"}},
+		{name: "export prefix", content: "export DB_USER=worker\n", want: []string{"DB_USER=worker"}},
+		{name: "quotes stripped", content: "A=\"two words\"\nB='x'\n", want: []string{"A=two words", "B=x"}},
+		{name: "mismatched quotes kept", content: "A=\"x'\n", want: []string{"A=\"x'"}},
+		{name: "value with =", content: "DSN=host=db user=worker\n", want: []string{"DSN=host=db user=worker"}},
+		{name: "empty value", content: "ADMIN_TOKEN=\n", want: []string{"ADMIN_TOKEN="}},
+		{name: "no =", content: "DB_HOST=db\nNATS_URL\n", wantErr: ":2: expected KEY=VALUE"},
+		{name: "no key", content: "=value\n", wantErr: ":1: expected KEY=VALUE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "worker.env")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readEnvFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readEnvFile(filepath.Join(t.TempDir(), "missing.env")); !os.IsNotExist(err) {
+		t.Fatalf("missing file: err = %v", err)
+	}
+}
+
+func TestServiceCommandUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{name: "start", want: 2},
+		{name: "install", args: []string{"-watchdog", "soon"}, want: 2},
+		{name: "uninstall", args: []string{"-user", "worker"}, want: 2},
+		{name: "uninstall", args: []string{"-unit-dir", t.TempDir(), "-name", "not-installed"}, want: 1},
+	}
+	for _, tt := range tests {
+		if got := serviceCommand(tt.name, tt.args); got != tt.want {
+			t.Errorf("serviceCommand(%s, %v) = %d, want %d", tt.name, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestRequestShutdown(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		waitForShutdown()
+		close(done)
+	}()
+
+	requestShutdown()
+	requestShutdown() // a second request is harmless
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitForShutdown did not return")
+	}
+}
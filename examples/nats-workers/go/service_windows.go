@@ -0,0 +1,187 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceNameEnv names the installed service, so it can log to the
+// matching event source
+const serviceNameEnv = "WORKER_SERVICE_NAME"
+
+func runningAsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// runService runs the worker under the Service Control Manager, logging to
+// the Windows event log
+func runService() {
+	name := getEnv(serviceNameEnv, defaultServiceName)
+	if elog, err := eventlog.Open(name); err == nil {
+		defer elog.Close()
+		log.SetFlags(0)
+		log.SetOutput(eventLogWriter{elog})
+	}
+	if err := svc.Run(name, windowsService{}); err != nil {
+		log.Fatalf("❌ Service failed: %v", err)
+	}
+}
+
+type windowsService struct{}
+
+func (windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run()
+	}()
+
+	running := svc.Status{State: svc.StartPending}
+	ready := workerReady
+	for {
+		select {
+		case <-ready:
+			running = svc.Status{State: svc.Running, Accepts: accepts}
+			status <- running
+			ready = nil // report once
+		case <-done:
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- running
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				requestShutdown()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventLogWriter sends each log line to the event log, as an error or
+// warning when it carries the matching emoji
+type eventLogWriter struct{ elog *eventlog.Log }
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	var err error
+	switch {
+	case strings.Contains(msg, "❌"):
+		err = w.elog.Error(1, msg)
+	case strings.Contains(msg, "⚠️"):
+		err = w.elog.Warning(1, msg)
+	default:
+		err = w.elog.Info(1, msg)
+	}
+	return len(p), err
+}
+
+// installService registers this binary with the Service Control Manager,
+// starting automatically, with the settings from opts.EnvFile as the
+// service's environment
+func installService(opts serviceOptions) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+	env := []string{serviceNameEnv + "=" + opts.Name}
+	if opts.EnvFile != "" {
+		settings, err := readEnvFile(opts.EnvFile)
+		if err != nil {
+			return err
+		}
+		env = append(env, settings...)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(opts.Name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", opts.Name)
+	}
+	s, err := m.CreateService(opts.Name, exe, mgr.Config{
+		DisplayName: "Rule Engine NATS Webhook Worker",
+		Description: "Delivers rule engine actions from NATS JetStream",
+		StartType:   mgr.StartAutomatic,
+	})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// Restart after a crash, like systemd's Restart=on-failure
+	recovery := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+	}
+	if err := s.SetRecoveryActions(recovery, uint32((24 * time.Hour).Seconds())); err != nil {
+		s.Delete()
+		return err
+	}
+
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+opts.Name, registry.SET_VALUE)
+	if err != nil {
+		s.Delete()
+		return err
+	}
+	defer key.Close()
+	if err := key.SetStringsValue("Environment", env); err != nil {
+		s.Delete()
+		return err
+	}
+
+	if err := eventlog.InstallAsEventCreate(opts.Name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to register event source: %w", err)
+	}
+	fmt.Printf("Installed service %s\nStart it with:\n  sc.exe start %s\n", opts.Name, opts.Name)
+	return nil
+}
+
+// uninstallService removes the service and its event source
+func uninstallService(opts serviceOptions) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(opts.Name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", opts.Name)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	if err := eventlog.Remove(opts.Name); err != nil {
+		return fmt.Errorf("failed to remove event source: %w", err)
+	}
+	fmt.Printf("Removed service %s; it is deleted once it stops\n", opts.Name)
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// slackPostMessageURL is the Web API endpoint; tests point it elsewhere
+var slackPostMessageURL = "https://slack.com/api/chat.postMessage"
+
+// slackAction posts a message to Slack, either through an incoming webhook
+// or through chat.postMessage with a bot token:
+//
+//	{"token_secret": "slack_bot", "channel": "#fraud", "text": "Order {{.order_id}} flagged",
+//	 "blocks": "[...]", "thread_key": "order-{{.order_id}}"}
+//
+// text is a template over data; blocks is a template producing a Block Kit
+// JSON array. Messages with the same rendered thread_key are posted as
+// replies to the first one (chat.postMessage only; incoming webhooks return
+// no message id).
+type slackAction struct{}
+
+type slackConfig struct {
+	WebhookURL     string  `json:"webhook_url"`
+	WebhookSecret  string  `json:"webhook_secret"`
+	Token          string  `json:"token"`
+	TokenSecret    string  `json:"token_secret"`
+	Channel        string  `json:"channel"`
+	Text           string  `json:"text"`
+	Blocks         string  `json:"blocks"`
+	Username       string  `json:"username"`
+	IconEmoji      string  `json:"icon_emoji"`
+	ThreadKey      string  `json:"thread_key"`
+	ReplyBroadcast bool    `json:"reply_broadcast"`
+	RatePerSecond  float64 `json:"rate_per_second"`
+}
+
+type slackMessage struct {
+	Channel        string          `json:"channel,omitempty"`
+	Text           string          `json:"text,omitempty"`
+	Blocks         json.RawMessage `json:"blocks,omitempty"`
+	Username       string          `json:"username,omitempty"`
+	IconEmoji      string          `json:"icon_emoji,omitempty"`
+	ThreadTS       string          `json:"thread_ts,omitempty"`
+	ReplyBroadcast bool            `json:"reply_broadcast,omitempty"`
+}
+
+type slackResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+func init() {
+	registerAction("slack", slackAction{})
+}
+
+func (slackAction) Execute(ctx context.Context, m *ActionMessage) (string, error) {
+	cfg := slackConfig{RatePerSecond: 1}
+	if err := m.Config.decode(&cfg); err != nil {
+		return "", err
+	}
+	data := m.Payload.Data
+
+	text, err := renderText(cfg.Text, data)
+	if err != nil {
+		return "", fmt.Errorf("text: %w", err)
+	}
+	message := slackMessage{
+		Channel:   cfg.Channel,
+		Text:      text,
+		Username:  cfg.Username,
+		IconEmoji: cfg.IconEmoji,
+	}
+	if cfg.Blocks != "" {
+		if message.Blocks, err = renderJSONTemplate(cfg.Blocks, data); err != nil {
+			return "", fmt.Errorf("blocks: %w", err)
+		}
+	}
+	if message.Text == "" && message.Blocks == nil {
+		return "", fmt.Errorf("action %s has no text or blocks", m.Config.Name)
+	}
+
+	webhookURL, err := secretOr(ctx, cfg.WebhookURL, cfg.WebhookSecret)
+	if err != nil {
+		return "", err
+	}
+	token, err := secretOr(ctx, cfg.Token, cfg.TokenSecret)
+	if err != nil {
+		return "", err
+	}
+
+	// Slack allows about one message per second per channel
+	limitKey := "slack:" + m.Config.Name
+	if err := chatLimiter.wait(ctx, limitKey, cfg.RatePerSecond); err != nil {
+		return "", err
+	}
+
+	if token == "" {
+		if webhookURL == "" {
+			return "", fmt.Errorf("action %s needs webhook_url or token", m.Config.Name)
+		}
+		if _, err := postJSON(ctx, webhookURL, message, nil); err != nil {
+			return "", err
+		}
+		return "posted to Slack", nil
+	}
+
+	if message.Channel == "" {
+		return "", fmt.Errorf("action %s needs a channel for chat.postMessage", m.Config.Name)
+	}
+	threadKey, err := renderText(cfg.ThreadKey, data)
+	if err != nil {
+		return "", fmt.Errorf("thread_key: %w", err)
+	}
+	if threadKey != "" {
+		channel, ts, ok, err := lookupThread(ctx, m.Config.Name, threadKey)
+		if err != nil {
+			return "", fmt.Errorf("thread lookup failed: %w", err)
+		}
+		if ok {
+			message.Channel = channel
+			message.ThreadTS = ts
+			message.ReplyBroadcast = cfg.ReplyBroadcast
+		}
+	}
+
+	body, err := postJSON(ctx, slackPostMessageURL, message, map[string]string{"Authorization": "Bearer " + token})
+	if err != nil {
+		return "", err
+	}
+	var resp slackResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", fmt.Errorf("invalid Slack response: %w", err)
+	}
+	if !resp.OK {
+		return "", fmt.Errorf("Slack error: %s", resp.Error)
+	}
+
+	if threadKey != "" && message.ThreadTS == "" {
+		if err := saveThread(ctx, m.Config.Name, threadKey, resp.Channel, resp.TS); err != nil {
+			// The message is out; losing the thread only affects replies
+			return fmt.Sprintf("posted to %s (thread not saved: %v)", resp.Channel, err), nil
+		}
+	}
+	if message.ThreadTS != "" {
+		return fmt.Sprintf("replied in %s thread %s", resp.Channel, message.ThreadTS), nil
+	}
+	return "posted to " + resp.Channel, nil
+}
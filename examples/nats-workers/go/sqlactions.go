@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// sqlNamePattern accepts optionally schema-qualified identifiers
+var sqlNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// quoteSQLName quotes a possibly schema-qualified table or function name
+func quoteSQLName(name string) (string, error) {
+	if !sqlNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid SQL name %q", name)
+	}
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// dataValue looks up a dotted path in the message data. Objects and arrays
+// are returned as JSON text so they bind to json/jsonb columns.
+func dataValue(data map[string]interface{}, path string) interface{} {
+	value := lookupData(data, path)
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+	return value
+}
+
+// insertRowAction inserts one row per message:
+//
+//	{"table": "reporting.alerts", "columns": {"customer_id": "customer.id", "score": "score"}}
+//
+// columns maps column names to dotted paths in data; missing paths insert
+// NULL. The table must be allow-listed in rule_sql_statements (kind
+// 'table'), whose database_secret also picks the database.
+type insertRowAction struct{}
+
+type insertRowConfig struct {
+	Table   string            `json:"table"`
+	Columns map[string]string `json:"columns"`
+}
+
+// functionAction calls a SQL function with the message data as JSONB, so
+// new behaviour can be written in PL/pgSQL without a worker release:
+//
+//	{"function": "crm.record_churn_risk"}
+//
+// The function must be allow-listed in rule_sql_statements (kind
+// 'function').
+type functionAction struct{}
+
+type functionConfig struct {
+	Function string `json:"function"`
+}
+
+func init() {
+	registerAction("insert_row", insertRowAction{})
+	registerAction("function", functionAction{})
+}
+
+func (insertRowAction) Execute(ctx context.Context, m *ActionMessage) (string, error) {
+	var cfg insertRowConfig
+	if err := m.Config.decode(&cfg); err != nil {
+		return "", err
+	}
+	table, err := quoteSQLName(cfg.Table)
+	if err != nil {
+		return "", fmt.Errorf("action %s: %w", m.Config.Name, err)
+	}
+	if len(cfg.Columns) == 0 {
+		return "", fmt.Errorf("action %s has no columns", m.Config.Name)
+	}
+	secret, err := allowedSQLTarget(ctx, "table", cfg.Table)
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(cfg.Columns))
+	for name := range cfg.Columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	columns := make([]string, len(names))
+	placeholders := make([]string, len(names))
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		columns[i] = pq.QuoteIdentifier(name)
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = dataValue(m.Payload.Data, cfg.Columns[name])
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		table, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	if err := execSQLTarget(ctx, secret, query, args...); err != nil {
+		return "", fmt.Errorf("insert into %s failed: %w", cfg.Table, err)
+	}
+	return "inserted into " + cfg.Table, nil
+}
+
+func (functionAction) Execute(ctx context.Context, m *ActionMessage) (string, error) {
+	var cfg functionConfig
+	if err := m.Config.decode(&cfg); err != nil {
+		return "", err
+	}
+	function, err := quoteSQLName(cfg.Function)
+	if err != nil {
+		return "", fmt.Errorf("action %s: %w", m.Config.Name, err)
+	}
+	secret, err := allowedSQLTarget(ctx, "function", cfg.Function)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := m.Payload.dataJSON()
+	if err != nil {
+		return "", err
+	}
+	if err := execSQLTarget(ctx, secret, fmt.Sprintf("SELECT %s($1::jsonb)", function), string(data)); err != nil {
+		return "", fmt.Errorf("%s failed: %w", cfg.Function, err)
+	}
+	return "called " + cfg.Function, nil
+}
+
+// sqlAction runs allow-listed statements from rule_sql_statements in one
+// transaction, with named parameters bound from data:
+//
+//	{"statements": ["upsert_customer_score", "log_score_change"], "for_each": "items"}
+//
+// Statements are written with :path placeholders ("VALUES (:customer.id,
+// :score)") and may target another database through database_secret. With
+// for_each, every statement runs once per element of that array, looking
+// paths up in the element first and then in data, all in the same
+// transaction.
+type sqlAction struct{}
+
+type sqlActionConfig struct {
+	Statements []string `json:"statements"`
+	ForEach    string   `json:"for_each"`
+}
+
+// sqlStatement is an allow-listed statement (rule_sql_statements row)
+// compiled to positional parameters
+type sqlStatement struct {
+	Name           string
+	Query          string
+	Params         []string // Data path for each $n
+	DatabaseSecret string   // Connection URL secret; empty for the worker's database
+}
+
+func init() {
+	registerAction("sql", sqlAction{})
+}
+
+func (sqlAction) Execute(ctx context.Context, m *ActionMessage) (string, error) {
+	var cfg sqlActionConfig
+	if err := m.Config.decode(&cfg); err != nil {
+		return "", err
+	}
+	if len(cfg.Statements) == 0 {
+		return "", fmt.Errorf("action %s has no statements", m.Config.Name)
+	}
+
+	statements := make([]*sqlStatement, len(cfg.Statements))
+	for i, name := range cfg.Statements {
+		stmt, err := getSQLStatement(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		if i > 0 && stmt.DatabaseSecret != statements[0].DatabaseSecret {
+			return "", fmt.Errorf("action %s: statements must share one database to run in a transaction", m.Config.Name)
+		}
+		statements[i] = stmt
+	}
+
+	rows := []map[string]interface{}{m.Payload.Data}
+	if cfg.ForEach != "" {
+		items, _ := lookupData(m.Payload.Data, cfg.ForEach).([]interface{})
+		rows = rows[:0]
+		for _, item := range items {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("%s must be an array of objects", cfg.ForEach)
+			}
+			rows = append(rows, obj)
+		}
+		if len(rows) == 0 {
+			return fmt.Sprintf("no %s to write", cfg.ForEach), nil
+		}
+	}
+
+	target, err := statementDB(ctx, statements[0].DatabaseSecret)
+	if err != nil {
+		return "", err
+	}
+	tx, err := target.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var affected int64
+	for _, row := range rows {
+		for _, stmt := range statements {
+			args := make([]interface{}, len(stmt.Params))
+			for i, path := range stmt.Params {
+				args[i] = rowValue(row, m.Payload.Data, path)
+			}
+			result, err := tx.ExecContext(ctx, stmt.Query, args...)
+			if err != nil {
+				return "", fmt.Errorf("statement %s failed: %w", stmt.Name, err)
+			}
+			if n, err := result.RowsAffected(); err == nil {
+				affected += n
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d statement(s) x %d row(s), %d rows affected", len(statements), len(rows), affected), nil
+}
+
+// rowValue looks path up in the for_each element, then in the message data
+func rowValue(row, data map[string]interface{}, path string) interface{} {
+	if value := dataValue(row, path); value != nil {
+		return value
+	}
+	return dataValue(data, path)
+}
+
+// lookupData resolves a dotted path in the message data without encoding
+func lookupData(data map[string]interface{}, path string) interface{} {
+	var current interface{} = data
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = obj[part]
+	}
+	return current
+}
+
+// compileNamedSQL rewrites :path placeholders to $n parameters, skipping
+// string literals (including E'...' escapes and $tag$ dollar quoting), quoted
+// identifiers, -- and nested /* */ comments, and :: casts. A path used
+// twice binds the same parameter.
+func compileNamedSQL(text string) (string, []string, error) {
+	var out strings.Builder
+	var params []string
+	index := map[string]int{}
+
+	isStart := func(c byte) bool { return c == '_' || (c|0x20) >= 'a' && (c|0x20) <= 'z' }
+	isPart := func(c byte) bool { return isStart(c) || c >= '0' && c <= '9' || c == '.' }
+	isIdent := func(c byte) bool { return isStart(c) || c >= '0' && c <= '9' || c == '$' }
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\'' || c == '"':
+			// E'...' strings allow backslash escapes
+			escapes := c == '\'' && i > 0 && (text[i-1]|0x20) == 'e' && (i == 1 || !isIdent(text[i-2]))
+			end := i + 1
+			for end < len(text) {
+				if escapes && text[end] == '\\' {
+					end += 2
+					continue
+				}
+				if text[end] == c {
+					if end+1 < len(text) && text[end+1] == c {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			if end >= len(text) {
+				return "", nil, fmt.Errorf("unterminated quote")
+			}
+			out.WriteString(text[i : end+1])
+			i = end
+		case c == '-' && i+1 < len(text) && text[i+1] == '-':
+			end := strings.IndexByte(text[i:], '\n')
+			if end < 0 {
+				end = len(text) - i
+			}
+			out.WriteString(text[i : i+end])
+			i += end - 1
+		case c == '/' && i+1 < len(text) && text[i+1] == '*':
+			// Block comments nest in Postgres
+			depth, end := 1, i+2
+			for end < len(text) && depth > 0 {
+				switch {
+				case strings.HasPrefix(text[end:], "/*"):
+					depth++
+					end += 2
+				case strings.HasPrefix(text[end:], "*/"):
+					depth--
+					end += 2
+				default:
+					end++
+				}
+			}
+			if depth > 0 {
+				return "", nil, fmt.Errorf("unterminated comment")
+			}
+			out.WriteString(text[i:end])
+			i = end - 1
+		case c == '$' && (i == 0 || !isIdent(text[i-1])) && dollarTag(text[i:]) != "":
+			tag := dollarTag(text[i:])
+			end := strings.Index(text[i+len(tag):], tag)
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated dollar-quoted string %s", tag)
+			}
+			end += i + 2*len(tag)
+			out.WriteString(text[i:end])
+			i = end - 1
+		case c == ':' && i+1 < len(text) && text[i+1] == ':':
+			out.WriteString("::")
+			i++
+		case c == ':' && i+1 < len(text) && isStart(text[i+1]):
+			end := i + 1
+			for end < len(text) && isPart(text[end]) {
+				end++
+			}
+			path := strings.TrimRight(text[i+1:end], ".")
+			end = i + 1 + len(path)
+			n, ok := index[path]
+			if !ok {
+				params = append(params, path)
+				n = len(params)
+				index[path] = n
+			}
+			fmt.Fprintf(&out, "$%d", n)
+			i = end - 1
+		case c == '$' && i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '9':
+			return "", nil, fmt.Errorf("use :path placeholders, not positional $n parameters")
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String(), params, nil
+}
+
+// dollarTag returns the $tag$ (or $$) opening a dollar-quoted string at the
+// start of text, or "" if there is none
+func dollarTag(text string) string {
+	for end := 1; end < len(text); end++ {
+		c := text[end]
+		switch {
+		case c == '$':
+			return text[:end+1]
+		case c == '_' || (c|0x20) >= 'a' && (c|0x20) <= 'z' || end > 1 && c >= '0' && c <= '9':
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+type cachedStatement struct {
+	stmt     *sqlStatement
+	loadedAt time.Time
+}
+
+var (
+	sqlStatementsMu sync.Mutex
+	sqlStatements   = map[string]cachedStatement{}
+
+	// sqlTargets caches allow-listed tables and functions by kind:name
+	sqlTargetsMu sync.Mutex
+	sqlTargets   = map[string]cachedStatement{}
+
+	statementDBsMu sync.Mutex
+	statementDBs   = map[string]*sql.DB{}
+)
+
+// getSQLStatement returns the enabled, compiled statement with the given
+// name, reading it from Postgres at most once per actionCacheTTL
+func getSQLStatement(ctx context.Context, name string) (*sqlStatement, error) {
+	sqlStatementsMu.Lock()
+	cached, ok := sqlStatements[name]
+	sqlStatementsMu.Unlock()
+	if ok && time.Since(cached.loadedAt) < actionCacheTTL {
+		return cached.stmt, nil
+	}
+
+	var text string
+	var secret sql.NullString
+	err := lookupQueryRow(ctx,
+		`SELECT statement, database_secret FROM rule_sql_statements
+		 WHERE statement_name = $1 AND kind = 'statement' AND enabled = true`,
+		name,
+	).Scan(&text, &secret)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("statement %s is not allow-listed in rule_sql_statements", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load statement %s: %w", name, err)
+	}
+
+	query, params, err := compileNamedSQL(text)
+	if err != nil {
+		return nil, fmt.Errorf("statement %s: %w", name, err)
+	}
+	stmt := &sqlStatement{Name: name, Query: query, Params: params, DatabaseSecret: secret.String}
+
+	sqlStatementsMu.Lock()
+	sqlStatements[name] = cachedStatement{stmt: stmt, loadedAt: time.Now()}
+	sqlStatementsMu.Unlock()
+	return stmt, nil
+}
+
+// allowedSQLTarget checks that a table or function (kind) is allow-listed
+// for insert_row and function actions and returns its database_secret,
+// reading it from Postgres at most once per actionCacheTTL
+func allowedSQLTarget(ctx context.Context, kind, name string) (string, error) {
+	key := kind + ":" + name
+	sqlTargetsMu.Lock()
+	cached, ok := sqlTargets[key]
+	sqlTargetsMu.Unlock()
+	if ok && time.Since(cached.loadedAt) < actionCacheTTL {
+		return cached.stmt.DatabaseSecret, nil
+	}
+
+	var secret sql.NullString
+	err := lookupQueryRow(ctx,
+		`SELECT database_secret FROM rule_sql_statements
+		 WHERE kind = $1 AND statement = $2 AND enabled = true
+		 ORDER BY statement_name LIMIT 1`,
+		kind, name,
+	).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("%s %s is not allow-listed in rule_sql_statements", kind, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to check %s %s: %w", kind, name, err)
+	}
+
+	sqlTargetsMu.Lock()
+	sqlTargets[key] = cachedStatement{stmt: &sqlStatement{Name: name, DatabaseSecret: secret.String}, loadedAt: time.Now()}
+	sqlTargetsMu.Unlock()
+	return secret.String, nil
+}
+
+// execSQLTarget runs one statement on the worker's database, with retries,
+// or on the database whose connection URL is in the named secret
+func execSQLTarget(ctx context.Context, secretName, query string, args ...interface{}) error {
+	if secretName == "" {
+		return withDBRetry(ctx, primaryHealth, func() error {
+			_, err := db.ExecContext(ctx, query, args...)
+			return err
+		})
+	}
+	pool, err := statementDB(ctx, secretName)
+	if err != nil {
+		return err
+	}
+	_, err = pool.ExecContext(ctx, query, args...)
+	return err
+}
+
+// statementDB returns the worker's database, or a pool for the connection
+// URL stored in the named secret. Pools are kept for the worker's lifetime.
+func statementDB(ctx context.Context, secretName string) (*sql.DB, error) {
+	if secretName == "" {
+		return db, nil
+	}
+
+	statementDBsMu.Lock()
+	defer statementDBsMu.Unlock()
+	if pool, ok := statementDBs[secretName]; ok {
+		return pool, nil
+	}
+	url, err := getSecret(ctx, secretName)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := openPostgres(url)
+	if err != nil {
+		return nil, fmt.Errorf("database %s: %w", secretName, err)
+	}
+	pool.SetMaxOpenConns(5)
+	statementDBs[secretName] = pool
+	return pool, nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCompileNamedSQL(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		want       string
+		wantParams []string
+		wantErr    string
+	}{
+		{name: "placeholders", text: "INSERT INTO t (a, b) VALUES (:customer.id, :score)",
+			want: "INSERT INTO t (a, b) VALUES ($1, $2)", wantParams: []string{"customer.id", "score"}},
+		{name: "repeated path binds once", text: "UPDATE t SET s = :score WHERE s <> :score AND id = :id",
+			want: "UPDATE t SET s = $1 WHERE s <> $1 AND id = $2", wantParams: []string{"score", "id"}},
+		{name: "trailing dot is not part of the path", text: "SELECT :a.",
+			want: "SELECT $1.", wantParams: []string{"a"}},
+		{name: "casts", text: "SELECT :amount::numeric, now()::date",
+			want: "SELECT $1::numeric, now()::date", wantParams: []string{"amount"}},
+		{name: "string literal", text: "SELECT ':not', 'it''s :x', :y",
+			want: "SELECT ':not', 'it''s :x', $1", wantParams: []string{"y"}},
+		{name: "escape string", text: `SELECT E'it\'s :x', :y`,
+			want: `SELECT E'it\'s :x', $1`, wantParams: []string{"y"}},
+		{name: "backslash in plain string", text: `SELECT 'C:\', :y`,
+			want: `SELECT 'C:\', $1`, wantParams: []string{"y"}},
+		{name: "quoted identifier", text: `SELECT ":col" FROM t WHERE x = :x`,
+			want: `SELECT ":col" FROM t WHERE x = $1`, wantParams: []string{"x"}},
+		{name: "line comment", text: "SELECT :a -- :b\n, :c",
+			want: "SELECT $1 -- :b\n, $2", wantParams: []string{"a", "c"}},
+		{name: "block comment", text: "SELECT /* :b */ :a",
+			want: "SELECT /* :b */ $1", wantParams: []string{"a"}},
+		{name: "nested block comment", text: "SELECT /* x /* :b */ :c */ :a",
+			want: "SELECT /* x /* :b */ :c */ $1", wantParams: []string{"a"}},
+		{name: "dollar quoted body", text: "DO $$ BEGIN PERFORM :x; RAISE NOTICE '%', 1; END $$; SELECT :y",
+			want: "DO $$ BEGIN PERFORM :x; RAISE NOTICE '%', 1; END $$; SELECT $1", wantParams: []string{"y"}},
+		{name: "tagged dollar quote", text: "SELECT $fn$ :x $$ :z $fn$, :y",
+			want: "SELECT $fn$ :x $$ :z $fn$, $1", wantParams: []string{"y"}},
+		{name: "dollar in identifier", text: "SELECT a$b$ FROM t WHERE x = :x",
+			want: "SELECT a$b$ FROM t WHERE x = $1", wantParams: []string{"x"}},
+		{name: "positional parameters rejected", text: "SELECT $1", wantErr: "not positional $n parameters"},
+		{name: "unterminated quote", text: "SELECT 'abc", wantErr: "unterminated quote"},
+		{name: "unterminated comment", text: "SELECT /* /* */ :a", wantErr: "unterminated comment"},
+		{name: "unterminated dollar quote", text: "SELECT $q$ abc $$", wantErr: "unterminated dollar-quoted string $q$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, params, err := compileNamedSQL(tt.text)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("query = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Fatalf("params = %q, want %q", params, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestQuoteSQLName(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "alerts", want: `"alerts"`},
+		{in: "reporting.churn", want: `"reporting"."churn"`},
+		{in: "a.b.c", wantErr: true},
+		{in: "t; DROP TABLE x", wantErr: true},
+		{in: `"quoted"`, wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := quoteSQLName(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("quoteSQLName(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestDataValue(t *testing.T) {
+	data := map[string]interface{}{
+		"customer": map[string]interface{}{"id": 42.0, "tags": []interface{}{"vip"}},
+		"score":    0.5,
+	}
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		{"score", 0.5},
+		{"customer.id", 42.0},
+		{"customer.tags", `["vip"]`},
+		{"customer", `{"id":42,"tags":["vip"]}`},
+		{"customer.missing", nil},
+		{"score.deeper", nil},
+	}
+	for _, tt := range tests {
+		if got := dataValue(data, tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("dataValue(%q) = %#v, want %#v", tt.path, got, tt.want)
+		}
+	}
+
+	row := map[string]interface{}{"sku": "A1"}
+	if got := rowValue(row, data, "sku"); got != "A1" {
+		t.Errorf("row value = %v", got)
+	}
+	if got := rowValue(row, data, "score"); got != 0.5 {
+		t.Errorf("fallback to data = %v", got)
+	}
+}
+
+// resetSQLCaches empties the statement and target caches for one test
+func resetSQLCaches(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		sqlStatementsMu.Lock()
+		sqlStatements = map[string]cachedStatement{}
+		sqlStatementsMu.Unlock()
+		sqlTargetsMu.Lock()
+		sqlTargets = map[string]cachedStatement{}
+		sqlTargetsMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func sqlMessage(typ, config string, data map[string]interface{}) *ActionMessage {
+	return &ActionMessage{
+		Payload: &WebhookPayload{Data: data},
+		Config:  &ActionConfig{Name: "writeback", Type: typ, Config: json.RawMessage(config)},
+	}
+}
+
+func TestInsertRowAction(t *testing.T) {
+	data := map[string]interface{}{"customer": map[string]interface{}{"id": 42.0}, "score": 0.87}
+	const rowConfig = `{"table": "reporting.churn", "columns": {"score": "score", "customer_id": "customer.id", "note": "missing"}}`
+
+	tests := []struct {
+		name    string
+		config  string
+		setup   func(sqlmock.Sqlmock)
+		want    string
+		wantErr string
+	}{
+		{name: "allow-listed table", config: rowConfig,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("table", "reporting.churn").
+					WillReturnRows(sqlmock.NewRows([]string{"database_secret"}).AddRow(nil))
+				mock.ExpectExec(`INSERT INTO "reporting"."churn" \("customer_id", "note", "score"\) VALUES \(\$1, \$2, \$3\)`).
+					WithArgs(42.0, nil, 0.87).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			want: "inserted into reporting.churn"},
+		{name: "table not allow-listed", config: rowConfig,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("table", "reporting.churn").WillReturnError(sql.ErrNoRows)
+			},
+			wantErr: "table reporting.churn is not allow-listed in rule_sql_statements"},
+		{name: "insert fails", config: rowConfig,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("table", "reporting.churn").
+					WillReturnRows(sqlmock.NewRows([]string{"database_secret"}).AddRow(nil))
+				mock.ExpectExec("INSERT INTO").WillReturnError(errors.New("permission denied"))
+			},
+			wantErr: "insert into reporting.churn failed: permission denied"},
+		{name: "invalid table name", config: `{"table": "x; drop", "columns": {"a": "a"}}`, wantErr: `invalid SQL name "x; drop"`},
+		{name: "no columns", config: `{"table": "t"}`, wantErr: "has no columns"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSQLCaches(t)
+			mock := mockDB(t)
+			if tt.setup != nil {
+				tt.setup(mock)
+			}
+			got, err := insertRowAction{}.Execute(context.Background(), sqlMessage("insert_row", tt.config, data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("detail = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFunctionAction(t *testing.T) {
+	data := map[string]interface{}{"customer": 42.0}
+	tests := []struct {
+		name    string
+		config  string
+		setup   func(sqlmock.Sqlmock)
+		want    string
+		wantErr string
+	}{
+		{name: "allow-listed function", config: `{"function": "crm.record_churn_risk"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("function", "crm.record_churn_risk").
+					WillReturnRows(sqlmock.NewRows([]string{"database_secret"}).AddRow(nil))
+				mock.ExpectExec(`SELECT "crm"."record_churn_risk"\(\$1::jsonb\)`).
+					WithArgs(`{"customer":42}`).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			want: "called crm.record_churn_risk"},
+		{name: "function not allow-listed", config: `{"function": "pg_terminate_backend"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("function", "pg_terminate_backend").WillReturnError(sql.ErrNoRows)
+			},
+			wantErr: "function pg_terminate_backend is not allow-listed"},
+		{name: "invalid name", config: `{"function": "f()"}`, wantErr: `invalid SQL name "f()"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSQLCaches(t)
+			mock := mockDB(t)
+			if tt.setup != nil {
+				tt.setup(mock)
+			}
+			got, err := functionAction{}.Execute(context.Background(), sqlMessage("function", tt.config, data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("detail = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedSQLTargetCaches(t *testing.T) {
+	resetSQLCaches(t)
+	mock := mockDB(t)
+	mock.ExpectQuery("FROM rule_sql_statements").WithArgs("table", "reporting.churn").
+		WillReturnRows(sqlmock.NewRows([]string{"database_secret"}).AddRow("reporting_db"))
+
+	for i := 0; i < 2; i++ {
+		secret, err := allowedSQLTarget(context.Background(), "table", "reporting.churn")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != "reporting_db" {
+			t.Fatalf("secret = %q", secret)
+		}
+	}
+}
+
+func TestSQLAction(t *testing.T) {
+	statementCols := []string{"statement", "database_secret"}
+	data := map[string]interface{}{
+		"customer": map[string]interface{}{"id": 42.0},
+		"score":    0.87,
+		"items":    []interface{}{map[string]interface{}{"sku": "A1"}, map[string]interface{}{"sku": "B2"}},
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		setup   func(sqlmock.Sqlmock)
+		want    string
+		wantErr string
+	}{
+		{name: "statements in one transaction", config: `{"statements": ["upsert_score", "log_score"]}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.MatchExpectationsInOrder(true)
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("upsert_score").
+					WillReturnRows(sqlmock.NewRows(statementCols).AddRow("UPDATE s SET score = :score WHERE id = :customer.id", nil))
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("log_score").
+					WillReturnRows(sqlmock.NewRows(statementCols).AddRow("INSERT INTO h VALUES (:customer.id, :score)", nil))
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE s SET score = \$1 WHERE id = \$2`).WithArgs(0.87, 42.0).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO h VALUES \(\$1, \$2\)`).WithArgs(42.0, 0.87).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			want: "2 statement(s) x 1 row(s), 2 rows affected"},
+		{name: "for each", config: `{"statements": ["line"], "for_each": "items"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.MatchExpectationsInOrder(true)
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("line").
+					WillReturnRows(sqlmock.NewRows(statementCols).AddRow("INSERT INTO l VALUES (:customer.id, :sku)", nil))
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO l").WithArgs(42.0, "A1").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO l").WithArgs(42.0, "B2").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			want: "1 statement(s) x 2 row(s), 2 rows affected"},
+		{name: "failure rolls back", config: `{"statements": ["upsert_score"]}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.MatchExpectationsInOrder(true)
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("upsert_score").
+					WillReturnRows(sqlmock.NewRows(statementCols).AddRow("UPDATE s SET score = :score", nil))
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE s").WillReturnError(errors.New("deadlock detected"))
+				mock.ExpectRollback()
+			},
+			wantErr: "statement upsert_score failed: deadlock detected"},
+		{name: "not allow-listed", config: `{"statements": ["drop_everything"]}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("drop_everything").WillReturnError(sql.ErrNoRows)
+			},
+			wantErr: "statement drop_everything is not allow-listed"},
+		{name: "statements on different databases", config: `{"statements": ["a", "b"]}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("a").
+					WillReturnRows(sqlmock.NewRows(statementCols).AddRow("SELECT 1", nil))
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("b").
+					WillReturnRows(sqlmock.NewRows(statementCols).AddRow("SELECT 1", "other_db"))
+			},
+			wantErr: "statements must share one database"},
+		{name: "empty for_each", config: `{"statements": ["line"], "for_each": "none"}`,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM rule_sql_statements").WithArgs("line").
+					WillReturnRows(sqlmock.NewRows(statementCols).AddRow("SELECT :sku", nil))
+			},
+			want: "no none to write"},
+		{name: "no statements", config: `{}`, wantErr: "has no statements"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSQLCaches(t)
+			mock := mockDB(t)
+			if tt.setup != nil {
+				tt.setup(mock)
+			}
+			got, err := sqlAction{}.Execute(context.Background(), sqlMessage("sql", tt.config, data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("detail = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
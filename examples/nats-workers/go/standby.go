@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// standbyDB is a hot standby of the primary, set by STANDBY_DATABASE_URL.
+// While the primary is unavailable, configuration lookups and reads of
+// the operational tables it holds go to the standby instead, and
+// statistics and audit writes are buffered (see opsWrite), so deliveries
+// continue through a primary failover. Writes that must not be lost
+// (dedup, exactly-once, SQL actions) still wait for the primary.
+var standbyDB *sql.DB
+
+// standbyServing is set while reads are failed over to the standby, so the
+// switch is logged once each way
+var standbyServing atomic.Bool
+
+// openStandbyDB connects to the standby, if one is configured. An
+// unreachable standby is only logged: the primary does not need it.
+func openStandbyDB() error {
+	if config.Postgres.StandbyURL == "" {
+		return nil
+	}
+	pool, err := openPostgres(config.Postgres.StandbyURL)
+	if err != nil {
+		return fmt.Errorf("invalid STANDBY_DATABASE_URL: %w", err)
+	}
+	standbyDB = pool
+	if err := pool.Ping(); err != nil {
+		standbyHealth.markUnhealthy(err)
+		return nil
+	}
+	log.Println("✅ Connected to PostgreSQL standby")
+	return nil
+}
+
+// withPrimaryRead runs a read against the primary, or against the standby
+// while the primary is unavailable. A read that fails on the primary with
+// a retryable error is tried on the standby before giving up.
+func withPrimaryRead(ctx context.Context, read func(pool *sql.DB) error) error {
+	if standbyDB == nil {
+		return withDBRetry(ctx, primaryHealth, func() error { return read(db) })
+	}
+	if primaryHealth.ok() {
+		err := withDBRetry(ctx, primaryHealth, func() error { return read(db) })
+		if !isRetryableDBError(err) || ctx.Err() != nil {
+			if standbyServing.Swap(false) {
+				log.Printf("✅ Reading from the primary again")
+			}
+			return err
+		}
+	}
+	if !standbyServing.Swap(true) {
+		log.Printf("🔀 Primary unavailable, reading from the standby and buffering statistics until it recovers")
+	}
+	return withDBRetry(ctx, standbyHealth, func() error { return read(standbyDB) })
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/internal/natstest"
+)
+
+// mockStandby points standbyDB at its own sqlmock for one test, with the
+// primary and the standby healthy and reads on the primary
+func mockStandby(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	pool, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevDB, prevPrimary, prevStandby, prevServing := standbyDB, primaryHealth, standbyHealth, standbyServing.Load()
+	prevAttempts := config.Postgres.RetryAttempts
+	standbyDB = pool
+	primaryHealth = &dbHealth{name: "PostgreSQL", healthy: true}
+	standbyHealth = &dbHealth{name: "Standby PostgreSQL", healthy: true}
+	standbyServing.Store(false)
+	config.Postgres.RetryAttempts = 1
+	t.Cleanup(func() {
+		standbyDB, primaryHealth, standbyHealth = prevDB, prevPrimary, prevStandby
+		standbyServing.Store(prevServing)
+		config.Postgres.RetryAttempts = prevAttempts
+		pool.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return mock
+}
+
+// errShutdown is a retryable error: the server is shutting down for a failover
+var errShutdown = &pq.Error{Code: "57P01", Message: "terminating connection due to administrator command"}
+
+func TestWithPrimaryRead(t *testing.T) {
+	const query = "SELECT url FROM rule_webhook_destinations"
+	rows := func(url string) *sqlmock.Rows { return sqlmock.NewRows([]string{"url"}).AddRow(url) }
+	tests := []struct {
+		name          string
+		noStandby     bool
+		primaryDown   bool
+		wasServing    bool
+		primary       func(m sqlmock.Sqlmock)
+		standby       func(m sqlmock.Sqlmock)
+		want          string
+		wantErr       error
+		wantServing   bool
+		wantPrimaryOK bool
+	}{
+		{name: "primary answers",
+			primary:       func(m sqlmock.Sqlmock) { m.ExpectQuery(query).WillReturnRows(rows("https://primary")) },
+			want:          "https://primary",
+			wantPrimaryOK: true},
+		{name: "no standby", noStandby: true,
+			primary:       func(m sqlmock.Sqlmock) { m.ExpectQuery(query).WillReturnRows(rows("https://primary")) },
+			want:          "https://primary",
+			wantPrimaryOK: true},
+		{name: "primary fails over to the standby",
+			primary:     func(m sqlmock.Sqlmock) { m.ExpectQuery(query).WillReturnError(errShutdown) },
+			standby:     func(m sqlmock.Sqlmock) { m.ExpectQuery(query).WillReturnRows(rows("https://standby")) },
+			want:        "https://standby",
+			wantServing: true},
+		{name: "unavailable primary is not asked", primaryDown: true,
+			standby:     func(m sqlmock.Sqlmock) { m.ExpectQuery(query).WillReturnRows(rows("https://standby")) },
+			want:        "https://standby",
+			wantServing: true},
+		// A query error would fail on the standby too
+		{name: "query errors are returned",
+			primary:       func(m sqlmock.Sqlmock) { m.ExpectQuery(query).WillReturnError(sql.ErrNoRows) },
+			wantErr:       sql.ErrNoRows,
+			wantPrimaryOK: true},
+		{name: "recovered primary serves again", wasServing: true,
+			primary:       func(m sqlmock.Sqlmock) { m.ExpectQuery(query).WillReturnRows(rows("https://primary")) },
+			want:          "https://primary",
+			wantPrimaryOK: true},
+		{name: "both down", primaryDown: true,
+			standby:     func(m sqlmock.Sqlmock) { m.ExpectQuery(query).WillReturnError(errShutdown) },
+			wantErr:     errShutdown,
+			wantServing: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := mockDB(t)
+			standby := mockStandby(t)
+			if tt.noStandby {
+				standbyDB = nil
+			}
+			if tt.primaryDown {
+				primaryHealth.markUnhealthy(errShutdown)
+			}
+			standbyServing.Store(tt.wasServing)
+			if tt.primary != nil {
+				tt.primary(primary)
+			}
+			if tt.standby != nil {
+				tt.standby(standby)
+			}
+
+			var url string
+			err := withPrimaryRead(context.Background(), func(pool *sql.DB) error {
+				return pool.QueryRow(query).Scan(&url)
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if url != tt.want {
+				t.Fatalf("url = %q, want %q", url, tt.want)
+			}
+			if standbyServing.Load() != tt.wantServing || primaryHealth.ok() != tt.wantPrimaryOK {
+				t.Fatalf("standby serving = %v, primary healthy = %v", standbyServing.Load(), primaryHealth.ok())
+			}
+		})
+	}
+}
+
+func TestOpsQueryRowReadsStandby(t *testing.T) {
+	primary := mockDB(t)
+	standby := mockStandby(t)
+	mockOpsDB(t)
+	opsDB = db
+
+	primary.ExpectQuery("FROM rule_nats_pauses").WillReturnError(errShutdown)
+	standby.ExpectQuery("FROM rule_nats_pauses").WithArgs("orders").WillReturnRows(sqlmock.NewRows([]string{"paused"}).AddRow(true))
+	var paused bool
+	if err := opsQueryRow([]interface{}{&paused}, "SELECT paused FROM rule_nats_pauses WHERE consumer = $1", "orders"); err != nil {
+		t.Fatal(err)
+	}
+	if !paused {
+		t.Fatal("standby row not read")
+	}
+}
+
+func TestReadinessWithStandby(t *testing.T) {
+	tests := []struct {
+		name           string
+		noStandby      bool
+		primaryHealthy bool
+		standbyHealthy bool
+		want           bool
+	}{
+		{name: "primary healthy", primaryHealthy: true, want: true},
+		{name: "standby stands in", standbyHealthy: true, want: true},
+		{name: "both down"},
+		{name: "no standby", noStandby: true},
+	}
+	nc, err := nats.Connect(natstest.NewServer(t).URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStandby(t)
+			useNATSConn(t, nc)
+			if tt.noStandby {
+				standbyDB = nil
+			}
+			primaryHealth.healthy = tt.primaryHealthy
+			standbyHealth.healthy = tt.standbyHealthy
+			if ready, connected := readiness(); ready != tt.want || !connected {
+				t.Fatalf("ready = %v, nats connected = %v, want %v", ready, connected, tt.want)
+			}
+
+			rec := httptest.NewRecorder()
+			serveReadiness(rec, httptest.NewRequest("GET", "/readyz", nil))
+			var body map[string]interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if _, reported := body["standby_postgres"]; reported == tt.noStandby {
+				t.Fatalf("body = %v", body)
+			}
+		})
+	}
+}
+
+func TestServeMetricsStandby(t *testing.T) {
+	mockStandby(t)
+	standbyHealth.healthy = false
+	standbyServing.Store(true)
+
+	samples, types := scrapeMetrics(t)
+	if types["rule_worker_postgres_standby_serving"] != "gauge" {
+		t.Fatalf("types = %v", types)
+	}
+	for labels, v := range samples["rule_worker_postgres_up"] {
+		if want := boolMetric(!strings.HasSuffix(labels, `database="standby"`)); v != float64(want) {
+			t.Errorf("rule_worker_postgres_up{%s} = %v, want %d", labels, v, want)
+		}
+	}
+	if len(samples["rule_worker_postgres_up"]) != 3 {
+		t.Fatalf("postgres_up = %v", samples["rule_worker_postgres_up"])
+	}
+	if len(samples["rule_worker_postgres_standby_serving"]) != 1 {
+		t.Fatalf("standby_serving = %v", samples["rule_worker_postgres_standby_serving"])
+	}
+	for _, v := range samples["rule_worker_postgres_standby_serving"] {
+		if v != 1 {
+			t.Fatalf("standby_serving = %v", v)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PayloadSerializer decides what the worker stores of a message payload in
+// its audit tables, e.g. only a few keys of a high-volume stream's
+// messages. STORED_PAYLOAD_SERIALIZER picks one by its registered name.
+type PayloadSerializer interface {
+	// Serialize returns the document to store in table for payload, which
+	// the scrub rules have already been applied to; nil stores no payload.
+	// A result that is not JSON is stored base64 encoded (see
+	// wrappedPayload), and encrypted afterwards when PAYLOAD_ENCRYPTION is
+	// set. Errors leave the row unrecorded.
+	Serialize(ctx context.Context, table string, payload []byte) ([]byte, error)
+}
+
+// PayloadSerializerFunc adapts a function to PayloadSerializer
+type PayloadSerializerFunc func(ctx context.Context, table string, payload []byte) ([]byte, error)
+
+func (f PayloadSerializerFunc) Serialize(ctx context.Context, table string, payload []byte) ([]byte, error) {
+	return f(ctx, table, payload)
+}
+
+var payloadSerializers = map[string]PayloadSerializer{}
+
+// registerPayloadSerializer makes a serializer available to
+// STORED_PAYLOAD_SERIALIZER. It is called from init functions, so a
+// custom one is a file added to this package, and panics on duplicate
+// names.
+func registerPayloadSerializer(name string, s PayloadSerializer) {
+	if _, exists := payloadSerializers[name]; exists {
+		panic("payload serializer registered twice: " + name)
+	}
+	payloadSerializers[name] = s
+}
+
+// registeredPayloadSerializers lists the known serializers in name order
+func registeredPayloadSerializers() []string {
+	names := make([]string, 0, len(payloadSerializers))
+	for name := range payloadSerializers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	registerPayloadSerializer("full", PayloadSerializerFunc(func(_ context.Context, _ string, payload []byte) ([]byte, error) {
+		return payload, nil
+	}))
+	registerPayloadSerializer("none", PayloadSerializerFunc(func(context.Context, string, []byte) ([]byte, error) {
+		return nil, nil
+	}))
+	registerPayloadSerializer("compact", PayloadSerializerFunc(compactPayload))
+}
+
+// wrappedPayload is how a payload that is not JSON is stored, such as a
+// binary message the scrub rules could not parse: {"encoding":"base64",
+// "data":"..."}
+type wrappedPayload struct {
+	Encoding string `json:"encoding"`
+	Data     []byte `json:"data"`
+}
+
+// isWrappedPayload reports whether a stored document is a wrappedPayload
+func isWrappedPayload(doc []byte) bool {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(doc, &fields) != nil || len(fields) != 2 || fields["data"] == nil {
+		return false
+	}
+	return string(fields["encoding"]) == `"base64"`
+}
+
+// storedPayload returns raw as the worker stores it in table: scrubbed,
+// passed through the configured serializer, wrapped unless it is JSON, and
+// encrypted. nil means no payload is stored.
+func storedPayload(ctx context.Context, table string, raw []byte) ([]byte, error) {
+	scrubbed, err := scrubPayload(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	serializer, ok := payloadSerializers[config.StoredPayload.Serializer]
+	if !ok {
+		return nil, fmt.Errorf("unknown payload serializer %q", config.StoredPayload.Serializer)
+	}
+	stored, err := serializer.Serialize(ctx, table, scrubbed)
+	if err != nil {
+		return nil, fmt.Errorf("payload serializer %s: %w", config.StoredPayload.Serializer, err)
+	}
+	if stored == nil {
+		return nil, nil
+	}
+	if !json.Valid(stored) {
+		if stored, err = json.Marshal(wrappedPayload{Encoding: "base64", Data: stored}); err != nil {
+			return nil, err
+		}
+	}
+	return payloadSealer.Seal(ctx, stored)
+}
+
+// compactPayload keeps the STORED_PAYLOAD_KEEP paths of a payload, all of
+// it when none are set, and the first STORED_PAYLOAD_MAX_ARRAY_ITEMS
+// elements of each array. Payloads that are not JSON objects are kept as
+// they are.
+func compactPayload(_ context.Context, _ string, payload []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return payload, nil
+	}
+	if paths := parseKeepPaths(config.StoredPayload.Keep); len(paths) > 0 {
+		kept := map[string]interface{}{}
+		for _, path := range paths {
+			keepPath(doc, kept, path)
+		}
+		doc = kept
+	}
+	if max := config.StoredPayload.MaxArrayItems; max > 0 {
+		capArrays(doc, max)
+	}
+	return json.Marshal(doc)
+}
+
+// parseKeepPaths splits STORED_PAYLOAD_KEEP into dotted paths
+func parseKeepPaths(s string) [][]string {
+	var paths [][]string
+	for _, path := range strings.Split(s, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, strings.Split(path, "."))
+		}
+	}
+	return paths
+}
+
+// keepPath copies the value at path in src, if any, to the same path in dst
+func keepPath(src, dst map[string]interface{}, path []string) {
+	value, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = value
+		return
+	}
+	child, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+	next, ok := dst[path[0]].(map[string]interface{})
+	if !ok {
+		next = map[string]interface{}{}
+	}
+	keepPath(child, next, path[1:])
+	if len(next) > 0 {
+		dst[path[0]] = next
+	}
+}
+
+// capArrays truncates every array in value to max elements
+func capArrays(value interface{}, max int) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = capArrays(child, max)
+		}
+	case []interface{}:
+		if len(v) > max {
+			v = v[:max]
+		}
+		for i, child := range v {
+			v[i] = capArrays(child, max)
+		}
+		return v
+	}
+	return value
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine/envelope"
+)
+
+// useStoredPayload sets the STORED_PAYLOAD_* settings for one test
+func useStoredPayload(t *testing.T, serializer, keep string, maxArrayItems int) {
+	t.Helper()
+	prev := config.StoredPayload
+	config.StoredPayload.Serializer = serializer
+	config.StoredPayload.Keep = keep
+	config.StoredPayload.MaxArrayItems = maxArrayItems
+	t.Cleanup(func() { config.StoredPayload = prev })
+}
+
+func TestCompactPayload(t *testing.T) {
+	const payload = `{"id":7,"customer":{"id":"c-1","name":"Ada","address":{"city":"Berlin"}},"items":[1,2,3,[4,5,6]],"note":"gift"}`
+	tests := []struct {
+		name    string
+		keep    string
+		max     int
+		payload string
+		want    string
+	}{
+		{name: "everything", payload: payload,
+			want: `{"customer":{"address":{"city":"Berlin"},"id":"c-1","name":"Ada"},"id":7,"items":[1,2,3,[4,5,6]],"note":"gift"}`},
+		{name: "keep paths", keep: "id, customer.id,customer.address.city,missing,note.x", payload: payload,
+			want: `{"customer":{"address":{"city":"Berlin"},"id":"c-1"},"id":7}`},
+		{name: "cap arrays", max: 2, payload: payload,
+			want: `{"customer":{"address":{"city":"Berlin"},"id":"c-1","name":"Ada"},"id":7,"items":[1,2],"note":"gift"}`},
+		{name: "cap nested arrays", keep: "items", max: 4, payload: payload, want: `{"items":[1,2,3,[4,5,6]]}`},
+		{name: "nothing kept", keep: "missing", payload: payload, want: `{}`},
+		{name: "not an object", keep: "id", payload: `[1,2,3]`, want: `[1,2,3]`},
+		{name: "not JSON", keep: "id", payload: `order 7`, want: `order 7`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useStoredPayload(t, "compact", tt.keep, tt.max)
+			got, err := compactPayload(context.Background(), "rule_nats_expired_messages", []byte(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("compactPayload = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoredPayload(t *testing.T) {
+	setScrubRules(t, map[string]string{"$.ssn": "mask"}, "$.ssn")
+	registerPayloadSerializer("test_failing", PayloadSerializerFunc(func(context.Context, string, []byte) ([]byte, error) {
+		return nil, errors.New("schema registry unavailable")
+	}))
+	registerPayloadSerializer("test_invalid", PayloadSerializerFunc(func(context.Context, string, []byte) ([]byte, error) {
+		return []byte("id=7"), nil
+	}))
+	registerPayloadSerializer("test_table", PayloadSerializerFunc(func(_ context.Context, table string, _ []byte) ([]byte, error) {
+		return []byte(`{"table":"` + table + `"}`), nil
+	}))
+	t.Cleanup(func() {
+		delete(payloadSerializers, "test_failing")
+		delete(payloadSerializers, "test_invalid")
+		delete(payloadSerializers, "test_table")
+	})
+
+	const raw = `{"id":7,"ssn":"123-45-6789","items":[1,2,3]}`
+	// An Avro-encoded message, which the scrub rules cannot parse
+	binary := string([]byte{0x00, 0x0e, 0xff, 0xfe, 'A', 'd', 'a'})
+	tests := []struct {
+		serializer string
+		keep       string
+		raw        string // raw when empty
+		want       string // "" for no payload
+		wantErr    string
+	}{
+		{serializer: "full", want: `{"id":7,"items":[1,2,3],"ssn":"[REDACTED]"}`},
+		{serializer: "compact", keep: "id,ssn", want: `{"id":7,"ssn":"[REDACTED]"}`},
+		{serializer: "none"},
+		{serializer: "test_table", want: `{"table":"rule_nats_expired_messages"}`},
+		{serializer: "test_failing", wantErr: "payload serializer test_failing: schema registry unavailable"},
+		{serializer: "test_invalid", want: `{"encoding":"base64","data":"aWQ9Nw=="}`},
+		{serializer: "full", raw: binary, want: `{"encoding":"base64","data":"AA7//kFkYQ=="}`},
+		{serializer: "compact", keep: "id", raw: binary, want: `{"encoding":"base64","data":"AA7//kFkYQ=="}`},
+		{serializer: "avro", wantErr: `unknown payload serializer "avro"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serializer, func(t *testing.T) {
+			useStoredPayload(t, tt.serializer, tt.keep, 0)
+			in := raw
+			if tt.raw != "" {
+				in = tt.raw
+			}
+			got, err := storedPayload(context.Background(), "rule_nats_expired_messages", []byte(in))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("stored %s, want nothing", got)
+				}
+				return
+			}
+			if string(got) != tt.want {
+				t.Fatalf("stored %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoredPayloadEncrypted(t *testing.T) {
+	setScrubRules(t, map[string]string{})
+	useStoredPayload(t, "compact", "id", 0)
+	prev := payloadSealer
+	t.Cleanup(func() { payloadSealer = prev })
+	key, err := envelope.NewLocalKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadSealer = envelope.New(key)
+
+	stored, err := storedPayload(context.Background(), "rule_nats_expired_messages", []byte(`{"id":7,"secret":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !envelope.IsSealed(stored) {
+		t.Fatalf("stored %s in the clear", stored)
+	}
+	// Serialized before it is sealed
+	plain, err := payloadSealer.Open(context.Background(), stored)
+	if err != nil || string(plain) != `{"id":7}` {
+		t.Fatalf("opened %s, %v", plain, err)
+	}
+}
+
+func TestStoredPayloadBinaryEncrypted(t *testing.T) {
+	setScrubRules(t, map[string]string{"$.ssn": "mask"}, "$.ssn")
+	useStoredPayload(t, "full", "", 0)
+	prev := payloadSealer
+	t.Cleanup(func() { payloadSealer = prev })
+	key, err := envelope.NewLocalKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadSealer = envelope.New(key)
+
+	binary := []byte{0x00, 0x0e, 0xff, 0xfe, 'A', 'd', 'a'}
+	stored, err := storedPayload(context.Background(), "rule_nats_expired_messages", binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !envelope.IsSealed(stored) {
+		t.Fatalf("stored %q in the clear", stored)
+	}
+	plain, err := payloadSealer.Open(context.Background(), stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wrapped wrappedPayload
+	if err := json.Unmarshal(plain, &wrapped); err != nil || wrapped.Encoding != "base64" || !bytes.Equal(wrapped.Data, binary) {
+		t.Fatalf("opened %s, %v", plain, err)
+	}
+	if !isWrappedPayload(plain) {
+		t.Fatalf("%s is not recognized as wrapped", plain)
+	}
+}
+
+func TestIsWrappedPayload(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want bool
+	}{
+		{`{"encoding":"base64","data":"AA7//kFkYQ=="}`, true},
+		{`{"data":"AA==","encoding":"base64"}`, true},
+		{`{"encoding":"base64","data":"AA==","id":7}`, false},
+		{`{"encoding":"utf-8","data":"x"}`, false},
+		{`{"id":7}`, false},
+		{`[1,2]`, false},
+	}
+	for _, tt := range tests {
+		if got := isWrappedPayload([]byte(tt.doc)); got != tt.want {
+			t.Errorf("isWrappedPayload(%s) = %v, want %v", tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterPayloadSerializer(t *testing.T) {
+	if got := registeredPayloadSerializers(); len(got) != 3 || got[0] != "compact" || got[1] != "full" || got[2] != "none" {
+		t.Fatalf("registered = %v", got)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a name twice did not panic")
+		}
+	}()
+	registerPayloadSerializer("full", PayloadSerializerFunc(compactPayload))
+}
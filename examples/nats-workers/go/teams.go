@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// teamsAction posts an Adaptive Card to a Microsoft Teams incoming webhook
+// (or a Workflows "post to channel" webhook):
+//
+//	{"webhook_secret": "teams_ops", "title": "Order {{.order_id}} flagged", "text": "Score {{.score}}"}
+//
+// title and text are templates over data and become a simple card; card, a
+// template producing Adaptive Card JSON, replaces it entirely. Teams
+// webhooks cannot reply to earlier messages, so there is no thread support.
+type teamsAction struct{}
+
+type teamsConfig struct {
+	WebhookURL    string  `json:"webhook_url"`
+	WebhookSecret string  `json:"webhook_secret"`
+	Title         string  `json:"title"`
+	Text          string  `json:"text"`
+	Card          string  `json:"card"`
+	RatePerSecond float64 `json:"rate_per_second"`
+}
+
+type teamsAttachment struct {
+	ContentType string          `json:"contentType"`
+	Content     json.RawMessage `json:"content"`
+}
+
+type teamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+func init() {
+	registerAction("teams", teamsAction{})
+}
+
+func (teamsAction) Execute(ctx context.Context, m *ActionMessage) (string, error) {
+	cfg := teamsConfig{RatePerSecond: 2}
+	if err := m.Config.decode(&cfg); err != nil {
+		return "", err
+	}
+	data := m.Payload.Data
+
+	var card json.RawMessage
+	var err error
+	if cfg.Card != "" {
+		if card, err = renderJSONTemplate(cfg.Card, data); err != nil {
+			return "", fmt.Errorf("card: %w", err)
+		}
+	} else {
+		if card, err = simpleTeamsCard(cfg.Title, cfg.Text, data); err != nil {
+			return "", err
+		}
+	}
+
+	webhookURL, err := secretOr(ctx, cfg.WebhookURL, cfg.WebhookSecret)
+	if err != nil {
+		return "", err
+	}
+	if webhookURL == "" {
+		return "", fmt.Errorf("action %s needs webhook_url or webhook_secret", m.Config.Name)
+	}
+
+	if err := chatLimiter.wait(ctx, "teams:"+m.Config.Name, cfg.RatePerSecond); err != nil {
+		return "", err
+	}
+
+	message := teamsMessage{
+		Type: "message",
+		Attachments: []teamsAttachment{{
+			ContentType: "application/vnd.microsoft.card.adaptive",
+			Content:     card,
+		}},
+	}
+	if _, err := postJSON(ctx, webhookURL, message, nil); err != nil {
+		return "", err
+	}
+	return "posted to Teams", nil
+}
+
+// simpleTeamsCard builds an Adaptive Card with a bold title and wrapped text
+func simpleTeamsCard(titleTemplate, textTemplate string, data map[string]interface{}) (json.RawMessage, error) {
+	title, err := renderText(titleTemplate, data)
+	if err != nil {
+		return nil, fmt.Errorf("title: %w", err)
+	}
+	text, err := renderText(textTemplate, data)
+	if err != nil {
+		return nil, fmt.Errorf("text: %w", err)
+	}
+	if title == "" && text == "" {
+		return nil, fmt.Errorf("teams action needs title, text, or card")
+	}
+
+	var body []map[string]interface{}
+	if title != "" {
+		body = append(body, map[string]interface{}{"type": "TextBlock", "text": title, "weight": "Bolder", "size": "Medium", "wrap": true})
+	}
+	if text != "" {
+		body = append(body, map[string]interface{}{"type": "TextBlock", "text": text, "wrap": true})
+	}
+	return json.Marshal(map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// traceIDHeader carries a message's trace ID, on NATS messages and on the
+// requests and messages the worker sends for it
+const traceIDHeader = "X-Request-Id"
+
+// messageTraceID returns the ID that follows msg through worker logs,
+// destination requests, and Postgres rows: its X-Request-Id header, the
+// trace ID of its W3C traceparent header, or one derived from its stream
+// sequence, so that redeliveries keep it.
+func messageTraceID(msg *nats.Msg) string {
+	if id := msg.Header.Get(traceIDHeader); id != "" {
+		return id
+	}
+	// traceparent is version-traceid-parentid-flags
+	if parts := strings.Split(msg.Header.Get("traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 {
+		return parts[1]
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		sum := sha256.Sum256([]byte(meta.Stream + ":" + strconv.FormatUint(meta.Sequence.Stream, 10)))
+		return hex.EncodeToString(sum[:16])
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestMessageTraceID(t *testing.T) {
+	jsMsg := func(stream string, seq string) *nats.Msg {
+		return &nats.Msg{Sub: &nats.Subscription{}, Reply: "$JS.ACK." + stream + ".webhooks.1." + seq + ".7.1700000000000000000.0", Header: nats.Header{}}
+	}
+	tests := []struct {
+		name string
+		msg  *nats.Msg
+		want string // empty: any 32 hex digits
+	}{
+		{name: "X-Request-Id", msg: &nats.Msg{Header: nats.Header{traceIDHeader: {"req-1"}, "traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}}},
+			want: "req-1"},
+		{name: "traceparent", msg: &nats.Msg{Header: nats.Header{"traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}}},
+			want: "0af7651916cd43dd8448eb211c80319c"},
+		{name: "malformed traceparent", msg: &nats.Msg{Header: nats.Header{"traceparent": {"00-short-b7ad-01"}}}},
+		{name: "stream sequence", msg: jsMsg("RULES", "42")},
+	}
+	for _, tt := range tests {
+		got := messageTraceID(tt.msg)
+		if tt.want != "" && got != tt.want {
+			t.Errorf("%s: trace ID = %q, want %q", tt.name, got, tt.want)
+		}
+		if tt.want == "" && len(got) != 32 {
+			t.Errorf("%s: trace ID = %q, want 32 hex digits", tt.name, got)
+		}
+	}
+
+	// Redeliveries keep their trace ID; other messages get their own
+	if a, b := messageTraceID(jsMsg("RULES", "42")), messageTraceID(jsMsg("RULES", "42")); a != b {
+		t.Errorf("redelivery trace IDs %s, %s differ", a, b)
+	}
+	if a, b := messageTraceID(jsMsg("RULES", "42")), messageTraceID(jsMsg("RULES", "43")); a == b {
+		t.Errorf("trace ID %s shared by two stream messages", a)
+	}
+	plain := &nats.Msg{Header: nats.Header{}}
+	if messageTraceID(plain) == messageTraceID(plain) {
+		t.Error("core NATS messages share a random trace ID")
+	}
+}
+
+func TestTraceIDSent(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(traceIDHeader)
+	}))
+	defer srv.Close()
+	m := &ActionMessage{Msg: &nats.Msg{Header: nats.Header{}}, traceID: "t1",
+		Payload: &WebhookPayload{WebhookURL: srv.URL, Data: map[string]interface{}{"id": 1}}}
+	if _, err := (webhookAction{}).Execute(context.Background(), m); err != nil || got != "t1" {
+		t.Fatalf("webhook %s = %q, %v", traceIDHeader, got, err)
+	}
+
+	js := &fakeJetStream{}
+	useJetStream(t, js)
+	m = &ActionMessage{Msg: &nats.Msg{Header: nats.Header{}}, traceID: "t2",
+		Payload: &WebhookPayload{Data: map[string]interface{}{"id": 1}},
+		Config:  &ActionConfig{Name: "alerts", Type: "nats_publish", Config: json.RawMessage(`{"subject":"alerts","jetstream":true}`)}}
+	if _, err := (natsPublishAction{}).Execute(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if len(js.published) != 1 || js.published[0].Header.Get(traceIDHeader) != "t2" {
+		t.Fatalf("published %v", js.published)
+	}
+}
+
+func TestRecordFailureTrace(t *testing.T) {
+	recentMu.Lock()
+	prev := recentFailures
+	recentFailures = nil
+	recentMu.Unlock()
+	defer func() {
+		recentMu.Lock()
+		recentFailures = prev
+		recentMu.Unlock()
+	}()
+
+	m := &ActionMessage{Msg: &nats.Msg{Subject: "rules.orders", Header: nats.Header{}}, traceID: "t1",
+		Payload: &WebhookPayload{WebhookURL: "https://crm.example.com/hook"}}
+	recordFailure(m, context.DeadlineExceeded)
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	if len(recentFailures) != 1 || recentFailures[0].TraceID != "t1" {
+		t.Fatalf("failures = %+v", recentFailures)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// twilioAPIURL is the Messages API base; tests point it elsewhere
+var twilioAPIURL = "https://api.twilio.com/2010-04-01"
+
+// twilioProvider sends SMS through the Twilio Messages API. Credentials:
+//
+//	{"account_sid": "AC...", "auth_token": "..."}
+//
+// Action options: from (a Twilio number) or messaging_service_sid, and an
+// optional status_callback URL for Twilio's delivery status updates.
+type twilioProvider struct{}
+
+type twilioCredentials struct {
+	AccountSID string `json:"account_sid"`
+	AuthToken  string `json:"auth_token"`
+}
+
+type twilioOptions struct {
+	From                string `json:"from"`
+	MessagingServiceSID string `json:"messaging_service_sid"`
+	StatusCallback      string `json:"status_callback"`
+}
+
+type twilioResponse struct {
+	SID     string `json:"sid"`
+	Status  string `json:"status"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func init() {
+	registerNotifyProvider("twilio", twilioProvider{})
+}
+
+func (twilioProvider) Send(ctx context.Context, credentials []byte, n *notification) (string, error) {
+	var creds twilioCredentials
+	if err := json.Unmarshal(credentials, &creds); err != nil || creds.AccountSID == "" || creds.AuthToken == "" {
+		return "", fmt.Errorf("twilio credentials need account_sid and auth_token")
+	}
+	var opts twilioOptions
+	if err := json.Unmarshal(n.Options, &opts); err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("To", n.Recipient)
+	form.Set("Body", n.Body)
+	switch {
+	case opts.MessagingServiceSID != "":
+		form.Set("MessagingServiceSid", opts.MessagingServiceSID)
+	case opts.From != "":
+		form.Set("From", opts.From)
+	default:
+		return "", fmt.Errorf("twilio needs from or messaging_service_sid")
+	}
+	if opts.StatusCallback != "" {
+		form.Set("StatusCallback", opts.StatusCallback)
+	}
+
+	endpoint := fmt.Sprintf("%s/Accounts/%s/Messages.json", twilioAPIURL, url.PathEscape(creds.AccountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(creds.AccountSID, creds.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result twilioResponse
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return result.SID, nil
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound:
+		// Invalid numbers, unsubscribed recipients, and similar
+		return "", worker.Permanent(fmt.Errorf("twilio %d: %s", result.Code, result.Message))
+	default:
+		return "", fmt.Errorf("twilio HTTP %d: %s", resp.StatusCode, result.Message)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// The operations UI (ENABLE_UI) is a single page on the admin server that
+// polls a small JSON API: live counters, consumer lag, recent failures,
+// destination health, and expired messages with a replay button. The page
+// itself is public; its API needs ADMIN_TOKEN, which the UI refuses to start
+// without.
+
+//go:embed ui
+var uiFiles embed.FS
+
+// recentFailureLimit is how many failures the UI can show
+const recentFailureLimit = 100
+
+// failedDelivery is a delivery that failed recently
+type failedDelivery struct {
+	At             time.Time `json:"at"`
+	Subject        string    `json:"subject"`
+	StreamSequence uint64    `json:"stream_sequence,omitempty"`
+	Destination    string    `json:"destination"`
+	Action         string    `json:"action"`
+	Error          string    `json:"error"`
+	TraceID        string    `json:"trace_id"`
+}
+
+// destinationHealth summarizes recent deliveries to one destination
+type destinationHealth struct {
+	Destination         string    `json:"destination"`
+	Status              string    `json:"status"`
+	Delivered           uint64    `json:"delivered"`
+	Failed              uint64    `json:"failed"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastFailure         time.Time `json:"last_failure"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+var (
+	recentMu          sync.Mutex
+	recentFailures    []failedDelivery
+	destinationStates = map[string]*destinationHealth{}
+)
+
+// recordFailure remembers a failed delivery for the UI
+func recordFailure(m *ActionMessage, err error) {
+	failure := failedDelivery{
+		At:          time.Now(),
+		Subject:     m.Msg.Subject,
+		Destination: statsDestination(m),
+		Action:      m.metricsName(),
+		Error:       err.Error(),
+		TraceID:     m.traceID,
+	}
+	if meta, metaErr := m.Msg.Metadata(); metaErr == nil {
+		failure.StreamSequence = meta.Sequence.Stream
+	}
+
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	if len(recentFailures) >= recentFailureLimit {
+		recentFailures = recentFailures[1:]
+	}
+	recentFailures = append(recentFailures, failure)
+	if health := destinationStates[failure.Destination]; health != nil {
+		health.LastError = failure.Error
+	}
+}
+
+// trackDestination updates destination health from a delivery outcome
+func trackDestination(destination, outcome string) {
+	if outcome != outcomeDelivered && outcome != outcomeFailed {
+		return
+	}
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	health, ok := destinationStates[destination]
+	if !ok {
+		health = &destinationHealth{Destination: destination}
+		destinationStates[destination] = health
+	}
+	if outcome == outcomeDelivered {
+		health.Delivered++
+		health.ConsecutiveFailures = 0
+		health.LastSuccess = time.Now()
+		return
+	}
+	health.Failed++
+	health.ConsecutiveFailures++
+	health.LastFailure = time.Now()
+}
+
+// status is healthy until a failure, degraded after one, and failing
+// after five in a row
+func (h destinationHealth) status() string {
+	switch {
+	case h.ConsecutiveFailures >= 5:
+		return "failing"
+	case h.ConsecutiveFailures > 0:
+		return "degraded"
+	default:
+		return "healthy"
+	}
+}
+
+// registerUI adds the page to root and its API to the token-protected mux
+func registerUI(root, mux *http.ServeMux) {
+	page, _ := fs.Sub(uiFiles, "ui")
+	root.Handle("/ui/", http.StripPrefix("/ui/", http.FileServer(http.FS(page))))
+	// "/ui/" would otherwise shadow the API on the protected mux
+	root.Handle("/ui/api/", requireAdminToken(mux))
+	mux.HandleFunc("/ui/api/overview", serveUIOverview)
+	mux.HandleFunc("/ui/api/failures", serveUIFailures)
+	mux.HandleFunc("/ui/api/destinations", serveUIDestinations)
+	mux.HandleFunc("/ui/api/expired", serveUIExpired)
+	mux.HandleFunc("/ui/api/expired/replay", serveUIReplay)
+}
+
+func writeUIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeUIError(w http.ResponseWriter, status int, err error) {
+	writeUIJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// serveUIOverview returns the expvar values the dashboard shows, so the
+// UI, /debug/vars, and /metrics report the same numbers
+func serveUIOverview(w http.ResponseWriter, r *http.Request) {
+	overview := map[string]interface{}{
+		"stream":   config.Worker.StreamName,
+		"consumer": config.Worker.ConsumerName,
+	}
+	for _, name := range []string{"worker", "consumer_lag", "postgres_health", "leader", "actions"} {
+		if v := expvar.Get(name); v != nil {
+			overview[name] = json.RawMessage(v.String())
+		}
+	}
+	overview["nats_connected"] = natsConn != nil && natsConn.IsConnected()
+	writeUIJSON(w, http.StatusOK, overview)
+}
+
+func serveUIFailures(w http.ResponseWriter, r *http.Request) {
+	recentMu.Lock()
+	failures := make([]failedDelivery, len(recentFailures))
+	for i, f := range recentFailures {
+		failures[len(recentFailures)-1-i] = f
+	}
+	recentMu.Unlock()
+	writeUIJSON(w, http.StatusOK, failures)
+}
+
+func serveUIDestinations(w http.ResponseWriter, r *http.Request) {
+	recentMu.Lock()
+	list := make([]destinationHealth, 0, len(destinationStates))
+	for _, h := range destinationStates {
+		snapshot := *h
+		snapshot.Status = snapshot.status()
+		list = append(list, snapshot)
+	}
+	recentMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ConsecutiveFailures != list[j].ConsecutiveFailures {
+			return list[i].ConsecutiveFailures > list[j].ConsecutiveFailures
+		}
+		return list[i].Destination < list[j].Destination
+	})
+	writeUIJSON(w, http.StatusOK, list)
+}
+
+// serveUIExpired lists this consumer's expired messages, decrypted
+func serveUIExpired(w http.ResponseWriter, r *http.Request) {
+	if err := ensureOpsReady(); err != nil {
+		writeUIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	client := ruleengine.New(db)
+	client.SetOpsDB(opsDB)
+	client.SetPayloadSealer(payloadSealer)
+
+	ctx, cancel := context.WithTimeout(r.Context(), opsWriteTimeout)
+	defer cancel()
+	messages, err := client.ListExpiredMessages(ctx, ruleengine.ExpiredFilter{
+		Stream:   config.Worker.StreamName,
+		Consumer: config.Worker.ConsumerName,
+		Limit:    limit,
+	})
+	if err != nil {
+		writeUIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeUIJSON(w, http.StatusOK, messages)
+}
+
+// serveUIReplay republishes an expired message (POST ?id=N)
+func serveUIReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeUIError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeUIError(w, http.StatusBadRequest, errors.New("id must be an expired message id"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	sequence, err := replayExpired(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeUIError(w, http.StatusNotFound, fmt.Errorf("expired message %d not found", id))
+		return
+	}
+	if err != nil {
+		writeUIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeUIJSON(w, http.StatusOK, map[string]interface{}{"replayed": id, "stream_sequence": sequence})
+}
+
+// replayExpired publishes an expired message to its subject again without
+// its deadline (expires_at and ttl), so the worker delivers it. Fields the
+// scrub rules masked before it was stored stay masked.
+func replayExpired(ctx context.Context, id int64) (uint64, error) {
+	if jetStream == nil {
+		return 0, errors.New("not connected to NATS")
+	}
+	if err := ensureOpsReady(); err != nil {
+		return 0, err
+	}
+
+	var subject, traceID string
+	var stored []byte
+	err := opsDB.QueryRowContext(ctx,
+		`SELECT subject, payload, COALESCE(trace_id, '') FROM rule_nats_expired_messages
+		 WHERE expired_id = $1 AND stream_name = $2 AND consumer_name = $3`,
+		id, config.Worker.StreamName, config.Worker.ConsumerName,
+	).Scan(&subject, &stored, &traceID)
+	if err != nil {
+		return 0, err
+	}
+
+	if stored == nil {
+		return 0, errors.New("the payload was not stored (see STORED_PAYLOAD_SERIALIZER)")
+	}
+	plain, err := payloadSealer.Open(ctx, stored)
+	if err != nil {
+		return 0, err
+	}
+	if isWrappedPayload(plain) {
+		// Its expires_at cannot be removed, so it would expire again
+		return 0, errors.New("the stored payload is not JSON and cannot be replayed")
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(plain, &payload); err != nil {
+		return 0, fmt.Errorf("stored payload is not a JSON object: %w", err)
+	}
+	delete(payload, "expires_at")
+	delete(payload, "ttl")
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	msg.Header.Set("Rule-Replay-Of", fmt.Sprintf("expired:%d", id))
+	if traceID != "" {
+		msg.Header.Set(traceIDHeader, traceID)
+	}
+	ack, err := jetStream.PublishMsg(msg, nats.Context(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("failed to publish replay: %w", err)
+	}
+
+	if _, err := opsDB.ExecContext(ctx,
+		`UPDATE rule_nats_expired_messages
+		 SET replayed_at = CURRENT_TIMESTAMP, replay_count = replay_count + 1
+		 WHERE expired_id = $1`, id); err != nil {
+		log.Printf("⚠️  Replayed expired message %d but could not record it: %v", id, err)
+	}
+	log.Printf("🔁 Replayed expired message %d to %s (stream sequence %d)", id, subject, ack.Sequence)
+	return ack.Sequence, nil
+}
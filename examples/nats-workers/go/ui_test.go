@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine/envelope"
+)
+
+// resetUIState empties the recent failures and destination health for one
+// test
+func resetUIState(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		recentMu.Lock()
+		recentFailures = nil
+		destinationStates = map[string]*destinationHealth{}
+		recentMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// fakeJetStream records published messages; only PublishMsg is implemented
+type fakeJetStream struct {
+	nats.JetStreamContext
+	mu        sync.Mutex
+	published []*nats.Msg
+	err       error
+}
+
+func (js *fakeJetStream) PublishMsg(m *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.err != nil {
+		return nil, js.err
+	}
+	js.published = append(js.published, m)
+	return &nats.PubAck{Stream: "RULES", Sequence: uint64(1000 + len(js.published))}, nil
+}
+
+// useJetStream swaps the worker's JetStream handle for one test
+func useJetStream(t *testing.T, js nats.JetStreamContext) {
+	t.Helper()
+	prev := jetStream
+	jetStream = js
+	t.Cleanup(func() { jetStream = prev })
+}
+
+func TestDestinationHealthStatus(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     string
+	}{
+		{0, "healthy"}, {1, "degraded"}, {4, "degraded"}, {5, "failing"}, {12, "failing"},
+	}
+	for _, tt := range tests {
+		if got := (destinationHealth{ConsecutiveFailures: tt.failures}).status(); got != tt.want {
+			t.Errorf("status with %d failures = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestTrackDestination(t *testing.T) {
+	resetUIState(t)
+	tests := []struct {
+		outcome     string
+		delivered   uint64
+		failed      uint64
+		consecutive int
+	}{
+		{outcomeFailed, 0, 1, 1},
+		{outcomeFailed, 0, 2, 2},
+		// Expired and duplicate messages say nothing about the destination
+		{outcomeExpired, 0, 2, 2},
+		{outcomeDuplicate, 0, 2, 2},
+		{outcomeDelivered, 1, 2, 0},
+		{outcomeFailed, 1, 3, 1},
+	}
+	for i, tt := range tests {
+		trackDestination("webhook:crm", tt.outcome)
+		h := *destinationStates["webhook:crm"]
+		if h.Delivered != tt.delivered || h.Failed != tt.failed || h.ConsecutiveFailures != tt.consecutive {
+			t.Fatalf("step %d (%s): %+v", i, tt.outcome, h)
+		}
+	}
+	h := destinationStates["webhook:crm"]
+	if h.LastSuccess.IsZero() || h.LastFailure.Before(h.LastSuccess) {
+		t.Fatalf("last success %v, last failure %v", h.LastSuccess, h.LastFailure)
+	}
+
+	trackDestination("webhook:erp", outcomeExpired)
+	if _, ok := destinationStates["webhook:erp"]; ok {
+		t.Fatal("an expiry created a destination")
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	resetUIState(t)
+	m := &ActionMessage{Msg: &nats.Msg{Subject: "rules.orders"}, dedupKey: "webhook:crm", traceID: "req-1"}
+	trackDestination("webhook:crm", outcomeFailed)
+
+	for i := 0; i < recentFailureLimit+5; i++ {
+		recordFailure(m, fmt.Errorf("HTTP 503 #%d", i))
+	}
+	if len(recentFailures) != recentFailureLimit {
+		t.Fatalf("%d failures kept, want %d", len(recentFailures), recentFailureLimit)
+	}
+	// The oldest are dropped first
+	if first := recentFailures[0]; first.Error != "HTTP 503 #5" || first.Destination != "webhook:crm" ||
+		first.Action != "webhook" || first.TraceID != "req-1" || first.Subject != "rules.orders" {
+		t.Fatalf("oldest kept = %+v", first)
+	}
+	if h := destinationStates["webhook:crm"]; h.LastError != fmt.Sprintf("HTTP 503 #%d", recentFailureLimit+4) {
+		t.Fatalf("last error = %q", h.LastError)
+	}
+}
+
+func TestRegisterUI(t *testing.T) {
+	resetUIState(t)
+	defer func(token string) { config.Admin.Token = token }(config.Admin.Token)
+	config.Admin.Token = "s3cret"
+
+	root, mux := http.NewServeMux(), http.NewServeMux()
+	registerUI(root, mux)
+	m := &ActionMessage{Msg: &nats.Msg{Subject: "rules.orders"}, dedupKey: "webhook:crm"}
+	recordFailure(m, errors.New("first"))
+	recordFailure(m, errors.New("second"))
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		want     int
+		contains string
+	}{
+		{name: "page is public", path: "/ui/", want: http.StatusOK, contains: "<html"},
+		{name: "api needs the token", path: "/ui/api/failures", want: http.StatusUnauthorized},
+		{name: "wrong token", path: "/ui/api/failures", token: "nope", want: http.StatusUnauthorized},
+		{name: "newest failure first", path: "/ui/api/failures", token: "s3cret", want: http.StatusOK, contains: `[{"at"`},
+		{name: "unknown api path", path: "/ui/api/nothing", token: "s3cret", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			root.ServeHTTP(rec, req)
+			if rec.Code != tt.want || !strings.Contains(rec.Body.String(), tt.contains) {
+				t.Fatalf("%d %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/ui/api/failures", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec := httptest.NewRecorder()
+	root.ServeHTTP(rec, req)
+	var failures []failedDelivery
+	if err := json.Unmarshal(rec.Body.Bytes(), &failures); err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 2 || failures[0].Error != "second" || failures[1].Error != "first" {
+		t.Fatalf("failures = %+v", failures)
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatal("API responses may be cached")
+	}
+}
+
+func TestServeUIDestinations(t *testing.T) {
+	resetUIState(t)
+	for _, d := range []struct {
+		destination string
+		outcomes    []string
+	}{
+		{"webhook:b", []string{outcomeDelivered}},
+		{"webhook:a", []string{outcomeDelivered}},
+		{"webhook:down", []string{outcomeFailed, outcomeFailed, outcomeFailed, outcomeFailed, outcomeFailed}},
+		{"webhook:flaky", []string{outcomeDelivered, outcomeFailed}},
+	} {
+		for _, outcome := range d.outcomes {
+			trackDestination(d.destination, outcome)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	serveUIDestinations(rec, httptest.NewRequest(http.MethodGet, "/ui/api/destinations", nil))
+	var list []destinationHealth
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	// Worst first, then by name
+	want := []struct{ destination, status string }{
+		{"webhook:down", "failing"}, {"webhook:flaky", "degraded"}, {"webhook:a", "healthy"}, {"webhook:b", "healthy"},
+	}
+	if len(list) != len(want) {
+		t.Fatalf("list = %+v", list)
+	}
+	for i, w := range want {
+		if list[i].Destination != w.destination || list[i].Status != w.status {
+			t.Errorf("list[%d] = %s %s, want %s %s", i, list[i].Destination, list[i].Status, w.destination, w.status)
+		}
+	}
+}
+
+func TestServeUIExpired(t *testing.T) {
+	ops := mockOpsDB(t)
+	prevWorker, prevSealer := config.Worker, payloadSealer
+	t.Cleanup(func() { config.Worker, payloadSealer = prevWorker, prevSealer })
+	config.Worker.StreamName, config.Worker.ConsumerName = "RULES", "webhooks"
+	payloadSealer = nil
+
+	expired := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ops.ExpectQuery("FROM rule_nats_expired_messages").WithArgs("RULES", "webhooks", 5, "").
+		WillReturnRows(sqlmock.NewRows([]string{"expired_id", "stream_name", "consumer_name", "subject", "stream_sequence",
+			"webhook_url", "published_at", "expires_at", "expired_at", "payload", "replayed_at", "replay_count", "trace_id"}).
+			AddRow(7, "RULES", "webhooks", "rules.orders", 42, "", nil, expired, expired, []byte(`{"order":1}`), nil, 0, "req-7"))
+
+	rec := httptest.NewRecorder()
+	serveUIExpired(rec, httptest.NewRequest(http.MethodGet, "/ui/api/expired?limit=5", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%d %s", rec.Code, rec.Body.String())
+	}
+	var messages []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &messages); err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0]["id"] != 7.0 || messages[0]["trace_id"] != "req-7" ||
+		messages[0]["payload"].(map[string]interface{})["order"] != 1.0 {
+		t.Fatalf("messages = %v", messages)
+	}
+}
+
+func TestServeUIReplay(t *testing.T) {
+	prevWorker, prevSealer := config.Worker, payloadSealer
+	t.Cleanup(func() { config.Worker, payloadSealer = prevWorker, prevSealer })
+	config.Worker.StreamName, config.Worker.ConsumerName = "RULES", "webhooks"
+	key, err := envelope.NewLocalKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadSealer = envelope.New(key)
+	sealed, err := payloadSealer.Seal(context.Background(), []byte(`{"order":1,"expires_at":"2024-03-01T12:00:00Z","ttl":"5m"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := func(payload []byte) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"subject", "payload", "trace_id"}).AddRow("rules.orders", payload, "req-7")
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		expect     func(ops sqlmock.Sqlmock)
+		publishErr error
+		want       int
+		wantError  string
+	}{
+		{name: "get", method: http.MethodGet, query: "?id=7", want: http.StatusMethodNotAllowed},
+		{name: "bad id", method: http.MethodPost, query: "?id=seven", want: http.StatusBadRequest},
+		{name: "not found", method: http.MethodPost, query: "?id=8", want: http.StatusNotFound, wantError: "expired message 8 not found",
+			expect: func(ops sqlmock.Sqlmock) {
+				ops.ExpectQuery("FROM rule_nats_expired_messages").WithArgs(int64(8), "RULES", "webhooks").WillReturnError(sql.ErrNoRows)
+			}},
+		{name: "payload not stored", method: http.MethodPost, query: "?id=7", want: http.StatusInternalServerError, wantError: "STORED_PAYLOAD_SERIALIZER",
+			expect: func(ops sqlmock.Sqlmock) {
+				ops.ExpectQuery("FROM rule_nats_expired_messages").WillReturnRows(rows(nil))
+			}},
+		{name: "publish fails", method: http.MethodPost, query: "?id=7", publishErr: nats.ErrTimeout,
+			want: http.StatusInternalServerError, wantError: "failed to publish replay",
+			expect: func(ops sqlmock.Sqlmock) {
+				ops.ExpectQuery("FROM rule_nats_expired_messages").WillReturnRows(rows(sealed))
+			}},
+		{name: "replayed", method: http.MethodPost, query: "?id=7", want: http.StatusOK,
+			expect: func(ops sqlmock.Sqlmock) {
+				ops.ExpectQuery("FROM rule_nats_expired_messages").WithArgs(int64(7), "RULES", "webhooks").WillReturnRows(rows(sealed))
+				ops.ExpectExec(`SET replayed_at = CURRENT_TIMESTAMP, replay_count = replay_count \+ 1`).WithArgs(int64(7)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := mockOpsDB(t)
+			js := &fakeJetStream{err: tt.publishErr}
+			useJetStream(t, js)
+			if tt.expect != nil {
+				tt.expect(ops)
+			}
+
+			rec := httptest.NewRecorder()
+			serveUIReplay(rec, httptest.NewRequest(tt.method, "/ui/api/expired/replay"+tt.query, nil))
+			if rec.Code != tt.want || !strings.Contains(rec.Body.String(), tt.wantError) {
+				t.Fatalf("%d %s", rec.Code, rec.Body.String())
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			if len(js.published) != 1 {
+				t.Fatalf("published %d messages", len(js.published))
+			}
+			msg := js.published[0]
+			// The deadline goes so the worker delivers it this time
+			if msg.Subject != "rules.orders" || string(msg.Data) != `{"order":1}` {
+				t.Fatalf("published %s %s", msg.Subject, msg.Data)
+			}
+			if msg.Header.Get("Rule-Replay-Of") != "expired:7" || msg.Header.Get(traceIDHeader) != "req-7" {
+				t.Fatalf("headers = %v", msg.Header)
+			}
+			if !strings.Contains(rec.Body.String(), `"stream_sequence":1001`) {
+				t.Fatalf("body = %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestReplayExpiredWithoutNATS(t *testing.T) {
+	useJetStream(t, nil)
+	if _, err := replayExpired(context.Background(), 1); err == nil || err.Error() != "not connected to NATS" {
+		t.Fatalf("err = %v", err)
+	}
+}
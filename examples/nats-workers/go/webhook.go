@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+// webhookAction delivers the message as an HTTP request. It handles plain
+// messages (webhook_url/webhook_id) and rule_actions rows of type webhook,
+// whose config is either {"webhook_id": 7} or an inline destination:
+//
+//	{"url": "https://...", "method": "PUT", "headers": {...}, "timeout_ms": 5000, "cloudevents": "binary"}
+type webhookAction struct{}
+
+type webhookActionConfig struct {
+	WebhookID    int               `json:"webhook_id"`
+	URL          string            `json:"url"`
+	Method       string            `json:"method"`
+	Headers      map[string]string `json:"headers"`
+	QueryParams  map[string]string `json:"query_params"`
+	TimeoutMs    int               `json:"timeout_ms"`
+	ContentType  string            `json:"content_type"`
+	BodyTemplate string            `json:"body_template"`
+	CloudEvents  string            `json:"cloudevents"`
+}
+
+func init() {
+	registerAction("webhook", webhookAction{})
+}
+
+// resolveWebhook returns the registered destination a plain message
+// references, if any, and the URL to call.
+func resolveWebhook(ctx context.Context, payload *WebhookPayload) (*Destination, string, error) {
+	var dest *Destination
+	if payload.WebhookID != 0 {
+		var err error
+		if dest, err = getDestination(ctx, payload.WebhookID); err != nil {
+			return nil, "", err
+		}
+	}
+
+	webhookURL := payload.WebhookURL
+	if webhookURL == "" && dest != nil {
+		webhookURL = dest.URL
+	}
+	if webhookURL == "" {
+		return nil, "", fmt.Errorf("missing webhook_url in payload")
+	}
+	return dest, webhookURL, nil
+}
+
+// destination returns the delivery settings for m: the message's own
+// webhook for plain messages, the action's config otherwise.
+func (webhookAction) destination(ctx context.Context, m *ActionMessage) (*Destination, string, error) {
+	if m.Config == nil {
+		return resolveWebhook(ctx, m.Payload)
+	}
+
+	var cfg webhookActionConfig
+	if err := m.Config.decode(&cfg); err != nil {
+		return nil, "", err
+	}
+	dest := &Destination{}
+	if cfg.WebhookID != 0 {
+		registered, err := getDestination(ctx, cfg.WebhookID)
+		if err != nil {
+			return nil, "", err
+		}
+		copied := *registered
+		dest = &copied
+	}
+	if cfg.URL != "" {
+		dest.URL = cfg.URL
+	}
+	if cfg.Method != "" {
+		dest.Method = cfg.Method
+	}
+	if cfg.Headers != nil {
+		dest.Headers = cfg.Headers
+	}
+	if cfg.QueryParams != nil {
+		dest.QueryParams = cfg.QueryParams
+	}
+	if cfg.TimeoutMs > 0 {
+		dest.TimeoutMs = cfg.TimeoutMs
+	}
+	if cfg.ContentType != "" {
+		dest.ContentType = cfg.ContentType
+	}
+	if cfg.BodyTemplate != "" {
+		dest.BodyTemplate = cfg.BodyTemplate
+	}
+	if cfg.CloudEvents != "" {
+		dest.CloudEvents = cfg.CloudEvents
+	}
+
+	webhookURL := m.Payload.WebhookURL
+	if webhookURL == "" {
+		webhookURL = dest.URL
+	}
+	if webhookURL == "" {
+		return nil, "", fmt.Errorf("action %s has no url or webhook_id", m.Config.Name)
+	}
+	return dest, webhookURL, nil
+}
+
+func (a webhookAction) Execute(ctx context.Context, m *ActionMessage) (string, error) {
+	payload := m.Payload
+	dest, webhookURL, err := a.destination(ctx, m)
+	if err != nil {
+		return "", err
+	}
+	if err := checkPause(dest); err != nil {
+		return "", err
+	}
+	if err := checkDeliveryHours(dest); err != nil {
+		return "", err
+	}
+	if err := checkCircuit(dest); err != nil {
+		return "", err
+	}
+
+	method, err := resolveMethod(payload, dest)
+	if err == nil {
+		webhookURL, err = buildURL(webhookURL, payload, dest)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Prepare request body; payload settings override the destination's
+	contentType, bodyTemplate := payload.ContentType, payload.BodyTemplate
+	if dest != nil {
+		if contentType == "" {
+			contentType = dest.ContentType
+		}
+		if bodyTemplate == "" {
+			bodyTemplate = dest.BodyTemplate
+		}
+	}
+	contentType = resolveContentType(contentType)
+
+	// GET requests carry no body; parameters go in the query string
+	var requestBody []byte
+	if method != http.MethodGet {
+		requestBody, err = encodeBody(contentType, bodyTemplate, payload, m.data)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode request body: %w", err)
+		}
+	}
+
+	// Send the request as a CloudEvent when the destination asks for one
+	mode, err := cloudEventMode(dest)
+	if err != nil {
+		return "", err
+	}
+	var ceHeaders http.Header
+	if mode != "" {
+		requestBody, contentType, ceHeaders, err = encodeCloudEvent(mode, outboundCloudEvent(m), contentType, requestBody)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode cloudevent: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, webhookURL, bytes.NewReader(requestBody))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Set headers: content type first so explicit headers can override it
+	if requestBody != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(traceIDHeader, m.traceID)
+	if m.deliveryKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey(m.deliveryKey))
+	}
+	for key, values := range ceHeaders {
+		req.Header[key] = values
+	}
+	if dest != nil {
+		for key, value := range dest.Headers {
+			req.Header.Set(key, value)
+		}
+	}
+	for key, value := range payload.Headers {
+		req.Header.Set(key, value)
+	}
+
+	timeout := 30 * time.Second
+	if dest != nil && dest.TimeoutMs > 0 {
+		timeout = time.Duration(dest.TimeoutMs) * time.Millisecond
+	}
+
+	capture := startCapture(ctx, m, dest, req, requestBody)
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	capture.finish(ctx, resp, err)
+	if err != nil {
+		return "", fmt.Errorf("request failed: %w", err)
+	}
+	defer func() {
+		drainBody(resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if dest != nil && dest.ResponseMapping != nil {
+			recordResponseFacts(ctx, m, dest, resp)
+		}
+		return fmt.Sprintf("HTTP %d", resp.StatusCode), nil
+	}
+	err = fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		if after := retryAfter(resp.Header, 0); after > 0 {
+			return "", worker.RetryAfter(err, after)
+		}
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout:
+		// The request itself was refused; sending it again will not help
+		return "", worker.Permanent(err)
+	}
+	return "", err
+}
+
+// retryAfter parses a Retry-After header given in seconds, or returns
+// fallback
+func retryAfter(header http.Header, fallback time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return fallback
+}
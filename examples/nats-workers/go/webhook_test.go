@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rule-engine/nats-webhook-worker/worker"
+)
+
+func TestWebhookActionAckPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		retryAfter    string
+		wantErr       string
+		wantPermanent bool
+	}{
+		{name: "delivered", status: 200},
+		{name: "accepted", status: 202},
+		{name: "server error retries", status: 500, wantErr: "HTTP error: 500"},
+		{name: "bad gateway retries", status: 502, wantErr: "HTTP error: 502"},
+		{name: "client error terminates", status: 404, wantErr: "HTTP error: 404", wantPermanent: true},
+		{name: "unauthorized terminates", status: 401, wantErr: "HTTP error: 401", wantPermanent: true},
+		{name: "request timeout retries", status: 408, wantErr: "HTTP error: 408"},
+		{name: "rate limited waits", status: 429, retryAfter: "7", wantErr: "HTTP error: 429 (retry after 7s)"},
+		{name: "rate limited without header", status: 429, wantErr: "HTTP error: 429"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			m := &ActionMessage{Payload: &WebhookPayload{WebhookURL: srv.URL, Data: map[string]interface{}{"id": 1}}}
+			_, err := webhookAction{}.Execute(context.Background(), m)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if worker.IsPermanent(err) != tt.wantPermanent {
+				t.Fatalf("permanent = %v, want %v", worker.IsPermanent(err), tt.wantPermanent)
+			}
+		})
+	}
+}
+
+func TestWebhookActionCancelled(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	m := &ActionMessage{Payload: &WebhookPayload{WebhookURL: srv.URL}}
+	start := time.Now()
+	_, err := webhookAction{}.Execute(ctx, m)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Fatalf("err = %v after %s, want the handler deadline", err, time.Since(start))
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", time.Second},
+		{"30", 30 * time.Second},
+		{"0", time.Second},
+		{"-5", time.Second},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", time.Second},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.header != "" {
+			header.Set("Retry-After", tt.header)
+		}
+		if got := retryAfter(header, time.Second); got != tt.want {
+			t.Errorf("retryAfter(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestParseNakBackoff(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []time.Duration
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "5s", want: []time.Duration{5 * time.Second}},
+		{value: "5s, 30s,2m", want: []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute}},
+		{value: "5s,,30s,", want: []time.Duration{5 * time.Second, 30 * time.Second}},
+		{value: "5", wantErr: true},
+		{value: "5s,-1s", wantErr: true},
+		{value: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseNakBackoff(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseNakBackoff(%q) err = %v", tt.value, err)
+			continue
+		}
+		if err != nil && !strings.Contains(err.Error(), "5s,30s,2m") {
+			t.Errorf("parseNakBackoff(%q) err = %v, want an example", tt.value, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseNakBackoff(%q) = %v, want %v", tt.value, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseNakBackoff(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		}
+	}
+}
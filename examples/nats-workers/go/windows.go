@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// windowPruneInterval is how often the leader deletes expired window
+// buckets
+const windowPruneInterval = time.Minute
+
+// windowStats counts events recorded into windows (see
+// ruleengine.Client.CreateWindow)
+var windowStats = expvar.NewMap("window_events")
+
+func init() {
+	registerSingleton("window_prune", windowPruneInterval, pruneWindows)
+}
+
+// startWindowRecorder subscribes to WINDOW_SUBJECTS and counts every event
+// into the windows it matches. Subscriptions share a queue group, so each
+// event is counted by one worker.
+func startWindowRecorder(nc *nats.Conn) error {
+	subjects := splitList(config.Windows.Subjects)
+	if len(subjects) == 0 {
+		return nil
+	}
+	client := ruleengine.New(db)
+	for _, subject := range subjects {
+		if _, err := nc.QueueSubscribe(subject, config.Worker.QueueGroup+".windows", func(msg *nats.Msg) {
+			recordWindowEvent(client, msg)
+		}); err != nil {
+			return err
+		}
+	}
+	log.Printf("📊 Recording window events from %v", subjects)
+	return nil
+}
+
+func recordWindowEvent(client *ruleengine.Client, msg *nats.Msg) {
+	if !json.Valid(msg.Data) {
+		windowStats.Add("invalid", 1)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := client.RecordWindowEvent(ctx, msg.Subject, json.RawMessage(msg.Data))
+	switch {
+	case err != nil:
+		windowStats.Add("failed", 1)
+		log.Printf("⚠️  Failed to record window event from %s: %v", msg.Subject, err)
+	case n == 0:
+		windowStats.Add("unmatched", 1)
+	default:
+		windowStats.Add("recorded", 1)
+	}
+}
+
+// pruneWindows deletes buckets that have left their windows
+func pruneWindows(ctx context.Context) error {
+	pruned, err := ruleengine.New(db).PruneWindows(ctx)
+	if pruned > 0 {
+		log.Printf("🧹 Pruned %d expired window bucket(s)", pruned)
+	}
+	return err
+}
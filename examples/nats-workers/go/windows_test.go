@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/ruleengine"
+)
+
+// windowCount reads one window_events counter
+func windowCount(key string) int64 {
+	if v, ok := windowStats.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestRecordWindowEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		expect func(mock sqlmock.Sqlmock)
+		want   string
+	}{
+		{name: "recorded", data: `{"user":"u1"}`, want: "recorded",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`rule_window_record`).WithArgs("auth.failed", []byte(`{"user":"u1"}`)).
+					WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(2))
+			}},
+		{name: "unmatched", data: `{"other":1}`, want: "unmatched",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`rule_window_record`).WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(0))
+			}},
+		{name: "failed", data: `{"user":"u1"}`, want: "failed",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`rule_window_record`).WillReturnError(errors.New("connection refused"))
+			}},
+		{name: "invalid JSON is not recorded", data: `{"user":`, want: "invalid", expect: func(sqlmock.Sqlmock) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockDB.Close()
+			tt.expect(mock)
+
+			before := windowCount(tt.want)
+			recordWindowEvent(ruleengine.New(mockDB), &nats.Msg{Subject: "auth.failed", Data: []byte(tt.data)})
+			if got := windowCount(tt.want) - before; got != 1 {
+				t.Fatalf("%s += %d, want 1", tt.want, got)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type ctxKey struct{}
+
+func TestHandlerContext(t *testing.T) {
+	srv := newTestServer(t)
+	w := newTestWorker(t, srv, Options{AckWait: time.Minute, HandlerTimeout: 2 * time.Second})
+
+	type seen struct {
+		value    any
+		deadline time.Duration
+		ok       bool
+	}
+	got := make(chan seen, 1)
+	w.RegisterHandler("rules.>", func(ctx context.Context, msg *nats.Msg) error {
+		deadline, ok := ctx.Deadline()
+		got <- seen{value: ctx.Value(ctxKey{}), deadline: time.Until(deadline), ok: ok}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "run"))
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+	waitFor(t, "subscription", func() bool { return len(w.Subscriptions()) > 0 })
+
+	srv.Publish("rules.orders", nil, []byte("1"))
+	s := <-got
+	if s.value != "run" {
+		t.Errorf("handler context value = %v, want Run's", s.value)
+	}
+	if !s.ok || s.deadline <= time.Second || s.deadline > 2*time.Second {
+		t.Errorf("handler deadline in %s (set %v), want HandlerTimeout", s.deadline, s.ok)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownWaitsForHandlers(t *testing.T) {
+	srv := newTestServer(t)
+	w := newTestWorker(t, srv, Options{AckWait: time.Minute, ShutdownGrace: 5 * time.Second})
+
+	started := make(chan struct{})
+	var ctxErr atomic.Value
+	w.RegisterHandler("rules.>", func(ctx context.Context, msg *nats.Msg) error {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		if err := ctx.Err(); err != nil {
+			ctxErr.Store(err)
+		}
+		return nil
+	})
+	stop := runWorker(t, w)
+
+	srv.Publish("rules.orders", nil, []byte("1"))
+	<-started
+	begin := time.Now()
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed < 150*time.Millisecond || elapsed > 4*time.Second {
+		t.Fatalf("Run returned after %s, want once the handler finished", elapsed)
+	}
+	if err := ctxErr.Load(); err != nil {
+		t.Fatalf("handler context ended within the grace period: %v", err)
+	}
+	// Settled after Run stopped taking messages
+	if a := srv.WaitForAcks(1)[0]; a.Kind != "+ACK" {
+		t.Fatalf("ack = %+v", a)
+	}
+}
+
+func TestShutdownGraceCancelsHandlers(t *testing.T) {
+	srv := newTestServer(t)
+	w := newTestWorker(t, srv, Options{AckWait: time.Minute, ShutdownGrace: 100 * time.Millisecond})
+
+	started := make(chan struct{})
+	ended := make(chan error, 1)
+	w.RegisterHandler("rules.>", func(ctx context.Context, msg *nats.Msg) error {
+		close(started)
+		<-ctx.Done()
+		ended <- ctx.Err()
+		return ctx.Err()
+	})
+	stop := runWorker(t, w)
+
+	srv.Publish("rules.orders", nil, []byte("1"))
+	<-started
+	begin := time.Now()
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed < 100*time.Millisecond {
+		t.Fatalf("Run returned after %s, before ShutdownGrace", elapsed)
+	}
+	if err := <-ended; !errors.Is(err, context.Canceled) {
+		t.Fatalf("handler context ended with %v, want cancellation", err)
+	}
+}
+
+func TestMessagesWhileStoppingStayUnacked(t *testing.T) {
+	srv := newTestServer(t)
+	w := newTestWorker(t, srv, Options{AckWait: time.Minute})
+	var handled atomic.Int32
+	w.RegisterHandler("rules.>", func(context.Context, *nats.Msg) error {
+		handled.Add(1)
+		return nil
+	})
+	runWorker(t, w)
+
+	w.mu.Lock()
+	w.stopping = true
+	w.mu.Unlock()
+	w.inFlight.Add(1)
+	w.dispatch(&nats.Msg{Subject: "rules.orders", Reply: "$JS.ACK.RULES.webhooks.1.1.1.0.0", Sub: w.Subscription()})
+	if handled.Load() != 0 {
+		t.Fatal("handler ran while stopping")
+	}
+	if acks := srv.Acks(); len(acks) != 0 {
+		t.Fatalf("acks = %+v", acks)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	tests := []struct {
+		name           string
+		handlerTimeout time.Duration
+		wantProgress   bool
+	}{
+		{name: "handler timeout past AckWait", handlerTimeout: 2 * time.Second, wantProgress: true},
+		{name: "default handler timeout", wantProgress: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			w := newTestWorker(t, srv, Options{AckWait: 300 * time.Millisecond, HandlerTimeout: tt.handlerTimeout})
+			var deliveries atomic.Int32
+			w.RegisterHandler("rules.>", func(ctx context.Context, msg *nats.Msg) error {
+				deliveries.Add(1)
+				if tt.wantProgress {
+					// Longer than AckWait; heartbeats hold off redelivery
+					time.Sleep(500 * time.Millisecond)
+				} else {
+					time.Sleep(150 * time.Millisecond)
+				}
+				return nil
+			})
+			runWorker(t, w)
+
+			srv.Publish("rules.orders", nil, []byte("1"))
+			waitFor(t, "ack", func() bool {
+				for _, a := range srv.Acks() {
+					if a.Kind == "+ACK" {
+						return true
+					}
+				}
+				return false
+			})
+			progress := 0
+			for _, a := range srv.Acks() {
+				if a.Kind == "+WPI" {
+					progress++
+				}
+			}
+			if (progress > 0) != tt.wantProgress {
+				t.Fatalf("%d in-progress acks, want any: %v", progress, tt.wantProgress)
+			}
+			if n := deliveries.Load(); n != 1 {
+				t.Fatalf("delivered %d times", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSettled tells the worker that the handler acked, naked, or terminated
+// the message itself, or arranged for that to happen later, so the worker
+// leaves it alone
+var ErrSettled = errors.New("worker: message settled by handler")
+
+// permanentError marks a failure that redelivery cannot fix
+type permanentError struct{ Err error }
+
+func (e *permanentError) Error() string { return e.Err.Error() }
+func (e *permanentError) Unwrap() error { return e.Err }
+
+// Permanent marks err as one redelivery cannot fix, such as a malformed
+// payload or a rejected request, so the message is terminated rather than
+// naked
+func Permanent(err error) error {
+	return &permanentError{err}
+}
+
+// IsPermanent reports whether err, or an error it wraps, came from
+// Permanent
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// retryAfterError asks for redelivery no sooner than After
+type retryAfterError struct {
+	After time.Duration
+	Err   error
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %s)", e.Err, e.After)
+}
+
+func (e *retryAfterError) Unwrap() error { return e.Err }
+
+// RetryAfter naks the message with a delay of after instead of the
+// Options.Backoff one, for targets that signal rate limits
+func RetryAfter(err error, after time.Duration) error {
+	return &retryAfterError{After: after, Err: err}
+}
@@ -0,0 +1,50 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestErrorClassification(t *testing.T) {
+	base := errors.New("boom")
+	tests := []struct {
+		name          string
+		err           error
+		wantPermanent bool
+		wantAfter     time.Duration
+		wantMsg       string
+	}{
+		{name: "plain", err: base, wantMsg: "boom"},
+		{name: "permanent", err: Permanent(base), wantPermanent: true, wantMsg: "boom"},
+		{name: "wrapped permanent", err: fmt.Errorf("send: %w", Permanent(base)), wantPermanent: true, wantMsg: "send: boom"},
+		{name: "retry after", err: RetryAfter(base, 3*time.Second), wantAfter: 3 * time.Second, wantMsg: "boom (retry after 3s)"},
+		{name: "wrapped retry after", err: fmt.Errorf("send: %w", RetryAfter(base, time.Minute)), wantAfter: time.Minute,
+			wantMsg: "send: boom (retry after 1m0s)"},
+		{name: "nil", err: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPermanent(tt.err); got != tt.wantPermanent {
+				t.Errorf("IsPermanent = %v", got)
+			}
+			var retry *retryAfterError
+			after := time.Duration(0)
+			if errors.As(tt.err, &retry) {
+				after = retry.After
+			}
+			if after != tt.wantAfter {
+				t.Errorf("retry after %s, want %s", after, tt.wantAfter)
+			}
+			if tt.err != nil {
+				if tt.err.Error() != tt.wantMsg {
+					t.Errorf("message = %q, want %q", tt.err.Error(), tt.wantMsg)
+				}
+				if !errors.Is(tt.err, base) {
+					t.Error("does not unwrap to the cause")
+				}
+			}
+		})
+	}
+}
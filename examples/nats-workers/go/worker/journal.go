@@ -0,0 +1,429 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	bolt "go.etcd.io/bbolt"
+)
+
+// journalReplayInterval is how often Run checks for a connection to send
+// journaled settlements on
+const journalReplayInterval = time.Second
+
+var (
+	// settlementsBucket holds journal entries by consumer and stream
+	// sequence
+	settlementsBucket = []byte("settlements")
+	// countsBucket holds the counts of settlements journaled before the
+	// last stop, by name, until Options.ReplayCounts takes them
+	countsBucket = []byte("counts")
+)
+
+// Counts are statistics a handler kept for one message, by name, e.g.
+// {"processed": 1, "failed": 1}. SettleCounted journals them with the
+// message's settlement.
+type Counts map[string]uint64
+
+// plus returns the sum of c and other
+func (c Counts) plus(other Counts) Counts {
+	if len(c) == 0 {
+		return other
+	}
+	sum := make(Counts, len(c)+len(other))
+	for name, n := range c {
+		sum[name] = n
+	}
+	for name, n := range other {
+		sum[name] += n
+	}
+	return sum
+}
+
+// journalEntry is a settlement NATS could not take: the acknowledgement
+// body JetStream expects on the message's reply subject, and the handler's
+// counts for the message
+type journalEntry struct {
+	Consumer string    `json:"consumer"`
+	Seq      uint64    `json:"seq"` // stream sequence
+	Reply    string    `json:"reply"`
+	Body     string    `json:"body"` // +ACK, +TERM, or -NAK with an optional delay
+	At       time.Time `json:"at"`
+	Counts   Counts    `json:"counts,omitempty"`
+}
+
+// journalKey is an entry's key: the consumer, a zero byte, and the stream
+// sequence
+func journalKey(consumer string, seq uint64) []byte {
+	key := make([]byte, len(consumer)+9)
+	copy(key, consumer)
+	binary.BigEndian.PutUint64(key[len(consumer)+1:], seq)
+	return key
+}
+
+// journal keeps settlements made while NATS is disconnected in a bbolt
+// file, each committed and synced before the handler's result is given
+// up. They are sent once the connection is back, or by the next worker to
+// open the file after a crash. JetStream ack subjects do not belong to a
+// connection, so a settlement from before a restart still applies.
+//
+// A settlement's counts are already in this process's statistics, so they
+// go when it is sent. Opening the journal moves the counts of an earlier
+// process's settlements to countsBucket, where they wait to be reported.
+type journal struct {
+	mu  sync.Mutex // serializes replays
+	db  *bolt.DB
+	len atomic.Int64 // entries in settlementsBucket
+}
+
+// openJournal opens the journal at path, creating it if needed. It fails
+// rather than wait when another worker has the file open.
+func openJournal(path string) (*journal, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("worker: failed to open journal %s: %w", path, err)
+	}
+	j := &journal{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		settlements, err := tx.CreateBucketIfNotExists(settlementsBucket)
+		if err != nil {
+			return err
+		}
+		counts, err := tx.CreateBucketIfNotExists(countsBucket)
+		if err != nil {
+			return err
+		}
+		// Entries are rewritten after the cursor is done with them
+		moved := map[string]journalEntry{}
+		var n int64
+		err = settlements.ForEach(func(k, v []byte) error {
+			n++
+			var e journalEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("entry %s/%d: %w", e.Consumer, e.Seq, err)
+			}
+			if len(e.Counts) > 0 {
+				moved[string(k)] = e
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, e := range moved {
+			if err := addCounts(counts, e.Counts); err != nil {
+				return err
+			}
+			e.Counts = nil
+			v, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := settlements.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		j.len.Store(n)
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("worker: failed to read journal %s: %w", path, err)
+	}
+	return j, nil
+}
+
+// addCounts adds counts to the totals in b
+func addCounts(b *bolt.Bucket, counts Counts) error {
+	for name, n := range counts {
+		var total uint64
+		if v := b.Get([]byte(name)); len(v) == 8 {
+			total = binary.BigEndian.Uint64(v)
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, total+n)
+		if err := b.Put([]byte(name), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add records e, replacing an earlier settlement of the same message but
+// keeping its counts, and syncs it to disk
+func (j *journal) add(e journalEntry) error {
+	added := false
+	err := j.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(settlementsBucket)
+		key := journalKey(e.Consumer, e.Seq)
+		if v := b.Get(key); v != nil {
+			var prev journalEntry
+			if err := json.Unmarshal(v, &prev); err == nil {
+				e.Counts = prev.Counts.plus(e.Counts)
+			}
+		} else {
+			added = true
+		}
+		v, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, v)
+	})
+	if err == nil && added {
+		j.len.Add(1)
+	}
+	return err
+}
+
+// settled returns the journaled body for a message acked or terminated
+// before a redelivery. Naks are not returned: the redelivery is the retry
+// they asked for.
+func (j *journal) settled(consumer string, seq uint64) (string, bool) {
+	var body string
+	j.db.View(func(tx *bolt.Tx) error {
+		var e journalEntry
+		if v := tx.Bucket(settlementsBucket).Get(journalKey(consumer, seq)); v != nil && json.Unmarshal(v, &e) == nil {
+			body = e.Body
+		}
+		return nil
+	})
+	return body, body == "+ACK" || body == "+TERM"
+}
+
+// pending is the number of settlements not yet sent
+func (j *journal) pending() int {
+	return int(j.len.Load())
+}
+
+// replay sends the journaled settlements on nc and, once the server has
+// them, removes them with their counts. An entry replaced while it was
+// being sent is kept for the next replay. It returns how many were sent.
+func (j *journal) replay(nc *nats.Conn) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.pending() == 0 {
+		return 0, nil
+	}
+	sent := map[string][]byte{}
+	err := j.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(settlementsBucket).ForEach(func(k, v []byte) error {
+			var e journalEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if err := nc.Publish(e.Reply, []byte(e.Body)); err != nil {
+				return err
+			}
+			// Only valid during the transaction
+			sent[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := nc.FlushTimeout(5 * time.Second); err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	err = j.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(settlementsBucket)
+		for k, v := range sent {
+			if !bytes.Equal(b.Get([]byte(k)), v) {
+				continue
+			}
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("worker: failed to remove sent settlements from the journal: %w", err)
+	}
+	j.len.Add(-removed)
+	return len(sent), nil
+}
+
+// counts returns the counts of settlements journaled before the last stop
+func (j *journal) counts() (Counts, error) {
+	counts := Counts{}
+	err := j.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(countsBucket).ForEach(func(k, v []byte) error {
+			if len(v) == 8 {
+				counts[string(k)] = binary.BigEndian.Uint64(v)
+			}
+			return nil
+		})
+	})
+	return counts, err
+}
+
+// replayCounts hands the counts of settlements journaled before the last
+// stop to report and, once it has them, removes them. It reports whether
+// there were any.
+func (j *journal) replayCounts(report func(Counts) error) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	counts, err := j.counts()
+	if err != nil || len(counts) == 0 {
+		return false, err
+	}
+	if err := report(counts); err != nil {
+		return false, err
+	}
+	err = j.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(countsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(countsBucket)
+		return err
+	})
+	if err != nil {
+		return true, fmt.Errorf("worker: failed to remove reported counts from the journal: %w", err)
+	}
+	return true, nil
+}
+
+// close releases the file; settlements in it are kept for the next start
+func (j *journal) close() {
+	j.db.Close()
+}
+
+// ackBody is what settle sends for a handler returning err, as a journal
+// entry body
+func (w *Worker) ackBody(msg *nats.Msg, err error) string {
+	var retry *retryAfterError
+	switch {
+	case err == nil:
+		return "+ACK"
+	case IsPermanent(err):
+		return "+TERM"
+	case errors.As(err, &retry):
+		return nakWithDelay(retry.After)
+	}
+	return nakWithDelay(w.backoff(msg))
+}
+
+// nakWithDelay is the body of msg.NakWithDelay(delay), or a plain nak
+func nakWithDelay(delay time.Duration) string {
+	if delay <= 0 {
+		return "-NAK"
+	}
+	return fmt.Sprintf(`-NAK {"delay": %d}`, delay.Nanoseconds())
+}
+
+// connected reports whether the connection can take a settlement now. A
+// reconnecting, draining, or closed connection would only buffer it in
+// memory, or fail.
+func (w *Worker) connected() bool {
+	return w.nc.Status() == nats.CONNECTED
+}
+
+// journalSettle keeps msg's settlement and counts in the journal when
+// NATS cannot take it: sendErr is the error sending it failed with, or
+// nil when it has not been tried, and it is then journaled only while
+// the connection is down. It reports false when settle should send it
+// itself, or when the message cannot be journaled, e.g. it is not a
+// JetStream message or the disk write failed.
+func (w *Worker) journalSettle(msg *nats.Msg, err error, counts Counts, sendErr error) bool {
+	if sendErr == nil && w.connected() {
+		return false
+	}
+	meta, metaErr := msg.Metadata()
+	if metaErr != nil || msg.Reply == "" {
+		return false
+	}
+	e := journalEntry{
+		Consumer: meta.Consumer,
+		Seq:      meta.Sequence.Stream,
+		Reply:    msg.Reply,
+		Body:     w.ackBody(msg, err),
+		At:       time.Now().UTC(),
+		Counts:   counts,
+	}
+	if err := w.journal.add(e); err != nil {
+		w.log.Printf("⚠️  Failed to journal the settlement of %s: %v", msg.Subject, err)
+		return false
+	}
+	return true
+}
+
+// settleFromJournal settles a redelivered message the journal already
+// acked or terminated, without running its handler again. It reports
+// whether it did. While the connection is down the journaled settlement
+// is left for the replay.
+func (w *Worker) settleFromJournal(msg *nats.Msg) bool {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return false
+	}
+	body, ok := w.journal.settled(meta.Consumer, meta.Sequence.Stream)
+	if !ok {
+		return false
+	}
+	if w.connected() {
+		msg.Respond([]byte(body))
+	}
+	if body == "+ACK" {
+		w.count(msg, func(s *laneStats) { s.acked.Add(1) })
+	} else {
+		w.count(msg, func(s *laneStats) { s.terminated.Add(1) })
+	}
+	return true
+}
+
+// replayJournal sends journaled settlements whenever the connection is up,
+// and hands counts journaled before the last stop to Options.ReplayCounts,
+// until quit is closed
+func (w *Worker) replayJournal(quit <-chan struct{}) {
+	ticker := time.NewTicker(journalReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		w.replayJournalOnce()
+	}
+}
+
+// replayJournalOnce is one pass of replayJournal
+func (w *Worker) replayJournalOnce() {
+	if w.opts.ReplayCounts != nil {
+		if replayed, err := w.journal.replayCounts(w.opts.ReplayCounts); err != nil {
+			w.log.Printf("⚠️  Failed to replay journaled statistics: %v", err)
+		} else if replayed {
+			w.log.Printf("📒 Replayed statistics journaled before the last stop")
+		}
+	}
+	if !w.connected() || w.journal.pending() == 0 {
+		return
+	}
+	sent, err := w.journal.replay(w.nc)
+	if err != nil {
+		w.log.Printf("⚠️  Failed to send journaled settlements: %v", err)
+		return
+	}
+	w.log.Printf("📒 Sent %d settlement(s) journaled while NATS was unavailable", sent)
+}
+
+// JournalPending returns the settlements waiting in the journal for NATS,
+// or 0 without Options.JournalPath
+func (w *Worker) JournalPending() int {
+	if w.journal == nil {
+		return 0
+	}
+	return w.journal.pending()
+}
@@ -0,0 +1,315 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/internal/natstest"
+)
+
+// testJournal opens a journal in a temporary directory, closed when the
+// test ends
+func testJournal(t *testing.T) (*journal, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "acks.journal")
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(j.close)
+	return j, path
+}
+
+// jsMsg is a JetStream message of the webhooks consumer, as the worker
+// receives it
+func jsMsg(seq string) *nats.Msg {
+	return &nats.Msg{Subject: "rules.orders", Reply: "$JS.ACK.RULES.webhooks.1." + seq + "." + seq + ".1714564800000000000.0",
+		Sub: &nats.Subscription{}}
+}
+
+func TestJournalEntries(t *testing.T) {
+	tests := []struct {
+		name        string
+		entries     []journalEntry
+		wantPending int
+		wantBody    string
+		wantSettled bool
+		wantCounts  Counts // after reopening
+	}{
+		{name: "ack", entries: []journalEntry{{Body: "+ACK", Counts: Counts{"processed": 1, "succeeded": 1}}},
+			wantPending: 1, wantBody: "+ACK", wantSettled: true, wantCounts: Counts{"processed": 1, "succeeded": 1}},
+		{name: "term", entries: []journalEntry{{Body: "+TERM"}}, wantPending: 1, wantBody: "+TERM", wantSettled: true, wantCounts: Counts{}},
+		// The redelivery a nak asked for runs the handler again
+		{name: "nak", entries: []journalEntry{{Body: `-NAK {"delay": 1000000000}`}}, wantPending: 1, wantBody: `-NAK {"delay": 1000000000}`,
+			wantCounts: Counts{}},
+		{name: "redelivery replaces the settlement and adds its counts",
+			entries: []journalEntry{
+				{Body: "-NAK", Counts: Counts{"processed": 1, "failed": 1}},
+				{Body: "+ACK", Counts: Counts{"processed": 1, "succeeded": 1}},
+			},
+			wantPending: 1, wantBody: "+ACK", wantSettled: true, wantCounts: Counts{"processed": 2, "failed": 1, "succeeded": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "acks.journal")
+			j, err := openJournal(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range tt.entries {
+				e.Consumer, e.Seq, e.Reply = "webhooks", 7, "$JS.ACK.RULES.webhooks.1.7.7.0.0"
+				if err := j.add(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if j.pending() != tt.wantPending {
+				t.Fatalf("pending = %d, want %d", j.pending(), tt.wantPending)
+			}
+			if body, ok := j.settled("webhooks", 7); body != tt.wantBody || ok != tt.wantSettled {
+				t.Fatalf("settled = %q, %v", body, ok)
+			}
+			if _, ok := j.settled("webhooks", 8); ok {
+				t.Fatal("another message settled")
+			}
+			// This process's counts are its own until it stops
+			if counts, err := j.counts(); err != nil || len(counts) != 0 {
+				t.Fatalf("counts = %v, %v", counts, err)
+			}
+			j.close()
+
+			j, err = openJournal(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer j.close()
+			if j.pending() != tt.wantPending {
+				t.Fatalf("pending after reopening = %d", j.pending())
+			}
+			if body, _ := j.settled("webhooks", 7); body != tt.wantBody {
+				t.Fatalf("settled after reopening = %q", body)
+			}
+			counts, err := j.counts()
+			if err != nil || !reflect.DeepEqual(counts, tt.wantCounts) {
+				t.Fatalf("counts after reopening = %v, %v, want %v", counts, err, tt.wantCounts)
+			}
+		})
+	}
+}
+
+func TestJournalOneWorkerPerFile(t *testing.T) {
+	_, path := testJournal(t)
+	if j, err := openJournal(path); err == nil {
+		j.close()
+		t.Fatal("a second worker opened the journal")
+	}
+}
+
+func TestJournalReplayCounts(t *testing.T) {
+	tests := []struct {
+		name       string
+		counts     Counts
+		reportErr  error
+		wantReport bool
+		wantKept   Counts
+	}{
+		{name: "nothing journaled", wantKept: Counts{}},
+		{name: "reported", counts: Counts{"processed": 2, "failed": 2}, wantReport: true, wantKept: Counts{}},
+		{name: "report failed", counts: Counts{"processed": 2, "failed": 2}, reportErr: errors.New("connection refused"),
+			wantReport: true, wantKept: Counts{"processed": 2, "failed": 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j, path := testJournal(t)
+			if tt.counts != nil {
+				j.add(journalEntry{Consumer: "webhooks", Seq: 1, Reply: "$JS.ACK.RULES.webhooks.1.1.1.0.0", Body: "-NAK", Counts: tt.counts})
+				j.close()
+				var err error
+				if j, err = openJournal(path); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(j.close)
+			}
+
+			var reported Counts
+			replayed, err := j.replayCounts(func(c Counts) error {
+				reported = c
+				return tt.reportErr
+			})
+			if !errors.Is(err, tt.reportErr) || replayed != (tt.wantReport && tt.reportErr == nil) {
+				t.Fatalf("replayed = %v, %v", replayed, err)
+			}
+			if (reported != nil) != tt.wantReport || tt.wantReport && !reflect.DeepEqual(reported, tt.counts) {
+				t.Fatalf("reported %v", reported)
+			}
+			if kept, _ := j.counts(); !reflect.DeepEqual(kept, tt.wantKept) {
+				t.Fatalf("kept %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestJournalSettleWhileDisconnected(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want natstest.Ack
+	}{
+		{name: "ack", want: natstest.Ack{Kind: "+ACK"}},
+		{name: "term", err: Permanent(errors.New("bad payload")), want: natstest.Ack{Kind: "+TERM"}},
+		{name: "nak with delay", err: RetryAfter(errors.New("429"), time.Hour), want: natstest.Ack{Kind: "-NAK", Delay: time.Hour}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			w := newTestWorker(t, srv, Options{AckWait: time.Minute, JournalPath: filepath.Join(t.TempDir(), "acks.journal")})
+			later := make(chan *nats.Msg, 1)
+			w.RegisterHandler("rules.>", func(_ context.Context, msg *nats.Msg) error {
+				later <- msg
+				return ErrSettled
+			})
+			runWorker(t, w)
+			srv.Publish("rules.orders", nil, []byte("1"))
+			msg := <-later
+
+			srv.Stop()
+			waitFor(t, "disconnect", func() bool { return !w.Conn().IsConnected() })
+			w.SettleCounted(msg, tt.err, Counts{"processed": 1})
+			if w.JournalPending() != 1 {
+				t.Fatalf("%d settlement(s) journaled", w.JournalPending())
+			}
+
+			srv.Start()
+			got := srv.WaitForAcks(1)[0]
+			if got.Kind != tt.want.Kind || got.Delay != tt.want.Delay || got.Sequence != 1 {
+				t.Fatalf("ack = %+v, want %+v", got, tt.want)
+			}
+			waitFor(t, "empty journal", func() bool { return w.JournalPending() == 0 })
+		})
+	}
+}
+
+func TestJournalConnectedSettlesDirectly(t *testing.T) {
+	srv := newTestServer(t)
+	w := newTestWorker(t, srv, Options{AckWait: time.Minute, JournalPath: filepath.Join(t.TempDir(), "acks.journal")})
+	w.RegisterHandler("rules.>", func(context.Context, *nats.Msg) error { return nil })
+	runWorker(t, w)
+	srv.Publish("rules.orders", nil, []byte("1"))
+	srv.WaitForAcks(1)
+	if w.JournalPending() != 0 {
+		t.Fatalf("%d settlement(s) journaled while connected", w.JournalPending())
+	}
+}
+
+func TestJournalRedelivery(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantHandled bool
+		wantAck     string
+	}{
+		{name: "acked", body: "+ACK", wantAck: "+ACK"},
+		{name: "terminated", body: "+TERM", wantAck: "+TERM"},
+		// Sent by the replay, racing the handler's own ack
+		{name: "naked runs again", body: "-NAK", wantHandled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			path := filepath.Join(t.TempDir(), "acks.journal")
+			j, err := openJournal(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Journaled by a worker that stopped before NATS came back
+			j.add(journalEntry{Consumer: "webhooks", Seq: 1, Reply: "$JS.ACK.RULES.webhooks.1.1.1.0.0", Body: tt.body})
+			j.close()
+
+			w := newTestWorker(t, srv, Options{AckWait: time.Minute, JournalPath: path})
+			var mu sync.Mutex
+			handled := false
+			w.RegisterHandler("rules.>", func(context.Context, *nats.Msg) error {
+				mu.Lock()
+				handled = true
+				mu.Unlock()
+				return nil
+			})
+			srv.Publish("rules.orders", nil, []byte("1"))
+			runWorker(t, w)
+
+			// The journal's settlement, sent on delivery or by the replay
+			got := srv.WaitForAcks(1)[0]
+			if tt.wantAck != "" && got.Kind != tt.wantAck {
+				t.Fatalf("ack = %+v, want %s", got, tt.wantAck)
+			}
+			waitFor(t, "empty journal", func() bool { return w.JournalPending() == 0 })
+			mu.Lock()
+			defer mu.Unlock()
+			if handled != tt.wantHandled {
+				t.Fatalf("handled = %v, want %v", handled, tt.wantHandled)
+			}
+		})
+	}
+}
+
+func TestJournalReplayCountsOnRun(t *testing.T) {
+	srv := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "acks.journal")
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.add(journalEntry{Consumer: "webhooks", Seq: 9, Reply: "$JS.ACK.RULES.webhooks.1.9.9.0.0", Body: "+ACK",
+		Counts: Counts{"processed": 1, "succeeded": 1}})
+	j.close()
+
+	replayed := make(chan Counts, 2)
+	attempts := 0
+	w := newTestWorker(t, srv, Options{JournalPath: path, ReplayCounts: func(c Counts) error {
+		// The first report fails and is tried again
+		if attempts++; attempts == 1 {
+			return errors.New("connection refused")
+		}
+		replayed <- c
+		return nil
+	}})
+	w.RegisterHandler("rules.>", func(context.Context, *nats.Msg) error { return nil })
+	runWorker(t, w)
+
+	select {
+	case c := <-replayed:
+		if !reflect.DeepEqual(c, Counts{"processed": 1, "succeeded": 1}) {
+			t.Fatalf("replayed %v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("counts not replayed")
+	}
+	if a := srv.WaitForAcks(1)[0]; a.Kind != "+ACK" || a.Sequence != 9 {
+		t.Fatalf("ack = %+v", a)
+	}
+	// Replayed once only
+	time.Sleep(2 * journalReplayInterval)
+	if len(replayed) != 0 {
+		t.Fatalf("counts replayed again: %v", <-replayed)
+	}
+}
+
+func TestJournalSettleRejected(t *testing.T) {
+	j, _ := testJournal(t)
+	w := &Worker{journal: j, log: log.New(io.Discard, "", 0)}
+	// Not a JetStream message: nothing to journal
+	if w.journalSettle(&nats.Msg{Subject: "rules.orders"}, nil, nil, errors.New("nats: connection closed")) {
+		t.Fatal("journaled a message without metadata")
+	}
+	if !w.journalSettle(jsMsg("3"), nil, Counts{"processed": 1}, errors.New("nats: connection closed")) || j.pending() != 1 {
+		t.Fatalf("rejected settlement not journaled: %d pending", j.pending())
+	}
+}
@@ -0,0 +1,214 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Lane is a priority class of messages. Each lane has its own durable
+// consumer, named Consumer-Name and filtered to Subject, so a backlog in one
+// lane does not hold up another. When several lanes have messages waiting,
+// handlers take from them in proportion to their weights: a lane of weight
+// 8 is served eight times as often as one of weight 1.
+//
+// A lane with Fetchers set uses a pull consumer instead of a push queue
+// subscription: that many goroutines fetch batches of up to Concurrency
+// messages, over the worker's one connection like every other lane.
+type Lane struct {
+	Name     string
+	Subject  string
+	Weight   int // default 1
+	Fetchers int // default 0, a push subscription
+}
+
+// fetchWait is how long a fetcher waits for a batch before asking again,
+// which is also how soon it notices Pause
+const fetchWait = 5 * time.Second
+
+// lane is a Lane's consumer and the messages it has received that no
+// handler has taken yet
+type lane struct {
+	Lane
+	consumer string
+	sub      *nats.Subscription
+	queue    chan *nats.Msg
+	current  int // smooth weighted round-robin credit
+	stats    laneStats
+}
+
+// laneStats counts a lane's messages; see SubscriptionStats
+type laneStats struct {
+	received, acked, naked, terminated atomic.Int64
+}
+
+// SubscriptionStats is one lane's subscription and what it has received
+// and settled since New. Pending is what the client library holds for
+// it, Queued what is waiting for a handler.
+type SubscriptionStats struct {
+	Lane       string `json:"lane"`
+	Consumer   string `json:"consumer"`
+	Subject    string `json:"subject"`
+	Fetchers   int    `json:"fetchers"`
+	Received   int64  `json:"received"`
+	Acked      int64  `json:"acked"`
+	Naked      int64  `json:"naked"`
+	Terminated int64  `json:"terminated"`
+	Pending    int    `json:"pending"`
+	Queued     int    `json:"queued"`
+}
+
+// newLanes validates opts.Lanes and returns the lanes to consume, the
+// Subject lane first
+func newLanes(opts *Options) ([]*lane, error) {
+	weight := opts.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	lanes := []*lane{{
+		Lane:     Lane{Subject: opts.Subject, Weight: weight, Fetchers: opts.Fetchers},
+		consumer: opts.Consumer,
+	}}
+	names := map[string]bool{}
+	for _, l := range opts.Lanes {
+		if l.Name == "" || l.Subject == "" {
+			return nil, errors.New("worker: lanes need a Name and a Subject")
+		}
+		if names[l.Name] {
+			return nil, fmt.Errorf("worker: lane %q defined twice", l.Name)
+		}
+		names[l.Name] = true
+		if l.Weight == 0 {
+			l.Weight = 1
+		}
+		lanes = append(lanes, &lane{Lane: l, consumer: opts.Consumer + "-" + l.Name})
+	}
+	for _, l := range lanes {
+		if l.Weight < 0 {
+			return nil, errors.New("worker: lane weights must be positive")
+		}
+		if l.Fetchers < 0 {
+			return nil, errors.New("worker: lane fetchers must not be negative")
+		}
+		l.queue = make(chan *nats.Msg, opts.Concurrency)
+	}
+	return lanes, nil
+}
+
+// enqueue returns the subscription callback for l. It hands messages to
+// the handler pool, blocking while l already has a message waiting for
+// every handler, so the rest stay with the server.
+func (w *Worker) enqueue(l *lane) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		w.mu.RLock()
+		if w.stopping {
+			// Left unacked, so another worker gets it after AckWait
+			w.mu.RUnlock()
+			return
+		}
+		w.inFlight.Add(1)
+		w.mu.RUnlock()
+
+		l.stats.received.Add(1)
+		l.queue <- msg
+		w.ready <- struct{}{}
+	}
+}
+
+// fetch pulls batches from a pull lane's subscription into the handler
+// pool until the subscription is stopped by Pause or the end of Run
+func (w *Worker) fetch(l *lane, sub *nats.Subscription) {
+	handle := w.enqueue(l)
+	for sub.IsValid() {
+		msgs, err := sub.Fetch(cap(l.queue), nats.MaxWait(fetchWait))
+		if err != nil && !errors.Is(err, nats.ErrTimeout) {
+			if !sub.IsValid() {
+				return
+			}
+			w.log.Printf("⚠️  Failed to fetch from %s: %v", l.Subject, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, msg := range msgs {
+			handle(msg)
+		}
+	}
+}
+
+// count applies add to the stats of the lane msg was received on
+func (w *Worker) count(msg *nats.Msg, add func(*laneStats)) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return
+	}
+	if l := w.byConsumer[meta.Consumer]; l != nil {
+		add(&l.stats)
+	}
+}
+
+// SubscriptionStats reports every lane's subscription, the Subject lane
+// first. The counts are kept across Pause and Resume.
+func (w *Worker) SubscriptionStats() []SubscriptionStats {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	stats := make([]SubscriptionStats, len(w.lanes))
+	for i, l := range w.lanes {
+		stats[i] = SubscriptionStats{
+			Lane:       l.Name,
+			Consumer:   l.consumer,
+			Subject:    l.Subject,
+			Fetchers:   l.Fetchers,
+			Received:   l.stats.received.Load(),
+			Acked:      l.stats.acked.Load(),
+			Naked:      l.stats.naked.Load(),
+			Terminated: l.stats.terminated.Load(),
+			Queued:     len(l.queue),
+		}
+		if l.sub != nil {
+			stats[i].Pending, _, _ = l.sub.Pending()
+		}
+	}
+	return stats
+}
+
+// serve runs handlers for queued messages until quit is closed
+func (w *Worker) serve(quit <-chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-w.ready:
+			if msg := w.next(); msg != nil {
+				w.dispatch(msg)
+			}
+		}
+	}
+}
+
+// next takes a message from the lanes by smooth weighted round-robin, or
+// returns nil if another handler took the last one first
+func (w *Worker) next() *nats.Msg {
+	w.pickMu.Lock()
+	defer w.pickMu.Unlock()
+
+	var best *lane
+	total := 0
+	for _, l := range w.lanes {
+		if len(l.queue) == 0 {
+			continue
+		}
+		l.current += l.Weight
+		total += l.Weight
+		if best == nil || l.current > best.current {
+			best = l
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	best.current -= total
+	return <-best.queue
+}
@@ -0,0 +1,212 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestNewLanes(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         Options
+		wantErr      string
+		wantConsumer []string
+		wantWeight   []int
+	}{
+		{name: "subject only", opts: Options{Consumer: "w", Subject: "rules.>"},
+			wantConsumer: []string{"w"}, wantWeight: []int{1}},
+		{name: "lanes", opts: Options{Consumer: "w", Subject: "rules.>", Weight: 2,
+			Lanes: []Lane{{Name: "urgent", Subject: "urgent.>", Weight: 8}, {Name: "bulk", Subject: "bulk.>", Fetchers: 2}}},
+			wantConsumer: []string{"w", "w-urgent", "w-bulk"}, wantWeight: []int{2, 8, 1}},
+		{name: "no name", opts: Options{Consumer: "w", Subject: "rules.>", Lanes: []Lane{{Subject: "urgent.>"}}},
+			wantErr: "need a Name and a Subject"},
+		{name: "no subject", opts: Options{Consumer: "w", Subject: "rules.>", Lanes: []Lane{{Name: "urgent"}}},
+			wantErr: "need a Name and a Subject"},
+		{name: "duplicate", opts: Options{Consumer: "w", Subject: "rules.>",
+			Lanes: []Lane{{Name: "urgent", Subject: "a.>"}, {Name: "urgent", Subject: "b.>"}}}, wantErr: `lane "urgent" defined twice`},
+		{name: "negative lane weight", opts: Options{Consumer: "w", Subject: "rules.>",
+			Lanes: []Lane{{Name: "urgent", Subject: "a.>", Weight: -1}}}, wantErr: "weights must be positive"},
+		{name: "negative subject weight", opts: Options{Consumer: "w", Subject: "rules.>", Weight: -2}, wantErr: "weights must be positive"},
+		{name: "negative fetchers", opts: Options{Consumer: "w", Subject: "rules.>", Fetchers: -1}, wantErr: "fetchers must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Concurrency = 4
+			lanes, err := newLanes(&tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(lanes) != len(tt.wantConsumer) {
+				t.Fatalf("%d lanes, want %d", len(lanes), len(tt.wantConsumer))
+			}
+			for i, l := range lanes {
+				if l.consumer != tt.wantConsumer[i] || l.Weight != tt.wantWeight[i] || cap(l.queue) != 4 {
+					t.Errorf("lane %d = %s weight %d queue %d", i, l.consumer, l.Weight, cap(l.queue))
+				}
+			}
+		})
+	}
+}
+
+func TestNextWeighted(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		queued  []int
+		picks   int
+		want    []int
+		wantSeq string // first picks, by lane index
+	}{
+		{name: "weights 3 to 1", weights: []int{3, 1}, queued: []int{10, 10}, picks: 8, want: []int{6, 2}, wantSeq: "0010"},
+		{name: "equal weights alternate", weights: []int{1, 1}, queued: []int{5, 5}, picks: 4, want: []int{2, 2}, wantSeq: "0101"},
+		{name: "empty lane skipped", weights: []int{1, 8}, queued: []int{3, 0}, picks: 3, want: []int{3, 0}, wantSeq: "000"},
+		{name: "drains into the other", weights: []int{1, 8}, queued: []int{3, 1}, picks: 4, want: []int{3, 1}, wantSeq: "1000"},
+		{name: "three lanes", weights: []int{5, 1, 1}, queued: []int{20, 20, 20}, picks: 7, want: []int{5, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &Worker{}
+			index := map[*nats.Msg]int{}
+			for i, weight := range tt.weights {
+				l := &lane{Lane: Lane{Weight: weight}, queue: make(chan *nats.Msg, 100)}
+				for n := 0; n < tt.queued[i]; n++ {
+					msg := &nats.Msg{}
+					index[msg] = i
+					l.queue <- msg
+				}
+				w.lanes = append(w.lanes, l)
+			}
+			got := make([]int, len(tt.weights))
+			var seq strings.Builder
+			for i := 0; i < tt.picks; i++ {
+				msg := w.next()
+				if msg == nil {
+					t.Fatalf("pick %d found nothing", i)
+				}
+				got[index[msg]]++
+				seq.WriteByte(byte('0' + index[msg]))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("picks = %v, want %v", got, tt.want)
+				}
+			}
+			if tt.wantSeq != "" && !strings.HasPrefix(seq.String(), tt.wantSeq) {
+				t.Fatalf("order = %s, want %s...", seq.String(), tt.wantSeq)
+			}
+		})
+	}
+
+	if msg := (&Worker{lanes: []*lane{{Lane: Lane{Weight: 1}, queue: make(chan *nats.Msg, 1)}}}).next(); msg != nil {
+		t.Fatal("next returned a message from empty lanes")
+	}
+}
+
+func TestRunLanes(t *testing.T) {
+	srv := newTestServer(t)
+	w := newTestWorker(t, srv, Options{
+		Subject: "rules.normal.>", AckWait: time.Minute, Concurrency: 2,
+		Lanes: []Lane{
+			{Name: "urgent", Subject: "rules.urgent.>", Weight: 8},
+			{Name: "bulk", Subject: "rules.bulk.>", Fetchers: 1},
+		},
+	})
+	var mu sync.Mutex
+	handled := map[string]int{}
+	w.RegisterHandler("rules.>", func(_ context.Context, msg *nats.Msg) error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled[strings.Split(msg.Subject, ".")[1]]++
+		return nil
+	})
+	// Published first, so the fetcher's first batch takes what is there
+	// rather than waiting out fetchWait for a full one
+	srv.Publish("rules.normal.a", nil, []byte("1"))
+	srv.Publish("rules.urgent.a", nil, []byte("2"))
+	srv.Publish("rules.urgent.b", nil, []byte("3"))
+	srv.Publish("rules.bulk.a", nil, []byte("4"))
+	runWorker(t, w)
+	if subs := w.Subscriptions(); len(subs) != 3 {
+		t.Fatalf("%d subscriptions, want one per lane", len(subs))
+	}
+
+	urgent, ok := srv.Consumer("RULES", "webhooks-urgent")
+	if !ok || urgent.FilterSubject != "rules.urgent.>" || urgent.DeliverSubject == "" || urgent.DeliverGroup != "webhooks" {
+		t.Fatalf("urgent consumer = %+v, %v", urgent, ok)
+	}
+	bulk, ok := srv.Consumer("RULES", "webhooks-bulk")
+	if !ok || bulk.FilterSubject != "rules.bulk.>" || bulk.DeliverSubject != "" {
+		t.Fatalf("bulk consumer = %+v, %v", bulk, ok)
+	}
+
+	srv.WaitForAcks(4)
+
+	mu.Lock()
+	if handled["normal"] != 1 || handled["urgent"] != 2 || handled["bulk"] != 1 {
+		t.Fatalf("handled = %v", handled)
+	}
+	mu.Unlock()
+	stats := w.SubscriptionStats()
+	want := []SubscriptionStats{
+		{Lane: "", Consumer: "webhooks", Subject: "rules.normal.>", Received: 1, Acked: 1},
+		{Lane: "urgent", Consumer: "webhooks-urgent", Subject: "rules.urgent.>", Received: 2, Acked: 2},
+		{Lane: "bulk", Consumer: "webhooks-bulk", Subject: "rules.bulk.>", Fetchers: 1, Received: 1, Acked: 1},
+	}
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Errorf("lane %d stats = %+v, want %+v", i, stats[i], want[i])
+		}
+	}
+}
+
+func TestSubscriptionStatsBySettlement(t *testing.T) {
+	srv := newTestServer(t)
+	w := newTestWorker(t, srv, Options{
+		Subject: "rules.push.>", AckWait: time.Minute, Concurrency: 4,
+		Lanes: []Lane{{Name: "bulk", Subject: "rules.pull.>", Fetchers: 1}},
+	})
+	w.RegisterHandler("rules.>", func(_ context.Context, msg *nats.Msg) error {
+		switch {
+		case strings.HasSuffix(msg.Subject, ".retry"):
+			return RetryAfter(errors.New("busy"), time.Hour)
+		case strings.HasSuffix(msg.Subject, ".bad"):
+			return Permanent(errors.New("malformed"))
+		}
+		return nil
+	})
+	for _, subject := range []string{
+		"rules.push.ok", "rules.push.ok", "rules.push.retry", "rules.push.bad",
+		"rules.pull.ok", "rules.pull.retry", "rules.pull.retry", "rules.pull.bad",
+	} {
+		srv.Publish(subject, nil, []byte("{}"))
+	}
+	runWorker(t, w)
+	srv.WaitForAcks(8)
+
+	tests := []struct {
+		lane                               int
+		received, acked, naked, terminated int64
+	}{
+		{lane: 0, received: 4, acked: 2, naked: 1, terminated: 1},
+		{lane: 1, received: 4, acked: 1, naked: 2, terminated: 1},
+	}
+	stats := w.SubscriptionStats()
+	for _, tt := range tests {
+		s := stats[tt.lane]
+		if s.Received != tt.received || s.Acked != tt.acked || s.Naked != tt.naked || s.Terminated != tt.terminated {
+			t.Errorf("lane %d stats = %+v", tt.lane, s)
+		}
+	}
+}
@@ -0,0 +1,675 @@
+// Package worker consumes a JetStream durable consumer and dispatches each
+// message to a handler registered for its subject. It is the consuming
+// half of the webhook worker, for binaries that embed their own processing:
+//
+//	w, err := worker.New(worker.Options{
+//	    NATSURL:  os.Getenv("NATS_URL"),
+//	    Stream:   "WEBHOOKS",
+//	    Consumer: "billing-worker",
+//	    Subject:  "billing.>",
+//	})
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer w.Close()
+//
+//	w.RegisterHandler("billing.invoice.*", func(ctx context.Context, msg *nats.Msg) error {
+//	    return sendInvoice(ctx, msg.Data) // nil acks, an error naks
+//	}, worker.AckSync())
+//	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+//	defer stop()
+//	err = w.Run(ctx)
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Handler processes one message. Returning nil acks it and returning an
+// error naks it for redelivery, unless the error is Permanent or the
+// handler settled the message itself (see ErrSettled). ctx carries the
+// values of Run's context and ends after HandlerTimeout, or when shutdown
+// stops waiting for the handler.
+type Handler func(ctx context.Context, msg *nats.Msg) error
+
+// Options configures a Worker
+type Options struct {
+	NATSURL  string
+	User     string // Optional, with Password
+	Password string
+	Name     string // Connection name shown by the NATS server
+
+	// Conn, if set, is used instead of connecting to NATSURL, so several
+	// workers share one connection. Close leaves it open.
+	Conn *nats.Conn
+
+	Stream     string
+	Consumer   string // Durable consumer name
+	QueueGroup string // Workers in the same group share messages; default Consumer
+	Subject    string // Consumer filter; handlers must fall within it or a lane's
+
+	MaxDeliver    int           // Delivery attempts; default 3
+	AckWait       time.Duration // Redelivery timeout; default 30s
+	MaxAckPending int           // Unacknowledged messages per consumer; default the server's
+
+	// Concurrency is how many handlers run at once; default 1
+	Concurrency int
+
+	// Lanes are priority lanes next to the Subject one, each with its own
+	// durable consumer (see Lane). Weight and Fetchers are the Subject
+	// lane's; Weight defaults to 1.
+	Lanes    []Lane
+	Weight   int
+	Fetchers int
+
+	// HandlerTimeout bounds each handler; default a tenth short of AckWait,
+	// so the handler can still settle the message before redelivery. Longer
+	// handlers get InProgress heartbeats to hold off redelivery.
+	HandlerTimeout time.Duration
+
+	// Backoff delays redelivery after an error, indexed by delivery
+	// attempt and repeating the last entry; default none
+	Backoff []time.Duration
+
+	// ShutdownGrace is how long handlers in flight may keep running once
+	// Run's context is done before their contexts are cancelled; default 10s
+	ShutdownGrace time.Duration
+
+	// NATSOptions are passed to nats.Connect after the ones above
+	NATSOptions []nats.Option
+
+	// Logger receives connection and dispatch messages; default log.Default()
+	Logger *log.Logger
+
+	// DropAck, if set, is asked before each ack and skips it by returning
+	// true, so the message is redelivered after AckWait. It is meant for
+	// fault injection.
+	DropAck func(msg *nats.Msg) bool
+
+	// OnSubscribe, if set, is called once Run is receiving messages, and
+	// again after each Resume
+	OnSubscribe func(sub *nats.Subscription)
+
+	// JournalPath, if set, is a file where settlements made while NATS is
+	// disconnected are kept and synced, then sent once it is back. A
+	// message redelivered meanwhile that the journal acked or terminated is
+	// settled without running its handler again. One worker per file.
+	JournalPath string
+
+	// ReplayCounts, if set, is given the Counts of settlements journaled
+	// before the last stop, which that process never reported. They are
+	// kept in the journal until it returns nil.
+	ReplayCounts func(counts Counts) error
+}
+
+// Worker consumes one durable consumer. Create it with New, register
+// handlers, then call Run.
+type Worker struct {
+	opts Options
+	log  *log.Logger
+	nc   *nats.Conn
+	js   nats.JetStreamContext
+
+	ownConn bool // nc was opened by New, so Close closes it
+
+	mu       sync.RWMutex
+	routes   []route
+	lanes    []*lane // the Subject lane first
+	running  bool
+	paused   bool
+	stopping bool // set once Run stops taking messages
+	inFlight sync.WaitGroup
+
+	pickMu sync.Mutex
+	ready  chan struct{} // one token per queued message
+
+	byConsumer map[string]*lane // for counting settled messages per lane
+
+	journal *journal // nil without Options.JournalPath
+
+	// handlerCtx parents every message context; it outlives Run's context
+	// by ShutdownGrace
+	handlerCtx     context.Context
+	cancelHandlers context.CancelFunc
+}
+
+// stopWait bounds the wait for handlers to return once their contexts
+// are cancelled
+const stopWait = 5 * time.Second
+
+type route struct {
+	pattern []string
+	handler Handler
+	ackSync bool
+}
+
+// HandlerOption configures a route in RegisterHandler
+type HandlerOption func(*route)
+
+// AckSync waits for the server to confirm each ack, for handlers whose
+// messages must not be processed twice. An unconfirmed ack is logged; the
+// message may be redelivered.
+func AckSync() HandlerOption {
+	return func(r *route) { r.ackSync = true }
+}
+
+// New connects to NATS. Close releases the connection.
+func New(opts Options) (*Worker, error) {
+	if (opts.NATSURL == "" && opts.Conn == nil) || opts.Stream == "" || opts.Consumer == "" || opts.Subject == "" {
+		return nil, errors.New("worker: NATSURL or Conn, Stream, Consumer, and Subject are required")
+	}
+	if opts.QueueGroup == "" {
+		opts.QueueGroup = opts.Consumer
+	}
+	if opts.MaxDeliver == 0 {
+		opts.MaxDeliver = 3
+	}
+	if opts.AckWait == 0 {
+		opts.AckWait = 30 * time.Second
+	}
+	if opts.HandlerTimeout == 0 {
+		opts.HandlerTimeout = opts.AckWait - opts.AckWait/10
+	}
+	if opts.ShutdownGrace == 0 {
+		opts.ShutdownGrace = 10 * time.Second
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	lanes, err := newLanes(&opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Name == "" {
+		opts.Name = "Rule Engine Worker"
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+
+	nc, ownConn := opts.Conn, false
+	if nc == nil {
+		natsOpts := []nats.Option{nats.Name(opts.Name)}
+		if opts.User != "" && opts.Password != "" {
+			natsOpts = append(natsOpts, nats.UserInfo(opts.User, opts.Password))
+		}
+		natsOpts = append(natsOpts, opts.NATSOptions...)
+
+		if nc, err = nats.Connect(opts.NATSURL, natsOpts...); err != nil {
+			return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		ownConn = true
+		opts.Logger.Printf("✅ Connected to NATS at %s", nc.ConnectedUrl())
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		if ownConn {
+			nc.Close()
+		}
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+	byConsumer := make(map[string]*lane, len(lanes))
+	for _, l := range lanes {
+		byConsumer[l.consumer] = l
+	}
+	var j *journal
+	if opts.JournalPath != "" {
+		if j, err = openJournal(opts.JournalPath); err != nil {
+			if ownConn {
+				nc.Close()
+			}
+			return nil, err
+		}
+		if n := j.pending(); n > 0 {
+			opts.Logger.Printf("📒 %d settlement(s) journaled before the last stop will be sent", n)
+		}
+	}
+	return &Worker{
+		opts:       opts,
+		log:        opts.Logger,
+		nc:         nc,
+		js:         js,
+		ownConn:    ownConn,
+		lanes:      lanes,
+		byConsumer: byConsumer,
+		journal:    j,
+		ready:      make(chan struct{}, opts.Concurrency*len(lanes)),
+	}, nil
+}
+
+// Conn returns the NATS connection, for publishing from handlers
+func (w *Worker) Conn() *nats.Conn {
+	return w.nc
+}
+
+// JetStream returns the JetStream context
+func (w *Worker) JetStream() nats.JetStreamContext {
+	return w.js
+}
+
+// Subscription returns the Subject lane's subscription, or nil outside Run
+// and while paused
+func (w *Worker) Subscription() *nats.Subscription {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.lanes[0].sub
+}
+
+// Subscriptions returns every lane's subscription, or nil outside Run and
+// while paused
+func (w *Worker) Subscriptions() []*nats.Subscription {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.lanes[0].sub == nil {
+		return nil
+	}
+	subs := make([]*nats.Subscription, len(w.lanes))
+	for i, l := range w.lanes {
+		subs[i] = l.sub
+	}
+	return subs
+}
+
+// RegisterHandler routes messages whose subject matches subjectPattern to
+// handler. Patterns use NATS wildcards ("*" for one token, ">" for the
+// rest); a message goes to the first registered pattern it matches, and
+// messages matching none are terminated. Handlers can be registered while
+// the worker runs.
+func (w *Worker) RegisterHandler(subjectPattern string, handler Handler, opts ...HandlerOption) error {
+	pattern := strings.Split(subjectPattern, ".")
+	for i, token := range pattern {
+		if token == "" || (token == ">" && i != len(pattern)-1) {
+			return fmt.Errorf("worker: invalid subject pattern %q", subjectPattern)
+		}
+	}
+	if handler == nil {
+		return errors.New("worker: nil handler")
+	}
+	r := route{pattern: pattern, handler: handler}
+	for _, opt := range opts {
+		opt(&r)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.routes = append(w.routes, r)
+	return nil
+}
+
+// Run creates the durable consumers if needed, subscribes, and dispatches
+// messages until ctx is done. It then stops taking messages, gives
+// handlers in flight ShutdownGrace to finish, and cancels their contexts
+// before returning.
+func (w *Worker) Run(ctx context.Context) error {
+	w.mu.Lock()
+	if w.running {
+		w.mu.Unlock()
+		return errors.New("worker: already running")
+	}
+	w.running = true
+	w.handlerCtx, w.cancelHandlers = context.WithCancel(context.WithoutCancel(ctx))
+	w.mu.Unlock()
+	defer w.cancelHandlers()
+	defer func() {
+		w.mu.Lock()
+		w.running, w.paused, w.stopping = false, false, false
+		for _, l := range w.lanes {
+			l.sub = nil
+		}
+		w.mu.Unlock()
+	}()
+
+	if _, err := w.js.StreamInfo(w.opts.Stream); err != nil {
+		w.log.Printf("⚠️  Stream '%s' not found - will be created by first publish", w.opts.Stream)
+	} else {
+		w.log.Printf("✅ Stream '%s' found", w.opts.Stream)
+	}
+
+	for _, l := range w.lanes {
+		// Created here rather than by QueueSubscribe, which would delete
+		// it again on Pause. Pull lanes' consumers have no deliver subject.
+		cfg := &nats.ConsumerConfig{
+			Durable:       l.consumer,
+			AckPolicy:     nats.AckExplicitPolicy,
+			FilterSubject: l.Subject,
+			MaxDeliver:    w.opts.MaxDeliver,
+			AckWait:       w.opts.AckWait,
+			MaxAckPending: w.opts.MaxAckPending,
+		}
+		if l.Fetchers == 0 {
+			cfg.DeliverSubject, cfg.DeliverGroup = nats.NewInbox(), w.opts.QueueGroup
+		}
+		_, err := w.js.AddConsumer(w.opts.Stream, cfg)
+		if err != nil {
+			// Consumer might already exist
+			w.log.Printf("⚠️  Consumer may already exist: %v", err)
+		}
+		w.log.Printf("✅ Consumer '%s' ready", l.consumer)
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	for i := 0; i < w.opts.Concurrency; i++ {
+		go w.serve(quit)
+	}
+	if w.journal != nil {
+		go w.replayJournal(quit)
+	}
+
+	for _, l := range w.lanes {
+		if l.Fetchers > 0 {
+			w.log.Printf("📥 Fetching messages on '%s' with %d fetcher(s)...", l.Subject, l.Fetchers)
+		} else {
+			w.log.Printf("📥 Listening for messages on '%s'...", l.Subject)
+		}
+	}
+	w.mu.Lock()
+	err := w.subscribe()
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+
+	w.mu.Lock()
+	w.stopping = true
+	w.unsubscribe()
+	w.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		w.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(w.opts.ShutdownGrace):
+	}
+
+	w.log.Printf("⚠️  Handlers still running after %s, cancelling them", w.opts.ShutdownGrace)
+	w.cancelHandlers()
+	select {
+	case <-done:
+	case <-time.After(stopWait):
+		w.log.Printf("⚠️  Handlers ignored cancellation; their messages will be redelivered")
+	}
+	return nil
+}
+
+// subscribe binds to every lane's durable consumer, or to none, and
+// starts pull lanes' fetchers. The caller holds w.mu.
+func (w *Worker) subscribe() error {
+	for _, l := range w.lanes {
+		var sub *nats.Subscription
+		var err error
+		if l.Fetchers > 0 {
+			sub, err = w.js.PullSubscribe(l.Subject, l.consumer, nats.Bind(w.opts.Stream, l.consumer))
+		} else {
+			sub, err = w.js.QueueSubscribe(
+				l.Subject,
+				w.opts.QueueGroup,
+				w.enqueue(l),
+				nats.Durable(l.consumer),
+				nats.ManualAck(),
+				nats.MaxDeliver(w.opts.MaxDeliver),
+				nats.AckWait(w.opts.AckWait),
+			)
+		}
+		if err != nil {
+			w.unsubscribe()
+			return fmt.Errorf("failed to subscribe to %s: %w", l.Subject, err)
+		}
+		l.sub = sub
+	}
+	for _, l := range w.lanes {
+		for i := 0; i < l.Fetchers; i++ {
+			go w.fetch(l, l.sub)
+		}
+	}
+	if w.opts.OnSubscribe != nil {
+		for _, l := range w.lanes {
+			w.opts.OnSubscribe(l.sub)
+		}
+	}
+	return nil
+}
+
+// unsubscribe stops every lane's subscription. The caller holds w.mu.
+func (w *Worker) unsubscribe() error {
+	var firstErr error
+	for _, l := range w.lanes {
+		if l.sub == nil {
+			continue
+		}
+		if err := l.sub.Unsubscribe(); err != nil {
+			w.log.Printf("⚠️  Failed to unsubscribe from %s: %v", l.Subject, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		l.sub = nil
+	}
+	return firstErr
+}
+
+// Pause stops receiving messages until Resume. The durable consumers keep
+// their position and unacknowledged messages, and handlers in flight finish
+// normally. Once every worker in the queue group pauses, the server holds
+// messages back.
+func (w *Worker) Pause() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.lanes[0].sub == nil || w.stopping {
+		return nil
+	}
+	if err := w.unsubscribe(); err != nil {
+		return fmt.Errorf("failed to unsubscribe: %w", err)
+	}
+	w.paused = true
+	return nil
+}
+
+// Resume receives messages again after Pause
+func (w *Worker) Resume() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.paused || w.stopping {
+		return nil
+	}
+	if err := w.subscribe(); err != nil {
+		return err
+	}
+	w.paused = false
+	return nil
+}
+
+// Paused reports whether the worker is paused
+func (w *Worker) Paused() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.paused
+}
+
+// Close closes the NATS connection, unless it was passed in Options.Conn,
+// and the journal
+func (w *Worker) Close() {
+	if w.journal != nil {
+		if w.connected() {
+			// Settlements of handlers that finished during shutdown
+			w.journal.replay(w.nc)
+		}
+		if n := w.journal.pending(); n > 0 {
+			w.log.Printf("📒 %d settlement(s) kept in the journal for the next start", n)
+		}
+		w.journal.close()
+	}
+	if w.ownConn {
+		w.nc.Close()
+	}
+}
+
+// dispatch runs the handler for msg and settles it by the result
+func (w *Worker) dispatch(msg *nats.Msg) {
+	defer w.inFlight.Done()
+	w.mu.RLock()
+	if w.stopping {
+		// Left unacked, so another worker gets it after AckWait
+		w.mu.RUnlock()
+		return
+	}
+	r := w.routeFor(msg.Subject)
+	parent := w.handlerCtx
+	w.mu.RUnlock()
+
+	if w.journal != nil && w.settleFromJournal(msg) {
+		return
+	}
+	if r == nil {
+		w.log.Printf("⚠️  No handler for %s, terminating message", msg.Subject)
+		msg.Term()
+		w.count(msg, func(s *laneStats) { s.terminated.Add(1) })
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(parent, w.opts.HandlerTimeout)
+	defer cancel()
+	if w.opts.HandlerTimeout > w.opts.AckWait-w.opts.AckWait/10 {
+		go w.heartbeat(ctx, msg)
+	}
+	err := r.handler(ctx, msg)
+	cancel()
+	if !errors.Is(err, ErrSettled) {
+		w.settle(msg, err, r.ackSync, nil)
+	}
+}
+
+// heartbeat resets the message's AckWait until ctx ends, for handlers
+// allowed to run longer than AckWait
+func (w *Worker) heartbeat(ctx context.Context, msg *nats.Msg) {
+	ticker := time.NewTicker(w.opts.AckWait / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := msg.InProgress(); err != nil {
+				w.log.Printf("⚠️  Failed to extend %s: %v", msg.Subject, err)
+			}
+		}
+	}
+}
+
+// Settle settles msg as the worker would for a handler returning err. A
+// handler that returns ErrSettled and finishes later calls it when done.
+func (w *Worker) Settle(msg *nats.Msg, err error) {
+	w.SettleCounted(msg, err, nil)
+}
+
+// SettleCounted is Settle for a handler that kept statistics for msg. A
+// settlement journaled while NATS is unavailable keeps counts with it, for
+// Options.ReplayCounts should the worker stop before it is sent.
+func (w *Worker) SettleCounted(msg *nats.Msg, err error, counts Counts) {
+	w.mu.RLock()
+	r := w.routeFor(msg.Subject)
+	w.mu.RUnlock()
+	w.settle(msg, err, r != nil && r.ackSync, counts)
+}
+
+// settle acks msg on success, terminates it after a Permanent error, and
+// otherwise naks it, delayed by RetryAfter or Options.Backoff. With a
+// journal, a settlement NATS cannot take is journaled instead.
+func (w *Worker) settle(msg *nats.Msg, err error, ackSync bool, counts Counts) {
+	if err == nil && w.opts.DropAck != nil && w.opts.DropAck(msg) {
+		return
+	}
+	if w.journal != nil && w.journalSettle(msg, err, counts, nil) {
+		w.countSettled(msg, err)
+		return
+	}
+
+	var retry *retryAfterError
+	var sendErr error
+	switch {
+	case err == nil && ackSync:
+		if sendErr = msg.AckSync(); sendErr != nil {
+			w.log.Printf("⚠️  Ack for %s not confirmed: %v", msg.Subject, sendErr)
+		}
+	case err == nil:
+		sendErr = msg.Ack()
+	case IsPermanent(err):
+		sendErr = msg.Term()
+	case errors.As(err, &retry):
+		sendErr = msg.NakWithDelay(retry.After)
+	default:
+		if delay := w.backoff(msg); delay > 0 {
+			sendErr = msg.NakWithDelay(delay)
+		} else {
+			sendErr = msg.Nak()
+		}
+	}
+	if sendErr != nil && w.journal != nil {
+		w.journalSettle(msg, err, counts, sendErr)
+	}
+	w.countSettled(msg, err)
+}
+
+// countSettled counts msg as settled by settle for err
+func (w *Worker) countSettled(msg *nats.Msg, err error) {
+	switch {
+	case err == nil:
+		w.count(msg, func(s *laneStats) { s.acked.Add(1) })
+	case IsPermanent(err):
+		w.count(msg, func(s *laneStats) { s.terminated.Add(1) })
+	default:
+		w.count(msg, func(s *laneStats) { s.naked.Add(1) })
+	}
+}
+
+// backoff is the Options.Backoff delay for msg's delivery attempt
+func (w *Worker) backoff(msg *nats.Msg) time.Duration {
+	if len(w.opts.Backoff) == 0 {
+		return 0
+	}
+	attempt := 1
+	if meta, err := msg.Metadata(); err == nil {
+		attempt = int(meta.NumDelivered)
+	}
+	if attempt > len(w.opts.Backoff) {
+		attempt = len(w.opts.Backoff)
+	}
+	return w.opts.Backoff[attempt-1]
+}
+
+// routeFor returns the first route whose pattern matches subject. The
+// caller holds w.mu.
+func (w *Worker) routeFor(subject string) *route {
+	tokens := strings.Split(subject, ".")
+	for i := range w.routes {
+		if subjectMatches(w.routes[i].pattern, tokens) {
+			return &w.routes[i]
+		}
+	}
+	return nil
+}
+
+// subjectMatches applies NATS wildcard rules to a tokenized subject
+func subjectMatches(pattern, subject []string) bool {
+	for i, token := range pattern {
+		if token == ">" {
+			return len(subject) > i
+		}
+		if i >= len(subject) || (token != "*" && token != subject[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(subject)
+}
@@ -0,0 +1,505 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/rule-engine/nats-webhook-worker/internal/natstest"
+)
+
+// newTestServer starts a fake NATS server with a RULES stream on rules.>
+func newTestServer(t *testing.T) *natstest.Server {
+	t.Helper()
+	srv := natstest.NewServer(t)
+	srv.AddStream("RULES", "rules.>")
+	return srv
+}
+
+// newTestWorker creates a worker for the RULES stream, filling in what
+// opts leaves out
+func newTestWorker(t *testing.T, srv *natstest.Server, opts Options) *Worker {
+	t.Helper()
+	if opts.NATSURL == "" && opts.Conn == nil {
+		opts.NATSURL = srv.URL()
+	}
+	if opts.Stream == "" {
+		opts.Stream = "RULES"
+	}
+	if opts.Consumer == "" {
+		opts.Consumer = "webhooks"
+	}
+	if opts.Subject == "" {
+		opts.Subject = "rules.>"
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+	opts.NATSOptions = append(opts.NATSOptions, nats.ReconnectWait(10*time.Millisecond), nats.MaxReconnects(-1))
+	w, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.Close)
+	return w
+}
+
+// runWorker runs w until the test ends or the returned stop is called,
+// and waits for it to subscribe
+func runWorker(t *testing.T, w *Worker) (stop func() error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+
+	var once sync.Once
+	var err error
+	stop = func() error {
+		once.Do(func() {
+			cancel()
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Second):
+				err = errors.New("Run did not return")
+			}
+		})
+		return err
+	}
+	t.Cleanup(func() { stop() })
+	waitFor(t, "subscription", func() bool { return len(w.Subscriptions()) > 0 })
+	return stop
+}
+
+// waitFor polls cond until it holds or five seconds pass
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewValidatesOptions(t *testing.T) {
+	srv := newTestServer(t)
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr string
+	}{
+		{name: "no server", opts: Options{Stream: "RULES", Consumer: "w", Subject: "rules.>"}, wantErr: "NATSURL or Conn"},
+		{name: "no stream", opts: Options{NATSURL: srv.URL(), Consumer: "w", Subject: "rules.>"}, wantErr: "Stream"},
+		{name: "no consumer", opts: Options{NATSURL: srv.URL(), Stream: "RULES", Subject: "rules.>"}, wantErr: "Consumer"},
+		{name: "no subject", opts: Options{NATSURL: srv.URL(), Stream: "RULES", Consumer: "w"}, wantErr: "Subject"},
+		{name: "unreachable", opts: Options{NATSURL: "nats://127.0.0.1:1", Stream: "RULES", Consumer: "w", Subject: "rules.>"},
+			wantErr: "failed to connect to NATS"},
+		{name: "unnamed lane", opts: Options{NATSURL: srv.URL(), Stream: "RULES", Consumer: "w", Subject: "rules.>",
+			Lanes: []Lane{{Subject: "urgent.>"}}}, wantErr: "lanes need a Name and a Subject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Logger = log.New(io.Discard, "", 0)
+			w, err := New(tt.opts)
+			if err == nil {
+				w.Close()
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	srv := newTestServer(t)
+	w := newTestWorker(t, srv, Options{AckWait: 10 * time.Second})
+	if w.opts.QueueGroup != "webhooks" || w.opts.MaxDeliver != 3 || w.opts.Concurrency != 1 ||
+		w.opts.HandlerTimeout != 9*time.Second || w.opts.ShutdownGrace != 10*time.Second {
+		t.Fatalf("opts = %+v", w.opts)
+	}
+	if w.Conn() == nil || !w.Conn().IsConnected() || w.JetStream() == nil {
+		t.Fatal("not connected")
+	}
+	if w.Subscription() != nil || w.Subscriptions() != nil {
+		t.Fatal("subscribed before Run")
+	}
+}
+
+func TestSharedConnectionStaysOpen(t *testing.T) {
+	srv := newTestServer(t)
+	nc, err := nats.Connect(srv.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	w, err := New(Options{Conn: nc, Stream: "RULES", Consumer: "w", Subject: "rules.>", Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if nc.IsClosed() {
+		t.Fatal("Close closed a connection it did not open")
+	}
+}
+
+func TestWorkersShareConnection(t *testing.T) {
+	srv := newTestServer(t)
+	srv.AddStream("BILLING", "billing.>")
+	nc, err := nats.Connect(srv.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	rules := newTestWorker(t, srv, Options{Conn: nc, Fetchers: 1})
+	billing := newTestWorker(t, srv, Options{Conn: nc, Stream: "BILLING", Consumer: "billing", Subject: "billing.>"})
+	if rules.Conn() != nc || billing.Conn() != nc {
+		t.Fatal("workers opened their own connections")
+	}
+
+	var mu sync.Mutex
+	var handled []string
+	handler := func(_ context.Context, msg *nats.Msg) error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, msg.Subject)
+		return nil
+	}
+	rules.RegisterHandler("rules.>", handler)
+	billing.RegisterHandler("billing.>", handler)
+	srv.Publish("rules.orders", nil, []byte("1"))
+	srv.Publish("billing.invoices", nil, []byte("2"))
+	stopRules := runWorker(t, rules)
+	runWorker(t, billing)
+	srv.WaitForAcks(2)
+
+	// One worker stopping leaves the other its connection
+	if err := stopRules(); err != nil {
+		t.Fatal(err)
+	}
+	rules.Close()
+	srv.Publish("billing.invoices", nil, []byte("3"))
+	srv.WaitForAcks(3)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(handled) != 3 || !nc.IsConnected() {
+		t.Fatalf("handled %v, connected %v", handled, nc.IsConnected())
+	}
+}
+
+func TestRegisterHandlerValidation(t *testing.T) {
+	w := &Worker{}
+	noop := func(context.Context, *nats.Msg) error { return nil }
+	tests := []struct {
+		pattern string
+		handler Handler
+		wantErr bool
+	}{
+		{"rules.orders", noop, false},
+		{"rules.*.created", noop, false},
+		{"rules.>", noop, false},
+		{">", noop, false},
+		{"rules..orders", noop, true},
+		{"", noop, true},
+		{"rules.>.created", noop, true},
+		{"rules.orders.", noop, true},
+		{"rules.orders", nil, true},
+	}
+	for _, tt := range tests {
+		if err := w.RegisterHandler(tt.pattern, tt.handler); (err != nil) != tt.wantErr {
+			t.Errorf("RegisterHandler(%q) err = %v, want error %v", tt.pattern, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSubjectMatches(t *testing.T) {
+	tests := []struct {
+		pattern, subject string
+		want             bool
+	}{
+		{"rules.orders", "rules.orders", true},
+		{"rules.orders", "rules.invoices", false},
+		{"rules.orders", "rules.orders.created", false},
+		{"rules.*", "rules.orders", true},
+		{"rules.*", "rules.orders.created", false},
+		{"rules.*.created", "rules.orders.created", true},
+		{"rules.*.created", "rules.orders.updated", false},
+		{"rules.>", "rules.orders", true},
+		{"rules.>", "rules.orders.created.v2", true},
+		{"rules.>", "rules", false},
+		{">", "anything.at.all", true},
+		{"*", "rules", true},
+		{"*", "rules.orders", false},
+	}
+	for _, tt := range tests {
+		if got := subjectMatches(strings.Split(tt.pattern, "."), strings.Split(tt.subject, ".")); got != tt.want {
+			t.Errorf("subjectMatches(%s, %s) = %v, want %v", tt.pattern, tt.subject, got, tt.want)
+		}
+	}
+}
+
+func TestRouteForFirstMatchWins(t *testing.T) {
+	w := &Worker{}
+	var got []string
+	handler := func(name string) Handler {
+		return func(context.Context, *nats.Msg) error {
+			got = append(got, name)
+			return nil
+		}
+	}
+	w.RegisterHandler("rules.orders.created", handler("exact"))
+	w.RegisterHandler("rules.orders.*", handler("orders"), AckSync())
+	w.RegisterHandler("rules.>", handler("catch-all"))
+
+	tests := []struct {
+		subject string
+		want    string
+		ackSync bool
+	}{
+		{"rules.orders.created", "exact", false},
+		{"rules.orders.updated", "orders", true},
+		{"rules.invoices.created", "catch-all", false},
+		{"other.orders", "", false},
+	}
+	for _, tt := range tests {
+		got = nil
+		r := w.routeFor(tt.subject)
+		if tt.want == "" {
+			if r != nil {
+				t.Errorf("%s matched a route", tt.subject)
+			}
+			continue
+		}
+		r.handler(context.Background(), nil)
+		if len(got) != 1 || got[0] != tt.want || r.ackSync != tt.ackSync {
+			t.Errorf("%s went to %v (ackSync %v), want %s", tt.subject, got, r.ackSync, tt.want)
+		}
+	}
+}
+
+func TestRunDispatchesBySubject(t *testing.T) {
+	srv := newTestServer(t)
+	w := newTestWorker(t, srv, Options{Concurrency: 2, MaxDeliver: 5, AckWait: time.Minute})
+
+	var mu sync.Mutex
+	handled := map[string][]string{}
+	record := func(name string) Handler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			mu.Lock()
+			defer mu.Unlock()
+			handled[name] = append(handled[name], string(msg.Data))
+			return nil
+		}
+	}
+	w.RegisterHandler("rules.orders.*", record("orders"))
+	w.RegisterHandler("rules.invoices.>", record("invoices"))
+	stop := runWorker(t, w)
+
+	cfg, ok := srv.Consumer("RULES", "webhooks")
+	if !ok || cfg.FilterSubject != "rules.>" || cfg.DeliverGroup != "webhooks" || cfg.MaxDeliver != 5 ||
+		cfg.AckWait != time.Minute || cfg.AckPolicy != nats.AckExplicitPolicy {
+		t.Fatalf("consumer = %+v, %v", cfg, ok)
+	}
+
+	srv.Publish("rules.orders.created", nil, []byte("o1"))
+	srv.Publish("rules.invoices.paid.eu", nil, []byte("i1"))
+	srv.Publish("rules.refunds.created", nil, []byte("r1")) // no handler
+	acks := srv.WaitForAcks(3)
+
+	kinds := map[uint64]string{}
+	for _, a := range acks {
+		kinds[a.Sequence] = a.Kind
+	}
+	if kinds[1] != "+ACK" || kinds[2] != "+ACK" || kinds[3] != "+TERM" {
+		t.Fatalf("acks = %+v", acks)
+	}
+	mu.Lock()
+	if len(handled["orders"]) != 1 || len(handled["invoices"]) != 1 {
+		t.Fatalf("handled = %v", handled)
+	}
+	mu.Unlock()
+
+	stats := w.SubscriptionStats()
+	if len(stats) != 1 || stats[0].Received != 3 || stats[0].Acked != 2 || stats[0].Terminated != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	// Handlers registered while running are used for the next message
+	w.RegisterHandler("rules.refunds.*", record("refunds"))
+	srv.Publish("rules.refunds.created", nil, []byte("r2"))
+	srv.WaitForAcks(4)
+	mu.Lock()
+	if len(handled["refunds"]) != 1 {
+		t.Fatalf("handled = %v", handled)
+	}
+	mu.Unlock()
+
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Subscription() != nil {
+		t.Fatal("still subscribed after Run")
+	}
+}
+
+func TestRunTwice(t *testing.T) {
+	srv := newTestServer(t)
+	w := newTestWorker(t, srv, Options{})
+	runWorker(t, w)
+	if err := w.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Fatalf("second Run: %v", err)
+	}
+}
+
+func TestSettleAckPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		ackSync bool
+		err     error
+		want    natstest.Ack // Kind "" means no ack is sent
+	}{
+		{name: "success acks", want: natstest.Ack{Kind: "+ACK"}},
+		{name: "ack sync route", ackSync: true, want: natstest.Ack{Kind: "+ACK", Sync: true}},
+		{name: "permanent terminates", err: Permanent(errors.New("bad payload")), want: natstest.Ack{Kind: "+TERM"}},
+		{name: "wrapped permanent terminates", err: fmt.Errorf("action: %w", Permanent(errors.New("404"))), want: natstest.Ack{Kind: "+TERM"}},
+		{name: "error naks", err: errors.New("timeout"), want: natstest.Ack{Kind: "-NAK"}},
+		{name: "error naks with backoff", opts: Options{Backoff: []time.Duration{time.Second, 5 * time.Second}},
+			err: errors.New("timeout"), want: natstest.Ack{Kind: "-NAK", Delay: time.Second}},
+		{name: "retry after beats backoff", opts: Options{Backoff: []time.Duration{time.Second}},
+			err: RetryAfter(errors.New("429"), 7*time.Second), want: natstest.Ack{Kind: "-NAK", Delay: 7 * time.Second}},
+		{name: "dropped ack", opts: Options{DropAck: func(*nats.Msg) bool { return true }}},
+		{name: "drop ack ignores failures", opts: Options{DropAck: func(*nats.Msg) bool { return true }},
+			err: errors.New("timeout"), want: natstest.Ack{Kind: "-NAK"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			tt.opts.MaxDeliver, tt.opts.AckWait = 1, time.Minute
+			w := newTestWorker(t, srv, tt.opts)
+			handled := make(chan struct{}, 1)
+			var opts []HandlerOption
+			if tt.ackSync {
+				opts = append(opts, AckSync())
+			}
+			w.RegisterHandler("rules.>", func(context.Context, *nats.Msg) error {
+				handled <- struct{}{}
+				return tt.err
+			}, opts...)
+			runWorker(t, w)
+
+			srv.Publish("rules.orders", nil, []byte("1"))
+			<-handled
+			if tt.want.Kind == "" {
+				time.Sleep(100 * time.Millisecond)
+				if acks := srv.Acks(); len(acks) != 0 {
+					t.Fatalf("acks = %+v, want none", acks)
+				}
+				return
+			}
+			got := srv.WaitForAcks(1)[0]
+			if got.Kind != tt.want.Kind || got.Delay != tt.want.Delay || got.Sync != tt.want.Sync {
+				t.Fatalf("ack = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSettleLater(t *testing.T) {
+	srv := newTestServer(t)
+	w := newTestWorker(t, srv, Options{AckWait: time.Minute})
+	later := make(chan *nats.Msg, 1)
+	w.RegisterHandler("rules.>", func(_ context.Context, msg *nats.Msg) error {
+		later <- msg
+		return ErrSettled
+	}, AckSync())
+	runWorker(t, w)
+
+	srv.Publish("rules.orders", nil, []byte("1"))
+	msg := <-later
+	time.Sleep(50 * time.Millisecond)
+	if acks := srv.Acks(); len(acks) != 0 {
+		t.Fatalf("worker settled a message the handler kept: %+v", acks)
+	}
+	w.Settle(msg, nil)
+	if a := srv.WaitForAcks(1)[0]; a.Kind != "+ACK" || !a.Sync {
+		t.Fatalf("ack = %+v, want the route's AckSync", a)
+	}
+	if stats := w.SubscriptionStats(); stats[0].Acked != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestBackoffByDelivery(t *testing.T) {
+	w := &Worker{opts: Options{Backoff: []time.Duration{time.Second, 10 * time.Second, time.Minute}}}
+	tests := []struct {
+		reply string
+		want  time.Duration
+	}{
+		{"$JS.ACK.RULES.webhooks.1.5.5.1700000000000000000.0", time.Second},
+		{"$JS.ACK.RULES.webhooks.2.5.6.1700000000000000000.0", 10 * time.Second},
+		{"$JS.ACK.RULES.webhooks.3.5.7.1700000000000000000.0", time.Minute},
+		{"$JS.ACK.RULES.webhooks.9.5.8.1700000000000000000.0", time.Minute},
+		{"_INBOX.not-jetstream", time.Second},
+	}
+	for _, tt := range tests {
+		if got := w.backoff(&nats.Msg{Reply: tt.reply, Sub: &nats.Subscription{}}); got != tt.want {
+			t.Errorf("backoff(%s) = %s, want %s", tt.reply, got, tt.want)
+		}
+	}
+	if got := (&Worker{}).backoff(&nats.Msg{Reply: tests[0].reply}); got != 0 {
+		t.Errorf("backoff without Options.Backoff = %s", got)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	srv := newTestServer(t)
+	w := newTestWorker(t, srv, Options{AckWait: time.Minute})
+	handled := make(chan string, 10)
+	w.RegisterHandler("rules.>", func(_ context.Context, msg *nats.Msg) error {
+		handled <- string(msg.Data)
+		return nil
+	})
+	if err := w.Pause(); err != nil || w.Paused() {
+		t.Fatalf("Pause before Run = %v, paused %v", err, w.Paused())
+	}
+	runWorker(t, w)
+
+	if err := w.Pause(); err != nil || !w.Paused() || len(w.Subscriptions()) != 0 {
+		t.Fatalf("Pause = %v, paused %v, subscriptions %d", err, w.Paused(), len(w.Subscriptions()))
+	}
+	if _, ok := srv.Consumer("RULES", "webhooks"); !ok {
+		t.Fatal("Pause deleted the durable consumer")
+	}
+	w.Conn().Flush() // the server has seen the unsubscribe
+	srv.Publish("rules.orders", nil, []byte("held"))
+	select {
+	case got := <-handled:
+		t.Fatalf("handled %s while paused", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := w.Resume(); err != nil || w.Paused() || len(w.Subscriptions()) == 0 {
+		t.Fatalf("Resume = %v, paused %v", err, w.Paused())
+	}
+	select {
+	case got := <-handled:
+		if got != "held" {
+			t.Fatalf("handled %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("held message not delivered after Resume")
+	}
+	if err := w.Resume(); err != nil {
+		t.Fatalf("second Resume: %v", err)
+	}
+}